@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"context"
+	"time"
+)
+
+// AccountStatus describes restrictions on an account beyond its
+// credentials. The zero value is an account in good standing.
+type AccountStatus struct {
+	// Disabled accounts are switched off: logins are refused, and daemons
+	// should refuse mail for them too.
+	Disabled bool
+
+	// Locked accounts refuse logins but keep receiving mail, e.g. while
+	// credentials are reset after a compromise.
+	Locked bool
+
+	// NoLogin accounts receive mail but never log in, such as role or
+	// archive mailboxes.
+	NoLogin bool
+
+	// Deleted is when the account was deleted with a grace period (see
+	// passwd.SoftDeleteUser); zero means it is not deleted. Deleted
+	// accounts refuse logins at once, but mail for them should still be
+	// accepted, into quarantine, until the account is purged.
+	Deleted time.Time
+
+	// Services is the set of services the account may log in to; the
+	// zero set places no restriction.
+	Services ServiceSet
+}
+
+// CanLogin reports whether the account may log in.
+func (s AccountStatus) CanLogin() bool {
+	return !s.Disabled && !s.Locked && !s.NoLogin && s.Deleted.IsZero()
+}
+
+// Quarantined reports whether mail for the account should be held in
+// quarantine rather than delivered, because the account is deleted and
+// awaiting purge.
+func (s AccountStatus) Quarantined() bool {
+	return !s.Deleted.IsZero()
+}
+
+// AcceptsMail reports whether mail for the account should be delivered.
+func (s AccountStatus) AcceptsMail() bool {
+	return !s.Disabled
+}
+
+// AccountStatusProvider is implemented by agents that store account
+// restrictions. Agents implementing it refuse logins to restricted accounts
+// with errors.ErrAccountDisabled from Authenticate; delivery daemons ask
+// AccountStatus to decide whether to accept mail.
+type AccountStatusProvider interface {
+	// AccountStatus returns username's restrictions. Returns
+	// errors.ErrUserNotFound if the user does not exist.
+	AccountStatus(ctx context.Context, username string) (AccountStatus, error)
+}
+
+// AsAccountStatusProvider returns agent as an AccountStatusProvider if it
+// supports one according to Capabilities.
+func AsAccountStatusProvider(agent AuthenticationAgent) (AccountStatusProvider, bool) {
+	if sp, ok := agent.(AccountStatusProvider); ok && Capabilities(agent).AccountStatus {
+		return sp, true
+	}
+	return nil, false
+}
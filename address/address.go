@@ -0,0 +1,263 @@
+// Package address parses mail addresses for the auth layer, so the router,
+// forwards and delivery all read an address the same way.
+//
+// Split and SplitExtension are the fast paths used on every login and
+// delivery: they take an address already in plain localpart@domain form.
+// Parse accepts an address as written by people and other software:
+//
+//	Alice <alice+news@Bücher.example>
+//	"john smith"@example.com
+//	alice(work)@example.com
+//
+// and returns its localpart and canonical domain. Domains are canonical
+// when lowercased and in ASCII form, with internationalized labels
+// punycode-encoded (see Domain). Localpart rewriting is a per-domain
+// choice, expressed as a Policy.
+package address
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Length limits of RFC 5321.
+const (
+	MaxLocalLength  = 64
+	MaxDomainLength = 255
+)
+
+// ErrInvalid is wrapped by the errors of Parse and Domain.
+var ErrInvalid = errors.New("invalid address")
+
+// Split splits "user@domain" into localpart and domain at the last '@'.
+// Without an '@' it returns s and an empty domain. Neither part is
+// validated or rewritten.
+func Split(s string) (local, domain string) {
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// SplitExtension splits a localpart on the first '+' into its base and
+// subaddress extension:
+//
+//	"user+folder" → ("user", "folder")
+//	"user"        → ("user", "")
+//	"user+"       → ("user", "")
+//	"user+a+b"    → ("user", "a+b")
+func SplitExtension(local string) (base, extension string) {
+	if b, ext, ok := strings.Cut(local, "+"); ok {
+		return b, ext
+	}
+	return local, ""
+}
+
+// Address is a parsed mail address.
+type Address struct {
+	// Local is the localpart, unquoted: `"john smith"@example.com` has
+	// Local "john smith". Its case is kept.
+	Local string
+
+	// Domain is the canonical domain (see Domain), or an address literal
+	// such as "[192.0.2.1]" as written.
+	Domain string
+}
+
+// String returns a in localpart@domain form, quoting the localpart when
+// it is not a dot-atom.
+func (a Address) String() string {
+	if isDotAtom(a.Local) {
+		return a.Local + "@" + a.Domain
+	}
+	return quote(a.Local) + "@" + a.Domain
+}
+
+// Base returns the localpart without its subaddress extension.
+func (a Address) Base() string {
+	base, _ := SplitExtension(a.Local)
+	return base
+}
+
+// Extension returns the localpart's subaddress extension, empty if none.
+func (a Address) Extension() string {
+	_, ext := SplitExtension(a.Local)
+	return ext
+}
+
+// Parse parses a single address: a bare addr-spec or one in angle
+// brackets after a display name, with RFC 5322 comments, a quoted or
+// UTF-8 (RFC 6531) localpart, and an internationalized domain. The
+// display name and comments are dropped and the domain made canonical.
+func Parse(s string) (Address, error) {
+	spec, err := addrSpec(s)
+	if err != nil {
+		return Address{}, err
+	}
+	i := strings.LastIndex(spec, "@")
+	if i < 0 {
+		return Address{}, fmt.Errorf("%w: %q has no domain", ErrInvalid, s)
+	}
+	rawLocal, rawDomain := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+
+	local, err := parseLocal(rawLocal)
+	if err != nil {
+		return Address{}, fmt.Errorf("%w: %q: %v", ErrInvalid, s, err)
+	}
+	var domain string
+	if strings.HasPrefix(rawDomain, "[") {
+		if !strings.HasSuffix(rawDomain, "]") || strings.ContainsAny(rawDomain[1:len(rawDomain)-1], "[]\\ ") {
+			return Address{}, fmt.Errorf("%w: %q: malformed address literal", ErrInvalid, s)
+		}
+		domain = rawDomain
+	} else if domain, err = Domain(rawDomain); err != nil {
+		return Address{}, err
+	}
+	return Address{Local: local, Domain: domain}, nil
+}
+
+// addrSpec strips comments and any display name from s, returning the
+// addr-spec.
+func addrSpec(s string) (string, error) {
+	var b strings.Builder
+	depth, quoted, escaped := 0, false, false
+	for _, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && (quoted || depth > 0):
+			escaped = true
+		case depth > 0:
+			switch r {
+			case '(':
+				depth++
+			case ')':
+				depth--
+			}
+			continue
+		case r == '"':
+			quoted = !quoted
+		case r == '(' && !quoted:
+			depth++
+			continue
+		case r == ')' && !quoted:
+			return "", fmt.Errorf("%w: %q: unbalanced parenthesis", ErrInvalid, s)
+		}
+		b.WriteRune(r)
+	}
+	if depth > 0 || quoted || escaped {
+		return "", fmt.Errorf("%w: %q: unterminated quote or comment", ErrInvalid, s)
+	}
+	spec := strings.TrimSpace(b.String())
+
+	// name-addr: the addr-spec is in the last angle brackets outside quotes.
+	if strings.HasSuffix(spec, ">") {
+		open, quoted := -1, false
+		for i := 0; i < len(spec); i++ {
+			switch spec[i] {
+			case '\\':
+				if quoted {
+					i++
+				}
+			case '"':
+				quoted = !quoted
+			case '<':
+				if !quoted {
+					open = i
+				}
+			}
+		}
+		if open < 0 {
+			return "", fmt.Errorf("%w: %q: unbalanced angle bracket", ErrInvalid, s)
+		}
+		spec = strings.TrimSpace(spec[open+1 : len(spec)-1])
+	}
+	if spec == "" {
+		return "", fmt.Errorf("%w: empty address", ErrInvalid)
+	}
+	return spec, nil
+}
+
+// parseLocal validates a localpart as written and returns it unquoted.
+func parseLocal(s string) (string, error) {
+	if s == "" {
+		return "", errors.New("empty localpart")
+	}
+	local := s
+	if strings.HasPrefix(s, `"`) {
+		if len(s) < 2 || !strings.HasSuffix(s, `"`) {
+			return "", errors.New("unterminated quoted localpart")
+		}
+		var b strings.Builder
+		inner := s[1 : len(s)-1]
+		for i := 0; i < len(inner); i++ {
+			c := inner[i]
+			if c == '\\' {
+				if i++; i == len(inner) {
+					return "", errors.New("trailing backslash in quoted localpart")
+				}
+				c = inner[i]
+			} else if c == '"' {
+				return "", errors.New("stray quote in localpart")
+			}
+			if c < ' ' && c != '\t' || c == 0x7f {
+				return "", errors.New("control character in localpart")
+			}
+			b.WriteByte(c)
+		}
+		local = b.String()
+		if local == "" {
+			return "", errors.New("empty localpart")
+		}
+	} else if !isDotAtom(s) {
+		return "", fmt.Errorf("localpart %q must be quoted", s)
+	}
+	if !utf8.ValidString(local) {
+		return "", errors.New("localpart is not valid UTF-8")
+	}
+	if len(local) > MaxLocalLength {
+		return "", fmt.Errorf("localpart longer than %d octets", MaxLocalLength)
+	}
+	return local, nil
+}
+
+// isDotAtom reports whether s is an RFC 5322 dot-atom, with UTF-8
+// allowed as by RFC 6531.
+func isDotAtom(s string) bool {
+	if s == "" || s[0] == '.' || s[len(s)-1] == '.' || strings.Contains(s, "..") {
+		return false
+	}
+	for _, r := range s {
+		if r != '.' && !isAtext(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// isAtext reports whether r may appear unquoted in a localpart.
+func isAtext(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	case r >= utf8.RuneSelf:
+		return r != utf8.RuneError
+	}
+	return strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", r)
+}
+
+// quote returns local as an RFC 5322 quoted string.
+func quote(local string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(local); i++ {
+		if c := local[i]; c == '"' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(local[i])
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,128 @@
+package address_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/infodancer/auth/address"
+)
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		input, local, domain string
+	}{
+		{"user@example.com", "user", "example.com"},
+		{"user+tag@example.com", "user+tag", "example.com"},
+		{`"a@b"@example.com`, `"a@b"`, "example.com"},
+		{"user", "user", ""},
+		{"@example.com", "", "example.com"},
+	}
+	for _, tt := range tests {
+		local, domain := address.Split(tt.input)
+		if local != tt.local || domain != tt.domain {
+			t.Errorf("Split(%q) = (%q, %q), want (%q, %q)", tt.input, local, domain, tt.local, tt.domain)
+		}
+	}
+}
+
+func TestSplitExtension(t *testing.T) {
+	tests := []struct {
+		input, base, ext string
+	}{
+		{"user+folder", "user", "folder"},
+		{"user", "user", ""},
+		{"user+", "user", ""},
+		{"user+a+b", "user", "a+b"},
+	}
+	for _, tt := range tests {
+		base, ext := address.SplitExtension(tt.input)
+		if base != tt.base || ext != tt.ext {
+			t.Errorf("SplitExtension(%q) = (%q, %q), want (%q, %q)", tt.input, base, ext, tt.base, tt.ext)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input string
+		want  address.Address
+	}{
+		{"alice@example.com", address.Address{Local: "alice", Domain: "example.com"}},
+		{"Alice@Example.COM.", address.Address{Local: "Alice", Domain: "example.com"}},
+		{"Alice Example <alice+news@example.com>", address.Address{Local: "alice+news", Domain: "example.com"}},
+		{`"Example, Alice" <alice@example.com>`, address.Address{Local: "alice", Domain: "example.com"}},
+		{`"john smith"@example.com`, address.Address{Local: "john smith", Domain: "example.com"}},
+		{`"a\"b@c"@example.com`, address.Address{Local: `a"b@c`, Domain: "example.com"}},
+		{"alice(work)@example.com", address.Address{Local: "alice", Domain: "example.com"}},
+		{"alice@(outer (nested))example.com", address.Address{Local: "alice", Domain: "example.com"}},
+		{"jörg@bücher.example", address.Address{Local: "jörg", Domain: "xn--bcher-kva.example"}},
+		{"postmaster@[192.0.2.1]", address.Address{Local: "postmaster", Domain: "[192.0.2.1]"}},
+		{"o'brien@example.com", address.Address{Local: "o'brien", Domain: "example.com"}},
+	}
+	for _, tt := range tests {
+		got, err := address.Parse(tt.input)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.input, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q) = %+v, want %+v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"alice",
+		"@example.com",
+		"alice@",
+		"john smith@example.com",
+		".alice@example.com",
+		"alice.@example.com",
+		"al..ice@example.com",
+		`"unterminated@example.com`,
+		"alice(comment@example.com",
+		"alice)@example.com",
+		"Alice example.com>",
+		"alice@exa mple.com",
+		"alice@-example.com",
+		"alice@example..com",
+		"alice@[192.0.2.1",
+		"a12345678901234567890123456789012345678901234567890123456789012345@example.com",
+	} {
+		if got, err := address.Parse(input); !errors.Is(err, address.ErrInvalid) {
+			t.Errorf("Parse(%q) = %+v, %v; want ErrInvalid", input, got, err)
+		}
+	}
+}
+
+func TestAddress_String(t *testing.T) {
+	tests := []struct {
+		addr address.Address
+		want string
+	}{
+		{address.Address{Local: "alice", Domain: "example.com"}, "alice@example.com"},
+		{address.Address{Local: "john smith", Domain: "example.com"}, `"john smith"@example.com`},
+		{address.Address{Local: `a"b`, Domain: "example.com"}, `"a\"b"@example.com`},
+	}
+	for _, tt := range tests {
+		if got := tt.addr.String(); got != tt.want {
+			t.Errorf("%+v.String() = %q, want %q", tt.addr, got, tt.want)
+		}
+		back, err := address.Parse(tt.want)
+		if err != nil || back != tt.addr {
+			t.Errorf("Parse(%q) = %+v, %v; want %+v", tt.want, back, err, tt.addr)
+		}
+	}
+}
+
+func TestAddress_BaseExtension(t *testing.T) {
+	a, err := address.Parse("user+a+b@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Base() != "user" || a.Extension() != "a+b" {
+		t.Errorf("Base, Extension = %q, %q; want user, a+b", a.Base(), a.Extension())
+	}
+}
@@ -0,0 +1,255 @@
+package address
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// acePrefix marks a punycode-encoded label.
+const acePrefix = "xn--"
+
+// Domain returns name in canonical form: lowercased, without a trailing
+// dot, and with each non-ASCII label punycode-encoded (RFC 3492), so
+// "Bücher.Example." becomes "xn--bcher-kva.example". Labels must be 1 to
+// 63 octets of letters, digits, '-' and '_', not starting or ending with
+// '-'. Domain lowercases Unicode labels but does not apply the rest of the
+// IDNA mapping (such as NFC normalization); pass names in NFC, as
+// keyboards and browsers produce them.
+func Domain(name string) (string, error) {
+	name = strings.TrimSuffix(strings.TrimSpace(name), ".")
+	if name == "" {
+		return "", fmt.Errorf("%w: empty domain", ErrInvalid)
+	}
+	if !utf8.ValidString(name) {
+		return "", fmt.Errorf("%w: domain %q is not valid UTF-8", ErrInvalid, name)
+	}
+	labels := strings.Split(strings.ToLower(name), ".")
+	for i, label := range labels {
+		if !isASCII(label) {
+			enc, err := punycodeEncode(label)
+			if err != nil {
+				return "", fmt.Errorf("%w: domain %q: %v", ErrInvalid, name, err)
+			}
+			label = acePrefix + enc
+		}
+		if err := checkLabel(label); err != nil {
+			return "", fmt.Errorf("%w: domain %q: %v", ErrInvalid, name, err)
+		}
+		labels[i] = label
+	}
+	out := strings.Join(labels, ".")
+	if len(out) > MaxDomainLength {
+		return "", fmt.Errorf("%w: domain %q longer than %d octets", ErrInvalid, name, MaxDomainLength)
+	}
+	return out, nil
+}
+
+// DomainToUnicode returns name with its punycode labels decoded, for
+// display: "xn--bcher-kva.example" becomes "bücher.example".
+func DomainToUnicode(name string) (string, error) {
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		if len(label) > len(acePrefix) && strings.EqualFold(label[:len(acePrefix)], acePrefix) {
+			dec, err := punycodeDecode(strings.ToLower(label[len(acePrefix):]))
+			if err != nil {
+				return "", fmt.Errorf("%w: domain %q: %v", ErrInvalid, name, err)
+			}
+			labels[i] = dec
+		}
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// checkLabel validates one ASCII label.
+func checkLabel(label string) error {
+	if label == "" {
+		return errors.New("empty label")
+	}
+	if len(label) > 63 {
+		return fmt.Errorf("label %q longer than 63 octets", label)
+	}
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return fmt.Errorf("label %q starts or ends with '-'", label)
+	}
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return fmt.Errorf("label %q contains %q", label, c)
+		}
+	}
+	return nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Punycode parameters of RFC 3492, section 5.
+const (
+	pcBase        = 36
+	pcTMin        = 1
+	pcTMax        = 26
+	pcSkew        = 38
+	pcDamp        = 700
+	pcInitialBias = 72
+	pcInitialN    = 128
+	pcMaxInt      = 1<<31 - 1
+)
+
+// punycodeEncode encodes a Unicode label (RFC 3492, section 6.3).
+func punycodeEncode(label string) (string, error) {
+	input := []rune(label)
+	var out strings.Builder
+	for _, r := range input {
+		if r < utf8.RuneSelf {
+			out.WriteRune(r)
+		}
+	}
+	basic := out.Len()
+	if basic > 0 {
+		out.WriteByte('-')
+	}
+	n, delta, bias := pcInitialN, 0, pcInitialBias
+	for h := basic; h < len(input); {
+		m := pcMaxInt
+		for _, r := range input {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		if (m - n) > (pcMaxInt-delta)/(h+1) {
+			return "", errors.New("punycode overflow")
+		}
+		delta += (m - n) * (h + 1)
+		n = m
+		for _, r := range input {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := pcBase; ; k += pcBase {
+				t := pcThreshold(k, bias)
+				if q < t {
+					break
+				}
+				out.WriteByte(pcDigit(t + (q-t)%(pcBase-t)))
+				q = (q - t) / (pcBase - t)
+			}
+			out.WriteByte(pcDigit(q))
+			bias = pcAdapt(delta, h+1, h == basic)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return out.String(), nil
+}
+
+// punycodeDecode decodes a label without its ACE prefix (RFC 3492,
+// section 6.2).
+func punycodeDecode(s string) (string, error) {
+	var output []rune
+	pos := 0
+	if b := strings.LastIndexByte(s, '-'); b >= 0 {
+		for _, r := range s[:b] {
+			if r >= utf8.RuneSelf {
+				return "", errors.New("non-ASCII basic code point")
+			}
+			output = append(output, r)
+		}
+		pos = b + 1
+	}
+	n, i, bias := pcInitialN, 0, pcInitialBias
+	for pos < len(s) {
+		oldi, w := i, 1
+		for k := pcBase; ; k += pcBase {
+			if pos >= len(s) {
+				return "", errors.New("truncated punycode")
+			}
+			d, ok := pcDecodeDigit(s[pos])
+			pos++
+			if !ok {
+				return "", fmt.Errorf("bad punycode digit %q", s[pos-1])
+			}
+			if d > (pcMaxInt-i)/w {
+				return "", errors.New("punycode overflow")
+			}
+			i += d * w
+			t := pcThreshold(k, bias)
+			if d < t {
+				break
+			}
+			w *= pcBase - t
+		}
+		count := len(output) + 1
+		bias = pcAdapt(i-oldi, count, oldi == 0)
+		if i/count > pcMaxInt-n {
+			return "", errors.New("punycode overflow")
+		}
+		n += i / count
+		i %= count
+		if n > utf8.MaxRune {
+			return "", errors.New("punycode code point out of range")
+		}
+		output = append(output, 0)
+		copy(output[i+1:], output[i:])
+		output[i] = rune(n)
+		i++
+	}
+	return string(output), nil
+}
+
+func pcThreshold(k, bias int) int {
+	switch {
+	case k <= bias:
+		return pcTMin
+	case k >= bias+pcTMax:
+		return pcTMax
+	}
+	return k - bias
+}
+
+func pcAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= pcDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((pcBase-pcTMin)*pcTMax)/2 {
+		delta /= pcBase - pcTMin
+		k += pcBase
+	}
+	return k + (pcBase-pcTMin+1)*delta/(delta+pcSkew)
+}
+
+func pcDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func pcDecodeDigit(c byte) (int, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c-'0') + 26, true
+	case c >= 'a' && c <= 'z':
+		return int(c - 'a'), true
+	case c >= 'A' && c <= 'Z':
+		return int(c - 'A'), true
+	}
+	return 0, false
+}
@@ -0,0 +1,67 @@
+package address_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/infodancer/auth/address"
+)
+
+func TestDomain(t *testing.T) {
+	tests := []struct {
+		input, want string
+	}{
+		{"example.com", "example.com"},
+		{"Example.COM.", "example.com"},
+		{"_dmarc.example.com", "_dmarc.example.com"},
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"MÜNCHEN.example", "xn--mnchen-3ya.example"},
+		{"xn--bcher-kva.example", "xn--bcher-kva.example"},
+		// RFC 3492, section 7.1, sample (B).
+		{"他们为什么不说中文", "xn--ihqwcrb4cv8a8dqg056pqjye"},
+	}
+	for _, tt := range tests {
+		got, err := address.Domain(tt.input)
+		if err != nil || got != tt.want {
+			t.Errorf("Domain(%q) = %q, %v; want %q", tt.input, got, err, tt.want)
+		}
+	}
+}
+
+func TestDomain_Invalid(t *testing.T) {
+	for _, input := range []string{
+		"",
+		".",
+		"example..com",
+		"-example.com",
+		"example-.com",
+		"exa mple.com",
+		"exa\xffmple.com",
+		strings.Repeat("a", 64) + ".com",
+		strings.Repeat(strings.Repeat("a", 63)+".", 4) + "com",
+	} {
+		if got, err := address.Domain(input); !errors.Is(err, address.ErrInvalid) {
+			t.Errorf("Domain(%q) = %q, %v; want ErrInvalid", input, got, err)
+		}
+	}
+}
+
+func TestDomainToUnicode(t *testing.T) {
+	for _, name := range []string{"bücher.example", "münchen.example", "他们为什么不说中文", "example.com"} {
+		ascii, err := address.Domain(name)
+		if err != nil {
+			t.Fatalf("Domain(%q): %v", name, err)
+		}
+		got, err := address.DomainToUnicode(ascii)
+		if err != nil || got != name {
+			t.Errorf("DomainToUnicode(%q) = %q, %v; want %q", ascii, got, err, name)
+		}
+	}
+	if got, err := address.DomainToUnicode("XN--BCHER-KVA.example"); err != nil || got != "bücher.example" {
+		t.Errorf("DomainToUnicode(upper case) = %q, %v", got, err)
+	}
+	if _, err := address.DomainToUnicode("xn--b!d.example"); !errors.Is(err, address.ErrInvalid) {
+		t.Errorf("DomainToUnicode(bad digit) error = %v, want ErrInvalid", err)
+	}
+}
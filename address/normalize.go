@@ -0,0 +1,73 @@
+package address
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Policy declares how a domain canonicalizes localparts. Rules apply to
+// the part before any "+extension". The zero value leaves localparts
+// unchanged.
+//
+//	strip_dots = true          # "j.doe" and "jdoe" are the same user
+//	case_insensitive = true    # "JDoe" and "jdoe" are the same user
+//	charset = "a-z0-9._-"      # anything else is rejected as unknown
+type Policy struct {
+	// StripDots removes "." from localparts (Gmail-style).
+	StripDots bool `toml:"strip_dots,omitempty"`
+
+	// CaseInsensitive lowercases localparts.
+	CaseInsensitive bool `toml:"case_insensitive,omitempty"`
+
+	// Charset is a regular expression character class body (without the
+	// brackets) listing the characters allowed in a localpart, checked after
+	// the other rules. Empty allows any character.
+	Charset string `toml:"charset,omitempty"`
+}
+
+// Normalizer applies a Policy. A nil *Normalizer changes nothing.
+type Normalizer struct {
+	stripDots bool
+	fold      bool
+	allowed   *regexp.Regexp // nil: any character
+}
+
+// NewNormalizer compiles p, returning nil when p has no rules.
+func NewNormalizer(p Policy) (*Normalizer, error) {
+	if p == (Policy{}) {
+		return nil, nil
+	}
+	n := &Normalizer{stripDots: p.StripDots, fold: p.CaseInsensitive}
+	if p.Charset != "" {
+		re, err := regexp.Compile("^[" + p.Charset + "]+$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid normalize charset %q: %w", p.Charset, err)
+		}
+		n.allowed = re
+	}
+	return n, nil
+}
+
+// Localpart returns the canonical form of local, keeping any "+extension"
+// as is. ok is false when the base contains characters outside the
+// policy's charset; such addresses never match a user or forward.
+func (n *Normalizer) Localpart(local string) (canonical string, ok bool) {
+	if n == nil {
+		return local, true
+	}
+	base, ext, hasExt := strings.Cut(local, "+")
+	if n.fold {
+		base = strings.ToLower(base)
+	}
+	if n.stripDots {
+		base = strings.ReplaceAll(base, ".", "")
+	}
+	if n.allowed != nil && !n.allowed.MatchString(base) {
+		return "", false
+	}
+	if hasExt {
+		return base + "+" + ext, true
+	}
+	return base, true
+}
@@ -0,0 +1,42 @@
+package address_test
+
+import (
+	"testing"
+
+	"github.com/infodancer/auth/address"
+)
+
+func TestNormalizer(t *testing.T) {
+	n, err := address.NewNormalizer(address.Policy{StripDots: true, CaseInsensitive: true, Charset: "a-z0-9_-"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"j.doe", "jdoe", true},
+		{"J.Doe+Lists.X", "jdoe+Lists.X", true},
+		{"jdoe", "jdoe", true},
+		{"j%doe", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := n.Localpart(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Localpart(%q) = %q, %v; want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestNewNormalizer_Zero(t *testing.T) {
+	n, err := address.NewNormalizer(address.Policy{})
+	if n != nil || err != nil {
+		t.Fatalf("NewNormalizer(zero) = %v, %v; want nil, nil", n, err)
+	}
+	if got, ok := n.Localpart("J.Doe"); got != "J.Doe" || !ok {
+		t.Errorf("nil Localpart = %q, %v", got, ok)
+	}
+	if _, err := address.NewNormalizer(address.Policy{Charset: "z-a"}); err == nil {
+		t.Error("expected error for invalid charset")
+	}
+}
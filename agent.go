@@ -32,7 +32,93 @@ type KeyProvider interface {
 	// Returns errors.ErrUserNotFound if the user does not exist.
 	GetPublicKey(ctx context.Context, username string) ([]byte, error)
 
+	// GetPublicKeys returns the public keys of several users at once, by
+	// username, so that a message to many recipients costs one call.
+	// Users without a key, or who do not exist, are left out; any other
+	// error fails the whole call. Backends with no cheaper way to fetch
+	// many keys implement it with GetPublicKeysOneByOne.
+	GetPublicKeys(ctx context.Context, usernames []string) (map[string][]byte, error)
+
 	// HasEncryption returns whether encryption is enabled for a user.
 	// Returns false if the user does not exist or has no keys configured.
 	HasEncryption(ctx context.Context, username string) (bool, error)
 }
+
+// AuthTokenAgent mints signed, expiring session tokens for logged-in users
+// and verifies them later without the password, so webmail and session
+// managers need not keep passwords between connections. See package token.
+type AuthTokenAgent interface {
+	// IssueToken returns a token for session's user. The token carries no
+	// key material.
+	IssueToken(ctx context.Context, session *AuthSession) (string, error)
+
+	// VerifyToken returns the user a token was issued for. Returns
+	// errors.ErrTokenExpired once it has expired and errors.ErrAuthFailed
+	// if it is otherwise invalid.
+	VerifyToken(ctx context.Context, token string) (*User, error)
+}
+
+// SenderAuthorizer decides which envelope sender addresses an authenticated
+// user may use. Used by smtpd submission to enforce MAIL FROM alignment
+// without knowing how identities, aliases and policies are stored.
+type SenderAuthorizer interface {
+	// MaySendAs reports whether the authenticated user may use address as
+	// MAIL FROM. username is the login name as passed to Authenticate.
+	// Returns an error only for backend failures, not for a refusal.
+	MaySendAs(ctx context.Context, username, address string) (bool, error)
+}
+
+// MFAAgent is implemented by agents that store a TOTP second factor for
+// their users. The password check in Authenticate is unchanged; callers
+// (normally the domain.AuthRouter) ask TOTPEnabled after it succeeds and
+// complete the login with VerifyTOTP.
+type MFAAgent interface {
+	// TOTPEnabled reports whether username has a TOTP secret enrolled.
+	// Returns an error only for backend failures.
+	TOTPEnabled(ctx context.Context, username string) (bool, error)
+
+	// VerifyTOTP reports whether code is username's current one-time code.
+	// Agents may require a successful Authenticate shortly before, and may
+	// refuse a code that was already used. Returns an error only for
+	// backend failures, not for a wrong code.
+	VerifyTOTP(ctx context.Context, username, code string) (bool, error)
+}
+
+// UserLister enumerates the accounts an agent can authenticate. Used for
+// directory features such as address book export. Optional: callers should
+// type-assert an AuthenticationAgent to UserLister.
+type UserLister interface {
+	// ListUsers returns the usernames known to the agent, sorted.
+	ListUsers(ctx context.Context) ([]string, error)
+}
+
+// AddressLookup describes how an address is handled, separating "can log in"
+// from "will accept delivery". UserExists conflates the two for
+// compatibility; callers such as smtpd RCPT checks and session managers
+// should prefer LookupAddress when the agent implements it.
+type AddressLookup interface {
+	// LookupAddress returns how address is handled. An address nobody
+	// handles yields a zero AddressInfo and no error.
+	// Returns an error only for backend failures.
+	LookupAddress(ctx context.Context, address string) (AddressInfo, error)
+}
+
+// AddressInfo is the result of AddressLookup.LookupAddress.
+type AddressInfo struct {
+	// CanAuthenticate is true when the address has an account that can log in.
+	CanAuthenticate bool
+
+	// AcceptsMail is true when mail to the address is delivered somewhere,
+	// to a mailbox or through a forwarding rule.
+	AcceptsMail bool
+
+	// IsForwardOnly is true when mail is forwarded and there is no account.
+	IsForwardOnly bool
+
+	// IsAlias is true when an explicit forwarding rule for the address
+	// applies (not a catchall).
+	IsAlias bool
+
+	// CatchallMatched is true when only a catchall (*) rule matched.
+	CatchallMatched bool
+}
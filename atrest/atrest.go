@@ -0,0 +1,308 @@
+// Package atrest seals credential files (passwd, forwards, domain config)
+// with a host key so backups and stolen disks do not expose them, for
+// deployments that cannot rely on full-disk encryption.
+//
+// A sealed file starts with a fixed header line followed by a NaCl
+// secretbox (XSalsa20-Poly1305) nonce and ciphertext. Readers in this module
+// call ReadFile or Open, which return plaintext for both sealed and plain
+// files, so sealing is transparent once the host key is installed with
+// SetKey at process start:
+//
+//	key, err := atrest.LoadKey("/etc/infodancer/host.key")
+//	...
+//	atrest.SetKey(key)
+//
+// Writers preserve a file's existing state: a sealed file stays sealed
+// when rewritten.
+package atrest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"github.com/infodancer/auth/vfs"
+)
+
+// header marks a sealed file.
+const header = "INFODANCER-SEALED-1\n"
+
+// linePrefix marks a sealed line in a line-oriented, append-only file.
+const linePrefix = "sealed:"
+
+const nonceSize = 24
+
+// KeyEnv is the environment variable LoadKeyFromEnv reads the key path from.
+const KeyEnv = "INFODANCER_HOST_KEY"
+
+var (
+	// ErrNoKey indicates a sealed file was read with no host key installed.
+	ErrNoKey = errors.New("atrest: file is sealed but no host key is set")
+
+	// ErrUnseal indicates sealed data could not be authenticated with the
+	// host key (wrong key or corrupted file).
+	ErrUnseal = errors.New("atrest: unseal failed")
+)
+
+// Key is a 32-byte host key.
+type Key [32]byte
+
+var (
+	keyMu   sync.RWMutex
+	hostKey *Key
+)
+
+// SetKey installs k as the process-wide host key. nil removes it.
+func SetKey(k *Key) {
+	keyMu.Lock()
+	defer keyMu.Unlock()
+	hostKey = k
+}
+
+// currentKey returns the installed host key, or nil.
+func currentKey() *Key {
+	keyMu.RLock()
+	defer keyMu.RUnlock()
+	return hostKey
+}
+
+// HasKey reports whether a host key is installed.
+func HasKey() bool {
+	return currentKey() != nil
+}
+
+// GenerateKey returns a new random host key.
+func GenerateKey() (*Key, error) {
+	var k Key
+	if _, err := rand.Read(k[:]); err != nil {
+		return nil, fmt.Errorf("generate host key: %w", err)
+	}
+	return &k, nil
+}
+
+// LoadKey reads a hex-encoded host key from path.
+func LoadKey(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read host key: %w", err)
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(raw) != len(Key{}) {
+		return nil, fmt.Errorf("invalid host key in %s", path)
+	}
+	var k Key
+	copy(k[:], raw)
+	return &k, nil
+}
+
+// WriteKey writes k hex-encoded to path with mode 0600, failing if path
+// already exists.
+func WriteKey(path string, k *Key) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("create host key: %w", err)
+	}
+	if _, err := f.WriteString(hex.EncodeToString(k[:]) + "\n"); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("write host key: %w", err)
+	}
+	return f.Close()
+}
+
+// LoadKeyFromEnv installs the host key named by $INFODANCER_HOST_KEY, if
+// set. Returns false with no error when the variable is unset.
+func LoadKeyFromEnv() (bool, error) {
+	path := os.Getenv(KeyEnv)
+	if path == "" {
+		return false, nil
+	}
+	k, err := LoadKey(path)
+	if err != nil {
+		return false, err
+	}
+	SetKey(k)
+	return true, nil
+}
+
+// IsSealed reports whether data is a sealed file.
+func IsSealed(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(header))
+}
+
+// Seal encrypts plaintext with k into the sealed file format.
+func Seal(k *Key, plaintext []byte) ([]byte, error) {
+	var nonce [nonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+	out := make([]byte, 0, len(header)+nonceSize+len(plaintext)+secretbox.Overhead)
+	out = append(out, header...)
+	out = append(out, nonce[:]...)
+	return secretbox.Seal(out, plaintext, &nonce, (*[32]byte)(k)), nil
+}
+
+// Unseal decrypts sealed data with k.
+func Unseal(k *Key, data []byte) ([]byte, error) {
+	body, ok := bytes.CutPrefix(data, []byte(header))
+	if !ok || len(body) < nonceSize+secretbox.Overhead {
+		return nil, ErrUnseal
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], body[:nonceSize])
+	plain, ok := secretbox.Open(nil, body[nonceSize:], &nonce, (*[32]byte)(k))
+	if !ok {
+		return nil, ErrUnseal
+	}
+	return plain, nil
+}
+
+// Decode returns the plaintext of data, unsealing it with the host key if it
+// is sealed. Use it for file contents read by other means than ReadFile.
+func Decode(data []byte) ([]byte, error) {
+	if !IsSealed(data) {
+		return data, nil
+	}
+	k := currentKey()
+	if k == nil {
+		return nil, ErrNoKey
+	}
+	return Unseal(k, data)
+}
+
+// ReadFile reads path and returns its plaintext, unsealing it with the host
+// key if it is sealed. Errors from os.ReadFile are returned unwrapped so
+// os.IsNotExist works on them.
+func ReadFile(path string) ([]byte, error) {
+	return ReadFileFS(vfs.OS{}, path)
+}
+
+// ReadFileFS is like ReadFile but reads path through fsys.
+func ReadFileFS(fsys vfs.FS, path string) ([]byte, error) {
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return plain, nil
+}
+
+// Open is like os.Open but yields plaintext for sealed files. Errors from
+// os.Open are returned unwrapped so os.IsNotExist works on them.
+func Open(path string) (io.ReadCloser, error) {
+	return OpenFS(vfs.OS{}, path)
+}
+
+// OpenFS is like Open but opens path through fsys.
+func OpenFS(fsys vfs.FS, path string) (io.ReadCloser, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(f)
+	peek, _ := br.Peek(len(header))
+	if !IsSealed(peek) {
+		return struct {
+			io.Reader
+			io.Closer
+		}{br, f}, nil
+	}
+	data, err := io.ReadAll(br)
+	_ = f.Close()
+	if err != nil {
+		return nil, err
+	}
+	plain, err := Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return io.NopCloser(bytes.NewReader(plain)), nil
+}
+
+// IsSealedFile reports whether the file at path is sealed. A missing file
+// is not sealed.
+func IsSealedFile(path string) (bool, error) {
+	return IsSealedFileFS(vfs.OS{}, path)
+}
+
+// IsSealedFileFS is like IsSealedFile but reads path through fsys.
+func IsSealedFileFS(fsys vfs.FS, path string) (bool, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer func() { _ = f.Close() }()
+	buf := make([]byte, len(header))
+	n, _ := io.ReadFull(f, buf)
+	return IsSealed(buf[:n]), nil
+}
+
+// WriteFile atomically replaces path with data, sealed with the host key
+// when seal is true.
+func WriteFile(path string, data []byte, perm os.FileMode, seal bool) error {
+	return WriteFileFS(vfs.OS{}, path, data, perm, seal)
+}
+
+// WriteFileFS is like WriteFile but writes path through fsys.
+func WriteFileFS(fsys vfs.WriteFS, path string, data []byte, perm fs.FileMode, seal bool) error {
+	if seal {
+		k := currentKey()
+		if k == nil {
+			return ErrNoKey
+		}
+		var err error
+		if data, err = Seal(k, data); err != nil {
+			return err
+		}
+	}
+	return vfs.WriteFileAtomic(fsys, path, data, perm)
+}
+
+// SealLine seals one line of an append-only file (such as a journal) when a
+// host key is installed, returning it as "sealed:<base64>". Without a key
+// the line is returned unchanged.
+func SealLine(line []byte) ([]byte, error) {
+	k := currentKey()
+	if k == nil {
+		return line, nil
+	}
+	sealed, err := Seal(k, line)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(linePrefix), base64.RawStdEncoding.EncodeToString(sealed[len(header):])...), nil
+}
+
+// UnsealLine reverses SealLine. Lines without the sealed prefix are
+// returned unchanged.
+func UnsealLine(line []byte) ([]byte, error) {
+	enc, ok := bytes.CutPrefix(line, []byte(linePrefix))
+	if !ok {
+		return line, nil
+	}
+	k := currentKey()
+	if k == nil {
+		return nil, ErrNoKey
+	}
+	raw, err := base64.RawStdEncoding.DecodeString(string(enc))
+	if err != nil {
+		return nil, ErrUnseal
+	}
+	return Unseal(k, append([]byte(header), raw...))
+}
@@ -0,0 +1,196 @@
+package atrest
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/infodancer/auth/vfs"
+)
+
+// withKey installs a fresh host key for the duration of the test.
+func withKey(t *testing.T) *Key {
+	t.Helper()
+	k, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetKey(k)
+	t.Cleanup(func() { SetKey(nil) })
+	return k
+}
+
+func TestWriteFile_SealedRoundTrip(t *testing.T) {
+	withKey(t)
+	path := filepath.Join(t.TempDir(), "passwd")
+	plain := []byte("alice:$argon2id$hash:alice\n")
+
+	if err := WriteFile(path, plain, 0o640, true); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(raw) || bytes.Contains(raw, []byte("alice")) {
+		t.Fatalf("file on disk is not sealed: %q", raw)
+	}
+	if sealed, err := IsSealedFile(path); err != nil || !sealed {
+		t.Errorf("IsSealedFile = %v, %v; want true", sealed, err)
+	}
+
+	got, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Errorf("ReadFile = %q, want %q", got, plain)
+	}
+
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Close() }()
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(r); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), plain) {
+		t.Errorf("Open = %q, want %q", buf.Bytes(), plain)
+	}
+}
+
+func TestWriteFileFS_SealedRoundTripInMemory(t *testing.T) {
+	withKey(t)
+	mem := vfs.NewMemFS()
+	plain := []byte("[forwards]\nsales = \"alice@example.com\"\n")
+
+	if err := WriteFileFS(mem, "/config.toml", plain, 0o640, true); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := mem.ReadFile("/config.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(raw) {
+		t.Fatalf("file is not sealed: %q", raw)
+	}
+	if sealed, err := IsSealedFileFS(mem, "/config.toml"); err != nil || !sealed {
+		t.Errorf("IsSealedFileFS = %v, %v; want true", sealed, err)
+	}
+	if got, err := ReadFileFS(mem, "/config.toml"); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("ReadFileFS = %q, %v; want %q", got, err, plain)
+	}
+	if _, err := mem.Stat("/config.toml.tmp"); err == nil {
+		t.Error("temporary file left behind")
+	}
+}
+
+func TestReadFile_PlainPassesThrough(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "forwards")
+	if err := os.WriteFile(path, []byte("info:alice@example.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "info:alice@example.com\n" {
+		t.Errorf("ReadFile = %q", got)
+	}
+	if _, err := ReadFile(filepath.Join(t.TempDir(), "missing")); !os.IsNotExist(err) {
+		t.Errorf("missing file: got %v, want a not-exist error", err)
+	}
+}
+
+func TestReadFile_SealedWithoutKey(t *testing.T) {
+	withKey(t)
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := WriteFile(path, []byte("[auth]\n"), 0o640, true); err != nil {
+		t.Fatal(err)
+	}
+	SetKey(nil)
+
+	if _, err := ReadFile(path); !errors.Is(err, ErrNoKey) {
+		t.Errorf("ReadFile without key: got %v, want ErrNoKey", err)
+	}
+	if err := WriteFile(path, []byte("x"), 0o640, true); !errors.Is(err, ErrNoKey) {
+		t.Errorf("WriteFile without key: got %v, want ErrNoKey", err)
+	}
+}
+
+func TestReadFile_WrongKey(t *testing.T) {
+	withKey(t)
+	path := filepath.Join(t.TempDir(), "passwd")
+	if err := WriteFile(path, []byte("alice:x:alice\n"), 0o640, true); err != nil {
+		t.Fatal(err)
+	}
+	withKey(t)
+
+	if _, err := ReadFile(path); !errors.Is(err, ErrUnseal) {
+		t.Errorf("got %v, want ErrUnseal", err)
+	}
+}
+
+func TestSealLine(t *testing.T) {
+	line := []byte(`{"op":"add"}`)
+
+	// Without a key lines pass through unchanged.
+	got, err := SealLine(line)
+	if err != nil || !bytes.Equal(got, line) {
+		t.Fatalf("SealLine without key = %q, %v", got, err)
+	}
+
+	withKey(t)
+	sealed, err := SealLine(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("add")) || bytes.ContainsRune(sealed, '\n') {
+		t.Fatalf("sealed line leaks content or spans lines: %q", sealed)
+	}
+	got, err = UnsealLine(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, line) {
+		t.Errorf("UnsealLine = %q, want %q", got, line)
+	}
+	if got, _ := UnsealLine(line); !bytes.Equal(got, line) {
+		t.Errorf("UnsealLine on plain line = %q", got)
+	}
+}
+
+func TestKeyFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "host.key")
+	k, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteKey(path, k); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteKey(path, k); err == nil {
+		t.Error("expected WriteKey to refuse an existing file")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	t.Setenv(KeyEnv, path)
+	t.Cleanup(func() { SetKey(nil) })
+	ok, err := LoadKeyFromEnv()
+	if err != nil || !ok {
+		t.Fatalf("LoadKeyFromEnv = %v, %v", ok, err)
+	}
+	if *currentKey() != *k {
+		t.Error("loaded key does not match written key")
+	}
+}
@@ -0,0 +1,214 @@
+// Package audit records an audit trail of authentication calls. Every
+// Authenticate and UserExists call that passes through a domain.AuthRouter
+// with an Auditor installed (see AuthRouter.WithAuditor) produces one
+// Record with its outcome, client IP, protocol, domain and latency, so
+// every consumer of the router gets an audit trail without code changes:
+//
+//	a, err := audit.NewFileAuditor("/var/log/infodancer/auth-audit.json")
+//	router := domain.NewAuthRouter(provider, nil).WithAuditor(a)
+//
+// Sinks write records as JSON lines to a file (FileAuditor), to syslog
+// (SyslogAuditor) or to a slog.Logger (SlogAuditor); Multi sends each
+// record to several. FailureLog writes refused logins only, one line each
+// in a stable format for fail2ban. Records never carry passwords or other
+// credentials.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Op is the call a Record audits.
+type Op string
+
+const (
+	// OpAuthenticate is a login: a password, SASL or certificate check.
+	OpAuthenticate Op = "authenticate"
+
+	// OpUserExists is an account lookup, such as an MTA's recipient check.
+	OpUserExists Op = "user_exists"
+
+	// OpImpersonate is an operator minting an impersonation token for a
+	// user (see domain.AuthRouter.MintImpersonationToken).
+	OpImpersonate Op = "impersonate"
+)
+
+// Outcome is the result of an audited call.
+type Outcome string
+
+const (
+	// OutcomeSuccess is a login that passed, or a lookup that found the user.
+	OutcomeSuccess Outcome = "success"
+
+	// OutcomeFailure is a login that was refused; Record.Error says why.
+	OutcomeFailure Outcome = "failure"
+
+	// OutcomeNotFound is a lookup for a user that does not exist.
+	OutcomeNotFound Outcome = "not_found"
+
+	// OutcomeError is a lookup that failed; Record.Error says why.
+	OutcomeError Outcome = "error"
+)
+
+// Record is one audited call.
+type Record struct {
+	Time     time.Time `json:"time"`
+	Op       Op        `json:"op"`
+	Username string    `json:"username"`
+	Domain   string    `json:"domain,omitempty"`
+
+	// ClientIP and Protocol are taken from the call's context (see
+	// domain.WithClientIP and domain.WithProtocol); empty when not set.
+	ClientIP string `json:"client_ip,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+
+	// Mechanism is the SASL mechanism of a login, empty for a plaintext
+	// password.
+	Mechanism string `json:"mechanism,omitempty"`
+
+	Outcome Outcome `json:"outcome"`
+	Error   string  `json:"error,omitempty"`
+
+	// StepUp is set on a successful login that still needs a second factor
+	// or step-up verification before access is granted.
+	StepUp bool `json:"step_up,omitempty"`
+
+	// Operator, TokenID and Reason describe an impersonation: the operator
+	// acting as Username, the token they use and why they minted it. Set
+	// on OpImpersonate records and on logins with the token.
+	Operator string `json:"operator,omitempty"`
+	TokenID  string `json:"token_id,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+
+	Latency time.Duration `json:"latency_ns"`
+}
+
+// Failed reports whether the record is a refused login or a failed lookup.
+func (r Record) Failed() bool {
+	return r.Outcome == OutcomeFailure || r.Outcome == OutcomeError
+}
+
+// Auditor receives audit records. Implementations must be safe for
+// concurrent use; Audit is called synchronously on the login path, so it
+// should not block for long.
+type Auditor interface {
+	Audit(ctx context.Context, rec Record) error
+}
+
+// AuditorFunc adapts a function to Auditor.
+type AuditorFunc func(ctx context.Context, rec Record) error
+
+// Audit calls f.
+func (f AuditorFunc) Audit(ctx context.Context, rec Record) error {
+	return f(ctx, rec)
+}
+
+// Multi returns an Auditor sending each record to every one of auditors,
+// returning their errors joined.
+func Multi(auditors ...Auditor) Auditor {
+	return multi(auditors)
+}
+
+type multi []Auditor
+
+func (m multi) Audit(ctx context.Context, rec Record) error {
+	var errs []error
+	for _, a := range m {
+		if err := a.Audit(ctx, rec); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// FileAuditor appends records to a file as JSON lines.
+type FileAuditor struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// NewFileAuditor opens path for appending, creating it with mode 0640 if
+// needed. Call Close when done.
+func NewFileAuditor(path string) (*FileAuditor, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+	return &FileAuditor{f: f}, nil
+}
+
+// Audit appends rec to the file.
+func (a *FileAuditor) Audit(_ context.Context, rec Record) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("write audit log: %w", err)
+	}
+	return nil
+}
+
+// Close closes the file.
+func (a *FileAuditor) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.f.Close()
+}
+
+// SlogAuditor logs records to a slog.Logger: successes at Info, failures
+// at Warn.
+type SlogAuditor struct {
+	logger *slog.Logger
+}
+
+// NewSlogAuditor returns a SlogAuditor logging to logger. A nil logger uses
+// slog.Default().
+func NewSlogAuditor(logger *slog.Logger) *SlogAuditor {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &SlogAuditor{logger: logger}
+}
+
+// Audit logs rec.
+func (a *SlogAuditor) Audit(ctx context.Context, rec Record) error {
+	level := slog.LevelInfo
+	if rec.Failed() {
+		level = slog.LevelWarn
+	}
+	attrs := []slog.Attr{
+		slog.String("op", string(rec.Op)),
+		slog.String("username", rec.Username),
+		slog.String("outcome", string(rec.Outcome)),
+		slog.Duration("latency", rec.Latency),
+	}
+	for _, kv := range [][2]string{
+		{"domain", rec.Domain},
+		{"ip", rec.ClientIP},
+		{"protocol", rec.Protocol},
+		{"mechanism", rec.Mechanism},
+		{"operator", rec.Operator},
+		{"token_id", rec.TokenID},
+		{"reason", rec.Reason},
+		{"error", rec.Error},
+	} {
+		if kv[1] != "" {
+			attrs = append(attrs, slog.String(kv[0], kv[1]))
+		}
+	}
+	if rec.StepUp {
+		attrs = append(attrs, slog.Bool("step_up", true))
+	}
+	a.logger.LogAttrs(ctx, level, "auth audit", attrs...)
+	return nil
+}
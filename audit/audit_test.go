@@ -0,0 +1,81 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileAuditor(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.json")
+	a, err := NewFileAuditor(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	recs := []Record{
+		{Time: time.Now().UTC(), Op: OpAuthenticate, Username: "alice@example.com", Domain: "example.com", ClientIP: "192.0.2.7", Outcome: OutcomeSuccess, Latency: 3 * time.Millisecond},
+		{Time: time.Now().UTC(), Op: OpUserExists, Username: "bob@example.com", Outcome: OutcomeNotFound},
+	}
+	for _, rec := range recs {
+		if err := a.Audit(ctx, rec); err != nil {
+			t.Fatalf("Audit: %v", err)
+		}
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	var got []Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		got = append(got, rec)
+	}
+	if len(got) != 2 || got[0].ClientIP != "192.0.2.7" || got[0].Latency != 3*time.Millisecond || got[1].Outcome != OutcomeNotFound {
+		t.Errorf("records = %+v", got)
+	}
+}
+
+func TestSlogAuditor(t *testing.T) {
+	var buf bytes.Buffer
+	a := NewSlogAuditor(slog.New(slog.NewTextHandler(&buf, nil)))
+	rec := Record{Op: OpAuthenticate, Username: "alice@example.com", Protocol: "imap", Outcome: OutcomeFailure, Error: "authentication failed"}
+	if err := a.Audit(context.Background(), rec); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{"level=WARN", "outcome=failure", "protocol=imap", `error="authentication failed"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log %q lacks %s", out, want)
+		}
+	}
+	if strings.Contains(out, "mechanism=") {
+		t.Errorf("log %q has an empty attribute", out)
+	}
+}
+
+func TestMulti(t *testing.T) {
+	var n int
+	count := AuditorFunc(func(context.Context, Record) error { n++; return nil })
+	fail := AuditorFunc(func(context.Context, Record) error { return errors.New("disk full") })
+	if err := Multi(count, fail, count).Audit(context.Background(), Record{}); err == nil || n != 2 {
+		t.Errorf("Multi: err = %v, delivered to %d, want an error and 2", err, n)
+	}
+}
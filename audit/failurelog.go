@@ -0,0 +1,97 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FailureLog appends one line per refused login to a file, for log
+// watchers such as fail2ban and CrowdSec. Successes and lookups are not
+// written. The format is stable:
+//
+//	<time> infodancer-auth: login failed ip=<ip> user=<user> domain=<domain> protocol=<protocol>
+//
+// <time> is RFC 3339 in UTC with second precision. Fields always appear in
+// this order; an unknown value is written as "-". A value containing
+// spaces, quotes, '=' or anything but printable ASCII is written as a Go
+// quoted ASCII string, so a crafted username cannot forge a line or a field.
+// Fields may be added at the end of the line in later releases but are
+// never removed or reordered. A fail2ban filter matches it with
+//
+//	failregex = ^\S+ infodancer-auth: login failed ip=<HOST>
+type FailureLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// NewFailureLog opens path for appending, creating it with mode 0640 if
+// needed. Call Close when done.
+func NewFailureLog(path string) (*FailureLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("open failure log: %w", err)
+	}
+	return &FailureLog{f: f}, nil
+}
+
+// Audit appends rec to the file if it is a refused login.
+func (l *FailureLog) Audit(_ context.Context, rec Record) error {
+	if rec.Op != OpAuthenticate || rec.Outcome != OutcomeFailure {
+		return nil
+	}
+	line := FormatFailure(rec)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.f.WriteString(line + "\n"); err != nil {
+		return fmt.Errorf("write failure log: %w", err)
+	}
+	return nil
+}
+
+// Close closes the file.
+func (l *FailureLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// FormatFailure returns the FailureLog line for rec, without the newline.
+func FormatFailure(rec Record) string {
+	t := rec.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	var b strings.Builder
+	b.WriteString(t.UTC().Format(time.RFC3339))
+	b.WriteString(" infodancer-auth: login failed")
+	for _, kv := range [][2]string{
+		{"ip", rec.ClientIP},
+		{"user", rec.Username},
+		{"domain", rec.Domain},
+		{"protocol", rec.Protocol},
+	} {
+		b.WriteString(" " + kv[0] + "=" + failureValue(kv[1]))
+	}
+	return b.String()
+}
+
+// failureValue returns v as a FailureLog field value.
+func failureValue(v string) string {
+	if v == "" {
+		return "-"
+	}
+	if v == "-" {
+		return `"-"`
+	}
+	for _, c := range []byte(v) {
+		if c <= ' ' || c > '~' || c == '"' || c == '\\' || c == '=' {
+			return strconv.QuoteToASCII(v)
+		}
+	}
+	return v
+}
@@ -0,0 +1,77 @@
+package audit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatFailure(t *testing.T) {
+	at := time.Date(2026, 3, 1, 12, 30, 45, 123, time.FixedZone("EST", -5*3600))
+	for _, tc := range []struct {
+		rec  Record
+		want string
+	}{
+		{
+			Record{Time: at, ClientIP: "192.0.2.7", Username: "alice@example.com", Domain: "example.com", Protocol: "imap"},
+			"2026-03-01T17:30:45Z infodancer-auth: login failed ip=192.0.2.7 user=alice@example.com domain=example.com protocol=imap",
+		},
+		{
+			Record{Time: at, ClientIP: "2001:db8::1", Username: "bob"},
+			"2026-03-01T17:30:45Z infodancer-auth: login failed ip=2001:db8::1 user=bob domain=- protocol=-",
+		},
+		{
+			Record{Time: at, Username: "x ip=10.0.0.1\n2026-03-01T00:00:00Z infodancer-auth: login failed ip=10.0.0.2"},
+			`2026-03-01T17:30:45Z infodancer-auth: login failed ip=- user="x ip=10.0.0.1\n2026-03-01T00:00:00Z infodancer-auth: login failed ip=10.0.0.2" domain=- protocol=-`,
+		},
+		{
+			Record{Time: at, Username: "-", Domain: "exämple.com"},
+			`2026-03-01T17:30:45Z infodancer-auth: login failed ip=- user="-" domain="ex\u00e4mple.com" protocol=-`,
+		},
+	} {
+		if got := FormatFailure(tc.rec); got != tc.want {
+			t.Errorf("FormatFailure =\n%s\nwant\n%s", got, tc.want)
+		}
+	}
+}
+
+func TestFailureLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "failures.log")
+	l, err := NewFailureLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, rec := range []Record{
+		{Op: OpAuthenticate, Username: "alice@example.com", ClientIP: "192.0.2.7", Outcome: OutcomeSuccess},
+		{Op: OpAuthenticate, Username: "alice@example.com", ClientIP: "192.0.2.8", Outcome: OutcomeFailure, Error: "authentication failed"},
+		{Op: OpUserExists, Username: "bob@example.com", ClientIP: "192.0.2.9", Outcome: OutcomeNotFound},
+		{Op: OpUserExists, Username: "bob@example.com", ClientIP: "192.0.2.9", Outcome: OutcomeError},
+	} {
+		if err := l.Audit(ctx, rec); err != nil {
+			t.Fatalf("Audit: %v", err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("log = %q, want one line", data)
+	}
+	// The documented fail2ban filter, with <HOST> as fail2ban expands it.
+	failregex := regexp.MustCompile(`^\S+ infodancer-auth: login failed ip=(?P<host>\S+)`)
+	m := failregex.FindStringSubmatch(lines[0])
+	if m == nil || m[1] != "192.0.2.8" {
+		t.Errorf("failregex on %q = %v", lines[0], m)
+	}
+}
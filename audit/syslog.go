@@ -0,0 +1,45 @@
+//go:build !windows && !plan9
+
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+)
+
+// SyslogAuditor sends records to syslog as JSON messages with the auth
+// facility: successes at info, failures at warning.
+type SyslogAuditor struct {
+	w *syslog.Writer
+}
+
+// NewSyslogAuditor connects to the syslog daemon at raddr over network
+// ("udp", "tcp" or "unix"), or to the local daemon when both are empty.
+// tag names the program in each message; empty uses the process name.
+// Call Close when done.
+func NewSyslogAuditor(network, raddr, tag string) (*SyslogAuditor, error) {
+	w, err := syslog.Dial(network, raddr, syslog.LOG_AUTH|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, fmt.Errorf("connect to syslog: %w", err)
+	}
+	return &SyslogAuditor{w: w}, nil
+}
+
+// Audit sends rec to syslog.
+func (a *SyslogAuditor) Audit(_ context.Context, rec Record) error {
+	msg, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if rec.Failed() {
+		return a.w.Warning(string(msg))
+	}
+	return a.w.Info(string(msg))
+}
+
+// Close closes the connection to syslog.
+func (a *SyslogAuditor) Close() error {
+	return a.w.Close()
+}
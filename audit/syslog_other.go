@@ -0,0 +1,22 @@
+//go:build windows || plan9
+
+package audit
+
+import (
+	"context"
+	"errors"
+)
+
+// SyslogAuditor is unavailable on platforms without syslog.
+type SyslogAuditor struct{}
+
+// NewSyslogAuditor always fails on platforms without syslog.
+func NewSyslogAuditor(network, raddr, tag string) (*SyslogAuditor, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
+
+// Audit does nothing.
+func (a *SyslogAuditor) Audit(context.Context, Record) error { return nil }
+
+// Close does nothing.
+func (a *SyslogAuditor) Close() error { return nil }
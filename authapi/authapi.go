@@ -0,0 +1,436 @@
+// Package authapi is the supported public surface of infodancer/auth for
+// downstream daemons (smtpd, pop3d, imapd, session managers).
+//
+// Everything exported here follows semantic versioning as recorded in
+// Version: within a major version, names are neither removed nor changed
+// incompatibly. Types are aliases of the implementing packages, so values
+// flow freely between authapi and code that still imports auth or domain
+// directly, and the error values are the same sentinels, so errors.Is works
+// across both.
+//
+// When an underlying package is refactored, authapi keeps the old name as a
+// deprecation shim (marked "Deprecated:" with its replacement) for at least
+// one minor release before the next major version removes it. Importing
+// authapi also registers the built-in "passwd" agent type.
+package authapi
+
+import (
+	"context"
+	"crypto/x509"
+	"log/slog"
+	"net/http"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/address"
+	"github.com/infodancer/auth/audit"
+	"github.com/infodancer/auth/domain"
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/passwd" // also registers the "passwd" agent type
+	"github.com/infodancer/auth/tracing"
+)
+
+// Version is the semantic version of the authapi surface.
+const Version = "1.41.0"
+
+// Agents and sessions.
+type (
+	// Agent authenticates users; see auth.AuthenticationAgent.
+	Agent = auth.AuthenticationAgent
+
+	// AgentConfig configures an Agent opened from the registry.
+	AgentConfig = auth.AuthAgentConfig
+
+	// AgentFactory creates an Agent from configuration.
+	AgentFactory = auth.AuthAgentFactory
+
+	// KeyProvider retrieves users' public keys.
+	KeyProvider = auth.KeyProvider
+
+	// KeyGenerator creates key pairs for users who have none.
+	KeyGenerator = auth.KeyGenerator
+
+	// KeyPair is a public key with its private key.
+	KeyPair = auth.KeyPair
+
+	// KeyFormat tags the encoding of a public key; see
+	// PublicKeyWithFormat.
+	KeyFormat = auth.KeyFormat
+
+	// FormattedKeyProvider is a KeyProvider that tags its keys' formats.
+	FormattedKeyProvider = auth.FormattedKeyProvider
+
+	// MFAAgent checks a TOTP second factor; the Router implements it.
+	MFAAgent = auth.MFAAgent
+
+	// AuthTokenAgent mints and verifies session tokens; see package token.
+	AuthTokenAgent = auth.AuthTokenAgent
+
+	// SessionStore lists and revokes issued sessions; the Router
+	// implements it.
+	SessionStore = auth.SessionStore
+
+	// SessionInfo is a session kept by a SessionStore.
+	SessionInfo = auth.SessionInfo
+
+	// SenderAuthorizer decides which MAIL FROM addresses a user may use.
+	SenderAuthorizer = auth.SenderAuthorizer
+
+	// AddressLookup describes how an address is handled.
+	AddressLookup = auth.AddressLookup
+
+	// AddressInfo is the result of AddressLookup.
+	AddressInfo = auth.AddressInfo
+
+	// Session is an authenticated user with decrypted key material.
+	Session = auth.AuthSession
+
+	// User is an authenticated mail user.
+	User = auth.User
+
+	// Credential records which credential opened a Session.
+	Credential = auth.Credential
+
+	// CredentialKind is the kind of a Credential.
+	CredentialKind = auth.CredentialKind
+
+	// ChallengeProvider issues step-up challenges for web flows.
+	ChallengeProvider = auth.ChallengeProvider
+
+	// Challenge is a step-up challenge.
+	Challenge = auth.Challenge
+
+	// Credentials are a login's credentials as the client sent them; see
+	// Router.AuthenticateCredentials.
+	Credentials = auth.Credentials
+
+	// ChannelBinding is the TLS channel binding of Credentials.
+	ChannelBinding = auth.ChannelBinding
+
+	// CredentialsAuthenticator verifies non-plaintext Credentials.
+	CredentialsAuthenticator = auth.CredentialsAuthenticator
+
+	// ChallengeResponseVerifier verifies CRAM-MD5 and DIGEST-MD5
+	// Credentials against reversible passwords.
+	ChallengeResponseVerifier = auth.ChallengeResponseVerifier
+
+	// ExternalIdentity is a verified TLS client certificate for SASL
+	// EXTERNAL.
+	ExternalIdentity = auth.ExternalIdentity
+
+	// ExternalAuthenticator logs users in with an ExternalIdentity.
+	ExternalAuthenticator = auth.ExternalAuthenticator
+
+	// SCRAMCredentials are a stored SCRAM-SHA-256 verifier; see
+	// Router.GetSCRAMCredentials and package sasl/scram.
+	SCRAMCredentials = auth.SCRAMCredentials
+
+	// SCRAMCredentialProvider returns users' SCRAMCredentials.
+	SCRAMCredentialProvider = auth.SCRAMCredentialProvider
+
+	// AccountStatus describes a disabled, locked or mail-only account.
+	AccountStatus = auth.AccountStatus
+
+	// ServiceSet is the set of services an account may log in to.
+	ServiceSet = auth.ServiceSet
+
+	// AccountStatusProvider reports accounts' AccountStatus.
+	AccountStatusProvider = auth.AccountStatusProvider
+)
+
+// Domains and routing.
+type (
+	// Router routes logins to per-domain agents; see domain.AuthRouter.
+	Router = domain.AuthRouter
+
+	// AuthResult is a login's session and resolved domain.
+	AuthResult = domain.AuthResult
+
+	// Provider maps domain names to Domains.
+	Provider = domain.DomainProvider
+
+	// FilesystemProvider is the directory-tree Provider.
+	FilesystemProvider = domain.FilesystemDomainProvider
+
+	// Domain holds one mail domain's agents and settings.
+	Domain = domain.Domain
+
+	// DomainConfig is a domain's merged configuration.
+	DomainConfig = domain.DomainConfig
+
+	// DomainFilter narrows FilesystemProvider.DomainsIter and DomainsPage.
+	DomainFilter = domain.DomainFilter
+
+	// RateLimitConfig configures Router rate limiting.
+	RateLimitConfig = domain.RateLimitConfig
+
+	// ConnInfo describes the client connection of a login.
+	ConnInfo = domain.ConnInfo
+
+	// EventSource is a Provider that reports changes; see
+	// FilesystemProvider.Subscribe.
+	EventSource = domain.EventSource
+
+	// Event is a change reported by an EventSource.
+	Event = domain.Event
+
+	// EventType identifies what an Event reports.
+	EventType = domain.EventType
+
+	// Change is the lifecycle step an Event records.
+	Change = domain.Change
+
+	// CertInfo is a verified TLS client certificate for
+	// Router.AuthenticateExternal.
+	CertInfo = domain.CertInfo
+
+	// DomainUsage is a billing snapshot of one domain's accounts; see
+	// FilesystemProvider.UsageReport.
+	DomainUsage = domain.DomainUsage
+
+	// UsageExporter writes periodic DomainUsage snapshots to files.
+	UsageExporter = domain.UsageExporter
+
+	// FreezeRecord is one freeze or thaw of a domain; see
+	// FilesystemProvider.FreezeDomain.
+	FreezeRecord = domain.FreezeRecord
+
+	// Auditor receives an AuditRecord for every login and user lookup of a
+	// Router; see Router.WithAuditor.
+	Auditor = audit.Auditor
+
+	// AuditRecord is one audited Router call.
+	AuditRecord = audit.Record
+
+	// MailboxMapper maps an authenticated user to their mailbox; see
+	// RegisterMailboxMapper.
+	MailboxMapper = domain.MailboxMapper
+
+	// Tracer starts the spans of auth calls; see SetTracer.
+	Tracer = tracing.Tracer
+
+	// TraceSpan is a span started by a Tracer.
+	TraceSpan = tracing.Span
+
+	// TraceAttr is a span attribute.
+	TraceAttr = tracing.Attr
+
+	// AuthFunc is a credential login as Router.AuthenticateCredentials
+	// performs it.
+	AuthFunc = domain.AuthFunc
+
+	// Middleware wraps a Router's credential logins; see
+	// Router.WithMiddleware.
+	Middleware = domain.Middleware
+
+	// Tarpit delays logins after consecutive failures; install its
+	// Middleware method with Router.WithMiddleware.
+	Tarpit = domain.Tarpit
+
+	// TarpitConfig holds the delays of a Tarpit.
+	TarpitConfig = domain.TarpitConfig
+
+	// ImpersonationRequest asks for an impersonation token; see
+	// Router.MintImpersonationToken.
+	ImpersonationRequest = domain.ImpersonationRequest
+
+	// Impersonation is the grant an impersonation token carries.
+	Impersonation = domain.Impersonation
+
+	// PasswordPolicy describes generated passwords; see GeneratePassword
+	// and Domain.PasswordPolicy.
+	PasswordPolicy = passwd.PasswordPolicy
+
+	// Address is a parsed mail address; see ParseAddress.
+	Address = address.Address
+)
+
+// Credential kinds.
+const (
+	CredentialPassword      = auth.CredentialPassword
+	CredentialAppPassword   = auth.CredentialAppPassword
+	CredentialCertificate   = auth.CredentialCertificate
+	CredentialImpersonation = auth.CredentialImpersonation
+	CredentialBearerToken   = auth.CredentialBearerToken
+	CredentialKerberos      = auth.CredentialKerberos
+	CredentialSessionToken  = auth.CredentialSessionToken
+)
+
+// Key formats, for KeyFormat.
+const (
+	KeyFormatNative  = auth.KeyFormatNative
+	KeyFormatOpenPGP = auth.KeyFormatOpenPGP
+)
+
+// Services, for User.Services.
+const (
+	ServiceIMAP    = auth.ServiceIMAP
+	ServicePOP3    = auth.ServicePOP3
+	ServiceSMTP    = auth.ServiceSMTP
+	ServiceWebmail = auth.ServiceWebmail
+	ServiceNone    = auth.ServiceNone
+)
+
+// Event types.
+const (
+	EventDomainAdded    = domain.EventDomainAdded
+	EventDomainRemoved  = domain.EventDomainRemoved
+	EventDomainReloaded = domain.EventDomainReloaded
+	EventUserChanged    = domain.EventUserChanged
+	EventDomainFrozen   = domain.EventDomainFrozen
+)
+
+// Event changes.
+const (
+	ChangeCreated  = domain.ChangeCreated
+	ChangeDeleted  = domain.ChangeDeleted
+	ChangeRenamed  = domain.ChangeRenamed
+	ChangeDisabled = domain.ChangeDisabled
+	ChangeEnabled  = domain.ChangeEnabled
+	ChangeModified = domain.ChangeModified
+)
+
+// QuarantineFolder is the folder mail for accounts deleted with a grace
+// period is filed into.
+const QuarantineFolder = domain.QuarantineFolder
+
+// Errors. These are the sentinels defined in package errors.
+var (
+	ErrAuthFailed            = autherrors.ErrAuthFailed
+	ErrUserNotFound          = autherrors.ErrUserNotFound
+	ErrRateLimited           = autherrors.ErrRateLimited
+	ErrLoginDenied           = autherrors.ErrLoginDenied
+	ErrStepUpRequired        = autherrors.ErrStepUpRequired
+	ErrMFARequired           = autherrors.ErrMFARequired
+	ErrTLSRequired           = autherrors.ErrTLSRequired
+	ErrAccessDenied          = autherrors.ErrAccessDenied
+	ErrTokenExpired          = autherrors.ErrTokenExpired
+	ErrSessionRevoked        = autherrors.ErrSessionRevoked
+	ErrSessionNotFound       = autherrors.ErrSessionNotFound
+	ErrMechanismUnsupported  = autherrors.ErrMechanismUnsupported
+	ErrAuthorizationDenied   = autherrors.ErrAuthorizationDenied
+	ErrBackendUnavailable    = autherrors.ErrBackendUnavailable
+	ErrAccountDisabled       = autherrors.ErrAccountDisabled
+	ErrDomainFrozen          = autherrors.ErrDomainFrozen
+	ErrServiceDenied         = autherrors.ErrServiceDenied
+	ErrReadOnly              = autherrors.ErrReadOnly
+	ErrAgentNotRegistered    = autherrors.ErrAuthAgentNotRegistered
+	ErrAgentConfigInvalid    = autherrors.ErrAuthAgentConfigInvalid
+	ErrKeyNotFound           = autherrors.ErrKeyNotFound
+	ErrKeyExists             = autherrors.ErrKeyExists
+	ErrKeyPassphraseRequired = autherrors.ErrKeyPassphraseRequired
+	ErrInvalidAddress        = address.ErrInvalid
+)
+
+// NewRouter returns a Router over provider with fallback for addresses no
+// domain serves. Either may be nil.
+func NewRouter(provider Provider, fallback Agent) *Router {
+	return domain.NewAuthRouter(provider, fallback)
+}
+
+// NewFilesystemProvider returns a Provider reading domains from basePath.
+// A nil logger uses slog.Default().
+func NewFilesystemProvider(basePath string, logger *slog.Logger) *FilesystemProvider {
+	return domain.NewFilesystemDomainProvider(basePath, logger)
+}
+
+// CertInfoFromCertificate returns the CertInfo of a verified client
+// certificate.
+func CertInfoFromCertificate(cert *x509.Certificate) CertInfo {
+	return domain.CertInfoFromCertificate(cert)
+}
+
+// NewUsageExporter returns an exporter writing usage snapshots of
+// provider's domains into dir as "json" or "csv". A nil logger uses
+// slog.Default().
+func NewUsageExporter(provider *FilesystemProvider, dir, format string, logger *slog.Logger) (*UsageExporter, error) {
+	return domain.NewUsageExporter(provider, dir, format, logger)
+}
+
+// PublicKeyWithFormat returns username's public key from kp with its
+// format, KeyFormatNative unless kp is a FormattedKeyProvider.
+func PublicKeyWithFormat(ctx context.Context, kp KeyProvider, username string) ([]byte, KeyFormat, error) {
+	return auth.PublicKeyWithFormat(ctx, kp, username)
+}
+
+// GetPublicKeysOneByOne implements KeyProvider.GetPublicKeys with get,
+// for backends that fetch keys one user at a time.
+func GetPublicKeysOneByOne(ctx context.Context, get func(context.Context, string) ([]byte, error), usernames []string) (map[string][]byte, error) {
+	return auth.GetPublicKeysOneByOne(ctx, get, usernames)
+}
+
+// NewWKDHandler returns an http.Handler serving the OpenPGP keys of the
+// users of provider's domains as a Web Key Directory; mount it at
+// /.well-known/openpgpkey/.
+func NewWKDHandler(provider Provider) http.Handler {
+	return domain.NewWKDHandler(provider)
+}
+
+// RegisterAgent adds an agent type to the registry. It panics on an empty
+// name, a nil factory or a duplicate registration.
+func RegisterAgent(name string, factory AgentFactory) {
+	auth.RegisterAuthAgent(name, factory)
+}
+
+// OpenAgent opens an Agent of the registered type named by cfg.Type.
+func OpenAgent(cfg AgentConfig) (Agent, error) {
+	return auth.OpenAuthAgent(cfg)
+}
+
+// RegisteredAgents returns the registered agent type names, sorted.
+func RegisteredAgents() []string {
+	return auth.RegisteredAuthAgents()
+}
+
+// SetTracer installs t to trace auth calls in this process; nil turns
+// tracing off. See package tracing for the spans and attributes.
+func SetTracer(t Tracer) {
+	tracing.SetTracer(t)
+}
+
+// RegisterMailboxMapper adds a mailbox mapping strategy that domains can
+// select with msgstore.mailbox. It panics on an empty name, a nil mapper or
+// a duplicate registration.
+func RegisterMailboxMapper(name string, m MailboxMapper) {
+	domain.RegisterMailboxMapper(name, m)
+}
+
+// NewTarpit returns a Tarpit with cfg; zero fields take their defaults
+// from DefaultTarpitConfig.
+func NewTarpit(cfg TarpitConfig) *Tarpit {
+	return domain.NewTarpit(cfg)
+}
+
+// DefaultTarpitConfig returns sensible defaults for a Tarpit.
+func DefaultTarpitConfig() TarpitConfig {
+	return domain.DefaultTarpitConfig()
+}
+
+// GeneratePassword returns a random password satisfying policy, for
+// provisioning accounts without a user-chosen password.
+func GeneratePassword(policy PasswordPolicy) (string, error) {
+	return passwd.GeneratePassword(policy)
+}
+
+// ParseAddress parses a mail address the way the router, forwards and
+// delivery do: display names and comments are dropped, quoted localparts
+// unquoted, and the domain made canonical (lowercase, IDN labels in
+// punycode). Errors wrap ErrInvalidAddress.
+func ParseAddress(s string) (Address, error) {
+	return address.Parse(s)
+}
+
+// WithClientIP returns a context carrying the client IP for rate limiting
+// and login history.
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return domain.WithClientIP(ctx, ip)
+}
+
+// WithProtocol returns a context carrying the protocol a login arrives on.
+func WithProtocol(ctx context.Context, protocol string) context.Context {
+	return domain.WithProtocol(ctx, protocol)
+}
+
+// WithConnInfo returns a context carrying the client connection details.
+func WithConnInfo(ctx context.Context, info ConnInfo) context.Context {
+	return domain.WithConnInfo(ctx, info)
+}
@@ -0,0 +1,46 @@
+package authapi_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/infodancer/auth/authapi"
+	"github.com/infodancer/auth/domain"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+func TestRegistersPasswdAgent(t *testing.T) {
+	if !slices.Contains(authapi.RegisteredAgents(), "passwd") {
+		t.Errorf("RegisteredAgents() = %v, want passwd registered", authapi.RegisteredAgents())
+	}
+	_, err := authapi.OpenAgent(authapi.AgentConfig{Type: "no-such-agent"})
+	if !errors.Is(err, autherrors.ErrAuthAgentNotRegistered) || !errors.Is(err, authapi.ErrAgentNotRegistered) {
+		t.Errorf("OpenAgent unknown type: got %v", err)
+	}
+}
+
+func TestAliasesInteroperate(t *testing.T) {
+	// Values built through authapi are the underlying package types.
+	var r *domain.AuthRouter = authapi.NewRouter(nil, nil)
+	if _, err := r.Authenticate(context.Background(), "alice@example.com", "pw"); !errors.Is(err, authapi.ErrAuthFailed) {
+		t.Errorf("got %v, want ErrAuthFailed", err)
+	}
+
+	wrapped := fmt.Errorf("login: %w", autherrors.ErrTLSRequired)
+	if !errors.Is(wrapped, authapi.ErrTLSRequired) {
+		t.Error("authapi errors must be the package errors sentinels")
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	a, err := authapi.ParseAddress("Alice <alice+news@Bücher.example>")
+	if err != nil || a.Local != "alice+news" || a.Domain != "xn--bcher-kva.example" {
+		t.Errorf("ParseAddress = %+v, %v", a, err)
+	}
+	if _, err := authapi.ParseAddress("no at sign"); !errors.Is(err, authapi.ErrInvalidAddress) {
+		t.Errorf("ParseAddress(invalid) error = %v, want ErrInvalidAddress", err)
+	}
+}
@@ -0,0 +1,132 @@
+// Package checkpassword implements the djb checkpassword interface, used by
+// qmail-pop3d and other qmail-style tools to delegate password checks.
+//
+// The caller runs the checker with a child program as its arguments and
+// writes the login to file descriptor 3 as NUL-terminated fields:
+//
+//	username\0password\0timestamp\0
+//
+// at most 512 bytes in all (the timestamp is for APOP and is ignored). On
+// success the checker executes the child with the user's environment; on
+// failure it exits with ExitFailure, ExitUsage or ExitTemporary. This
+// package parses the request and checks it against any
+// auth.AuthenticationAgent; cmd/checkpassword does the exec.
+package checkpassword
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// MaxRequest is the largest request the interface allows on descriptor 3.
+const MaxRequest = 512
+
+// Exit statuses defined by the checkpassword interface.
+const (
+	ExitFailure   = 1   // wrong password, unknown user, or login refused
+	ExitUsage     = 2   // malformed request or no child program
+	ExitTemporary = 111 // backend error; the caller may retry later
+)
+
+// ErrMalformed is returned by ReadRequest for a request that does not follow
+// the interface.
+var ErrMalformed = errors.New("checkpassword: malformed request")
+
+// ReadRequest reads a request from r and returns the username and password.
+func ReadRequest(r io.Reader) (username, password string, err error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxRequest+1))
+	if err != nil {
+		return "", "", fmt.Errorf("read request: %w", err)
+	}
+	if len(data) > MaxRequest {
+		return "", "", fmt.Errorf("%w: longer than %d bytes", ErrMalformed, MaxRequest)
+	}
+	fields := bytes.SplitN(data, []byte{0}, 3)
+	if len(fields) < 3 {
+		return "", "", fmt.Errorf("%w: missing NUL terminator", ErrMalformed)
+	}
+	if len(fields[0]) == 0 {
+		return "", "", fmt.Errorf("%w: empty username", ErrMalformed)
+	}
+	return string(fields[0]), string(fields[1]), nil
+}
+
+// Check reads a request from r and authenticates it with agent. It returns
+// the authenticated user on success, and otherwise the exit status to report
+// with the error that caused it. Key material in the session is cleared,
+// since the child never receives it.
+func Check(ctx context.Context, agent auth.AuthenticationAgent, r io.Reader) (*auth.User, int, error) {
+	username, password, err := ReadRequest(r)
+	if err != nil {
+		return nil, ExitUsage, err
+	}
+	session, err := agent.Authenticate(ctx, username, password)
+	if err != nil {
+		return nil, ExitStatus(err), err
+	}
+	user := &auth.User{Username: username}
+	if session.User != nil {
+		user.Mailbox = session.User.Mailbox
+		user.Uid, user.Gid = session.User.Uid, session.User.Gid
+		if session.User.Username != "" {
+			user.Username = session.User.Username
+		}
+	}
+	session.Clear()
+	return user, 0, nil
+}
+
+// ExitStatus maps an authentication error to a checkpassword exit status:
+// ExitFailure for credential and policy failures, which the caller should
+// not retry, and ExitTemporary for anything else.
+func ExitStatus(err error) int {
+	switch {
+	case errors.Is(err, autherrors.ErrAuthFailed),
+		errors.Is(err, autherrors.ErrUserNotFound),
+		errors.Is(err, autherrors.ErrTLSRequired),
+		errors.Is(err, autherrors.ErrAccessDenied),
+		errors.Is(err, autherrors.ErrRateLimited),
+		errors.Is(err, autherrors.ErrLoginDenied),
+		errors.Is(err, autherrors.ErrStepUpRequired),
+		errors.Is(err, autherrors.ErrMFARequired),
+		errors.Is(err, autherrors.ErrAccountDisabled):
+		return ExitFailure
+	default:
+		return ExitTemporary
+	}
+}
+
+// Env returns environ updated for the child of a successful check: USER is
+// the authenticated username and MAILBOX the user's mailbox. When the
+// mailbox is an absolute path HOME is set to it, as qmail-pop3d expects to
+// find its maildir relative to HOME.
+func Env(environ []string, user *auth.User) []string {
+	set := map[string]string{
+		"USER":    user.Username,
+		"MAILBOX": user.Mailbox,
+	}
+	if filepath.IsAbs(user.Mailbox) {
+		set["HOME"] = user.Mailbox
+	}
+	env := make([]string, 0, len(environ)+len(set))
+	for _, kv := range environ {
+		name, _, _ := strings.Cut(kv, "=")
+		if _, ok := set[name]; !ok {
+			env = append(env, kv)
+		}
+	}
+	for _, name := range []string{"USER", "MAILBOX", "HOME"} {
+		if v, ok := set[name]; ok {
+			env = append(env, name+"="+v)
+		}
+	}
+	return env
+}
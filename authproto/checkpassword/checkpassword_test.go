@@ -0,0 +1,125 @@
+package checkpassword
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// stubAgent accepts alice@example.com/secret.
+type stubAgent struct {
+	fail    error
+	session *auth.AuthSession
+}
+
+func (a *stubAgent) Authenticate(_ context.Context, username, password string) (*auth.AuthSession, error) {
+	if a.fail != nil {
+		return nil, a.fail
+	}
+	if username != "alice@example.com" {
+		return nil, autherrors.ErrUserNotFound
+	}
+	if password != "secret" {
+		return nil, autherrors.ErrAuthFailed
+	}
+	a.session = &auth.AuthSession{
+		User:       &auth.User{Username: username, Mailbox: "/var/mail/example.com/alice", Uid: 1001, Gid: 100},
+		PrivateKey: []byte{1, 2, 3},
+	}
+	return a.session, nil
+}
+
+func (a *stubAgent) UserExists(context.Context, string) (bool, error) { return true, nil }
+func (a *stubAgent) Close() error                                     { return nil }
+
+func TestReadRequest(t *testing.T) {
+	tests := []struct {
+		name, in   string
+		user, pass string
+		wantErr    bool
+	}{
+		{"with timestamp", "alice\x00secret\x00<123@host>\x00", "alice", "secret", false},
+		{"empty timestamp", "alice\x00secret\x00\x00", "alice", "secret", false},
+		{"empty password", "alice\x00\x00\x00", "alice", "", false},
+		{"missing terminator", "alice\x00secret", "", "", true},
+		{"empty username", "\x00secret\x00\x00", "", "", true},
+		{"too long", "alice\x00" + strings.Repeat("x", MaxRequest) + "\x00\x00", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, pass, err := ReadRequest(strings.NewReader(tt.in))
+			if tt.wantErr {
+				if !errors.Is(err, ErrMalformed) {
+					t.Fatalf("err = %v, want ErrMalformed", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user != tt.user || pass != tt.pass {
+				t.Errorf("got %q/%q, want %q/%q", user, pass, tt.user, tt.pass)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	agent := &stubAgent{}
+	user, status, err := Check(t.Context(), agent, strings.NewReader("alice@example.com\x00secret\x00\x00"))
+	if err != nil || status != 0 {
+		t.Fatalf("Check = %d, %v", status, err)
+	}
+	if user.Username != "alice@example.com" || user.Mailbox != "/var/mail/example.com/alice" || user.Uid != 1001 || user.Gid != 100 {
+		t.Errorf("user = %+v", user)
+	}
+	if agent.session.PrivateKey != nil {
+		t.Error("session key material not cleared")
+	}
+
+	tests := []struct {
+		name, in string
+		fail     error
+		want     int
+	}{
+		{"wrong password", "alice@example.com\x00nope\x00\x00", nil, ExitFailure},
+		{"unknown user", "bob@example.com\x00secret\x00\x00", nil, ExitFailure},
+		{"malformed", "alice@example.com", nil, ExitUsage},
+		{"rate limited", "alice@example.com\x00secret\x00\x00", autherrors.ErrRateLimited, ExitFailure},
+		{"access denied", "alice@example.com\x00secret\x00\x00", autherrors.ErrAccessDenied, ExitFailure},
+		{"backend error", "alice@example.com\x00secret\x00\x00", errors.New("disk on fire"), ExitTemporary},
+		{"wrapped failure", "alice@example.com\x00secret\x00\x00",
+			fmt.Errorf("%w: bad hash", autherrors.ErrAuthFailed), ExitFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, status, err := Check(t.Context(), &stubAgent{fail: tt.fail}, strings.NewReader(tt.in))
+			if err == nil || status != tt.want {
+				t.Errorf("Check = %d, %v; want status %d", status, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnv(t *testing.T) {
+	environ := []string{"PATH=/bin", "USER=root", "HOME=/root", "TCPREMOTEIP=192.0.2.1"}
+
+	got := Env(environ, &auth.User{Username: "alice@example.com", Mailbox: "/var/mail/alice"})
+	want := []string{"PATH=/bin", "TCPREMOTEIP=192.0.2.1",
+		"USER=alice@example.com", "MAILBOX=/var/mail/alice", "HOME=/var/mail/alice"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Env = %v, want %v", got, want)
+	}
+
+	// A relative mailbox identifier leaves HOME alone.
+	got = Env(environ, &auth.User{Username: "alice@example.com", Mailbox: "alice"})
+	if !slices.Contains(got, "HOME=/root") || !slices.Contains(got, "MAILBOX=alice") {
+		t.Errorf("Env = %v, want HOME kept and MAILBOX=alice", got)
+	}
+}
@@ -0,0 +1,393 @@
+// Package dovecot serves any auth.AuthenticationAgent over the Dovecot
+// authentication protocol (version 1.2), the "client" socket Postfix uses
+// with smtpd_sasl_type = dovecot and Exim with its dovecot authenticator.
+// Existing installations can point their SASL configuration at this server
+// and move authentication to the infodancer auth layer without touching
+// the MTA.
+//
+// Only the client side of the protocol is implemented: the PLAIN and LOGIN
+// mechanisms, and no master/userdb requests. A session looks like:
+//
+//	S: VERSION	1	2
+//	S: MECH	PLAIN	plaintext
+//	S: MECH	LOGIN	plaintext
+//	S: SPID	1234
+//	S: CUID	1
+//	S: COOKIE	<hex>
+//	S: DONE
+//	C: VERSION	1	2
+//	C: CPID	5678
+//	C: AUTH	1	PLAIN	service=smtp	rip=192.0.2.1	secured	resp=<base64>
+//	S: OK	1	user=alice@example.com
+//
+// The rip, service and secured parameters reach the agent as the client
+// IP, protocol and ConnInfo.TLS; local_name (the TLS SNI hostname), lip and
+// lport as ConnInfo.ServerName and LocalAddr, for realm routing (see
+// domain.AuthRouter.WithRealms).
+//
+// Wrong credentials and unknown users both fail with FAIL, so the client
+// cannot tell them apart; backend errors fail with the "temp" flag.
+package dovecot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/domain"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// Protocol version spoken by this server.
+const (
+	versionMajor = 1
+	versionMinor = 2
+)
+
+// maxLineLength bounds a protocol line, base64 responses included.
+const maxLineLength = 16 * 1024
+
+// maxPending bounds the AUTH requests awaiting CONT on one connection.
+const maxPending = 64
+
+// Server answers Dovecot auth protocol requests using Agent.
+type Server struct {
+	// Agent validates credentials, typically a domain.AuthRouter.
+	Agent auth.AuthenticationAgent
+
+	// Logger receives connection errors; nil uses slog.Default.
+	Logger *slog.Logger
+
+	cuid atomic.Uint64
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// ErrServerClosed is returned by Serve after Close.
+var ErrServerClosed = errors.New("dovecot: server closed")
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+// ListenAndServe listens on the UNIX socket at path, replacing a stale
+// socket file, and serves it. The socket is created with mode 0660; set the
+// group so only the MTA can connect.
+func (s *Server) ListenAndServe(path string) error {
+	_ = os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0o660); err != nil {
+		_ = l.Close()
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until it fails or Close is called.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.track(l, nil) {
+		_ = l.Close()
+		return ErrServerClosed
+	}
+	defer s.untrack(l, nil)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// Close stops all listeners and closes open connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var errs []error
+	for l := range s.listeners {
+		errs = append(errs, l.Close())
+	}
+	for c := range s.conns {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// track registers a listener or connection; false if the server is closed.
+func (s *Server) track(l net.Listener, c net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if l != nil {
+		if s.listeners == nil {
+			s.listeners = make(map[net.Listener]struct{})
+		}
+		s.listeners[l] = struct{}{}
+	}
+	if c != nil {
+		if s.conns == nil {
+			s.conns = make(map[net.Conn]struct{})
+		}
+		s.conns[c] = struct{}{}
+	}
+	return true
+}
+
+func (s *Server) untrack(l net.Listener, c net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, l)
+	delete(s.conns, c)
+}
+
+// pending is an AUTH request waiting for CONT responses.
+type pending struct {
+	mech     string
+	params   map[string]string
+	username string // LOGIN: set after the first response
+}
+
+// ServeConn runs the protocol on one connection and closes it.
+func (s *Server) ServeConn(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	if !s.track(nil, conn) {
+		return
+	}
+	defer s.untrack(nil, conn)
+
+	cookie := make([]byte, 16)
+	if _, err := rand.Read(cookie); err != nil {
+		s.logger().Error("dovecot auth: generate cookie", slog.String("error", err.Error()))
+		return
+	}
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "VERSION\t%d\t%d\n", versionMajor, versionMinor)
+	fmt.Fprintf(w, "MECH\tPLAIN\tplaintext\n")
+	fmt.Fprintf(w, "MECH\tLOGIN\tplaintext\n")
+	fmt.Fprintf(w, "SPID\t%d\n", os.Getpid())
+	fmt.Fprintf(w, "CUID\t%d\n", s.cuid.Add(1))
+	fmt.Fprintf(w, "COOKIE\t%s\n", hex.EncodeToString(cookie))
+	fmt.Fprintf(w, "DONE\n")
+	if err := w.Flush(); err != nil {
+		return
+	}
+
+	r := bufio.NewReaderSize(conn, maxLineLength)
+	requests := make(map[string]*pending)
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !s.isClosed() {
+				s.logger().Debug("dovecot auth: read", slog.String("error", err.Error()))
+			}
+			return
+		}
+		fields := strings.Split(line, "\t")
+		switch fields[0] {
+		case "VERSION":
+			if len(fields) < 2 || fields[1] != strconv.Itoa(versionMajor) {
+				s.logger().Warn("dovecot auth: unsupported client version", slog.String("line", line))
+				return
+			}
+		case "CPID":
+		case "AUTH":
+			if len(fields) < 3 {
+				return
+			}
+			if len(requests) >= maxPending {
+				s.logger().Warn("dovecot auth: too many pending requests")
+				return
+			}
+			id, mech := fields[1], strings.ToUpper(fields[2])
+			p := &pending{mech: mech, params: parseParams(fields[3:])}
+			resp, haveResp := p.params["resp"]
+			s.step(w, requests, id, p, resp, haveResp)
+		case "CONT":
+			if len(fields) < 2 {
+				return
+			}
+			p, ok := requests[fields[1]]
+			if !ok {
+				fmt.Fprintf(w, "FAIL\t%s\n", fields[1])
+				break
+			}
+			var resp string
+			if len(fields) > 2 {
+				resp = fields[2]
+			}
+			s.step(w, requests, fields[1], p, resp, true)
+		default:
+			s.logger().Debug("dovecot auth: unknown command", slog.String("command", fields[0]))
+			return
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// step advances request id given a client response (haveResp false for an
+// AUTH without an initial response), writing CONT, OK or FAIL.
+func (s *Server) step(w io.Writer, requests map[string]*pending, id string, p *pending, resp string, haveResp bool) {
+	delete(requests, id)
+	var data []byte
+	if haveResp {
+		var err error
+		if data, err = base64.StdEncoding.DecodeString(resp); err != nil {
+			fmt.Fprintf(w, "FAIL\t%s\treason=Invalid base64 data\n", id)
+			return
+		}
+	}
+
+	switch p.mech {
+	case "PLAIN":
+		if !haveResp {
+			requests[id] = p
+			fmt.Fprintf(w, "CONT\t%s\t\n", id)
+			return
+		}
+		parts := bytes.Split(data, []byte{0})
+		if len(parts) != 3 {
+			fmt.Fprintf(w, "FAIL\t%s\treason=Invalid PLAIN data\n", id)
+			return
+		}
+		authzid, authcid := string(parts[0]), string(parts[1])
+		if authzid != "" && authzid != authcid {
+			fmt.Fprintf(w, "FAIL\t%s\tuser=%s\treason=Authorization identity not permitted\n", id, escape(authcid))
+			return
+		}
+		s.authenticate(w, id, p.params, authcid, string(parts[2]))
+	case "LOGIN":
+		switch {
+		case !haveResp:
+			requests[id] = p
+			fmt.Fprintf(w, "CONT\t%s\t%s\n", id, base64.StdEncoding.EncodeToString([]byte("Username:")))
+		case p.username == "":
+			if len(data) == 0 {
+				fmt.Fprintf(w, "FAIL\t%s\treason=Empty username\n", id)
+				return
+			}
+			p.username = string(data)
+			requests[id] = p
+			fmt.Fprintf(w, "CONT\t%s\t%s\n", id, base64.StdEncoding.EncodeToString([]byte("Password:")))
+		default:
+			s.authenticate(w, id, p.params, p.username, string(data))
+		}
+	default:
+		fmt.Fprintf(w, "FAIL\t%s\treason=Unsupported authentication mechanism\n", id)
+	}
+}
+
+// authenticate checks the credentials with the agent and writes the result.
+func (s *Server) authenticate(w io.Writer, id string, params map[string]string, username, password string) {
+	ctx := context.Background()
+	if ip := params["rip"]; ip != "" {
+		ctx = domain.WithClientIP(ctx, ip)
+	}
+	if service := params["service"]; service != "" {
+		ctx = domain.WithProtocol(ctx, service)
+	}
+	_, secured := params["secured"]
+	info := domain.ConnInfo{TLS: secured, ServerName: params["local_name"], LocalAddr: params["lip"]}
+	if info.LocalAddr != "" && params["lport"] != "" {
+		info.LocalAddr = net.JoinHostPort(info.LocalAddr, params["lport"])
+	}
+	ctx = domain.WithConnInfo(ctx, info)
+
+	session, err := s.Agent.Authenticate(ctx, username, password)
+	if err == nil {
+		user := username
+		if session.User != nil && session.User.Username != "" {
+			user = session.User.Username
+		}
+		session.Clear()
+		fmt.Fprintf(w, "OK\t%s\tuser=%s\n", id, escape(user))
+		return
+	}
+
+	u := escape(username)
+	switch {
+	case errors.Is(err, autherrors.ErrAuthFailed), errors.Is(err, autherrors.ErrUserNotFound):
+		fmt.Fprintf(w, "FAIL\t%s\tuser=%s\n", id, u)
+	case errors.Is(err, autherrors.ErrTLSRequired):
+		fmt.Fprintf(w, "FAIL\t%s\tuser=%s\treason=Encryption required\n", id, u)
+	case errors.Is(err, autherrors.ErrAccountDisabled):
+		fmt.Fprintf(w, "FAIL\t%s\tuser=%s\treason=Account disabled\n", id, u)
+	case errors.Is(err, autherrors.ErrRateLimited), errors.Is(err, autherrors.ErrLoginDenied),
+		errors.Is(err, autherrors.ErrStepUpRequired), errors.Is(err, autherrors.ErrMFARequired),
+		errors.Is(err, autherrors.ErrAccessDenied):
+		fmt.Fprintf(w, "FAIL\t%s\tuser=%s\treason=Login not permitted\n", id, u)
+	default:
+		s.logger().Error("dovecot auth: backend error",
+			slog.String("username", username),
+			slog.String("error", err.Error()))
+		fmt.Fprintf(w, "FAIL\t%s\tuser=%s\ttemp\n", id, u)
+	}
+}
+
+// readLine reads one LF-terminated line without the terminator, rejecting
+// lines longer than maxLineLength.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", errors.New("line too long")
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimRight(line, "\r\n")), nil
+}
+
+// parseParams splits "key=value" and bare flag arguments.
+func parseParams(args []string) map[string]string {
+	params := make(map[string]string, len(args))
+	for _, a := range args {
+		k, v, _ := strings.Cut(a, "=")
+		params[k] = unescape(v)
+	}
+	return params
+}
+
+// Protocol escaping: tab, LF and the escape character itself.
+var (
+	escaper   = strings.NewReplacer("\x01", "\x011", "\t", "\x01t", "\r", "\x01r", "\n", "\x01n")
+	unescaper = strings.NewReplacer("\x011", "\x01", "\x01t", "\t", "\x01r", "\r", "\x01n", "\n")
+)
+
+func escape(s string) string   { return escaper.Replace(s) }
+func unescape(s string) string { return unescaper.Replace(s) }
@@ -0,0 +1,172 @@
+package dovecot
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/domain"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// stubAgent accepts alice/secret and records the last context.
+type stubAgent struct {
+	fail error
+	ctx  context.Context
+}
+
+func (a *stubAgent) Authenticate(ctx context.Context, username, password string) (*auth.AuthSession, error) {
+	a.ctx = ctx
+	if a.fail != nil {
+		return nil, a.fail
+	}
+	if username != "alice@example.com" {
+		return nil, autherrors.ErrUserNotFound
+	}
+	if password != "secret" {
+		return nil, autherrors.ErrAuthFailed
+	}
+	return &auth.AuthSession{User: &auth.User{Username: username}}, nil
+}
+
+func (a *stubAgent) UserExists(context.Context, string) (bool, error) { return true, nil }
+func (a *stubAgent) Close() error                                     { return nil }
+
+// client is the MTA end of a connection.
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, agent auth.AuthenticationAgent) *client {
+	t.Helper()
+	srvConn, cliConn := net.Pipe()
+	s := &Server{Agent: agent}
+	go s.ServeConn(srvConn)
+	t.Cleanup(func() { _ = cliConn.Close() })
+
+	c := &client{t: t, conn: cliConn, r: bufio.NewReader(cliConn)}
+	var handshake []string
+	for {
+		line := c.read()
+		handshake = append(handshake, strings.SplitN(line, "\t", 2)[0])
+		if line == "DONE" {
+			break
+		}
+	}
+	if got := strings.Join(handshake, " "); got != "VERSION MECH MECH SPID CUID COOKIE DONE" {
+		t.Fatalf("handshake = %s", got)
+	}
+	c.send("VERSION\t1\t2")
+	c.send("CPID\t42")
+	return c
+}
+
+func (c *client) send(line string) {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(line + "\n")); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *client) read() string {
+	c.t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return strings.TrimSuffix(line, "\n")
+}
+
+func b64(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+func TestPLAIN(t *testing.T) {
+	agent := &stubAgent{}
+	c := dial(t, agent)
+
+	c.send("AUTH\t1\tPLAIN\tservice=smtp\trip=192.0.2.1\tsecured\tresp=" + b64("\x00alice@example.com\x00secret"))
+	if got := c.read(); got != "OK\t1\tuser=alice@example.com" {
+		t.Errorf("good password: %q", got)
+	}
+	if info, ok := agent.ctx.Value(domain.ConnInfoKey).(domain.ConnInfo); !ok || !info.TLS {
+		t.Errorf("ConnInfo = %+v, %v; want TLS from the secured flag", info, ok)
+	}
+	if ip, _ := agent.ctx.Value(domain.ClientIPKey).(string); ip != "192.0.2.1" {
+		t.Errorf("client IP = %q", ip)
+	}
+
+	c.send("AUTH\t4\tPLAIN\tlocal_name=mail.example.com\tlip=203.0.113.7\tlport=993\tresp=" + b64("\x00alice@example.com\x00secret"))
+	if got := c.read(); got != "OK\t4\tuser=alice@example.com" {
+		t.Errorf("realm hints: %q", got)
+	}
+	if info, _ := agent.ctx.Value(domain.ConnInfoKey).(domain.ConnInfo); info.ServerName != "mail.example.com" || info.LocalAddr != "203.0.113.7:993" || info.TLS {
+		t.Errorf("ConnInfo = %+v, want server name and local address", info)
+	}
+
+	c.send("AUTH\t2\tPLAIN\tservice=smtp\tresp=" + b64("\x00alice@example.com\x00wrong"))
+	if got := c.read(); got != "FAIL\t2\tuser=alice@example.com" {
+		t.Errorf("wrong password: %q", got)
+	}
+	c.send("AUTH\t3\tPLAIN\tservice=smtp\tresp=" + b64("\x00bob@example.com\x00secret"))
+	if got := c.read(); got != "FAIL\t3\tuser=bob@example.com" {
+		t.Errorf("unknown user: %q", got)
+	}
+
+	// Without an initial response the server asks for one.
+	c.send("AUTH\t4\tPLAIN\tservice=smtp")
+	if got := c.read(); got != "CONT\t4\t" {
+		t.Fatalf("no initial response: %q", got)
+	}
+	c.send("CONT\t4\t" + b64("alice@example.com\x00alice@example.com\x00secret"))
+	if got := c.read(); got != "OK\t4\tuser=alice@example.com" {
+		t.Errorf("after CONT: %q", got)
+	}
+
+	c.send("AUTH\t5\tPLAIN\tservice=smtp\tresp=" + b64("admin\x00alice@example.com\x00secret"))
+	if got := c.read(); !strings.HasPrefix(got, "FAIL\t5\t") {
+		t.Errorf("foreign authzid: %q", got)
+	}
+}
+
+func TestLOGIN(t *testing.T) {
+	c := dial(t, &stubAgent{})
+	c.send("AUTH\t7\tLOGIN\tservice=smtp")
+	if got := c.read(); got != "CONT\t7\t"+b64("Username:") {
+		t.Fatalf("first challenge: %q", got)
+	}
+	c.send("CONT\t7\t" + b64("alice@example.com"))
+	if got := c.read(); got != "CONT\t7\t"+b64("Password:") {
+		t.Fatalf("second challenge: %q", got)
+	}
+	c.send("CONT\t7\t" + b64("secret"))
+	if got := c.read(); got != "OK\t7\tuser=alice@example.com" {
+		t.Errorf("result: %q", got)
+	}
+}
+
+func TestBackendErrorIsTemporary(t *testing.T) {
+	c := dial(t, &stubAgent{fail: context.DeadlineExceeded})
+	c.send("AUTH\t1\tPLAIN\tservice=smtp\tresp=" + b64("\x00alice@example.com\x00secret"))
+	if got := c.read(); got != "FAIL\t1\tuser=alice@example.com\ttemp" {
+		t.Errorf("backend error: %q", got)
+	}
+	c.send("AUTH\t2\tCRAM-MD5\tservice=smtp")
+	if got := c.read(); !strings.HasPrefix(got, "FAIL\t2\treason=") {
+		t.Errorf("unsupported mechanism: %q", got)
+	}
+}
+
+func TestEscaping(t *testing.T) {
+	in := "a\tb\nc\x01d"
+	if got := unescape(escape(in)); got != in {
+		t.Errorf("round trip = %q", got)
+	}
+	if strings.ContainsAny(escape(in), "\t\n") {
+		t.Errorf("escape(%q) = %q", in, escape(in))
+	}
+}
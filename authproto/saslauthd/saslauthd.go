@@ -0,0 +1,238 @@
+// Package saslauthd serves a domain.AuthRouter over the Cyrus saslauthd
+// protocol, the UNIX socket Cyrus SASL's "saslauthd" pwcheck method (and
+// through it Postfix, Cyrus IMAP and sendmail) uses to check plaintext
+// passwords. Existing installations point saslauthd_path at this server
+// and keep the rest of their configuration.
+//
+// Each connection carries one request: four counted strings, each a
+// two-byte big-endian length followed by that many bytes,
+//
+//	login, password, service, realm
+//
+// answered with one counted string, "OK" or "NO <reason>", after which the
+// server closes the connection. A login without "@" is qualified with the
+// realm when one is sent, as saslauthd -r does.
+package saslauthd
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/infodancer/auth/domain"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// maxField bounds each counted string in a request, as saslauthd does.
+const maxField = 256
+
+// ioTimeout bounds how long one request may take to arrive and be answered.
+const ioTimeout = 30 * time.Second
+
+// Server answers saslauthd requests using Router.
+type Server struct {
+	// Router routes logins to their domain's agent.
+	Router *domain.AuthRouter
+
+	// Logger receives connection errors; nil uses slog.Default.
+	Logger *slog.Logger
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// ErrServerClosed is returned by Serve after Close.
+var ErrServerClosed = errors.New("saslauthd: server closed")
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+// ListenAndServe listens on the UNIX socket at path, replacing a stale
+// socket file, and serves it. saslauthd clients connect to "mux" inside
+// the configured directory, e.g. /var/run/saslauthd/mux. The socket is
+// created with mode 0660; set the group so only the MTA can connect.
+func (s *Server) ListenAndServe(path string) error {
+	_ = os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0o660); err != nil {
+		_ = l.Close()
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until it fails or Close is called.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.track(l, nil) {
+		_ = l.Close()
+		return ErrServerClosed
+	}
+	defer s.untrack(l, nil)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// Close stops all listeners and closes open connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var errs []error
+	for l := range s.listeners {
+		errs = append(errs, l.Close())
+	}
+	for c := range s.conns {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// track registers a listener or connection; false if the server is closed.
+func (s *Server) track(l net.Listener, c net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if l != nil {
+		if s.listeners == nil {
+			s.listeners = make(map[net.Listener]struct{})
+		}
+		s.listeners[l] = struct{}{}
+	}
+	if c != nil {
+		if s.conns == nil {
+			s.conns = make(map[net.Conn]struct{})
+		}
+		s.conns[c] = struct{}{}
+	}
+	return true
+}
+
+func (s *Server) untrack(l net.Listener, c net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, l)
+	delete(s.conns, c)
+}
+
+// ServeConn answers the request on one connection and closes it.
+func (s *Server) ServeConn(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	if !s.track(nil, conn) {
+		return
+	}
+	defer s.untrack(nil, conn)
+	_ = conn.SetDeadline(time.Now().Add(ioTimeout))
+
+	var fields [4]string
+	for i := range fields {
+		f, err := readString(conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !s.isClosed() {
+				s.logger().Debug("saslauthd: read", slog.String("error", err.Error()))
+			}
+			return
+		}
+		fields[i] = f
+	}
+	login, password, service, realm := fields[0], fields[1], fields[2], fields[3]
+	if realm != "" && !strings.Contains(login, "@") {
+		login += "@" + realm
+	}
+
+	reply := s.check(login, password, service)
+	if err := writeString(conn, reply); err != nil {
+		s.logger().Debug("saslauthd: write", slog.String("error", err.Error()))
+	}
+}
+
+// check authenticates one login and returns the reply.
+func (s *Server) check(login, password, service string) string {
+	ctx := context.Background()
+	if service != "" {
+		ctx = domain.WithProtocol(ctx, service)
+	}
+	result, err := s.Router.AuthenticateWithDomain(ctx, login, password)
+	if err == nil {
+		result.Session.Clear()
+		if result.StepUpRequired || result.MFARequired {
+			return "NO Login not permitted"
+		}
+		return "OK"
+	}
+
+	switch {
+	case errors.Is(err, autherrors.ErrAuthFailed), errors.Is(err, autherrors.ErrUserNotFound):
+		return "NO Authentication failed"
+	case errors.Is(err, autherrors.ErrTLSRequired):
+		return "NO Encryption required"
+	case errors.Is(err, autherrors.ErrAccountDisabled):
+		return "NO Account disabled"
+	case errors.Is(err, autherrors.ErrRateLimited), errors.Is(err, autherrors.ErrLoginDenied),
+		errors.Is(err, autherrors.ErrStepUpRequired), errors.Is(err, autherrors.ErrMFARequired),
+		errors.Is(err, autherrors.ErrAccessDenied):
+		return "NO Login not permitted"
+	default:
+		s.logger().Error("saslauthd: backend error",
+			slog.String("username", login),
+			slog.String("error", err.Error()))
+		return "NO Temporary failure"
+	}
+}
+
+// readString reads one counted string.
+func readString(r io.Reader) (string, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return "", err
+	}
+	if n > maxField {
+		return "", fmt.Errorf("field of %d bytes exceeds %d", n, maxField)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// writeString writes one counted string.
+func writeString(w io.Writer, s string) error {
+	buf := make([]byte, 2+len(s))
+	binary.BigEndian.PutUint16(buf, uint16(len(s)))
+	copy(buf[2:], s)
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,120 @@
+package saslauthd
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/infodancer/msgstore/maildir"
+
+	"github.com/infodancer/auth/authtest"
+	_ "github.com/infodancer/auth/passwd"
+)
+
+// request sends one saslauthd request over a pipe and returns the reply.
+func request(t *testing.T, s *Server, fields ...string) string {
+	t.Helper()
+	srvConn, cliConn := net.Pipe()
+	go s.ServeConn(srvConn)
+	defer func() { _ = cliConn.Close() }()
+
+	var buf bytes.Buffer
+	for _, f := range fields {
+		if err := writeString(&buf, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go func() { _, _ = cliConn.Write(buf.Bytes()) }()
+	reply, err := readString(cliConn)
+	if err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	return reply
+}
+
+func TestServer(t *testing.T) {
+	tree := authtest.Build(t, authtest.Options{})
+	s := &Server{Router: tree.Router(t)}
+	user := authtest.UserName(0)
+	domainName := authtest.DomainName(0)
+
+	tests := []struct {
+		name                    string
+		login, pass, svc, realm string
+		want                    string
+	}{
+		{"full address", tree.Address(0, 0), tree.Password, "smtp", "", "OK"},
+		{"qualified by realm", user, tree.Password, "imap", domainName, "OK"},
+		{"realm ignored for full address", tree.Address(0, 0), tree.Password, "smtp", "other.test", "OK"},
+		{"wrong password", tree.Address(0, 0), "wrong", "smtp", "", "NO Authentication failed"},
+		{"unknown user", "nobody@" + domainName, tree.Password, "smtp", "", "NO Authentication failed"},
+		{"unknown domain", user + "@unknown.test", tree.Password, "smtp", "", "NO Authentication failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := request(t, s, tt.login, tt.pass, tt.svc, tt.realm); got != tt.want {
+				t.Errorf("reply = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_OversizedField(t *testing.T) {
+	srvConn, cliConn := net.Pipe()
+	s := &Server{Router: authtest.Build(t, authtest.Options{Users: 1}).Router(t)}
+	done := make(chan struct{})
+	go func() {
+		s.ServeConn(srvConn)
+		close(done)
+	}()
+
+	var buf bytes.Buffer
+	_ = writeString(&buf, strings.Repeat("x", maxField+1))
+	go func() { _, _ = cliConn.Write(buf.Bytes()) }()
+	<-done
+	if _, err := readString(cliConn); err == nil {
+		t.Error("server replied to an oversized request")
+	}
+}
+
+func TestServer_ListenAndClose(t *testing.T) {
+	tree := authtest.Build(t, authtest.Options{Users: 1})
+	s := &Server{Router: tree.Router(t)}
+	path := filepath.Join(t.TempDir(), "mux")
+	errc := make(chan error, 1)
+	go func() { errc <- s.ListenAndServe(path) }()
+
+	var conn net.Conn
+	var err error
+	for range 100 {
+		if conn, err = net.Dial("unix", path); err == nil {
+			break
+		}
+		select {
+		case err := <-errc:
+			t.Fatalf("ListenAndServe: %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{tree.Address(0, 0), tree.Password, "smtp", ""} {
+		_ = writeString(conn, f)
+	}
+	if reply, err := readString(conn); err != nil || reply != "OK" {
+		t.Errorf("reply = %q, %v", reply, err)
+	}
+	_ = conn.Close()
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; !errors.Is(err, ErrServerClosed) {
+		t.Errorf("ListenAndServe = %v, want ErrServerClosed", err)
+	}
+}
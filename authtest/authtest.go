@@ -0,0 +1,272 @@
+// Package authtest builds realistic, deterministic domains trees on disk for
+// integration tests and benchmarks, here and in downstream repositories.
+//
+// Build lays out N domains with M passwd users each, optional forwarding
+// aliases and optional encryption keys, in the same format the
+// FilesystemDomainProvider reads in production:
+//
+//	tree := authtest.Build(t, authtest.Options{Domains: 3, Users: 10, Keys: true})
+//	router := tree.Router(t)
+//	session, err := router.Authenticate(ctx, tree.Address(0, 0), tree.Password)
+//
+// Every name, hash, salt and key is derived from Options.Seed, so two builds
+// with the same options produce byte-identical trees. That makes fixtures
+// reproducible in CI, and it also means fixture credentials and private keys
+// are not secret: never use them outside tests.
+package authtest
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pelletier/go-toml/v2"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"github.com/infodancer/auth/domain"
+	_ "github.com/infodancer/auth/passwd"      // registers the "passwd" agent type
+	_ "github.com/infodancer/msgstore/maildir" // registers the "maildir" store type
+)
+
+// DefaultPassword is the password of every fixture user unless
+// Options.Password is set.
+const DefaultPassword = "authtest-password"
+
+// Argon2id parameters matching passwd.HashPassword, so fixture hashes verify
+// at production cost.
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	saltSize      = 32
+	nonceSize     = 24
+)
+
+// Options configures Build. Zero values select small defaults.
+type Options struct {
+	// Domains is the number of domains to create (default 1).
+	Domains int
+
+	// Users is the number of passwd users per domain (default 3).
+	Users int
+
+	// Aliases is the number of forward-only addresses per domain. Alias i
+	// forwards to user i modulo Users in the same domain.
+	Aliases int
+
+	// Keys writes an encryption key pair for every user.
+	Keys bool
+
+	// Password is shared by all users (default DefaultPassword).
+	Password string
+
+	// Seed selects the tree's salts and keys (default "authtest").
+	Seed string
+}
+
+// Tree is a domains tree created by Build.
+type Tree struct {
+	// Base is the domains directory, removed when the test ends.
+	Base string
+
+	// Domains lists the domain names in creation order.
+	Domains []string
+
+	// Users lists the localparts created in every domain, and Aliases the
+	// forward-only localparts.
+	Users   []string
+	Aliases []string
+
+	// Password authenticates every user.
+	Password string
+
+	opts Options
+}
+
+// DomainName returns the name of domain i, e.g. "d000.test".
+func DomainName(i int) string {
+	return fmt.Sprintf("d%03d.test", i)
+}
+
+// UserName returns the localpart of user j, e.g. "user0000".
+func UserName(j int) string {
+	return fmt.Sprintf("user%04d", j)
+}
+
+// AliasName returns the localpart of alias k, e.g. "alias0000".
+func AliasName(k int) string {
+	return fmt.Sprintf("alias%04d", k)
+}
+
+// Build writes a domains tree into a fresh temporary directory and returns
+// it. Failures abort the test via tb.Fatal.
+func Build(tb testing.TB, opts Options) *Tree {
+	tb.Helper()
+	if opts.Domains <= 0 {
+		opts.Domains = 1
+	}
+	if opts.Users <= 0 {
+		opts.Users = 3
+	}
+	if opts.Password == "" {
+		opts.Password = DefaultPassword
+	}
+	if opts.Seed == "" {
+		opts.Seed = "authtest"
+	}
+
+	t := &Tree{Base: tb.TempDir(), Password: opts.Password, opts: opts}
+	for j := 0; j < opts.Users; j++ {
+		t.Users = append(t.Users, UserName(j))
+	}
+	for k := 0; k < opts.Aliases; k++ {
+		t.Aliases = append(t.Aliases, AliasName(k))
+	}
+
+	// Argon2 dominates build time, so every user shares one hash and one
+	// key-encryption key; both are still valid under production parameters.
+	hash := t.passwordHash()
+	var kek [32]byte
+	if opts.Keys {
+		copy(kek[:], argon2.IDKey([]byte(opts.Password), t.derive("key-salt", saltSize),
+			argon2Time, argon2Memory, argon2Threads, argon2KeyLen))
+	}
+
+	for i := 0; i < opts.Domains; i++ {
+		name := DomainName(i)
+		t.Domains = append(t.Domains, name)
+		if err := t.writeDomain(name, hash, &kek); err != nil {
+			tb.Fatalf("authtest: build %s: %v", name, err)
+		}
+	}
+	return t
+}
+
+// Address returns the full address of user j in domain i.
+func (t *Tree) Address(i, j int) string {
+	return UserName(j) + "@" + DomainName(i)
+}
+
+// Provider returns a FilesystemDomainProvider over the tree, closed when the
+// test ends.
+func (t *Tree) Provider(tb testing.TB) *domain.FilesystemDomainProvider {
+	tb.Helper()
+	p := domain.NewFilesystemDomainProvider(t.Base, nil)
+	tb.Cleanup(func() { _ = p.Close() })
+	return p
+}
+
+// Router returns an AuthRouter over a fresh Provider, closed when the test
+// ends.
+func (t *Tree) Router(tb testing.TB) *domain.AuthRouter {
+	tb.Helper()
+	r := domain.NewAuthRouter(t.Provider(tb), nil)
+	tb.Cleanup(func() { _ = r.Close() })
+	return r
+}
+
+// PrivateKey returns the plaintext private key written for localpart in
+// domainName, so tests can check key loading. It is only meaningful when the
+// tree was built with Keys.
+func (t *Tree) PrivateKey(domainName, localpart string) []byte {
+	return t.derive("private/"+domainName+"/"+localpart, curve25519.ScalarSize)
+}
+
+// PublicKey returns the public key written for localpart in domainName.
+func (t *Tree) PublicKey(domainName, localpart string) []byte {
+	pub, err := curve25519.X25519(t.PrivateKey(domainName, localpart), curve25519.Basepoint)
+	if err != nil {
+		// X25519 with the base point only fails for a low-order scalar,
+		// which the SHA-256 derivation cannot realistically produce.
+		panic("authtest: derive public key: " + err.Error())
+	}
+	return pub
+}
+
+// writeDomain creates one domain directory: config.toml, passwd, the
+// mailbox root and, with Keys, the users' key pairs.
+func (t *Tree) writeDomain(name, hash string, kek *[32]byte) error {
+	dir := filepath.Join(t.Base, name)
+	for _, sub := range []string{"keys", "users"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o750); err != nil {
+			return err
+		}
+	}
+
+	cfg := domain.DomainConfig{
+		Auth: domain.DomainAuthConfig{
+			Type:              "passwd",
+			CredentialBackend: "passwd",
+			KeyBackend:        "keys",
+		},
+		MsgStore: domain.DomainMsgStoreConfig{
+			Type:     "maildir",
+			BasePath: "users",
+		},
+	}
+	if len(t.Aliases) > 0 {
+		cfg.Forwards = make(map[string]string, len(t.Aliases))
+		for k, alias := range t.Aliases {
+			cfg.Forwards[alias] = t.Users[k%len(t.Users)] + "@" + name
+		}
+	}
+	data, err := toml.Marshal(cfg)
+	if err != nil {
+		return fmt.Errorf("encode config: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.toml"), data, 0o640); err != nil {
+		return err
+	}
+
+	var passwd strings.Builder
+	for _, user := range t.Users {
+		fmt.Fprintf(&passwd, "%s:%s:%s\n", user, hash, user)
+		if t.opts.Keys {
+			if err := t.writeKeys(filepath.Join(dir, "keys"), name, user, kek); err != nil {
+				return err
+			}
+		}
+	}
+	return os.WriteFile(filepath.Join(dir, "passwd"), []byte(passwd.String()), 0o640)
+}
+
+// writeKeys writes user's public key and password-encrypted private key in
+// the passwd agent's format: salt (32B) || nonce (24B) || secretbox.
+func (t *Tree) writeKeys(keyDir, domainName, user string, kek *[32]byte) error {
+	if err := os.WriteFile(filepath.Join(keyDir, user+".pub"), t.PublicKey(domainName, user), 0o644); err != nil {
+		return err
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], t.derive("nonce/"+domainName+"/"+user, nonceSize))
+	sealed := append(t.derive("key-salt", saltSize), nonce[:]...)
+	sealed = secretbox.Seal(sealed, t.PrivateKey(domainName, user), &nonce, kek)
+	return os.WriteFile(filepath.Join(keyDir, user+".key"), sealed, 0o600)
+}
+
+// passwordHash returns the PHC-format argon2id hash of the tree password
+// with a seed-derived salt.
+func (t *Tree) passwordHash() string {
+	salt := t.derive("password-salt", saltSize)
+	hash := argon2.IDKey([]byte(t.Password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=19$m=%d,t=%d,p=%d$%s$%s",
+		argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash))
+}
+
+// derive returns n deterministic bytes for label under the tree seed.
+func (t *Tree) derive(label string, n int) []byte {
+	var out []byte
+	for counter := 0; len(out) < n; counter++ {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d", t.opts.Seed, label, counter)))
+		out = append(out, sum[:]...)
+	}
+	return out[:n]
+}
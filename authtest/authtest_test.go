@@ -0,0 +1,86 @@
+package authtest
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuild_AuthenticatesEveryDomain(t *testing.T) {
+	tree := Build(t, Options{Domains: 2, Users: 2, Keys: true})
+	router := tree.Router(t)
+	ctx := context.Background()
+
+	for i, name := range tree.Domains {
+		session, err := router.Authenticate(ctx, tree.Address(i, 1), tree.Password)
+		if err != nil {
+			t.Fatalf("Authenticate(%s): %v", tree.Address(i, 1), err)
+		}
+		if !bytes.Equal(session.PrivateKey, tree.PrivateKey(name, UserName(1))) {
+			t.Errorf("%s: session private key does not match fixture", name)
+		}
+		if !bytes.Equal(session.PublicKey, tree.PublicKey(name, UserName(1))) {
+			t.Errorf("%s: session public key does not match fixture", name)
+		}
+		session.Clear()
+
+		if _, err := router.Authenticate(ctx, tree.Address(i, 0), "wrong"); err == nil {
+			t.Errorf("%s: expected wrong password to fail", name)
+		}
+	}
+}
+
+func TestBuild_Aliases(t *testing.T) {
+	tree := Build(t, Options{Users: 2, Aliases: 3})
+	d := tree.Provider(t).GetDomain(DomainName(0))
+	if d == nil {
+		t.Fatal("GetDomain returned nil")
+	}
+
+	targets, ok := d.AuthAgent.ResolveForward(context.Background(), AliasName(2))
+	if !ok || len(targets) != 1 || targets[0] != tree.Address(0, 0) {
+		t.Errorf("ResolveForward(%s) = %v, %v; want [%s]", AliasName(2), targets, ok, tree.Address(0, 0))
+	}
+}
+
+func TestBuild_Deterministic(t *testing.T) {
+	opts := Options{Domains: 1, Users: 2, Aliases: 1, Keys: true}
+	a, b := Build(t, opts), Build(t, opts)
+
+	for _, rel := range []string{"passwd", "config.toml", "keys/user0001.key", "keys/user0001.pub"} {
+		da, err := os.ReadFile(filepath.Join(a.Base, DomainName(0), rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := os.ReadFile(filepath.Join(b.Base, DomainName(0), rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(da, db) {
+			t.Errorf("%s differs between builds", rel)
+		}
+	}
+
+	opts.Seed = "other"
+	c := Build(t, opts)
+	if bytes.Equal(a.PrivateKey(DomainName(0), UserName(0)), c.PrivateKey(DomainName(0), UserName(0))) {
+		t.Error("different seeds produced the same private key")
+	}
+}
+
+func BenchmarkRouterAuthenticate(b *testing.B) {
+	tree := Build(b, Options{Domains: 10, Users: 100})
+	router := tree.Router(b)
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		session, err := router.Authenticate(ctx, tree.Address(i%10, i%100), tree.Password)
+		if err != nil {
+			b.Fatal(err)
+		}
+		session.Clear()
+	}
+}
@@ -0,0 +1,206 @@
+package auth
+
+// AgentCapabilities lists the optional interfaces an agent supports, as
+// returned by Capabilities.
+type AgentCapabilities struct {
+	KeyProvider       bool // KeyProvider: public key lookup
+	UserLister        bool // UserLister: account enumeration
+	AddressLookup     bool // AddressLookup: account vs forward distinction
+	SenderAuthorizer  bool // SenderAuthorizer: MAIL FROM authorization
+	LoginHistory      bool // LoginHistoryProvider: recent login records
+	ResourceReporter  bool // ResourceReporter: resource usage
+	MFA               bool // MFAAgent: TOTP second factor
+	Credentials       bool // CredentialsAuthenticator: non-plaintext mechanisms
+	AccountStatus     bool // AccountStatusProvider: disabled and locked accounts
+	SCRAM             bool // SCRAMCredentialProvider: stored SCRAM verifiers
+	ChallengeResponse bool // ChallengeResponseVerifier: CRAM-MD5 and DIGEST-MD5
+	External          bool // ExternalAuthenticator: TLS client certificates
+	LoginState        bool // LoginStateProvider: last login and failures since
+	KeyGenerator      bool // KeyGenerator: key pair provisioning
+	FormattedKeys     bool // FormattedKeyProvider: keys tagged with their format
+	Sessions          bool // SessionStore: session listing and revocation
+}
+
+// Names returns the names of the supported interfaces, for logging.
+func (c AgentCapabilities) Names() []string {
+	var names []string
+	for _, f := range []struct {
+		ok   bool
+		name string
+	}{
+		{c.KeyProvider, "KeyProvider"},
+		{c.UserLister, "UserLister"},
+		{c.AddressLookup, "AddressLookup"},
+		{c.SenderAuthorizer, "SenderAuthorizer"},
+		{c.LoginHistory, "LoginHistoryProvider"},
+		{c.ResourceReporter, "ResourceReporter"},
+		{c.MFA, "MFAAgent"},
+		{c.Credentials, "CredentialsAuthenticator"},
+		{c.AccountStatus, "AccountStatusProvider"},
+		{c.SCRAM, "SCRAMCredentialProvider"},
+		{c.ChallengeResponse, "ChallengeResponseVerifier"},
+		{c.External, "ExternalAuthenticator"},
+		{c.LoginState, "LoginStateProvider"},
+		{c.KeyGenerator, "KeyGenerator"},
+		{c.FormattedKeys, "FormattedKeyProvider"},
+		{c.Sessions, "SessionStore"},
+	} {
+		if f.ok {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
+
+// CapabilityReporter is implemented by wrapping agents whose method set does
+// not reflect what they can actually do, because they delegate optional
+// interfaces to an inner agent that may not support them.
+type CapabilityReporter interface {
+	// Capabilities returns the interfaces the agent effectively supports.
+	Capabilities() AgentCapabilities
+}
+
+// Capabilities reports which optional interfaces agent supports. Agents
+// implementing CapabilityReporter answer for themselves; for others the
+// answer comes from their method set.
+func Capabilities(agent AuthenticationAgent) AgentCapabilities {
+	if agent == nil {
+		return AgentCapabilities{}
+	}
+	if cr, ok := agent.(CapabilityReporter); ok {
+		return cr.Capabilities()
+	}
+	_, kp := agent.(KeyProvider)
+	_, ul := agent.(UserLister)
+	_, al := agent.(AddressLookup)
+	_, sa := agent.(SenderAuthorizer)
+	_, lh := agent.(LoginHistoryProvider)
+	_, rr := agent.(ResourceReporter)
+	_, mfa := agent.(MFAAgent)
+	_, cr := agent.(CredentialsAuthenticator)
+	_, as := agent.(AccountStatusProvider)
+	_, sc := agent.(SCRAMCredentialProvider)
+	_, crv := agent.(ChallengeResponseVerifier)
+	_, ea := agent.(ExternalAuthenticator)
+	_, ls := agent.(LoginStateProvider)
+	_, kg := agent.(KeyGenerator)
+	_, fk := agent.(FormattedKeyProvider)
+	_, ss := agent.(SessionStore)
+	return AgentCapabilities{
+		KeyProvider:       kp,
+		UserLister:        ul,
+		AddressLookup:     al,
+		SenderAuthorizer:  sa,
+		LoginHistory:      lh,
+		ResourceReporter:  rr,
+		MFA:               mfa,
+		Credentials:       cr,
+		AccountStatus:     as,
+		SCRAM:             sc,
+		ChallengeResponse: crv,
+		External:          ea,
+		LoginState:        ls,
+		KeyGenerator:      kg,
+		FormattedKeys:     fk,
+		Sessions:          ss,
+	}
+}
+
+// AsKeyProvider returns agent as a KeyProvider if it supports one
+// according to Capabilities.
+func AsKeyProvider(agent AuthenticationAgent) (KeyProvider, bool) {
+	if kp, ok := agent.(KeyProvider); ok && Capabilities(agent).KeyProvider {
+		return kp, true
+	}
+	return nil, false
+}
+
+// AsUserLister returns agent as a UserLister if it supports one according
+// to Capabilities.
+func AsUserLister(agent AuthenticationAgent) (UserLister, bool) {
+	if ul, ok := agent.(UserLister); ok && Capabilities(agent).UserLister {
+		return ul, true
+	}
+	return nil, false
+}
+
+// AsAddressLookup returns agent as an AddressLookup if it supports one
+// according to Capabilities.
+func AsAddressLookup(agent AuthenticationAgent) (AddressLookup, bool) {
+	if al, ok := agent.(AddressLookup); ok && Capabilities(agent).AddressLookup {
+		return al, true
+	}
+	return nil, false
+}
+
+// AsResourceReporter returns agent as a ResourceReporter if it supports one
+// according to Capabilities.
+func AsResourceReporter(agent AuthenticationAgent) (ResourceReporter, bool) {
+	if rr, ok := agent.(ResourceReporter); ok && Capabilities(agent).ResourceReporter {
+		return rr, true
+	}
+	return nil, false
+}
+
+// AsMFAAgent returns agent as an MFAAgent if it supports one according to
+// Capabilities.
+func AsMFAAgent(agent AuthenticationAgent) (MFAAgent, bool) {
+	if m, ok := agent.(MFAAgent); ok && Capabilities(agent).MFA {
+		return m, true
+	}
+	return nil, false
+}
+
+// AsSenderAuthorizer returns agent as a SenderAuthorizer if it supports
+// one according to Capabilities.
+func AsSenderAuthorizer(agent AuthenticationAgent) (SenderAuthorizer, bool) {
+	if sa, ok := agent.(SenderAuthorizer); ok && Capabilities(agent).SenderAuthorizer {
+		return sa, true
+	}
+	return nil, false
+}
+
+// AsLoginHistoryProvider returns agent as a LoginHistoryProvider if it
+// supports one according to Capabilities.
+func AsLoginHistoryProvider(agent AuthenticationAgent) (LoginHistoryProvider, bool) {
+	if lh, ok := agent.(LoginHistoryProvider); ok && Capabilities(agent).LoginHistory {
+		return lh, true
+	}
+	return nil, false
+}
+
+// AsLoginStateProvider returns agent as a LoginStateProvider if it
+// supports one according to Capabilities.
+func AsLoginStateProvider(agent AuthenticationAgent) (LoginStateProvider, bool) {
+	if ls, ok := agent.(LoginStateProvider); ok && Capabilities(agent).LoginState {
+		return ls, true
+	}
+	return nil, false
+}
+
+// AsKeyGenerator returns agent as a KeyGenerator if it supports one
+// according to Capabilities.
+func AsKeyGenerator(agent AuthenticationAgent) (KeyGenerator, bool) {
+	if kg, ok := agent.(KeyGenerator); ok && Capabilities(agent).KeyGenerator {
+		return kg, true
+	}
+	return nil, false
+}
+
+// AsFormattedKeyProvider returns agent as a FormattedKeyProvider if it
+// supports one according to Capabilities.
+func AsFormattedKeyProvider(agent AuthenticationAgent) (FormattedKeyProvider, bool) {
+	if fk, ok := agent.(FormattedKeyProvider); ok && Capabilities(agent).FormattedKeys {
+		return fk, true
+	}
+	return nil, false
+}
+
+// AsSessionStore returns agent as a SessionStore if it supports one
+// according to Capabilities.
+func AsSessionStore(agent AuthenticationAgent) (SessionStore, bool) {
+	if ss, ok := agent.(SessionStore); ok && Capabilities(agent).Sessions {
+		return ss, true
+	}
+	return nil, false
+}
@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+type basicAgent struct{}
+
+func (basicAgent) Authenticate(context.Context, string, string) (*AuthSession, error) {
+	return nil, nil
+}
+func (basicAgent) UserExists(context.Context, string) (bool, error) { return false, nil }
+func (basicAgent) Close() error                                     { return nil }
+
+type keyAgent struct{ basicAgent }
+
+func (keyAgent) GetPublicKey(context.Context, string) ([]byte, error) { return []byte("pub"), nil }
+func (keyAgent) HasEncryption(context.Context, string) (bool, error)  { return true, nil }
+func (a keyAgent) GetPublicKeys(ctx context.Context, usernames []string) (map[string][]byte, error) {
+	return GetPublicKeysOneByOne(ctx, a.GetPublicKey, usernames)
+}
+
+// wrapper delegates KeyProvider but reports its inner agent's capabilities.
+type wrapper struct {
+	keyAgent
+	inner AuthenticationAgent
+}
+
+func (w wrapper) Capabilities() AgentCapabilities { return Capabilities(w.inner) }
+
+func TestCapabilities(t *testing.T) {
+	if c := Capabilities(basicAgent{}); c != (AgentCapabilities{}) {
+		t.Errorf("basic agent capabilities = %+v, want none", c)
+	}
+	if c := Capabilities(nil); c != (AgentCapabilities{}) {
+		t.Errorf("nil agent capabilities = %+v, want none", c)
+	}
+
+	c := Capabilities(keyAgent{})
+	if !c.KeyProvider || c.UserLister {
+		t.Errorf("key agent capabilities = %+v", c)
+	}
+	if got := c.Names(); !slices.Equal(got, []string{"KeyProvider"}) {
+		t.Errorf("Names() = %v", got)
+	}
+	if kp, ok := AsKeyProvider(keyAgent{}); !ok || kp == nil {
+		t.Error("AsKeyProvider(keyAgent) failed")
+	}
+}
+
+func TestCapabilities_Reporter(t *testing.T) {
+	// The wrapper's method set includes KeyProvider, but its inner agent
+	// has none, so the typed accessor must refuse it.
+	w := wrapper{inner: basicAgent{}}
+	if Capabilities(w).KeyProvider {
+		t.Error("expected wrapper to report the inner agent's capabilities")
+	}
+	if kp, ok := AsKeyProvider(w); ok || kp != nil {
+		t.Errorf("AsKeyProvider(wrapper over basic agent) = %v, %v", kp, ok)
+	}
+
+	w = wrapper{inner: keyAgent{}}
+	if _, ok := AsKeyProvider(w); !ok {
+		t.Error("AsKeyProvider(wrapper over key agent) should succeed")
+	}
+}
+
+// stateAgent supports LoginStateProvider and KeyGenerator.
+type stateAgent struct{ basicAgent }
+
+func (stateAgent) GetLoginState(context.Context, string) (LoginState, error) {
+	return LoginState{}, nil
+}
+func (stateAgent) GenerateUserKeys(context.Context, string, string) ([]byte, error) {
+	return []byte("pub"), nil
+}
+
+// stateWrapper has stateAgent's method set but reports basicAgent's
+// capabilities.
+type stateWrapper struct{ stateAgent }
+
+func (stateWrapper) Capabilities() AgentCapabilities { return AgentCapabilities{} }
+
+func TestCapabilities_Accessors(t *testing.T) {
+	c := Capabilities(stateAgent{})
+	if got := c.Names(); !slices.Equal(got, []string{"LoginStateProvider", "KeyGenerator"}) {
+		t.Errorf("Names() = %v", got)
+	}
+	if _, ok := AsLoginStateProvider(stateAgent{}); !ok {
+		t.Error("AsLoginStateProvider(stateAgent) failed")
+	}
+	if _, ok := AsKeyGenerator(stateAgent{}); !ok {
+		t.Error("AsKeyGenerator(stateAgent) failed")
+	}
+	if _, ok := AsSessionStore(stateAgent{}); ok {
+		t.Error("AsSessionStore(stateAgent) succeeded")
+	}
+
+	if _, ok := AsLoginStateProvider(stateWrapper{}); ok {
+		t.Error("AsLoginStateProvider(stateWrapper) should refuse")
+	}
+	if _, ok := AsKeyGenerator(stateWrapper{}); ok {
+		t.Error("AsKeyGenerator(stateWrapper) should refuse")
+	}
+}
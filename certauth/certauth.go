@@ -0,0 +1,254 @@
+// Package certauth provides an authentication agent that logs users in
+// with TLS client certificates (SASL EXTERNAL) instead of passwords, for
+// machine submitters and mTLS clients. It implements
+// auth.ExternalAuthenticator and is usually chained after the backend
+// holding the domain's passwords:
+//
+//	[[auth.chain]]
+//	type = "passwd"
+//	credential_backend = "passwd"
+//	key_backend = "keys"
+//
+//	[[auth.chain]]
+//	type = "certauth"
+//	credential_backend = "certs"
+//
+// The backend is a directory or a file. A directory holds one file per
+// user, <localpart>.pem, with the PEM certificates that user may present:
+//
+//	certs/backup.pem
+//	certs/relay.pem
+//
+// A file maps users to certificates by SHA-256 fingerprint or by email
+// subject alternative name, one per line:
+//
+//	# localpart  certificate
+//	backup       sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+//	relay        email:relay@example.com
+//
+// Fingerprints pin one certificate; an email line accepts any certificate
+// the trusted CAs issue for that address. The daemon verifies the chain
+// before asking the agent. The backend is read on each call, so changes
+// apply without a reload. Users known only here cannot log in with a
+// password.
+package certauth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/atrest"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// pemSuffix ends the per-user files of a directory backend.
+const pemSuffix = ".pem"
+
+// Agent maps client certificates to users.
+type Agent struct {
+	path string
+	dir  bool
+}
+
+var (
+	_ auth.AuthenticationAgent   = (*Agent)(nil)
+	_ auth.ExternalAuthenticator = (*Agent)(nil)
+	_ auth.UserLister            = (*Agent)(nil)
+)
+
+// New returns an agent for the directory or mapping file at path, which
+// must exist.
+func New(path string) (*Agent, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("certauth: %w", err)
+	}
+	return &Agent{path: path, dir: fi.IsDir()}, nil
+}
+
+// mapping is what a user's certificate must match: one of its
+// fingerprints or email addresses.
+type mapping struct {
+	fingerprints []string // lowercase hex SHA-256
+	emails       []string // lowercase
+}
+
+// empty reports whether m accepts nothing.
+func (m mapping) empty() bool {
+	return len(m.fingerprints) == 0 && len(m.emails) == 0
+}
+
+// matches reports whether m accepts identity's certificate.
+func (m mapping) matches(identity auth.ExternalIdentity) bool {
+	if identity.Fingerprint != "" && slices.Contains(m.fingerprints, strings.ToLower(identity.Fingerprint)) {
+		return true
+	}
+	return slices.ContainsFunc(identity.Emails, func(e string) bool {
+		return slices.Contains(m.emails, strings.ToLower(e))
+	})
+}
+
+// AuthenticateExternal opens a session for identity.Username if their
+// mapping accepts the certificate. Implements auth.ExternalAuthenticator.
+func (a *Agent) AuthenticateExternal(_ context.Context, identity auth.ExternalIdentity) (*auth.AuthSession, error) {
+	m, err := a.lookup(identity.Username)
+	if err != nil {
+		return nil, err
+	}
+	if m.empty() {
+		return nil, autherrors.ErrUserNotFound
+	}
+	if !m.matches(identity) {
+		return nil, autherrors.ErrAuthFailed
+	}
+	return &auth.AuthSession{
+		User:       &auth.User{Username: identity.Username, Mailbox: identity.Username},
+		Credential: auth.Credential{Kind: auth.CredentialCertificate, ID: strings.ToLower(identity.Fingerprint)},
+	}, nil
+}
+
+// Authenticate refuses passwords: users known here log in with their
+// certificate only. Unknown users fail with errors.ErrUserNotFound, so a
+// chain moves on to the next backend.
+func (a *Agent) Authenticate(_ context.Context, username, _ string) (*auth.AuthSession, error) {
+	m, err := a.lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	if m.empty() {
+		return nil, autherrors.ErrUserNotFound
+	}
+	return nil, fmt.Errorf("%w: %s logs in with a certificate only", autherrors.ErrMechanismUnsupported, username)
+}
+
+// UserExists reports whether any certificate is mapped to username.
+func (a *Agent) UserExists(_ context.Context, username string) (bool, error) {
+	m, err := a.lookup(username)
+	if err != nil {
+		return false, err
+	}
+	return !m.empty(), nil
+}
+
+// ListUsers returns the sorted users with a certificate mapped. Implements
+// auth.UserLister.
+func (a *Agent) ListUsers(context.Context) ([]string, error) {
+	if a.dir {
+		entries, err := os.ReadDir(a.path)
+		if err != nil {
+			return nil, fmt.Errorf("certauth: %w", err)
+		}
+		var users []string
+		for _, e := range entries {
+			if name, ok := strings.CutSuffix(e.Name(), pemSuffix); ok && e.Type().IsRegular() && validUsername(name) {
+				users = append(users, name)
+			}
+		}
+		return users, nil
+	}
+	mappings, err := a.readFile()
+	if err != nil {
+		return nil, err
+	}
+	users := make([]string, 0, len(mappings))
+	for u := range mappings {
+		users = append(users, u)
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+// Close releases nothing; the backend is read on each call.
+func (a *Agent) Close() error {
+	return nil
+}
+
+// lookup returns username's mapping, empty if they have none.
+func (a *Agent) lookup(username string) (mapping, error) {
+	if !validUsername(username) {
+		return mapping{}, nil
+	}
+	if a.dir {
+		return readPEMFile(filepath.Join(a.path, username+pemSuffix))
+	}
+	mappings, err := a.readFile()
+	if err != nil {
+		return mapping{}, err
+	}
+	return mappings[strings.ToLower(username)], nil
+}
+
+// validUsername reports whether username can name a user's file: it must
+// not be empty, hidden or reach outside the directory.
+func validUsername(username string) bool {
+	return username != "" && !strings.HasPrefix(username, ".") && !strings.ContainsAny(username, "/\\\x00")
+}
+
+// readPEMFile returns the fingerprints of the certificates in path. A
+// missing file is an empty mapping.
+func readPEMFile(path string) (mapping, error) {
+	data, err := atrest.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return mapping{}, nil
+		}
+		return mapping{}, fmt.Errorf("certauth: %w", err)
+	}
+	var m mapping
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			sum := sha256.Sum256(block.Bytes)
+			m.fingerprints = append(m.fingerprints, hex.EncodeToString(sum[:]))
+		}
+	}
+	return m, nil
+}
+
+// readFile parses the mapping file, keyed by lowercase localpart.
+// Malformed lines are skipped.
+func (a *Agent) readFile() (map[string]mapping, error) {
+	data, err := atrest.ReadFile(a.path)
+	if err != nil {
+		return nil, fmt.Errorf("certauth: %w", err)
+	}
+	mappings := make(map[string]mapping)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		user, match := strings.ToLower(fields[0]), fields[1]
+		m := mappings[user]
+		if fp, ok := strings.CutPrefix(match, "sha256:"); ok {
+			m.fingerprints = append(m.fingerprints, strings.ToLower(strings.ReplaceAll(fp, ":", "")))
+		} else if email, ok := strings.CutPrefix(match, "email:"); ok && strings.Contains(email, "@") {
+			m.emails = append(m.emails, strings.ToLower(email))
+		} else {
+			continue
+		}
+		mappings[user] = m
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("certauth: %w", err)
+	}
+	return mappings, nil
+}
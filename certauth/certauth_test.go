@@ -0,0 +1,132 @@
+package certauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// newCert returns a self-signed certificate in PEM form and its
+// fingerprint.
+func newCert(t *testing.T, cn string) (pemData []byte, fingerprint string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(der)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), hex.EncodeToString(sum[:])
+}
+
+func TestAgent_Directory(t *testing.T) {
+	ctx := t.Context()
+	dir := t.TempDir()
+	relayPEM, relayFP := newCert(t, "relay")
+	_, otherFP := newCert(t, "other")
+	if err := os.WriteFile(filepath.Join(dir, "relay.pem"), relayPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := a.AuthenticateExternal(ctx, auth.ExternalIdentity{Username: "relay", Fingerprint: relayFP})
+	if err != nil {
+		t.Fatalf("relay: %v", err)
+	}
+	if s.User.Username != "relay" || s.Credential.Kind != auth.CredentialCertificate || s.Credential.ID != relayFP {
+		t.Errorf("session = %+v", s)
+	}
+	if _, err := a.AuthenticateExternal(ctx, auth.ExternalIdentity{Username: "relay", Fingerprint: otherFP}); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("other certificate: err = %v, want ErrAuthFailed", err)
+	}
+	if _, err := a.AuthenticateExternal(ctx, auth.ExternalIdentity{Username: "dave", Fingerprint: relayFP}); !errors.Is(err, autherrors.ErrUserNotFound) {
+		t.Errorf("dave: err = %v, want ErrUserNotFound", err)
+	}
+	if _, err := a.AuthenticateExternal(ctx, auth.ExternalIdentity{Username: "../relay", Fingerprint: relayFP}); !errors.Is(err, autherrors.ErrUserNotFound) {
+		t.Errorf("../relay: err = %v, want ErrUserNotFound", err)
+	}
+	if users, err := a.ListUsers(ctx); err != nil || !slices.Equal(users, []string{"relay"}) {
+		t.Errorf("ListUsers = %v, %v", users, err)
+	}
+}
+
+func TestAgent_File(t *testing.T) {
+	ctx := t.Context()
+	_, backupFP := newCert(t, "backup")
+	path := filepath.Join(t.TempDir(), "certs")
+	content := "# localpart  certificate\n" +
+		"backup sha256:" + backupFP + "\n" +
+		"relay  email:Relay@Example.com\n" +
+		"broken nonsense\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.AuthenticateExternal(ctx, auth.ExternalIdentity{Username: "backup", Fingerprint: backupFP}); err != nil {
+		t.Errorf("backup: %v", err)
+	}
+	if _, err := a.AuthenticateExternal(ctx, auth.ExternalIdentity{Username: "relay", Emails: []string{"relay@example.com"}}); err != nil {
+		t.Errorf("relay by email: %v", err)
+	}
+	if _, err := a.AuthenticateExternal(ctx, auth.ExternalIdentity{Username: "relay", Emails: []string{"backup@example.com"}}); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("relay with wrong email: err = %v, want ErrAuthFailed", err)
+	}
+	if ok, _ := a.UserExists(ctx, "broken"); ok {
+		t.Error("malformed line created a user")
+	}
+	if users, err := a.ListUsers(ctx); err != nil || !slices.Equal(users, []string{"backup", "relay"}) {
+		t.Errorf("ListUsers = %v, %v", users, err)
+	}
+}
+
+func TestAgent_RefusesPasswords(t *testing.T) {
+	ctx := t.Context()
+	path := filepath.Join(t.TempDir(), "certs")
+	if err := os.WriteFile(path, []byte("relay email:relay@example.com\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Authenticate(ctx, "relay", "pw"); !errors.Is(err, autherrors.ErrMechanismUnsupported) {
+		t.Errorf("relay: err = %v, want ErrMechanismUnsupported", err)
+	}
+	if _, err := a.Authenticate(ctx, "dave", "pw"); !errors.Is(err, autherrors.ErrUserNotFound) {
+		t.Errorf("dave: err = %v, want ErrUserNotFound", err)
+	}
+	if _, err := New(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("New accepted a missing path")
+	}
+}
@@ -0,0 +1,10 @@
+package certauth
+
+import "github.com/infodancer/auth"
+
+func init() {
+	// CredentialBackend is the certificate directory or mapping file.
+	auth.RegisterAuthAgent("certauth", func(config auth.AuthAgentConfig) (auth.AuthenticationAgent, error) {
+		return New(config.CredentialBackend)
+	})
+}
@@ -0,0 +1,336 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// ChainAgent consults several agents in order, e.g. a local passwd file
+// before a directory server. A user belongs to the first agent that knows
+// them: Authenticate moves on only when an agent returns
+// errors.ErrUserNotFound, so a wrong password in one backend never falls
+// through to a later one, and a backend failure is returned rather than
+// letting a later backend answer for a user it may shadow.
+//
+// Optional interfaces are delegated the same way and reported through
+// CapabilityReporter as supported when any member supports them.
+type ChainAgent struct {
+	agents []AuthenticationAgent
+}
+
+var (
+	_ AuthenticationAgent   = (*ChainAgent)(nil)
+	_ KeyProvider           = (*ChainAgent)(nil)
+	_ UserLister            = (*ChainAgent)(nil)
+	_ ResourceReporter      = (*ChainAgent)(nil)
+	_ MFAAgent              = (*ChainAgent)(nil)
+	_ AccountStatusProvider = (*ChainAgent)(nil)
+	_ CapabilityReporter    = (*ChainAgent)(nil)
+)
+
+// NewChainAgent returns an agent consulting agents in order. The chain owns
+// the agents: Close closes all of them.
+func NewChainAgent(agents ...AuthenticationAgent) *ChainAgent {
+	return &ChainAgent{agents: agents}
+}
+
+// OpenChainAgent opens an agent for each config from the registry and chains
+// them. If any fails to open, those already opened are closed.
+func OpenChainAgent(configs []AuthAgentConfig) (*ChainAgent, error) {
+	agents := make([]AuthenticationAgent, 0, len(configs))
+	for i, cfg := range configs {
+		agent, err := OpenAuthAgent(cfg)
+		if err != nil {
+			for _, a := range agents {
+				_ = a.Close()
+			}
+			return nil, fmt.Errorf("chain agent %d (%s): %w", i, cfg.Type, err)
+		}
+		agents = append(agents, agent)
+	}
+	return NewChainAgent(agents...), nil
+}
+
+// Authenticate tries each agent until one knows the user.
+func (c *ChainAgent) Authenticate(ctx context.Context, username, password string) (*AuthSession, error) {
+	for _, a := range c.agents {
+		session, err := a.Authenticate(ctx, username, password)
+		if errors.Is(err, autherrors.ErrUserNotFound) {
+			continue
+		}
+		return session, err
+	}
+	return nil, autherrors.ErrUserNotFound
+}
+
+// UserExists reports whether any agent knows the user.
+func (c *ChainAgent) UserExists(ctx context.Context, username string) (bool, error) {
+	for _, a := range c.agents {
+		ok, err := a.UserExists(ctx, username)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// owner returns the first agent that knows username, or nil.
+func (c *ChainAgent) owner(ctx context.Context, username string) (AuthenticationAgent, error) {
+	for _, a := range c.agents {
+		ok, err := a.UserExists(ctx, username)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return a, nil
+		}
+	}
+	return nil, nil
+}
+
+// GetPublicKey returns the key held by the agent that owns the user.
+func (c *ChainAgent) GetPublicKey(ctx context.Context, username string) ([]byte, error) {
+	a, err := c.owner(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil {
+		return nil, autherrors.ErrUserNotFound
+	}
+	if kp, ok := AsKeyProvider(a); ok {
+		return kp.GetPublicKey(ctx, username)
+	}
+	return nil, autherrors.ErrKeyNotFound
+}
+
+// GetPublicKeyWithFormat returns the key held by the agent that owns the
+// user, with its format (see PublicKeyWithFormat).
+func (c *ChainAgent) GetPublicKeyWithFormat(ctx context.Context, username string) ([]byte, KeyFormat, error) {
+	a, err := c.owner(ctx, username)
+	if err != nil {
+		return nil, "", err
+	}
+	if a == nil {
+		return nil, "", autherrors.ErrUserNotFound
+	}
+	if kp, ok := AsKeyProvider(a); ok {
+		return PublicKeyWithFormat(ctx, kp, username)
+	}
+	return nil, "", autherrors.ErrKeyNotFound
+}
+
+// GetPublicKeys returns the keys held by the agents that own the users.
+func (c *ChainAgent) GetPublicKeys(ctx context.Context, usernames []string) (map[string][]byte, error) {
+	return GetPublicKeysOneByOne(ctx, c.GetPublicKey, usernames)
+}
+
+// HasEncryption reports whether the agent that owns the user has
+// encryption enabled for them.
+func (c *ChainAgent) HasEncryption(ctx context.Context, username string) (bool, error) {
+	a, err := c.owner(ctx, username)
+	if err != nil || a == nil {
+		return false, err
+	}
+	if kp, ok := AsKeyProvider(a); ok {
+		return kp.HasEncryption(ctx, username)
+	}
+	return false, nil
+}
+
+// TOTPEnabled reports whether the agent that owns the user has a second
+// factor enrolled for them.
+func (c *ChainAgent) TOTPEnabled(ctx context.Context, username string) (bool, error) {
+	a, err := c.owner(ctx, username)
+	if err != nil || a == nil {
+		return false, err
+	}
+	if m, ok := AsMFAAgent(a); ok {
+		return m.TOTPEnabled(ctx, username)
+	}
+	return false, nil
+}
+
+// VerifyTOTP checks code with the agent that owns the user.
+func (c *ChainAgent) VerifyTOTP(ctx context.Context, username, code string) (bool, error) {
+	a, err := c.owner(ctx, username)
+	if err != nil || a == nil {
+		return false, err
+	}
+	if m, ok := AsMFAAgent(a); ok {
+		return m.VerifyTOTP(ctx, username, code)
+	}
+	return false, nil
+}
+
+// GetSCRAMCredentials returns the SCRAM credentials the agent that owns
+// the user stores for them.
+func (c *ChainAgent) GetSCRAMCredentials(ctx context.Context, username string) (*SCRAMCredentials, error) {
+	a, err := c.owner(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil {
+		return nil, autherrors.ErrUserNotFound
+	}
+	if sp, ok := AsSCRAMCredentialProvider(a); ok {
+		return sp.GetSCRAMCredentials(ctx, username)
+	}
+	return nil, autherrors.ErrMechanismUnsupported
+}
+
+// VerifyChallengeResponse verifies creds with the agent that owns the
+// user.
+func (c *ChainAgent) VerifyChallengeResponse(ctx context.Context, creds Credentials) (*AuthSession, error) {
+	a, err := c.owner(ctx, creds.Username)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil {
+		return nil, autherrors.ErrUserNotFound
+	}
+	if cv, ok := AsChallengeResponseVerifier(a); ok {
+		return cv.VerifyChallengeResponse(ctx, creds)
+	}
+	return nil, autherrors.ErrMechanismUnsupported
+}
+
+// AuthenticateCredentials verifies plaintext and challenge-response
+// credentials like Authenticate and VerifyChallengeResponse. Other
+// mechanisms, such as bearer tokens, go to each agent that supports
+// CredentialsAuthenticator in turn until one knows the user, like
+// AuthenticateExternal, so a token validator can sit beside the backend
+// holding the user's password.
+func (c *ChainAgent) AuthenticateCredentials(ctx context.Context, creds Credentials) (*AuthSession, error) {
+	if creds.IsPlaintext() {
+		return c.Authenticate(ctx, creds.Username, creds.Password)
+	}
+	if creds.Challenge != nil {
+		return c.VerifyChallengeResponse(ctx, creds)
+	}
+	err := fmt.Errorf("%w: %s", autherrors.ErrMechanismUnsupported, creds.Mechanism)
+	for _, a := range c.agents {
+		ca, ok := AsCredentialsAuthenticator(a)
+		if !ok {
+			continue
+		}
+		session, aerr := ca.AuthenticateCredentials(ctx, creds)
+		switch {
+		case errors.Is(aerr, autherrors.ErrUserNotFound):
+			err = aerr
+		case errors.Is(aerr, autherrors.ErrMechanismUnsupported):
+		default:
+			return session, aerr
+		}
+	}
+	return nil, err
+}
+
+// AuthenticateExternal tries each agent that supports ExternalAuthenticator
+// until one knows the user. Unlike the other optional interfaces it does
+// not go to the agent that owns the user, so a certificate mapping can sit
+// in the chain beside the backend holding the user's password.
+func (c *ChainAgent) AuthenticateExternal(ctx context.Context, identity ExternalIdentity) (*AuthSession, error) {
+	for _, a := range c.agents {
+		ea, ok := AsExternalAuthenticator(a)
+		if !ok {
+			continue
+		}
+		session, err := ea.AuthenticateExternal(ctx, identity)
+		if errors.Is(err, autherrors.ErrUserNotFound) {
+			continue
+		}
+		return session, err
+	}
+	return nil, autherrors.ErrUserNotFound
+}
+
+// ListUsers returns the sorted union of the users of every agent that can
+// list them. A user known to several agents is listed once.
+func (c *ChainAgent) ListUsers(ctx context.Context) ([]string, error) {
+	seen := make(map[string]bool)
+	var users []string
+	for _, a := range c.agents {
+		ul, ok := AsUserLister(a)
+		if !ok {
+			continue
+		}
+		names, err := ul.ListUsers(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range names {
+			if !seen[n] {
+				seen[n] = true
+				users = append(users, n)
+			}
+		}
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+// Resources returns the summed usage of every agent.
+func (c *ChainAgent) Resources() ResourceUsage {
+	var total ResourceUsage
+	for _, a := range c.agents {
+		if rr, ok := AsResourceReporter(a); ok {
+			total = total.Add(rr.Resources())
+		}
+	}
+	return total
+}
+
+// AccountStatus returns the restrictions the agent that owns the user
+// stores; none if it stores none.
+func (c *ChainAgent) AccountStatus(ctx context.Context, username string) (AccountStatus, error) {
+	a, err := c.owner(ctx, username)
+	if err != nil {
+		return AccountStatus{}, err
+	}
+	if a == nil {
+		return AccountStatus{}, autherrors.ErrUserNotFound
+	}
+	if sp, ok := AsAccountStatusProvider(a); ok {
+		return sp.AccountStatus(ctx, username)
+	}
+	return AccountStatus{}, nil
+}
+
+// Capabilities reports the optional interfaces the chain delegates:
+// KeyProvider, FormattedKeyProvider, UserLister, ResourceReporter,
+// MFAAgent, AccountStatusProvider, SCRAMCredentialProvider,
+// ChallengeResponseVerifier, ExternalAuthenticator and
+// CredentialsAuthenticator when any member supports them. Implements
+// CapabilityReporter.
+func (c *ChainAgent) Capabilities() AgentCapabilities {
+	var caps AgentCapabilities
+	for _, a := range c.agents {
+		m := Capabilities(a)
+		caps.KeyProvider = caps.KeyProvider || m.KeyProvider
+		caps.FormattedKeys = caps.FormattedKeys || m.FormattedKeys
+		caps.UserLister = caps.UserLister || m.UserLister
+		caps.ResourceReporter = caps.ResourceReporter || m.ResourceReporter
+		caps.MFA = caps.MFA || m.MFA
+		caps.AccountStatus = caps.AccountStatus || m.AccountStatus
+		caps.SCRAM = caps.SCRAM || m.SCRAM
+		caps.ChallengeResponse = caps.ChallengeResponse || m.ChallengeResponse
+		caps.External = caps.External || m.External
+		caps.Credentials = caps.Credentials || m.Credentials
+	}
+	return caps
+}
+
+// Close closes every agent, returning their errors joined.
+func (c *ChainAgent) Close() error {
+	var errs []error
+	for _, a := range c.agents {
+		if err := a.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,307 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// mapAgent knows the users in passwords and lists them.
+type mapAgent struct {
+	passwords map[string]string
+	key       []byte // returned by GetPublicKey when set
+	err       error  // returned by every call when set
+	closed    bool
+}
+
+func (a *mapAgent) Authenticate(_ context.Context, username, password string) (*AuthSession, error) {
+	if a.err != nil {
+		return nil, a.err
+	}
+	want, ok := a.passwords[username]
+	if !ok {
+		return nil, autherrors.ErrUserNotFound
+	}
+	if password != want {
+		return nil, autherrors.ErrAuthFailed
+	}
+	return &AuthSession{User: &User{Username: username}}, nil
+}
+
+func (a *mapAgent) UserExists(_ context.Context, username string) (bool, error) {
+	_, ok := a.passwords[username]
+	return ok, a.err
+}
+
+func (a *mapAgent) ListUsers(context.Context) ([]string, error) {
+	var users []string
+	for u := range a.passwords {
+		users = append(users, u)
+	}
+	slices.Sort(users)
+	return users, a.err
+}
+
+func (a *mapAgent) Close() error {
+	a.closed = true
+	return nil
+}
+
+// mapKeyAgent is a mapAgent with public keys.
+type mapKeyAgent struct{ *mapAgent }
+
+func (a mapKeyAgent) GetPublicKey(context.Context, string) ([]byte, error) { return a.key, nil }
+func (a mapKeyAgent) HasEncryption(context.Context, string) (bool, error)  { return true, nil }
+func (a mapKeyAgent) GetPublicKeys(ctx context.Context, usernames []string) (map[string][]byte, error) {
+	return GetPublicKeysOneByOne(ctx, a.GetPublicKey, usernames)
+}
+
+// mapStatusAgent is a mapAgent storing account restrictions.
+type mapStatusAgent struct {
+	*mapAgent
+	status map[string]AccountStatus
+}
+
+func (a mapStatusAgent) AccountStatus(_ context.Context, username string) (AccountStatus, error) {
+	return a.status[username], nil
+}
+
+func (a mapStatusAgent) Capabilities() AgentCapabilities {
+	return AgentCapabilities{UserLister: true, AccountStatus: true}
+}
+
+func TestChainAgent_Authenticate(t *testing.T) {
+	local := &mapAgent{passwords: map[string]string{"alice": "local", "carol": "local"}}
+	remote := &mapAgent{passwords: map[string]string{"alice": "remote", "bob": "remote"}}
+	c := NewChainAgent(local, remote)
+	ctx := t.Context()
+
+	if _, err := c.Authenticate(ctx, "alice", "local"); err != nil {
+		t.Errorf("alice/local: %v", err)
+	}
+	// alice belongs to the first agent; its refusal is final.
+	if _, err := c.Authenticate(ctx, "alice", "remote"); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("alice/remote err = %v, want ErrAuthFailed", err)
+	}
+	if _, err := c.Authenticate(ctx, "bob", "remote"); err != nil {
+		t.Errorf("bob/remote: %v", err)
+	}
+	if _, err := c.Authenticate(ctx, "dave", "x"); !errors.Is(err, autherrors.ErrUserNotFound) {
+		t.Errorf("dave err = %v, want ErrUserNotFound", err)
+	}
+
+	// A failing backend stops the chain rather than letting a later one
+	// answer for its users.
+	broken := NewChainAgent(&mapAgent{err: errors.New("ldap down")}, remote)
+	if _, err := broken.Authenticate(ctx, "bob", "remote"); err == nil || errors.Is(err, autherrors.ErrUserNotFound) {
+		t.Errorf("err = %v, want backend error", err)
+	}
+}
+
+func TestChainAgent_Delegation(t *testing.T) {
+	local := &mapAgent{passwords: map[string]string{"alice": "x"}}
+	remote := &mapAgent{passwords: map[string]string{"alice": "y", "bob": "y"}, key: []byte("bob-key")}
+	c := NewChainAgent(local, mapKeyAgent{remote})
+	ctx := t.Context()
+
+	if ok, err := c.UserExists(ctx, "bob"); !ok || err != nil {
+		t.Errorf("UserExists(bob) = %v, %v", ok, err)
+	}
+	if ok, _ := c.UserExists(ctx, "dave"); ok {
+		t.Error("UserExists(dave) = true")
+	}
+	if key, err := c.GetPublicKey(ctx, "bob"); err != nil || string(key) != "bob-key" {
+		t.Errorf("GetPublicKey(bob) = %q, %v", key, err)
+	}
+	if key, format, err := PublicKeyWithFormat(ctx, c, "bob"); err != nil || string(key) != "bob-key" || format != KeyFormatNative {
+		t.Errorf("PublicKeyWithFormat(bob) = %q, %q, %v", key, format, err)
+	}
+	// alice is owned by the keyless first agent, not the one with keys.
+	if _, err := c.GetPublicKey(ctx, "alice"); !errors.Is(err, autherrors.ErrKeyNotFound) {
+		t.Errorf("GetPublicKey(alice) err = %v, want ErrKeyNotFound", err)
+	}
+	if users, err := c.ListUsers(ctx); err != nil || !slices.Equal(users, []string{"alice", "bob"}) {
+		t.Errorf("ListUsers = %v, %v", users, err)
+	}
+	if caps := Capabilities(c); !caps.KeyProvider || !caps.UserLister || caps.AddressLookup {
+		t.Errorf("Capabilities = %+v", caps)
+	}
+	if caps := Capabilities(NewChainAgent(local)); caps.KeyProvider {
+		t.Error("chain without key agents reports KeyProvider")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !local.closed || !remote.closed {
+		t.Error("Close did not close every member")
+	}
+}
+
+func TestChainAgent_AccountStatus(t *testing.T) {
+	local := mapStatusAgent{
+		mapAgent: &mapAgent{passwords: map[string]string{"alice": "x"}},
+		status:   map[string]AccountStatus{"alice": {Locked: true}},
+	}
+	remote := &mapAgent{passwords: map[string]string{"bob": "y"}}
+	c := NewChainAgent(local, remote)
+	ctx := t.Context()
+
+	if _, ok := AsAccountStatusProvider(c); !ok {
+		t.Fatal("chain does not report AccountStatusProvider")
+	}
+	if s, err := c.AccountStatus(ctx, "alice"); err != nil || !s.Locked || s.CanLogin() || !s.AcceptsMail() {
+		t.Errorf("AccountStatus(alice) = %+v, %v", s, err)
+	}
+	// bob's agent stores no restrictions.
+	if s, err := c.AccountStatus(ctx, "bob"); err != nil || !s.CanLogin() {
+		t.Errorf("AccountStatus(bob) = %+v, %v", s, err)
+	}
+	if _, err := c.AccountStatus(ctx, "dave"); !errors.Is(err, autherrors.ErrUserNotFound) {
+		t.Errorf("AccountStatus(dave) err = %v, want ErrUserNotFound", err)
+	}
+	if _, ok := AsAccountStatusProvider(NewChainAgent(remote)); ok {
+		t.Error("chain without status agents reports AccountStatusProvider")
+	}
+}
+
+// mapChallengeAgent is a mapAgent verifying challenge-response
+// credentials: the response must be the user's password.
+type mapChallengeAgent struct{ *mapAgent }
+
+func (a mapChallengeAgent) VerifyChallengeResponse(ctx context.Context, creds Credentials) (*AuthSession, error) {
+	return a.Authenticate(ctx, creds.Username, string(creds.Response))
+}
+
+func TestChainAgent_ChallengeResponse(t *testing.T) {
+	local := mapChallengeAgent{&mapAgent{passwords: map[string]string{"alice": "x"}}}
+	remote := &mapAgent{passwords: map[string]string{"bob": "y"}}
+	c := NewChainAgent(local, remote)
+	ctx := t.Context()
+
+	if _, ok := AsChallengeResponseVerifier(c); !ok {
+		t.Fatal("chain does not report ChallengeResponseVerifier")
+	}
+	creds := Credentials{Username: "alice", Mechanism: "CRAM-MD5", Challenge: []byte("c"), Response: []byte("x")}
+	if _, err := VerifyCredentials(ctx, c, creds); err != nil {
+		t.Errorf("alice: %v", err)
+	}
+	creds.Username, creds.Response = "bob", []byte("y")
+	if _, err := c.VerifyChallengeResponse(ctx, creds); !errors.Is(err, autherrors.ErrMechanismUnsupported) {
+		t.Errorf("bob err = %v, want ErrMechanismUnsupported", err)
+	}
+	creds.Username = "dave"
+	if _, err := c.VerifyChallengeResponse(ctx, creds); !errors.Is(err, autherrors.ErrUserNotFound) {
+		t.Errorf("dave err = %v, want ErrUserNotFound", err)
+	}
+	if _, ok := AsChallengeResponseVerifier(NewChainAgent(remote)); ok {
+		t.Error("chain without challenge-response agents reports ChallengeResponseVerifier")
+	}
+}
+
+// fingerprintAgent logs users in with the certificate fingerprint mapped
+// to them.
+type fingerprintAgent struct {
+	*mapAgent
+	certs map[string]string // username → fingerprint
+}
+
+func (a fingerprintAgent) AuthenticateExternal(_ context.Context, identity ExternalIdentity) (*AuthSession, error) {
+	fp, ok := a.certs[identity.Username]
+	if !ok {
+		return nil, autherrors.ErrUserNotFound
+	}
+	if fp != identity.Fingerprint {
+		return nil, autherrors.ErrAuthFailed
+	}
+	return &AuthSession{User: &User{Username: identity.Username}, Credential: Credential{Kind: CredentialCertificate}}, nil
+}
+
+func TestChainAgent_External(t *testing.T) {
+	// The password backend owns alice; the certificate mapping after it
+	// still answers for her certificate.
+	passwords := &mapAgent{passwords: map[string]string{"alice": "x"}}
+	certs := fingerprintAgent{&mapAgent{}, map[string]string{"alice": "aa", "relay": "bb"}}
+	c := NewChainAgent(passwords, certs)
+	ctx := t.Context()
+
+	ea, ok := AsExternalAuthenticator(c)
+	if !ok {
+		t.Fatal("chain does not report ExternalAuthenticator")
+	}
+	if s, err := ea.AuthenticateExternal(ctx, ExternalIdentity{Username: "alice", Fingerprint: "aa"}); err != nil || s.Credential.Kind != CredentialCertificate {
+		t.Errorf("alice: %+v, %v", s, err)
+	}
+	if _, err := ea.AuthenticateExternal(ctx, ExternalIdentity{Username: "alice", Fingerprint: "bb"}); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("alice with relay's certificate: err = %v, want ErrAuthFailed", err)
+	}
+	if _, err := ea.AuthenticateExternal(ctx, ExternalIdentity{Username: "dave", Fingerprint: "aa"}); !errors.Is(err, autherrors.ErrUserNotFound) {
+		t.Errorf("dave: err = %v, want ErrUserNotFound", err)
+	}
+	if _, ok := AsExternalAuthenticator(NewChainAgent(passwords)); ok {
+		t.Error("chain without certificate agents reports ExternalAuthenticator")
+	}
+}
+
+// tokenAgent is a mapAgent accepting XOAUTH2 tokens issued to users.
+type tokenAgent struct {
+	*mapAgent
+	tokens map[string]string // token → username
+}
+
+func (a tokenAgent) AuthenticateCredentials(_ context.Context, creds Credentials) (*AuthSession, error) {
+	if creds.Mechanism != "XOAUTH2" {
+		return nil, autherrors.ErrMechanismUnsupported
+	}
+	if a.tokens[string(creds.Response)] != creds.Username {
+		return nil, autherrors.ErrAuthFailed
+	}
+	return &AuthSession{User: &User{Username: creds.Username}, Credential: Credential{Kind: CredentialBearerToken}}, nil
+}
+
+func TestChainAgent_Credentials(t *testing.T) {
+	passwords := &mapAgent{passwords: map[string]string{"alice": "x"}}
+	tokens := tokenAgent{&mapAgent{}, map[string]string{"tok-alice": "alice"}}
+	c := NewChainAgent(passwords, tokens)
+	ctx := t.Context()
+
+	if _, ok := AsCredentialsAuthenticator(c); !ok {
+		t.Fatal("chain does not report CredentialsAuthenticator")
+	}
+	// The token backend vouches for alice although the password backend
+	// owns her.
+	creds := Credentials{Username: "alice", Mechanism: "XOAUTH2", Response: []byte("tok-alice")}
+	if s, err := VerifyCredentials(ctx, c, creds); err != nil || s.Credential.Kind != CredentialBearerToken {
+		t.Errorf("alice token: %+v, %v", s, err)
+	}
+	creds.Response = []byte("forged")
+	if _, err := VerifyCredentials(ctx, c, creds); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("forged token: err = %v, want ErrAuthFailed", err)
+	}
+	if _, err := VerifyCredentials(ctx, c, Credentials{Username: "alice", Password: "x"}); err != nil {
+		t.Errorf("alice password: %v", err)
+	}
+	creds.Mechanism = "GSSAPI"
+	if _, err := VerifyCredentials(ctx, c, creds); !errors.Is(err, autherrors.ErrMechanismUnsupported) {
+		t.Errorf("GSSAPI: err = %v, want ErrMechanismUnsupported", err)
+	}
+	if _, ok := AsCredentialsAuthenticator(NewChainAgent(passwords)); ok {
+		t.Error("chain without credential agents reports CredentialsAuthenticator")
+	}
+}
+
+func TestOpenChainAgent_ClosesOnError(t *testing.T) {
+	opened := &mapAgent{}
+	RegisterAuthAgent("chain-test-ok", func(AuthAgentConfig) (AuthenticationAgent, error) { return opened, nil })
+
+	_, err := OpenChainAgent([]AuthAgentConfig{{Type: "chain-test-ok"}, {Type: "chain-test-missing"}})
+	if !errors.Is(err, autherrors.ErrAuthAgentNotRegistered) {
+		t.Fatalf("err = %v, want ErrAuthAgentNotRegistered", err)
+	}
+	if !opened.closed {
+		t.Error("agent opened before the failure was not closed")
+	}
+}
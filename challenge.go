@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"context"
+	"time"
+)
+
+// Challenge is an extra verification step issued by a ChallengeProvider,
+// such as a CAPTCHA, an emailed code or a push approval. How it is presented
+// is up to the web flow that receives it.
+type Challenge struct {
+	// ID identifies the challenge when the response is verified.
+	ID string `json:"id"`
+
+	// Kind names the challenge type (e.g., "captcha", "email_code").
+	Kind string `json:"kind"`
+
+	// Data carries provider-specific presentation data, such as a CAPTCHA
+	// site key or a masked delivery address.
+	Data map[string]string `json:"data,omitempty"`
+
+	// Expires is when the challenge stops being accepted; zero means the
+	// provider does not expire it.
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// ChallengeProvider issues and verifies step-up challenges for web-based
+// flows (admin API, self-service pages) after suspicious activity. It is
+// protocol-agnostic: mail protocols cannot present a challenge, so their
+// daemons keep failing step-up logins.
+type ChallengeProvider interface {
+	// Issue starts a challenge for username. reason is a short machine-
+	// readable cause (e.g., the anomaly scorer's reason). A nil Challenge
+	// with no error means the provider cannot challenge this user; the
+	// step-up stays unresolved.
+	Issue(ctx context.Context, username, reason string) (*Challenge, error)
+
+	// Verify checks the response to the challenge with the given ID and
+	// reports whether it passed. Unknown or expired challenges do not pass.
+	// Returns an error only for backend failures.
+	Verify(ctx context.Context, username, id, response string) (bool, error)
+}
+
+// NoopChallengeProvider is the default ChallengeProvider: it never issues a
+// challenge, so step-ups stay unresolved, and no response ever passes.
+type NoopChallengeProvider struct{}
+
+// Issue returns no challenge.
+func (NoopChallengeProvider) Issue(context.Context, string, string) (*Challenge, error) {
+	return nil, nil
+}
+
+// Verify rejects every response; no challenge was issued.
+func (NoopChallengeProvider) Verify(context.Context, string, string, string) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,170 @@
+// Command authd serves the infodancer auth layer over the Dovecot
+// authentication protocol on a UNIX socket, so Postfix (smtpd_sasl_type =
+// dovecot) and other Dovecot SASL clients can authenticate against the
+// domains tree.
+//
+// Usage:
+//
+//	authd [--domains <path>] [--socket <path>] [--webhooks <path>]
+//	      [--audit-log <path>] [--audit-syslog] [--failure-log <path>] [--tarpit]
+//	      [--realm <realm>=<domain>]... [--verbose]
+//
+// The domains path defaults to the INFODANCER_DOMAINS_PATH environment
+// variable, then /etc/infodancer/domains. The socket defaults to
+// /run/infodancer/auth; it is created with mode 0660, so set its group to
+// the MTA's.
+//
+// --webhooks names a webhook configuration file (see package webhook);
+// domain and user lifecycle changes in the domains tree are then posted to
+// the endpoints it lists.
+//
+// --audit-log appends an audit record of every login and user lookup to
+// the named file as JSON lines, and --audit-syslog sends them to the local
+// syslog daemon with the auth facility (see package audit).
+//
+// --failure-log appends one line per refused login to the named file in
+// the fixed format of audit.FailureLog, for fail2ban and CrowdSec.
+//
+// --tarpit delays logins after consecutive failures for the same client
+// and user, doubling the delay with each failure (see domain.Tarpit).
+//
+// --realm routes bare usernames (no "@domain") arriving on realm to
+// domain, where realm is the TLS server name or listening address the MTA
+// reports (local_name, lip and lport); repeat it for each brand endpoint
+// (see domain.AuthRouter.WithRealms).
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	_ "github.com/infodancer/msgstore/maildir" // registers the "maildir" store type
+
+	"github.com/infodancer/auth/audit"
+	"github.com/infodancer/auth/authproto/dovecot"
+	"github.com/infodancer/auth/domain"
+	"github.com/infodancer/auth/passwd" // also registers the "passwd" agent type
+	"github.com/infodancer/auth/webhook"
+)
+
+func main() {
+	domainsPath := flag.String("domains", "", "path to the domains directory")
+	socketPath := flag.String("socket", "/run/infodancer/auth", "UNIX socket to listen on")
+	webhooksPath := flag.String("webhooks", "", "webhook configuration file")
+	auditPath := flag.String("audit-log", "", "append an audit trail of logins to this file")
+	auditSyslog := flag.Bool("audit-syslog", false, "send an audit trail of logins to syslog")
+	failurePath := flag.String("failure-log", "", "append refused logins to this file for fail2ban")
+	tarpit := flag.Bool("tarpit", false, "delay logins after consecutive failures")
+	realms := make(map[string]string)
+	flag.Func("realm", "route bare usernames on `realm=domain` (TLS server name or listening address) to domain; repeatable", func(v string) error {
+		realm, name, ok := strings.Cut(v, "=")
+		if !ok || realm == "" || name == "" {
+			return errors.New("want realm=domain")
+		}
+		realms[realm] = name
+		return nil
+	})
+	verbose := flag.Bool("verbose", false, "enable debug logging")
+	flag.Parse()
+
+	level := slog.LevelInfo
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+	if *domainsPath == "" {
+		*domainsPath = os.Getenv("INFODANCER_DOMAINS_PATH")
+	}
+	if *domainsPath == "" {
+		*domainsPath = "/etc/infodancer/domains"
+	}
+
+	if _, err := passwd.LoadPeppersFromEnv(); err != nil {
+		fmt.Fprintf(os.Stderr, "authd: %v\n", err)
+		os.Exit(1)
+	}
+
+	provider := domain.NewFilesystemDomainProvider(*domainsPath, logger).WithPepperFile(os.Getenv(passwd.PepperEnv))
+	defer func() { _ = provider.Close() }()
+	router := domain.NewAuthRouter(provider, nil)
+	defer func() { _ = router.Close() }()
+
+	if len(realms) > 0 {
+		router.WithRealms(realms)
+	}
+	if *tarpit {
+		router.WithMiddleware(domain.NewTarpit(domain.DefaultTarpitConfig()).Middleware)
+	}
+
+	var auditors []audit.Auditor
+	if *auditPath != "" {
+		a, err := audit.NewFileAuditor(*auditPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "authd: %v\n", err)
+			os.Exit(1)
+		}
+		defer func() { _ = a.Close() }()
+		auditors = append(auditors, a)
+	}
+	if *auditSyslog {
+		a, err := audit.NewSyslogAuditor("", "", "authd")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "authd: %v\n", err)
+			os.Exit(1)
+		}
+		defer func() { _ = a.Close() }()
+		auditors = append(auditors, a)
+	}
+	if *failurePath != "" {
+		l, err := audit.NewFailureLog(*failurePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "authd: %v\n", err)
+			os.Exit(1)
+		}
+		defer func() { _ = l.Close() }()
+		auditors = append(auditors, l)
+	}
+	if len(auditors) > 0 {
+		router.WithAuditor(audit.Multi(auditors...))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if *webhooksPath != "" {
+		cfg, err := webhook.LoadConfig(*webhooksPath)
+		if err == nil && len(cfg.Hooks) == 0 {
+			err = fmt.Errorf("%s lists no hooks", *webhooksPath)
+		}
+		var hooks *webhook.Dispatcher
+		if err == nil {
+			hooks, err = webhook.New(cfg, nil, logger)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "authd: %v\n", err)
+			os.Exit(1)
+		}
+		go hooks.Run(ctx, provider)
+	}
+
+	srv := &dovecot.Server{Agent: router, Logger: logger}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		_ = srv.Close()
+	}()
+
+	logger.Info("authd listening", slog.String("socket", *socketPath), slog.String("domains", *domainsPath))
+	if err := srv.ListenAndServe(*socketPath); err != nil && !errors.Is(err, dovecot.ErrServerClosed) {
+		fmt.Fprintf(os.Stderr, "authd: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,253 @@
+// Command authsmoke checks a deployed domains tree end to end: it loads
+// the domain provider, adds a temporary user, logs in as them through
+// domain.AuthRouter, resolves their address and optionally a forward,
+// delivers a test message through the domain's delivery agent, and
+// removes the user again. Run it after each deploy.
+//
+// Usage:
+//
+//	authsmoke [--domains <path>] [--forward <address>] [--format json|text] [--verbose] <domain>
+//
+// --forward names an address of the domain that a forwarding rule
+// handles; it must resolve as one. The report lists each step with its
+// result and duration, as a JSON object (the default) or one line per
+// step. The command exits 0 if every step passed, 1 if one failed and 2
+// on misuse. The temporary user is removed even when a step fails; the
+// test message stays in their mailbox, as mail does for purged users.
+//
+// The domain's credential backend must be its writable passwd file. The
+// domains path defaults to the INFODANCER_DOMAINS_PATH environment
+// variable, then /etc/infodancer/domains.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/infodancer/msgstore"
+	_ "github.com/infodancer/msgstore/maildir" // registers the "maildir" store type
+
+	"github.com/infodancer/auth/domain"
+	"github.com/infodancer/auth/passwd" // also registers the "passwd" agent type
+)
+
+// Exit statuses.
+const (
+	exitPass  = 0
+	exitFail  = 1
+	exitUsage = 2
+)
+
+// userPrefix starts the temporary user's localpart.
+const userPrefix = "authsmoke-"
+
+// step is the outcome of one check.
+type step struct {
+	Name       string `json:"name"`
+	OK         bool   `json:"ok"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// report is the command's output.
+type report struct {
+	Domain string `json:"domain"`
+	User   string `json:"user,omitempty"`
+	OK     bool   `json:"ok"`
+	Steps  []step `json:"steps"`
+}
+
+// run records fn as a step named name and reports whether it passed.
+// Once a step fails, later steps are skipped unless always is set.
+func (r *report) run(name string, always bool, fn func() error) bool {
+	if !r.OK && !always {
+		return false
+	}
+	start := time.Now()
+	err := fn()
+	s := step{Name: name, OK: err == nil, DurationMS: time.Since(start).Milliseconds()}
+	if err != nil {
+		s.Error = err.Error()
+		r.OK = false
+	}
+	r.Steps = append(r.Steps, s)
+	return s.OK
+}
+
+// write prints the report in format.
+func (r *report) write(w io.Writer, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+	for _, s := range r.Steps {
+		status := "ok"
+		if !s.OK {
+			status = "FAIL " + s.Error
+		}
+		if _, err := fmt.Fprintf(w, "%-10s %5dms  %s\n", s.Name, s.DurationMS, status); err != nil {
+			return err
+		}
+	}
+	result := "PASS"
+	if !r.OK {
+		result = "FAIL"
+	}
+	_, err := fmt.Fprintf(w, "%s: %s\n", result, r.Domain)
+	return err
+}
+
+func main() {
+	domainsPath := flag.String("domains", "", "path to the domains directory")
+	forward := flag.String("forward", "", "address of the domain that must resolve through a forwarding rule")
+	format := flag.String("format", "json", "report format: json or text")
+	verbose := flag.Bool("verbose", false, "enable debug logging")
+	flag.Parse()
+
+	level := slog.LevelWarn
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+	if flag.NArg() != 1 || (*format != "json" && *format != "text") {
+		fmt.Fprintln(os.Stderr, "usage: authsmoke [--domains <path>] [--forward <address>] [--format json|text] <domain>")
+		os.Exit(exitUsage)
+	}
+
+	if *domainsPath == "" {
+		*domainsPath = os.Getenv("INFODANCER_DOMAINS_PATH")
+	}
+	if *domainsPath == "" {
+		*domainsPath = "/etc/infodancer/domains"
+	}
+
+	if _, err := passwd.LoadPeppersFromEnv(); err != nil {
+		fmt.Fprintf(os.Stderr, "authsmoke: %v\n", err)
+		os.Exit(exitUsage)
+	}
+
+	r := smoke(context.Background(), logger, *domainsPath, strings.ToLower(flag.Arg(0)), *forward)
+	if err := r.write(os.Stdout, *format); err != nil {
+		fmt.Fprintf(os.Stderr, "authsmoke: %v\n", err)
+		os.Exit(exitFail)
+	}
+	if !r.OK {
+		os.Exit(exitFail)
+	}
+	os.Exit(exitPass)
+}
+
+// smoke runs the checks against name.
+func smoke(ctx context.Context, logger *slog.Logger, domainsPath, name, forward string) *report {
+	r := &report{Domain: name, OK: true}
+	ctx = domain.WithProtocol(ctx, "authsmoke")
+
+	provider := domain.NewFilesystemDomainProvider(domainsPath, logger).WithPepperFile(os.Getenv(passwd.PepperEnv))
+	defer func() { _ = provider.Close() }()
+	router := domain.NewAuthRouter(provider, nil)
+	defer func() { _ = router.Close() }()
+
+	var d *domain.Domain
+	r.run("load", false, func() error {
+		if d = provider.GetDomain(name); d == nil {
+			return fmt.Errorf("domain %q failed to load (see log for details)", name)
+		}
+		return nil
+	})
+
+	passwdPath := filepath.Join(domainsPath, name, "passwd")
+	var localpart, password string
+	created := r.run("create", false, func() error {
+		suffix := make([]byte, 6)
+		if _, err := rand.Read(suffix); err != nil {
+			return err
+		}
+		localpart = userPrefix + hex.EncodeToString(suffix)
+		policy, err := provider.PasswordPolicy(name)
+		if err != nil {
+			return err
+		}
+		if password, err = passwd.GeneratePassword(policy); err != nil {
+			return err
+		}
+		return passwd.AddUser(passwdPath, localpart, password)
+	})
+	address := localpart + "@" + name
+	if created {
+		r.User = address
+	}
+
+	r.run("login", false, func() error {
+		session, err := router.Authenticate(ctx, address, password)
+		if err != nil {
+			return err
+		}
+		if session.User == nil || session.User.Mailbox == "" {
+			return errors.New("session has no mailbox")
+		}
+		return nil
+	})
+
+	r.run("resolve", false, func() error {
+		info, err := router.LookupAddress(ctx, address)
+		if err != nil {
+			return err
+		}
+		if !info.CanAuthenticate || !info.AcceptsMail || info.IsForwardOnly {
+			return fmt.Errorf("%s resolved as %+v, want a mailbox", address, info)
+		}
+		return nil
+	})
+
+	if forward != "" {
+		r.run("forward", false, func() error {
+			info, err := router.LookupAddress(ctx, forward)
+			if err != nil {
+				return err
+			}
+			if !info.AcceptsMail || !(info.IsAlias || info.CatchallMatched) {
+				return fmt.Errorf("%s resolved as %+v, want a forward", forward, info)
+			}
+			return nil
+		})
+	}
+
+	r.run("deliver", false, func() error {
+		envelope := msgstore.Envelope{
+			From:         "postmaster@" + name,
+			Recipients:   []string{address},
+			ReceivedTime: time.Now(),
+		}
+		return d.DeliveryAgent.Deliver(ctx, envelope, strings.NewReader(testMessage(name, address, envelope.ReceivedTime)))
+	})
+
+	if created {
+		r.run("cleanup", true, func() error {
+			return passwd.DeleteUser(passwdPath, localpart)
+		})
+	}
+	return r
+}
+
+// testMessage returns the message delivered to address.
+func testMessage(name, address string, date time.Time) string {
+	return "From: postmaster@" + name + "\r\n" +
+		"To: " + address + "\r\n" +
+		"Subject: authsmoke delivery check\r\n" +
+		"Date: " + date.Format(time.RFC1123Z) + "\r\n" +
+		"\r\n" +
+		"This message was delivered by authsmoke and can be deleted.\r\n"
+}
@@ -0,0 +1,103 @@
+// Command checkpassword authenticates against the domains tree using the djb
+// checkpassword interface, so qmail-pop3d and other legacy tools can share
+// the passwd files the rest of the mail system uses.
+//
+// Usage:
+//
+//	checkpassword [--domains <path>] [--protocol <name>] [--verbose] <prog> [args...]
+//
+// The login is read from file descriptor 3 (see package
+// authproto/checkpassword). On success prog is executed with USER, MAILBOX
+// and, for absolute mailbox paths, HOME set; otherwise the command exits 1
+// (login refused), 2 (misuse) or 111 (temporary failure). Usernames are
+// full addresses, routed to their domain as by AuthRouter. The client IP
+// is taken from TCPREMOTEIP, as set by tcpserver, for rate limiting and
+// login history.
+//
+// The domains path defaults to the INFODANCER_DOMAINS_PATH environment
+// variable, then /etc/infodancer/domains.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"syscall"
+
+	_ "github.com/infodancer/msgstore/maildir" // registers the "maildir" store type
+
+	"github.com/infodancer/auth/authproto/checkpassword"
+	"github.com/infodancer/auth/domain"
+	"github.com/infodancer/auth/passwd" // also registers the "passwd" agent type
+)
+
+func main() {
+	domainsPath := flag.String("domains", "", "path to the domains directory")
+	protocol := flag.String("protocol", "pop3", "protocol recorded for the login")
+	verbose := flag.Bool("verbose", false, "enable debug logging")
+	flag.Parse()
+
+	level := slog.LevelWarn
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: checkpassword [flags] <prog> [args...]")
+		os.Exit(checkpassword.ExitUsage)
+	}
+	prog, err := exec.LookPath(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "checkpassword: %v\n", err)
+		os.Exit(checkpassword.ExitUsage)
+	}
+
+	if *domainsPath == "" {
+		*domainsPath = os.Getenv("INFODANCER_DOMAINS_PATH")
+	}
+	if *domainsPath == "" {
+		*domainsPath = "/etc/infodancer/domains"
+	}
+
+	if _, err := passwd.LoadPeppersFromEnv(); err != nil {
+		logger.Error("load peppers", slog.String("error", err.Error()))
+		os.Exit(checkpassword.ExitTemporary)
+	}
+
+	os.Exit(run(logger, *domainsPath, *protocol, prog))
+}
+
+// run checks the login and executes prog, returning an exit status only if
+// it does not exec.
+func run(logger *slog.Logger, domainsPath, protocol, prog string) int {
+	provider := domain.NewFilesystemDomainProvider(domainsPath, logger).WithPepperFile(os.Getenv(passwd.PepperEnv))
+	router := domain.NewAuthRouter(provider, nil)
+
+	ctx := domain.WithProtocol(context.Background(), protocol)
+	if ip := os.Getenv("TCPREMOTEIP"); ip != "" {
+		ctx = domain.WithClientIP(ctx, ip)
+	}
+
+	fd3 := os.NewFile(3, "checkpassword-input")
+	user, status, err := checkpassword.Check(ctx, router, fd3)
+	_ = fd3.Close()
+	_ = router.Close()
+	_ = provider.Close()
+	if err != nil {
+		if status == checkpassword.ExitTemporary || status == checkpassword.ExitUsage {
+			logger.Error("checkpassword failed", slog.String("error", err.Error()))
+		} else {
+			logger.Info("login refused", slog.String("error", err.Error()))
+		}
+		return status
+	}
+
+	env := checkpassword.Env(os.Environ(), user)
+	err = syscall.Exec(prog, flag.Args(), env)
+	logger.Error("exec failed", slog.String("program", prog), slog.String("error", err.Error()))
+	return checkpassword.ExitTemporary
+}
@@ -0,0 +1,75 @@
+// Command saslauthd serves the infodancer auth layer over the Cyrus
+// saslauthd protocol on a UNIX socket, as a drop-in replacement for Cyrus
+// saslauthd: Postfix, Cyrus IMAP and other Cyrus SASL clients configured
+// with pwcheck_method: saslauthd authenticate against the domains tree by
+// pointing saslauthd_path at the socket.
+//
+// Usage:
+//
+//	saslauthd [--domains <path>] [--socket <path>] [--verbose]
+//
+// The domains path defaults to the INFODANCER_DOMAINS_PATH environment
+// variable, then /etc/infodancer/domains. The socket defaults to
+// /run/saslauthd/mux, where Cyrus SASL looks for it; it is created with
+// mode 0660, so set its group to the clients'.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	_ "github.com/infodancer/msgstore/maildir" // registers the "maildir" store type
+
+	"github.com/infodancer/auth/authproto/saslauthd"
+	"github.com/infodancer/auth/domain"
+	"github.com/infodancer/auth/passwd" // also registers the "passwd" agent type
+)
+
+func main() {
+	domainsPath := flag.String("domains", "", "path to the domains directory")
+	socketPath := flag.String("socket", "/run/saslauthd/mux", "UNIX socket to listen on")
+	verbose := flag.Bool("verbose", false, "enable debug logging")
+	flag.Parse()
+
+	level := slog.LevelInfo
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+	if *domainsPath == "" {
+		*domainsPath = os.Getenv("INFODANCER_DOMAINS_PATH")
+	}
+	if *domainsPath == "" {
+		*domainsPath = "/etc/infodancer/domains"
+	}
+
+	if _, err := passwd.LoadPeppersFromEnv(); err != nil {
+		fmt.Fprintf(os.Stderr, "saslauthd: %v\n", err)
+		os.Exit(1)
+	}
+
+	provider := domain.NewFilesystemDomainProvider(*domainsPath, logger).WithPepperFile(os.Getenv(passwd.PepperEnv))
+	defer func() { _ = provider.Close() }()
+	router := domain.NewAuthRouter(provider, nil)
+	defer func() { _ = router.Close() }()
+
+	srv := &saslauthd.Server{Router: router, Logger: logger}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		_ = srv.Close()
+	}()
+
+	logger.Info("saslauthd listening", slog.String("socket", *socketPath), slog.String("domains", *domainsPath))
+	if err := srv.ListenAndServe(*socketPath); err != nil && !errors.Is(err, saslauthd.ErrServerClosed) {
+		fmt.Fprintf(os.Stderr, "saslauthd: %v\n", err)
+		os.Exit(1)
+	}
+}
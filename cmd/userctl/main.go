@@ -3,9 +3,68 @@
 // Usage:
 //
 //	userctl [--domains <path>] [--verbose] add    <user@domain>   add user (prompts for password)
-//	userctl [--domains <path>] [--verbose] del    <user@domain>   remove user
+//	userctl [--domains <path>] [--verbose] add --generate [--password-fd <n>] <user@domain>
+//	                                                               add user with a generated password, printed once
+//	userctl [--domains <path>] [--verbose] del    <user@domain>   remove user (mark deleted with a grace period)
+//	userctl [--domains <path>] [--verbose] restore <user@domain>  undelete a user marked deleted
+//	userctl [--domains <path>] [--verbose] purge  <user@domain>   remove user at once, even with a grace period
+//	userctl [--domains <path>] [--verbose] reap   <domain>        remove users whose delete grace period has ended
 //	userctl [--domains <path>] [--verbose] list   <domain>        list users and mailboxes
 //	userctl [--domains <path>] [--verbose] verify <user@domain>   verify user password
+//	userctl [--domains <path>] [--verbose] keygen <user@domain>   create an encryption key pair (prompts for password)
+//	userctl [--domains <path>] [--verbose] key rotate <user@domain>
+//	                                                               replace the key pair, keeping the old one for decryption
+//	userctl [--domains <path>] [--verbose] key recover <user@domain> <recovery-key-file>
+//	                                                               restore an escrowed key and set a new password
+//	userctl [--domains <path>] [--verbose] key import <user@domain> <openpgp-key-file>
+//	                                                               use an OpenPGP public key (armored or binary) for the user
+//	userctl [--domains <path>] [--verbose] key escrow-keygen <path>
+//	                                                               create a domain recovery key pair for [auth] escrow_pubkey
+//	userctl [--domains <path>] [--verbose] flags  <user@domain> [flag,...] set account flags (disabled,
+//	                                                               locked, nologin); none clears them
+//	userctl [--domains <path>] [--verbose] services <user@domain> [service,...] limit logins to services
+//	                                                               (imap, pop3, smtp, webmail); none lifts the limit
+//	userctl [--domains <path>] [--verbose] check  <domain> [text|json] report config, forwards and passwd
+//	                                                               problems and missing role accounts (default text)
+//	userctl [--domains <path>] [--verbose] history <user@domain> [n] show recent logins (default 20)
+//	userctl [--domains <path>] [--verbose] lastlog <user@domain|domain> show last logins and failures since
+//	userctl [--domains <path>] [--verbose] sessions list <user@domain|domain>
+//	                                                               show active sessions
+//	userctl [--domains <path>] [--verbose] sessions revoke <user@domain> <id|all>
+//	                                                               end one or all of a user's sessions
+//	userctl [--domains <path>] [--verbose] undo   <domain> [n]    roll back the last n passwd changes (default 1)
+//	userctl [--domains <path>] [--verbose] domain add [--template <name>] <domain>
+//	                                                               provision a new domain from a template
+//	userctl [--domains <path>] [--verbose] domain freeze <domain> <reason>
+//	                                                               block logins and off-host forwarding for a domain
+//	userctl [--domains <path>] [--verbose] domain thaw <domain> [reason]
+//	                                                               lift a freeze
+//	userctl [--domains <path>] [--verbose] domain status <domain>  show whether a domain is frozen, and its freeze history
+//	userctl [--domains <path>] [--verbose] gal    <domain> [json|vcard] export the global address list (default json)
+//	userctl [--domains <path>] [--verbose] usage  <domain|all> [json|csv] report account usage for billing (default json)
+//	userctl [--domains <path>] [--verbose] wkd    <domain|all> <dir>
+//	                                                               export OpenPGP keys in Web Key Directory layout
+//	userctl [--domains <path>] [--verbose] seal   <domain>        encrypt passwd, forwards and config.toml with the host key
+//	userctl [--domains <path>] [--verbose] compile <domain>       compile passwd into passwd.cdb for fast lookups
+//	userctl [--domains <path>] [--verbose] migrate <domain>       rewrite passwd entries in the v2 format
+//	userctl [--verbose] hostkey <path>                             generate a new host key
+//
+// With --generate, add creates a password under the domain's [password]
+// policy (see passwd.PasswordPolicy) and prints it once for provisioning
+// scripts: alone on stdout, or on the descriptor given by --password-fd.
+//
+// With a delete grace period, from the domain's delete_grace_days or
+// --delete-grace-days, del marks the user deleted instead of removing it:
+// logins stop at once, mail is quarantined, and reap removes the user once
+// the grace period has passed (see passwd.SoftDeleteUser).
+//
+// Mutating subcommands fail with a read-only error when the domains path
+// contains a .readonly marker (see domain.ReadOnlyMarker), as on secondaries.
+//
+// Sealed files (see package atrest) are read with the host key named by
+// --host-key or the INFODANCER_HOST_KEY environment variable. New password
+// hashes are peppered with the current pepper in the file named by --pepper
+// or INFODANCER_PEPPER_FILE (see passwd.Peppers).
 //
 // The domains path is resolved in order:
 //  1. --domains flag
@@ -15,19 +74,32 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/pelletier/go-toml/v2"
 	"golang.org/x/term"
 
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/address"
+	"github.com/infodancer/auth/atrest"
+	"github.com/infodancer/auth/diagnostic"
+	"github.com/infodancer/auth/domain"
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/forwards"
 	"github.com/infodancer/auth/passwd"
+	"github.com/infodancer/auth/wkd"
 )
 
 const defaultConfigPath = "/etc/infodancer/config.toml"
@@ -43,6 +115,9 @@ func main() {
 	fs := flag.NewFlagSet("userctl", flag.ExitOnError)
 	domainsFlag := fs.String("domains", "", "path to domains directory")
 	verboseFlag := fs.Bool("verbose", true, "enable debug logging")
+	hostKeyFlag := fs.String("host-key", os.Getenv(atrest.KeyEnv), "path to host key for sealed files")
+	pepperFlag := fs.String("pepper", os.Getenv(passwd.PepperEnv), "path to password pepper file")
+	graceFlag := fs.Int("delete-grace-days", -1, "days deleted users are kept before reap removes them (default: the domain's delete_grace_days)")
 	fs.Usage = usage
 
 	if err := fs.Parse(os.Args[1:]); err != nil {
@@ -61,6 +136,26 @@ func main() {
 		os.Exit(1)
 	}
 
+	// hostkey needs neither a domains path nor an existing key.
+	if args[0] == "hostkey" {
+		exitOnErr(cmdHostKey(args[1]))
+		return
+	}
+
+	if *hostKeyFlag != "" {
+		key, err := atrest.LoadKey(*hostKeyFlag)
+		exitOnErr(err)
+		atrest.SetKey(key)
+		slog.Debug("loaded host key", "path", *hostKeyFlag)
+	}
+
+	if *pepperFlag != "" {
+		peppers, err := passwd.LoadPeppers(*pepperFlag)
+		exitOnErr(err)
+		exitOnErr(passwd.SetPeppers(peppers))
+		slog.Debug("loaded peppers", "path", *pepperFlag, "current", peppers.Current)
+	}
+
 	domainsPath, err := resolveDomainsPath(*domainsFlag)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -69,28 +164,53 @@ func main() {
 
 	slog.Debug("resolved domains path", "path", domainsPath)
 
+	if domain.MarkedReadOnly(domainsPath) {
+		slog.Debug("domains path is read-only", "marker", filepath.Join(domainsPath, domain.ReadOnlyMarker))
+	}
+
 	subcmd := args[0]
 	target := args[1]
 
 	switch subcmd {
 	case "add":
+		exitOnErr(cmdAddArgs(domainsPath, args[1:]))
+
+	case "del":
 		username, domainDir, err := parseEmailTarget(domainsPath, target)
 		if err == nil {
 			passwdPath := filepath.Join(domainDir, "passwd")
-			slog.Debug("adding user", "username", username, "passwd", passwdPath)
-			err = cmdAdd(passwdPath, username)
+			var grace time.Duration
+			grace, err = deleteGrace(domainsPath, filepath.Base(domainDir), *graceFlag)
+			if err == nil {
+				slog.Debug("deleting user", "username", username, "passwd", passwdPath, "grace", grace)
+				err = cmdDel(passwdPath, username, grace)
+			}
 		}
 		exitOnErr(err)
 
-	case "del":
+	case "restore":
+		username, domainDir, err := parseEmailTarget(domainsPath, target)
+		if err == nil {
+			passwdPath := filepath.Join(domainDir, "passwd")
+			slog.Debug("restoring user", "username", username, "passwd", passwdPath)
+			err = cmdRestore(passwdPath, username)
+		}
+		exitOnErr(err)
+
+	case "purge":
 		username, domainDir, err := parseEmailTarget(domainsPath, target)
 		if err == nil {
 			passwdPath := filepath.Join(domainDir, "passwd")
-			slog.Debug("deleting user", "username", username, "passwd", passwdPath)
-			err = cmdDel(passwdPath, username)
+			slog.Debug("purging user", "username", username, "passwd", passwdPath)
+			err = cmdPurge(passwdPath, username)
 		}
 		exitOnErr(err)
 
+	case "reap":
+		passwdPath := filepath.Join(domainsPath, target, "passwd")
+		slog.Debug("reaping deleted users", "domain", target, "passwd", passwdPath)
+		exitOnErr(cmdReap(passwdPath))
+
 	case "list":
 		domainDir := filepath.Join(domainsPath, target)
 		passwdPath := filepath.Join(domainDir, "passwd")
@@ -105,6 +225,124 @@ func main() {
 		}
 		exitOnErr(err)
 
+	case "keygen":
+		username, domainDir, err := parseEmailTarget(domainsPath, target)
+		if err == nil {
+			slog.Debug("generating keys", "username", username, "domain_dir", domainDir)
+			err = cmdKeygen(domainsPath, domainDir, username)
+		}
+		exitOnErr(err)
+
+	case "key":
+		exitOnErr(cmdKey(domainsPath, target, args[2:]))
+
+	case "flags":
+		username, domainDir, err := parseEmailTarget(domainsPath, target)
+		if err == nil {
+			var flags []string
+			if len(args) > 2 {
+				flags = strings.Split(args[2], ",")
+			}
+			passwdPath := filepath.Join(domainDir, "passwd")
+			slog.Debug("setting account flags", "username", username, "passwd", passwdPath, "flags", flags)
+			err = cmdFlags(passwdPath, username, flags)
+		}
+		exitOnErr(err)
+
+	case "services":
+		username, domainDir, err := parseEmailTarget(domainsPath, target)
+		if err == nil {
+			var list string
+			if len(args) > 2 {
+				list = args[2]
+			}
+			passwdPath := filepath.Join(domainDir, "passwd")
+			slog.Debug("setting services", "username", username, "passwd", passwdPath, "services", list)
+			err = cmdServices(passwdPath, username, list)
+		}
+		exitOnErr(err)
+
+	case "check":
+		format := "text"
+		if len(args) > 2 {
+			format = args[2]
+		}
+		slog.Debug("checking domain", "domain", target, "format", format)
+		exitOnErr(cmdCheck(domainsPath, target, format))
+
+	case "history":
+		n := 20
+		if len(args) > 2 {
+			v, err := strconv.Atoi(args[2])
+			if err != nil || v < 1 {
+				exitOnErr(fmt.Errorf("invalid count %q", args[2]))
+			}
+			n = v
+		}
+		slog.Debug("showing login history", "user", target, "count", n)
+		exitOnErr(cmdHistory(domainsPath, target, n))
+
+	case "lastlog":
+		slog.Debug("showing login state", "target", target)
+		exitOnErr(cmdLastlog(domainsPath, target))
+
+	case "sessions":
+		exitOnErr(cmdSessions(domainsPath, target, args[2:]))
+
+	case "undo":
+		n := 1
+		if len(args) > 2 {
+			v, err := strconv.Atoi(args[2])
+			if err != nil || v < 1 {
+				exitOnErr(fmt.Errorf("invalid count %q", args[2]))
+			}
+			n = v
+		}
+		passwdPath := filepath.Join(domainsPath, target, "passwd")
+		slog.Debug("undoing passwd changes", "domain", target, "passwd", passwdPath, "count", n)
+		exitOnErr(cmdUndo(passwdPath, n))
+
+	case "domain":
+		exitOnErr(cmdDomain(domainsPath, target, args[2:]))
+
+	case "gal":
+		format := "json"
+		if len(args) > 2 {
+			format = args[2]
+		}
+		slog.Debug("exporting address list", "domain", target, "format", format)
+		exitOnErr(cmdGAL(domainsPath, target, format))
+
+	case "wkd":
+		if len(args) < 3 {
+			exitOnErr(fmt.Errorf("usage: wkd <domain|all> <dir>"))
+		}
+		slog.Debug("exporting web key directory", "domain", target, "dir", args[2])
+		exitOnErr(cmdWKD(domainsPath, target, args[2]))
+
+	case "usage":
+		format := "json"
+		if len(args) > 2 {
+			format = args[2]
+		}
+		slog.Debug("reporting usage", "domain", target, "format", format)
+		exitOnErr(cmdUsage(domainsPath, target, format))
+
+	case "seal":
+		domainDir := filepath.Join(domainsPath, target)
+		slog.Debug("sealing domain", "domain", target, "dir", domainDir)
+		exitOnErr(cmdSeal(domainDir))
+
+	case "compile":
+		passwdPath := filepath.Join(domainsPath, target, "passwd")
+		slog.Debug("compiling passwd", "domain", target, "passwd", passwdPath)
+		exitOnErr(cmdCompile(passwdPath))
+
+	case "migrate":
+		passwdPath := filepath.Join(domainsPath, target, "passwd")
+		slog.Debug("migrating passwd", "domain", target, "passwd", passwdPath)
+		exitOnErr(cmdMigrate(passwdPath))
+
 	default:
 		fmt.Fprintf(os.Stderr, "unknown subcommand: %s\n", subcmd)
 		usage()
@@ -157,13 +395,41 @@ func domainsPathFromConfig(configPath string) (string, error) {
 	return cfg.SMTPD.DomainsPath, nil
 }
 
-// parseEmailTarget splits user@domain and returns the username and domain directory path.
-func parseEmailTarget(domainsPath, address string) (username, domainDir string, err error) {
-	parts := strings.SplitN(address, "@", 2)
-	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
-		return "", "", fmt.Errorf("invalid address %q: expected user@domain", address)
+// parseEmailTarget parses user@domain (see address.Parse) and returns the
+// username and the directory of the canonical domain name.
+func parseEmailTarget(domainsPath, addr string) (username, domainDir string, err error) {
+	a, err := address.Parse(addr)
+	if err != nil || strings.HasPrefix(a.Domain, "[") {
+		return "", "", fmt.Errorf("invalid address %q: expected user@domain", addr)
 	}
-	return parts[0], filepath.Join(domainsPath, parts[1]), nil
+	return a.Local, filepath.Join(domainsPath, a.Domain), nil
+}
+
+// cmdAddArgs parses the arguments of add: [--generate [--password-fd N]]
+// <user@domain>.
+func cmdAddArgs(domainsPath string, args []string) error {
+	fs := flag.NewFlagSet("add", flag.ContinueOnError)
+	generate := fs.Bool("generate", false, "generate a password with the domain's password policy and print it once")
+	fd := fs.Int("password-fd", -1, "write the generated password to this file descriptor instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: add [--generate [--password-fd <n>]] <user@domain>")
+	}
+	if *fd >= 0 && !*generate {
+		return fmt.Errorf("--password-fd requires --generate")
+	}
+	username, domainDir, err := parseEmailTarget(domainsPath, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	passwdPath := filepath.Join(domainDir, "passwd")
+	slog.Debug("adding user", "username", username, "passwd", passwdPath, "generate", *generate)
+	if !*generate {
+		return cmdAdd(passwdPath, username)
+	}
+	return cmdAddGenerated(domainsPath, filepath.Base(domainDir), passwdPath, username, *fd)
 }
 
 func cmdAdd(passwdPath, username string) error {
@@ -190,7 +456,63 @@ func cmdAdd(passwdPath, username string) error {
 	return nil
 }
 
-func cmdDel(passwdPath, username string) error {
+// cmdAddGenerated adds username with a password generated under the
+// domain's password policy. The password is written once, alone on a line,
+// to stdout or to file descriptor fd when fd is not negative; it is never
+// stored anywhere but as a hash.
+func cmdAddGenerated(domainsPath, domainName, passwdPath, username string, fd int) error {
+	provider := domain.NewFilesystemDomainProvider(domainsPath, slog.Default())
+	defer func() { _ = provider.Close() }()
+
+	policy, err := provider.PasswordPolicy(domainName)
+	if err != nil {
+		return err
+	}
+	password, err := passwd.GeneratePassword(policy)
+	if err != nil {
+		return fmt.Errorf("domain %s: %w", domainName, err)
+	}
+
+	out := os.Stdout
+	if fd >= 0 {
+		out = os.NewFile(uintptr(fd), "password-fd")
+		if out == nil {
+			return fmt.Errorf("invalid --password-fd %d", fd)
+		}
+		defer func() { _ = out.Close() }()
+	}
+
+	if err := passwd.AddUser(passwdPath, username, password); err != nil {
+		slog.Debug("AddUser failed", "passwd", passwdPath, "username", username, "error", err)
+		return err
+	}
+	if _, err := fmt.Fprintln(out, password); err != nil {
+		return fmt.Errorf("write generated password: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "Added user %q\n", username)
+	return nil
+}
+
+// deleteGrace returns the delete grace period for domainName: days when
+// --delete-grace-days was given, otherwise the domain's delete_grace_days.
+func deleteGrace(domainsPath, domainName string, days int) (time.Duration, error) {
+	if days >= 0 {
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	provider := domain.NewFilesystemDomainProvider(domainsPath, slog.Default())
+	defer func() { _ = provider.Close() }()
+	return provider.DeleteGrace(domainName)
+}
+
+func cmdDel(passwdPath, username string, grace time.Duration) error {
+	if grace > 0 {
+		if err := passwd.SoftDeleteUser(passwdPath, username, grace); err != nil {
+			slog.Debug("SoftDeleteUser failed", "passwd", passwdPath, "username", username, "error", err)
+			return err
+		}
+		fmt.Printf("Marked user %q deleted; reap removes it after %s\n", username, time.Now().Add(grace).Format(time.DateOnly))
+		return nil
+	}
 	if err := passwd.DeleteUser(passwdPath, username); err != nil {
 		slog.Debug("DeleteUser failed", "passwd", passwdPath, "username", username, "error", err)
 		return err
@@ -199,6 +521,69 @@ func cmdDel(passwdPath, username string) error {
 	return nil
 }
 
+func cmdRestore(passwdPath, username string) error {
+	if err := passwd.RestoreUser(passwdPath, username); err != nil {
+		slog.Debug("RestoreUser failed", "passwd", passwdPath, "username", username, "error", err)
+		return err
+	}
+	fmt.Printf("Restored user %q\n", username)
+	return nil
+}
+
+func cmdPurge(passwdPath, username string) error {
+	if err := passwd.DeleteUser(passwdPath, username); err != nil {
+		slog.Debug("DeleteUser failed", "passwd", passwdPath, "username", username, "error", err)
+		return err
+	}
+	fmt.Printf("Purged user %q\n", username)
+	return nil
+}
+
+func cmdReap(passwdPath string) error {
+	purged, err := passwd.Reap(passwdPath)
+	for _, u := range purged {
+		fmt.Printf("Purged user %q\n", u)
+	}
+	if err != nil {
+		slog.Debug("Reap failed", "passwd", passwdPath, "error", err)
+		return err
+	}
+	if len(purged) == 0 {
+		fmt.Println("no users to purge")
+	}
+	return nil
+}
+
+func cmdFlags(passwdPath, username string, flags []string) error {
+	if err := passwd.SetFlags(passwdPath, username, flags...); err != nil {
+		slog.Debug("SetFlags failed", "passwd", passwdPath, "username", username, "error", err)
+		return err
+	}
+	if len(flags) == 0 {
+		fmt.Printf("Cleared flags of user %q\n", username)
+	} else {
+		fmt.Printf("Set flags of user %q to %s\n", username, strings.Join(flags, ","))
+	}
+	return nil
+}
+
+func cmdServices(passwdPath, username, list string) error {
+	services, err := auth.ParseServiceSet(list)
+	if err != nil {
+		return err
+	}
+	if err := passwd.SetServices(passwdPath, username, services); err != nil {
+		slog.Debug("SetServices failed", "passwd", passwdPath, "username", username, "error", err)
+		return err
+	}
+	if services == 0 {
+		fmt.Printf("User %q may log in to every service\n", username)
+	} else {
+		fmt.Printf("Limited user %q to %s\n", username, services)
+	}
+	return nil
+}
+
 func cmdList(passwdPath string) error {
 	users, err := passwd.ListUsers(passwdPath)
 	if err != nil {
@@ -212,11 +597,15 @@ func cmdList(passwdPath string) error {
 	}
 
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-	if _, err := fmt.Fprintln(w, "USERNAME\tMAILBOX"); err != nil {
+	if _, err := fmt.Fprintln(w, "USERNAME\tMAILBOX\tFLAGS\tDELETED"); err != nil {
 		return err
 	}
 	for _, u := range users {
-		if _, err := fmt.Fprintf(w, "%s\t%s\n", u.Username, u.Mailbox); err != nil {
+		deleted := ""
+		if !u.Deleted.IsZero() {
+			deleted = u.Deleted.Format(time.DateOnly)
+		}
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", u.Username, u.Mailbox, strings.Join(u.Flags, ","), deleted); err != nil {
 			return err
 		}
 	}
@@ -252,6 +641,616 @@ func cmdVerify(domainDir, username string) error {
 	return nil
 }
 
+func cmdUndo(passwdPath string, n int) error {
+	undone, err := passwd.Undo(passwdPath, n)
+	for _, e := range undone {
+		fmt.Printf("Undid #%d: %s %q by %s at %s\n", e.Seq, e.Op, e.Username, e.Actor, e.Time.Format(time.RFC3339))
+	}
+	if err != nil {
+		slog.Debug("Undo failed", "passwd", passwdPath, "error", err)
+		return err
+	}
+	if len(undone) == 0 {
+		fmt.Println("nothing to undo")
+	}
+	return nil
+}
+
+func cmdCheck(domainsPath, name, format string) error {
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown format %q: expected text or json", format)
+	}
+	domainDir := filepath.Join(domainsPath, name)
+
+	problems, err := domain.CheckConfig(filepath.Join(domainDir, "config.toml"))
+	if err != nil {
+		return err
+	}
+	fwd, err := forwards.Check(filepath.Join(domainDir, "forwards"))
+	if err != nil {
+		return err
+	}
+	problems = append(problems, fwd...)
+	pw, err := passwd.Lint(filepath.Join(domainDir, "passwd"))
+	if err != nil {
+		return err
+	}
+	problems = append(problems, pw...)
+
+	provider := domain.NewFilesystemDomainProvider(domainsPath, slog.Default())
+	defer func() { _ = provider.Close() }()
+
+	var missing []string
+	d := provider.GetDomain(name)
+	if d == nil {
+		problems = append(problems, diagnostic.Problem{
+			Severity: diagnostic.Error,
+			Code:     "domain.load",
+			Message:  fmt.Sprintf("domain %q failed to load (see log for details)", name),
+		})
+	} else if missing, err = d.MissingRoles(context.Background()); err != nil {
+		return err
+	}
+	for _, role := range missing {
+		problems = append(problems, diagnostic.Problem{
+			Severity: diagnostic.Error,
+			Code:     "roles.missing",
+			Message:  fmt.Sprintf("%s@%s has no account or forward", role, d.Name),
+			Fix:      fmt.Sprintf("userctl add %s@%s, or forward %s in config.toml", role, d.Name, role),
+		})
+	}
+	diagnostic.Sort(problems)
+
+	if format == "json" {
+		err = diagnostic.WriteJSON(os.Stdout, problems)
+	} else {
+		err = diagnostic.WriteText(os.Stdout, problems)
+	}
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(missing) > 0:
+		return fmt.Errorf("%w: %d of %d", autherrors.ErrRoleAccountMissing, len(missing), len(d.RequiredRoles))
+	case diagnostic.HasErrors(problems):
+		return fmt.Errorf("%s has problems", name)
+	}
+	if format == "text" && len(problems) == 0 {
+		fmt.Printf("OK: %s has all role accounts (%s)\n", d.Name, strings.Join(d.RequiredRoles, ", "))
+	}
+	return nil
+}
+
+func cmdHistory(domainsPath, address string, n int) error {
+	provider := domain.NewFilesystemDomainProvider(domainsPath, slog.Default()).WithLoginHistory(0)
+	defer func() { _ = provider.Close() }()
+
+	records, err := domain.NewAuthRouter(provider, nil).GetLoginHistory(context.Background(), address, n)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		fmt.Println("no login history")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if _, err := fmt.Fprintln(w, "TIME\tIP\tPROTOCOL\tOUTCOME"); err != nil {
+		return err
+	}
+	for _, r := range records {
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Time.Local().Format(time.RFC3339), r.RemoteIP, r.Protocol, r.Outcome); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func cmdLastlog(domainsPath, target string) error {
+	provider := domain.NewFilesystemDomainProvider(domainsPath, slog.Default()).WithLoginState()
+	defer func() { _ = provider.Close() }()
+
+	localpart, name := domain.SplitUsername(target)
+	if name == "" {
+		localpart, name = "", target
+	}
+	d := provider.GetDomain(name)
+	if d == nil {
+		return fmt.Errorf("domain %q failed to load (see log for details)", name)
+	}
+	states, err := d.LoginStates()
+	if err != nil {
+		return err
+	}
+	if localpart != "" {
+		base, _ := domain.ParseLocalPart(localpart)
+		base = strings.ToLower(base)
+		states = map[string]auth.LoginState{base: states[base]}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if _, err := fmt.Fprintln(w, "USER\tLAST LOGIN\tIP\tPROTOCOL\tFAILURES\tLAST FAILURE"); err != nil {
+		return err
+	}
+	for _, user := range slices.Sorted(maps.Keys(states)) {
+		st := states[user]
+		last, failed := "never", "-"
+		if !st.LastLogin.IsZero() {
+			last = st.LastLogin.Local().Format(time.RFC3339)
+		}
+		if !st.LastFailure.IsZero() {
+			failed = st.LastFailure.Local().Format(time.RFC3339) + " from " + st.LastFailureIP
+		}
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", user, last, st.LastIP, st.LastProtocol, st.Failures, failed); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// cmdSessions lists or revokes the sessions kept in a domain's session
+// registry (see package sessions).
+func cmdSessions(domainsPath, action string, args []string) error {
+	if len(args) < 1 || (action == "revoke" && len(args) < 2) {
+		return fmt.Errorf("usage: sessions list <user@domain|domain> | sessions revoke <user@domain> <id|all>")
+	}
+	provider := domain.NewFilesystemDomainProvider(domainsPath, slog.Default()).WithSessions()
+	defer func() { _ = provider.Close() }()
+	router := domain.NewAuthRouter(provider, nil)
+	ctx := context.Background()
+
+	switch action {
+	case "list":
+		target := args[0]
+		users := []string{target}
+		if localpart, name := domain.SplitUsername(target); localpart == "" || name == "" {
+			d := provider.GetDomain(target)
+			if d == nil {
+				return fmt.Errorf("domain %q failed to load (see log for details)", target)
+			}
+			bases, err := d.SessionUsers()
+			if err != nil {
+				return err
+			}
+			users = users[:0]
+			for _, base := range bases {
+				users = append(users, base+"@"+strings.ToLower(target))
+			}
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		if _, err := fmt.Fprintln(w, "USER\tID\tISSUED\tEXPIRES\tOPERATOR"); err != nil {
+			return err
+		}
+		for _, user := range users {
+			list, err := router.ListSessions(ctx, user)
+			if err != nil {
+				return err
+			}
+			for _, s := range list {
+				if _, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", s.Username, s.ID,
+					s.Issued.Local().Format(time.RFC3339), s.Expires.Local().Format(time.RFC3339), s.Operator); err != nil {
+					return err
+				}
+			}
+		}
+		return w.Flush()
+	case "revoke":
+		user, id := args[0], args[1]
+		if _, name := domain.SplitUsername(user); name == "" || provider.GetDomain(name) == nil {
+			return fmt.Errorf("no domain loaded for %q (see log for details)", user)
+		}
+		if id == "all" {
+			slog.Debug("revoking all sessions", "user", user)
+			n, err := router.RevokeSessions(ctx, user)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Revoked %d sessions of %s\n", n, user)
+			return nil
+		}
+		slog.Debug("revoking session", "user", user, "id", id)
+		if err := router.RevokeSession(ctx, user, id); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked session %s of %s\n", id, user)
+		return nil
+	default:
+		return fmt.Errorf("unknown sessions action: %s", action)
+	}
+}
+
+// cmdKeygen creates a key pair for username, sealing the private key under
+// their password.
+func cmdKeygen(domainsPath, domainDir, username string) error {
+	agent, err := openKeyAgent(domainsPath, domainDir)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = agent.Close() }()
+
+	password, err := promptPassword("Password: ")
+	if err != nil {
+		return err
+	}
+	pub, err := agent.GenerateUserKeys(context.Background(), username, password)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Generated key pair for %s (public key: %s)\n", username, base64.StdEncoding.EncodeToString(pub))
+	return nil
+}
+
+// openKeyAgent opens the passwd agent of domainDir for key management,
+// escrowing new keys to the domain's [auth] escrow_pubkey if it has one.
+func openKeyAgent(domainsPath, domainDir string) (*passwd.Agent, error) {
+	provider := domain.NewFilesystemDomainProvider(domainsPath, slog.Default())
+	defer func() { _ = provider.Close() }()
+	escrowKey, err := provider.EscrowKey(filepath.Base(domainDir))
+	if err != nil {
+		return nil, err
+	}
+	agent, err := passwd.NewAgent(filepath.Join(domainDir, "passwd"), filepath.Join(domainDir, "keys"))
+	if err != nil {
+		return nil, fmt.Errorf("load passwd: %w", err)
+	}
+	return agent.WithEscrowKey(escrowKey), nil
+}
+
+// cmdKey runs a key management action: rotating or recovering a user's
+// key pair, importing an OpenPGP public key, or creating a domain recovery
+// key pair.
+func cmdKey(domainsPath, action string, args []string) error {
+	switch action {
+	case "rotate":
+		if len(args) < 1 {
+			return fmt.Errorf("usage: key rotate <user@domain>")
+		}
+	case "recover":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: key recover <user@domain> <recovery-key-file>")
+		}
+	case "import":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: key import <user@domain> <openpgp-key-file>")
+		}
+		return cmdKeyImport(domainsPath, args[0], args[1])
+	case "escrow-keygen":
+		if len(args) < 1 {
+			return fmt.Errorf("usage: key escrow-keygen <path>")
+		}
+		return cmdEscrowKeygen(args[0])
+	default:
+		return fmt.Errorf("unknown key action: %s", action)
+	}
+	username, domainDir, err := parseEmailTarget(domainsPath, args[0])
+	if err != nil {
+		return err
+	}
+	slog.Debug("managing keys", "action", action, "username", username, "domain_dir", domainDir)
+
+	agent, err := openKeyAgent(domainsPath, domainDir)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = agent.Close() }()
+	ctx := context.Background()
+
+	if action == "recover" {
+		data, err := os.ReadFile(args[1])
+		if err != nil {
+			return fmt.Errorf("read recovery key: %w", err)
+		}
+		recoveryKey, err := passwd.ParseEscrowKey(string(data))
+		if err != nil {
+			return err
+		}
+		defer clear(recoveryKey)
+		password, err := promptPassword("New password: ")
+		if err != nil {
+			return err
+		}
+		confirm, err := promptPassword("Confirm password: ")
+		if err != nil {
+			return err
+		}
+		if password != confirm {
+			return fmt.Errorf("passwords do not match")
+		}
+		if err := agent.RecoverUserKeys(ctx, username, recoveryKey, password); err != nil {
+			return err
+		}
+		fmt.Printf("Recovered key pair for %s and set a new password\n", username)
+		return nil
+	}
+
+	password, err := promptPassword("Password or key passphrase: ")
+	if err != nil {
+		return err
+	}
+	pub, err := agent.RotateUserKeys(ctx, username, password)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Rotated key pair for %s (new public key: %s)\n", username, base64.StdEncoding.EncodeToString(pub))
+	fmt.Println("App passwords created before the rotation no longer unlock the key; create them anew.")
+	return nil
+}
+
+// cmdKeyImport stores the OpenPGP public key in file as address's public
+// key.
+func cmdKeyImport(domainsPath, address, file string) error {
+	username, domainDir, err := parseEmailTarget(domainsPath, address)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("read key: %w", err)
+	}
+	if err := passwd.ImportOpenPGPKey(filepath.Join(domainDir, "keys"), username, data); err != nil {
+		return err
+	}
+	fmt.Printf("Imported OpenPGP key for %s\n", username)
+	return nil
+}
+
+// cmdEscrowKeygen writes a new domain recovery private key to path and
+// prints the public key to set as [auth] escrow_pubkey. The private key
+// belongs offline.
+func cmdEscrowKeygen(path string) error {
+	pub, priv, err := passwd.GenerateX25519()
+	if err != nil {
+		return err
+	}
+	defer clear(priv)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("write recovery key: %w", err)
+	}
+	if _, err := fmt.Fprintln(f, base64.StdEncoding.EncodeToString(priv)); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("write recovery key: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("write recovery key: %w", err)
+	}
+	fmt.Printf("Wrote recovery key to %s; keep it offline.\n", path)
+	fmt.Printf("escrow_pubkey = %q\n", base64.StdEncoding.EncodeToString(pub))
+	return nil
+}
+
+func cmdDomain(domainsPath, action string, args []string) error {
+	switch action {
+	case "add":
+	case "freeze", "thaw", "status":
+		return cmdFreeze(domainsPath, action, args)
+	default:
+		return fmt.Errorf("unknown domain action: %s", action)
+	}
+	fs := flag.NewFlagSet("domain add", flag.ContinueOnError)
+	template := fs.String("template", "", "template name under "+domain.TemplatesDir)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: domain add [--template <name>] <domain>")
+	}
+	name := fs.Arg(0)
+
+	provider := domain.NewFilesystemDomainProvider(domainsPath, slog.Default())
+	defer func() { _ = provider.Close() }()
+
+	slog.Debug("creating domain", "domain", name, "template", *template)
+	if err := provider.CreateDomain(name, *template); err != nil {
+		if errors.Is(err, autherrors.ErrTemplateNotFound) {
+			if names := provider.Templates(); len(names) > 0 {
+				return fmt.Errorf("%w (available: %s)", err, strings.Join(names, ", "))
+			}
+		}
+		return err
+	}
+	fmt.Printf("Created domain %q\n", strings.ToLower(name))
+	return nil
+}
+
+// cmdFreeze freezes, thaws or reports the freeze status of a domain.
+func cmdFreeze(domainsPath, action string, args []string) error {
+	if len(args) < 1 || (action == "freeze" && len(args) < 2) {
+		return fmt.Errorf("usage: domain freeze <domain> <reason> | domain thaw <domain> [reason] | domain status <domain>")
+	}
+	name := strings.ToLower(args[0])
+	reason := strings.Join(args[1:], " ")
+
+	provider := domain.NewFilesystemDomainProvider(domainsPath, slog.Default())
+	defer func() { _ = provider.Close() }()
+
+	switch action {
+	case "freeze":
+		slog.Debug("freezing domain", "domain", name, "reason", reason)
+		if err := provider.FreezeDomain(name, reason); err != nil {
+			return err
+		}
+		fmt.Printf("Froze domain %q\n", name)
+	case "thaw":
+		slog.Debug("thawing domain", "domain", name, "reason", reason)
+		if err := provider.ThawDomain(name, reason); err != nil {
+			return err
+		}
+		fmt.Printf("Thawed domain %q\n", name)
+	case "status":
+		if rec, frozen := provider.Frozen(name); frozen {
+			fmt.Printf("%s is frozen since %s by %s: %s\n", name, rec.Time.Format(time.RFC3339), rec.Actor, rec.Reason)
+		} else {
+			fmt.Printf("%s is not frozen\n", name)
+		}
+		history, err := provider.FreezeHistory(name)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, rec := range history {
+			if _, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", rec.Time.Format(time.RFC3339), rec.Action, rec.Actor, rec.Reason); err != nil {
+				return err
+			}
+		}
+		return w.Flush()
+	}
+	return nil
+}
+
+func cmdGAL(domainsPath, name, format string) error {
+	provider := domain.NewFilesystemDomainProvider(domainsPath, slog.Default())
+	defer func() { _ = provider.Close() }()
+
+	d := provider.GetDomain(name)
+	if d == nil {
+		return fmt.Errorf("domain %q failed to load (see log for details)", name)
+	}
+	entries, err := d.ExportGAL(context.Background())
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "json":
+		return domain.WriteGALJSON(os.Stdout, entries)
+	case "vcard":
+		return domain.WriteGALVCard(os.Stdout, entries)
+	default:
+		return fmt.Errorf("unknown format %q: expected json or vcard", format)
+	}
+}
+
+// cmdWKD exports the OpenPGP keys of the named domain's users, or of every
+// domain's, into dir in Web Key Directory layout (see wkd.Export).
+func cmdWKD(domainsPath, name, dir string) error {
+	provider := domain.NewFilesystemDomainProvider(domainsPath, slog.Default())
+	defer func() { _ = provider.Close() }()
+
+	names := []string{name}
+	if name == "all" {
+		names = provider.Domains()
+	}
+	for _, name := range names {
+		d := provider.GetDomain(name)
+		if d == nil {
+			return fmt.Errorf("domain %q failed to load (see log for details)", name)
+		}
+		keys, err := d.WKDKeys(context.Background())
+		if err != nil {
+			return fmt.Errorf("domain %s: %w", name, err)
+		}
+		if err := wkd.Export(dir, name, keys); err != nil {
+			return err
+		}
+		fmt.Printf("Exported %d keys for %s\n", len(keys), name)
+	}
+	return nil
+}
+
+func cmdUsage(domainsPath, name, format string) error {
+	provider := domain.NewFilesystemDomainProvider(domainsPath, slog.Default())
+	defer func() { _ = provider.Close() }()
+
+	var report []domain.DomainUsage
+	if name == "all" {
+		r, err := provider.UsageReport(context.Background())
+		if err != nil {
+			return err
+		}
+		report = r
+	} else {
+		d := provider.GetDomain(name)
+		if d == nil {
+			return fmt.Errorf("domain %q failed to load (see log for details)", name)
+		}
+		u, err := d.Usage(context.Background())
+		if err != nil {
+			return err
+		}
+		report = []domain.DomainUsage{u}
+	}
+	switch format {
+	case "json":
+		return domain.WriteUsageJSON(os.Stdout, report)
+	case "csv":
+		return domain.WriteUsageCSV(os.Stdout, report)
+	default:
+		return fmt.Errorf("unknown format %q: expected json or csv", format)
+	}
+}
+
+func cmdHostKey(path string) error {
+	key, err := atrest.GenerateKey()
+	if err != nil {
+		return err
+	}
+	if err := atrest.WriteKey(path, key); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote host key to %s\n", path)
+	return nil
+}
+
+// sealedFiles are the per-domain files cmdSeal encrypts.
+var sealedFiles = []string{"passwd", "forwards", "config.toml"}
+
+func cmdSeal(domainDir string) error {
+	if domain.MarkedReadOnly(filepath.Dir(domainDir)) {
+		return autherrors.ErrReadOnly
+	}
+	if !atrest.HasKey() {
+		return fmt.Errorf("no host key: use --host-key or %s", atrest.KeyEnv)
+	}
+	for _, name := range sealedFiles {
+		path := filepath.Join(domainDir, name)
+		info, err := os.Stat(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		if info.IsDir() {
+			return fmt.Errorf("%s is a directory; sealing sharded passwd files is not supported", path)
+		}
+		sealed, err := atrest.IsSealedFile(path)
+		if err != nil {
+			return err
+		}
+		if sealed {
+			fmt.Printf("Already sealed: %s\n", path)
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := atrest.WriteFile(path, data, info.Mode().Perm(), true); err != nil {
+			return fmt.Errorf("seal %s: %w", path, err)
+		}
+		fmt.Printf("Sealed %s\n", path)
+	}
+	return nil
+}
+
+func cmdCompile(passwdPath string) error {
+	n, err := passwd.CompilePasswd(passwdPath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Compiled %d users into %s\n", n, passwdPath+passwd.CDBSuffix)
+	return nil
+}
+
+func cmdMigrate(passwdPath string) error {
+	n, err := passwd.MigratePasswd(passwdPath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Migrated %d entries in %s to the v2 format\n", n, passwdPath)
+	return nil
+}
+
 func promptPassword(prompt string) (string, error) {
 	fmt.Fprint(os.Stderr, prompt)
 	raw, err := term.ReadPassword(int(os.Stdin.Fd()))
@@ -272,12 +1271,56 @@ func exitOnErr(err error) {
 func usage() {
 	fmt.Fprintf(os.Stderr, `Usage:
   userctl [--domains <path>] [--verbose] add    <user@domain>   add user (prompts for password)
-  userctl [--domains <path>] [--verbose] del    <user@domain>   remove user
+  userctl [--domains <path>] [--verbose] add --generate [--password-fd <n>] <user@domain>
+                                                                 add user with a generated password, printed once
+  userctl [--domains <path>] [--verbose] del    <user@domain>   remove user (mark deleted with a grace period)
+  userctl [--domains <path>] [--verbose] restore <user@domain>  undelete a user marked deleted
+  userctl [--domains <path>] [--verbose] purge  <user@domain>   remove user at once, even with a grace period
+  userctl [--domains <path>] [--verbose] reap   <domain>        remove users whose delete grace period has ended
   userctl [--domains <path>] [--verbose] list   <domain>        list users and mailboxes
   userctl [--domains <path>] [--verbose] verify <user@domain>   verify user password
+  userctl [--domains <path>] [--verbose] keygen <user@domain>   create an encryption key pair (prompts for password)
+  userctl [--domains <path>] [--verbose] key rotate <user@domain>
+                                                                 replace the key pair, keeping the old one for decryption
+  userctl [--domains <path>] [--verbose] key recover <user@domain> <recovery-key-file>
+                                                                 restore an escrowed key and set a new password
+  userctl [--domains <path>] [--verbose] key import <user@domain> <openpgp-key-file>
+                                                                 use an OpenPGP public key (armored or binary) for the user
+  userctl [--domains <path>] [--verbose] key escrow-keygen <path>
+                                                                 create a domain recovery key pair for [auth] escrow_pubkey
+  userctl [--domains <path>] [--verbose] flags  <user@domain> [flag,...] set account flags (disabled,
+                                                                 locked, nologin); none clears them
+  userctl [--domains <path>] [--verbose] services <user@domain> [service,...] limit logins to services
+                                                                 (imap, pop3, smtp, webmail); none lifts the limit
+  userctl [--domains <path>] [--verbose] check  <domain>        report missing role accounts
+  userctl [--domains <path>] [--verbose] history <user@domain> [n] show recent logins (default 20)
+  userctl [--domains <path>] [--verbose] lastlog <user@domain|domain> show last logins and failures since
+  userctl [--domains <path>] [--verbose] sessions list <user@domain|domain>
+                                                                 show active sessions
+  userctl [--domains <path>] [--verbose] sessions revoke <user@domain> <id|all>
+                                                                 end one or all of a user's sessions
+  userctl [--domains <path>] [--verbose] undo   <domain> [n]    roll back the last n passwd changes (default 1)
+  userctl [--domains <path>] [--verbose] domain add [--template <name>] <domain>
+                                                                 provision a new domain from a template
+  userctl [--domains <path>] [--verbose] domain freeze <domain> <reason>
+                                                                 block logins and off-host forwarding for a domain
+  userctl [--domains <path>] [--verbose] domain thaw <domain> [reason]
+                                                                 lift a freeze
+  userctl [--domains <path>] [--verbose] domain status <domain>  show whether a domain is frozen, and its freeze history
+  userctl [--domains <path>] [--verbose] gal    <domain> [json|vcard] export the global address list (default json)
+  userctl [--domains <path>] [--verbose] usage  <domain|all> [json|csv] report account usage for billing (default json)
+  userctl [--domains <path>] [--verbose] wkd    <domain|all> <dir>
+                                                                 export OpenPGP keys in Web Key Directory layout
+  userctl [--domains <path>] [--verbose] seal   <domain>        encrypt passwd, forwards and config.toml with the host key
+  userctl [--domains <path>] [--verbose] compile <domain>       compile passwd into passwd.cdb for fast lookups
+  userctl [--domains <path>] [--verbose] migrate <domain>       rewrite passwd entries in the v2 format
+  userctl [--verbose] hostkey <path>                             generate a new host key
 
 Flags:
   --domains   path to domains directory (overrides env and config)
+  --host-key  path to host key for sealed files (default: $INFODANCER_HOST_KEY)
+  --pepper    path to password pepper file (default: $INFODANCER_PEPPER_FILE)
+  --delete-grace-days  keep deleted users this many days before reap removes them (default: the domain's delete_grace_days)
   --verbose   enable debug logging (default: true)
 
 Domains path resolution order:
@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/infodancer/auth/errors"
+)
+
+// Credentials are a login's credentials in the form the client sent them.
+// Plaintext mechanisms (PLAIN, LOGIN) only need Username and Password; the
+// other fields carry what richer mechanisms send, such as a challenge
+// response, a pre-hashed password or channel binding data, so daemons can
+// pass them through without the interface changing again.
+type Credentials struct {
+	// Username is the authentication identity: whose credentials these are.
+	Username string
+
+	// AuthzID is the authorization identity the client asked to act as
+	// (the SASL authzid). Empty means Username.
+	AuthzID string
+
+	// Mechanism names the SASL mechanism the credentials came from, such
+	// as "PLAIN", "LOGIN", "CRAM-MD5" or "SCRAM-SHA-256-PLUS". Empty means
+	// a plaintext password.
+	Mechanism string
+
+	// Password is the plaintext password of PLAIN and LOGIN logins.
+	Password string
+
+	// Response is the mechanism-specific proof of other mechanisms: the
+	// bearer token, for XOAUTH2 and OAUTHBEARER.
+	Response []byte
+
+	// Challenge is the server's challenge that Response answers, for
+	// challenge-response mechanisms such as CRAM-MD5; nil otherwise.
+	Challenge []byte
+
+	// ChannelBinding is the binding of the client's TLS connection, for
+	// mechanisms that bind to it; nil otherwise.
+	ChannelBinding *ChannelBinding
+}
+
+// ChannelBinding is the channel binding data of a TLS connection
+// (RFC 5056), as computed by the server for its end of the connection.
+type ChannelBinding struct {
+	// Type is the binding type, such as "tls-exporter" or
+	// "tls-server-end-point".
+	Type string
+
+	// Data is the binding data.
+	Data []byte
+}
+
+// IsPlaintext reports whether c is a plaintext password login that any
+// AuthenticationAgent can verify with Authenticate.
+func (c Credentials) IsPlaintext() bool {
+	switch strings.ToUpper(c.Mechanism) {
+	case "", "PLAIN", "LOGIN":
+		return c.Response == nil && c.Challenge == nil && c.ChannelBinding == nil
+	}
+	return false
+}
+
+// CredentialsAuthenticator is implemented by agents that verify more than
+// plaintext passwords. The domain.AuthRouter hands them Credentials with
+// the routed username (the localpart, for domain agents).
+type CredentialsAuthenticator interface {
+	// AuthenticateCredentials validates creds like Authenticate validates
+	// a password. Returns errors.ErrMechanismUnsupported for mechanisms
+	// the agent cannot verify.
+	AuthenticateCredentials(ctx context.Context, creds Credentials) (*AuthSession, error)
+}
+
+// AsCredentialsAuthenticator returns agent as a CredentialsAuthenticator
+// if it supports one according to Capabilities.
+func AsCredentialsAuthenticator(agent AuthenticationAgent) (CredentialsAuthenticator, bool) {
+	if ca, ok := agent.(CredentialsAuthenticator); ok && Capabilities(agent).Credentials {
+		return ca, true
+	}
+	return nil, false
+}
+
+// VerifyCredentials validates creds with agent: through
+// AuthenticateCredentials if the agent supports it, through
+// VerifyChallengeResponse for challenge-response credentials, otherwise
+// with Authenticate for plaintext credentials. Other mechanisms fail with
+// errors.ErrMechanismUnsupported.
+func VerifyCredentials(ctx context.Context, agent AuthenticationAgent, creds Credentials) (*AuthSession, error) {
+	if ca, ok := AsCredentialsAuthenticator(agent); ok {
+		return ca.AuthenticateCredentials(ctx, creds)
+	}
+	if creds.Challenge != nil {
+		if cv, ok := AsChallengeResponseVerifier(agent); ok {
+			return cv.VerifyChallengeResponse(ctx, creds)
+		}
+	}
+	if !creds.IsPlaintext() {
+		return nil, fmt.Errorf("%w: %s", errors.ErrMechanismUnsupported, creds.Mechanism)
+	}
+	return agent.Authenticate(ctx, creds.Username, creds.Password)
+}
+
+// ChallengeResponseVerifier is implemented by agents that can check
+// challenge-response mechanisms such as CRAM-MD5 and DIGEST-MD5. Those
+// mechanisms need the plaintext password on the server, so agents only
+// verify them for users whose password they keep in reversible form, which
+// is off unless an administrator turns it on. VerifyCredentials hands
+// credentials with a Challenge to it.
+type ChallengeResponseVerifier interface {
+	// VerifyChallengeResponse validates creds.Response, the client's
+	// answer to creds.Challenge under creds.Mechanism, like Authenticate
+	// validates a password. The session's ServerResponse holds the
+	// mechanism's final server message, if it has one. Returns
+	// errors.ErrMechanismUnsupported for mechanisms the agent does not know
+	// and users without a reversible password.
+	VerifyChallengeResponse(ctx context.Context, creds Credentials) (*AuthSession, error)
+}
+
+// AsChallengeResponseVerifier returns agent as a ChallengeResponseVerifier
+// if it supports one according to Capabilities.
+func AsChallengeResponseVerifier(agent AuthenticationAgent) (ChallengeResponseVerifier, bool) {
+	if cv, ok := agent.(ChallengeResponseVerifier); ok && Capabilities(agent).ChallengeResponse {
+		return cv, true
+	}
+	return nil, false
+}
+
+// SCRAMCredentials are a user's stored SCRAM verifier (RFC 5802): what a
+// server needs to check a SCRAM login and prove itself to the client,
+// but not enough to log in with. See package sasl/scram.
+type SCRAMCredentials struct {
+	// Mechanism is the SCRAM variant, "SCRAM-SHA-256".
+	Mechanism string
+
+	// Salt and Iterations are the PBKDF2 parameters the client derives its
+	// key with.
+	Salt       []byte
+	Iterations int
+
+	// StoredKey verifies the client's proof; ServerKey signs the server's
+	// reply.
+	StoredKey []byte
+	ServerKey []byte
+}
+
+// SCRAMCredentialProvider is implemented by agents that store SCRAM
+// verifiers, so daemons can offer SCRAM mechanisms.
+type SCRAMCredentialProvider interface {
+	// GetSCRAMCredentials returns username's SCRAM-SHA-256 verifier.
+	// Returns errors.ErrUserNotFound for unknown users and
+	// errors.ErrMechanismUnsupported for users without a current verifier.
+	GetSCRAMCredentials(ctx context.Context, username string) (*SCRAMCredentials, error)
+}
+
+// AsSCRAMCredentialProvider returns agent as a SCRAMCredentialProvider if
+// it supports one according to Capabilities.
+func AsSCRAMCredentialProvider(agent AuthenticationAgent) (SCRAMCredentialProvider, bool) {
+	if sp, ok := agent.(SCRAMCredentialProvider); ok && Capabilities(agent).SCRAM {
+		return sp, true
+	}
+	return nil, false
+}
@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// credsAgent verifies any credentials and records the last ones seen.
+type credsAgent struct {
+	basicAgent
+	got *Credentials
+}
+
+func (a credsAgent) AuthenticateCredentials(_ context.Context, creds Credentials) (*AuthSession, error) {
+	*a.got = creds
+	return &AuthSession{User: &User{Username: creds.Username}}, nil
+}
+
+func (credsAgent) Capabilities() AgentCapabilities {
+	return AgentCapabilities{Credentials: true}
+}
+
+// pwAgent accepts password "pw" through Authenticate.
+type pwAgent struct{ basicAgent }
+
+func (pwAgent) Authenticate(_ context.Context, username, password string) (*AuthSession, error) {
+	if password != "pw" {
+		return nil, autherrors.ErrAuthFailed
+	}
+	return &AuthSession{User: &User{Username: username}}, nil
+}
+
+// challengeAgent accepts challenge-response credentials whose response is
+// "ok".
+type challengeAgent struct{ pwAgent }
+
+func (challengeAgent) VerifyChallengeResponse(_ context.Context, creds Credentials) (*AuthSession, error) {
+	if string(creds.Response) != "ok" {
+		return nil, autherrors.ErrAuthFailed
+	}
+	return &AuthSession{User: &User{Username: creds.Username}, ServerResponse: creds.Challenge}, nil
+}
+
+func TestCredentials_IsPlaintext(t *testing.T) {
+	for _, tc := range []struct {
+		creds Credentials
+		want  bool
+	}{
+		{Credentials{Password: "pw"}, true},
+		{Credentials{Mechanism: "plain", Password: "pw"}, true},
+		{Credentials{Mechanism: "LOGIN", Password: "pw"}, true},
+		{Credentials{Mechanism: "PLAIN", ChannelBinding: &ChannelBinding{Type: "tls-exporter"}}, false},
+		{Credentials{Mechanism: "CRAM-MD5", Response: []byte("alice 0123")}, false},
+		{Credentials{Mechanism: "SCRAM-SHA-256"}, false},
+		{Credentials{Mechanism: "LOGIN", Password: "pw", Challenge: []byte("<1@host>")}, false},
+	} {
+		if got := tc.creds.IsPlaintext(); got != tc.want {
+			t.Errorf("%+v.IsPlaintext() = %v, want %v", tc.creds, got, tc.want)
+		}
+	}
+}
+
+func TestVerifyCredentials(t *testing.T) {
+	ctx := context.Background()
+
+	session, err := VerifyCredentials(ctx, pwAgent{}, Credentials{Username: "alice", Mechanism: "PLAIN", Password: "pw"})
+	if err != nil || session.User.Username != "alice" {
+		t.Errorf("plaintext = %v, %v", session, err)
+	}
+	if _, err := VerifyCredentials(ctx, pwAgent{}, Credentials{Username: "alice", Password: "bad"}); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("wrong password: err = %v", err)
+	}
+	_, err = VerifyCredentials(ctx, pwAgent{}, Credentials{Username: "alice", Mechanism: "CRAM-MD5", Response: []byte("r")})
+	if !errors.Is(err, autherrors.ErrMechanismUnsupported) {
+		t.Errorf("CRAM-MD5 on password agent: err = %v, want ErrMechanismUnsupported", err)
+	}
+
+	var got Credentials
+	creds := Credentials{Username: "alice", Mechanism: "CRAM-MD5", Response: []byte("r")}
+	if _, err := VerifyCredentials(ctx, credsAgent{got: &got}, creds); err != nil {
+		t.Fatal(err)
+	}
+	if got.Mechanism != "CRAM-MD5" || string(got.Response) != "r" {
+		t.Errorf("agent received %+v", got)
+	}
+	if c := Capabilities(credsAgent{got: &got}); !c.Credentials {
+		t.Errorf("capabilities = %+v, want Credentials", c)
+	}
+}
+
+func TestVerifyCredentials_ChallengeResponse(t *testing.T) {
+	ctx := context.Background()
+	agent := challengeAgent{}
+	if c := Capabilities(agent); !c.ChallengeResponse {
+		t.Errorf("capabilities = %+v, want ChallengeResponse", c)
+	}
+
+	creds := Credentials{Username: "alice", Mechanism: "CRAM-MD5", Challenge: []byte("<1@host>"), Response: []byte("ok")}
+	session, err := VerifyCredentials(ctx, agent, creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.User.Username != "alice" || string(session.ServerResponse) != "<1@host>" {
+		t.Errorf("session = %+v", session)
+	}
+	creds.Response = []byte("bad")
+	if _, err := VerifyCredentials(ctx, agent, creds); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("wrong response: err = %v", err)
+	}
+
+	// Without a challenge the credentials are not challenge-response ones.
+	creds.Challenge = nil
+	if _, err := VerifyCredentials(ctx, agent, creds); !errors.Is(err, autherrors.ErrMechanismUnsupported) {
+		t.Errorf("no challenge: err = %v, want ErrMechanismUnsupported", err)
+	}
+	if _, err := VerifyCredentials(ctx, agent, Credentials{Username: "alice", Password: "pw"}); err != nil {
+		t.Errorf("plaintext on challenge agent: %v", err)
+	}
+}
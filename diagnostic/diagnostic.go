@@ -0,0 +1,152 @@
+// Package diagnostic defines Problem, the one shape in which every
+// validation surface reports issues: domain config checks
+// (domain.CheckConfig), forwards checks (forwards.Check), passwd lint
+// (passwd.Lint) and userctl check. Tools can print problems as text or
+// JSON and decide on an exit status without knowing which check found
+// them.
+package diagnostic
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Severity ranks a Problem. It marshals as text: "info", "warning" or
+// "error".
+type Severity int
+
+const (
+	// Info is worth knowing but needs no action.
+	Info Severity = iota
+
+	// Warning works today but is likely a mistake or will stop working.
+	Warning
+
+	// Error is broken: the setting or entry is ignored or refused.
+	Error
+)
+
+// String returns "info", "warning" or "error".
+func (s Severity) String() string {
+	switch s {
+	case Warning:
+		return "warning"
+	case Error:
+		return "error"
+	default:
+		return "info"
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (s *Severity) UnmarshalText(b []byte) error {
+	switch string(b) {
+	case "info":
+		*s = Info
+	case "warning":
+		*s = Warning
+	case "error":
+		*s = Error
+	default:
+		return fmt.Errorf("unknown severity %q", b)
+	}
+	return nil
+}
+
+// Problem is one issue found by a check.
+type Problem struct {
+	// Severity ranks the problem.
+	Severity Severity `json:"severity"`
+
+	// Code identifies the kind of problem, as "<surface>.<name>" such as
+	// "passwd.duplicate-user". Codes are stable; tools may match on them.
+	Code string `json:"code"`
+
+	// File is the file the problem is in, empty if it is not about a file.
+	File string `json:"file,omitempty"`
+
+	// Line is the 1-based line in File, 0 if unknown.
+	Line int `json:"line,omitempty"`
+
+	// Message describes the problem.
+	Message string `json:"message"`
+
+	// Fix suggests how to resolve the problem, empty if there is no
+	// obvious fix.
+	Fix string `json:"fix,omitempty"`
+}
+
+// String formats p as "file:line: severity: message [code]", leaving out
+// the location parts that are unknown.
+func (p Problem) String() string {
+	var b strings.Builder
+	if p.File != "" {
+		b.WriteString(p.File)
+		if p.Line > 0 {
+			fmt.Fprintf(&b, ":%d", p.Line)
+		}
+		b.WriteString(": ")
+	}
+	fmt.Fprintf(&b, "%s: %s [%s]", p.Severity, p.Message, p.Code)
+	return b.String()
+}
+
+// HasErrors reports whether any problem has Error severity.
+func HasErrors(problems []Problem) bool {
+	for _, p := range problems {
+		if p.Severity == Error {
+			return true
+		}
+	}
+	return false
+}
+
+// Sort orders problems by file, line and then severity (most severe
+// first), keeping the original order otherwise.
+func Sort(problems []Problem) {
+	sort.SliceStable(problems, func(i, j int) bool {
+		a, b := problems[i], problems[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Severity > b.Severity
+	})
+}
+
+// WriteText writes one problem per line, followed by its fix, if any, on
+// an indented line.
+func WriteText(w io.Writer, problems []Problem) error {
+	for _, p := range problems {
+		if _, err := fmt.Fprintln(w, p); err != nil {
+			return err
+		}
+		if p.Fix != "" {
+			if _, err := fmt.Fprintf(w, "\tfix: %s\n", p.Fix); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes problems as an indented JSON array; no problems is
+// written as [] rather than null.
+func WriteJSON(w io.Writer, problems []Problem) error {
+	if problems == nil {
+		problems = []Problem{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(problems)
+}
@@ -0,0 +1,94 @@
+package diagnostic
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestProblem_JSON(t *testing.T) {
+	p := Problem{
+		Severity: Warning,
+		Code:     "passwd.no-uid",
+		File:     "/srv/example.com/passwd",
+		Line:     3,
+		Message:  "alice has no uid",
+		Fix:      "run userctl migrate",
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"severity":"warning","code":"passwd.no-uid","file":"/srv/example.com/passwd","line":3,"message":"alice has no uid","fix":"run userctl migrate"}`
+	if string(data) != want {
+		t.Errorf("json = %s\nwant   %s", data, want)
+	}
+
+	var back Problem
+	if err := json.Unmarshal(data, &back); err != nil || back != p {
+		t.Errorf("round trip = %+v, %v", back, err)
+	}
+	if err := json.Unmarshal([]byte(`{"severity":"fatal"}`), &back); err == nil {
+		t.Error("expected error for unknown severity")
+	}
+
+	data, _ = json.Marshal(Problem{Severity: Error, Code: "x.y", Message: "m"})
+	if strings.Contains(string(data), "file") || strings.Contains(string(data), "line") {
+		t.Errorf("empty location not omitted: %s", data)
+	}
+}
+
+func TestProblem_String(t *testing.T) {
+	tests := []struct {
+		p    Problem
+		want string
+	}{
+		{Problem{Severity: Error, Code: "a.b", File: "f", Line: 2, Message: "bad"}, "f:2: error: bad [a.b]"},
+		{Problem{Severity: Warning, Code: "a.b", File: "f", Message: "odd"}, "f: warning: odd [a.b]"},
+		{Problem{Severity: Info, Code: "a.b", Message: "note"}, "info: note [a.b]"},
+	}
+	for _, tt := range tests {
+		if got := tt.p.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestSortAndHasErrors(t *testing.T) {
+	problems := []Problem{
+		{Severity: Info, Code: "c", File: "b", Line: 1},
+		{Severity: Warning, Code: "b", File: "a", Line: 5},
+		{Severity: Error, Code: "a", File: "a", Line: 5},
+		{Severity: Warning, Code: "d", File: "a", Line: 1},
+	}
+	if !HasErrors(problems) {
+		t.Error("HasErrors = false")
+	}
+	Sort(problems)
+	var codes []string
+	for _, p := range problems {
+		codes = append(codes, p.Code)
+	}
+	if got := strings.Join(codes, ","); got != "d,a,b,c" {
+		t.Errorf("sorted codes = %s", got)
+	}
+	if HasErrors(problems[3:]) {
+		t.Error("HasErrors(info only) = true")
+	}
+}
+
+func TestWrite(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteJSON(&buf, nil); err != nil || strings.TrimSpace(buf.String()) != "[]" {
+		t.Errorf("WriteJSON(nil) = %q, %v", buf.String(), err)
+	}
+	buf.Reset()
+	p := Problem{Severity: Error, Code: "a.b", Message: "bad", Fix: "do x"}
+	if err := WriteText(&buf, []Problem{p}); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != "error: bad [a.b]\n\tfix: do x\n" {
+		t.Errorf("WriteText = %q", got)
+	}
+}
@@ -0,0 +1,72 @@
+package dirsync
+
+import (
+	"context"
+
+	"github.com/infodancer/auth"
+)
+
+var (
+	_ auth.AuthenticationAgent = (*Agent)(nil)
+	_ auth.UserLister          = (*Agent)(nil)
+	_ auth.CapabilityReporter  = (*Agent)(nil)
+)
+
+// Agent authenticates against a directory and answers existence questions
+// from the local copy a Syncer maintains: pass-through logins that fail
+// while the directory is down, but delivery that does not.
+type Agent struct {
+	dir   auth.AuthenticationAgent
+	local auth.AuthenticationAgent
+}
+
+// NewAgent returns an agent sending logins to dir and UserExists and
+// ListUsers to local, usually a passwd.Agent over the synced file. The
+// agent owns both: Close closes them.
+func NewAgent(dir, local auth.AuthenticationAgent) *Agent {
+	return &Agent{dir: dir, local: local}
+}
+
+// Authenticate validates credentials with the directory.
+func (a *Agent) Authenticate(ctx context.Context, username, password string) (*auth.AuthSession, error) {
+	return a.dir.Authenticate(ctx, username, password)
+}
+
+// AuthenticateCredentials validates credentials with the directory.
+// Implements auth.CredentialsAuthenticator.
+func (a *Agent) AuthenticateCredentials(ctx context.Context, creds auth.Credentials) (*auth.AuthSession, error) {
+	return auth.VerifyCredentials(ctx, a.dir, creds)
+}
+
+// UserExists reports whether username is in the synced copy.
+func (a *Agent) UserExists(ctx context.Context, username string) (bool, error) {
+	return a.local.UserExists(ctx, username)
+}
+
+// ListUsers lists the synced copy's users, or returns nil if the local
+// agent cannot list them. Implements auth.UserLister.
+func (a *Agent) ListUsers(ctx context.Context) ([]string, error) {
+	if ul, ok := auth.AsUserLister(a.local); ok {
+		return ul.ListUsers(ctx)
+	}
+	return nil, nil
+}
+
+// Capabilities reports UserLister when the local agent supports it, and
+// CredentialsAuthenticator when the directory does.
+// Implements auth.CapabilityReporter.
+func (a *Agent) Capabilities() auth.AgentCapabilities {
+	return auth.AgentCapabilities{
+		UserLister:  auth.Capabilities(a.local).UserLister,
+		Credentials: auth.Capabilities(a.dir).Credentials,
+	}
+}
+
+// Close closes the directory and local agents.
+func (a *Agent) Close() error {
+	err := a.dir.Close()
+	if lerr := a.local.Close(); err == nil {
+		err = lerr
+	}
+	return err
+}
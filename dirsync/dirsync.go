@@ -0,0 +1,200 @@
+// Package dirsync materializes the users of an external directory (a SQL
+// database, a directory server, or any agent that can list its accounts)
+// into a local passwd file, so that delivery-time UserExists keeps working
+// while the directory is down or unreachable.
+//
+// Password hashes are never copied. Each synced entry gets the hash of a
+// random secret nobody knows, so the local file cannot be used to log in
+// or to attack the directory's passwords. Logins either stay with the
+// directory, through Agent, or do not happen on the host at all, as on
+// delivery-only machines:
+//
+//	s := dirsync.New(directory, "/etc/mail/domains/example.com/passwd", dirsync.Options{})
+//	go s.Run(ctx, 10*time.Minute)
+//
+//	local, _ := passwd.NewAgent(passwdPath, keyDir)
+//	agent := dirsync.NewAgent(directory, local)
+//
+// The passwd file is owned by the syncer: users added to it by other means
+// are removed at the next sync unless the directory lists them too.
+package dirsync
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/passwd"
+)
+
+// ErrEmptyDirectory is returned by RunOnce when the directory lists no
+// users but the passwd file has some, unless Options.AllowEmpty is set.
+// An empty listing is far more often a misconfiguration or outage than a
+// directory that really lost every account.
+var ErrEmptyDirectory = errors.New("dirsync: directory lists no users")
+
+// placeholderParams hash the random secrets of synced entries. The secrets
+// are 256-bit random values, so the hash needs no work factor.
+var placeholderParams = passwd.Argon2Params{Time: 1, Memory: 64, Threads: 1}
+
+// Options configures a Syncer. The zero value is usable.
+type Options struct {
+	// AllowEmpty lets a sync with an empty directory listing remove every
+	// user (see ErrEmptyDirectory).
+	AllowEmpty bool
+
+	// Logger receives sync results and failures. nil means slog.Default().
+	Logger *slog.Logger
+}
+
+// Result reports what one sync changed.
+type Result struct {
+	// Added and Removed are the usernames added to and removed from the
+	// passwd file, sorted.
+	Added, Removed []string
+
+	// Users is the number of users in the passwd file after the sync.
+	Users int
+}
+
+// Syncer copies a directory's users into a passwd file.
+type Syncer struct {
+	dir        auth.UserLister
+	passwdPath string
+	opts       Options
+
+	mu       sync.Mutex // serializes RunOnce
+	lastSync time.Time
+}
+
+// New returns a Syncer copying dir's users into the passwd file at
+// passwdPath (a shard directory works as well, see passwd.SplitPasswd).
+func New(dir auth.UserLister, passwdPath string, opts Options) *Syncer {
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	return &Syncer{dir: dir, passwdPath: passwdPath, opts: opts}
+}
+
+// RunOnce lists the directory's users and brings the passwd file in line:
+// users missing locally are added with a placeholder hash, and local users
+// the directory no longer lists are removed. Existing entries are left
+// alone, so their uids and mailboxes survive. Changes go through the
+// passwd management functions and so are journaled, leased and refused in
+// read-only mode like any other.
+//
+// A directory failure changes nothing and is returned; the passwd file
+// keeps answering UserExists from the last successful sync.
+func (s *Syncer) RunOnce(ctx context.Context) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	remote, err := s.dir.ListUsers(ctx)
+	if err != nil {
+		return Result{}, fmt.Errorf("dirsync: list directory users: %w", err)
+	}
+	entries, err := passwd.ListUsers(s.passwdPath)
+	if err != nil {
+		return Result{}, fmt.Errorf("dirsync: %w", err)
+	}
+	if len(remote) == 0 && len(entries) > 0 && !s.opts.AllowEmpty {
+		return Result{}, ErrEmptyDirectory
+	}
+
+	want := make(map[string]bool, len(remote))
+	for _, u := range remote {
+		want[u] = true
+	}
+	have := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		have[e.Username] = true
+	}
+
+	var res Result
+	for u := range have {
+		if want[u] {
+			continue
+		}
+		if err := passwd.DeleteUser(s.passwdPath, u); err != nil {
+			return sorted(res), fmt.Errorf("dirsync: remove %s: %w", u, err)
+		}
+		res.Removed = append(res.Removed, u)
+	}
+	for u := range want {
+		if have[u] {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return sorted(res), err
+		}
+		hash, err := placeholderHash()
+		if err != nil {
+			return sorted(res), err
+		}
+		if err := passwd.AddUserWithHash(s.passwdPath, u, hash); err != nil {
+			return sorted(res), fmt.Errorf("dirsync: add %s: %w", u, err)
+		}
+		res.Added = append(res.Added, u)
+	}
+	res = sorted(res)
+	res.Users = len(want)
+	s.lastSync = time.Now()
+	if len(res.Added) > 0 || len(res.Removed) > 0 {
+		s.opts.Logger.Info("directory sync",
+			slog.String("passwd", s.passwdPath),
+			slog.Int("added", len(res.Added)),
+			slog.Int("removed", len(res.Removed)),
+			slog.Int("users", res.Users))
+	}
+	return res, nil
+}
+
+// sorted returns res with its changes sorted.
+func sorted(res Result) Result {
+	slices.Sort(res.Added)
+	slices.Sort(res.Removed)
+	return res
+}
+
+// LastSync returns when RunOnce last completed successfully; zero if never.
+func (s *Syncer) LastSync() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastSync
+}
+
+// Run calls RunOnce every interval until ctx is cancelled. Errors are
+// logged only: the passwd file keeps its last synced state.
+func (s *Syncer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.RunOnce(ctx); err != nil && ctx.Err() == nil {
+			s.opts.Logger.Warn("directory sync failed",
+				slog.String("passwd", s.passwdPath),
+				slog.String("error", err.Error()))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// placeholderHash returns the hash of a random secret that is discarded,
+// so that no password matches it.
+func placeholderHash() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("dirsync: generate secret: %w", err)
+	}
+	return passwd.HashPasswordWithParams(hex.EncodeToString(secret), placeholderParams)
+}
@@ -0,0 +1,200 @@
+package dirsync
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/passwd"
+)
+
+// fakeDirectory is a directory of users whose password is "pw", which can
+// be taken down.
+type fakeDirectory struct {
+	users []string
+	down  bool
+}
+
+var errDown = errors.New("directory unreachable")
+
+func (d *fakeDirectory) Authenticate(_ context.Context, username, password string) (*auth.AuthSession, error) {
+	if d.down {
+		return nil, errDown
+	}
+	if !slices.Contains(d.users, username) {
+		return nil, autherrors.ErrUserNotFound
+	}
+	if password != "pw" {
+		return nil, autherrors.ErrAuthFailed
+	}
+	return &auth.AuthSession{User: &auth.User{Username: username, Mailbox: username}}, nil
+}
+
+func (d *fakeDirectory) UserExists(_ context.Context, username string) (bool, error) {
+	if d.down {
+		return false, errDown
+	}
+	return slices.Contains(d.users, username), nil
+}
+
+func (d *fakeDirectory) ListUsers(context.Context) ([]string, error) {
+	if d.down {
+		return nil, errDown
+	}
+	return slices.Clone(d.users), nil
+}
+
+func (d *fakeDirectory) Close() error { return nil }
+
+func localUsers(t *testing.T, passwdPath string) []string {
+	t.Helper()
+	entries, err := passwd.ListUsers(passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Username)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestSyncer_RunOnce(t *testing.T) {
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	dir := &fakeDirectory{users: []string{"alice", "bob"}}
+	s := New(dir, passwdPath, Options{})
+	ctx := context.Background()
+
+	res, err := s.RunOnce(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(res.Added, []string{"alice", "bob"}) || len(res.Removed) != 0 || res.Users != 2 {
+		t.Errorf("first sync = %+v", res)
+	}
+	if s.LastSync().IsZero() {
+		t.Error("LastSync not set")
+	}
+
+	// No directory hash is copied and the placeholder opens nothing.
+	entries, err := passwd.ListUsers(passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if passwd.VerifyPassword("pw", e.Hash) || passwd.VerifyPassword("", e.Hash) {
+			t.Errorf("%s's placeholder hash verifies", e.Username)
+		}
+	}
+
+	dir.users = []string{"bob", "carol"}
+	res, err = s.RunOnce(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(res.Added, []string{"carol"}) || !slices.Equal(res.Removed, []string{"alice"}) {
+		t.Errorf("second sync = %+v", res)
+	}
+	if got := localUsers(t, passwdPath); !slices.Equal(got, []string{"bob", "carol"}) {
+		t.Errorf("local users = %v", got)
+	}
+
+	// An unchanged directory changes nothing, not even bob's hash.
+	before, _ := os.ReadFile(passwdPath)
+	if res, err := s.RunOnce(ctx); err != nil || len(res.Added)+len(res.Removed) != 0 {
+		t.Errorf("idle sync = %+v, %v", res, err)
+	}
+	if after, _ := os.ReadFile(passwdPath); string(after) != string(before) {
+		t.Error("idle sync rewrote the passwd file")
+	}
+
+	journal, err := passwd.ReadJournal(passwdPath)
+	if err != nil || len(journal) != 4 {
+		t.Errorf("journal = %d entries, %v; want 4", len(journal), err)
+	}
+}
+
+func TestSyncer_DirectoryFailure(t *testing.T) {
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	dir := &fakeDirectory{users: []string{"alice"}}
+	s := New(dir, passwdPath, Options{})
+	ctx := context.Background()
+	if _, err := s.RunOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	dir.down = true
+	if _, err := s.RunOnce(ctx); !errors.Is(err, errDown) {
+		t.Errorf("sync with directory down: err = %v", err)
+	}
+	dir.down, dir.users = false, nil
+	if _, err := s.RunOnce(ctx); !errors.Is(err, ErrEmptyDirectory) {
+		t.Errorf("sync with empty directory: err = %v, want ErrEmptyDirectory", err)
+	}
+	if got := localUsers(t, passwdPath); !slices.Equal(got, []string{"alice"}) {
+		t.Errorf("local users after failures = %v", got)
+	}
+
+	s = New(dir, passwdPath, Options{AllowEmpty: true})
+	if res, err := s.RunOnce(ctx); err != nil || !slices.Equal(res.Removed, []string{"alice"}) {
+		t.Errorf("AllowEmpty sync = %+v, %v", res, err)
+	}
+}
+
+func TestSyncer_ReadOnly(t *testing.T) {
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	s := New(&fakeDirectory{users: []string{"alice"}}, passwdPath, Options{})
+	marker := filepath.Join(filepath.Dir(passwdPath), passwd.ReadOnlyMarker)
+	if err := os.WriteFile(marker, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RunOnce(context.Background()); !errors.Is(err, autherrors.ErrReadOnly) {
+		t.Errorf("read-only sync: err = %v, want ErrReadOnly", err)
+	}
+}
+
+func TestAgent(t *testing.T) {
+	tmp := t.TempDir()
+	passwdPath := filepath.Join(tmp, "passwd")
+	dir := &fakeDirectory{users: []string{"alice"}}
+	ctx := context.Background()
+	if _, err := New(dir, passwdPath, Options{}).RunOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	local, err := passwd.NewAgent(passwdPath, filepath.Join(tmp, "keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAgent(dir, local)
+	defer func() { _ = a.Close() }()
+
+	if _, err := a.Authenticate(ctx, "alice", "pw"); err != nil {
+		t.Errorf("pass-through login: %v", err)
+	}
+	if _, err := auth.VerifyCredentials(ctx, a, auth.Credentials{Username: "alice", Mechanism: "PLAIN", Password: "pw"}); err != nil {
+		t.Errorf("pass-through PLAIN login: %v", err)
+	}
+
+	// With the directory down, logins fail but delivery checks do not.
+	dir.down = true
+	if _, err := a.Authenticate(ctx, "alice", "pw"); !errors.Is(err, errDown) {
+		t.Errorf("login with directory down: err = %v", err)
+	}
+	if ok, err := a.UserExists(ctx, "alice"); err != nil || !ok {
+		t.Errorf("UserExists(alice) with directory down = %v, %v", ok, err)
+	}
+	if ok, err := a.UserExists(ctx, "bob"); err != nil || ok {
+		t.Errorf("UserExists(bob) = %v, %v", ok, err)
+	}
+	if ul, ok := auth.AsUserLister(a); !ok {
+		t.Error("agent does not report UserLister")
+	} else if names, err := ul.ListUsers(ctx); err != nil || !slices.Equal(names, []string{"alice"}) {
+		t.Errorf("ListUsers = %v, %v", names, err)
+	}
+}
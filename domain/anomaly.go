@@ -0,0 +1,237 @@
+package domain
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// ipReputationKeyType is the context key type for client IP reputation.
+type ipReputationKeyType struct{}
+
+// IPReputationKey is the context key used to pass a reputation label for the
+// client IP (e.g., "tor", "residential", "known-bad") from the protocol
+// daemon to the anomaly scorer. Use WithIPReputation to set it.
+var IPReputationKey = ipReputationKeyType{}
+
+// WithIPReputation returns a context with the client IP reputation set.
+func WithIPReputation(ctx context.Context, reputation string) context.Context {
+	return context.WithValue(ctx, IPReputationKey, reputation)
+}
+
+// ipReputationFromContext extracts the IP reputation from the context.
+// Returns empty string if not set.
+func ipReputationFromContext(ctx context.Context) string {
+	r, _ := ctx.Value(IPReputationKey).(string)
+	return r
+}
+
+// LoginFeatures describes a login that passed the credential check, as seen
+// by an AnomalyScorer.
+type LoginFeatures struct {
+	Username     string    `json:"username"`
+	Domain       string    `json:"domain,omitempty"`
+	RemoteIP     string    `json:"ip,omitempty"`
+	Protocol     string    `json:"protocol,omitempty"`
+	IPReputation string    `json:"ip_reputation,omitempty"`
+	Time         time.Time `json:"time"`
+
+	// Hour is the UTC hour of day (0-23) of the attempt.
+	Hour int `json:"hour"`
+
+	// RecentUserFailures and RecentIPFailures count failed attempts within
+	// the rate limit window. Both are 0 when rate limiting is disabled.
+	RecentUserFailures int `json:"recent_user_failures"`
+	RecentIPFailures   int `json:"recent_ip_failures"`
+}
+
+// RiskDecision is the action the router takes for a scored login.
+type RiskDecision int
+
+const (
+	// RiskAllow lets the login proceed.
+	RiskAllow RiskDecision = iota
+	// RiskStepUp lets the login proceed only after an additional
+	// verification step (see AuthResult.StepUpRequired).
+	RiskStepUp
+	// RiskDeny refuses the login with errors.ErrLoginDenied.
+	RiskDeny
+)
+
+// String returns "allow", "step_up" or "deny".
+func (d RiskDecision) String() string {
+	switch d {
+	case RiskStepUp:
+		return "step_up"
+	case RiskDeny:
+		return "deny"
+	default:
+		return "allow"
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (d RiskDecision) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. Empty means RiskAllow.
+func (d *RiskDecision) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "", "allow":
+		*d = RiskAllow
+	case "step_up":
+		*d = RiskStepUp
+	case "deny":
+		*d = RiskDeny
+	default:
+		return fmt.Errorf("unknown risk decision %q", text)
+	}
+	return nil
+}
+
+// RiskAssessment is an AnomalyScorer's verdict on a login.
+type RiskAssessment struct {
+	// Score is the anomaly score; higher is riskier. Compared against
+	// AnomalyPolicy thresholds.
+	Score float64 `json:"score"`
+
+	// Decision is an explicit action from the scorer. The router applies
+	// the stricter of Decision and the policy thresholds.
+	Decision RiskDecision `json:"decision"`
+
+	// Reason is a short human-readable explanation for logs.
+	Reason string `json:"reason,omitempty"`
+}
+
+// AnomalyScorer scores logins that passed the credential check.
+// Install one with AuthRouter.WithAnomalyScorer.
+type AnomalyScorer interface {
+	Score(ctx context.Context, f LoginFeatures) (RiskAssessment, error)
+}
+
+// AnomalyScorerFunc adapts a function to the AnomalyScorer interface.
+type AnomalyScorerFunc func(ctx context.Context, f LoginFeatures) (RiskAssessment, error)
+
+// Score calls fn(ctx, f).
+func (fn AnomalyScorerFunc) Score(ctx context.Context, f LoginFeatures) (RiskAssessment, error) {
+	return fn(ctx, f)
+}
+
+// AnomalyPolicy maps scores to decisions.
+type AnomalyPolicy struct {
+	// StepUpScore and DenyScore are the minimum scores for RiskStepUp and
+	// RiskDeny. Zero disables the threshold.
+	StepUpScore float64
+	DenyScore   float64
+
+	// FailClosed denies logins when the scorer returns an error. The
+	// default is to allow them and log a warning.
+	FailClosed bool
+}
+
+// decide returns the stricter of a's explicit decision and the thresholds.
+func (p AnomalyPolicy) decide(a RiskAssessment) RiskDecision {
+	d := a.Decision
+	if p.DenyScore > 0 && a.Score >= p.DenyScore {
+		d = max(d, RiskDeny)
+	}
+	if p.StepUpScore > 0 && a.Score >= p.StepUpScore {
+		d = max(d, RiskStepUp)
+	}
+	return d
+}
+
+// HTTPAnomalyScorer scores logins by POSTing LoginFeatures as JSON to URL
+// and decoding a RiskAssessment from the response, e.g.
+//
+//	{"score": 0.82, "decision": "step_up", "reason": "new country"}
+type HTTPAnomalyScorer struct {
+	URL string
+
+	// Client is the HTTP client to use; nil uses a client with a 5 second
+	// timeout. Scoring sits on the login path, so keep timeouts short.
+	Client *http.Client
+}
+
+var defaultScorerClient = &http.Client{Timeout: 5 * time.Second}
+
+// Score implements AnomalyScorer.
+func (s *HTTPAnomalyScorer) Score(ctx context.Context, f LoginFeatures) (RiskAssessment, error) {
+	body, err := json.Marshal(f)
+	if err != nil {
+		return RiskAssessment{}, fmt.Errorf("encode login features: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return RiskAssessment{}, fmt.Errorf("build scorer request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := s.Client
+	if client == nil {
+		client = defaultScorerClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return RiskAssessment{}, fmt.Errorf("scorer request: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return RiskAssessment{}, fmt.Errorf("scorer returned %s", resp.Status)
+	}
+	var a RiskAssessment
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&a); err != nil {
+		return RiskAssessment{}, fmt.Errorf("decode scorer response: %w", err)
+	}
+	return a, nil
+}
+
+// WithAnomalyScorer installs s to score every login that passes the
+// credential check, and policy to act on the result. Logins judged RiskDeny
+// fail with errors.ErrLoginDenied; RiskStepUp sets AuthResult.StepUpRequired
+// (Authenticate, which cannot return the flag, fails with
+// errors.ErrStepUpRequired instead).
+func (r *AuthRouter) WithAnomalyScorer(s AnomalyScorer, policy AnomalyPolicy) *AuthRouter {
+	r.scorer = s
+	r.policy = policy
+	return r
+}
+
+// assessLogin scores a successful credential check for username.
+func (r *AuthRouter) assessLogin(ctx context.Context, username string, result *AuthResult) (RiskDecision, RiskAssessment) {
+	now := time.Now().UTC()
+	f := LoginFeatures{
+		Username:     username,
+		RemoteIP:     clientIPFromContext(ctx),
+		Protocol:     protocolFromContext(ctx),
+		IPReputation: ipReputationFromContext(ctx),
+		Time:         now,
+		Hour:         now.Hour(),
+	}
+	if result.Domain != nil {
+		f.Domain = result.Domain.Name
+	}
+	if r.rateLimiter != nil {
+		f.RecentUserFailures, f.RecentIPFailures = r.rateLimiter.failures(f.RemoteIP, username)
+	}
+
+	a, err := r.scorer.Score(ctx, f)
+	if err != nil {
+		slog.Warn("anomaly scorer failed",
+			slog.String("username", username),
+			slog.String("error", err.Error()),
+			slog.Bool("fail_closed", r.policy.FailClosed))
+		if r.policy.FailClosed {
+			return RiskDeny, RiskAssessment{Decision: RiskDeny, Reason: "scorer unavailable"}
+		}
+		return RiskAllow, RiskAssessment{}
+	}
+	return r.policy.decide(a), a
+}
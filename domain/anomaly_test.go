@@ -0,0 +1,135 @@
+package domain
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+func anomalyTestRouter(scorer AnomalyScorer, policy AnomalyPolicy) *AuthRouter {
+	agent := &mockAuthAgent{
+		authenticateFn: func(_ context.Context, username, password string) (*auth.AuthSession, error) {
+			if password != "secret" {
+				return nil, autherrors.ErrAuthFailed
+			}
+			return &auth.AuthSession{User: &auth.User{Username: username}}, nil
+		},
+	}
+	provider := &mockDomainProvider{domains: map[string]*Domain{
+		"example.com": {Name: "example.com", AuthAgent: agent},
+	}}
+	return NewAuthRouter(provider, nil).WithAnomalyScorer(scorer, policy)
+}
+
+func TestAnomalyScorer_Decisions(t *testing.T) {
+	var got LoginFeatures
+	scorer := AnomalyScorerFunc(func(_ context.Context, f LoginFeatures) (RiskAssessment, error) {
+		got = f
+		switch f.IPReputation {
+		case "tor":
+			return RiskAssessment{Score: 0.95}, nil
+		case "new-country":
+			return RiskAssessment{Score: 0.6}, nil
+		case "blocked":
+			return RiskAssessment{Decision: RiskDeny, Reason: "listed"}, nil
+		}
+		return RiskAssessment{Score: 0.1}, nil
+	})
+	r := anomalyTestRouter(scorer, AnomalyPolicy{StepUpScore: 0.5, DenyScore: 0.9})
+
+	ctx := WithProtocol(WithClientIP(context.Background(), "198.51.100.1"), "imap")
+	res, err := r.AuthenticateWithDomain(ctx, "alice@example.com", "secret")
+	if err != nil || res.StepUpRequired {
+		t.Fatalf("low score: %+v, %v", res, err)
+	}
+	if got.Domain != "example.com" || got.RemoteIP != "198.51.100.1" || got.Protocol != "imap" || got.Hour != got.Time.Hour() {
+		t.Errorf("unexpected features: %+v", got)
+	}
+
+	res, err = r.AuthenticateWithDomain(WithIPReputation(ctx, "new-country"), "alice@example.com", "secret")
+	if err != nil || !res.StepUpRequired || res.Risk == nil || res.Risk.Score != 0.6 {
+		t.Errorf("step-up: %+v, %v", res, err)
+	}
+	if _, err := r.Authenticate(WithIPReputation(ctx, "new-country"), "alice@example.com", "secret"); !errors.Is(err, autherrors.ErrStepUpRequired) {
+		t.Errorf("Authenticate step-up err = %v", err)
+	}
+
+	for _, rep := range []string{"tor", "blocked"} {
+		if _, err := r.AuthenticateWithDomain(WithIPReputation(ctx, rep), "alice@example.com", "secret"); !errors.Is(err, autherrors.ErrLoginDenied) {
+			t.Errorf("%s: err = %v, want ErrLoginDenied", rep, err)
+		}
+	}
+
+	// Failed credentials never reach the scorer.
+	got = LoginFeatures{}
+	if _, err := r.AuthenticateWithDomain(ctx, "alice@example.com", "wrong"); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("wrong password err = %v", err)
+	}
+	if got.Username != "" {
+		t.Error("scorer called for failed credentials")
+	}
+}
+
+func TestAnomalyScorer_FailureHistory(t *testing.T) {
+	var got LoginFeatures
+	scorer := AnomalyScorerFunc(func(_ context.Context, f LoginFeatures) (RiskAssessment, error) {
+		got = f
+		return RiskAssessment{}, nil
+	})
+	r := anomalyTestRouter(scorer, AnomalyPolicy{}).WithRateLimit(DefaultRateLimitConfig())
+	defer func() { _ = r.Close() }()
+
+	ctx := WithClientIP(context.Background(), "203.0.113.9")
+	for i := 0; i < 2; i++ {
+		_, _ = r.Authenticate(ctx, "alice@example.com", "wrong")
+	}
+	if _, err := r.Authenticate(ctx, "alice@example.com", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if got.RecentUserFailures != 2 || got.RecentIPFailures != 2 {
+		t.Errorf("failure counts = %d/%d, want 2/2", got.RecentUserFailures, got.RecentIPFailures)
+	}
+}
+
+func TestAnomalyScorer_FailClosed(t *testing.T) {
+	broken := AnomalyScorerFunc(func(context.Context, LoginFeatures) (RiskAssessment, error) {
+		return RiskAssessment{}, errors.New("scorer down")
+	})
+	if _, err := anomalyTestRouter(broken, AnomalyPolicy{}).Authenticate(context.Background(), "alice@example.com", "secret"); err != nil {
+		t.Errorf("fail-open: err = %v", err)
+	}
+	if _, err := anomalyTestRouter(broken, AnomalyPolicy{FailClosed: true}).Authenticate(context.Background(), "alice@example.com", "secret"); !errors.Is(err, autherrors.ErrLoginDenied) {
+		t.Errorf("fail-closed: err = %v", err)
+	}
+}
+
+func TestHTTPAnomalyScorer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var f LoginFeatures
+		if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		decision := "allow"
+		if f.Username == "alice@example.com" {
+			decision = "step_up"
+		}
+		_, _ = w.Write([]byte(`{"score": 0.4, "decision": "` + decision + `", "reason": "test"}`))
+	}))
+	defer srv.Close()
+
+	s := &HTTPAnomalyScorer{URL: srv.URL}
+	a, err := s.Score(context.Background(), LoginFeatures{Username: "alice@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Score != 0.4 || a.Decision != RiskStepUp || a.Reason != "test" {
+		t.Errorf("unexpected assessment: %+v", a)
+	}
+}
@@ -0,0 +1,77 @@
+package domain
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/infodancer/auth/audit"
+)
+
+// WithAuditor installs a to record every login (AuthenticateCredentials and
+// the methods built on it, and AuthenticateExternal) and every UserExists
+// call, with its outcome, client IP and protocol from the context, domain
+// and latency. Attempts refused by the rate limiter are recorded too. A
+// failing auditor is logged and does not fail the call.
+func (r *AuthRouter) WithAuditor(a audit.Auditor) *AuthRouter {
+	r.auditor = a
+	return r
+}
+
+// auditLogin records a login for username, started at start.
+func (r *AuthRouter) auditLogin(ctx context.Context, start time.Time, username, mechanism string, result *AuthResult, err error) {
+	if r.auditor == nil {
+		return
+	}
+	rec := r.auditRecord(ctx, start, audit.OpAuthenticate, username)
+	rec.Mechanism = mechanism
+	switch {
+	case err != nil:
+		rec.Outcome, rec.Error = audit.OutcomeFailure, err.Error()
+	default:
+		rec.Outcome = audit.OutcomeSuccess
+		rec.StepUp = result.MFARequired || result.StepUpRequired
+		if result.Domain != nil {
+			rec.Domain = result.Domain.Name
+		}
+	}
+	r.emitAudit(ctx, rec)
+}
+
+// auditLookup records a UserExists call for username, started at start.
+func (r *AuthRouter) auditLookup(ctx context.Context, start time.Time, username string, exists bool, err error) {
+	if r.auditor == nil {
+		return
+	}
+	rec := r.auditRecord(ctx, start, audit.OpUserExists, username)
+	switch {
+	case err != nil:
+		rec.Outcome, rec.Error = audit.OutcomeError, err.Error()
+	case exists:
+		rec.Outcome = audit.OutcomeSuccess
+	default:
+		rec.Outcome = audit.OutcomeNotFound
+	}
+	r.emitAudit(ctx, rec)
+}
+
+// auditRecord returns the fields common to every record.
+func (r *AuthRouter) auditRecord(ctx context.Context, start time.Time, op audit.Op, username string) audit.Record {
+	_, domainName := SplitUsername(username)
+	return audit.Record{
+		Time:     start.UTC(),
+		Op:       op,
+		Username: username,
+		Domain:   strings.ToLower(domainName),
+		ClientIP: clientIPFromContext(ctx),
+		Protocol: protocolFromContext(ctx),
+		Latency:  time.Since(start),
+	}
+}
+
+func (r *AuthRouter) emitAudit(ctx context.Context, rec audit.Record) {
+	if err := r.auditor.Audit(ctx, rec); err != nil {
+		slog.Warn("audit record lost", "op", rec.Op, "username", rec.Username, "error", err)
+	}
+}
@@ -0,0 +1,72 @@
+package domain
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/infodancer/auth/audit"
+	"github.com/infodancer/auth/passwd"
+)
+
+// recordingAuditor keeps the records it receives.
+type recordingAuditor struct {
+	mu   sync.Mutex
+	recs []audit.Record
+}
+
+func (a *recordingAuditor) Audit(_ context.Context, rec audit.Record) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.recs = append(a.recs, rec)
+	return nil
+}
+
+func TestAuthRouter_Audit(t *testing.T) {
+	hash, err := passwd.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := newTestDomainsTree(t, "alice:"+hash+":alice\n", "example.com")
+	rec := &recordingAuditor{}
+	r := NewAuthRouter(p, nil).
+		WithRateLimit(RateLimitConfig{MaxFailuresPerUser: 1, Window: time.Minute, Lockout: time.Minute}).
+		WithAuditor(rec)
+	defer func() { _ = r.Close() }()
+
+	ctx := WithProtocol(WithClientIP(context.Background(), "192.0.2.7"), "imap")
+	if _, err := r.Authenticate(ctx, "alice@Example.com", "secret"); err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	_, _ = r.Authenticate(ctx, "alice@example.com", "wrong")
+	_, _ = r.Authenticate(ctx, "alice@example.com", "secret") // rate limited
+	_, _ = r.UserExists(ctx, "alice@example.com")
+	_, _ = r.UserExists(ctx, "nobody@example.com")
+
+	want := []struct {
+		op      audit.Op
+		outcome audit.Outcome
+	}{
+		{audit.OpAuthenticate, audit.OutcomeSuccess},
+		{audit.OpAuthenticate, audit.OutcomeFailure},
+		{audit.OpAuthenticate, audit.OutcomeFailure},
+		{audit.OpUserExists, audit.OutcomeSuccess},
+		{audit.OpUserExists, audit.OutcomeNotFound},
+	}
+	if len(rec.recs) != len(want) {
+		t.Fatalf("records = %+v, want %d", rec.recs, len(want))
+	}
+	for i, w := range want {
+		got := rec.recs[i]
+		if got.Op != w.op || got.Outcome != w.outcome {
+			t.Errorf("record %d = %s %s, want %s %s", i, got.Op, got.Outcome, w.op, w.outcome)
+		}
+		if got.ClientIP != "192.0.2.7" || got.Protocol != "imap" || got.Domain != "example.com" || got.Time.IsZero() || got.Latency <= 0 {
+			t.Errorf("record %d = %+v", i, got)
+		}
+	}
+	if rec.recs[2].Error == "" {
+		t.Error("rate-limited login recorded without a reason")
+	}
+}
@@ -0,0 +1,117 @@
+package domain
+
+import (
+	"context"
+	"strings"
+
+	"github.com/infodancer/auth"
+)
+
+// DefaultBounceLocalparts are the localparts every domain accepts and
+// discards mail for when BouncesConfig.Localparts is not set: the qmail
+// double-bounce recipient and the conventional sender of bounces.
+var DefaultBounceLocalparts = []string{"double-bounce", "mailer-daemon"}
+
+// BouncesConfig controls the handling of bounce traffic, which is where
+// mail loops start: a bounce rejected at RCPT or forwarded to a host that
+// rejects it comes straight back as another bounce.
+//
+//   - Bounce localparts (see Localparts) always exist, so mail to them is
+//     never rejected, and mail to them is discarded unless the localpart
+//     is an account or has a forwarding rule.
+//   - Mail with the null envelope sender (MAIL FROM:<>, i.e. bounces and
+//     DSNs) does not follow forwards to domains this server does not serve
+//     unless RelayNullSender is set. The skipped targets are replaced by a
+//     single inbox copy when the recipient is an account, and dropped
+//     otherwise.
+type BouncesConfig struct {
+	// Localparts lists the bounce localparts. Empty means
+	// DefaultBounceLocalparts.
+	Localparts []string `toml:"localparts,omitempty"`
+
+	// RelayNullSender lets null-sender mail follow forwards off-host.
+	RelayNullSender bool `toml:"relay_null_sender,omitempty"`
+
+	// Disable turns all of the above off.
+	Disable bool `toml:"disable,omitempty"`
+}
+
+// bounceRules is the loaded form of BouncesConfig shared by a domain's
+// mailAuthAgent and MailDeliveryAgent. A nil *bounceRules disables the
+// special handling.
+type bounceRules struct {
+	sinks           map[string]bool
+	relayNullSender bool
+	users           auth.AuthenticationAgent // accounts shadow bounce localparts
+}
+
+// rules returns the bounce rules for a domain whose accounts live in users,
+// or nil when disabled.
+func (c BouncesConfig) rules(users auth.AuthenticationAgent) *bounceRules {
+	if c.Disable {
+		return nil
+	}
+	localparts := c.Localparts
+	if len(localparts) == 0 {
+		localparts = DefaultBounceLocalparts
+	}
+	r := &bounceRules{
+		sinks:           make(map[string]bool, len(localparts)),
+		relayNullSender: c.RelayNullSender,
+		users:           users,
+	}
+	for _, lp := range localparts {
+		r.sinks[strings.ToLower(strings.TrimSpace(lp))] = true
+	}
+	return r
+}
+
+// isSink reports whether localpart, ignoring any subaddress extension, is a
+// bounce localpart.
+func (r *bounceRules) isSink(localpart string) bool {
+	if r == nil {
+		return false
+	}
+	base, _ := ParseLocalPart(localpart)
+	return r.sinks[strings.ToLower(base)]
+}
+
+// discards reports whether mail to localpart, which has no forwarding
+// rule, is discarded: it is a bounce localpart that is not an account.
+func (r *bounceRules) discards(ctx context.Context, localpart string) (bool, error) {
+	if !r.isSink(localpart) {
+		return false, nil
+	}
+	base, _ := ParseLocalPart(localpart)
+	exists, err := r.users.UserExists(ctx, base)
+	if err != nil {
+		return false, err
+	}
+	return !exists, nil
+}
+
+// relaysNullSender reports whether mail with the null sender may be
+// relayed to unserved domains.
+func (r *bounceRules) relaysNullSender() bool {
+	return r == nil || r.relayNullSender
+}
+
+// IsNullSender reports whether from is the null envelope sender, as given
+// in MAIL FROM:<> ("" or "<>").
+func IsNullSender(from string) bool {
+	from = strings.TrimSpace(from)
+	return from == "" || from == "<>"
+}
+
+// discardsBounce reports whether agent discards mail to localpart as a
+// bounce localpart. Agents other than the provider's own never do.
+func discardsBounce(ctx context.Context, agent MailAuthAgent, localpart string) (bool, error) {
+	m, ok := agent.(*mailAuthAgent)
+	if !ok {
+		return false, nil
+	}
+	if localpart, ok = m.norm.localpart(localpart); !ok {
+		return false, nil
+	}
+	return m.bounces.discards(ctx, localpart)
+}
@@ -0,0 +1,185 @@
+package domain
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/forwards"
+	"github.com/infodancer/msgstore"
+)
+
+// bounceAgents returns a mail auth agent and delivery agent for a domain
+// with the given users, forwarding rules and bounce configuration.
+func bounceAgents(users []string, rules map[string]string, cfg BouncesConfig, relay Relayer, provider DomainProvider) (*mailAuthAgent, *MailDeliveryAgent, *stubDeliveryAgent) {
+	known := make(map[string]bool, len(users))
+	for _, u := range users {
+		known[u] = true
+	}
+	inner := &stubAuthAgent{users: known}
+	chain := &forwardChain{
+		domainForwards:  forwards.FromMap(rules),
+		defaultForwards: forwards.FromMap(nil),
+	}
+	bounces := cfg.rules(inner)
+	store := &stubDeliveryAgent{}
+	return &mailAuthAgent{inner: inner, chain: chain, bounces: bounces},
+		&MailDeliveryAgent{inner: store, chain: chain, provider: provider, relay: relay, bounces: bounces},
+		store
+}
+
+func TestBounces_UserExists(t *testing.T) {
+	ctx := context.Background()
+	agent, _, _ := bounceAgents([]string{"alice"}, nil, BouncesConfig{}, nil, nil)
+	for lp, want := range map[string]bool{
+		"alice":            true,
+		"mailer-daemon":    true,
+		"MAILER-DAEMON":    true,
+		"double-bounce":    true,
+		"double-bounce+id": true,
+		"nobody":           false,
+	} {
+		if got, err := agent.UserExists(ctx, lp); err != nil || got != want {
+			t.Errorf("UserExists(%q) = %v, %v; want %v", lp, got, err, want)
+		}
+	}
+	if info, _ := agent.LookupAddress(ctx, "mailer-daemon"); !info.AcceptsMail || info.CanAuthenticate {
+		t.Errorf("LookupAddress(mailer-daemon) = %+v", info)
+	}
+
+	disabled, _, _ := bounceAgents(nil, nil, BouncesConfig{Disable: true}, nil, nil)
+	if got, _ := disabled.UserExists(ctx, "mailer-daemon"); got {
+		t.Error("disabled rules still accept mailer-daemon")
+	}
+
+	custom, _, _ := bounceAgents(nil, nil, BouncesConfig{Localparts: []string{"bounces"}}, nil, nil)
+	if got, _ := custom.UserExists(ctx, "bounces"); !got {
+		t.Error("custom bounce localpart not accepted")
+	}
+	if got, _ := custom.UserExists(ctx, "mailer-daemon"); got {
+		t.Error("custom list should replace the defaults")
+	}
+}
+
+func TestBounces_DeliverDiscardsSink(t *testing.T) {
+	_, mda, store := bounceAgents([]string{"mailer-daemon"}, nil, BouncesConfig{}, nil, nil)
+	for _, rcpt := range []string{"double-bounce@this.com", "mailer-daemon@this.com"} {
+		env := msgstore.Envelope{Recipients: []string{rcpt}}
+		if err := mda.Deliver(context.Background(), env, bytes.NewReader([]byte("bounce"))); err != nil {
+			t.Fatalf("Deliver(%s): %v", rcpt, err)
+		}
+	}
+	// mailer-daemon is an account here, so only it is delivered.
+	if len(store.delivered) != 1 || store.delivered[0].Recipients[0] != "mailer-daemon@this.com" {
+		t.Errorf("delivered = %+v", store.delivered)
+	}
+}
+
+func TestBounces_NullSenderNotRelayed(t *testing.T) {
+	local := &stubDeliveryAgent{}
+	provider := &stubDomainProvider{domains: map[string]*Domain{
+		"local.com": {Name: "local.com", DeliveryAgent: local},
+	}}
+	rules := map[string]string{
+		"alice": "alice@gmail.com, bob@local.com",
+		"alias": "someone@gmail.com",
+	}
+	deliver := func(mda *MailDeliveryAgent, from, rcpt string) {
+		t.Helper()
+		env := msgstore.Envelope{From: from, Recipients: []string{rcpt}}
+		if err := mda.Deliver(context.Background(), env, bytes.NewReader([]byte("dsn"))); err != nil {
+			t.Fatalf("Deliver: %v", err)
+		}
+	}
+
+	t.Run("account keeps a copy", func(t *testing.T) {
+		relay := &stubRelayer{}
+		_, mda, store := bounceAgents([]string{"alice"}, rules, BouncesConfig{}, relay, provider)
+		local.delivered = nil
+		deliver(mda, "", "alice@this.com")
+		if len(relay.relayed) != 0 {
+			t.Errorf("null-sender mail relayed to %+v", relay.relayed)
+		}
+		if len(local.delivered) != 1 {
+			t.Errorf("served target got %d deliveries, want 1", len(local.delivered))
+		}
+		if len(store.delivered) != 1 {
+			t.Errorf("inbox got %d deliveries, want 1", len(store.delivered))
+		}
+	})
+
+	t.Run("alias drops", func(t *testing.T) {
+		relay := &stubRelayer{}
+		_, mda, store := bounceAgents(nil, rules, BouncesConfig{}, relay, provider)
+		deliver(mda, "<>", "alias@this.com")
+		if len(relay.relayed) != 0 || len(store.delivered) != 0 {
+			t.Errorf("relayed %d, stored %d; want none", len(relay.relayed), len(store.delivered))
+		}
+	})
+
+	t.Run("ordinary sender relayed", func(t *testing.T) {
+		relay := &stubRelayer{}
+		_, mda, store := bounceAgents([]string{"alice"}, rules, BouncesConfig{}, relay, provider)
+		deliver(mda, "carol@example.org", "alice@this.com")
+		if len(relay.relayed) != 1 || len(store.delivered) != 0 {
+			t.Errorf("relayed %d, stored %d; want 1, 0", len(relay.relayed), len(store.delivered))
+		}
+	})
+
+	t.Run("relay_null_sender", func(t *testing.T) {
+		relay := &stubRelayer{}
+		_, mda, _ := bounceAgents(nil, rules, BouncesConfig{RelayNullSender: true}, relay, provider)
+		deliver(mda, "", "alias@this.com")
+		if len(relay.relayed) != 1 {
+			t.Errorf("relayed %d, want 1", len(relay.relayed))
+		}
+	})
+}
+
+func TestBounces_ResolveFinalRecipients(t *testing.T) {
+	agent, _, _ := bounceAgents(nil, map[string]string{"errors": "mailer-daemon@this.com"}, BouncesConfig{}, nil, nil)
+	provider := &stubDomainProvider{domains: map[string]*Domain{
+		"this.com": {Name: "this.com", AuthAgent: agent},
+	}}
+	ctx := context.Background()
+
+	for _, addr := range []string{"double-bounce@this.com", "errors@this.com"} {
+		got, err := ResolveFinalRecipients(ctx, provider, addr)
+		if err != nil || len(got) != 0 {
+			t.Errorf("ResolveFinalRecipients(%s) = %+v, %v; want no deliveries", addr, got, err)
+		}
+	}
+	if _, err := ResolveFinalRecipients(ctx, provider, "nobody@this.com"); !errors.Is(err, autherrors.ErrUserNotFound) {
+		t.Errorf("nobody: err = %v, want ErrUserNotFound", err)
+	}
+}
+
+func TestBounces_Config(t *testing.T) {
+	p, base := newTestDomainsTree(t, "alice:x:alice\n", "a.com", "b.com")
+	cfg := "[bounces]\ndisable = true\n"
+	if err := os.WriteFile(filepath.Join(base, "b.com", "config.toml"), []byte(cfg), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for name, want := range map[string]bool{"a.com": true, "b.com": false} {
+		d := p.GetDomain(name)
+		if d == nil {
+			t.Fatalf("GetDomain(%s) = nil", name)
+		}
+		if got, err := d.AuthAgent.UserExists(ctx, "double-bounce"); err != nil || got != want {
+			t.Errorf("%s: UserExists(double-bounce) = %v, %v; want %v", name, got, err, want)
+		}
+	}
+}
+
+func TestIsNullSender(t *testing.T) {
+	for from, want := range map[string]bool{"": true, "<>": true, " <> ": true, "a@b.com": false} {
+		if got := IsNullSender(from); got != want {
+			t.Errorf("IsNullSender(%q) = %v", from, got)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package domain
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/infodancer/auth"
+)
+
+// WithChallengeProvider installs cp to issue a challenge for every login the
+// anomaly scorer judges RiskStepUp (see AuthResult.Challenge). Without one
+// the router uses auth.NoopChallengeProvider: step-ups are flagged but no
+// challenge is issued.
+// Returns the router to allow chaining.
+func (r *AuthRouter) WithChallengeProvider(cp auth.ChallengeProvider) *AuthRouter {
+	r.challenges = cp
+	return r
+}
+
+// challengeProvider returns the installed provider or the no-op default.
+func (r *AuthRouter) challengeProvider() auth.ChallengeProvider {
+	if r.challenges == nil {
+		return auth.NoopChallengeProvider{}
+	}
+	return r.challenges
+}
+
+// issueChallenge asks the provider for a step-up challenge. A provider
+// failure is logged and leaves the login without a challenge, which callers
+// must treat like any unresolved step-up.
+func (r *AuthRouter) issueChallenge(ctx context.Context, username, reason string) *auth.Challenge {
+	ch, err := r.challengeProvider().Issue(ctx, username, reason)
+	if err != nil {
+		slog.Warn("issue step-up challenge failed", "username", username, "error", err)
+		return nil
+	}
+	return ch
+}
+
+// VerifyChallenge checks a response to a challenge issued for username and
+// reports whether it passed. Web flows call it before completing a login
+// whose AuthResult had StepUpRequired set.
+func (r *AuthRouter) VerifyChallenge(ctx context.Context, username, id, response string) (bool, error) {
+	return r.challengeProvider().Verify(ctx, username, id, response)
+}
@@ -0,0 +1,55 @@
+package domain
+
+import (
+	"context"
+	"testing"
+
+	"github.com/infodancer/auth"
+)
+
+// codeChallenges issues a fixed-code challenge and records the reason.
+type codeChallenges struct {
+	reason string
+}
+
+func (c *codeChallenges) Issue(_ context.Context, username, reason string) (*auth.Challenge, error) {
+	c.reason = reason
+	return &auth.Challenge{ID: "ch-" + username, Kind: "email_code"}, nil
+}
+
+func (c *codeChallenges) Verify(_ context.Context, username, id, response string) (bool, error) {
+	return id == "ch-"+username && response == "123456", nil
+}
+
+func TestAuthRouter_StepUpChallenge(t *testing.T) {
+	scorer := AnomalyScorerFunc(func(context.Context, LoginFeatures) (RiskAssessment, error) {
+		return RiskAssessment{Decision: RiskStepUp, Reason: "new_device"}, nil
+	})
+	ctx := context.Background()
+
+	// Default: step-up is flagged but nothing can be challenged or verified.
+	r := anomalyTestRouter(scorer, AnomalyPolicy{})
+	res, err := r.AuthenticateWithDomain(ctx, "alice@example.com", "secret")
+	if err != nil || !res.StepUpRequired || res.Challenge != nil {
+		t.Fatalf("default provider: %+v, %v", res, err)
+	}
+	if ok, err := r.VerifyChallenge(ctx, "alice@example.com", "anything", "123456"); err != nil || ok {
+		t.Errorf("no-op VerifyChallenge = %v, %v; want false", ok, err)
+	}
+
+	cp := &codeChallenges{}
+	r = anomalyTestRouter(scorer, AnomalyPolicy{}).WithChallengeProvider(cp)
+	res, err = r.AuthenticateWithDomain(ctx, "alice@example.com", "secret")
+	if err != nil || !res.StepUpRequired || res.Challenge == nil {
+		t.Fatalf("with provider: %+v, %v", res, err)
+	}
+	if cp.reason != "new_device" || res.Challenge.Kind != "email_code" {
+		t.Errorf("reason = %q, challenge = %+v", cp.reason, res.Challenge)
+	}
+	if ok, _ := r.VerifyChallenge(ctx, "alice@example.com", res.Challenge.ID, "000000"); ok {
+		t.Error("wrong response passed")
+	}
+	if ok, err := r.VerifyChallenge(ctx, "alice@example.com", res.Challenge.ID, "123456"); err != nil || !ok {
+		t.Errorf("VerifyChallenge = %v, %v; want true", ok, err)
+	}
+}
@@ -0,0 +1,119 @@
+package domain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/atrest"
+	"github.com/infodancer/auth/diagnostic"
+	"github.com/infodancer/auth/forwards"
+	"github.com/pelletier/go-toml/v2"
+)
+
+// CheckConfig reports the problems in the domain config.toml at path:
+// syntax errors, keys no DomainConfig field reads, and values the router
+// would ignore or refuse. A missing file has no problems. The error is for
+// files that cannot be read.
+func CheckConfig(path string) ([]diagnostic.Problem, error) {
+	data, err := atrest.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+	return checkConfig(path, data), nil
+}
+
+// checkConfig checks the contents of the config file at path.
+func checkConfig(path string, data []byte) []diagnostic.Problem {
+	var problems []diagnostic.Problem
+	add := func(sev diagnostic.Severity, code string, line int, msg, fix string) {
+		problems = append(problems, diagnostic.Problem{
+			Severity: sev, Code: code, File: path, Line: line, Message: msg, Fix: fix,
+		})
+	}
+
+	var cfg DomainConfig
+	err := toml.NewDecoder(bytes.NewReader(data)).DisallowUnknownFields().Decode(&cfg)
+	var decodeErr *toml.DecodeError
+	var strictErr *toml.StrictMissingError
+	switch {
+	case errors.As(err, &strictErr):
+		// The known keys were still decoded; check them too.
+		for _, e := range strictErr.Errors {
+			line, _ := e.Position()
+			add(diagnostic.Warning, "config.unknown-key", line,
+				fmt.Sprintf("key %q is not a domain setting and is ignored", strings.Join(e.Key(), ".")),
+				"check the spelling or remove the key")
+		}
+	case errors.As(err, &decodeErr):
+		line, _ := decodeErr.Position()
+		add(diagnostic.Error, "config.parse", line,
+			strings.TrimPrefix(decodeErr.Error(), "toml: "), "")
+		return problems
+	case err != nil:
+		add(diagnostic.Error, "config.parse", 0, err.Error(), "")
+		return problems
+	}
+
+	switch cfg.RecipientRejection {
+	case "", "rcpt", "data":
+	default:
+		add(diagnostic.Error, "config.bad-value", 0,
+			fmt.Sprintf("recipient_rejection %q is not \"rcpt\" or \"data\"", cfg.RecipientRejection), "")
+	}
+	if cfg.MaxMessageSize < 0 {
+		add(diagnostic.Error, "config.bad-value", 0, "max_message_size is negative", "")
+	}
+	if cfg.DeleteGraceDays < 0 {
+		add(diagnostic.Error, "config.bad-value", 0, "delete_grace_days is negative", "")
+	}
+	if cfg.Limits.MaxSendsPerHour < 0 {
+		add(diagnostic.Error, "config.bad-value", 0, "limits.max_sends_per_hour is negative", "")
+	}
+	if cfg.Limits.MaxForwardRecipients < 0 {
+		add(diagnostic.Error, "config.bad-value", 0, "limits.max_forward_recipients is negative", "")
+	}
+	switch cfg.Outbound.Strategy {
+	case "", "direct":
+	case "smarthost":
+		if cfg.Outbound.Smarthost == "" {
+			add(diagnostic.Error, "config.bad-value", 0,
+				"outbound.strategy is \"smarthost\" but outbound.smarthost is not set", "")
+		}
+	default:
+		add(diagnostic.Error, "config.bad-value", 0,
+			fmt.Sprintf("outbound.strategy %q is not \"direct\" or \"smarthost\"", cfg.Outbound.Strategy), "")
+	}
+
+	if m := cfg.MsgStore.Mailbox; m != "" && !slices.Contains(RegisteredMailboxMappers(), m) {
+		add(diagnostic.Error, "config.bad-value", 0,
+			fmt.Sprintf("msgstore.mailbox %q is not a mailbox strategy", m),
+			"strategies: "+strings.Join(RegisteredMailboxMappers(), ", "))
+	}
+
+	if err := cfg.Password.Validate(); err != nil {
+		add(diagnostic.Error, "config.bad-value", 0, "password: "+err.Error(), "")
+	}
+
+	registered := auth.RegisteredAuthAgents()
+	checkType := func(key, typ string) {
+		if typ != "" && !slices.Contains(registered, typ) {
+			add(diagnostic.Warning, "config.unknown-auth-type", 0,
+				fmt.Sprintf("%s %q is not registered in this program", key, typ),
+				"registered types: "+strings.Join(registered, ", "))
+		}
+	}
+	checkType("auth.type", cfg.Auth.Type)
+	for i, c := range cfg.Auth.Chain {
+		checkType(fmt.Sprintf("auth.chain[%d].type", i), c.Type)
+	}
+
+	return append(problems, forwards.CheckMap(path, cfg.Forwards)...)
+}
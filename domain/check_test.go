@@ -0,0 +1,94 @@
+package domain
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/infodancer/auth/diagnostic"
+)
+
+func TestCheckConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	content := `recipient_rejection = "later"
+max_mesage_size = 100
+
+[auth]
+type = "no-such-backend"
+
+[limits]
+max_forward_recipients = -1
+
+[outbound]
+strategy = "smarthost"
+
+[password]
+length = 4
+
+[forwards]
+sales = "nobody"
+`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := CheckConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"config.unknown-key",
+		"config.bad-value",
+		"config.bad-value",
+		"config.bad-value",
+		"config.bad-value",
+		"config.unknown-auth-type",
+		"forwards.bad-target",
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("problems = %v", problems)
+	}
+	for i, p := range problems {
+		if p.Code != want[i] {
+			t.Errorf("problem %d = %s, want %s", i, p.Code, want[i])
+		}
+		if p.File != path {
+			t.Errorf("%s: file = %q", p.Code, p.File)
+		}
+	}
+	if problems[0].Line != 2 || problems[0].Severity != diagnostic.Warning {
+		t.Errorf("unknown key = line %d, %v", problems[0].Line, problems[0].Severity)
+	}
+}
+
+func TestCheckConfig_Syntax(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte("gid = 1\n[auth\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := CheckConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].Code != "config.parse" || problems[0].Line != 2 {
+		t.Errorf("problems = %v", problems)
+	}
+	if !diagnostic.HasErrors(problems) {
+		t.Error("syntax error is not an error")
+	}
+}
+
+func TestCheckConfig_Clean(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.toml")
+	if err := os.WriteFile(path, []byte("recipient_rejection = \"data\"\n[forwards]\nsales = \"alice@example.com\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := CheckConfig(path)
+	if err != nil || len(problems) != 0 {
+		t.Errorf("CheckConfig = %v, %v", problems, err)
+	}
+	problems, err = CheckConfig(filepath.Join(dir, "missing.toml"))
+	if err != nil || problems != nil {
+		t.Errorf("CheckConfig(missing) = %v, %v", problems, err)
+	}
+}
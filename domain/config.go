@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/infodancer/auth/atrest"
+	"github.com/infodancer/auth/passwd"
 	"github.com/pelletier/go-toml/v2"
 )
 
@@ -11,11 +13,27 @@ import (
 // All fields use omitempty so that TOML-level deep merge correctly skips
 // zero values — only explicitly set fields override lower-priority layers.
 type DomainConfig struct {
-	Auth     DomainAuthConfig     `toml:"auth,omitempty"`
-	MsgStore DomainMsgStoreConfig `toml:"msgstore,omitempty"`
-	DKIM     DKIMConfig           `toml:"dkim,omitempty"`
-	Outbound OutboundConfig       `toml:"outbound,omitempty"`
-	Limits   LimitsConfig         `toml:"limits,omitempty"`
+	Auth      DomainAuthConfig     `toml:"auth,omitempty"`
+	MsgStore  DomainMsgStoreConfig `toml:"msgstore,omitempty"`
+	DKIM      DKIMConfig           `toml:"dkim,omitempty"`
+	Outbound  OutboundConfig       `toml:"outbound,omitempty"`
+	Limits    LimitsConfig         `toml:"limits,omitempty"`
+	Log       LogConfig            `toml:"log,omitempty"`
+	Roles     RolesConfig          `toml:"roles,omitempty"`
+	OAuth     OAuthConfig          `toml:"oauth,omitempty"`
+	GAL       GALConfig            `toml:"gal,omitempty"`
+	Normalize NormalizeConfig      `toml:"normalize,omitempty"`
+	Bounces   BouncesConfig        `toml:"bounces,omitempty"`
+
+	// Password is the policy for passwords generated for the domain's
+	// users, such as by userctl add --generate.
+	Password passwd.PasswordPolicy `toml:"password,omitempty"`
+
+	// LoginNotify sends users a notice of logins from new IP addresses.
+	LoginNotify LoginNotifyConfig `toml:"login_notify,omitempty"`
+
+	// Degraded serves cached answers while the auth backend is down.
+	Degraded DegradedConfig `toml:"degraded,omitempty"`
 
 	// Gid is the OS group ID under which mail-session runs for this domain.
 	// 0 means not configured.
@@ -30,11 +48,31 @@ type DomainConfig struct {
 	// "rcpt" = reject at RCPT TO (default); "data" = defer rejection to after DATA.
 	RecipientRejection string `toml:"recipient_rejection,omitempty"`
 
+	// RequireTLSAuth refuses logins over unencrypted connections with
+	// errors.ErrTLSRequired. Individual users can override it with
+	// require_tls in UserMetadata.
+	RequireTLSAuth bool `toml:"require_tls_auth,omitempty"`
+
+	// AcceptSubdomains makes the domain also serve addresses at any of its
+	// subdomains that are not served themselves, so user@host.example.com
+	// lands in user@example.com's mailbox (see ResolveDomain).
+	AcceptSubdomains bool `toml:"accept_subdomains,omitempty"`
+
+	// DeleteGraceDays keeps deleted users, marked deleted with their mail
+	// quarantined, for this many days before userctl reap purges them, so
+	// a deletion can be undone (see passwd.DeleteUser). 0 deletes at once.
+	DeleteGraceDays int `toml:"delete_grace_days,omitempty"`
+
 	// Forwards maps localpart to comma-separated forwarding targets.
 	// The special key "*" is a catchall. A nil map means "not set" and allows
 	// the system default forwards to apply. An empty non-nil map (forwards = {})
 	// explicitly disables forwarding for this domain.
 	Forwards map[string]string `toml:"forwards,omitempty"`
+
+	// Senders grants users additional MAIL FROM identities, keyed by
+	// localpart. Values are addresses or path.Match patterns such as
+	// "*@example.com" (see AuthRouter.MaySendAs).
+	Senders map[string][]string `toml:"senders,omitempty"`
 }
 
 // DomainAuthConfig holds authentication settings for a domain.
@@ -50,6 +88,31 @@ type DomainAuthConfig struct {
 
 	// Options contains backend-specific settings.
 	Options map[string]string `toml:"options,omitempty"`
+
+	// EscrowPubKey is the domain's recovery public key, base64-encoded
+	// (see passwd.ParseEscrowKey). When set, new user private keys are also
+	// sealed to it, so that the holder of the recovery private key, kept
+	// offline, can restore a mailbox after a forgotten password. Chain
+	// members without their own inherit it. Passed to the agent as
+	// Options["escrow_pubkey"].
+	EscrowPubKey string `toml:"escrow_pubkey,omitempty"`
+
+	// Chain, when set, replaces the single agent above with an ordered list
+	// consulted through auth.ChainAgent, e.g. a local passwd file before a
+	// directory server:
+	//
+	//	[[auth.chain]]
+	//	type = "passwd"
+	//	credential_backend = "passwd"
+	//
+	//	[[auth.chain]]
+	//	type = "http"
+	//	credential_backend = "https://sso.example.com/mail"
+	//
+	// Paths are relative to the domain directory. Members cannot themselves
+	// chain. A layer declaring chain replaces an inherited one as a whole;
+	// a layer setting type without chain drops it (see mergeConfigLayers).
+	Chain []DomainAuthConfig `toml:"chain,omitempty"`
 }
 
 // DomainMsgStoreConfig holds message storage settings for a domain.
@@ -60,6 +123,12 @@ type DomainMsgStoreConfig struct {
 	// BasePath is the base directory for storage (relative to domain dir).
 	BasePath string `toml:"base_path,omitempty"`
 
+	// Mailbox names the strategy mapping a user to the mailbox reported in
+	// their session: "address" (the default), "localpart", "uid", "hash",
+	// "backend" or one added with RegisterMailboxMapper. See MailboxAddress
+	// and the other built-in strategies.
+	Mailbox string `toml:"mailbox,omitempty"`
+
 	// Options contains backend-specific settings.
 	Options map[string]string `toml:"options,omitempty"`
 }
@@ -98,6 +167,11 @@ type LimitsConfig struct {
 	// MaxSendsPerHour is the maximum messages an authenticated sender on this
 	// domain may send per hour. 0 means use the global default.
 	MaxSendsPerHour int `toml:"max_sends_per_hour,omitempty"`
+
+	// MaxForwardRecipients caps how many final recipients one message to
+	// this domain may expand to through forwards. 0 means
+	// DefaultMaxForwardRecipients.
+	MaxForwardRecipients int `toml:"max_forward_recipients,omitempty"`
 }
 
 // DomainsConfig holds per-domain configuration overrides from domains.toml.
@@ -109,13 +183,18 @@ type DomainsConfig map[string]DomainConfig
 // LoadDomainsConfig reads and parses a domains.toml file.
 // A missing file is not an error — returns an empty DomainsConfig.
 func LoadDomainsConfig(path string) (DomainsConfig, error) {
-	data, err := os.ReadFile(path)
+	data, err := atrest.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return make(DomainsConfig), nil
 		}
 		return nil, fmt.Errorf("read domains config: %w", err)
 	}
+	return parseDomainsConfig(data)
+}
+
+// parseDomainsConfig parses the contents of a domains.toml file.
+func parseDomainsConfig(data []byte) (DomainsConfig, error) {
 	var cfg DomainsConfig
 	if err := toml.Unmarshal(data, &cfg); err != nil {
 		return nil, fmt.Errorf("parse domains config: %w", err)
@@ -125,11 +204,15 @@ func LoadDomainsConfig(path string) (DomainsConfig, error) {
 
 // LoadDomainConfig reads and parses a domain configuration file.
 func LoadDomainConfig(path string) (*DomainConfig, error) {
-	data, err := os.ReadFile(path)
+	data, err := atrest.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("read config: %w", err)
 	}
+	return parseDomainConfig(data)
+}
 
+// parseDomainConfig parses the contents of a domain configuration file.
+func parseDomainConfig(data []byte) (*DomainConfig, error) {
 	var cfg DomainConfig
 	if err := toml.Unmarshal(data, &cfg); err != nil {
 		return nil, fmt.Errorf("parse config: %w", err)
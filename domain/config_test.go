@@ -4,6 +4,8 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+
+	"github.com/infodancer/auth/passwd"
 )
 
 func TestDomainConfig_GidTOML(t *testing.T) {
@@ -85,3 +87,25 @@ max_sends_per_hour = 50
 		t.Errorf("expected MaxSendsPerHour 50, got %d", cfg.Limits.MaxSendsPerHour)
 	}
 }
+
+func TestDomainConfig_PasswordPolicy(t *testing.T) {
+	p, base := newTestDomainsTree(t, "", "example.com")
+	content := `
+[password]
+length = 32
+min_symbols = 4
+exclude_similar = true
+`
+	if err := os.WriteFile(filepath.Join(base, "example.com", "config.toml"), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := p.GetDomain("example.com")
+	if d == nil {
+		t.Fatal("GetDomain returned nil")
+	}
+	want := passwd.PasswordPolicy{Length: 32, MinSymbols: 4, ExcludeSimilar: true}
+	if d.PasswordPolicy != want {
+		t.Errorf("PasswordPolicy = %+v, want %+v", d.PasswordPolicy, want)
+	}
+}
@@ -0,0 +1,164 @@
+package domain
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/atrest"
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/passwd"
+	"github.com/infodancer/auth/sasl/crammd5"
+)
+
+// credsMockAgent is a mockAuthAgent that also verifies Credentials.
+type credsMockAgent struct {
+	mockAuthAgent
+	got auth.Credentials
+}
+
+func (m *credsMockAgent) AuthenticateCredentials(_ context.Context, creds auth.Credentials) (*auth.AuthSession, error) {
+	m.got = creds
+	return &auth.AuthSession{User: &auth.User{Username: creds.Username}}, nil
+}
+
+func (m *credsMockAgent) Capabilities() auth.AgentCapabilities {
+	return auth.AgentCapabilities{Credentials: true}
+}
+
+func TestAuthRouter_AuthenticateCredentials(t *testing.T) {
+	hash, err := passwd.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := newTestDomainsTree(t, "alice:"+hash+":alice\n", "example.com")
+	r := NewAuthRouter(p, nil).WithRateLimit(RateLimitConfig{MaxFailuresPerUser: 1, Window: time.Minute, Lockout: time.Minute})
+	defer func() { _ = r.Close() }()
+	ctx := context.Background()
+
+	result, err := r.AuthenticateCredentials(ctx, auth.Credentials{
+		Username: "alice@example.com", AuthzID: "alice@example.com", Mechanism: "PLAIN", Password: "secret",
+	})
+	if err != nil {
+		t.Fatalf("PLAIN login: %v", err)
+	}
+	if result.Domain == nil || result.Domain.Name != "example.com" {
+		t.Errorf("domain = %+v", result.Domain)
+	}
+
+	// Refused mechanisms and identities do not count against the limit.
+	for range 3 {
+		_, err = r.AuthenticateCredentials(ctx, auth.Credentials{
+			Username: "alice@example.com", Mechanism: "CRAM-MD5", Response: []byte("alice 0123"),
+		})
+		if !errors.Is(err, autherrors.ErrMechanismUnsupported) {
+			t.Errorf("CRAM-MD5 on passwd: got %v, want ErrMechanismUnsupported", err)
+		}
+		_, err = r.AuthenticateCredentials(ctx, auth.Credentials{
+			Username: "alice@example.com", AuthzID: "bob@example.com", Password: "secret",
+		})
+		if !errors.Is(err, autherrors.ErrAuthorizationDenied) {
+			t.Errorf("authzid bob: got %v, want ErrAuthorizationDenied", err)
+		}
+	}
+	if _, err := r.Authenticate(ctx, "alice@example.com", "secret"); err != nil {
+		t.Errorf("login after refusals: %v", err)
+	}
+}
+
+func TestAuthRouter_AccountDisabled(t *testing.T) {
+	hash, err := passwd.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := newTestDomainsTree(t, "alice:"+hash+":alice::locked\n", "example.com")
+	r := NewAuthRouter(p, nil).WithRateLimit(RateLimitConfig{MaxFailuresPerUser: 1, Window: time.Minute, Lockout: time.Minute})
+	defer func() { _ = r.Close() }()
+	ctx := context.Background()
+
+	// A locked account given the right password does not count against
+	// the limit, so it keeps getting the distinct error.
+	for range 3 {
+		if _, err := r.Authenticate(ctx, "alice@example.com", "secret"); !errors.Is(err, autherrors.ErrAccountDisabled) {
+			t.Fatalf("locked login: got %v, want ErrAccountDisabled", err)
+		}
+	}
+	if _, err := r.Authenticate(ctx, "alice@example.com", "wrong"); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("wrong password: got %v, want ErrAuthFailed", err)
+	}
+}
+
+func TestAuthRouter_AuthenticateCredentialsAgent(t *testing.T) {
+	agent := &credsMockAgent{}
+	provider := &mockDomainProvider{domains: map[string]*Domain{
+		"example.com": {Name: "example.com", AuthAgent: agent},
+	}}
+	r := NewAuthRouter(provider, nil)
+
+	binding := &auth.ChannelBinding{Type: "tls-exporter", Data: []byte{1, 2, 3}}
+	result, err := r.AuthenticateCredentials(context.Background(), auth.Credentials{
+		Username: "alice+tag@example.com", Mechanism: "SCRAM-SHA-256-PLUS", Response: []byte("proof"), ChannelBinding: binding,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agent.got.Username != "alice" || agent.got.ChannelBinding != binding || string(agent.got.Response) != "proof" {
+		t.Errorf("agent received %+v", agent.got)
+	}
+	if result.Extension != "tag" {
+		t.Errorf("extension = %q, want tag", result.Extension)
+	}
+}
+
+func TestAuthRouter_CRAMMD5(t *testing.T) {
+	hash, err := passwd.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, base := newTestDomainsTree(t, "alice:"+hash+":alice\n", "a.com", "b.com")
+	key, err := atrest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "reversible.key")
+	if err := atrest.WriteKey(keyPath, key); err != nil {
+		t.Fatal(err)
+	}
+	// Only a.com opts in.
+	writeDomainConfig(t, base, "a.com", "[auth.options]\nreversible_key = \""+keyPath+"\"\n")
+	for _, d := range []string{"a.com", "b.com"} {
+		if err := passwd.SetReversiblePassword(filepath.Join(base, d, "passwd"), "alice", "secret", key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := NewAuthRouter(p, nil)
+	defer func() { _ = r.Close() }()
+	ctx := context.Background()
+
+	login := func(username string) error {
+		challenge, err := crammd5.NewChallenge("mail.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := hmac.New(md5.New, []byte("secret"))
+		m.Write(challenge)
+		creds, err := crammd5.Credentials(challenge, []byte(username+" "+hex.EncodeToString(m.Sum(nil))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = r.AuthenticateCredentials(ctx, creds)
+		return err
+	}
+	if err := login("alice@a.com"); err != nil {
+		t.Errorf("CRAM-MD5 on a.com: %v", err)
+	}
+	if err := login("alice@b.com"); !errors.Is(err, autherrors.ErrMechanismUnsupported) {
+		t.Errorf("CRAM-MD5 on b.com: got %v, want ErrMechanismUnsupported", err)
+	}
+}
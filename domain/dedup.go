@@ -0,0 +1,264 @@
+package domain
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/infodancer/auth/vfs"
+)
+
+// deliveryIDKeyType is the context key type for the delivery idempotency key.
+type deliveryIDKeyType struct{}
+
+// DeliveryIDKey is the context key used to pass an envelope ID to
+// MailDeliveryAgent for deduplication. Use WithDeliveryID to set it.
+var DeliveryIDKey = deliveryIDKeyType{}
+
+// WithDeliveryID returns a context carrying an idempotency key for the
+// message being delivered (e.g., the smtpd queue ID or an ENVID). When a
+// retried Deliver call carries the same key, recipients already delivered
+// within the dedup window are skipped.
+func WithDeliveryID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, DeliveryIDKey, id)
+}
+
+// deliveryIDFromContext extracts the delivery ID from the context.
+// Returns empty string if not set.
+func deliveryIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(DeliveryIDKey).(string)
+	return id
+}
+
+// DefaultDedupWindow is the dedup window used when WithDeliveryDedup is
+// called with a zero duration.
+const DefaultDedupWindow = 24 * time.Hour
+
+// dedupCompactBytes is the dedup file size past which it is compacted.
+const dedupCompactBytes = 1 << 20
+
+// dedupStore remembers (delivery ID, recipient) pairs for a sliding window.
+// Entries are persisted as "unixnano<TAB>key" lines appended to a file so the
+// window survives process restarts (mail-deliver is typically a oneshot).
+// The file is loaded lazily. Expired entries are pruned on load and, for a
+// long-running process, by record once a window has passed since the last
+// prune; the file is compacted when pruning dropped entries or it has grown
+// past its size threshold, dedupCompactBytes to begin with.
+type dedupStore struct {
+	mu     sync.Mutex
+	fsys   vfs.WriteFS
+	path   string
+	window time.Duration
+	now    func() time.Time // for testing
+	seen   map[string]time.Time
+	loaded bool
+	pruned time.Time // last prune
+	bytes  int64     // dedup file size
+	limit  int64     // file size that triggers compaction
+}
+
+func newDedupStore(fsys vfs.WriteFS, path string, window time.Duration) *dedupStore {
+	if window <= 0 {
+		window = DefaultDedupWindow
+	}
+	return &dedupStore{
+		fsys:   fsys,
+		path:   path,
+		window: window,
+		now:    time.Now,
+		seen:   make(map[string]time.Time),
+		limit:  dedupCompactBytes,
+	}
+}
+
+// dedupKey builds the store key for a delivery ID and recipient. Returns
+// empty string if the ID is empty or contains characters that would corrupt
+// the line-oriented file format.
+func dedupKey(id, recipient string) string {
+	if id == "" || strings.ContainsAny(id, "\t\r\n") {
+		return ""
+	}
+	return id + "\x00" + strings.ToLower(recipient)
+}
+
+// delivered reports whether key was recorded within the window.
+func (s *dedupStore) delivered(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return false, err
+	}
+	t, ok := s.seen[key]
+	return ok && s.now().Sub(t) < s.window, nil
+}
+
+// record marks key as delivered now and appends it to the dedup file,
+// pruning and compacting it as needed. The append holds the filesystem's
+// lock on the file (see vfs.Lock), as compaction does, so a compaction in
+// another process never replaces the file under the append.
+func (s *dedupStore) record(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+	now := s.now()
+	s.seen[key] = now
+
+	line := fmt.Sprintf("%d\t%s\n", now.UnixNano(), key)
+	if err := s.append(line); err != nil {
+		return err
+	}
+	s.bytes += int64(len(line))
+
+	expired := 0
+	if now.Sub(s.pruned) >= s.window {
+		expired = s.prune(now)
+	}
+	if expired > 0 || s.bytes > s.limit {
+		return s.compact()
+	}
+	return nil
+}
+
+// append appends line to the dedup file under its lock.
+func (s *dedupStore) append(line string) error {
+	unlock, err := vfs.Lock(s.fsys, s.path)
+	if err != nil {
+		return fmt.Errorf("lock dedup file: %w", err)
+	}
+	defer unlock()
+	if err := s.fsys.AppendFile(s.path, []byte(line), 0o600); err != nil {
+		return fmt.Errorf("write dedup file: %w", err)
+	}
+	return nil
+}
+
+// size estimates the heap bytes held by the in-memory window.
+func (s *dedupStore) size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+	for key := range s.seen {
+		n += int64(len(key)) + 48 // key bytes + time.Time + map bucket share
+	}
+	return n
+}
+
+// load reads the dedup file on first use, dropping expired entries.
+// Caller must hold s.mu.
+func (s *dedupStore) load() error {
+	if s.loaded {
+		return nil
+	}
+
+	now := s.now()
+	size, expired, err := s.read(now)
+	if err != nil {
+		return err
+	}
+	s.bytes = size
+	s.loaded, s.pruned = true, now
+	if expired > 0 || s.bytes > s.limit {
+		return s.compact()
+	}
+	return nil
+}
+
+// read adds the live entries of the dedup file to s.seen, and returns the
+// file's size and how many expired entries it holds. A missing file is
+// empty. Caller must hold s.mu.
+func (s *dedupStore) read(now time.Time) (size int64, expired int, err error) {
+	f, err := s.fsys.Open(s.path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, 0, nil
+		}
+		return 0, 0, fmt.Errorf("open dedup file: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	cutoff := now.Add(-s.window)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		size += int64(len(scanner.Bytes())) + 1
+		ts, key, ok := strings.Cut(scanner.Text(), "\t")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			continue
+		}
+		t := time.Unix(0, n)
+		if t.Before(cutoff) {
+			expired++
+			continue
+		}
+		if t.After(s.seen[key]) {
+			s.seen[key] = t
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, fmt.Errorf("read dedup file: %w", err)
+	}
+	return size, expired, nil
+}
+
+// prune drops the entries that expired by now and returns how many it
+// dropped. Caller must hold s.mu.
+func (s *dedupStore) prune(now time.Time) int {
+	cutoff := now.Add(-s.window)
+	n := 0
+	for key, t := range s.seen {
+		if t.Before(cutoff) {
+			delete(s.seen, key)
+			n++
+		}
+	}
+	s.pruned = now
+	return n
+}
+
+// compact rewrites the dedup file with only the live entries, and raises
+// the compaction threshold if they alone fill more than half of it, so a
+// large live window is not rewritten on every record. It holds the file's
+// lock and reads the file again first, so entries other processes
+// appended since it was loaded are kept. Caller must hold s.mu.
+func (s *dedupStore) compact() error {
+	unlock, err := vfs.Lock(s.fsys, s.path)
+	if err != nil {
+		return fmt.Errorf("lock dedup file: %w", err)
+	}
+	defer unlock()
+	if _, _, err := s.read(s.now()); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	for key, t := range s.seen {
+		fmt.Fprintf(&buf, "%d\t%s\n", t.UnixNano(), key)
+	}
+	tmpPath := s.path + ".tmp"
+	if err := s.fsys.WriteFile(tmpPath, buf.Bytes(), 0o600); err != nil {
+		_ = s.fsys.Remove(tmpPath)
+		return fmt.Errorf("write temp dedup file: %w", err)
+	}
+	if err := s.fsys.Rename(tmpPath, s.path); err != nil {
+		_ = s.fsys.Remove(tmpPath)
+		return fmt.Errorf("replace dedup file: %w", err)
+	}
+	s.bytes = int64(buf.Len())
+	s.limit = max(s.limit, 2*s.bytes)
+	return nil
+}
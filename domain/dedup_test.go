@@ -0,0 +1,244 @@
+package domain
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/infodancer/auth/forwards"
+	"github.com/infodancer/auth/vfs"
+	"github.com/infodancer/msgstore"
+)
+
+func TestWithDeliveryID(t *testing.T) {
+	ctx := WithDeliveryID(context.Background(), "abc123")
+	if got := deliveryIDFromContext(ctx); got != "abc123" {
+		t.Errorf("expected abc123, got %q", got)
+	}
+	if got := deliveryIDFromContext(context.Background()); got != "" {
+		t.Errorf("expected empty ID, got %q", got)
+	}
+}
+
+func TestDedupKey_RejectsUnsafeIDs(t *testing.T) {
+	if dedupKey("", "a@b.com") != "" {
+		t.Error("expected empty key for empty ID")
+	}
+	if dedupKey("bad\nid", "a@b.com") != "" {
+		t.Error("expected empty key for ID containing newline")
+	}
+	if dedupKey("id", "A@B.com") != dedupKey("id", "a@b.com") {
+		t.Error("expected recipient to be case-insensitive")
+	}
+}
+
+func TestDedupStore_PersistsAcrossInstances(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".delivery_dedup")
+
+	s1 := newDedupStore(vfs.OS{}, path, time.Hour)
+	if err := s1.record("k1"); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+
+	s2 := newDedupStore(vfs.OS{}, path, time.Hour)
+	done, err := s2.delivered("k1")
+	if err != nil || !done {
+		t.Errorf("expected k1 delivered after reload: done=%v err=%v", done, err)
+	}
+	done, err = s2.delivered("k2")
+	if err != nil || done {
+		t.Errorf("expected k2 not delivered: done=%v err=%v", done, err)
+	}
+}
+
+func TestDedupStore_WindowExpiryCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".delivery_dedup")
+	now := time.Now()
+
+	s1 := newDedupStore(vfs.OS{}, path, time.Hour)
+	s1.now = func() time.Time { return now }
+	if err := s1.record("old"); err != nil {
+		t.Fatal(err)
+	}
+
+	s2 := newDedupStore(vfs.OS{}, path, time.Hour)
+	s2.now = func() time.Time { return now.Add(2 * time.Hour) }
+	done, err := s2.delivered("old")
+	if err != nil || done {
+		t.Errorf("expected expired entry to be forgotten: done=%v err=%v", done, err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "old") {
+		t.Error("expected expired entry to be compacted out of the file")
+	}
+}
+
+func TestDedupStore_RecordPrunesAndCompacts(t *testing.T) {
+	mem := vfs.NewMemFS()
+	if err := mem.MkdirAll("/data", 0o750); err != nil {
+		t.Fatal(err)
+	}
+	path := "/data/.delivery_dedup"
+	now := time.Now()
+
+	// A long-running store drops expired entries once a window has passed.
+	s := newDedupStore(mem, path, time.Hour)
+	s.now = func() time.Time { return now }
+	if err := s.record("old"); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * time.Hour)
+	if err := s.record("new"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.seen["old"]; ok {
+		t.Error("expected expired entry to be pruned from memory")
+	}
+	data, err := mem.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "old") || !strings.Contains(string(data), "new") {
+		t.Errorf("dedup file after prune = %q", data)
+	}
+
+	// Past the size threshold, re-recorded keys are compacted away.
+	s.limit = 64
+	for range 10 {
+		if err := s.record("new"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if data, err = mem.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\n"); n > 3 {
+		t.Errorf("dedup file has %d lines after compaction, want at most 3", n)
+	}
+	if done, err := s.delivered("new"); err != nil || !done {
+		t.Errorf("delivered(new) = %v, %v", done, err)
+	}
+}
+
+func TestDedupStore_CompactKeepsOtherWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".delivery_dedup")
+
+	// Two stores on one file stand for two mail-deliver processes.
+	s1 := newDedupStore(vfs.OS{}, path, time.Hour)
+	if err := s1.record("k1"); err != nil {
+		t.Fatal(err)
+	}
+	s2 := newDedupStore(vfs.OS{}, path, time.Hour)
+	if err := s2.record("k2"); err != nil {
+		t.Fatal(err)
+	}
+	// s1 loaded before k2 was written; its compaction must keep k2.
+	s1.limit = 1
+	if err := s1.record("k3"); err != nil {
+		t.Fatal(err)
+	}
+
+	s3 := newDedupStore(vfs.OS{}, path, time.Hour)
+	for _, key := range []string{"k1", "k2", "k3"} {
+		if done, err := s3.delivered(key); err != nil || !done {
+			t.Errorf("delivered(%s) after compaction = %v, %v", key, done, err)
+		}
+	}
+}
+
+func TestMailDeliveryAgent_DedupRecordFailure(t *testing.T) {
+	mem := vfs.NewMemFS()
+	if err := mem.MkdirAll("/data", 0o750); err != nil {
+		t.Fatal(err)
+	}
+	inner := &stubDeliveryAgent{}
+	agent := &MailDeliveryAgent{
+		inner: inner,
+		chain: &forwardChain{
+			domainForwards:  forwards.FromMap(nil),
+			defaultForwards: forwards.FromMap(nil),
+		},
+		provider: &stubDomainProvider{domains: map[string]*Domain{}},
+		dedup:    newDedupStore(vfs.ReadOnly(mem), "/data/.delivery_dedup", time.Hour),
+	}
+
+	// The message was delivered, so an unwritable dedup file must not
+	// fail the delivery and have it retried.
+	ctx := WithDeliveryID(context.Background(), "queue-1")
+	env := msgstore.Envelope{Recipients: []string{"alice@this.com"}}
+	if err := agent.Deliver(ctx, env, bytes.NewReader([]byte("test"))); err != nil {
+		t.Fatalf("Deliver with unwritable dedup file: %v", err)
+	}
+	if len(inner.delivered) != 1 {
+		t.Errorf("expected 1 delivery, got %d", len(inner.delivered))
+	}
+}
+
+func TestMailDeliveryAgent_DedupSkipsRetriedTargets(t *testing.T) {
+	dir := t.TempDir()
+	targetInner := &stubDeliveryAgent{}
+	provider := &stubDomainProvider{domains: map[string]*Domain{
+		"other.com": {Name: "other.com", DeliveryAgent: targetInner},
+	}}
+	inner := &stubDeliveryAgent{}
+	agent := &MailDeliveryAgent{
+		inner: inner,
+		chain: &forwardChain{
+			domainForwards:  forwards.FromMap(map[string]string{"list": "a@other.com,b@other.com"}),
+			defaultForwards: forwards.FromMap(nil),
+		},
+		provider: provider,
+		dedup:    newDedupStore(vfs.OS{}, filepath.Join(dir, ".delivery_dedup"), time.Hour),
+	}
+
+	ctx := WithDeliveryID(context.Background(), "queue-1")
+	env := msgstore.Envelope{Recipients: []string{"list@this.com"}}
+	for i := 0; i < 2; i++ {
+		if err := agent.Deliver(ctx, env, bytes.NewReader([]byte("test"))); err != nil {
+			t.Fatalf("deliver %d: %v", i, err)
+		}
+	}
+	if len(targetInner.delivered) != 2 {
+		t.Errorf("expected 2 forwarded deliveries across retries, got %d", len(targetInner.delivered))
+	}
+
+	// A different delivery ID is a new message.
+	ctx = WithDeliveryID(context.Background(), "queue-2")
+	if err := agent.Deliver(ctx, env, bytes.NewReader([]byte("test"))); err != nil {
+		t.Fatal(err)
+	}
+	if len(targetInner.delivered) != 4 {
+		t.Errorf("expected 4 forwarded deliveries, got %d", len(targetInner.delivered))
+	}
+}
+
+func TestMailDeliveryAgent_NoDeliveryIDNoDedup(t *testing.T) {
+	inner := &stubDeliveryAgent{}
+	agent := &MailDeliveryAgent{
+		inner: inner,
+		chain: &forwardChain{
+			domainForwards:  forwards.FromMap(nil),
+			defaultForwards: forwards.FromMap(nil),
+		},
+		provider: &stubDomainProvider{domains: map[string]*Domain{}},
+		dedup:    newDedupStore(vfs.OS{}, filepath.Join(t.TempDir(), ".delivery_dedup"), time.Hour),
+	}
+
+	env := msgstore.Envelope{Recipients: []string{"alice@this.com"}}
+	for i := 0; i < 2; i++ {
+		if err := agent.Deliver(context.Background(), env, bytes.NewReader([]byte("test"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(inner.delivered) != 2 {
+		t.Errorf("expected 2 local deliveries without a delivery ID, got %d", len(inner.delivered))
+	}
+}
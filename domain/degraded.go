@@ -0,0 +1,153 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// DefaultDegradedCacheTTL is how long a UserExists answer is served while
+// the backend is down when DegradedConfig sets no cache_ttl.
+const DefaultDegradedCacheTTL = 24 * time.Hour
+
+// DefaultDegradedCacheEntries caps how many UserExists answers a domain
+// remembers when DegradedConfig sets no max_entries.
+const DefaultDegradedCacheEntries = 100000
+
+// DegradedConfig controls how a domain behaves while its auth backend
+// (e.g., LDAP or SQL) cannot be reached:
+//
+//	[degraded]
+//	enabled = true
+//	cache_ttl = "12h"
+//
+// When enabled, UserExists answers are remembered while the backend
+// works and served from memory while it is down, so mail for known users
+// keeps arriving, and logins fail with errors.ErrBackendUnavailable, a
+// temporary failure, rather than with the backend's own error. Without it
+// every backend failure is returned as is.
+type DegradedConfig struct {
+	// Enabled turns degradation mode on for the domain.
+	Enabled bool `toml:"enabled,omitempty"`
+
+	// CacheTTL is how old a remembered UserExists answer may be and
+	// still be served, as a Go duration such as "12h". Empty means
+	// DefaultDegradedCacheTTL.
+	CacheTTL string `toml:"cache_ttl,omitempty"`
+
+	// MaxEntries caps how many answers are remembered. 0 means
+	// DefaultDegradedCacheEntries.
+	MaxEntries int `toml:"max_entries,omitempty"`
+}
+
+// cache returns the answer cache for c, or nil if degradation mode is off.
+func (c DegradedConfig) cache() (*degradedCache, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+	ttl := DefaultDegradedCacheTTL
+	if c.CacheTTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(c.CacheTTL); err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("degraded: invalid cache_ttl %q", c.CacheTTL)
+		}
+	}
+	limit := c.MaxEntries
+	if limit <= 0 {
+		limit = DefaultDegradedCacheEntries
+	}
+	return &degradedCache{ttl: ttl, limit: limit, now: time.Now, users: make(map[string]degradedEntry)}, nil
+}
+
+// degradedCache remembers UserExists answers for serving while the
+// backend is down. Safe for concurrent use.
+type degradedCache struct {
+	ttl   time.Duration
+	limit int
+	now   func() time.Time // for testing
+
+	mu    sync.Mutex
+	users map[string]degradedEntry
+}
+
+// degradedEntry is a remembered UserExists answer.
+type degradedEntry struct {
+	exists bool
+	at     time.Time
+}
+
+// backendDown reports whether err is a failure to reach the backend rather
+// than an answer from it, such as a wrong password or an unknown user.
+func backendDown(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, answer := range []error{
+		autherrors.ErrAuthFailed,
+		autherrors.ErrUserNotFound,
+		autherrors.ErrAccountDisabled,
+		autherrors.ErrMechanismUnsupported,
+		autherrors.ErrAuthorizationDenied,
+		autherrors.ErrMFARequired,
+		autherrors.ErrKeyNotFound,
+		autherrors.ErrEncryptionNotEnabled,
+		autherrors.ErrBackendUnavailable,
+	} {
+		if errors.Is(err, answer) {
+			return false
+		}
+	}
+	return true
+}
+
+// unavailable returns err as errors.ErrBackendUnavailable if it is a
+// backend failure and c is enabled; otherwise err as is.
+func (c *degradedCache) unavailable(err error) error {
+	if c == nil || !backendDown(err) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", autherrors.ErrBackendUnavailable, err)
+}
+
+// userExists returns the backend's answer for username, remembering it,
+// or if the backend failed with err a remembered answer younger than the
+// TTL. Without one it fails with errors.ErrBackendUnavailable.
+func (c *degradedCache) userExists(username string, exists bool, err error) (bool, error) {
+	if c == nil {
+		return exists, err
+	}
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		c.store(username, degradedEntry{exists: exists, at: now})
+		return exists, nil
+	}
+	if !backendDown(err) {
+		return exists, err
+	}
+	if e, ok := c.users[username]; ok && now.Sub(e.at) < c.ttl {
+		return e.exists, nil
+	}
+	return false, fmt.Errorf("%w: %w", autherrors.ErrBackendUnavailable, err)
+}
+
+// store remembers e for username. A full cache first drops expired
+// answers; if none have expired, new users are not remembered. Callers
+// hold c.mu.
+func (c *degradedCache) store(username string, e degradedEntry) {
+	if _, ok := c.users[username]; !ok && len(c.users) >= c.limit {
+		for u, old := range c.users {
+			if e.at.Sub(old.at) >= c.ttl {
+				delete(c.users, u)
+			}
+		}
+		if len(c.users) >= c.limit {
+			return
+		}
+	}
+	c.users[username] = e
+}
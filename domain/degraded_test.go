@@ -0,0 +1,175 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+var errConnRefused = errors.New("dial tcp 10.0.0.5:389: connection refused")
+
+// flakyAgent is a backend knowing alice (password "secret") that fails
+// every call with errConnRefused while down is set.
+func flakyAgent(down *atomic.Bool) *mockAuthAgent {
+	return &mockAuthAgent{
+		authenticateFn: func(_ context.Context, username, password string) (*auth.AuthSession, error) {
+			if down.Load() {
+				return nil, errConnRefused
+			}
+			if username != "alice" || password != "secret" {
+				return nil, autherrors.ErrAuthFailed
+			}
+			return &auth.AuthSession{User: &auth.User{Username: username}}, nil
+		},
+		userExistsFn: func(_ context.Context, username string) (bool, error) {
+			if down.Load() {
+				return false, errConnRefused
+			}
+			return username == "alice", nil
+		},
+	}
+}
+
+// openedLazyAgent returns a lazyAuthAgent already holding agent.
+func openedLazyAgent(agent auth.AuthenticationAgent, degraded *degradedCache) *lazyAuthAgent {
+	l := &lazyAuthAgent{degraded: degraded}
+	l.once.Do(func() { l.agent = agent })
+	return l
+}
+
+func TestDegradedConfig_Cache(t *testing.T) {
+	if c, err := (DegradedConfig{}).cache(); c != nil || err != nil {
+		t.Errorf("disabled: cache = %v, %v; want nil", c, err)
+	}
+	c, err := DegradedConfig{Enabled: true}.cache()
+	if err != nil || c.ttl != DefaultDegradedCacheTTL || c.limit != DefaultDegradedCacheEntries {
+		t.Errorf("defaults: cache = %+v, %v", c, err)
+	}
+	if c, err := (DegradedConfig{Enabled: true, CacheTTL: "90m", MaxEntries: 5}).cache(); err != nil || c.ttl != 90*time.Minute || c.limit != 5 {
+		t.Errorf("cache = %+v, %v", c, err)
+	}
+	for _, ttl := range []string{"forever", "-1h", "0s"} {
+		if _, err := (DegradedConfig{Enabled: true, CacheTTL: ttl}).cache(); err == nil {
+			t.Errorf("cache_ttl %q accepted", ttl)
+		}
+	}
+}
+
+func TestDegraded_UserExists(t *testing.T) {
+	ctx := context.Background()
+	var down atomic.Bool
+	c, _ := DegradedConfig{Enabled: true, CacheTTL: "1h"}.cache()
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	l := openedLazyAgent(flakyAgent(&down), c)
+
+	for _, u := range []string{"alice", "bob"} {
+		if _, err := l.UserExists(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	down.Store(true)
+
+	if exists, err := l.UserExists(ctx, "alice"); err != nil || !exists {
+		t.Errorf("alice while down = %v, %v; want cached true", exists, err)
+	}
+	if exists, err := l.UserExists(ctx, "bob"); err != nil || exists {
+		t.Errorf("bob while down = %v, %v; want cached false", exists, err)
+	}
+	_, err := l.UserExists(ctx, "carol")
+	if !errors.Is(err, autherrors.ErrBackendUnavailable) || !errors.Is(err, errConnRefused) {
+		t.Errorf("unseen user while down: err = %v, want ErrBackendUnavailable wrapping the cause", err)
+	}
+
+	now = now.Add(time.Hour)
+	if _, err := l.UserExists(ctx, "alice"); !errors.Is(err, autherrors.ErrBackendUnavailable) {
+		t.Errorf("expired answer: err = %v, want ErrBackendUnavailable", err)
+	}
+}
+
+func TestDegraded_Authenticate(t *testing.T) {
+	ctx := context.Background()
+	var down atomic.Bool
+	c, _ := DegradedConfig{Enabled: true}.cache()
+	l := openedLazyAgent(flakyAgent(&down), c)
+
+	if _, err := l.Authenticate(ctx, "alice", "wrong"); !errors.Is(err, autherrors.ErrAuthFailed) || errors.Is(err, autherrors.ErrBackendUnavailable) {
+		t.Errorf("wrong password: err = %v, want plain ErrAuthFailed", err)
+	}
+	down.Store(true)
+	if _, err := l.Authenticate(ctx, "alice", "secret"); !errors.Is(err, autherrors.ErrBackendUnavailable) {
+		t.Errorf("while down: err = %v, want ErrBackendUnavailable", err)
+	}
+	if _, err := l.AuthenticateCredentials(ctx, auth.Credentials{Username: "alice", Password: "secret"}); !errors.Is(err, autherrors.ErrBackendUnavailable) {
+		t.Errorf("credentials while down: err = %v, want ErrBackendUnavailable", err)
+	}
+
+	// Without degradation mode the backend's error is returned as is.
+	plain := openedLazyAgent(flakyAgent(&down), nil)
+	if _, err := plain.Authenticate(ctx, "alice", "secret"); errors.Is(err, autherrors.ErrBackendUnavailable) || !errors.Is(err, errConnRefused) {
+		t.Errorf("disabled: err = %v, want the backend's error", err)
+	}
+	if _, err := plain.UserExists(ctx, "alice"); !errors.Is(err, errConnRefused) {
+		t.Errorf("disabled UserExists: err = %v", err)
+	}
+}
+
+func TestDegradedCache_Limit(t *testing.T) {
+	c, _ := DegradedConfig{Enabled: true, CacheTTL: "1h", MaxEntries: 2}.cache()
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	for _, u := range []string{"a", "b", "c"} {
+		_, _ = c.userExists(u, true, nil)
+	}
+	if _, ok := c.users["c"]; ok || len(c.users) != 2 {
+		t.Errorf("full cache took a new user: %v", c.users)
+	}
+
+	// Expired answers make room.
+	now = now.Add(time.Hour)
+	_, _ = c.userExists("c", true, nil)
+	if _, ok := c.users["c"]; !ok || len(c.users) != 1 {
+		t.Errorf("after expiry: %v", c.users)
+	}
+}
+
+func TestAuthRouter_BackendUnavailable(t *testing.T) {
+	var down atomic.Bool
+	agent := flakyAgent(&down)
+	auth.RegisterAuthAgent("degraded-test", func(auth.AuthAgentConfig) (auth.AuthenticationAgent, error) { return agent, nil })
+
+	p, base := newTestDomainsTree(t, "", "a.com")
+	writeDomainConfig(t, base, "a.com", "[auth]\ntype = \"degraded-test\"\n\n[degraded]\nenabled = true\n")
+	r := NewAuthRouter(p, nil).WithRateLimit(RateLimitConfig{MaxFailuresPerUser: 1, Window: time.Minute, Lockout: time.Minute})
+	defer func() { _ = r.Close() }()
+	ctx := context.Background()
+
+	d := p.GetDomain("a.com")
+	if d == nil {
+		t.Fatal("a.com did not load")
+	}
+	if exists, err := d.AuthAgent.UserExists(ctx, "alice"); err != nil || !exists {
+		t.Fatalf("UserExists = %v, %v", exists, err)
+	}
+
+	down.Store(true)
+	if exists, err := d.AuthAgent.UserExists(ctx, "alice"); err != nil || !exists {
+		t.Errorf("UserExists while down = %v, %v; want cached true", exists, err)
+	}
+	for range 3 {
+		if _, err := r.Authenticate(ctx, "alice@a.com", "secret"); !errors.Is(err, autherrors.ErrBackendUnavailable) {
+			t.Fatalf("login while down: err = %v, want ErrBackendUnavailable", err)
+		}
+	}
+
+	// The outage counted against no limits.
+	down.Store(false)
+	if _, err := r.Authenticate(ctx, "alice@a.com", "secret"); err != nil {
+		t.Errorf("login after recovery: %v", err)
+	}
+}
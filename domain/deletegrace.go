@@ -0,0 +1,31 @@
+package domain
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DeleteGrace returns the named domain's delete grace period, from
+// delete_grace_days, without loading it. Users deleted with a grace period
+// are marked deleted rather than removed (see passwd.SoftDeleteUser) until
+// passwd.Reap purges them; 0 deletes at once.
+func (p *FilesystemDomainProvider) DeleteGrace(name string) (time.Duration, error) {
+	name = strings.ToLower(name)
+	if !validDirName(name) {
+		return 0, fmt.Errorf("invalid domain name %q", name)
+	}
+	domainPath := filepath.Join(p.basePath, name)
+	if !p.exists(domainPath) {
+		return 0, fmt.Errorf("domain %s does not exist", name)
+	}
+	cfg, _, err := p.mergedConfig(name, filepath.Join(domainPath, "config.toml"))
+	if err != nil {
+		return 0, fmt.Errorf("domain %s: %w", name, err)
+	}
+	if cfg.DeleteGraceDays < 0 {
+		return 0, fmt.Errorf("domain %s: delete_grace_days is negative", name)
+	}
+	return time.Duration(cfg.DeleteGraceDays) * 24 * time.Hour, nil
+}
@@ -0,0 +1,39 @@
+package domain
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFilesystemDomainProvider_DeleteGrace(t *testing.T) {
+	p, base := newTestDomainsTree(t, "", "example.com", "example.org", "example.net")
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(base, name, "config.toml"), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("example.com", "delete_grace_days = 30\n")
+	write("example.org", "delete_grace_days = 0\n")
+	write("example.net", "delete_grace_days = -1\n")
+
+	tests := []struct {
+		name    string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"Example.COM", 30 * 24 * time.Hour, false},
+		{"example.org", 0, false},
+		{"example.net", 0, true},
+		{"nosuch.example", 0, true},
+		{"../example.com", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := p.DeleteGrace(tt.name)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("DeleteGrace(%q) = %v, %v; want %v, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
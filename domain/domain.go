@@ -6,8 +6,12 @@ import (
 	"context"
 	"crypto"
 	"errors"
+	"log/slog"
 
 	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/loginstate"
+	"github.com/infodancer/auth/passwd"
+	"github.com/infodancer/auth/sessions"
 	"github.com/infodancer/msgstore"
 )
 
@@ -56,6 +60,76 @@ type Domain struct {
 	// DKIMKey is the loaded Ed25519 private key for DKIM signing.
 	// Nil means DKIM is not configured for this domain.
 	DKIMKey crypto.Signer
+
+	// Logger is the domain's logger, carrying a "domain" attribute and the
+	// level and attributes from the domain's [log] config. Never nil for
+	// domains returned by FilesystemDomainProvider.
+	Logger *slog.Logger
+
+	// RequiredRoles lists the RFC 2142 role localparts this domain must
+	// accept mail for (see RolesConfig and MissingRoles).
+	RequiredRoles []string
+
+	// Senders maps a localpart to the extra sender addresses or patterns
+	// that user may use as MAIL FROM. Nil means own address and aliases only.
+	Senders map[string][]string
+
+	// OAuth configures the token issuer for XOAUTH2/OAUTHBEARER logins
+	// (see OAuthAgent).
+	OAuth OAuthConfig
+
+	// RequireTLSAuth is the domain's default TLS requirement for logins
+	// (see RequiresTLS).
+	RequireTLSAuth bool
+
+	// AcceptSubdomains is set when the domain also serves unserved
+	// subdomains (see ResolveDomain).
+	AcceptSubdomains bool
+
+	// GAL controls the domain's global address list export (see ExportGAL).
+	GAL GALConfig
+
+	// PasswordPolicy is the policy for passwords generated for the
+	// domain's users (see passwd.GeneratePassword).
+	PasswordPolicy passwd.PasswordPolicy
+
+	// Gid is the OS group id mail sessions for the domain run under, 0 when
+	// not configured. Logins whose backend assigns no gid get this one.
+	Gid uint32
+
+	// ReadOnly is set when the provider runs in read-only mode (see
+	// FilesystemDomainProvider.WithReadOnly). Callers offering management
+	// operations must refuse them with errors.ErrReadOnly.
+	ReadOnly bool
+
+	history         *loginHistory     // nil unless the provider enables login history
+	loginState      *loginstate.Store // nil unless the provider enables login state
+	sessions        *sessions.Store   // nil unless the provider enables sessions
+	metadataPath    string            // per-user metadata file (see UserMetadata)
+	clientCertsPath string            // certificate mapping (see ClientCertsFile)
+	frozenPath      string            // freeze marker (see FrozenFile)
+	fs              FS                // reads the files above; nil: the local disk
+	normalize       *normalizer       // nil: localparts used as given
+	mailbox         MailboxMapper     // nil: MailboxAddress
+	loginNotify     *loginNotifier    // nil: no login notices
+	backend         string            // auth backend type, for tracing
+	oauth           domainOAuth
+}
+
+// Resources sums the usage reported by the domain's agents and store, for
+// those that implement auth.ResourceReporter (for the auth agent, according
+// to auth.Capabilities).
+func (d *Domain) Resources() auth.ResourceUsage {
+	var total auth.ResourceUsage
+	if rr, ok := auth.AsResourceReporter(d.AuthAgent); ok {
+		total = total.Add(rr.Resources())
+	}
+	for _, v := range []any{d.DeliveryAgent, d.MessageStore} {
+		if rr, ok := v.(auth.ResourceReporter); ok {
+			total = total.Add(rr.Resources())
+		}
+	}
+	return total
 }
 
 // Close releases resources held by the domain's agents.
@@ -68,6 +142,10 @@ func (d *Domain) Close() error {
 		}
 	}
 
+	if err := d.closeOAuth(); err != nil {
+		errs = append(errs, err)
+	}
+
 	// DeliveryAgent (MsgStore) may have Close() - check if it implements io.Closer
 	if closer, ok := d.DeliveryAgent.(interface{ Close() error }); ok {
 		if err := closer.Close(); err != nil {
@@ -0,0 +1,72 @@
+package domain
+
+import "context"
+
+// EnvelopeMetadata carries delivery metadata that msgstore.Envelope has no
+// fields for. smtpd sets what it knows (typically AuthenticatedSender and,
+// when the client supplied it, OriginalRecipient) with WithEnvelopeMetadata;
+// MailDeliveryAgent fills in the rest and extends it on every forwarding hop
+// so the final store or relay sees where the message was originally addressed.
+type EnvelopeMetadata struct {
+	// OriginalRecipient is the recipient as first received (DSN ORCPT).
+	// Preserved unchanged across forwarding hops.
+	OriginalRecipient string
+
+	// AuthenticatedSender is the SMTP AUTH identity of the submitting client,
+	// empty for unauthenticated inbound mail.
+	AuthenticatedSender string
+
+	// Extension is the subaddress extension of the original recipient
+	// ("folder" for "user+folder@domain"), empty if none.
+	Extension string
+
+	// ForwardPath lists the addresses whose forwarding rules were applied to
+	// reach the current recipient, oldest first. Empty for direct delivery.
+	ForwardPath []string
+
+	// Folder is the folder of the recipient's mailbox to file the message
+	// into, set by a "=Folder" forward target; empty for the inbox. Stores
+	// with folder support deliver there, others deliver to the inbox.
+	Folder string
+}
+
+// envelopeMetadataKeyType is the context key type for EnvelopeMetadata.
+type envelopeMetadataKeyType struct{}
+
+// EnvelopeMetadataKey is the context key used to pass EnvelopeMetadata
+// through Deliver calls. Use WithEnvelopeMetadata to set it.
+var EnvelopeMetadataKey = envelopeMetadataKeyType{}
+
+// WithEnvelopeMetadata returns a context carrying md.
+func WithEnvelopeMetadata(ctx context.Context, md EnvelopeMetadata) context.Context {
+	return context.WithValue(ctx, EnvelopeMetadataKey, md)
+}
+
+// EnvelopeMetadataFromContext returns the EnvelopeMetadata carried by ctx,
+// or the zero value if none was set. Stores and relays call this inside
+// Deliver to record accurate delivery metadata.
+func EnvelopeMetadataFromContext(ctx context.Context) EnvelopeMetadata {
+	md, _ := ctx.Value(EnvelopeMetadataKey).(EnvelopeMetadata)
+	return md
+}
+
+// withRecipientMetadata returns ctx with metadata defaults filled in for a
+// delivery to recipient: the original recipient and its extension are
+// recorded on the first hop only.
+func withRecipientMetadata(ctx context.Context, recipient string) (context.Context, EnvelopeMetadata) {
+	md := EnvelopeMetadataFromContext(ctx)
+	if md.OriginalRecipient == "" {
+		md.OriginalRecipient = recipient
+		localpart, _ := SplitUsername(recipient)
+		_, md.Extension = ParseLocalPart(localpart)
+	}
+	return WithEnvelopeMetadata(ctx, md), md
+}
+
+// forwardedMetadata returns a copy of md with from appended to ForwardPath.
+func forwardedMetadata(md EnvelopeMetadata, from string) EnvelopeMetadata {
+	path := make([]string, len(md.ForwardPath), len(md.ForwardPath)+1)
+	copy(path, md.ForwardPath)
+	md.ForwardPath = append(path, from)
+	return md
+}
@@ -0,0 +1,113 @@
+package domain
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/infodancer/auth/forwards"
+	"github.com/infodancer/msgstore"
+)
+
+// metadataRecorder is a DeliveryAgent that records the EnvelopeMetadata it
+// receives on each Deliver call.
+type metadataRecorder struct {
+	got []EnvelopeMetadata
+}
+
+func (m *metadataRecorder) Deliver(ctx context.Context, _ msgstore.Envelope, _ io.Reader) error {
+	m.got = append(m.got, EnvelopeMetadataFromContext(ctx))
+	return nil
+}
+
+func TestEnvelopeMetadataFromContext_Unset(t *testing.T) {
+	md := EnvelopeMetadataFromContext(context.Background())
+	if md.OriginalRecipient != "" || md.ForwardPath != nil {
+		t.Errorf("expected zero metadata, got %+v", md)
+	}
+}
+
+func TestMailDeliveryAgent_LocalDeliveryMetadata(t *testing.T) {
+	inner := &metadataRecorder{}
+	agent := &MailDeliveryAgent{
+		inner: inner,
+		chain: &forwardChain{
+			domainForwards:  forwards.FromMap(nil),
+			defaultForwards: forwards.FromMap(nil),
+		},
+		provider: &stubDomainProvider{domains: map[string]*Domain{}},
+	}
+
+	ctx := WithEnvelopeMetadata(context.Background(), EnvelopeMetadata{AuthenticatedSender: "bob@this.com"})
+	env := msgstore.Envelope{Recipients: []string{"alice+lists@this.com"}}
+	if err := agent.Deliver(ctx, env, bytes.NewReader([]byte("test"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(inner.got) != 1 {
+		t.Fatalf("expected 1 delivery, got %d", len(inner.got))
+	}
+	md := inner.got[0]
+	if md.OriginalRecipient != "alice+lists@this.com" {
+		t.Errorf("OriginalRecipient = %q", md.OriginalRecipient)
+	}
+	if md.Extension != "lists" {
+		t.Errorf("Extension = %q, want lists", md.Extension)
+	}
+	if md.AuthenticatedSender != "bob@this.com" {
+		t.Errorf("AuthenticatedSender = %q", md.AuthenticatedSender)
+	}
+	if len(md.ForwardPath) != 0 {
+		t.Errorf("expected empty ForwardPath, got %v", md.ForwardPath)
+	}
+}
+
+func TestMailDeliveryAgent_ForwardPreservesMetadata(t *testing.T) {
+	final := &metadataRecorder{}
+	provider := &stubDomainProvider{domains: map[string]*Domain{
+		"final.com": {Name: "final.com", DeliveryAgent: final},
+	}}
+	// middle.com forwards everything to final.com.
+	provider.domains["middle.com"] = &Domain{
+		Name: "middle.com",
+		DeliveryAgent: &MailDeliveryAgent{
+			inner: &stubDeliveryAgent{},
+			chain: &forwardChain{
+				domainForwards:  forwards.FromMap(map[string]string{"*": "carol@final.com"}),
+				defaultForwards: forwards.FromMap(nil),
+			},
+			provider: provider,
+		},
+	}
+
+	agent := &MailDeliveryAgent{
+		inner: &stubDeliveryAgent{},
+		chain: &forwardChain{
+			domainForwards:  forwards.FromMap(map[string]string{"*": "bob@middle.com"}),
+			defaultForwards: forwards.FromMap(nil),
+		},
+		provider: provider,
+	}
+
+	ctx := WithEnvelopeMetadata(context.Background(), EnvelopeMetadata{AuthenticatedSender: "sender@x.org"})
+	env := msgstore.Envelope{Recipients: []string{"alice+tag@this.com"}}
+	if err := agent.Deliver(ctx, env, bytes.NewReader([]byte("test"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(final.got) != 1 {
+		t.Fatalf("expected 1 final delivery, got %d", len(final.got))
+	}
+	md := final.got[0]
+	if md.OriginalRecipient != "alice+tag@this.com" || md.Extension != "tag" {
+		t.Errorf("original recipient not preserved: %+v", md)
+	}
+	if md.AuthenticatedSender != "sender@x.org" {
+		t.Errorf("AuthenticatedSender = %q", md.AuthenticatedSender)
+	}
+	want := []string{"alice+tag@this.com", "bob@middle.com"}
+	if len(md.ForwardPath) != len(want) || md.ForwardPath[0] != want[0] || md.ForwardPath[1] != want[1] {
+		t.Errorf("ForwardPath = %v, want %v", md.ForwardPath, want)
+	}
+}
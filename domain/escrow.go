@@ -0,0 +1,35 @@
+package domain
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/infodancer/auth/passwd"
+)
+
+// EscrowKey returns the recovery public key in the merged [auth]
+// escrow_pubkey of the named domain, or nil if it has none, without
+// loading the domain, for tools that create user keys themselves.
+func (p *FilesystemDomainProvider) EscrowKey(name string) ([]byte, error) {
+	name = strings.ToLower(name)
+	if !validDirName(name) {
+		return nil, fmt.Errorf("invalid domain name %q", name)
+	}
+	domainPath := filepath.Join(p.basePath, name)
+	if !p.exists(domainPath) {
+		return nil, fmt.Errorf("domain %s does not exist", name)
+	}
+	cfg, _, err := p.mergedConfig(name, filepath.Join(domainPath, "config.toml"))
+	if err != nil {
+		return nil, fmt.Errorf("domain %s: %w", name, err)
+	}
+	if cfg.Auth.EscrowPubKey == "" {
+		return nil, nil
+	}
+	key, err := passwd.ParseEscrowKey(cfg.Auth.EscrowPubKey)
+	if err != nil {
+		return nil, fmt.Errorf("domain %s: escrow_pubkey: %w", name, err)
+	}
+	return key, nil
+}
@@ -0,0 +1,48 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFilesystemDomainProvider_EscrowKey(t *testing.T) {
+	p, base := newTestDomainsTree(t, "", "example.com", "plain.com")
+	key := bytes.Repeat([]byte{7}, 32)
+	content := "[auth]\nescrow_pubkey = \"" + base64.StdEncoding.EncodeToString(key) + "\"\n"
+	if err := os.WriteFile(filepath.Join(base, "example.com", "config.toml"), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := p.EscrowKey("example.com")
+	if err != nil || !bytes.Equal(got, key) {
+		t.Errorf("EscrowKey = %x, %v; want %x", got, err, key)
+	}
+	if got, err := p.EscrowKey("plain.com"); err != nil || got != nil {
+		t.Errorf("EscrowKey(no escrow) = %x, %v", got, err)
+	}
+	if _, err := p.EscrowKey("nosuch.example"); err == nil {
+		t.Error("EscrowKey(unknown domain) succeeded")
+	}
+
+	if err := os.WriteFile(filepath.Join(base, "plain.com", "config.toml"), []byte("[auth]\nescrow_pubkey = \"short\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.EscrowKey("plain.com"); err == nil {
+		t.Error("EscrowKey(invalid key) succeeded")
+	}
+}
+
+func TestDomainAuthConfig_EscrowOption(t *testing.T) {
+	opts := map[string]string{"mmap": "true"}
+	c := DomainAuthConfig{Type: "passwd", Options: opts, EscrowPubKey: "KEY"}
+	got := c.agentConfig("/d", OSFS{}, false).Options
+	if got["escrow_pubkey"] != "KEY" || got["mmap"] != "true" {
+		t.Errorf("Options = %v", got)
+	}
+	if _, ok := opts["escrow_pubkey"]; ok {
+		t.Error("agentConfig modified the configured options")
+	}
+}
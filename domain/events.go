@@ -0,0 +1,613 @@
+package domain
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/infodancer/auth/atrest"
+)
+
+// DefaultWatchInterval is how often Subscribe polls the domains tree unless
+// WithWatchInterval sets another interval.
+const DefaultWatchInterval = 30 * time.Second
+
+// eventBuffer is the channel capacity of each subscription.
+const eventBuffer = 64
+
+// EventType identifies what changed in a provider Event.
+type EventType string
+
+const (
+	// EventDomainAdded reports a new domain directory.
+	EventDomainAdded EventType = "domain_added"
+
+	// EventDomainRemoved reports that a domain directory disappeared.
+	EventDomainRemoved EventType = "domain_removed"
+
+	// EventDomainReloaded reports an edited domain config.toml. The cached
+	// Domain has been dropped; the next GetDomain loads the new config.
+	EventDomainReloaded EventType = "domain_reloaded"
+
+	// EventDomainFrozen reports a domain frozen or thawed (see
+	// FreezeDomain); Change is ChangeDisabled or ChangeEnabled.
+	EventDomainFrozen EventType = "domain_frozen"
+
+	// EventUserChanged reports a user added, removed or modified in the
+	// domain's credential file or user_metadata.toml. User is the localpart,
+	// or empty when the credential backend is not a passwd file and only
+	// the file as a whole is known to have changed.
+	EventUserChanged EventType = "user_changed"
+)
+
+// Change is the lifecycle step an Event records, for consumers such as
+// provisioning webhooks that care about more than "something changed".
+type Change string
+
+const (
+	// ChangeCreated is a domain or user that did not exist before.
+	ChangeCreated Change = "created"
+
+	// ChangeDeleted is a domain or user that no longer exists.
+	ChangeDeleted Change = "deleted"
+
+	// ChangeRenamed is a domain or user that exists under a new name;
+	// Event.Previous holds the old one.
+	ChangeRenamed Change = "renamed"
+
+	// ChangeDisabled is a user whose entry gained the disabled flag, or a
+	// domain that was frozen (see FreezeDomain).
+	ChangeDisabled Change = "disabled"
+
+	// ChangeEnabled is a user whose entry lost the disabled flag, or a
+	// domain that was thawed.
+	ChangeEnabled Change = "enabled"
+
+	// ChangeModified is any other change.
+	ChangeModified Change = "modified"
+)
+
+// Event is a change to the domains tree observed by a subscription.
+type Event struct {
+	Type   EventType
+	Domain string
+	User   string
+	Time   time.Time
+
+	// Change refines Type. Domain events are ChangeCreated (added),
+	// ChangeDeleted (removed), ChangeModified (reloaded), ChangeRenamed, or
+	// ChangeDisabled and ChangeEnabled for an EventDomainFrozen.
+	// User events are ChangeCreated, ChangeDeleted, ChangeRenamed,
+	// ChangeDisabled or ChangeEnabled when the credential file is a passwd
+	// file, and ChangeModified otherwise.
+	Change Change
+
+	// Previous is the old domain or localpart of a ChangeRenamed event.
+	// A rename is reported once, as an EventDomainAdded or EventUserChanged
+	// for the new name, so subscribers dropping state by name must drop
+	// Previous as well.
+	Previous string
+}
+
+// EventSource is implemented by providers that can report changes, so
+// daemons can drop sessions or refresh advertised domains instead of
+// polling Domains.
+type EventSource interface {
+	// Subscribe returns a channel of events that is closed when ctx is
+	// done or the provider is closed.
+	Subscribe(ctx context.Context) <-chan Event
+}
+
+// WithWatchInterval sets how often subscriptions poll the domains tree for
+// changes (default DefaultWatchInterval). Takes effect for the next watcher
+// started by Subscribe. Returns the provider to allow chaining.
+func (p *FilesystemDomainProvider) WithWatchInterval(d time.Duration) *FilesystemDomainProvider {
+	p.watchMu.Lock()
+	p.watchInterval = d
+	p.watchMu.Unlock()
+	return p
+}
+
+// Subscribe returns a channel of changes to the domains tree: domains added
+// and removed, per-domain config.toml edits, and user changes in passwd
+// credential files and user_metadata.toml. Changes are detected by polling
+// through the provider's FS, so they arrive up to one watch interval late
+// and work on NFS and object storage where change notification does not.
+// Base-level files (config.toml, domains.toml, postmaster) are not watched.
+//
+// All subscriptions share one watcher, which runs while any is open. Its
+// first poll records the current state without reporting it. Each channel
+// buffers a few dozen events; events for a subscriber that falls further
+// behind are dropped and logged rather than stalling the others. The
+// channel is closed when ctx is done or the provider is closed.
+func (p *FilesystemDomainProvider) Subscribe(ctx context.Context) <-chan Event {
+	ch := make(chan Event, eventBuffer)
+
+	p.watchMu.Lock()
+	if p.watchClosed {
+		p.watchMu.Unlock()
+		close(ch)
+		return ch
+	}
+	if p.watch == nil {
+		interval := p.watchInterval
+		if interval <= 0 {
+			interval = DefaultWatchInterval
+		}
+		p.watch = newWatcher(p, interval)
+	}
+	w := p.watch
+	w.mu.Lock()
+	w.subs[ch] = struct{}{}
+	w.mu.Unlock()
+	p.watchMu.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-w.stopped:
+			return
+		}
+		p.unsubscribe(w, ch)
+	}()
+	return ch
+}
+
+// unsubscribe removes ch from w, stopping w when no subscribers remain.
+func (p *FilesystemDomainProvider) unsubscribe(w *watcher, ch chan Event) {
+	p.watchMu.Lock()
+	defer p.watchMu.Unlock()
+	w.mu.Lock()
+	if _, ok := w.subs[ch]; ok {
+		delete(w.subs, ch)
+		close(ch)
+	}
+	last := len(w.subs) == 0
+	w.mu.Unlock()
+	if last && p.watch == w {
+		p.watch = nil
+		w.stop()
+	}
+}
+
+// closeWatch stops the watcher, closing every subscription, and refuses
+// new ones. Called by Close.
+func (p *FilesystemDomainProvider) closeWatch() {
+	p.watchMu.Lock()
+	w := p.watch
+	p.watch = nil
+	p.watchClosed = true
+	p.watchMu.Unlock()
+	if w != nil {
+		w.stop()
+	}
+}
+
+// dropCached closes and forgets the cached Domain for name, if any, so the
+// next GetDomain reloads it.
+func (p *FilesystemDomainProvider) dropCached(name string) {
+	p.mu.Lock()
+	cd, ok := p.cache[name]
+	delete(p.cache, name)
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+	if err := cd.domain.Close(); err != nil {
+		p.logger.Warn("error closing reloaded domain",
+			slog.String("domain", name),
+			slog.String("error", err.Error()))
+	}
+}
+
+// watcher polls the domains tree and fans events out to subscribers.
+type watcher struct {
+	p        *FilesystemDomainProvider
+	interval time.Duration
+	cancel   context.CancelFunc
+	stopped  chan struct{} // closed once run has returned and subs are closed
+
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+func newWatcher(p *FilesystemDomainProvider, interval time.Duration) *watcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &watcher{
+		p:        p,
+		interval: interval,
+		cancel:   cancel,
+		stopped:  make(chan struct{}),
+		subs:     make(map[chan Event]struct{}),
+	}
+	go w.run(ctx)
+	return w
+}
+
+// stop ends polling and waits until every subscription is closed.
+func (w *watcher) stop() {
+	w.cancel()
+	<-w.stopped
+}
+
+func (w *watcher) run(ctx context.Context) {
+	defer func() {
+		w.mu.Lock()
+		for ch := range w.subs {
+			close(ch)
+		}
+		w.subs = nil
+		w.mu.Unlock()
+		close(w.stopped)
+	}()
+
+	prev, err := w.p.snapshot(ctx, nil)
+	if err != nil && ctx.Err() == nil {
+		w.p.logger.Warn("domain watch: initial scan failed", slog.String("error", err.Error()))
+	}
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		next, err := w.p.snapshot(ctx, prev)
+		if err != nil {
+			if ctx.Err() == nil {
+				w.p.logger.Warn("domain watch: scan failed", slog.String("error", err.Error()))
+			}
+			continue
+		}
+		if prev != nil {
+			events := diffSnapshots(prev, next, time.Now())
+			for _, ev := range events {
+				if ev.Type == EventDomainReloaded || ev.Type == EventDomainRemoved {
+					w.p.dropCached(ev.Domain)
+				}
+				if ev.Type == EventDomainAdded && ev.Previous != "" {
+					w.p.dropCached(ev.Previous)
+				}
+			}
+			w.broadcast(events)
+		}
+		prev = next
+	}
+}
+
+// broadcast delivers events without blocking, dropping those a full
+// subscription cannot take.
+func (w *watcher) broadcast(events []Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	dropped := 0
+	for _, ev := range events {
+		for ch := range w.subs {
+			select {
+			case ch <- ev:
+			default:
+				dropped++
+			}
+		}
+	}
+	if dropped > 0 {
+		w.p.logger.Warn("domain watch: subscriber too slow, events dropped",
+			slog.Int("dropped", dropped))
+	}
+}
+
+// domainState is what the watcher remembers about one domain.
+type domainState struct {
+	config   string // fingerprint of config.toml
+	credPath string // resolved credential backend path; "" when none
+	passwd   bool   // credPath is in passwd line format
+	cred     string // fingerprint of credPath
+	users    map[string]userState
+	metadata string // fingerprint of user_metadata.toml
+	meta     map[string]UserMetadata
+	frozen   bool // FrozenFile exists
+}
+
+// snapshot records the state of every domain, reusing parsed files from prev
+// whose fingerprints have not changed.
+func (p *FilesystemDomainProvider) snapshot(ctx context.Context, prev map[string]*domainState) (map[string]*domainState, error) {
+	next := make(map[string]*domainState)
+	for name, err := range p.DomainsIter(ctx, DomainFilter{}) {
+		if err != nil {
+			return nil, err
+		}
+		next[name] = p.domainSnapshot(name, prev[name])
+	}
+	return next, nil
+}
+
+// domainSnapshot records the state of one domain. Unreadable files are
+// recorded as empty, so they read as changes once they can be read again.
+func (p *FilesystemDomainProvider) domainSnapshot(name string, old *domainState) *domainState {
+	domainPath := filepath.Join(p.basePath, name)
+	configPath := filepath.Join(domainPath, "config.toml")
+
+	st := &domainState{config: p.fingerprint(configPath)}
+	if _, err := p.fs.Stat(filepath.Join(domainPath, FrozenFile)); err == nil {
+		st.frozen = true
+	}
+	if old != nil && old.config == st.config {
+		st.credPath, st.passwd = old.credPath, old.passwd
+	} else if cfg, _, err := p.mergedConfig(name, configPath); err == nil {
+		a := cfg.Auth
+		if len(a.Chain) > 0 {
+			// Only the first member of a chain is watched.
+			a = a.Chain[0]
+		}
+		st.credPath = resolvePath(domainPath, a.CredentialBackend)
+		st.passwd = a.Type == "passwd"
+	}
+
+	if st.credPath != "" {
+		st.cred = p.fingerprint(st.credPath)
+		if old != nil && old.credPath == st.credPath && old.cred == st.cred {
+			st.users = old.users
+		} else if st.passwd {
+			st.users = p.passwdUsers(st.credPath)
+		}
+	}
+
+	metaPath := filepath.Join(domainPath, UserMetadataFile)
+	st.metadata = p.fingerprint(metaPath)
+	if old != nil && old.metadata == st.metadata {
+		st.meta = old.meta
+	} else if md, err := loadUserMetadata(p.fs, metaPath); err == nil {
+		st.meta = md
+	}
+	return st
+}
+
+// userState is what the watcher remembers about one passwd entry.
+type userState struct {
+	line     [32]byte // hash of the whole entry
+	secret   [32]byte // hash of the password hash field, to recognise renames
+	disabled bool     // the entry has the disabled account flag
+}
+
+// fingerprint summarizes the size and modification time of name, or of
+// every entry when name is a directory (a passwd shard directory). It is
+// empty when name cannot be read.
+func (p *FilesystemDomainProvider) fingerprint(name string) string {
+	info, err := p.fs.Stat(name)
+	if err != nil {
+		return ""
+	}
+	if !info.IsDir() {
+		return fileFingerprint(info)
+	}
+	entries, err := p.fs.ReadDir(name)
+	if err != nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		b.WriteString(e.Name() + "=" + fileFingerprint(info) + ";")
+	}
+	return b.String()
+}
+
+func fileFingerprint(info fs.FileInfo) string {
+	return fmt.Sprintf("%d:%d", info.Size(), info.ModTime().UnixNano())
+}
+
+// passwdUsers hashes each user's line in a passwd file or shard directory,
+// so entries can be compared without keeping password hashes in memory.
+func (p *FilesystemDomainProvider) passwdUsers(path string) map[string]userState {
+	files := []string{path}
+	if info, err := p.fs.Stat(path); err == nil && info.IsDir() {
+		entries, err := p.fs.ReadDir(path)
+		if err != nil {
+			return nil
+		}
+		files = files[:0]
+		for _, e := range entries {
+			if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+				files = append(files, filepath.Join(path, e.Name()))
+			}
+		}
+	}
+
+	users := make(map[string]userState)
+	for _, f := range files {
+		data, err := atrest.ReadFileFS(p.fs, f)
+		if err != nil {
+			continue
+		}
+		for _, line := range bytes.Split(data, []byte("\n")) {
+			line = bytes.TrimSpace(line)
+			if len(line) == 0 || line[0] == '#' {
+				continue
+			}
+			fields := bytes.SplitN(line, []byte(":"), 6)
+			if len(fields) < 2 {
+				continue
+			}
+			st := userState{line: sha256.Sum256(line), secret: sha256.Sum256(fields[1])}
+			if len(fields) > 4 {
+				// The flags field; "disabled" is passwd.FlagDisabled.
+				for _, f := range bytes.Split(fields[4], []byte(",")) {
+					st.disabled = st.disabled || string(bytes.TrimSpace(f)) == "disabled"
+				}
+			}
+			users[string(fields[0])] = st
+		}
+	}
+	return users
+}
+
+// diffSnapshots returns the events that turn prev into next, sorted by
+// domain so subscribers see a stable order. A domain that disappears while
+// another with identical files appears is reported as renamed.
+func diffSnapshots(prev, next map[string]*domainState, now time.Time) []Event {
+	var events []Event
+	add := func(t EventType, c Change, domain, user, previous string) {
+		events = append(events, Event{Type: t, Domain: domain, User: user, Time: now, Change: c, Previous: previous})
+	}
+	var added, removed []string
+	for name := range prev {
+		if _, ok := next[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	for name, n := range next {
+		o, ok := prev[name]
+		if !ok {
+			added = append(added, name)
+			continue
+		}
+		if o.config != n.config {
+			add(EventDomainReloaded, ChangeModified, name, "", "")
+		}
+		if o.frozen != n.frozen {
+			c := ChangeEnabled
+			if n.frozen {
+				c = ChangeDisabled
+			}
+			add(EventDomainFrozen, c, name, "", "")
+		}
+		for _, c := range changedUsers(o, n) {
+			add(EventUserChanged, c.change, name, c.user, c.previous)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	for _, name := range added {
+		i := slices.IndexFunc(removed, func(old string) bool { return sameDomainFiles(prev[old], next[name]) })
+		if i < 0 {
+			add(EventDomainAdded, ChangeCreated, name, "", "")
+			continue
+		}
+		add(EventDomainAdded, ChangeRenamed, name, "", removed[i])
+		removed = slices.Delete(removed, i, i+1)
+	}
+	for _, name := range removed {
+		add(EventDomainRemoved, ChangeDeleted, name, "", "")
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].Domain != events[j].Domain {
+			return events[i].Domain < events[j].Domain
+		}
+		return events[i].User < events[j].User
+	})
+	return events
+}
+
+// sameDomainFiles reports whether two domains have the same, readable
+// config and credential files, as a renamed domain directory does.
+func sameDomainFiles(o, n *domainState) bool {
+	return o.config != "" && o.cred != "" &&
+		o.config == n.config && o.cred == n.cred && o.metadata == n.metadata
+}
+
+// userChange is one user reported by changedUsers.
+type userChange struct {
+	user     string
+	previous string // set for ChangeRenamed
+	change   Change
+}
+
+// changedUsers lists the users whose credentials or metadata differ between
+// two states of a domain. A changed non-passwd credential file is reported
+// as a single empty name. A passwd entry that disappears while another with
+// the same password hash appears is reported as renamed; password hashes
+// are salted, so two accounts share one only when an entry was renamed.
+func changedUsers(o, n *domainState) []userChange {
+	changed := make(map[string]userChange)
+	renamed := make(map[string]bool) // old names of renamed users
+	set := func(user, previous string, c Change) {
+		changed[user] = userChange{user: user, previous: previous, change: c}
+	}
+	if o.cred != n.cred {
+		if n.passwd && o.passwd {
+			var added, removed []string
+			for u, ns := range n.users {
+				ps, ok := o.users[u]
+				switch {
+				case !ok:
+					added = append(added, u)
+				case ps.line == ns.line:
+				case ns.disabled && !ps.disabled:
+					set(u, "", ChangeDisabled)
+				case !ns.disabled && ps.disabled:
+					set(u, "", ChangeEnabled)
+				default:
+					set(u, "", ChangeModified)
+				}
+			}
+			for u := range o.users {
+				if _, ok := n.users[u]; !ok {
+					removed = append(removed, u)
+				}
+			}
+			bySecret := func(users map[string]userState, names []string) map[[32]byte][]string {
+				m := make(map[[32]byte][]string)
+				for _, u := range names {
+					m[users[u].secret] = append(m[users[u].secret], u)
+				}
+				return m
+			}
+			addedBy, removedBy := bySecret(n.users, added), bySecret(o.users, removed)
+			for secret, news := range addedBy {
+				if olds := removedBy[secret]; len(news) == 1 && len(olds) == 1 {
+					set(news[0], olds[0], ChangeRenamed)
+					renamed[olds[0]] = true
+				}
+			}
+			for _, u := range added {
+				if _, ok := changed[u]; !ok {
+					set(u, "", ChangeCreated)
+				}
+			}
+			for _, u := range removed {
+				if !renamed[u] {
+					set(u, "", ChangeDeleted)
+				}
+			}
+		} else {
+			set("", "", ChangeModified)
+		}
+	}
+	if o.metadata != n.metadata {
+		touch := func(u string) {
+			if _, ok := changed[u]; !ok && !renamed[u] {
+				set(u, "", ChangeModified)
+			}
+		}
+		for u, md := range n.meta {
+			if omd, ok := o.meta[u]; !ok || !reflect.DeepEqual(omd, md) {
+				touch(u)
+			}
+		}
+		for u := range o.meta {
+			if _, ok := n.meta[u]; !ok {
+				touch(u)
+			}
+		}
+	}
+	users := make([]userChange, 0, len(changed))
+	for _, c := range changed {
+		users = append(users, c)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].user < users[j].user })
+	return users
+}
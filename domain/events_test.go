@@ -0,0 +1,190 @@
+package domain
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// replaceFile writes name atomically so a poll never sees it half written.
+func replaceFile(t *testing.T, name, content string) {
+	t.Helper()
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitEvent returns the next event on ch, failing the test after a timeout.
+func waitEvent(t *testing.T, ch <-chan Event) Event {
+	t.Helper()
+	select {
+	case ev, ok := <-ch:
+		if !ok {
+			t.Fatal("event channel closed")
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	return Event{}
+}
+
+// settle waits for the watcher's baseline scan and first poll.
+func settle() { time.Sleep(50 * time.Millisecond) }
+
+func TestSubscribe_DomainAddedRemoved(t *testing.T) {
+	p, base := newTestDomainsTree(t, "alice:HASH:alice\n", "a.com")
+	p.WithWatchInterval(10 * time.Millisecond)
+	ch := p.Subscribe(t.Context())
+	settle()
+
+	if err := os.MkdirAll(filepath.Join(base, "b.com"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	ev := waitEvent(t, ch)
+	if ev.Type != EventDomainAdded || ev.Domain != "b.com" || ev.Time.IsZero() {
+		t.Errorf("event = %+v, want domain_added b.com", ev)
+	}
+
+	if p.GetDomain("a.com") == nil {
+		t.Fatal("a.com not loaded")
+	}
+	if err := os.RemoveAll(filepath.Join(base, "a.com")); err != nil {
+		t.Fatal(err)
+	}
+	ev = waitEvent(t, ch)
+	if ev.Type != EventDomainRemoved || ev.Domain != "a.com" {
+		t.Errorf("event = %+v, want domain_removed a.com", ev)
+	}
+	p.mu.RLock()
+	_, cached := p.cache["a.com"]
+	p.mu.RUnlock()
+	if cached {
+		t.Error("removed domain still cached")
+	}
+}
+
+func TestSubscribe_ConfigReloadDropsCache(t *testing.T) {
+	p, base := newTestDomainsTree(t, "alice:HASH:alice\n", "a.com")
+	p.WithWatchInterval(10 * time.Millisecond)
+	before := p.GetDomain("a.com")
+	if before == nil {
+		t.Fatal("a.com not loaded")
+	}
+	ch := p.Subscribe(t.Context())
+	settle()
+
+	replaceFile(t, filepath.Join(base, "a.com", "config.toml"), "require_tls_auth = true\n")
+	ev := waitEvent(t, ch)
+	if ev.Type != EventDomainReloaded || ev.Domain != "a.com" {
+		t.Fatalf("event = %+v, want domain_reloaded a.com", ev)
+	}
+	if after := p.GetDomain("a.com"); after == nil || after == before {
+		t.Error("GetDomain did not reload the domain after its config changed")
+	}
+}
+
+func TestSubscribe_UserChanged(t *testing.T) {
+	p, base := newTestDomainsTree(t, "alice:HASH:alice\nbob:HASH:bob\n", "a.com")
+	p.WithWatchInterval(10 * time.Millisecond)
+	ch := p.Subscribe(t.Context())
+	settle()
+
+	// bob's hash changes, carol is added; alice is untouched.
+	replaceFile(t, filepath.Join(base, "a.com", "passwd"),
+		"alice:HASH:alice\nbob:NEWHASH:bob\ncarol:HASH:carol\n")
+	got := []string{waitEvent(t, ch).User, waitEvent(t, ch).User}
+	if got[0] != "bob" || got[1] != "carol" {
+		t.Errorf("changed users = %v, want [bob carol]", got)
+	}
+
+	replaceFile(t, filepath.Join(base, "a.com", UserMetadataFile), "[alice]\ndisplay_name = \"Alice\"\n")
+	ev := waitEvent(t, ch)
+	if ev.Type != EventUserChanged || ev.Domain != "a.com" || ev.User != "alice" {
+		t.Errorf("event = %+v, want user_changed a.com alice", ev)
+	}
+}
+
+func TestSubscribe_CloseEndsSubscriptions(t *testing.T) {
+	p, _ := newTestDomainsTree(t, "", "a.com")
+	p.WithWatchInterval(10 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	first := p.Subscribe(ctx)
+	second := p.Subscribe(t.Context())
+	cancel()
+	if _, ok := <-first; ok {
+		t.Error("cancelled subscription received an event")
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-second; ok {
+		t.Error("subscription open after Close")
+	}
+	if _, ok := <-p.Subscribe(t.Context()); ok {
+		t.Error("Subscribe after Close returned an open channel")
+	}
+}
+
+func TestDiffSnapshots_NonPasswdBackend(t *testing.T) {
+	prev := map[string]*domainState{"a.com": {config: "1", credPath: "/db", cred: "1"}}
+	next := map[string]*domainState{"a.com": {config: "1", credPath: "/db", cred: "2"}}
+	events := diffSnapshots(prev, next, time.Now())
+	if len(events) != 1 || events[0].Type != EventUserChanged || events[0].User != "" {
+		t.Errorf("events = %+v, want one user_changed with no user", events)
+	}
+}
+
+func TestDiffSnapshots_Lifecycle(t *testing.T) {
+	user := func(line, secret string, disabled bool) userState {
+		return userState{line: [32]byte{line[0]}, secret: [32]byte{secret[0]}, disabled: disabled}
+	}
+	prev := map[string]*domainState{
+		"a.com": {config: "1", credPath: "/a", passwd: true, cred: "1", users: map[string]userState{
+			"alice": user("a", "A", false),
+			"bob":   user("b", "B", false),
+			"carol": user("c", "C", false),
+			"dave":  user("d", "D", false),
+		}},
+		"old.com":  {config: "2", cred: "2", credPath: "/old", passwd: true},
+		"gone.com": {config: "3", cred: "3", credPath: "/gone", passwd: true},
+	}
+	next := map[string]*domainState{
+		"a.com": {config: "1", credPath: "/a", passwd: true, cred: "2", users: map[string]userState{
+			"alice":  user("A", "A", true),  // disabled
+			"robert": user("b", "B", false), // bob renamed
+			"carol":  user("C", "X", false), // password changed
+			"erin":   user("e", "E", false), // dave deleted, erin created
+		}},
+		"new.com": {config: "2", cred: "2", credPath: "/new", passwd: true},
+	}
+	var got []string
+	for _, ev := range diffSnapshots(prev, next, time.Now()) {
+		got = append(got, string(ev.Type)+" "+string(ev.Change)+" "+ev.Domain+" "+ev.User+" "+ev.Previous)
+	}
+	want := []string{
+		"user_changed disabled a.com alice ",
+		"user_changed modified a.com carol ",
+		"user_changed deleted a.com dave ",
+		"user_changed created a.com erin ",
+		"user_changed renamed a.com robert bob",
+		"domain_removed deleted gone.com  ",
+		"domain_added renamed new.com  old.com",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("events = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package domain
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/atrest"
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/vfs"
+)
+
+// ClientCertsFile is the per-domain file mapping TLS client certificates
+// to users for SASL EXTERNAL logins (see AuthRouter.AuthenticateExternal).
+// Each line names a localpart and the certificate it accepts, by SHA-256
+// fingerprint or by subject:
+//
+//	# localpart  certificate
+//	backup       sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+//	relay        subject:CN=relay.example.com,O=Example
+//
+// Fingerprints are preferred: any certificate the trusted CAs issue with
+// the same subject matches a subject line.
+const ClientCertsFile = "client_certs"
+
+// CertInfo describes the verified TLS client certificate of a connection.
+// The daemon terminating TLS fills it in, normally with
+// CertInfoFromCertificate, after verifying the chain.
+type CertInfo struct {
+	// Fingerprint is the lowercase hex SHA-256 of the DER certificate.
+	Fingerprint string
+
+	// Subject is the certificate subject as pkix.Name.String formats it.
+	Subject string
+
+	// Emails are the certificate's email subject alternative names.
+	Emails []string
+
+	// AuthzID is the identity the client asked to log in as, the SASL
+	// EXTERNAL authorization identity. Empty means the certificate's only
+	// email address.
+	AuthzID string
+}
+
+// CertInfoFromCertificate returns the CertInfo of a verified client
+// certificate, with no AuthzID.
+func CertInfoFromCertificate(cert *x509.Certificate) CertInfo {
+	sum := sha256.Sum256(cert.Raw)
+	return CertInfo{
+		Fingerprint: hex.EncodeToString(sum[:]),
+		Subject:     cert.Subject.String(),
+		Emails:      cert.EmailAddresses,
+	}
+}
+
+// identity returns the address the certificate logs in as.
+func (c CertInfo) identity() (string, bool) {
+	if c.AuthzID != "" {
+		return c.AuthzID, true
+	}
+	if len(c.Emails) == 1 {
+		return c.Emails[0], true
+	}
+	return "", false
+}
+
+// certMapping is one line of a ClientCertsFile.
+type certMapping struct {
+	localpart   string
+	fingerprint string // set for sha256: lines
+	subject     string // set for subject: lines
+}
+
+// matches reports whether m accepts cert.
+func (m certMapping) matches(cert CertInfo) bool {
+	if m.fingerprint != "" {
+		return strings.EqualFold(m.fingerprint, cert.Fingerprint)
+	}
+	return m.subject != "" && m.subject == cert.Subject
+}
+
+// loadClientCerts reads a ClientCertsFile. Malformed lines are skipped. A
+// missing file yields no mappings and no error.
+func loadClientCerts(fsys vfs.FS, path string) ([]certMapping, error) {
+	data, err := atrest.ReadFileFS(fsys, path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read client certs: %w", err)
+	}
+	var mappings []certMapping
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		localpart, match, ok := strings.Cut(line, " ")
+		if !ok {
+			localpart, match, ok = strings.Cut(line, "\t")
+		}
+		if !ok {
+			continue
+		}
+		m := certMapping{localpart: strings.ToLower(localpart)}
+		match = strings.TrimSpace(match)
+		if fp, ok := strings.CutPrefix(match, "sha256:"); ok {
+			m.fingerprint = strings.ToLower(strings.ReplaceAll(fp, ":", ""))
+		} else if subject, ok := strings.CutPrefix(match, "subject:"); ok {
+			m.subject = subject
+		} else {
+			continue
+		}
+		mappings = append(mappings, m)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read client certs: %w", err)
+	}
+	return mappings, nil
+}
+
+// certAccepted reports whether the domain's ClientCertsFile maps cert to
+// localpart. The file is read on each call, like user metadata.
+func (d *Domain) certAccepted(localpart string, cert CertInfo) (bool, error) {
+	if d.clientCertsPath == "" {
+		return false, nil
+	}
+	fsys := d.fs
+	if fsys == nil {
+		fsys = vfs.OS{}
+	}
+	mappings, err := loadClientCerts(fsys, d.clientCertsPath)
+	if err != nil {
+		return false, err
+	}
+	localpart = strings.ToLower(localpart)
+	for _, m := range mappings {
+		if m.localpart == localpart && m.matches(cert) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AuthenticateExternal logs in with a verified TLS client certificate
+// instead of a password (SASL EXTERNAL), for machine submitters. The
+// identity is cert.AuthzID, or the certificate's only email address; its
+// domain's ClientCertsFile, or failing that its agent if it implements
+// auth.ExternalAuthenticator (see the certauth package), must map the
+// certificate to that user, who must exist and be allowed to log in (see
+// auth.AccountStatus).
+//
+// The session has Credential.Kind auth.CredentialCertificate and no
+// private key. Rate limits and the anomaly scorer apply as for
+// passwords; second factors do not. A certificate that does not map to
+// the user fails with errors.ErrAuthFailed, a certificate without an
+// identity or for an address no domain serves with
+// errors.ErrUserNotFound.
+func (r *AuthRouter) AuthenticateExternal(ctx context.Context, cert CertInfo) (*AuthResult, error) {
+	start := time.Now()
+	username, _ := cert.identity()
+	username = r.qualify(ctx, username)
+	ctx, span := startLoginSpan(ctx, "EXTERNAL")
+	result, err := r.authenticateCert(ctx, cert)
+	endLoginSpan(span, username, result, err)
+	r.auditLogin(ctx, start, username, "EXTERNAL", result, err)
+	return result, err
+}
+
+// AuthenticatePrincipal logs in the Kerberos principal a daemon
+// authenticated through SASL GSSAPI as address, the mailbox the
+// principal maps to (see the krb5auth package, which checks the ticket
+// and maps the realm). The user must exist and be allowed to log in.
+//
+// The session has Credential.Kind auth.CredentialKerberos, the principal
+// as Credential.ID, and no private key. Rate limits and the anomaly
+// scorer apply as for passwords; second factors do not, since the realm
+// applies its own.
+func (r *AuthRouter) AuthenticatePrincipal(ctx context.Context, address, principal string) (*AuthResult, error) {
+	start := time.Now()
+	username := r.qualify(ctx, address)
+	ctx, span := startLoginSpan(ctx, "GSSAPI")
+	cred := auth.Credential{Kind: auth.CredentialKerberos, ID: principal}
+	result, err := r.passwordlessLogin(ctx, username, cred, func(*Domain, string) (bool, error) {
+		return true, nil
+	})
+	endLoginSpan(span, username, result, err)
+	r.auditLogin(ctx, start, username, "GSSAPI", result, err)
+	return result, err
+}
+
+// authenticateCert is AuthenticateExternal without auditing.
+func (r *AuthRouter) authenticateCert(ctx context.Context, cert CertInfo) (*AuthResult, error) {
+	username, ok := cert.identity()
+	if !ok {
+		return nil, fmt.Errorf("%w: certificate names no identity", autherrors.ErrUserNotFound)
+	}
+	username = r.qualify(ctx, username)
+	cred := auth.Credential{Kind: auth.CredentialCertificate, ID: cert.Fingerprint}
+	return r.passwordlessLogin(ctx, username, cred, func(d *Domain, base string) (bool, error) {
+		accepted, err := d.certAccepted(base, cert)
+		if err == nil && !accepted {
+			accepted, err = d.agentAcceptsCert(ctx, base, cert)
+		}
+		return accepted, err
+	})
+}
+
+// passwordlessLogin logs username in with cred, a credential the daemon
+// verified, if accepted approves it for the user's domain. Rate limits
+// and the anomaly scorer apply as for passwords.
+func (r *AuthRouter) passwordlessLogin(ctx context.Context, username string, cred auth.Credential, accepted func(d *Domain, base string) (bool, error)) (*AuthResult, error) {
+	clientIP := clientIPFromContext(ctx)
+	if r.rateLimiter != nil && r.rateLimiter.isLimited(clientIP, username) {
+		slog.Warn("auth rate limited", "username", username, "ip", clientIP)
+		return nil, autherrors.ErrRateLimited
+	}
+
+	result, err := r.authenticatePasswordless(ctx, username, cred, accepted)
+	if err != nil {
+		if r.rateLimiter != nil && !errors.Is(err, autherrors.ErrAccountDisabled) {
+			r.rateLimiter.recordFailure(clientIP, username)
+		}
+		return nil, err
+	}
+
+	if r.scorer != nil {
+		decision, risk := r.assessLogin(ctx, username, result)
+		result.Risk = &risk
+		switch decision {
+		case RiskDeny:
+			slog.Warn("login denied by anomaly policy",
+				"username", username, "ip", clientIP, "score", risk.Score, "reason", risk.Reason)
+			return nil, autherrors.ErrLoginDenied
+		case RiskStepUp:
+			result.StepUpRequired = true
+			result.Challenge = r.issueChallenge(ctx, username, risk.Reason)
+		}
+	}
+
+	if r.rateLimiter != nil {
+		r.rateLimiter.recordSuccess(clientIP, username)
+	}
+	result.notifyLogin(ctx)
+	return result, nil
+}
+
+// authenticatePasswordless checks cred against username's domain without
+// rate limiting.
+func (r *AuthRouter) authenticatePasswordless(ctx context.Context, username string, cred auth.Credential, accepted func(d *Domain, base string) (bool, error)) (*AuthResult, error) {
+	localPart, domainName := SplitUsername(username)
+	base, extension := ParseLocalPart(localPart)
+	if r.provider == nil || domainName == "" {
+		return nil, autherrors.ErrUserNotFound
+	}
+	d, host := ResolveDomain(r.provider, domainName)
+	if d == nil {
+		return nil, autherrors.ErrUserNotFound
+	}
+	if canonical, ok := d.NormalizeLocalpart(base); ok {
+		base = canonical
+	}
+	if err := d.checkFrozen(); err != nil {
+		return nil, err
+	}
+
+	exists, err := d.AuthAgent.UserExists(ctx, base)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, autherrors.ErrUserNotFound
+	}
+	ok, err := accepted(d, base)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		d.recordLogin(ctx, base, auth.LoginFailure)
+		return nil, autherrors.ErrAuthFailed
+	}
+	if err := d.checkCanLogin(ctx, base); err != nil {
+		return nil, err
+	}
+	if err := d.checkNetwork(ctx, base); err != nil {
+		return nil, err
+	}
+	newLocation := d.newLoginLocation(ctx, base)
+	d.recordLogin(ctx, base, auth.LoginSuccess)
+
+	session, err := d.passwordlessSession(ctx, base, cred)
+	if err != nil {
+		return nil, err
+	}
+	result := &AuthResult{Session: session, Domain: d, Extension: extension, Host: host}
+	if newLocation {
+		result.notify = base
+	}
+	return result, nil
+}
+
+// agentAcceptsCert reports whether the domain's agent maps cert to base,
+// for agents implementing auth.ExternalAuthenticator such as certauth.
+func (d *Domain) agentAcceptsCert(ctx context.Context, base string, cert CertInfo) (bool, error) {
+	ea, ok := auth.AsExternalAuthenticator(d.AuthAgent)
+	if !ok {
+		return false, nil
+	}
+	_, err := ea.AuthenticateExternal(ctx, auth.ExternalIdentity{
+		Username:    base,
+		Fingerprint: cert.Fingerprint,
+		Subject:     cert.Subject,
+		Emails:      cert.Emails,
+	})
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, autherrors.ErrAuthFailed), errors.Is(err, autherrors.ErrUserNotFound):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// checkCanLogin fails with errors.ErrAccountDisabled if the domain's agent
+// reports that base may not log in (see auth.AccountStatus), and with
+// errors.ErrServiceDenied if not to the context's protocol.
+func (d *Domain) checkCanLogin(ctx context.Context, base string) error {
+	sp, ok := auth.AsAccountStatusProvider(d.AuthAgent)
+	if !ok {
+		return nil
+	}
+	status, err := sp.AccountStatus(ctx, base)
+	if err != nil {
+		return err
+	}
+	if !status.CanLogin() {
+		return fmt.Errorf("%w: %s", autherrors.ErrAccountDisabled, base)
+	}
+	return checkService(ctx, base, status.Services)
+}
+
+// checkService fails with errors.ErrServiceDenied unless services allows
+// the context's protocol.
+func checkService(ctx context.Context, base string, services auth.ServiceSet) error {
+	if protocol := protocolFromContext(ctx); !services.Allows(protocol) {
+		return fmt.Errorf("%w: %s may not use %s", autherrors.ErrServiceDenied, base, protocol)
+	}
+	return nil
+}
+
+// passwordlessSession returns a session for base opened with cred, for
+// logins that involve no password: it carries the user's mailbox, the
+// domain's gid and the public key but no private key.
+func (d *Domain) passwordlessSession(ctx context.Context, base string, cred auth.Credential) (*auth.AuthSession, error) {
+	user := &auth.User{Username: base, Gid: d.Gid}
+	mailbox, err := d.Mailbox(base, user)
+	if err != nil {
+		return nil, err
+	}
+	user.Mailbox = mailbox
+	session := &auth.AuthSession{User: user, Credential: cred}
+	if kp, ok := auth.AsKeyProvider(d.AuthAgent); ok {
+		if pub, err := kp.GetPublicKey(ctx, base); err == nil {
+			session.PublicKey = pub
+			session.EncryptionEnabled = true
+		} else if !errors.Is(err, autherrors.ErrKeyNotFound) {
+			return nil, err
+		}
+	}
+	return session, nil
+}
@@ -0,0 +1,169 @@
+package domain
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/infodancer/auth"
+	_ "github.com/infodancer/auth/certauth"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// newClientCert returns a self-signed client certificate for cn with the
+// given email addresses.
+func newClientCert(t *testing.T, cn string, emails ...string) *x509.Certificate {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(1),
+		Subject:        pkix.Name{CommonName: cn, Organization: []string{"Example"}},
+		EmailAddresses: emails,
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestAuthRouter_AuthenticateExternal(t *testing.T) {
+	p, base := newTestDomainsTree(t, "backup:x:backup\nrelay:x:relay\nalice:x:alice\nlocked:x:locked::locked\n", "example.com")
+	backup := CertInfoFromCertificate(newClientCert(t, "backup", "backup@example.com"))
+	relay := CertInfoFromCertificate(newClientCert(t, "relay.example.com"))
+	stranger := CertInfoFromCertificate(newClientCert(t, "stranger", "alice@example.com"))
+	lockedCert := CertInfoFromCertificate(newClientCert(t, "locked", "locked@example.com"))
+	mapping := "# machine accounts\n" +
+		"backup sha256:" + backup.Fingerprint + "\n" +
+		"relay  subject:" + relay.Subject + "\n" +
+		"locked sha256:" + lockedCert.Fingerprint + "\n" +
+		"garbage\n"
+	if err := os.WriteFile(filepath.Join(base, "example.com", ClientCertsFile), []byte(mapping), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	r := NewAuthRouter(p, nil).WithRateLimit(RateLimitConfig{MaxFailuresPerUser: 2, Window: time.Minute, Lockout: time.Minute})
+	defer func() { _ = r.Close() }()
+	ctx := context.Background()
+
+	// The certificate's email address is the identity.
+	result, err := r.AuthenticateExternal(ctx, backup)
+	if err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	s := result.Session
+	if s.User.Username != "backup" || s.User.Mailbox != "backup@example.com" ||
+		s.Credential.Kind != auth.CredentialCertificate || s.Credential.ID != backup.Fingerprint || result.Domain.Name != "example.com" {
+		t.Errorf("backup session = %+v, credential %+v", s.User, s.Credential)
+	}
+
+	// A certificate without an email needs an explicit identity.
+	if _, err := r.AuthenticateExternal(ctx, relay); !errors.Is(err, autherrors.ErrUserNotFound) {
+		t.Errorf("relay without authzid: err = %v, want ErrUserNotFound", err)
+	}
+	relay.AuthzID = "relay@example.com"
+	if _, err := r.AuthenticateExternal(ctx, relay); err != nil {
+		t.Errorf("relay by subject: %v", err)
+	}
+
+	// A mapped certificate opens only the account it is mapped to.
+	backup.AuthzID = "alice@example.com"
+	if _, err := r.AuthenticateExternal(ctx, backup); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("backup as alice: err = %v, want ErrAuthFailed", err)
+	}
+	if _, err := r.AuthenticateExternal(ctx, stranger); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("unmapped certificate: err = %v, want ErrAuthFailed", err)
+	}
+	// Two failures for alice trip the per-user limit.
+	if _, err := r.AuthenticateExternal(ctx, stranger); !errors.Is(err, autherrors.ErrRateLimited) {
+		t.Errorf("after failures: err = %v, want ErrRateLimited", err)
+	}
+
+	if _, err := r.AuthenticateExternal(ctx, lockedCert); !errors.Is(err, autherrors.ErrAccountDisabled) {
+		t.Errorf("locked account: err = %v, want ErrAccountDisabled", err)
+	}
+	other := CertInfo{Fingerprint: backup.Fingerprint, AuthzID: "backup@elsewhere.com"}
+	if _, err := r.AuthenticateExternal(ctx, other); !errors.Is(err, autherrors.ErrUserNotFound) {
+		t.Errorf("unserved domain: err = %v, want ErrUserNotFound", err)
+	}
+}
+
+func TestAuthRouter_AuthenticateExternal_Agent(t *testing.T) {
+	p, base := newTestDomainsTree(t, "alice:x:alice\n", "example.com")
+	relayCert := newClientCert(t, "relay", "relay@example.com")
+	relay := CertInfoFromCertificate(relayCert)
+	certsDir := filepath.Join(base, "example.com", "certs")
+	if err := os.Mkdir(certsDir, 0o750); err != nil {
+		t.Fatal(err)
+	}
+	relayPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: relayCert.Raw})
+	if err := os.WriteFile(filepath.Join(certsDir, "relay.pem"), relayPEM, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	writeDomainConfig(t, base, "example.com", "[[auth.chain]]\ntype = \"passwd\"\ncredential_backend = \"passwd\"\nkey_backend = \"keys\"\n\n"+
+		"[[auth.chain]]\ntype = \"certauth\"\ncredential_backend = \"certs\"\n")
+	r := NewAuthRouter(p, nil)
+	defer func() { _ = r.Close() }()
+	ctx := context.Background()
+
+	// relay is known only to the certificate backend.
+	result, err := r.AuthenticateExternal(ctx, relay)
+	if err != nil {
+		t.Fatalf("relay: %v", err)
+	}
+	if s := result.Session; s.User.Mailbox != "relay@example.com" || s.Credential.Kind != auth.CredentialCertificate {
+		t.Errorf("relay session = %+v, credential %+v", s.User, s.Credential)
+	}
+	if _, err := r.Authenticate(ctx, "relay@example.com", "x"); !errors.Is(err, autherrors.ErrMechanismUnsupported) {
+		t.Errorf("relay password: err = %v, want ErrMechanismUnsupported", err)
+	}
+	relay.AuthzID = "alice@example.com"
+	if _, err := r.AuthenticateExternal(ctx, relay); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("relay as alice: err = %v, want ErrAuthFailed", err)
+	}
+}
+
+func TestAuthRouter_AuthenticatePrincipal(t *testing.T) {
+	p, _ := newTestDomainsTree(t, "alice:x:alice\nlocked:x:locked::locked\n", "example.com")
+	r := NewAuthRouter(p, nil)
+	defer func() { _ = r.Close() }()
+	ctx := context.Background()
+
+	result, err := r.AuthenticatePrincipal(ctx, "alice@example.com", "alice@EXAMPLE.COM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := result.Session
+	if s.User.Username != "alice" || s.User.Mailbox != "alice@example.com" ||
+		s.Credential.Kind != auth.CredentialKerberos || s.Credential.ID != "alice@EXAMPLE.COM" {
+		t.Errorf("session = %+v, credential %+v", s.User, s.Credential)
+	}
+
+	for address, want := range map[string]error{
+		"bob@example.com":    autherrors.ErrUserNotFound,
+		"alice@example.org":  autherrors.ErrUserNotFound,
+		"locked@example.com": autherrors.ErrAccountDisabled,
+	} {
+		if _, err := r.AuthenticatePrincipal(ctx, address, "x@EXAMPLE.COM"); !errors.Is(err, want) {
+			t.Errorf("%s: err = %v, want %v", address, err, want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// DefaultMaxForwardRecipients is the fan-out limit of domains that do not
+// set LimitsConfig.MaxForwardRecipients.
+const DefaultMaxForwardRecipients = 1000
+
+// forwardRecipientLimit returns the domain's fan-out limit.
+func (c LimitsConfig) forwardRecipientLimit() int {
+	if c.MaxForwardRecipients > 0 {
+		return c.MaxForwardRecipients
+	}
+	return DefaultMaxForwardRecipients
+}
+
+// fanOutKey is the context key of the fanOut of a message being delivered.
+type fanOutKey struct{}
+
+// fanOut counts the final recipients one inbound message has reached as it
+// is forwarded from domain to domain. The limit is that of the domain the
+// message was first delivered to. Deliveries of one message are sequential,
+// so no locking is needed.
+type fanOut struct {
+	recipient string
+	limit     int
+	n         int
+	seen      map[string]bool // final recipients reached, by recipientKey
+}
+
+// withFanOut returns the fanOut carried by ctx, or attaches a new one for a
+// message to recipient with the given limit.
+func withFanOut(ctx context.Context, recipient string, limit int) (context.Context, *fanOut) {
+	if f, ok := ctx.Value(fanOutKey{}).(*fanOut); ok {
+		return ctx, f
+	}
+	f := newFanOut(recipient, limit)
+	return context.WithValue(ctx, fanOutKey{}, f), f
+}
+
+// newFanOut returns a fanOut for a message to recipient.
+func newFanOut(recipient string, limit int) *fanOut {
+	return &fanOut{recipient: recipient, limit: limit, seen: make(map[string]bool)}
+}
+
+// recipientKey identifies a final recipient: address, or the folder of its
+// mailbox a "=Folder" target files into.
+func recipientKey(address, folder string) string {
+	key := strings.ToLower(address)
+	if folder != "" {
+		key += " =" + folder
+	}
+	return key
+}
+
+// check fails with ErrForwardFanOutExceeded if n more recipients would
+// exceed the limit.
+func (f *fanOut) check(n int) error {
+	if f.n+n > f.limit {
+		return fmt.Errorf("%w: %s expands to more than %d recipients",
+			autherrors.ErrForwardFanOutExceeded, f.recipient, f.limit)
+	}
+	return nil
+}
+
+// add counts the final recipient key (see recipientKey). first is false,
+// and nothing is counted, if the message already reached it by another
+// path.
+func (f *fanOut) add(key string) (first bool, err error) {
+	if f.seen[key] {
+		return false, nil
+	}
+	if err := f.check(1); err != nil {
+		return false, err
+	}
+	f.n++
+	f.seen[key] = true
+	return true, nil
+}
+
+// countRecipient counts one final recipient against the fanOut on ctx, if
+// any, failing instead if the limit is reached. first is false if the
+// message already reached key, so that it is delivered there once, as
+// ResolveFinalRecipients reports it once.
+func countRecipient(ctx context.Context, key string) (first bool, err error) {
+	f, ok := ctx.Value(fanOutKey{}).(*fanOut)
+	if !ok {
+		return true, nil
+	}
+	return f.add(key)
+}
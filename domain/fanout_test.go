@@ -0,0 +1,183 @@
+package domain
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/forwards"
+	"github.com/infodancer/msgstore"
+)
+
+// listTargets returns n comma-separated addresses user0@domain...
+func listTargets(n int, domain string) string {
+	targets := make([]string, n)
+	for i := range targets {
+		targets[i] = fmt.Sprintf("user%d@%s", i, domain)
+	}
+	return strings.Join(targets, ",")
+}
+
+func TestResolveFinalRecipients_FanOutLimit(t *testing.T) {
+	d := forwardingDomain("this.com", nil, map[string]string{
+		"small": listTargets(3, "elsewhere.net"),
+		"big":   listTargets(4, "elsewhere.net"),
+		"lists": "small@this.com,big@this.com",
+	})
+	d.Limits.MaxForwardRecipients = 3
+	provider := &stubDomainProvider{domains: map[string]*Domain{"this.com": d}}
+
+	got, err := ResolveFinalRecipients(context.Background(), provider, "small@this.com")
+	if err != nil || len(got) != 3 {
+		t.Fatalf("small: %d deliveries, err %v", len(got), err)
+	}
+	for _, addr := range []string{"big@this.com", "lists@this.com"} {
+		if _, err := ResolveFinalRecipients(context.Background(), provider, addr); !errors.Is(err, autherrors.ErrForwardFanOutExceeded) {
+			t.Errorf("%s: err = %v, want ErrForwardFanOutExceeded", addr, err)
+		}
+	}
+}
+
+func TestResolveFinalRecipients_DefaultFanOutLimit(t *testing.T) {
+	provider := &stubDomainProvider{domains: map[string]*Domain{
+		"this.com": forwardingDomain("this.com", nil, map[string]string{
+			"all": listTargets(DefaultMaxForwardRecipients+1, "elsewhere.net"),
+		}),
+	}}
+	if _, err := ResolveFinalRecipients(context.Background(), provider, "all@this.com"); !errors.Is(err, autherrors.ErrForwardFanOutExceeded) {
+		t.Errorf("err = %v, want ErrForwardFanOutExceeded", err)
+	}
+}
+
+func TestMailDeliveryAgent_FanOutLimit(t *testing.T) {
+	otherInner := &stubDeliveryAgent{}
+	provider := &stubDomainProvider{domains: map[string]*Domain{}}
+	other := &MailDeliveryAgent{
+		inner:    otherInner,
+		chain:    &forwardChain{domainForwards: forwards.FromMap(nil), defaultForwards: forwards.FromMap(nil)},
+		provider: provider,
+	}
+	provider.domains["other.com"] = &Domain{Name: "other.com", DeliveryAgent: other}
+
+	inner := &stubDeliveryAgent{}
+	agent := &MailDeliveryAgent{
+		inner: inner,
+		chain: &forwardChain{
+			domainForwards: forwards.FromMap(map[string]string{
+				"team":  listTargets(3, "other.com"),
+				"crowd": listTargets(4, "other.com"),
+			}),
+			defaultForwards: forwards.FromMap(nil),
+		},
+		provider: provider,
+		limits:   LimitsConfig{MaxForwardRecipients: 3},
+	}
+
+	env := msgstore.Envelope{Recipients: []string{"team@this.com"}}
+	if err := agent.Deliver(context.Background(), env, bytes.NewReader([]byte("test"))); err != nil {
+		t.Fatalf("team: %v", err)
+	}
+	if len(otherInner.delivered) != 3 {
+		t.Fatalf("team: %d deliveries, want 3", len(otherInner.delivered))
+	}
+
+	// A rule over the limit is refused before anything is delivered.
+	otherInner.delivered = nil
+	env = msgstore.Envelope{Recipients: []string{"crowd@this.com"}}
+	err := agent.Deliver(context.Background(), env, bytes.NewReader([]byte("test")))
+	if !errors.Is(err, autherrors.ErrForwardFanOutExceeded) {
+		t.Errorf("crowd: err = %v, want ErrForwardFanOutExceeded", err)
+	}
+	if len(otherInner.delivered) != 0 {
+		t.Errorf("crowd: %d deliveries, want none", len(otherInner.delivered))
+	}
+}
+
+func TestMailDeliveryAgent_FanOutLimitAcrossDomains(t *testing.T) {
+	provider := &stubDomainProvider{domains: map[string]*Domain{}}
+	otherInner := &stubDeliveryAgent{}
+	other := &MailDeliveryAgent{
+		inner: otherInner,
+		chain: &forwardChain{
+			domainForwards: forwards.FromMap(map[string]string{
+				"a": listTargets(2, "far.com"),
+				"b": "x@far.com,y@far.com",
+			}),
+			defaultForwards: forwards.FromMap(nil),
+		},
+		provider: provider,
+	}
+	farInner := &stubDeliveryAgent{}
+	far := &MailDeliveryAgent{
+		inner:    farInner,
+		chain:    &forwardChain{domainForwards: forwards.FromMap(nil), defaultForwards: forwards.FromMap(nil)},
+		provider: provider,
+	}
+	provider.domains["other.com"] = &Domain{Name: "other.com", DeliveryAgent: other}
+	provider.domains["far.com"] = &Domain{Name: "far.com", DeliveryAgent: far}
+
+	// The first domain's limit applies to the whole expansion, even though
+	// other.com's own rules each stay under it.
+	agent := &MailDeliveryAgent{
+		inner: &stubDeliveryAgent{},
+		chain: &forwardChain{
+			domainForwards:  forwards.FromMap(map[string]string{"lists": "a@other.com,b@other.com"}),
+			defaultForwards: forwards.FromMap(nil),
+		},
+		provider: provider,
+		limits:   LimitsConfig{MaxForwardRecipients: 3},
+	}
+	env := msgstore.Envelope{Recipients: []string{"lists@this.com"}}
+	err := agent.Deliver(context.Background(), env, bytes.NewReader([]byte("test")))
+	if !errors.Is(err, autherrors.ErrForwardFanOutExceeded) {
+		t.Errorf("err = %v, want ErrForwardFanOutExceeded", err)
+	}
+	if len(farInner.delivered) != 2 {
+		t.Errorf("%d deliveries, want the first list's 2", len(farInner.delivered))
+	}
+}
+
+func TestMailDeliveryAgent_ForwardLoop(t *testing.T) {
+	provider := &stubDomainProvider{domains: map[string]*Domain{}}
+	newAgent := func(rules map[string]string) (*MailDeliveryAgent, *stubDeliveryAgent) {
+		inner := &stubDeliveryAgent{}
+		return &MailDeliveryAgent{
+			inner:    inner,
+			chain:    &forwardChain{domainForwards: forwards.FromMap(rules), defaultForwards: forwards.FromMap(nil)},
+			provider: provider,
+		}, inner
+	}
+	this, thisInner := newAgent(map[string]string{"a": "b@other.com"})
+	other, otherInner := newAgent(map[string]string{"b": "a@this.com"})
+	provider.domains["this.com"] = &Domain{Name: "this.com", DeliveryAgent: this}
+	provider.domains["other.com"] = &Domain{Name: "other.com", DeliveryAgent: other}
+
+	env := msgstore.Envelope{Recipients: []string{"a@this.com"}}
+	err := this.Deliver(context.Background(), env, bytes.NewReader([]byte("test")))
+	if !errors.Is(err, autherrors.ErrForwardLoop) {
+		t.Errorf("mutual forward: err = %v, want ErrForwardLoop", err)
+	}
+	if len(thisInner.delivered)+len(otherInner.delivered) != 0 {
+		t.Errorf("mutual forward delivered %d messages", len(thisInner.delivered)+len(otherInner.delivered))
+	}
+
+	// A chain longer than MaxForwardDepth is cut off.
+	rules := make(map[string]string)
+	for i := 0; i <= MaxForwardDepth; i++ {
+		rules[fmt.Sprintf("hop%d", i)] = fmt.Sprintf("hop%d@deep.com", i+1)
+	}
+	deep, deepInner := newAgent(rules)
+	provider.domains["deep.com"] = &Domain{Name: "deep.com", DeliveryAgent: deep}
+	env = msgstore.Envelope{Recipients: []string{"hop0@deep.com"}}
+	err = deep.Deliver(context.Background(), env, bytes.NewReader([]byte("test")))
+	if !errors.Is(err, autherrors.ErrForwardDepthExceeded) {
+		t.Errorf("deep chain: err = %v, want ErrForwardDepthExceeded", err)
+	}
+	if len(deepInner.delivered) != 0 {
+		t.Errorf("deep chain delivered %d messages", len(deepInner.delivered))
+	}
+}
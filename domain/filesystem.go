@@ -1,16 +1,22 @@
 package domain
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
-	"os"
+	"maps"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/infodancer/auth"
 	"github.com/infodancer/auth/forwards"
+	"github.com/infodancer/auth/lease"
+	"github.com/infodancer/auth/loginstate"
+	"github.com/infodancer/auth/sessions"
+	"github.com/infodancer/auth/tracing"
 	"github.com/infodancer/msgstore"
 )
 
@@ -25,14 +31,21 @@ import (
 //   - domains.toml — per-domain behavior overrides managed by the system postmaster
 //   - postmaster   — authoritative domain GIDs, postmaster UIDs, and data paths
 //
+// Configuration is read through an FS (the local disk by default, see
+// WithFS), and so are the passwd files and keys of file-backed auth agents;
+// mailboxes are not.
+//
 // Directory structure:
 //
 //	/etc/mail/domains/
 //	├── config.toml       (optional; system-wide defaults incl. [forwards])
 //	├── domains.toml      (optional; per-domain overrides with ["example.com"] sections)
 //	├── postmaster        (optional; address:uid:gid:data-path entries)
+//	├── .templates/       (optional; named templates for CreateDomain)
+//	├── .readonly         (optional; marks a read-only secondary, see WithReadOnly)
 //	├── example.com/
-//	│   └── config.toml   (optional when defaults are set; domain-admin editable)
+//	│   ├── config.toml   (optional when defaults are set; domain-admin editable)
+//	│   └── user_metadata.toml (optional; per-user attributes, see UserMetadata)
 //	├── other.org/
 //	│   └── config.toml
 type FilesystemDomainProvider struct {
@@ -42,9 +55,26 @@ type FilesystemDomainProvider struct {
 	baseDefaults    *DomainConfig               // loaded from {basePath}/config.toml
 	domainOverrides DomainsConfig               // loaded from {basePath}/domains.toml
 	postmaster      map[string]*PostmasterEntry // loaded from {basePath}/postmaster
-	cache           map[string]*Domain
+	dedupWindow     time.Duration               // 0 disables delivery deduplication
+	relay           Relayer                     // outbound hook for forwards to unserved domains
+	limits          ResourceLimits              // zero value: no caps
+	historyPerUser  int                         // 0 disables login history
+	loginState      bool                        // set by WithLoginState
+	sessions        bool                        // set by WithSessions
+	loginNotifier   LoginNotifier               // set by WithLoginNotifier
+	readOnly        bool                        // set by WithReadOnly
+	pepperFile      string                      // set by WithPepperFile
+	leases          *lease.Manager              // set by WithLeaseManager
+	fs              FS                          // OSFS unless set by WithFS
+	cache           map[string]*cachedDomain
 	mu              sync.RWMutex
 	logger          *slog.Logger
+
+	// Subscribe's shared watcher, guarded by watchMu (see events.go).
+	watchMu       sync.Mutex
+	watch         *watcher
+	watchInterval time.Duration
+	watchClosed   bool
 }
 
 // NewFilesystemDomainProvider creates a new filesystem-based domain provider.
@@ -56,18 +86,11 @@ func NewFilesystemDomainProvider(basePath string, logger *slog.Logger) *Filesyst
 	}
 	p := &FilesystemDomainProvider{
 		basePath: basePath,
-		cache:    make(map[string]*Domain),
+		cache:    make(map[string]*cachedDomain),
 		logger:   logger,
+		fs:       OSFS{},
 	}
-	if baseCfg, err := LoadDomainConfig(filepath.Join(basePath, "config.toml")); err == nil {
-		p.baseDefaults = baseCfg
-	}
-	if overrides, err := LoadDomainsConfig(filepath.Join(basePath, "domains.toml")); err == nil {
-		p.domainOverrides = overrides
-	}
-	if entries, err := ParsePostmasterFile(filepath.Join(basePath, "postmaster")); err == nil {
-		p.postmaster = entries
-	}
+	p.loadBaseFiles()
 	return p
 }
 
@@ -88,16 +111,103 @@ func (p *FilesystemDomainProvider) WithDataPath(path string) *FilesystemDomainPr
 	return p
 }
 
+// WithDeliveryDedup enables delivery deduplication for every loaded domain.
+// Deliveries carrying a delivery ID (see WithDeliveryID) are recorded in a
+// .delivery_dedup file in each domain's data directory for window
+// (DefaultDedupWindow if zero); a retried delivery with the same ID skips
+// recipients already delivered.
+// Returns the provider to allow chaining.
+func (p *FilesystemDomainProvider) WithDeliveryDedup(window time.Duration) *FilesystemDomainProvider {
+	if window <= 0 {
+		window = DefaultDedupWindow
+	}
+	p.dedupWindow = window
+	return p
+}
+
+// WithLoginHistory enables per-domain login history, retaining the newest
+// perUser records for each account (DefaultLoginHistoryPerUser if zero).
+// Records are stored in .login_history in each domain's data directory and
+// written by AuthRouter for attempts against existing users.
+func (p *FilesystemDomainProvider) WithLoginHistory(perUser int) *FilesystemDomainProvider {
+	if perUser <= 0 {
+		perUser = DefaultLoginHistoryPerUser
+	}
+	p.historyPerUser = perUser
+	return p
+}
+
+// WithLoginState enables per-domain login state: each account's last
+// successful login and the failed attempts since (see package loginstate).
+// It is stored in .login_state in each domain's data directory and written
+// by AuthRouter for attempts against existing users.
+func (p *FilesystemDomainProvider) WithLoginState() *FilesystemDomainProvider {
+	p.loginState = true
+	return p
+}
+
+// WithSessions enables per-domain session registries (see package
+// sessions), kept in .sessions in each domain's data directory. AuthRouter
+// then serves as an auth.SessionStore, for a token.Agent to register and
+// check its tokens in.
+func (p *FilesystemDomainProvider) WithSessions() *FilesystemDomainProvider {
+	p.sessions = true
+	return p
+}
+
+// WithLoginNotifier installs n to be told of logins from new locations in
+// domains that enable login notices (see LoginNotifyConfig), in place of
+// delivering the notice mail.
+// Returns the provider to allow chaining.
+func (p *FilesystemDomainProvider) WithLoginNotifier(n LoginNotifier) *FilesystemDomainProvider {
+	p.loginNotifier = n
+	return p
+}
+
+// WithPepperFile sets the pepper file (see passwd.LoadPeppers) of the auth
+// agents of domains whose [auth] options name none with "pepper_file".
+// A relative path there is resolved against the domain directory; path
+// here should be absolute. Chain members inherit the domain's. Domains
+// already loaded are not affected until they are evicted.
+// Returns the provider to allow chaining.
+func (p *FilesystemDomainProvider) WithPepperFile(path string) *FilesystemDomainProvider {
+	p.pepperFile = path
+	return p
+}
+
+// WithLeaseManager makes the auth agents of domains hold m's lease on
+// their credential backend while they write it, as they do to upgrade
+// hashes at login, for hosts sharing one domains tree (see
+// passwd.WithLeaseManager). Domains already loaded are not affected until
+// they are evicted.
+// Returns the provider to allow chaining.
+func (p *FilesystemDomainProvider) WithLeaseManager(m *lease.Manager) *FilesystemDomainProvider {
+	p.leases = m
+	return p
+}
+
+// WithRelay installs r as the outbound hook used when a forward target's
+// domain is not served by this provider. Without a relay such forwards fail.
+// Returns the provider to allow chaining.
+func (p *FilesystemDomainProvider) WithRelay(r Relayer) *FilesystemDomainProvider {
+	p.relay = r
+	return p
+}
+
 // GetDomain returns the Domain for a given domain name.
 // Returns nil if the domain is not handled.
 func (p *FilesystemDomainProvider) GetDomain(name string) *Domain {
 	name = strings.ToLower(name)
+	if !validDirName(name) {
+		return nil
+	}
 
 	// Check cache first
 	p.mu.RLock()
-	if domain, ok := p.cache[name]; ok {
+	if cd, ok := p.cache[name]; ok {
 		p.mu.RUnlock()
-		return domain
+		cd.touch()
+		return cd.domain
 	}
 	p.mu.RUnlock()
 
@@ -107,18 +217,25 @@ func (p *FilesystemDomainProvider) GetDomain(name string) *Domain {
 
 	if p.defaults != nil {
 		// With defaults: domain directory must exist; config.toml is optional
-		if _, err := os.Stat(domainPath); os.IsNotExist(err) {
+		if !p.exists(domainPath) {
 			return nil
 		}
 	} else {
 		// Without defaults: config.toml is required
-		if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		if !p.exists(configPath) {
 			return nil
 		}
 	}
 
-	// Load config and create Domain
+	// Load config and create Domain. The provider API carries no context,
+	// so the span is not a child of the login that caused the load.
+	_, span := tracing.Start(context.Background(), "auth.LoadDomain",
+		tracing.String(tracing.AttrDomain, name))
 	domain, err := p.loadDomain(name, domainPath, configPath)
+	if domain != nil {
+		span.SetAttributes(tracing.String(tracing.AttrBackend, domain.backend))
+	}
+	tracing.End(span, err)
 	if err != nil {
 		p.logger.Error("failed to load domain",
 			slog.String("domain", name),
@@ -133,9 +250,13 @@ func (p *FilesystemDomainProvider) GetDomain(name string) *Domain {
 		p.mu.Unlock()
 		// Clean up the one we just created
 		_ = domain.Close()
-		return existing
+		existing.touch()
+		return existing.domain
 	}
-	p.cache[name] = domain
+	cd := &cachedDomain{domain: domain}
+	cd.touch()
+	p.cache[name] = cd
+	p.evictLocked(name)
 	p.mu.Unlock()
 
 	return domain
@@ -149,61 +270,23 @@ func (p *FilesystemDomainProvider) GetDomain(name string) *Domain {
 //  4. Per-domain config.toml
 //  5. Postmaster GID (authoritative, applied post-merge)
 func (p *FilesystemDomainProvider) loadDomain(name, domainPath, configPath string) (*Domain, error) {
-	// Build config layers (lowest to highest priority).
-	var layers []map[string]any
-
-	// 1. Programmatic defaults (from WithDefaults).
-	if p.defaults != nil {
-		m, err := toTOMLMap(*p.defaults)
-		if err != nil {
-			return nil, fmt.Errorf("marshal defaults: %w", err)
-		}
-		layers = append(layers, m)
-	}
-
-	// 2. System config.toml ({basePath}/config.toml).
-	if p.baseDefaults != nil {
-		m, err := toTOMLMap(*p.baseDefaults)
-		if err != nil {
-			return nil, fmt.Errorf("marshal base defaults: %w", err)
-		}
-		layers = append(layers, m)
-	}
-
-	// 3. domains.toml per-domain overrides.
-	if override, ok := p.domainOverrides[name]; ok {
-		m, err := toTOMLMap(override)
-		if err != nil {
-			return nil, fmt.Errorf("marshal domain overrides: %w", err)
-		}
-		layers = append(layers, m)
+	cfg, perDomainMap, err := p.mergedConfig(name, configPath)
+	if err != nil {
+		return nil, err
 	}
 
-	// 4. Per-domain config.toml (highest priority for config values).
-	var perDomainMap map[string]any
-	if _, err := os.Stat(configPath); err == nil {
-		m, err := loadTOMLMap(configPath)
-		if err != nil {
-			return nil, fmt.Errorf("load config: %w", err)
-		}
-		perDomainMap = m
-		layers = append(layers, m)
-	} else if p.defaults == nil {
-		return nil, fmt.Errorf("no config.toml and no defaults set for domain %s", name)
+	logger, err := domainLogger(p.logger, name, cfg.Log)
+	if err != nil {
+		return nil, fmt.Errorf("configure logging: %w", err)
 	}
 
-	// Merge all layers into final config.
-	var cfg DomainConfig
-	if err := mergeConfigLayers(&cfg, layers...); err != nil {
-		return nil, fmt.Errorf("merge config: %w", err)
+	norm, err := newNormalizer(cfg.Normalize)
+	if err != nil {
+		return nil, err
 	}
-
-	// Postmaster GID is authoritative — applied after all config merges so that
-	// neither system defaults nor domain-admin config.toml can override it.
-	if p.postmaster != nil {
-		if entry, ok := p.postmaster[name]; ok && entry.GID != 0 {
-			cfg.Gid = entry.GID
-		}
+	mailbox, err := mailboxMapper(cfg.MsgStore.Mailbox)
+	if err != nil {
+		return nil, err
 	}
 
 	// Create lazy auth agent — defers OpenAuthAgent() until the first
@@ -211,13 +294,27 @@ func (p *FilesystemDomainProvider) loadDomain(name, domainPath, configPath strin
 	// privilege-dropped processes (e.g., mail-session oneshot delivery)
 	// to use GetDomain() for forwarding/spam/sieve without needing read
 	// access to credential files.
+	degraded, err := cfg.Degraded.cache()
+	if err != nil {
+		return nil, err
+	}
+	authCfg := cfg.Auth.withDefaultOption("pepper_file", p.pepperFile)
+	readOnly := p.ReadOnly()
+	agentCfg := authCfg.agentConfig(domainPath, p.fs, readOnly)
+	agentCfg.Leases = p.leases
 	authAgent := &lazyAuthAgent{
-		cfg: auth.AuthAgentConfig{
-			Type:              cfg.Auth.Type,
-			CredentialBackend: resolvePath(domainPath, cfg.Auth.CredentialBackend),
-			KeyBackend:        resolvePath(domainPath, cfg.Auth.KeyBackend),
-			Options:           cfg.Auth.Options,
-		},
+		cfg:      agentCfg,
+		logger:   logger,
+		degraded: degraded,
+	}
+	for _, member := range authCfg.Chain {
+		if member.EscrowPubKey == "" {
+			member.EscrowPubKey = authCfg.EscrowPubKey
+		}
+		member = member.withDefaultOption("pepper_file", authCfg.Options["pepper_file"])
+		memberCfg := member.agentConfig(domainPath, p.fs, readOnly)
+		memberCfg.Leases = p.leases
+		authAgent.chain = append(authAgent.chain, memberCfg)
 	}
 
 	// Create message store. The data path comes from (highest priority first):
@@ -277,21 +374,41 @@ func (p *FilesystemDomainProvider) loadDomain(name, domainPath, configPath strin
 	}
 
 	// Wrap auth agent so UserExists returns true for forward-only addresses.
+	bounces := cfg.Bounces.rules(authAgent)
 	finalAuth := &mailAuthAgent{
-		inner: authAgent,
-		chain: chain,
+		inner:   authAgent,
+		chain:   chain,
+		norm:    norm,
+		bounces: bounces,
+	}
+
+	if err := applyRoles(context.Background(), cfg.Roles, finalAuth, chain, logger); err != nil {
+		_ = finalAuth.Close()
+		if closer, ok := store.(interface{ Close() error }); ok {
+			_ = closer.Close()
+		}
+		return nil, err
 	}
 
 	// Wrap delivery agent to expand forwarding rules at delivery time.
-	var finalDelivery msgstore.DeliveryAgent = &MailDeliveryAgent{
+	mda := &MailDeliveryAgent{
 		inner:    store,
 		chain:    chain,
 		provider: p,
+		relay:    p.relay,
+		logger:   logger,
+		norm:     norm,
+		bounces:  bounces,
+		limits:   cfg.Limits,
+		users:    authAgent,
+	}
+	if p.dedupWindow > 0 {
+		mda.dedup = newDedupStore(p.writeFS(), filepath.Join(storageBase, ".delivery_dedup"), p.dedupWindow)
 	}
+	var finalDelivery msgstore.DeliveryAgent = mda
 
-	p.logger.Debug("loaded domain",
-		slog.String("domain", name),
-		slog.String("auth_type", cfg.Auth.Type),
+	logger.Debug("loaded domain",
+		slog.String("auth_type", authAgent.typeName()),
 		slog.String("store_type", cfg.MsgStore.Type))
 
 	dom := &Domain{
@@ -302,6 +419,52 @@ func (p *FilesystemDomainProvider) loadDomain(name, domainPath, configPath strin
 		MaxMessageSize:     cfg.MaxMessageSize,
 		RecipientRejection: cfg.RecipientRejection,
 		Limits:             cfg.Limits,
+		Logger:             logger,
+		RequiredRoles:      cfg.Roles.required(),
+		Senders:            cfg.Senders,
+		OAuth:              cfg.OAuth,
+		AcceptSubdomains:   cfg.AcceptSubdomains,
+		RequireTLSAuth:     cfg.RequireTLSAuth,
+		GAL:                cfg.GAL,
+		PasswordPolicy:     cfg.Password,
+		Gid:                cfg.Gid,
+		ReadOnly:           readOnly,
+		metadataPath:       filepath.Join(domainPath, UserMetadataFile),
+		clientCertsPath:    filepath.Join(domainPath, ClientCertsFile),
+		frozenPath:         filepath.Join(domainPath, FrozenFile),
+		fs:                 p.fs,
+		normalize:          norm,
+		mailbox:            mailbox,
+		backend:            authAgent.typeName(),
+	}
+	mda.frozen = func() bool {
+		_, frozen := dom.Frozen()
+		return frozen
+	}
+	if p.historyPerUser > 0 {
+		dom.history = newLoginHistory(p.writeFS(), filepath.Join(storageBase, ".login_history"), p.historyPerUser)
+	}
+	if p.loginState {
+		dom.loginState = loginstate.Open(storageBase)
+	}
+	if p.sessions {
+		dom.sessions = sessions.Open(storageBase).WithFS(p.writeFS())
+	}
+	if cfg.LoginNotify.Enabled {
+		var tmpl []byte
+		if cfg.LoginNotify.Template != "" {
+			tmplPath := resolvePath(domainPath, cfg.LoginNotify.Template)
+			if tmpl, err = p.readFile(tmplPath); err != nil {
+				logger.Warn("failed to read login notice template, using the default",
+					slog.String("path", tmplPath),
+					slog.String("error", err.Error()))
+			}
+		}
+		dom.loginNotify = newLoginNotifier(name, cfg.LoginNotify, tmpl, logger)
+		dom.loginNotify.hook = p.loginNotifier
+		if dom.history == nil && dom.loginState == nil {
+			logger.Warn("login notices need login history or login state, neither of which is enabled")
+		}
 	}
 
 	// Load DKIM signing key if configured.
@@ -309,15 +472,13 @@ func (p *FilesystemDomainProvider) loadDomain(name, domainPath, configPath strin
 		keyPath := resolvePath(domainPath, cfg.DKIM.PrivateKeyPath)
 		key, err := LoadDKIMKey(keyPath)
 		if err != nil {
-			p.logger.Warn("failed to load DKIM key",
-				slog.String("domain", name),
+			logger.Warn("failed to load DKIM key",
 				slog.String("path", keyPath),
 				slog.String("error", err.Error()))
 		} else {
 			dom.DKIMSelector = cfg.DKIM.Selector
 			dom.DKIMKey = key
-			p.logger.Info("DKIM signing enabled",
-				slog.String("domain", name),
+			logger.Info("DKIM signing enabled",
 				slog.String("selector", cfg.DKIM.Selector))
 		}
 	}
@@ -328,8 +489,9 @@ func (p *FilesystemDomainProvider) loadDomain(name, domainPath, configPath strin
 // Domains returns the list of domain names handled by this provider.
 // When defaults are set, all subdirectories are considered valid domains.
 // Without defaults, only subdirectories containing a config.toml are listed.
+// For large trees see DomainsIter and DomainsPage.
 func (p *FilesystemDomainProvider) Domains() []string {
-	entries, err := os.ReadDir(p.basePath)
+	entries, err := p.fs.ReadDir(p.basePath)
 	if err != nil {
 		p.logger.Debug("failed to read domains directory",
 			slog.String("path", p.basePath),
@@ -339,18 +501,8 @@ func (p *FilesystemDomainProvider) Domains() []string {
 
 	var domains []string
 	for _, entry := range entries {
-		if !entry.IsDir() {
-			continue
-		}
-		if p.defaults != nil {
-			// With defaults: any subdirectory is a valid domain
+		if p.isDomainEntry(entry) {
 			domains = append(domains, entry.Name())
-		} else {
-			// Without defaults: only directories with config.toml
-			configPath := filepath.Join(p.basePath, entry.Name(), "config.toml")
-			if _, err := os.Stat(configPath); err == nil {
-				domains = append(domains, entry.Name())
-			}
 		}
 	}
 	return domains
@@ -358,22 +510,128 @@ func (p *FilesystemDomainProvider) Domains() []string {
 
 // Close releases resources for all loaded domains.
 func (p *FilesystemDomainProvider) Close() error {
+	p.closeWatch()
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
 	var errs []error
-	for name, domain := range p.cache {
-		if err := domain.Close(); err != nil {
+	for name, cd := range p.cache {
+		if err := cd.domain.Close(); err != nil {
 			errs = append(errs, fmt.Errorf("close domain %s: %w", name, err))
 		}
 	}
-	p.cache = make(map[string]*Domain)
+	p.cache = make(map[string]*cachedDomain)
 	return errors.Join(errs...)
 }
 
-// resolvePath returns path as-is if absolute, or joined with base if relative.
+// mergedConfig merges the configuration layers for a domain, as documented
+// on loadDomain. It also returns the per-domain config.toml as a raw map (nil
+// when the file is absent) so callers can tell which sections it declares.
+func (p *FilesystemDomainProvider) mergedConfig(name, configPath string) (DomainConfig, map[string]any, error) {
+	// Build config layers (lowest to highest priority).
+	var layers []map[string]any
+
+	// 1. Programmatic defaults (from WithDefaults).
+	if p.defaults != nil {
+		m, err := toTOMLMap(*p.defaults)
+		if err != nil {
+			return DomainConfig{}, nil, fmt.Errorf("marshal defaults: %w", err)
+		}
+		layers = append(layers, m)
+	}
+
+	// 2. System config.toml ({basePath}/config.toml).
+	if p.baseDefaults != nil {
+		m, err := toTOMLMap(*p.baseDefaults)
+		if err != nil {
+			return DomainConfig{}, nil, fmt.Errorf("marshal base defaults: %w", err)
+		}
+		layers = append(layers, m)
+	}
+
+	// 3. domains.toml per-domain overrides.
+	if override, ok := p.domainOverrides[name]; ok {
+		m, err := toTOMLMap(override)
+		if err != nil {
+			return DomainConfig{}, nil, fmt.Errorf("marshal domain overrides: %w", err)
+		}
+		layers = append(layers, m)
+	}
+
+	// 4. Per-domain config.toml (highest priority for config values).
+	var perDomainMap map[string]any
+	if p.exists(configPath) {
+		m, err := p.loadTOMLMap(configPath)
+		if err != nil {
+			return DomainConfig{}, nil, fmt.Errorf("load config: %w", err)
+		}
+		perDomainMap = m
+		layers = append(layers, m)
+	} else if p.defaults == nil {
+		return DomainConfig{}, nil, fmt.Errorf("no config.toml and no defaults set for domain %s", name)
+	}
+
+	// Merge all layers into final config.
+	var cfg DomainConfig
+	if err := mergeConfigLayers(&cfg, layers...); err != nil {
+		return DomainConfig{}, nil, fmt.Errorf("merge config: %w", err)
+	}
+
+	// Postmaster GID is authoritative — applied after all config merges so that
+	// neither system defaults nor domain-admin config.toml can override it.
+	if p.postmaster != nil {
+		if entry, ok := p.postmaster[name]; ok && entry.GID != 0 {
+			cfg.Gid = entry.GID
+		}
+	}
+
+	return cfg, perDomainMap, nil
+}
+
+// agentConfig returns the registry configuration for c, resolving paths,
+// including Options["pepper_file"], against the domain directory.
+// File-backed agents read through fsys, and never write when readOnly.
+func (c DomainAuthConfig) agentConfig(domainPath string, fsys FS, readOnly bool) auth.AuthAgentConfig {
+	options := c.Options
+	pepperFile := c.Options["pepper_file"]
+	if c.EscrowPubKey != "" || pepperFile != "" {
+		options = make(map[string]string, len(c.Options)+2)
+		maps.Copy(options, c.Options)
+		if c.EscrowPubKey != "" {
+			options["escrow_pubkey"] = c.EscrowPubKey
+		}
+		if pepperFile != "" {
+			options["pepper_file"] = resolvePath(domainPath, pepperFile)
+		}
+	}
+	return auth.AuthAgentConfig{
+		Type:              c.Type,
+		CredentialBackend: resolvePath(domainPath, c.CredentialBackend),
+		KeyBackend:        resolvePath(domainPath, c.KeyBackend),
+		Options:           options,
+		FS:                fsys,
+		ReadOnly:          readOnly,
+	}
+}
+
+// withDefaultOption returns c with Options[key] set to value if it has no
+// such option, leaving c's own map alone. An empty value changes nothing.
+func (c DomainAuthConfig) withDefaultOption(key, value string) DomainAuthConfig {
+	if value == "" || c.Options[key] != "" {
+		return c
+	}
+	options := make(map[string]string, len(c.Options)+1)
+	maps.Copy(options, c.Options)
+	options[key] = value
+	c.Options = options
+	return c
+}
+
+// resolvePath returns path as-is if absolute or a URL, or joined with base
+// if relative.
 func resolvePath(base, path string) string {
-	if path == "" || filepath.IsAbs(path) {
+	if path == "" || filepath.IsAbs(path) || strings.Contains(path, "://") {
 		return path
 	}
 	return filepath.Join(base, path)
@@ -1,12 +1,14 @@
 package domain
 
 import (
+	"bytes"
 	"context"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
-	_ "github.com/infodancer/auth/passwd"
+	"github.com/infodancer/auth/passwd"
 	_ "github.com/infodancer/msgstore/maildir"
 )
 
@@ -228,6 +230,7 @@ func TestResolvePath(t *testing.T) {
 		{"absolute path", "/etc/domains/example.com", "/opt/mail/example.com/users", "/opt/mail/example.com/users"},
 		{"empty path", "/etc/domains/example.com", "", ""},
 		{"relative subdir", "/etc/domains/example.com", "data/keys", "/etc/domains/example.com/data/keys"},
+		{"url", "/etc/domains/example.com", "https://idp.example.com/realms/mail", "https://idp.example.com/realms/mail"},
 	}
 
 	for _, tt := range tests {
@@ -491,3 +494,103 @@ func TestDomain_Close(t *testing.T) {
 		t.Errorf("unexpected error: %v", err)
 	}
 }
+
+func TestFilesystemDomainProvider_AuthChain(t *testing.T) {
+	local, err := passwd.HashPassword("local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := passwd.HashPassword("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, base := newTestDomainsTree(t, "alice:"+local+":alice\n", "example.com")
+	dir := filepath.Join(base, "example.com")
+	if err := os.WriteFile(filepath.Join(dir, "passwd.legacy"),
+		[]byte("alice:"+legacy+":alice\nbob:"+legacy+":bob\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	config := `
+[[auth.chain]]
+type = "passwd"
+credential_backend = "passwd"
+key_backend = "keys"
+
+[[auth.chain]]
+type = "passwd"
+credential_backend = "passwd.legacy"
+key_backend = "keys"
+`
+	if err := os.WriteFile(filepath.Join(dir, "config.toml"), []byte(config), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewAuthRouter(p, nil)
+	ctx := context.Background()
+	if _, err := r.Authenticate(ctx, "alice@example.com", "local"); err != nil {
+		t.Errorf("alice via first agent: %v", err)
+	}
+	if _, err := r.Authenticate(ctx, "alice@example.com", "legacy"); err == nil {
+		t.Error("alice authenticated with the password of a later agent")
+	}
+	if _, err := r.Authenticate(ctx, "bob@example.com", "legacy"); err != nil {
+		t.Errorf("bob via second agent: %v", err)
+	}
+}
+
+func TestFilesystemDomainProvider_PepperFile(t *testing.T) {
+	pp := &passwd.Peppers{Current: "k1", Secrets: map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)}}
+	if err := passwd.SetPeppers(pp); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := passwd.HashPassword("secret")
+	_ = passwd.SetPeppers(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, base := newTestDomainsTree(t, "alice:"+hash+":alice\n", "a.com", "b.com")
+	pepperLine := []byte("k1:" + strings.Repeat("01", 32) + "\n")
+
+	// a.com takes the provider's pepper file; b.com names its own,
+	// relative to the domain directory, which wins.
+	shared := filepath.Join(t.TempDir(), "peppers")
+	if err := os.WriteFile(shared, pepperLine, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(base, "b.com", "peppers"), pepperLine, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := "[auth]\ntype = \"passwd\"\ncredential_backend = \"passwd\"\nkey_backend = \"keys\"\noptions = { pepper_file = \"peppers\" }\n"
+	if err := os.WriteFile(filepath.Join(base, "b.com", "config.toml"), []byte(config), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	p.WithPepperFile(shared)
+
+	r := NewAuthRouter(p, nil)
+	defer func() { _ = r.Close() }()
+	for _, address := range []string{"alice@a.com", "alice@b.com"} {
+		session, err := r.Authenticate(context.Background(), address, "secret")
+		if err != nil {
+			t.Errorf("Authenticate(%s): %v", address, err)
+			continue
+		}
+		session.Clear()
+	}
+}
+
+func TestDomainAuthConfig_PepperOption(t *testing.T) {
+	opts := map[string]string{"pepper_file": "peppers"}
+	c := DomainAuthConfig{Type: "passwd", Options: opts}
+	if got := c.agentConfig("/d", OSFS{}, false).Options["pepper_file"]; got != filepath.Join("/d", "peppers") {
+		t.Errorf("pepper_file = %q, want resolved against the domain directory", got)
+	}
+	if opts["pepper_file"] != "peppers" {
+		t.Error("agentConfig modified the configured options")
+	}
+	if got := c.withDefaultOption("pepper_file", "/other").Options["pepper_file"]; got != "peppers" {
+		t.Errorf("default replaced the domain's pepper_file: %q", got)
+	}
+	if got := (DomainAuthConfig{}).withDefaultOption("pepper_file", "/p").Options["pepper_file"]; got != "/p" {
+		t.Errorf("default pepper_file = %q, want /p", got)
+	}
+}
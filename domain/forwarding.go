@@ -6,7 +6,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"path/filepath"
+	"strings"
 
 	"github.com/infodancer/auth"
 	autherrors "github.com/infodancer/auth/errors"
@@ -21,35 +23,50 @@ import (
 //   - Domain-level:   {domainPath}/forwards                   (localpart:targets)
 //   - System default: {basePath}/forwards                     (localpart:targets)
 //
+// A final level holds role forwards synthesized at load for missing RFC 2142
+// role accounts (see RolesConfig.Operator); it is empty unless configured.
+//
 // User-level files are read on every lookup so changes take effect without restart.
 // Domain and default maps are loaded at domain init time.
 type forwardChain struct {
 	userForwardsDir string
 	domainForwards  *forwards.ForwardMap
 	defaultForwards *forwards.ForwardMap
+	roleForwards    *forwards.ForwardMap // nil unless roles are auto-forwarded
 }
 
-// resolve returns forwarding targets for localpart, walking the chain in priority order.
+// resolve returns forwarding target addresses for localpart, walking the chain
+// in priority order.
 func (c *forwardChain) resolve(localpart string) ([]string, bool) {
+	targets, ok := c.resolveTargets(localpart)
+	return forwards.Addresses(targets), ok
+}
+
+// resolveTargets is like resolve but keeps per-target routing hints.
+func (c *forwardChain) resolveTargets(localpart string) ([]forwards.Target, bool) {
+	targets, _, ok := c.match(localpart)
+	return targets, ok
+}
+
+// match is like resolveTargets but also reports whether the winning level
+// matched through its catchall rule.
+func (c *forwardChain) match(localpart string) (targets []forwards.Target, catchall, ok bool) {
 	// 1. User-level: {userForwardsDir}/{localpart}
 	if c.userForwardsDir != "" {
-		targets, err := forwards.LoadTargets(filepath.Join(c.userForwardsDir, localpart))
+		targets, err := forwards.LoadTargetEntries(filepath.Join(c.userForwardsDir, localpart))
 		if err == nil && len(targets) > 0 {
-			return targets, true
+			return targets, false, true
 		}
 	}
 
-	// 2. Domain-level
-	if targets, ok := c.domainForwards.Resolve(localpart); ok {
-		return targets, true
-	}
-
-	// 3. System default
-	if targets, ok := c.defaultForwards.Resolve(localpart); ok {
-		return targets, true
+	// 2. Domain-level, 3. system default, 4. synthesized role forwards.
+	for _, m := range []*forwards.ForwardMap{c.domainForwards, c.defaultForwards, c.roleForwards} {
+		if targets, catchall, ok := m.Match(localpart); ok {
+			return targets, catchall, true
+		}
 	}
 
-	return nil, false
+	return nil, false, false
 }
 
 // mailAuthAgent implements MailAuthAgent. It wraps an AuthenticationAgent and
@@ -59,21 +76,49 @@ func (c *forwardChain) resolve(localpart string) ([]string, bool) {
 //
 // Authenticate always delegates to the inner agent — forward-only addresses
 // have no credentials and cannot log in.
+//
+// Bounce localparts (see BouncesConfig) always exist.
+//
+// Every lookup first applies the domain's localpart normalization (see
+// NormalizeConfig); a localpart outside the allowed charset matches nothing.
 type mailAuthAgent struct {
-	inner auth.AuthenticationAgent
-	chain *forwardChain
+	inner   auth.AuthenticationAgent
+	chain   *forwardChain
+	norm    *normalizer  // nil: localparts used as given
+	bounces *bounceRules // nil: no bounce localparts
 }
 
 // Compile-time check: mailAuthAgent must satisfy MailAuthAgent.
 var _ MailAuthAgent = (*mailAuthAgent)(nil)
 
 func (a *mailAuthAgent) Authenticate(ctx context.Context, username, password string) (*auth.AuthSession, error) {
+	username, ok := a.norm.localpart(username)
+	if !ok {
+		return nil, autherrors.ErrUserNotFound
+	}
 	return a.inner.Authenticate(ctx, username, password)
 }
 
+// AuthenticateCredentials normalizes the username like Authenticate and
+// verifies creds with the inner agent (see auth.VerifyCredentials).
+// Implements auth.CredentialsAuthenticator.
+func (a *mailAuthAgent) AuthenticateCredentials(ctx context.Context, creds auth.Credentials) (*auth.AuthSession, error) {
+	username, ok := a.norm.localpart(creds.Username)
+	if !ok {
+		return nil, autherrors.ErrUserNotFound
+	}
+	creds.Username = username
+	return auth.VerifyCredentials(ctx, a.inner, creds)
+}
+
 // UserExists returns true if the user exists in the inner agent OR if the
-// localpart has a forwarding rule at any level of the chain.
+// localpart has a forwarding rule at any level of the chain OR if it is a
+// bounce localpart, so bounces are never rejected.
 func (a *mailAuthAgent) UserExists(ctx context.Context, username string) (bool, error) {
+	username, ok := a.norm.localpart(username)
+	if !ok {
+		return false, nil
+	}
 	exists, err := a.inner.UserExists(ctx, username)
 	if err != nil {
 		return false, err
@@ -81,41 +126,234 @@ func (a *mailAuthAgent) UserExists(ctx context.Context, username string) (bool,
 	if exists {
 		return true, nil
 	}
-	_, ok := a.chain.resolve(username)
-	return ok, nil
+	_, ok = a.chain.resolve(username)
+	return ok || a.bounces.isSink(username), nil
 }
 
 // ResolveForward returns forwarding targets for localpart by walking the chain.
 func (a *mailAuthAgent) ResolveForward(_ context.Context, localpart string) ([]string, bool) {
+	localpart, ok := a.norm.localpart(localpart)
+	if !ok {
+		return nil, false
+	}
 	return a.chain.resolve(localpart)
 }
 
+// LookupAddress reports how localpart is handled, distinguishing accounts
+// from forward-only addresses. Implements auth.AddressLookup.
+func (a *mailAuthAgent) LookupAddress(ctx context.Context, localpart string) (auth.AddressInfo, error) {
+	localpart, ok := a.norm.localpart(localpart)
+	if !ok {
+		return auth.AddressInfo{}, nil
+	}
+	exists, err := a.inner.UserExists(ctx, localpart)
+	if err != nil {
+		return auth.AddressInfo{}, err
+	}
+	_, catchall, forwarded := a.chain.match(localpart)
+	return auth.AddressInfo{
+		CanAuthenticate: exists,
+		AcceptsMail:     exists || forwarded || a.bounces.isSink(localpart),
+		IsForwardOnly:   forwarded && !exists,
+		IsAlias:         forwarded && !catchall,
+		CatchallMatched: catchall,
+	}, nil
+}
+
+// Capabilities reports the inner agent's capabilities; AddressLookup is
+// always supported, from the forwarding chain, and KeyGenerator never, as
+// it is not delegated. Implements auth.CapabilityReporter.
+func (a *mailAuthAgent) Capabilities() auth.AgentCapabilities {
+	c := auth.Capabilities(a.inner)
+	c.AddressLookup = true
+	c.KeyGenerator = false
+	return c
+}
+
 func (a *mailAuthAgent) Close() error {
 	return a.inner.Close()
 }
 
+// Resources delegates to the inner agent if it implements ResourceReporter.
+func (a *mailAuthAgent) Resources() auth.ResourceUsage {
+	if rr, ok := auth.AsResourceReporter(a.inner); ok {
+		return rr.Resources()
+	}
+	return auth.ResourceUsage{}
+}
+
+// ListUsers delegates to the inner agent if it implements auth.UserLister.
+// Forward-only addresses are not accounts and are not listed.
+func (a *mailAuthAgent) ListUsers(ctx context.Context) ([]string, error) {
+	if ul, ok := auth.AsUserLister(a.inner); ok {
+		return ul.ListUsers(ctx)
+	}
+	return nil, nil
+}
+
 // GetPublicKey delegates to the inner agent if it implements KeyProvider.
 // Forward-only addresses have no keys.
 func (a *mailAuthAgent) GetPublicKey(ctx context.Context, username string) ([]byte, error) {
-	if kp, ok := a.inner.(auth.KeyProvider); ok {
-		return kp.GetPublicKey(ctx, username)
+	if kp, ok := auth.AsKeyProvider(a.inner); ok {
+		if username, ok := a.norm.localpart(username); ok {
+			return kp.GetPublicKey(ctx, username)
+		}
 	}
 	return nil, autherrors.ErrKeyNotFound
 }
 
+// GetPublicKeys delegates to the inner agent if it implements KeyProvider,
+// in one call for all the usernames, and returns the keys by the names
+// they were asked for. Forward-only addresses have no keys.
+func (a *mailAuthAgent) GetPublicKeys(ctx context.Context, usernames []string) (map[string][]byte, error) {
+	keys := make(map[string][]byte, len(usernames))
+	kp, ok := auth.AsKeyProvider(a.inner)
+	if !ok {
+		return keys, nil
+	}
+	asked := make(map[string][]string, len(usernames))
+	locals := make([]string, 0, len(usernames))
+	for _, username := range usernames {
+		local, ok := a.norm.localpart(username)
+		if !ok {
+			continue
+		}
+		if _, seen := asked[local]; !seen {
+			locals = append(locals, local)
+		}
+		asked[local] = append(asked[local], username)
+	}
+	if len(locals) == 0 {
+		return keys, nil
+	}
+	found, err := kp.GetPublicKeys(ctx, locals)
+	if err != nil {
+		return nil, err
+	}
+	for local, key := range found {
+		for _, username := range asked[local] {
+			keys[username] = key
+		}
+	}
+	return keys, nil
+}
+
+// GetPublicKeyWithFormat delegates to the inner agent if it implements
+// KeyProvider.
+func (a *mailAuthAgent) GetPublicKeyWithFormat(ctx context.Context, username string) ([]byte, auth.KeyFormat, error) {
+	if kp, ok := auth.AsKeyProvider(a.inner); ok {
+		if username, ok := a.norm.localpart(username); ok {
+			return auth.PublicKeyWithFormat(ctx, kp, username)
+		}
+	}
+	return nil, "", autherrors.ErrKeyNotFound
+}
+
 // HasEncryption delegates to the inner agent if it implements KeyProvider.
 func (a *mailAuthAgent) HasEncryption(ctx context.Context, username string) (bool, error) {
-	if kp, ok := a.inner.(auth.KeyProvider); ok {
-		return kp.HasEncryption(ctx, username)
+	if kp, ok := auth.AsKeyProvider(a.inner); ok {
+		if username, ok := a.norm.localpart(username); ok {
+			return kp.HasEncryption(ctx, username)
+		}
+	}
+	return false, nil
+}
+
+// TOTPEnabled delegates to the inner agent if it implements auth.MFAAgent.
+func (a *mailAuthAgent) TOTPEnabled(ctx context.Context, username string) (bool, error) {
+	if m, ok := auth.AsMFAAgent(a.inner); ok {
+		if username, ok := a.norm.localpart(username); ok {
+			return m.TOTPEnabled(ctx, username)
+		}
+	}
+	return false, nil
+}
+
+// VerifyTOTP delegates to the inner agent if it implements auth.MFAAgent.
+func (a *mailAuthAgent) VerifyTOTP(ctx context.Context, username, code string) (bool, error) {
+	if m, ok := auth.AsMFAAgent(a.inner); ok {
+		if username, ok := a.norm.localpart(username); ok {
+			return m.VerifyTOTP(ctx, username, code)
+		}
 	}
 	return false, nil
 }
 
+// AccountStatus delegates to the inner agent if it implements
+// auth.AccountStatusProvider. Forward-only addresses are not accounts.
+func (a *mailAuthAgent) AccountStatus(ctx context.Context, username string) (auth.AccountStatus, error) {
+	if sp, ok := auth.AsAccountStatusProvider(a.inner); ok {
+		if username, ok := a.norm.localpart(username); ok {
+			return sp.AccountStatus(ctx, username)
+		}
+		return auth.AccountStatus{}, autherrors.ErrUserNotFound
+	}
+	return auth.AccountStatus{}, nil
+}
+
+// GetSCRAMCredentials delegates to the inner agent if it implements
+// auth.SCRAMCredentialProvider.
+func (a *mailAuthAgent) GetSCRAMCredentials(ctx context.Context, username string) (*auth.SCRAMCredentials, error) {
+	sp, ok := auth.AsSCRAMCredentialProvider(a.inner)
+	if !ok {
+		return nil, autherrors.ErrMechanismUnsupported
+	}
+	if username, ok := a.norm.localpart(username); ok {
+		return sp.GetSCRAMCredentials(ctx, username)
+	}
+	return nil, autherrors.ErrUserNotFound
+}
+
+// VerifyChallengeResponse normalizes the username like Authenticate and
+// delegates to the inner agent if it implements
+// auth.ChallengeResponseVerifier.
+func (a *mailAuthAgent) VerifyChallengeResponse(ctx context.Context, creds auth.Credentials) (*auth.AuthSession, error) {
+	cv, ok := auth.AsChallengeResponseVerifier(a.inner)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", autherrors.ErrMechanismUnsupported, creds.Mechanism)
+	}
+	username, ok := a.norm.localpart(creds.Username)
+	if !ok {
+		return nil, autherrors.ErrUserNotFound
+	}
+	creds.Username = username
+	return cv.VerifyChallengeResponse(ctx, creds)
+}
+
+// AuthenticateExternal normalizes the username like Authenticate and
+// delegates to the inner agent if it implements auth.ExternalAuthenticator.
+func (a *mailAuthAgent) AuthenticateExternal(ctx context.Context, identity auth.ExternalIdentity) (*auth.AuthSession, error) {
+	ea, ok := auth.AsExternalAuthenticator(a.inner)
+	if !ok {
+		return nil, fmt.Errorf("%w: EXTERNAL", autherrors.ErrMechanismUnsupported)
+	}
+	username, ok := a.norm.localpart(identity.Username)
+	if !ok {
+		return nil, autherrors.ErrUserNotFound
+	}
+	identity.Username = username
+	return ea.AuthenticateExternal(ctx, identity)
+}
+
+// Relayer delivers forwarded mail to targets on domains this server does not
+// serve. target carries the routing hints from the forward rule (Via,
+// Priority, Hints) so implementations can pick among multiple outbound paths.
+// Install one with FilesystemDomainProvider.WithRelay.
+type Relayer interface {
+	Relay(ctx context.Context, target forwards.Target, envelope msgstore.Envelope, message io.Reader) error
+}
+
+// QuarantineFolder is the folder MailDeliveryAgent files mail into for an
+// account deleted with a grace period (see auth.AccountStatus.Quarantined).
+const QuarantineFolder = "Quarantine"
+
 // MailDeliveryAgent is a msgstore.DeliveryAgent that applies mail-routing
 // logic before delivering to the underlying store. It handles:
 //
 //   - Forwarding rule resolution and expansion via the three-level forwardChain
 //   - Routing forwarded messages to the correct domain's DeliveryAgent
+//   - Filing into folders of the recipient's own mailbox ("=Folder" targets)
+//   - Holding mail for deleted accounts in QuarantineFolder
 //
 // Future capabilities may include: relay routing, alias expansion, per-user
 // filtering, and quota enforcement.
@@ -123,18 +361,66 @@ func (a *mailAuthAgent) HasEncryption(ctx context.Context, username string) (boo
 // smtpd is entirely unaware of this logic — it simply calls Deliver() and the
 // MailDeliveryAgent handles all routing decisions.
 //
-// Note: loop detection is not implemented. Avoid circular forwarding rules.
+// When the context carries a delivery ID (see WithDeliveryID) and the provider
+// enables deduplication (see WithDeliveryDedup), recipients already delivered
+// for that ID within the dedup window are skipped, so a retried Deliver call
+// does not duplicate mail to every forward target.
+//
+// The number of final recipients one message reaches through forwards,
+// across every domain it passes through, is capped by the first domain's
+// LimitsConfig.MaxForwardRecipients. Its path through forwarding rules is
+// tracked in EnvelopeMetadata.ForwardPath: a target already on the path
+// fails with errors.ErrForwardLoop, and one more than MaxForwardDepth hops
+// away with errors.ErrForwardDepthExceeded, as in ResolveFinalRecipients.
 type MailDeliveryAgent struct {
 	inner    msgstore.DeliveryAgent
 	chain    *forwardChain
 	provider DomainProvider
+	dedup    *dedupStore              // nil disables deduplication
+	relay    Relayer                  // nil: forwards to unserved domains fail
+	logger   *slog.Logger             // nil: slog.Default()
+	norm     *normalizer              // nil: recipients used as given
+	bounces  *bounceRules             // nil: no bounce handling
+	limits   LimitsConfig             // fan-out limit, see MaxForwardRecipients
+	frozen   func() bool              // nil: never frozen, see FreezeDomain
+	users    auth.AuthenticationAgent // accounts, for status and keepBounce; nil: bounces.users
 }
 
 // Deliver resolves any forwarding rules for the recipient and routes accordingly.
 //
 //   - No forward match: deliver locally via the inner agent.
 //   - Forward match: buffer and deliver to each target via its domain's DeliveryAgent.
-//   - Target on an unserved domain: returns an error (no outbound relay available).
+//   - Target on an unserved domain: handed to the Relayer if one is set,
+//     otherwise returns an error (no outbound relay available).
+//   - "=Folder" target: delivered to the recipient's own mailbox via the
+//     inner agent with EnvelopeMetadata.Folder set, so a rule such as
+//     "alice:=Archive, alice@elsewhere.example" keeps a filed copy.
+//   - Target equal to the recipient: delivered to its own inbox via the
+//     inner agent rather than forwarded again.
+//   - Final recipient the message already reached through another rule:
+//     skipped, so each is delivered once.
+//   - Bounce localpart without an account or forward: discarded.
+//   - Account deleted with a grace period (see
+//     auth.AccountStatus.Quarantined): filed into QuarantineFolder of its
+//     own mailbox; its forwarding rules are not applied.
+//   - Null envelope sender: targets on unserved domains are skipped unless
+//     the domain sets relay_null_sender (see BouncesConfig).
+//   - Frozen domain (see FreezeDomain): targets on unserved domains are
+//     skipped and the message is kept in the recipient's own mailbox; a
+//     forward-only address has none, so it is refused with
+//     errors.ErrDomainFrozen.
+//   - More final recipients than the fan-out limit: a rule with more
+//     targets than the recipients left is refused before any is tried, and
+//     recipients beyond the limit reached through nested rules are not
+//     delivered. Either way the error wraps errors.ErrForwardFanOutExceeded.
+//   - Recipient already on the forwarding path, or too many hops from the
+//     original recipient: refused with errors.ErrForwardLoop or
+//     errors.ErrForwardDepthExceeded, which the forwarding hop reports.
+//
+// Targets are attempted in ascending Priority order (see forwards.Target).
+// The original recipient, its subaddress extension, and the forwarding path
+// are propagated to the inner store and to forward targets as
+// EnvelopeMetadata on the context.
 func (a *MailDeliveryAgent) Deliver(ctx context.Context, envelope msgstore.Envelope, message io.Reader) error {
 	if len(envelope.Recipients) == 0 {
 		return a.inner.Deliver(ctx, envelope, message)
@@ -142,11 +428,63 @@ func (a *MailDeliveryAgent) Deliver(ctx context.Context, envelope msgstore.Envel
 
 	// smtpd enforces one recipient per message; handle all defensively.
 	to := envelope.Recipients[0]
-	localpart, _ := SplitUsername(to)
+	localpart, domainName := SplitUsername(to)
+
+	// Deliver to the canonical address so every spelling the domain's
+	// normalization rules accept lands in the same mailbox.
+	if canonical, ok := a.norm.localpart(localpart); !ok {
+		return fmt.Errorf("%w: %s", autherrors.ErrUserNotFound, to)
+	} else if canonical != localpart {
+		localpart = canonical
+		to = canonical + "@" + domainName
+		envelope.Recipients = append([]string{to}, envelope.Recipients[1:]...)
+	}
+
+	id := deliveryIDFromContext(ctx)
+	ctx, md := withRecipientMetadata(ctx, to)
+	if err := checkForwardHop(md.ForwardPath, to); err != nil {
+		loggerOrDefault(a.logger).Warn("forwarding loop", slog.String("recipient", to), slog.String("error", err.Error()))
+		return err
+	}
+	ctx, fo := withFanOut(ctx, to, a.limits.forwardRecipientLimit())
 
-	targets, forwarded := a.chain.resolve(localpart)
+	logger := loggerOrDefault(a.logger)
+	quarantined, err := a.quarantined(ctx, localpart)
+	if err != nil {
+		return fmt.Errorf("lookup %s: %w", to, err)
+	}
+	if quarantined {
+		data, err := io.ReadAll(message)
+		if err != nil {
+			return fmt.Errorf("buffer message for quarantine: %w", err)
+		}
+		logger.Info("quarantining mail for deleted account", slog.String("recipient", to))
+		return a.fileInto(ctx, id, to, QuarantineFolder, envelope, data)
+	}
+
+	rule, forwarded := a.chain.resolveTargets(localpart)
 	if !forwarded {
-		return a.inner.Deliver(ctx, envelope, message)
+		discard, err := a.bounces.discards(ctx, localpart)
+		if err != nil {
+			return fmt.Errorf("lookup %s: %w", to, err)
+		}
+		if discard {
+			logger.Debug("discarding mail to bounce address", slog.String("recipient", to))
+			return nil
+		}
+		first, err := countRecipient(ctx, recipientKey(to, ""))
+		if err != nil {
+			logger.Warn("forward fan-out limit reached", slog.String("recipient", to), slog.String("error", err.Error()))
+			return err
+		}
+		if !first {
+			logger.Debug("skipping recipient already reached", slog.String("recipient", to))
+			return nil
+		}
+		logger.Debug("delivering locally", slog.String("recipient", to))
+		return a.deliverOnce(id, to, func() error {
+			return a.inner.Deliver(ctx, envelope, message)
+		})
 	}
 
 	// Buffer the message body so it can be re-read for each forward target.
@@ -155,25 +493,242 @@ func (a *MailDeliveryAgent) Deliver(ctx context.Context, envelope msgstore.Envel
 		return fmt.Errorf("buffer message for forwarding: %w", err)
 	}
 
+	fwdCtx := WithEnvelopeMetadata(ctx, forwardedMetadata(md, to))
+
+	// Copy before sorting: rule slices are shared with the forward map.
+	targets := append([]forwards.Target(nil), rule...)
+	forwards.SortByPriority(targets)
+	if err := fo.check(len(targets)); err != nil {
+		logger.Warn("forward fan-out limit reached",
+			slog.String("recipient", to),
+			slog.Int("targets", len(targets)),
+			slog.String("error", err.Error()))
+		return err
+	}
+	logger.Debug("forwarding message",
+		slog.String("recipient", to),
+		slog.Int("targets", len(targets)))
+
+	nullSender := IsNullSender(envelope.From) && !a.bounces.relaysNullSender()
+	frozen := a.frozen != nil && a.frozen()
 	var errs []error
+	var skipped []string
 	for _, target := range targets {
-		_, targetDomain := SplitUsername(target)
-		if targetDomain == "" {
-			errs = append(errs, fmt.Errorf("forward target %q has no domain", target))
+		if folder, ok := target.Folder(); ok {
+			if err := a.fileInto(ctx, id, to, folder, envelope, data); err != nil {
+				logger.Warn("fileinto failed",
+					slog.String("recipient", to),
+					slog.String("target", target.Address),
+					slog.String("error", err.Error()))
+				errs = append(errs, err)
+			}
 			continue
 		}
-
-		d := a.provider.GetDomain(targetDomain)
-		if d == nil || d.DeliveryAgent == nil {
-			errs = append(errs, fmt.Errorf("forward to %q: domain %q is not locally served (no outbound relay)", target, targetDomain))
+		if isSelfTarget(target.Address, to) {
+			if err := a.keepCopy(ctx, id, to, envelope, data); err != nil {
+				logger.Warn("keeping copy failed",
+					slog.String("recipient", to),
+					slog.String("error", err.Error()))
+				errs = append(errs, err)
+			}
 			continue
 		}
-
-		fwdEnvelope := envelope
-		fwdEnvelope.Recipients = []string{target}
-		if err := d.DeliveryAgent.Deliver(ctx, fwdEnvelope, bytes.NewReader(data)); err != nil {
-			errs = append(errs, fmt.Errorf("forward to %q: %w", target, err))
+		if (nullSender || frozen) && !a.serves(target.Address) {
+			skipped = append(skipped, target.Address)
+			continue
+		}
+		if err := a.forwardTo(fwdCtx, id, target, envelope, data); err != nil {
+			logger.Warn("forward failed",
+				slog.String("recipient", to),
+				slog.String("target", target.Address),
+				slog.String("error", err.Error()))
+			errs = append(errs, err)
+		}
+	}
+	if len(skipped) > 0 {
+		if err := a.keepBounce(ctx, id, to, localpart, skipped, frozen, envelope, data); err != nil {
+			errs = append(errs, err)
 		}
 	}
 	return errors.Join(errs...)
 }
+
+// accounts returns the agent holding the domain's accounts, or nil.
+func (a *MailDeliveryAgent) accounts() auth.AuthenticationAgent {
+	if a.users == nil && a.bounces != nil {
+		return a.bounces.users
+	}
+	return a.users
+}
+
+// quarantined reports whether the account for localpart is deleted and
+// awaiting purge. Addresses without an account, and accounts whose agent
+// keeps no status, are not.
+func (a *MailDeliveryAgent) quarantined(ctx context.Context, localpart string) (bool, error) {
+	sp, ok := auth.AsAccountStatusProvider(a.accounts())
+	if !ok {
+		return false, nil
+	}
+	base, _ := ParseLocalPart(localpart)
+	status, err := sp.AccountStatus(ctx, base)
+	if errors.Is(err, autherrors.ErrUserNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return status.Quarantined(), nil
+}
+
+// serves reports whether address is on a domain delivered locally.
+func (a *MailDeliveryAgent) serves(address string) bool {
+	_, domainName := SplitUsername(address)
+	d, _ := ResolveDomain(a.provider, domainName)
+	return d != nil && d.DeliveryAgent != nil
+}
+
+// keepBounce handles a null-sender message, or one for a frozen domain,
+// whose off-host forward targets were skipped: the recipient keeps it in
+// the inbox if it is an account. Otherwise a null-sender message is
+// dropped and one for a frozen domain refused.
+func (a *MailDeliveryAgent) keepBounce(ctx context.Context, id, to, localpart string, skipped []string, frozen bool, envelope msgstore.Envelope, data []byte) error {
+	logger := loggerOrDefault(a.logger)
+	base, _ := ParseLocalPart(localpart)
+	users := a.accounts()
+	exists := false
+	if users != nil {
+		var err error
+		if exists, err = users.UserExists(ctx, base); err != nil {
+			return fmt.Errorf("lookup %s: %w", to, err)
+		}
+	}
+	if !exists && frozen {
+		return fmt.Errorf("%w: not forwarding %s off-host", autherrors.ErrDomainFrozen, to)
+	}
+	if !exists {
+		logger.Info("dropping null-sender message instead of relaying it off-host",
+			slog.String("recipient", to),
+			slog.String("targets", strings.Join(skipped, ",")))
+		return nil
+	}
+	reason := "null-sender message"
+	if frozen {
+		reason = "message for frozen domain"
+	}
+	logger.Info("keeping "+reason+" instead of relaying it off-host",
+		slog.String("recipient", to),
+		slog.String("targets", strings.Join(skipped, ",")))
+	return a.keepCopy(ctx, id, to, envelope, data)
+}
+
+// keepCopy delivers one buffered message to the recipient's own inbox
+// through the inner store, unless the message already reached it.
+func (a *MailDeliveryAgent) keepCopy(ctx context.Context, id, to string, envelope msgstore.Envelope, data []byte) error {
+	first, err := countRecipient(ctx, recipientKey(to, ""))
+	if err != nil || !first {
+		return err
+	}
+	return a.deliverOnce(id, to, func() error {
+		return a.inner.Deliver(ctx, envelope, bytes.NewReader(data))
+	})
+}
+
+// forwardTo delivers one buffered message to a forward target, locally if its
+// domain is served and through the Relayer otherwise.
+func (a *MailDeliveryAgent) forwardTo(ctx context.Context, id string, target forwards.Target, envelope msgstore.Envelope, data []byte) error {
+	_, targetDomain := SplitUsername(target.Address)
+	if targetDomain == "" {
+		return fmt.Errorf("forward target %q has no domain", target.Address)
+	}
+
+	fwdEnvelope := envelope
+	fwdEnvelope.Recipients = []string{target.Address}
+
+	var deliver func() error
+	if d, _ := ResolveDomain(a.provider, targetDomain); d != nil && d.DeliveryAgent != nil {
+		deliver = func() error {
+			return d.DeliveryAgent.Deliver(ctx, fwdEnvelope, bytes.NewReader(data))
+		}
+	} else if a.relay != nil {
+		first, err := countRecipient(ctx, recipientKey(target.Address, ""))
+		if err != nil || !first {
+			return err
+		}
+		deliver = func() error {
+			return a.relay.Relay(ctx, target, fwdEnvelope, bytes.NewReader(data))
+		}
+	} else {
+		return fmt.Errorf("forward to %q: domain %q is not locally served (no outbound relay)", target.Address, targetDomain)
+	}
+
+	if err := a.deliverOnce(id, target.Address, deliver); err != nil {
+		return fmt.Errorf("forward to %q: %w", target.Address, err)
+	}
+	return nil
+}
+
+// fileInto delivers one buffered message to folder of the recipient's own
+// mailbox through the inner store, which finds the folder in the
+// EnvelopeMetadata on ctx.
+func (a *MailDeliveryAgent) fileInto(ctx context.Context, id, recipient, folder string, envelope msgstore.Envelope, data []byte) error {
+	if folder == "" {
+		return fmt.Errorf("fileinto for %q: invalid folder name", recipient)
+	}
+	first, err := countRecipient(ctx, recipientKey(recipient, folder))
+	if err != nil || !first {
+		return err
+	}
+	md := EnvelopeMetadataFromContext(ctx)
+	md.Folder = folder
+	ctx = WithEnvelopeMetadata(ctx, md)
+
+	err = a.deliverOnce(id, recipient+" ="+folder, func() error {
+		return a.inner.Deliver(ctx, envelope, bytes.NewReader(data))
+	})
+	if err != nil {
+		return fmt.Errorf("fileinto %q for %q: %w", folder, recipient, err)
+	}
+	return nil
+}
+
+// Resources reports the memory held by the dedup window.
+// Implements auth.ResourceReporter.
+func (a *MailDeliveryAgent) Resources() auth.ResourceUsage {
+	if a.dedup == nil {
+		return auth.ResourceUsage{}
+	}
+	return auth.ResourceUsage{CacheBytes: a.dedup.size()}
+}
+
+// deliverOnce runs deliver unless (id, recipient) was already delivered within
+// the dedup window, and records it on success; failing to record is logged,
+// not returned. Without a dedup store or a delivery ID it simply calls
+// deliver.
+func (a *MailDeliveryAgent) deliverOnce(id, recipient string, deliver func() error) error {
+	key := dedupKey(id, recipient)
+	if a.dedup == nil || key == "" {
+		return deliver()
+	}
+	done, err := a.dedup.delivered(key)
+	if err != nil {
+		return fmt.Errorf("check delivery dedup: %w", err)
+	}
+	if done {
+		loggerOrDefault(a.logger).Debug("skipping duplicate delivery",
+			slog.String("recipient", recipient),
+			slog.String("delivery_id", id))
+		return nil
+	}
+	if err := deliver(); err != nil {
+		return err
+	}
+	// The message is delivered: failing now would have it retried and
+	// delivered twice, so a lost record only weakens deduplication.
+	if err := a.dedup.record(key); err != nil {
+		loggerOrDefault(a.logger).Warn("record delivery dedup failed",
+			slog.String("recipient", recipient),
+			slog.String("delivery_id", id),
+			slog.String("error", err.Error()))
+	}
+	return nil
+}
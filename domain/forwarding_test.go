@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/infodancer/auth"
 	autherrors "github.com/infodancer/auth/errors"
@@ -348,3 +349,197 @@ func TestForwardChain_ResolutionOrder(t *testing.T) {
 		t.Errorf("charlie: expected default-level catchall, got %v ok=%v", targets, ok)
 	}
 }
+
+// stubRelayer records relayed targets.
+type stubRelayer struct {
+	relayed []forwards.Target
+}
+
+func (s *stubRelayer) Relay(_ context.Context, target forwards.Target, _ msgstore.Envelope, _ io.Reader) error {
+	s.relayed = append(s.relayed, target)
+	return nil
+}
+
+func TestForwardingDeliveryAgent_RelayHonorsHints(t *testing.T) {
+	relay := &stubRelayer{}
+	localInner := &stubDeliveryAgent{}
+	provider := &stubDomainProvider{domains: map[string]*Domain{
+		"local.com": {Name: "local.com", DeliveryAgent: localInner},
+	}}
+	agent := &MailDeliveryAgent{
+		inner: &stubDeliveryAgent{},
+		chain: &forwardChain{
+			domainForwards: forwards.FromMap(map[string]string{
+				"alice": "alice@gmail.com via=relay1 priority=2, bob@local.com, alice@backup.net via=relay2 priority=1",
+			}),
+			defaultForwards: forwards.FromMap(nil),
+		},
+		provider: provider,
+		relay:    relay,
+	}
+
+	env := msgstore.Envelope{Recipients: []string{"alice@this.com"}}
+	if err := agent.Deliver(context.Background(), env, bytes.NewReader([]byte("test"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(localInner.delivered) != 1 {
+		t.Errorf("expected 1 local forward, got %d", len(localInner.delivered))
+	}
+	if len(relay.relayed) != 2 {
+		t.Fatalf("expected 2 relayed targets, got %d", len(relay.relayed))
+	}
+	if relay.relayed[0].Address != "alice@backup.net" || relay.relayed[0].Via != "relay2" {
+		t.Errorf("expected priority 1 target first, got %+v", relay.relayed[0])
+	}
+	if relay.relayed[1].Address != "alice@gmail.com" || relay.relayed[1].Via != "relay1" {
+		t.Errorf("expected priority 2 target second, got %+v", relay.relayed[1])
+	}
+}
+
+func TestMailAuthAgent_Capabilities(t *testing.T) {
+	agent := &mailAuthAgent{inner: &stubAuthAgent{}, chain: &forwardChain{}}
+	c := auth.Capabilities(agent)
+	if !c.AddressLookup || c.KeyProvider || c.UserLister {
+		t.Errorf("capabilities = %+v, want AddressLookup only", c)
+	}
+	if _, ok := auth.AsKeyProvider(agent); ok {
+		t.Error("AsKeyProvider should refuse a wrapper over an agent without keys")
+	}
+
+	p, _ := newTestDomainsTree(t, "alice:x:alice\n", "example.com")
+	d := p.GetDomain("example.com")
+	if d == nil {
+		t.Fatal("expected domain to load")
+	}
+	if c := auth.Capabilities(d.AuthAgent); !c.KeyProvider || !c.UserLister || !c.AddressLookup {
+		t.Errorf("passwd domain capabilities = %+v", c)
+	}
+}
+
+func TestMailAuthAgent_GetPublicKeys(t *testing.T) {
+	p, base := newTestDomainsTree(t, "alice:x:alice\nbob:x:bob\n", "example.com")
+	if err := os.WriteFile(filepath.Join(base, "example.com", "keys", "alice.pub"), []byte("alice-key"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d := p.GetDomain("example.com")
+	if d == nil {
+		t.Fatal("expected domain to load")
+	}
+	agent, ok := d.AuthAgent.(*mailAuthAgent)
+	if !ok {
+		t.Fatalf("AuthAgent is %T", d.AuthAgent)
+	}
+	norm, err := newNormalizer(NormalizeConfig{CaseInsensitive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent.norm = norm
+
+	// Keys come back under the names asked for; bob has no key and nobody
+	// does not exist.
+	keys, err := agent.GetPublicKeys(context.Background(), []string{"alice", "Alice", "bob", "nobody"})
+	if err != nil {
+		t.Fatalf("GetPublicKeys: %v", err)
+	}
+	if len(keys) != 2 || string(keys["alice"]) != "alice-key" || string(keys["Alice"]) != "alice-key" {
+		t.Errorf("GetPublicKeys = %q", keys)
+	}
+}
+
+// folderDeliveryAgent records the folder each delivery was filed into.
+type folderDeliveryAgent struct {
+	folders []string
+}
+
+func (s *folderDeliveryAgent) Deliver(ctx context.Context, _ msgstore.Envelope, _ io.Reader) error {
+	s.folders = append(s.folders, EnvelopeMetadataFromContext(ctx).Folder)
+	return nil
+}
+
+func TestForwardingDeliveryAgent_FileInto(t *testing.T) {
+	inner := &folderDeliveryAgent{}
+	chain := &forwardChain{
+		domainForwards: forwards.FromMap(map[string]string{
+			"alice": "=Archive, alice@this.com",
+			"bob":   "=../escape",
+		}),
+		defaultForwards: forwards.FromMap(nil),
+	}
+	self := &Domain{Name: "this.com"}
+	provider := &stubDomainProvider{domains: map[string]*Domain{"this.com": self}}
+	agent := &MailDeliveryAgent{inner: inner, chain: chain, provider: provider}
+	self.DeliveryAgent = &stubDeliveryAgent{}
+
+	env := msgstore.Envelope{Recipients: []string{"alice@this.com"}}
+	if err := agent.Deliver(context.Background(), env, bytes.NewReader([]byte("test"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The self target keeps alice's inbox copy through the inner store.
+	if len(inner.folders) != 2 || inner.folders[0] != "Archive" || inner.folders[1] != "" {
+		t.Errorf("filed into %q, want [Archive, inbox]", inner.folders)
+	}
+
+	env = msgstore.Envelope{Recipients: []string{"bob@this.com"}}
+	if err := agent.Deliver(context.Background(), env, bytes.NewReader([]byte("test"))); err == nil {
+		t.Error("expected error for an invalid folder name")
+	}
+	if len(inner.folders) != 2 {
+		t.Errorf("invalid folder was delivered: %v", inner.folders)
+	}
+}
+
+// statusAuthAgent is a stubAuthAgent that keeps account status.
+type statusAuthAgent struct {
+	stubAuthAgent
+	status map[string]auth.AccountStatus
+}
+
+func (s *statusAuthAgent) AccountStatus(_ context.Context, username string) (auth.AccountStatus, error) {
+	if !s.users[username] {
+		return auth.AccountStatus{}, autherrors.ErrUserNotFound
+	}
+	return s.status[username], nil
+}
+
+func TestMailDeliveryAgent_Quarantine(t *testing.T) {
+	inner := &folderDeliveryAgent{}
+	fwd := &stubDeliveryAgent{}
+	agent := &MailDeliveryAgent{
+		inner: inner,
+		chain: &forwardChain{
+			domainForwards:  forwards.FromMap(map[string]string{"alice": "alice@other.com"}),
+			defaultForwards: forwards.FromMap(nil),
+		},
+		provider: &stubDomainProvider{domains: map[string]*Domain{
+			"other.com": {Name: "other.com", DeliveryAgent: fwd},
+		}},
+		users: &statusAuthAgent{
+			stubAuthAgent: stubAuthAgent{users: map[string]bool{"alice": true, "bob": true}},
+			status:        map[string]auth.AccountStatus{"alice": {Deleted: time.Now()}},
+		},
+	}
+	ctx := context.Background()
+
+	// A deleted account's mail is held in quarantine, not forwarded.
+	env := msgstore.Envelope{Recipients: []string{"alice+tag@this.com"}}
+	if err := agent.Deliver(ctx, env, bytes.NewReader([]byte("test"))); err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+	if len(inner.folders) != 1 || inner.folders[0] != QuarantineFolder {
+		t.Errorf("filed into %q, want [%s]", inner.folders, QuarantineFolder)
+	}
+	if len(fwd.delivered) != 0 {
+		t.Errorf("forwarded %+v for a deleted account", fwd.delivered)
+	}
+
+	// Accounts in good standing and unknown addresses go to the inbox.
+	for _, rcpt := range []string{"bob@this.com", "carol@this.com"} {
+		env = msgstore.Envelope{Recipients: []string{rcpt}}
+		if err := agent.Deliver(ctx, env, bytes.NewReader([]byte("test"))); err != nil {
+			t.Fatalf("Deliver(%s): %v", rcpt, err)
+		}
+	}
+	if len(inner.folders) != 3 || inner.folders[1] != "" || inner.folders[2] != "" {
+		t.Errorf("filed into %q, want [%s, inbox, inbox]", inner.folders, QuarantineFolder)
+	}
+}
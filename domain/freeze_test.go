@@ -0,0 +1,123 @@
+package domain
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/forwards"
+	"github.com/infodancer/auth/passwd"
+	"github.com/infodancer/msgstore"
+)
+
+func TestFreezeDomain(t *testing.T) {
+	hash, err := passwd.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := newTestDomainsTree(t, "alice:"+hash+":alice\n", "example.com")
+	r := NewAuthRouter(p, nil)
+	ctx := context.Background()
+
+	if _, err := r.Authenticate(ctx, "alice@example.com", "secret"); err != nil {
+		t.Fatalf("Authenticate before freeze: %v", err)
+	}
+	if err := p.FreezeDomain("Example.com", "phishing campaign"); err != nil {
+		t.Fatalf("FreezeDomain: %v", err)
+	}
+	rec, frozen := p.Frozen("example.com")
+	if !frozen || rec.Reason != "phishing campaign" || rec.Actor == "" {
+		t.Errorf("Frozen = %+v, %v", rec, frozen)
+	}
+
+	// The loaded domain sees the freeze without a reload.
+	_, err = r.Authenticate(ctx, "alice@example.com", "secret")
+	if !errors.Is(err, autherrors.ErrDomainFrozen) || !errors.Is(err, autherrors.ErrAccountDisabled) {
+		t.Errorf("Authenticate while frozen: err = %v, want ErrDomainFrozen", err)
+	}
+
+	if err := p.ThawDomain("example.com", "cleaned up"); err != nil {
+		t.Fatalf("ThawDomain: %v", err)
+	}
+	if err := p.ThawDomain("example.com", ""); err != nil {
+		t.Errorf("thawing a thawed domain: %v", err)
+	}
+	if _, frozen := p.Frozen("example.com"); frozen {
+		t.Error("domain still frozen after ThawDomain")
+	}
+	if _, err := r.Authenticate(ctx, "alice@example.com", "secret"); err != nil {
+		t.Errorf("Authenticate after thaw: %v", err)
+	}
+
+	history, err := p.FreezeHistory("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || history[0].Action != FreezeActionFreeze || history[1].Action != FreezeActionThaw || history[1].Reason != "cleaned up" {
+		t.Errorf("FreezeHistory = %+v", history)
+	}
+}
+
+func TestFreezeDomain_Errors(t *testing.T) {
+	p, _ := newTestDomainsTree(t, "", "example.com")
+	if err := p.FreezeDomain("missing.com", "x"); !errors.Is(err, autherrors.ErrInvalidDomainName) {
+		t.Errorf("unknown domain: err = %v, want ErrInvalidDomainName", err)
+	}
+	if err := p.FreezeDomain("../example.com", "x"); !errors.Is(err, autherrors.ErrInvalidDomainName) {
+		t.Errorf("traversal: err = %v, want ErrInvalidDomainName", err)
+	}
+	if history, err := p.FreezeHistory("example.com"); err != nil || len(history) != 0 {
+		t.Errorf("FreezeHistory of a never frozen domain = %+v, %v", history, err)
+	}
+
+	p.WithReadOnly()
+	if err := p.FreezeDomain("example.com", "x"); !errors.Is(err, autherrors.ErrReadOnly) {
+		t.Errorf("read-only: err = %v, want ErrReadOnly", err)
+	}
+}
+
+func TestMailDeliveryAgent_FrozenSkipsRelay(t *testing.T) {
+	relay := &stubRelayer{}
+	localInner := &stubDeliveryAgent{}
+	inner := &stubDeliveryAgent{}
+	agent := &MailDeliveryAgent{
+		inner: inner,
+		chain: &forwardChain{
+			domainForwards: forwards.FromMap(map[string]string{
+				"alice": "alice@gmail.com, bob@local.com",
+				"sales": "sales@gmail.com",
+			}),
+			defaultForwards: forwards.FromMap(nil),
+		},
+		provider: &stubDomainProvider{domains: map[string]*Domain{
+			"local.com": {Name: "local.com", DeliveryAgent: localInner},
+		}},
+		relay:  relay,
+		users:  &stubAuthAgent{users: map[string]bool{"alice": true}},
+		frozen: func() bool { return true },
+	}
+	ctx := context.Background()
+
+	// An account keeps the message; served targets still get it.
+	env := msgstore.Envelope{Recipients: []string{"alice@this.com"}}
+	if err := agent.Deliver(ctx, env, bytes.NewReader([]byte("test"))); err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+	if len(relay.relayed) != 0 {
+		t.Errorf("relayed %+v while frozen", relay.relayed)
+	}
+	if len(localInner.delivered) != 1 || len(inner.delivered) != 1 {
+		t.Errorf("local deliveries = %d served, %d own; want 1, 1", len(localInner.delivered), len(inner.delivered))
+	}
+
+	// A forward-only address has no mailbox to keep it in.
+	env = msgstore.Envelope{Recipients: []string{"sales@this.com"}}
+	if err := agent.Deliver(ctx, env, bytes.NewReader([]byte("test"))); !errors.Is(err, autherrors.ErrDomainFrozen) {
+		t.Errorf("forward-only Deliver: err = %v, want ErrDomainFrozen", err)
+	}
+	if len(relay.relayed) != 0 {
+		t.Errorf("relayed %+v while frozen", relay.relayed)
+	}
+}
@@ -0,0 +1,83 @@
+package domain
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"path/filepath"
+
+	"github.com/infodancer/auth/atrest"
+	"github.com/infodancer/auth/vfs"
+)
+
+// FS is the filesystem a FilesystemDomainProvider reads its configuration
+// through: the base config.toml, domains.toml and postmaster files, the
+// domain directories, their config.toml and user_metadata.toml files, and
+// the domain templates. Names are host paths under the provider's base path.
+// File-backed auth agents such as passwd are opened on it too, so their
+// passwd files and keys come from the same place.
+//
+// The default is OSFS. Install another implementation with WithFS to serve
+// configuration from memory (vfs.MemFS), from a read-only bundle, or to
+// inject faults in tests. CreateDomain needs a vfs.WriteFS.
+type FS = vfs.FS
+
+// OSFS is the FS backed by the local disk via package os.
+type OSFS = vfs.OS
+
+// WithFS makes the provider read configuration through fsys instead of the
+// local disk, and reloads the base-level config files from it. Domains
+// already loaded are not affected until they are evicted or the provider is
+// closed. Returns the provider to allow chaining.
+func (p *FilesystemDomainProvider) WithFS(fsys FS) *FilesystemDomainProvider {
+	p.fs = fsys
+	p.loadBaseFiles()
+	return p
+}
+
+// loadBaseFiles loads the optional config.toml, domains.toml and postmaster
+// files from the base path. Unreadable or invalid files are ignored.
+func (p *FilesystemDomainProvider) loadBaseFiles() {
+	p.baseDefaults, p.domainOverrides, p.postmaster = nil, nil, nil
+	if data, err := p.readFile(filepath.Join(p.basePath, "config.toml")); err == nil {
+		if cfg, err := parseDomainConfig(data); err == nil {
+			p.baseDefaults = cfg
+		}
+	}
+	if data, err := p.readFile(filepath.Join(p.basePath, "domains.toml")); err == nil {
+		if overrides, err := parseDomainsConfig(data); err == nil {
+			p.domainOverrides = overrides
+		}
+	} else if errors.Is(err, fs.ErrNotExist) {
+		p.domainOverrides = make(DomainsConfig)
+	}
+	if data, err := p.readFile(filepath.Join(p.basePath, "postmaster")); err == nil {
+		if entries, err := parsePostmaster(bytes.NewReader(data)); err == nil {
+			p.postmaster = entries
+		}
+	}
+}
+
+// readFile returns the plaintext of a configuration file read through the
+// provider's FS, unsealing it with the host key if needed (see atrest).
+func (p *FilesystemDomainProvider) readFile(name string) ([]byte, error) {
+	return atrest.ReadFileFS(p.fs, name)
+}
+
+// writeFS returns the provider's FS for stores that write, such as the
+// session and dedup files: p.fs if it is a vfs.WriteFS, and else p.fs
+// refusing every write.
+func (p *FilesystemDomainProvider) writeFS() vfs.WriteFS {
+	if fsys, ok := p.fs.(vfs.WriteFS); ok {
+		return fsys
+	}
+	return vfs.ReadOnly(p.fs)
+}
+
+// exists reports whether name exists on the provider's FS. Errors other than
+// "not exist" count as existing, so a transient failure surfaces when the
+// file is read rather than hiding the domain.
+func (p *FilesystemDomainProvider) exists(name string) bool {
+	_, err := p.fs.Stat(name)
+	return !errors.Is(err, fs.ErrNotExist)
+}
@@ -0,0 +1,138 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/passwd"
+	"github.com/infodancer/auth/vfs"
+)
+
+// overlayFS serves files from an in-memory MapFS, keyed by host path without
+// the leading slash, in front of the local disk.
+type overlayFS struct {
+	OSFS
+	mem fstest.MapFS
+}
+
+func (o overlayFS) Stat(name string) (fs.FileInfo, error) {
+	if fi, err := o.mem.Stat(strings.TrimPrefix(name, "/")); err == nil {
+		return fi, nil
+	}
+	return o.OSFS.Stat(name)
+}
+
+func (o overlayFS) ReadFile(name string) ([]byte, error) {
+	if data, err := o.mem.ReadFile(strings.TrimPrefix(name, "/")); err == nil {
+		return data, nil
+	}
+	return o.OSFS.ReadFile(name)
+}
+
+func TestWithFS_ReadsConfigThroughFS(t *testing.T) {
+	p, base := newTestDomainsTree(t, "alice:HASH:alice\n", "example.com")
+	key := strings.TrimPrefix(base, "/")
+	p.WithFS(overlayFS{mem: fstest.MapFS{
+		key + "/config.toml":             {Data: []byte("[forwards]\nabuse = \"ops@elsewhere.net\"\n")},
+		key + "/example.com/config.toml": {Data: []byte("max_message_size = 1234\n")},
+	}})
+
+	d := p.GetDomain("example.com")
+	if d == nil {
+		t.Fatal("GetDomain returned nil")
+	}
+	if d.MaxMessageSize != 1234 {
+		t.Errorf("MaxMessageSize = %d, want 1234 from the in-memory config", d.MaxMessageSize)
+	}
+	targets, ok := d.AuthAgent.ResolveForward(context.Background(), "abuse")
+	if !ok || len(targets) != 1 || targets[0] != "ops@elsewhere.net" {
+		t.Errorf("ResolveForward(abuse) = %v, %v; want base config forward", targets, ok)
+	}
+}
+
+func TestWithFS_StatErrorDoesNotHideDomain(t *testing.T) {
+	p, _ := newTestDomainsTree(t, "", "example.com")
+	fsys := &faultFS{FS: OSFS{}}
+	p.WithFS(fsys)
+
+	// A failing Stat is not "not exist": the load is attempted and the read
+	// error reported, rather than the domain silently disappearing.
+	fsys.percent.Store(100)
+	if d := p.GetDomain("example.com"); d != nil {
+		t.Error("expected GetDomain to fail while the FS is failing")
+	}
+	fsys.percent.Store(0)
+	if d := p.GetDomain("example.com"); d == nil {
+		t.Error("expected GetDomain to recover once the FS is healthy")
+	}
+}
+
+func TestWithFS_InMemoryProvider(t *testing.T) {
+	mem := vfs.NewMemFS()
+
+	const base = "/etc/mail/domains"
+	if err := mem.MkdirAll(base+"/"+TemplatesDir+"/basic", 0o750); err != nil {
+		t.Fatal(err)
+	}
+	config := "[auth]\ntype = \"passwd\"\ncredential_backend = \"passwd\"\nkey_backend = \"keys\"\n\n" +
+		"[msgstore]\ntype = \"maildir\"\nbase_path = \"" + filepath.ToSlash(t.TempDir()) + "\"\n\n" +
+		"[forwards]\nabuse = \"postmaster@${DOMAIN}\"\n"
+	if err := mem.WriteFile(base+"/"+TemplatesDir+"/basic/config.toml", []byte(config), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewFilesystemDomainProvider(base, nil).WithFS(mem)
+	t.Cleanup(func() { _ = p.Close() })
+	if err := p.CreateDomain("example.com", "basic"); err != nil {
+		t.Fatalf("CreateDomain: %v", err)
+	}
+	// The domain's passwd agent reads from mem, where the local-disk
+	// management functions cannot write.
+	hash, err := passwd.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.AppendFile(base+"/example.com/passwd", []byte("alice:"+hash+":alice\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := p.Domains(); len(got) != 1 || got[0] != "example.com" {
+		t.Errorf("Domains() = %v, want [example.com]", got)
+	}
+	r := NewAuthRouter(p, nil)
+	defer func() { _ = r.Close() }()
+	session, err := r.Authenticate(context.Background(), "alice@example.com", "secret")
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	session.Clear()
+	d := p.GetDomain("example.com")
+	if targets, ok := d.AuthAgent.ResolveForward(context.Background(), "abuse"); !ok || targets[0] != "postmaster@example.com" {
+		t.Errorf("ResolveForward(abuse) = %v, %v", targets, ok)
+	}
+}
+
+func TestCreateDomain_ReadOnlyFS(t *testing.T) {
+	p, _ := newTestDomainsTree(t, "")
+
+	// An FS without write methods makes the provider read-only.
+	p.WithFS(struct{ FS }{OSFS{}})
+	if err := p.CreateDomain("new.com", ""); !errors.Is(err, autherrors.ErrReadOnly) {
+		t.Errorf("CreateDomain on a read-only FS: got %v, want ErrReadOnly", err)
+	}
+
+	// A WriteFS that refuses mutations reports the refusal.
+	p.WithFS(vfs.ReadOnly(OSFS{}))
+	if err := p.CreateDomain("new.com", ""); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("CreateDomain on a read-only bundle: got %v, want ErrPermission", err)
+	}
+	if got := p.Domains(); len(got) != 0 {
+		t.Errorf("Domains() = %v, want none", got)
+	}
+}
@@ -0,0 +1,124 @@
+package domain
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// GALConfig controls a domain's global address list.
+//
+//	[gal]
+//	opt_out = true
+type GALConfig struct {
+	// OptOut disables GAL export for the domain entirely.
+	OptOut bool `toml:"opt_out,omitempty"`
+}
+
+// GALEntry is one user in a domain's global address list.
+type GALEntry struct {
+	// DisplayName is the user's display name from UserMetadata, or the
+	// localpart when none is set.
+	DisplayName string `json:"display_name"`
+
+	// Address is the user's email address.
+	Address string `json:"address"`
+
+	// KeyFingerprint is the hex SHA-256 of the user's public key, empty
+	// when the user has no key.
+	KeyFingerprint string `json:"key_fingerprint,omitempty"`
+}
+
+// ExportGAL returns the domain's global address list for webmail clients:
+// every account the auth agent can enumerate (see auth.UserLister), minus
+// users with GALHidden set in UserMetadata. Forward-only addresses are not
+// listed. Returns no entries when the domain has GAL.OptOut set or its auth
+// agent cannot enumerate users.
+func (d *Domain) ExportGAL(ctx context.Context) ([]GALEntry, error) {
+	if d.GAL.OptOut || d.AuthAgent == nil {
+		return nil, nil
+	}
+	ul, ok := auth.AsUserLister(d.AuthAgent)
+	if !ok {
+		return nil, nil
+	}
+	users, err := ul.ListUsers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list users: %w", err)
+	}
+	md, err := d.userMetadata()
+	if err != nil {
+		return nil, err
+	}
+	kp, _ := auth.AsKeyProvider(d.AuthAgent)
+
+	entries := make([]GALEntry, 0, len(users))
+	for _, user := range users {
+		meta := md[strings.ToLower(user)]
+		if meta.GALHidden {
+			continue
+		}
+		e := GALEntry{
+			DisplayName: meta.DisplayName,
+			Address:     user + "@" + d.Name,
+		}
+		if e.DisplayName == "" {
+			e.DisplayName = user
+		}
+		if kp != nil {
+			pub, err := kp.GetPublicKey(ctx, user)
+			switch {
+			case err == nil:
+				e.KeyFingerprint = KeyFingerprint(pub)
+			case !errors.Is(err, autherrors.ErrKeyNotFound):
+				return nil, fmt.Errorf("public key for %s: %w", e.Address, err)
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// KeyFingerprint returns the hex SHA-256 of a public key.
+func KeyFingerprint(pub []byte) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:])
+}
+
+// WriteGALJSON writes entries to w as a JSON array.
+func WriteGALJSON(w io.Writer, entries []GALEntry) error {
+	if entries == nil {
+		entries = []GALEntry{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(entries)
+}
+
+// WriteGALVCard writes entries to w as vCard 4.0 (RFC 6350) records. The
+// key fingerprint is carried in an X-KEY-FINGERPRINT property.
+func WriteGALVCard(w io.Writer, entries []GALEntry) error {
+	var b strings.Builder
+	for _, e := range entries {
+		b.WriteString("BEGIN:VCARD\r\nVERSION:4.0\r\n")
+		fmt.Fprintf(&b, "FN:%s\r\n", vcardEscape(e.DisplayName))
+		fmt.Fprintf(&b, "EMAIL;TYPE=work:%s\r\n", vcardEscape(e.Address))
+		if e.KeyFingerprint != "" {
+			fmt.Fprintf(&b, "X-KEY-FINGERPRINT:sha256:%s\r\n", e.KeyFingerprint)
+		}
+		b.WriteString("END:VCARD\r\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// vcardEscape escapes a vCard text value (RFC 6350 section 3.4).
+var vcardEscape = strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\n", `\n`, "\r", "").Replace
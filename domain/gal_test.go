@@ -0,0 +1,85 @@
+package domain
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExportGAL(t *testing.T) {
+	p, base := newTestDomainsTree(t, "alice:x:alice\nbob:x:bob\nsvc:x:svc\n", "example.com")
+	dir := filepath.Join(base, "example.com")
+	if err := os.WriteFile(filepath.Join(dir, UserMetadataFile), []byte(
+		"[Alice]\ndisplay_name = \"Alice Example\"\n\n[svc]\ngal_hidden = true\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "keys", "alice.pub"), []byte("alice-public-key"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := p.GetDomain("example.com")
+	if d == nil {
+		t.Fatal("expected domain to load")
+	}
+	entries, err := d.ExportGAL(context.Background())
+	if err != nil {
+		t.Fatalf("ExportGAL: %v", err)
+	}
+	want := []GALEntry{
+		{DisplayName: "Alice Example", Address: "alice@example.com", KeyFingerprint: KeyFingerprint([]byte("alice-public-key"))},
+		{DisplayName: "bob", Address: "bob@example.com"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries, want %d: %+v", len(entries), len(want), entries)
+	}
+	for i := range want {
+		if entries[i] != want[i] {
+			t.Errorf("entry %d = %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WriteGALJSON(&buf, entries); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []GALEntry
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil || len(decoded) != 2 {
+		t.Errorf("JSON round trip: %v, %+v", err, decoded)
+	}
+
+	buf.Reset()
+	if err := WriteGALVCard(&buf, entries); err != nil {
+		t.Fatal(err)
+	}
+	vcf := buf.String()
+	if strings.Count(vcf, "BEGIN:VCARD\r\n") != 2 ||
+		!strings.Contains(vcf, "FN:Alice Example\r\n") ||
+		!strings.Contains(vcf, "EMAIL;TYPE=work:bob@example.com\r\n") ||
+		!strings.Contains(vcf, "X-KEY-FINGERPRINT:sha256:"+want[0].KeyFingerprint) {
+		t.Errorf("unexpected vCard output:\n%s", vcf)
+	}
+}
+
+func TestExportGAL_DomainOptOut(t *testing.T) {
+	p, base := newTestDomainsTree(t, "alice:x:alice\n", "example.com")
+	writeDomainConfig(t, base, "example.com", "[gal]\nopt_out = true\n")
+
+	d := p.GetDomain("example.com")
+	if d == nil {
+		t.Fatal("expected domain to load")
+	}
+	entries, err := d.ExportGAL(context.Background())
+	if err != nil || len(entries) != 0 {
+		t.Errorf("ExportGAL = %+v, %v; want no entries", entries, err)
+	}
+}
+
+func TestVCardEscape(t *testing.T) {
+	if got := vcardEscape("Doe, Jane; \\ops\nteam"); got != `Doe\, Jane\; \\ops\nteam` {
+		t.Errorf("vcardEscape = %q", got)
+	}
+}
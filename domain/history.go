@@ -0,0 +1,231 @@
+package domain
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/vfs"
+)
+
+// protocolKeyType is the context key type for the client protocol.
+type protocolKeyType struct{}
+
+// ProtocolKey is the context key used to pass the protocol a login arrives
+// on (e.g., "imap", "pop3", "submission") to the AuthRouter for login
+// history and service entitlements (see auth.ServiceSet). Use
+// WithProtocol to set it.
+var ProtocolKey = protocolKeyType{}
+
+// WithProtocol returns a context with the client protocol set.
+func WithProtocol(ctx context.Context, protocol string) context.Context {
+	return context.WithValue(ctx, ProtocolKey, protocol)
+}
+
+// protocolFromContext extracts the protocol from the context.
+// Returns empty string if not set.
+func protocolFromContext(ctx context.Context) string {
+	p, _ := ctx.Value(ProtocolKey).(string)
+	return p
+}
+
+// DefaultLoginHistoryPerUser is the number of records retained per user when
+// WithLoginHistory is called with zero.
+const DefaultLoginHistoryPerUser = 50
+
+// loginHistoryCompactBytes is the file size that triggers compaction down to
+// perUser records per user.
+const loginHistoryCompactBytes = 1 << 20
+
+// loginHistory is a per-domain login record store persisted as JSON lines
+// appended to a file. Attempts for unknown users are never recorded, so the
+// file is bounded by the number of accounts times perUser after compaction.
+type loginHistory struct {
+	mu      sync.Mutex
+	fsys    vfs.WriteFS
+	path    string
+	perUser int
+}
+
+func newLoginHistory(fsys vfs.WriteFS, path string, perUser int) *loginHistory {
+	if perUser <= 0 {
+		perUser = DefaultLoginHistoryPerUser
+	}
+	return &loginHistory{fsys: fsys, path: path, perUser: perUser}
+}
+
+// record appends rec, compacting the file once it grows past the threshold.
+// The append holds the filesystem's lock on the file (see vfs.Lock), as
+// compaction does, so a compaction in another process never drops it.
+func (h *loginHistory) record(rec auth.LoginRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("encode login record: %w", err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	unlock, err := vfs.Lock(h.fsys, h.path)
+	if err != nil {
+		return fmt.Errorf("lock login history: %w", err)
+	}
+	defer unlock()
+
+	if err := h.fsys.AppendFile(h.path, append(data, '\n'), 0o600); err != nil {
+		return fmt.Errorf("write login history: %w", err)
+	}
+	if fi, err := h.fsys.Stat(h.path); err == nil && fi.Size() > loginHistoryCompactBytes {
+		return h.compact()
+	}
+	return nil
+}
+
+// list returns up to limit records for username, newest first.
+func (h *loginHistory) list(username string, limit int) ([]auth.LoginRecord, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	all, err := h.load()
+	if err != nil {
+		return nil, err
+	}
+	username = strings.ToLower(username)
+	var out []auth.LoginRecord
+	for i := len(all) - 1; i >= 0; i-- {
+		if all[i].Username != username {
+			continue
+		}
+		out = append(out, all[i])
+		if limit > 0 && len(out) == limit {
+			break
+		}
+	}
+	return out, nil
+}
+
+// load reads every record in file order. Caller must hold h.mu.
+func (h *loginHistory) load() ([]auth.LoginRecord, error) {
+	f, err := h.fsys.Open(h.path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("open login history: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	var recs []auth.LoginRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec auth.LoginRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue // skip a torn final line
+		}
+		recs = append(recs, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read login history: %w", err)
+	}
+	return recs, nil
+}
+
+// compact rewrites the file keeping the newest perUser records per user.
+// Caller must hold h.mu and the file's lock.
+func (h *loginHistory) compact() error {
+	all, err := h.load()
+	if err != nil {
+		return err
+	}
+	counts := make(map[string]int)
+	keep := make([]bool, len(all))
+	for i := len(all) - 1; i >= 0; i-- {
+		u := all[i].Username
+		if counts[u] < h.perUser {
+			counts[u]++
+			keep[i] = true
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i, rec := range all {
+		if !keep[i] {
+			continue
+		}
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	if err := vfs.WriteFileAtomic(h.fsys, h.path, buf.Bytes(), 0o600); err != nil {
+		return fmt.Errorf("compact login history: %w", err)
+	}
+	return nil
+}
+
+// GetLoginHistory returns up to limit of localpart's most recent login
+// records in this domain, newest first. Returns an empty slice when login
+// history is not enabled for the provider (see WithLoginHistory).
+func (d *Domain) GetLoginHistory(_ context.Context, localpart string, limit int) ([]auth.LoginRecord, error) {
+	if d.history == nil {
+		return nil, nil
+	}
+	return d.history.list(localpart, limit)
+}
+
+// recordLogin stores a login attempt against d in its history and login
+// state, for those enabled. Failures to record are logged, never returned:
+// history must not block authentication.
+func (d *Domain) recordLogin(ctx context.Context, localpart string, outcome auth.LoginOutcome) {
+	if d.history == nil && d.loginState == nil {
+		return
+	}
+	rec := auth.LoginRecord{
+		Time:     time.Now().UTC(),
+		Username: strings.ToLower(localpart),
+		RemoteIP: clientIPFromContext(ctx),
+		Protocol: protocolFromContext(ctx),
+		Outcome:  outcome,
+	}
+	if d.history != nil {
+		if err := d.history.record(rec); err != nil {
+			loggerOrDefault(d.Logger).Warn("failed to record login",
+				slog.String("username", rec.Username),
+				slog.String("error", err.Error()))
+		}
+	}
+	if d.loginState != nil {
+		if err := d.loginState.Record(rec.Username, rec.RemoteIP, rec.Protocol, outcome, rec.Time); err != nil {
+			loggerOrDefault(d.Logger).Warn("failed to record login state",
+				slog.String("username", rec.Username),
+				slog.String("error", err.Error()))
+		}
+	}
+}
+
+// Compile-time check: AuthRouter serves login history.
+var _ auth.LoginHistoryProvider = (*AuthRouter)(nil)
+
+// GetLoginHistory returns the login history for user@domain, routing to the
+// user's domain. Implements auth.LoginHistoryProvider. Users of the fallback
+// agent, or of unserved domains, have no history.
+func (r *AuthRouter) GetLoginHistory(ctx context.Context, username string, limit int) ([]auth.LoginRecord, error) {
+	localPart, domainName := SplitUsername(username)
+	base, _ := ParseLocalPart(localPart)
+	if r.provider == nil || domainName == "" {
+		return nil, nil
+	}
+	d := r.provider.GetDomain(domainName)
+	if d == nil {
+		return nil, nil
+	}
+	return d.GetLoginHistory(ctx, base, limit)
+}
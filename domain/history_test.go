@@ -0,0 +1,145 @@
+package domain
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/passwd"
+	"github.com/infodancer/auth/vfs"
+)
+
+func TestAuthRouter_LoginHistory(t *testing.T) {
+	hash, err := passwd.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := newTestDomainsTree(t, "alice:"+hash+":alice\n", "example.com")
+	p.WithLoginHistory(2)
+	r := NewAuthRouter(p, nil)
+
+	ctx := WithProtocol(WithClientIP(context.Background(), "192.0.2.7"), "imap")
+	if _, err := r.Authenticate(ctx, "alice@example.com", "wrong"); err == nil {
+		t.Fatal("expected failure with wrong password")
+	}
+	if _, err := r.Authenticate(ctx, "alice+x@example.com", "secret"); err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	// Unknown users leave no trace.
+	_, _ = r.Authenticate(ctx, "mallory@example.com", "secret")
+
+	history, err := r.GetLoginHistory(context.Background(), "alice@example.com", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("expected 2 records, got %+v", history)
+	}
+	if history[0].Outcome != auth.LoginSuccess || history[1].Outcome != auth.LoginFailure {
+		t.Errorf("expected newest first (success, failure), got %+v", history)
+	}
+	if history[0].RemoteIP != "192.0.2.7" || history[0].Protocol != "imap" {
+		t.Errorf("unexpected record details: %+v", history[0])
+	}
+
+	limited, err := r.GetLoginHistory(context.Background(), "alice@example.com", 1)
+	if err != nil || len(limited) != 1 || limited[0].Outcome != auth.LoginSuccess {
+		t.Errorf("GetLoginHistory limit 1 = %+v, %v", limited, err)
+	}
+	if none, _ := r.GetLoginHistory(context.Background(), "mallory@example.com", 0); len(none) != 0 {
+		t.Errorf("expected no history for unknown user, got %+v", none)
+	}
+}
+
+func TestLoginHistory_Compact(t *testing.T) {
+	h := newLoginHistory(vfs.OS{}, t.TempDir()+"/history", 2)
+	for i := 0; i < 5; i++ {
+		for _, u := range []string{"alice", "bob"} {
+			if err := h.record(auth.LoginRecord{Username: u, Outcome: auth.LoginSuccess, Protocol: string(rune('a' + i))}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := lockedCompact(h); err != nil {
+		t.Fatal(err)
+	}
+	recs, err := h.list("alice", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 || recs[0].Protocol != "e" || recs[1].Protocol != "d" {
+		t.Errorf("expected alice's newest 2 records after compaction, got %+v", recs)
+	}
+}
+
+// lockedCompact compacts h as record does, holding h.mu and the file lock.
+func lockedCompact(h *loginHistory) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	unlock, err := vfs.Lock(h.fsys, h.path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return h.compact()
+}
+
+func TestLoginHistory_CompactConcurrentRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".login_history")
+
+	// Two histories on one file stand for two processes serving the domain.
+	writer := newLoginHistory(vfs.OS{}, path, 1000)
+	compactor := newLoginHistory(vfs.OS{}, path, 1000)
+	const n = 200
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := lockedCompact(compactor); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < n; i++ {
+		if err := writer.record(auth.LoginRecord{Username: "alice", Outcome: auth.LoginSuccess}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	recs, err := writer.list("alice", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != n {
+		t.Errorf("got %d records after concurrent compaction, want %d", len(recs), n)
+	}
+}
+
+func TestLoginHistory_ProviderFS(t *testing.T) {
+	mem := vfs.NewMemFS()
+	if err := mem.MkdirAll("/data", 0o750); err != nil {
+		t.Fatal(err)
+	}
+	h := newLoginHistory(mem, "/data/.login_history", 2)
+	if err := h.record(auth.LoginRecord{Username: "alice", Outcome: auth.LoginSuccess}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Stat("/data/.login_history"); err != nil {
+		t.Errorf("history not written to the FS: %v", err)
+	}
+	if recs, err := h.list("alice", 0); err != nil || len(recs) != 1 {
+		t.Errorf("list = %+v, %v", recs, err)
+	}
+}
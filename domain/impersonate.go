@@ -0,0 +1,298 @@
+package domain
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/atrest"
+	"github.com/infodancer/auth/audit"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// ImpersonationMechanism is the mechanism recorded for logins with an
+// impersonation token in audit records and traces.
+const ImpersonationMechanism = "IMPERSONATION"
+
+// DefaultImpersonationTTL is the lifetime of an impersonation token when
+// ImpersonationRequest sets none; MaxImpersonationTTL is the longest
+// allowed.
+const (
+	DefaultImpersonationTTL = 15 * time.Minute
+	MaxImpersonationTTL     = time.Hour
+)
+
+// impersonationPrefix starts every impersonation token, so daemons can
+// tell one from a password.
+const impersonationPrefix = "imp1."
+
+// ImpersonationRequest asks for a token letting an operator act as a user.
+type ImpersonationRequest struct {
+	// Operator identifies the member of staff, as the admin API
+	// authenticated them. Required.
+	Operator string
+
+	// Username is the user to act as, "user@domain". Required.
+	Username string
+
+	// Scope lists the protocols the token is accepted on (compared with
+	// the login's WithProtocol, ignoring case), such as "imap"; "*"
+	// accepts any. Required.
+	Scope []string
+
+	// Reason says why, such as a ticket number. Required; it is audited
+	// with the token and every login made with it.
+	Reason string
+
+	// TTL is the token's lifetime: 0 means DefaultImpersonationTTL, and
+	// more than MaxImpersonationTTL is refused.
+	TTL time.Duration
+}
+
+// Impersonation is the grant an impersonation token carries.
+type Impersonation struct {
+	ID       string    `json:"id"`
+	Operator string    `json:"operator"`
+	Username string    `json:"username"`
+	Scope    []string  `json:"scope"`
+	Reason   string    `json:"reason"`
+	Issued   time.Time `json:"issued"`
+	Expires  time.Time `json:"expires"`
+}
+
+// allows reports whether the grant covers logins on protocol.
+func (imp *Impersonation) allows(protocol string) bool {
+	return slices.ContainsFunc(imp.Scope, func(s string) bool {
+		return s == "*" || (protocol != "" && strings.EqualFold(s, protocol))
+	})
+}
+
+// WithImpersonation enables impersonation tokens sealed with key, which
+// should be its own key rather than the at-rest host key: anyone holding
+// it can mint tokens for any user. Without it MintImpersonationToken and
+// AuthenticateToken fail with errors.ErrMechanismUnsupported.
+func (r *AuthRouter) WithImpersonation(key *atrest.Key) *AuthRouter {
+	r.impersonationKey = key
+	return r
+}
+
+// MintImpersonationToken returns a token letting req.Operator log in as
+// req.Username with AuthenticateToken until it expires, for support staff
+// reproducing what a user sees. The router does not check who the
+// operator is: only admin tooling that has authenticated and authorized
+// them may call it.
+//
+// The user must exist. Every request is audited as audit.OpImpersonate
+// with the operator, token ID and reason, whether or not a token is
+// minted, and logged at warning level.
+func (r *AuthRouter) MintImpersonationToken(ctx context.Context, req ImpersonationRequest) (string, *Impersonation, error) {
+	start := time.Now()
+	token, imp, err := r.mintImpersonationToken(ctx, req)
+	if err != nil {
+		slog.Warn("impersonation refused", "operator", req.Operator, "username", req.Username, "error", err)
+	} else {
+		slog.Warn("impersonation token minted", "operator", imp.Operator, "username", imp.Username,
+			"token_id", imp.ID, "scope", imp.Scope, "expires", imp.Expires, "reason", imp.Reason)
+	}
+	if r.auditor != nil {
+		rec := r.auditRecord(ctx, start, audit.OpImpersonate, req.Username)
+		rec.Operator, rec.Reason = req.Operator, req.Reason
+		if err != nil {
+			rec.Outcome, rec.Error = audit.OutcomeFailure, err.Error()
+		} else {
+			rec.Outcome, rec.TokenID = audit.OutcomeSuccess, imp.ID
+		}
+		r.emitAudit(ctx, rec)
+	}
+	return token, imp, err
+}
+
+// mintImpersonationToken is MintImpersonationToken without auditing.
+func (r *AuthRouter) mintImpersonationToken(ctx context.Context, req ImpersonationRequest) (string, *Impersonation, error) {
+	if r.impersonationKey == nil {
+		return "", nil, fmt.Errorf("%w: impersonation tokens not enabled", autherrors.ErrMechanismUnsupported)
+	}
+	switch {
+	case req.Operator == "":
+		return "", nil, errors.New("impersonation: no operator")
+	case req.Reason == "":
+		return "", nil, errors.New("impersonation: no reason")
+	case len(req.Scope) == 0:
+		return "", nil, errors.New("impersonation: no scope")
+	case req.TTL < 0 || req.TTL > MaxImpersonationTTL:
+		return "", nil, fmt.Errorf("impersonation: lifetime %v outside 0 to %v", req.TTL, MaxImpersonationTTL)
+	}
+	ttl := req.TTL
+	if ttl == 0 {
+		ttl = DefaultImpersonationTTL
+	}
+	d, base, err := r.impersonatedUser(ctx, req.Username)
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now()
+	imp := &Impersonation{
+		ID:       rand.Text(),
+		Operator: req.Operator,
+		Username: base + "@" + d.Name,
+		Scope:    slices.Clone(req.Scope),
+		Reason:   req.Reason,
+		Issued:   now.UTC(),
+		Expires:  now.Add(ttl).UTC(),
+	}
+	data, err := json.Marshal(imp)
+	if err != nil {
+		return "", nil, err
+	}
+	sealed, err := atrest.Seal(r.impersonationKey, data)
+	if err != nil {
+		return "", nil, err
+	}
+	return impersonationPrefix + base64.RawURLEncoding.EncodeToString(sealed), imp, nil
+}
+
+// impersonatedUser resolves username to its domain and canonical
+// localpart, failing with errors.ErrUserNotFound unless the user exists.
+func (r *AuthRouter) impersonatedUser(ctx context.Context, username string) (*Domain, string, error) {
+	localPart, domainName := SplitUsername(username)
+	base, _ := ParseLocalPart(localPart)
+	if r.provider == nil || domainName == "" {
+		return nil, "", autherrors.ErrUserNotFound
+	}
+	d, _ := ResolveDomain(r.provider, domainName)
+	if d == nil {
+		return nil, "", autherrors.ErrUserNotFound
+	}
+	if canonical, ok := d.NormalizeLocalpart(base); ok {
+		base = canonical
+	}
+	exists, err := d.AuthAgent.UserExists(ctx, base)
+	if err != nil {
+		return nil, "", err
+	}
+	if !exists {
+		return nil, "", fmt.Errorf("%w: %s", autherrors.ErrUserNotFound, username)
+	}
+	return d, base, nil
+}
+
+// AuthenticateToken logs in as the user an impersonation token from
+// MintImpersonationToken was minted for. The token must be unexpired and
+// its scope must cover the protocol in the context (see WithProtocol); the
+// user must still exist and be allowed to log in, and their domain must
+// not be frozen. Anything else fails with errors.ErrAuthFailed.
+//
+// The session has Credential.Kind auth.CredentialImpersonation with the
+// token ID and operator, and no private key, so the operator sees what the
+// user sees without their encrypted mail. Each login is audited with the
+// operator, token ID and reason and logged at warning level. Rate limits,
+// anomaly scoring, second factors, login history and login notices do not
+// apply.
+func (r *AuthRouter) AuthenticateToken(ctx context.Context, token string) (*AuthResult, error) {
+	start := time.Now()
+	ctx, span := startLoginSpan(ctx, ImpersonationMechanism)
+	imp, err := r.openImpersonationToken(ctx, token)
+	var result *AuthResult
+	if err == nil {
+		result, err = r.authenticateImpersonation(ctx, imp)
+	}
+	username := ""
+	if imp != nil {
+		username = imp.Username
+	}
+	endLoginSpan(span, username, result, err)
+	r.auditImpersonation(ctx, start, imp, result, err)
+	if err != nil {
+		slog.Warn("impersonation login refused", "username", username, "error", err)
+	} else {
+		slog.Warn("impersonation login", "operator", imp.Operator, "username", imp.Username,
+			"token_id", imp.ID, "protocol", protocolFromContext(ctx))
+	}
+	return result, err
+}
+
+// openImpersonationToken returns the grant in token if it is genuine,
+// unexpired and covers the context's protocol. The grant is returned with
+// the error when only the last two checks fail, for auditing.
+func (r *AuthRouter) openImpersonationToken(ctx context.Context, token string) (*Impersonation, error) {
+	if r.impersonationKey == nil {
+		return nil, fmt.Errorf("%w: impersonation tokens not enabled", autherrors.ErrMechanismUnsupported)
+	}
+	raw, ok := strings.CutPrefix(token, impersonationPrefix)
+	if !ok {
+		return nil, fmt.Errorf("%w: not an impersonation token", autherrors.ErrAuthFailed)
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed impersonation token", autherrors.ErrAuthFailed)
+	}
+	data, err := atrest.Unseal(r.impersonationKey, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("%w: impersonation token not genuine", autherrors.ErrAuthFailed)
+	}
+	var imp Impersonation
+	if err := json.Unmarshal(data, &imp); err != nil {
+		return nil, fmt.Errorf("%w: malformed impersonation token", autherrors.ErrAuthFailed)
+	}
+	if !time.Now().Before(imp.Expires) {
+		return &imp, fmt.Errorf("%w: impersonation token expired", autherrors.ErrAuthFailed)
+	}
+	if protocol := protocolFromContext(ctx); !imp.allows(protocol) {
+		return &imp, fmt.Errorf("%w: impersonation token not valid for protocol %q", autherrors.ErrAuthFailed, protocol)
+	}
+	return &imp, nil
+}
+
+// authenticateImpersonation opens a session for imp's user.
+func (r *AuthRouter) authenticateImpersonation(ctx context.Context, imp *Impersonation) (*AuthResult, error) {
+	d, base, err := r.impersonatedUser(ctx, imp.Username)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.checkFrozen(); err != nil {
+		return nil, err
+	}
+	if err := d.checkCanLogin(ctx, base); err != nil {
+		return nil, err
+	}
+	session, err := d.passwordlessSession(ctx, base, auth.Credential{
+		Kind:     auth.CredentialImpersonation,
+		ID:       imp.ID,
+		Operator: imp.Operator,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &AuthResult{Session: session, Domain: d}, nil
+}
+
+// auditImpersonation records a login with the impersonation token for imp,
+// started at start. imp is nil when the token could not be opened.
+func (r *AuthRouter) auditImpersonation(ctx context.Context, start time.Time, imp *Impersonation, result *AuthResult, err error) {
+	if r.auditor == nil {
+		return
+	}
+	var username string
+	if imp != nil {
+		username = imp.Username
+	}
+	rec := r.auditRecord(ctx, start, audit.OpAuthenticate, username)
+	rec.Mechanism = ImpersonationMechanism
+	if imp != nil {
+		rec.Operator, rec.TokenID, rec.Reason = imp.Operator, imp.ID, imp.Reason
+	}
+	if err != nil {
+		rec.Outcome, rec.Error = audit.OutcomeFailure, err.Error()
+	} else {
+		rec.Outcome, rec.Domain = audit.OutcomeSuccess, result.Domain.Name
+	}
+	r.emitAudit(ctx, rec)
+}
@@ -0,0 +1,171 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/atrest"
+	"github.com/infodancer/auth/audit"
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/passwd"
+)
+
+// impersonationRouter returns a router with impersonation tokens enabled
+// for a tree where alice@example.com exists, and its auditor.
+func impersonationRouter(t *testing.T) (*AuthRouter, *recordingAuditor) {
+	t.Helper()
+	hash, err := passwd.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := newTestDomainsTree(t, "alice:"+hash+":alice\n", "example.com")
+	key, err := atrest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &recordingAuditor{}
+	r := NewAuthRouter(p, nil).WithImpersonation(key).WithAuditor(rec)
+	t.Cleanup(func() { _ = r.Close() })
+	return r, rec
+}
+
+func TestImpersonation(t *testing.T) {
+	r, rec := impersonationRouter(t)
+	ctx := WithProtocol(context.Background(), "imap")
+
+	token, imp, err := r.MintImpersonationToken(ctx, ImpersonationRequest{
+		Operator: "support-jo",
+		Username: "alice@Example.com",
+		Scope:    []string{"IMAP"},
+		Reason:   "ticket 4711",
+	})
+	if err != nil {
+		t.Fatalf("MintImpersonationToken: %v", err)
+	}
+	if imp.Username != "alice@example.com" || imp.ID == "" || imp.Expires.Sub(imp.Issued) != DefaultImpersonationTTL {
+		t.Errorf("grant = %+v", imp)
+	}
+	if strings.Contains(token, "ticket") || strings.Contains(token, "support-jo") {
+		t.Error("token carries its grant in the clear")
+	}
+
+	result, err := r.AuthenticateToken(ctx, token)
+	if err != nil {
+		t.Fatalf("AuthenticateToken: %v", err)
+	}
+	cred := result.Session.Credential
+	if result.Session.User.Username != "alice" || cred.Kind != auth.CredentialImpersonation ||
+		cred.ID != imp.ID || cred.Operator != "support-jo" || result.Session.KeysUnlocked() {
+		t.Errorf("session = %+v", result.Session)
+	}
+
+	// Out of scope.
+	if _, err := r.AuthenticateToken(WithProtocol(context.Background(), "pop3"), token); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("pop3: err = %v, want ErrAuthFailed", err)
+	}
+
+	if len(rec.recs) != 3 {
+		t.Fatalf("records = %+v, want 3", rec.recs)
+	}
+	minted, login := rec.recs[0], rec.recs[1]
+	if minted.Op != audit.OpImpersonate || minted.Outcome != audit.OutcomeSuccess ||
+		minted.Operator != "support-jo" || minted.TokenID != imp.ID || minted.Reason != "ticket 4711" {
+		t.Errorf("mint record = %+v", minted)
+	}
+	if login.Op != audit.OpAuthenticate || login.Outcome != audit.OutcomeSuccess || login.Mechanism != ImpersonationMechanism ||
+		login.Username != "alice@example.com" || login.Operator != "support-jo" || login.TokenID != imp.ID {
+		t.Errorf("login record = %+v", login)
+	}
+	if rec.recs[2].Outcome != audit.OutcomeFailure || rec.recs[2].TokenID != imp.ID {
+		t.Errorf("refused login record = %+v", rec.recs[2])
+	}
+}
+
+func TestImpersonation_Refused(t *testing.T) {
+	r, rec := impersonationRouter(t)
+	ctx := WithProtocol(context.Background(), "imap")
+	req := ImpersonationRequest{Operator: "jo", Username: "alice@example.com", Scope: []string{"*"}, Reason: "ticket 1"}
+
+	for name, mutate := range map[string]func(*ImpersonationRequest){
+		"no operator":  func(q *ImpersonationRequest) { q.Operator = "" },
+		"no reason":    func(q *ImpersonationRequest) { q.Reason = "" },
+		"no scope":     func(q *ImpersonationRequest) { q.Scope = nil },
+		"too long":     func(q *ImpersonationRequest) { q.TTL = 2 * MaxImpersonationTTL },
+		"unknown user": func(q *ImpersonationRequest) { q.Username = "carol@example.com" },
+	} {
+		q := req
+		mutate(&q)
+		if _, _, err := r.MintImpersonationToken(ctx, q); err == nil {
+			t.Errorf("%s: minted", name)
+		}
+	}
+	for _, rc := range rec.recs {
+		if rc.Op != audit.OpImpersonate || rc.Outcome != audit.OutcomeFailure {
+			t.Errorf("refusal record = %+v", rc)
+		}
+	}
+
+	// Forged, tampered and foreign tokens.
+	token, _, err := r.MintImpersonationToken(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := atrest.GenerateKey()
+	foreign := NewAuthRouter(r.provider, nil).WithImpersonation(other)
+	for name, try := range map[string]func() error{
+		"password":      func() error { _, err := r.AuthenticateToken(ctx, "secret"); return err },
+		"tampered":      func() error { _, err := r.AuthenticateToken(ctx, token[:len(token)-2]+"AA"); return err },
+		"other key":     func() error { _, err := foreign.AuthenticateToken(ctx, token); return err },
+		"empty payload": func() error { _, err := r.AuthenticateToken(ctx, impersonationPrefix); return err },
+	} {
+		if err := try(); !errors.Is(err, autherrors.ErrAuthFailed) {
+			t.Errorf("%s: err = %v, want ErrAuthFailed", name, err)
+		}
+	}
+
+	// A frozen domain refuses the token like any other login.
+	if err := r.provider.(*FilesystemDomainProvider).FreezeDomain("example.com", "abuse"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.AuthenticateToken(ctx, token); !errors.Is(err, autherrors.ErrDomainFrozen) {
+		t.Errorf("frozen: err = %v, want ErrDomainFrozen", err)
+	}
+
+	// Without a key nothing is minted or accepted.
+	plain := NewAuthRouter(r.provider, nil)
+	if _, _, err := plain.MintImpersonationToken(ctx, req); !errors.Is(err, autherrors.ErrMechanismUnsupported) {
+		t.Errorf("disabled mint: err = %v", err)
+	}
+	if _, err := plain.AuthenticateToken(ctx, token); !errors.Is(err, autherrors.ErrMechanismUnsupported) {
+		t.Errorf("disabled login: err = %v", err)
+	}
+}
+
+func TestImpersonation_Expiry(t *testing.T) {
+	imp := &Impersonation{Scope: []string{"imap", "Submission"}}
+	for protocol, want := range map[string]bool{"imap": true, "IMAP": true, "submission": true, "pop3": false, "": false} {
+		if got := imp.allows(protocol); got != want {
+			t.Errorf("allows(%q) = %v, want %v", protocol, got, want)
+		}
+	}
+	if !(&Impersonation{Scope: []string{"*"}}).allows("") {
+		t.Error(`"*" does not cover a login without protocol`)
+	}
+
+	r, _ := impersonationRouter(t)
+	ctx := WithProtocol(context.Background(), "imap")
+	token, _, err := r.MintImpersonationToken(ctx, ImpersonationRequest{
+		Operator: "jo", Username: "alice@example.com", Scope: []string{"imap"}, Reason: "r", TTL: time.Nanosecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if _, err := r.AuthenticateToken(ctx, token); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("expired: err = %v, want ErrAuthFailed", err)
+	}
+}
@@ -3,10 +3,12 @@ package domain
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"sync"
 
 	"github.com/infodancer/auth"
 	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/tracing"
 )
 
 // lazyAuthAgent defers auth.OpenAuthAgent() until the first auth-related method
@@ -15,7 +17,14 @@ import (
 // for privilege-dropped processes that only need domain metadata (forwarding
 // rules, spam config, message size limits) and never authenticate users.
 type lazyAuthAgent struct {
-	cfg   auth.AuthAgentConfig
+	cfg    auth.AuthAgentConfig
+	chain  []auth.AuthAgentConfig // when set, opened as an auth.ChainAgent instead of cfg
+	logger *slog.Logger           // nil: slog.Default()
+
+	// degraded, when set, serves UserExists from remembered answers and
+	// types login failures while the backend is down (see DegradedConfig).
+	degraded *degradedCache
+
 	once  sync.Once
 	agent auth.AuthenticationAgent
 	err   error
@@ -27,26 +36,67 @@ var (
 	_ auth.KeyProvider         = (*lazyAuthAgent)(nil)
 )
 
+// typeName returns the configured agent type for logging.
+func (l *lazyAuthAgent) typeName() string {
+	if len(l.chain) > 0 {
+		return "chain"
+	}
+	return l.cfg.Type
+}
+
 func (l *lazyAuthAgent) init() {
 	l.once.Do(func() {
-		l.agent, l.err = auth.OpenAuthAgent(l.cfg)
+		_, span := tracing.Start(context.Background(), "auth.OpenAgent",
+			tracing.String(tracing.AttrBackend, l.typeName()))
+		defer func() { tracing.End(span, l.err) }()
+		if len(l.chain) > 0 {
+			var chain *auth.ChainAgent
+			if chain, l.err = auth.OpenChainAgent(l.chain); l.err == nil {
+				l.agent = chain
+			}
+		} else {
+			l.agent, l.err = auth.OpenAuthAgent(l.cfg)
+		}
+		logger := loggerOrDefault(l.logger)
+		if l.err != nil {
+			logger.Warn("failed to open auth agent",
+				slog.String("auth_type", l.typeName()),
+				slog.String("error", l.err.Error()))
+			return
+		}
+		logger.Debug("opened auth agent",
+			slog.String("auth_type", l.typeName()),
+			slog.String("credential_backend", l.cfg.CredentialBackend))
 	})
 }
 
 func (l *lazyAuthAgent) Authenticate(ctx context.Context, username, password string) (*auth.AuthSession, error) {
 	l.init()
 	if l.err != nil {
-		return nil, fmt.Errorf("auth agent init: %w", l.err)
+		return nil, l.degraded.unavailable(fmt.Errorf("auth agent init: %w", l.err))
+	}
+	session, err := l.agent.Authenticate(ctx, username, password)
+	return session, l.degraded.unavailable(err)
+}
+
+// AuthenticateCredentials verifies creds with the inner agent (see
+// auth.VerifyCredentials).
+func (l *lazyAuthAgent) AuthenticateCredentials(ctx context.Context, creds auth.Credentials) (*auth.AuthSession, error) {
+	l.init()
+	if l.err != nil {
+		return nil, l.degraded.unavailable(fmt.Errorf("auth agent init: %w", l.err))
 	}
-	return l.agent.Authenticate(ctx, username, password)
+	session, err := auth.VerifyCredentials(ctx, l.agent, creds)
+	return session, l.degraded.unavailable(err)
 }
 
 func (l *lazyAuthAgent) UserExists(ctx context.Context, username string) (bool, error) {
 	l.init()
 	if l.err != nil {
-		return false, fmt.Errorf("auth agent init: %w", l.err)
+		return l.degraded.userExists(username, false, fmt.Errorf("auth agent init: %w", l.err))
 	}
-	return l.agent.UserExists(ctx, username)
+	exists, err := l.agent.UserExists(ctx, username)
+	return l.degraded.userExists(username, exists, err)
 }
 
 func (l *lazyAuthAgent) GetPublicKey(ctx context.Context, username string) ([]byte, error) {
@@ -54,23 +104,160 @@ func (l *lazyAuthAgent) GetPublicKey(ctx context.Context, username string) ([]by
 	if l.err != nil {
 		return nil, autherrors.ErrKeyNotFound
 	}
-	if kp, ok := l.agent.(auth.KeyProvider); ok {
+	if kp, ok := auth.AsKeyProvider(l.agent); ok {
 		return kp.GetPublicKey(ctx, username)
 	}
 	return nil, autherrors.ErrKeyNotFound
 }
 
+// GetPublicKeys delegates to the inner agent if it implements
+// auth.KeyProvider.
+func (l *lazyAuthAgent) GetPublicKeys(ctx context.Context, usernames []string) (map[string][]byte, error) {
+	l.init()
+	if l.err != nil {
+		return map[string][]byte{}, nil
+	}
+	if kp, ok := auth.AsKeyProvider(l.agent); ok {
+		return kp.GetPublicKeys(ctx, usernames)
+	}
+	return map[string][]byte{}, nil
+}
+
+// GetPublicKeyWithFormat delegates to the inner agent if it implements
+// auth.KeyProvider.
+func (l *lazyAuthAgent) GetPublicKeyWithFormat(ctx context.Context, username string) ([]byte, auth.KeyFormat, error) {
+	l.init()
+	if l.err != nil {
+		return nil, "", autherrors.ErrKeyNotFound
+	}
+	if kp, ok := auth.AsKeyProvider(l.agent); ok {
+		return auth.PublicKeyWithFormat(ctx, kp, username)
+	}
+	return nil, "", autherrors.ErrKeyNotFound
+}
+
 func (l *lazyAuthAgent) HasEncryption(ctx context.Context, username string) (bool, error) {
 	l.init()
 	if l.err != nil {
 		return false, nil
 	}
-	if kp, ok := l.agent.(auth.KeyProvider); ok {
+	if kp, ok := auth.AsKeyProvider(l.agent); ok {
 		return kp.HasEncryption(ctx, username)
 	}
 	return false, nil
 }
 
+// TOTPEnabled delegates to the inner agent if it implements auth.MFAAgent.
+func (l *lazyAuthAgent) TOTPEnabled(ctx context.Context, username string) (bool, error) {
+	l.init()
+	if l.err != nil {
+		return false, fmt.Errorf("auth agent init: %w", l.err)
+	}
+	if m, ok := auth.AsMFAAgent(l.agent); ok {
+		return m.TOTPEnabled(ctx, username)
+	}
+	return false, nil
+}
+
+// VerifyTOTP delegates to the inner agent if it implements auth.MFAAgent.
+func (l *lazyAuthAgent) VerifyTOTP(ctx context.Context, username, code string) (bool, error) {
+	l.init()
+	if l.err != nil {
+		return false, fmt.Errorf("auth agent init: %w", l.err)
+	}
+	if m, ok := auth.AsMFAAgent(l.agent); ok {
+		return m.VerifyTOTP(ctx, username, code)
+	}
+	return false, nil
+}
+
+// AccountStatus delegates to the inner agent if it implements
+// auth.AccountStatusProvider; otherwise the account is unrestricted.
+func (l *lazyAuthAgent) AccountStatus(ctx context.Context, username string) (auth.AccountStatus, error) {
+	l.init()
+	if l.err != nil {
+		return auth.AccountStatus{}, fmt.Errorf("auth agent init: %w", l.err)
+	}
+	if sp, ok := auth.AsAccountStatusProvider(l.agent); ok {
+		return sp.AccountStatus(ctx, username)
+	}
+	return auth.AccountStatus{}, nil
+}
+
+// GetSCRAMCredentials delegates to the inner agent if it implements
+// auth.SCRAMCredentialProvider.
+func (l *lazyAuthAgent) GetSCRAMCredentials(ctx context.Context, username string) (*auth.SCRAMCredentials, error) {
+	l.init()
+	if l.err != nil {
+		return nil, l.degraded.unavailable(fmt.Errorf("auth agent init: %w", l.err))
+	}
+	if sp, ok := auth.AsSCRAMCredentialProvider(l.agent); ok {
+		creds, err := sp.GetSCRAMCredentials(ctx, username)
+		return creds, l.degraded.unavailable(err)
+	}
+	return nil, autherrors.ErrMechanismUnsupported
+}
+
+// VerifyChallengeResponse delegates to the inner agent if it implements
+// auth.ChallengeResponseVerifier.
+func (l *lazyAuthAgent) VerifyChallengeResponse(ctx context.Context, creds auth.Credentials) (*auth.AuthSession, error) {
+	l.init()
+	if l.err != nil {
+		return nil, l.degraded.unavailable(fmt.Errorf("auth agent init: %w", l.err))
+	}
+	if cv, ok := auth.AsChallengeResponseVerifier(l.agent); ok {
+		session, err := cv.VerifyChallengeResponse(ctx, creds)
+		return session, l.degraded.unavailable(err)
+	}
+	return nil, fmt.Errorf("%w: %s", autherrors.ErrMechanismUnsupported, creds.Mechanism)
+}
+
+// AuthenticateExternal delegates to the inner agent if it implements
+// auth.ExternalAuthenticator.
+func (l *lazyAuthAgent) AuthenticateExternal(ctx context.Context, identity auth.ExternalIdentity) (*auth.AuthSession, error) {
+	l.init()
+	if l.err != nil {
+		return nil, l.degraded.unavailable(fmt.Errorf("auth agent init: %w", l.err))
+	}
+	if ea, ok := auth.AsExternalAuthenticator(l.agent); ok {
+		session, err := ea.AuthenticateExternal(ctx, identity)
+		return session, l.degraded.unavailable(err)
+	}
+	return nil, fmt.Errorf("%w: EXTERNAL", autherrors.ErrMechanismUnsupported)
+}
+
+// ListUsers delegates to the inner agent if it implements auth.UserLister;
+// otherwise no users are listed.
+func (l *lazyAuthAgent) ListUsers(ctx context.Context) ([]string, error) {
+	l.init()
+	if l.err != nil {
+		return nil, fmt.Errorf("auth agent init: %w", l.err)
+	}
+	if ul, ok := auth.AsUserLister(l.agent); ok {
+		return ul.ListUsers(ctx)
+	}
+	return nil, nil
+}
+
+// Resources reports the inner agent's usage, or zero if it has not been
+// opened yet.
+func (l *lazyAuthAgent) Resources() auth.ResourceUsage {
+	if rr, ok := auth.AsResourceReporter(l.agent); ok {
+		return rr.Resources()
+	}
+	return auth.ResourceUsage{}
+}
+
+// Capabilities opens the inner agent and reports its capabilities, or none
+// if it cannot be opened. Implements auth.CapabilityReporter.
+func (l *lazyAuthAgent) Capabilities() auth.AgentCapabilities {
+	l.init()
+	if l.err != nil {
+		return auth.AgentCapabilities{}
+	}
+	return auth.Capabilities(l.agent)
+}
+
 func (l *lazyAuthAgent) Close() error {
 	// Only close if init() was called and succeeded.
 	if l.agent != nil {
@@ -0,0 +1,177 @@
+package domain
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// listBatch is how many directory entries DomainsIter reads at a time.
+const listBatch = 256
+
+// DomainFilter narrows DomainsIter and DomainsPage. The zero value matches
+// every domain.
+type DomainFilter struct {
+	// Pattern is a path.Match glob on the domain name, e.g. "*.example.com".
+	Pattern string
+
+	// Match, when set, is called for each name that passes Pattern and
+	// keeps the domain when it returns true, e.g. to list only domains a
+	// control plane has enabled.
+	Match func(name string) bool
+}
+
+// matches reports whether name passes the filter. The pattern must already
+// be known to be valid.
+func (f DomainFilter) matches(name string) bool {
+	if f.Pattern != "" {
+		if ok, _ := path.Match(f.Pattern, name); !ok {
+			return false
+		}
+	}
+	return f.Match == nil || f.Match(name)
+}
+
+// isDomainEntry reports whether a base-path directory entry is a domain, by
+// the rules documented on Domains.
+func (p *FilesystemDomainProvider) isDomainEntry(entry fs.DirEntry) bool {
+	if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+		// Dot-directories hold templates and staging areas, never domains.
+		return false
+	}
+	if p.defaults != nil {
+		// With defaults: any subdirectory is a valid domain
+		return true
+	}
+	// Without defaults: only directories with config.toml
+	return p.exists(filepath.Join(p.basePath, entry.Name(), "config.toml"))
+}
+
+// DomainsIter yields the domains Domains would list that pass filter,
+// reading the base directory in batches so memory stays bounded however
+// many domains there are. Names come in directory order, not sorted. An
+// error (reading the directory, a bad pattern, or ctx being cancelled) is
+// yielded once with an empty name and ends the sequence.
+func (p *FilesystemDomainProvider) DomainsIter(ctx context.Context, filter DomainFilter) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		if _, err := path.Match(filter.Pattern, ""); err != nil {
+			yield("", fmt.Errorf("domain filter pattern: %w", err))
+			return
+		}
+		next, closeDir, err := p.readBaseDir()
+		if err != nil {
+			yield("", err)
+			return
+		}
+		defer closeDir()
+
+		for {
+			if err := ctx.Err(); err != nil {
+				yield("", err)
+				return
+			}
+			entries, err := next()
+			for _, entry := range entries {
+				if !p.isDomainEntry(entry) {
+					continue
+				}
+				if filter.matches(entry.Name()) && !yield(entry.Name(), nil) {
+					return
+				}
+			}
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if err != nil {
+				yield("", fmt.Errorf("read domains directory: %w", err))
+				return
+			}
+		}
+	}
+}
+
+// readBaseDir opens the base directory for batched reading. When the FS
+// cannot read a directory incrementally, the whole listing is returned as
+// a single batch.
+func (p *FilesystemDomainProvider) readBaseDir() (next func() ([]fs.DirEntry, error), closeDir func(), err error) {
+	f, err := p.fs.Open(p.basePath)
+	if err == nil {
+		if dir, ok := f.(fs.ReadDirFile); ok {
+			return func() ([]fs.DirEntry, error) { return dir.ReadDir(listBatch) },
+				func() { _ = f.Close() }, nil
+		}
+		_ = f.Close()
+	}
+	entries, err := p.fs.ReadDir(p.basePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read domains directory: %w", err)
+	}
+	done := false
+	return func() ([]fs.DirEntry, error) {
+		if done {
+			return nil, io.EOF
+		}
+		done = true
+		return entries, nil
+	}, func() {}, nil
+}
+
+// DomainsPage returns up to limit domain names passing filter that sort
+// after the cursor, in sorted order, and the cursor for the next page ("" on
+// the last page). Start with an empty cursor. Only limit names are held in
+// memory at a time, so a control plane can page through tens of thousands
+// of domains cheaply; each call still reads the whole directory.
+func (p *FilesystemDomainProvider) DomainsPage(ctx context.Context, after string, limit int, filter DomainFilter) (names []string, next string, err error) {
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("domain page limit must be positive, got %d", limit)
+	}
+	// Keep the limit+1 smallest names after the cursor; the extra one
+	// shows whether another page follows.
+	h := &maxHeap{}
+	for name, err := range p.DomainsIter(ctx, filter) {
+		if err != nil {
+			return nil, "", err
+		}
+		if name <= after {
+			continue
+		}
+		if h.Len() <= limit {
+			heap.Push(h, name)
+		} else if name < (*h)[0] {
+			(*h)[0] = name
+			heap.Fix(h, 0)
+		}
+	}
+
+	names = make([]string, h.Len())
+	for i := len(names) - 1; i >= 0; i-- {
+		names[i] = heap.Pop(h).(string)
+	}
+	if len(names) > limit {
+		names = names[:limit]
+		next = names[limit-1]
+	}
+	return names, next, nil
+}
+
+// maxHeap is a max-heap of strings for DomainsPage.
+type maxHeap []string
+
+func (h maxHeap) Len() int           { return len(h) }
+func (h maxHeap) Less(i, j int) bool { return h[i] > h[j] }
+func (h maxHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *maxHeap) Push(x any)        { *h = append(*h, x.(string)) }
+
+func (h *maxHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,114 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"testing"
+)
+
+func newListingTree(t *testing.T, n int) *FilesystemDomainProvider {
+	t.Helper()
+	var names []string
+	for i := 0; i < n; i++ {
+		names = append(names, fmt.Sprintf("d%04d.test", i))
+	}
+	names = append(names, "mail.example.com", "example.org")
+	p, base := newTestDomainsTree(t, "", names...)
+	if err := os.MkdirAll(filepath.Join(base, TemplatesDir, "basic"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestDomainsIter_MatchesDomains(t *testing.T) {
+	p := newListingTree(t, 600) // more than one batch
+	var got []string
+	for name, err := range p.DomainsIter(context.Background(), DomainFilter{}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, name)
+	}
+	sort.Strings(got)
+	if want := p.Domains(); !slices.Equal(got, want) {
+		t.Errorf("DomainsIter yielded %d names, Domains() %d", len(got), len(want))
+	}
+}
+
+func TestDomainsIter_Filter(t *testing.T) {
+	p := newListingTree(t, 5)
+	collect := func(f DomainFilter) []string {
+		var got []string
+		for name, err := range p.DomainsIter(context.Background(), f) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, name)
+		}
+		sort.Strings(got)
+		return got
+	}
+
+	if got := collect(DomainFilter{Pattern: "*.example.*"}); !slices.Equal(got, []string{"mail.example.com"}) {
+		t.Errorf("glob: %v", got)
+	}
+	enabled := map[string]bool{"d0001.test": true, "example.org": true}
+	if got := collect(DomainFilter{Match: func(n string) bool { return enabled[n] }}); !slices.Equal(got, []string{"d0001.test", "example.org"}) {
+		t.Errorf("predicate: %v", got)
+	}
+
+	for _, err := range p.DomainsIter(context.Background(), DomainFilter{Pattern: "[bad"}) {
+		if err == nil {
+			t.Error("bad pattern yielded a name")
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, err := range p.DomainsIter(ctx, DomainFilter{}) {
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("cancelled context: got %v", err)
+		}
+	}
+}
+
+func TestDomainsPage(t *testing.T) {
+	p := newListingTree(t, 25)
+	want := p.Domains()
+	sort.Strings(want)
+
+	var got []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("pagination did not terminate")
+		}
+		names, next, err := p.DomainsPage(context.Background(), cursor, 10, DomainFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) > 10 {
+			t.Fatalf("page of %d names", len(names))
+		}
+		got = append(got, names...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("pages = %v, want %v", got, want)
+	}
+
+	names, next, err := p.DomainsPage(context.Background(), "", 10, DomainFilter{Pattern: "*.example.*"})
+	if err != nil || next != "" || !slices.Equal(names, []string{"mail.example.com"}) {
+		t.Errorf("filtered page = %v, %q, %v", names, next, err)
+	}
+	if _, _, err := p.DomainsPage(context.Background(), "", 0, DomainFilter{}); err == nil {
+		t.Error("expected an error for a zero limit")
+	}
+}
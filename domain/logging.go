@@ -0,0 +1,78 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// LogConfig holds per-domain logging settings. It lets one domain be
+// debugged verbosely without raising the level of the global logger.
+type LogConfig struct {
+	// Level is the minimum level logged for this domain's agents:
+	// "debug", "info", "warn" or "error". Empty inherits the provider
+	// logger's level.
+	Level string `toml:"level,omitempty"`
+
+	// Attrs are extra attributes added to every record logged for this
+	// domain (e.g., tenant = "acme").
+	Attrs map[string]string `toml:"attrs,omitempty"`
+}
+
+// domainLogger derives the logger for a domain from the provider logger.
+// Every record carries a "domain" attribute plus cfg.Attrs (sorted by key).
+// When cfg.Level is set, it replaces the base handler's level check in both
+// directions, so "debug" surfaces records the global logger would drop.
+func domainLogger(base *slog.Logger, name string, cfg LogConfig) (*slog.Logger, error) {
+	h := base.Handler()
+	if cfg.Level != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(strings.TrimSpace(cfg.Level))); err != nil {
+			return nil, fmt.Errorf("invalid log level %q: %w", cfg.Level, err)
+		}
+		h = &levelHandler{level: level, inner: h}
+	}
+
+	keys := make([]string, 0, len(cfg.Attrs))
+	for k := range cfg.Attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	attrs := []any{slog.String("domain", name)}
+	for _, k := range keys {
+		attrs = append(attrs, slog.String(k, cfg.Attrs[k]))
+	}
+	return slog.New(h).With(attrs...), nil
+}
+
+// levelHandler overrides the minimum level of the handler it wraps.
+type levelHandler struct {
+	level slog.Leveler
+	inner slog.Handler
+}
+
+func (h *levelHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.inner.Handle(ctx, r)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{level: h.level, inner: h.inner.WithAttrs(attrs)}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{level: h.level, inner: h.inner.WithGroup(name)}
+}
+
+// loggerOrDefault returns l, or slog.Default() when l is nil.
+func loggerOrDefault(l *slog.Logger) *slog.Logger {
+	if l != nil {
+		return l
+	}
+	return slog.Default()
+}
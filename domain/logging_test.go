@@ -0,0 +1,89 @@
+package domain
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDomainLogger_LevelOverride(t *testing.T) {
+	var buf bytes.Buffer
+	base := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	l, err := domainLogger(base, "noisy.com", LogConfig{
+		Level: "debug",
+		Attrs: map[string]string{"tenant": "acme"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Debug("probe")
+
+	out := buf.String()
+	for _, want := range []string{"msg=probe", "domain=noisy.com", "tenant=acme"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output %q missing %q", out, want)
+		}
+	}
+
+	// The base logger itself must stay at info.
+	buf.Reset()
+	base.Debug("global")
+	if buf.Len() != 0 {
+		t.Errorf("base logger emitted debug record: %q", buf.String())
+	}
+}
+
+func TestDomainLogger_Quieter(t *testing.T) {
+	var buf bytes.Buffer
+	base := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	l, err := domainLogger(base, "quiet.com", LogConfig{Level: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Warn("dropped")
+	if buf.Len() != 0 {
+		t.Errorf("expected warn to be suppressed, got %q", buf.String())
+	}
+}
+
+func TestDomainLogger_InvalidLevel(t *testing.T) {
+	if _, err := domainLogger(slog.Default(), "x.com", LogConfig{Level: "chatty"}); err == nil {
+		t.Error("expected error for invalid log level")
+	}
+}
+
+func TestFilesystemDomainProvider_DomainLogConfig(t *testing.T) {
+	p, base := newTestDomainsTree(t, "", "noisy.com", "normal.com")
+	cfg := "[log]\nlevel = \"debug\"\n\n[log.attrs]\ntenant = \"acme\"\n"
+	if err := os.WriteFile(filepath.Join(base, "noisy.com", "config.toml"), []byte(cfg), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	p.logger = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	noisy := p.GetDomain("noisy.com")
+	if noisy == nil || noisy.Logger == nil {
+		t.Fatal("expected noisy.com with a logger")
+	}
+	if !noisy.Logger.Enabled(context.Background(), slog.LevelDebug) {
+		t.Error("expected debug enabled for noisy.com")
+	}
+	if !strings.Contains(buf.String(), "tenant=acme") {
+		t.Errorf("expected load log with domain attrs, got %q", buf.String())
+	}
+
+	normal := p.GetDomain("normal.com")
+	if normal == nil || normal.Logger == nil {
+		t.Fatal("expected normal.com with a logger")
+	}
+	if normal.Logger.Enabled(context.Background(), slog.LevelDebug) {
+		t.Error("expected debug disabled for normal.com")
+	}
+}
@@ -0,0 +1,45 @@
+package domain
+
+import (
+	"context"
+
+	"github.com/infodancer/auth"
+)
+
+// GetLoginState returns localpart's login state in this domain. Returns
+// the zero LoginState when login state is not enabled for the provider
+// (see WithLoginState).
+func (d *Domain) GetLoginState(_ context.Context, localpart string) (auth.LoginState, error) {
+	if d.loginState == nil {
+		return auth.LoginState{}, nil
+	}
+	return d.loginState.Get(localpart)
+}
+
+// LoginStates returns the login state of every user with one recorded in
+// this domain, keyed by localpart; nil when login state is not enabled.
+func (d *Domain) LoginStates() (map[string]auth.LoginState, error) {
+	if d.loginState == nil {
+		return nil, nil
+	}
+	return d.loginState.All()
+}
+
+// Compile-time check: AuthRouter serves login state.
+var _ auth.LoginStateProvider = (*AuthRouter)(nil)
+
+// GetLoginState returns the login state of user@domain, routing to the
+// user's domain. Implements auth.LoginStateProvider. Users of the fallback
+// agent, or of unserved domains, have none.
+func (r *AuthRouter) GetLoginState(ctx context.Context, username string) (auth.LoginState, error) {
+	localPart, domainName := SplitUsername(username)
+	base, _ := ParseLocalPart(localPart)
+	if r.provider == nil || domainName == "" {
+		return auth.LoginState{}, nil
+	}
+	d := r.provider.GetDomain(domainName)
+	if d == nil {
+		return auth.LoginState{}, nil
+	}
+	return d.GetLoginState(ctx, base)
+}
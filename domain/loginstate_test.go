@@ -0,0 +1,57 @@
+package domain
+
+import (
+	"context"
+	"testing"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/passwd"
+)
+
+func TestAuthRouter_LoginState(t *testing.T) {
+	hash, err := passwd.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := newTestDomainsTree(t, "alice:"+hash+":alice\n", "example.com")
+	p.WithLoginState()
+	r := NewAuthRouter(p, nil)
+
+	ctx := WithProtocol(WithClientIP(context.Background(), "192.0.2.7"), "imap")
+	if _, err := r.Authenticate(ctx, "alice@example.com", "secret"); err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	bad := WithClientIP(context.Background(), "203.0.113.9")
+	for range 2 {
+		if _, err := r.Authenticate(bad, "alice@example.com", "wrong"); err == nil {
+			t.Fatal("expected failure with wrong password")
+		}
+	}
+	// Unknown users leave no trace.
+	_, _ = r.Authenticate(bad, "mallory@example.com", "secret")
+
+	state, err := r.GetLoginState(context.Background(), "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.LastLogin.IsZero() || state.LastIP != "192.0.2.7" || state.LastProtocol != "imap" {
+		t.Errorf("last login = %+v", state)
+	}
+	if state.Failures != 2 || state.LastFailureIP != "203.0.113.9" {
+		t.Errorf("failures = %+v", state)
+	}
+
+	if _, err := r.Authenticate(ctx, "alice@example.com", "secret"); err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if state, _ := r.GetLoginState(context.Background(), "alice+x@example.com"); state.Failures != 0 {
+		t.Errorf("failures not reset by a login: %+v", state)
+	}
+	states, err := p.GetDomain("example.com").LoginStates()
+	if err != nil || len(states) != 1 {
+		t.Errorf("LoginStates = %+v, %v", states, err)
+	}
+	if none, _ := r.GetLoginState(context.Background(), "mallory@example.com"); none != (auth.LoginState{}) {
+		t.Errorf("expected no state for unknown user, got %+v", none)
+	}
+}
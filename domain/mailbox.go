@@ -0,0 +1,150 @@
+package domain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/infodancer/auth"
+)
+
+// Built-in mailbox mapping strategies, selected per domain with
+// msgstore.mailbox in config.toml:
+//
+//	[msgstore]
+//	type    = "maildir"
+//	mailbox = "localpart"
+const (
+	// MailboxAddress maps alice@example.com to "alice@example.com".
+	MailboxAddress = "address"
+
+	// MailboxLocalpart maps alice@example.com to "alice", for stores with
+	// one directory per domain.
+	MailboxLocalpart = "localpart"
+
+	// MailboxUID maps a user to their numeric id, such as "1001", so
+	// mailboxes survive renames. Logins for users without a uid fail, as
+	// do certificate logins (see AuthenticateExternal), which carry none.
+	MailboxUID = "uid"
+
+	// MailboxHash maps alice@example.com to the hex SHA-256 of the address,
+	// for stores that must not reveal addresses in their layout.
+	MailboxHash = "hash"
+
+	// MailboxBackend keeps the mailbox the auth backend reports, such as
+	// the passwd mailbox field, falling back to MailboxAddress when it
+	// reports none.
+	MailboxBackend = "backend"
+)
+
+// MailboxMapper maps an authenticated user to the mailbox reported in
+// their session. localpart is canonical and without extension, domainName
+// is the serving domain, and user is the session's user as the auth
+// backend returned it.
+type MailboxMapper func(localpart, domainName string, user *auth.User) (string, error)
+
+var (
+	mailboxMappersMu sync.RWMutex
+	mailboxMappers   = map[string]MailboxMapper{
+		MailboxAddress:   mailboxAddress,
+		MailboxLocalpart: mailboxLocalpart,
+		MailboxUID:       mailboxUID,
+		MailboxHash:      mailboxHash,
+		MailboxBackend:   mailboxBackend,
+	}
+)
+
+// RegisterMailboxMapper adds a mailbox mapping strategy for domains to
+// select by name. It panics if called with an empty name or nil mapper,
+// or if the name is already registered.
+func RegisterMailboxMapper(name string, m MailboxMapper) {
+	if name == "" {
+		panic("domain: RegisterMailboxMapper called with empty name")
+	}
+	if m == nil {
+		panic("domain: RegisterMailboxMapper called with nil mapper")
+	}
+	mailboxMappersMu.Lock()
+	defer mailboxMappersMu.Unlock()
+	if _, exists := mailboxMappers[name]; exists {
+		panic("domain: RegisterMailboxMapper called twice for " + name)
+	}
+	mailboxMappers[name] = m
+}
+
+// RegisteredMailboxMappers returns the names of the mailbox mapping
+// strategies, sorted.
+func RegisteredMailboxMappers() []string {
+	mailboxMappersMu.RLock()
+	defer mailboxMappersMu.RUnlock()
+	names := make([]string, 0, len(mailboxMappers))
+	for name := range mailboxMappers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mailboxMapper returns the strategy registered as name; empty is
+// MailboxAddress.
+func mailboxMapper(name string) (MailboxMapper, error) {
+	if name == "" {
+		name = MailboxAddress
+	}
+	mailboxMappersMu.RLock()
+	defer mailboxMappersMu.RUnlock()
+	m, ok := mailboxMappers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown msgstore mailbox strategy %q", name)
+	}
+	return m, nil
+}
+
+// Mailbox returns the mailbox of the domain's user localpart, authenticated
+// as user, under the domain's mailbox strategy (see
+// DomainMsgStoreConfig.Mailbox).
+func (d *Domain) Mailbox(localpart string, user *auth.User) (string, error) {
+	m := d.mailbox
+	if m == nil {
+		m = mailboxAddress
+	}
+	if user == nil {
+		user = &auth.User{Username: localpart}
+	}
+	mailbox, err := m(localpart, d.Name, user)
+	if err != nil {
+		return "", fmt.Errorf("map mailbox of %s@%s: %w", localpart, d.Name, err)
+	}
+	return mailbox, nil
+}
+
+func mailboxAddress(localpart, domainName string, _ *auth.User) (string, error) {
+	return localpart + "@" + domainName, nil
+}
+
+func mailboxLocalpart(localpart, _ string, _ *auth.User) (string, error) {
+	return localpart, nil
+}
+
+func mailboxUID(_, _ string, user *auth.User) (string, error) {
+	if user.Uid == 0 {
+		return "", errors.New("user has no uid")
+	}
+	return strconv.FormatUint(uint64(user.Uid), 10), nil
+}
+
+func mailboxHash(localpart, domainName string, _ *auth.User) (string, error) {
+	sum := sha256.Sum256([]byte(localpart + "@" + domainName))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func mailboxBackend(localpart, domainName string, user *auth.User) (string, error) {
+	if user.Mailbox != "" {
+		return user.Mailbox, nil
+	}
+	return mailboxAddress(localpart, domainName, user)
+}
@@ -0,0 +1,77 @@
+package domain
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/passwd"
+)
+
+func TestMailboxStrategies(t *testing.T) {
+	hash, err := passwd.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		strategy string
+		want     string
+	}{
+		{"", "alice@example.com"},
+		{MailboxAddress, "alice@example.com"},
+		{MailboxLocalpart, "alice"},
+		{MailboxUID, "1001"},
+		{MailboxHash, "ff8d9819fc0e12bf0d24892e45987e249a28dce836a85cad60e28eaaa8c6d976"},
+		{MailboxBackend, "mail/alice"},
+	} {
+		t.Run(tc.strategy, func(t *testing.T) {
+			p, base := newTestDomainsTree(t, "alice:"+hash+":mail/alice:1001\n", "example.com")
+			cfg := "[msgstore]\nmailbox = \"" + tc.strategy + "\"\n"
+			if err := os.WriteFile(filepath.Join(base, "example.com", "config.toml"), []byte(cfg), 0o640); err != nil {
+				t.Fatal(err)
+			}
+			session, err := NewAuthRouter(p, nil).Authenticate(context.Background(), "alice+tag@example.com", "secret")
+			if err != nil {
+				t.Fatalf("Authenticate: %v", err)
+			}
+			if session.User.Mailbox != tc.want {
+				t.Errorf("Mailbox = %q, want %q", session.User.Mailbox, tc.want)
+			}
+		})
+	}
+}
+
+func TestMailboxStrategies_Errors(t *testing.T) {
+	d := &Domain{Name: "example.com", mailbox: mailboxUID}
+	if _, err := d.Mailbox("alice", &auth.User{Username: "alice"}); err == nil {
+		t.Error("uid strategy mapped a user without a uid")
+	}
+	d.mailbox = mailboxBackend
+	if got, err := d.Mailbox("alice", &auth.User{Username: "alice"}); err != nil || got != "alice@example.com" {
+		t.Errorf("backend strategy without a backend mailbox = %q, %v", got, err)
+	}
+
+	if _, err := mailboxMapper("nosuch"); err == nil {
+		t.Error("unknown strategy accepted")
+	}
+	RegisterMailboxMapper("test-upper", func(localpart, _ string, _ *auth.User) (string, error) {
+		return "U-" + localpart, nil
+	})
+	if !slices.Contains(RegisteredMailboxMappers(), "test-upper") {
+		t.Errorf("RegisteredMailboxMappers = %v", RegisteredMailboxMappers())
+	}
+	m, err := mailboxMapper("test-upper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := m("alice", "example.com", &auth.User{}); got != "U-alice" {
+		t.Errorf("registered mapper = %q", got)
+	}
+
+	if codes := checkConfig("config.toml", []byte("[msgstore]\nmailbox = \"nosuch\"\n")); len(codes) != 1 || codes[0].Code != "config.bad-value" {
+		t.Errorf("checkConfig = %v", codes)
+	}
+}
@@ -1,9 +1,12 @@
 package domain
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 
+	"github.com/infodancer/auth/atrest"
 	"github.com/pelletier/go-toml/v2"
 )
 
@@ -32,13 +35,31 @@ func deepMergeMaps(base, override map[string]any) map[string]any {
 // loadTOMLMap reads a TOML file and returns its contents as a raw map.
 // Returns nil, nil if the file does not exist.
 func loadTOMLMap(path string) (map[string]any, error) {
-	data, err := os.ReadFile(path)
+	data, err := atrest.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, nil
 		}
 		return nil, fmt.Errorf("read %s: %w", path, err)
 	}
+	return parseTOMLMap(path, data)
+}
+
+// loadTOMLMap is like the package-level loadTOMLMap but reads through the
+// provider's FS.
+func (p *FilesystemDomainProvider) loadTOMLMap(path string) (map[string]any, error) {
+	data, err := p.readFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	return parseTOMLMap(path, data)
+}
+
+// parseTOMLMap parses TOML data read from path into a raw map.
+func parseTOMLMap(path string, data []byte) (map[string]any, error) {
 	var m map[string]any
 	if err := toml.Unmarshal(data, &m); err != nil {
 		return nil, fmt.Errorf("parse %s: %w", path, err)
@@ -64,12 +85,24 @@ func toTOMLMap(v any) (map[string]any, error) {
 // mergeConfigLayers deep-merges multiple TOML maps in order and unmarshals
 // the result into dst. Later layers have higher priority.
 // Nil layers are skipped.
+//
+// The [auth] chain list is replaced, not merged, by a layer declaring it,
+// and a layer that sets auth.type without a chain drops the inherited one,
+// so a domain choosing a single agent is not overridden by a chain in the
+// system defaults.
 func mergeConfigLayers(dst any, layers ...map[string]any) error {
 	merged := make(map[string]any)
 	for _, layer := range layers {
 		if layer == nil {
 			continue
 		}
+		if a, ok := layer["auth"].(map[string]any); ok && a["type"] != nil && a["chain"] == nil {
+			if m, ok := merged["auth"].(map[string]any); ok {
+				m = deepMergeMaps(m, nil)
+				delete(m, "chain")
+				merged["auth"] = m
+			}
+		}
 		merged = deepMergeMaps(merged, layer)
 	}
 	data, err := toml.Marshal(merged)
@@ -372,3 +372,61 @@ max_sends_per_hour = 25
 		t.Errorf("MsgStore.Type = %q, want maildir", cfg.MsgStore.Type)
 	}
 }
+
+func TestMergeConfigLayers_AuthChain(t *testing.T) {
+	parse := func(t *testing.T, s string) map[string]any {
+		t.Helper()
+		m, err := parseTOMLMap("test", []byte(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	system := parse(t, `
+[auth]
+type = "passwd"
+credential_backend = "passwd"
+
+[[auth.chain]]
+type = "passwd"
+credential_backend = "passwd"
+
+[[auth.chain]]
+type = "http"
+credential_backend = "https://sso.example.com"
+`)
+
+	t.Run("inherited", func(t *testing.T) {
+		var cfg DomainConfig
+		if err := mergeConfigLayers(&cfg, system, parse(t, "gid = 5\n")); err != nil {
+			t.Fatal(err)
+		}
+		if len(cfg.Auth.Chain) != 2 || cfg.Auth.Chain[1].Type != "http" {
+			t.Errorf("Chain = %+v, want inherited two-member chain", cfg.Auth.Chain)
+		}
+	})
+
+	t.Run("replaced whole", func(t *testing.T) {
+		var cfg DomainConfig
+		domain := parse(t, "[[auth.chain]]\ntype = \"sql\"\ncredential_backend = \"dsn\"\n")
+		if err := mergeConfigLayers(&cfg, system, domain); err != nil {
+			t.Fatal(err)
+		}
+		if len(cfg.Auth.Chain) != 1 || cfg.Auth.Chain[0].Type != "sql" {
+			t.Errorf("Chain = %+v, want only the domain's sql member", cfg.Auth.Chain)
+		}
+	})
+
+	t.Run("dropped by single type", func(t *testing.T) {
+		var cfg DomainConfig
+		if err := mergeConfigLayers(&cfg, system, parse(t, "[auth]\ntype = \"http\"\n")); err != nil {
+			t.Fatal(err)
+		}
+		if len(cfg.Auth.Chain) != 0 || cfg.Auth.Type != "http" {
+			t.Errorf("Auth = %+v, want single http agent", cfg.Auth)
+		}
+		if len(system["auth"].(map[string]any)["chain"].([]any)) != 2 {
+			t.Error("merge modified the system layer")
+		}
+	})
+}
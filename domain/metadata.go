@@ -0,0 +1,100 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/infodancer/auth/atrest"
+	"github.com/infodancer/auth/vfs"
+	"github.com/pelletier/go-toml/v2"
+)
+
+// UserMetadataFile is the per-domain file holding optional per-user
+// attributes, one table per localpart:
+//
+//	[alice]
+//	display_name = "Alice Example"
+//
+//	[svc-backup]
+//	gal_hidden = true
+//	allowed_networks = ["192.168.1.0/24", "10.0.0.5"]
+const UserMetadataFile = "user_metadata.toml"
+
+// UserMetadata holds optional per-user attributes that are not credentials.
+// The zero value applies to users without an entry.
+type UserMetadata struct {
+	// DisplayName is the user's human-readable name.
+	DisplayName string `toml:"display_name,omitempty"`
+
+	// GALHidden excludes the user from the global address list.
+	GALHidden bool `toml:"gal_hidden,omitempty"`
+
+	// RequireTLS overrides the domain's require_tls_auth for this user
+	// when set (see Domain.RequiresTLS).
+	RequireTLS *bool `toml:"require_tls,omitempty"`
+
+	// QuotaBytes is the storage quota assigned to the user, reported in
+	// usage snapshots (see Domain.Usage). The message store enforces it;
+	// 0 means none assigned.
+	QuotaBytes int64 `toml:"quota_bytes,omitempty"`
+
+	// LoginNotify overrides the domain's login notifications for this
+	// user when set; false opts out (see LoginNotifyConfig).
+	LoginNotify *bool `toml:"login_notify,omitempty"`
+
+	// AllowedNetworks limits the addresses the user may authenticate
+	// from to these CIDR prefixes and single addresses; empty means any
+	// (see Domain.AllowsAddress).
+	AllowedNetworks []string `toml:"allowed_networks,omitempty"`
+}
+
+// LoadUserMetadata reads a user metadata file keyed by localpart.
+// A missing file yields an empty map and no error.
+func LoadUserMetadata(path string) (map[string]UserMetadata, error) {
+	return loadUserMetadata(vfs.OS{}, path)
+}
+
+// loadUserMetadata is LoadUserMetadata reading through fsys.
+func loadUserMetadata(fsys vfs.FS, path string) (map[string]UserMetadata, error) {
+	data, err := atrest.ReadFileFS(fsys, path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return map[string]UserMetadata{}, nil
+		}
+		return nil, fmt.Errorf("read user metadata: %w", err)
+	}
+	var raw map[string]UserMetadata
+	if err := toml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse user metadata: %w", err)
+	}
+	md := make(map[string]UserMetadata, len(raw))
+	for k, v := range raw {
+		md[strings.ToLower(k)] = v
+	}
+	return md, nil
+}
+
+// userMetadata loads the domain's user metadata. The file is read on each
+// call so edits take effect without a restart, like user-level forwards.
+func (d *Domain) userMetadata() (map[string]UserMetadata, error) {
+	if d.metadataPath == "" {
+		return map[string]UserMetadata{}, nil
+	}
+	fsys := d.fs
+	if fsys == nil {
+		fsys = vfs.OS{}
+	}
+	return loadUserMetadata(fsys, d.metadataPath)
+}
+
+// UserMetadata returns the metadata for localpart, or the zero value when
+// the user has no entry.
+func (d *Domain) UserMetadata(localpart string) (UserMetadata, error) {
+	md, err := d.userMetadata()
+	if err != nil {
+		return UserMetadata{}, err
+	}
+	return md[strings.ToLower(localpart)], nil
+}
@@ -0,0 +1,104 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// Compile-time check: AuthRouter must satisfy MFAAgent.
+var _ auth.MFAAgent = (*AuthRouter)(nil)
+
+// mfaRequired reports whether username, who just passed the password
+// check, must also pass a TOTP code. App passwords stand in for both
+// factors: they exist for clients that cannot prompt for a code. Bearer
+// tokens do too; the issuer applies its own second factor.
+func mfaRequired(ctx context.Context, agent auth.AuthenticationAgent, username string, session *auth.AuthSession) (bool, error) {
+	if session.Credential.Kind == auth.CredentialAppPassword || session.Credential.Kind == auth.CredentialBearerToken {
+		return false, nil
+	}
+	m, ok := auth.AsMFAAgent(agent)
+	if !ok {
+		return false, nil
+	}
+	enabled, err := m.TOTPEnabled(ctx, username)
+	if err != nil {
+		return false, fmt.Errorf("check second factor: %w", err)
+	}
+	return enabled, nil
+}
+
+// mfaAgent returns the agent answering username's second factor and the
+// name it knows the user by, routing like UserExists.
+func (r *AuthRouter) mfaAgent(username string) (auth.MFAAgent, string) {
+	localPart, domainName := SplitUsername(username)
+	base, extension := ParseLocalPart(localPart)
+
+	if r.provider != nil && domainName != "" {
+		if d, _ := ResolveDomain(r.provider, domainName); d != nil {
+			if canonical, ok := d.NormalizeLocalpart(base); ok {
+				base = canonical
+			}
+			m, _ := auth.AsMFAAgent(d.AuthAgent)
+			return m, base
+		}
+	}
+
+	if r.fallback != nil {
+		fallbackUser := username
+		if extension != "" {
+			if domainName != "" {
+				fallbackUser = base + "@" + domainName
+			} else {
+				fallbackUser = base
+			}
+		}
+		m, _ := auth.AsMFAAgent(r.fallback)
+		return m, fallbackUser
+	}
+	return nil, ""
+}
+
+// TOTPEnabled reports whether username has a TOTP second factor enrolled.
+// Implements auth.MFAAgent.
+func (r *AuthRouter) TOTPEnabled(ctx context.Context, username string) (bool, error) {
+	username = r.qualify(ctx, username)
+	m, name := r.mfaAgent(username)
+	if m == nil {
+		return false, nil
+	}
+	return m.TOTPEnabled(ctx, name)
+}
+
+// VerifyTOTP completes a login whose AuthResult had MFARequired set (or for
+// which Authenticate failed with errors.ErrMFARequired) by checking the
+// user's one-time code. Agents accept the code only shortly after the
+// password check and only once; IMAP and webmail callers prompt for it
+// right away. Wrong codes count as failures for rate limiting, and a
+// rate-limited client gets errors.ErrRateLimited.
+// Implements auth.MFAAgent.
+func (r *AuthRouter) VerifyTOTP(ctx context.Context, username, code string) (bool, error) {
+	username = r.qualify(ctx, username)
+	clientIP := clientIPFromContext(ctx)
+	if r.rateLimiter != nil && r.rateLimiter.isLimited(clientIP, username) {
+		return false, autherrors.ErrRateLimited
+	}
+	m, name := r.mfaAgent(username)
+	if m == nil {
+		return false, nil
+	}
+	ok, err := m.VerifyTOTP(ctx, name, code)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		slog.Warn("totp verification failed", "username", username, "ip", clientIP)
+		if r.rateLimiter != nil {
+			r.rateLimiter.recordFailure(clientIP, username)
+		}
+	}
+	return ok, nil
+}
@@ -0,0 +1,153 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// stubMFAAgent is a stubAuthAgent whose enrolled users accept a fixed code.
+type stubMFAAgent struct {
+	stubAuthAgent
+	enrolled map[string]bool
+	code     string
+	verified []string
+}
+
+// Authenticate treats the password "app" as an app password.
+func (s *stubMFAAgent) Authenticate(ctx context.Context, username, password string) (*auth.AuthSession, error) {
+	session, err := s.stubAuthAgent.Authenticate(ctx, username, password)
+	if err == nil && password == "app" {
+		session.Credential = auth.Credential{Kind: auth.CredentialAppPassword, ID: "1", Label: "Phone"}
+	}
+	return session, err
+}
+
+func (s *stubMFAAgent) TOTPEnabled(_ context.Context, username string) (bool, error) {
+	return s.enrolled[username], nil
+}
+
+func (s *stubMFAAgent) VerifyTOTP(_ context.Context, username, code string) (bool, error) {
+	s.verified = append(s.verified, username)
+	return s.enrolled[username] && code == s.code, nil
+}
+
+func newMFARouter() (*AuthRouter, *stubMFAAgent) {
+	agent := &stubMFAAgent{
+		stubAuthAgent: stubAuthAgent{users: map[string]bool{"alice": true, "bob": true}},
+		enrolled:      map[string]bool{"alice": true},
+		code:          "123456",
+	}
+	provider := &stubDomainProvider{domains: map[string]*Domain{
+		"example.com": {Name: "example.com", AuthAgent: agent},
+	}}
+	return NewAuthRouter(provider, nil), agent
+}
+
+func TestAuthRouter_MFARequired(t *testing.T) {
+	ctx := context.Background()
+	router, _ := newMFARouter()
+
+	result, err := router.AuthenticateWithDomain(ctx, "alice@example.com", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.MFARequired {
+		t.Error("alice: MFARequired not set")
+	}
+	if _, err := router.Authenticate(ctx, "alice@example.com", "pw"); !errors.Is(err, autherrors.ErrMFARequired) {
+		t.Errorf("Authenticate(alice) err = %v, want ErrMFARequired", err)
+	}
+
+	result, err = router.AuthenticateWithDomain(ctx, "bob@example.com", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.MFARequired {
+		t.Error("bob: MFARequired set without enrollment")
+	}
+	if _, err := router.Authenticate(ctx, "bob@example.com", "pw"); err != nil {
+		t.Errorf("Authenticate(bob) err = %v", err)
+	}
+
+	// App passwords are for clients that cannot prompt for a code.
+	session, err := router.Authenticate(ctx, "alice@example.com", "app")
+	if err != nil {
+		t.Fatalf("Authenticate(alice, app password) err = %v", err)
+	}
+	if session.Credential.Kind != auth.CredentialAppPassword {
+		t.Errorf("credential = %+v", session.Credential)
+	}
+}
+
+func TestAuthRouter_VerifyTOTP(t *testing.T) {
+	ctx := context.Background()
+	router, agent := newMFARouter()
+
+	if enabled, err := router.TOTPEnabled(ctx, "alice+tag@example.com"); err != nil || !enabled {
+		t.Errorf("TOTPEnabled = %v, %v", enabled, err)
+	}
+	if ok, err := router.VerifyTOTP(ctx, "alice+tag@example.com", "123456"); err != nil || !ok {
+		t.Errorf("VerifyTOTP = %v, %v", ok, err)
+	}
+	if len(agent.verified) != 1 || agent.verified[0] != "alice" {
+		t.Errorf("domain agent saw %v, want [alice]", agent.verified)
+	}
+	if ok, _ := router.VerifyTOTP(ctx, "alice@other.com", "123456"); ok {
+		t.Error("code accepted for unknown domain")
+	}
+}
+
+func TestAuthRouter_VerifyTOTP_RateLimited(t *testing.T) {
+	router, _ := newMFARouter()
+	router.WithRateLimit(RateLimitConfig{
+		MaxFailuresPerIPUser: 2,
+		MaxFailuresPerIP:     100,
+		MaxFailuresPerUser:   100,
+		Window:               5 * time.Minute,
+		Lockout:              15 * time.Minute,
+	})
+	defer func() { _ = router.Close() }()
+
+	ctx := WithClientIP(context.Background(), "10.0.0.1")
+	for range 2 {
+		if ok, err := router.VerifyTOTP(ctx, "alice@example.com", "000000"); ok || err != nil {
+			t.Fatalf("wrong code: %v, %v", ok, err)
+		}
+	}
+	if _, err := router.VerifyTOTP(ctx, "alice@example.com", "123456"); !errors.Is(err, autherrors.ErrRateLimited) {
+		t.Errorf("err = %v, want ErrRateLimited", err)
+	}
+}
+
+// bearerMFAAgent is a stubMFAAgent accepting the XOAUTH2 token "tok".
+type bearerMFAAgent struct{ *stubMFAAgent }
+
+func (b bearerMFAAgent) AuthenticateCredentials(ctx context.Context, creds auth.Credentials) (*auth.AuthSession, error) {
+	if string(creds.Response) != "tok" {
+		return nil, autherrors.ErrAuthFailed
+	}
+	return &auth.AuthSession{User: &auth.User{Username: creds.Username}, Credential: auth.Credential{Kind: auth.CredentialBearerToken}}, nil
+}
+
+func TestAuthRouter_MFANotRequiredForBearerTokens(t *testing.T) {
+	_, agent := newMFARouter()
+	provider := &stubDomainProvider{domains: map[string]*Domain{
+		"example.com": {Name: "example.com", AuthAgent: bearerMFAAgent{agent}},
+	}}
+	router := NewAuthRouter(provider, nil)
+
+	// The issuer checked its own second factor.
+	creds := auth.Credentials{Username: "alice@example.com", Mechanism: "XOAUTH2", Response: []byte("tok")}
+	result, err := router.AuthenticateCredentials(context.Background(), creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.MFARequired {
+		t.Error("MFARequired set for a bearer token")
+	}
+}
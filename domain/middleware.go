@@ -0,0 +1,47 @@
+package domain
+
+import (
+	"context"
+
+	"github.com/infodancer/auth"
+)
+
+// AuthFunc performs a credential login, as AuthRouter.AuthenticateCredentials
+// does.
+type AuthFunc func(ctx context.Context, creds auth.Credentials) (*AuthResult, error)
+
+// Middleware wraps the router's credential logins, so callers can layer
+// features such as metrics, tarpitting or extra policy over an AuthRouter
+// without changing it. A middleware may inspect or rewrite the call,
+// refuse it without calling next, or act on next's result:
+//
+//	count := func(next domain.AuthFunc) domain.AuthFunc {
+//		return func(ctx context.Context, creds auth.Credentials) (*domain.AuthResult, error) {
+//			result, err := next(ctx, creds)
+//			loginsTotal.WithLabelValues(outcome(err)).Inc()
+//			return result, err
+//		}
+//	}
+//	router := domain.NewAuthRouter(provider, nil).WithMiddleware(count)
+//
+// A middleware that refuses a login after next succeeded must clear the
+// result's session (see auth.AuthSession.Clear).
+type Middleware func(next AuthFunc) AuthFunc
+
+// WithMiddleware adds mw to the router's credential logins
+// (AuthenticateCredentials and the methods built on it); the first
+// middleware added is the outermost. Middleware runs inside the router's
+// tracing span and audit record, so its refusals are traced and audited,
+// and outside the rate limiter, TLS policy, credential check and anomaly
+// scoring, so it sees every attempt, including those the rate limiter
+// refuses. Certificate logins (AuthenticateExternal) do not pass through
+// middleware.
+func (r *AuthRouter) WithMiddleware(mw ...Middleware) *AuthRouter {
+	r.middleware = append(r.middleware, mw...)
+	login := AuthFunc(r.authenticateCredentials)
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		login = r.middleware[i](login)
+	}
+	r.login = login
+	return r
+}
@@ -0,0 +1,75 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/audit"
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/passwd"
+)
+
+func TestAuthRouter_WithMiddleware(t *testing.T) {
+	hash, err := passwd.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := newTestDomainsTree(t, "alice:"+hash+":alice\n", "example.com")
+
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next AuthFunc) AuthFunc {
+			return func(ctx context.Context, creds auth.Credentials) (*AuthResult, error) {
+				calls = append(calls, name+">")
+				result, err := next(ctx, creds)
+				calls = append(calls, "<"+name)
+				return result, err
+			}
+		}
+	}
+	blocked := errors.New("blocked by policy")
+	block := func(next AuthFunc) AuthFunc {
+		return func(ctx context.Context, creds auth.Credentials) (*AuthResult, error) {
+			if creds.Username == "mallory@example.com" {
+				return nil, blocked
+			}
+			return next(ctx, creds)
+		}
+	}
+	rec := &recordingAuditor{}
+	r := NewAuthRouter(p, nil).
+		WithRateLimit(RateLimitConfig{MaxFailuresPerUser: 1, Window: time.Minute, Lockout: time.Minute}).
+		WithAuditor(rec).
+		WithMiddleware(trace("outer"), trace("inner")).
+		WithMiddleware(block)
+	defer func() { _ = r.Close() }()
+
+	ctx := context.Background()
+	if _, err := r.Authenticate(ctx, "alice@example.com", "secret"); err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if want := []string{"outer>", "inner>", "<inner", "<outer"}; !slices.Equal(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+
+	if _, err := r.Authenticate(ctx, "mallory@example.com", "secret"); !errors.Is(err, blocked) {
+		t.Errorf("blocked login: err = %v", err)
+	}
+	if n := len(rec.recs); n != 2 || rec.recs[1].Outcome != audit.OutcomeFailure || rec.recs[1].Error != blocked.Error() {
+		t.Errorf("audit records = %+v", rec.recs)
+	}
+
+	// Middleware sees attempts the rate limiter refuses.
+	calls = nil
+	_, _ = r.Authenticate(ctx, "alice@example.com", "wrong")
+	if _, err := r.Authenticate(ctx, "alice@example.com", "secret"); !errors.Is(err, autherrors.ErrRateLimited) {
+		t.Fatalf("err = %v, want rate limited", err)
+	}
+	if len(calls) != 8 {
+		t.Errorf("calls = %v, want both attempts", calls)
+	}
+}
@@ -0,0 +1,69 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// AllowsAddress reports whether localpart may authenticate from ip: always
+// when the user's allowed_networks metadata is empty (see UserMetadata),
+// otherwise only when ip is inside one of them. An ip that does not parse
+// is inside none. Returns an error if an entry is neither a CIDR prefix
+// nor an address.
+func (d *Domain) AllowsAddress(localpart, ip string) (bool, error) {
+	md, err := d.UserMetadata(localpart)
+	if err != nil {
+		return false, err
+	}
+	if len(md.AllowedNetworks) == 0 {
+		return true, nil
+	}
+	addr, addrErr := netip.ParseAddr(strings.TrimSpace(ip))
+	addr = addr.Unmap()
+	for _, n := range md.AllowedNetworks {
+		prefix, err := parseNetwork(n)
+		if err != nil {
+			return false, fmt.Errorf("allowed_networks of %s: %w", localpart, err)
+		}
+		if addrErr == nil && prefix.Contains(addr) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// parseNetwork parses an allowed_networks entry: a CIDR prefix, or an
+// address standing for itself alone.
+func parseNetwork(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// checkNetwork returns ErrAccessDenied when localpart may not authenticate
+// from the context's client IP (see WithClientIP). A context without one
+// is outside every network, so restricted users stay restricted behind
+// daemons that do not set it.
+func (d *Domain) checkNetwork(ctx context.Context, localpart string) error {
+	ip := clientIPFromContext(ctx)
+	ok, err := d.AllowsAddress(localpart, ip)
+	if err != nil {
+		return fmt.Errorf("check network policy: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s from %q", autherrors.ErrAccessDenied, localpart, ip)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/passwd"
+)
+
+func TestAuthRouter_AllowedNetworks(t *testing.T) {
+	hash, err := passwd.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, base := newTestDomainsTree(t, "svc:"+hash+":svc\nalice:"+hash+":alice\n", "example.com")
+	metadata := "[svc]\nallowed_networks = [\"192.168.1.0/24\", \"2001:db8::1\"]\n"
+	if err := os.WriteFile(filepath.Join(base, "example.com", UserMetadataFile), []byte(metadata), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	r := NewAuthRouter(p, nil).WithRateLimit(RateLimitConfig{MaxFailuresPerUser: 1, Window: time.Minute, Lockout: time.Minute})
+	defer func() { _ = r.Close() }()
+
+	for _, tc := range []struct {
+		user, ip string
+		wantErr  error
+	}{
+		{"svc@example.com", "192.168.1.20", nil},
+		{"svc@example.com", "::ffff:192.168.1.20", nil},
+		{"svc@example.com", "2001:db8::1", nil},
+		{"svc@example.com", "203.0.113.9", autherrors.ErrAccessDenied},
+		{"svc@example.com", "2001:db8::2", autherrors.ErrAccessDenied},
+		{"svc@example.com", "", autherrors.ErrAccessDenied},
+		{"svc@example.com", "not-an-ip", autherrors.ErrAccessDenied},
+		// Refusals are not counted as credential failures.
+		{"svc@example.com", "192.168.1.21", nil},
+		{"alice@example.com", "203.0.113.9", nil},
+	} {
+		session, err := r.Authenticate(WithClientIP(context.Background(), tc.ip), tc.user, "secret")
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("%s from %q: err = %v, want %v", tc.user, tc.ip, err, tc.wantErr)
+		}
+		if session != nil {
+			session.Clear()
+		}
+	}
+}
+
+func TestDomain_AllowsAddress_BadNetwork(t *testing.T) {
+	p, base := newTestDomainsTree(t, "svc:HASH:svc\n", "example.com")
+	if err := os.WriteFile(filepath.Join(base, "example.com", UserMetadataFile),
+		[]byte("[svc]\nallowed_networks = [\"192.168.1.0/33\"]\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	d := p.GetDomain("example.com")
+	if ok, err := d.AllowsAddress("svc", "192.168.1.1"); err == nil || ok {
+		t.Errorf("AllowsAddress = %v, %v; want an error", ok, err)
+	}
+	if ok, err := d.AllowsAddress("other", "192.168.1.1"); err != nil || !ok {
+		t.Errorf("AllowsAddress(other) = %v, %v", ok, err)
+	}
+}
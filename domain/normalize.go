@@ -0,0 +1,37 @@
+package domain
+
+import "github.com/infodancer/auth/address"
+
+// NormalizeConfig declares how a domain canonicalizes localparts. Rules are
+// applied to the part before any "+extension" and used consistently by
+// authentication, UserExists, forward resolution and delivery, so migrated
+// user bases keep the addressing they expect. The zero value leaves
+// localparts unchanged.
+//
+//	[normalize]
+//	strip_dots = true          # "j.doe" and "jdoe" are the same user
+//	case_insensitive = true    # "JDoe" and "jdoe" are the same user
+//	charset = "a-z0-9._-"      # anything else is rejected as unknown
+type NormalizeConfig = address.Policy
+
+// normalizer applies a NormalizeConfig. A nil normalizer changes nothing.
+type normalizer address.Normalizer
+
+// newNormalizer compiles cfg, returning nil when cfg has no rules.
+func newNormalizer(cfg NormalizeConfig) (*normalizer, error) {
+	n, err := address.NewNormalizer(cfg)
+	return (*normalizer)(n), err
+}
+
+// localpart returns the canonical form of localpart, keeping any
+// "+extension" as is. ok is false when the base contains characters outside
+// the configured charset; such addresses never match a user or forward.
+func (n *normalizer) localpart(localpart string) (canonical string, ok bool) {
+	return (*address.Normalizer)(n).Localpart(localpart)
+}
+
+// NormalizeLocalpart returns localpart in the domain's canonical form (see
+// NormalizeConfig). ok is false when the localpart is not allowed.
+func (d *Domain) NormalizeLocalpart(localpart string) (canonical string, ok bool) {
+	return d.normalize.localpart(localpart)
+}
@@ -0,0 +1,89 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/passwd"
+)
+
+func TestNormalizer_Localpart(t *testing.T) {
+	n, err := newNormalizer(NormalizeConfig{StripDots: true, CaseInsensitive: true, Charset: "a-z0-9_-"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		in     string
+		want   string
+		wantOK bool
+	}{
+		{"jdoe", "jdoe", true},
+		{"J.Doe", "jdoe", true},
+		{"j.doe+Lists.Work", "jdoe+Lists.Work", true},
+		{"j!doe", "", false},
+		{".", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := n.localpart(tt.in)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("localpart(%q) = %q, %v; want %q, %v", tt.in, got, ok, tt.want, tt.wantOK)
+		}
+	}
+
+	var none *normalizer
+	if got, ok := none.localpart("J.Doe"); got != "J.Doe" || !ok {
+		t.Errorf("nil normalizer changed localpart: %q, %v", got, ok)
+	}
+	if n, err := newNormalizer(NormalizeConfig{}); n != nil || err != nil {
+		t.Errorf("empty config = %v, %v; want nil normalizer", n, err)
+	}
+	if _, err := newNormalizer(NormalizeConfig{Charset: "z-a"}); err == nil {
+		t.Error("expected invalid charset to fail")
+	}
+}
+
+func TestNormalize_AppliedByDomain(t *testing.T) {
+	hash, err := passwd.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, base := newTestDomainsTree(t, "jdoe:"+hash+":jdoe\n", "example.com")
+	writeDomainConfig(t, base, "example.com",
+		"[normalize]\nstrip_dots = true\ncase_insensitive = true\ncharset = \"a-z0-9._-\"\n\n[forwards]\nsales = \"jdoe@example.com\"\n")
+	r := NewAuthRouter(p, nil)
+	ctx := context.Background()
+
+	result, err := r.AuthenticateWithDomain(ctx, "J.Doe@example.com", "secret")
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if got := result.Session.User.Mailbox; got != "jdoe@example.com" {
+		t.Errorf("Mailbox = %q, want jdoe@example.com", got)
+	}
+
+	for _, addr := range []string{"jdoe@example.com", "J.D.O.E@example.com", "S.ales@example.com"} {
+		if exists, err := r.UserExists(ctx, addr); err != nil || !exists {
+			t.Errorf("UserExists(%s) = %v, %v", addr, exists, err)
+		}
+	}
+	if exists, _ := r.UserExists(ctx, "j!doe@example.com"); exists {
+		t.Error("expected localpart outside the charset to be unknown")
+	}
+	if _, err := r.Authenticate(ctx, "j!doe@example.com", "secret"); !errors.Is(err, autherrors.ErrUserNotFound) {
+		t.Errorf("Authenticate outside charset: got %v, want ErrUserNotFound", err)
+	}
+
+	deliveries, err := ResolveFinalRecipients(ctx, p, "Sa.les@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Address != "jdoe@example.com" {
+		t.Errorf("ResolveFinalRecipients = %+v, want jdoe@example.com", deliveries)
+	}
+
+	if ok, err := r.MaySendAs(ctx, "jdoe@example.com", "J.Doe@example.com"); err != nil || !ok {
+		t.Errorf("MaySendAs own spelling = %v, %v", ok, err)
+	}
+}
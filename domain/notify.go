@@ -0,0 +1,246 @@
+package domain
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/msgstore"
+)
+
+// LoginNotifyConfig controls the notice a domain delivers to a user's own
+// mailbox after a successful login from an IP address not among the
+// user's recent successful logins. Detection reads the login history, or
+// failing that the last login in the login state, so the provider must
+// keep one (see WithLoginHistory and WithLoginState); a user's first
+// recorded login is not reported. Users opt out with login_notify = false
+// in their UserMetadata entry. A provider with a LoginNotifier (see
+// WithLoginNotifier) hands the notice to it instead of delivering it.
+//
+//	[login_notify]
+//	enabled = true
+//	from = "security@example.com"
+//	template = "login-notice.tmpl"
+type LoginNotifyConfig struct {
+	// Enabled turns notifications on for the domain's users.
+	Enabled bool `toml:"enabled,omitempty"`
+
+	// From is the notice's From header; empty means postmaster@<domain>.
+	// The envelope sender is always null, so the notice cannot bounce.
+	From string `toml:"from,omitempty"`
+
+	// Template names a text/template file, relative to the domain
+	// directory, producing the whole message: headers, a blank line and
+	// the body. It is executed with a LoginNotice. Empty, or a template
+	// that fails to load, uses DefaultLoginNoticeTemplate.
+	Template string `toml:"template,omitempty"`
+}
+
+// DefaultLoginNoticeTemplate is the notice delivered when LoginNotifyConfig
+// names no template.
+const DefaultLoginNoticeTemplate = `From: {{.From}}
+To: {{.Address}}
+Subject: New login to {{.Address}}
+Date: {{.Date}}
+Message-ID: {{.MessageID}}
+Auto-Submitted: auto-generated
+MIME-Version: 1.0
+Content-Type: text/plain; charset=utf-8
+
+Your account {{.Address}} was just used to log in from an address
+it has not logged in from recently.
+
+  Time:     {{.Time.Format "2006-01-02 15:04:05 MST"}}
+  From IP:  {{or .IP "unknown"}}
+  Protocol: {{or .Protocol "unknown"}}
+
+If this was you, there is nothing to do. If it was not, change your
+password at once and tell your administrator.
+`
+
+// LoginNotice is the data a login notice template is executed with. All
+// strings are free of line breaks.
+type LoginNotice struct {
+	Username  string    // localpart of the account
+	Domain    string    // domain name
+	Address   string    // Username@Domain
+	From      string    // From header, see LoginNotifyConfig.From
+	IP        string    // client IP of the login, empty if unknown
+	Protocol  string    // protocol of the login, empty if unknown
+	Time      time.Time // time of the login
+	Date      string    // Time in RFC 5322 form, for the Date header
+	MessageID string    // a fresh Message-ID, angle brackets included
+}
+
+// LoginNotifier is told of logins from new locations in place of the
+// notice mail. NotifyLogin runs on the login path, after the credentials
+// are checked, under a deadline; d is the user's domain, so a notifier can
+// still deliver through d.DeliveryAgent. Errors are logged, never failing
+// the login. Install one with FilesystemDomainProvider.WithLoginNotifier.
+type LoginNotifier interface {
+	NotifyLogin(ctx context.Context, d *Domain, notice LoginNotice) error
+}
+
+// LoginNotifierFunc adapts a function to the LoginNotifier interface.
+type LoginNotifierFunc func(ctx context.Context, d *Domain, notice LoginNotice) error
+
+// NotifyLogin calls fn(ctx, d, notice).
+func (fn LoginNotifierFunc) NotifyLogin(ctx context.Context, d *Domain, notice LoginNotice) error {
+	return fn(ctx, d, notice)
+}
+
+// loginNotifyTimeout bounds the delivery of a notice, which runs on the
+// login path.
+const loginNotifyTimeout = 10 * time.Second
+
+// loginNotifier is the loaded form of LoginNotifyConfig.
+type loginNotifier struct {
+	from string
+	tmpl *template.Template
+	hook LoginNotifier // nil: deliver the rendered template
+}
+
+// newLoginNotifier returns the notifier for domain name, or nil when cfg
+// is disabled. tmpl is the contents of cfg.Template; when it is nil or
+// fails to parse, DefaultLoginNoticeTemplate is used.
+func newLoginNotifier(name string, cfg LoginNotifyConfig, tmpl []byte, logger *slog.Logger) *loginNotifier {
+	if !cfg.Enabled {
+		return nil
+	}
+	n := &loginNotifier{from: cfg.From}
+	if n.from == "" {
+		n.from = "postmaster@" + name
+	}
+	if tmpl != nil {
+		t, err := template.New("login_notify").Parse(string(tmpl))
+		if err == nil {
+			n.tmpl = t
+		} else {
+			logger.Warn("failed to parse login notice template, using the default",
+				slog.String("template", cfg.Template),
+				slog.String("error", err.Error()))
+		}
+	}
+	if n.tmpl == nil {
+		n.tmpl = template.Must(template.New("login_notify").Parse(DefaultLoginNoticeTemplate))
+	}
+	return n
+}
+
+// newLoginLocation reports whether a successful login of localpart from
+// the client IP in ctx should be notified: the domain notifies logins, the
+// user has not opted out, the IP is known, and the user's login history
+// has successful logins but none from that IP. Without a history the
+// login state stands in for it, with the last login as the only one. Call
+// it before recording the login.
+func (d *Domain) newLoginLocation(ctx context.Context, localpart string) bool {
+	ip := clientIPFromContext(ctx)
+	if d.loginNotify == nil || (d.history == nil && d.loginState == nil) || ip == "" {
+		return false
+	}
+	logger := loggerOrDefault(d.Logger)
+	md, err := d.UserMetadata(localpart)
+	if err != nil {
+		logger.Warn("login notice skipped", slog.String("username", localpart), slog.String("error", err.Error()))
+		return false
+	}
+	if md.LoginNotify != nil && !*md.LoginNotify {
+		return false
+	}
+	if d.history == nil {
+		state, err := d.loginState.Get(localpart)
+		if err != nil {
+			logger.Warn("login notice skipped", slog.String("username", localpart), slog.String("error", err.Error()))
+			return false
+		}
+		return !state.LastLogin.IsZero() && state.LastIP != ip
+	}
+	recs, err := d.history.list(localpart, 0)
+	if err != nil {
+		logger.Warn("login notice skipped", slog.String("username", localpart), slog.String("error", err.Error()))
+		return false
+	}
+	seen := false
+	for _, rec := range recs {
+		if rec.Outcome != auth.LoginSuccess {
+			continue
+		}
+		if rec.RemoteIP == ip {
+			return false
+		}
+		seen = true
+	}
+	return seen
+}
+
+// notifyLogin delivers a login notice for localpart through the domain's
+// DeliveryAgent, so it lands where the user's other mail does, or hands it
+// to the provider's LoginNotifier. Failures are logged, never returned: a
+// notice must not fail the login.
+func (d *Domain) notifyLogin(ctx context.Context, localpart string) {
+	n := d.loginNotify
+	if n == nil || (n.hook == nil && d.DeliveryAgent == nil) {
+		return
+	}
+	logger := loggerOrDefault(d.Logger)
+	now := time.Now()
+	id := make([]byte, 12)
+	_, _ = rand.Read(id)
+	notice := LoginNotice{
+		Username:  oneLine(localpart),
+		Domain:    d.Name,
+		Address:   oneLine(localpart) + "@" + d.Name,
+		From:      oneLine(n.from),
+		IP:        oneLine(clientIPFromContext(ctx)),
+		Protocol:  oneLine(protocolFromContext(ctx)),
+		Time:      now,
+		Date:      now.Format(time.RFC1123Z),
+		MessageID: "<login-" + hex.EncodeToString(id) + "@" + d.Name + ">",
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), loginNotifyTimeout)
+	defer cancel()
+	if n.hook != nil {
+		if err := n.hook.NotifyLogin(ctx, d, notice); err != nil {
+			logger.Warn("login notifier failed", slog.String("username", localpart), slog.String("error", err.Error()))
+			return
+		}
+		logger.Info("notified login", slog.String("username", localpart), slog.String("ip", notice.IP))
+		return
+	}
+
+	var msg bytes.Buffer
+	if err := n.tmpl.Execute(&msg, notice); err != nil {
+		logger.Warn("failed to render login notice", slog.String("username", localpart), slog.String("error", err.Error()))
+		return
+	}
+	envelope := msgstore.Envelope{
+		From:         "",
+		Recipients:   []string{notice.Address},
+		ReceivedTime: now,
+	}
+	if err := d.DeliveryAgent.Deliver(ctx, envelope, &msg); err != nil {
+		logger.Warn("failed to deliver login notice", slog.String("username", localpart), slog.String("error", err.Error()))
+		return
+	}
+	logger.Info("delivered login notice", slog.String("username", localpart), slog.String("ip", notice.IP))
+}
+
+// notifyLogin sends the login notice r.notify asks for, if any.
+func (r *AuthResult) notifyLogin(ctx context.Context) {
+	if r.notify != "" && r.Domain != nil {
+		r.Domain.notifyLogin(ctx, r.notify)
+	}
+}
+
+// oneLine replaces line breaks in s with spaces, so a value cannot add
+// header lines to a notice.
+func oneLine(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
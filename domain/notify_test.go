@@ -0,0 +1,168 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/infodancer/auth/passwd"
+	"github.com/infodancer/msgstore"
+)
+
+// noticeRecorder is a DeliveryAgent keeping the messages it receives.
+type noticeRecorder struct {
+	envelopes []msgstore.Envelope
+	messages  []string
+}
+
+func (n *noticeRecorder) Deliver(_ context.Context, env msgstore.Envelope, message io.Reader) error {
+	data, err := io.ReadAll(message)
+	if err != nil {
+		return err
+	}
+	n.envelopes = append(n.envelopes, env)
+	n.messages = append(n.messages, string(data))
+	return nil
+}
+
+// newNotifyTree returns a router over example.com with login history and
+// files written to the domain directory, and the recorder its notices are
+// delivered to.
+func newNotifyTree(t *testing.T, files map[string]string) (*AuthRouter, *noticeRecorder) {
+	t.Helper()
+	hash, err := passwd.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, base := newTestDomainsTree(t, "alice:"+hash+":alice\nbob:"+hash+":bob\n", "example.com")
+	p.WithLoginHistory(0)
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(base, "example.com", name), []byte(content), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := p.GetDomain("example.com")
+	if d == nil {
+		t.Fatal("GetDomain returned nil")
+	}
+	rec := &noticeRecorder{}
+	d.DeliveryAgent = rec
+	return NewAuthRouter(p, nil), rec
+}
+
+func TestLoginNotify(t *testing.T) {
+	r, rec := newNotifyTree(t, map[string]string{
+		"config.toml":    "[login_notify]\nenabled = true\n",
+		UserMetadataFile: "[bob]\nlogin_notify = false\n",
+	})
+	login := func(user, ip string) {
+		t.Helper()
+		ctx := WithProtocol(WithClientIP(context.Background(), ip), "imap")
+		if _, err := r.Authenticate(ctx, user, "secret"); err != nil {
+			t.Fatalf("Authenticate(%s from %s): %v", user, ip, err)
+		}
+	}
+
+	login("alice@example.com", "192.0.2.1") // first login: nothing to compare with
+	login("alice@example.com", "192.0.2.1") // known IP
+	if len(rec.messages) != 0 {
+		t.Fatalf("notices = %q, want none", rec.messages)
+	}
+	_, _ = r.Authenticate(WithClientIP(context.Background(), "192.0.2.66"), "alice@example.com", "wrong")
+	if len(rec.messages) != 0 {
+		t.Fatal("failed login was notified")
+	}
+
+	login("alice@example.com", "198.51.100.7") // new IP
+	if len(rec.messages) != 1 {
+		t.Fatalf("notices = %d, want 1", len(rec.messages))
+	}
+	env, msg := rec.envelopes[0], rec.messages[0]
+	if env.From != "" || len(env.Recipients) != 1 || env.Recipients[0] != "alice@example.com" {
+		t.Errorf("envelope = %+v", env)
+	}
+	for _, want := range []string{
+		"From: postmaster@example.com\n",
+		"To: alice@example.com\n",
+		"Subject: New login to alice@example.com\n",
+		"Auto-Submitted: auto-generated\n",
+		"From IP:  198.51.100.7\n",
+		"Protocol: imap\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("notice lacks %q:\n%s", want, msg)
+		}
+	}
+
+	login("alice@example.com", "198.51.100.7") // now known
+	login("bob@example.com", "192.0.2.1")
+	login("bob@example.com", "198.51.100.7") // opted out
+	if len(rec.messages) != 1 {
+		t.Errorf("notices = %d, want 1", len(rec.messages))
+	}
+}
+
+func TestLoginNotify_Template(t *testing.T) {
+	r, rec := newNotifyTree(t, map[string]string{
+		"config.toml": "[login_notify]\nenabled = true\nfrom = \"security@example.com\"\ntemplate = \"notice.tmpl\"\n",
+		"notice.tmpl": "From: {{.From}}\nSubject: login {{.Username}} {{.IP}}\n\nhi\n",
+	})
+
+	// A line break in a value cannot add a header.
+	for _, ip := range []string{"192.0.2.1", "198.51.100.7\r\nBcc: x@example.net"} {
+		if _, err := r.Authenticate(WithClientIP(context.Background(), ip), "alice@example.com", "secret"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(rec.messages) != 1 {
+		t.Fatalf("notices = %q", rec.messages)
+	}
+	want := "From: security@example.com\nSubject: login alice 198.51.100.7  Bcc: x@example.net\n\nhi\n"
+	if rec.messages[0] != want {
+		t.Errorf("notice = %q, want %q", rec.messages[0], want)
+	}
+}
+
+func TestLoginNotify_Hook(t *testing.T) {
+	hash, err := passwd.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, base := newTestDomainsTree(t, "alice:"+hash+":alice\n", "example.com")
+	if err := os.WriteFile(filepath.Join(base, "example.com", "config.toml"), []byte("[login_notify]\nenabled = true\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	var notices []LoginNotice
+	p.WithLoginState().WithLoginNotifier(LoginNotifierFunc(func(ctx context.Context, d *Domain, n LoginNotice) error {
+		if _, ok := ctx.Deadline(); !ok || d.Name != "example.com" {
+			t.Errorf("hook called with deadline %v, domain %q", ok, d.Name)
+		}
+		notices = append(notices, n)
+		return errors.New("notifier down")
+	}))
+	rec := &noticeRecorder{}
+	p.GetDomain("example.com").DeliveryAgent = rec
+	r := NewAuthRouter(p, nil)
+
+	for _, ip := range []string{"192.0.2.1", "192.0.2.1", "198.51.100.7", "198.51.100.7", "192.0.2.1"} {
+		ctx := WithProtocol(WithClientIP(context.Background(), ip), "pop3")
+		if _, err := r.Authenticate(ctx, "alice@example.com", "secret"); err != nil {
+			t.Fatalf("Authenticate from %s: %v", ip, err)
+		}
+	}
+	// The login state remembers only the last IP, so returning to an
+	// earlier one is a new location again.
+	if len(notices) != 2 || notices[0].IP != "198.51.100.7" || notices[1].IP != "192.0.2.1" {
+		t.Fatalf("notices = %+v", notices)
+	}
+	if n := notices[0]; n.Address != "alice@example.com" || n.Protocol != "pop3" || n.From != "postmaster@example.com" {
+		t.Errorf("notice = %+v", n)
+	}
+	if len(rec.messages) != 0 {
+		t.Errorf("mail delivered despite the hook: %q", rec.messages)
+	}
+}
@@ -0,0 +1,98 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/infodancer/auth/oauth"
+	"github.com/infodancer/auth/sasl"
+)
+
+// OAuthConfig configures the bearer token issuer trusted for a domain's
+// XOAUTH2 and OAUTHBEARER logins.
+type OAuthConfig struct {
+	// Issuer is the expected "iss" claim. Empty disables OAuth for the domain.
+	Issuer string `toml:"issuer,omitempty"`
+
+	// Audience is the expected "aud" claim.
+	Audience string `toml:"audience,omitempty"`
+
+	// JWKSURL is where the issuer's signing keys are published.
+	JWKSURL string `toml:"jwks_url,omitempty"`
+
+	// UsernameClaim names the claim holding the mail address. Default "email".
+	UsernameClaim string `toml:"username_claim,omitempty"`
+
+	// DiscoveryURL is the issuer's OpenID configuration URL, advertised to
+	// clients in OAUTHBEARER error responses.
+	DiscoveryURL string `toml:"discovery_url,omitempty"`
+}
+
+// domainOAuth lazily builds a domain's token validator on first use, so
+// loading a domain never fetches JWKS.
+type domainOAuth struct {
+	once   sync.Once
+	agent  oauth.Agent
+	err    error
+	cancel context.CancelFunc
+}
+
+// OAuthAgent returns the domain's bearer token validator, built from its
+// [oauth] config on first call. Tokens are accepted only for addresses in
+// this domain. Returns an error wrapping sasl.ErrNoIssuer when OAuth is not
+// configured for the domain.
+func (d *Domain) OAuthAgent() (oauth.Agent, error) {
+	if d.OAuth.Issuer == "" {
+		return nil, fmt.Errorf("%w: %s", sasl.ErrNoIssuer, d.Name)
+	}
+	d.oauth.once.Do(func() {
+		// The JWKS cache refreshes in the background for the agent's
+		// lifetime, so it must not be tied to a request context.
+		ctx, cancel := context.WithCancel(context.Background())
+		d.oauth.agent, d.oauth.err = oauth.NewJWTAgent(ctx, oauth.JWTAgentConfig{
+			JWKSURL:        d.OAuth.JWKSURL,
+			Issuer:         d.OAuth.Issuer,
+			Audience:       d.OAuth.Audience,
+			UsernameClaim:  d.OAuth.UsernameClaim,
+			AllowedDomains: []string{d.Name},
+		})
+		if d.oauth.err != nil {
+			cancel()
+			return
+		}
+		d.oauth.cancel = cancel
+	})
+	return d.oauth.agent, d.oauth.err
+}
+
+// closeOAuth releases the domain's token validator, if built.
+func (d *Domain) closeOAuth() error {
+	if d.oauth.cancel == nil {
+		return nil
+	}
+	d.oauth.cancel()
+	return d.oauth.agent.Close()
+}
+
+// Compile-time check: the provider resolves per-domain token issuers.
+var _ sasl.IssuerResolver = (*FilesystemDomainProvider)(nil)
+
+// IssuerFor returns the token validator configured for domain name.
+// Implements sasl.IssuerResolver.
+func (p *FilesystemDomainProvider) IssuerFor(_ context.Context, name string) (oauth.Agent, error) {
+	d := p.GetDomain(name)
+	if d == nil {
+		return nil, fmt.Errorf("%w: %q", sasl.ErrNoIssuer, name)
+	}
+	return d.OAuthAgent()
+}
+
+// DiscoveryURL returns the OpenID configuration URL configured for domain
+// name, or "". Suitable for sasl.OAuthServer.DiscoveryURL.
+func (p *FilesystemDomainProvider) DiscoveryURL(name string) string {
+	if d := p.GetDomain(name); d != nil {
+		return d.OAuth.DiscoveryURL
+	}
+	return ""
+}
@@ -0,0 +1,82 @@
+package domain
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+	_ "github.com/infodancer/auth/oidcauth"
+	"github.com/infodancer/auth/sasl"
+)
+
+func TestFilesystemDomainProvider_IssuerFor(t *testing.T) {
+	p, base := newTestDomainsTree(t, "", "plain.com", "sso.com")
+	writeDomainConfig(t, base, "sso.com", `
+[oauth]
+issuer = "https://id.sso.com"
+audience = "mail"
+jwks_url = "http://127.0.0.1:1/jwks"
+discovery_url = "https://id.sso.com/.well-known/openid-configuration"
+`)
+
+	if _, err := p.IssuerFor(context.Background(), "plain.com"); !errors.Is(err, sasl.ErrNoIssuer) {
+		t.Errorf("plain.com: err = %v, want ErrNoIssuer", err)
+	}
+	if _, err := p.IssuerFor(context.Background(), "unknown.com"); !errors.Is(err, sasl.ErrNoIssuer) {
+		t.Errorf("unknown.com: err = %v, want ErrNoIssuer", err)
+	}
+	// The JWKS endpoint is unreachable: the agent is built lazily and the
+	// fetch error surfaces here rather than at domain load.
+	if _, err := p.IssuerFor(context.Background(), "sso.com"); err == nil {
+		t.Error("sso.com: expected JWKS fetch error")
+	}
+	if got := p.DiscoveryURL("sso.com"); got != "https://id.sso.com/.well-known/openid-configuration" {
+		t.Errorf("DiscoveryURL = %q", got)
+	}
+}
+
+func TestAuthRouter_BearerToken(t *testing.T) {
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		active := r.PostFormValue("token") == "tok-alice"
+		_ = json.NewEncoder(w).Encode(map[string]any{"active": active, "iss": "https://idp.example.com", "email": "alice@example.com"})
+	}))
+	defer idp.Close()
+	p, base := newTestDomainsTree(t, "alice:x:alice\nbob:x:bob\n", "example.com")
+	writeDomainConfig(t, base, "example.com", `
+[[auth.chain]]
+type = "passwd"
+credential_backend = "passwd"
+key_backend = "keys"
+
+[[auth.chain]]
+type = "oidcauth"
+credential_backend = "https://idp.example.com"
+options = { domain = "example.com", introspection_url = "`+idp.URL+`" }
+`)
+	r := NewAuthRouter(p, nil)
+	defer func() { _ = r.Close() }()
+	ctx := context.Background()
+
+	req, err := sasl.ParseXOAUTH2([]byte("user=alice@example.com\x01auth=Bearer tok-alice\x01\x01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := r.AuthenticateCredentials(ctx, req.Credentials())
+	if err != nil {
+		t.Fatalf("alice: %v", err)
+	}
+	if s := result.Session; s.User.Mailbox != "alice@example.com" || s.Credential.Kind != auth.CredentialBearerToken {
+		t.Errorf("alice session = %+v, credential %+v", s.User, s.Credential)
+	}
+
+	creds := req.Credentials()
+	creds.Username = "bob@example.com"
+	if _, err := r.AuthenticateCredentials(ctx, creds); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("alice's token for bob: err = %v, want ErrAuthFailed", err)
+	}
+}
@@ -0,0 +1,28 @@
+package domain
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/infodancer/auth/passwd"
+)
+
+// PasswordPolicy returns the merged [password] policy of the named domain
+// without loading it, so passwords can be generated for a domain whose
+// backends are not reachable from the provisioning host.
+func (p *FilesystemDomainProvider) PasswordPolicy(name string) (passwd.PasswordPolicy, error) {
+	name = strings.ToLower(name)
+	if !validDirName(name) {
+		return passwd.PasswordPolicy{}, fmt.Errorf("invalid domain name %q", name)
+	}
+	domainPath := filepath.Join(p.basePath, name)
+	if !p.exists(domainPath) {
+		return passwd.PasswordPolicy{}, fmt.Errorf("domain %s does not exist", name)
+	}
+	cfg, _, err := p.mergedConfig(name, filepath.Join(domainPath, "config.toml"))
+	if err != nil {
+		return passwd.PasswordPolicy{}, fmt.Errorf("domain %s: %w", name, err)
+	}
+	return cfg.Password, nil
+}
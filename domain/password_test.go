@@ -0,0 +1,33 @@
+package domain
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/infodancer/auth/passwd"
+)
+
+func TestFilesystemDomainProvider_PasswordPolicy(t *testing.T) {
+	p, base := newTestDomainsTree(t, "", "example.com")
+	// An unknown msgstore type keeps the domain from loading, but not its
+	// password policy from being read.
+	content := "[msgstore]\ntype = \"nosuch\"\n\n[password]\nlength = 12\nmin_symbols = 2\n"
+	if err := os.WriteFile(filepath.Join(base, "example.com", "config.toml"), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := p.PasswordPolicy("Example.COM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (passwd.PasswordPolicy{Length: 12, MinSymbols: 2}); got != want {
+		t.Errorf("PasswordPolicy = %+v, want %+v", got, want)
+	}
+
+	for _, name := range []string{"nosuch.example", "../example.com"} {
+		if _, err := p.PasswordPolicy(name); err == nil {
+			t.Errorf("PasswordPolicy(%q) succeeded", name)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package domain
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -33,9 +34,13 @@ func ParsePostmasterFile(path string) (map[string]*PostmasterEntry, error) {
 		return nil, fmt.Errorf("open: %w", err)
 	}
 	defer func() { _ = f.Close() }()
+	return parsePostmaster(f)
+}
 
+// parsePostmaster parses postmaster file contents read from r.
+func parsePostmaster(r io.Reader) (map[string]*PostmasterEntry, error) {
 	entries := make(map[string]*PostmasterEntry)
-	scanner := bufio.NewScanner(f)
+	scanner := bufio.NewScanner(r)
 	lineNum := 0
 	for scanner.Scan() {
 		lineNum++
@@ -167,6 +167,34 @@ func (rl *authRateLimiter) record(m map[string]*failureBucket, key string, now,
 	}
 }
 
+// failures returns the failed attempts within the window for username
+// (across all IPs) and for ip (across all usernames).
+func (rl *authRateLimiter) failures(ip, username string) (userFailures, ipFailures int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	cutoff := rl.now().Add(-rl.cfg.Window)
+	count := func(b *failureBucket) int {
+		if b == nil {
+			return 0
+		}
+		n := 0
+		for _, t := range b.failures {
+			if t.After(cutoff) {
+				n++
+			}
+		}
+		return n
+	}
+	if username != "" {
+		userFailures = count(rl.user[username])
+	}
+	if ip != "" {
+		ipFailures = count(rl.ip[ip])
+	}
+	return userFailures, ipFailures
+}
+
 // recordSuccess clears failure state for the given IP and username,
 // so a successful login resets the counters.
 func (rl *authRateLimiter) recordSuccess(ip, username string) {
@@ -0,0 +1,44 @@
+package domain
+
+import (
+	"path/filepath"
+
+	"github.com/infodancer/auth/passwd"
+)
+
+// ReadOnlyMarker is the file under the provider's basePath that puts the
+// provider in read-only mode. Placing it on a secondary MX (and excluding it
+// from replication) keeps management tools from changing a replica that the
+// next sync would silently overwrite. The passwd package honours the same
+// marker for the passwd files and keys of the domains under it.
+const ReadOnlyMarker = passwd.ReadOnlyMarker
+
+// WithReadOnly puts the provider in read-only mode: authentication,
+// UserExists and forward resolution work normally, but CreateDomain returns
+// errors.ErrReadOnly, every loaded Domain has ReadOnly set, and its auth
+// agents are opened read-only (see auth.AuthAgentConfig.ReadOnly), so
+// logins never rewrite the replicated credential files. A provider is
+// also read-only when ReadOnlyMarker exists under basePath.
+// Returns the provider to allow chaining.
+func (p *FilesystemDomainProvider) WithReadOnly() *FilesystemDomainProvider {
+	p.readOnly = true
+	return p
+}
+
+// ReadOnly reports whether the provider is in read-only mode. The marker
+// is looked for on the provider's FS (see WithFS).
+func (p *FilesystemDomainProvider) ReadOnly() bool {
+	return p.readOnly || markedReadOnly(p.fs, p.basePath)
+}
+
+// MarkedReadOnly reports whether basePath on the local disk contains
+// ReadOnlyMarker.
+func MarkedReadOnly(basePath string) bool {
+	return markedReadOnly(OSFS{}, basePath)
+}
+
+// markedReadOnly reports whether basePath on fsys contains ReadOnlyMarker.
+func markedReadOnly(fsys FS, basePath string) bool {
+	_, err := fsys.Stat(filepath.Join(basePath, ReadOnlyMarker))
+	return err == nil
+}
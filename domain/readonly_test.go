@@ -0,0 +1,78 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/passwd"
+)
+
+func TestReadOnly_WithReadOnly(t *testing.T) {
+	p, _ := newTestDomainsTree(t, "alice:HASH:alice\n", "example.com")
+	p.WithReadOnly()
+
+	if err := p.CreateDomain("new.com", ""); !errors.Is(err, autherrors.ErrReadOnly) {
+		t.Errorf("CreateDomain: got %v, want ErrReadOnly", err)
+	}
+
+	d := p.GetDomain("example.com")
+	if d == nil {
+		t.Fatal("expected domain to load in read-only mode")
+	}
+	if !d.ReadOnly {
+		t.Error("expected Domain.ReadOnly to be set")
+	}
+	if exists, err := d.AuthAgent.UserExists(context.Background(), "alice"); err != nil || !exists {
+		t.Errorf("UserExists(alice) = %v, %v", exists, err)
+	}
+}
+
+func TestReadOnly_Marker(t *testing.T) {
+	p, base := newTestDomainsTree(t, "", "example.com")
+	if p.ReadOnly() {
+		t.Fatal("provider should be writable without the marker")
+	}
+	if err := os.WriteFile(filepath.Join(base, ReadOnlyMarker), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if !p.ReadOnly() || !MarkedReadOnly(base) {
+		t.Error("expected marker to enable read-only mode")
+	}
+	if err := p.CreateDomain("new.com", ""); !errors.Is(err, autherrors.ErrReadOnly) {
+		t.Errorf("CreateDomain: got %v, want ErrReadOnly", err)
+	}
+	if _, err := os.Stat(filepath.Join(base, "new.com")); !os.IsNotExist(err) {
+		t.Error("read-only CreateDomain must not create the directory")
+	}
+}
+
+func TestReadOnly_LoginsDoNotWrite(t *testing.T) {
+	// A hash weaker than the defaults would be upgraded at login on a
+	// writable provider.
+	hash, err := passwd.HashPasswordWithParams("pw", passwd.Argon2Params{Time: 1, Memory: 8 * 1024, Threads: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, base := newTestDomainsTree(t, "alice:"+hash+":alice\n", "example.com")
+	p.WithReadOnly()
+	passwdPath := filepath.Join(base, "example.com", "passwd")
+	before, err := os.ReadFile(passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := p.GetDomain("example.com")
+	if d == nil {
+		t.Fatal("expected domain to load in read-only mode")
+	}
+	if _, err := d.AuthAgent.Authenticate(context.Background(), "alice", "pw"); err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if after, err := os.ReadFile(passwdPath); err != nil || string(after) != string(before) {
+		t.Errorf("read-only login rewrote the passwd file: %q, %v", after, err)
+	}
+}
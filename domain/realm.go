@@ -0,0 +1,107 @@
+package domain
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/infodancer/auth/address"
+)
+
+// WithRealms routes bare usernames (no "@domain") by the endpoint a client
+// connected to, so one server can offer brand-specific login endpoints
+// whose users log in without their domain, and the same username can exist
+// in several domains. realms maps a realm to the domain name serving it. A
+// realm is a TLS server name (ConnInfo.ServerName), a listening address
+// "host:port" or a listening IP address (ConnInfo.LocalAddr):
+//
+//	router.WithRealms(map[string]string{
+//		"mail.brand-a.com": "brand-a.com",
+//		"mail.brand-b.com": "brand-b.com",
+//		"203.0.113.7:993":  "brand-b.com",
+//	})
+//
+// The server name is tried first, then the address with and without its
+// port. A bare username arriving on a realm is handled as
+// username@domain throughout: logins, UserExists, LookupAddress, second
+// factors, rate limits and the audit log. Usernames that name a domain,
+// connections matching no realm, and realms whose domain is not served
+// are routed as before. Call WithRealms before serving; later calls
+// replace the mapping.
+func (r *AuthRouter) WithRealms(realms map[string]string) *AuthRouter {
+	r.realms = make(map[string]string, len(realms))
+	for realm, name := range realms {
+		if canonical, err := address.Domain(name); err == nil {
+			name = canonical
+		}
+		r.realms[canonicalRealm(realm)] = name
+	}
+	return r
+}
+
+// Realm returns the domain name the realm of ctx maps to, or "" if the
+// connection matches no realm (see WithRealms).
+func (r *AuthRouter) Realm(ctx context.Context) string {
+	if len(r.realms) == 0 {
+		return ""
+	}
+	info, ok := connInfoFromContext(ctx)
+	if !ok {
+		return ""
+	}
+	if info.ServerName != "" {
+		if name, ok := r.realms[canonicalRealm(info.ServerName)]; ok {
+			return name
+		}
+	}
+	if info.LocalAddr != "" {
+		if name, ok := r.realms[canonicalRealm(info.LocalAddr)]; ok {
+			return name
+		}
+		if host, _, err := net.SplitHostPort(info.LocalAddr); err == nil {
+			if name, ok := r.realms[canonicalRealm(host)]; ok {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// qualify returns username with the domain of the realm of ctx appended
+// when username names no domain and the realm's domain is served;
+// otherwise username unchanged.
+func (r *AuthRouter) qualify(ctx context.Context, username string) string {
+	if r.provider == nil || username == "" || strings.Contains(username, "@") {
+		return username
+	}
+	name := r.Realm(ctx)
+	if name == "" {
+		return username
+	}
+	if d, _ := ResolveDomain(r.provider, name); d == nil {
+		return username
+	}
+	return username + "@" + name
+}
+
+// canonicalRealm returns the form realms are compared in: host names
+// canonical as by address.Domain, addresses as written.
+func canonicalRealm(realm string) string {
+	realm = strings.TrimSpace(realm)
+	if net.ParseIP(realm) != nil || strings.Contains(realm, ":") {
+		if host, port, err := net.SplitHostPort(realm); err == nil {
+			if ip := net.ParseIP(host); ip != nil {
+				return net.JoinHostPort(ip.String(), port)
+			}
+			return net.JoinHostPort(strings.ToLower(host), port)
+		}
+		if ip := net.ParseIP(realm); ip != nil {
+			return ip.String()
+		}
+		return realm
+	}
+	if canonical, err := address.Domain(realm); err == nil {
+		return canonical
+	}
+	return strings.ToLower(realm)
+}
@@ -0,0 +1,121 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/passwd"
+)
+
+// newRealmTestRouter returns a router over brand-a.com and brand-b.com,
+// both with a user alice whose password is the domain name, mapped to
+// realms by SNI name and by listening address.
+func newRealmTestRouter(t *testing.T) *AuthRouter {
+	t.Helper()
+	p, base := newTestDomainsTree(t, "", "brand-a.com", "brand-b.com")
+	for _, name := range []string{"brand-a.com", "brand-b.com"} {
+		hash, err := passwd.HashPassword(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(base, name, "passwd"), []byte("alice:"+hash+":alice\n"), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return NewAuthRouter(p, nil).WithRealms(map[string]string{
+		"Mail.Brand-A.com":  "brand-a.com",
+		"mail.brand-b.com":  "Brand-B.com",
+		"203.0.113.7":       "brand-a.com",
+		"203.0.113.8:993":   "brand-b.com",
+		"mail.unserved.net": "unserved.net",
+	})
+}
+
+func TestAuthRouter_Realms(t *testing.T) {
+	r := newRealmTestRouter(t)
+
+	tests := []struct {
+		name string
+		info ConnInfo
+		want string // domain serving bare "alice", "" for none
+	}{
+		{"server name", ConnInfo{ServerName: "mail.brand-a.com"}, "brand-a.com"},
+		{"server name case", ConnInfo{ServerName: "MAIL.BRAND-B.COM."}, "brand-b.com"},
+		{"server name first", ConnInfo{ServerName: "mail.brand-b.com", LocalAddr: "203.0.113.7:143"}, "brand-b.com"},
+		{"ip with any port", ConnInfo{LocalAddr: "203.0.113.7:143"}, "brand-a.com"},
+		{"ip and port", ConnInfo{LocalAddr: "203.0.113.8:993"}, "brand-b.com"},
+		{"other port", ConnInfo{LocalAddr: "203.0.113.8:143"}, ""},
+		{"unknown name", ConnInfo{ServerName: "mail.other.org"}, ""},
+		{"unserved domain", ConnInfo{ServerName: "mail.unserved.net"}, ""},
+		{"no hints", ConnInfo{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := WithConnInfo(context.Background(), tt.info)
+			result, err := r.AuthenticateWithDomain(ctx, "alice", tt.want)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("bare login without a realm succeeded in %s", result.Domain.Name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AuthenticateWithDomain: %v", err)
+			}
+			if result.Domain == nil || result.Domain.Name != tt.want {
+				t.Errorf("served by %v, want %s", result.Domain, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthRouter_RealmsDoNotOverrideDomain(t *testing.T) {
+	r := newRealmTestRouter(t)
+	ctx := WithConnInfo(context.Background(), ConnInfo{ServerName: "mail.brand-a.com"})
+
+	// A username naming its domain is routed by it, whatever the realm.
+	result, err := r.AuthenticateWithDomain(ctx, "alice@brand-b.com", "brand-b.com")
+	if err != nil || result.Domain.Name != "brand-b.com" {
+		t.Fatalf("qualified login = %v, %v", result, err)
+	}
+	// The realm's password does not open the other domain's account.
+	if _, err := r.AuthenticateWithDomain(ctx, "alice", "brand-b.com"); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("wrong realm password: got %v, want ErrAuthFailed", err)
+	}
+}
+
+func TestAuthRouter_RealmsLookups(t *testing.T) {
+	r := newRealmTestRouter(t)
+	ctx := WithConnInfo(context.Background(), ConnInfo{LocalAddr: "203.0.113.8:993"})
+
+	if got := r.Realm(ctx); got != "brand-b.com" {
+		t.Errorf("Realm = %q, want brand-b.com", got)
+	}
+	if exists, err := r.UserExists(ctx, "alice"); err != nil || !exists {
+		t.Errorf("UserExists(alice) = %v, %v; want true", exists, err)
+	}
+	if exists, err := r.UserExists(context.Background(), "alice"); err != nil || exists {
+		t.Errorf("UserExists(alice) without realm = %v, %v; want false", exists, err)
+	}
+	if info, err := r.LookupAddress(ctx, "alice"); err != nil || !info.CanAuthenticate {
+		t.Errorf("LookupAddress(alice) = %+v, %v", info, err)
+	}
+}
+
+func TestAuthRouter_RealmsAudit(t *testing.T) {
+	rec := &recordingAuditor{}
+	r := newRealmTestRouter(t).WithAuditor(rec)
+	ctx := WithConnInfo(context.Background(), ConnInfo{ServerName: "mail.brand-a.com"})
+
+	if _, err := r.AuthenticateWithDomain(ctx, "alice", "brand-a.com"); err != nil {
+		t.Fatal(err)
+	}
+	recs := rec.recs
+	if len(recs) != 1 || recs[0].Username != "alice@brand-a.com" || recs[0].Domain != "brand-a.com" {
+		t.Errorf("audit records = %+v, want alice@brand-a.com", recs)
+	}
+}
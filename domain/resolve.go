@@ -0,0 +1,225 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/forwards"
+)
+
+// MaxForwardDepth is the maximum number of forwarding hops followed by
+// ResolveFinalRecipients and MailDeliveryAgent before giving up with
+// ErrForwardDepthExceeded.
+const MaxForwardDepth = 10
+
+// checkForwardHop fails with ErrForwardLoop if address is already on path,
+// the addresses whose rules were applied to reach it, and with
+// ErrForwardDepthExceeded if path is longer than MaxForwardDepth.
+// ResolveFinalRecipients and MailDeliveryAgent both apply it, so they agree
+// on which rules loop.
+func checkForwardHop(path []string, address string) error {
+	if len(path) > MaxForwardDepth {
+		return fmt.Errorf("%w: %s", autherrors.ErrForwardDepthExceeded, strings.Join(append(path[:len(path):len(path)], address), " -> "))
+	}
+	for _, p := range path {
+		if strings.EqualFold(p, address) {
+			return fmt.Errorf("%w: %s", autherrors.ErrForwardLoop, strings.Join(append(path[:len(path):len(path)], address), " -> "))
+		}
+	}
+	return nil
+}
+
+// DeliveryKind distinguishes local mailbox deliveries from outbound relays.
+type DeliveryKind int
+
+const (
+	// DeliveryLocal is a delivery into a mailbox on a locally served domain.
+	DeliveryLocal DeliveryKind = iota
+
+	// DeliveryRelay is a delivery to a domain not served by this provider.
+	DeliveryRelay
+)
+
+// String returns "local" or "relay".
+func (k DeliveryKind) String() string {
+	if k == DeliveryRelay {
+		return "relay"
+	}
+	return "local"
+}
+
+// Delivery is one final recipient produced by ResolveFinalRecipients.
+type Delivery struct {
+	// Kind reports whether the message lands locally or must be relayed.
+	Kind DeliveryKind
+
+	// Address is the final recipient address (lowercased).
+	Address string
+
+	// Domain is the locally served domain for DeliveryLocal; nil for relays.
+	Domain *Domain
+
+	// Path is the chain of addresses expanded to reach Address, starting with
+	// the original recipient. A direct delivery has a single-element path.
+	Path []string
+
+	// Folder is the mailbox folder a "=Folder" forward target files into;
+	// empty for the inbox.
+	Folder string
+}
+
+// ResolveFinalRecipients fully expands forwarding rules for address across all
+// domains served by provider and returns the deliveries that would occur.
+//
+// Expansion follows the same rules as MailDeliveryAgent, sharing its loop,
+// depth, self-target and duplicate checks: a localpart with a forwarding
+// rule (user, domain, or system catchall) is replaced by its targets; a
+// target on a served domain is expanded again; a target on an unserved
+// domain becomes a relay. A target equal to the address being expanded
+// keeps a local copy rather than looping, and a "=Folder" target keeps one
+// in that folder. Mail to a bounce localpart that is discarded (see
+// BouncesConfig) produces no delivery. The null-sender rules are not
+// applied: the expansion is that of an ordinary message.
+//
+// Errors:
+//   - ErrUserNotFound: a served local address has no user and no forward.
+//   - ErrForwardLoop: rules lead back to an address already expanded.
+//   - ErrForwardDepthExceeded: more than MaxForwardDepth hops.
+//   - ErrForwardFanOutExceeded: more final recipients than address's
+//     domain allows (see LimitsConfig.MaxForwardRecipients).
+//
+// Duplicate final recipients reached through different paths are reported
+// once, on the first path found.
+func ResolveFinalRecipients(ctx context.Context, provider DomainProvider, address string) ([]Delivery, error) {
+	address = strings.ToLower(address)
+	limit := DefaultMaxForwardRecipients
+	if _, domainName := SplitUsername(address); domainName != "" {
+		if d, _ := ResolveDomain(provider, domainName); d != nil {
+			limit = d.Limits.forwardRecipientLimit()
+		}
+	}
+	r := &recipientResolver{
+		provider: provider,
+		fanOut:   newFanOut(address, limit),
+	}
+	if err := r.expand(ctx, address, nil); err != nil {
+		return nil, err
+	}
+	return r.out, nil
+}
+
+// isSelfTarget reports whether a forward target of address is address
+// itself, which keeps a copy in its own mailbox rather than forwarding.
+func isSelfTarget(target, address string) bool {
+	return strings.EqualFold(target, address)
+}
+
+// recipientResolver carries the state of one ResolveFinalRecipients call.
+type recipientResolver struct {
+	provider DomainProvider
+	fanOut   *fanOut // final addresses already emitted, and the limit
+	out      []Delivery
+}
+
+// expand resolves address, where path holds the addresses already expanded to
+// reach it (used for loop detection and reporting).
+func (r *recipientResolver) expand(ctx context.Context, address string, path []string) error {
+	if err := checkForwardHop(path, address); err != nil {
+		return err
+	}
+	path = append(path[:len(path):len(path)], address)
+
+	localpart, domainName := SplitUsername(address)
+	d, _ := ResolveDomain(r.provider, domainName)
+	if d == nil {
+		return r.emit(Delivery{Kind: DeliveryRelay, Address: address, Path: path})
+	}
+	canonical, ok := d.NormalizeLocalpart(localpart)
+	if !ok {
+		return fmt.Errorf("%w: %s", autherrors.ErrUserNotFound, address)
+	}
+	if canonical != localpart || d.Name != domainName {
+		// Deliver to the canonical address, on the parent domain when a
+		// subdomain address was delegated.
+		localpart = canonical
+		address = canonical + "@" + d.Name
+		path[len(path)-1] = address
+	}
+
+	if d.AuthAgent != nil {
+		if targets, ok := forwardTargets(ctx, d.AuthAgent, localpart); ok {
+			for _, t := range targets {
+				if folder, ok := t.Folder(); ok {
+					if folder == "" {
+						return fmt.Errorf("%s: invalid fileinto target %q", address, t.Address)
+					}
+					if err := r.emit(Delivery{Kind: DeliveryLocal, Address: address, Domain: d, Path: path, Folder: folder}); err != nil {
+						return err
+					}
+					continue
+				}
+				target := t.Address
+				if isSelfTarget(target, address) {
+					if err := r.emit(Delivery{Kind: DeliveryLocal, Address: address, Domain: d, Path: path}); err != nil {
+						return err
+					}
+					continue
+				}
+				if err := r.expand(ctx, target, path); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		discard, err := discardsBounce(ctx, d.AuthAgent, localpart)
+		if err != nil {
+			return fmt.Errorf("lookup %s: %w", address, err)
+		}
+		if discard {
+			return nil
+		}
+		base, _ := ParseLocalPart(localpart)
+		exists, err := d.AuthAgent.UserExists(ctx, base)
+		if err != nil {
+			return fmt.Errorf("lookup %s: %w", address, err)
+		}
+		if !exists {
+			return fmt.Errorf("%w: %s", autherrors.ErrUserNotFound, address)
+		}
+	}
+
+	return r.emit(Delivery{Kind: DeliveryLocal, Address: address, Domain: d, Path: path})
+}
+
+// emit records a final delivery unless the address (and folder) was already
+// emitted, failing once the fan-out limit is exceeded.
+func (r *recipientResolver) emit(d Delivery) error {
+	first, err := r.fanOut.add(recipientKey(d.Address, d.Folder))
+	if err != nil || !first {
+		return err
+	}
+	r.out = append(r.out, d)
+	return nil
+}
+
+// forwardTargets returns the forward rule for localpart including folder
+// targets, which ResolveForward leaves out. Agents other than the
+// provider's own yield only ResolveForward's addresses.
+func forwardTargets(ctx context.Context, agent MailAuthAgent, localpart string) ([]forwards.Target, bool) {
+	if m, ok := agent.(*mailAuthAgent); ok {
+		localpart, ok := m.norm.localpart(localpart)
+		if !ok {
+			return nil, false
+		}
+		return m.chain.resolveTargets(localpart)
+	}
+	addrs, ok := agent.ResolveForward(ctx, localpart)
+	targets := make([]forwards.Target, len(addrs))
+	for i, a := range addrs {
+		targets[i] = forwards.Target{Address: a}
+	}
+	return targets, ok
+}
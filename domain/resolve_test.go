@@ -0,0 +1,250 @@
+package domain
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/forwards"
+	"github.com/infodancer/msgstore"
+)
+
+// forwardingDomain builds a Domain whose auth agent has the given users and
+// domain-level forwarding rules.
+func forwardingDomain(name string, users []string, rules map[string]string) *Domain {
+	known := make(map[string]bool, len(users))
+	for _, u := range users {
+		known[u] = true
+	}
+	return &Domain{
+		Name: name,
+		AuthAgent: &mailAuthAgent{
+			inner: &stubAuthAgent{users: known},
+			chain: &forwardChain{
+				domainForwards:  forwards.FromMap(rules),
+				defaultForwards: forwards.FromMap(nil),
+			},
+		},
+	}
+}
+
+func TestResolveFinalRecipients_Direct(t *testing.T) {
+	provider := &stubDomainProvider{domains: map[string]*Domain{
+		"this.com": forwardingDomain("this.com", []string{"alice"}, nil),
+	}}
+
+	got, err := ResolveFinalRecipients(context.Background(), provider, "Alice@this.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 1 || got[0].Kind != DeliveryLocal || got[0].Address != "alice@this.com" {
+		t.Fatalf("unexpected deliveries: %+v", got)
+	}
+	if got[0].Domain == nil || got[0].Domain.Name != "this.com" {
+		t.Errorf("expected domain this.com, got %+v", got[0].Domain)
+	}
+}
+
+func TestResolveFinalRecipients_UnknownUser(t *testing.T) {
+	provider := &stubDomainProvider{domains: map[string]*Domain{
+		"this.com": forwardingDomain("this.com", nil, nil),
+	}}
+
+	_, err := ResolveFinalRecipients(context.Background(), provider, "nobody@this.com")
+	if !errors.Is(err, autherrors.ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestResolveFinalRecipients_CrossDomainAndRelay(t *testing.T) {
+	provider := &stubDomainProvider{domains: map[string]*Domain{
+		"this.com":  forwardingDomain("this.com", nil, map[string]string{"sales": "bob@other.com,ext@gmail.com"}),
+		"other.com": forwardingDomain("other.com", nil, map[string]string{"bob": "carol@other.com"}),
+	}}
+	provider.domains["other.com"].AuthAgent.(*mailAuthAgent).inner = &stubAuthAgent{users: map[string]bool{"carol": true}}
+
+	got, err := ResolveFinalRecipients(context.Background(), provider, "sales@this.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 deliveries, got %+v", got)
+	}
+	if got[0].Kind != DeliveryLocal || got[0].Address != "carol@other.com" {
+		t.Errorf("expected local delivery to carol@other.com, got %+v", got[0])
+	}
+	if len(got[0].Path) != 3 {
+		t.Errorf("expected 3-hop path, got %v", got[0].Path)
+	}
+	if got[1].Kind != DeliveryRelay || got[1].Address != "ext@gmail.com" || got[1].Domain != nil {
+		t.Errorf("expected relay to ext@gmail.com, got %+v", got[1])
+	}
+}
+
+func TestResolveFinalRecipients_SelfReferenceKeepsCopy(t *testing.T) {
+	provider := &stubDomainProvider{domains: map[string]*Domain{
+		"this.com": forwardingDomain("this.com", []string{"alice"}, map[string]string{"alice": "alice@this.com,alice@gmail.com"}),
+	}}
+
+	got, err := ResolveFinalRecipients(context.Background(), provider, "alice@this.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 2 || got[0].Kind != DeliveryLocal || got[1].Kind != DeliveryRelay {
+		t.Errorf("expected local copy plus relay, got %+v", got)
+	}
+}
+
+func TestResolveFinalRecipients_Loop(t *testing.T) {
+	provider := &stubDomainProvider{domains: map[string]*Domain{
+		"this.com": forwardingDomain("this.com", nil, map[string]string{
+			"a": "b@this.com",
+			"b": "a@this.com",
+		}),
+	}}
+
+	_, err := ResolveFinalRecipients(context.Background(), provider, "a@this.com")
+	if !errors.Is(err, autherrors.ErrForwardLoop) {
+		t.Errorf("expected ErrForwardLoop, got %v", err)
+	}
+}
+
+func TestResolveFinalRecipients_DepthExceeded(t *testing.T) {
+	rules := make(map[string]string)
+	for i := 0; i <= MaxForwardDepth; i++ {
+		rules[string(rune('a'+i))] = string(rune('a'+i+1)) + "@this.com"
+	}
+	provider := &stubDomainProvider{domains: map[string]*Domain{
+		"this.com": forwardingDomain("this.com", []string{"z"}, rules),
+	}}
+
+	_, err := ResolveFinalRecipients(context.Background(), provider, "a@this.com")
+	if !errors.Is(err, autherrors.ErrForwardDepthExceeded) {
+		t.Errorf("expected ErrForwardDepthExceeded, got %v", err)
+	}
+}
+
+func TestResolveFinalRecipients_Deduplicates(t *testing.T) {
+	provider := &stubDomainProvider{domains: map[string]*Domain{
+		"this.com": forwardingDomain("this.com", []string{"carol"}, map[string]string{
+			"team": "a@this.com,b@this.com",
+			"a":    "carol@this.com",
+			"b":    "carol@this.com",
+		}),
+	}}
+
+	got, err := ResolveFinalRecipients(context.Background(), provider, "team@this.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 1 || got[0].Address != "carol@this.com" {
+		t.Errorf("expected a single delivery to carol, got %+v", got)
+	}
+}
+
+func TestResolveFinalRecipients_FileInto(t *testing.T) {
+	provider := &stubDomainProvider{domains: map[string]*Domain{
+		"this.com": forwardingDomain("this.com", []string{"alice"}, map[string]string{
+			"alice": "=Archive, =Lists.Go, bob@that.org",
+		}),
+	}}
+
+	got, err := ResolveFinalRecipients(context.Background(), provider, "alice@this.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("deliveries = %+v, want two folders and a relay", got)
+	}
+	for i, folder := range []string{"Archive", "Lists.Go"} {
+		if got[i].Kind != DeliveryLocal || got[i].Address != "alice@this.com" || got[i].Folder != folder {
+			t.Errorf("delivery %d = %+v, want local alice@this.com in %s", i, got[i], folder)
+		}
+	}
+	if got[2].Kind != DeliveryRelay || got[2].Address != "bob@that.org" {
+		t.Errorf("delivery 2 = %+v, want relay to bob@that.org", got[2])
+	}
+}
+
+// finalRecorder is an inner store recording each delivery by recipientKey.
+type finalRecorder struct {
+	got *[]string
+}
+
+func (r finalRecorder) Deliver(ctx context.Context, env msgstore.Envelope, _ io.Reader) error {
+	*r.got = append(*r.got, recipientKey(env.Recipients[0], EnvelopeMetadataFromContext(ctx).Folder))
+	return nil
+}
+
+// relayRecorder is a Relayer recording each relayed target.
+type relayRecorder struct {
+	got *[]string
+}
+
+func (r relayRecorder) Relay(_ context.Context, target forwards.Target, _ msgstore.Envelope, _ io.Reader) error {
+	*r.got = append(*r.got, "relay "+target.Address)
+	return nil
+}
+
+func TestResolveFinalRecipients_MatchesDelivery(t *testing.T) {
+	provider := &stubDomainProvider{domains: map[string]*Domain{
+		"this.com": forwardingDomain("this.com", []string{"alice"}, map[string]string{
+			"alice": "=Archive, alice@this.com, bob@other.com, ext@gmail.com",
+			"team":  "bob@other.com,carol@other.com",
+			"a":     "b@other.com",
+		}),
+		"other.com": forwardingDomain("other.com", []string{"carol"}, map[string]string{
+			"bob": "carol@other.com",
+			"b":   "a@this.com",
+		}),
+	}}
+	var got []string
+	for _, d := range provider.domains {
+		d.DeliveryAgent = &MailDeliveryAgent{
+			inner:    finalRecorder{&got},
+			chain:    d.AuthAgent.(*mailAuthAgent).chain,
+			provider: provider,
+			relay:    relayRecorder{&got},
+		}
+	}
+
+	// Each address is delivered as it resolves: the same final recipients,
+	// or the same refusal.
+	for _, addr := range []string{"alice@this.com", "team@this.com", "carol@other.com", "a@this.com"} {
+		resolved, rerr := ResolveFinalRecipients(context.Background(), provider, addr)
+		var want []string
+		for _, r := range resolved {
+			if r.Kind == DeliveryRelay {
+				want = append(want, "relay "+r.Address)
+			} else {
+				want = append(want, recipientKey(r.Address, r.Folder))
+			}
+		}
+
+		got = nil
+		_, domainName := SplitUsername(addr)
+		env := msgstore.Envelope{Recipients: []string{addr}}
+		derr := provider.domains[domainName].DeliveryAgent.Deliver(context.Background(), env, bytes.NewReader([]byte("test")))
+
+		for _, sentinel := range []error{autherrors.ErrForwardLoop, autherrors.ErrForwardDepthExceeded, autherrors.ErrForwardFanOutExceeded} {
+			if errors.Is(rerr, sentinel) != errors.Is(derr, sentinel) {
+				t.Errorf("%s: resolve err = %v, deliver err = %v", addr, rerr, derr)
+			}
+		}
+		if rerr != nil {
+			continue
+		}
+		if derr != nil {
+			t.Errorf("%s: deliver err = %v", addr, derr)
+		}
+		slices.Sort(want)
+		slices.Sort(got)
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: delivered %q, resolved %q", addr, got, want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package domain
+
+import (
+	"log/slog"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/infodancer/auth"
+)
+
+// cachedDomain is a loaded Domain with its last-use time, for LRU eviction.
+type cachedDomain struct {
+	domain   *Domain
+	lastUsed atomic.Int64 // unix nanoseconds
+}
+
+// touch records a use of the cached domain.
+func (c *cachedDomain) touch() {
+	c.lastUsed.Store(time.Now().UnixNano())
+}
+
+// ResourceLimits caps the resources a FilesystemDomainProvider keeps loaded.
+// When a newly loaded domain pushes the provider over a cap, the least
+// recently used domains are closed and dropped from the cache until it is
+// back under. A dropped domain is reloaded on its next GetDomain call.
+// Zero values disable the corresponding cap.
+type ResourceLimits struct {
+	// MaxDomains is the maximum number of domains kept loaded.
+	MaxDomains int
+
+	// MaxCacheBytes caps the summed CacheBytes+MappedBytes of loaded domains.
+	MaxCacheBytes int64
+}
+
+// DomainResources is one row of FilesystemDomainProvider.ResourceReport.
+type DomainResources struct {
+	Name     string
+	Usage    auth.ResourceUsage
+	LastUsed time.Time
+}
+
+// WithResourceLimits sets caps on loaded domains (see ResourceLimits).
+// Evicted domains are closed; callers must not hold a *Domain across
+// requests when limits are in use.
+// Returns the provider to allow chaining.
+func (p *FilesystemDomainProvider) WithResourceLimits(limits ResourceLimits) *FilesystemDomainProvider {
+	p.limits = limits
+	return p
+}
+
+// ResourceReport returns the resource usage of every loaded domain, heaviest
+// first (by CacheBytes+MappedBytes), so operators can see which tenant is
+// consuming the most.
+func (p *FilesystemDomainProvider) ResourceReport() []DomainResources {
+	p.mu.RLock()
+	report := make([]DomainResources, 0, len(p.cache))
+	for name, cd := range p.cache {
+		report = append(report, DomainResources{
+			Name:     name,
+			Usage:    cd.domain.Resources(),
+			LastUsed: time.Unix(0, cd.lastUsed.Load()),
+		})
+	}
+	p.mu.RUnlock()
+
+	sort.Slice(report, func(i, j int) bool {
+		bi, bj := memoryBytes(report[i].Usage), memoryBytes(report[j].Usage)
+		if bi != bj {
+			return bi > bj
+		}
+		return report[i].Name < report[j].Name
+	})
+	return report
+}
+
+// memoryBytes is the figure compared against ResourceLimits.MaxCacheBytes.
+func memoryBytes(u auth.ResourceUsage) int64 {
+	return u.CacheBytes + u.MappedBytes
+}
+
+// evictLocked closes least-recently-used domains until the cache is within
+// limits. keep is never evicted (it is the domain just loaded).
+// Caller must hold p.mu for writing.
+func (p *FilesystemDomainProvider) evictLocked(keep string) {
+	if p.limits.MaxDomains <= 0 && p.limits.MaxCacheBytes <= 0 {
+		return
+	}
+
+	type candidate struct {
+		name     string
+		lastUsed int64
+		bytes    int64
+	}
+	var total int64
+	candidates := make([]candidate, 0, len(p.cache))
+	for name, cd := range p.cache {
+		b := memoryBytes(cd.domain.Resources())
+		total += b
+		if name != keep {
+			candidates = append(candidates, candidate{name, cd.lastUsed.Load(), b})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastUsed < candidates[j].lastUsed
+	})
+
+	for _, c := range candidates {
+		overCount := p.limits.MaxDomains > 0 && len(p.cache) > p.limits.MaxDomains
+		overBytes := p.limits.MaxCacheBytes > 0 && total > p.limits.MaxCacheBytes
+		if !overCount && !overBytes {
+			return
+		}
+		if err := p.cache[c.name].domain.Close(); err != nil {
+			p.logger.Warn("error closing evicted domain",
+				slog.String("domain", c.name),
+				slog.String("error", err.Error()))
+		}
+		delete(p.cache, c.name)
+		total -= c.bytes
+		p.logger.Info("evicted domain from cache",
+			slog.String("domain", c.name),
+			slog.Int64("bytes", c.bytes))
+	}
+}
@@ -0,0 +1,95 @@
+package domain
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestDomainsTree creates a domains directory with one subdirectory per
+// name, each holding a passwd file with the given lines, and returns a
+// provider using passwd/maildir defaults over it.
+func newTestDomainsTree(t *testing.T, passwdContent string, names ...string) (*FilesystemDomainProvider, string) {
+	t.Helper()
+	base := t.TempDir()
+	for _, name := range names {
+		dir := filepath.Join(base, name)
+		for _, sub := range []string{"keys", "users"} {
+			if err := os.MkdirAll(filepath.Join(dir, sub), 0o750); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(dir, "passwd"), []byte(passwdContent), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := NewFilesystemDomainProvider(base, nil).WithDefaults(DomainConfig{
+		Auth: DomainAuthConfig{
+			Type:              "passwd",
+			CredentialBackend: "passwd",
+			KeyBackend:        "keys",
+		},
+		MsgStore: DomainMsgStoreConfig{
+			Type:     "maildir",
+			BasePath: "users",
+		},
+	})
+	t.Cleanup(func() { _ = p.Close() })
+	return p, base
+}
+
+func TestResourceReport(t *testing.T) {
+	p, _ := newTestDomainsTree(t, "alice:HASH:alice\nbob:HASH:bob\n", "a.com", "b.com")
+
+	for _, name := range []string{"a.com", "b.com"} {
+		d := p.GetDomain(name)
+		if d == nil {
+			t.Fatalf("GetDomain(%s) returned nil", name)
+		}
+		// Force the lazy auth agent open so its cache is counted.
+		if _, err := d.AuthAgent.UserExists(context.Background(), "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report := p.ResourceReport()
+	if len(report) != 2 {
+		t.Fatalf("expected 2 report rows, got %d", len(report))
+	}
+	for _, r := range report {
+		if r.Usage.CacheBytes <= 0 {
+			t.Errorf("%s: expected non-zero CacheBytes, got %+v", r.Name, r.Usage)
+		}
+		if r.LastUsed.IsZero() {
+			t.Errorf("%s: expected LastUsed to be set", r.Name)
+		}
+	}
+}
+
+func TestResourceLimits_MaxDomainsEvictsLRU(t *testing.T) {
+	p, _ := newTestDomainsTree(t, "", "a.com", "b.com", "c.com")
+	p.WithResourceLimits(ResourceLimits{MaxDomains: 2})
+
+	p.GetDomain("a.com")
+	time.Sleep(time.Millisecond)
+	p.GetDomain("b.com")
+	time.Sleep(time.Millisecond)
+	p.GetDomain("a.com") // a.com is now more recent than b.com
+	time.Sleep(time.Millisecond)
+	p.GetDomain("c.com")
+
+	loaded := make(map[string]bool)
+	for _, r := range p.ResourceReport() {
+		loaded[r.Name] = true
+	}
+	if len(loaded) != 2 || !loaded["a.com"] || !loaded["c.com"] {
+		t.Errorf("expected a.com and c.com to remain loaded, got %v", loaded)
+	}
+
+	// An evicted domain reloads on demand.
+	if p.GetDomain("b.com") == nil {
+		t.Error("expected evicted domain to reload")
+	}
+}
@@ -0,0 +1,104 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/forwards"
+)
+
+// DefaultRoleAccounts are the RFC 2142 role localparts every domain is
+// expected to accept mail for when RolesConfig.Required is not set.
+var DefaultRoleAccounts = []string{"postmaster", "abuse"}
+
+// RolesConfig controls checking of RFC 2142 role addresses for a domain.
+//
+// A role is satisfied by a local account or by a forwarding rule at any
+// level of the forwarding chain. Checking at load requires opening the
+// domain's auth agent, so it only happens when Enforce or Operator is set;
+// if the auth backend cannot be read (e.g., a privilege-dropped process),
+// the check is skipped with a warning rather than failing the domain.
+type RolesConfig struct {
+	// Required lists the role localparts to check. Empty means
+	// DefaultRoleAccounts.
+	Required []string `toml:"required,omitempty"`
+
+	// Enforce refuses to load the domain while a required role is missing.
+	Enforce bool `toml:"enforce,omitempty"`
+
+	// Operator, when set, is the address missing roles are forwarded to.
+	// The forwards are synthesized at load and rank below every configured
+	// forwarding rule, so they never shadow a real account or rule.
+	Operator string `toml:"operator,omitempty"`
+}
+
+// required returns the role localparts to check, lowercased.
+func (c RolesConfig) required() []string {
+	roles := c.Required
+	if len(roles) == 0 {
+		roles = DefaultRoleAccounts
+	}
+	out := make([]string, len(roles))
+	for i, r := range roles {
+		out[i] = strings.ToLower(strings.TrimSpace(r))
+	}
+	return out
+}
+
+// MissingRoles returns the domain's required role localparts that have
+// neither an account nor a forward, in configured order.
+func (d *Domain) MissingRoles(ctx context.Context) ([]string, error) {
+	roles := d.RequiredRoles
+	if len(roles) == 0 {
+		roles = DefaultRoleAccounts
+	}
+	return missingRoles(ctx, d.AuthAgent, roles)
+}
+
+func missingRoles(ctx context.Context, agent MailAuthAgent, roles []string) ([]string, error) {
+	var missing []string
+	for _, role := range roles {
+		exists, err := agent.UserExists(ctx, role)
+		if err != nil {
+			return nil, fmt.Errorf("check role %s: %w", role, err)
+		}
+		if !exists {
+			missing = append(missing, role)
+		}
+	}
+	return missing, nil
+}
+
+// applyRoles checks the domain's role accounts at load. Missing roles are
+// forwarded to cfg.Operator when set; otherwise, with cfg.Enforce, a missing
+// role fails the load with ErrRoleAccountMissing.
+func applyRoles(ctx context.Context, cfg RolesConfig, agent MailAuthAgent, chain *forwardChain, logger *slog.Logger) error {
+	if !cfg.Enforce && cfg.Operator == "" {
+		return nil
+	}
+	missing, err := missingRoles(ctx, agent, cfg.required())
+	if err != nil {
+		logger.Warn("skipping role account check", slog.String("error", err.Error()))
+		return nil
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	if cfg.Operator != "" {
+		rules := make(map[string]string, len(missing))
+		for _, role := range missing {
+			rules[role] = cfg.Operator
+		}
+		chain.roleForwards = forwards.FromMap(rules)
+		logger.Info("forwarding missing role accounts to operator",
+			slog.String("roles", strings.Join(missing, ",")),
+			slog.String("operator", cfg.Operator))
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", autherrors.ErrRoleAccountMissing, strings.Join(missing, ", "))
+}
@@ -0,0 +1,66 @@
+package domain
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeDomainConfig(t *testing.T, base, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(base, name, "config.toml"), []byte(content), 0o640); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMissingRoles(t *testing.T) {
+	p, base := newTestDomainsTree(t, "postmaster:HASH:postmaster\n", "a.com")
+	writeDomainConfig(t, base, "a.com", "[roles]\nrequired = [\"postmaster\", \"abuse\", \"hostmaster\"]\n\n[forwards]\nhostmaster = \"ops@elsewhere.net\"\n")
+
+	d := p.GetDomain("a.com")
+	if d == nil {
+		t.Fatal("expected domain to load without enforcement")
+	}
+	missing, err := d.MissingRoles(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 1 || missing[0] != "abuse" {
+		t.Errorf("MissingRoles = %v, want [abuse]", missing)
+	}
+}
+
+func TestRoles_EnforceRefusesLoad(t *testing.T) {
+	p, base := newTestDomainsTree(t, "postmaster:HASH:postmaster\n", "strict.com", "ok.com")
+	writeDomainConfig(t, base, "strict.com", "[roles]\nenforce = true\n")
+	writeDomainConfig(t, base, "ok.com", "[roles]\nenforce = true\n\n[forwards]\nabuse = \"postmaster@ok.com\"\n")
+
+	if d := p.GetDomain("strict.com"); d != nil {
+		t.Error("expected strict.com to fail to load with abuse missing")
+	}
+	if d := p.GetDomain("ok.com"); d == nil {
+		t.Error("expected ok.com to load with all roles present")
+	}
+}
+
+func TestRoles_OperatorForwards(t *testing.T) {
+	p, base := newTestDomainsTree(t, "postmaster:HASH:postmaster\n", "a.com")
+	writeDomainConfig(t, base, "a.com", "[roles]\nenforce = true\noperator = \"noc@operator.net\"\n")
+
+	d := p.GetDomain("a.com")
+	if d == nil {
+		t.Fatal("expected domain to load with operator forwards")
+	}
+	targets, ok := d.AuthAgent.ResolveForward(context.Background(), "abuse")
+	if !ok || len(targets) != 1 || targets[0] != "noc@operator.net" {
+		t.Errorf("abuse forward = %v, %v", targets, ok)
+	}
+	// The existing account is not shadowed by a synthesized forward.
+	if _, ok := d.AuthAgent.ResolveForward(context.Background(), "postmaster"); ok {
+		t.Error("postmaster account should not be forwarded")
+	}
+	if missing, err := d.MissingRoles(context.Background()); err != nil || len(missing) != 0 {
+		t.Errorf("MissingRoles = %v, %v", missing, err)
+	}
+}
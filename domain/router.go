@@ -2,12 +2,17 @@ package domain
 
 import (
 	"context"
+	"errors"
 	"log/slog"
 	"strings"
 	"time"
 
 	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/address"
+	"github.com/infodancer/auth/atrest"
+	"github.com/infodancer/auth/audit"
 	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/tracing"
 )
 
 // AuthResult contains the authentication session and the resolved domain.
@@ -16,6 +21,31 @@ type AuthResult struct {
 	Session   *auth.AuthSession
 	Domain    *Domain
 	Extension string // subaddress extension from "user+ext@domain", empty if none
+
+	// Host is the subdomain part of the address when it was served by a
+	// parent domain with AcceptSubdomains, e.g. "host" for
+	// user@host.example.com. Empty otherwise.
+	Host string
+
+	// StepUpRequired is set when the anomaly scorer judged the login
+	// RiskStepUp: the caller must complete an additional verification step
+	// before granting access. Risk holds the assessment when scored.
+	StepUpRequired bool
+	Risk           *RiskAssessment
+
+	// Challenge is the step-up challenge issued for this login by the
+	// router's ChallengeProvider, nil when none was issued. Web flows
+	// present it and pass the response to VerifyChallenge.
+	Challenge *auth.Challenge
+
+	// MFARequired is set when the user has a TOTP second factor enrolled:
+	// the caller must pass the user's one-time code to VerifyTOTP before
+	// granting access.
+	MFARequired bool
+
+	// notify is the localpart to send a login notice for once the login
+	// completes, empty for none (see LoginNotifyConfig).
+	notify string
 }
 
 // AuthRouter routes authentication requests to domain-specific agents or a
@@ -35,6 +65,15 @@ type AuthRouter struct {
 	fallback    auth.AuthenticationAgent
 	rateLimiter *authRateLimiter
 	cleanupDone chan struct{} // closed to stop the cleanup goroutine
+	scorer      AnomalyScorer // nil disables anomaly scoring
+	policy      AnomalyPolicy
+	challenges  auth.ChallengeProvider // nil: auth.NoopChallengeProvider
+	auditor     audit.Auditor          // nil disables auditing
+	middleware  []Middleware
+	login       AuthFunc          // middleware around authenticateCredentials; nil: none
+	realms      map[string]string // realm → domain name, see WithRealms
+
+	impersonationKey *atrest.Key // nil disables impersonation tokens
 }
 
 // NewAuthRouter creates a new AuthRouter with no rate limiting.
@@ -73,24 +112,20 @@ func (r *AuthRouter) cleanupLoop() {
 }
 
 // ParseLocalPart splits a local part on the first '+' into base and extension.
+// It is address.SplitExtension:
 // "user+folder" → ("user", "folder")
 // "user"        → ("user", "")
 // "user+"       → ("user", "")
 // "user+a+b"   → ("user", "a+b")
 func ParseLocalPart(localPart string) (base, extension string) {
-	if b, ext, ok := strings.Cut(localPart, "+"); ok {
-		return b, ext
-	}
-	return localPart, ""
+	return address.SplitExtension(localPart)
 }
 
 // SplitUsername splits "user@domain" into local part and domain.
 // Returns the full username and empty domain if no @ is present.
+// It is address.Split.
 func SplitUsername(username string) (localPart, domainName string) {
-	if idx := strings.LastIndex(username, "@"); idx >= 0 {
-		return username[:idx], username[idx+1:]
-	}
-	return username, ""
+	return address.Split(username)
 }
 
 // Authenticate validates credentials, routing to domain-specific or fallback
@@ -100,6 +135,14 @@ func (r *AuthRouter) Authenticate(ctx context.Context, username, password string
 	if err != nil {
 		return nil, err
 	}
+	if result.MFARequired {
+		result.Session.Clear()
+		return nil, autherrors.ErrMFARequired
+	}
+	if result.StepUpRequired {
+		result.Session.Clear()
+		return nil, autherrors.ErrStepUpRequired
+	}
 	return result.Session, nil
 }
 
@@ -110,7 +153,69 @@ func (r *AuthRouter) Authenticate(ctx context.Context, username, password string
 // Rate limiting: if WithRateLimit has been called, failed attempts are tracked
 // by client IP (from context, see WithClientIP), username, and (IP, username)
 // pair. Exceeding any threshold returns errors.ErrRateLimited.
+//
+// TLS policy: logins for users whose domain or metadata requires TLS (see
+// Domain.RequiresTLS) fail with errors.ErrTLSRequired unless the context
+// carries ConnInfo with TLS set (see WithConnInfo).
+//
+// Network policy: logins for users with allowed_networks metadata (see
+// Domain.AllowsAddress) fail with errors.ErrAccessDenied unless the client
+// IP is inside one of them.
+//
+// Anomaly scoring: if WithAnomalyScorer has been called, logins that pass the
+// credential check are scored; see WithAnomalyScorer for the outcomes.
+//
+// Second factor: for users of an auth.MFAAgent with TOTP enrolled the
+// result has MFARequired set (Authenticate fails with errors.ErrMFARequired
+// instead); see VerifyTOTP.
+//
+// Service entitlements: users whose backend lists the services they may
+// use (see auth.User.Services) fail with errors.ErrServiceDenied when the
+// context's protocol (see WithProtocol) is not among them.
+//
+// Backend outages: for domains with degradation mode on (see
+// DegradedConfig), logins the backend could not check fail with
+// errors.ErrBackendUnavailable and count against no limits.
 func (r *AuthRouter) AuthenticateWithDomain(ctx context.Context, username, password string) (*AuthResult, error) {
+	return r.AuthenticateCredentials(ctx, auth.Credentials{Username: username, Password: password})
+}
+
+// AuthenticateCredentials is AuthenticateWithDomain for credentials in the
+// form the client sent them, such as a SASL mechanism's response with
+// channel binding data (see auth.Credentials). Routing and policies are
+// those of AuthenticateWithDomain, keyed by creds.Username qualified with
+// the connection's realm (see WithRealms).
+//
+// Plaintext credentials work with every agent. Other mechanisms need a
+// domain agent implementing auth.CredentialsAuthenticator, or for
+// challenge-response credentials auth.ChallengeResponseVerifier, and fail
+// with errors.ErrMechanismUnsupported otherwise. An AuthzID other than the
+// username fails with errors.ErrAuthorizationDenied. Neither refusal
+// counts against the rate limits.
+func (r *AuthRouter) AuthenticateCredentials(ctx context.Context, creds auth.Credentials) (*AuthResult, error) {
+	start := time.Now()
+	creds.Username = r.qualify(ctx, creds.Username)
+	if creds.AuthzID != "" {
+		creds.AuthzID = r.qualify(ctx, creds.AuthzID)
+	}
+	ctx, span := startLoginSpan(ctx, creds.Mechanism)
+	login := r.login
+	if login == nil {
+		login = r.authenticateCredentials
+	}
+	result, err := login(ctx, creds)
+	endLoginSpan(span, creds.Username, result, err)
+	r.auditLogin(ctx, start, creds.Username, creds.Mechanism, result, err)
+	return result, err
+}
+
+// authenticateCredentials is AuthenticateCredentials without auditing and
+// middleware.
+func (r *AuthRouter) authenticateCredentials(ctx context.Context, creds auth.Credentials) (*AuthResult, error) {
+	username := creds.Username
+	if creds.AuthzID != "" && creds.AuthzID != username {
+		return nil, autherrors.ErrAuthorizationDenied
+	}
 	clientIP := clientIPFromContext(ctx)
 
 	// Check rate limits before attempting authentication.
@@ -119,37 +224,135 @@ func (r *AuthRouter) AuthenticateWithDomain(ctx context.Context, username, passw
 		return nil, autherrors.ErrRateLimited
 	}
 
-	result, err := r.authenticateInternal(ctx, username, password)
+	result, err := r.authenticateInternal(ctx, creds)
 	if err != nil {
-		if r.rateLimiter != nil {
+		if r.rateLimiter != nil && isCredentialFailure(err) {
 			r.rateLimiter.recordFailure(clientIP, username)
 		}
 		return nil, err
 	}
 
+	if r.scorer != nil {
+		decision, risk := r.assessLogin(ctx, username, result)
+		result.Risk = &risk
+		switch decision {
+		case RiskDeny:
+			slog.Warn("login denied by anomaly policy",
+				"username", username, "ip", clientIP, "score", risk.Score, "reason", risk.Reason)
+			result.Session.Clear()
+			return nil, autherrors.ErrLoginDenied
+		case RiskStepUp:
+			result.StepUpRequired = true
+			result.Challenge = r.issueChallenge(ctx, username, risk.Reason)
+		}
+	}
+
 	// Clear the (IP, username) pair on success.
 	if r.rateLimiter != nil {
 		r.rateLimiter.recordSuccess(clientIP, username)
 	}
+	result.notifyLogin(ctx)
 	return result, nil
 }
 
+// isCredentialFailure reports whether a login failing with err counts
+// against the rate limits and the tarpit. A plaintext-channel, network or
+// mechanism refusal or an unreachable backend says nothing about the
+// credentials, and a disabled account was given the right ones.
+func isCredentialFailure(err error) bool {
+	return !errors.Is(err, autherrors.ErrTLSRequired) &&
+		!errors.Is(err, autherrors.ErrAccessDenied) &&
+		!errors.Is(err, autherrors.ErrMechanismUnsupported) &&
+		!errors.Is(err, autherrors.ErrBackendUnavailable) &&
+		!errors.Is(err, autherrors.ErrAccountDisabled)
+}
+
+// startLoginSpan starts the span of a login with mechanism.
+func startLoginSpan(ctx context.Context, mechanism string) (context.Context, tracing.Span) {
+	attrs := []tracing.Attr{tracing.String(tracing.AttrProtocol, protocolFromContext(ctx))}
+	if mechanism != "" {
+		attrs = append(attrs, tracing.String(tracing.AttrMechanism, mechanism))
+	}
+	return tracing.Start(ctx, "auth.Authenticate", attrs...)
+}
+
+// endLoginSpan ends the span of username's login with its outcome. The
+// domain and backend are those that served the login, if it got that far.
+func endLoginSpan(span tracing.Span, username string, result *AuthResult, err error) {
+	_, domainName := SplitUsername(username)
+	domainName, backend := strings.ToLower(domainName), "fallback"
+	if result != nil && result.Domain != nil {
+		domainName, backend = result.Domain.Name, result.Domain.backend
+	}
+	span.SetAttributes(tracing.String(tracing.AttrDomain, domainName))
+	if result != nil {
+		span.SetAttributes(tracing.String(tracing.AttrBackend, backend))
+	}
+	tracing.End(span, err)
+}
+
 // authenticateInternal performs the actual credential check without rate limiting.
-func (r *AuthRouter) authenticateInternal(ctx context.Context, username, password string) (*AuthResult, error) {
+func (r *AuthRouter) authenticateInternal(ctx context.Context, creds auth.Credentials) (*AuthResult, error) {
+	username := creds.Username
 	localPart, domainName := SplitUsername(username)
 	base, extension := ParseLocalPart(localPart)
 
 	if r.provider != nil && domainName != "" {
-		d := r.provider.GetDomain(domainName)
+		d, host := ResolveDomain(r.provider, domainName)
 		if d != nil {
-			session, err := d.AuthAgent.Authenticate(ctx, base, password)
+			// Canonicalize so the mailbox and login history use one
+			// spelling; the domain's auth agent normalizes as well.
+			if canonical, ok := d.NormalizeLocalpart(base); ok {
+				base = canonical
+			}
+			if err := d.checkFrozen(); err != nil {
+				return nil, err
+			}
+			// Refuse before verifying a password sent in the clear, or
+			// from a network the user may not log in from.
+			if err := d.checkTLS(ctx, base); err != nil {
+				return nil, err
+			}
+			if err := d.checkNetwork(ctx, base); err != nil {
+				return nil, err
+			}
+			creds.Username = base
+			session, err := auth.VerifyCredentials(ctx, d.AuthAgent, creds)
 			if err != nil {
+				// Unknown users are not recorded, keeping history bounded,
+				// nor are logins the backend could not check.
+				if !errors.Is(err, autherrors.ErrUserNotFound) && !errors.Is(err, autherrors.ErrBackendUnavailable) {
+					d.recordLogin(ctx, base, auth.LoginFailure)
+				}
 				return nil, err
 			}
 			if session.User != nil {
-				session.User.Mailbox = base + "@" + domainName
+				if err := checkService(ctx, base, session.User.Services); err != nil {
+					session.Clear()
+					return nil, err
+				}
+			}
+			newLocation := d.newLoginLocation(ctx, base)
+			d.recordLogin(ctx, base, auth.LoginSuccess)
+			if session.User != nil {
+				if session.User.Mailbox, err = d.Mailbox(base, session.User); err != nil {
+					session.Clear()
+					return nil, err
+				}
+				if session.User.Gid == 0 {
+					session.User.Gid = d.Gid
+				}
+			}
+			mfa, err := mfaRequired(ctx, d.AuthAgent, base, session)
+			if err != nil {
+				session.Clear()
+				return nil, err
 			}
-			return &AuthResult{Session: session, Domain: d, Extension: extension}, nil
+			result := &AuthResult{Session: session, Domain: d, Extension: extension, Host: host, MFARequired: mfa}
+			if newLocation {
+				result.notify = base
+			}
+			return result, nil
 		}
 	}
 
@@ -162,11 +365,23 @@ func (r *AuthRouter) authenticateInternal(ctx context.Context, username, passwor
 				fallbackUser = base
 			}
 		}
-		session, err := r.fallback.Authenticate(ctx, fallbackUser, password)
+		creds.Username = fallbackUser
+		session, err := auth.VerifyCredentials(ctx, r.fallback, creds)
 		if err != nil {
 			return nil, err
 		}
-		return &AuthResult{Session: session, Domain: nil, Extension: extension}, nil
+		if session.User != nil {
+			if err := checkService(ctx, fallbackUser, session.User.Services); err != nil {
+				session.Clear()
+				return nil, err
+			}
+		}
+		mfa, err := mfaRequired(ctx, r.fallback, fallbackUser, session)
+		if err != nil {
+			session.Clear()
+			return nil, err
+		}
+		return &AuthResult{Session: session, Domain: nil, Extension: extension, MFARequired: mfa}, nil
 	}
 
 	return nil, autherrors.ErrAuthFailed
@@ -175,12 +390,25 @@ func (r *AuthRouter) authenticateInternal(ctx context.Context, username, passwor
 // UserExists checks if a user exists, routing to domain-specific or fallback
 // auth agents as appropriate. Implements auth.AuthenticationAgent.
 func (r *AuthRouter) UserExists(ctx context.Context, username string) (bool, error) {
+	start := time.Now()
+	username = r.qualify(ctx, username)
+	_, domainName := SplitUsername(username)
+	ctx, span := tracing.Start(ctx, "auth.UserExists",
+		tracing.String(tracing.AttrDomain, strings.ToLower(domainName)))
+	exists, err := r.userExists(ctx, username)
+	span.SetAttributes(tracing.Bool(tracing.AttrExists, exists))
+	tracing.End(span, err)
+	r.auditLookup(ctx, start, username, exists, err)
+	return exists, err
+}
+
+// userExists is UserExists without auditing.
+func (r *AuthRouter) userExists(ctx context.Context, username string) (bool, error) {
 	localPart, domainName := SplitUsername(username)
 	base, extension := ParseLocalPart(localPart)
 
 	if r.provider != nil && domainName != "" {
-		d := r.provider.GetDomain(domainName)
-		if d != nil {
+		if d, _ := ResolveDomain(r.provider, domainName); d != nil {
 			return d.AuthAgent.UserExists(ctx, base)
 		}
 	}
@@ -201,6 +429,65 @@ func (r *AuthRouter) UserExists(ctx context.Context, username string) (bool, err
 	return false, nil
 }
 
+// LookupAddress reports how address is handled, routing like UserExists.
+// Subaddress extensions are ignored. Domain agents that implement
+// auth.AddressLookup answer directly; for other agents the result is
+// derived from UserExists and ResolveForward, and the fallback agent can
+// only report accounts. Implements auth.AddressLookup.
+func (r *AuthRouter) LookupAddress(ctx context.Context, address string) (auth.AddressInfo, error) {
+	address = r.qualify(ctx, address)
+	localPart, domainName := SplitUsername(address)
+	base, extension := ParseLocalPart(localPart)
+
+	if r.provider != nil && domainName != "" {
+		if d, _ := ResolveDomain(r.provider, domainName); d != nil {
+			return lookupDomainAddress(ctx, d.AuthAgent, base)
+		}
+	}
+
+	if r.fallback != nil {
+		fallbackUser := address
+		if extension != "" {
+			if domainName != "" {
+				fallbackUser = base + "@" + domainName
+			} else {
+				fallbackUser = base
+			}
+		}
+		if al, ok := auth.AsAddressLookup(r.fallback); ok {
+			return al.LookupAddress(ctx, fallbackUser)
+		}
+		exists, err := r.fallback.UserExists(ctx, fallbackUser)
+		if err != nil {
+			return auth.AddressInfo{}, err
+		}
+		return auth.AddressInfo{CanAuthenticate: exists, AcceptsMail: exists}, nil
+	}
+
+	return auth.AddressInfo{}, nil
+}
+
+// lookupDomainAddress answers LookupAddress for localpart within a domain.
+func lookupDomainAddress(ctx context.Context, agent MailAuthAgent, localpart string) (auth.AddressInfo, error) {
+	if al, ok := auth.AsAddressLookup(agent); ok {
+		return al.LookupAddress(ctx, localpart)
+	}
+	// UserExists on a MailAuthAgent includes forward-only addresses, so a
+	// forwarded address cannot be told apart from an account here; it is
+	// reported as forward-only.
+	exists, err := agent.UserExists(ctx, localpart)
+	if err != nil {
+		return auth.AddressInfo{}, err
+	}
+	_, forwarded := agent.ResolveForward(ctx, localpart)
+	return auth.AddressInfo{
+		CanAuthenticate: exists && !forwarded,
+		AcceptsMail:     exists || forwarded,
+		IsForwardOnly:   forwarded,
+		IsAlias:         forwarded,
+	}, nil
+}
+
 // Close stops the rate limit cleanup goroutine (if running). AuthRouter does
 // not own the domain provider or fallback agent; the caller manages their
 // lifecycles independently.
@@ -2,11 +2,15 @@ package domain
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"testing"
 
 	"github.com/infodancer/auth"
 	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/forwards"
+	"github.com/infodancer/auth/passwd"
+	"github.com/infodancer/auth/tracing"
 )
 
 // mockAuthAgent implements auth.AuthenticationAgent for testing.
@@ -549,5 +553,209 @@ func TestAuthRouterMailbox_AddressContract(t *testing.T) {
 	})
 }
 
+func TestAuthRouter_DomainGidFallback(t *testing.T) {
+	domainAgent := &mockAuthAgent{
+		authenticateFn: func(_ context.Context, username, password string) (*auth.AuthSession, error) {
+			switch {
+			case username == "alice" && password == "secret":
+				return &auth.AuthSession{User: &auth.User{Username: "alice", Uid: 1001}}, nil
+			case username == "bob" && password == "secret":
+				return &auth.AuthSession{User: &auth.User{Username: "bob", Uid: 1002, Gid: 200}}, nil
+			}
+			return nil, autherrors.ErrAuthFailed
+		},
+	}
+	provider := &mockDomainProvider{
+		domains: map[string]*Domain{
+			"example.com": {Name: "example.com", AuthAgent: domainAgent, Gid: 100},
+		},
+	}
+	router := NewAuthRouter(provider, nil)
+
+	for _, tc := range []struct {
+		user     string
+		uid, gid uint32
+	}{
+		{"alice@example.com", 1001, 100},
+		{"bob@example.com", 1002, 200},
+	} {
+		result, err := router.AuthenticateWithDomain(context.Background(), tc.user, "secret")
+		if err != nil {
+			t.Fatalf("%s: %v", tc.user, err)
+		}
+		if u := result.Session.User; u.Uid != tc.uid || u.Gid != tc.gid {
+			t.Errorf("%s: uid, gid = %d, %d; want %d, %d", tc.user, u.Uid, u.Gid, tc.uid, tc.gid)
+		}
+	}
+}
+
+func TestAuthRouter_ServiceEntitlements(t *testing.T) {
+	domainAgent := &mockAuthAgent{
+		authenticateFn: func(_ context.Context, username, password string) (*auth.AuthSession, error) {
+			if password != "secret" {
+				return nil, autherrors.ErrAuthFailed
+			}
+			user := &auth.User{Username: username}
+			if username == "sender" {
+				user.Services = auth.ServiceSMTP
+			}
+			return &auth.AuthSession{User: user}, nil
+		},
+	}
+	provider := &mockDomainProvider{
+		domains: map[string]*Domain{
+			"example.com": {Name: "example.com", AuthAgent: domainAgent},
+		},
+	}
+	router := NewAuthRouter(provider, nil)
+
+	for _, tc := range []struct {
+		user, protocol string
+		wantErr        error
+	}{
+		{"sender@example.com", "submission", nil},
+		{"sender@example.com", "imap", autherrors.ErrServiceDenied},
+		{"sender@example.com", "", nil},
+		{"alice@example.com", "imap", nil},
+	} {
+		ctx := WithProtocol(context.Background(), tc.protocol)
+		_, err := router.AuthenticateWithDomain(ctx, tc.user, "secret")
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("%s over %q: err = %v, want %v", tc.user, tc.protocol, err, tc.wantErr)
+		}
+		if tc.wantErr != nil && !errors.Is(err, autherrors.ErrAccountDisabled) {
+			t.Errorf("%s over %q: err = %v does not wrap ErrAccountDisabled", tc.user, tc.protocol, err)
+		}
+	}
+}
+
 // Verify AuthRouter implements auth.AuthenticationAgent at compile time.
 var _ auth.AuthenticationAgent = (*AuthRouter)(nil)
+
+func TestAuthRouterLookupAddress(t *testing.T) {
+	plain := &mailAuthAgent{
+		inner: &stubAuthAgent{users: map[string]bool{"alice": true, "bob": true}},
+		chain: &forwardChain{
+			domainForwards: forwards.FromMap(map[string]string{
+				"info": "alice@example.com",
+				"bob":  "bob@elsewhere.net",
+			}),
+		},
+	}
+	catchall := &mailAuthAgent{
+		inner: &stubAuthAgent{},
+		chain: &forwardChain{domainForwards: forwards.FromMap(map[string]string{"*": "alice@example.com"})},
+	}
+	fallback := &mockAuthAgent{
+		userExistsFn: func(_ context.Context, username string) (bool, error) {
+			return username == "root", nil
+		},
+	}
+	provider := &mockDomainProvider{domains: map[string]*Domain{
+		"example.com": {Name: "example.com", AuthAgent: plain},
+		"catch.com":   {Name: "catch.com", AuthAgent: catchall},
+	}}
+	router := NewAuthRouter(provider, fallback)
+
+	tests := []struct {
+		address string
+		want    auth.AddressInfo
+	}{
+		{"alice@example.com", auth.AddressInfo{CanAuthenticate: true, AcceptsMail: true}},
+		{"alice+lists@example.com", auth.AddressInfo{CanAuthenticate: true, AcceptsMail: true}},
+		{"info@example.com", auth.AddressInfo{AcceptsMail: true, IsForwardOnly: true, IsAlias: true}},
+		{"bob@example.com", auth.AddressInfo{CanAuthenticate: true, AcceptsMail: true, IsAlias: true}},
+		{"nobody@example.com", auth.AddressInfo{}},
+		{"anyone@catch.com", auth.AddressInfo{AcceptsMail: true, IsForwardOnly: true, CatchallMatched: true}},
+		{"root", auth.AddressInfo{CanAuthenticate: true, AcceptsMail: true}},
+		{"someone@unknown.org", auth.AddressInfo{}},
+	}
+	for _, tt := range tests {
+		got, err := router.LookupAddress(context.Background(), tt.address)
+		if err != nil {
+			t.Errorf("LookupAddress(%q): %v", tt.address, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("LookupAddress(%q) = %+v, want %+v", tt.address, got, tt.want)
+		}
+	}
+}
+
+// spanRecorder is a tracing.Tracer keeping the spans it starts, with the
+// name of each span's parent.
+type spanRecorder struct {
+	spans []*recordedSpan
+}
+
+type spanKey struct{}
+
+type recordedSpan struct {
+	name, parent string
+	attrs        map[string]any
+	err          error
+}
+
+func (s *recordedSpan) SetAttributes(attrs ...tracing.Attr) {
+	for _, a := range attrs {
+		s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *recordedSpan) RecordError(err error) { s.err = err }
+func (s *recordedSpan) End()                  {}
+
+func (r *spanRecorder) Start(ctx context.Context, name string, attrs ...tracing.Attr) (context.Context, tracing.Span) {
+	s := &recordedSpan{name: name, attrs: map[string]any{}}
+	if parent, ok := ctx.Value(spanKey{}).(*recordedSpan); ok {
+		s.parent = parent.name
+	}
+	s.SetAttributes(attrs...)
+	r.spans = append(r.spans, s)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func TestAuthRouter_Tracing(t *testing.T) {
+	hash, err := passwd.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := newTestDomainsTree(t, "alice:"+hash+":alice\n", "example.com")
+	rec := &spanRecorder{}
+	tracing.SetTracer(rec)
+	defer tracing.SetTracer(nil)
+
+	ctx := WithProtocol(context.Background(), "imap")
+	r := NewAuthRouter(p, nil)
+	if _, err := r.Authenticate(ctx, "alice@example.com", "secret"); err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	_, _ = r.Authenticate(ctx, "alice@example.com", "wrong")
+
+	byName := map[string][]*recordedSpan{}
+	for _, s := range rec.spans {
+		byName[s.name] = append(byName[s.name], s)
+	}
+	if n := len(byName["auth.LoadDomain"]); n != 1 {
+		t.Errorf("%d auth.LoadDomain spans, want 1", n)
+	}
+	if s := byName["auth.OpenAgent"]; len(s) != 1 || s[0].attrs[tracing.AttrBackend] != "passwd" {
+		t.Errorf("auth.OpenAgent spans = %+v", s)
+	}
+	logins := byName["auth.Authenticate"]
+	if len(logins) != 2 {
+		t.Fatalf("auth.Authenticate spans = %+v", logins)
+	}
+	ok, failed := logins[0], logins[1]
+	if ok.attrs[tracing.AttrResult] != tracing.ResultSuccess || ok.attrs[tracing.AttrDomain] != "example.com" ||
+		ok.attrs[tracing.AttrBackend] != "passwd" || ok.attrs[tracing.AttrProtocol] != "imap" {
+		t.Errorf("successful login span = %+v", ok)
+	}
+	if failed.attrs[tracing.AttrResult] != tracing.ResultFailure || failed.err == nil {
+		t.Errorf("failed login span = %+v", failed)
+	}
+	backend := byName["passwd.Authenticate"]
+	if len(backend) != 2 || backend[0].parent != "auth.Authenticate" {
+		t.Errorf("passwd.Authenticate spans = %+v", backend)
+	}
+}
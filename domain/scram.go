@@ -0,0 +1,56 @@
+package domain
+
+import (
+	"context"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// Compile-time check: AuthRouter must satisfy SCRAMCredentialProvider.
+var _ auth.SCRAMCredentialProvider = (*AuthRouter)(nil)
+
+// GetSCRAMCredentials returns username's stored SCRAM-SHA-256 verifier,
+// routing like Authenticate: a qualified username goes to its domain's
+// agent by its canonical localpart, anything else to the fallback agent.
+// It is the lookup of a sasl/scram Server. Unknown users fail with
+// errors.ErrUserNotFound, users whose agent stores no verifier for them
+// with errors.ErrMechanismUnsupported, and rate-limited clients with
+// errors.ErrRateLimited. Implements auth.SCRAMCredentialProvider.
+func (r *AuthRouter) GetSCRAMCredentials(ctx context.Context, username string) (*auth.SCRAMCredentials, error) {
+	username = r.qualify(ctx, username)
+	if r.rateLimiter != nil && r.rateLimiter.isLimited(clientIPFromContext(ctx), username) {
+		return nil, autherrors.ErrRateLimited
+	}
+	localPart, domainName := SplitUsername(username)
+	base, extension := ParseLocalPart(localPart)
+
+	if r.provider != nil && domainName != "" {
+		if d, _ := ResolveDomain(r.provider, domainName); d != nil {
+			canonical, ok := d.NormalizeLocalpart(base)
+			if !ok {
+				return nil, autherrors.ErrUserNotFound
+			}
+			if sp, ok := auth.AsSCRAMCredentialProvider(d.AuthAgent); ok {
+				return sp.GetSCRAMCredentials(ctx, canonical)
+			}
+			return nil, autherrors.ErrMechanismUnsupported
+		}
+	}
+
+	if r.fallback != nil {
+		fallbackUser := username
+		if extension != "" {
+			if domainName != "" {
+				fallbackUser = base + "@" + domainName
+			} else {
+				fallbackUser = base
+			}
+		}
+		if sp, ok := auth.AsSCRAMCredentialProvider(r.fallback); ok {
+			return sp.GetSCRAMCredentials(ctx, fallbackUser)
+		}
+		return nil, autherrors.ErrMechanismUnsupported
+	}
+	return nil, autherrors.ErrUserNotFound
+}
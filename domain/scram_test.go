@@ -0,0 +1,55 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/passwd"
+	"github.com/infodancer/auth/sasl/scram"
+)
+
+func TestAuthRouter_GetSCRAMCredentials(t *testing.T) {
+	hash, err := passwd.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, base := newTestDomainsTree(t, "jdoe:"+hash+":jdoe\nbob:"+hash+":bob\n", "example.com")
+	writeDomainConfig(t, base, "example.com", "[normalize]\nstrip_dots = true\ncase_insensitive = true\n")
+	if err := passwd.SetSCRAMCredentials(filepath.Join(base, "example.com", "passwd"), "jdoe", "secret", 0); err != nil {
+		t.Fatal(err)
+	}
+	r := NewAuthRouter(p, nil)
+	defer func() { _ = r.Close() }()
+	ctx := context.Background()
+
+	c, err := r.GetSCRAMCredentials(ctx, "J.Doe+lists@example.com")
+	if err != nil {
+		t.Fatalf("GetSCRAMCredentials: %v", err)
+	}
+	if !scram.Verify(*c, "secret") {
+		t.Error("verifier does not match the password")
+	}
+
+	for _, tc := range []struct {
+		username string
+		want     error
+	}{
+		{"bob@example.com", autherrors.ErrMechanismUnsupported},
+		{"carol@example.com", autherrors.ErrUserNotFound},
+		{"jdoe@other.example", autherrors.ErrUserNotFound},
+		{"jdoe", autherrors.ErrUserNotFound},
+	} {
+		if _, err := r.GetSCRAMCredentials(ctx, tc.username); !errors.Is(err, tc.want) {
+			t.Errorf("GetSCRAMCredentials(%s) err = %v, want %v", tc.username, err, tc.want)
+		}
+	}
+
+	// A fallback agent without verifiers cannot offer SCRAM.
+	fallback := NewAuthRouter(nil, &stubAuthAgent{users: map[string]bool{"jdoe": true}})
+	if _, err := fallback.GetSCRAMCredentials(ctx, "jdoe"); !errors.Is(err, autherrors.ErrMechanismUnsupported) {
+		t.Errorf("fallback err = %v, want ErrMechanismUnsupported", err)
+	}
+}
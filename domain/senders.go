@@ -0,0 +1,95 @@
+package domain
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/infodancer/auth"
+)
+
+// Compile-time check: AuthRouter answers sender authorization queries.
+var _ auth.SenderAuthorizer = (*AuthRouter)(nil)
+
+// MaySendAs reports whether the authenticated user may use address as MAIL
+// FROM. Implements auth.SenderAuthorizer. Subaddress extensions are ignored
+// on both sides, comparison is case-insensitive, and each served domain's
+// localpart normalization (see NormalizeConfig) applies. A user may send as:
+//
+//   - their own address (user@domain, or the bare username for fallback users)
+//   - any address whose own forwarding rule delivers to them, i.e. an alias
+//     they own, on any domain served by the provider, subdomains accepted
+//     through AcceptSubdomains included; a catchall rule names no address,
+//     so its targets may not send as the addresses it matches
+//   - any address matching a pattern in their domain's [senders] entry for
+//     their localpart, e.g. postmaster = ["*@example.com"]
+//
+// The null sender ("") is always allowed for bounces.
+func (r *AuthRouter) MaySendAs(ctx context.Context, username, address string) (bool, error) {
+	if address == "" {
+		return true, nil
+	}
+	user := r.normalizedAddress(username)
+	addr := r.normalizedAddress(address)
+	if user == addr {
+		return true, nil
+	}
+
+	userLocal, userDomain := SplitUsername(user)
+	addrLocal, addrDomain := SplitUsername(addr)
+	if r.provider == nil || userDomain == "" || addrDomain == "" {
+		return false, nil
+	}
+
+	if d, _ := ResolveDomain(r.provider, userDomain); d != nil {
+		for _, pattern := range d.Senders[userLocal] {
+			if ok, _ := path.Match(strings.ToLower(pattern), addr); ok {
+				return true, nil
+			}
+		}
+	}
+
+	d, _ := ResolveDomain(r.provider, addrDomain)
+	if d == nil {
+		return false, nil
+	}
+	info, err := lookupDomainAddress(ctx, d.AuthAgent, addrLocal)
+	if err != nil || !info.IsAlias {
+		return false, err
+	}
+	targets, _ := d.AuthAgent.ResolveForward(ctx, addrLocal)
+	for _, t := range targets {
+		if r.normalizedAddress(t) == user {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// canonicalAddress lowercases address and drops any subaddress extension
+// from its local part.
+func canonicalAddress(address string) string {
+	local, domainName := SplitUsername(strings.ToLower(strings.TrimSpace(address)))
+	base, _ := ParseLocalPart(local)
+	if domainName == "" {
+		return base
+	}
+	return base + "@" + domainName
+}
+
+// normalizedAddress is canonicalAddress followed by the localpart
+// normalization of the domain serving the address, if any (see
+// ResolveDomain).
+func (r *AuthRouter) normalizedAddress(address string) string {
+	addr := canonicalAddress(address)
+	local, domainName := SplitUsername(addr)
+	if r.provider == nil || domainName == "" {
+		return addr
+	}
+	if d, _ := ResolveDomain(r.provider, domainName); d != nil {
+		if canonical, ok := d.NormalizeLocalpart(local); ok {
+			return canonical + "@" + domainName
+		}
+	}
+	return addr
+}
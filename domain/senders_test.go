@@ -0,0 +1,72 @@
+package domain
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAuthRouter_MaySendAs(t *testing.T) {
+	p, base := newTestDomainsTree(t, "alice:HASH:alice\nbob:HASH:bob\npostmaster:HASH:postmaster\n", "example.com", "example.org", "example.net")
+	writeDomainConfig(t, base, "example.com", `
+[forwards]
+sales = "alice@example.com, bob@example.com"
+
+[senders]
+postmaster = ["*@example.com"]
+bob = ["news@example.org"]
+`)
+	writeDomainConfig(t, base, "example.org", `
+[forwards]
+info = "Alice+inbox@Example.com"
+`)
+	writeDomainConfig(t, base, "example.net", `
+accept_subdomains = true
+
+[forwards]
+help = "bob@example.com"
+"*" = "alice@example.com"
+`)
+
+	r := NewAuthRouter(p, nil)
+	tests := []struct {
+		user, from string
+		want       bool
+	}{
+		{"alice@example.com", "alice@example.com", true},
+		{"alice@example.com", "Alice+lists@EXAMPLE.com", true},
+		{"alice@example.com", "sales@example.com", true},
+		{"alice@example.com", "info@example.org", true},
+		{"alice@example.com", "bob@example.com", false},
+		{"alice@example.com", "news@example.org", false},
+		{"bob@example.com", "news@example.org", true},
+		{"bob@example.com", "info@example.org", false},
+		{"postmaster@example.com", "anyone@example.com", true},
+		{"postmaster@example.com", "anyone@example.org", false},
+		{"alice@example.com", "", true},
+		{"alice@example.com", "alice@unserved.net", false},
+		{"bob@example.com", "help@example.net", true},
+		{"bob@example.com", "help@host.example.net", true},
+		{"alice@example.com", "anyone@example.net", false},
+		{"alice@example.com", "anyone@host.example.net", false},
+	}
+	for _, tt := range tests {
+		got, err := r.MaySendAs(context.Background(), tt.user, tt.from)
+		if err != nil {
+			t.Errorf("MaySendAs(%q, %q): %v", tt.user, tt.from, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("MaySendAs(%q, %q) = %v, want %v", tt.user, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestAuthRouter_MaySendAs_Fallback(t *testing.T) {
+	r := NewAuthRouter(nil, nil)
+	if ok, _ := r.MaySendAs(context.Background(), "alice", "alice"); !ok {
+		t.Error("expected fallback user to send as own name")
+	}
+	if ok, _ := r.MaySendAs(context.Background(), "alice", "bob@example.com"); ok {
+		t.Error("expected fallback user to be refused other addresses")
+	}
+}
@@ -0,0 +1,144 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/token"
+)
+
+// Sessions returns the domain's session registry, nil when sessions are
+// not enabled for the provider (see WithSessions). Usernames in it are
+// localparts.
+func (d *Domain) Sessions() auth.SessionStore {
+	if d.sessions == nil {
+		return nil
+	}
+	return d.sessions
+}
+
+// SessionUsers returns the localparts with active sessions in this
+// domain, sorted; nil when sessions are not enabled.
+func (d *Domain) SessionUsers() ([]string, error) {
+	if d.sessions == nil {
+		return nil, nil
+	}
+	return d.sessions.Users()
+}
+
+// Compile-time checks: AuthRouter keeps sessions and vouches for the
+// accounts they belong to.
+var (
+	_ auth.SessionStore    = (*AuthRouter)(nil)
+	_ token.AccountChecker = (*AuthRouter)(nil)
+)
+
+// sessionStore returns the session registry of username's domain and the
+// username's base localpart in it; a nil store when the domain keeps
+// none, is not served, or username has no domain.
+func (r *AuthRouter) sessionStore(username string) (auth.SessionStore, string, string) {
+	localPart, domainName := SplitUsername(username)
+	base, _ := ParseLocalPart(localPart)
+	if r.provider == nil || domainName == "" {
+		return nil, base, domainName
+	}
+	d := r.provider.GetDomain(domainName)
+	if d == nil {
+		return nil, base, domainName
+	}
+	return d.Sessions(), base, domainName
+}
+
+// AddSession registers info in the registry of its user's domain.
+// Implements auth.SessionStore. Sessions of users whose domain keeps no
+// registry are not recorded, and cannot be revoked.
+func (r *AuthRouter) AddSession(ctx context.Context, info auth.SessionInfo) error {
+	store, base, _ := r.sessionStore(info.Username)
+	if store == nil {
+		return nil
+	}
+	info.Username = base
+	return store.AddSession(ctx, info)
+}
+
+// CheckSession returns nil if id is an active session of username, and
+// errors.ErrSessionRevoked if not. Implements auth.SessionStore. Users
+// whose domain keeps no registry always pass.
+func (r *AuthRouter) CheckSession(ctx context.Context, username, id string) error {
+	store, base, _ := r.sessionStore(username)
+	if store == nil {
+		return nil
+	}
+	return store.CheckSession(ctx, base, id)
+}
+
+// ListSessions returns username's active sessions, oldest first, with
+// Username set to base@domain. Implements auth.SessionStore.
+func (r *AuthRouter) ListSessions(ctx context.Context, username string) ([]auth.SessionInfo, error) {
+	store, base, domainName := r.sessionStore(username)
+	if store == nil {
+		return nil, nil
+	}
+	list, err := store.ListSessions(ctx, base)
+	if err != nil {
+		return nil, err
+	}
+	for i := range list {
+		list[i].Username = base + "@" + domainName
+	}
+	return list, nil
+}
+
+// RevokeSession ends one of username's sessions. Implements
+// auth.SessionStore.
+func (r *AuthRouter) RevokeSession(ctx context.Context, username, id string) error {
+	store, base, _ := r.sessionStore(username)
+	if store == nil {
+		return fmt.Errorf("%w: %s", autherrors.ErrSessionNotFound, id)
+	}
+	return store.RevokeSession(ctx, base, id)
+}
+
+// RevokeSessions ends all of username's sessions and returns how many
+// were active. Implements auth.SessionStore.
+func (r *AuthRouter) RevokeSessions(ctx context.Context, username string) (int, error) {
+	store, base, _ := r.sessionStore(username)
+	if store == nil {
+		return 0, nil
+	}
+	return store.RevokeSessions(ctx, base)
+}
+
+// CheckAccount returns nil if username, an address, may still log in:
+// errors.ErrUserNotFound if the user or their domain no longer exists,
+// errors.ErrDomainFrozen if the domain is frozen, and
+// errors.ErrAccountDisabled if the account is disabled, locked or deleted
+// (see auth.AccountStatus). Implements token.AccountChecker, so session
+// tokens stop working with the account.
+func (r *AuthRouter) CheckAccount(ctx context.Context, username string) error {
+	localPart, domainName := SplitUsername(username)
+	base, _ := ParseLocalPart(localPart)
+	if r.provider == nil || domainName == "" {
+		return autherrors.ErrUserNotFound
+	}
+	d, _ := ResolveDomain(r.provider, domainName)
+	if d == nil {
+		return autherrors.ErrUserNotFound
+	}
+	if canonical, ok := d.NormalizeLocalpart(base); ok {
+		base = canonical
+	}
+	if err := d.checkFrozen(); err != nil {
+		return err
+	}
+	exists, err := d.AuthAgent.UserExists(ctx, base)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("%w: %s", autherrors.ErrUserNotFound, username)
+	}
+	return d.checkCanLogin(ctx, base)
+}
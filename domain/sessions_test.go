@@ -0,0 +1,132 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/passwd"
+	"github.com/infodancer/auth/token"
+)
+
+func TestAuthRouter_Sessions(t *testing.T) {
+	hash, err := passwd.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := newTestDomainsTree(t, "alice:"+hash+":alice\n", "example.com")
+	p.WithSessions()
+	r := NewAuthRouter(p, nil)
+	agent, err := token.NewHMAC([]byte(strings.Repeat("k", token.MinHMACKeySize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent.WithSessionStore(r)
+
+	ctx := context.Background()
+	var toks []string
+	for range 2 {
+		session, err := r.Authenticate(ctx, "alice@example.com", "secret")
+		if err != nil {
+			t.Fatalf("Authenticate: %v", err)
+		}
+		tok, err := agent.IssueToken(ctx, session)
+		if err != nil {
+			t.Fatalf("IssueToken: %v", err)
+		}
+		toks = append(toks, tok)
+	}
+
+	list, err := r.ListSessions(ctx, "alice+x@example.com")
+	if err != nil || len(list) != 2 || list[0].Username != "alice@example.com" {
+		t.Fatalf("ListSessions = %+v, %v", list, err)
+	}
+	if users, err := p.GetDomain("example.com").SessionUsers(); err != nil || len(users) != 1 || users[0] != "alice" {
+		t.Errorf("SessionUsers = %v, %v", users, err)
+	}
+
+	revoked, kept := toks[0], toks[1]
+	if s, _ := agent.Session(ctx, toks[1]); s != nil && s.Credential.ID == list[0].ID {
+		revoked, kept = toks[1], toks[0]
+	}
+	if err := r.RevokeSession(ctx, "alice@example.com", list[0].ID); err != nil {
+		t.Fatalf("RevokeSession: %v", err)
+	}
+	if _, err := agent.VerifyToken(ctx, revoked); !errors.Is(err, autherrors.ErrSessionRevoked) {
+		t.Errorf("revoked token: err = %v, want ErrSessionRevoked", err)
+	}
+	if _, err := agent.VerifyToken(ctx, kept); err != nil {
+		t.Errorf("kept token: %v", err)
+	}
+	if n, err := r.RevokeSessions(ctx, "alice@example.com"); err != nil || n != 1 {
+		t.Errorf("RevokeSessions = %d, %v; want 1", n, err)
+	}
+	if _, err := agent.VerifyToken(ctx, kept); !errors.Is(err, autherrors.ErrSessionRevoked) {
+		t.Errorf("token after RevokeSessions: err = %v", err)
+	}
+
+	// Unserved domains keep no sessions.
+	if err := r.CheckSession(ctx, "bob@elsewhere.test", "x"); err != nil {
+		t.Errorf("CheckSession(unserved) = %v", err)
+	}
+	if err := r.RevokeSession(ctx, "bob@elsewhere.test", "x"); !errors.Is(err, autherrors.ErrSessionNotFound) {
+		t.Errorf("RevokeSession(unserved) = %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestAuthRouter_TokensFollowAccount(t *testing.T) {
+	var users strings.Builder
+	for _, u := range []string{"alice", "bob", "carol", "dave"} {
+		users.WriteString(u + ":HASH:" + u + "\n")
+	}
+	p, base := newTestDomainsTree(t, users.String(), "example.com", "frozen.com")
+	r := NewAuthRouter(p, nil)
+	agent, err := token.NewHMAC([]byte(strings.Repeat("k", token.MinHMACKeySize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent.WithAccountChecker(r)
+
+	// Tokens are minted before the accounts change, and verified after.
+	ctx := context.Background()
+	toks := make(map[string]string)
+	for _, addr := range []string{"alice@example.com", "bob@example.com", "carol@example.com", "dave@example.com", "alice@frozen.com"} {
+		session := &auth.AuthSession{User: &auth.User{Username: addr}}
+		if toks[addr], err = agent.IssueToken(ctx, session); err != nil {
+			t.Fatalf("IssueToken(%s): %v", addr, err)
+		}
+	}
+
+	passwdPath := filepath.Join(base, "example.com", "passwd")
+	if err := passwd.SetFlags(passwdPath, "alice", passwd.FlagDisabled); err != nil {
+		t.Fatal(err)
+	}
+	if err := passwd.SoftDeleteUser(passwdPath, "bob", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := passwd.DeleteUser(passwdPath, "carol"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.FreezeDomain("frozen.com", "abuse"); err != nil {
+		t.Fatal(err)
+	}
+
+	for addr, want := range map[string]error{
+		"alice@example.com": autherrors.ErrAccountDisabled,
+		"bob@example.com":   autherrors.ErrAccountDisabled,
+		"carol@example.com": autherrors.ErrUserNotFound,
+		"alice@frozen.com":  autherrors.ErrDomainFrozen,
+	} {
+		if _, err := agent.VerifyToken(ctx, toks[addr]); !errors.Is(err, want) {
+			t.Errorf("%s: err = %v, want %v", addr, err, want)
+		}
+	}
+	if _, err := agent.VerifyToken(ctx, toks["dave@example.com"]); err != nil {
+		t.Errorf("account in good standing: %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/infodancer/auth/passwd"
+)
+
+// soakDuration lengthens TestProviderSoak from a short smoke run, e.g.
+//
+//	go test -race -run TestProviderSoak -soak 5m ./domain/
+var soakDuration = flag.Duration("soak", 0, "run TestProviderSoak for this long instead of a short smoke run")
+
+var errInjected = errors.New("injected fault")
+
+// faultFS wraps an FS and fails a configurable percentage of calls.
+type faultFS struct {
+	FS
+	percent  atomic.Int64
+	injected atomic.Int64
+}
+
+func (f *faultFS) fault(op, name string) error {
+	if p := f.percent.Load(); p > 0 && rand.Int64N(100) < p {
+		f.injected.Add(1)
+		return &fs.PathError{Op: op, Path: name, Err: errInjected}
+	}
+	return nil
+}
+
+func (f *faultFS) Stat(name string) (fs.FileInfo, error) {
+	if err := f.fault("stat", name); err != nil {
+		return nil, err
+	}
+	return f.FS.Stat(name)
+}
+
+func (f *faultFS) ReadFile(name string) ([]byte, error) {
+	if err := f.fault("read", name); err != nil {
+		return nil, err
+	}
+	return f.FS.ReadFile(name)
+}
+
+func (f *faultFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := f.fault("readdir", name); err != nil {
+		return nil, err
+	}
+	return f.FS.ReadDir(name)
+}
+
+// TestProviderSoak hammers GetDomain, Authenticate, Domains, ResourceReport,
+// Close and cache eviction from several goroutines while the provider's FS
+// fails intermittently. It checks that nothing panics or races (run with
+// -race) and that the provider recovers fully once faults stop.
+func TestProviderSoak(t *testing.T) {
+	duration := 300 * time.Millisecond
+	if *soakDuration > 0 {
+		duration = *soakDuration
+	}
+
+	hash, err := passwd.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"a.test", "b.test", "c.test", "d.test"}
+	p, base := newTestDomainsTree(t, "alice:"+hash+":alice\nbob:"+hash+":bob\n", names...)
+	for _, name := range names {
+		writeDomainConfig(t, base, name, "[forwards]\nsales = \"alice@"+name+"\"\n")
+	}
+	fsys := &faultFS{FS: OSFS{}}
+	p.WithFS(fsys).WithResourceLimits(ResourceLimits{MaxDomains: 2})
+	r := NewAuthRouter(p, nil)
+	defer func() { _ = r.Close() }()
+
+	ctx := context.Background()
+	deadline := time.Now().Add(duration)
+	var wg sync.WaitGroup
+	var ops atomic.Int64
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				ops.Add(1)
+				name := names[rand.IntN(len(names))]
+				switch rand.IntN(8) {
+				case 0:
+					if session, err := r.Authenticate(ctx, "alice@"+name, "secret"); err == nil {
+						session.Clear()
+					}
+				case 1, 2:
+					if d := p.GetDomain(name); d != nil {
+						_, _ = d.AuthAgent.UserExists(ctx, "bob")
+						_, _ = d.AuthAgent.ResolveForward(ctx, "sales")
+					}
+				case 3:
+					_ = p.Domains()
+				case 4:
+					_ = p.ResourceReport()
+				case 5:
+					_ = p.Close()
+				default:
+					fsys.percent.Store(int64(rand.IntN(2) * 30))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	t.Logf("%d operations, %d injected faults", ops.Load(), fsys.injected.Load())
+
+	// Recovery: with faults off and the cache dropped, every domain loads
+	// and authenticates.
+	fsys.percent.Store(0)
+	if err := p.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got := len(p.Domains()); got != len(names) {
+		t.Errorf("Domains() after soak: got %d, want %d", got, len(names))
+	}
+	for _, name := range names {
+		session, err := r.Authenticate(ctx, "alice@"+name, "secret")
+		if err != nil {
+			t.Errorf("%s: Authenticate after soak: %v", name, err)
+			continue
+		}
+		if want := fmt.Sprintf("alice@%s", name); session.User.Mailbox != want {
+			t.Errorf("%s: Mailbox = %q, want %q", name, session.User.Mailbox, want)
+		}
+		session.Clear()
+	}
+}
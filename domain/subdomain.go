@@ -0,0 +1,45 @@
+package domain
+
+import (
+	"strings"
+
+	"github.com/infodancer/auth/address"
+)
+
+// ResolveDomain returns the Domain serving name. If name itself is not
+// served, its parent domains are tried from the nearest up; a parent with
+// AcceptSubdomains set serves name, and host is the part of name before the
+// parent (e.g. "host" for host.example.com under example.com).
+// name is made canonical first (see address.Domain), so an
+// internationalized name finds the domain configured under its punycode
+// form. Returns nil and "" when no domain serves name or name is invalid.
+func ResolveDomain(provider DomainProvider, name string) (d *Domain, host string) {
+	if provider == nil || name == "" {
+		return nil, ""
+	}
+	name, err := address.Domain(name)
+	if err != nil {
+		return nil, ""
+	}
+	if d := provider.GetDomain(name); d != nil {
+		return d, ""
+	}
+	for i := strings.IndexByte(name, '.'); i >= 0; {
+		parent := name[i+1:]
+		if !strings.Contains(parent, ".") {
+			break // never delegate from a bare TLD
+		}
+		if d := provider.GetDomain(parent); d != nil {
+			if d.AcceptSubdomains {
+				return d, name[:i]
+			}
+			return nil, ""
+		}
+		next := strings.IndexByte(parent, '.')
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return nil, ""
+}
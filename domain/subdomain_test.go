@@ -0,0 +1,85 @@
+package domain
+
+import (
+	"context"
+	"testing"
+
+	"github.com/infodancer/auth/passwd"
+)
+
+func TestResolveDomain(t *testing.T) {
+	p, base := newTestDomainsTree(t, "", "example.com", "closed.org", "lab.closed.org")
+	writeDomainConfig(t, base, "example.com", "accept_subdomains = true\n")
+
+	tests := []struct {
+		name     string
+		wantName string
+		wantHost string
+	}{
+		{"example.com", "example.com", ""},
+		{"Host.Example.com", "example.com", "host"},
+		{"a.b.example.com", "example.com", "a.b"},
+		{"lab.closed.org", "lab.closed.org", ""},
+		{"host.closed.org", "", ""},  // parent does not accept subdomains
+		{"x.lab.closed.org", "", ""}, // nearest served parent decides
+		{"other.net", "", ""},        // not served at all
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		d, host := ResolveDomain(p, tt.name)
+		gotName := ""
+		if d != nil {
+			gotName = d.Name
+		}
+		if gotName != tt.wantName || host != tt.wantHost {
+			t.Errorf("ResolveDomain(%q) = %q, %q; want %q, %q", tt.name, gotName, host, tt.wantName, tt.wantHost)
+		}
+	}
+}
+
+func TestResolveDomain_IDN(t *testing.T) {
+	p, _ := newTestDomainsTree(t, "", "xn--bcher-kva.example")
+
+	for _, name := range []string{"bücher.example", "Bücher.Example.", "xn--bcher-kva.example"} {
+		if d, _ := ResolveDomain(p, name); d == nil || d.Name != "xn--bcher-kva.example" {
+			t.Errorf("ResolveDomain(%q) = %v, want xn--bcher-kva.example", name, d)
+		}
+	}
+	if d, _ := ResolveDomain(p, "bad..example"); d != nil {
+		t.Errorf("ResolveDomain(invalid) = %q, want nil", d.Name)
+	}
+}
+
+func TestAuthRouter_SubdomainAddress(t *testing.T) {
+	hash, err := passwd.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, base := newTestDomainsTree(t, "alice:"+hash+":alice\n", "example.com")
+	writeDomainConfig(t, base, "example.com", "accept_subdomains = true\n")
+	r := NewAuthRouter(p, nil)
+	ctx := context.Background()
+
+	result, err := r.AuthenticateWithDomain(ctx, "alice@laptop.example.com", "secret")
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if result.Domain.Name != "example.com" || result.Host != "laptop" {
+		t.Errorf("Domain = %s, Host = %q; want example.com, laptop", result.Domain.Name, result.Host)
+	}
+	if result.Session.User.Mailbox != "alice@example.com" {
+		t.Errorf("Mailbox = %q, want alice@example.com", result.Session.User.Mailbox)
+	}
+
+	if exists, err := r.UserExists(ctx, "alice@laptop.example.com"); err != nil || !exists {
+		t.Errorf("UserExists = %v, %v", exists, err)
+	}
+
+	deliveries, err := ResolveFinalRecipients(ctx, p, "alice@laptop.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Kind != DeliveryLocal || deliveries[0].Address != "alice@example.com" {
+		t.Errorf("ResolveFinalRecipients = %+v", deliveries)
+	}
+}
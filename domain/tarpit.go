@@ -0,0 +1,175 @@
+package domain
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/infodancer/auth"
+)
+
+// TarpitConfig holds the delays of a Tarpit.
+type TarpitConfig struct {
+	// BaseDelay is the delay before the attempt after one failure; each
+	// further consecutive failure doubles it. Default: 500 milliseconds.
+	BaseDelay time.Duration
+
+	// MaxDelay caps the delay. Default: 30 seconds.
+	MaxDelay time.Duration
+
+	// Reset is how long after its last failure an (IP, username) pair is
+	// forgotten. Default: 15 minutes.
+	Reset time.Duration
+}
+
+// DefaultTarpitConfig returns sensible defaults for a Tarpit.
+func DefaultTarpitConfig() TarpitConfig {
+	return TarpitConfig{
+		BaseDelay: 500 * time.Millisecond,
+		MaxDelay:  30 * time.Second,
+		Reset:     15 * time.Minute,
+	}
+}
+
+// Tarpit slows online password guessing: after consecutive failed logins
+// for an (IP, username) pair, each further attempt for the pair waits
+// BaseDelay, 2×BaseDelay, 4×BaseDelay and so on up to MaxDelay before it
+// is checked. A successful login clears the pair. Unlike the router's rate
+// limits there is no lockout, so a user who mistypes a password is slowed,
+// never locked out, and callers see only a slower AuthenticationAgent.
+// Install it as router middleware:
+//
+//	router := domain.NewAuthRouter(provider, nil).
+//		WithMiddleware(domain.NewTarpit(domain.DefaultTarpitConfig()).Middleware)
+//
+// The IP comes from the context (see WithClientIP). Refusals that say
+// nothing about the password (errors.ErrTLSRequired,
+// errors.ErrAccessDenied, errors.ErrMechanismUnsupported,
+// errors.ErrBackendUnavailable, errors.ErrAccountDisabled) do not count as
+// failures, as they do not against the router's rate limits. A Tarpit is
+// safe for concurrent use.
+type Tarpit struct {
+	mu        sync.Mutex
+	cfg       TarpitConfig
+	now       func() time.Time                                 // for testing
+	sleep     func(ctx context.Context, d time.Duration) error // for testing
+	pairs     map[string]*tarpitPair
+	lastPrune time.Time
+}
+
+// tarpitPair is the failure state of one (IP, username) pair.
+type tarpitPair struct {
+	failures int
+	last     time.Time
+}
+
+// NewTarpit returns a Tarpit with cfg; zero fields take their defaults
+// from DefaultTarpitConfig.
+func NewTarpit(cfg TarpitConfig) *Tarpit {
+	def := DefaultTarpitConfig()
+	if cfg.BaseDelay <= 0 {
+		cfg.BaseDelay = def.BaseDelay
+	}
+	if cfg.MaxDelay <= 0 {
+		cfg.MaxDelay = def.MaxDelay
+	}
+	if cfg.Reset <= 0 {
+		cfg.Reset = def.Reset
+	}
+	return &Tarpit{
+		cfg:   cfg,
+		now:   time.Now,
+		sleep: sleepContext,
+		pairs: make(map[string]*tarpitPair),
+	}
+}
+
+// Middleware delays each login by the pair's current delay, then records
+// its outcome. A login whose context ends during the delay fails with the
+// context's error.
+func (t *Tarpit) Middleware(next AuthFunc) AuthFunc {
+	return func(ctx context.Context, creds auth.Credentials) (*AuthResult, error) {
+		key := clientIPFromContext(ctx) + "\x00" + creds.Username
+		if d := t.delay(key); d > 0 {
+			slog.Debug("auth tarpit", "username", creds.Username, "ip", clientIPFromContext(ctx), "delay", d)
+			if err := t.sleep(ctx, d); err != nil {
+				return nil, err
+			}
+		}
+		result, err := next(ctx, creds)
+		switch {
+		case err == nil:
+			t.recordSuccess(key)
+		case isCredentialFailure(err):
+			t.recordFailure(key)
+		}
+		return result, err
+	}
+}
+
+// Delay returns the delay the next login for ip and username would wait.
+func (t *Tarpit) Delay(ip, username string) time.Duration {
+	return t.delay(ip + "\x00" + username)
+}
+
+// delay returns the delay for the pair key.
+func (t *Tarpit) delay(key string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p := t.pairs[key]
+	if p == nil || p.failures == 0 || t.now().Sub(p.last) >= t.cfg.Reset {
+		return 0
+	}
+	d := t.cfg.BaseDelay
+	for i := 1; i < p.failures && d < t.cfg.MaxDelay; i++ {
+		d *= 2
+	}
+	return min(d, t.cfg.MaxDelay)
+}
+
+// recordFailure counts a failed login for the pair key.
+func (t *Tarpit) recordFailure(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	p := t.pairs[key]
+	if p == nil || now.Sub(p.last) >= t.cfg.Reset {
+		p = &tarpitPair{}
+		t.pairs[key] = p
+	}
+	p.failures++
+	p.last = now
+
+	// Forget idle pairs, at most once per Reset period.
+	if now.Sub(t.lastPrune) >= t.cfg.Reset {
+		for k, q := range t.pairs {
+			if now.Sub(q.last) >= t.cfg.Reset {
+				delete(t.pairs, k)
+			}
+		}
+		t.lastPrune = now
+	}
+}
+
+// recordSuccess clears the pair key.
+func (t *Tarpit) recordSuccess(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pairs, key)
+}
+
+// sleepContext waits for d or until ctx ends, returning ctx's error in
+// the latter case.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
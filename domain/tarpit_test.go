@@ -0,0 +1,114 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+func TestTarpit(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tp := NewTarpit(TarpitConfig{BaseDelay: time.Second, MaxDelay: 5 * time.Second, Reset: time.Minute})
+	tp.now = func() time.Time { return now }
+	var slept []time.Duration
+	tp.sleep = func(_ context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return nil
+	}
+	errFor := map[string]error{}
+	login := tp.Middleware(func(_ context.Context, creds auth.Credentials) (*AuthResult, error) {
+		if err := errFor[creds.Username]; err != nil {
+			return nil, err
+		}
+		return &AuthResult{}, nil
+	})
+	attempt := func(ip, user string) error {
+		_, err := login(WithClientIP(context.Background(), ip), auth.Credentials{Username: user})
+		return err
+	}
+
+	errFor["alice"] = autherrors.ErrAuthFailed
+	for range 5 {
+		_ = attempt("192.0.2.1", "alice")
+	}
+	if want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}; !slices.Equal(slept, want) {
+		t.Errorf("delays = %v, want %v", slept, want)
+	}
+	if d := tp.Delay("192.0.2.1", "alice"); d != 5*time.Second {
+		t.Errorf("Delay = %v", d)
+	}
+
+	// Other pairs are not slowed.
+	if d := tp.Delay("192.0.2.2", "alice"); d != 0 {
+		t.Errorf("Delay from another IP = %v", d)
+	}
+
+	// A success clears the pair.
+	errFor["alice"] = nil
+	if err := attempt("192.0.2.1", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if d := tp.Delay("192.0.2.1", "alice"); d != 0 {
+		t.Errorf("Delay after success = %v", d)
+	}
+
+	// Refusals that say nothing about the password do not count.
+	errFor["bob"] = autherrors.ErrTLSRequired
+	_ = attempt("192.0.2.1", "bob")
+	if d := tp.Delay("192.0.2.1", "bob"); d != 0 {
+		t.Errorf("Delay after TLS refusal = %v", d)
+	}
+
+	// Failures are forgotten after Reset.
+	errFor["carol"] = autherrors.ErrAuthFailed
+	_ = attempt("192.0.2.1", "carol")
+	now = now.Add(time.Minute)
+	if d := tp.Delay("192.0.2.1", "carol"); d != 0 {
+		t.Errorf("Delay after reset = %v", d)
+	}
+	_ = attempt("192.0.2.9", "dave") // prunes idle pairs
+	tp.mu.Lock()
+	n := len(tp.pairs)
+	tp.mu.Unlock()
+	if n != 1 {
+		t.Errorf("pairs after prune = %d, want 1", n)
+	}
+}
+
+func TestTarpit_ContextEnds(t *testing.T) {
+	tp := NewTarpit(TarpitConfig{BaseDelay: time.Hour})
+	called := 0
+	login := tp.Middleware(func(context.Context, auth.Credentials) (*AuthResult, error) {
+		called++
+		return nil, autherrors.ErrAuthFailed
+	})
+	ctx := WithClientIP(context.Background(), "192.0.2.1")
+	_, _ = login(ctx, auth.Credentials{Username: "alice"})
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := login(ctx, auth.Credentials{Username: "alice"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want deadline exceeded", err)
+	}
+	if called != 1 {
+		t.Errorf("next called %d times, want 1", called)
+	}
+}
+
+func TestTarpit_Router(t *testing.T) {
+	tp := NewTarpit(TarpitConfig{BaseDelay: time.Millisecond})
+	inner := &stubAuthAgent{users: map[string]bool{"alice": true}}
+	r := NewAuthRouter(nil, inner).WithMiddleware(tp.Middleware)
+	ctx := WithClientIP(context.Background(), "192.0.2.1")
+	if _, err := r.Authenticate(ctx, "mallory", "x"); err == nil {
+		t.Fatal("unknown user authenticated")
+	}
+	if d := tp.Delay("192.0.2.1", "mallory"); d != time.Millisecond {
+		t.Errorf("Delay = %v", d)
+	}
+}
@@ -0,0 +1,235 @@
+package domain
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/vfs"
+)
+
+// TemplatesDir is the directory under the provider's basePath that holds
+// named domain templates. Dot-directories are never treated as domains.
+//
+//	/etc/mail/domains/
+//	├── .templates/
+//	│   └── business/
+//	│       ├── config.toml     (optional; base config for the new domain)
+//	│       ├── config.d/       (optional; *.toml fragments merged in name order)
+//	│       ├── passwd          (optional; e.g. locked postmaster/abuse accounts)
+//	│       └── ...             (any other files, copied verbatim)
+//	├── example.com/
+//
+// Every copied file, and each config fragment, has "${DOMAIN}" replaced by
+// the new domain's name, so a template can say
+//
+//	[forwards]
+//	abuse = "abuse-desk@${DOMAIN}"
+const TemplatesDir = ".templates"
+
+// domainPlaceholder is substituted with the domain name in template files.
+const domainPlaceholder = "${DOMAIN}"
+
+// Templates returns the names of the templates available to CreateDomain.
+func (p *FilesystemDomainProvider) Templates() []string {
+	entries, err := p.fs.ReadDir(filepath.Join(p.basePath, TemplatesDir))
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
+
+// CreateDomain provisions a new domain directory under basePath from the
+// named template. An empty template creates an empty domain directory, which
+// relies on provider defaults. The domain is assembled in a staging directory
+// and renamed into place, so a failed provisioning leaves nothing behind.
+//
+// Returns ErrInvalidDomainName, ErrDomainExists or ErrTemplateNotFound for
+// the corresponding conditions, and ErrReadOnly in read-only mode or when
+// the provider's FS (see WithFS) is not a vfs.WriteFS.
+func (p *FilesystemDomainProvider) CreateDomain(name, template string) error {
+	fsys, writable := p.fs.(vfs.WriteFS)
+	if p.ReadOnly() || !writable {
+		return autherrors.ErrReadOnly
+	}
+	name = strings.ToLower(name)
+	if !validDirName(name) || strings.ContainsAny(name, "_ ") {
+		return fmt.Errorf("%w: %q", autherrors.ErrInvalidDomainName, name)
+	}
+	target := filepath.Join(p.basePath, name)
+	if _, err := fsys.Stat(target); err == nil {
+		return fmt.Errorf("%w: %s", autherrors.ErrDomainExists, name)
+	}
+
+	var templateDir string
+	if template != "" {
+		templateDir = filepath.Join(p.basePath, TemplatesDir, template)
+		fi, err := fsys.Stat(templateDir)
+		if !validDirName(template) || err != nil || !fi.IsDir() {
+			return fmt.Errorf("%w: %s", autherrors.ErrTemplateNotFound, template)
+		}
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return fmt.Errorf("create staging directory: %w", err)
+	}
+	staging := filepath.Join(p.basePath, "."+name+".tmp-"+hex.EncodeToString(suffix))
+	if err := fsys.MkdirAll(staging, 0o750); err != nil {
+		return fmt.Errorf("create staging directory: %w", err)
+	}
+	defer func() { _ = fsys.RemoveAll(staging) }()
+
+	if templateDir != "" {
+		if err := applyTemplate(fsys, templateDir, staging, name); err != nil {
+			return fmt.Errorf("apply template %s: %w", template, err)
+		}
+	}
+
+	if err := fsys.Rename(staging, target); err != nil {
+		if _, statErr := fsys.Stat(target); statErr == nil {
+			return fmt.Errorf("%w: %s", autherrors.ErrDomainExists, name)
+		}
+		return fmt.Errorf("install domain directory: %w", err)
+	}
+
+	p.logger.Info("created domain",
+		slog.String("domain", name),
+		slog.String("template", template))
+	return nil
+}
+
+// validDirName reports whether name is usable as a single path element
+// under basePath: non-empty, no separators, and not a dot-file.
+func validDirName(name string) bool {
+	return name != "" &&
+		!strings.HasPrefix(name, ".") &&
+		!strings.ContainsAny(name, `/\`) &&
+		filepath.Base(name) == name
+}
+
+// applyTemplate copies templateDir into dst for domain name, merging
+// config.toml and config.d/*.toml into a single config.toml.
+func applyTemplate(fsys vfs.WriteFS, templateDir, dst, name string) error {
+	if err := copyTemplateDir(fsys, templateDir, dst, "", name); err != nil {
+		return err
+	}
+	return writeTemplateConfig(fsys, templateDir, dst, name)
+}
+
+// copyTemplateDir copies the template subdirectory rel (relative to
+// templateDir) into dst, skipping the config files assembled separately.
+func copyTemplateDir(fsys vfs.WriteFS, templateDir, dst, rel, name string) error {
+	entries, err := fsys.ReadDir(filepath.Join(templateDir, rel))
+	if err != nil {
+		return err
+	}
+	for _, d := range entries {
+		entryRel := filepath.Join(rel, d.Name())
+		// Config is assembled separately below.
+		if entryRel == "config.toml" || entryRel == "config.d" {
+			continue
+		}
+
+		out := filepath.Join(dst, entryRel)
+		if d.IsDir() {
+			if err := fsys.MkdirAll(out, 0o750); err != nil {
+				return err
+			}
+			if err := copyTemplateDir(fsys, templateDir, dst, entryRel, name); err != nil {
+				return err
+			}
+			continue
+		}
+		if !d.Type().IsRegular() {
+			return fmt.Errorf("%s: not a regular file", entryRel)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		data, err := readTemplateFile(fsys, filepath.Join(templateDir, entryRel), name)
+		if err != nil {
+			return err
+		}
+		if err := fsys.WriteFile(out, data, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTemplateConfig deep-merges the template's config.toml and its
+// config.d fragments (in name order) and writes the result to dst/config.toml.
+// Nothing is written when the template has no config.
+func writeTemplateConfig(fsys vfs.WriteFS, templateDir, dst, name string) error {
+	paths := []string{filepath.Join(templateDir, "config.toml")}
+	fragments, err := fsys.ReadDir(filepath.Join(templateDir, "config.d"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	// ReadDir returns entries sorted by name.
+	for _, e := range fragments {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".toml") {
+			paths = append(paths, filepath.Join(templateDir, "config.d", e.Name()))
+		}
+	}
+
+	var merged map[string]any
+	for _, path := range paths {
+		data, err := readTemplateFile(fsys, path, name)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		var m map[string]any
+		if err := toml.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("parse %s: %w", path, err)
+		}
+		if merged == nil {
+			merged = make(map[string]any)
+		}
+		merged = deepMergeMaps(merged, m)
+	}
+	if merged == nil {
+		return nil
+	}
+
+	data, err := toml.Marshal(merged)
+	if err != nil {
+		return fmt.Errorf("encode config: %w", err)
+	}
+	// Validate the result against DomainConfig so a broken template fails
+	// at provisioning rather than at first load.
+	var cfg DomainConfig
+	if err := toml.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("invalid merged config: %w", err)
+	}
+	return fsys.WriteFile(filepath.Join(dst, "config.toml"), data, 0o640)
+}
+
+// readTemplateFile reads path with the domain placeholder substituted.
+func readTemplateFile(fsys vfs.FS, path, name string) ([]byte, error) {
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.ReplaceAll(data, []byte(domainPlaceholder), []byte(name)), nil
+}
@@ -0,0 +1,120 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+func writeTemplateFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCreateDomain_FromTemplate(t *testing.T) {
+	p, base := newTestDomainsTree(t, "")
+	writeTemplateFiles(t, filepath.Join(base, TemplatesDir, "business"), map[string]string{
+		"config.toml":            "max_message_size = 1000\n\n[forwards]\npostmaster = \"ops@operator.net\"\n",
+		"config.d/10-limit.toml": "max_message_size = 2000\n",
+		"config.d/20-abuse.toml": "[forwards]\nabuse = \"abuse-desk@${DOMAIN}\"\n",
+		"passwd":                 "postmaster:!:postmaster\n",
+		"keys/README":            "keys for ${DOMAIN}\n",
+	})
+
+	if err := p.CreateDomain("New.com", "business"); err != nil {
+		t.Fatalf("CreateDomain: %v", err)
+	}
+
+	cfg, err := LoadDomainConfig(filepath.Join(base, "new.com", "config.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxMessageSize != 2000 {
+		t.Errorf("MaxMessageSize = %d, want 2000 (later fragment wins)", cfg.MaxMessageSize)
+	}
+	if cfg.Forwards["postmaster"] != "ops@operator.net" || cfg.Forwards["abuse"] != "abuse-desk@new.com" {
+		t.Errorf("unexpected forwards: %v", cfg.Forwards)
+	}
+	readme, err := os.ReadFile(filepath.Join(base, "new.com", "keys", "README"))
+	if err != nil || strings.TrimSpace(string(readme)) != "keys for new.com" {
+		t.Errorf("README = %q, %v", readme, err)
+	}
+
+	d := p.GetDomain("new.com")
+	if d == nil {
+		t.Fatal("expected provisioned domain to load")
+	}
+	if exists, err := d.AuthAgent.UserExists(context.Background(), "postmaster"); err != nil || !exists {
+		t.Errorf("UserExists(postmaster) = %v, %v", exists, err)
+	}
+
+	for _, name := range p.Domains() {
+		if strings.HasPrefix(name, ".") {
+			t.Errorf("Domains() listed %q", name)
+		}
+	}
+	if got := p.Templates(); len(got) != 1 || got[0] != "business" {
+		t.Errorf("Templates() = %v", got)
+	}
+}
+
+func TestCreateDomain_Errors(t *testing.T) {
+	p, base := newTestDomainsTree(t, "", "taken.com")
+	writeTemplateFiles(t, filepath.Join(base, TemplatesDir, "broken"), map[string]string{
+		"config.toml": "max_message_size = \"lots\"\n",
+	})
+
+	tests := []struct {
+		name, domain, template string
+		want                   error
+	}{
+		{"exists", "taken.com", "", autherrors.ErrDomainExists},
+		{"dot name", ".hidden", "", autherrors.ErrInvalidDomainName},
+		{"traversal", "../x", "", autherrors.ErrInvalidDomainName},
+		{"missing template", "a.com", "nope", autherrors.ErrTemplateNotFound},
+		{"template traversal", "a.com", "../taken.com", autherrors.ErrTemplateNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := p.CreateDomain(tt.domain, tt.template); !errors.Is(err, tt.want) {
+				t.Errorf("CreateDomain(%q, %q) = %v, want %v", tt.domain, tt.template, err, tt.want)
+			}
+		})
+	}
+
+	if err := p.CreateDomain("b.com", "broken"); err == nil {
+		t.Error("expected error for invalid template config")
+	}
+	if _, err := os.Stat(filepath.Join(base, "b.com")); !os.IsNotExist(err) {
+		t.Error("failed provisioning left a domain directory behind")
+	}
+	entries, _ := os.ReadDir(base)
+	for _, e := range entries {
+		if strings.Contains(e.Name(), ".tmp-") {
+			t.Errorf("staging directory %s left behind", e.Name())
+		}
+	}
+}
+
+func TestCreateDomain_NoTemplate(t *testing.T) {
+	p, base := newTestDomainsTree(t, "")
+	if err := p.CreateDomain("plain.com", ""); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(filepath.Join(base, "plain.com")); err != nil || !fi.IsDir() {
+		t.Fatalf("expected domain directory, got %v", err)
+	}
+}
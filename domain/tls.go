@@ -0,0 +1,75 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// connInfoKeyType is the context key type for connection details.
+type connInfoKeyType struct{}
+
+// ConnInfoKey is the context key used to pass details of the client
+// connection a login arrives on to the AuthRouter. Use WithConnInfo to set it.
+var ConnInfoKey = connInfoKeyType{}
+
+// ConnInfo describes the client connection a login arrives on.
+type ConnInfo struct {
+	// TLS is true when the connection is encrypted (implicit TLS or after
+	// STARTTLS).
+	TLS bool
+
+	// ServerName is the hostname the client asked for with TLS SNI, empty
+	// if none. With LocalAddr it selects the realm (see WithRealms).
+	ServerName string
+
+	// LocalAddr is the server address the client connected to, as
+	// "host:port" or a bare IP address, empty if unknown.
+	LocalAddr string
+}
+
+// WithConnInfo returns a context carrying the connection details.
+func WithConnInfo(ctx context.Context, info ConnInfo) context.Context {
+	return context.WithValue(ctx, ConnInfoKey, info)
+}
+
+// connInfoFromContext extracts the connection details from the context.
+// ok is false if they were not set.
+func connInfoFromContext(ctx context.Context) (info ConnInfo, ok bool) {
+	info, ok = ctx.Value(ConnInfoKey).(ConnInfo)
+	return info, ok
+}
+
+// RequiresTLS reports whether localpart may only authenticate over an
+// encrypted connection: the user's require_tls metadata when set (see
+// UserMetadata), otherwise the domain's require_tls_auth. Daemons can use it
+// to decide whether to offer AUTH before STARTTLS.
+func (d *Domain) RequiresTLS(localpart string) (bool, error) {
+	md, err := d.UserMetadata(localpart)
+	if err != nil {
+		return false, err
+	}
+	if md.RequireTLS != nil {
+		return *md.RequireTLS, nil
+	}
+	return d.RequireTLSAuth, nil
+}
+
+// checkTLS returns ErrTLSRequired when localpart requires TLS and the
+// context does not report an encrypted connection. A context without
+// ConnInfo counts as plaintext, so protected users stay protected behind
+// daemons that do not set it.
+func (d *Domain) checkTLS(ctx context.Context, localpart string) error {
+	required, err := d.RequiresTLS(localpart)
+	if err != nil {
+		return fmt.Errorf("check TLS policy: %w", err)
+	}
+	if !required {
+		return nil
+	}
+	if info, _ := connInfoFromContext(ctx); !info.TLS {
+		return autherrors.ErrTLSRequired
+	}
+	return nil
+}
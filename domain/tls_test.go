@@ -0,0 +1,58 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/passwd"
+)
+
+func TestAuthRouter_RequireTLS(t *testing.T) {
+	hash, err := passwd.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, base := newTestDomainsTree(t, "alice:"+hash+":alice\nlegacy:"+hash+":legacy\n", "example.com")
+	writeDomainConfig(t, base, "example.com", "require_tls_auth = true\n")
+	if err := os.WriteFile(filepath.Join(base, "example.com", UserMetadataFile),
+		[]byte("[legacy]\nrequire_tls = false\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	r := NewAuthRouter(p, nil).WithRateLimit(RateLimitConfig{MaxFailuresPerUser: 1, Window: time.Minute, Lockout: time.Minute})
+	defer func() { _ = r.Close() }()
+
+	plain := WithConnInfo(context.Background(), ConnInfo{TLS: false})
+	for _, ctx := range []context.Context{plain, context.Background()} {
+		if _, err := r.Authenticate(ctx, "alice@example.com", "secret"); !errors.Is(err, autherrors.ErrTLSRequired) {
+			t.Errorf("plaintext login: got %v, want ErrTLSRequired", err)
+		}
+	}
+
+	// TLS refusals are not counted as credential failures.
+	secure := WithConnInfo(context.Background(), ConnInfo{TLS: true})
+	session, err := r.Authenticate(secure, "alice@example.com", "secret")
+	if err != nil {
+		t.Fatalf("TLS login: %v", err)
+	}
+	session.Clear()
+
+	// The per-user override lets a legacy client log in without TLS.
+	session, err = r.Authenticate(plain, "legacy@example.com", "secret")
+	if err != nil {
+		t.Fatalf("legacy plaintext login: %v", err)
+	}
+	session.Clear()
+
+	d := p.GetDomain("example.com")
+	if req, err := d.RequiresTLS("alice"); err != nil || !req {
+		t.Errorf("RequiresTLS(alice) = %v, %v", req, err)
+	}
+	if req, err := d.RequiresTLS("legacy"); err != nil || req {
+		t.Errorf("RequiresTLS(legacy) = %v, %v", req, err)
+	}
+}
@@ -0,0 +1,260 @@
+package domain
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/infodancer/auth"
+)
+
+// DomainUsage is a snapshot of one domain's accounts for billing: how many
+// there are, which features they use and how much storage they are
+// assigned.
+type DomainUsage struct {
+	// Domain is the domain name.
+	Domain string `json:"domain"`
+
+	// Time is when the snapshot was taken.
+	Time time.Time `json:"time"`
+
+	// Users is the number of accounts, including disabled ones.
+	Users int `json:"users"`
+
+	// Disabled is the number of accounts flagged disabled (see
+	// auth.AccountStatus), which receive no mail.
+	Disabled int `json:"disabled"`
+
+	// Encrypted is the number of accounts with encryption enabled.
+	Encrypted int `json:"encrypted"`
+
+	// TOTP is the number of accounts enrolled in two-factor login.
+	TOTP int `json:"totp"`
+
+	// QuotaBytes is the sum of the storage quotas assigned to the domain's
+	// accounts in UserMetadata.
+	QuotaBytes int64 `json:"quota_bytes"`
+
+	// Unlisted is set when the domain's auth agent cannot enumerate its
+	// users (see auth.UserLister); the counts are then zero.
+	Unlisted bool `json:"unlisted,omitempty"`
+}
+
+// Usage returns a snapshot of the domain's accounts. Features the auth
+// agent does not support (keys, TOTP, account status) are counted as
+// unused.
+func (d *Domain) Usage(ctx context.Context) (DomainUsage, error) {
+	u := DomainUsage{Domain: d.Name, Time: time.Now().UTC()}
+	if d.AuthAgent == nil {
+		u.Unlisted = true
+		return u, nil
+	}
+	ul, ok := auth.AsUserLister(d.AuthAgent)
+	if !ok {
+		u.Unlisted = true
+		return u, nil
+	}
+	users, err := ul.ListUsers(ctx)
+	if err != nil {
+		return DomainUsage{}, fmt.Errorf("list users: %w", err)
+	}
+	md, err := d.userMetadata()
+	if err != nil {
+		return DomainUsage{}, err
+	}
+	kp, _ := auth.AsKeyProvider(d.AuthAgent)
+	mfa, _ := auth.AsMFAAgent(d.AuthAgent)
+	sp, _ := auth.AsAccountStatusProvider(d.AuthAgent)
+
+	u.Users = len(users)
+	for _, user := range users {
+		if kp != nil {
+			enc, err := kp.HasEncryption(ctx, user)
+			if err != nil {
+				return DomainUsage{}, fmt.Errorf("encryption for %s: %w", user, err)
+			}
+			if enc {
+				u.Encrypted++
+			}
+		}
+		if mfa != nil {
+			on, err := mfa.TOTPEnabled(ctx, user)
+			if err != nil {
+				return DomainUsage{}, fmt.Errorf("totp for %s: %w", user, err)
+			}
+			if on {
+				u.TOTP++
+			}
+		}
+		if sp != nil {
+			s, err := sp.AccountStatus(ctx, user)
+			if err != nil {
+				return DomainUsage{}, fmt.Errorf("account status for %s: %w", user, err)
+			}
+			if s.Disabled {
+				u.Disabled++
+			}
+		}
+		u.QuotaBytes += md[strings.ToLower(user)].QuotaBytes
+	}
+	return u, nil
+}
+
+// UsageReport returns a usage snapshot of every domain, in the order of
+// Domains. A domain that fails to load or to report aborts the report.
+// Loading every domain may evict others under ResourceLimits.
+func (p *FilesystemDomainProvider) UsageReport(ctx context.Context) ([]DomainUsage, error) {
+	var report []DomainUsage
+	for _, name := range p.Domains() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		d := p.GetDomain(name)
+		if d == nil {
+			return nil, fmt.Errorf("domain %q failed to load", name)
+		}
+		u, err := d.Usage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("usage of %s: %w", name, err)
+		}
+		report = append(report, u)
+	}
+	return report, nil
+}
+
+// WriteUsageJSON writes report to w as a JSON array.
+func WriteUsageJSON(w io.Writer, report []DomainUsage) error {
+	if report == nil {
+		report = []DomainUsage{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+// usageCSVHeader is the first record written by WriteUsageCSV.
+var usageCSVHeader = []string{"domain", "time", "users", "disabled", "encrypted", "totp", "quota_bytes", "unlisted"}
+
+// WriteUsageCSV writes report to w as CSV with a header record. Times are
+// RFC 3339 in UTC.
+func WriteUsageCSV(w io.Writer, report []DomainUsage) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(usageCSVHeader); err != nil {
+		return err
+	}
+	for _, u := range report {
+		if err := cw.Write([]string{
+			u.Domain,
+			u.Time.UTC().Format(time.RFC3339),
+			strconv.Itoa(u.Users),
+			strconv.Itoa(u.Disabled),
+			strconv.Itoa(u.Encrypted),
+			strconv.Itoa(u.TOTP),
+			strconv.FormatInt(u.QuotaBytes, 10),
+			strconv.FormatBool(u.Unlisted),
+		}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// UsageExporter writes periodic usage snapshots of a provider's domains to
+// a directory, one file per snapshot named usage-<UTC time>.json (or
+// .csv), for billing systems to collect. The latest snapshot is also kept
+// in memory (see Latest).
+type UsageExporter struct {
+	provider *FilesystemDomainProvider
+	dir      string
+	format   string
+	logger   *slog.Logger
+
+	mu     sync.Mutex // serializes RunOnce
+	latest []DomainUsage
+}
+
+// NewUsageExporter returns an exporter writing snapshots of provider's
+// domains into dir in format, "json" or "csv". logger may be nil for
+// slog.Default().
+func NewUsageExporter(provider *FilesystemDomainProvider, dir, format string, logger *slog.Logger) (*UsageExporter, error) {
+	if format != "json" && format != "csv" {
+		return nil, fmt.Errorf("unknown usage format %q: expected json or csv", format)
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &UsageExporter{provider: provider, dir: dir, format: format, logger: logger}, nil
+}
+
+// RunOnce takes a snapshot, writes it and returns the file's path. The
+// file appears complete or not at all.
+func (e *UsageExporter) RunOnce(ctx context.Context) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	report, err := e.provider.UsageReport(ctx)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	path := filepath.Join(e.dir, "usage-"+now.Format("20060102T150405Z")+"."+e.format)
+
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o640)
+	if err != nil {
+		return "", fmt.Errorf("create usage snapshot: %w", err)
+	}
+	if e.format == "csv" {
+		err = WriteUsageCSV(f, report)
+	} else {
+		err = WriteUsageJSON(f, report)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return "", fmt.Errorf("write usage snapshot: %w", err)
+	}
+	e.latest = report
+	return path, nil
+}
+
+// Latest returns the snapshot RunOnce last wrote; nil if none yet.
+func (e *UsageExporter) Latest() []DomainUsage {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.latest
+}
+
+// Run calls RunOnce every interval until ctx is cancelled. Errors are
+// logged only.
+func (e *UsageExporter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if path, err := e.RunOnce(ctx); err != nil && ctx.Err() == nil {
+			e.logger.Warn("usage snapshot failed", slog.String("error", err.Error()))
+		} else if err == nil {
+			e.logger.Debug("usage snapshot written", slog.String("path", path))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
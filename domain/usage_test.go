@@ -0,0 +1,99 @@
+package domain
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUsageReport(t *testing.T) {
+	p, base := newTestDomainsTree(t, "alice:x:alice\nbob:x:bob\nsvc:x:svc::disabled\n", "a.com", "b.com")
+	dir := filepath.Join(base, "a.com")
+	if err := os.WriteFile(filepath.Join(dir, UserMetadataFile), []byte(
+		"[alice]\nquota_bytes = 1000\n\n[Bob]\nquota_bytes = 500\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "keys", "alice.pub"), []byte("alice-public-key"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := p.UsageReport(context.Background())
+	if err != nil {
+		t.Fatalf("UsageReport: %v", err)
+	}
+	if len(report) != 2 {
+		t.Fatalf("got %d domains, want 2: %+v", len(report), report)
+	}
+	byName := map[string]DomainUsage{}
+	for _, u := range report {
+		if u.Time.IsZero() {
+			t.Errorf("%s: Time not set", u.Domain)
+		}
+		byName[u.Domain] = u
+	}
+	a := byName["a.com"]
+	if a.Users != 3 || a.Disabled != 1 || a.Encrypted != 1 || a.TOTP != 0 || a.QuotaBytes != 1500 || a.Unlisted {
+		t.Errorf("a.com usage = %+v", a)
+	}
+	if b := byName["b.com"]; b.Users != 3 || b.Encrypted != 0 || b.QuotaBytes != 0 {
+		t.Errorf("b.com usage = %+v", b)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteUsageJSON(&buf, report); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []DomainUsage
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil || len(decoded) != 2 {
+		t.Errorf("JSON round trip: %v, %+v", err, decoded)
+	}
+
+	buf.Reset()
+	if err := WriteUsageCSV(&buf, report); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil || len(records) != 3 || records[0][0] != "domain" {
+		t.Errorf("CSV = %v, %v", records, err)
+	}
+}
+
+func TestUsageExporter(t *testing.T) {
+	p, _ := newTestDomainsTree(t, "alice:x:alice\n", "example.com")
+	out := t.TempDir()
+
+	if _, err := NewUsageExporter(p, out, "xml", nil); err == nil {
+		t.Error("unknown format accepted")
+	}
+	e, err := NewUsageExporter(p, out, "csv", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Latest() != nil {
+		t.Error("Latest before first snapshot is not nil")
+	}
+	path, err := e.RunOnce(context.Background())
+	if err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+	if filepath.Dir(path) != out || filepath.Ext(path) != ".csv" {
+		t.Errorf("snapshot path = %q", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records, err := csv.NewReader(bytes.NewReader(data)).ReadAll(); err != nil || len(records) != 2 || records[1][0] != "example.com" {
+		t.Errorf("snapshot = %v, %v", records, err)
+	}
+	if latest := e.Latest(); len(latest) != 1 || latest[0].Users != 1 {
+		t.Errorf("Latest = %+v", latest)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(out, "*.tmp")); len(matches) != 0 {
+		t.Errorf("temporary files left: %v", matches)
+	}
+}
@@ -0,0 +1,68 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/wkd"
+)
+
+// WKDKeys returns the keys the domain publishes in its Web Key Directory,
+// by WKD hash of the localpart (see wkd.Hash): the OpenPGP keys of every
+// account the auth agent can enumerate (see auth.UserLister). Native keys
+// are not OpenPGP and are not published. Returns no keys when the auth
+// agent cannot enumerate users or provide keys.
+func (d *Domain) WKDKeys(ctx context.Context) (map[string][]byte, error) {
+	if d.AuthAgent == nil {
+		return nil, nil
+	}
+	ul, ok := auth.AsUserLister(d.AuthAgent)
+	if !ok {
+		return nil, nil
+	}
+	kp, ok := auth.AsKeyProvider(d.AuthAgent)
+	if !ok {
+		return nil, nil
+	}
+	users, err := ul.ListUsers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list users: %w", err)
+	}
+	keys := make(map[string][]byte)
+	for _, user := range users {
+		key, format, err := auth.PublicKeyWithFormat(ctx, kp, user)
+		switch {
+		case errors.Is(err, autherrors.ErrKeyNotFound):
+			continue
+		case err != nil:
+			return nil, fmt.Errorf("public key for %s@%s: %w", user, d.Name, err)
+		}
+		if format == auth.KeyFormatOpenPGP {
+			keys[wkd.Hash(user)] = key
+		}
+	}
+	return keys, nil
+}
+
+// NewWKDHandler returns a wkd.Handler publishing the WKDKeys of the
+// domains p serves.
+func NewWKDHandler(p DomainProvider) *wkd.Handler {
+	return wkd.NewHandler(func(ctx context.Context, name, hash string) ([]byte, error) {
+		d := p.GetDomain(name)
+		if d == nil {
+			return nil, wkd.ErrNotFound
+		}
+		keys, err := d.WKDKeys(ctx)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := keys[hash]
+		if !ok {
+			return nil, wkd.ErrNotFound
+		}
+		return key, nil
+	})
+}
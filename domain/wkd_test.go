@@ -0,0 +1,87 @@
+package domain
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/infodancer/auth/pgpkey"
+	"github.com/infodancer/auth/wkd"
+)
+
+func TestWKDKeys(t *testing.T) {
+	p, base := newTestDomainsTree(t, "alice:x:alice\nbob:x:bob\ncarol:x:carol\n", "example.com")
+	armored, err := os.ReadFile("../pgpkey/testdata/alice.asc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary, err := pgpkey.Decode(armored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDir := filepath.Join(base, "example.com", "keys")
+	if err := os.WriteFile(filepath.Join(keyDir, "alice.pub"), armored, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// bob's native key is not OpenPGP; carol has none.
+	if err := os.WriteFile(filepath.Join(keyDir, "bob.pub"), bytes.Repeat([]byte{1}, 32), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := p.GetDomain("example.com")
+	if d == nil {
+		t.Fatal("expected domain to load")
+	}
+	keys, err := d.WKDKeys(context.Background())
+	if err != nil {
+		t.Fatalf("WKDKeys: %v", err)
+	}
+	if len(keys) != 1 || !bytes.Equal(keys[wkd.Hash("alice")], binary) {
+		t.Errorf("WKDKeys = %d keys", len(keys))
+	}
+
+	srv := httptest.NewServer(NewWKDHandler(p))
+	defer srv.Close()
+	get := func(host, path string) (int, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, body
+	}
+
+	if code, body := get("openpgpkey.example.com", "/.well-known/openpgpkey/example.com/hu/"+wkd.Hash("Alice")+"?l=Alice"); code != http.StatusOK || !bytes.Equal(body, binary) {
+		t.Errorf("advanced: %d, %d bytes", code, len(body))
+	}
+	if code, body := get("example.com:443", "/.well-known/openpgpkey/hu/"+wkd.Hash("alice")); code != http.StatusOK || !bytes.Equal(body, binary) {
+		t.Errorf("direct: %d, %d bytes", code, len(body))
+	}
+	for _, path := range []string{"/.well-known/openpgpkey/example.com/policy", "/.well-known/openpgpkey/policy"} {
+		if code, _ := get("example.com", path); code != http.StatusOK {
+			t.Errorf("%s: %d", path, code)
+		}
+	}
+	for _, path := range []string{
+		"/.well-known/openpgpkey/example.com/hu/" + wkd.Hash("bob"),
+		"/.well-known/openpgpkey/example.com/hu/" + wkd.Hash("carol"),
+		"/.well-known/openpgpkey/other.test/hu/" + wkd.Hash("alice"),
+		"/.well-known/openpgpkey/example.com/hu/short",
+	} {
+		if code, _ := get("example.com", path); code != http.StatusNotFound {
+			t.Errorf("%s: %d, want 404", path, code)
+		}
+	}
+}
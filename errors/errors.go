@@ -1,7 +1,10 @@
 // Package errors provides centralized error definitions for auth.
 package errors
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 // Authentication errors.
 var (
@@ -15,6 +18,75 @@ var (
 	// Callers should return a temporary failure (e.g., SMTP 421) rather
 	// than a credentials-invalid response.
 	ErrRateLimited = errors.New("too many failed authentication attempts")
+
+	// ErrLoginDenied indicates valid credentials were refused by policy
+	// (e.g., an anomaly scorer judged the login too risky).
+	ErrLoginDenied = errors.New("login denied by policy")
+
+	// ErrStepUpRequired indicates valid credentials need an additional
+	// verification step before the login may proceed.
+	ErrStepUpRequired = errors.New("additional verification required")
+
+	// ErrMFARequired indicates the password was correct but the user has a
+	// second factor enrolled: the login completes only after the caller
+	// verifies a one-time code (see auth.MFAAgent).
+	ErrMFARequired = errors.New("second factor required")
+
+	// ErrTLSRequired indicates the user may only authenticate over an
+	// encrypted connection. Daemons should offer STARTTLS and retry rather
+	// than report invalid credentials.
+	ErrTLSRequired = errors.New("authentication requires an encrypted connection")
+
+	// ErrAccountDisabled indicates the credentials were valid but the
+	// account is disabled, locked or may not log in (see
+	// auth.AccountStatus). Daemons should report it as a permanent refusal
+	// rather than as invalid credentials.
+	ErrAccountDisabled = errors.New("account disabled")
+
+	// ErrDomainFrozen indicates the user's domain is frozen for abuse
+	// handling, so no account in it may log in. It wraps
+	// ErrAccountDisabled, so callers handling that need no change.
+	ErrDomainFrozen = fmt.Errorf("%w: domain frozen", ErrAccountDisabled)
+
+	// ErrServiceDenied indicates the credentials were valid but the account
+	// is not entitled to the service the login arrived on, such as IMAP for
+	// a send-only account (see auth.ServiceSet). It wraps
+	// ErrAccountDisabled, so callers handling that need no change.
+	ErrServiceDenied = fmt.Errorf("%w: service not allowed", ErrAccountDisabled)
+
+	// ErrAccessDenied indicates the user may not authenticate from the
+	// client's address. It is returned before the credentials are checked,
+	// so it says nothing about them.
+	ErrAccessDenied = errors.New("authentication not allowed from this address")
+
+	// ErrMechanismUnsupported indicates the agent cannot verify credentials
+	// of the requested mechanism (see auth.Credentials). Daemons should not
+	// have offered the mechanism for the user's domain.
+	ErrMechanismUnsupported = errors.New("authentication mechanism not supported")
+
+	// ErrAuthorizationDenied indicates the authenticated user may not act
+	// as the requested authorization identity.
+	ErrAuthorizationDenied = errors.New("not authorized to act as the requested identity")
+
+	// ErrBackendUnavailable indicates the domain's auth backend (e.g., a
+	// directory or database server) could not be reached, so nothing is
+	// known about the credentials. Callers should return a temporary
+	// failure (e.g., SMTP 454 or 451) so the client retries later.
+	ErrBackendUnavailable = errors.New("authentication backend unavailable")
+
+	// ErrTokenExpired indicates a session token was valid once but has
+	// expired (see auth.AuthTokenAgent), so the user must log in again. It
+	// wraps ErrAuthFailed, so callers handling that need no change.
+	ErrTokenExpired = fmt.Errorf("%w: session token expired", ErrAuthFailed)
+
+	// ErrSessionRevoked indicates a session token is validly signed and
+	// unexpired but its session was revoked (see auth.SessionStore). It
+	// wraps ErrAuthFailed, so callers handling that need no change.
+	ErrSessionRevoked = fmt.Errorf("%w: session revoked", ErrAuthFailed)
+
+	// ErrSessionNotFound indicates a user has no active session with the
+	// given ID, so there is nothing to revoke.
+	ErrSessionNotFound = errors.New("session not found")
 )
 
 // Authentication agent errors.
@@ -34,6 +106,66 @@ var (
 	// ErrInvalidKeyFormat indicates the key file has an invalid format.
 	ErrInvalidKeyFormat = errors.New("invalid key format")
 
+	// ErrKeyExists indicates the user already has a key pair, which
+	// generating another would orphan mail encrypted to it.
+	ErrKeyExists = errors.New("key already exists")
+
 	// ErrEncryptionNotEnabled indicates encryption is not enabled for the user.
 	ErrEncryptionNotEnabled = errors.New("encryption not enabled")
+
+	// ErrKeyPassphraseRequired indicates the password was correct but the
+	// login needs the user's separate key passphrase (see
+	// auth.WithKeyPassphrase), because their second factor is sealed under
+	// the key. It wraps ErrKeyDecryptFailed.
+	ErrKeyPassphraseRequired = fmt.Errorf("%w: key passphrase required", ErrKeyDecryptFailed)
+)
+
+// Forwarding errors.
+var (
+	// ErrForwardLoop indicates forwarding rules form a cycle that never
+	// reaches a final recipient.
+	ErrForwardLoop = errors.New("forwarding loop detected")
+
+	// ErrForwardDepthExceeded indicates forwarding expansion exceeded the
+	// maximum number of hops.
+	ErrForwardDepthExceeded = errors.New("forwarding depth exceeded")
+
+	// ErrForwardFanOutExceeded indicates a message would expand through
+	// forwards to more final recipients than its domain allows.
+	ErrForwardFanOutExceeded = errors.New("forwarding fan-out limit exceeded")
+)
+
+// Domain provisioning errors.
+var (
+	// ErrDomainExists indicates a domain directory already exists.
+	ErrDomainExists = errors.New("domain already exists")
+
+	// ErrInvalidDomainName indicates a domain name is empty or contains
+	// characters not allowed in a domain directory name.
+	ErrInvalidDomainName = errors.New("invalid domain name")
+
+	// ErrTemplateNotFound indicates the named domain template does not exist.
+	ErrTemplateNotFound = errors.New("domain template not found")
+
+	// ErrRoleAccountMissing indicates a required RFC 2142 role address
+	// (e.g., postmaster) has neither an account nor a forward.
+	ErrRoleAccountMissing = errors.New("required role account missing")
+)
+
+// Replication errors.
+var (
+	// ErrReadOnly indicates a mutation was attempted on a host running in
+	// read-only mode (e.g., a secondary MX replicating from a primary).
+	ErrReadOnly = errors.New("read-only mode: changes must be made on the primary")
+)
+
+// Shared-storage coordination errors.
+var (
+	// ErrLeaseHeld indicates another host holds the lease on a resource
+	// that is about to be modified.
+	ErrLeaseHeld = errors.New("resource is locked by another host")
+
+	// ErrLeaseLost indicates a lease expired or was taken over before the
+	// holder finished, so its fencing token is no longer current.
+	ErrLeaseLost = errors.New("lease lost")
 )
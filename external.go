@@ -0,0 +1,42 @@
+package auth
+
+import "context"
+
+// ExternalIdentity is an identity a connection established before the
+// login, such as a verified TLS client certificate, for SASL EXTERNAL.
+// The daemon terminating TLS verifies the chain; agents only map the
+// certificate to a user.
+type ExternalIdentity struct {
+	// Username is the user to log in as. The domain.AuthRouter passes
+	// the routed username (the localpart, for domain agents).
+	Username string
+
+	// Fingerprint is the lowercase hex SHA-256 of the DER certificate.
+	Fingerprint string
+
+	// Subject is the certificate subject as pkix.Name.String formats it.
+	Subject string
+
+	// Emails are the certificate's email subject alternative names.
+	Emails []string
+}
+
+// ExternalAuthenticator is implemented by agents that log users in with
+// an ExternalIdentity instead of a password.
+type ExternalAuthenticator interface {
+	// AuthenticateExternal opens a session for identity.Username if the
+	// agent maps the identity to them. Returns errors.ErrAuthFailed for a
+	// certificate not mapped to the user and errors.ErrUserNotFound for
+	// users the agent does not know. The session has Credential.Kind
+	// CredentialCertificate and no private key.
+	AuthenticateExternal(ctx context.Context, identity ExternalIdentity) (*AuthSession, error)
+}
+
+// AsExternalAuthenticator returns agent as an ExternalAuthenticator if it
+// supports one according to Capabilities.
+func AsExternalAuthenticator(agent AuthenticationAgent) (ExternalAuthenticator, bool) {
+	if ea, ok := agent.(ExternalAuthenticator); ok && Capabilities(agent).External {
+		return ea, true
+	}
+	return nil, false
+}
@@ -0,0 +1,86 @@
+package forwards
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/infodancer/auth/address"
+	"github.com/infodancer/auth/diagnostic"
+)
+
+// Check reports the problems in the forwards file at path: lines Load
+// skips or overrides, and targets that cannot be delivered to. A missing
+// file has no problems. The error is for files that cannot be read.
+func Check(path string) ([]diagnostic.Problem, error) {
+	_, problems, err := LoadWith(path, LoadOptions{})
+	return problems, err
+}
+
+// CheckMap reports the problems in rules from a [forwards] TOML section,
+// attributed to file (the config file they came from). TOML has no line
+// numbers to give, so problems are ordered by localpart.
+func CheckMap(file string, rules map[string]string) []diagnostic.Problem {
+	keys := make([]string, 0, len(rules))
+	for k := range rules {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var problems []diagnostic.Problem
+	for _, k := range keys {
+		problems = append(problems, checkRule(file, 0, strings.ToLower(k), rules[k])...)
+	}
+	return problems
+}
+
+// checkRule reports the problems in one rule's comma-separated targets.
+func checkRule(file string, line int, key, value string) []diagnostic.Problem {
+	problem := func(sev diagnostic.Severity, code, msg, fix string) diagnostic.Problem {
+		return diagnostic.Problem{Severity: sev, Code: code, File: file, Line: line, Message: msg, Fix: fix}
+	}
+	var problems []diagnostic.Problem
+	if key == "" {
+		problems = append(problems, problem(diagnostic.Error, "forwards.empty-localpart",
+			"rule has no localpart", `name the localpart, or use "*" for a catchall`))
+	}
+	targets := 0
+	for _, s := range strings.Split(value, ",") {
+		fields := strings.Fields(s)
+		if len(fields) == 0 {
+			continue
+		}
+		targets++
+		t := ParseTarget(s)
+		if name, ok := t.Folder(); ok {
+			if name == "" {
+				problems = append(problems, problem(diagnostic.Error, "forwards.bad-folder",
+					fmt.Sprintf("%q is not a usable folder name", t.Address),
+					`use a name without "/", such as =Archive`))
+			}
+		} else if _, err := address.Parse(t.Address); err != nil {
+			problems = append(problems, problem(diagnostic.Error, "forwards.bad-target",
+				fmt.Sprintf("target %q is not an address", t.Address),
+				"write targets as user@domain"))
+		}
+		for _, f := range fields[1:] {
+			k, v, ok := strings.Cut(f, "=")
+			if !ok {
+				problems = append(problems, problem(diagnostic.Warning, "forwards.bad-hint",
+					fmt.Sprintf("hint %q on %s is not key=value and is ignored", f, fields[0]), ""))
+				continue
+			}
+			if strings.EqualFold(k, "priority") {
+				if _, err := strconv.Atoi(v); err != nil {
+					problems = append(problems, problem(diagnostic.Warning, "forwards.bad-priority",
+						fmt.Sprintf("priority %q on %s is not a number and is ignored", v, fields[0]), ""))
+				}
+			}
+		}
+	}
+	if targets == 0 {
+		problems = append(problems, problem(diagnostic.Error, "forwards.no-targets",
+			fmt.Sprintf("rule for %q has no targets and is ignored", key), ""))
+	}
+	return problems
+}
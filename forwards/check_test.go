@@ -0,0 +1,106 @@
+package forwards
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/infodancer/auth/diagnostic"
+)
+
+// codes returns "line:code" for each problem.
+func codes(problems []diagnostic.Problem) []string {
+	out := make([]string, len(problems))
+	for i, p := range problems {
+		out[i] = p.Code
+		if p.Line > 0 {
+			out[i] = fmt.Sprintf("%d:%s", p.Line, p.Code)
+		}
+	}
+	return out
+}
+
+func TestCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "forwards")
+	content := `# comment
+sales:alice@example.com, bob@example.com priority=2
+broken line
+info:
+sales:carol@example.com
+archive:=Archive, =../x
+typo:alice, dave@example.com priority=high
+hint:erin@example.com via
+`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := Check(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"3:forwards.malformed",
+		"4:forwards.no-targets",
+		"5:forwards.duplicate",
+		"6:forwards.bad-folder",
+		"7:forwards.bad-target",
+		"7:forwards.bad-priority",
+		"8:forwards.bad-hint",
+	}
+	got := codes(problems)
+	if len(got) != len(want) {
+		t.Fatalf("problems = %v\nwant %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("problem %d = %s, want %s", i, got[i], want[i])
+		}
+	}
+	for _, p := range problems {
+		if p.File != path {
+			t.Errorf("%s: file = %q", p.Code, p.File)
+		}
+	}
+	if problems[0].Severity != diagnostic.Error || problems[2].Severity != diagnostic.Warning {
+		t.Errorf("severities = %v, %v", problems[0].Severity, problems[2].Severity)
+	}
+}
+
+func TestCheck_MissingFile(t *testing.T) {
+	problems, err := Check(filepath.Join(t.TempDir(), "forwards"))
+	if err != nil || problems != nil {
+		t.Errorf("Check(missing) = %v, %v", problems, err)
+	}
+}
+
+func TestCheckMap(t *testing.T) {
+	problems := CheckMap("config.toml", map[string]string{
+		"ok":    "alice@example.com",
+		"bad":   "nobody",
+		"empty": " , ",
+		"*":     "catchall@example.com",
+	})
+	got := codes(problems)
+	want := []string{"forwards.bad-target", "forwards.no-targets"}
+	if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("problems = %v, want %v", got, want)
+	}
+	if problems[0].File != "config.toml" || problems[0].Line != 0 {
+		t.Errorf("location = %s:%d", problems[0].File, problems[0].Line)
+	}
+}
+
+func TestCheckMap_AddressSyntax(t *testing.T) {
+	problems := CheckMap("config.toml", map[string]string{
+		"quoted":  `"a..b"@example.com`,
+		"idn":     "jörg@bücher.example",
+		"comment": "alice(work)@example.com",
+		"dots":    "al..ice@example.com",
+		"domain":  "alice@example..com",
+	})
+	got := codes(problems)
+	if len(got) != 2 || got[0] != "forwards.bad-target" || got[1] != "forwards.bad-target" {
+		t.Errorf("problems = %v, want two forwards.bad-target", got)
+	}
+}
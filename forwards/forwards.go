@@ -4,9 +4,14 @@ package forwards
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"strings"
+
+	"github.com/infodancer/auth/atrest"
+	"github.com/infodancer/auth/diagnostic"
 )
 
 // ForwardMap holds mail forwarding rules loaded from a forwards file.
@@ -18,28 +23,62 @@ import (
 //	# comment lines and blank lines are ignored
 //
 // The * wildcard is a catchall for any localpart not matched exactly.
-// Multiple targets may be listed as a comma-separated value.
+// Multiple targets may be listed as a comma-separated value. Each target may
+// carry routing hints (see Target).
 type ForwardMap struct {
-	exact    map[string][]string // localpart → forwarding targets
-	catchall []string            // targets for the * wildcard
+	exact    map[string][]Target // localpart → forwarding targets
+	catchall []Target            // targets for the * wildcard
+}
+
+// ErrMalformed is returned by LoadWith in strict mode when the forwards
+// file has error-severity problems.
+var ErrMalformed = errors.New("forwards: malformed rules")
+
+// LoadOptions configures LoadWith. The zero value loads leniently.
+type LoadOptions struct {
+	// Strict fails the load with ErrMalformed when any line is broken
+	// (an error-severity problem, see Check), instead of loading the rest.
+	// Use it where a skipped rule would misroute mail unnoticed.
+	Strict bool
 }
 
 // Load reads forwarding rules from path.
-// A missing file is treated as empty (no forwards), not an error.
+// A missing file is treated as empty (no forwards), not an error. Files
+// sealed with the host key (see package atrest) are decrypted transparently.
+//
+// Malformed lines are skipped and logged to slog.Default(). New code
+// should use LoadWith, which returns them as problems.
 func Load(path string) (*ForwardMap, error) {
-	m := &ForwardMap{exact: make(map[string][]string)}
+	m, problems, err := LoadWith(path, LoadOptions{})
+	for _, p := range problems {
+		if p.Severity == diagnostic.Error {
+			slog.Warn("forwards: rule ignored", slog.String("problem", p.String()))
+		}
+	}
+	return m, err
+}
 
-	f, err := os.Open(path)
+// LoadWith reads forwarding rules from path like Load and returns the
+// problems Check would report alongside them. Lines with error-severity
+// problems that leave no usable rule are skipped, unless opts.Strict is
+// set, in which case no map is returned and the error wraps ErrMalformed.
+// The problems are returned either way.
+func LoadWith(path string, opts LoadOptions) (*ForwardMap, []diagnostic.Problem, error) {
+	m := &ForwardMap{exact: make(map[string][]Target)}
+
+	f, err := atrest.Open(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return m, nil
+			return m, nil, nil
 		}
-		return nil, fmt.Errorf("open forwards file: %w", err)
+		return nil, nil, fmt.Errorf("open forwards file: %w", err)
 	}
 	defer func() { _ = f.Close() }()
 
+	var problems []diagnostic.Problem
+	seen := make(map[string]int) // key → line of its first rule
 	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
+	for n := 1; scanner.Scan(); n++ {
 		line := strings.TrimSpace(scanner.Text())
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
@@ -47,17 +86,32 @@ func Load(path string) (*ForwardMap, error) {
 
 		key, value, ok := strings.Cut(line, ":")
 		if !ok {
-			continue // malformed line, skip silently
+			problems = append(problems, diagnostic.Problem{
+				Severity: diagnostic.Error,
+				Code:     "forwards.malformed",
+				File:     path,
+				Line:     n,
+				Message:  "line has no \"localpart:targets\" separator and is ignored",
+				Fix:      "write the rule as localpart:target@domain",
+			})
+			continue
 		}
 		key = strings.TrimSpace(strings.ToLower(key))
-
-		var targets []string
-		for _, t := range strings.Split(value, ",") {
-			t = strings.TrimSpace(strings.ToLower(t))
-			if t != "" {
-				targets = append(targets, t)
-			}
+		if first, dup := seen[key]; dup {
+			problems = append(problems, diagnostic.Problem{
+				Severity: diagnostic.Warning,
+				Code:     "forwards.duplicate",
+				File:     path,
+				Line:     n,
+				Message:  fmt.Sprintf("rule for %q replaces the one on line %d", key, first),
+				Fix:      "merge the targets into one rule",
+			})
+		} else {
+			seen[key] = n
 		}
+		problems = append(problems, checkRule(path, n, key, value)...)
+
+		targets := parseTargetList(value)
 		if len(targets) == 0 {
 			continue
 		}
@@ -69,18 +123,34 @@ func Load(path string) (*ForwardMap, error) {
 		}
 	}
 	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("read forwards file: %w", err)
+		return nil, nil, fmt.Errorf("read forwards file: %w", err)
 	}
 
-	return m, nil
+	if opts.Strict {
+		for _, p := range problems {
+			if p.Severity == diagnostic.Error {
+				return nil, problems, fmt.Errorf("%w: %s", ErrMalformed, p)
+			}
+		}
+	}
+	return m, problems, nil
 }
 
-// LoadTargets reads a per-user forwards file.
-// The file contains one forwarding target address per line with no localpart
-// key — the filename itself is the key (the localpart).
+// LoadTargets reads a per-user forwards file and returns the target addresses.
+// The file contains one forwarding target per line with no localpart key —
+// the filename itself is the key (the localpart). Routing hints are dropped;
+// use LoadTargetEntries to keep them.
 // Returns nil, nil if the file does not exist.
 func LoadTargets(path string) ([]string, error) {
-	f, err := os.Open(path)
+	targets, err := LoadTargetEntries(path)
+	return Addresses(targets), err
+}
+
+// LoadTargetEntries reads a per-user forwards file like LoadTargets but
+// returns each line parsed as a Target, including routing hints.
+// Returns nil, nil if the file does not exist.
+func LoadTargetEntries(path string) ([]Target, error) {
+	f, err := atrest.Open(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, nil
@@ -89,11 +159,14 @@ func LoadTargets(path string) ([]string, error) {
 	}
 	defer func() { _ = f.Close() }()
 
-	var targets []string
+	var targets []Target
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
-		t := strings.TrimSpace(strings.ToLower(scanner.Text()))
-		if t != "" && !strings.HasPrefix(t, "#") {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if t := ParseTarget(line); t.Address != "" {
 			targets = append(targets, t)
 		}
 	}
@@ -108,14 +181,9 @@ func LoadTargets(path string) ([]string, error) {
 // stored in a [forwards] TOML section rather than a separate file.
 // The special key "*" sets the catchall rule. A nil map produces an empty map.
 func FromMap(m map[string]string) *ForwardMap {
-	fm := &ForwardMap{exact: make(map[string][]string)}
+	fm := &ForwardMap{exact: make(map[string][]Target)}
 	for k, v := range m {
-		var targets []string
-		for _, t := range strings.Split(v, ",") {
-			if t = strings.TrimSpace(strings.ToLower(t)); t != "" {
-				targets = append(targets, t)
-			}
-		}
+		targets := parseTargetList(v)
 		if len(targets) == 0 {
 			continue
 		}
@@ -128,21 +196,35 @@ func FromMap(m map[string]string) *ForwardMap {
 	return fm
 }
 
-// Resolve returns the forwarding targets for localpart.
+// Resolve returns the forwarding target addresses for localpart.
 // It checks for an exact match first, then falls back to the catchall (*).
 // Returns (nil, false) if no forwarding rule applies.
 func (m *ForwardMap) Resolve(localpart string) ([]string, bool) {
+	targets, ok := m.ResolveTargets(localpart)
+	return Addresses(targets), ok
+}
+
+// ResolveTargets is like Resolve but returns targets with their routing hints.
+// The returned slice must not be modified.
+func (m *ForwardMap) ResolveTargets(localpart string) ([]Target, bool) {
+	targets, _, ok := m.Match(localpart)
+	return targets, ok
+}
+
+// Match is like ResolveTargets but also reports whether the targets came
+// from the catchall rule rather than an exact match.
+func (m *ForwardMap) Match(localpart string) (targets []Target, catchall, ok bool) {
 	if m == nil {
-		return nil, false
+		return nil, false, false
 	}
 	localpart = strings.ToLower(localpart)
 	if targets, ok := m.exact[localpart]; ok {
-		return targets, true
+		return targets, false, true
 	}
 	if len(m.catchall) > 0 {
-		return m.catchall, true
+		return m.catchall, true, true
 	}
-	return nil, false
+	return nil, false, false
 }
 
 // UserExists reports whether localpart has a forwarding rule (exact or catchall).
@@ -1,10 +1,12 @@
 package forwards_test
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/infodancer/auth/atrest"
 	"github.com/infodancer/auth/forwards"
 )
 
@@ -244,3 +246,77 @@ func TestFromMap_Empty(t *testing.T) {
 		t.Error("expected empty map from empty input")
 	}
 }
+
+func TestLoad_SealedFile(t *testing.T) {
+	k, err := atrest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	atrest.SetKey(k)
+	t.Cleanup(func() { atrest.SetKey(nil) })
+
+	path := filepath.Join(t.TempDir(), "forwards")
+	if err := atrest.WriteFile(path, []byte("info:alice@example.com\n"), 0o640, true); err != nil {
+		t.Fatal(err)
+	}
+	m, err := forwards.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets, ok := m.Resolve("info")
+	if !ok || len(targets) != 1 || targets[0] != "alice@example.com" {
+		t.Errorf("Resolve(info) = %v, %v", targets, ok)
+	}
+}
+
+func TestMatch_ReportsCatchall(t *testing.T) {
+	m := forwards.FromMap(map[string]string{
+		"info": "alice@example.com",
+		"*":    "catchall@example.com",
+	})
+	if _, catchall, ok := m.Match("INFO"); !ok || catchall {
+		t.Errorf("Match(INFO): ok=%v catchall=%v, want exact match", ok, catchall)
+	}
+	if targets, catchall, ok := m.Match("other"); !ok || !catchall || targets[0].Address != "catchall@example.com" {
+		t.Errorf("Match(other) = %v, %v, %v; want catchall", targets, catchall, ok)
+	}
+	if _, _, ok := forwards.FromMap(nil).Match("info"); ok {
+		t.Error("expected no match on empty map")
+	}
+}
+
+func TestLoadWith_Problems(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "forwards")
+	content := "alice:alice@other.com\nbob bob@other.com\ncarol:\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, problems, err := forwards.LoadWith(path, forwards.LoadOptions{})
+	if err != nil {
+		t.Fatalf("lenient load: %v", err)
+	}
+	if _, ok := m.Resolve("alice"); !ok {
+		t.Error("expected alice's rule to load")
+	}
+	if m.UserExists("bob") || m.UserExists("carol") {
+		t.Error("expected broken rules to be skipped")
+	}
+	if len(problems) != 2 || problems[0].Code != "forwards.malformed" || problems[0].Line != 2 ||
+		problems[1].Code != "forwards.no-targets" || problems[1].Line != 3 {
+		t.Errorf("problems = %v", problems)
+	}
+
+	m, problems, err = forwards.LoadWith(path, forwards.LoadOptions{Strict: true})
+	if !errors.Is(err, forwards.ErrMalformed) || m != nil || len(problems) != 2 {
+		t.Errorf("strict load = %v, %v, %v; want ErrMalformed", m, problems, err)
+	}
+
+	// Warnings alone do not fail a strict load.
+	if err := os.WriteFile(path, []byte("alice:a@x.com\nalice:b@x.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, problems, err := forwards.LoadWith(path, forwards.LoadOptions{Strict: true}); err != nil || len(problems) != 1 {
+		t.Errorf("strict load with duplicate = %v, %v", problems, err)
+	}
+}
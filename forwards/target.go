@@ -0,0 +1,144 @@
+package forwards
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Target is a forwarding target with optional routing hints.
+//
+// In forwards files and [forwards] sections a target is an address optionally
+// followed by whitespace-separated key=value hints:
+//
+//	alice:alice@other.com via=relay1 priority=2, backup@example.net
+//
+// Hints are only meaningful for targets on domains not served locally; they
+// tell the relay hook which outbound path to use.
+//
+// A target of the form "=Folder" is not an address: it files the message
+// into that folder of the recipient's own mailbox (see Folder).
+//
+//	alice:=Archive, alice-backup@example.net
+type Target struct {
+	// Address is the lowercased target address, or "=Folder" with the
+	// folder name's case preserved.
+	Address string
+
+	// Via names the outbound path (relay) to use, empty for the default.
+	Via string
+
+	// Priority orders delivery among targets of one rule; lower values are
+	// attempted first. Targets without a priority default to 0.
+	Priority int
+
+	// Hints holds any other key=value annotations, keys lowercased.
+	// nil when there are none.
+	Hints map[string]string
+}
+
+// ParseTarget parses a single target with optional routing hints.
+// Unparseable priority values are ignored. Returns a Target with an empty
+// Address if s contains no address.
+func ParseTarget(s string) Target {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return Target{}
+	}
+	t := Target{Address: fields[0]}
+	if !strings.HasPrefix(t.Address, "=") {
+		t.Address = strings.ToLower(t.Address)
+	}
+	for _, f := range fields[1:] {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok {
+			continue
+		}
+		k = strings.ToLower(k)
+		switch k {
+		case "via":
+			t.Via = v
+		case "priority":
+			if n, err := strconv.Atoi(v); err == nil {
+				t.Priority = n
+			}
+		default:
+			if t.Hints == nil {
+				t.Hints = make(map[string]string)
+			}
+			t.Hints[k] = v
+		}
+	}
+	return t
+}
+
+// Folder reports whether t files into a folder of the recipient's mailbox
+// rather than forwarding, and returns the folder name. ok is false for
+// address targets. A folder target with an unusable name (empty, ".",
+// "..", or containing "/" or NUL) returns ok with an empty name, which
+// callers must reject.
+func (t Target) Folder() (name string, ok bool) {
+	name, ok = strings.CutPrefix(t.Address, "=")
+	if !ok {
+		return "", false
+	}
+	if name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return "", true
+	}
+	return name, true
+}
+
+// String formats t in the same syntax accepted by ParseTarget.
+func (t Target) String() string {
+	var b strings.Builder
+	b.WriteString(t.Address)
+	if t.Via != "" {
+		b.WriteString(" via=" + t.Via)
+	}
+	if t.Priority != 0 {
+		b.WriteString(" priority=" + strconv.Itoa(t.Priority))
+	}
+	keys := make([]string, 0, len(t.Hints))
+	for k := range t.Hints {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteString(" " + k + "=" + t.Hints[k])
+	}
+	return b.String()
+}
+
+// parseTargetList splits a comma-separated target list, dropping empties.
+func parseTargetList(value string) []Target {
+	var targets []Target
+	for _, s := range strings.Split(value, ",") {
+		if t := ParseTarget(s); t.Address != "" {
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
+
+// SortByPriority orders targets by ascending Priority, keeping the original
+// order among equal priorities.
+func SortByPriority(targets []Target) {
+	sort.SliceStable(targets, func(i, j int) bool {
+		return targets[i].Priority < targets[j].Priority
+	})
+}
+
+// Addresses returns the Address of each target, leaving out folder targets,
+// which are not addresses.
+func Addresses(targets []Target) []string {
+	if targets == nil {
+		return nil
+	}
+	out := make([]string, 0, len(targets))
+	for _, t := range targets {
+		if _, folder := t.Folder(); !folder {
+			out = append(out, t.Address)
+		}
+	}
+	return out
+}
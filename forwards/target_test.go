@@ -0,0 +1,127 @@
+package forwards_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/infodancer/auth/forwards"
+)
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		input string
+		want  forwards.Target
+	}{
+		{"Alice@Other.com", forwards.Target{Address: "alice@other.com"}},
+		{"  bob@x.org  via=relay1 ", forwards.Target{Address: "bob@x.org", Via: "relay1"}},
+		{"c@x.org priority=2", forwards.Target{Address: "c@x.org", Priority: 2}},
+		{"d@x.org priority=high", forwards.Target{Address: "d@x.org"}},
+		{"", forwards.Target{}},
+	}
+	for _, tt := range tests {
+		got := forwards.ParseTarget(tt.input)
+		if got.Address != tt.want.Address || got.Via != tt.want.Via || got.Priority != tt.want.Priority {
+			t.Errorf("ParseTarget(%q) = %+v, want %+v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestParseTarget_ExtraHints(t *testing.T) {
+	got := forwards.ParseTarget("a@x.org TLS=required via=r2")
+	if got.Hints["tls"] != "required" {
+		t.Errorf("expected tls hint, got %v", got.Hints)
+	}
+	if got.String() != "a@x.org via=r2 tls=required" {
+		t.Errorf("String() = %q", got.String())
+	}
+}
+
+func TestSortByPriority_Stable(t *testing.T) {
+	targets := []forwards.Target{
+		{Address: "a", Priority: 2},
+		{Address: "b"},
+		{Address: "c", Priority: 1},
+		{Address: "d"},
+	}
+	forwards.SortByPriority(targets)
+	got := forwards.Addresses(targets)
+	want := []string{"b", "d", "c", "a"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("SortByPriority order = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestLoad_TargetsWithHints(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "forwards")
+	content := "alice:alice@other.com via=relay1 priority=2, alice@backup.net\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := forwards.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addrs, ok := m.Resolve("alice")
+	if !ok || len(addrs) != 2 || addrs[0] != "alice@other.com" || addrs[1] != "alice@backup.net" {
+		t.Errorf("Resolve should return bare addresses, got %v", addrs)
+	}
+
+	targets, ok := m.ResolveTargets("alice")
+	if !ok || len(targets) != 2 {
+		t.Fatalf("expected 2 targets, got %v", targets)
+	}
+	if targets[0].Via != "relay1" || targets[0].Priority != 2 {
+		t.Errorf("hints not parsed: %+v", targets[0])
+	}
+}
+
+func TestLoadTargetEntries_WithHints(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "alice")
+	if err := os.WriteFile(path, []byte("# note\nalice@other.com via=relay2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	targets, err := forwards.LoadTargetEntries(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 || targets[0].Via != "relay2" {
+		t.Errorf("unexpected targets: %+v", targets)
+	}
+
+	addrs, err := forwards.LoadTargets(path)
+	if err != nil || len(addrs) != 1 || addrs[0] != "alice@other.com" {
+		t.Errorf("LoadTargets = %v, %v", addrs, err)
+	}
+}
+
+func TestTarget_Folder(t *testing.T) {
+	tests := []struct {
+		input  string
+		folder string
+		ok     bool
+	}{
+		{"=Archive", "Archive", true},
+		{"=Lists.Go priority=1", "Lists.Go", true},
+		{"alice@example.com", "", false},
+		{"=../etc", "", true},
+		{"=..", "", true},
+		{"=", "", true},
+	}
+	for _, tt := range tests {
+		folder, ok := forwards.ParseTarget(tt.input).Folder()
+		if folder != tt.folder || ok != tt.ok {
+			t.Errorf("ParseTarget(%q).Folder() = %q, %v; want %q, %v", tt.input, folder, ok, tt.folder, tt.ok)
+		}
+	}
+
+	targets := []forwards.Target{forwards.ParseTarget("=Archive"), forwards.ParseTarget("bob@x.org")}
+	if got := forwards.Addresses(targets); len(got) != 1 || got[0] != "bob@x.org" {
+		t.Errorf("Addresses = %v, want only bob@x.org", got)
+	}
+}
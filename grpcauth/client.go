@@ -0,0 +1,226 @@
+package grpcauth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/domain"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// Options configures a Client.
+type Options struct {
+	// Target is the server URL. https:// uses HTTP/2 over TLS; http:// uses
+	// unencrypted HTTP/2 and, as responses carry private keys, belongs on
+	// loopback or a trusted network only.
+	Target string
+
+	// Timeout bounds each call (default 5 seconds).
+	Timeout time.Duration
+
+	// Client is the HTTP client to use; nil uses one that speaks HTTP/2
+	// for both schemes. A custom client must do the same.
+	Client *http.Client
+}
+
+// Client authenticates users against a grpcauth server.
+// It is safe for concurrent use.
+type Client struct {
+	base   *url.URL
+	opts   Options
+	client *http.Client
+}
+
+// Compile-time checks: Client must satisfy AuthenticationAgent and KeyProvider.
+var (
+	_ auth.AuthenticationAgent = (*Client)(nil)
+	_ auth.KeyProvider         = (*Client)(nil)
+)
+
+// New returns a client for the server at opts.Target.
+func New(opts Options) (*Client, error) {
+	base, err := url.Parse(opts.Target)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("%w: invalid target %q", autherrors.ErrAuthAgentConfigInvalid, opts.Target)
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	client := opts.Client
+	if client == nil {
+		var p http.Protocols
+		p.SetHTTP2(true)
+		p.SetUnencryptedHTTP2(true)
+		client = &http.Client{Transport: &http.Transport{Protocols: &p}}
+	}
+	return &Client{base: base, opts: opts, client: client}, nil
+}
+
+// Authenticate asks the server to validate the credentials. The client IP,
+// protocol and connection details set on ctx with domain.WithClientIP,
+// WithProtocol and WithConnInfo are passed on for the server's policies,
+// and a key passphrase set with auth.WithKeyPassphrase to unlock the key.
+func (c *Client) Authenticate(ctx context.Context, username, password string) (*auth.AuthSession, error) {
+	req := &authenticateRequest{Username: username, Password: password}
+	req.ClientIP, _ = ctx.Value(domain.ClientIPKey).(string)
+	req.Protocol, _ = ctx.Value(domain.ProtocolKey).(string)
+	if info, ok := ctx.Value(domain.ConnInfoKey).(domain.ConnInfo); ok {
+		req.TLS, req.ServerName, req.LocalAddr = info.TLS, info.ServerName, info.LocalAddr
+	}
+	req.KeyPassphrase, _ = auth.KeyPassphrase(ctx)
+	var resp authenticateResponse
+	if err := c.call(ctx, "Authenticate", req, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Username == "" {
+		resp.Username = username
+	}
+	if resp.Mailbox == "" {
+		resp.Mailbox = resp.Username
+	}
+	// Unknown names leave a set that restricts rather than allows.
+	services, _ := auth.ParseServiceSet(resp.Services)
+	session := &auth.AuthSession{
+		User:              &auth.User{Username: resp.Username, Mailbox: resp.Mailbox, Uid: resp.Uid, Gid: resp.Gid, Services: services},
+		PrivateKey:        resp.PrivateKey,
+		PublicKey:         resp.PublicKey,
+		EncryptionEnabled: len(resp.PublicKey) > 0,
+		Credential:        auth.Credential{ID: resp.CredentialID, Label: resp.CredentialLabel},
+		PasswordExpired:   resp.PasswordExpired,
+	}
+	if resp.AppPassword {
+		session.Credential.Kind = auth.CredentialAppPassword
+	}
+	return session, nil
+}
+
+// UserExists asks the server whether username exists.
+func (c *Client) UserExists(ctx context.Context, username string) (bool, error) {
+	var resp userExistsResponse
+	if err := c.call(ctx, "UserExists", &usernameRequest{Username: username}, &resp); err != nil {
+		return false, err
+	}
+	return resp.Exists, nil
+}
+
+// GetPublicKey asks the server for the user's public key.
+func (c *Client) GetPublicKey(ctx context.Context, username string) ([]byte, error) {
+	var resp getPublicKeyResponse
+	if err := c.call(ctx, "GetPublicKey", &usernameRequest{Username: username}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.PublicKey, nil
+}
+
+// GetPublicKeys asks the server for each user's public key in turn.
+func (c *Client) GetPublicKeys(ctx context.Context, usernames []string) (map[string][]byte, error) {
+	return auth.GetPublicKeysOneByOne(ctx, c.GetPublicKey, usernames)
+}
+
+// HasEncryption reports whether the server has a public key for username.
+func (c *Client) HasEncryption(ctx context.Context, username string) (bool, error) {
+	_, err := c.GetPublicKey(ctx, username)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, autherrors.ErrKeyNotFound), errors.Is(err, autherrors.ErrUserNotFound):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// ResolveForward asks the server for the forwarding targets of localpart.
+// Errors are reported as not found.
+func (c *Client) ResolveForward(ctx context.Context, localpart string) ([]string, bool) {
+	var resp resolveForwardResponse
+	if err := c.call(ctx, "ResolveForward", &resolveForwardRequest{Localpart: localpart}, &resp); err != nil {
+		return nil, false
+	}
+	return resp.Targets, resp.Found
+}
+
+// Close releases idle connections.
+func (c *Client) Close() error {
+	c.client.CloseIdleConnections()
+	return nil
+}
+
+// call invokes method with in and decodes the response into out. A non-OK
+// status is returned as the matching auth error where there is one.
+func (c *Client) call(ctx context.Context, method string, in, out message) error {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancel()
+
+	u := c.base.JoinPath(serviceName, method)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(frame(in.marshal())))
+	if err != nil {
+		return fmt.Errorf("build grpc request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("grpc request: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("auth service returned HTTP status %d", resp.StatusCode)
+	}
+	// Read to EOF so the trailers arrive.
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 5+maxMessageSize+1))
+	if err != nil {
+		return fmt.Errorf("read grpc response: %w", err)
+	}
+	if err := statusError(method, resp); err != nil {
+		return err
+	}
+	msg, err := readFrame(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if err := out.unmarshal(msg); err != nil {
+		return fmt.Errorf("decode %s response: %w", method, err)
+	}
+	return nil
+}
+
+// statusError returns the error for a response's gRPC status, or nil if it
+// is OK. Trailers-only responses carry the status in the headers.
+func statusError(method string, resp *http.Response) error {
+	get := func(key string) string {
+		if v := resp.Trailer.Get(key); v != "" {
+			return v
+		}
+		return resp.Header.Get(key)
+	}
+	status := get("Grpc-Status")
+	if status == "" {
+		return fmt.Errorf("grpc %s: response has no status", method)
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return fmt.Errorf("grpc %s: invalid status %q", method, status)
+	}
+	if code == codeOK {
+		return nil
+	}
+	if name := strings.TrimSpace(get(errorTrailer)); name != "" {
+		for _, e := range errorNames {
+			if e.name == name {
+				return e.err
+			}
+		}
+	}
+	return fmt.Errorf("grpc %s: status %d: %s", method, code, decodeMessage(get("Grpc-Message")))
+}
@@ -0,0 +1,257 @@
+package grpcauth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/domain"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// stubAgent knows alice/secret, who has a key pair and forwards "sales";
+// it records the context of the last Authenticate call.
+type stubAgent struct {
+	err     error // returned by every call when set
+	lastCtx context.Context
+}
+
+func (a *stubAgent) Authenticate(ctx context.Context, username, password string) (*auth.AuthSession, error) {
+	a.lastCtx = ctx
+	switch {
+	case a.err != nil:
+		return nil, a.err
+	case username != "alice":
+		return nil, autherrors.ErrUserNotFound
+	case password != "secret":
+		return nil, autherrors.ErrAuthFailed
+	}
+	return &auth.AuthSession{
+		User:              &auth.User{Username: "alice", Mailbox: "alice-box", Uid: 1001, Gid: 100, Services: auth.ServiceIMAP},
+		PublicKey:         []byte("pub"),
+		PrivateKey:        []byte("priv"),
+		EncryptionEnabled: true,
+	}, nil
+}
+
+func (a *stubAgent) UserExists(_ context.Context, username string) (bool, error) {
+	return username == "alice", a.err
+}
+
+func (a *stubAgent) GetPublicKey(_ context.Context, username string) ([]byte, error) {
+	switch {
+	case a.err != nil:
+		return nil, a.err
+	case username == "alice":
+		return []byte("pub"), nil
+	case username == "bob":
+		return nil, autherrors.ErrKeyNotFound
+	}
+	return nil, autherrors.ErrUserNotFound
+}
+
+func (a *stubAgent) GetPublicKeys(ctx context.Context, usernames []string) (map[string][]byte, error) {
+	return auth.GetPublicKeysOneByOne(ctx, a.GetPublicKey, usernames)
+}
+
+func (a *stubAgent) HasEncryption(ctx context.Context, username string) (bool, error) {
+	key, err := a.GetPublicKey(ctx, username)
+	return key != nil, err
+}
+
+func (a *stubAgent) ResolveForward(_ context.Context, localpart string) ([]string, bool) {
+	if localpart == "sales" {
+		return []string{"alice@example.com", "bob@example.com"}, true
+	}
+	return nil, false
+}
+
+func (a *stubAgent) Close() error { return nil }
+
+// newClient serves agent over unencrypted HTTP/2 and returns a client for it.
+func newClient(t *testing.T, agent auth.AuthenticationAgent) *Client {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(NewServer(agent))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	c, err := New(Options{Target: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func TestClient_Authenticate(t *testing.T) {
+	agent := &stubAgent{}
+	c := newClient(t, agent)
+	ctx := domain.WithClientIP(context.Background(), "192.0.2.7")
+	ctx = domain.WithProtocol(ctx, "imap")
+	ctx = domain.WithConnInfo(ctx, domain.ConnInfo{TLS: true, ServerName: "mail.example.com", LocalAddr: "203.0.113.7:993"})
+
+	session, err := c.Authenticate(ctx, "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := session.User; u.Username != "alice" || u.Mailbox != "alice-box" || u.Uid != 1001 || u.Gid != 100 || u.Services != auth.ServiceIMAP {
+		t.Errorf("user = %+v", session.User)
+	}
+	if !bytes.Equal(session.PublicKey, []byte("pub")) || !bytes.Equal(session.PrivateKey, []byte("priv")) {
+		t.Errorf("keys = %q, %q", session.PublicKey, session.PrivateKey)
+	}
+	if !session.EncryptionEnabled {
+		t.Error("EncryptionEnabled = false")
+	}
+
+	if ip, _ := agent.lastCtx.Value(domain.ClientIPKey).(string); ip != "192.0.2.7" {
+		t.Errorf("server saw client IP %q", ip)
+	}
+	if p, _ := agent.lastCtx.Value(domain.ProtocolKey).(string); p != "imap" {
+		t.Errorf("server saw protocol %q", p)
+	}
+	if info, _ := agent.lastCtx.Value(domain.ConnInfoKey).(domain.ConnInfo); !info.TLS {
+		t.Error("server did not see TLS")
+	} else if info.ServerName != "mail.example.com" || info.LocalAddr != "203.0.113.7:993" {
+		t.Errorf("server saw ConnInfo %+v", info)
+	}
+}
+
+func TestClient_Errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		agentErr error
+		user     string
+		pass     string
+		want     error
+	}{
+		{"wrong password", nil, "alice", "wrong", autherrors.ErrAuthFailed},
+		{"unknown user", nil, "nobody", "secret", autherrors.ErrUserNotFound},
+		{"rate limited", autherrors.ErrRateLimited, "alice", "secret", autherrors.ErrRateLimited},
+		{"login denied", fmt.Errorf("%w: outside hours", autherrors.ErrLoginDenied), "alice", "secret", autherrors.ErrLoginDenied},
+		{"step-up", autherrors.ErrStepUpRequired, "alice", "secret", autherrors.ErrStepUpRequired},
+		{"tls required", autherrors.ErrTLSRequired, "alice", "secret", autherrors.ErrTLSRequired},
+		{"access denied", autherrors.ErrAccessDenied, "alice", "secret", autherrors.ErrAccessDenied},
+		{"account disabled", fmt.Errorf("%w: locked", autherrors.ErrAccountDisabled), "alice", "secret", autherrors.ErrAccountDisabled},
+		{"domain frozen", fmt.Errorf("%w: example.com", autherrors.ErrDomainFrozen), "alice", "secret", autherrors.ErrDomainFrozen},
+		{"service denied", fmt.Errorf("%w: alice may not use imap", autherrors.ErrServiceDenied), "alice", "secret", autherrors.ErrServiceDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newClient(t, &stubAgent{err: tt.agentErr})
+			_, err := c.Authenticate(context.Background(), tt.user, tt.pass)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestClient_BackendErrorHidden(t *testing.T) {
+	c := newClient(t, &stubAgent{err: errors.New("database password is hunter2")})
+	_, err := c.Authenticate(context.Background(), "alice", "secret")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if bytes.Contains([]byte(err.Error()), []byte("hunter2")) {
+		t.Errorf("backend error leaked to client: %v", err)
+	}
+}
+
+func TestClient_UserExists(t *testing.T) {
+	c := newClient(t, &stubAgent{})
+	for user, want := range map[string]bool{"alice": true, "nobody": false} {
+		got, err := c.UserExists(context.Background(), user)
+		if err != nil || got != want {
+			t.Errorf("UserExists(%q) = %v, %v; want %v", user, got, err, want)
+		}
+	}
+}
+
+func TestClient_Keys(t *testing.T) {
+	c := newClient(t, &stubAgent{})
+	ctx := context.Background()
+
+	key, err := c.GetPublicKey(ctx, "alice")
+	if err != nil || !bytes.Equal(key, []byte("pub")) {
+		t.Errorf("GetPublicKey(alice) = %q, %v", key, err)
+	}
+	if _, err := c.GetPublicKey(ctx, "bob"); !errors.Is(err, autherrors.ErrKeyNotFound) {
+		t.Errorf("GetPublicKey(bob) err = %v, want ErrKeyNotFound", err)
+	}
+	if _, err := c.GetPublicKey(ctx, "nobody"); !errors.Is(err, autherrors.ErrUserNotFound) {
+		t.Errorf("GetPublicKey(nobody) err = %v, want ErrUserNotFound", err)
+	}
+	for user, want := range map[string]bool{"alice": true, "bob": false, "nobody": false} {
+		got, err := c.HasEncryption(ctx, user)
+		if err != nil || got != want {
+			t.Errorf("HasEncryption(%q) = %v, %v; want %v", user, got, err, want)
+		}
+	}
+}
+
+func TestClient_ResolveForward(t *testing.T) {
+	c := newClient(t, &stubAgent{})
+	targets, ok := c.ResolveForward(context.Background(), "sales")
+	if !ok || len(targets) != 2 || targets[1] != "bob@example.com" {
+		t.Errorf("ResolveForward(sales) = %v, %v", targets, ok)
+	}
+	if targets, ok := c.ResolveForward(context.Background(), "alice"); ok {
+		t.Errorf("ResolveForward(alice) = %v, true", targets)
+	}
+}
+
+func TestServer_RejectsNonGRPC(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/"+serviceName+"/UserExists", nil)
+	NewServer(&stubAgent{}).ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("status = %d", rec.Code)
+	}
+}
+
+func TestServer_UnknownMethod(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/"+serviceName+"/DeleteEverything", bytes.NewReader(frame(nil)))
+	req.Header.Set("Content-Type", "application/grpc")
+	NewServer(&stubAgent{}).ServeHTTP(rec, req)
+	if got := rec.Header().Get("Grpc-Status"); got != "12" {
+		t.Errorf("grpc-status = %q, want 12", got)
+	}
+}
+
+func TestNew_InvalidTarget(t *testing.T) {
+	for _, target := range []string{"", "localhost:50051", "ftp://host"} {
+		if _, err := New(Options{Target: target}); !errors.Is(err, autherrors.ErrAuthAgentConfigInvalid) {
+			t.Errorf("New(%q) err = %v", target, err)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	a, err := auth.OpenAuthAgent(auth.AuthAgentConfig{
+		Type:              "grpc",
+		CredentialBackend: "http://127.0.0.1:1",
+		Options:           map[string]string{"timeout": "2s"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = a.Close()
+
+	_, err = auth.OpenAuthAgent(auth.AuthAgentConfig{
+		Type:              "grpc",
+		CredentialBackend: "http://127.0.0.1:1",
+		Options:           map[string]string{"timeout": "soon"},
+	})
+	if !errors.Is(err, autherrors.ErrAuthAgentConfigInvalid) {
+		t.Errorf("err = %v, want ErrAuthAgentConfigInvalid", err)
+	}
+}
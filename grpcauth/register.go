@@ -0,0 +1,25 @@
+package grpcauth
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/errors"
+)
+
+func init() {
+	// CredentialBackend is the server URL. Options: "timeout", a Go
+	// duration bounding each call.
+	auth.RegisterAuthAgent("grpc", func(config auth.AuthAgentConfig) (auth.AuthenticationAgent, error) {
+		opts := Options{Target: config.CredentialBackend}
+		if v := config.Options["timeout"]; v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("%w: timeout: %v", errors.ErrAuthAgentConfigInvalid, err)
+			}
+			opts.Timeout = d
+		}
+		return New(opts)
+	})
+}
@@ -0,0 +1,211 @@
+package grpcauth
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/domain"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// ForwardResolver is implemented by agents that can resolve forwarding
+// rules, such as a domain's MailAuthAgent. The server answers
+// ResolveForward with found=false for agents without it.
+type ForwardResolver interface {
+	ResolveForward(ctx context.Context, localpart string) ([]string, bool)
+}
+
+// Server serves the Auth service of auth.proto for Agent. It is an
+// http.Handler; gRPC requires HTTP/2, so serve it with TLS or, on a
+// trusted network, with unencrypted HTTP/2 enabled in http.Server's
+// Protocols. Authenticate responses carry decrypted private keys.
+type Server struct {
+	// Agent answers the requests, typically a domain.AuthRouter.
+	Agent auth.AuthenticationAgent
+
+	// Logger receives backend errors; nil uses slog.Default.
+	Logger *slog.Logger
+}
+
+// NewServer returns a Server for agent.
+func NewServer(agent auth.AuthenticationAgent) *Server {
+	return &Server{Agent: agent}
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+// ServeHTTP handles one gRPC call.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+
+	method, ok := strings.CutPrefix(r.URL.Path, "/"+serviceName+"/")
+	if !ok {
+		writeStatus(w, codeUnimplemented, "unknown service", "")
+		return
+	}
+	data, err := readFrame(r.Body)
+	if err != nil {
+		writeStatus(w, codeInvalidArgument, err.Error(), "")
+		return
+	}
+
+	var resp message
+	switch method {
+	case "Authenticate":
+		resp, err = s.authenticate(r.Context(), data)
+	case "UserExists":
+		resp, err = s.userExists(r.Context(), data)
+	case "GetPublicKey":
+		resp, err = s.getPublicKey(r.Context(), data)
+	case "ResolveForward":
+		resp, err = s.resolveForward(r.Context(), data)
+	default:
+		writeStatus(w, codeUnimplemented, "unknown method "+method, "")
+		return
+	}
+	if err != nil {
+		s.writeError(w, method, err)
+		return
+	}
+	// Errors above are sent trailers-only, in the headers; a message is
+	// followed by its status in declared trailers.
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message, "+errorTrailer)
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(frame(resp.marshal())); err != nil {
+		return
+	}
+	writeStatus(w, codeOK, "", "")
+}
+
+func (s *Server) authenticate(ctx context.Context, data []byte) (message, error) {
+	var req authenticateRequest
+	if err := req.unmarshal(data); err != nil {
+		return nil, badRequest{err}
+	}
+	if req.ClientIP != "" {
+		ctx = domain.WithClientIP(ctx, req.ClientIP)
+	}
+	if req.Protocol != "" {
+		ctx = domain.WithProtocol(ctx, req.Protocol)
+	}
+	ctx = domain.WithConnInfo(ctx, domain.ConnInfo{TLS: req.TLS, ServerName: req.ServerName, LocalAddr: req.LocalAddr})
+	if req.KeyPassphrase != "" {
+		ctx = auth.WithKeyPassphrase(ctx, req.KeyPassphrase)
+	}
+
+	session, err := s.Agent.Authenticate(ctx, req.Username, req.Password)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Clear()
+	resp := &authenticateResponse{
+		Username:        req.Username,
+		PublicKey:       session.PublicKey,
+		PrivateKey:      append([]byte(nil), session.PrivateKey...),
+		AppPassword:     session.Credential.Kind == auth.CredentialAppPassword,
+		CredentialID:    session.Credential.ID,
+		CredentialLabel: session.Credential.Label,
+		PasswordExpired: session.PasswordExpired,
+	}
+	if session.User != nil {
+		resp.Mailbox = session.User.Mailbox
+		resp.Uid, resp.Gid = session.User.Uid, session.User.Gid
+		resp.Services = session.User.Services.String()
+		if session.User.Username != "" {
+			resp.Username = session.User.Username
+		}
+	}
+	return resp, nil
+}
+
+func (s *Server) userExists(ctx context.Context, data []byte) (message, error) {
+	var req usernameRequest
+	if err := req.unmarshal(data); err != nil {
+		return nil, badRequest{err}
+	}
+	exists, err := s.Agent.UserExists(ctx, req.Username)
+	if err != nil {
+		return nil, err
+	}
+	return &userExistsResponse{Exists: exists}, nil
+}
+
+func (s *Server) getPublicKey(ctx context.Context, data []byte) (message, error) {
+	var req usernameRequest
+	if err := req.unmarshal(data); err != nil {
+		return nil, badRequest{err}
+	}
+	kp, ok := auth.AsKeyProvider(s.Agent)
+	if !ok {
+		return nil, autherrors.ErrKeyNotFound
+	}
+	key, err := kp.GetPublicKey(ctx, req.Username)
+	if err != nil {
+		return nil, err
+	}
+	return &getPublicKeyResponse{PublicKey: key}, nil
+}
+
+func (s *Server) resolveForward(ctx context.Context, data []byte) (message, error) {
+	var req resolveForwardRequest
+	if err := req.unmarshal(data); err != nil {
+		return nil, badRequest{err}
+	}
+	fr, ok := s.Agent.(ForwardResolver)
+	if !ok {
+		return &resolveForwardResponse{}, nil
+	}
+	targets, found := fr.ResolveForward(ctx, req.Localpart)
+	return &resolveForwardResponse{Targets: targets, Found: found}, nil
+}
+
+// badRequest marks a request that could not be decoded.
+type badRequest struct{ err error }
+
+func (b badRequest) Error() string { return "decode request: " + b.err.Error() }
+
+// writeError reports err as a gRPC status. Backend errors are logged and
+// reported without detail.
+func (s *Server) writeError(w http.ResponseWriter, method string, err error) {
+	var bad badRequest
+	if errors.As(err, &bad) {
+		writeStatus(w, codeInvalidArgument, bad.Error(), "")
+		return
+	}
+	for _, e := range errorNames {
+		if errors.Is(err, e.err) {
+			writeStatus(w, e.code, e.err.Error(), e.name)
+			return
+		}
+	}
+	s.logger().Error("grpcauth: backend error",
+		slog.String("method", method),
+		slog.String("error", err.Error()))
+	writeStatus(w, codeInternal, "internal error", "")
+}
+
+// writeStatus sets the gRPC status trailers. Called before any body is
+// written it produces a trailers-only response.
+func writeStatus(w http.ResponseWriter, code int, msg, authErr string) {
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set("Grpc-Message", encodeMessage(msg))
+	}
+	if authErr != "" {
+		w.Header().Set(errorTrailer, authErr)
+	}
+}
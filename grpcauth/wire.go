@@ -0,0 +1,303 @@
+package grpcauth
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Protocol buffer wire types used by auth.proto.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("truncated protobuf message")
+
+// message is a protobuf message of auth.proto.
+type message interface {
+	marshal() []byte
+	unmarshal(data []byte) error
+}
+
+// encoder appends protobuf fields, omitting zero values as proto3 does.
+type encoder struct{ buf []byte }
+
+func (e *encoder) tag(field, wire int) {
+	e.buf = binary.AppendUvarint(e.buf, uint64(field)<<3|uint64(wire))
+}
+
+func (e *encoder) bytes(field int, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	e.tag(field, wireBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) string(field int, s string) {
+	e.bytes(field, []byte(s))
+}
+
+func (e *encoder) bool(field int, v bool) {
+	if !v {
+		return
+	}
+	e.tag(field, wireVarint)
+	e.buf = append(e.buf, 1)
+}
+
+func (e *encoder) uint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	e.tag(field, wireVarint)
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+// decode calls fn for each field of data: varints with their value, and
+// length-delimited fields with their contents. Fixed-width fields, which
+// auth.proto does not use, are skipped.
+func decode(data []byte, fn func(field int, v uint64, b []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errTruncated
+		}
+		data = data[n:]
+		field, wire := int(key>>3), int(key&7)
+		switch wire {
+		case wireVarint:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return errTruncated
+			}
+			data = data[n:]
+			if err := fn(field, v, nil); err != nil {
+				return err
+			}
+		case wireBytes:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < l {
+				return errTruncated
+			}
+			b := data[n : n+int(l)]
+			data = data[n+int(l):]
+			if err := fn(field, 0, b); err != nil {
+				return err
+			}
+		case wireFixed64:
+			if len(data) < 8 {
+				return errTruncated
+			}
+			data = data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return errTruncated
+			}
+			data = data[4:]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", wire)
+		}
+	}
+	return nil
+}
+
+type authenticateRequest struct {
+	Username, Password, ClientIP, Protocol string
+	TLS                                    bool
+	KeyPassphrase                          string
+	ServerName, LocalAddr                  string
+}
+
+func (m *authenticateRequest) marshal() []byte {
+	var e encoder
+	e.string(1, m.Username)
+	e.string(2, m.Password)
+	e.string(3, m.ClientIP)
+	e.string(4, m.Protocol)
+	e.bool(5, m.TLS)
+	e.string(6, m.KeyPassphrase)
+	e.string(7, m.ServerName)
+	e.string(8, m.LocalAddr)
+	return e.buf
+}
+
+func (m *authenticateRequest) unmarshal(data []byte) error {
+	return decode(data, func(field int, v uint64, b []byte) error {
+		switch field {
+		case 1:
+			m.Username = string(b)
+		case 2:
+			m.Password = string(b)
+		case 3:
+			m.ClientIP = string(b)
+		case 4:
+			m.Protocol = string(b)
+		case 5:
+			m.TLS = v != 0
+		case 6:
+			m.KeyPassphrase = string(b)
+		case 7:
+			m.ServerName = string(b)
+		case 8:
+			m.LocalAddr = string(b)
+		}
+		return nil
+	})
+}
+
+type authenticateResponse struct {
+	Username, Mailbox             string
+	PublicKey, PrivateKey         []byte
+	AppPassword                   bool
+	CredentialID, CredentialLabel string
+	PasswordExpired               bool
+	Uid, Gid                      uint32
+	Services                      string
+}
+
+func (m *authenticateResponse) marshal() []byte {
+	var e encoder
+	e.string(1, m.Username)
+	e.string(2, m.Mailbox)
+	e.bytes(3, m.PublicKey)
+	e.bytes(4, m.PrivateKey)
+	e.bool(5, m.AppPassword)
+	e.string(6, m.CredentialID)
+	e.string(7, m.CredentialLabel)
+	e.bool(8, m.PasswordExpired)
+	e.uint(9, uint64(m.Uid))
+	e.uint(10, uint64(m.Gid))
+	e.string(11, m.Services)
+	return e.buf
+}
+
+func (m *authenticateResponse) unmarshal(data []byte) error {
+	return decode(data, func(field int, v uint64, b []byte) error {
+		switch field {
+		case 1:
+			m.Username = string(b)
+		case 2:
+			m.Mailbox = string(b)
+		case 3:
+			m.PublicKey = append([]byte(nil), b...)
+		case 4:
+			m.PrivateKey = append([]byte(nil), b...)
+		case 5:
+			m.AppPassword = v != 0
+		case 6:
+			m.CredentialID = string(b)
+		case 7:
+			m.CredentialLabel = string(b)
+		case 8:
+			m.PasswordExpired = v != 0
+		case 9:
+			m.Uid = uint32(v)
+		case 10:
+			m.Gid = uint32(v)
+		case 11:
+			m.Services = string(b)
+		}
+		return nil
+	})
+}
+
+// usernameRequest is UserExistsRequest and GetPublicKeyRequest, which share
+// their only field.
+type usernameRequest struct{ Username string }
+
+func (m *usernameRequest) marshal() []byte {
+	var e encoder
+	e.string(1, m.Username)
+	return e.buf
+}
+
+func (m *usernameRequest) unmarshal(data []byte) error {
+	return decode(data, func(field int, _ uint64, b []byte) error {
+		if field == 1 {
+			m.Username = string(b)
+		}
+		return nil
+	})
+}
+
+type userExistsResponse struct{ Exists bool }
+
+func (m *userExistsResponse) marshal() []byte {
+	var e encoder
+	e.bool(1, m.Exists)
+	return e.buf
+}
+
+func (m *userExistsResponse) unmarshal(data []byte) error {
+	return decode(data, func(field int, v uint64, _ []byte) error {
+		if field == 1 {
+			m.Exists = v != 0
+		}
+		return nil
+	})
+}
+
+type getPublicKeyResponse struct{ PublicKey []byte }
+
+func (m *getPublicKeyResponse) marshal() []byte {
+	var e encoder
+	e.bytes(1, m.PublicKey)
+	return e.buf
+}
+
+func (m *getPublicKeyResponse) unmarshal(data []byte) error {
+	return decode(data, func(field int, _ uint64, b []byte) error {
+		if field == 1 {
+			m.PublicKey = append([]byte(nil), b...)
+		}
+		return nil
+	})
+}
+
+type resolveForwardRequest struct{ Localpart string }
+
+func (m *resolveForwardRequest) marshal() []byte {
+	var e encoder
+	e.string(1, m.Localpart)
+	return e.buf
+}
+
+func (m *resolveForwardRequest) unmarshal(data []byte) error {
+	return decode(data, func(field int, _ uint64, b []byte) error {
+		if field == 1 {
+			m.Localpart = string(b)
+		}
+		return nil
+	})
+}
+
+type resolveForwardResponse struct {
+	Targets []string
+	Found   bool
+}
+
+func (m *resolveForwardResponse) marshal() []byte {
+	var e encoder
+	for _, t := range m.Targets {
+		e.string(1, t)
+	}
+	e.bool(2, m.Found)
+	return e.buf
+}
+
+func (m *resolveForwardResponse) unmarshal(data []byte) error {
+	return decode(data, func(field int, v uint64, b []byte) error {
+		switch field {
+		case 1:
+			m.Targets = append(m.Targets, string(b))
+		case 2:
+			m.Found = v != 0
+		}
+		return nil
+	})
+}
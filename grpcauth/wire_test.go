@@ -0,0 +1,91 @@
+package grpcauth
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestMessages_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		in, out message
+	}{
+		{"authenticate request",
+			&authenticateRequest{Username: "alice@example.com", Password: "pw", ClientIP: "192.0.2.1", Protocol: "imap", TLS: true,
+				KeyPassphrase: "secret words", ServerName: "mail.example.com", LocalAddr: "203.0.113.7:993"},
+			&authenticateRequest{}},
+		{"authenticate response",
+			&authenticateResponse{Username: "alice", Mailbox: "alice-box", PublicKey: []byte{1, 2}, PrivateKey: []byte{3},
+				AppPassword: true, CredentialID: "0a1b", CredentialLabel: "Phone", PasswordExpired: true,
+				Uid: 1001, Gid: 1 << 31, Services: "imap,smtp"},
+			&authenticateResponse{}},
+		{"username request", &usernameRequest{Username: "bob"}, &usernameRequest{}},
+		{"user exists", &userExistsResponse{Exists: true}, &userExistsResponse{}},
+		{"public key", &getPublicKeyResponse{PublicKey: bytes.Repeat([]byte{7}, 300)}, &getPublicKeyResponse{}},
+		{"forward request", &resolveForwardRequest{Localpart: "sales"}, &resolveForwardRequest{}},
+		{"forward response",
+			&resolveForwardResponse{Targets: []string{"a@example.com", "=Archive"}, Found: true},
+			&resolveForwardResponse{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.out.unmarshal(tt.in.marshal()); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tt.in, tt.out) {
+				t.Errorf("got %+v, want %+v", tt.out, tt.in)
+			}
+		})
+	}
+}
+
+func TestMessages_ZeroValuesOmitted(t *testing.T) {
+	if b := (&authenticateRequest{}).marshal(); len(b) != 0 {
+		t.Errorf("empty message encodes to %x", b)
+	}
+}
+
+func TestDecode_SkipsUnknownFields(t *testing.T) {
+	var e encoder
+	e.string(1, "alice")
+	e.string(9, "future field")
+	e.bool(10, true)
+	e.buf = append(e.buf, 11<<3|wireFixed32, 0, 0, 0, 0)
+
+	var m usernameRequest
+	if err := m.unmarshal(e.buf); err != nil {
+		t.Fatal(err)
+	}
+	if m.Username != "alice" {
+		t.Errorf("Username = %q", m.Username)
+	}
+}
+
+func TestDecode_Truncated(t *testing.T) {
+	data := (&usernameRequest{Username: "alice"}).marshal()
+	var m usernameRequest
+	if err := m.unmarshal(data[:len(data)-1]); err == nil {
+		t.Error("expected error for truncated message")
+	}
+}
+
+func TestFrame_RoundTrip(t *testing.T) {
+	msg := []byte("payload")
+	got, err := readFrame(bytes.NewReader(frame(msg)))
+	if err != nil || !bytes.Equal(got, msg) {
+		t.Errorf("readFrame = %q, %v", got, err)
+	}
+	compressed := frame(msg)
+	compressed[0] = 1
+	if _, err := readFrame(bytes.NewReader(compressed)); err == nil {
+		t.Error("expected error for compressed frame")
+	}
+}
+
+func TestMessageEncoding(t *testing.T) {
+	msg := "user not found: 100% ünicode\n"
+	if got := decodeMessage(encodeMessage(msg)); got != msg {
+		t.Errorf("round trip = %q", got)
+	}
+}
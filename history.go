@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"context"
+	"time"
+)
+
+// LoginOutcome is the result of a recorded login attempt.
+type LoginOutcome string
+
+// Login outcomes.
+const (
+	LoginSuccess LoginOutcome = "success"
+	LoginFailure LoginOutcome = "failure"
+)
+
+// LoginRecord is one login attempt in a user's history.
+type LoginRecord struct {
+	// Time is when the attempt was made.
+	Time time.Time `json:"time"`
+
+	// Username is the account the attempt was for.
+	Username string `json:"user"`
+
+	// RemoteIP is the client address, empty if the caller did not set it.
+	RemoteIP string `json:"ip,omitempty"`
+
+	// Protocol names the service used (e.g., "imap", "pop3", "submission"),
+	// empty if the caller did not set it.
+	Protocol string `json:"protocol,omitempty"`
+
+	// Outcome is whether the attempt succeeded.
+	Outcome LoginOutcome `json:"outcome"`
+}
+
+// LoginHistoryProvider exposes a user's recent login attempts, for
+// "recent activity" pages in webmail and for administrative display.
+type LoginHistoryProvider interface {
+	// GetLoginHistory returns up to limit of the user's most recent login
+	// records, newest first. limit <= 0 returns all retained records.
+	// An unknown user or a user with no history yields an empty slice.
+	GetLoginHistory(ctx context.Context, username string, limit int) ([]LoginRecord, error)
+}
+
+// LoginState summarizes a user's logins: the last success and the failures
+// since. The zero value is a user with no recorded logins.
+type LoginState struct {
+	// LastLogin is when the user last logged in successfully; zero if
+	// never recorded.
+	LastLogin time.Time `json:"last_login,omitzero"`
+
+	// LastIP and LastProtocol are the client address and service of that
+	// login, empty if the caller did not set them.
+	LastIP       string `json:"last_ip,omitempty"`
+	LastProtocol string `json:"last_protocol,omitempty"`
+
+	// Failures counts the failed attempts since the last successful
+	// login, which resets it.
+	Failures int `json:"failures,omitempty"`
+
+	// LastFailure is when the latest of those failures was; zero when
+	// Failures is 0.
+	LastFailure time.Time `json:"last_failure,omitzero"`
+
+	// LastFailureIP is the client address of that failure.
+	LastFailureIP string `json:"last_failure_ip,omitempty"`
+}
+
+// LoginStateProvider exposes a user's LoginState, for "last login" and
+// "failed attempts since" notices in webmail dashboards.
+type LoginStateProvider interface {
+	// GetLoginState returns username's login state. An unknown user or
+	// a user with no recorded logins yields the zero LoginState.
+	GetLoginState(ctx context.Context, username string) (LoginState, error)
+}
@@ -0,0 +1,271 @@
+// Package httpauth provides an authentication agent that delegates to a
+// remote HTTP service, so a deployment can keep credentials in one place
+// while pop3d, imapd and smtpd use the usual AuthenticationAgent interface.
+//
+// The agent POSTs JSON to two endpoints below the base URL:
+//
+//	POST {base}/authenticate  {"username": "alice", "password": "secret"}
+//	  200 {"mailbox": "alice", "uid": 1001, "gid": 100, "services": "imap,smtp",
+//	       "public_key": "<base64>", "private_key": "<base64>"}
+//	  401 or 403: wrong password; 404: no such user
+//
+//	POST {base}/exists        {"username": "alice"}
+//	  200 {"exists": true}
+//
+// Every field of the authenticate response is optional; the mailbox
+// defaults to the username, uid and gid to 0 (none), and services to all
+// of them (see auth.ParseServiceSet). When a secret is configured each
+// request is signed (see Sign) so the service can reject requests that
+// did not come from a mail daemon.
+//
+// Network errors, 429 and 5xx responses are retried.
+package httpauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// Headers carrying the request signature.
+const (
+	TimestampHeader = "X-Auth-Timestamp"
+	SignatureHeader = "X-Auth-Signature"
+)
+
+// maxResponseSize bounds how much of a response body is read.
+const maxResponseSize = 64 * 1024
+
+// errBadResponse marks a 200 response that could not be decoded; the
+// service answered, so the request is not retried.
+var errBadResponse = errors.New("malformed auth service response")
+
+// Options configures an Agent.
+type Options struct {
+	// BaseURL is the service root; endpoint paths are appended to it.
+	BaseURL string
+
+	// Timeout bounds each attempt (default 5 seconds). Authentication sits
+	// on the login path, so keep it short.
+	Timeout time.Duration
+
+	// Secret, when set, signs every request with HMAC-SHA256.
+	Secret []byte
+
+	// Retries is the number of extra attempts after a retryable failure.
+	Retries int
+
+	// RetryBackoff is the delay before the first retry, doubled for each
+	// later one (default 100ms).
+	RetryBackoff time.Duration
+
+	// Client is the HTTP client to use; nil uses http.DefaultTransport.
+	// Timeout still applies per attempt.
+	Client *http.Client
+}
+
+// Agent authenticates users against a remote HTTP service.
+// It is safe for concurrent use.
+type Agent struct {
+	base   *url.URL
+	opts   Options
+	client *http.Client
+}
+
+// Compile-time check: Agent must satisfy AuthenticationAgent.
+var _ auth.AuthenticationAgent = (*Agent)(nil)
+
+// New returns an agent for the service at opts.BaseURL.
+func New(opts Options) (*Agent, error) {
+	base, err := url.Parse(opts.BaseURL)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("%w: invalid base URL %q", autherrors.ErrAuthAgentConfigInvalid, opts.BaseURL)
+	}
+	if opts.Retries < 0 {
+		return nil, fmt.Errorf("%w: negative retry count", autherrors.ErrAuthAgentConfigInvalid)
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = 100 * time.Millisecond
+	}
+	client := opts.Client
+	if client == nil {
+		client = &http.Client{}
+	}
+	return &Agent{base: base, opts: opts, client: client}, nil
+}
+
+type authenticateRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type authenticateResponse struct {
+	Mailbox    string `json:"mailbox"`
+	Uid        uint32 `json:"uid"`
+	Gid        uint32 `json:"gid"`
+	Services   string `json:"services"`
+	PublicKey  []byte `json:"public_key"`
+	PrivateKey []byte `json:"private_key"`
+}
+
+type existsRequest struct {
+	Username string `json:"username"`
+}
+
+type existsResponse struct {
+	Exists bool `json:"exists"`
+}
+
+// Authenticate asks the service to validate the credentials.
+func (a *Agent) Authenticate(ctx context.Context, username, password string) (*auth.AuthSession, error) {
+	var resp authenticateResponse
+	status, err := a.call(ctx, "authenticate", authenticateRequest{Username: username, Password: password}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	switch status {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, autherrors.ErrAuthFailed
+	case http.StatusNotFound:
+		return nil, autherrors.ErrUserNotFound
+	default:
+		return nil, fmt.Errorf("auth service returned status %d", status)
+	}
+	if resp.Mailbox == "" {
+		resp.Mailbox = username
+	}
+	// Unknown names leave a set that restricts rather than allows.
+	services, _ := auth.ParseServiceSet(resp.Services)
+	return &auth.AuthSession{
+		User:       &auth.User{Username: username, Mailbox: resp.Mailbox, Uid: resp.Uid, Gid: resp.Gid, Services: services},
+		PrivateKey: resp.PrivateKey,
+		PublicKey:  resp.PublicKey,
+	}, nil
+}
+
+// UserExists asks the service whether username exists.
+func (a *Agent) UserExists(ctx context.Context, username string) (bool, error) {
+	var resp existsResponse
+	status, err := a.call(ctx, "exists", existsRequest{Username: username}, &resp)
+	if err != nil {
+		return false, err
+	}
+	if status != http.StatusOK {
+		return false, fmt.Errorf("auth service returned status %d", status)
+	}
+	return resp.Exists, nil
+}
+
+// Close releases idle connections.
+func (a *Agent) Close() error {
+	a.client.CloseIdleConnections()
+	return nil
+}
+
+// call POSTs in as JSON to endpoint, retrying transient failures, and
+// decodes a 200 response into out. Other final statuses are returned for
+// the caller to interpret.
+func (a *Agent) call(ctx context.Context, endpoint string, in, out any) (int, error) {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return 0, fmt.Errorf("encode request: %w", err)
+	}
+	u := a.base.JoinPath(endpoint)
+
+	backoff := a.opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		status, err := a.attempt(ctx, u, body, out)
+		if attempt >= a.opts.Retries || !retryable(status, err) {
+			return status, err
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// attempt makes one request.
+func (a *Agent) attempt(ctx context.Context, u *url.URL, body []byte, out any) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.opts.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("build auth request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(a.opts.Secret) > 0 {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(TimestampHeader, ts)
+		req.Header.Set(SignatureHeader, Sign(a.opts.Secret, ts, req.Method, u.EscapedPath(), body))
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("auth request: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxResponseSize))
+		return resp.StatusCode, nil
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(out); err != nil {
+		return 0, fmt.Errorf("%w: %v", errBadResponse, err)
+	}
+	return resp.StatusCode, nil
+}
+
+// retryable reports whether a failed attempt may succeed if repeated.
+// Caller cancellation is final; per-attempt timeouts are not.
+func retryable(status int, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, errBadResponse)
+	}
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// Sign returns the hex HMAC-SHA256 of a request, computed over the
+// timestamp, method, escaped URL path and body separated by newlines.
+// Services verify it with Verify.
+func Sign(secret []byte, timestamp, method, path string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = io.WriteString(mac, timestamp+"\n"+method+"\n"+path+"\n")
+	_, _ = mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature headers of r, whose body has already been
+// read into body, and rejects timestamps more than maxSkew from now.
+func Verify(secret []byte, r *http.Request, body []byte, maxSkew time.Duration) bool {
+	ts := r.Header.Get(TimestampHeader)
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	if d := time.Since(time.Unix(sec, 0)); d > maxSkew || d < -maxSkew {
+		return false
+	}
+	want := Sign(secret, ts, r.Method, r.URL.EscapedPath(), body)
+	return hmac.Equal([]byte(want), []byte(r.Header.Get(SignatureHeader)))
+}
@@ -0,0 +1,203 @@
+package httpauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// newService returns a fake auth service knowing alice/secret, which
+// rejects requests not signed with secret.
+func newService(t *testing.T, secret []byte) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !Verify(secret, r, body, time.Minute) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var req authenticateRequest
+		_ = json.Unmarshal(body, &req)
+		switch r.URL.Path {
+		case "/api/authenticate":
+			switch {
+			case req.Username != "alice":
+				w.WriteHeader(http.StatusNotFound)
+			case req.Password != "secret":
+				w.WriteHeader(http.StatusUnauthorized)
+			default:
+				_, _ = w.Write([]byte(`{"mailbox": "alice-box", "uid": 1001, "gid": 100, "services": "pop3", "public_key": "cHVi"}`))
+			}
+		case "/api/exists":
+			_ = json.NewEncoder(w).Encode(existsResponse{Exists: req.Username == "alice"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestAgent_Authenticate(t *testing.T) {
+	secret := []byte("shared-secret")
+	srv := newService(t, secret)
+	a, err := New(Options{BaseURL: srv.URL + "/api", Secret: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = a.Close() }()
+	ctx := context.Background()
+
+	session, err := a.Authenticate(ctx, "alice", "secret")
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if u := session.User; u.Mailbox != "alice-box" || u.Uid != 1001 || u.Gid != 100 || u.Services != auth.ServicePOP3 || string(session.PublicKey) != "pub" {
+		t.Errorf("session = %+v, public key %q", session.User, session.PublicKey)
+	}
+	if _, err := a.Authenticate(ctx, "alice", "wrong"); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("wrong password: got %v, want ErrAuthFailed", err)
+	}
+	if _, err := a.Authenticate(ctx, "bob", "secret"); !errors.Is(err, autherrors.ErrUserNotFound) {
+		t.Errorf("unknown user: got %v, want ErrUserNotFound", err)
+	}
+	if ok, err := a.UserExists(ctx, "alice"); err != nil || !ok {
+		t.Errorf("UserExists(alice) = %v, %v", ok, err)
+	}
+	if ok, err := a.UserExists(ctx, "bob"); err != nil || ok {
+		t.Errorf("UserExists(bob) = %v, %v", ok, err)
+	}
+}
+
+func TestAgent_UnsignedRequestsRejected(t *testing.T) {
+	srv := newService(t, []byte("shared-secret"))
+	a, err := New(Options{BaseURL: srv.URL + "/api", Secret: []byte("other")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Authenticate(context.Background(), "alice", "secret"); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("bad signature: got %v, want ErrAuthFailed", err)
+	}
+}
+
+func TestAgent_RetriesTransientFailures(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"exists": true}`))
+	}))
+	defer srv.Close()
+
+	a, err := New(Options{BaseURL: srv.URL, Retries: 2, RetryBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := a.UserExists(context.Background(), "alice"); err != nil || !ok {
+		t.Fatalf("UserExists = %v, %v after retries", ok, err)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("calls = %d, want 3", n)
+	}
+
+	// Out of retries: the last status is reported.
+	calls.Store(0)
+	a.opts.Retries = 1
+	if _, err := a.UserExists(context.Background(), "alice"); err == nil {
+		t.Error("expected an error once retries are exhausted")
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("calls = %d, want 2", n)
+	}
+}
+
+func TestAgent_DoesNotRetryAuthFailures(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	a, err := New(Options{BaseURL: srv.URL, Retries: 3, RetryBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Authenticate(context.Background(), "alice", "x"); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("got %v, want ErrAuthFailed", err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("calls = %d, want 1", n)
+	}
+}
+
+func TestAgent_Timeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	a, err := New(Options{BaseURL: srv.URL, Timeout: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.UserExists(context.Background(), "alice"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestNew_RejectsInvalidBaseURL(t *testing.T) {
+	for _, u := range []string{"", "ftp://host", "http://", "::"} {
+		if _, err := New(Options{BaseURL: u}); !errors.Is(err, autherrors.ErrAuthAgentConfigInvalid) {
+			t.Errorf("New(%q): got %v, want ErrAuthAgentConfigInvalid", u, err)
+		}
+	}
+}
+
+func TestRegisteredAgentType(t *testing.T) {
+	secret := []byte("shared-secret")
+	srv := newService(t, secret)
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, append(secret, '\n'), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	agent, err := auth.OpenAuthAgent(auth.AuthAgentConfig{
+		Type:              "http",
+		CredentialBackend: srv.URL + "/api",
+		Options:           map[string]string{"secret_file": secretFile, "timeout": "2s", "retries": "1"},
+	})
+	if err != nil {
+		t.Fatalf("OpenAuthAgent: %v", err)
+	}
+	defer func() { _ = agent.Close() }()
+	if _, err := agent.Authenticate(context.Background(), "alice", "secret"); err != nil {
+		t.Errorf("Authenticate: %v", err)
+	}
+
+	if _, err := auth.OpenAuthAgent(auth.AuthAgentConfig{
+		Type:              "http",
+		CredentialBackend: srv.URL,
+		Options:           map[string]string{"timeout": "soon"},
+	}); !errors.Is(err, autherrors.ErrAuthAgentConfigInvalid) {
+		t.Errorf("bad timeout: got %v, want ErrAuthAgentConfigInvalid", err)
+	}
+}
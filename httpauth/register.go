@@ -0,0 +1,45 @@
+package httpauth
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/errors"
+)
+
+func init() {
+	// CredentialBackend is the service base URL. Options: "timeout" and
+	// "retry_backoff" (Go durations), "retries", and "secret_file", a file
+	// holding the signing secret so it stays out of the config.
+	auth.RegisterAuthAgent("http", func(config auth.AuthAgentConfig) (auth.AuthenticationAgent, error) {
+		opts := Options{BaseURL: config.CredentialBackend}
+		var err error
+		if v := config.Options["timeout"]; v != "" {
+			if opts.Timeout, err = time.ParseDuration(v); err != nil {
+				return nil, fmt.Errorf("%w: timeout: %v", errors.ErrAuthAgentConfigInvalid, err)
+			}
+		}
+		if v := config.Options["retry_backoff"]; v != "" {
+			if opts.RetryBackoff, err = time.ParseDuration(v); err != nil {
+				return nil, fmt.Errorf("%w: retry_backoff: %v", errors.ErrAuthAgentConfigInvalid, err)
+			}
+		}
+		if v := config.Options["retries"]; v != "" {
+			if opts.Retries, err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("%w: retries: %v", errors.ErrAuthAgentConfigInvalid, err)
+			}
+		}
+		if path := config.Options["secret_file"]; path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("read secret file: %w", err)
+			}
+			opts.Secret = []byte(strings.TrimSpace(string(data)))
+		}
+		return New(opts)
+	})
+}
@@ -1,6 +1,12 @@
 package auth
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	autherrors "github.com/infodancer/auth/errors"
+)
 
 // DeriveKeyPair derives an X25519 key pair from a user's password and username.
 // The salt parameter provides domain separation and should be stored per-user.
@@ -14,3 +20,99 @@ import "errors"
 func DeriveKeyPair(password, username string, salt []byte) (pub, priv []byte, err error) {
 	return nil, nil, errors.New("DeriveKeyPair: not yet implemented")
 }
+
+// KeyPair is one of a user's encryption key pairs.
+type KeyPair struct {
+	PublicKey  []byte
+	PrivateKey []byte
+}
+
+// KeyFormat tags the encoding of a public key from a KeyProvider, so
+// callers know how to encrypt to it.
+type KeyFormat string
+
+const (
+	// KeyFormatNative is a raw 32-byte X25519 key for NaCl box
+	// (golang.org/x/crypto/nacl/box), as key backends generate.
+	KeyFormatNative KeyFormat = "native"
+
+	// KeyFormatOpenPGP is a binary (unarmored) OpenPGP transferable public
+	// key, as users publish through WKD.
+	KeyFormatOpenPGP KeyFormat = "openpgp"
+)
+
+// FormattedKeyProvider is a KeyProvider whose keys are not all native.
+type FormattedKeyProvider interface {
+	KeyProvider
+
+	// GetPublicKeyWithFormat returns the key GetPublicKey returns along
+	// with its format.
+	GetPublicKeyWithFormat(ctx context.Context, username string) ([]byte, KeyFormat, error)
+}
+
+// PublicKeyWithFormat returns username's public key from kp and its
+// format: as tagged by kp if it is a FormattedKeyProvider, and
+// KeyFormatNative otherwise.
+func PublicKeyWithFormat(ctx context.Context, kp KeyProvider, username string) ([]byte, KeyFormat, error) {
+	if f, ok := kp.(FormattedKeyProvider); ok {
+		return f.GetPublicKeyWithFormat(ctx, username)
+	}
+	key, err := kp.GetPublicKey(ctx, username)
+	if err != nil {
+		return nil, "", err
+	}
+	return key, KeyFormatNative, nil
+}
+
+// GetPublicKeysOneByOne implements KeyProvider.GetPublicKeys with get, a
+// GetPublicKey method, called once per distinct username in turn. Users
+// for which get fails with errors.ErrKeyNotFound or errors.ErrUserNotFound
+// are left out of the result; any other error is returned.
+func GetPublicKeysOneByOne(ctx context.Context, get func(context.Context, string) ([]byte, error), usernames []string) (map[string][]byte, error) {
+	keys := make(map[string][]byte, len(usernames))
+	seen := make(map[string]bool, len(usernames))
+	for _, username := range usernames {
+		if seen[username] {
+			continue
+		}
+		seen[username] = true
+		key, err := get(ctx, username)
+		switch {
+		case errors.Is(err, autherrors.ErrKeyNotFound), errors.Is(err, autherrors.ErrUserNotFound):
+			continue
+		case err != nil:
+			return nil, fmt.Errorf("public key for %s: %w", username, err)
+		}
+		keys[username] = key
+	}
+	return keys, nil
+}
+
+// KeyGenerator provisions encryption keys for users who have none, so
+// keys need not be created out of band.
+type KeyGenerator interface {
+	// GenerateUserKeys creates a key pair for username, stores the
+	// private key sealed under password, which must be the user's login
+	// password, and returns the public key. Returns errors.ErrKeyExists if
+	// the user already has a key pair.
+	GenerateUserKeys(ctx context.Context, username, password string) ([]byte, error)
+}
+
+// keyPassphraseKeyType is the context key type for a key passphrase.
+type keyPassphraseKeyType struct{}
+
+// WithKeyPassphrase returns a context carrying the passphrase that unlocks
+// the user's private key, for users whose key is protected by a passphrase
+// distinct from their login password (see passwd.SetKeyPassphrase). Without
+// it such a login succeeds but the session's key stays locked. Backends
+// that seal keys under the login password ignore it.
+func WithKeyPassphrase(ctx context.Context, passphrase string) context.Context {
+	return context.WithValue(ctx, keyPassphraseKeyType{}, passphrase)
+}
+
+// KeyPassphrase returns the passphrase set by WithKeyPassphrase. ok is
+// false if none was set.
+func KeyPassphrase(ctx context.Context) (passphrase string, ok bool) {
+	passphrase, ok = ctx.Value(keyPassphraseKeyType{}).(string)
+	return passphrase, ok
+}
@@ -1,6 +1,12 @@
 package auth
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"testing"
+
+	autherrors "github.com/infodancer/auth/errors"
+)
 
 func TestDeriveKeyPair_Stub(t *testing.T) {
 	pub, priv, err := DeriveKeyPair("password", "user@example.com", []byte("salt"))
@@ -14,3 +20,108 @@ func TestDeriveKeyPair_Stub(t *testing.T) {
 		t.Errorf("expected nil priv key from stub, got %v", priv)
 	}
 }
+
+func TestKeyPassphrase(t *testing.T) {
+	if _, ok := KeyPassphrase(context.Background()); ok {
+		t.Error("KeyPassphrase(background) ok = true")
+	}
+	ctx := WithKeyPassphrase(context.Background(), "correct horse")
+	if pp, ok := KeyPassphrase(ctx); !ok || pp != "correct horse" {
+		t.Errorf("KeyPassphrase = %q, %v", pp, ok)
+	}
+}
+
+func TestAuthSession_KeysUnlocked(t *testing.T) {
+	s := &AuthSession{PublicKey: []byte("pub"), EncryptionEnabled: true}
+	if s.KeysUnlocked() {
+		t.Error("KeysUnlocked without a private key")
+	}
+	s.PrivateKey = []byte("priv")
+	if !s.KeysUnlocked() {
+		t.Error("KeysUnlocked = false with a private key")
+	}
+	s.Clear()
+	if s.KeysUnlocked() {
+		t.Error("KeysUnlocked after Clear")
+	}
+}
+
+func TestAuthSession_PrivateKeys(t *testing.T) {
+	old := []byte("old")
+	s := &AuthSession{RetiredKeys: []KeyPair{{PublicKey: []byte("oldpub"), PrivateKey: old}}}
+	if keys := s.PrivateKeys(); keys != nil {
+		t.Errorf("PrivateKeys while locked = %q", keys)
+	}
+	s.PrivateKey = []byte("new")
+	if keys := s.PrivateKeys(); len(keys) != 2 || string(keys[0]) != "new" || string(keys[1]) != "old" {
+		t.Errorf("PrivateKeys = %q", keys)
+	}
+	s.Clear()
+	if s.RetiredKeys != nil || string(old) != "\x00\x00\x00" {
+		t.Errorf("Clear left retired keys: %+v, %q", s.RetiredKeys, old)
+	}
+}
+
+type pgpKeyAgent struct{ mapKeyAgent }
+
+func (a pgpKeyAgent) GetPublicKeyWithFormat(context.Context, string) ([]byte, KeyFormat, error) {
+	return a.key, KeyFormatOpenPGP, nil
+}
+
+func TestPublicKeyWithFormat(t *testing.T) {
+	ctx := t.Context()
+	native := mapKeyAgent{&mapAgent{passwords: map[string]string{"bob": "y"}, key: []byte("native")}}
+	pgp := pgpKeyAgent{mapKeyAgent{&mapAgent{passwords: map[string]string{"carol": "z"}, key: []byte("pgp")}}}
+
+	if key, format, err := PublicKeyWithFormat(ctx, native, "bob"); err != nil || string(key) != "native" || format != KeyFormatNative {
+		t.Errorf("untagged provider = %q, %q, %v", key, format, err)
+	}
+	if key, format, err := PublicKeyWithFormat(ctx, pgp, "carol"); err != nil || string(key) != "pgp" || format != KeyFormatOpenPGP {
+		t.Errorf("tagged provider = %q, %q, %v", key, format, err)
+	}
+	// The chain passes tags through from the member that owns the user.
+	if _, format, err := PublicKeyWithFormat(ctx, NewChainAgent(native, pgp), "carol"); err != nil || format != KeyFormatOpenPGP {
+		t.Errorf("chain = %q, %v", format, err)
+	}
+}
+
+func TestGetPublicKeysOneByOne(t *testing.T) {
+	ctx := t.Context()
+	calls := 0
+	get := func(_ context.Context, username string) ([]byte, error) {
+		calls++
+		switch username {
+		case "alice":
+			return []byte("a"), nil
+		case "bob":
+			return nil, autherrors.ErrKeyNotFound
+		case "down":
+			return nil, autherrors.ErrBackendUnavailable
+		}
+		return nil, autherrors.ErrUserNotFound
+	}
+
+	keys, err := GetPublicKeysOneByOne(ctx, get, []string{"alice", "bob", "nobody", "alice", "bob"})
+	if err != nil {
+		t.Fatalf("GetPublicKeysOneByOne: %v", err)
+	}
+	if len(keys) != 1 || string(keys["alice"]) != "a" {
+		t.Errorf("keys = %q", keys)
+	}
+	if calls != 3 {
+		t.Errorf("get called %d times, want once per distinct user", calls)
+	}
+	if _, err := GetPublicKeysOneByOne(ctx, get, []string{"alice", "down"}); !errors.Is(err, autherrors.ErrBackendUnavailable) {
+		t.Errorf("backend failure: err = %v", err)
+	}
+
+	// Through the chain, each user's key comes from the member owning them.
+	chain := NewChainAgent(
+		mapKeyAgent{&mapAgent{passwords: map[string]string{"bob": "y"}, key: []byte("b")}},
+		mapKeyAgent{&mapAgent{passwords: map[string]string{"carol": "z"}, key: []byte("c")}},
+	)
+	keys, err = chain.GetPublicKeys(ctx, []string{"bob", "carol", "dave"})
+	if err != nil || len(keys) != 2 || string(keys["bob"]) != "b" || string(keys["carol"]) != "c" {
+		t.Errorf("chain GetPublicKeys = %q, %v", keys, err)
+	}
+}
@@ -0,0 +1,275 @@
+// Package krb5auth accepts Kerberos V5 logins through SASL GSSAPI (RFC
+// 4752), for deployments whose users already hold tickets from a realm's
+// KDC, such as Active Directory. The daemon checks each client's ticket
+// against the service keytab with an Acceptor, maps the client principal
+// user@REALM to a mailbox through a realm→domain table, and logs the
+// user in with domain.AuthRouter.AuthenticatePrincipal:
+//
+//	keytab, err := krb5auth.LoadKeytab("/etc/infodancer/mail.keytab")
+//	realms, err := krb5auth.LoadRealms("/etc/infodancer/krb5-realms")
+//	acceptor, err := krb5auth.New(krb5auth.Options{Keytab: keytab, Realms: realms})
+//
+//	s := acceptor.NewServer() // per AUTHENTICATE GSSAPI
+//	challenge, done, err := s.Next(clientResponse) // until done
+//	result, err := router.AuthenticatePrincipal(ctx, s.Address(), s.Principal())
+//
+// Only the AES encryption types (aes128- and aes256-cts-hmac-sha1-96) are
+// supported, and no security layer is offered: run GSSAPI inside TLS.
+package krb5auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// DefaultClockSkew is the clock difference tolerated between clients and
+// the acceptor, the Kerberos default.
+const DefaultClockSkew = 5 * time.Minute
+
+// Errors returned by Accept, wrapped with errors.ErrAuthFailed.
+var (
+	// ErrNoKey indicates a ticket for a service the keytab holds no key
+	// for, or encrypted with a key version it lacks.
+	ErrNoKey = errors.New("krb5auth: no keytab key for ticket")
+
+	// ErrTicketExpired indicates a ticket outside its validity period.
+	ErrTicketExpired = errors.New("krb5auth: ticket expired or not yet valid")
+
+	// ErrClockSkew indicates an authenticator whose timestamp is too far
+	// from the acceptor's clock.
+	ErrClockSkew = errors.New("krb5auth: clock skew too great")
+
+	// ErrReplay indicates an authenticator the acceptor has seen before.
+	ErrReplay = errors.New("krb5auth: replayed authenticator")
+
+	// ErrRealmNotMapped indicates a client principal whose realm maps to
+	// no mail domain, or that has an instance ("user/admin@REALM").
+	ErrRealmNotMapped = errors.New("krb5auth: principal not mapped to a mailbox")
+)
+
+// Options configures an Acceptor.
+type Options struct {
+	// Keytab holds the keys of the service principals clients get tickets
+	// for, normally imap/<host> and smtp/<host>. Required.
+	Keytab *Keytab
+
+	// Realms maps Kerberos realms to mail domains: the principal
+	// alice@EXAMPLE.COM logs in as alice@<Realms["EXAMPLE.COM"]>.
+	// Principals of other realms are refused. Required.
+	Realms map[string]string
+
+	// ClockSkew is the tolerated clock difference; zero means
+	// DefaultClockSkew.
+	ClockSkew time.Duration
+}
+
+// Acceptor verifies Kerberos tickets presented through GSS-API against a
+// keytab. It is safe for concurrent use; daemons share one across
+// connections so its replay cache sees every login.
+type Acceptor struct {
+	opts Options
+	now  func() time.Time
+
+	mu     sync.Mutex
+	seen   map[[sha256.Size]byte]time.Time // authenticator digest → expiry
+	pruned time.Time
+}
+
+// New returns an Acceptor for opts.
+func New(opts Options) (*Acceptor, error) {
+	if opts.Keytab == nil {
+		return nil, fmt.Errorf("%w: krb5auth: keytab required", autherrors.ErrAuthAgentConfigInvalid)
+	}
+	if len(opts.Realms) == 0 {
+		return nil, fmt.Errorf("%w: krb5auth: realm mapping required", autherrors.ErrAuthAgentConfigInvalid)
+	}
+	if opts.ClockSkew == 0 {
+		opts.ClockSkew = DefaultClockSkew
+	}
+	return &Acceptor{opts: opts, now: time.Now, seen: make(map[[sha256.Size]byte]time.Time)}, nil
+}
+
+// Context is a security context Accept established with a client.
+type Context struct {
+	// Principal is the client's Kerberos principal, "alice@EXAMPLE.COM".
+	Principal string
+
+	// Address is the mail address the principal maps to through
+	// Options.Realms, "alice@example.com".
+	Address string
+
+	// Reply is the GSS-API token to return to the client, the AP-REP
+	// proving the acceptor's identity, when the client asked for mutual
+	// authentication. nil otherwise.
+	Reply []byte
+
+	key     encryptionKey // protects wrap tokens
+	sendSeq uint64        // sequence number of the next wrap token
+}
+
+// Address returns the mail address principal maps to through realms. The
+// localpart is lowercased; principals with an instance are refused.
+func Address(realms map[string]string, principal string) (string, error) {
+	name, realm, ok := strings.Cut(principal, "@")
+	domain := realms[realm]
+	if !ok || name == "" || strings.Contains(name, "/") || domain == "" {
+		return "", fmt.Errorf("%w: %s", ErrRealmNotMapped, principal)
+	}
+	return strings.ToLower(name) + "@" + domain, nil
+}
+
+// Accept verifies a client's GSS-API initial context token, which carries
+// a Kerberos AP-REQ: the ticket must decrypt with a keytab key and be
+// valid now, and the authenticator must match it, be fresh and not have
+// been seen before. Failures wrap errors.ErrAuthFailed.
+func (a *Acceptor) Accept(token []byte) (*Context, error) {
+	ctx, err := a.accept(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", autherrors.ErrAuthFailed, err)
+	}
+	return ctx, nil
+}
+
+func (a *Acceptor) accept(token []byte) (*Context, error) {
+	msg, err := unwrapToken(token, tokAPReq)
+	if err != nil {
+		return nil, err
+	}
+	var req apReq
+	if err := unmarshalApp(msg, tagAPReq, &req); err != nil {
+		return nil, err
+	}
+	if req.PVNO != 5 || req.MsgType != tagAPReq {
+		return nil, fmt.Errorf("%w: not an AP-REQ", ErrMalformedToken)
+	}
+	if flagSet(req.APOptions, apOptionUseSessionKey) {
+		return nil, fmt.Errorf("%w: user-to-user tickets are not supported", ErrMalformedToken)
+	}
+	// The explicitly tagged RawValue holds the [3] wrapper; Bytes is the
+	// ticket.
+	var tkt ticket
+	if err := unmarshalApp(req.Ticket.Bytes, tagTicket, &tkt); err != nil {
+		return nil, err
+	}
+
+	service := tkt.SName.principal(tkt.Realm)
+	serviceKey, ok := a.opts.Keytab.key(service, tkt.EncPart.EType, uint32(tkt.EncPart.KVNO))
+	if !ok {
+		return nil, fmt.Errorf("%w: %s, etype %d, kvno %d", ErrNoKey, service, tkt.EncPart.EType, tkt.EncPart.KVNO)
+	}
+	plain, err := serviceKey.decrypt(usageTicket, tkt.EncPart.Cipher)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt ticket: %w", err)
+	}
+	var part encTicketPart
+	if err := unmarshalApp(plain, tagEncTicketPart, &part); err != nil {
+		return nil, err
+	}
+
+	now := a.now()
+	skew := a.opts.ClockSkew
+	start := part.StartTime
+	if start.IsZero() {
+		start = part.AuthTime
+	}
+	if flagSet(part.Flags, ticketFlagInvalid) || now.Add(skew).Before(start) || !now.Add(-skew).Before(part.EndTime) {
+		return nil, ErrTicketExpired
+	}
+	sessionKey, err := newKey(part.Key.KeyType, part.Key.KeyValue)
+	if err != nil {
+		return nil, fmt.Errorf("session key: %w", err)
+	}
+
+	plain, err = sessionKey.decrypt(usageAuthenticator, req.Authenticator.Cipher)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt authenticator: %w", err)
+	}
+	var auth authenticator
+	if err := unmarshalApp(plain, tagAuthenticator, &auth); err != nil {
+		return nil, err
+	}
+	client := part.CName.principal(part.CRealm)
+	if auth.CName.principal(auth.CRealm) != client {
+		return nil, fmt.Errorf("%w: authenticator names %s, ticket %s", ErrMalformedToken, auth.CName.principal(auth.CRealm), client)
+	}
+	if d := now.Sub(auth.CTime); d > skew || d < -skew {
+		return nil, ErrClockSkew
+	}
+	flags, err := gssFlags(auth.Cksum)
+	if err != nil {
+		return nil, err
+	}
+	if !a.remember(req.Authenticator.Cipher, auth.CTime.Add(skew)) {
+		return nil, ErrReplay
+	}
+
+	address, err := Address(a.opts.Realms, client)
+	if err != nil {
+		return nil, err
+	}
+	c := &Context{Principal: client, Address: address, key: sessionKey, sendSeq: uint64(auth.SeqNumber)}
+	if auth.Subkey.KeyType != 0 {
+		if c.key, err = newKey(auth.Subkey.KeyType, auth.Subkey.KeyValue); err != nil {
+			return nil, fmt.Errorf("subkey: %w", err)
+		}
+	}
+	if flags&gssMutualFlag != 0 || flagSet(req.APOptions, apOptionMutualRequired) {
+		if c.Reply, err = c.reply(sessionKey, auth); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// reply builds the AP-REP for auth and picks the acceptor's sequence
+// numbers.
+func (c *Context) reply(sessionKey encryptionKey, auth authenticator) ([]byte, error) {
+	var seq [4]byte
+	if _, err := rand.Read(seq[:]); err != nil {
+		return nil, err
+	}
+	c.sendSeq = uint64(binary.BigEndian.Uint32(seq[:]) & 0x3fffffff)
+	part, err := marshalApp(encAPRepPart{CTime: auth.CTime, Cusec: auth.Cusec, SeqNumber: int64(c.sendSeq)}, tagEncAPRepPart)
+	if err != nil {
+		return nil, err
+	}
+	cipher, err := sessionKey.encrypt(usageAPRep, part)
+	if err != nil {
+		return nil, err
+	}
+	rep, err := marshalApp(apRep{PVNO: 5, MsgType: tagAPRep, EncPart: encryptedData{EType: sessionKey.etype, Cipher: cipher}}, tagAPRep)
+	if err != nil {
+		return nil, err
+	}
+	return wrapToken(tokAPRep, rep)
+}
+
+// remember records an authenticator until expiry and reports whether it
+// is new.
+func (a *Acceptor) remember(authenticator []byte, expiry time.Time) bool {
+	digest := sha256.Sum256(authenticator)
+	now := a.now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now.Sub(a.pruned) > time.Minute {
+		for k, exp := range a.seen {
+			if now.After(exp) {
+				delete(a.seen, k)
+			}
+		}
+		a.pruned = now
+	}
+	if _, ok := a.seen[digest]; ok {
+		return false
+	}
+	a.seen[digest] = expiry
+	return true
+}
@@ -0,0 +1,306 @@
+package krb5auth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+const (
+	testRealm   = "EXAMPLE.COM"
+	testService = "imap/mail.example.com@EXAMPLE.COM"
+)
+
+var testRealms = map[string]string{testRealm: "example.com", "AD.EXAMPLE.COM": "example.com"}
+
+// testKDC issues tickets for testService, encrypted with its keytab key.
+type testKDC struct {
+	key    encryptionKey
+	kvno   uint32
+	keytab *Keytab
+}
+
+func randomKey(t *testing.T, etype int) encryptionKey {
+	t.Helper()
+	value := make([]byte, keyLength(etype))
+	if _, err := rand.Read(value); err != nil {
+		t.Fatal(err)
+	}
+	key, err := newKey(etype, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newTestKDC(t *testing.T) *testKDC {
+	t.Helper()
+	kdc := &testKDC{key: randomKey(t, ETypeAES256), kvno: 3}
+	data := keytabFile(keytabRecord{testService, 3, kdc.key.etype, kdc.key.value})
+	var err error
+	if kdc.keytab, err = ParseKeytab(data); err != nil {
+		t.Fatal(err)
+	}
+	return kdc
+}
+
+// ticketOpts varies the AP-REQ a client builds.
+type ticketOpts struct {
+	client     string // "alice@EXAMPLE.COM" unless set
+	authTime   time.Time
+	endTime    time.Time
+	ctime      time.Time
+	mutual     bool
+	subkey     bool
+	serviceKey *encryptionKey // the KDC's key unless set
+}
+
+// clientContext is the initiator's side of an established context.
+type clientContext struct {
+	token      []byte
+	sessionKey encryptionKey
+	key        encryptionKey // subkey or session key
+	ctime      time.Time
+	seq        uint64
+}
+
+// apReq returns a GSS-API initial context token for a client of kdc.
+func (kdc *testKDC) apReq(t *testing.T, opts ticketOpts) *clientContext {
+	t.Helper()
+	now := time.Now()
+	if opts.client == "" {
+		opts.client = "alice@" + testRealm
+	}
+	if opts.authTime.IsZero() {
+		opts.authTime = now.Add(-time.Minute)
+	}
+	if opts.endTime.IsZero() {
+		opts.endTime = now.Add(10 * time.Hour)
+	}
+	if opts.ctime.IsZero() {
+		opts.ctime = now
+	}
+	serviceKey := kdc.key
+	if opts.serviceKey != nil {
+		serviceKey = *opts.serviceKey
+	}
+	name, realm, _ := bytes.Cut([]byte(opts.client), []byte("@"))
+	cname := principalName{NameType: 1, NameString: []string{string(name)}}
+	if i := bytes.IndexByte(name, '/'); i >= 0 {
+		cname = principalName{NameType: 1, NameString: []string{string(name[:i]), string(name[i+1:])}}
+	}
+	c := &clientContext{sessionKey: randomKey(t, ETypeAES128), ctime: kerberosTime(opts.ctime), seq: 1234}
+	c.key = c.sessionKey
+
+	part := encTicketPart{
+		Flags:     asn1.BitString{Bytes: make([]byte, 4), BitLength: 32},
+		Key:       encKey{KeyType: c.sessionKey.etype, KeyValue: c.sessionKey.value},
+		CRealm:    string(realm),
+		CName:     cname,
+		Transited: transitedEncoding{Contents: []byte{}},
+		AuthTime:  kerberosTime(opts.authTime),
+		EndTime:   kerberosTime(opts.endTime),
+	}
+	plain := mustMarshalApp(t, part, tagEncTicketPart, string(realm))
+	cipher, err := serviceKey.encrypt(usageTicket, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tkt := ticket{
+		TktVNO:  5,
+		Realm:   testRealm,
+		SName:   principalName{NameType: 2, NameString: []string{"imap", "mail.example.com"}},
+		EncPart: encryptedData{EType: serviceKey.etype, KVNO: int(kdc.kvno), Cipher: cipher},
+	}
+	tktBytes := mustMarshalApp(t, tkt, tagTicket, testRealm, "imap", "mail.example.com")
+
+	var gssFlagsValue uint32 = 0x20 // GSS_C_INTEG_FLAG
+	if opts.mutual {
+		gssFlagsValue |= gssMutualFlag
+	}
+	cksum := make([]byte, 24)
+	binary.LittleEndian.PutUint32(cksum, 16)
+	binary.LittleEndian.PutUint32(cksum[20:], gssFlagsValue)
+	auth := authenticator{
+		AVNO:      5,
+		CRealm:    string(realm),
+		CName:     cname,
+		Cksum:     checksumField{CksumType: gssChecksumType, Checksum: cksum},
+		Cusec:     42,
+		CTime:     c.ctime,
+		SeqNumber: int64(c.seq),
+	}
+	if opts.subkey {
+		c.key = randomKey(t, ETypeAES256)
+		auth.Subkey = encKey{KeyType: c.key.etype, KeyValue: c.key.value}
+	}
+	plain = mustMarshalApp(t, auth, tagAuthenticator, string(realm))
+	authCipher, err := c.sessionKey.encrypt(usageAuthenticator, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := asn1.BitString{Bytes: make([]byte, 4), BitLength: 32}
+	if opts.mutual {
+		options.Bytes[0] |= 0x80 >> apOptionMutualRequired
+	}
+	req := apReq{
+		PVNO:          5,
+		MsgType:       tagAPReq,
+		APOptions:     options,
+		Ticket:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 3, IsCompound: true, Bytes: tktBytes},
+		Authenticator: encryptedData{EType: c.sessionKey.etype, Cipher: authCipher},
+	}
+	if c.token, err = wrapToken(tokAPReq, mustMarshalApp(t, req, tagAPReq)); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// mustMarshalApp marshals v like a KDC does, encoding strs as
+// GeneralString where encoding/asn1 writes PrintableString.
+func mustMarshalApp(t *testing.T, v any, tag int, strs ...string) []byte {
+	t.Helper()
+	b, err := marshalApp(v, tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range strs {
+		printable := append([]byte{asn1.TagPrintableString, byte(len(s))}, s...)
+		general := append([]byte{asn1.TagGeneralString, byte(len(s))}, s...)
+		b = bytes.ReplaceAll(b, printable, general)
+	}
+	return b
+}
+
+// checkReply verifies the acceptor's AP-REP against the client's
+// authenticator and returns the acceptor's sequence number.
+func (c *clientContext) checkReply(t *testing.T, reply []byte) uint64 {
+	t.Helper()
+	msg, err := unwrapToken(reply, tokAPRep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rep apRep
+	if err := unmarshalApp(msg, tagAPRep, &rep); err != nil {
+		t.Fatal(err)
+	}
+	plain, err := c.sessionKey.decrypt(usageAPRep, rep.EncPart.Cipher)
+	if err != nil {
+		t.Fatalf("decrypt AP-REP: %v", err)
+	}
+	var part encAPRepPart
+	if err := unmarshalApp(plain, tagEncAPRepPart, &part); err != nil {
+		t.Fatal(err)
+	}
+	if !part.CTime.Equal(c.ctime) || part.Cusec != 42 {
+		t.Errorf("AP-REP echoes %v.%d, want %v.42", part.CTime, part.Cusec, c.ctime)
+	}
+	return uint64(part.SeqNumber)
+}
+
+func newTestAcceptor(t *testing.T, kdc *testKDC) *Acceptor {
+	t.Helper()
+	a, err := New(Options{Keytab: kdc.keytab, Realms: testRealms})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAccept(t *testing.T) {
+	kdc := newTestKDC(t)
+	a := newTestAcceptor(t, kdc)
+
+	c := kdc.apReq(t, ticketOpts{mutual: true, subkey: true})
+	ctx, err := a.Accept(c.token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Principal != "alice@EXAMPLE.COM" || ctx.Address != "alice@example.com" {
+		t.Errorf("context = %s → %s", ctx.Principal, ctx.Address)
+	}
+	if !bytes.Equal(ctx.key.value, c.key.value) {
+		t.Error("context does not use the authenticator subkey")
+	}
+	if ctx.sendSeq != c.checkReply(t, ctx.Reply) {
+		t.Error("context sequence number differs from the AP-REP's")
+	}
+
+	if _, err := a.Accept(c.token); !errors.Is(err, ErrReplay) {
+		t.Errorf("replay: err = %v, want ErrReplay", err)
+	}
+
+	c = kdc.apReq(t, ticketOpts{client: "Bob@AD.EXAMPLE.COM"})
+	if ctx, err := a.Accept(c.token); err != nil || ctx.Address != "bob@example.com" || ctx.Reply != nil {
+		t.Errorf("second realm without mutual auth: %+v, %v", ctx, err)
+	}
+}
+
+func TestAccept_Refused(t *testing.T) {
+	kdc := newTestKDC(t)
+	a := newTestAcceptor(t, kdc)
+	now := time.Now()
+	otherKey := randomKey(t, ETypeAES256)
+
+	for name, tc := range map[string]struct {
+		opts ticketOpts
+		want error
+	}{
+		"expired":   {ticketOpts{authTime: now.Add(-11 * time.Hour), endTime: now.Add(-time.Hour)}, ErrTicketExpired},
+		"future":    {ticketOpts{authTime: now.Add(time.Hour)}, ErrTicketExpired},
+		"skew":      {ticketOpts{ctime: now.Add(-10 * time.Minute)}, ErrClockSkew},
+		"realm":     {ticketOpts{client: "alice@OTHER.ORG"}, ErrRealmNotMapped},
+		"instance":  {ticketOpts{client: "alice/admin@EXAMPLE.COM"}, ErrRealmNotMapped},
+		"wrong key": {ticketOpts{serviceKey: &otherKey}, errIntegrity},
+	} {
+		_, err := a.Accept(kdc.apReq(t, tc.opts).token)
+		if !errors.Is(err, autherrors.ErrAuthFailed) || !errors.Is(err, tc.want) {
+			t.Errorf("%s: err = %v, want ErrAuthFailed and %v", name, err, tc.want)
+		}
+	}
+
+	other := newTestKDC(t)
+	other.kvno = 4
+	if _, err := a.Accept(other.apReq(t, ticketOpts{}).token); !errors.Is(err, ErrNoKey) {
+		t.Errorf("unknown kvno: err = %v, want ErrNoKey", err)
+	}
+	for _, token := range [][]byte{nil, []byte("garbage"), kdc.apReq(t, ticketOpts{}).token[:40]} {
+		if _, err := a.Accept(token); !errors.Is(err, ErrMalformedToken) {
+			t.Errorf("token %x: err = %v, want ErrMalformedToken", token, err)
+		}
+	}
+}
+
+func TestAddress(t *testing.T) {
+	for principal, want := range map[string]string{
+		"alice@EXAMPLE.COM":       "alice@example.com",
+		"Alice@AD.EXAMPLE.COM":    "alice@example.com",
+		"alice@example.com":       "",
+		"alice/admin@EXAMPLE.COM": "",
+		"@EXAMPLE.COM":            "",
+		"alice":                   "",
+	} {
+		got, err := Address(testRealms, principal)
+		if got != want || (want == "") != errors.Is(err, ErrRealmNotMapped) {
+			t.Errorf("Address(%q) = %q, %v, want %q", principal, got, err, want)
+		}
+	}
+}
+
+func TestNew_Config(t *testing.T) {
+	kdc := newTestKDC(t)
+	for name, opts := range map[string]Options{
+		"no keytab": {Realms: testRealms},
+		"no realms": {Keytab: kdc.keytab},
+	} {
+		if _, err := New(opts); !errors.Is(err, autherrors.ErrAuthAgentConfigInvalid) {
+			t.Errorf("%s: err = %v, want ErrAuthAgentConfigInvalid", name, err)
+		}
+	}
+}
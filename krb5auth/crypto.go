@@ -0,0 +1,243 @@
+package krb5auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Encryption types (RFC 3962). Only the AES types are supported; DES and
+// RC4 keys in a keytab are ignored.
+const (
+	ETypeAES128 = 17 // aes128-cts-hmac-sha1-96
+	ETypeAES256 = 18 // aes256-cts-hmac-sha1-96
+)
+
+// Key usage numbers (RFC 4120 section 7.5.1, RFC 4121 section 2).
+const (
+	usageTicket        = 2
+	usageAuthenticator = 11
+	usageAPRep         = 12
+	usageAcceptorSeal  = 22
+	usageInitiatorSeal = 24
+)
+
+// hmacSize is the length of the truncated HMAC-SHA1-96 checksum.
+const hmacSize = 12
+
+// errIntegrity indicates ciphertext or a checksum that does not verify.
+var errIntegrity = errors.New("integrity check failed")
+
+// keyLength returns the key size of etype, or 0 if it is unsupported.
+func keyLength(etype int) int {
+	switch etype {
+	case ETypeAES128:
+		return 16
+	case ETypeAES256:
+		return 32
+	}
+	return 0
+}
+
+// encryptionKey is a protocol key of a supported etype.
+type encryptionKey struct {
+	etype int
+	value []byte
+}
+
+// newKey checks that value is a key of etype.
+func newKey(etype int, value []byte) (encryptionKey, error) {
+	if n := keyLength(etype); n == 0 || len(value) != n {
+		return encryptionKey{}, fmt.Errorf("unsupported encryption type %d", etype)
+	}
+	return encryptionKey{etype: etype, value: value}, nil
+}
+
+// derive returns DK(key, usage | kind) (RFC 3961 section 5.1), where kind
+// is 0x99 for checksum, 0xAA for encryption and 0x55 for integrity keys.
+func (k encryptionKey) derive(usage uint32, kind byte) []byte {
+	constant := binary.BigEndian.AppendUint32(nil, usage)
+	constant = append(constant, kind)
+	block, _ := aes.NewCipher(k.value)
+	in := nfold(constant, aes.BlockSize*8)
+	out := make([]byte, 0, len(k.value)+aes.BlockSize)
+	for len(out) < len(k.value) {
+		next := make([]byte, aes.BlockSize)
+		block.Encrypt(next, in)
+		out = append(out, next...)
+		in = next
+	}
+	return out[:len(k.value)]
+}
+
+// encrypt returns the RFC 3961 simplified-profile ciphertext of plaintext:
+// AES-CTS over a random confounder and plaintext, then HMAC-SHA1-96.
+func (k encryptionKey) encrypt(usage uint32, plaintext []byte) ([]byte, error) {
+	data := make([]byte, aes.BlockSize, aes.BlockSize+len(plaintext))
+	if _, err := rand.Read(data); err != nil {
+		return nil, err
+	}
+	data = append(data, plaintext...)
+	ciphertext, err := ctsEncrypt(k.derive(usage, 0xAA), data)
+	if err != nil {
+		return nil, err
+	}
+	return append(ciphertext, hmacSHA1(k.derive(usage, 0x55), data)...), nil
+}
+
+// decrypt reverses encrypt, verifying the HMAC.
+func (k encryptionKey) decrypt(usage uint32, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < aes.BlockSize+hmacSize {
+		return nil, fmt.Errorf("%w: ciphertext too short", errIntegrity)
+	}
+	body, mac := ciphertext[:len(ciphertext)-hmacSize], ciphertext[len(ciphertext)-hmacSize:]
+	data, err := ctsDecrypt(k.derive(usage, 0xAA), body)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, hmacSHA1(k.derive(usage, 0x55), data)) {
+		return nil, errIntegrity
+	}
+	return data[aes.BlockSize:], nil
+}
+
+// checksum returns the HMAC-SHA1-96-AES checksum of data (checksum types
+// 15 and 16).
+func (k encryptionKey) checksum(usage uint32, data []byte) []byte {
+	return hmacSHA1(k.derive(usage, 0x99), data)
+}
+
+func hmacSHA1(key, data []byte) []byte {
+	mac := hmac.New(sha1.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)[:hmacSize]
+}
+
+// ctsEncrypt encrypts data with AES in CBC mode with ciphertext stealing
+// and a zero IV (RFC 3962 section 5). data must be at least one block.
+func ctsEncrypt(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	n := len(data)
+	if n < aes.BlockSize {
+		return nil, errors.New("cts: input shorter than a block")
+	}
+	padded := make([]byte, (n+aes.BlockSize-1)/aes.BlockSize*aes.BlockSize)
+	copy(padded, data)
+	cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(padded, padded)
+	if n == aes.BlockSize {
+		return padded, nil
+	}
+	// Swap the last two blocks and drop the padding.
+	last := len(padded) - aes.BlockSize
+	out := make([]byte, 0, n)
+	out = append(out, padded[:last-aes.BlockSize]...)
+	out = append(out, padded[last:]...)
+	out = append(out, padded[last-aes.BlockSize : last][:n-last]...)
+	return out, nil
+}
+
+// ctsDecrypt reverses ctsEncrypt.
+func ctsDecrypt(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	n := len(data)
+	if n < aes.BlockSize {
+		return nil, fmt.Errorf("%w: ciphertext shorter than a block", errIntegrity)
+	}
+	out := make([]byte, n)
+	if n == aes.BlockSize {
+		block.Decrypt(out, data)
+		return out, nil
+	}
+	// Blocks before the final two decrypt as plain CBC.
+	tail := ((n+aes.BlockSize-1)/aes.BlockSize - 2) * aes.BlockSize // start of the penultimate block
+	iv := make([]byte, aes.BlockSize)
+	if tail > 0 {
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(out[:tail], data[:tail])
+		copy(iv, data[tail-aes.BlockSize:tail])
+	}
+	partial := data[tail+aes.BlockSize:]
+	d := make([]byte, aes.BlockSize)
+	block.Decrypt(d, data[tail:tail+aes.BlockSize])
+	prev := make([]byte, aes.BlockSize)
+	copy(prev, partial)
+	copy(prev[len(partial):], d[len(partial):])
+	for i := range partial {
+		out[tail+aes.BlockSize+i] = d[i] ^ partial[i]
+	}
+	block.Decrypt(out[tail:tail+aes.BlockSize], prev)
+	for i := range aes.BlockSize {
+		out[tail+i] ^= iv[i]
+	}
+	return out, nil
+}
+
+// nfold stretches or folds in to bits bits (RFC 3961 section 5.1).
+func nfold(in []byte, bits int) []byte {
+	inBits := len(in) * 8
+	lcm := bits * inBits / gcd(bits, inBits)
+	outLen := bits / 8
+	// Concatenate copies of in, each rotated right 13 bits more than the
+	// last, and add the outLen-byte chunks with end-around carry.
+	buf := make([]byte, lcm/8)
+	for i := range lcm / inBits {
+		rotated := rotateRight(in, 13*i)
+		copy(buf[i*len(in):], rotated)
+	}
+	sum := make([]byte, outLen)
+	for off := 0; off < len(buf); off += outLen {
+		sum = onesComplementAdd(sum, buf[off:off+outLen])
+	}
+	return sum
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// rotateRight rotates the bit string in right by n bits.
+func rotateRight(in []byte, n int) []byte {
+	bits := len(in) * 8
+	n %= bits
+	out := make([]byte, len(in))
+	for i := range bits {
+		if in[i/8]&(0x80>>(i%8)) != 0 {
+			j := (i + n) % bits
+			out[j/8] |= 0x80 >> (j % 8)
+		}
+	}
+	return out
+}
+
+// onesComplementAdd adds two equal-length big-endian numbers with
+// end-around carry.
+func onesComplementAdd(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	carry := 0
+	for i := len(a) - 1; i >= 0; i-- {
+		s := int(a[i]) + int(b[i]) + carry
+		out[i] = byte(s)
+		carry = s >> 8
+	}
+	for carry != 0 {
+		for i := len(out) - 1; i >= 0 && carry != 0; i-- {
+			s := int(out[i]) + carry
+			out[i] = byte(s)
+			carry = s >> 8
+		}
+	}
+	return out
+}
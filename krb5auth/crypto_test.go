@@ -0,0 +1,98 @@
+package krb5auth
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// RFC 3961 appendix A.1.
+func TestNfold(t *testing.T) {
+	for _, tc := range []struct {
+		bits int
+		in   string
+		want string
+	}{
+		{64, "012345", "be072631276b1955"},
+		{56, "password", "78a07b6caf85fa"},
+		{64, "Rough Consensus, and Running Code", "bb6ed30870b7f0e0"},
+		{168, "password", "59e4a8ca7c0385c3c37b3f6d2000247cb6e6bd5b3e"},
+		{192, "MASSACHVSETTS INSTITVTE OF TECHNOLOGY", "db3b0d8f0b061e603282b308a50841229ad798fab9540c1b"},
+		{168, "Q", "518a54a215a8452a518a54a215a8452a518a54a215"},
+		{64, "kerberos", "6b65726265726f73"},
+		{128, "kerberos", "6b65726265726f737b9b5b2b93132b93"},
+		{256, "kerberos", "6b65726265726f737b9b5b2b93132b935c9bdcdad95c9899c4cae4dee6d6cae4"},
+	} {
+		if got := hex.EncodeToString(nfold([]byte(tc.in), tc.bits)); got != tc.want {
+			t.Errorf("%d-fold(%q) = %s, want %s", tc.bits, tc.in, got, tc.want)
+		}
+	}
+}
+
+// RFC 3962 appendix B.
+func TestCTS(t *testing.T) {
+	key := []byte("chicken teriyaki")
+	plain := []byte("I would like the General Gau's Chicken, please, and wonton soup.")
+	for _, tc := range []struct {
+		n    int
+		want string
+	}{
+		{17, "c6353568f2bf8cb4d8a580362da7ff7f97"},
+		{31, "fc00783e0efdb2c1d445d4c8eff7ed2297687268d6ecccc0c07b25e25ecfe5"},
+		{32, "39312523a78662d5be7fcbcc98ebf5a897687268d6ecccc0c07b25e25ecfe584"},
+		{47, "97687268d6ecccc0c07b25e25ecfe584b3fffd940c16a18c1b5549d2f838029e39312523a78662d5be7fcbcc98ebf5"},
+		{64, "97687268d6ecccc0c07b25e25ecfe58439312523a78662d5be7fcbcc98ebf5a84807efe836ee89a526730dbc2f7bc8409dad8bbb96c4cdc03bc103e1a194bbd8"},
+	} {
+		got, err := ctsEncrypt(key, plain[:tc.n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(got) != tc.want {
+			t.Errorf("encrypt %d bytes = %x, want %s", tc.n, got, tc.want)
+		}
+		back, err := ctsDecrypt(key, unhex(t, tc.want))
+		if err != nil || !bytes.Equal(back, plain[:tc.n]) {
+			t.Errorf("decrypt %d bytes = %q, %v", tc.n, back, err)
+		}
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	for _, etype := range []int{ETypeAES128, ETypeAES256} {
+		key, err := newKey(etype, bytes.Repeat([]byte{0x42}, keyLength(etype)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range []int{0, 1, 16, 33} {
+			plain := bytes.Repeat([]byte{'x'}, n)
+			ct, err := key.encrypt(usageTicket, plain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := key.decrypt(usageTicket, ct)
+			if err != nil || !bytes.Equal(got, plain) {
+				t.Errorf("etype %d, %d bytes: got %q, %v", etype, n, got, err)
+			}
+			if _, err := key.decrypt(usageAuthenticator, ct); !errors.Is(err, errIntegrity) {
+				t.Errorf("etype %d: wrong usage: err = %v, want errIntegrity", etype, err)
+			}
+			ct[0] ^= 1
+			if _, err := key.decrypt(usageTicket, ct); !errors.Is(err, errIntegrity) {
+				t.Errorf("etype %d: tampered: err = %v, want errIntegrity", etype, err)
+			}
+		}
+	}
+	if _, err := newKey(23, make([]byte, 16)); err == nil {
+		t.Error("rc4-hmac key accepted")
+	}
+}
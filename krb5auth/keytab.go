@@ -0,0 +1,186 @@
+package krb5auth
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// keytabVersion is the only keytab format supported, the one MIT and
+// Heimdal ktutil write.
+const keytabVersion = 0x0502
+
+// ErrMalformedKeytab indicates a keytab that does not follow the MIT
+// file format.
+var ErrMalformedKeytab = errors.New("krb5auth: malformed keytab")
+
+// Keytab holds the service keys tickets are encrypted with.
+type Keytab struct {
+	entries []keytabEntry
+}
+
+// keytabEntry is one key of a keytab.
+type keytabEntry struct {
+	principal string // "service/host@REALM"
+	kvno      uint32
+	key       encryptionKey
+}
+
+// LoadKeytab reads a keytab file.
+func LoadKeytab(path string) (*Keytab, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read keytab: %w", err)
+	}
+	return ParseKeytab(data)
+}
+
+// ParseKeytab parses keytab data in the MIT format (version 0x502). Keys
+// of unsupported encryption types are skipped; a keytab without any AES
+// key is an error.
+func ParseKeytab(data []byte) (*Keytab, error) {
+	if len(data) < 2 || binary.BigEndian.Uint16(data) != keytabVersion {
+		return nil, fmt.Errorf("%w: unsupported version", ErrMalformedKeytab)
+	}
+	kt := &Keytab{}
+	r := keytabReader{data: data[2:]}
+	for len(r.data) > 0 {
+		size := int32(r.uint32())
+		if r.err != nil {
+			break
+		}
+		if size < 0 { // a hole left by a deleted entry
+			r.bytes(int(-size))
+			continue
+		}
+		entry := keytabReader{data: r.bytes(int(size))}
+		if r.err != nil {
+			break
+		}
+		if e, ok := entry.entry(); ok {
+			kt.entries = append(kt.entries, e)
+		}
+		if entry.err != nil {
+			r.err = entry.err
+		}
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedKeytab, r.err)
+	}
+	if len(kt.entries) == 0 {
+		return nil, fmt.Errorf("%w: no AES keys", ErrMalformedKeytab)
+	}
+	return kt, nil
+}
+
+// Principals returns the service principals the keytab holds keys for.
+func (kt *Keytab) Principals() []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, e := range kt.entries {
+		if !seen[e.principal] {
+			seen[e.principal] = true
+			names = append(names, e.principal)
+		}
+	}
+	return names
+}
+
+// key returns the key for principal of etype with version kvno, or the
+// newest one if kvno is 0.
+func (kt *Keytab) key(principal string, etype int, kvno uint32) (encryptionKey, bool) {
+	var found *keytabEntry
+	for i, e := range kt.entries {
+		if e.principal != principal || e.key.etype != etype {
+			continue
+		}
+		if kvno != 0 && e.kvno != kvno {
+			continue
+		}
+		if found == nil || e.kvno > found.kvno {
+			found = &kt.entries[i]
+		}
+	}
+	if found == nil {
+		return encryptionKey{}, false
+	}
+	return found.key, true
+}
+
+// keytabReader decodes big-endian keytab fields, remembering the first
+// error.
+type keytabReader struct {
+	data []byte
+	err  error
+}
+
+func (r *keytabReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.data) {
+		r.err = errors.New("truncated entry")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *keytabReader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *keytabReader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *keytabReader) string() string {
+	return string(r.bytes(int(r.uint16())))
+}
+
+// entry decodes one keytab entry. It reports false for entries with a
+// key of an unsupported type.
+func (r *keytabReader) entry() (keytabEntry, bool) {
+	components := int(r.uint16())
+	realm := r.string()
+	names := make([]string, 0, components)
+	for range components {
+		names = append(names, r.string())
+	}
+	r.uint32() // name type
+	r.uint32() // timestamp
+	var kvno uint32
+	if b := r.bytes(1); b != nil {
+		kvno = uint32(b[0])
+	}
+	etype := int(r.uint16())
+	value := r.bytes(int(r.uint16()))
+	// A 32-bit version number follows in newer keytabs and supersedes the
+	// 8-bit one when it is non-zero.
+	if len(r.data) >= 4 {
+		if v := r.uint32(); v != 0 {
+			kvno = v
+		}
+	}
+	if r.err != nil {
+		return keytabEntry{}, false
+	}
+	key, err := newKey(etype, value)
+	if err != nil {
+		return keytabEntry{}, false
+	}
+	return keytabEntry{
+		principal: strings.Join(names, "/") + "@" + realm,
+		kvno:      kvno,
+		key:       key,
+	}, true
+}
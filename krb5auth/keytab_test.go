@@ -0,0 +1,107 @@
+package krb5auth
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// keytabRecord is one entry for keytabFile.
+type keytabRecord struct {
+	principal string
+	kvno      uint32
+	etype     int
+	key       []byte
+}
+
+// keytabFile encodes records in the MIT keytab format, with the 32-bit
+// version number after each key.
+func keytabFile(records ...keytabRecord) []byte {
+	out := []byte{0x05, 0x02}
+	for _, r := range records {
+		names, realm, _ := strings.Cut(r.principal, "@")
+		components := strings.Split(names, "/")
+		var e []byte
+		e = binary.BigEndian.AppendUint16(e, uint16(len(components)))
+		e = appendCounted(e, realm)
+		for _, c := range components {
+			e = appendCounted(e, c)
+		}
+		e = binary.BigEndian.AppendUint32(e, 1) // KRB5_NT_PRINCIPAL
+		e = binary.BigEndian.AppendUint32(e, 1700000000)
+		e = append(e, byte(r.kvno))
+		e = binary.BigEndian.AppendUint16(e, uint16(r.etype))
+		e = appendCounted(e, string(r.key))
+		e = binary.BigEndian.AppendUint32(e, r.kvno)
+		out = binary.BigEndian.AppendUint32(out, uint32(len(e)))
+		out = append(out, e...)
+	}
+	return out
+}
+
+func appendCounted(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func TestParseKeytab(t *testing.T) {
+	aes128 := bytes.Repeat([]byte{1}, 16)
+	aes256 := bytes.Repeat([]byte{2}, 32)
+	newer := bytes.Repeat([]byte{3}, 32)
+	data := keytabFile(
+		keytabRecord{testService, 2, ETypeAES256, aes256},
+		keytabRecord{testService, 2, ETypeAES128, aes128},
+		keytabRecord{testService, 2, 23, bytes.Repeat([]byte{4}, 16)}, // rc4-hmac
+		keytabRecord{"smtp/mail.example.com@EXAMPLE.COM", 300, ETypeAES256, newer},
+		keytabRecord{testService, 3, ETypeAES256, newer},
+	)
+	// A hole left by a deleted entry.
+	data = binary.BigEndian.AppendUint32(data, uint32(0xffffffff-7)) // -8
+	data = append(data, make([]byte, 8)...)
+
+	path := filepath.Join(t.TempDir(), "mail.keytab")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	kt, err := LoadKeytab(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := kt.Principals(); !slices.Equal(got, []string{testService, "smtp/mail.example.com@EXAMPLE.COM"}) {
+		t.Errorf("Principals() = %v", got)
+	}
+	for _, tc := range []struct {
+		principal string
+		etype     int
+		kvno      uint32
+		want      []byte
+	}{
+		{testService, ETypeAES256, 2, aes256},
+		{testService, ETypeAES256, 0, newer},
+		{testService, ETypeAES128, 0, aes128},
+		{"smtp/mail.example.com@EXAMPLE.COM", ETypeAES256, 300, newer},
+		{testService, 23, 2, nil},
+		{testService, ETypeAES128, 3, nil},
+		{"imap/other.example.com@EXAMPLE.COM", ETypeAES256, 0, nil},
+	} {
+		key, ok := kt.key(tc.principal, tc.etype, tc.kvno)
+		if ok != (tc.want != nil) || !bytes.Equal(key.value, tc.want) {
+			t.Errorf("key(%s, %d, %d) = %x, %v", tc.principal, tc.etype, tc.kvno, key.value, ok)
+		}
+	}
+
+	for name, data := range map[string][]byte{
+		"version":   {0x05, 0x01},
+		"truncated": keytabFile(keytabRecord{testService, 2, ETypeAES256, aes256})[:30],
+		"no aes":    keytabFile(keytabRecord{testService, 2, 23, bytes.Repeat([]byte{4}, 16)}),
+	} {
+		if _, err := ParseKeytab(data); !errors.Is(err, ErrMalformedKeytab) {
+			t.Errorf("%s: err = %v, want ErrMalformedKeytab", name, err)
+		}
+	}
+}
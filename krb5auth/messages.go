@@ -0,0 +1,205 @@
+package krb5auth
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrMalformedToken indicates a GSS-API token or Kerberos message that
+// does not parse.
+var ErrMalformedToken = errors.New("krb5auth: malformed token")
+
+// Kerberos message types and ASN.1 application tags (RFC 4120 section 5).
+const (
+	tagTicket        = 1
+	tagAuthenticator = 2
+	tagEncTicketPart = 3
+	tagAPReq         = 14
+	tagAPRep         = 15
+	tagEncAPRepPart  = 27
+)
+
+// krb5Mech is the Kerberos V5 GSS-API mechanism OID (RFC 1964).
+var krb5Mech = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2}
+
+// GSS-API token identifiers (RFC 4121 section 4.1).
+var (
+	tokAPReq = []byte{0x01, 0x00}
+	tokAPRep = []byte{0x02, 0x00}
+)
+
+// Bits of KerberosFlags values. BIT STRING bit 0 is the most significant.
+const (
+	apOptionUseSessionKey  = 1
+	apOptionMutualRequired = 2
+	ticketFlagInvalid      = 7
+)
+
+// gssChecksumType is the authenticator checksum type carrying GSS-API
+// flags (RFC 4121 section 4.1.1).
+const gssChecksumType = 0x8003
+
+// gssMutualFlag is the GSS-API context flag requesting mutual
+// authentication.
+const gssMutualFlag = 0x02
+
+type principalName struct {
+	NameType   int      `asn1:"explicit,tag:0"`
+	NameString []string `asn1:"explicit,tag:1"`
+}
+
+// principal returns the name as "name/instance@realm".
+func (p principalName) principal(realm string) string {
+	return strings.Join(p.NameString, "/") + "@" + realm
+}
+
+type encryptedData struct {
+	EType  int    `asn1:"explicit,tag:0"`
+	KVNO   int    `asn1:"optional,explicit,tag:1"`
+	Cipher []byte `asn1:"explicit,tag:2"`
+}
+
+type encKey struct {
+	KeyType  int    `asn1:"explicit,tag:0"`
+	KeyValue []byte `asn1:"explicit,tag:1"`
+}
+
+type checksumField struct {
+	CksumType int    `asn1:"explicit,tag:0"`
+	Checksum  []byte `asn1:"explicit,tag:1"`
+}
+
+type apReq struct {
+	PVNO          int            `asn1:"explicit,tag:0"`
+	MsgType       int            `asn1:"explicit,tag:1"`
+	APOptions     asn1.BitString `asn1:"explicit,tag:2"`
+	Ticket        asn1.RawValue  `asn1:"explicit,tag:3"`
+	Authenticator encryptedData  `asn1:"explicit,tag:4"`
+}
+
+type ticket struct {
+	TktVNO  int           `asn1:"explicit,tag:0"`
+	Realm   string        `asn1:"explicit,tag:1"`
+	SName   principalName `asn1:"explicit,tag:2"`
+	EncPart encryptedData `asn1:"explicit,tag:3"`
+}
+
+type transitedEncoding struct {
+	TRType   int    `asn1:"explicit,tag:0"`
+	Contents []byte `asn1:"explicit,tag:1"`
+}
+
+type encTicketPart struct {
+	Flags     asn1.BitString    `asn1:"explicit,tag:0"`
+	Key       encKey            `asn1:"explicit,tag:1"`
+	CRealm    string            `asn1:"explicit,tag:2"`
+	CName     principalName     `asn1:"explicit,tag:3"`
+	Transited transitedEncoding `asn1:"explicit,tag:4"`
+	AuthTime  time.Time         `asn1:"generalized,explicit,tag:5"`
+	StartTime time.Time         `asn1:"generalized,optional,explicit,tag:6"`
+	EndTime   time.Time         `asn1:"generalized,explicit,tag:7"`
+	// renew-till, caddr and authorization-data are not used.
+}
+
+type authenticator struct {
+	AVNO      int           `asn1:"explicit,tag:0"`
+	CRealm    string        `asn1:"explicit,tag:1"`
+	CName     principalName `asn1:"explicit,tag:2"`
+	Cksum     checksumField `asn1:"optional,explicit,tag:3"`
+	Cusec     int           `asn1:"explicit,tag:4"`
+	CTime     time.Time     `asn1:"generalized,explicit,tag:5"`
+	Subkey    encKey        `asn1:"optional,explicit,tag:6"`
+	SeqNumber int64         `asn1:"optional,explicit,tag:7"`
+	// authorization-data is not used.
+}
+
+type apRep struct {
+	PVNO    int           `asn1:"explicit,tag:0"`
+	MsgType int           `asn1:"explicit,tag:1"`
+	EncPart encryptedData `asn1:"explicit,tag:2"`
+}
+
+type encAPRepPart struct {
+	CTime     time.Time `asn1:"generalized,explicit,tag:0"`
+	Cusec     int       `asn1:"explicit,tag:1"`
+	SeqNumber int64     `asn1:"optional,explicit,tag:3"`
+}
+
+// unmarshalApp decodes an [APPLICATION tag] SEQUENCE into v, rejecting
+// trailing data.
+func unmarshalApp(data []byte, tag int, v any) error {
+	rest, err := asn1.UnmarshalWithParams(data, v, fmt.Sprintf("application,explicit,tag:%d", tag))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedToken, err)
+	}
+	if len(rest) != 0 {
+		return fmt.Errorf("%w: trailing data", ErrMalformedToken)
+	}
+	return nil
+}
+
+// marshalApp encodes v as an [APPLICATION tag] SEQUENCE.
+func marshalApp(v any, tag int) ([]byte, error) {
+	return asn1.MarshalWithParams(v, fmt.Sprintf("application,explicit,tag:%d", tag))
+}
+
+// kerberosTime truncates t to the whole seconds KerberosTime holds.
+func kerberosTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Second)
+}
+
+// unwrapToken returns the Kerberos message inside a GSS-API initial
+// context token (RFC 2743 section 3.1) with token identifier tokID.
+func unwrapToken(token, tokID []byte) ([]byte, error) {
+	var outer asn1.RawValue
+	rest, err := asn1.Unmarshal(token, &outer)
+	if err != nil || len(rest) != 0 || outer.Class != asn1.ClassApplication || outer.Tag != 0 || !outer.IsCompound {
+		return nil, fmt.Errorf("%w: not a GSS-API token", ErrMalformedToken)
+	}
+	var mech asn1.ObjectIdentifier
+	body, err := asn1.Unmarshal(outer.Bytes, &mech)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedToken, err)
+	}
+	if !mech.Equal(krb5Mech) {
+		return nil, fmt.Errorf("%w: mechanism %v is not Kerberos V5", ErrMalformedToken, mech)
+	}
+	if len(body) < 2 || !bytes.Equal(body[:2], tokID) {
+		return nil, fmt.Errorf("%w: unexpected token identifier", ErrMalformedToken)
+	}
+	return body[2:], nil
+}
+
+// wrapToken frames a Kerberos message as a GSS-API token with token
+// identifier tokID.
+func wrapToken(tokID, msg []byte) ([]byte, error) {
+	mech, err := asn1.Marshal(krb5Mech)
+	if err != nil {
+		return nil, err
+	}
+	inner := append(append(mech, tokID...), msg...)
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassApplication, Tag: 0, IsCompound: true, Bytes: inner})
+}
+
+// gssFlags returns the context flags of a GSS-API authenticator checksum:
+// a 4-byte length of the channel bindings hash, the 16-byte hash and the
+// 4-byte little-endian flags.
+func gssFlags(c checksumField) (uint32, error) {
+	if c.CksumType != gssChecksumType || len(c.Checksum) < 24 {
+		return 0, fmt.Errorf("%w: authenticator lacks the GSS-API checksum", ErrMalformedToken)
+	}
+	if binary.LittleEndian.Uint32(c.Checksum) != 16 {
+		return 0, fmt.Errorf("%w: bad channel bindings length", ErrMalformedToken)
+	}
+	return binary.LittleEndian.Uint32(c.Checksum[20:]), nil
+}
+
+// flagSet reports whether bit is set in a KerberosFlags value.
+func flagSet(flags asn1.BitString, bit int) bool {
+	return bit < flags.BitLength && flags.At(bit) == 1
+}
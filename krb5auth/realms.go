@@ -0,0 +1,40 @@
+package krb5auth
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// LoadRealms reads a realm mapping file for Options.Realms: "REALM
+// domain" lines, with blank lines and "#" comments ignored.
+//
+//	# realm            domain
+//	EXAMPLE.COM        example.com
+//	AD.EXAMPLE.COM     example.com
+func LoadRealms(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read realms file: %w", err)
+	}
+	realms := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%w: %s:%d: want \"REALM domain\"", autherrors.ErrAuthAgentConfigInvalid, path, n)
+		}
+		realms[fields[0]] = strings.ToLower(fields[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read realms file: %w", err)
+	}
+	return realms, nil
+}
@@ -0,0 +1,33 @@
+package krb5auth
+
+import (
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+func TestLoadRealms(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "krb5-realms")
+	content := "# realm  domain\nEXAMPLE.COM example.com\n\nAD.EXAMPLE.COM\tExample.com\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	realms, err := LoadRealms(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(realms, testRealms) {
+		t.Errorf("realms = %v, want %v", realms, testRealms)
+	}
+
+	if err := os.WriteFile(path, []byte("EXAMPLE.COM\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadRealms(path); !errors.Is(err, autherrors.ErrAuthAgentConfigInvalid) {
+		t.Errorf("malformed: err = %v, want ErrAuthAgentConfigInvalid", err)
+	}
+}
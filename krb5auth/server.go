@@ -0,0 +1,114 @@
+package krb5auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// Mechanism is the SASL mechanism name (RFC 4752).
+const Mechanism = "GSSAPI"
+
+// securityLayerNone is the RFC 4752 bit for "no security layer", the only
+// layer offered: connections are protected by TLS instead.
+const securityLayerNone = 0x01
+
+// Server states.
+const (
+	stateStart = iota
+	stateReplied
+	stateOffered
+	stateDone
+)
+
+// Server is the server side of one GSSAPI SASL exchange (RFC 4752): pass
+// each client response to Next until it reports done, then log the user
+// in with domain.AuthRouter.AuthenticatePrincipal(ctx, s.Address(),
+// s.Principal()). A Server is not safe for concurrent use and serves a
+// single exchange.
+type Server struct {
+	acceptor *Acceptor
+	ctx      *Context
+	state    int
+	authzid  string
+}
+
+// NewServer returns a Server accepting tickets with a.
+func (a *Acceptor) NewServer() *Server {
+	return &Server{acceptor: a}
+}
+
+// Principal returns the client's Kerberos principal once the ticket has
+// been accepted.
+func (s *Server) Principal() string {
+	if s.ctx == nil {
+		return ""
+	}
+	return s.ctx.Principal
+}
+
+// Address returns the mail address the principal maps to once the ticket
+// has been accepted.
+func (s *Server) Address() string {
+	if s.ctx == nil {
+		return ""
+	}
+	return s.ctx.Address
+}
+
+// AuthzID returns the authorization identity the client asked for, empty
+// if none. It is known once Next reports done.
+func (s *Server) AuthzID() string { return s.authzid }
+
+// Next processes a client response and returns the next challenge. done
+// means the exchange succeeded and the daemon should log the user in;
+// the returned challenge is then nil. The first response is the client's
+// GSS-API token. An authzid other than Address fails with
+// errors.ErrAuthorizationDenied; other failures wrap
+// errors.ErrAuthFailed.
+func (s *Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	switch s.state {
+	case stateStart:
+		if s.ctx, err = s.acceptor.Accept(response); err != nil {
+			s.state = stateDone
+			return nil, false, err
+		}
+		if s.ctx.Reply != nil {
+			s.state = stateReplied
+			return s.ctx.Reply, false, nil
+		}
+		return s.offer(), false, nil
+	case stateReplied:
+		// The client acknowledges the AP-REP with an empty response.
+		return s.offer(), false, nil
+	case stateOffered:
+		s.state = stateDone
+		return nil, true, s.finish(response)
+	}
+	return nil, false, errors.New("krb5auth: exchange already finished")
+}
+
+// offer returns the wrapped security layer offer: no layer, and so a
+// maximum message size of zero.
+func (s *Server) offer() []byte {
+	s.state = stateOffered
+	return s.ctx.wrap([]byte{securityLayerNone, 0, 0, 0})
+}
+
+// finish checks the client's wrapped security layer choice and authzid.
+func (s *Server) finish(response []byte) error {
+	msg, err := s.ctx.unwrap(response)
+	if err != nil {
+		return fmt.Errorf("%w: %w", autherrors.ErrAuthFailed, err)
+	}
+	if len(msg) < 4 || msg[0] != securityLayerNone {
+		return fmt.Errorf("%w: %w: client must choose no security layer", autherrors.ErrAuthFailed, ErrMalformedToken)
+	}
+	s.authzid = string(msg[4:])
+	if s.authzid != "" && !strings.EqualFold(s.authzid, s.ctx.Address) {
+		return fmt.Errorf("%w: %s as %s", autherrors.ErrAuthorizationDenied, s.ctx.Principal, s.authzid)
+	}
+	return nil
+}
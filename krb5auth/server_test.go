@@ -0,0 +1,139 @@
+package krb5auth
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// initiatorWrap returns the client's wrap token for data. Sealed tokens
+// are encrypted and rotated by rrc octets, as Windows clients do.
+func (c *clientContext) initiatorWrap(t *testing.T, data []byte, sealed bool, rrc int) []byte {
+	t.Helper()
+	header := make([]byte, wrapHeaderSize)
+	header[0], header[1], header[3] = 0x05, 0x04, 0xff
+	binary.BigEndian.PutUint64(header[8:], c.seq)
+	c.seq++
+	if !sealed {
+		sum := c.key.checksum(usageInitiatorSeal, append(append([]byte{}, data...), header...))
+		binary.BigEndian.PutUint16(header[4:], uint16(len(sum)))
+		return append(append(header, data...), sum...)
+	}
+	header[2] = wrapSealed
+	body, err := c.key.encrypt(usageInitiatorSeal, append(append([]byte{}, data...), header...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rrc %= len(body)
+	body = append(body[len(body)-rrc:], body[:len(body)-rrc]...)
+	binary.BigEndian.PutUint16(header[6:], uint16(rrc))
+	return append(header, body...)
+}
+
+// checkOffer verifies the acceptor's wrapped security layer offer.
+func (c *clientContext) checkOffer(t *testing.T, token []byte, seq uint64) {
+	t.Helper()
+	if len(token) != wrapHeaderSize+4+hmacSize || token[2] != wrapSentByAcceptor {
+		t.Fatalf("offer = %x", token)
+	}
+	if got := binary.BigEndian.Uint64(token[8:]); got != seq {
+		t.Errorf("offer sequence number = %d, want %d", got, seq)
+	}
+	header := append([]byte{}, token[:wrapHeaderSize]...)
+	binary.BigEndian.PutUint16(header[4:], 0)
+	data := token[wrapHeaderSize : wrapHeaderSize+4]
+	if !hmac.Equal(token[wrapHeaderSize+4:], c.key.checksum(usageAcceptorSeal, append(append([]byte{}, data...), header...))) {
+		t.Error("offer checksum does not verify")
+	}
+	if data[0] != securityLayerNone || data[1]|data[2]|data[3] != 0 {
+		t.Errorf("offer = %x, want no security layer", data)
+	}
+}
+
+func layerChoice(authzid string) []byte {
+	return append([]byte{securityLayerNone, 0, 0, 0}, authzid...)
+}
+
+func TestServer(t *testing.T) {
+	kdc := newTestKDC(t)
+	a := newTestAcceptor(t, kdc)
+
+	// With mutual authentication: AP-REP, empty response, offer, choice.
+	c := kdc.apReq(t, ticketOpts{mutual: true})
+	s := a.NewServer()
+	reply, done, err := s.Next(c.token)
+	if err != nil || done {
+		t.Fatalf("token: done %v, %v", done, err)
+	}
+	seq := c.checkReply(t, reply)
+	offer, done, err := s.Next(nil)
+	if err != nil || done {
+		t.Fatalf("ack: done %v, %v", done, err)
+	}
+	c.checkOffer(t, offer, seq)
+	challenge, done, err := s.Next(c.initiatorWrap(t, layerChoice(""), false, 0))
+	if err != nil || !done || challenge != nil {
+		t.Fatalf("choice: %x, done %v, %v", challenge, done, err)
+	}
+	if s.Principal() != "alice@EXAMPLE.COM" || s.Address() != "alice@example.com" || s.AuthzID() != "" {
+		t.Errorf("server = %s, %s, %q", s.Principal(), s.Address(), s.AuthzID())
+	}
+	if _, _, err := s.Next(nil); err == nil {
+		t.Error("Next after done succeeded")
+	}
+
+	// Without: the offer answers the token directly. The client seals and
+	// rotates its choice.
+	c = kdc.apReq(t, ticketOpts{subkey: true})
+	s = a.NewServer()
+	offer, _, err = s.Next(c.token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.checkOffer(t, offer, c.seq)
+	if _, done, err := s.Next(c.initiatorWrap(t, layerChoice("Alice@example.com"), true, 28)); err != nil || !done {
+		t.Errorf("sealed choice with authzid: done %v, %v", done, err)
+	}
+}
+
+func TestServer_Refused(t *testing.T) {
+	kdc := newTestKDC(t)
+	a := newTestAcceptor(t, kdc)
+
+	start := func() (*Server, *clientContext) {
+		c := kdc.apReq(t, ticketOpts{})
+		s := a.NewServer()
+		if _, _, err := s.Next(c.token); err != nil {
+			t.Fatal(err)
+		}
+		return s, c
+	}
+
+	s, c := start()
+	if _, _, err := s.Next(c.initiatorWrap(t, layerChoice("bob@example.com"), false, 0)); !errors.Is(err, autherrors.ErrAuthorizationDenied) {
+		t.Errorf("other authzid: err = %v, want ErrAuthorizationDenied", err)
+	}
+
+	s, c = start()
+	if _, _, err := s.Next(c.initiatorWrap(t, []byte{0x04, 0, 0x10, 0}, false, 0)); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("confidentiality layer: err = %v, want ErrAuthFailed", err)
+	}
+
+	s, c = start()
+	token := c.initiatorWrap(t, layerChoice(""), false, 0)
+	token[wrapHeaderSize] ^= 1
+	if _, _, err := s.Next(token); !errors.Is(err, autherrors.ErrAuthFailed) || !errors.Is(err, errIntegrity) {
+		t.Errorf("tampered choice: err = %v, want ErrAuthFailed", err)
+	}
+
+	s = a.NewServer()
+	if _, _, err := s.Next([]byte("not a token")); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("garbage token: err = %v, want ErrAuthFailed", err)
+	}
+	if _, _, err := s.Next(nil); err == nil {
+		t.Error("Next after a failed token succeeded")
+	}
+}
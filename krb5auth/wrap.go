@@ -0,0 +1,78 @@
+package krb5auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/binary"
+	"fmt"
+)
+
+// Wrap token layout (RFC 4121 section 4.2.6.2).
+const (
+	wrapHeaderSize = 16
+
+	wrapSentByAcceptor = 0x01
+	wrapSealed         = 0x02
+	wrapAcceptorSubkey = 0x04
+)
+
+// wrap returns an integrity-protected wrap token carrying data from the
+// acceptor.
+func (c *Context) wrap(data []byte) []byte {
+	header := make([]byte, wrapHeaderSize)
+	header[0], header[1] = 0x05, 0x04
+	header[2] = wrapSentByAcceptor
+	header[3] = 0xff
+	binary.BigEndian.PutUint64(header[8:], c.sendSeq)
+	c.sendSeq++
+
+	// The checksum covers the data, then the header with EC and RRC zero.
+	sum := c.key.checksum(usageAcceptorSeal, append(append([]byte{}, data...), header...))
+	binary.BigEndian.PutUint16(header[4:], uint16(len(sum)))
+	return append(append(header, data...), sum...)
+}
+
+// unwrap verifies a wrap token from the initiator and returns its data.
+// Sealed tokens are decrypted.
+func (c *Context) unwrap(token []byte) ([]byte, error) {
+	if len(token) < wrapHeaderSize || token[0] != 0x05 || token[1] != 0x04 || token[3] != 0xff {
+		return nil, fmt.Errorf("%w: not a wrap token", ErrMalformedToken)
+	}
+	flags := token[2]
+	if flags&(wrapSentByAcceptor|wrapAcceptorSubkey) != 0 {
+		return nil, fmt.Errorf("%w: unexpected wrap token flags %#x", ErrMalformedToken, flags)
+	}
+	ec := int(binary.BigEndian.Uint16(token[4:]))
+	rrc := int(binary.BigEndian.Uint16(token[6:]))
+	header := append([]byte{}, token[:wrapHeaderSize]...)
+	binary.BigEndian.PutUint16(header[6:], 0)
+
+	// Undo the right rotation of the token body by RRC octets.
+	body := token[wrapHeaderSize:]
+	if len(body) > 0 {
+		rrc %= len(body)
+		body = append(append([]byte{}, body[rrc:]...), body[:rrc]...)
+	}
+
+	if flags&wrapSealed != 0 {
+		plain, err := c.key.decrypt(usageInitiatorSeal, body)
+		if err != nil {
+			return nil, fmt.Errorf("unwrap: %w", err)
+		}
+		// The plaintext is the data, EC filler octets and the header.
+		if len(plain) < ec+wrapHeaderSize || !bytes.Equal(plain[len(plain)-wrapHeaderSize:], header) {
+			return nil, fmt.Errorf("%w: wrap token header mismatch", ErrMalformedToken)
+		}
+		return plain[:len(plain)-wrapHeaderSize-ec], nil
+	}
+
+	if ec != hmacSize || len(body) < ec {
+		return nil, fmt.Errorf("%w: bad wrap token checksum length", ErrMalformedToken)
+	}
+	data, sum := body[:len(body)-ec], body[len(body)-ec:]
+	binary.BigEndian.PutUint16(header[4:], 0)
+	if !hmac.Equal(sum, c.key.checksum(usageInitiatorSeal, append(append([]byte{}, data...), header...))) {
+		return nil, fmt.Errorf("unwrap: %w", errIntegrity)
+	}
+	return data, nil
+}
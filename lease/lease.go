@@ -0,0 +1,211 @@
+// Package lease coordinates writers on a domains tree shared by several
+// hosts (NFS, or an object store behind package vfs) without replication.
+//
+// A lease is a small JSON file next to the resource it guards
+// ("passwd.lease" for "passwd") naming the holder and an expiry. A host
+// acquires the lease before a mutation, and it expires on its own if the
+// host dies. Every acquisition increments a fencing token stored in the
+// file. Before committing a write the holder calls Check, which re-reads
+// the file and fails with errors.ErrLeaseLost if the token has moved on, so
+// a host that stalled past its expiry cannot overwrite changes made by the
+// next holder.
+//
+// Shared filesystems offer no atomic compare-and-swap, so Acquire writes
+// the record, waits for the settle time and reads it back: of two hosts
+// racing for an expired lease only the last writer keeps it. Expiries are
+// absolute times, so the TTL must be much longer than the clock skew
+// between hosts.
+package lease
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/vfs"
+)
+
+// Suffix is appended to a resource path to name its lease file.
+const Suffix = ".lease"
+
+// record is the content of a lease file.
+type record struct {
+	Holder  string    `json:"holder"`
+	Nonce   string    `json:"nonce,omitempty"` // identifies one acquisition; empty when released
+	Token   uint64    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// Manager acquires leases on behalf of one host.
+type Manager struct {
+	fs     vfs.WriteFS
+	holder string
+	ttl    time.Duration
+	settle time.Duration
+	now    func() time.Time
+}
+
+// NewManager returns a Manager storing lease files on fsys, identifying
+// this host as holder (e.g. its hostname) and granting leases for ttl.
+func NewManager(fsys vfs.WriteFS, holder string, ttl time.Duration) *Manager {
+	return &Manager{
+		fs:     fsys,
+		holder: holder,
+		ttl:    ttl,
+		settle: 100 * time.Millisecond,
+		now:    time.Now,
+	}
+}
+
+// WithSettle sets how long Acquire waits before reading a freshly written
+// lease back (default 100ms). It should exceed the time the shared storage
+// takes to make a write visible to other hosts. Returns the Manager to
+// allow chaining.
+func (m *Manager) WithSettle(d time.Duration) *Manager {
+	m.settle = d
+	return m
+}
+
+// Lease is a held lease on one resource. Its methods are not safe for
+// concurrent use.
+type Lease struct {
+	m    *Manager
+	path string // lease file
+	rec  record
+}
+
+// Acquire takes the lease on resource. It fails with errors.ErrLeaseHeld
+// if another acquisition holds an unexpired lease, including a lost race.
+func (m *Manager) Acquire(resource string) (*Lease, error) {
+	path := resource + Suffix
+	cur, err := m.read(path)
+	if err != nil {
+		return nil, err
+	}
+	now := m.now()
+	if cur.Nonce != "" && now.Before(cur.Expires) {
+		return nil, fmt.Errorf("%w: %s held by %s until %s", autherrors.ErrLeaseHeld,
+			resource, cur.Holder, cur.Expires.Format(time.RFC3339))
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generate lease nonce: %w", err)
+	}
+	rec := record{
+		Holder:  m.holder,
+		Nonce:   hex.EncodeToString(nonce),
+		Token:   cur.Token + 1,
+		Expires: now.Add(m.ttl),
+	}
+	if err := m.write(path, rec); err != nil {
+		return nil, err
+	}
+
+	if m.settle > 0 {
+		time.Sleep(m.settle)
+	}
+	got, err := m.read(path)
+	if err != nil {
+		return nil, err
+	}
+	if got.Nonce != rec.Nonce {
+		return nil, fmt.Errorf("%w: %s taken by %s", autherrors.ErrLeaseHeld, resource, got.Holder)
+	}
+	return &Lease{m: m, path: path, rec: rec}, nil
+}
+
+// Token returns the fencing token of the acquisition. Tokens of successive
+// acquisitions of a resource strictly increase.
+func (l *Lease) Token() uint64 {
+	return l.rec.Token
+}
+
+// Check confirms the lease is still held: not expired and not taken over.
+// Call it immediately before committing a write. Returns
+// errors.ErrLeaseLost otherwise.
+func (l *Lease) Check() error {
+	if !l.m.now().Before(l.rec.Expires) {
+		return fmt.Errorf("%w: expired at %s", autherrors.ErrLeaseLost, l.rec.Expires.Format(time.RFC3339))
+	}
+	cur, err := l.m.read(l.path)
+	if err != nil {
+		return err
+	}
+	if cur.Nonce != l.rec.Nonce || cur.Token != l.rec.Token {
+		return fmt.Errorf("%w: token %d superseded by %d (%s)", autherrors.ErrLeaseLost, l.rec.Token, cur.Token, cur.Holder)
+	}
+	return nil
+}
+
+// Renew extends a held lease by the manager's TTL.
+func (l *Lease) Renew() error {
+	if err := l.Check(); err != nil {
+		return err
+	}
+	rec := l.rec
+	rec.Expires = l.m.now().Add(l.m.ttl)
+	if err := l.m.write(l.path, rec); err != nil {
+		return err
+	}
+	l.rec = rec
+	return nil
+}
+
+// Release gives the lease up so another host can acquire it without
+// waiting for expiry. The token is kept so the next acquisition still
+// increments it. Releasing a lease that was already lost is a no-op.
+func (l *Lease) Release() error {
+	cur, err := l.m.read(l.path)
+	if err != nil {
+		return err
+	}
+	if cur.Nonce != l.rec.Nonce {
+		return nil
+	}
+	return l.m.write(l.path, record{Holder: l.rec.Holder, Token: l.rec.Token})
+}
+
+// read returns the lease record at path; a missing file is a zero record.
+func (m *Manager) read(path string) (record, error) {
+	var rec record
+	data, err := m.fs.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return rec, nil
+		}
+		return rec, fmt.Errorf("read lease: %w", err)
+	}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return rec, fmt.Errorf("parse lease %s: %w", path, err)
+	}
+	return rec, nil
+}
+
+// write replaces the lease record at path. The temporary file is unique to
+// the acquisition so concurrent writers never share one.
+func (m *Manager) write(path string, rec record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("encode lease: %w", err)
+	}
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return fmt.Errorf("generate lease file name: %w", err)
+	}
+	tmp := path + "." + hex.EncodeToString(suffix) + ".tmp"
+	if err := m.fs.WriteFile(tmp, data, 0o640); err != nil {
+		_ = m.fs.Remove(tmp)
+		return fmt.Errorf("write lease: %w", err)
+	}
+	if err := m.fs.Rename(tmp, path); err != nil {
+		_ = m.fs.Remove(tmp)
+		return fmt.Errorf("write lease: %w", err)
+	}
+	return nil
+}
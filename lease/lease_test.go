@@ -0,0 +1,116 @@
+package lease
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/vfs"
+)
+
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time { return c.t }
+
+func newHosts(t *testing.T, fsys vfs.WriteFS, ttl time.Duration) (a, b *Manager, clk *clock) {
+	t.Helper()
+	clk = &clock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	a = NewManager(fsys, "host-a", ttl).WithSettle(0)
+	b = NewManager(fsys, "host-b", ttl).WithSettle(0)
+	a.now, b.now = clk.now, clk.now
+	return a, b, clk
+}
+
+func TestAcquire_ExcludesOtherHosts(t *testing.T) {
+	a, b, clk := newHosts(t, vfs.OS{}, time.Minute)
+	resource := t.TempDir() + "/passwd"
+
+	la, err := a.Acquire(resource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Acquire(resource); !errors.Is(err, autherrors.ErrLeaseHeld) {
+		t.Fatalf("second host: got %v, want ErrLeaseHeld", err)
+	}
+	if err := la.Check(); err != nil {
+		t.Errorf("Check while held: %v", err)
+	}
+
+	// Released: the other host acquires with a higher token.
+	if err := la.Release(); err != nil {
+		t.Fatal(err)
+	}
+	lb, err := b.Acquire(resource)
+	if err != nil {
+		t.Fatalf("after release: %v", err)
+	}
+	if lb.Token() <= la.Token() {
+		t.Errorf("token %d not above %d", lb.Token(), la.Token())
+	}
+
+	// Expired: taken over, and the stale holder is fenced off.
+	clk.t = clk.t.Add(2 * time.Minute)
+	la2, err := a.Acquire(resource)
+	if err != nil {
+		t.Fatalf("after expiry: %v", err)
+	}
+	if err := lb.Check(); !errors.Is(err, autherrors.ErrLeaseLost) {
+		t.Errorf("stale Check: got %v, want ErrLeaseLost", err)
+	}
+	if err := lb.Renew(); !errors.Is(err, autherrors.ErrLeaseLost) {
+		t.Errorf("stale Renew: got %v, want ErrLeaseLost", err)
+	}
+	// Releasing a lost lease does not release the new holder's.
+	if err := lb.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if err := la2.Check(); err != nil {
+		t.Errorf("new holder lost its lease: %v", err)
+	}
+}
+
+func TestRenew_ExtendsExpiry(t *testing.T) {
+	a, b, clk := newHosts(t, vfs.NewMemFS(), time.Minute)
+	l, err := a.Acquire("/passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk.t = clk.t.Add(50 * time.Second)
+	if err := l.Renew(); err != nil {
+		t.Fatal(err)
+	}
+	clk.t = clk.t.Add(50 * time.Second)
+	if err := l.Check(); err != nil {
+		t.Errorf("Check after renew: %v", err)
+	}
+	if _, err := b.Acquire("/passwd"); !errors.Is(err, autherrors.ErrLeaseHeld) {
+		t.Errorf("got %v, want ErrLeaseHeld", err)
+	}
+}
+
+// TestAcquire_RaceHasOneWinner has many managers race for one lease; the
+// settle-and-verify step must leave at most one of them holding it.
+func TestAcquire_RaceHasOneWinner(t *testing.T) {
+	resource := t.TempDir() + "/passwd"
+	var winners atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m := NewManager(vfs.OS{}, "host", time.Minute).WithSettle(20 * time.Millisecond)
+			if _, err := m.Acquire(resource); err == nil {
+				winners.Add(1)
+			} else if !errors.Is(err, autherrors.ErrLeaseHeld) {
+				t.Errorf("Acquire: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := winners.Load(); n > 1 {
+		t.Errorf("%d managers hold the lease", n)
+	}
+}
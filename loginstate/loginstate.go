@@ -0,0 +1,191 @@
+// Package loginstate records, per user, the last successful login and the
+// failed attempts since, for "last login" notices and lastlog reports (see
+// auth.LoginState).
+//
+// A Store keeps one domain's state in a file of JSON lines, one per event,
+// appended so that several daemons serving the domain can share it. Reads
+// replay the file. Once it grows past a threshold it is compacted into one
+// snapshot line per user.
+package loginstate
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/infodancer/auth"
+)
+
+// FileName is the name of a domain's login state file in its data
+// directory.
+const FileName = ".login_state"
+
+// compactBytes is the file size that triggers compaction.
+const compactBytes = 1 << 20
+
+// line is one line of the file: an event, or a snapshot of a user's state
+// written by compaction.
+type line struct {
+	Time     time.Time         `json:"time,omitzero"`
+	Username string            `json:"user"`
+	IP       string            `json:"ip,omitempty"`
+	Protocol string            `json:"protocol,omitempty"`
+	Outcome  auth.LoginOutcome `json:"outcome,omitempty"`
+	State    *auth.LoginState  `json:"state,omitempty"`
+}
+
+// apply updates state with l.
+func (l line) apply(state auth.LoginState) auth.LoginState {
+	switch {
+	case l.State != nil:
+		return *l.State
+	case l.Outcome == auth.LoginSuccess:
+		return auth.LoginState{LastLogin: l.Time, LastIP: l.IP, LastProtocol: l.Protocol}
+	case l.Outcome == auth.LoginFailure:
+		state.Failures++
+		state.LastFailure, state.LastFailureIP = l.Time, l.IP
+	}
+	return state
+}
+
+// Store is one domain's login state. It is safe for concurrent use, and
+// by several processes appending to the same file.
+type Store struct {
+	mu   sync.Mutex
+	path string
+}
+
+// New returns a Store kept in the file at path, which need not exist yet.
+func New(path string) *Store {
+	return &Store{path: path}
+}
+
+// Open returns the Store of the domain whose data directory is dir.
+func Open(dir string) *Store {
+	return New(filepath.Join(dir, FileName))
+}
+
+// Record appends an attempt by username with outcome: a success sets the
+// last login and clears the failures, a failure adds one.
+func (s *Store) Record(username, ip, protocol string, outcome auth.LoginOutcome, t time.Time) error {
+	data, err := json.Marshal(line{
+		Time:     t.UTC(),
+		Username: strings.ToLower(username),
+		IP:       ip,
+		Protocol: protocol,
+		Outcome:  outcome,
+	})
+	if err != nil {
+		return fmt.Errorf("encode login state: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("open login state: %w", err)
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("write login state: %w", err)
+	}
+	fi, statErr := f.Stat()
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if statErr == nil && fi.Size() > compactBytes {
+		return s.compact()
+	}
+	return nil
+}
+
+// Get returns username's state, the zero value if none is recorded.
+func (s *Store) Get(username string) (auth.LoginState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	states, err := s.load()
+	if err != nil {
+		return auth.LoginState{}, err
+	}
+	return states[strings.ToLower(username)], nil
+}
+
+// All returns every recorded user's state, keyed by username.
+func (s *Store) All() (map[string]auth.LoginState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load()
+}
+
+// load replays the file. Caller must hold s.mu.
+func (s *Store) load() (map[string]auth.LoginState, error) {
+	states := make(map[string]auth.LoginState)
+	f, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return states, nil
+		}
+		return nil, fmt.Errorf("open login state: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var l line
+		if err := json.Unmarshal(scanner.Bytes(), &l); err != nil || l.Username == "" {
+			continue // skip a torn final line
+		}
+		states[l.Username] = l.apply(states[l.Username])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read login state: %w", err)
+	}
+	return states, nil
+}
+
+// compact rewrites the file as one snapshot per user. Caller must hold
+// s.mu.
+func (s *Store) compact() error {
+	states, err := s.load()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(states))
+	for name := range states {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tmpPath := s.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("create temp login state: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, name := range names {
+		state := states[name]
+		if err := enc.Encode(line{Username: name, State: &state}); err != nil {
+			_ = f.Close()
+			_ = os.Remove(tmpPath)
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
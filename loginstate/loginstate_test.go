@@ -0,0 +1,98 @@
+package loginstate
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/infodancer/auth"
+)
+
+func TestStore_Record(t *testing.T) {
+	s := Open(t.TempDir())
+	t0 := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	if st, err := s.Get("alice"); err != nil || st != (auth.LoginState{}) {
+		t.Fatalf("empty store: %+v, %v", st, err)
+	}
+	steps := []struct {
+		ip      string
+		outcome auth.LoginOutcome
+	}{
+		{"192.0.2.1", auth.LoginFailure},
+		{"192.0.2.2", auth.LoginSuccess},
+		{"198.51.100.1", auth.LoginFailure},
+		{"198.51.100.2", auth.LoginFailure},
+	}
+	for i, step := range steps {
+		if err := s.Record("Alice", step.ip, "imap", step.outcome, t0.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := auth.LoginState{
+		LastLogin:     t0.Add(time.Minute),
+		LastIP:        "192.0.2.2",
+		LastProtocol:  "imap",
+		Failures:      2,
+		LastFailure:   t0.Add(3 * time.Minute),
+		LastFailureIP: "198.51.100.2",
+	}
+	if got, err := s.Get("alice"); err != nil || got != want {
+		t.Errorf("Get = %+v, %v; want %+v", got, err, want)
+	}
+
+	// A torn final line is skipped.
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString(`{"user":"alice","outc`)
+	_ = f.Close()
+	if got, err := s.Get("alice"); err != nil || got != want {
+		t.Errorf("Get after torn line = %+v, %v", got, err)
+	}
+}
+
+func TestStore_Compact(t *testing.T) {
+	s := Open(t.TempDir())
+	t0 := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := range 100 {
+		if err := s.Record(fmt.Sprintf("user%d", i), "192.0.2.1", "pop3", auth.LoginSuccess, t0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range 3 {
+		if err := s.Record("user7", "192.0.2.9", "", auth.LoginFailure, t0.Add(time.Duration(i+1)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, err := s.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.mu.Lock()
+	err = s.compact()
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	after, err := s.All()
+	if err != nil || len(after) != 100 {
+		t.Fatalf("All after compact: %d users, %v", len(after), err)
+	}
+	for user, st := range before {
+		if after[user] != st {
+			t.Errorf("%s: %+v after compact, want %+v", user, after[user], st)
+		}
+	}
+
+	// Events after a snapshot apply on top of it.
+	if err := s.Record("user7", "192.0.2.10", "", auth.LoginFailure, t0.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := s.Get("user7"); st.Failures != 4 || st.LastFailureIP != "192.0.2.10" {
+		t.Errorf("user7 = %+v", st)
+	}
+}
@@ -0,0 +1,340 @@
+// Package oidcauth provides an authentication agent that accepts OAuth 2.0
+// access tokens from an OpenID Connect provider instead of passwords, for
+// SASL XOAUTH2 and OAUTHBEARER. Daemons parse the exchange with package
+// sasl and pass sasl.OAuthRequest.Credentials to
+// domain.AuthRouter.AuthenticateCredentials, so token logins are routed,
+// rate limited and audited like passwords. The agent holds no accounts of
+// its own and is chained after the backend that does:
+//
+//	[[auth.chain]]
+//	type = "passwd"
+//	credential_backend = "passwd"
+//	key_backend = "keys"
+//
+//	[[auth.chain]]
+//	type = "oidcauth"
+//	credential_backend = "https://idp.example.com/realms/mail"
+//	options = { domain = "example.com", audience = "mail", jwks_url = "https://idp.example.com/realms/mail/certs" }
+//
+// JWT access tokens are verified with the issuer's signing keys (JWKS),
+// and their "iss", "aud" and "exp" claims checked. Opaque tokens, and JWTs
+// the published keys cannot verify, are sent to the token introspection
+// endpoint (RFC 7662) when one is configured.
+//
+// The claim named by Options.Claim, "email" by default, names the user: an
+// address must be in Options.Domain and its localpart is the user, a bare
+// value is the localpart itself. Options.Subjects maps "sub" claims to
+// localparts first, for users whose address the issuer does not know. The
+// token must name the user logging in.
+package oidcauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/oauth"
+)
+
+// Mechanisms the agent verifies.
+const (
+	MechXOAUTH2     = "XOAUTH2"
+	MechOAUTHBEARER = "OAUTHBEARER"
+)
+
+// DefaultTimeout bounds each introspection request.
+const DefaultTimeout = 5 * time.Second
+
+// clockSkew is the leeway allowed on "exp" and "nbf".
+const clockSkew = 30 * time.Second
+
+// maxResponseSize bounds how much of an introspection response is read.
+const maxResponseSize = 64 * 1024
+
+// Options configures an Agent.
+type Options struct {
+	// Issuer is the expected "iss" claim. Required.
+	Issuer string
+
+	// Audience is the expected "aud" claim. Required with JWKSURL; for
+	// introspection it is checked when the response carries an audience.
+	Audience string
+
+	// Domain is the mail domain the agent logs users in to. Address
+	// claims in other domains are refused. Required.
+	Domain string
+
+	// JWKSURL is where the issuer publishes its signing keys. Fetched on
+	// first use and refreshed in the background.
+	JWKSURL string
+
+	// IntrospectionURL is the issuer's token introspection endpoint.
+	// At least one of JWKSURL and IntrospectionURL is required.
+	IntrospectionURL string
+
+	// ClientID and ClientSecret authenticate introspection requests with
+	// HTTP Basic authentication.
+	ClientID     string
+	ClientSecret string
+
+	// Claim names the claim identifying the user (default "email").
+	Claim string
+
+	// Subjects maps "sub" claims to localparts, overriding Claim.
+	Subjects map[string]string
+
+	// Timeout bounds each introspection request (default DefaultTimeout).
+	Timeout time.Duration
+
+	// Client is the HTTP client for JWKS and introspection requests; nil
+	// uses http.DefaultClient.
+	Client *http.Client
+}
+
+// Agent verifies bearer tokens. It is safe for concurrent use.
+type Agent struct {
+	opts   Options
+	keys   *jwk.Cache // nil without a JWKS URL
+	cancel context.CancelFunc
+	now    func() time.Time
+}
+
+var (
+	_ auth.AuthenticationAgent      = (*Agent)(nil)
+	_ auth.CredentialsAuthenticator = (*Agent)(nil)
+)
+
+// New returns an agent for opts. It does not contact the issuer.
+func New(opts Options) (*Agent, error) {
+	switch {
+	case opts.Issuer == "":
+		return nil, fmt.Errorf("%w: oidcauth: issuer is required", autherrors.ErrAuthAgentConfigInvalid)
+	case opts.Domain == "":
+		return nil, fmt.Errorf("%w: oidcauth: domain is required", autherrors.ErrAuthAgentConfigInvalid)
+	case opts.JWKSURL == "" && opts.IntrospectionURL == "":
+		return nil, fmt.Errorf("%w: oidcauth: jwks_url or introspection_url is required", autherrors.ErrAuthAgentConfigInvalid)
+	case opts.JWKSURL != "" && opts.Audience == "":
+		return nil, fmt.Errorf("%w: oidcauth: audience is required with jwks_url", autherrors.ErrAuthAgentConfigInvalid)
+	}
+	if opts.Claim == "" {
+		opts.Claim = "email"
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	a := &Agent{opts: opts, now: time.Now}
+	if opts.JWKSURL != "" {
+		// The cache refreshes in the background for the agent's lifetime,
+		// so it must not be tied to a request context.
+		ctx, cancel := context.WithCancel(context.Background())
+		a.keys = jwk.NewCache(ctx)
+		if err := a.keys.Register(opts.JWKSURL, jwk.WithHTTPClient(opts.Client)); err != nil {
+			cancel()
+			return nil, fmt.Errorf("%w: oidcauth: jwks_url: %v", autherrors.ErrAuthAgentConfigInvalid, err)
+		}
+		a.cancel = cancel
+	}
+	return a, nil
+}
+
+// AuthenticateCredentials verifies the bearer token in creds.Response for
+// XOAUTH2 and OAUTHBEARER and opens a session for creds.Username if the
+// token names them. Other mechanisms fail with
+// errors.ErrMechanismUnsupported, invalid tokens and tokens for another
+// user with errors.ErrAuthFailed wrapping the reason (see package oauth).
+// When the issuer cannot be reached the error wraps
+// errors.ErrBackendUnavailable, so the login does not count as a failure.
+// Implements auth.CredentialsAuthenticator.
+func (a *Agent) AuthenticateCredentials(ctx context.Context, creds auth.Credentials) (*auth.AuthSession, error) {
+	switch strings.ToUpper(creds.Mechanism) {
+	case MechXOAUTH2, MechOAUTHBEARER:
+	default:
+		return nil, fmt.Errorf("%w: %s", autherrors.ErrMechanismUnsupported, creds.Mechanism)
+	}
+	claims, err := a.validate(ctx, string(creds.Response))
+	if err == nil {
+		var user string
+		if user, err = a.localpart(claims); err == nil && !strings.EqualFold(user, creds.Username) {
+			err = fmt.Errorf("token is for %s", user)
+		}
+	}
+	if err != nil {
+		if !errors.Is(err, autherrors.ErrBackendUnavailable) {
+			return nil, fmt.Errorf("%w: %w", autherrors.ErrAuthFailed, err)
+		}
+		return nil, err
+	}
+	sub, _ := claims["sub"].(string)
+	return &auth.AuthSession{
+		User:       &auth.User{Username: creds.Username, Mailbox: creds.Username},
+		Credential: auth.Credential{Kind: auth.CredentialBearerToken, ID: sub},
+	}, nil
+}
+
+// Authenticate refuses passwords: the agent knows no users of its own, so
+// it fails with errors.ErrUserNotFound and a chain moves on.
+func (a *Agent) Authenticate(context.Context, string, string) (*auth.AuthSession, error) {
+	return nil, autherrors.ErrUserNotFound
+}
+
+// UserExists reports false: accounts live in the backends chained beside
+// the agent.
+func (a *Agent) UserExists(context.Context, string) (bool, error) {
+	return false, nil
+}
+
+// Close stops refreshing the signing keys.
+func (a *Agent) Close() error {
+	if a.cancel != nil {
+		a.cancel()
+	}
+	return nil
+}
+
+// validate checks token and returns its claims: as a JWT when it looks
+// like one and a JWKS URL is set, otherwise, or when the keys cannot
+// verify it, by introspection.
+func (a *Agent) validate(ctx context.Context, token string) (map[string]any, error) {
+	if token == "" {
+		return nil, oauth.ErrTokenMalformed
+	}
+	if a.keys != nil && strings.Count(token, ".") == 2 {
+		claims, err := a.validateJWT(ctx, token)
+		if err == nil || a.opts.IntrospectionURL == "" ||
+			errors.Is(err, oauth.ErrTokenExpired) || errors.Is(err, oauth.ErrIssuerMismatch) || errors.Is(err, oauth.ErrAudienceMismatch) {
+			return claims, err
+		}
+	}
+	if a.opts.IntrospectionURL == "" {
+		return nil, oauth.ErrTokenMalformed
+	}
+	return a.introspect(ctx, token)
+}
+
+// validateJWT verifies a JWT access token with the issuer's keys.
+func (a *Agent) validateJWT(ctx context.Context, token string) (map[string]any, error) {
+	keySet, err := a.keys.Get(ctx, a.opts.JWKSURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: fetch JWKS: %w", autherrors.ErrBackendUnavailable, err)
+	}
+	tok, err := jwt.Parse([]byte(token), jwt.WithKeySet(keySet), jwt.WithValidate(false))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", oauth.ErrTokenInvalid, err)
+	}
+	err = jwt.Validate(tok,
+		jwt.WithIssuer(a.opts.Issuer),
+		jwt.WithAudience(a.opts.Audience),
+		jwt.WithRequiredClaim("exp"),
+		jwt.WithAcceptableSkew(clockSkew),
+		jwt.WithClock(jwt.ClockFunc(a.now)),
+	)
+	switch {
+	case err == nil:
+	case errors.Is(err, jwt.ErrTokenExpired()):
+		return nil, oauth.ErrTokenExpired
+	case errors.Is(err, jwt.ErrInvalidIssuer()):
+		return nil, oauth.ErrIssuerMismatch
+	case errors.Is(err, jwt.ErrInvalidAudience()):
+		return nil, oauth.ErrAudienceMismatch
+	default:
+		return nil, fmt.Errorf("%w: %v", oauth.ErrTokenInvalid, err)
+	}
+	return tok.AsMap(ctx)
+}
+
+// introspect asks the issuer whether token is active (RFC 7662) and
+// checks the claims it returns.
+func (a *Agent) introspect(ctx context.Context, token string) (map[string]any, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.opts.Timeout)
+	defer cancel()
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.opts.IntrospectionURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", autherrors.ErrBackendUnavailable, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if a.opts.ClientID != "" {
+		// RFC 6749 section 2.3.1: credentials are form-encoded first.
+		req.SetBasicAuth(url.QueryEscape(a.opts.ClientID), url.QueryEscape(a.opts.ClientSecret))
+	}
+	resp, err := a.opts.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: introspect: %w", autherrors.ErrBackendUnavailable, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: introspect: %s", autherrors.ErrBackendUnavailable, resp.Status)
+	}
+	var claims map[string]any
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&claims); err != nil {
+		return nil, fmt.Errorf("%w: introspect: %w", autherrors.ErrBackendUnavailable, err)
+	}
+
+	if active, _ := claims["active"].(bool); !active {
+		return nil, fmt.Errorf("%w: not active", oauth.ErrTokenInvalid)
+	}
+	if iss, ok := claims["iss"].(string); ok && iss != a.opts.Issuer {
+		return nil, oauth.ErrIssuerMismatch
+	}
+	if a.opts.Audience != "" && claims["aud"] != nil && !hasAudience(claims["aud"], a.opts.Audience) {
+		return nil, oauth.ErrAudienceMismatch
+	}
+	if exp, ok := claims["exp"].(float64); ok && a.now().After(time.Unix(int64(exp), 0).Add(clockSkew)) {
+		return nil, oauth.ErrTokenExpired
+	}
+	return claims, nil
+}
+
+// hasAudience reports whether aud, a string or a list of strings, holds
+// want.
+func hasAudience(aud any, want string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == want
+	case []any:
+		return slices.Contains(v, any(want))
+	}
+	return false
+}
+
+// localpart returns the user the claims name.
+func (a *Agent) localpart(claims map[string]any) (string, error) {
+	if sub, ok := claims["sub"].(string); ok && sub != "" {
+		if user, ok := a.opts.Subjects[sub]; ok {
+			return user, nil
+		}
+	}
+	value, _ := claims[a.opts.Claim].(string)
+	if value == "" {
+		return "", oauth.ErrUsernameMissing
+	}
+	if a.opts.Claim == "email" {
+		if verified, ok := claims["email_verified"].(bool); ok && !verified {
+			return "", fmt.Errorf("%w: email not verified", oauth.ErrUsernameMissing)
+		}
+	}
+	i := strings.LastIndex(value, "@")
+	if i < 0 {
+		return value, nil
+	}
+	if !strings.EqualFold(value[i+1:], a.opts.Domain) {
+		return "", fmt.Errorf("%w: %s", oauth.ErrDomainNotAllowed, value)
+	}
+	return value[:i], nil
+}
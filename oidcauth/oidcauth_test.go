@@ -0,0 +1,257 @@
+package oidcauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/oauth"
+)
+
+const (
+	testIssuer   = "https://idp.example.com"
+	testAudience = "mail"
+)
+
+// testIdP is an OpenID provider publishing one signing key and answering
+// introspection for the tokens in active.
+type testIdP struct {
+	key    jwk.Key
+	server *httptest.Server
+	active map[string]map[string]any // token → introspection response
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+	idp := &testIdP{key: newKey(t, "idp-1"), active: make(map[string]map[string]any)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, _ *http.Request) {
+		pub, err := idp.key.PublicKey()
+		if err != nil {
+			t.Error(err)
+		}
+		set := jwk.NewSet()
+		_ = set.AddKey(pub)
+		_ = json.NewEncoder(w).Encode(set)
+	})
+	mux.HandleFunc("/introspect", func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, ok := r.BasicAuth(); !ok || id != "mail" || secret != "s3cret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		resp, ok := idp.active[r.PostFormValue("token")]
+		if !ok {
+			resp = map[string]any{"active": false}
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// newKey returns an ES256 signing key.
+func newKey(t *testing.T, kid string) jwk.Key {
+	t.Helper()
+	raw, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := jwk.FromRaw(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = key.Set(jwk.KeyIDKey, kid)
+	_ = key.Set(jwk.AlgorithmKey, jwa.ES256)
+	return key
+}
+
+// sign returns a JWT access token with claims, signed by key.
+func sign(t *testing.T, key jwk.Key, audience string, exp time.Time, claims map[string]any) string {
+	t.Helper()
+	b := jwt.NewBuilder().Issuer(testIssuer).Audience([]string{audience}).Expiration(exp)
+	for k, v := range claims {
+		b = b.Claim(k, v)
+	}
+	tok, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := jwt.Sign(tok, jwt.WithKey(jwa.ES256, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(signed)
+}
+
+// newAgent returns an agent trusting idp for example.com.
+func newAgent(t *testing.T, idp *testIdP, introspect bool) *Agent {
+	t.Helper()
+	opts := Options{
+		Issuer:   testIssuer,
+		Audience: testAudience,
+		Domain:   "example.com",
+		JWKSURL:  idp.server.URL + "/jwks",
+		Subjects: map[string]string{"svc-42": "robot"},
+	}
+	if introspect {
+		opts.IntrospectionURL = idp.server.URL + "/introspect"
+		opts.ClientID, opts.ClientSecret = "mail", "s3cret"
+	}
+	a, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = a.Close() })
+	return a
+}
+
+func bearer(user, token string) auth.Credentials {
+	return auth.Credentials{Username: user, Mechanism: MechXOAUTH2, Response: []byte(token)}
+}
+
+func TestAgent_JWT(t *testing.T) {
+	ctx := t.Context()
+	idp := newTestIdP(t)
+	a := newAgent(t, idp, false)
+	hour := time.Now().Add(time.Hour)
+
+	alice := sign(t, idp.key, testAudience, hour, map[string]any{"sub": "u-1", "email": "alice@Example.com"})
+	s, err := a.AuthenticateCredentials(ctx, bearer("alice", alice))
+	if err != nil {
+		t.Fatalf("alice: %v", err)
+	}
+	if s.User.Username != "alice" || s.Credential.Kind != auth.CredentialBearerToken || s.Credential.ID != "u-1" {
+		t.Errorf("session = %+v, credential %+v", s.User, s.Credential)
+	}
+
+	robot := sign(t, idp.key, testAudience, hour, map[string]any{"sub": "svc-42"})
+	if _, err := a.AuthenticateCredentials(ctx, bearer("robot", robot)); err != nil {
+		t.Errorf("robot by subject: %v", err)
+	}
+
+	for name, tc := range map[string]struct {
+		user, token string
+		want        error
+	}{
+		"other user": {"bob", alice, autherrors.ErrAuthFailed},
+		"expired":    {"alice", sign(t, idp.key, testAudience, time.Now().Add(-time.Hour), map[string]any{"email": "alice@example.com"}), oauth.ErrTokenExpired},
+		"audience":   {"alice", sign(t, idp.key, "calendar", hour, map[string]any{"email": "alice@example.com"}), oauth.ErrAudienceMismatch},
+		"domain":     {"alice", sign(t, idp.key, testAudience, hour, map[string]any{"email": "alice@example.net"}), oauth.ErrDomainNotAllowed},
+		"unverified": {"alice", sign(t, idp.key, testAudience, hour, map[string]any{"email": "alice@example.com", "email_verified": false}), oauth.ErrUsernameMissing},
+		"forged":     {"alice", sign(t, newKey(t, "idp-1"), testAudience, hour, map[string]any{"email": "alice@example.com"}), oauth.ErrTokenInvalid},
+		"opaque":     {"alice", "opaque-token", oauth.ErrTokenMalformed},
+	} {
+		_, err := a.AuthenticateCredentials(ctx, bearer(tc.user, tc.token))
+		if !errors.Is(err, autherrors.ErrAuthFailed) || !errors.Is(err, tc.want) {
+			t.Errorf("%s: err = %v, want ErrAuthFailed and %v", name, err, tc.want)
+		}
+	}
+
+	if _, err := a.AuthenticateCredentials(ctx, auth.Credentials{Username: "alice", Password: "pw"}); !errors.Is(err, autherrors.ErrMechanismUnsupported) {
+		t.Errorf("password: err = %v, want ErrMechanismUnsupported", err)
+	}
+	if _, err := a.Authenticate(ctx, "alice", "pw"); !errors.Is(err, autherrors.ErrUserNotFound) {
+		t.Errorf("Authenticate: err = %v, want ErrUserNotFound", err)
+	}
+}
+
+func TestAgent_Introspection(t *testing.T) {
+	ctx := t.Context()
+	idp := newTestIdP(t)
+	a := newAgent(t, idp, true)
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	idp.active["opaque-alice"] = map[string]any{"active": true, "iss": testIssuer, "aud": testAudience, "exp": exp, "email": "alice@example.com"}
+	idp.active["opaque-stale"] = map[string]any{"active": true, "exp": float64(time.Now().Add(-time.Hour).Unix()), "email": "alice@example.com"}
+	idp.active["opaque-foreign"] = map[string]any{"active": true, "iss": "https://evil.example", "email": "alice@example.com"}
+
+	if _, err := a.AuthenticateCredentials(ctx, bearer("alice", "opaque-alice")); err != nil {
+		t.Errorf("opaque token: %v", err)
+	}
+	// A JWT signed with a key the JWKS does not hold is introspected.
+	rotated := sign(t, newKey(t, "idp-2"), testAudience, time.Now().Add(time.Hour), map[string]any{"email": "alice@example.com"})
+	idp.active[rotated] = map[string]any{"active": true, "aud": []any{"other", testAudience}, "email": "alice@example.com"}
+	if _, err := a.AuthenticateCredentials(ctx, bearer("alice", rotated)); err != nil {
+		t.Errorf("JWT with rotated key: %v", err)
+	}
+
+	for token, want := range map[string]error{
+		"revoked":        oauth.ErrTokenInvalid,
+		"opaque-stale":   oauth.ErrTokenExpired,
+		"opaque-foreign": oauth.ErrIssuerMismatch,
+	} {
+		if _, err := a.AuthenticateCredentials(ctx, bearer("alice", token)); !errors.Is(err, want) {
+			t.Errorf("%s: err = %v, want %v", token, err, want)
+		}
+	}
+
+	// An unreachable issuer is not the client's fault.
+	idp.server.Close()
+	if _, err := a.AuthenticateCredentials(ctx, bearer("alice", "opaque-alice")); !errors.Is(err, autherrors.ErrBackendUnavailable) || errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("issuer down: err = %v, want ErrBackendUnavailable", err)
+	}
+}
+
+func TestNew_Config(t *testing.T) {
+	for name, opts := range map[string]Options{
+		"no issuer":   {Domain: "example.com", IntrospectionURL: "https://idp/introspect"},
+		"no domain":   {Issuer: testIssuer, IntrospectionURL: "https://idp/introspect"},
+		"no endpoint": {Issuer: testIssuer, Domain: "example.com"},
+		"no audience": {Issuer: testIssuer, Domain: "example.com", JWKSURL: "https://idp/jwks"},
+	} {
+		if _, err := New(opts); !errors.Is(err, autherrors.ErrAuthAgentConfigInvalid) {
+			t.Errorf("%s: err = %v, want ErrAuthAgentConfigInvalid", name, err)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	dir := t.TempDir()
+	subjects := filepath.Join(dir, "subjects")
+	if err := os.WriteFile(subjects, []byte("# service accounts\nsvc-42 robot\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := auth.AuthAgentConfig{
+		Type:              "oidcauth",
+		CredentialBackend: testIssuer,
+		Options: map[string]string{
+			"domain":            "example.com",
+			"introspection_url": "https://idp.example.com/introspect",
+			"subjects_file":     subjects,
+			"timeout":           "2s",
+		},
+	}
+	agent, err := auth.OpenAuthAgent(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	a := agent.(*Agent)
+	if a.opts.Subjects["svc-42"] != "robot" || a.opts.Timeout != 2*time.Second {
+		t.Errorf("opts = %+v", a.opts)
+	}
+	if !auth.Capabilities(agent).Credentials {
+		t.Error("agent does not report CredentialsAuthenticator")
+	}
+
+	if err := os.WriteFile(subjects, []byte("svc-42\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.OpenAuthAgent(cfg); !errors.Is(err, autherrors.ErrAuthAgentConfigInvalid) {
+		t.Errorf("malformed subjects file: err = %v, want ErrAuthAgentConfigInvalid", err)
+	}
+}
@@ -0,0 +1,76 @@
+package oidcauth
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/errors"
+)
+
+func init() {
+	// CredentialBackend is the issuer. Options: "domain", "audience",
+	// "jwks_url", "introspection_url", "client_id", "claim", "timeout" (a
+	// Go duration), "client_secret_file", a file holding the introspection
+	// secret so it stays out of the config, and "subjects_file", a file of
+	// "subject localpart" lines.
+	auth.RegisterAuthAgent("oidcauth", func(config auth.AuthAgentConfig) (auth.AuthenticationAgent, error) {
+		opts := Options{
+			Issuer:           config.CredentialBackend,
+			Domain:           config.Options["domain"],
+			Audience:         config.Options["audience"],
+			JWKSURL:          config.Options["jwks_url"],
+			IntrospectionURL: config.Options["introspection_url"],
+			ClientID:         config.Options["client_id"],
+			Claim:            config.Options["claim"],
+		}
+		var err error
+		if v := config.Options["timeout"]; v != "" {
+			if opts.Timeout, err = time.ParseDuration(v); err != nil {
+				return nil, fmt.Errorf("%w: timeout: %v", errors.ErrAuthAgentConfigInvalid, err)
+			}
+		}
+		if path := config.Options["client_secret_file"]; path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("read client secret file: %w", err)
+			}
+			opts.ClientSecret = strings.TrimSpace(string(data))
+		}
+		if path := config.Options["subjects_file"]; path != "" {
+			if opts.Subjects, err = readSubjects(path); err != nil {
+				return nil, err
+			}
+		}
+		return New(opts)
+	})
+}
+
+// readSubjects parses a subjects file: "subject localpart" lines, with
+// blank lines and "#" comments ignored.
+func readSubjects(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read subjects file: %w", err)
+	}
+	subjects := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%w: %s:%d: want \"subject localpart\"", errors.ErrAuthAgentConfigInvalid, path, n)
+		}
+		subjects[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read subjects file: %w", err)
+	}
+	return subjects, nil
+}
@@ -0,0 +1,425 @@
+package passwd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/atrest"
+	"github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/vfs"
+)
+
+const (
+	// appPasswordsFile is the name of the app password file, kept next to
+	// the passwd file (or shard directory) in the domain directory.
+	// Line format: username:id:created:sha256:sealedkey:label
+	//
+	// created is a Unix time, sha256 the hex digest of the token, and
+	// sealedkey the user's private key sealed under the token (base64,
+	// empty when the app password does not unlock keys). The label is last
+	// so that it may contain colons.
+	appPasswordsFile = "app_passwords"
+
+	// appPasswordSize is the number of random bytes in a token (160 bits,
+	// 32 base32 characters). Tokens are random, so a fast hash suffices.
+	appPasswordSize = 20
+
+	// appPasswordKeyInfo separates the key sealing a private key under an
+	// app password from other uses of the token.
+	appPasswordKeyInfo = "infodancer/auth passwd app password v1"
+
+	// maxAppPasswordLabel is the longest label accepted, in runes.
+	maxAppPasswordLabel = 64
+)
+
+// tokenEncoding is the alphabet of app password tokens.
+var tokenEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// AppPassword describes an app password. The token itself is only returned
+// by AddAppPassword.
+type AppPassword struct {
+	// ID identifies the app password for RevokeAppPassword.
+	ID string
+
+	// Label is the user's name for the app password, such as "Phone".
+	Label string
+
+	// Created is when the app password was added.
+	Created time.Time
+
+	// UnlocksKeys reports whether sessions opened with the app password
+	// carry the user's private key.
+	UnlocksKeys bool
+}
+
+// appPasswordEntry is a parsed line of the app password file.
+type appPasswordEntry struct {
+	username  string
+	info      AppPassword
+	hash      []byte
+	sealedKey []byte
+}
+
+// appPasswordsPath returns the app password file for passwdPath.
+func appPasswordsPath(passwdPath string) string {
+	return filepath.Join(filepath.Dir(filepath.Clean(passwdPath)), appPasswordsFile)
+}
+
+// AddAppPassword creates an app password for username with the given label
+// and returns it along with the token to hand to the user, once: only a
+// hash is stored. The token is 32 characters in groups of four; case,
+// spaces and dashes are ignored when it is used.
+//
+// If password unlocks the user's key pair (their main password, or their
+// key passphrase if they have one; see SetKeyPassphrase), the private key
+// is also sealed under the token so that sessions opened with it can
+// decrypt mail; a wrong password fails with errors.ErrKeyDecryptFailed. With an empty password the app password
+// only logs in. Returns errors.ErrReadOnly in read-only mode.
+func AddAppPassword(passwdPath, keyDir, username, label, password string) (AppPassword, string, error) {
+	if err := checkWritable(vfs.OS{}, passwdPath); err != nil {
+		return AppPassword{}, "", err
+	}
+	if err := validateAppPasswordLabel(label); err != nil {
+		return AppPassword{}, "", err
+	}
+	l, err := lockPasswd(vfs.OS{}, passwdPath)
+	if err != nil {
+		return AppPassword{}, "", err
+	}
+	defer l.release()
+
+	users, err := parsePasswd(vfs.OS{}, userFile(vfs.OS{}, passwdPath, username))
+	if err != nil {
+		return AppPassword{}, "", err
+	}
+	found := false
+	for _, u := range users {
+		found = found || u.Username == username
+	}
+	if !found {
+		return AppPassword{}, "", fmt.Errorf("%w: %s", errors.ErrUserNotFound, username)
+	}
+
+	raw := make([]byte, appPasswordSize)
+	id := make([]byte, 4)
+	for _, b := range [][]byte{raw, id} {
+		if _, err := rand.Read(b); err != nil {
+			return AppPassword{}, "", fmt.Errorf("generate app password: %w", err)
+		}
+	}
+	secret := strings.ToLower(tokenEncoding.EncodeToString(raw))
+	sum := sha256.Sum256([]byte(secret))
+	e := appPasswordEntry{
+		username: username,
+		info: AppPassword{
+			ID:      hex.EncodeToString(id),
+			Label:   label,
+			Created: time.Now().Truncate(time.Second),
+		},
+		hash: sum[:],
+	}
+
+	if password != "" && keyDir != "" {
+		encryptedKey, err := vfs.OS{}.ReadFile(filepath.Join(keyDir, username+privateKeyExt))
+		if err != nil && !os.IsNotExist(err) {
+			return AppPassword{}, "", fmt.Errorf("read private key: %w", err)
+		}
+		if err == nil {
+			privateKey, err := decryptPrivateKey(encryptedKey, password)
+			if err != nil {
+				return AppPassword{}, "", err
+			}
+			e.sealedKey, err = sealWith(privateKey, []byte(secret), appPasswordKeyInfo)
+			clear(privateKey)
+			if err != nil {
+				return AppPassword{}, "", err
+			}
+			e.info.UnlocksKeys = true
+		}
+	}
+
+	if err := l.check(); err != nil {
+		return AppPassword{}, "", err
+	}
+	err = updateAppPasswords(vfs.OS{}, passwdPath, func(entries []appPasswordEntry) []appPasswordEntry {
+		return append(entries, e)
+	})
+	if err != nil {
+		return AppPassword{}, "", err
+	}
+	return e.info, groupToken(secret), nil
+}
+
+// ListAppPasswords returns username's app passwords, oldest first.
+func ListAppPasswords(passwdPath, username string) ([]AppPassword, error) {
+	entries, err := readAppPasswords(vfs.OS{}, appPasswordsPath(passwdPath))
+	if err != nil {
+		return nil, err
+	}
+	var list []AppPassword
+	for _, e := range entries {
+		if e.username == username {
+			list = append(list, e.info)
+		}
+	}
+	return list, nil
+}
+
+// RevokeAppPassword removes username's app password id; it stops working
+// immediately, including for agents already running. Returns an error if
+// there is no such app password, and errors.ErrReadOnly in read-only mode.
+func RevokeAppPassword(passwdPath, username, id string) error {
+	if err := checkWritable(vfs.OS{}, passwdPath); err != nil {
+		return err
+	}
+	l, err := lockPasswd(vfs.OS{}, passwdPath)
+	if err != nil {
+		return err
+	}
+	defer l.release()
+	if err := l.check(); err != nil {
+		return err
+	}
+
+	found := false
+	err = updateAppPasswords(vfs.OS{}, passwdPath, func(entries []appPasswordEntry) []appPasswordEntry {
+		kept := entries[:0]
+		for _, e := range entries {
+			if e.username == username && e.info.ID == id {
+				found = true
+				continue
+			}
+			kept = append(kept, e)
+		}
+		return kept
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("app password %q not found for %q", id, username)
+	}
+	return nil
+}
+
+// removeAppPasswords drops every app password of username. Callers hold
+// the lock on passwdPath (see lockPasswd).
+func removeAppPasswords(fsys vfs.WriteFS, passwdPath, username string) error {
+	return updateAppPasswords(fsys, passwdPath, func(entries []appPasswordEntry) []appPasswordEntry {
+		kept := entries[:0]
+		for _, e := range entries {
+			if e.username != username {
+				kept = append(kept, e)
+			}
+		}
+		return kept
+	})
+}
+
+// matchAppPassword returns username's app password whose token is
+// candidate. Every entry is compared in constant time, whoever it belongs
+// to, so the work does not depend on username or on whether it exists.
+func (a *Agent) matchAppPassword(username, candidate string) (*appPasswordEntry, bool, error) {
+	secret, ok := normalizeToken(candidate)
+	if !ok {
+		return nil, false, nil
+	}
+	entries, err := readAppPasswords(a.files(), appPasswordsPath(a.passwdPath))
+	if err != nil {
+		return nil, false, err
+	}
+	sum := sha256.Sum256([]byte(secret))
+	var match *appPasswordEntry
+	for i := range entries {
+		e := &entries[i]
+		if subtle.ConstantTimeCompare(e.hash, sum[:]) == 1 && e.username == username {
+			match = e
+		}
+	}
+	return match, match != nil, nil
+}
+
+// appPasswordSession builds the session for entry's login with token.
+func (a *Agent) appPasswordSession(entry *userEntry, ap *appPasswordEntry, token string) (*auth.AuthSession, error) {
+	session := &auth.AuthSession{
+		User: entry.user(),
+		Credential: auth.Credential{
+			Kind:  auth.CredentialAppPassword,
+			ID:    ap.info.ID,
+			Label: ap.info.Label,
+		},
+	}
+
+	pubKey, err := a.files().ReadFile(filepath.Join(a.keyDir, entry.username+publicKeyExt))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return session, nil
+		}
+		return nil, fmt.Errorf("read public key: %w", err)
+	}
+	session.PublicKey = pubKey
+	session.EncryptionEnabled = true
+	if ap.sealedKey != nil {
+		secret, _ := normalizeToken(token)
+		privKey, err := openWith(ap.sealedKey, []byte(secret), appPasswordKeyInfo)
+		if err != nil {
+			return nil, err
+		}
+		// A key rotated since the app password was created stays locked.
+		current, err := a.isCurrentKey(entry.username, pubKey, privKey)
+		if err != nil || !current {
+			clear(privKey)
+			return session, err
+		}
+		session.PrivateKey = privKey
+		if session.RetiredKeys, err = a.unlockRetired(entry.username, pubKey, privKey); err != nil {
+			session.Clear()
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+// normalizeToken strips the grouping, spaces and case from a token as
+// typed by a user. Returns false if the result cannot be a token.
+func normalizeToken(s string) (string, bool) {
+	s = strings.Map(func(r rune) rune {
+		if r == '-' || unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, s)
+	if len(s) != tokenEncoding.EncodedLen(appPasswordSize) {
+		return "", false
+	}
+	if _, err := tokenEncoding.DecodeString(strings.ToUpper(s)); err != nil {
+		return "", false
+	}
+	return s, true
+}
+
+// groupToken formats secret in dash-separated groups of four.
+func groupToken(secret string) string {
+	var b strings.Builder
+	for i := 0; i < len(secret); i += 4 {
+		if i > 0 {
+			b.WriteByte('-')
+		}
+		b.WriteString(secret[i:min(i+4, len(secret))])
+	}
+	return b.String()
+}
+
+// validateAppPasswordLabel rejects empty or overlong labels and labels
+// with control characters, which would corrupt the file.
+func validateAppPasswordLabel(label string) error {
+	if strings.TrimSpace(label) == "" {
+		return fmt.Errorf("app password label is empty")
+	}
+	if n := len([]rune(label)); n > maxAppPasswordLabel {
+		return fmt.Errorf("app password label is %d characters, limit %d", n, maxAppPasswordLabel)
+	}
+	if strings.IndexFunc(label, unicode.IsControl) >= 0 {
+		return fmt.Errorf("app password label contains control characters")
+	}
+	return nil
+}
+
+// updateAppPasswords rewrites the app password file of passwdPath with the
+// entries returned by fn. The file is left alone if fn returns as many
+// entries as it was given, so removing nothing writes nothing.
+func updateAppPasswords(fsys vfs.WriteFS, passwdPath string, fn func([]appPasswordEntry) []appPasswordEntry) error {
+	path := appPasswordsPath(passwdPath)
+	entries, err := readAppPasswords(fsys, path)
+	if err != nil {
+		return err
+	}
+	n := len(entries)
+	entries = fn(entries)
+	if len(entries) == n {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, e := range entries {
+		fmt.Fprintf(&buf, "%s:%s:%d:%s:%s:%s\n",
+			e.username, e.info.ID, e.info.Created.Unix(), hex.EncodeToString(e.hash),
+			base64.RawStdEncoding.EncodeToString(e.sealedKey), e.info.Label)
+	}
+	if err := atrest.WriteFileFS(fsys, path, buf.Bytes(), 0o600, false); err != nil {
+		return fmt.Errorf("write app passwords: %w", err)
+	}
+	return nil
+}
+
+// readAppPasswords parses the app password file at path. A missing file
+// has no entries; malformed lines are skipped.
+func readAppPasswords(fsys vfs.FS, path string) ([]appPasswordEntry, error) {
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read app passwords: %w", err)
+	}
+	var entries []appPasswordEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if e, ok := parseAppPassword(scanner.Text()); ok {
+			entries = append(entries, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read app passwords: %w", err)
+	}
+	return entries, nil
+}
+
+// parseAppPassword parses one app password line.
+func parseAppPassword(line string) (appPasswordEntry, bool) {
+	if line == "" || strings.HasPrefix(line, "#") {
+		return appPasswordEntry{}, false
+	}
+	parts := strings.SplitN(line, ":", 6)
+	if len(parts) != 6 {
+		return appPasswordEntry{}, false
+	}
+	created, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return appPasswordEntry{}, false
+	}
+	hash, err := hex.DecodeString(parts[3])
+	if err != nil || len(hash) != sha256.Size {
+		return appPasswordEntry{}, false
+	}
+	var sealedKey []byte
+	if parts[4] != "" {
+		if sealedKey, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+			return appPasswordEntry{}, false
+		}
+	}
+	return appPasswordEntry{
+		username: parts[0],
+		info: AppPassword{
+			ID:          parts[1],
+			Label:       parts[5],
+			Created:     time.Unix(created, 0),
+			UnlocksKeys: sealedKey != nil,
+		},
+		hash:      hash,
+		sealedKey: sealedKey,
+	}, true
+}
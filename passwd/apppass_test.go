@@ -0,0 +1,188 @@
+package passwd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// newAppPasswordAgent returns a domain directory with alice (with keys) and
+// bob (without), and the passwd and key paths.
+func newAppPasswordAgent(t *testing.T) (passwdPath, keyDir string) {
+	t.Helper()
+	dir := t.TempDir()
+	passwdPath = filepath.Join(dir, "passwd")
+	keyDir = filepath.Join(dir, "keys")
+	for _, u := range []string{"alice", "bob"} {
+		if err := AddUser(passwdPath, u, "pw"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeKeyPair(t, keyDir, "alice", "pw")
+	return passwdPath, keyDir
+}
+
+func TestAppPassword_Authenticate(t *testing.T) {
+	ctx := context.Background()
+	passwdPath, keyDir := newAppPasswordAgent(t)
+
+	phone, token, err := AddAppPassword(passwdPath, keyDir, "alice", "Phone", "pw")
+	if err != nil {
+		t.Fatalf("AddAppPassword: %v", err)
+	}
+	if !phone.UnlocksKeys || len(token) != 39 {
+		t.Errorf("AddAppPassword = %+v, %q", phone, token)
+	}
+	agent, err := NewAgent(passwdPath, keyDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+
+	main, err := agent.Authenticate(ctx, "alice", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer main.Clear()
+	if main.Credential.Kind != auth.CredentialPassword {
+		t.Errorf("main password credential = %+v", main.Credential)
+	}
+
+	// Case, spaces and dashes do not matter.
+	typed := strings.ToUpper(strings.ReplaceAll(token, "-", " "))
+	session, err := agent.Authenticate(ctx, "alice", typed)
+	if err != nil {
+		t.Fatalf("Authenticate with app password: %v", err)
+	}
+	defer session.Clear()
+	want := auth.Credential{Kind: auth.CredentialAppPassword, ID: phone.ID, Label: "Phone"}
+	if session.Credential != want {
+		t.Errorf("credential = %+v, want %+v", session.Credential, want)
+	}
+	if !bytes.Equal(session.PrivateKey, main.PrivateKey) {
+		t.Error("app password session does not carry the private key")
+	}
+
+	if _, err := agent.Authenticate(ctx, "bob", token); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("alice's app password for bob: err = %v", err)
+	}
+}
+
+func TestAppPassword_WithoutKeys(t *testing.T) {
+	ctx := context.Background()
+	passwdPath, keyDir := newAppPasswordAgent(t)
+
+	info, token, err := AddAppPassword(passwdPath, keyDir, "alice", "Calendar", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.UnlocksKeys {
+		t.Error("UnlocksKeys set without the main password")
+	}
+	agent, err := NewAgent(passwdPath, keyDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+
+	session, err := agent.Authenticate(ctx, "alice", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.PrivateKey != nil || !session.EncryptionEnabled || session.PublicKey == nil {
+		t.Errorf("session = %+v, want public key only", session)
+	}
+}
+
+func TestAppPassword_Revoke(t *testing.T) {
+	ctx := context.Background()
+	passwdPath, keyDir := newAppPasswordAgent(t)
+
+	phone, phoneToken, err := AddAppPassword(passwdPath, keyDir, "alice", "Phone", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, laptopToken, err := AddAppPassword(passwdPath, keyDir, "alice", "Laptop: work", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent, err := NewAgent(passwdPath, keyDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+
+	if err := RevokeAppPassword(passwdPath, "alice", phone.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := RevokeAppPassword(passwdPath, "alice", phone.ID); err == nil {
+		t.Error("expected error revoking twice")
+	}
+	if _, err := agent.Authenticate(ctx, "alice", phoneToken); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("revoked app password: err = %v", err)
+	}
+	if _, err := agent.Authenticate(ctx, "alice", laptopToken); err != nil {
+		t.Errorf("other app password: err = %v", err)
+	}
+
+	list, err := ListAppPasswords(passwdPath, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Label != "Laptop: work" {
+		t.Errorf("ListAppPasswords = %+v", list)
+	}
+}
+
+func TestAppPassword_Errors(t *testing.T) {
+	passwdPath, keyDir := newAppPasswordAgent(t)
+
+	if _, _, err := AddAppPassword(passwdPath, keyDir, "nobody", "Phone", ""); !errors.Is(err, autherrors.ErrUserNotFound) {
+		t.Errorf("unknown user: err = %v", err)
+	}
+	if _, _, err := AddAppPassword(passwdPath, keyDir, "alice", "Phone", "wrong"); !errors.Is(err, autherrors.ErrKeyDecryptFailed) {
+		t.Errorf("wrong password: err = %v", err)
+	}
+	for _, label := range []string{"", " ", "a\nb", strings.Repeat("x", maxAppPasswordLabel+1)} {
+		if _, _, err := AddAppPassword(passwdPath, keyDir, "alice", label, ""); err == nil {
+			t.Errorf("label %q accepted", label)
+		}
+	}
+
+	markReadOnly(t, passwdPath)
+	if _, _, err := AddAppPassword(passwdPath, keyDir, "alice", "Phone", ""); !errors.Is(err, autherrors.ErrReadOnly) {
+		t.Errorf("read-only: err = %v", err)
+	}
+}
+
+func TestDeleteUser_RemovesAppPasswords(t *testing.T) {
+	passwdPath, keyDir := newAppPasswordAgent(t)
+	for _, u := range []string{"alice", "bob"} {
+		if _, _, err := AddAppPassword(passwdPath, keyDir, u, "Phone", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := DeleteUser(passwdPath, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := ListAppPasswords(passwdPath, "alice"); len(list) != 0 {
+		t.Errorf("alice still has %d app passwords", len(list))
+	}
+	if list, _ := ListAppPasswords(passwdPath, "bob"); len(list) != 1 {
+		t.Errorf("bob has %d app passwords, want 1", len(list))
+	}
+	fi, err := os.Stat(appPasswordsPath(passwdPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("mode = %v, want 0600", fi.Mode().Perm())
+	}
+}
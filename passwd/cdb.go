@@ -0,0 +1,324 @@
+package passwd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/infodancer/auth/atrest"
+	"github.com/infodancer/auth/vfs"
+)
+
+// Compiled passwd files
+//
+// A domain with tens of thousands of users can compile its passwd file (or
+// shard directory) into a constant database next to it, "passwd.cdb" for
+// "passwd", with CompilePasswd. The file uses D. J. Bernstein's cdb format:
+// a 2048-byte header of 256 (position, length) pairs locating hash tables,
+// then the records (key length, data length, key, data), then the tables
+// of (hash, record position) slots. Every value is a little-endian uint32.
+// Keys are usernames and values their passwd lines, so a lookup reads two
+// or three slots without parsing the file.
+//
+// The database also records the size and modification time of every
+// source file under cdbStampKey. An agent opened with NewCDBAgent compares
+// them with the files on disk and falls back to the text file when they
+// differ, so a passwd change made without recompiling is never masked.
+
+// CDBSuffix is appended to a passwd path to name its compiled form.
+const CDBSuffix = ".cdb"
+
+// cdbStampKey holds the source stamp; a NUL cannot start a username.
+const cdbStampKey = "\x00stamp"
+
+const cdbHeaderSize = 256 * 8
+
+// errCDBFormat indicates a file that is not a valid cdb.
+var errCDBFormat = errors.New("malformed passwd cdb")
+
+// cdbHash is the cdb hash function: h = ((h << 5) + h) ^ c from 5381.
+func cdbHash(key []byte) uint32 {
+	h := uint32(5381)
+	for _, c := range key {
+		h = ((h << 5) + h) ^ uint32(c)
+	}
+	return h
+}
+
+// CompilePasswd writes the compiled form of passwdPath, a passwd file or
+// shard directory, to passwdPath+CDBSuffix and returns the number of users
+// in it. When a username appears more than once the last line wins, as
+// when loading the text file. Sealed passwd files are refused: the
+// database would hold their hashes in the clear.
+func CompilePasswd(passwdPath string) (int, error) {
+	if err := checkWritable(vfs.OS{}, passwdPath); err != nil {
+		return 0, err
+	}
+	// Stamp first: a change made while reading then shows as stale.
+	stamp, err := sourceStamp(vfs.OS{}, passwdPath)
+	if err != nil {
+		return 0, err
+	}
+	files, err := passwdFiles(vfs.OS{}, passwdPath)
+	if err != nil {
+		return 0, err
+	}
+	lines := make(map[string]string)
+	for _, path := range files {
+		if err := readEntryLines(vfs.OS{}, path, lines); err != nil {
+			return 0, err
+		}
+	}
+
+	names := make([]string, 0, len(lines))
+	for name := range lines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var w cdbWriter
+	for _, name := range names {
+		w.add(name, lines[name])
+	}
+	w.add(cdbStampKey, stamp)
+	data, err := w.finish()
+	if err != nil {
+		return 0, err
+	}
+	if err := vfs.WriteFileAtomic(vfs.OS{}, passwdPath+CDBSuffix, data, 0o600); err != nil {
+		return 0, fmt.Errorf("write passwd cdb: %w", err)
+	}
+	return len(names), nil
+}
+
+// readEntryLines adds the entry lines of one passwd file to lines, keyed
+// by username. A missing file adds nothing.
+func readEntryLines(fsys vfs.FS, path string, lines map[string]string) error {
+	sealed, err := atrest.IsSealedFileFS(fsys, path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("open passwd file: %w", err)
+	}
+	if sealed {
+		return fmt.Errorf("%s is sealed; sealed passwd files are not compiled", path)
+	}
+	f, err := fsys.Open(path)
+	if err != nil {
+		return fmt.Errorf("open passwd file: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if entry, ok := parseEntry(scanner.Text()); ok {
+			lines[entry.username] = strings.TrimSpace(scanner.Text())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read passwd file: %w", err)
+	}
+	return nil
+}
+
+// cdbWriter builds a cdb in memory.
+type cdbWriter struct {
+	buf     bytes.Buffer
+	buckets [256][]cdbSlot
+}
+
+type cdbSlot struct{ hash, pos uint32 }
+
+func (w *cdbWriter) add(key, value string) {
+	if w.buf.Len() == 0 {
+		w.buf.Write(make([]byte, cdbHeaderSize))
+	}
+	h := cdbHash([]byte(key))
+	w.buckets[h&0xff] = append(w.buckets[h&0xff], cdbSlot{hash: h, pos: uint32(w.buf.Len())})
+	w.buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(key))))
+	w.buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(value))))
+	w.buf.WriteString(key)
+	w.buf.WriteString(value)
+}
+
+// finish appends the hash tables and fills in the header.
+func (w *cdbWriter) finish() ([]byte, error) {
+	if w.buf.Len() == 0 {
+		w.buf.Write(make([]byte, cdbHeaderSize))
+	}
+	var header [cdbHeaderSize]byte
+	for i, slots := range w.buckets {
+		n := 2 * len(slots)
+		binary.LittleEndian.PutUint32(header[i*8:], uint32(w.buf.Len()))
+		binary.LittleEndian.PutUint32(header[i*8+4:], uint32(n))
+		table := make([]cdbSlot, n)
+		for _, s := range slots {
+			j := int(s.hash>>8) % n
+			for table[j].pos != 0 {
+				j = (j + 1) % n
+			}
+			table[j] = s
+		}
+		for _, s := range table {
+			w.buf.Write(binary.LittleEndian.AppendUint32(nil, s.hash))
+			w.buf.Write(binary.LittleEndian.AppendUint32(nil, s.pos))
+		}
+	}
+	if w.buf.Len() > 1<<32-1 {
+		return nil, fmt.Errorf("passwd cdb too large: %d bytes", w.buf.Len())
+	}
+	data := w.buf.Bytes()
+	copy(data, header[:])
+	return data, nil
+}
+
+// cdbPasswd is an open compiled passwd file.
+type cdbPasswd struct {
+	path    string // the source passwd path
+	fsys    vfs.FS
+	data    []byte
+	unmap   func() error
+	stamp   string
+	checked atomic.Int64 // UnixNano of the last fresh stamp comparison
+}
+
+// openCDB opens the compiled form of passwdPath, memory-mapped on the
+// local disk and read into memory from any other fsys.
+func openCDB(fsys vfs.FS, passwdPath string) (*cdbPasswd, error) {
+	path := passwdPath + CDBSuffix
+	var data []byte
+	unmap := func() error { return nil }
+	if onDisk(fsys) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = f.Close() }()
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if fi.Size() < cdbHeaderSize || fi.Size() > 1<<32-1 {
+			return nil, fmt.Errorf("%w: %s: size %d", errCDBFormat, path, fi.Size())
+		}
+		if data, unmap, err = mapFile(f, int(fi.Size())); err != nil {
+			return nil, fmt.Errorf("map passwd cdb: %w", err)
+		}
+	} else {
+		var err error
+		if data, err = fsys.ReadFile(path); err != nil {
+			return nil, err
+		}
+		if len(data) < cdbHeaderSize {
+			return nil, fmt.Errorf("%w: %s: size %d", errCDBFormat, path, len(data))
+		}
+	}
+	warnInsecurePerms(fsys, path)
+	c := &cdbPasswd{path: passwdPath, fsys: fsys, data: data, unmap: unmap}
+	stamp, ok := c.get([]byte(cdbStampKey))
+	if !ok {
+		_ = unmap()
+		return nil, fmt.Errorf("%w: %s: no source stamp", errCDBFormat, path)
+	}
+	c.stamp = string(stamp)
+	return c, nil
+}
+
+// get returns the value stored under key.
+func (c *cdbPasswd) get(key []byte) ([]byte, bool) {
+	h := cdbHash(key)
+	i := int(h&0xff) * 8
+	tpos := binary.LittleEndian.Uint32(c.data[i:])
+	n := binary.LittleEndian.Uint32(c.data[i+4:])
+	if n == 0 || uint64(tpos)+uint64(n)*8 > uint64(len(c.data)) {
+		return nil, false
+	}
+	for k, j := uint32(0), (h>>8)%n; k < n; k, j = k+1, (j+1)%n {
+		slot := c.data[tpos+j*8:]
+		hash, pos := binary.LittleEndian.Uint32(slot), binary.LittleEndian.Uint32(slot[4:])
+		if pos == 0 {
+			return nil, false
+		}
+		if hash != h {
+			continue
+		}
+		if rk, rv, ok := c.record(pos); ok && bytes.Equal(rk, key) {
+			return rv, true
+		}
+	}
+	return nil, false
+}
+
+// record returns the key and value of the record at pos.
+func (c *cdbPasswd) record(pos uint32) (key, value []byte, ok bool) {
+	if uint64(pos)+8 > uint64(len(c.data)) {
+		return nil, nil, false
+	}
+	klen := uint64(binary.LittleEndian.Uint32(c.data[pos:]))
+	vlen := uint64(binary.LittleEndian.Uint32(c.data[pos+4:]))
+	start := uint64(pos) + 8
+	if start+klen+vlen > uint64(len(c.data)) {
+		return nil, nil, false
+	}
+	return c.data[start : start+klen], c.data[start+klen : start+klen+vlen], true
+}
+
+// lookup parses username's line.
+func (c *cdbPasswd) lookup(username string) (*userEntry, bool) {
+	if username == "" || username[0] == 0 {
+		return nil, false
+	}
+	line, ok := c.get([]byte(username))
+	if !ok {
+		return nil, false
+	}
+	return parseEntry(string(line))
+}
+
+// names returns every username, sorted, by walking the records, which
+// end where the first hash table starts.
+func (c *cdbPasswd) names() []string {
+	end := uint32(len(c.data))
+	for i := 0; i < 256; i++ {
+		end = min(end, binary.LittleEndian.Uint32(c.data[i*8:]))
+	}
+	var names []string
+	for pos := uint32(cdbHeaderSize); pos < end; {
+		key, value, ok := c.record(pos)
+		if !ok {
+			break
+		}
+		if len(key) > 0 && key[0] != 0 {
+			names = append(names, string(key))
+		}
+		pos += 8 + uint32(len(key)+len(value))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fresh reports whether the source files still match the stamp,
+// comparing at most once per statInterval.
+func (c *cdbPasswd) fresh(now time.Time) bool {
+	if now.UnixNano()-c.checked.Load() < int64(statInterval) {
+		return true
+	}
+	stamp, err := sourceStamp(c.fsys, c.path)
+	if err != nil || stamp != c.stamp {
+		return false
+	}
+	c.checked.Store(now.UnixNano())
+	return true
+}
+
+// close releases the mapping.
+func (c *cdbPasswd) close() error {
+	c.data = nil
+	return c.unmap()
+}
@@ -0,0 +1,242 @@
+package passwd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/infodancer/auth/vfs"
+)
+
+func TestCompilePasswd_Lookup(t *testing.T) {
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	keyDir := filepath.Join(dir, "keys")
+
+	if err := os.WriteFile(passwdPath, []byte("# header\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []string{"carol", "alice", "bob"} {
+		if err := AddUser(passwdPath, u, u+"-pw"); err != nil {
+			t.Fatalf("AddUser %s: %v", u, err)
+		}
+	}
+	n, err := CompilePasswd(passwdPath)
+	if err != nil || n != 3 {
+		t.Fatalf("CompilePasswd = %d, %v; want 3", n, err)
+	}
+	if fi, err := os.Stat(passwdPath + CDBSuffix); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("stat cdb: %v, %v", fi, err)
+	}
+
+	agent, err := NewCDBAgent(passwdPath, keyDir)
+	if err != nil {
+		t.Fatalf("NewCDBAgent: %v", err)
+	}
+	defer func() { _ = agent.Close() }()
+
+	if agent.cdb == nil {
+		t.Fatal("expected compiled mode")
+	}
+	for _, u := range []string{"alice", "bob", "carol"} {
+		exists, err := agent.UserExists(t.Context(), u)
+		if err != nil || !exists {
+			t.Errorf("UserExists(%s) = %v, %v", u, exists, err)
+		}
+	}
+	for _, u := range []string{"dave", "", cdbStampKey} {
+		if exists, _ := agent.UserExists(t.Context(), u); exists {
+			t.Errorf("expected %q to not exist", u)
+		}
+	}
+	users, err := agent.ListUsers(t.Context())
+	if err != nil || !reflect.DeepEqual(users, []string{"alice", "bob", "carol"}) {
+		t.Errorf("ListUsers = %v, %v", users, err)
+	}
+
+	session, err := agent.Authenticate(t.Context(), "bob", "bob-pw")
+	if err != nil {
+		t.Fatalf("Authenticate bob: %v", err)
+	}
+	session.Clear()
+	if _, err := agent.Authenticate(t.Context(), "bob", "wrong"); err == nil {
+		t.Error("expected wrong password to fail")
+	}
+}
+
+func TestCompilePasswd_ManyUsers(t *testing.T) {
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	var content []byte
+	for i := range 5000 {
+		content = fmt.Appendf(content, "user%d:HASH:mbox%d\n", i, i)
+	}
+	content = append(content, "user7:HASH:last\n"...)
+	if err := os.WriteFile(passwdPath, content, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := CompilePasswd(passwdPath); err != nil || n != 5000 {
+		t.Fatalf("CompilePasswd = %d, %v; want 5000", n, err)
+	}
+	c, err := openCDB(vfs.OS{}, passwdPath)
+	if err != nil {
+		t.Fatalf("openCDB: %v", err)
+	}
+	defer func() { _ = c.close() }()
+
+	for i := range 5000 {
+		want := fmt.Sprintf("mbox%d", i)
+		if i == 7 {
+			want = "last"
+		}
+		name := fmt.Sprintf("user%d", i)
+		if entry, ok := c.lookup(name); !ok || entry.mailbox != want {
+			t.Fatalf("lookup %s = %+v, %v; want mailbox %s", name, entry, ok, want)
+		}
+	}
+	if _, ok := c.lookup("user5000"); ok {
+		t.Error("expected user5000 to not exist")
+	}
+	if names := c.names(); len(names) != 5000 || !slices.IsSorted(names) {
+		t.Errorf("names: %d, sorted %v", len(names), slices.IsSorted(names))
+	}
+}
+
+func TestCompilePasswd_Sharded(t *testing.T) {
+	dir := t.TempDir()
+	shardDir := filepath.Join(dir, "passwd.d")
+	if err := os.MkdirAll(shardDir, 0o750); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []string{"alice", "bob", "zed"} {
+		if err := AddUser(shardDir, u, u+"-pw"); err != nil {
+			t.Fatalf("AddUser %s: %v", u, err)
+		}
+	}
+	if n, err := CompilePasswd(shardDir); err != nil || n != 3 {
+		t.Fatalf("CompilePasswd = %d, %v; want 3", n, err)
+	}
+	agent, err := NewCDBAgent(shardDir, filepath.Join(dir, "keys"))
+	if err != nil {
+		t.Fatalf("NewCDBAgent: %v", err)
+	}
+	defer func() { _ = agent.Close() }()
+	if agent.cdb == nil {
+		t.Fatal("expected compiled mode")
+	}
+	session, err := agent.Authenticate(t.Context(), "zed", "zed-pw")
+	if err != nil {
+		t.Fatalf("Authenticate zed: %v", err)
+	}
+	session.Clear()
+}
+
+func TestCDBAgent_Fallback(t *testing.T) {
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	keyDir := filepath.Join(dir, "keys")
+	if err := AddUser(passwdPath, "alice", "alice-pw"); err != nil {
+		t.Fatal(err)
+	}
+
+	// No cdb yet: the text file is served.
+	agent, err := NewCDBAgent(passwdPath, keyDir)
+	if err != nil {
+		t.Fatalf("NewCDBAgent without cdb: %v", err)
+	}
+	if agent.cdb != nil {
+		t.Error("expected text mode without a cdb")
+	}
+	if exists, _ := agent.UserExists(t.Context(), "alice"); !exists {
+		t.Error("expected alice to exist")
+	}
+	_ = agent.Close()
+
+	if _, err := CompilePasswd(passwdPath); err != nil {
+		t.Fatal(err)
+	}
+	agent, err = NewCDBAgent(passwdPath, keyDir)
+	if err != nil {
+		t.Fatalf("NewCDBAgent: %v", err)
+	}
+	defer func() { _ = agent.Close() }()
+	if agent.cdb == nil {
+		t.Fatal("expected compiled mode")
+	}
+
+	// A change made without recompiling is noticed at the next recheck.
+	if err := AddUser(passwdPath, "bob", "bob-pw"); err != nil {
+		t.Fatal(err)
+	}
+	agent.cdb.checked.Store(time.Now().Add(-statInterval).UnixNano())
+	if exists, _ := agent.UserExists(t.Context(), "bob"); !exists {
+		t.Error("expected bob to exist after the passwd change")
+	}
+	if agent.cdb != nil || len(agent.stale) != 1 {
+		t.Error("expected the stale cdb to be dropped")
+	}
+
+	// Opening against a stale cdb serves the text file from the start.
+	stale, err := NewCDBAgent(passwdPath, keyDir)
+	if err != nil {
+		t.Fatalf("NewCDBAgent with stale cdb: %v", err)
+	}
+	defer func() { _ = stale.Close() }()
+	if stale.cdb != nil {
+		t.Error("expected text mode with a stale cdb")
+	}
+	if exists, _ := stale.UserExists(t.Context(), "bob"); !exists {
+		t.Error("expected bob to exist")
+	}
+}
+
+func TestCDBAgent_Unusable(t *testing.T) {
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	if err := AddUser(passwdPath, "alice", "alice-pw"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(passwdPath+CDBSuffix, []byte("not a cdb"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	agent, err := NewCDBAgent(passwdPath, filepath.Join(dir, "keys"))
+	if err != nil {
+		t.Fatalf("NewCDBAgent: %v", err)
+	}
+	defer func() { _ = agent.Close() }()
+	if exists, _ := agent.UserExists(t.Context(), "alice"); agent.cdb != nil || !exists {
+		t.Errorf("expected text mode with alice; cdb %v, exists %v", agent.cdb != nil, exists)
+	}
+}
+
+func TestLint_CDB(t *testing.T) {
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	if err := AddUser(passwdPath, "alice", "alice-pw"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CompilePasswd(passwdPath); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := Lint(passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(lintCodes(problems), "0:passwd.cdb-stale") {
+		t.Errorf("fresh cdb reported stale: %v", lintCodes(problems))
+	}
+
+	if err := AddUser(passwdPath, "bob", "bob-pw"); err != nil {
+		t.Fatal(err)
+	}
+	if problems, err = Lint(passwdPath); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(lintCodes(problems), "0:passwd.cdb-stale") {
+		t.Errorf("stale cdb not reported: %v", lintCodes(problems))
+	}
+}
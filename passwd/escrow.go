@@ -0,0 +1,176 @@
+package passwd
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+
+	"github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/vfs"
+)
+
+// escrowExt is the extension of a user's escrowed private key in the key
+// directory: the SHA-256 of the public key it belongs to, followed by the
+// private key in a NaCl sealed box (box.SealAnonymous) to the domain's
+// recovery public key.
+const escrowExt = ".escrow"
+
+// ParseEscrowKey decodes a base64 X25519 key, as written in a domain's
+// [auth] escrow_pubkey or in the recovery key file userctl creates.
+func ParseEscrowKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != curve25519.PointSize {
+		return nil, fmt.Errorf("%w: escrow key must be %d base64-encoded bytes", errors.ErrInvalidKeyFormat, curve25519.PointSize)
+	}
+	return key, nil
+}
+
+// WithEscrowKey sets the domain recovery public key (see ParseEscrowKey).
+// GenerateUserKeys and RotateUserKeys then also seal each new private key
+// to it, so that whoever holds the recovery private key, kept offline, can
+// restore a user's mailbox after a forgotten password (see
+// RecoverUserKeys). nil turns escrow off. Returns the Agent to allow
+// chaining.
+func (a *Agent) WithEscrowKey(publicKey []byte) *Agent {
+	a.escrowKey = publicKey
+	return a
+}
+
+// writeEscrow escrows privateKey, the private key of publicKey, for
+// username; without an escrow key it removes any escrow left from an
+// earlier key instead.
+func (a *Agent) writeEscrow(username string, publicKey, privateKey []byte) error {
+	path := filepath.Join(a.keyDir, username+escrowExt)
+	if a.escrowKey == nil {
+		if err := a.files().Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove escrowed key: %w", err)
+		}
+		return nil
+	}
+	var recipient [32]byte
+	copy(recipient[:], a.escrowKey)
+	sum := sha256.Sum256(publicKey)
+	sealed, err := box.SealAnonymous(sum[:], privateKey, &recipient, rand.Reader)
+	if err != nil {
+		return fmt.Errorf("escrow private key: %w", err)
+	}
+	if err := vfs.WriteFileAtomic(a.files(), path, sealed, 0o600); err != nil {
+		return fmt.Errorf("write escrowed key: %w", err)
+	}
+	return nil
+}
+
+// RecoverUserKeys restores username's mailbox after a forgotten password:
+// it opens their escrowed private key with the domain recovery private key
+// and sets password as both their login password and the key's seal. A
+// key passphrase set earlier no longer applies. Retired keys, TOTP secrets
+// and app passwords keep working, as the private key itself does not
+// change. The change is recorded in the mutation journal.
+//
+// An unknown user fails with errors.ErrUserNotFound, a user without an
+// escrowed key with errors.ErrKeyNotFound, a wrong recovery key or an
+// escrow of a key that is no longer current with
+// errors.ErrKeyDecryptFailed, and read-only mode with errors.ErrReadOnly.
+func (a *Agent) RecoverUserKeys(_ context.Context, username string, recoveryKey []byte, password string) error {
+	if err := a.writable(); err != nil {
+		return err
+	}
+	if password == "" {
+		return fmt.Errorf("new password is empty")
+	}
+	if len(recoveryKey) != curve25519.ScalarSize {
+		return fmt.Errorf("%w: recovery key must be %d bytes", errors.ErrInvalidKeyFormat, curve25519.ScalarSize)
+	}
+	if _, exists := a.lookup(username); !exists {
+		return errors.ErrUserNotFound
+	}
+	sealed, err := a.files().ReadFile(filepath.Join(a.keyDir, username+escrowExt))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s has no escrowed key", errors.ErrKeyNotFound, username)
+		}
+		return fmt.Errorf("read escrowed key: %w", err)
+	}
+	publicKey, err := a.files().ReadFile(filepath.Join(a.keyDir, username+publicKeyExt))
+	if err != nil {
+		return fmt.Errorf("read public key: %w", err)
+	}
+	sum := sha256.Sum256(publicKey)
+	if len(sealed) < len(sum) || !bytes.Equal(sealed[:len(sum)], sum[:]) {
+		return fmt.Errorf("%w: escrowed key is not %s's current key", errors.ErrKeyDecryptFailed, username)
+	}
+
+	var priv, pub [32]byte
+	copy(priv[:], recoveryKey)
+	defer clear(priv[:])
+	recipient, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errors.ErrInvalidKeyFormat, err)
+	}
+	copy(pub[:], recipient)
+	privateKey, ok := box.OpenAnonymous(nil, sealed[len(sum):], &pub, &priv)
+	if !ok {
+		return errors.ErrKeyDecryptFailed
+	}
+	defer clear(privateKey)
+
+	encrypted, err := encryptPrivateKey(privateKey, password)
+	if err != nil {
+		return err
+	}
+	newHash, err := hashPassword(password, DefaultArgon2Params, a.peppers)
+	if err != nil {
+		return err
+	}
+
+	// Reseal the key first, as ChangePassword does, putting the old one
+	// back if the entry then cannot be updated.
+	privPath := filepath.Join(a.keyDir, username+privateKeyExt)
+	previous, err := a.files().ReadFile(privPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("read private key: %w", err)
+	}
+	if err := vfs.WriteFileAtomic(a.files(), privPath, encrypted, 0o600); err != nil {
+		return fmt.Errorf("write private key: %w", err)
+	}
+	now := time.Now()
+	changed, err := updateEntry(a.writeFiles(), a.passwdPath, username, OpPassword, func(parts []string) ([]string, bool) {
+		parts = padFields(parts, username, 6)
+		parts[1] = newHash
+		parts[5] = formatChanged(now)
+		return trimFields(parts), true
+	})
+	if err == nil && !changed {
+		err = errors.ErrUserNotFound
+	}
+	if err != nil {
+		if previous != nil {
+			_ = vfs.WriteFileAtomic(a.files(), privPath, previous, 0o600)
+		}
+		return err
+	}
+	if err := a.files().Remove(keyPassphrasePath(a.keyDir, username)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove key passphrase marker: %w", err)
+	}
+	refreshSCRAM(a.writeFiles(), a.passwdPath, username, password, newHash)
+	dropReversible(a.writeFiles(), a.passwdPath, username)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if cur := a.users[username]; cur != nil {
+		recovered := *cur
+		recovered.hash, recovered.changed = newHash, now
+		a.users[username] = &recovered
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package passwd
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+func TestRecoverUserKeys(t *testing.T) {
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	keyDir := filepath.Join(dir, "keys")
+	if err := AddUser(passwdPath, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	recoveryPub, recoveryPriv, err := GenerateX25519()
+	if err != nil {
+		t.Fatal(err)
+	}
+	escrowKey, err := ParseEscrowKey(base64.StdEncoding.EncodeToString(recoveryPub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent, err := NewAgent(passwdPath, keyDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	agent.WithEscrowKey(escrowKey)
+	ctx := context.Background()
+
+	pub, err := agent.GenerateUserKeys(ctx, "alice", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.RecoverUserKeys(ctx, "alice", recoveryPub, "new"); !errors.Is(err, autherrors.ErrKeyDecryptFailed) {
+		t.Errorf("wrong recovery key: err = %v, want ErrKeyDecryptFailed", err)
+	}
+	if err := agent.RecoverUserKeys(ctx, "bob", recoveryPriv, "new"); !errors.Is(err, autherrors.ErrUserNotFound) {
+		t.Errorf("unknown user: err = %v, want ErrUserNotFound", err)
+	}
+
+	// The password is forgotten; recovery sets a new one that unlocks the
+	// same key.
+	if err := agent.RecoverUserKeys(ctx, "alice", recoveryPriv, "new"); err != nil {
+		t.Fatalf("RecoverUserKeys: %v", err)
+	}
+	if _, err := agent.Authenticate(ctx, "alice", "pw"); err == nil {
+		t.Error("old password still logs in")
+	}
+	session, err := agent.Authenticate(ctx, "alice", "new")
+	if err != nil {
+		t.Fatalf("Authenticate after recovery: %v", err)
+	}
+	defer session.Clear()
+	if !session.KeysUnlocked() || !bytes.Equal(session.PublicKey, pub) {
+		t.Error("recovered key does not unlock at login")
+	}
+
+	// Rotation escrows the new key; without an escrow key it drops the
+	// escrow instead of leaving a stale one.
+	newPub, err := agent.RotateUserKeys(ctx, "alice", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.RecoverUserKeys(ctx, "alice", recoveryPriv, "newer"); err != nil {
+		t.Fatalf("RecoverUserKeys after rotation: %v", err)
+	}
+	session2, err := agent.Authenticate(ctx, "alice", "newer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session2.Clear()
+	if !bytes.Equal(session2.PublicKey, newPub) || len(session2.RetiredKeys) != 1 {
+		t.Errorf("after recovery: public key %x, %d retired keys", session2.PublicKey, len(session2.RetiredKeys))
+	}
+	agent.WithEscrowKey(nil)
+	if _, err := agent.RotateUserKeys(ctx, "alice", "newer"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(keyDir, "alice"+escrowExt)); !os.IsNotExist(err) {
+		t.Errorf("escrow kept after rotation without escrow key: %v", err)
+	}
+	if err := agent.RecoverUserKeys(ctx, "alice", recoveryPriv, "x"); !errors.Is(err, autherrors.ErrKeyNotFound) {
+		t.Errorf("no escrow: err = %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestParseEscrowKey(t *testing.T) {
+	for _, s := range []string{"", "not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := ParseEscrowKey(s); !errors.Is(err, autherrors.ErrInvalidKeyFormat) {
+			t.Errorf("ParseEscrowKey(%q) = %v, want ErrInvalidKeyFormat", s, err)
+		}
+	}
+}
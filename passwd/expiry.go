@@ -0,0 +1,146 @@
+package passwd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/vfs"
+)
+
+// parseChanged parses the sixth field of an entry, the Unix time in
+// seconds when the password was set. An empty field is the zero time.
+func parseChanged(field string) (time.Time, bool) {
+	if field == "" {
+		return time.Time{}, true
+	}
+	sec, err := strconv.ParseInt(field, 10, 64)
+	if err != nil || sec <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0), true
+}
+
+// formatChanged formats t for the sixth field of an entry.
+func formatChanged(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+// WithPasswordMaxAge sets how long a password stays valid after it was
+// set. A main-password login with an older password still succeeds, with
+// auth.AuthSession.PasswordExpired set so the caller can demand a change
+// (see ChangePassword). Entries that do not record when their password
+// was set, such as those added with AddUserWithHash, never expire. 0, the
+// default, disables expiry.
+func (a *Agent) WithPasswordMaxAge(d time.Duration) *Agent {
+	a.maxAge = d
+	return a
+}
+
+// passwordExpired reports whether entry's password is older than the
+// agent's maximum password age.
+func (a *Agent) passwordExpired(entry *userEntry) bool {
+	return a.maxAge > 0 && !entry.changed.IsZero() && time.Since(entry.changed) > a.maxAge
+}
+
+// PasswordMaxAgeFromOptions reads the "password_max_age_days" agent
+// option. A missing option is 0 (no expiry); a value that is not a
+// non-negative whole number of days fails with
+// errors.ErrAuthAgentConfigInvalid.
+func PasswordMaxAgeFromOptions(opts map[string]string) (time.Duration, error) {
+	v, ok := opts["password_max_age_days"]
+	if !ok || v == "" {
+		return 0, nil
+	}
+	days, err := strconv.Atoi(v)
+	if err != nil || days < 0 || days > 100*365 {
+		return 0, fmt.Errorf("%w: password_max_age_days %q", errors.ErrAuthAgentConfigInvalid, v)
+	}
+	return time.Duration(days) * 24 * time.Hour, nil
+}
+
+// ChangePassword replaces username's password with password after checking
+// current, and records the time so that expiry starts over. A private key
+// sealed under the login password is resealed under the new one; one with
+// a separate key passphrase (see SetKeyPassphrase) is left alone. App
+// passwords keep working, and a SCRAM verifier (see SetSCRAMCredentials)
+// is derived anew. A reversible password (see SetReversiblePassword) is
+// removed; the agent stores the new one at the next login. The change is
+// recorded in the mutation journal.
+//
+// A wrong current password fails with errors.ErrAuthFailed, a missing user
+// with errors.ErrUserNotFound, and read-only mode with errors.ErrReadOnly.
+func ChangePassword(passwdPath, keyDir, username, current, password string) error {
+	if err := checkWritable(vfs.OS{}, passwdPath); err != nil {
+		return err
+	}
+	if password == "" {
+		return fmt.Errorf("new password is empty")
+	}
+	fsys := vfs.OS{}
+	users, err := parsePasswd(fsys, userFile(fsys, passwdPath, username))
+	if err != nil {
+		return err
+	}
+	var oldHash string
+	for _, u := range users {
+		if u.Username == username {
+			oldHash = u.Hash
+		}
+	}
+	if oldHash == "" {
+		return errors.ErrUserNotFound
+	}
+	if !VerifyPassword(current, oldHash) {
+		return errors.ErrAuthFailed
+	}
+	newHash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	// Reseal the key first: if the entry then cannot be updated, the key
+	// is put back under the old password rather than left unopenable.
+	separate, err := hasKeyPassphrase(fsys, keyDir, username)
+	if err != nil {
+		return err
+	}
+	resealed := false
+	if !separate {
+		_, err := fsys.Stat(filepath.Join(keyDir, username+privateKeyExt))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("stat private key: %w", err)
+		}
+		if err == nil {
+			if err := resealPrivateKey(fsys, keyDir, username, current, password, false); err != nil {
+				return err
+			}
+			resealed = true
+		}
+	}
+
+	changed, err := updateEntry(fsys, passwdPath, username, OpPassword, func(parts []string) ([]string, bool) {
+		if parts[1] != oldHash {
+			return nil, false
+		}
+		parts = padFields(parts, username, 6)
+		parts[1] = newHash
+		parts[5] = formatChanged(time.Now())
+		return trimFields(parts), true
+	})
+	if err == nil && !changed {
+		err = fmt.Errorf("password of %q changed concurrently", username)
+	}
+	if err != nil {
+		if resealed {
+			_ = resealPrivateKey(fsys, keyDir, username, password, current, false)
+		}
+		return err
+	}
+	refreshSCRAM(fsys, passwdPath, username, password, newHash)
+	dropReversible(fsys, passwdPath, username)
+	return nil
+}
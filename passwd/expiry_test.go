@@ -0,0 +1,152 @@
+package passwd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+func TestPasswordMaxAgeFromOptions(t *testing.T) {
+	if d, err := PasswordMaxAgeFromOptions(nil); err != nil || d != 0 {
+		t.Errorf("no options = %v, %v", d, err)
+	}
+	if d, err := PasswordMaxAgeFromOptions(map[string]string{"password_max_age_days": "90"}); err != nil || d != 90*24*time.Hour {
+		t.Errorf("90 days = %v, %v", d, err)
+	}
+	for _, v := range []string{"90d", "-1", "1e9"} {
+		if _, err := PasswordMaxAgeFromOptions(map[string]string{"password_max_age_days": v}); !errors.Is(err, autherrors.ErrAuthAgentConfigInvalid) {
+			t.Errorf("%q: err = %v, want ErrAuthAgentConfigInvalid", v, err)
+		}
+	}
+}
+
+func TestAuthenticate_PasswordExpired(t *testing.T) {
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	hash, err := HashPasswordWithParams("pw", cheapParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := strconv.FormatInt(time.Now().Add(-100*24*time.Hour).Unix(), 10)
+	recent := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	content := "old:" + hash + ":old:::" + old + "\n" +
+		"recent:" + hash + ":recent:::" + recent + "\n" +
+		"unknown:" + hash + ":unknown\n"
+	if err := os.WriteFile(passwdPath, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for _, mapped := range []bool{false, true} {
+		newAgent := NewAgent
+		if mapped {
+			newAgent = NewMappedAgent
+		}
+		agent, err := newAgent(passwdPath, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		agent.WithArgon2Params(cheapParams).WithPasswordMaxAge(90 * 24 * time.Hour)
+		for user, want := range map[string]bool{"old": true, "recent": false, "unknown": false} {
+			session, err := agent.Authenticate(ctx, user, "pw")
+			if err != nil {
+				t.Fatalf("mapped=%v: %s: %v", mapped, user, err)
+			}
+			if session.PasswordExpired != want {
+				t.Errorf("mapped=%v: %s: PasswordExpired = %v, want %v", mapped, user, session.PasswordExpired, want)
+			}
+		}
+
+		// Without a maximum age nothing expires.
+		agent.WithPasswordMaxAge(0)
+		if session, err := agent.Authenticate(ctx, "old", "pw"); err != nil || session.PasswordExpired {
+			t.Errorf("mapped=%v: no max age: %+v, %v", mapped, session, err)
+		}
+		_ = agent.Close()
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	keyDir := filepath.Join(dir, "keys")
+	if err := AddUser(passwdPath, "alice", "old-pw"); err != nil {
+		t.Fatal(err)
+	}
+	writeKeyPair(t, keyDir, "alice", "old-pw")
+
+	users, err := ListUsers(passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if since := time.Since(users[0].PasswordChanged); since < 0 || since > time.Minute {
+		t.Errorf("AddUser PasswordChanged = %v", users[0].PasswordChanged)
+	}
+
+	if err := ChangePassword(passwdPath, keyDir, "alice", "wrong", "new-pw"); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("wrong current password: err = %v, want ErrAuthFailed", err)
+	}
+	if err := ChangePassword(passwdPath, keyDir, "bob", "old-pw", "new-pw"); !errors.Is(err, autherrors.ErrUserNotFound) {
+		t.Errorf("missing user: err = %v, want ErrUserNotFound", err)
+	}
+	if err := ChangePassword(passwdPath, keyDir, "alice", "old-pw", "new-pw"); err != nil {
+		t.Fatalf("ChangePassword: %v", err)
+	}
+
+	agent, err := NewAgent(passwdPath, keyDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	if _, err := agent.Authenticate(context.Background(), "alice", "old-pw"); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("old password: err = %v, want ErrAuthFailed", err)
+	}
+	session, err := agent.Authenticate(context.Background(), "alice", "new-pw")
+	if err != nil {
+		t.Fatalf("new password: %v", err)
+	}
+	if !session.KeysUnlocked() {
+		t.Error("private key not resealed under the new password")
+	}
+	session.Clear()
+
+	entries, err := ReadJournal(passwdPath)
+	if err != nil || len(entries) != 2 || entries[1].Op != OpPassword {
+		t.Errorf("journal = %+v, %v", entries, err)
+	}
+}
+
+func TestChangePassword_ReadOnly(t *testing.T) {
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	if err := AddUser(passwdPath, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	markReadOnly(t, passwdPath)
+	if err := ChangePassword(passwdPath, t.TempDir(), "alice", "pw", "new"); !errors.Is(err, autherrors.ErrReadOnly) {
+		t.Errorf("err = %v, want ErrReadOnly", err)
+	}
+}
+
+func TestLint_BadChanged(t *testing.T) {
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	hash, err := HashPasswordWithParams("pw", cheapParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(passwdPath, []byte("alice:"+hash+":alice:::yesterday\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := Lint(passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codes := lintCodes(problems); !slices.Equal(codes, []string{"1:passwd.bad-changed"}) {
+		t.Errorf("codes = %v", codes)
+	}
+}
@@ -0,0 +1,120 @@
+package passwd
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/vfs"
+)
+
+// Account flags restrict an account (see auth.AccountStatus). They are kept
+// comma-separated in the fifth field of the user's entry:
+//
+//	alice:$argon2id$...:alice:1001:locked,nologin
+const (
+	FlagDisabled = "disabled" // no logins and no mail
+	FlagLocked   = "locked"   // no logins; mail is still delivered
+	FlagNoLogin  = "nologin"  // a mail-only account
+)
+
+// knownFlags are the flags SetFlags accepts.
+var knownFlags = []string{FlagDisabled, FlagLocked, FlagNoLogin}
+
+// parseFlags splits a flags field. Empty elements are dropped.
+func parseFlags(field string) []string {
+	var flags []string
+	for _, f := range strings.Split(field, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			flags = append(flags, f)
+		}
+	}
+	return flags
+}
+
+// statusFromFlags returns the account status flags describe. Unknown flags
+// are ignored.
+func statusFromFlags(flags []string) auth.AccountStatus {
+	deleted, _, _ := deletion(flags)
+	return auth.AccountStatus{
+		Disabled: slices.Contains(flags, FlagDisabled),
+		Locked:   slices.Contains(flags, FlagLocked),
+		NoLogin:  slices.Contains(flags, FlagNoLogin),
+		Deleted:  deleted,
+	}
+}
+
+// SetFlags replaces the account flags of username's entry with flags
+// (FlagDisabled, FlagLocked, FlagNoLogin); none clears them. The change is
+// recorded in the mutation journal and can be undone (see Undo). Returns
+// an error if the user does not exist or a flag is unknown, and
+// errors.ErrReadOnly in read-only mode.
+func SetFlags(passwdPath, username string, flags ...string) error {
+	if err := checkWritable(vfs.OS{}, passwdPath); err != nil {
+		return err
+	}
+	for _, f := range flags {
+		if !slices.Contains(knownFlags, f) {
+			return fmt.Errorf("unknown account flag %q", f)
+		}
+	}
+	flags = slices.Compact(slices.Sorted(slices.Values(flags)))
+	field := strings.Join(flags, ",")
+
+	var found bool
+	_, err := updateEntry(vfs.OS{}, passwdPath, username, OpFlags, func(parts []string) ([]string, bool) {
+		found = true
+		parts = padFields(parts, username, 5)
+		// The deletion marker is not an account flag; keep it.
+		field := field
+		if marker, ok := deletionMarker(parseFlags(parts[4])); ok {
+			field = strings.Trim(field+","+marker, ",")
+		}
+		if parts[4] == field {
+			return nil, false
+		}
+		parts[4] = field
+		return trimFields(parts), true
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("user %q not found", username)
+	}
+	return nil
+}
+
+// AccountStatus returns username's restrictions from their entry's flags
+// and AttrServices attribute. Returns errors.ErrUserNotFound if the user
+// does not exist.
+// Implements auth.AccountStatusProvider.
+func (a *Agent) AccountStatus(ctx context.Context, username string) (auth.AccountStatus, error) {
+	entry, exists := a.lookup(username)
+	if !exists {
+		return auth.AccountStatus{}, errors.ErrUserNotFound
+	}
+	status := statusFromFlags(entry.flags)
+	status.Services = entry.profile.services()
+	return status, nil
+}
+
+// checkStatus returns errors.ErrAccountDisabled, naming the restriction,
+// if entry's account may not log in.
+func checkStatus(entry *userEntry) error {
+	s := statusFromFlags(entry.flags)
+	switch {
+	case !s.Deleted.IsZero():
+		return fmt.Errorf("%w: %s", errors.ErrAccountDisabled, FlagDeleted)
+	case s.Disabled:
+		return fmt.Errorf("%w: %s", errors.ErrAccountDisabled, FlagDisabled)
+	case s.Locked:
+		return fmt.Errorf("%w: %s", errors.ErrAccountDisabled, FlagLocked)
+	case s.NoLogin:
+		return fmt.Errorf("%w: %s", errors.ErrAccountDisabled, FlagNoLogin)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package passwd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+func TestSetFlags(t *testing.T) {
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	if err := AddUser(passwdPath, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	original, _ := os.ReadFile(passwdPath)
+
+	if err := SetFlags(passwdPath, "alice", FlagNoLogin, FlagLocked, FlagLocked); err != nil {
+		t.Fatal(err)
+	}
+	users, err := ListUsers(passwdPath)
+	if err != nil || len(users) != 1 {
+		t.Fatalf("ListUsers = %v, %v", users, err)
+	}
+	if u := users[0]; u.Mailbox != "alice" || !slices.Equal(u.Flags, []string{FlagLocked, FlagNoLogin}) {
+		t.Errorf("entry = %+v", u)
+	}
+	data, _ := os.ReadFile(passwdPath)
+	if !strings.Contains(string(data), ":alice::locked,nologin:") {
+		t.Errorf("passwd file = %q", data)
+	}
+
+	// Clearing the flags restores the original entry.
+	if err := SetFlags(passwdPath, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(passwdPath); string(data) != string(original) {
+		t.Errorf("cleared passwd file = %q", data)
+	}
+
+	if err := SetFlags(passwdPath, "bob", FlagLocked); err == nil {
+		t.Error("flags set on missing user")
+	}
+	if err := SetFlags(passwdPath, "alice", "frozen"); err == nil {
+		t.Error("unknown flag accepted")
+	}
+}
+
+func TestSetFlags_Undo(t *testing.T) {
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	if err := AddUser(passwdPath, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetFlags(passwdPath, "alice", FlagDisabled); err != nil {
+		t.Fatal(err)
+	}
+	// An unchanged value is not journaled.
+	if err := SetFlags(passwdPath, "alice", FlagDisabled); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ReadJournal(passwdPath)
+	if err != nil || len(entries) != 2 || entries[1].Op != OpFlags {
+		t.Fatalf("journal = %+v, %v", entries, err)
+	}
+
+	if _, err := Undo(passwdPath, 1); err != nil {
+		t.Fatal(err)
+	}
+	users, err := ListUsers(passwdPath)
+	if err != nil || len(users) != 1 || len(users[0].Flags) != 0 {
+		t.Errorf("after undo: %+v, %v", users, err)
+	}
+}
+
+func TestAuthenticate_AccountFlags(t *testing.T) {
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	for _, u := range []string{"alice", "bob", "carol", "dave"} {
+		if err := AddUser(passwdPath, u, "pw"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for u, flag := range map[string]string{"bob": FlagDisabled, "carol": FlagLocked, "dave": FlagNoLogin} {
+		if err := SetFlags(passwdPath, u, flag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+
+	for _, mapped := range []bool{false, true} {
+		newAgent := NewAgent
+		if mapped {
+			newAgent = NewMappedAgent
+		}
+		agent, err := newAgent(passwdPath, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := auth.AsAccountStatusProvider(agent); !ok {
+			t.Error("agent does not report AccountStatusProvider")
+		}
+
+		if _, err := agent.Authenticate(ctx, "alice", "pw"); err != nil {
+			t.Errorf("mapped=%v: alice: %v", mapped, err)
+		}
+		for _, u := range []string{"bob", "carol", "dave"} {
+			if _, err := agent.Authenticate(ctx, u, "pw"); !errors.Is(err, autherrors.ErrAccountDisabled) {
+				t.Errorf("mapped=%v: %s: err = %v, want ErrAccountDisabled", mapped, u, err)
+			}
+			// A wrong password reveals nothing about the flags.
+			if _, err := agent.Authenticate(ctx, u, "wrong"); !errors.Is(err, autherrors.ErrAuthFailed) {
+				t.Errorf("mapped=%v: %s with wrong password: err = %v, want ErrAuthFailed", mapped, u, err)
+			}
+		}
+
+		for u, want := range map[string]auth.AccountStatus{
+			"alice": {},
+			"bob":   {Disabled: true},
+			"carol": {Locked: true},
+			"dave":  {NoLogin: true},
+		} {
+			got, err := agent.AccountStatus(ctx, u)
+			if err != nil || got != want {
+				t.Errorf("mapped=%v: AccountStatus(%s) = %+v, %v; want %+v", mapped, u, got, err, want)
+			}
+		}
+		if _, err := agent.AccountStatus(ctx, "eve"); !errors.Is(err, autherrors.ErrUserNotFound) {
+			t.Errorf("mapped=%v: AccountStatus(eve): err = %v, want ErrUserNotFound", mapped, err)
+		}
+		_ = agent.Close()
+	}
+}
+
+func TestLint_UnknownFlag(t *testing.T) {
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	if err := AddUser(passwdPath, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	users, err := ListUsers(passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := "alice:" + users[0].Hash + ":alice:1001:locked,frozen\n"
+	if err := os.WriteFile(passwdPath, []byte(line), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := Lint(passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codes := lintCodes(problems); !slices.Equal(codes, []string{"1:passwd.unknown-flag"}) {
+		t.Errorf("codes = %v", codes)
+	}
+}
@@ -0,0 +1,35 @@
+package passwd
+
+import (
+	"github.com/infodancer/auth/vfs"
+)
+
+// Option configures an Agent as it is opened.
+type Option func(*Agent)
+
+// WithFS makes the agent read and write its passwd files, shard
+// directories, journal and key files through fsys instead of the local
+// disk. Memory-mapped agents (NewMappedAgent) need the local disk and load
+// as with NewAgent under any other FS. Use vfs.ReadOnly to serve a
+// read-only bundle: the agent's own writes, such as hash upgrades, then
+// fail with fs.ErrPermission.
+//
+// The package-level management functions (AddUser, EnableTOTP and the
+// like) work on the local disk, where management tools run.
+func WithFS(fsys vfs.WriteFS) Option {
+	return func(a *Agent) { a.fsys = fsys }
+}
+
+// files returns the FS the agent was opened with, or vfs.OS.
+func (a *Agent) files() vfs.WriteFS {
+	if a.fsys == nil {
+		return vfs.OS{}
+	}
+	return a.fsys
+}
+
+// onDisk reports whether fsys is the local disk.
+func onDisk(fsys vfs.FS) bool {
+	_, ok := fsys.(vfs.OS)
+	return ok
+}
@@ -0,0 +1,142 @@
+package passwd
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/vfs"
+)
+
+// newMemFS returns an in-memory FS holding a passwd file with the given
+// users, each with password name+"-pw", and an empty key directory.
+func newMemFS(t *testing.T, users ...string) *vfs.MemFS {
+	t.Helper()
+	mem := vfs.NewMemFS()
+	if err := mem.MkdirAll("/domain/keys", 0o750); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, name := range users {
+		hash, err := HashPassword(name + "-pw")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, name+":"+hash+":"+name)
+	}
+	if err := writePasswd(mem, "/domain/passwd", lines); err != nil {
+		t.Fatal(err)
+	}
+	return mem
+}
+
+func TestWithFS_InMemoryAgent(t *testing.T) {
+	mem := newMemFS(t, "alice", "bob")
+	passwdPath := "/domain/passwd"
+
+	// NewMappedAgent falls back to the map-based loader off disk.
+	agent, err := NewMappedAgent(passwdPath, "/domain/keys", WithFS(mem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	ctx := context.Background()
+	if _, err := agent.Authenticate(ctx, "bob", "bob-pw"); err != nil {
+		t.Errorf("Authenticate(bob): %v", err)
+	}
+	pub, err := agent.GenerateUserKeys(ctx, "alice", "alice-pw")
+	if err != nil {
+		t.Fatalf("GenerateUserKeys: %v", err)
+	}
+	if data, err := mem.ReadFile("/domain/keys/alice.pub"); err != nil || string(data) != string(pub) {
+		t.Errorf("public key in FS = %q, %v", data, err)
+	}
+	if got, err := agent.GetPublicKey(ctx, "alice"); err != nil || string(got) != string(pub) {
+		t.Errorf("GetPublicKey(alice) = %q, %v", got, err)
+	}
+
+	// Nothing reached the local disk.
+	if _, err := os.Stat(passwdPath); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("passwd file on disk: %v", err)
+	}
+	if _, err := os.Stat("/domain/keys/alice.pub"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("public key on disk: %v", err)
+	}
+}
+
+func TestWithFS_AgentsDoNotShare(t *testing.T) {
+	// Agents on different filesystems in one process see only their own.
+	a, err := NewAgent("/domain/passwd", "/domain/keys", WithFS(newMemFS(t, "alice")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = a.Close() }()
+	b, err := NewAgent("/domain/passwd", "/domain/keys", WithFS(newMemFS(t, "bob")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = b.Close() }()
+
+	ctx := context.Background()
+	if _, err := a.Authenticate(ctx, "alice", "alice-pw"); err != nil {
+		t.Errorf("a.Authenticate(alice): %v", err)
+	}
+	if _, err := a.Authenticate(ctx, "bob", "bob-pw"); err == nil {
+		t.Error("a.Authenticate(bob) succeeded")
+	}
+	if _, err := b.Authenticate(ctx, "bob", "bob-pw"); err != nil {
+		t.Errorf("b.Authenticate(bob): %v", err)
+	}
+}
+
+func TestWithFS_ReadOnlyBundle(t *testing.T) {
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	if err := AddUser(passwdPath, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+
+	agent, err := NewAgent(passwdPath, filepath.Join(dir, "keys"), WithFS(vfs.ReadOnly(vfs.OS{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	ctx := context.Background()
+	if _, err := agent.Authenticate(ctx, "alice", "pw"); err != nil {
+		t.Errorf("Authenticate: %v", err)
+	}
+	if _, err := agent.GenerateUserKeys(ctx, "alice", "pw"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("GenerateUserKeys: got %v, want ErrPermission", err)
+	}
+}
+
+// readOnlyFS hides the write methods of the FS it wraps.
+type readOnlyFS struct{ vfs.FS }
+
+func TestRegistry_FS(t *testing.T) {
+	mem := newMemFS(t, "alice")
+	agent, err := auth.OpenAuthAgent(auth.AuthAgentConfig{
+		Type:              "passwd",
+		CredentialBackend: "/domain/passwd",
+		KeyBackend:        "/domain/keys",
+		FS:                readOnlyFS{mem},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	ctx := context.Background()
+	if _, err := agent.Authenticate(ctx, "alice", "alice-pw"); err != nil {
+		t.Errorf("Authenticate: %v", err)
+	}
+	// An FS without write methods is served read-only.
+	gen := agent.(auth.KeyGenerator)
+	if _, err := gen.GenerateUserKeys(ctx, "alice", "alice-pw"); !errors.Is(err, autherrors.ErrReadOnly) {
+		t.Errorf("GenerateUserKeys: got %v, want ErrReadOnly", err)
+	}
+}
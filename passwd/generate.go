@@ -0,0 +1,180 @@
+package passwd
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Character classes of generated passwords.
+const (
+	lowerChars   = "abcdefghijklmnopqrstuvwxyz"
+	upperChars   = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	digitChars   = "0123456789"
+	symbolChars  = "!#$%&*+-=?@^_"
+	similarChars = "0O1lI"
+)
+
+// Limits on PasswordPolicy.Length.
+const (
+	MinGeneratedLength     = 8
+	DefaultGeneratedLength = 20
+	MaxGeneratedLength     = 1024
+)
+
+// PasswordPolicy describes the passwords GeneratePassword produces. A
+// domain sets its policy in config.toml:
+//
+//	[password]
+//	length = 24
+//	min_symbols = 2
+//
+// The zero value generates like DefaultPasswordPolicy.
+type PasswordPolicy struct {
+	// Length is the number of characters; 0 means DefaultGeneratedLength.
+	Length int `toml:"length,omitempty"`
+
+	// MinLower, MinUpper, MinDigits and MinSymbols are the least number of
+	// characters of each class. All zero means one each of lower, upper
+	// and digit.
+	MinLower   int `toml:"min_lower,omitempty"`
+	MinUpper   int `toml:"min_upper,omitempty"`
+	MinDigits  int `toml:"min_digits,omitempty"`
+	MinSymbols int `toml:"min_symbols,omitempty"`
+
+	// Symbols is the symbol alphabet, printable ASCII. Symbols are used
+	// only when it is set or MinSymbols is positive; empty then means
+	// "!#$%&*+-=?@^_".
+	Symbols string `toml:"symbols,omitempty"`
+
+	// ExcludeSimilar leaves out characters that are easily confused when
+	// read aloud or copied by hand: 0, O, 1, l and I.
+	ExcludeSimilar bool `toml:"exclude_similar,omitempty"`
+}
+
+// DefaultPasswordPolicy is the policy GeneratePassword applies for the
+// zero PasswordPolicy.
+var DefaultPasswordPolicy = PasswordPolicy{Length: DefaultGeneratedLength, MinLower: 1, MinUpper: 1, MinDigits: 1}
+
+// passwordClass is a character class with the least number of its
+// characters a password must contain.
+type passwordClass struct {
+	chars string
+	min   int
+}
+
+// Validate reports whether GeneratePassword can satisfy p. A length outside
+// MinGeneratedLength..MaxGeneratedLength, a negative minimum, more required
+// characters than the length, or a symbol alphabet that is not printable
+// ASCII are errors.
+func (p PasswordPolicy) Validate() error {
+	_, _, err := p.resolve()
+	return err
+}
+
+// resolve applies the defaults to p, validates it, and returns its length
+// and character classes.
+func (p PasswordPolicy) resolve() (int, []passwordClass, error) {
+	if p.Length == 0 {
+		p.Length = DefaultGeneratedLength
+	}
+	if p.MinLower == 0 && p.MinUpper == 0 && p.MinDigits == 0 && p.MinSymbols == 0 {
+		p.MinLower, p.MinUpper, p.MinDigits = 1, 1, 1
+	}
+	if p.Length < MinGeneratedLength || p.Length > MaxGeneratedLength {
+		return 0, nil, fmt.Errorf("password length %d is outside %d..%d", p.Length, MinGeneratedLength, MaxGeneratedLength)
+	}
+	if p.MinLower < 0 || p.MinUpper < 0 || p.MinDigits < 0 || p.MinSymbols < 0 {
+		return 0, nil, fmt.Errorf("password policy has a negative minimum")
+	}
+	if required := p.MinLower + p.MinUpper + p.MinDigits + p.MinSymbols; required > p.Length {
+		return 0, nil, fmt.Errorf("password policy requires %d characters but length is %d", required, p.Length)
+	}
+	symbols := p.Symbols
+	if symbols == "" && p.MinSymbols > 0 {
+		symbols = symbolChars
+	}
+	for _, c := range symbols {
+		if c <= ' ' || c > '~' {
+			return 0, nil, fmt.Errorf("password symbols must be printable ASCII, not %q", c)
+		}
+	}
+
+	classes := []passwordClass{
+		{lowerChars, p.MinLower},
+		{upperChars, p.MinUpper},
+		{digitChars, p.MinDigits},
+		{symbols, p.MinSymbols},
+	}
+	for i, class := range classes {
+		if p.ExcludeSimilar {
+			classes[i].chars = strings.Map(func(r rune) rune {
+				if strings.ContainsRune(similarChars, r) {
+					return -1
+				}
+				return r
+			}, class.chars)
+		}
+		if classes[i].chars == "" && class.min > 0 {
+			return 0, nil, fmt.Errorf("password policy requires symbols but excludes them all")
+		}
+	}
+	return p.Length, classes, nil
+}
+
+// GeneratePassword returns a random password satisfying policy, drawn from
+// crypto/rand. It fails if policy is not valid (see PasswordPolicy.Validate).
+func GeneratePassword(policy PasswordPolicy) (string, error) {
+	length, classes, err := policy.resolve()
+	if err != nil {
+		return "", err
+	}
+	var all strings.Builder
+	out := make([]byte, 0, length)
+	for _, class := range classes {
+		all.WriteString(class.chars)
+		for range class.min {
+			c, err := randomChar(class.chars)
+			if err != nil {
+				return "", err
+			}
+			out = append(out, c)
+		}
+	}
+	for len(out) < length {
+		c, err := randomChar(all.String())
+		if err != nil {
+			return "", err
+		}
+		out = append(out, c)
+	}
+
+	// Shuffle so the required characters are not at the front.
+	for i := len(out) - 1; i > 0; i-- {
+		j, err := randomInt(i + 1)
+		if err != nil {
+			return "", err
+		}
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out), nil
+}
+
+// randomChar returns a uniformly chosen byte of chars.
+func randomChar(chars string) (byte, error) {
+	i, err := randomInt(len(chars))
+	if err != nil {
+		return 0, err
+	}
+	return chars[i], nil
+}
+
+// randomInt returns a uniform random integer in [0, n).
+func randomInt(n int) (int, error) {
+	v, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, fmt.Errorf("generate password: %w", err)
+	}
+	return int(v.Int64()), nil
+}
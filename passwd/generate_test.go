@@ -0,0 +1,122 @@
+package passwd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGeneratePassword(t *testing.T) {
+	count := func(s, chars string) int {
+		n := 0
+		for _, c := range s {
+			if strings.ContainsRune(chars, c) {
+				n++
+			}
+		}
+		return n
+	}
+	for _, tc := range []struct {
+		name   string
+		policy PasswordPolicy
+	}{
+		{"default", DefaultPasswordPolicy},
+		{"symbols", PasswordPolicy{Length: 12, MinSymbols: 3}},
+		{"all classes", PasswordPolicy{Length: 8, MinLower: 2, MinUpper: 2, MinDigits: 2, MinSymbols: 2}},
+		{"custom symbols", PasswordPolicy{Length: 16, MinSymbols: 2, Symbols: ".,"}},
+		{"exclude similar", PasswordPolicy{Length: 200, MinDigits: 50, ExcludeSimilar: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pw, err := GeneratePassword(tc.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tc.policy.Length
+			if want == 0 {
+				want = DefaultGeneratedLength
+			}
+			if len(pw) != want {
+				t.Errorf("len(%q) = %d, want %d", pw, len(pw), want)
+			}
+			symbols := tc.policy.Symbols
+			if symbols == "" {
+				symbols = symbolChars
+			}
+			if n := count(pw, symbols); n < tc.policy.MinSymbols {
+				t.Errorf("%q has %d symbols, want %d", pw, n, tc.policy.MinSymbols)
+			}
+			if n := count(pw, lowerChars); n < tc.policy.MinLower {
+				t.Errorf("%q has %d lowercase letters, want %d", pw, n, tc.policy.MinLower)
+			}
+			if n := count(pw, upperChars); n < tc.policy.MinUpper {
+				t.Errorf("%q has %d uppercase letters, want %d", pw, n, tc.policy.MinUpper)
+			}
+			if n := count(pw, digitChars); n < tc.policy.MinDigits {
+				t.Errorf("%q has %d digits, want %d", pw, n, tc.policy.MinDigits)
+			}
+			if n := count(pw, lowerChars+upperChars+digitChars+symbols); n != len(pw) {
+				t.Errorf("%q has characters outside the policy", pw)
+			}
+			if tc.policy.ExcludeSimilar && strings.ContainsAny(pw, similarChars) {
+				t.Errorf("%q has similar characters", pw)
+			}
+		})
+	}
+
+	// The zero policy requires a letter of each case and a digit.
+	for range 20 {
+		pw, err := GeneratePassword(PasswordPolicy{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pw) != DefaultGeneratedLength || !strings.ContainsAny(pw, lowerChars) ||
+			!strings.ContainsAny(pw, upperChars) || !strings.ContainsAny(pw, digitChars) {
+			t.Errorf("zero policy generated %q", pw)
+		}
+	}
+
+	seen := map[string]bool{}
+	for range 100 {
+		pw, err := GeneratePassword(PasswordPolicy{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[pw] {
+			t.Fatalf("GeneratePassword repeated %q", pw)
+		}
+		seen[pw] = true
+	}
+
+	pw, err := GeneratePassword(PasswordPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := HashPassword(pw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyPassword(pw, hash) {
+		t.Error("generated password does not verify against its hash")
+	}
+}
+
+func TestGeneratePassword_InvalidPolicy(t *testing.T) {
+	for _, p := range []PasswordPolicy{
+		{Length: MinGeneratedLength - 1},
+		{Length: MaxGeneratedLength + 1},
+		{Length: 8, MinLower: -1, MinUpper: 1},
+		{Length: 8, MinLower: 4, MinUpper: 4, MinDigits: 1},
+		{MinSymbols: 1, Symbols: "a b"},
+		{MinSymbols: 1, Symbols: "é"},
+		{MinSymbols: 1, Symbols: "01lIO", ExcludeSimilar: true},
+	} {
+		if err := p.Validate(); err == nil {
+			t.Errorf("Validate(%+v) = nil", p)
+		}
+		if pw, err := GeneratePassword(p); err == nil {
+			t.Errorf("GeneratePassword(%+v) = %q", p, pw)
+		}
+	}
+	if err := (PasswordPolicy{}).Validate(); err != nil {
+		t.Errorf("zero policy: %v", err)
+	}
+}
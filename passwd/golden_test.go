@@ -0,0 +1,117 @@
+package passwd
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// hashVectors is a testdata/hash_vectors_v*.json file: stored hashes from
+// other implementations and earlier releases that must keep verifying
+// across upgrades of the hashing libraries and of the default parameters.
+// Vectors are never edited or removed; new formats go in a new version.
+type hashVectors struct {
+	Version int               `json:"version"`
+	Peppers map[string]string `json:"peppers"` // id → hex secret
+	Vectors []struct {
+		Source   string `json:"source"`
+		Password string `json:"password"`
+		Hash     string `json:"hash"`
+	} `json:"vectors"`
+}
+
+// loadHashVectors reads every golden vector file, installing their
+// peppers for the rest of the test.
+func loadHashVectors(t *testing.T) []hashVectors {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join("testdata", "hash_vectors_v*.json"))
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("no golden hash vectors: %v", err)
+	}
+	pp := &Peppers{Secrets: map[string][]byte{}}
+	var files []hashVectors
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var f hashVectors
+		if err := json.Unmarshal(data, &f); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if want := fmt.Sprintf("hash_vectors_v%d.json", f.Version); filepath.Base(path) != want {
+			t.Errorf("%s declares version %d", path, f.Version)
+		}
+		for id, s := range f.Peppers {
+			secret, err := hex.DecodeString(s)
+			if err != nil {
+				t.Fatalf("%s: pepper %s: %v", path, id, err)
+			}
+			pp.Secrets[id], pp.Current = secret, id
+		}
+		files = append(files, f)
+	}
+	if len(pp.Secrets) > 0 {
+		if err := SetPeppers(pp); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = SetPeppers(nil) })
+	}
+	return files
+}
+
+func TestGoldenHashVectors(t *testing.T) {
+	for _, f := range loadHashVectors(t) {
+		for i, v := range f.Vectors {
+			name := fmt.Sprintf("v%d/%02d", f.Version, i)
+			if _, _, ok := hashScheme(v.Hash); !ok {
+				t.Errorf("%s (%s): scheme of %q not recognized", name, v.Source, v.Hash)
+				continue
+			}
+			if !VerifyPassword(v.Password, v.Hash) {
+				t.Errorf("%s (%s): %q no longer verifies", name, v.Source, v.Hash)
+			}
+			if VerifyPassword(v.Password+"x", v.Hash) {
+				t.Errorf("%s (%s): wrong password verifies", name, v.Source)
+			}
+		}
+	}
+}
+
+// TestGoldenHashVectors_Agent checks the vectors through a passwd file, as
+// they are stored in production.
+func TestGoldenHashVectors_Agent(t *testing.T) {
+	var lines []string
+	passwords := map[string]string{}
+	for _, f := range loadHashVectors(t) {
+		for i, v := range f.Vectors {
+			if v.Password == "" {
+				continue // empty passwords never reach the hash check
+			}
+			user := fmt.Sprintf("v%duser%02d", f.Version, i)
+			lines = append(lines, user+":"+v.Hash+":"+user)
+			passwords[user] = v.Password
+		}
+	}
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	if err := os.WriteFile(passwdPath, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	agent, err := NewAgent(passwdPath, filepath.Join(dir, "keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	agent.WithPeppers(installedPeppers())
+	for user, password := range passwords {
+		if _, err := agent.Authenticate(context.Background(), user, password); err != nil {
+			t.Errorf("Authenticate(%s): %v", user, err)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package passwd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/infodancer/auth/atrest"
+	"github.com/infodancer/auth/vfs"
+)
+
+// Mutation journal
+//
+// Every change made through this package's management functions (AddUser,
+// DeleteUser, SoftDeleteUser, RestoreUser, Reap, SetFlags, SetProfile,
+// ChangePassword, Undo), and every hash upgrade on login (see
+// Agent.WithArgon2Params), is recorded in an append-only journal next to
+// the passwd file ("passwd.journal", or "passwd.d.journal" for a shard
+// directory). The record is written and synced before the passwd file is touched, so the
+// journal never misses a change that reached disk.
+//
+// Each record holds the user's entry line before and after the change, which
+// is enough for Undo to roll back recent mistakes (such as a scripted bulk
+// delete) without restoring a full backup. The journal contains password
+// hashes and is created with the same permissions as the passwd file; when a
+// host key is installed (see package atrest) each entry is sealed.
+
+// Journal operations.
+const (
+	OpAdd      = "add"
+	OpDelete   = "delete"
+	OpUndo     = "undo"
+	OpRehash   = "rehash"
+	OpFlags    = "flags"
+	OpPassword = "password"
+	OpProfile  = "profile"
+
+	// OpSoftDelete and OpRestore mark a user deleted with a grace period
+	// and clear the mark (see FlagDeleted). Purging the user is an
+	// OpDelete.
+	OpSoftDelete = "soft-delete"
+	OpRestore    = "restore"
+)
+
+// JournalEntry is one recorded passwd mutation.
+type JournalEntry struct {
+	// Seq numbers entries from 1 in journal order.
+	Seq int `json:"seq"`
+
+	// Time is when the mutation was recorded.
+	Time time.Time `json:"time"`
+
+	// Actor is the OS user that made the change (SUDO_USER when set).
+	Actor string `json:"actor"`
+
+	// Op is OpAdd, OpDelete, OpUndo, OpRehash, OpFlags, OpPassword,
+	// OpProfile, OpSoftDelete or OpRestore.
+	Op string `json:"op"`
+
+	// Username is the passwd entry affected.
+	Username string `json:"user"`
+
+	// Before and After are the full entry lines; empty means absent.
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+
+	// Undoes is the Seq of the entry rolled back, for OpUndo entries.
+	Undoes int `json:"undoes,omitempty"`
+
+	// Token is the fencing token of the lease held for the change, or 0
+	// when leasing is disabled (see WithLeaseManager).
+	Token uint64 `json:"token,omitempty"`
+}
+
+// journalPath returns the journal file for passwdPath.
+func journalPath(passwdPath string) string {
+	return filepath.Clean(passwdPath) + ".journal"
+}
+
+// ReadJournal returns all journal entries for passwdPath in order.
+// A missing journal yields no entries and no error.
+func ReadJournal(passwdPath string) ([]JournalEntry, error) {
+	f, err := vfs.OS{}.Open(journalPath(passwdPath))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("open journal: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		plain, err := atrest.UnsealLine([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("journal entry %d: %w", len(entries)+1, err)
+		}
+		var e JournalEntry
+		if err := json.Unmarshal(plain, &e); err != nil {
+			return nil, fmt.Errorf("parse journal entry %d: %w", len(entries)+1, err)
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read journal: %w", err)
+	}
+	return entries, nil
+}
+
+// journal appends a mutation record for passwdPath and syncs it to disk.
+// The sequence number continues from the last entry in the journal.
+func journal(fsys vfs.WriteFS, passwdPath string, e JournalEntry) error {
+	existing, err := ReadJournal(passwdPath)
+	if err != nil {
+		return err
+	}
+	e.Seq = 1
+	if n := len(existing); n > 0 {
+		e.Seq = existing[n-1].Seq + 1
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if e.Actor == "" {
+		e.Actor = currentActor()
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("encode journal entry: %w", err)
+	}
+	if data, err = atrest.SealLine(data); err != nil {
+		return fmt.Errorf("seal journal entry: %w", err)
+	}
+
+	if err := fsys.AppendFile(journalPath(passwdPath), append(data, '\n'), 0o640); err != nil {
+		return fmt.Errorf("write journal: %w", err)
+	}
+	return nil
+}
+
+// currentActor names the OS user making a change, preferring SUDO_USER so
+// that changes made via sudo are attributed to the operator, not root.
+func currentActor() string {
+	if s := os.Getenv("SUDO_USER"); s != "" {
+		return s
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return fmt.Sprintf("uid:%d", os.Getuid())
+}
+
+// Undo rolls back the last n mutations recorded in the journal for
+// passwdPath, newest first, and returns the entries that were undone.
+// Entries that are themselves undos, hash upgrades (which are not mistakes
+// to roll back), or that were already undone, are skipped. Each rollback
+// restores the user's entry line to its Before state and is journaled as an
+// OpUndo entry, so an Undo can be audited (but not itself undone with Undo).
+func Undo(passwdPath string, n int) ([]JournalEntry, error) {
+	if err := checkWritable(vfs.OS{}, passwdPath); err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	l, err := lockPasswd(vfs.OS{}, passwdPath)
+	if err != nil {
+		return nil, err
+	}
+	defer l.release()
+	entries, err := ReadJournal(passwdPath)
+	if err != nil {
+		return nil, err
+	}
+
+	undone := make(map[int]bool)
+	for _, e := range entries {
+		if e.Op == OpUndo {
+			undone[e.Undoes] = true
+		}
+	}
+
+	var rolledBack []JournalEntry
+	for i := len(entries) - 1; i >= 0 && len(rolledBack) < n; i-- {
+		e := entries[i]
+		if e.Op == OpUndo || e.Op == OpRehash || undone[e.Seq] {
+			continue
+		}
+		if err := undoEntry(vfs.OS{}, passwdPath, e, l); err != nil {
+			return rolledBack, fmt.Errorf("undo journal entry %d: %w", e.Seq, err)
+		}
+		rolledBack = append(rolledBack, e)
+	}
+	return rolledBack, nil
+}
+
+// undoEntry restores e.Username's entry to e.Before and journals the undo
+// under lock l.
+func undoEntry(fsys vfs.WriteFS, passwdPath string, e JournalEntry, l *passwdLock) error {
+	path := userFile(fsys, passwdPath, e.Username)
+	lines, removed, err := filterPasswd(fsys, path, e.Username)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := l.check(); err != nil {
+		return err
+	}
+	if err := journal(fsys, passwdPath, JournalEntry{
+		Op:       OpUndo,
+		Username: e.Username,
+		Before:   strings.Join(removed, "\n"),
+		After:    e.Before,
+		Undoes:   e.Seq,
+		Token:    l.token(),
+	}); err != nil {
+		return err
+	}
+	if e.Before != "" {
+		lines = append(lines, strings.Split(e.Before, "\n")...)
+	}
+	return writePasswd(fsys, path, lines)
+}
@@ -0,0 +1,108 @@
+package passwd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournal_RecordsMutations(t *testing.T) {
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	t.Setenv("SUDO_USER", "operator")
+
+	if err := AddUser(passwdPath, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteUser(passwdPath, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := ReadJournal(passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 journal entries, got %d", len(entries))
+	}
+	add, del := entries[0], entries[1]
+	if add.Seq != 1 || add.Op != OpAdd || add.Username != "alice" || add.Before != "" || add.After == "" {
+		t.Errorf("unexpected add entry: %+v", add)
+	}
+	if del.Seq != 2 || del.Op != OpDelete || del.Before != add.After || del.After != "" {
+		t.Errorf("unexpected delete entry: %+v", del)
+	}
+	if add.Actor != "operator" {
+		t.Errorf("Actor = %q, want operator", add.Actor)
+	}
+	if add.Time.IsZero() {
+		t.Error("expected Time to be set")
+	}
+}
+
+func TestUndo_RestoresBulkDelete(t *testing.T) {
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	for _, u := range []string{"alice", "bob", "carol"} {
+		if err := AddUser(passwdPath, u, "pw-"+u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, u := range []string{"alice", "bob"} {
+		if err := DeleteUser(passwdPath, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	undone, err := Undo(passwdPath, 2)
+	if err != nil {
+		t.Fatalf("Undo: %v", err)
+	}
+	if len(undone) != 2 || undone[0].Username != "bob" || undone[1].Username != "alice" {
+		t.Fatalf("unexpected undone entries: %+v", undone)
+	}
+
+	agent, err := NewAgent(passwdPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	for _, u := range []string{"alice", "bob", "carol"} {
+		if _, err := agent.Authenticate(t.Context(), u, "pw-"+u); err != nil {
+			t.Errorf("Authenticate(%s) after undo: %v", u, err)
+		}
+	}
+
+	// Already-undone entries are skipped; the next undo reverts carol's add.
+	undone, err = Undo(passwdPath, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(undone) != 1 || undone[0].Op != OpAdd || undone[0].Username != "carol" {
+		t.Fatalf("unexpected second undo: %+v", undone)
+	}
+	users, err := ListUsers(passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Errorf("expected 2 users after undoing carol's add, got %+v", users)
+	}
+
+	entries, err := ReadJournal(passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := entries[len(entries)-1]; last.Op != OpUndo || last.Undoes != 3 {
+		t.Errorf("expected last entry to undo seq 3, got %+v", last)
+	}
+}
+
+func TestUndo_EmptyJournal(t *testing.T) {
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	if err := os.WriteFile(passwdPath, nil, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	undone, err := Undo(passwdPath, 5)
+	if err != nil || len(undone) != 0 {
+		t.Errorf("Undo on empty journal = %v, %v", undone, err)
+	}
+}
@@ -0,0 +1,114 @@
+package passwd
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/curve25519"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/vfs"
+)
+
+// KeyPairGenerator returns a new key pair for a user's encryption keys.
+// The public key is stored as returned; the private key is sealed under
+// the user's password.
+type KeyPairGenerator func() (publicKey, privateKey []byte, err error)
+
+// GenerateX25519 returns a new X25519 key pair: 32-byte keys compatible
+// with NaCl box (golang.org/x/crypto/nacl/box). It is the default
+// KeyPairGenerator.
+func GenerateX25519() (publicKey, privateKey []byte, err error) {
+	privateKey = make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(privateKey); err != nil {
+		return nil, nil, fmt.Errorf("generate private key: %w", err)
+	}
+	publicKey, err = curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		clear(privateKey)
+		return nil, nil, fmt.Errorf("derive public key: %w", err)
+	}
+	return publicKey, privateKey, nil
+}
+
+// Compile-time check: Agent generates keys.
+var _ auth.KeyGenerator = (*Agent)(nil)
+
+// WithKeyPairGenerator sets the generator GenerateUserKeys uses, for key
+// types other than X25519 (GenerateX25519 if nil). Returns the Agent to
+// allow chaining.
+func (a *Agent) WithKeyPairGenerator(gen KeyPairGenerator) *Agent {
+	a.keyGen = gen
+	return a
+}
+
+// GenerateUserKeys creates a key pair for username, seals the private key
+// under password and writes both to the key directory, returning the
+// public key. Implements auth.KeyGenerator. With an escrow key (see
+// WithEscrowKey) the private key is escrowed as well.
+//
+// password must be the user's login password, so that logins unlock the
+// key; a wrong one fails with errors.ErrAuthFailed. An unknown user fails
+// with errors.ErrUserNotFound, a user who already has a key pair with
+// errors.ErrKeyExists, and read-only mode with errors.ErrReadOnly.
+func (a *Agent) GenerateUserKeys(_ context.Context, username, password string) ([]byte, error) {
+	if err := a.writable(); err != nil {
+		return nil, err
+	}
+	entry, exists := a.lookup(username)
+	if !exists {
+		a.dummyVerify(password)
+		return nil, errors.ErrUserNotFound
+	}
+	if !a.verifyPassword(password, entry.hash) {
+		return nil, errors.ErrAuthFailed
+	}
+	pubPath := filepath.Join(a.keyDir, username+publicKeyExt)
+	privPath := filepath.Join(a.keyDir, username+privateKeyExt)
+	for _, path := range []string{pubPath, privPath} {
+		if _, err := a.files().Stat(path); err == nil {
+			return nil, fmt.Errorf("%w: %s", errors.ErrKeyExists, username)
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("stat key: %w", err)
+		}
+	}
+
+	gen := a.keyGen
+	if gen == nil {
+		gen = GenerateX25519
+	}
+	publicKey, privateKey, err := gen()
+	if err != nil {
+		return nil, err
+	}
+	defer clear(privateKey)
+	sealed, err := encryptPrivateKey(privateKey, password)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.files().MkdirAll(a.keyDir, 0o700); err != nil {
+		return nil, fmt.Errorf("create key directory: %w", err)
+	}
+	// A passphrase marker left from an earlier key would keep the new one
+	// locked at login.
+	if err := a.files().Remove(keyPassphrasePath(a.keyDir, username)); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("remove key passphrase marker: %w", err)
+	}
+	// The private key goes first: the public key is what marks the user as
+	// having encryption enabled (see HasEncryption).
+	if err := vfs.WriteFileAtomic(a.files(), privPath, sealed, 0o600); err != nil {
+		return nil, fmt.Errorf("write private key: %w", err)
+	}
+	if err := a.writeEscrow(username, publicKey, privateKey); err != nil {
+		return nil, err
+	}
+	if err := vfs.WriteFileAtomic(a.files(), pubPath, publicKey, 0o644); err != nil {
+		return nil, fmt.Errorf("write public key: %w", err)
+	}
+	return publicKey, nil
+}
@@ -0,0 +1,104 @@
+package passwd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+func TestGenerateUserKeys(t *testing.T) {
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	keyDir := filepath.Join(dir, "keys") // created on demand
+	if err := AddUser(passwdPath, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	agent, err := NewAgent(passwdPath, keyDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	ctx := context.Background()
+
+	if _, err := agent.GenerateUserKeys(ctx, "alice", "wrong"); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("wrong password: err = %v, want ErrAuthFailed", err)
+	}
+	if _, err := agent.GenerateUserKeys(ctx, "bob", "pw"); !errors.Is(err, autherrors.ErrUserNotFound) {
+		t.Errorf("unknown user: err = %v, want ErrUserNotFound", err)
+	}
+
+	pub, err := agent.GenerateUserKeys(ctx, "alice", "pw")
+	if err != nil {
+		t.Fatalf("GenerateUserKeys: %v", err)
+	}
+	if got, err := agent.GetPublicKey(ctx, "alice"); err != nil || !bytes.Equal(got, pub) {
+		t.Errorf("GetPublicKey = %x, %v; want %x", got, err, pub)
+	}
+	session, err := agent.Authenticate(ctx, "alice", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Clear()
+	if !session.KeysUnlocked() {
+		t.Fatal("login did not unlock the generated key")
+	}
+	derived, err := curve25519.X25519(session.PrivateKey, curve25519.Basepoint)
+	if err != nil || !bytes.Equal(derived, pub) {
+		t.Errorf("private key does not match public key")
+	}
+
+	if _, err := agent.GenerateUserKeys(ctx, "alice", "pw"); !errors.Is(err, autherrors.ErrKeyExists) {
+		t.Errorf("second GenerateUserKeys: err = %v, want ErrKeyExists", err)
+	}
+}
+
+func TestGenerateUserKeys_CustomGenerator(t *testing.T) {
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	if err := AddUser(passwdPath, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	agent, err := NewAgent(passwdPath, filepath.Join(dir, "keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	agent.WithKeyPairGenerator(func() ([]byte, []byte, error) {
+		return []byte("custom public"), []byte("custom private"), nil
+	})
+
+	ctx := context.Background()
+	if pub, err := agent.GenerateUserKeys(ctx, "alice", "pw"); err != nil || string(pub) != "custom public" {
+		t.Fatalf("GenerateUserKeys = %q, %v", pub, err)
+	}
+	session, err := agent.Authenticate(ctx, "alice", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(session.PrivateKey) != "custom private" {
+		t.Errorf("private key = %q", session.PrivateKey)
+	}
+}
+
+func TestGenerateUserKeys_ReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	if err := AddUser(passwdPath, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	agent, err := NewAgent(passwdPath, filepath.Join(dir, "keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	markReadOnly(t, passwdPath)
+	if _, err := agent.GenerateUserKeys(context.Background(), "alice", "pw"); !errors.Is(err, autherrors.ErrReadOnly) {
+		t.Errorf("read-only: err = %v, want ErrReadOnly", err)
+	}
+}
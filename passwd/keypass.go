@@ -0,0 +1,132 @@
+package passwd
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/vfs"
+)
+
+// keyPassphraseExt is the extension of the marker in the key directory
+// whose presence means the user's private key is sealed under a key
+// passphrase rather than their login password. The marker is empty.
+const keyPassphraseExt = ".keypass"
+
+// SetKeyPassphrase reseals username's private key under passphrase, so
+// that a password change or an administrator's reset no longer unlocks
+// the user's mail. current is whatever unlocks the key now: the login
+// password or the previous passphrase. From then on logins unlock the key
+// only when they supply the passphrase with auth.WithKeyPassphrase; logins
+// without it succeed with the key locked (see auth.AuthSession.KeysUnlocked).
+//
+// Users enrolled in TOTP must supply the passphrase at every login, since
+// their TOTP secret is sealed under the private key. App passwords created
+// earlier with the login password keep unlocking the key.
+//
+// A wrong current fails with errors.ErrKeyDecryptFailed, a user without a
+// key pair with errors.ErrEncryptionNotEnabled, and read-only mode with
+// errors.ErrReadOnly.
+func SetKeyPassphrase(keyDir, username, current, passphrase string) error {
+	if err := checkWritable(vfs.OS{}, keyDir); err != nil {
+		return err
+	}
+	if passphrase == "" {
+		return fmt.Errorf("key passphrase is empty")
+	}
+	return resealPrivateKey(vfs.OS{}, keyDir, username, current, passphrase, true)
+}
+
+// ClearKeyPassphrase reseals username's private key under their login
+// password, undoing SetKeyPassphrase. It fails like SetKeyPassphrase.
+func ClearKeyPassphrase(keyDir, username, passphrase, password string) error {
+	if err := checkWritable(vfs.OS{}, keyDir); err != nil {
+		return err
+	}
+	return resealPrivateKey(vfs.OS{}, keyDir, username, passphrase, password, false)
+}
+
+// HasKeyPassphrase reports whether username's private key is sealed under
+// a key passphrase (see SetKeyPassphrase).
+func HasKeyPassphrase(keyDir, username string) (bool, error) {
+	return hasKeyPassphrase(vfs.OS{}, keyDir, username)
+}
+
+// hasKeyPassphrase is HasKeyPassphrase on fsys.
+func hasKeyPassphrase(fsys vfs.FS, keyDir, username string) (bool, error) {
+	_, err := fsys.Stat(keyPassphrasePath(keyDir, username))
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, fmt.Errorf("stat key passphrase marker: %w", err)
+}
+
+// keyPassphrasePath returns the path of username's passphrase marker.
+func keyPassphrasePath(keyDir, username string) string {
+	return filepath.Join(keyDir, username+keyPassphraseExt)
+}
+
+// resealPrivateKey decrypts username's private key with oldSecret, replaces
+// it with one encrypted under newSecret and sets or removes the passphrase
+// marker. The marker is written before the key and removed after it: if
+// the key is not replaced after all, logins leave it locked rather than
+// fail.
+func resealPrivateKey(fsys vfs.WriteFS, keyDir, username, oldSecret, newSecret string, passphrase bool) error {
+	path := filepath.Join(keyDir, username+privateKeyExt)
+	encryptedKey, err := fsys.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s has no key pair", errors.ErrEncryptionNotEnabled, username)
+		}
+		return fmt.Errorf("read private key: %w", err)
+	}
+	privateKey, err := decryptPrivateKey(encryptedKey, oldSecret)
+	if err != nil {
+		return err
+	}
+	defer clear(privateKey)
+
+	sealed, err := encryptPrivateKey(privateKey, newSecret)
+	if err != nil {
+		return err
+	}
+	marker := keyPassphrasePath(keyDir, username)
+	if passphrase {
+		if err := fsys.WriteFile(marker, nil, 0o600); err != nil {
+			return fmt.Errorf("write key passphrase marker: %w", err)
+		}
+	}
+	if err := vfs.WriteFileAtomic(fsys, path, sealed, 0o600); err != nil {
+		return fmt.Errorf("write private key: %w", err)
+	}
+	if !passphrase {
+		if err := fsys.Remove(marker); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove key passphrase marker: %w", err)
+		}
+	}
+	return nil
+}
+
+// encryptPrivateKey encrypts a private key under secret in the format
+// decryptPrivateKey reads: salt (32B) || nonce (24B) || ciphertext.
+func encryptPrivateKey(privateKey []byte, secret string) ([]byte, error) {
+	out := make([]byte, saltSize+nonceSize, saltSize+nonceSize+len(privateKey)+secretbox.Overhead)
+	if _, err := rand.Read(out); err != nil {
+		return nil, fmt.Errorf("generate key salt: %w", err)
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], out[saltSize:])
+
+	var key [32]byte
+	copy(key[:], argon2.IDKey([]byte(secret), out[:saltSize], argon2Time, argon2Memory, argon2Threads, argon2KeyLen))
+	defer clear(key[:])
+	return secretbox.Seal(out, privateKey, &nonce, &key), nil
+}
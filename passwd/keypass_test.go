@@ -0,0 +1,150 @@
+package passwd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/totp"
+)
+
+// newKeyPassphraseAgent returns an agent whose user alice has a key pair
+// sealed under the passphrase "secret words", and alice's private key.
+func newKeyPassphraseAgent(t *testing.T) (*Agent, string, []byte) {
+	t.Helper()
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	keyDir := filepath.Join(dir, "keys")
+	if err := AddUser(passwdPath, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	writeKeyPair(t, keyDir, "alice", "pw")
+
+	agent, err := NewAgent(passwdPath, keyDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = agent.Close() })
+	session, err := agent.Authenticate(context.Background(), "alice", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv := bytes.Clone(session.PrivateKey)
+	session.Clear()
+
+	if err := SetKeyPassphrase(keyDir, "alice", "pw", "secret words"); err != nil {
+		t.Fatalf("SetKeyPassphrase: %v", err)
+	}
+	return agent, keyDir, priv
+}
+
+func TestKeyPassphrase_Authenticate(t *testing.T) {
+	agent, keyDir, priv := newKeyPassphraseAgent(t)
+	if ok, err := HasKeyPassphrase(keyDir, "alice"); err != nil || !ok {
+		t.Fatalf("HasKeyPassphrase = %v, %v", ok, err)
+	}
+
+	// The password alone logs in with the key locked.
+	session, err := agent.Authenticate(context.Background(), "alice", "pw")
+	if err != nil {
+		t.Fatalf("Authenticate without passphrase: %v", err)
+	}
+	if session.KeysUnlocked() || !session.EncryptionEnabled || session.PublicKey == nil {
+		t.Errorf("session = unlocked %v, encryption %v, public key %q",
+			session.KeysUnlocked(), session.EncryptionEnabled, session.PublicKey)
+	}
+
+	ctx := auth.WithKeyPassphrase(context.Background(), "secret words")
+	session, err = agent.Authenticate(ctx, "alice", "pw")
+	if err != nil {
+		t.Fatalf("Authenticate with passphrase: %v", err)
+	}
+	if !session.KeysUnlocked() || !bytes.Equal(session.PrivateKey, priv) {
+		t.Error("passphrase did not unlock the private key")
+	}
+
+	ctx = auth.WithKeyPassphrase(context.Background(), "wrong words")
+	if _, err := agent.Authenticate(ctx, "alice", "pw"); !errors.Is(err, autherrors.ErrKeyDecryptFailed) {
+		t.Errorf("wrong passphrase: err = %v, want ErrKeyDecryptFailed", err)
+	}
+
+	// The passphrase is no substitute for the login password.
+	ctx = auth.WithKeyPassphrase(context.Background(), "secret words")
+	if _, err := agent.Authenticate(ctx, "alice", "secret words"); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("passphrase as password: err = %v, want ErrAuthFailed", err)
+	}
+}
+
+func TestKeyPassphrase_TOTP(t *testing.T) {
+	agent, keyDir, _ := newKeyPassphraseAgent(t)
+	secret, err := EnableTOTP(keyDir, "alice", "secret words")
+	if err != nil {
+		t.Fatalf("EnableTOTP: %v", err)
+	}
+
+	// The secret is sealed under the key, so the passphrase is required.
+	if _, err := agent.Authenticate(context.Background(), "alice", "pw"); !errors.Is(err, autherrors.ErrKeyPassphraseRequired) {
+		t.Errorf("without passphrase: err = %v, want ErrKeyPassphraseRequired", err)
+	}
+	if ok, _ := agent.VerifyTOTP(context.Background(), "alice", totp.Code(secret, time.Now())); ok {
+		t.Error("VerifyTOTP succeeded without a staged login")
+	}
+
+	ctx := auth.WithKeyPassphrase(context.Background(), "secret words")
+	if _, err := agent.Authenticate(ctx, "alice", "pw"); err != nil {
+		t.Fatalf("Authenticate with passphrase: %v", err)
+	}
+	if ok, err := agent.VerifyTOTP(ctx, "alice", totp.Code(secret, time.Now())); err != nil || !ok {
+		t.Errorf("VerifyTOTP = %v, %v", ok, err)
+	}
+}
+
+func TestKeyPassphrase_Clear(t *testing.T) {
+	agent, keyDir, priv := newKeyPassphraseAgent(t)
+
+	if err := ClearKeyPassphrase(keyDir, "alice", "pw", "pw"); !errors.Is(err, autherrors.ErrKeyDecryptFailed) {
+		t.Errorf("ClearKeyPassphrase(wrong passphrase) = %v", err)
+	}
+	if err := ClearKeyPassphrase(keyDir, "alice", "secret words", "pw"); err != nil {
+		t.Fatalf("ClearKeyPassphrase: %v", err)
+	}
+	if ok, _ := HasKeyPassphrase(keyDir, "alice"); ok {
+		t.Error("marker still present after ClearKeyPassphrase")
+	}
+	session, err := agent.Authenticate(context.Background(), "alice", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(session.PrivateKey, priv) {
+		t.Error("password does not unlock the key after ClearKeyPassphrase")
+	}
+}
+
+func TestSetKeyPassphrase_Errors(t *testing.T) {
+	dir := t.TempDir()
+	keyDir := filepath.Join(dir, "keys")
+	writeKeyPair(t, keyDir, "alice", "pw")
+
+	if err := SetKeyPassphrase(keyDir, "alice", "wrong", "secret words"); !errors.Is(err, autherrors.ErrKeyDecryptFailed) {
+		t.Errorf("wrong current: err = %v", err)
+	}
+	if ok, _ := HasKeyPassphrase(keyDir, "alice"); ok {
+		t.Error("failed SetKeyPassphrase left a marker")
+	}
+	if err := SetKeyPassphrase(keyDir, "bob", "pw", "secret words"); !errors.Is(err, autherrors.ErrEncryptionNotEnabled) {
+		t.Errorf("no key pair: err = %v", err)
+	}
+	if err := SetKeyPassphrase(keyDir, "alice", "pw", ""); err == nil {
+		t.Error("empty passphrase accepted")
+	}
+
+	markReadOnly(t, keyDir)
+	if err := SetKeyPassphrase(keyDir, "alice", "pw", "secret words"); !errors.Is(err, autherrors.ErrReadOnly) {
+		t.Errorf("read-only: err = %v", err)
+	}
+}
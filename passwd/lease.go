@@ -0,0 +1,97 @@
+package passwd
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/infodancer/auth/lease"
+	"github.com/infodancer/auth/vfs"
+)
+
+// WithLeaseManager makes the agent hold m's lease on its passwd path while
+// it writes its passwd files, as it does to upgrade hashes at login or to
+// reset a password from escrow, for hosts sharing one domains tree. A
+// write fails with errors.ErrLeaseHeld while another host holds the lease,
+// and with errors.ErrLeaseLost if the lease is lost before the change is
+// committed; journal entries record the fencing token. Without it, the
+// default, only the local lock is taken.
+//
+// The package-level management functions, such as AddUser, take only the
+// local lock: run them on one host, the primary (see ReadOnlyMarker).
+func WithLeaseManager(m *lease.Manager) Option {
+	return func(a *Agent) { a.leases = m }
+}
+
+// leasedFS is an agent's filesystem as handed to the mutation helpers,
+// carrying its lease manager to lockPasswd.
+type leasedFS struct {
+	vfs.WriteFS
+	leases *lease.Manager
+}
+
+// Lock implements vfs.Locker with the underlying filesystem's lock.
+func (f leasedFS) Lock(name string) (func(), error) {
+	return vfs.Lock(f.WriteFS, name)
+}
+
+// writeFiles returns the FS the agent writes its passwd files through:
+// files, carrying the agent's lease manager if it has one.
+func (a *Agent) writeFiles() vfs.WriteFS {
+	if a.leases == nil {
+		return a.files()
+	}
+	return leasedFS{WriteFS: a.files(), leases: a.leases}
+}
+
+// passwdLock is held across a passwd mutation: the filesystem's lock on
+// the passwd path (see vfs.Lock), which serializes writers on this host,
+// logins upgrading hashes among them, and the lease when leasing is on,
+// which serializes hosts sharing the domains tree.
+type passwdLock struct {
+	unlock func()
+	lease  *lease.Lease // nil when leasing is disabled
+}
+
+// lockPasswd takes the write lock on passwdPath, and the lease when fsys
+// carries a lease manager (see writeFiles). Mutations read the files they
+// rewrite only once they hold it, so none undoes another's change.
+func lockPasswd(fsys vfs.FS, passwdPath string) (*passwdLock, error) {
+	passwdPath = filepath.Clean(passwdPath)
+	unlock, err := vfs.Lock(fsys, passwdPath)
+	if err != nil {
+		return nil, fmt.Errorf("lock passwd file: %w", err)
+	}
+	var l *lease.Lease
+	if lf, ok := fsys.(leasedFS); ok {
+		if l, err = lf.leases.Acquire(passwdPath); err != nil {
+			unlock()
+			return nil, err
+		}
+	}
+	return &passwdLock{unlock: unlock, lease: l}, nil
+}
+
+// check confirms the lease is still held just before a write is committed.
+func (l *passwdLock) check() error {
+	if l.lease == nil {
+		return nil
+	}
+	return l.lease.Check()
+}
+
+// release gives the lock up. Lease errors are ignored since the lease
+// expires anyway.
+func (l *passwdLock) release() {
+	if l.lease != nil {
+		_ = l.lease.Release()
+	}
+	l.unlock()
+}
+
+// token returns the lease's fencing token, or 0 when leasing is disabled.
+func (l *passwdLock) token() uint64 {
+	if l.lease == nil {
+		return 0
+	}
+	return l.lease.Token()
+}
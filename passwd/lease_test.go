@@ -0,0 +1,65 @@
+package passwd
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/infodancer/auth/lease"
+	"github.com/infodancer/auth/vfs"
+)
+
+func TestAgent_WithLeaseManager(t *testing.T) {
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	if err := AddUser(passwdPath, "alice", "pw"); err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	agent, err := NewAgent(passwdPath, t.TempDir(),
+		WithLeaseManager(lease.NewManager(vfs.OS{}, "host-a", time.Minute).WithSettle(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	agent.WithArgon2Params(cheapParams)
+
+	storedHash := func() string {
+		users, err := ListUsers(passwdPath)
+		if err != nil || len(users) != 1 {
+			t.Fatalf("ListUsers = %v, %v", users, err)
+		}
+		return users[0].Hash
+	}
+	original := storedHash()
+
+	// While another host holds the lease, logins succeed but leave the
+	// passwd file alone.
+	other, err := lease.NewManager(vfs.OS{}, "host-b", time.Minute).WithSettle(0).Acquire(passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := agent.Authenticate(context.Background(), "alice", "pw"); err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if storedHash() != original {
+		t.Error("hash upgraded while another host held the lease")
+	}
+	if err := other.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := agent.Authenticate(context.Background(), "alice", "pw"); err != nil {
+		t.Fatalf("Authenticate after release: %v", err)
+	}
+	if storedHash() == original {
+		t.Fatal("hash not upgraded after release")
+	}
+	entries, err := ReadJournal(passwdPath)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("ReadJournal = %+v, %v", entries, err)
+	}
+	// AddUser took no lease; host-b's acquisition consumed token 1.
+	if entries[0].Token != 0 || entries[1].Token != 2 {
+		t.Errorf("journal tokens = %d, %d; want 0, 2", entries[0].Token, entries[1].Token)
+	}
+}
@@ -0,0 +1,252 @@
+package passwd
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/atrest"
+	"github.com/infodancer/auth/diagnostic"
+	"github.com/infodancer/auth/vfs"
+)
+
+// Lint reports the problems in the passwd file at passwdPath (every shard
+// file in sharded mode) and in its app password file: entries the agent
+// skips or shadows, hashes no password matches, and file permissions that
+// expose hashes. The error is for files that cannot be read.
+func Lint(passwdPath string) ([]diagnostic.Problem, error) {
+	l := &linter{fsys: vfs.OS{}, users: make(map[string]string), uids: make(map[uint32]string)}
+	files, err := passwdFiles(l.fsys, passwdPath)
+	if err != nil {
+		return nil, err
+	}
+	sharded := isSharded(l.fsys, passwdPath)
+	for _, path := range files {
+		if err := l.lintFile(path, sharded); err != nil {
+			return nil, err
+		}
+	}
+	if err := l.lintAppPasswords(appPasswordsPath(passwdPath)); err != nil {
+		return nil, err
+	}
+	l.lintCDB(passwdPath)
+	return l.problems, nil
+}
+
+// lintCDB reports a compiled passwd file that no longer matches the text
+// file: compiled agents ignore it and load the text file instead.
+func (l *linter) lintCDB(passwdPath string) {
+	c, err := openCDB(l.fsys, passwdPath)
+	if os.IsNotExist(err) {
+		return
+	}
+	path := passwdPath + CDBSuffix
+	if err != nil {
+		l.add(diagnostic.Error, "passwd.cdb-unreadable", path, 0, err.Error(), "userctl compile <domain>")
+		return
+	}
+	defer func() { _ = c.close() }()
+	if stamp, err := sourceStamp(l.fsys, passwdPath); err == nil && stamp != c.stamp {
+		l.add(diagnostic.Warning, "passwd.cdb-stale", path, 0,
+			"passwd changed since it was compiled; compiled agents load the text file instead",
+			"userctl compile <domain>")
+	}
+}
+
+// linter accumulates problems across the files of one passwd path.
+type linter struct {
+	fsys     vfs.FS
+	problems []diagnostic.Problem
+	users    map[string]string // username → "file:line" of its entry
+	uids     map[uint32]string // uid → username
+}
+
+func (l *linter) add(sev diagnostic.Severity, code, file string, line int, msg, fix string) {
+	l.problems = append(l.problems, diagnostic.Problem{
+		Severity: sev, Code: code, File: file, Line: line, Message: msg, Fix: fix,
+	})
+}
+
+// lintFile checks one passwd or shard file. A missing file has no users,
+// which is worth a note but not a problem.
+func (l *linter) lintFile(path string, sharded bool) error {
+	f, err := atrest.OpenFS(l.fsys, path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			l.add(diagnostic.Info, "passwd.missing", path, 0, "passwd file does not exist; the domain has no users", "")
+			return nil
+		}
+		return fmt.Errorf("open passwd file: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	if fi, err := l.fsys.Stat(path); err == nil && fi.Mode().Perm()&0o027 != 0 {
+		l.add(diagnostic.Warning, "passwd.permissions", path, 0,
+			fmt.Sprintf("mode %04o lets other users read password hashes", fi.Mode().Perm()),
+			"chmod 600 "+path)
+	}
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entry, ok := parseEntry(line)
+		if !ok || entry.username == "" {
+			l.add(diagnostic.Error, "passwd.malformed", path, n,
+				"entry is not username:hash[:mailbox[:uid[:flags[:changed[:gid:quota[:name[:attrs]]]]]]] and is ignored", "")
+			continue
+		}
+		l.lintEntry(path, n, line, entry, sharded)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read passwd file: %w", err)
+	}
+	return nil
+}
+
+// lintEntry checks one parsed passwd entry.
+func (l *linter) lintEntry(path string, n int, line string, entry *userEntry, sharded bool) {
+	name := entry.username
+	if first, dup := l.users[name]; dup {
+		l.add(diagnostic.Warning, "passwd.duplicate-user", path, n,
+			fmt.Sprintf("%s is also defined at %s; this entry replaces it", name, first),
+			"delete one of the entries")
+	}
+	l.users[name] = fmt.Sprintf("%s:%d", path, n)
+
+	if sharded && filepath.Base(path) != ShardName(name) {
+		l.add(diagnostic.Error, "passwd.wrong-shard", path, n,
+			fmt.Sprintf("%s belongs in shard %s; AddUser and DeleteUser will not find it", name, ShardName(name)),
+			"move the entry to "+filepath.Join(filepath.Dir(path), ShardName(name)))
+	}
+
+	if prefix, _, ok := hashScheme(entry.hash); !ok {
+		l.add(diagnostic.Error, "passwd.bad-hash", path, n,
+			fmt.Sprintf("%s's hash is not of a supported scheme; no password will match", name),
+			"reset the password with userctl")
+	} else if h, ok := parseArgon2Hash(entry.hash); ok && h.keyid != "" {
+		if _, loaded := installedPeppers().secret(h.keyid); !loaded {
+			l.add(diagnostic.Warning, "passwd.unknown-pepper", path, n,
+				fmt.Sprintf("%s's hash uses pepper %q, which is not loaded; no password will match without it", name, h.keyid),
+				"load the pepper file (see "+PepperEnv+")")
+		}
+	} else if !ok {
+		l.add(diagnostic.Info, "passwd.legacy-hash", path, n,
+			fmt.Sprintf("%s's hash is a %s hash, not argon2id", name, prefix),
+			"set upgrade_hashes = \"true\" to upgrade it at the next login")
+	}
+
+	for _, f := range entry.flags {
+		if strings.HasPrefix(f, FlagDeleted+"=") {
+			if _, _, ok := parseDeletion(f); !ok {
+				l.add(diagnostic.Warning, "passwd.bad-deleted", path, n,
+					fmt.Sprintf("%s's deletion mark %q is not two Unix times, deletion/purge; the next reap purges the user", name, f),
+					"restore the user with userctl restore, or fix the times")
+			}
+			continue
+		}
+		if !slices.Contains(knownFlags, f) {
+			l.add(diagnostic.Warning, "passwd.unknown-flag", path, n,
+				fmt.Sprintf("%s has unknown account flag %q, which is ignored", name, f),
+				"set the flags with userctl flags")
+		}
+	}
+
+	parts := strings.SplitN(line, ":", v2Fields)
+	l.lintProfile(path, n, name, parts)
+	if len(parts) >= 6 {
+		if _, ok := parseChanged(parts[5]); !ok {
+			l.add(diagnostic.Warning, "passwd.bad-changed", path, n,
+				fmt.Sprintf("%s's password change time %q is not a Unix time; the password never expires", name, parts[5]),
+				"change the password with passwd.ChangePassword")
+		}
+	}
+	if len(parts) < 4 || parts[3] == "" {
+		return
+	}
+	uid, err := strconv.ParseUint(parts[3], 10, 32)
+	if err != nil {
+		l.add(diagnostic.Warning, "passwd.bad-uid", path, n,
+			fmt.Sprintf("%s's uid %q is not a number and is ignored", name, parts[3]), "")
+		return
+	}
+	if other, dup := l.uids[uint32(uid)]; dup && other != name && uid != 0 {
+		l.add(diagnostic.Warning, "passwd.duplicate-uid", path, n,
+			fmt.Sprintf("%s has the same uid %d as %s", name, uid, other), "")
+	}
+	l.uids[uint32(uid)] = name
+}
+
+// lintProfile checks the v2 fields of an entry split into parts.
+func (l *linter) lintProfile(path string, n int, name string, parts []string) {
+	if len(parts) <= v1Fields {
+		return
+	}
+	fields := slices.Concat(parts[v1Fields:], []string{"", "", ""})
+	if _, err := strconv.ParseUint(fields[0], 10, 32); err != nil {
+		l.add(diagnostic.Warning, "passwd.bad-gid", path, n,
+			fmt.Sprintf("%s's gid %q is not a number and is ignored", name, fields[0]), "")
+	}
+	if _, err := strconv.ParseUint(fields[1], 10, 64); err != nil {
+		l.add(diagnostic.Warning, "passwd.bad-quota", path, n,
+			fmt.Sprintf("%s's quota %q is not a number of bytes; the user has no quota", name, fields[1]), "")
+	}
+	if _, err := url.PathUnescape(fields[2]); err != nil {
+		l.add(diagnostic.Warning, "passwd.bad-profile", path, n,
+			fmt.Sprintf("%s's display name is not validly escaped and is ignored", name),
+			"set the profile with passwd.SetProfile")
+	}
+	attrs, ok := parseAttributes(fields[3])
+	if !ok {
+		l.add(diagnostic.Warning, "passwd.bad-profile", path, n,
+			fmt.Sprintf("%s has malformed attributes, which are ignored", name),
+			"set the profile with passwd.SetProfile")
+	}
+	if _, err := auth.ParseServiceSet(attrs[AttrServices]); err != nil {
+		l.add(diagnostic.Warning, "passwd.bad-services", path, n,
+			fmt.Sprintf("%s's services: %v; the user may not log in to it", name, err),
+			"set the services with passwd.SetServices")
+	}
+}
+
+// lintAppPasswords checks the app password file. It runs after the passwd
+// files so that app passwords of unknown users can be found.
+func (l *linter) lintAppPasswords(path string) error {
+	data, err := l.fsys.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("read app passwords: %w", err)
+	}
+	if fi, err := l.fsys.Stat(path); err == nil && fi.Mode().Perm()&0o077 != 0 {
+		l.add(diagnostic.Warning, "passwd.permissions", path, 0,
+			fmt.Sprintf("mode %04o lets other users read app password hashes", fi.Mode().Perm()),
+			"chmod 600 "+path)
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		e, ok := parseAppPassword(line)
+		if !ok {
+			l.add(diagnostic.Error, "passwd.app-password-malformed", path, i+1,
+				"app password entry is malformed and is ignored", "")
+			continue
+		}
+		if _, exists := l.users[e.username]; !exists {
+			l.add(diagnostic.Warning, "passwd.app-password-orphan", path, i+1,
+				fmt.Sprintf("app password %s belongs to %s, who has no passwd entry", e.info.ID, e.username),
+				"delete the line")
+		}
+	}
+	return nil
+}
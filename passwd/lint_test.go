@@ -0,0 +1,103 @@
+package passwd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/infodancer/auth/diagnostic"
+)
+
+// lintCodes returns "line:code" for each problem.
+func lintCodes(problems []diagnostic.Problem) []string {
+	out := make([]string, len(problems))
+	for i, p := range problems {
+		out[i] = fmt.Sprintf("%d:%s", p.Line, p.Code)
+	}
+	return out
+}
+
+func TestLint(t *testing.T) {
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	hash, err := HashPassword("pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := fmt.Sprintf(`# users
+alice:%[1]s:alice:1001
+justaname
+bob:{SHA}abc:bob
+alice:%[1]s:alice2:1002
+carol:%[1]s:carol:x
+dave:%[1]s:dave:1001
+`, hash)
+	if err := os.WriteFile(passwdPath, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	apps := "alice:01:0:" + fmt.Sprintf("%064x", 0) + "::Phone\nzed:02:0:" + fmt.Sprintf("%064x", 0) + "::Phone\nbroken\n"
+	if err := os.WriteFile(appPasswordsPath(passwdPath), []byte(apps), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := Lint(passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"0:passwd.permissions",
+		"3:passwd.malformed",
+		"4:passwd.bad-hash",
+		"5:passwd.duplicate-user",
+		"6:passwd.bad-uid",
+		"7:passwd.duplicate-uid",
+		"2:passwd.app-password-orphan",
+		"3:passwd.app-password-malformed",
+	}
+	got := lintCodes(problems)
+	if len(got) != len(want) {
+		t.Fatalf("problems = %v\nwant %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("problem %d = %s, want %s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestLint_Clean(t *testing.T) {
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	if err := AddUser(passwdPath, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(passwdPath, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := Lint(passwdPath)
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Lint = %v, %v", problems, err)
+	}
+}
+
+func TestLint_WrongShard(t *testing.T) {
+	shardDir := filepath.Join(t.TempDir(), "passwd")
+	if err := os.Mkdir(shardDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	hash, _ := HashPassword("pw")
+	wrong := "00"
+	if ShardName("alice") == wrong {
+		wrong = "01"
+	}
+	if err := os.WriteFile(filepath.Join(shardDir, wrong), []byte("alice:"+hash+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := Lint(shardDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lintCodes(problems); len(got) != 1 || got[0] != "1:passwd.wrong-shard" {
+		t.Errorf("problems = %v", got)
+	}
+}
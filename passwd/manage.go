@@ -2,44 +2,117 @@ package passwd
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"os"
+	"slices"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/argon2"
+
+	"github.com/infodancer/auth/atrest"
+	"github.com/infodancer/auth/vfs"
 )
 
-// UserInfo holds the display fields for a user entry.
+// UserInfo holds the fields of a user entry.
 type UserInfo struct {
 	Username string
+	Hash     string // PHC-format password hash, see HashPassword
 	Mailbox  string
-	Uid      uint32 // 0 = not yet assigned (pre-migration entry)
+	Uid      uint32   // 0 = not yet assigned (pre-migration entry)
+	Flags    []string // account flags, see SetFlags
+
+	// Deleted is when the user was marked deleted (see FlagDeleted), and
+	// PurgeAfter when their grace period ends; both zero if the user is
+	// not.
+	Deleted    time.Time
+	PurgeAfter time.Time
+
+	// PasswordChanged is when the password was last set (see
+	// ChangePassword); zero if the entry does not record it.
+	PasswordChanged time.Time
+
+	// Profile holds the fields of a v2 entry (see SetProfile); it is zero
+	// for a v1 entry.
+	Profile
 }
 
 // HashPassword generates an argon2id hash of password using canonical parameters.
 // The returned string is the full PHC-format hash ready to embed in a passwd entry.
+// If peppers are installed (see SetPeppers), the current one is mixed in.
 func HashPassword(password string) (string, error) {
+	return hashPassword(password, DefaultArgon2Params, installedPeppers())
+}
+
+// HashPasswordWithParams is HashPassword with the given argon2id
+// parameters (see Argon2ParamsFromOptions).
+func HashPasswordWithParams(password string, p Argon2Params) (string, error) {
+	if err := p.validate(); err != nil {
+		return "", err
+	}
+	return hashPassword(password, p, installedPeppers())
+}
+
+// hashPassword hashes password with valid parameters p, mixing in the
+// current pepper of pp if any.
+func hashPassword(password string, p Argon2Params, pp *Peppers) (string, error) {
 	salt := make([]byte, saltSize)
 	if _, err := rand.Read(salt); err != nil {
 		return "", fmt.Errorf("generate salt: %w", err)
 	}
 
-	hash := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	input, params := []byte(password), fmt.Sprintf("m=%d,t=%d,p=%d", p.Memory, p.Time, p.Threads)
+	if id, secret := pp.current(); secret != nil {
+		input, params = pepperPassword(password, secret), params+",keyid="+id
+	}
+	hash := argon2.IDKey(input, salt, p.Time, p.Memory, p.Threads, argon2KeyLen)
 
 	encodedSalt := base64.RawStdEncoding.EncodeToString(salt)
 	encodedHash := base64.RawStdEncoding.EncodeToString(hash)
 
-	return fmt.Sprintf("$argon2id$v=19$m=%d,t=%d,p=%d$%s$%s",
-		argon2Memory, argon2Time, argon2Threads, encodedSalt, encodedHash), nil
+	return fmt.Sprintf("$argon2id$v=19$%s$%s$%s", params, encodedSalt, encodedHash), nil
 }
 
-// AddUser appends a new user entry to the passwd file at passwdPath.
-// Returns an error if the username already exists.
+// AddUser appends a new user entry to the passwd file at passwdPath,
+// recording the current time as when the password was set (see
+// WithPasswordMaxAge). In sharded mode the entry is appended to the user's
+// shard file.
+// The change is recorded in the mutation journal (see Undo).
+// Returns an error if the username already exists, and errors.ErrReadOnly
+// in read-only mode (see ReadOnlyMarker).
 func AddUser(passwdPath, username, password string) error {
-	users, err := parsePasswd(passwdPath)
+	return addUser(vfs.OS{}, passwdPath, username, true, func() (string, error) { return HashPassword(password) })
+}
+
+// AddUserWithHash is AddUser for an already hashed password, such as one
+// exported from another system or a hash of a secret nobody knows. hash
+// must be of a registered scheme (see RegisterHashScheme). The entry does
+// not record when the password was set, so it never expires.
+func AddUserWithHash(passwdPath, username, hash string) error {
+	if _, _, ok := hashScheme(hash); !ok || strings.ContainsAny(hash, ":\n") {
+		return fmt.Errorf("hash for %q is not of a supported scheme", username)
+	}
+	return addUser(vfs.OS{}, passwdPath, username, false, func() (string, error) { return hash, nil })
+}
+
+// addUser appends username's entry with the hash from hash, which is only
+// called once the user is known not to exist. stamp records the current
+// time as when the password was set.
+func addUser(fsys vfs.WriteFS, passwdPath, username string, stamp bool, hash func() (string, error)) error {
+	if err := checkWritable(fsys, passwdPath); err != nil {
+		return err
+	}
+	l, err := lockPasswd(fsys, passwdPath)
+	if err != nil {
+		return err
+	}
+	defer l.release()
+	path := userFile(fsys, passwdPath, username)
+	users, err := parsePasswd(fsys, path)
 	if err != nil {
 		return err
 	}
@@ -50,43 +123,132 @@ func AddUser(passwdPath, username, password string) error {
 		}
 	}
 
-	hash, err := HashPassword(password)
+	h, err := hash()
 	if err != nil {
 		return err
 	}
 
-	f, err := os.OpenFile(passwdPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o640)
+	line := fmt.Sprintf("%s:%s:%s", username, h, username)
+	if stamp {
+		line += ":::" + formatChanged(time.Now())
+	}
+	if err := l.check(); err != nil {
+		return err
+	}
+	if err := journal(fsys, passwdPath, JournalEntry{Op: OpAdd, Username: username, After: line, Token: l.token()}); err != nil {
+		return err
+	}
+
+	// A sealed file cannot be appended to; rewrite it instead.
+	sealed, err := atrest.IsSealedFileFS(fsys, path)
 	if err != nil {
 		return fmt.Errorf("open passwd file: %w", err)
 	}
-	defer func() { _ = f.Close() }()
+	if sealed {
+		lines, _, err := filterPasswd(fsys, path, "")
+		if err != nil {
+			return err
+		}
+		return writePasswd(fsys, path, append(lines, line))
+	}
 
-	_, err = fmt.Fprintf(f, "%s:%s:%s\n", username, hash, username)
-	return err
+	if err := fsys.AppendFile(path, []byte(line+"\n"), 0o640); err != nil {
+		return fmt.Errorf("write passwd file: %w", err)
+	}
+	return nil
 }
 
-// DeleteUser removes the named user from the passwd file.
-// Returns an error if the user does not exist.
+// DeleteUser removes the named user from the passwd file at once, whether
+// or not they are marked deleted (see SoftDeleteUser).
+// In sharded mode only the user's shard file is rewritten.
+// The user's app passwords are removed too. The change is recorded in the
+// mutation journal (see Undo); undoing it does not restore app passwords.
+// Returns an error if the user does not exist, and errors.ErrReadOnly in
+// read-only mode.
 func DeleteUser(passwdPath, username string) error {
-	lines, found, err := filterPasswd(passwdPath, username)
-	if err != nil {
+	if err := checkWritable(vfs.OS{}, passwdPath); err != nil {
 		return err
 	}
-	if !found {
-		return fmt.Errorf("user %q not found", username)
+	_, err := removeUser(vfs.OS{}, passwdPath, username, time.Time{})
+	return err
+}
+
+// removeUser removes username's entry and app passwords under the lock. A
+// non-zero purgeBy removes the entry only if it exists, is marked deleted,
+// and its grace period ended by then, reporting false otherwise.
+func removeUser(fsys vfs.WriteFS, passwdPath, username string, purgeBy time.Time) (bool, error) {
+	l, err := lockPasswd(fsys, passwdPath)
+	if err != nil {
+		return false, err
 	}
-	return writePasswd(passwdPath, lines)
+	defer l.release()
+	path := userFile(fsys, passwdPath, username)
+	lines, removed, err := filterPasswd(fsys, path, username)
+	if err != nil {
+		return false, err
+	}
+	if len(removed) == 0 {
+		if !purgeBy.IsZero() {
+			return false, nil
+		}
+		return false, fmt.Errorf("user %q not found", username)
+	}
+	if !purgeBy.IsZero() {
+		for _, line := range removed {
+			entry, ok := parseEntry(line)
+			if !ok {
+				return false, nil
+			}
+			if _, purge, ok := deletion(entry.flags); !ok || purge.After(purgeBy) {
+				return false, nil
+			}
+		}
+	}
+	if err := l.check(); err != nil {
+		return false, err
+	}
+	if err := journal(fsys, passwdPath, JournalEntry{
+		Op:       OpDelete,
+		Username: username,
+		Before:   strings.Join(removed, "\n"),
+		Token:    l.token(),
+	}); err != nil {
+		return false, err
+	}
+	if err := writePasswd(fsys, path, lines); err != nil {
+		return false, err
+	}
+	// A user added later under the same name must not inherit these.
+	for _, f := range []taggedFile{scramStore, reversibleStore} {
+		if err := f.remove(fsys, passwdPath, username); err != nil {
+			return true, err
+		}
+	}
+	return true, removeAppPasswords(fsys, passwdPath, username)
 }
 
-// ListUsers returns all user entries from the passwd file.
+// ListUsers returns all user entries from the passwd file, or from every
+// shard file in sharded mode.
 func ListUsers(passwdPath string) ([]UserInfo, error) {
-	return parsePasswd(passwdPath)
+	files, err := passwdFiles(vfs.OS{}, passwdPath)
+	if err != nil {
+		return nil, err
+	}
+	var users []UserInfo
+	for _, path := range files {
+		u, err := parsePasswd(vfs.OS{}, path)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u...)
+	}
+	return users, nil
 }
 
 // LookupUID returns the uid for the named user, or an error if not found.
 // A uid of 0 means the field is absent or not yet assigned.
 func LookupUID(passwdPath, username string) (uint32, error) {
-	users, err := parsePasswd(passwdPath)
+	users, err := parsePasswd(vfs.OS{}, userFile(vfs.OS{}, passwdPath, username))
 	if err != nil {
 		return 0, err
 	}
@@ -100,8 +262,8 @@ func LookupUID(passwdPath, username string) (uint32, error) {
 
 // parsePasswd reads the passwd file and returns all user entries.
 // Returns an empty slice if the file does not exist.
-func parsePasswd(passwdPath string) ([]UserInfo, error) {
-	f, err := os.Open(passwdPath)
+func parsePasswd(fsys vfs.FS, passwdPath string) ([]UserInfo, error) {
+	f, err := atrest.OpenFS(fsys, passwdPath)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			return nil, nil
@@ -113,37 +275,38 @@ func parsePasswd(passwdPath string) ([]UserInfo, error) {
 	var users []UserInfo
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
-		parts := strings.SplitN(line, ":", 4)
-		if len(parts) < 2 {
+		entry, ok := parseEntry(scanner.Text())
+		if !ok {
 			continue
 		}
-		mailbox := parts[0]
-		if len(parts) >= 3 {
-			mailbox = parts[2]
+		flags := entry.flags
+		deleted, purge, _ := deletion(flags)
+		if marker, ok := deletionMarker(flags); ok {
+			flags = slices.DeleteFunc(flags, func(f string) bool { return f == marker })
 		}
-		var uid uint32
-		if len(parts) >= 4 && parts[3] != "" {
-			var n uint64
-			if _, err := fmt.Sscanf(parts[3], "%d", &n); err == nil {
-				uid = uint32(n)
-			}
-		}
-		users = append(users, UserInfo{Username: parts[0], Mailbox: mailbox, Uid: uid})
+		users = append(users, UserInfo{
+			Username:        entry.username,
+			Hash:            entry.hash,
+			Mailbox:         entry.mailbox,
+			Uid:             entry.uid,
+			Flags:           flags,
+			Deleted:         deleted,
+			PurgeAfter:      purge,
+			PasswordChanged: entry.changed,
+			Profile:         entry.profile,
+		})
 	}
 
 	return users, scanner.Err()
 }
 
 // filterPasswd reads all lines from the passwd file, returning them with the
-// named user removed. found reports whether the user was present.
-func filterPasswd(passwdPath, username string) (lines []string, found bool, err error) {
-	f, err := os.Open(passwdPath)
+// named user removed. removed holds the user's entry lines (trimmed), empty
+// if the user was not present.
+func filterPasswd(fsys vfs.FS, passwdPath, username string) (lines, removed []string, err error) {
+	f, err := atrest.OpenFS(fsys, passwdPath)
 	if err != nil {
-		return nil, false, fmt.Errorf("open passwd file: %w", err)
+		return nil, nil, fmt.Errorf("open passwd file: %w", err)
 	}
 	defer func() { _ = f.Close() }()
 
@@ -156,43 +319,36 @@ func filterPasswd(passwdPath, username string) (lines []string, found bool, err
 			continue
 		}
 		parts := strings.SplitN(trimmed, ":", 3)
-		if len(parts) >= 1 && parts[0] == username {
-			found = true
+		if username != "" && parts[0] == username {
+			removed = append(removed, trimmed)
 			continue
 		}
 		lines = append(lines, line)
 	}
 
-	return lines, found, scanner.Err()
+	return lines, removed, scanner.Err()
 }
 
 // writePasswd atomically replaces the passwd file with the given lines.
-func writePasswd(passwdPath string, lines []string) error {
-	tmpPath := passwdPath + ".tmp"
-	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o640)
+// A sealed file (see package atrest) stays sealed.
+func writePasswd(fsys vfs.WriteFS, passwdPath string, lines []string) error {
+	sealed, err := atrest.IsSealedFileFS(fsys, passwdPath)
 	if err != nil {
-		return fmt.Errorf("create temp passwd file: %w", err)
+		return fmt.Errorf("open passwd file: %w", err)
 	}
+	return writePasswdFile(fsys, passwdPath, lines, sealed)
+}
 
-	w := bufio.NewWriter(f)
+// writePasswdFile atomically replaces passwdPath with lines, sealing the
+// content with the host key when seal is true.
+func writePasswdFile(fsys vfs.WriteFS, passwdPath string, lines []string, seal bool) error {
+	var buf bytes.Buffer
 	for _, line := range lines {
-		if _, err := fmt.Fprintln(w, line); err != nil {
-			_ = f.Close()
-			_ = os.Remove(tmpPath)
-			return err
-		}
-	}
-
-	if err := w.Flush(); err != nil {
-		_ = f.Close()
-		_ = os.Remove(tmpPath)
-		return err
+		buf.WriteString(line)
+		buf.WriteByte('\n')
 	}
-
-	if err := f.Close(); err != nil {
-		_ = os.Remove(tmpPath)
-		return err
+	if err := atrest.WriteFileFS(fsys, passwdPath, buf.Bytes(), 0o640, seal); err != nil {
+		return fmt.Errorf("write passwd file: %w", err)
 	}
-
-	return os.Rename(tmpPath, passwdPath)
+	return nil
 }
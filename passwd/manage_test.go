@@ -1,9 +1,12 @@
 package passwd
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"testing"
+
+	"github.com/infodancer/auth/atrest"
 )
 
 func TestHashPassword(t *testing.T) {
@@ -220,3 +223,85 @@ func TestNewAgent_MissingPasswdFile(t *testing.T) {
 		t.Error("expected no users in empty agent")
 	}
 }
+
+func TestAddUser_SealedPasswdStaysSealed(t *testing.T) {
+	k, err := atrest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	atrest.SetKey(k)
+	t.Cleanup(func() { atrest.SetKey(nil) })
+
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	if err := AddUser(passwdPath, "alice", "pw1"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := atrest.WriteFile(passwdPath, data, 0o640, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := AddUser(passwdPath, "bob", "pw2"); err != nil {
+		t.Fatal(err)
+	}
+	if sealed, err := atrest.IsSealedFile(passwdPath); err != nil || !sealed {
+		t.Fatalf("passwd no longer sealed after AddUser: %v, %v", sealed, err)
+	}
+
+	for _, newAgent := range []func(string, string, ...Option) (*Agent, error){NewAgent, NewMappedAgent} {
+		agent, err := newAgent(passwdPath, filepath.Join(dir, "keys"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for user, pw := range map[string]string{"alice": "pw1", "bob": "pw2"} {
+			session, err := agent.Authenticate(context.Background(), user, pw)
+			if err != nil {
+				t.Errorf("Authenticate(%s): %v", user, err)
+				continue
+			}
+			session.Clear()
+		}
+		_ = agent.Close()
+	}
+
+	if err := DeleteUser(passwdPath, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	users, err := ListUsers(passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Username != "bob" {
+		t.Errorf("ListUsers = %+v, want only bob", users)
+	}
+	if sealed, _ := atrest.IsSealedFile(passwdPath); !sealed {
+		t.Error("passwd no longer sealed after DeleteUser")
+	}
+}
+
+func TestAddUserWithHash(t *testing.T) {
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	hash, err := HashPasswordWithParams("hunter2", cheapParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AddUserWithHash(passwdPath, "matthew", hash); err != nil {
+		t.Fatalf("AddUserWithHash: %v", err)
+	}
+	users, err := ListUsers(passwdPath)
+	if err != nil || len(users) != 1 || users[0].Hash != hash {
+		t.Fatalf("ListUsers = %+v, %v", users, err)
+	}
+	if err := AddUserWithHash(passwdPath, "matthew", hash); err == nil {
+		t.Error("duplicate user accepted")
+	}
+	for _, bad := range []string{"", "plaintext", "{SHA}abc", hash + ":extra"} {
+		if err := AddUserWithHash(passwdPath, "other", bad); err == nil {
+			t.Errorf("hash %q accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package passwd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/infodancer/auth/vfs"
+)
+
+// mappedPasswd is a read-only view of a passwd file backed by a memory
+// mapping. index holds the byte offset of each entry line, sorted by
+// username, so lookups binary-search the mapped bytes without allocating.
+type mappedPasswd struct {
+	data  []byte
+	index []uint32
+	unmap func() error
+}
+
+// openMappedPasswd maps path and builds the username index.
+// A missing or empty file yields an empty index.
+func openMappedPasswd(path string) (*mappedPasswd, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &mappedPasswd{unmap: func() error { return nil }}, nil
+		}
+		return nil, fmt.Errorf("open passwd file: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	warnInsecurePerms(vfs.OS{}, path)
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat passwd file: %w", err)
+	}
+	if fi.Size() == 0 {
+		return &mappedPasswd{unmap: func() error { return nil }}, nil
+	}
+	if fi.Size() > 1<<32-1 {
+		return nil, fmt.Errorf("passwd file too large to map: %d bytes", fi.Size())
+	}
+
+	data, unmap, err := mapFile(f, int(fi.Size()))
+	if err != nil {
+		return nil, fmt.Errorf("map passwd file: %w", err)
+	}
+
+	m := &mappedPasswd{data: data, unmap: unmap}
+	m.buildIndex()
+	return m, nil
+}
+
+// buildIndex records the offset of every entry line and sorts by username.
+// When a username appears more than once the last line wins, matching the
+// map-based loader.
+func (m *mappedPasswd) buildIndex() {
+	var offsets []uint32
+	for off := 0; off < len(m.data); {
+		end := bytes.IndexByte(m.data[off:], '\n')
+		if end < 0 {
+			end = len(m.data)
+		} else {
+			end += off
+		}
+		if _, ok := parseEntry(string(m.data[off:end])); ok {
+			start := off
+			for start < end && (m.data[start] == ' ' || m.data[start] == '\t') {
+				start++
+			}
+			offsets = append(offsets, uint32(start))
+		}
+		off = end + 1
+	}
+
+	sort.SliceStable(offsets, func(i, j int) bool {
+		return bytes.Compare(m.nameAt(offsets[i]), m.nameAt(offsets[j])) < 0
+	})
+
+	// Drop all but the last of each run of equal usernames.
+	deduped := offsets[:0]
+	for i, off := range offsets {
+		if i+1 < len(offsets) && bytes.Equal(m.nameAt(off), m.nameAt(offsets[i+1])) {
+			continue
+		}
+		deduped = append(deduped, off)
+	}
+	m.index = deduped
+}
+
+// nameAt returns the username field of the line starting at off.
+func (m *mappedPasswd) nameAt(off uint32) []byte {
+	line := m.data[off:]
+	if i := bytes.IndexByte(line, ':'); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
+
+// lineAt returns the full line starting at off, without the newline.
+func (m *mappedPasswd) lineAt(off uint32) string {
+	line := m.data[off:]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	return string(line)
+}
+
+// lookup binary-searches the index for username and parses its line.
+func (m *mappedPasswd) lookup(username string) (*userEntry, bool) {
+	key := []byte(username)
+	i := sort.Search(len(m.index), func(i int) bool {
+		return bytes.Compare(m.nameAt(m.index[i]), key) >= 0
+	})
+	if i == len(m.index) || !bytes.Equal(m.nameAt(m.index[i]), key) {
+		return nil, false
+	}
+	return parseEntry(m.lineAt(m.index[i]))
+}
+
+// names returns every indexed username in sorted order.
+func (m *mappedPasswd) names() []string {
+	names := make([]string, len(m.index))
+	for i, off := range m.index {
+		names[i] = string(m.nameAt(off))
+	}
+	return names
+}
+
+// close releases the mapping.
+func (m *mappedPasswd) close() error {
+	m.index = nil
+	m.data = nil
+	return m.unmap()
+}
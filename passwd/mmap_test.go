@@ -0,0 +1,149 @@
+package passwd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMappedAgent_Lookup(t *testing.T) {
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	keyDir := filepath.Join(dir, "keys")
+
+	if err := os.WriteFile(passwdPath, []byte("# header\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []string{"carol", "alice", "bob"} {
+		if err := AddUser(passwdPath, u, u+"-pw"); err != nil {
+			t.Fatalf("AddUser %s: %v", u, err)
+		}
+	}
+
+	agent, err := NewMappedAgent(passwdPath, keyDir)
+	if err != nil {
+		t.Fatalf("NewMappedAgent: %v", err)
+	}
+	defer func() { _ = agent.Close() }()
+
+	if agent.mapped == nil {
+		t.Fatal("expected memory-mapped mode")
+	}
+	for _, u := range []string{"alice", "bob", "carol"} {
+		exists, err := agent.UserExists(t.Context(), u)
+		if err != nil || !exists {
+			t.Errorf("UserExists(%s) = %v, %v", u, exists, err)
+		}
+	}
+	if exists, _ := agent.UserExists(t.Context(), "dave"); exists {
+		t.Error("expected dave to not exist")
+	}
+
+	session, err := agent.Authenticate(t.Context(), "bob", "bob-pw")
+	if err != nil {
+		t.Fatalf("Authenticate bob: %v", err)
+	}
+	session.Clear()
+	if _, err := agent.Authenticate(t.Context(), "bob", "wrong"); err == nil {
+		t.Error("expected wrong password to fail")
+	}
+}
+
+func TestMappedAgent_DuplicateLastWins(t *testing.T) {
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	content := "alice:HASH:first\n  bob:HASH:bob\r\nalice:HASH:second\n"
+	if err := os.WriteFile(passwdPath, []byte(content), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := openMappedPasswd(passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = m.close() }()
+
+	entry, ok := m.lookup("alice")
+	if !ok || entry.mailbox != "second" {
+		t.Errorf("expected last alice entry to win, got %+v", entry)
+	}
+	entry, ok = m.lookup("bob")
+	if !ok || entry.mailbox != "bob" {
+		t.Errorf("expected bob with indented line, got %+v ok=%v", entry, ok)
+	}
+}
+
+func TestMappedAgent_MissingAndEmptyFile(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"missing", "empty"} {
+		path := filepath.Join(dir, name)
+		if name == "empty" {
+			if err := os.WriteFile(path, nil, 0o640); err != nil {
+				t.Fatal(err)
+			}
+		}
+		agent, err := NewMappedAgent(path, dir)
+		if err != nil {
+			t.Fatalf("%s: NewMappedAgent: %v", name, err)
+		}
+		if exists, _ := agent.UserExists(t.Context(), "alice"); exists {
+			t.Errorf("%s: expected no users", name)
+		}
+		if err := agent.Close(); err != nil {
+			t.Errorf("%s: Close: %v", name, err)
+		}
+	}
+}
+
+func BenchmarkMappedLookup(b *testing.B) {
+	dir := b.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	var sb strings.Builder
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&sb, "user%d:HASH:user%d\n", i, i)
+	}
+	if err := os.WriteFile(passwdPath, []byte(sb.String()), 0o640); err != nil {
+		b.Fatal(err)
+	}
+	m, err := openMappedPasswd(passwdPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() { _ = m.close() }()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := m.lookup("user54321"); !ok {
+			b.Fatal("lookup failed")
+		}
+	}
+}
+
+func TestAgent_ListUsers(t *testing.T) {
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	content := "carol:x:carol\n# comment\nalice:x:alice\nbob:x:bob\nalice:y:alice\n"
+	if err := os.WriteFile(passwdPath, []byte(content), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, newAgent := range map[string]func(string, string, ...Option) (*Agent, error){
+		"map":    NewAgent,
+		"mapped": NewMappedAgent,
+	} {
+		agent, err := newAgent(passwdPath, filepath.Join(dir, "keys"))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		users, err := agent.ListUsers(t.Context())
+		_ = agent.Close()
+		if err != nil {
+			t.Fatalf("%s: ListUsers: %v", name, err)
+		}
+		if got := strings.Join(users, ","); got != "alice,bob,carol" {
+			t.Errorf("%s: ListUsers = %s, want alice,bob,carol", name, got)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package passwd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/pgpkey"
+	"github.com/infodancer/auth/vfs"
+)
+
+// Compile-time check: Agent tags its keys' formats.
+var _ auth.FormattedKeyProvider = (*Agent)(nil)
+
+// GetPublicKeyWithFormat returns username's public key and its format.
+// A public key file holding an armored OpenPGP key (see ImportOpenPGPKey)
+// yields the binary key, tagged auth.KeyFormatOpenPGP; any other is
+// returned as stored, tagged auth.KeyFormatNative. Implements
+// auth.FormattedKeyProvider.
+func (a *Agent) GetPublicKeyWithFormat(_ context.Context, username string) ([]byte, auth.KeyFormat, error) {
+	if _, exists := a.lookup(username); !exists {
+		return nil, "", errors.ErrUserNotFound
+	}
+	data, err := a.files().ReadFile(filepath.Join(a.keyDir, username+publicKeyExt))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, "", errors.ErrKeyNotFound
+		}
+		return nil, "", fmt.Errorf("read public key: %w", err)
+	}
+	if !pgpkey.IsArmored(data) {
+		return data, auth.KeyFormatNative, nil
+	}
+	key, err := pgpkey.Decode(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %s: %v", errors.ErrInvalidKeyFormat, username, err)
+	}
+	return key, auth.KeyFormatOpenPGP, nil
+}
+
+// ImportOpenPGPKey stores key, an armored or binary OpenPGP public key, as
+// username's public key, armored, so that mail to them is encrypted to it.
+// The private key stays with the user: logins do not unlock it, and the
+// key cannot be rotated or escrowed here. An imported key may be replaced
+// by another.
+//
+// A user with a native key pair fails with errors.ErrKeyExists, a key
+// that is not OpenPGP with errors.ErrInvalidKeyFormat, and read-only mode
+// with errors.ErrReadOnly.
+func ImportOpenPGPKey(keyDir, username string, key []byte) error {
+	if err := checkWritable(vfs.OS{}, keyDir); err != nil {
+		return err
+	}
+	binary := key
+	if pgpkey.IsArmored(key) {
+		var err error
+		if binary, err = pgpkey.Decode(key); err != nil {
+			return fmt.Errorf("%w: %v", errors.ErrInvalidKeyFormat, err)
+		}
+	} else if err := pgpkey.Check(key); err != nil {
+		return fmt.Errorf("%w: %v", errors.ErrInvalidKeyFormat, err)
+	}
+	fsys := vfs.OS{}
+	if _, err := fsys.Stat(filepath.Join(keyDir, username+privateKeyExt)); err == nil {
+		return fmt.Errorf("%w: %s has a key pair", errors.ErrKeyExists, username)
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("stat private key: %w", err)
+	}
+	if err := fsys.MkdirAll(keyDir, 0o700); err != nil {
+		return fmt.Errorf("create key directory: %w", err)
+	}
+	if err := vfs.WriteFileAtomic(fsys, filepath.Join(keyDir, username+publicKeyExt), pgpkey.Encode(binary), 0o644); err != nil {
+		return fmt.Errorf("write public key: %w", err)
+	}
+	return nil
+}
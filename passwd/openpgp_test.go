@@ -0,0 +1,82 @@
+package passwd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/pgpkey"
+)
+
+func TestImportOpenPGPKey(t *testing.T) {
+	armored, err := os.ReadFile("../pgpkey/testdata/alice.asc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary, err := pgpkey.Decode(armored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	keyDir := filepath.Join(dir, "keys")
+	for _, user := range []string{"alice", "bob"} {
+		if err := AddUser(passwdPath, user, "pw"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	agent, err := NewAgent(passwdPath, keyDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	ctx := context.Background()
+
+	if err := ImportOpenPGPKey(keyDir, "alice", []byte("not a key")); !errors.Is(err, autherrors.ErrInvalidKeyFormat) {
+		t.Errorf("invalid key: err = %v, want ErrInvalidKeyFormat", err)
+	}
+	// Binary keys are accepted too, and stored armored.
+	if err := ImportOpenPGPKey(keyDir, "alice", binary); err != nil {
+		t.Fatalf("ImportOpenPGPKey: %v", err)
+	}
+	if stored, _ := os.ReadFile(filepath.Join(keyDir, "alice"+publicKeyExt)); !pgpkey.IsArmored(stored) {
+		t.Error("imported key not stored armored")
+	}
+	key, format, err := auth.PublicKeyWithFormat(ctx, agent, "alice")
+	if err != nil || format != auth.KeyFormatOpenPGP || !bytes.Equal(key, binary) {
+		t.Errorf("PublicKeyWithFormat = %d bytes, %q, %v", len(key), format, err)
+	}
+	if got, err := agent.GetPublicKey(ctx, "alice"); err != nil || !bytes.Equal(got, binary) {
+		t.Errorf("GetPublicKey = %v", err)
+	}
+	if ok, _ := agent.HasEncryption(ctx, "alice"); !ok {
+		t.Error("HasEncryption = false with an imported key")
+	}
+	session, err := agent.Authenticate(ctx, "alice", "pw")
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if session.KeysUnlocked() {
+		t.Error("login unlocked a key for an imported public key")
+	}
+	if _, err := agent.GenerateUserKeys(ctx, "alice", "pw"); !errors.Is(err, autherrors.ErrKeyExists) {
+		t.Errorf("GenerateUserKeys over imported key: err = %v, want ErrKeyExists", err)
+	}
+
+	// Native keys keep their format; importing over them is refused.
+	pub, err := agent.GenerateUserKeys(ctx, "bob", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, format, err := agent.GetPublicKeyWithFormat(ctx, "bob"); err != nil || format != auth.KeyFormatNative || !bytes.Equal(key, pub) {
+		t.Errorf("GetPublicKeyWithFormat(native) = %q, %v", format, err)
+	}
+	if err := ImportOpenPGPKey(keyDir, "bob", armored); !errors.Is(err, autherrors.ErrKeyExists) {
+		t.Errorf("import over key pair: err = %v, want ErrKeyExists", err)
+	}
+}
@@ -4,20 +4,29 @@ package passwd
 import (
 	"bufio"
 	"context"
-	"crypto/subtle"
+	"crypto/rand"
 	"encoding/base64"
+	stderrors "errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/nacl/secretbox"
 
 	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/atrest"
 	"github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/lease"
+	"github.com/infodancer/auth/tracing"
+	"github.com/infodancer/auth/vfs"
 )
 
 const (
@@ -36,12 +45,33 @@ const (
 	argon2KeyLen  = 32
 )
 
+// statInterval is how often an agent stats its passwd files to notice
+// changes; lookups in between trust the last answer.
+const statInterval = time.Second
+
 // userEntry represents a parsed line from the passwd file.
 type userEntry struct {
 	username string
 	hash     string // Full hash string including algorithm prefix
 	mailbox  string
-	uid      uint32 // 0 = not yet assigned (pre-migration entry)
+	uid      uint32    // 0 = not yet assigned (pre-migration entry)
+	flags    []string  // account flags, see SetFlags
+	changed  time.Time // when the password was set; zero if unknown
+	profile  Profile   // v2 fields; zero for a v1 entry
+}
+
+// user returns the auth.User e describes.
+func (e *userEntry) user() *auth.User {
+	return &auth.User{
+		Username:    e.username,
+		Mailbox:     e.mailbox,
+		Uid:         e.uid,
+		Gid:         e.profile.Gid,
+		Quota:       e.profile.Quota,
+		DisplayName: e.profile.DisplayName,
+		Attributes:  maps.Clone(e.profile.Attributes),
+		Services:    e.profile.services(),
+	}
 }
 
 // Agent implements AuthenticationAgent using a passwd file and key directory.
@@ -49,19 +79,51 @@ type Agent struct {
 	passwdPath string
 	keyDir     string
 
-	mu    sync.RWMutex
-	users map[string]*userEntry // Cached user entries
+	mu      sync.RWMutex
+	users   map[string]*userEntry // Cached user entries
+	stamp   string                // sourceStamp of the files users was loaded from
+	checked atomic.Int64          // UnixNano of the last stamp comparison, see reload
+	mapped  *mappedPasswd         // non-nil in memory-mapped mode; users is unused
+	cdb     *cdbPasswd            // non-nil in compiled mode while fresh; users is unused
+	stale   []*cdbPasswd          // compiled files fallen back from, unmapped on Close
+
+	compiled bool // opened with NewCDBAgent; see readOnlyView
+	readOnly bool // never write, see WithReadOnly
+
+	totp totpState // second-factor logins in progress, see VerifyTOTP
+
+	params  Argon2Params  // expected hash parameters, see WithArgon2Params
+	upgrade bool          // rehash other schemes to argon2id, see WithHashUpgrade
+	maxAge  time.Duration // password lifetime, see WithPasswordMaxAge
+	peppers *Peppers      // nil: no peppers, see WithPeppers
+
+	scramIterations int         // derive SCRAM verifiers at login, see WithSCRAM
+	reversibleKey   *atrest.Key // seals passwords for CRAM-MD5, see WithReversiblePasswords
+
+	keyGen    KeyPairGenerator // nil: GenerateX25519, see WithKeyPairGenerator
+	escrowKey []byte           // domain recovery public key, see WithEscrowKey
+
+	fsys   vfs.WriteFS    // nil: the local disk, see WithFS
+	leases *lease.Manager // nil: the local lock only, see WithLeaseManager
 }
 
 // NewAgent creates a new passwd-based authentication agent.
 // passwdPath is the path to the passwd file.
 // keyDir is the directory containing user key files.
-func NewAgent(passwdPath, keyDir string) (*Agent, error) {
+//
+// Entries are loaded into memory at open. Lookups stat the passwd files at
+// most once a second and load them again when their size or modification
+// time has changed, so users added by another process are seen without
+// reopening the agent.
+func NewAgent(passwdPath, keyDir string, opts ...Option) (*Agent, error) {
 	a := &Agent{
 		passwdPath: passwdPath,
 		keyDir:     keyDir,
 		users:      make(map[string]*userEntry),
 	}
+	for _, opt := range opts {
+		opt(a)
+	}
 
 	if err := a.loadPasswd(); err != nil {
 		return nil, err
@@ -70,10 +132,93 @@ func NewAgent(passwdPath, keyDir string) (*Agent, error) {
 	return a, nil
 }
 
+// NewMappedAgent creates a read-only passwd agent that memory-maps the passwd
+// file and keeps only a sorted offset index (4 bytes per user) instead of
+// materializing every entry. Entries are parsed on demand at lookup. Intended
+// for hosts serving thousands of rarely-used domains.
+//
+// The mapping reflects the file as it was when opened; replacing the file
+// (e.g., by AddUser's atomic rename) is not seen until a new agent is opened.
+// Sharded passwd directories and sealed passwd files (see package atrest)
+// are not mapped and load as with NewAgent.
+func NewMappedAgent(passwdPath, keyDir string, opts ...Option) (*Agent, error) {
+	a := &Agent{passwdPath: passwdPath, keyDir: keyDir}
+	for _, opt := range opts {
+		opt(a)
+	}
+	if isSharded(a.files(), passwdPath) || !onDisk(a.files()) {
+		return NewAgent(passwdPath, keyDir, opts...)
+	}
+	if sealed, err := atrest.IsSealedFile(passwdPath); err != nil {
+		return nil, fmt.Errorf("open passwd file: %w", err)
+	} else if sealed {
+		return NewAgent(passwdPath, keyDir, opts...)
+	}
+
+	m, err := openMappedPasswd(passwdPath)
+	if err != nil {
+		return nil, err
+	}
+	a.mapped = m
+	return a, nil
+}
+
+// NewCDBAgent creates a read-only passwd agent that looks users up in the
+// file compiled by CompilePasswd, for domains too large to load or scan.
+// When the compiled file is missing, or the passwd file has changed since
+// it was compiled, the agent loads the text file as NewAgent does. The
+// check is repeated on lookups, at most once a second, so a change made
+// after the agent opened is not masked either; it is logged, and
+// recompiling takes effect for agents opened afterwards.
+func NewCDBAgent(passwdPath, keyDir string, opts ...Option) (*Agent, error) {
+	a := &Agent{passwdPath: passwdPath, keyDir: keyDir, compiled: true}
+	for _, opt := range opts {
+		opt(a)
+	}
+	c, err := openCDB(a.files(), passwdPath)
+	switch {
+	case err == nil && c.fresh(time.Now()):
+		a.cdb = c
+		return a, nil
+	case err == nil:
+		slog.Warn("passwd cdb is stale, loading the text file", "passwd", passwdPath)
+		_ = c.close()
+	case !os.IsNotExist(err):
+		slog.Warn("passwd cdb unusable, loading the text file", "passwd", passwdPath, "error", err)
+	}
+	if err := a.loadPasswd(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// dropCDB switches from c to the text file after c went stale. c stays
+// mapped until Close: lookups in flight may still be reading it.
+func (a *Agent) dropCDB(c *cdbPasswd) {
+	slog.Warn("passwd changed since it was compiled, loading the text file", "passwd", a.passwdPath)
+	if err := a.loadPasswd(); err != nil {
+		slog.Error("load passwd file; still serving the stale cdb", "passwd", a.passwdPath, "error", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cdb == c {
+		a.cdb = nil
+		a.stale = append(a.stale, c)
+	}
+}
+
+// readOnlyView reports whether the agent serves a memory-mapped or
+// compiled view that its own writes, such as hash upgrades, would leave
+// behind; such agents do not write.
+func (a *Agent) readOnlyView() bool {
+	return a.mapped != nil || a.compiled
+}
+
 // warnInsecurePerms logs a warning if a sensitive file is group-writable or
 // world-readable. Best-effort: errors from Stat are silently ignored.
-func warnInsecurePerms(path string) {
-	fi, err := os.Stat(path)
+func warnInsecurePerms(fsys vfs.FS, path string) {
+	fi, err := fsys.Stat(path)
 	if err != nil {
 		return
 	}
@@ -86,10 +231,82 @@ func warnInsecurePerms(path string) {
 	}
 }
 
-// loadPasswd reads and parses the passwd file.
+// loadPasswd reads and parses the passwd file, or every shard file when
+// passwdPath is a shard directory (see ShardName).
 // A missing passwd file is treated as empty (no users), not an error.
 func (a *Agent) loadPasswd() error {
-	f, err := os.Open(a.passwdPath)
+	// Stamp first: a change made while reading then shows at the next check.
+	stamp, err := sourceStamp(a.files(), a.passwdPath)
+	if err != nil {
+		return err
+	}
+	files, err := passwdFiles(a.files(), a.passwdPath)
+	if err != nil {
+		return err
+	}
+
+	users := make(map[string]*userEntry)
+	for _, path := range files {
+		if err := loadPasswdFile(a.files(), path, users); err != nil {
+			return err
+		}
+	}
+
+	a.mu.Lock()
+	a.users = users
+	a.stamp = stamp
+	a.mu.Unlock()
+	a.checked.Store(time.Now().UnixNano())
+	return nil
+}
+
+// sync brings the agent up to date with its passwd files: a compiled file
+// that went stale is dropped and, in text mode, changed files are loaded
+// again. Memory-mapped agents keep the file as it was when opened.
+func (a *Agent) sync(now time.Time) {
+	a.mu.RLock()
+	c, mapped := a.cdb, a.mapped != nil
+	a.mu.RUnlock()
+	switch {
+	case c != nil:
+		if !c.fresh(now) {
+			a.dropCDB(c)
+		}
+	case !mapped:
+		a.reload(now)
+	}
+}
+
+// reload loads the passwd files again when their stamp differs from the
+// one they were loaded with, comparing at most once per statInterval. On
+// failure the entries loaded before are kept.
+func (a *Agent) reload(now time.Time) {
+	last := a.checked.Load()
+	if now.UnixNano()-last < int64(statInterval) || !a.checked.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	stamp, err := sourceStamp(a.files(), a.passwdPath)
+	if err != nil {
+		slog.Warn("stat passwd file; keeping loaded entries", "passwd", a.passwdPath, "error", err)
+		return
+	}
+	a.mu.RLock()
+	changed := stamp != a.stamp
+	a.mu.RUnlock()
+	if !changed {
+		return
+	}
+	if err := a.loadPasswd(); err != nil {
+		slog.Warn("reload passwd file; keeping loaded entries", "passwd", a.passwdPath, "error", err)
+		return
+	}
+	slog.Debug("reloaded passwd file", "passwd", a.passwdPath)
+}
+
+// loadPasswdFile parses one passwd (or shard) file into users.
+// A missing file is treated as empty.
+func loadPasswdFile(fsys vfs.FS, path string, users map[string]*userEntry) error {
+	f, err := atrest.OpenFS(fsys, path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil
@@ -98,87 +315,203 @@ func (a *Agent) loadPasswd() error {
 	}
 	defer func() { _ = f.Close() }()
 
-	warnInsecurePerms(a.passwdPath)
-
-	a.mu.Lock()
-	defer a.mu.Unlock()
-
-	// Clear existing entries
-	a.users = make(map[string]*userEntry)
+	warnInsecurePerms(fsys, path)
 
 	scanner := bufio.NewScanner(f)
-	lineNum := 0
 	for scanner.Scan() {
-		lineNum++
-		line := strings.TrimSpace(scanner.Text())
-
-		// Skip empty lines and comments
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
+		if entry, ok := parseEntry(scanner.Text()); ok {
+			users[entry.username] = entry
 		}
+	}
 
-		parts := strings.SplitN(line, ":", 4)
-		if len(parts) < 2 {
-			continue // Invalid line, skip
-		}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read passwd file: %w", err)
+	}
 
-		entry := &userEntry{
-			username: parts[0],
-			hash:     parts[1],
-		}
+	return nil
+}
 
-		if len(parts) >= 3 {
-			entry.mailbox = parts[2]
-		} else {
-			// Default mailbox is username
-			entry.mailbox = parts[0]
-		}
+// parseEntry parses one passwd line, v1 or v2 (see Profile). Returns false
+// for blank lines, comments, and lines without at least a username and
+// hash field.
+func parseEntry(line string) (*userEntry, bool) {
+	line = strings.TrimSpace(line)
 
-		if len(parts) >= 4 && parts[3] != "" {
-			var uid uint64
-			if _, err := fmt.Sscanf(parts[3], "%d", &uid); err == nil {
-				entry.uid = uint32(uid)
-			}
+	// Skip empty lines and comments
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, false
+	}
+
+	parts := strings.SplitN(line, ":", v2Fields)
+	if len(parts) < 2 {
+		return nil, false // Invalid line, skip
+	}
+
+	entry := &userEntry{
+		username: parts[0],
+		hash:     parts[1],
+	}
+
+	if len(parts) >= 3 {
+		entry.mailbox = parts[2]
+	} else {
+		// Default mailbox is username
+		entry.mailbox = parts[0]
+	}
+
+	if len(parts) >= 4 && parts[3] != "" {
+		var uid uint64
+		if _, err := fmt.Sscanf(parts[3], "%d", &uid); err == nil {
+			entry.uid = uint32(uid)
 		}
+	}
 
-		a.users[entry.username] = entry
+	if len(parts) >= 5 {
+		entry.flags = parseFlags(parts[4])
 	}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("read passwd file: %w", err)
+	if len(parts) >= 6 {
+		entry.changed, _ = parseChanged(parts[5])
 	}
 
-	return nil
+	if len(parts) > v1Fields {
+		entry.profile = parseProfile(parts[v1Fields:])
+	}
+
+	return entry, true
 }
 
-// Authenticate validates credentials and returns an AuthSession with keys.
-func (a *Agent) Authenticate(ctx context.Context, username, password string) (*auth.AuthSession, error) {
+// lookup returns the entry for username from the in-memory map or, in
+// memory-mapped or compiled mode, from the mapped file index or cdb.
+func (a *Agent) lookup(username string) (*userEntry, bool) {
+	a.sync(time.Now())
+
 	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.cdb != nil {
+		return a.cdb.lookup(username)
+	}
+	if a.mapped != nil {
+		return a.mapped.lookup(username)
+	}
 	entry, exists := a.users[username]
-	a.mu.RUnlock()
+	return entry, exists
+}
 
+// Authenticate validates credentials and returns an AuthSession with keys.
+// password may be the user's main password or one of their app passwords
+// (see AddAppPassword); the session's Credential tells which. App password
+// sessions carry the private key only if the app password was created to
+// unlock it.
+//
+// Users whose key has a separate passphrase (see SetKeyPassphrase) get it
+// unlocked only when ctx carries the passphrase (auth.WithKeyPassphrase); a
+// wrong passphrase fails with errors.ErrKeyDecryptFailed.
+//
+// A hash made with parameters other than the agent's is upgraded (see
+// WithArgon2Params), as is a hash of another scheme if WithHashUpgrade is
+// set. With WithSCRAM, a missing SCRAM verifier is derived as well, and
+// with WithReversiblePasswords a missing reversible password is stored.
+//
+// Sessions opened with a main password older than the agent's maximum
+// age have PasswordExpired set (see WithPasswordMaxAge); app passwords do
+// not expire.
+//
+// An unknown user fails with errors.ErrUserNotFound only after a password
+// verification as costly as a real one, so timing does not reveal which
+// accounts exist.
+//
+// Accounts with flags (see SetFlags) fail with errors.ErrAccountDisabled,
+// but only once the password is found correct, so the flags are not
+// revealed to someone guessing passwords.
+//
+// For users enrolled in TOTP (see EnableTOTP) it also unseals their secret
+// so that VerifyTOTP can complete the login; the session itself is returned
+// as usual, so callers must check TOTPEnabled (the domain.AuthRouter does).
+// The secret is sealed under the private key, so an enrolled user with a
+// separate key passphrase who logs in without it fails with
+// errors.ErrKeyPassphraseRequired rather than with a code that could never
+// be verified.
+func (a *Agent) Authenticate(ctx context.Context, username, password string) (*auth.AuthSession, error) {
+	ctx, span := tracing.Start(ctx, "passwd.Authenticate", tracing.String(tracing.AttrBackend, "passwd"))
+	session, err := a.authenticate(ctx, username, password)
+	tracing.End(span, err)
+	return session, err
+}
+
+// authenticate is Authenticate without tracing.
+func (a *Agent) authenticate(ctx context.Context, username, password string) (*auth.AuthSession, error) {
+	entry, exists := a.lookup(username)
 	if !exists {
+		// Take as long as a wrong password would, the app password scan
+		// included, so that response times do not tell which users exist.
+		a.dummyVerify(password)
+		_, _, _ = a.matchAppPassword(username, password)
 		return nil, errors.ErrUserNotFound
 	}
 
-	// Verify password against stored hash
+	// Verify password against stored hash, then against app passwords
 	if !a.verifyPassword(password, entry.hash) {
-		return nil, errors.ErrAuthFailed
+		ap, ok, err := a.matchAppPassword(username, password)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errors.ErrAuthFailed
+		}
+		if err := checkStatus(entry); err != nil {
+			return nil, err
+		}
+		return a.appPasswordSession(entry, ap, password)
 	}
+	if err := checkStatus(entry); err != nil {
+		return nil, err
+	}
+	a.rehash(entry, password)
+	a.deriveSCRAM(entry.username, password)
+	a.storeReversibleAtLogin(entry.username, password)
 
 	session := &auth.AuthSession{
-		User: &auth.User{
-			Username: entry.username,
-			Mailbox:  entry.mailbox,
-		},
+		User:            entry.user(),
+		PasswordExpired: a.passwordExpired(entry),
+	}
+
+	// The key is sealed under the login password unless it has a separate
+	// passphrase, which only the context can supply.
+	keySecret := password
+	separate, err := hasKeyPassphrase(a.files(), a.keyDir, username)
+	if err != nil {
+		return nil, err
+	}
+	if separate {
+		keySecret, _ = auth.KeyPassphrase(ctx)
 	}
 
 	// Try to load and decrypt keys if they exist
-	pubKey, privKey, err := a.loadKeys(username, password)
+	pubKey, privKey, err := a.loadKeys(username, keySecret)
 	if err == nil {
 		session.PublicKey = pubKey
 		session.PrivateKey = privKey
 		session.EncryptionEnabled = true
+		if privKey == nil {
+			mfa, err := a.TOTPEnabled(ctx, username)
+			if err != nil {
+				return nil, err
+			}
+			if mfa {
+				return nil, fmt.Errorf("%w: %s", errors.ErrKeyPassphraseRequired, username)
+			}
+			return session, nil
+		}
+		if session.RetiredKeys, err = a.unlockRetired(username, pubKey, privKey); err != nil {
+			session.Clear()
+			return nil, err
+		}
+		if err := a.stageTOTP(username, privKey); err != nil {
+			session.Clear()
+			return nil, err
+		}
 	} else if err != errors.ErrKeyNotFound {
 		// Key exists but couldn't be decrypted - this is an error
 		return nil, err
@@ -188,108 +521,197 @@ func (a *Agent) Authenticate(ctx context.Context, username, password string) (*a
 	return session, nil
 }
 
-// Close releases any resources held by the agent.
+// Close releases any resources held by the agent, including the file
+// mapping in memory-mapped and compiled mode.
 func (a *Agent) Close() error {
-	return nil
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var errs []error
+	if a.mapped != nil {
+		errs = append(errs, a.mapped.close())
+		a.mapped = nil
+	}
+	if a.cdb != nil {
+		a.stale = append(a.stale, a.cdb)
+		a.cdb = nil
+	}
+	for _, c := range a.stale {
+		errs = append(errs, c.close())
+	}
+	a.stale = nil
+	return stderrors.Join(errs...)
 }
 
 // UserExists checks if a user exists without authenticating.
 func (a *Agent) UserExists(ctx context.Context, username string) (bool, error) {
-	a.mu.RLock()
-	defer a.mu.RUnlock()
-
-	_, exists := a.users[username]
+	_, exists := a.lookup(username)
 	return exists, nil
 }
 
-// GetPublicKey returns the public key for a user.
-func (a *Agent) GetPublicKey(ctx context.Context, username string) ([]byte, error) {
+// ListUsers returns all usernames in the passwd file, sorted.
+// Implements auth.UserLister.
+func (a *Agent) ListUsers(ctx context.Context) ([]string, error) {
+	a.sync(time.Now())
+
 	a.mu.RLock()
-	_, exists := a.users[username]
-	a.mu.RUnlock()
+	defer a.mu.RUnlock()
 
-	if !exists {
-		return nil, errors.ErrUserNotFound
+	if a.cdb != nil {
+		return a.cdb.names(), nil
 	}
-
-	pubKeyPath := filepath.Join(a.keyDir, username+publicKeyExt)
-	pubKey, err := os.ReadFile(pubKeyPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, errors.ErrKeyNotFound
-		}
-		return nil, fmt.Errorf("read public key: %w", err)
+	if a.mapped != nil {
+		return a.mapped.names(), nil
+	}
+	names := make([]string, 0, len(a.users))
+	for name := range a.users {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// GetPublicKey returns the public key for a user: a native key, or a
+// binary OpenPGP key for one imported with ImportOpenPGPKey (see
+// GetPublicKeyWithFormat).
+func (a *Agent) GetPublicKey(ctx context.Context, username string) ([]byte, error) {
+	key, _, err := a.GetPublicKeyWithFormat(ctx, username)
+	return key, err
+}
 
-	return pubKey, nil
+// GetPublicKeys returns the public keys of usernames, as GetPublicKey
+// returns them. Users without a key are left out.
+func (a *Agent) GetPublicKeys(ctx context.Context, usernames []string) (map[string][]byte, error) {
+	return auth.GetPublicKeysOneByOne(ctx, a.GetPublicKey, usernames)
 }
 
 // HasEncryption returns whether encryption is enabled for a user.
 func (a *Agent) HasEncryption(ctx context.Context, username string) (bool, error) {
-	a.mu.RLock()
-	_, exists := a.users[username]
-	a.mu.RUnlock()
-
-	if !exists {
+	if _, exists := a.lookup(username); !exists {
 		return false, nil
 	}
 
 	pubKeyPath := filepath.Join(a.keyDir, username+publicKeyExt)
-	_, err := os.Stat(pubKeyPath)
+	_, err := a.files().Stat(pubKeyPath)
 	return err == nil, nil
 }
 
-// verifyPassword checks if the password matches the stored hash.
+// verifyPassword checks if the password matches the stored hash, using
+// the agent's peppers.
 func (a *Agent) verifyPassword(password, hash string) bool {
-	// Parse the hash format: $argon2id$v=19$m=65536,t=3,p=4$salt$hash
-	if !strings.HasPrefix(hash, "$argon2id$") {
+	return verifyPassword(password, hash, a.peppers)
+}
+
+// dummyHashes holds, per Argon2Params, the hash of a random secret that
+// dummyVerify checks passwords against.
+var dummyHashes sync.Map
+
+// dummyVerify verifies password against a hash made with the agent's
+// parameters that no password matches, costing what a real verification
+// costs. The hash is made on first use for each parameter set, so the
+// first unknown user of a process takes twice as long.
+func (a *Agent) dummyVerify(password string) {
+	p := a.argon2Params()
+	h, ok := dummyHashes.Load(p)
+	if !ok {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return
+		}
+		hash, err := hashPassword(base64.RawStdEncoding.EncodeToString(secret), p, nil)
+		if err != nil {
+			return
+		}
+		h, _ = dummyHashes.LoadOrStore(p, hash)
+	}
+	_ = a.verifyPassword(password, h.(string))
+}
+
+// VerifyPassword reports whether password matches hash: an argon2id PHC
+// string as produced by HashPassword, or a hash of another registered
+// scheme (see RegisterHashScheme), such as bcrypt, scrypt or SHA-512
+// crypt. Hashes of unknown schemes match no password. The comparison is
+// constant-time. Other backends storing hashes from HashPassword use it to
+// verify them.
+func VerifyPassword(password, hash string) bool {
+	return verifyPassword(password, hash, installedPeppers())
+}
+
+// verifyPassword is VerifyPassword with the peppers pp.
+func verifyPassword(password, hash string, pp *Peppers) bool {
+	prefix, verify, ok := hashScheme(hash)
+	if !ok {
 		return false
 	}
+	if prefix == argon2Prefix {
+		return verifyArgon2With(password, hash, pp)
+	}
+	return verify(password, hash)
+}
+
+// argon2Hash is a parsed argon2id PHC string.
+type argon2Hash struct {
+	memory, time uint32
+	threads      uint8
+	keyid        string // pepper ID, "" for unpeppered hashes (see Peppers)
+	salt, key    []byte
+}
+
+// parseArgon2Hash parses an argon2id PHC string as produced by
+// HashPassword. Returns false if hash is not one.
+func parseArgon2Hash(hash string) (argon2Hash, bool) {
+	// Parse the hash format: $argon2id$v=19$m=65536,t=3,p=4[,keyid=id]$salt$hash
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		return argon2Hash{}, false
+	}
 
 	parts := strings.Split(hash, "$")
 	if len(parts) != 6 {
-		return false
+		return argon2Hash{}, false
 	}
 
 	// parts[0] = "" (before first $)
 	// parts[1] = "argon2id"
 	// parts[2] = "v=19"
-	// parts[3] = "m=65536,t=3,p=4"
+	// parts[3] = "m=65536,t=3,p=4", optionally followed by ",keyid=id"
 	// parts[4] = salt (base64)
 	// parts[5] = hash (base64)
 
 	var version int
 	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != 19 {
-		return false
+		return argon2Hash{}, false
 	}
 
-	var memory, time, threads uint32
-	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
-		return false
+	var h argon2Hash
+	params, keyid, peppered := strings.Cut(parts[3], ",keyid=")
+	if peppered {
+		if !validPepperID(keyid) {
+			return argon2Hash{}, false
+		}
+		h.keyid = keyid
 	}
-
-	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
-	if err != nil {
-		return false
+	var threads uint32
+	if _, err := fmt.Sscanf(params, "m=%d,t=%d,p=%d", &h.memory, &h.time, &threads); err != nil {
+		return argon2Hash{}, false
 	}
+	h.threads = uint8(threads)
 
-	expectedHash, err := base64.RawStdEncoding.DecodeString(parts[5])
-	if err != nil {
-		return false
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return argon2Hash{}, false
 	}
-
-	// Derive key from password using same parameters
-	derivedKey := argon2.IDKey([]byte(password), salt, time, memory, uint8(threads), uint32(len(expectedHash)))
-
-	// Constant-time comparison
-	return subtle.ConstantTimeCompare(derivedKey, expectedHash) == 1
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return argon2Hash{}, false
+	}
+	return h, true
 }
 
-// loadKeys loads and decrypts the user's key pair.
-func (a *Agent) loadKeys(username, password string) (publicKey, privateKey []byte, err error) {
+// loadKeys loads the user's key pair and decrypts the private key with
+// secret. An empty secret leaves the private key nil.
+func (a *Agent) loadKeys(username, secret string) (publicKey, privateKey []byte, err error) {
 	// Load public key
 	pubKeyPath := filepath.Join(a.keyDir, username+publicKeyExt)
-	publicKey, err = os.ReadFile(pubKeyPath)
+	publicKey, err = a.files().ReadFile(pubKeyPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, nil, errors.ErrKeyNotFound
@@ -299,8 +721,8 @@ func (a *Agent) loadKeys(username, password string) (publicKey, privateKey []byt
 
 	// Load encrypted private key
 	privKeyPath := filepath.Join(a.keyDir, username+privateKeyExt)
-	warnInsecurePerms(privKeyPath)
-	encryptedKey, err := os.ReadFile(privKeyPath)
+	warnInsecurePerms(a.files(), privKeyPath)
+	encryptedKey, err := a.files().ReadFile(privKeyPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, nil, errors.ErrKeyNotFound
@@ -308,8 +730,12 @@ func (a *Agent) loadKeys(username, password string) (publicKey, privateKey []byt
 		return nil, nil, fmt.Errorf("read private key: %w", err)
 	}
 
+	if secret == "" {
+		return publicKey, nil, nil
+	}
+
 	// Decrypt private key
-	privateKey, err = decryptPrivateKey(encryptedKey, password)
+	privateKey, err = decryptPrivateKey(encryptedKey, secret)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -342,3 +768,44 @@ func decryptPrivateKey(encryptedKey []byte, password string) ([]byte, error) {
 
 	return plaintext, nil
 }
+
+// EncryptPrivateKey seals privateKey under secret in the key file format
+// (salt || nonce || secretbox ciphertext), for backends that store keys
+// elsewhere than a key directory.
+func EncryptPrivateKey(privateKey []byte, secret string) ([]byte, error) {
+	return encryptPrivateKey(privateKey, secret)
+}
+
+// DecryptPrivateKey opens a key sealed by EncryptPrivateKey. Other
+// backends storing sealed keys use it, as they use VerifyPassword for
+// hashes. Returns errors.ErrKeyDecryptFailed if secret is wrong.
+func DecryptPrivateKey(sealed []byte, secret string) ([]byte, error) {
+	return decryptPrivateKey(sealed, secret)
+}
+
+// entryOverhead approximates the per-entry heap cost of a userEntry beyond
+// its string contents (struct, pointer, map bucket share).
+const entryOverhead = 96
+
+// Resources reports the memory held by the user cache or, in memory-mapped
+// mode, the mapping and its offset index, or in compiled mode the cdb.
+// Implements auth.ResourceReporter.
+func (a *Agent) Resources() auth.ResourceUsage {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.cdb != nil {
+		return auth.ResourceUsage{MappedBytes: int64(len(a.cdb.data))}
+	}
+	if a.mapped != nil {
+		return auth.ResourceUsage{
+			CacheBytes:  int64(4 * len(a.mapped.index)),
+			MappedBytes: int64(len(a.mapped.data)),
+		}
+	}
+	var n int64
+	for _, e := range a.users {
+		n += int64(entryOverhead + len(e.username) + len(e.hash) + len(e.mailbox))
+	}
+	return auth.ResourceUsage{CacheBytes: n}
+}
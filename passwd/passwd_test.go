@@ -0,0 +1,229 @@
+package passwd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// timingParams cost a few milliseconds, enough to dominate the rest of
+// Authenticate and to measure.
+var timingParams = Argon2Params{Time: 2, Memory: 8 * 1024, Threads: 1}
+
+// newTimingAgent returns an agent with one user, alice, hashed with
+// timingParams.
+func newTimingAgent(tb testing.TB) *Agent {
+	tb.Helper()
+	passwdPath := filepath.Join(tb.TempDir(), "passwd")
+	hash, err := HashPasswordWithParams("correct horse", timingParams)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := AddUserWithHash(passwdPath, "alice", hash); err != nil {
+		tb.Fatal(err)
+	}
+	agent, err := NewAgent(passwdPath, tb.TempDir())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { _ = agent.Close() })
+	return agent.WithArgon2Params(timingParams)
+}
+
+// medianAuth returns the median time of n failed logins as username with
+// password.
+func medianAuth(t *testing.T, agent *Agent, username, password string, n int) time.Duration {
+	t.Helper()
+	times := make([]time.Duration, n)
+	for i := range times {
+		start := time.Now()
+		if _, err := agent.Authenticate(context.Background(), username, password); err == nil {
+			t.Fatalf("%s: login succeeded", username)
+		}
+		times[i] = time.Since(start)
+	}
+	slices.Sort(times)
+	return times[n/2]
+}
+
+func TestAuthenticate_UnknownUserTiming(t *testing.T) {
+	if testing.Short() {
+		t.Skip("timing test")
+	}
+	agent := newTimingAgent(t)
+	if _, err := agent.Authenticate(context.Background(), "nobody", "wrong"); !errors.Is(err, autherrors.ErrUserNotFound) {
+		t.Fatalf("unknown user: err = %v, want ErrUserNotFound", err)
+	}
+
+	const n = 15
+	known := medianAuth(t, agent, "alice", "wrong", n)
+	unknown := medianAuth(t, agent, "nobody", "wrong", n)
+	// Without the dummy verification an unknown user answers hundreds of
+	// times faster; allow generous noise either way.
+	if unknown < known/2 || unknown > known*2 {
+		t.Errorf("median wrong password %v, unknown user %v: differ by more than 2x", known, unknown)
+	}
+}
+
+func TestAuthenticate_UnknownUserTimingAppPasswords(t *testing.T) {
+	if testing.Short() {
+		t.Skip("timing test")
+	}
+	agent := newTimingAgent(t)
+
+	// Enough app passwords that scanning them costs several times the
+	// password verification.
+	var b strings.Builder
+	for i := range 50000 {
+		fmt.Fprintf(&b, "alice:%08x:0:%s::app\n", i, strings.Repeat("00", 32))
+	}
+	if err := os.WriteFile(appPasswordsPath(agent.passwdPath), []byte(b.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// A wrong password shaped like a token is checked against them.
+	token := strings.Repeat("a", 32)
+	const n = 15
+	known := medianAuth(t, agent, "alice", token, n)
+	unknown := medianAuth(t, agent, "nobody", token, n)
+	if unknown < known/2 || unknown > known*2 {
+		t.Errorf("median wrong token %v, unknown user %v: differ by more than 2x", known, unknown)
+	}
+}
+
+func BenchmarkAuthenticate_WrongPassword(b *testing.B) {
+	agent := newTimingAgent(b)
+	for b.Loop() {
+		_, _ = agent.Authenticate(context.Background(), "alice", "wrong")
+	}
+}
+
+func BenchmarkAuthenticate_UnknownUser(b *testing.B) {
+	agent := newTimingAgent(b)
+	for b.Loop() {
+		_, _ = agent.Authenticate(context.Background(), "nobody", "wrong")
+	}
+}
+
+func TestEncryptPrivateKey_RoundTrip(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	sealed, err := EncryptPrivateKey(key, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecryptPrivateKey(sealed, "correct horse")
+	if err != nil || !slices.Equal(got, key) {
+		t.Errorf("DecryptPrivateKey = %q, %v", got, err)
+	}
+	if _, err := DecryptPrivateKey(sealed, "battery staple"); !errors.Is(err, autherrors.ErrKeyDecryptFailed) {
+		t.Errorf("wrong secret: err = %v, want ErrKeyDecryptFailed", err)
+	}
+}
+
+func TestAgent_ReloadsChangedFile(t *testing.T) {
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	if err := AddUser(passwdPath, "alice", "alice-pw"); err != nil {
+		t.Fatal(err)
+	}
+	agent, err := NewAgent(passwdPath, filepath.Join(dir, "keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+
+	if err := AddUser(passwdPath, "bob", "bob-pw"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteUser(passwdPath, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	agent.checked.Store(time.Now().Add(-statInterval).UnixNano())
+	if exists, _ := agent.UserExists(context.Background(), "bob"); !exists {
+		t.Error("expected bob to exist after reload")
+	}
+	if exists, _ := agent.UserExists(context.Background(), "alice"); exists {
+		t.Error("expected alice to be gone after reload")
+	}
+}
+
+// writeLargePasswd writes a passwd file of n users, user0 to user<n-1>,
+// all with the password "pw" hashed at the lowest cost.
+func writeLargePasswd(b *testing.B, n int) string {
+	b.Helper()
+	hash, err := HashPasswordWithParams("pw", Argon2Params{Time: 1, Memory: 8, Threads: 1})
+	if err != nil {
+		b.Fatal(err)
+	}
+	var sb strings.Builder
+	for i := range n {
+		fmt.Fprintf(&sb, "user%d:%s:user%d\n", i, hash, i)
+	}
+	passwdPath := filepath.Join(b.TempDir(), "passwd")
+	if err := os.WriteFile(passwdPath, []byte(sb.String()), 0o600); err != nil {
+		b.Fatal(err)
+	}
+	return passwdPath
+}
+
+// benchmarkModes runs fn against an agent of each kind over a passwd
+// file of 100,000 users.
+func benchmarkModes(b *testing.B, fn func(b *testing.B, agent *Agent)) {
+	passwdPath := writeLargePasswd(b, 100000)
+	if _, err := CompilePasswd(passwdPath); err != nil {
+		b.Fatal(err)
+	}
+	for name, open := range map[string]func(string, string, ...Option) (*Agent, error){
+		"text":   NewAgent,
+		"mapped": NewMappedAgent,
+		"cdb":    NewCDBAgent,
+	} {
+		b.Run(name, func(b *testing.B) {
+			agent, err := open(passwdPath, b.TempDir())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer func() { _ = agent.Close() }()
+			fn(b, agent.WithArgon2Params(Argon2Params{Time: 1, Memory: 8, Threads: 1}))
+		})
+	}
+}
+
+func BenchmarkUserExists_100k(b *testing.B) {
+	benchmarkModes(b, func(b *testing.B, agent *Agent) {
+		for b.Loop() {
+			if exists, _ := agent.UserExists(context.Background(), "user54321"); !exists {
+				b.Fatal("user54321 not found")
+			}
+		}
+	})
+}
+
+func BenchmarkAuthenticate_100k(b *testing.B) {
+	benchmarkModes(b, func(b *testing.B, agent *Agent) {
+		for b.Loop() {
+			session, err := agent.Authenticate(context.Background(), "user54321", "pw")
+			if err != nil {
+				b.Fatal(err)
+			}
+			session.Clear()
+		}
+	})
+}
+
+func BenchmarkLoadPasswd_100k(b *testing.B) {
+	agent := &Agent{passwdPath: writeLargePasswd(b, 100000)}
+	for b.Loop() {
+		if err := agent.loadPasswd(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package passwd
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// PepperEnv is the environment variable LoadPeppersFromEnv and the
+// commands read the pepper file path from.
+const PepperEnv = "INFODANCER_PEPPER_FILE"
+
+// minPepperSize is the shortest pepper secret accepted, in bytes.
+const minPepperSize = 16
+
+// Peppers are server-side secrets mixed into password hashes, so that a
+// stolen passwd file cannot be attacked without them. Each has an ID that
+// argon2id hashes record in their keyid parameter:
+//
+//	$argon2id$v=19$m=65536,t=3,p=4,keyid=2026a$salt$hash
+//
+// so a pepper can be rotated by adding a new current one and keeping the
+// old one until every hash using it has been upgraded at login (see
+// WithArgon2Params). Hashes without a keyid are verified without a pepper.
+//
+// Agents use the peppers they are given (see Agent.WithPeppers and the
+// "pepper_file" option); the package-level functions use those installed
+// with SetPeppers.
+type Peppers struct {
+	// Current is the ID of the pepper new hashes use.
+	Current string
+
+	// Secrets maps pepper IDs to secrets.
+	Secrets map[string][]byte
+}
+
+// validate rejects peppers that cannot be used or recorded in a hash.
+func (p *Peppers) validate() error {
+	if _, ok := p.Secrets[p.Current]; !ok {
+		return fmt.Errorf("current pepper %q has no secret", p.Current)
+	}
+	for id, secret := range p.Secrets {
+		if !validPepperID(id) {
+			return fmt.Errorf("pepper id %q must be 1-32 letters, digits or dashes", id)
+		}
+		if len(secret) < minPepperSize {
+			return fmt.Errorf("pepper %q must be at least %d bytes", id, minPepperSize)
+		}
+	}
+	return nil
+}
+
+// validPepperID reports whether id can be a keyid in a PHC string.
+func validPepperID(id string) bool {
+	if id == "" || len(id) > 32 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	pepperMu sync.RWMutex
+	peppers  *Peppers
+)
+
+// SetPeppers installs p as the peppers of the package-level functions:
+// HashPassword, VerifyPassword and the management functions built on them,
+// such as AddUser and ChangePassword, as run by management tools. Agents
+// do not use them (see Agent.WithPeppers). nil removes them: new hashes
+// are made without a pepper and peppered hashes no longer verify.
+func SetPeppers(p *Peppers) error {
+	if p != nil {
+		if err := p.validate(); err != nil {
+			return err
+		}
+	}
+	pepperMu.Lock()
+	defer pepperMu.Unlock()
+	peppers = p
+	return nil
+}
+
+// WithPeppers sets the peppers the agent verifies peppered hashes with and
+// mixes into the hashes it writes. nil, the default, means none: peppered
+// hashes then match no password. Invalid peppers are ignored.
+func (a *Agent) WithPeppers(p *Peppers) *Agent {
+	if p != nil {
+		if err := p.validate(); err != nil {
+			slog.Warn("ignoring invalid peppers", "error", err)
+			return a
+		}
+	}
+	a.peppers = p
+	return a
+}
+
+// installedPeppers returns the peppers installed with SetPeppers, or nil.
+func installedPeppers() *Peppers {
+	pepperMu.RLock()
+	defer pepperMu.RUnlock()
+	return peppers
+}
+
+// secret returns the secret of pepper id. A nil p has none.
+func (p *Peppers) secret(id string) ([]byte, bool) {
+	if p == nil {
+		return nil, false
+	}
+	secret, ok := p.Secrets[id]
+	return secret, ok
+}
+
+// current returns the ID and secret new hashes use; "" and nil for a nil
+// p.
+func (p *Peppers) current() (string, []byte) {
+	if p == nil {
+		return "", nil
+	}
+	return p.Current, p.Secrets[p.Current]
+}
+
+// pepperPassword mixes secret into password: HMAC-SHA256 keyed with the
+// pepper, the input argon2id hashes instead of the password.
+func pepperPassword(password string, secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+// LoadPeppers reads a pepper file: one "id:hex-secret" line per pepper,
+// with blank lines and lines starting with "#" ignored. The last pepper is
+// the current one, so rotating means appending a line. The file should be
+// readable only by the mail system, like a host key.
+func LoadPeppers(path string) (*Peppers, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("read pepper file: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	p := &Peppers{Secrets: make(map[string][]byte)}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(line, ":")
+		secret, err := hex.DecodeString(encoded)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("invalid pepper in %s:%d", path, n)
+		}
+		if _, dup := p.Secrets[id]; dup {
+			return nil, fmt.Errorf("duplicate pepper %q in %s:%d", id, path, n)
+		}
+		p.Secrets[id] = secret
+		p.Current = id
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read pepper file: %w", err)
+	}
+	if len(p.Secrets) == 0 {
+		return nil, fmt.Errorf("no peppers in %s", path)
+	}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return p, nil
+}
+
+// LoadPeppersFromEnv installs the peppers in the file named by
+// $INFODANCER_PEPPER_FILE, if set, for the package-level functions (see
+// SetPeppers). Returns false with no error when the variable is unset.
+func LoadPeppersFromEnv() (bool, error) {
+	path := os.Getenv(PepperEnv)
+	if path == "" {
+		return false, nil
+	}
+	p, err := LoadPeppers(path)
+	if err != nil {
+		return false, err
+	}
+	return true, SetPeppers(p)
+}
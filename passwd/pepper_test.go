@@ -0,0 +1,178 @@
+package passwd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// withPeppers installs p for the duration of the test.
+func withPeppers(t *testing.T, p *Peppers) {
+	t.Helper()
+	if err := SetPeppers(p); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = SetPeppers(nil) })
+}
+
+func TestLoadPeppers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peppers")
+	content := "# rotated 2026-10\nold:" + strings.Repeat("aa", 32) + "\n\nnew:" + strings.Repeat("bb", 32) + "\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := LoadPeppers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Current != "new" || len(p.Secrets) != 2 || p.Secrets["old"][0] != 0xaa {
+		t.Errorf("peppers = %+v", p)
+	}
+
+	for _, bad := range []string{
+		"",
+		"nocolon\n",
+		"a:zz\n",
+		"short:" + strings.Repeat("aa", 8) + "\n",
+		"bad$id:" + strings.Repeat("aa", 32) + "\n",
+		"a:" + strings.Repeat("aa", 32) + "\na:" + strings.Repeat("bb", 32) + "\n",
+	} {
+		if err := os.WriteFile(path, []byte(bad), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadPeppers(path); err == nil {
+			t.Errorf("LoadPeppers accepted %q", bad)
+		}
+	}
+}
+
+func TestHashPassword_Pepper(t *testing.T) {
+	plain, err := HashPasswordWithParams("pw", cheapParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withPeppers(t, &Peppers{Current: "k1", Secrets: map[string][]byte{"k1": []byte(strings.Repeat("s", 32))}})
+	peppered, err := HashPasswordWithParams("pw", cheapParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(peppered, ",keyid=k1$") {
+		t.Fatalf("hash %q has no keyid", peppered)
+	}
+	if !VerifyPassword("pw", peppered) || VerifyPassword("wrong", peppered) {
+		t.Error("peppered hash did not verify")
+	}
+	if !VerifyPassword("pw", plain) {
+		t.Error("unpeppered hash no longer verifies")
+	}
+
+	// A hash made with the right password but another pepper must fail.
+	withPeppers(t, &Peppers{Current: "k1", Secrets: map[string][]byte{"k1": []byte(strings.Repeat("t", 32))}})
+	if VerifyPassword("pw", peppered) {
+		t.Error("hash verified with a different pepper")
+	}
+	withPeppers(t, nil)
+	if VerifyPassword("pw", peppered) {
+		t.Error("peppered hash verified without its pepper")
+	}
+}
+
+func TestAuthenticate_PepperRotation(t *testing.T) {
+	k1 := []byte(strings.Repeat("1", 32))
+	k2 := []byte(strings.Repeat("2", 32))
+	withPeppers(t, &Peppers{Current: "k1", Secrets: map[string][]byte{"k1": k1}})
+
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	if err := AddUser(passwdPath, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	agent, err := NewAgent(passwdPath, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+
+	agent.WithPeppers(&Peppers{Current: "k2", Secrets: map[string][]byte{"k1": k1, "k2": k2}})
+	if _, err := agent.Authenticate(context.Background(), "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	users, err := ListUsers(passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(users[0].Hash, ",keyid=k2$") {
+		t.Fatalf("hash not rotated to k2: %q", users[0].Hash)
+	}
+
+	// Once rotated, the old pepper can be retired.
+	agent.WithPeppers(&Peppers{Current: "k2", Secrets: map[string][]byte{"k2": k2}})
+	if _, err := agent.Authenticate(context.Background(), "alice", "pw"); err != nil {
+		t.Errorf("login after retiring k1: %v", err)
+	}
+}
+
+func TestAuthenticate_AgentPeppers(t *testing.T) {
+	k1 := &Peppers{Current: "k1", Secrets: map[string][]byte{"k1": []byte(strings.Repeat("1", 32))}}
+	withPeppers(t, k1)
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	if err := AddUser(passwdPath, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Agents use their own peppers, not those installed with SetPeppers.
+	plain, err := NewAgent(passwdPath, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = plain.Close() }()
+	if _, err := plain.Authenticate(context.Background(), "alice", "pw"); err == nil {
+		t.Error("agent without peppers verified a peppered hash")
+	}
+
+	path := filepath.Join(t.TempDir(), "peppers")
+	if err := os.WriteFile(path, []byte("k1:"+strings.Repeat("31", 32)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	agent, err := auth.OpenAuthAgent(auth.AuthAgentConfig{
+		Type:              "passwd",
+		CredentialBackend: passwdPath,
+		KeyBackend:        t.TempDir(),
+		Options:           map[string]string{"pepper_file": path},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	if _, err := agent.Authenticate(context.Background(), "alice", "pw"); err != nil {
+		t.Errorf("Authenticate with pepper_file: %v", err)
+	}
+
+	_, err = auth.OpenAuthAgent(auth.AuthAgentConfig{
+		Type:              "passwd",
+		CredentialBackend: passwdPath,
+		KeyBackend:        t.TempDir(),
+		Options:           map[string]string{"pepper_file": filepath.Join(t.TempDir(), "missing")},
+	})
+	if !errors.Is(err, autherrors.ErrAuthAgentConfigInvalid) {
+		t.Errorf("missing pepper_file: got %v, want ErrAuthAgentConfigInvalid", err)
+	}
+}
+
+func TestSetPeppers_Invalid(t *testing.T) {
+	for _, p := range []*Peppers{
+		{Current: "missing", Secrets: map[string][]byte{"k1": []byte(strings.Repeat("s", 32))}},
+		{Current: "k1", Secrets: map[string][]byte{"k1": []byte("short")}},
+	} {
+		if err := SetPeppers(p); err == nil {
+			_ = SetPeppers(nil)
+			t.Errorf("SetPeppers(%+v) accepted", p)
+		}
+	}
+}
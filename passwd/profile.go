@@ -0,0 +1,229 @@
+package passwd
+
+import (
+	"bufio"
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/infodancer/auth/atrest"
+	"github.com/infodancer/auth/vfs"
+)
+
+// Entry versions
+//
+// A v1 entry has up to six colon-separated fields:
+//
+//	username:hash[:mailbox[:uid[:flags[:changed]]]]
+//
+// A v2 entry keeps them in place and adds the user's profile (see Profile):
+//
+//	username:hash:mailbox:uid:flags:changed:gid:quota[:name[:attrs]]
+//
+// gid and quota (in bytes, 0 for none) are numbers, name is the display
+// name, and attrs holds key=value attributes separated by ";". In the name
+// and attributes, "%", ":", ";", "=" and control characters are written as
+// %XX. An entry with more than six fields is v2; the two can be mixed in
+// one file, and MigratePasswd rewrites v1 entries as v2. Releases that
+// predate v2 cannot parse a v2 entry's password change time, so for them
+// its password never expires.
+
+const (
+	v1Fields = 6
+	v2Fields = 10
+)
+
+// Profile holds the fields a v2 entry adds to a v1 entry.
+type Profile struct {
+	// Gid is the user's numeric group id, 0 when none is assigned.
+	Gid uint32
+
+	// Quota is the user's mailbox quota in bytes, 0 for no limit.
+	Quota uint64
+
+	// DisplayName is the user's full name.
+	DisplayName string
+
+	// Attributes holds site-specific key=value pairs. Keys are not empty.
+	Attributes map[string]string
+}
+
+// parseProfile parses the fields after the sixth of a v2 entry. Values that
+// do not parse are ignored, as a uid that is not a number is.
+func parseProfile(fields []string) Profile {
+	var p Profile
+	field := func(i int) string {
+		if i < len(fields) {
+			return fields[i]
+		}
+		return ""
+	}
+	if gid, err := strconv.ParseUint(field(0), 10, 32); err == nil {
+		p.Gid = uint32(gid)
+	}
+	p.Quota, _ = strconv.ParseUint(field(1), 10, 64)
+	p.DisplayName, _ = url.PathUnescape(field(2))
+	p.Attributes, _ = parseAttributes(field(3))
+	return p
+}
+
+// fields returns p as the fields after the sixth of a v2 entry, leaving
+// out the name and attributes when they are empty.
+func (p Profile) fields() []string {
+	fields := []string{
+		strconv.FormatUint(uint64(p.Gid), 10),
+		strconv.FormatUint(p.Quota, 10),
+		escapeField(p.DisplayName),
+		formatAttributes(p.Attributes),
+	}
+	for len(fields) > 2 && fields[len(fields)-1] == "" {
+		fields = fields[:len(fields)-1]
+	}
+	return fields
+}
+
+// parseAttributes parses an attrs field. ok is false if any pair is
+// malformed; the pairs that parse are returned either way.
+func parseAttributes(field string) (attrs map[string]string, ok bool) {
+	ok = true
+	for _, pair := range strings.Split(field, ";") {
+		if pair == "" {
+			continue
+		}
+		k, v, found := strings.Cut(pair, "=")
+		key, kerr := url.PathUnescape(k)
+		value, verr := url.PathUnescape(v)
+		if !found || key == "" || kerr != nil || verr != nil {
+			ok = false
+			continue
+		}
+		if attrs == nil {
+			attrs = make(map[string]string)
+		}
+		attrs[key] = value
+	}
+	return attrs, ok
+}
+
+// formatAttributes formats attrs for the attrs field, sorted by key.
+func formatAttributes(attrs map[string]string) string {
+	pairs := make([]string, 0, len(attrs))
+	for _, k := range slices.Sorted(maps.Keys(attrs)) {
+		pairs = append(pairs, escapeField(k)+"="+escapeField(attrs[k]))
+	}
+	return strings.Join(pairs, ";")
+}
+
+// escapeField percent-encodes the characters a name or attribute cannot
+// hold as they are.
+func escapeField(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c == 0x7f || strings.IndexByte("%:;=", c) >= 0 {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// SetProfile replaces the profile of username's entry with p, making it a
+// v2 entry. The change is recorded in the mutation journal and can be
+// undone (see Undo). Returns an error if the user does not exist or an
+// attribute key is empty, and errors.ErrReadOnly in read-only mode.
+func SetProfile(passwdPath, username string, p Profile) error {
+	if err := checkWritable(vfs.OS{}, passwdPath); err != nil {
+		return err
+	}
+	if _, ok := p.Attributes[""]; ok {
+		return fmt.Errorf("attribute key is empty")
+	}
+	var found bool
+	_, err := updateEntry(vfs.OS{}, passwdPath, username, OpProfile, func(parts []string) ([]string, bool) {
+		found = true
+		parts = append(padFields(parts, username, v1Fields)[:v1Fields], p.fields()...)
+		return parts, true
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("user %q not found", username)
+	}
+	return nil
+}
+
+// MigratePasswd rewrites every v1 entry of passwdPath, a passwd file or
+// shard directory, as a v2 entry with an empty profile, and returns how
+// many it rewrote. Comments, blank lines and v2 entries are kept as they
+// are. No user's data changes, so the rewrite is not journaled. Returns
+// errors.ErrReadOnly in read-only mode.
+func MigratePasswd(passwdPath string) (int, error) {
+	if err := checkWritable(vfs.OS{}, passwdPath); err != nil {
+		return 0, err
+	}
+	l, err := lockPasswd(vfs.OS{}, passwdPath)
+	if err != nil {
+		return 0, err
+	}
+	defer l.release()
+	files, err := passwdFiles(vfs.OS{}, passwdPath)
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, path := range files {
+		lines, n, err := migrateFile(vfs.OS{}, path)
+		if err != nil {
+			return total, err
+		}
+		if n == 0 {
+			continue
+		}
+		if err := l.check(); err != nil {
+			return total, err
+		}
+		if err := writePasswd(vfs.OS{}, path, lines); err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// migrateFile returns the lines of one passwd file with its v1 entries
+// rewritten as v2, and how many were. A missing file has none.
+func migrateFile(fsys vfs.FS, path string) ([]string, int, error) {
+	f, err := atrest.OpenFS(fsys, path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, fmt.Errorf("open passwd file: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	var lines []string
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		parts := strings.Split(strings.TrimSpace(line), ":")
+		if entry, ok := parseEntry(line); ok && len(parts) <= v1Fields {
+			parts = append(padFields(parts, entry.username, v1Fields), Profile{}.fields()...)
+			line = strings.Join(parts, ":")
+			n++
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, fmt.Errorf("read passwd file: %w", err)
+	}
+	return lines, n, nil
+}
@@ -0,0 +1,182 @@
+package passwd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/infodancer/auth/diagnostic"
+)
+
+func TestParseEntry_V2(t *testing.T) {
+	entry, ok := parseEntry("alice:HASH:alice:1001:locked:1700000000:100:5000:Alice%3A Smith:dept=ops;tags=a%3Bb%3Dc")
+	if !ok {
+		t.Fatal("v2 entry not parsed")
+	}
+	want := Profile{
+		Gid:         100,
+		Quota:       5000,
+		DisplayName: "Alice: Smith",
+		Attributes:  map[string]string{"dept": "ops", "tags": "a;b=c"},
+	}
+	if !reflect.DeepEqual(entry.profile, want) {
+		t.Errorf("profile = %+v, want %+v", entry.profile, want)
+	}
+	if entry.uid != 1001 || entry.changed.Unix() != 1700000000 || !slices.Equal(entry.flags, []string{"locked"}) {
+		t.Errorf("v1 fields = %d, %v, %v", entry.uid, entry.changed, entry.flags)
+	}
+
+	for _, line := range []string{"alice:HASH", "alice:HASH:alice:1001::1700000000"} {
+		entry, ok := parseEntry(line)
+		if !ok || !reflect.DeepEqual(entry.profile, Profile{}) {
+			t.Errorf("%q: profile = %+v, %v; want zero", line, entry.profile, ok)
+		}
+	}
+}
+
+func TestProfile_FieldsRoundTrip(t *testing.T) {
+	for _, p := range []Profile{
+		{},
+		{Gid: 7},
+		{Quota: 1 << 40, DisplayName: "Zoë O'Neil"},
+		{Attributes: map[string]string{"k%:;=": "v\n%:;="}},
+	} {
+		fields := p.fields()
+		if got := parseProfile(fields); !reflect.DeepEqual(got, p) {
+			t.Errorf("%q = %+v, want %+v", strings.Join(fields, ":"), got, p)
+		}
+		for _, f := range fields {
+			if strings.ContainsAny(f, ":\n") {
+				t.Errorf("field %q is not escaped", f)
+			}
+		}
+	}
+}
+
+func TestSetProfile(t *testing.T) {
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	if err := AddUser(passwdPath, "alice", "alice-pw"); err != nil {
+		t.Fatal(err)
+	}
+	p := Profile{Gid: 100, Quota: 1 << 30, DisplayName: "Alice Smith", Attributes: map[string]string{"dept": "ops"}}
+	if err := SetProfile(passwdPath, "alice", p); err != nil {
+		t.Fatalf("SetProfile: %v", err)
+	}
+	users, err := ListUsers(passwdPath)
+	if err != nil || len(users) != 1 || !reflect.DeepEqual(users[0].Profile, p) {
+		t.Fatalf("ListUsers = %+v, %v", users, err)
+	}
+	if users[0].PasswordChanged.IsZero() {
+		t.Error("SetProfile lost the password change time")
+	}
+
+	agent, err := NewAgent(passwdPath, filepath.Join(dir, "keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	session, err := agent.Authenticate(t.Context(), "alice", "alice-pw")
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	defer session.Clear()
+	u := session.User
+	if u.Gid != 100 || u.Quota != 1<<30 || u.DisplayName != "Alice Smith" || u.Attributes["dept"] != "ops" {
+		t.Errorf("session user = %+v", u)
+	}
+
+	if err := SetProfile(passwdPath, "bob", p); err == nil {
+		t.Error("expected SetProfile of a missing user to fail")
+	}
+	if err := SetProfile(passwdPath, "alice", Profile{Attributes: map[string]string{"": "x"}}); err == nil {
+		t.Error("expected an empty attribute key to be refused")
+	}
+
+	if _, err := Undo(passwdPath, 1); err != nil {
+		t.Fatalf("Undo: %v", err)
+	}
+	users, _ = ListUsers(passwdPath)
+	if len(users) != 1 || !reflect.DeepEqual(users[0].Profile, Profile{}) {
+		t.Errorf("after Undo: %+v", users)
+	}
+}
+
+func TestMigratePasswd(t *testing.T) {
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	content := "# users\nalice:HASH\nbob:HASH:bobbox:1002:locked:1700000000\n\ncarol:HASH:carol:1003:::200:0:Carol\n"
+	if err := os.WriteFile(passwdPath, []byte(content), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	before, err := ListUsers(passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := MigratePasswd(passwdPath)
+	if err != nil || n != 2 {
+		t.Fatalf("MigratePasswd = %d, %v; want 2", n, err)
+	}
+	data, err := os.ReadFile(passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# users\nalice:HASH:alice::::0:0\nbob:HASH:bobbox:1002:locked:1700000000:0:0\n\ncarol:HASH:carol:1003:::200:0:Carol\n"
+	if string(data) != want {
+		t.Errorf("migrated file:\n%s\nwant:\n%s", data, want)
+	}
+	after, err := ListUsers(passwdPath)
+	if err != nil || !reflect.DeepEqual(after, before) {
+		t.Errorf("users changed by migration:\n%+v\nwant\n%+v", after, before)
+	}
+
+	if n, err := MigratePasswd(passwdPath); err != nil || n != 0 {
+		t.Errorf("second MigratePasswd = %d, %v; want 0", n, err)
+	}
+}
+
+func TestMigratePasswd_Sharded(t *testing.T) {
+	shardDir := filepath.Join(t.TempDir(), "passwd.d")
+	if err := os.MkdirAll(shardDir, 0o750); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := HashPasswordWithParams("pw", timingParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []string{"alice", "bob", "carol"} {
+		if err := AddUserWithHash(shardDir, u, hash); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := MigratePasswd(shardDir); err != nil || n != 3 {
+		t.Fatalf("MigratePasswd = %d, %v; want 3", n, err)
+	}
+	if problems, err := Lint(shardDir); err != nil || slices.ContainsFunc(problems, func(p diagnostic.Problem) bool {
+		return strings.HasPrefix(p.Code, "passwd.bad-")
+	}) {
+		t.Errorf("Lint after migration: %v, %v", lintCodes(problems), err)
+	}
+}
+
+func TestLint_Profile(t *testing.T) {
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	content := "alice:{SHA}abc:alice:1001:::x:y:%zz:k=v;novalue\n"
+	if err := os.WriteFile(passwdPath, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := Lint(passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes := lintCodes(problems)
+	for _, want := range []string{"1:passwd.bad-gid", "1:passwd.bad-quota", "1:passwd.bad-profile"} {
+		if !slices.Contains(codes, want) {
+			t.Errorf("missing %s in %v", want, codes)
+		}
+	}
+}
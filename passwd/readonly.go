@@ -0,0 +1,47 @@
+package passwd
+
+import (
+	"path/filepath"
+
+	"github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/vfs"
+)
+
+// ReadOnlyMarker is the file that puts passwd files and key directories in
+// read-only mode: a path is read-only when the marker exists in its
+// directory or the one above it, as on a secondary whose domains directory
+// carries it (see domain.ReadOnlyMarker). In read-only mode AddUser,
+// DeleteUser, Undo, SplitPasswd and the other management functions return
+// errors.ErrReadOnly, and agents keep authenticating but never write.
+const ReadOnlyMarker = ".readonly"
+
+// WithReadOnly opens the agent in read-only mode, as if its files were
+// marked with ReadOnlyMarker: logins never rewrite the passwd file (hash
+// upgrades, SCRAM verifiers, reversible passwords) and key management
+// returns errors.ErrReadOnly. The domain provider sets it for the agents of
+// a read-only provider (see domain.FilesystemDomainProvider.WithReadOnly).
+func WithReadOnly() Option {
+	return func(a *Agent) { a.readOnly = true }
+}
+
+// checkWritable returns errors.ErrReadOnly if path on fsys is marked
+// read-only.
+func checkWritable(fsys vfs.FS, path string) error {
+	dir := filepath.Dir(path)
+	for range 2 {
+		if _, err := fsys.Stat(filepath.Join(dir, ReadOnlyMarker)); err == nil {
+			return errors.ErrReadOnly
+		}
+		dir = filepath.Dir(dir)
+	}
+	return nil
+}
+
+// writable returns errors.ErrReadOnly if the agent was opened read-only or
+// its passwd file is marked read-only.
+func (a *Agent) writable() error {
+	if a.readOnly {
+		return errors.ErrReadOnly
+	}
+	return checkWritable(a.files(), a.passwdPath)
+}
@@ -0,0 +1,110 @@
+package passwd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/vfs"
+)
+
+// markReadOnly puts ReadOnlyMarker beside path until the test ends.
+func markReadOnly(t *testing.T, path string) {
+	t.Helper()
+	marker := filepath.Join(filepath.Dir(path), ReadOnlyMarker)
+	if err := os.WriteFile(marker, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Remove(marker) })
+}
+
+func TestReadOnly_RejectsMutations(t *testing.T) {
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	if err := AddUser(passwdPath, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+
+	markReadOnly(t, passwdPath)
+
+	if err := AddUser(passwdPath, "bob", "pw"); !errors.Is(err, autherrors.ErrReadOnly) {
+		t.Errorf("AddUser: got %v, want ErrReadOnly", err)
+	}
+	if err := DeleteUser(passwdPath, "alice"); !errors.Is(err, autherrors.ErrReadOnly) {
+		t.Errorf("DeleteUser: got %v, want ErrReadOnly", err)
+	}
+	if _, err := Undo(passwdPath, 1); !errors.Is(err, autherrors.ErrReadOnly) {
+		t.Errorf("Undo: got %v, want ErrReadOnly", err)
+	}
+	if err := SplitPasswd(passwdPath, filepath.Join(dir, "passwd.d")); !errors.Is(err, autherrors.ErrReadOnly) {
+		t.Errorf("SplitPasswd: got %v, want ErrReadOnly", err)
+	}
+
+	// Reads and authentication are unaffected.
+	agent, err := NewAgent(passwdPath, filepath.Join(dir, "keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	session, err := agent.Authenticate(context.Background(), "alice", "pw")
+	if err != nil {
+		t.Fatalf("Authenticate in read-only mode: %v", err)
+	}
+	session.Clear()
+	if users, err := ListUsers(passwdPath); err != nil || len(users) != 1 {
+		t.Errorf("ListUsers = %v, %v", users, err)
+	}
+}
+
+func TestReadOnly_MarkerAboveDomain(t *testing.T) {
+	// The marker in the domains directory covers each domain's files.
+	base := t.TempDir()
+	passwdPath := filepath.Join(base, "example.com", "passwd")
+	if err := os.MkdirAll(filepath.Dir(passwdPath), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddUser(passwdPath, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	markReadOnly(t, filepath.Dir(passwdPath))
+	if err := AddUser(passwdPath, "bob", "pw"); !errors.Is(err, autherrors.ErrReadOnly) {
+		t.Errorf("AddUser: got %v, want ErrReadOnly", err)
+	}
+}
+
+func TestWithReadOnly_NoLoginWrites(t *testing.T) {
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	if err := AddUser(passwdPath, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agent, err := NewAgent(passwdPath, filepath.Join(dir, "keys"), WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	agent.WithArgon2Params(cheapParams).WithSCRAM(4096)
+
+	ctx := context.Background()
+	if _, err := agent.Authenticate(ctx, "alice", "pw"); err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if after, err := os.ReadFile(passwdPath); err != nil || !bytes.Equal(after, before) {
+		t.Errorf("read-only login rewrote the passwd file: %v", err)
+	}
+	if entries, err := scramStore.read(vfs.OS{}, passwdPath); err != nil || len(entries) != 0 {
+		t.Errorf("read-only login derived SCRAM credentials: %+v, %v", entries, err)
+	}
+	if _, err := agent.GenerateUserKeys(ctx, "alice", "pw"); !errors.Is(err, autherrors.ErrReadOnly) {
+		t.Errorf("GenerateUserKeys: got %v, want ErrReadOnly", err)
+	}
+}
@@ -1,8 +1,12 @@
 package passwd
 
 import (
+	"fmt"
+
 	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/atrest"
 	"github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/vfs"
 )
 
 func init() {
@@ -15,6 +19,89 @@ func init() {
 		if keyDir == "" {
 			return nil, errors.ErrAuthAgentConfigInvalid
 		}
-		return NewAgent(config.CredentialBackend, keyDir)
+		// Options["argon2_time"], ["argon2_memory"] and ["argon2_threads"]
+		// set the hash parameters logins upgrade to.
+		params, err := Argon2ParamsFromOptions(config.Options)
+		if err != nil {
+			return nil, err
+		}
+		// Options["password_max_age_days"] sets how long passwords last
+		// before logins report them expired.
+		maxAge, err := PasswordMaxAgeFromOptions(config.Options)
+		if err != nil {
+			return nil, err
+		}
+		// Options["scram"] = "true" derives SCRAM-SHA-256 verifiers as
+		// users log in, with Options["scram_iterations"] iterations.
+		scramIterations, err := SCRAMIterationsFromOptions(config.Options)
+		if err != nil {
+			return nil, err
+		}
+		// Options["reversible_key"] names a hex key file (see
+		// atrest.LoadKey) and turns on CRAM-MD5 and DIGEST-MD5 with
+		// passwords sealed under it. Off unless set.
+		var reversibleKey *atrest.Key
+		if path := config.Options["reversible_key"]; path != "" {
+			if reversibleKey, err = atrest.LoadKey(path); err != nil {
+				return nil, fmt.Errorf("%w: reversible_key: %v", errors.ErrAuthAgentConfigInvalid, err)
+			}
+		}
+		// Options["pepper_file"] names a pepper file (see LoadPeppers)
+		// whose peppers the agent hashes and verifies with.
+		var peppers *Peppers
+		if path := config.Options["pepper_file"]; path != "" {
+			if peppers, err = LoadPeppers(path); err != nil {
+				return nil, fmt.Errorf("%w: pepper_file: %v", errors.ErrAuthAgentConfigInvalid, err)
+			}
+		}
+		// config.FS, when set, replaces the local disk (see WithFS); one
+		// that cannot be written is served read-only.
+		var opts []Option
+		readOnly := config.ReadOnly
+		if config.FS != nil {
+			fsys, ok := config.FS.(vfs.WriteFS)
+			if !ok {
+				fsys, readOnly = vfs.ReadOnly(config.FS), true
+			}
+			opts = append(opts, WithFS(fsys))
+		}
+		if readOnly {
+			opts = append(opts, WithReadOnly())
+		}
+		if config.Leases != nil {
+			opts = append(opts, WithLeaseManager(config.Leases))
+		}
+		// Options["mmap"] = "true" selects the memory-mapped read-only mode.
+		if config.Options["mmap"] == "true" {
+			a, err := NewMappedAgent(config.CredentialBackend, keyDir, opts...)
+			if err != nil {
+				return nil, err
+			}
+			return a.WithPasswordMaxAge(maxAge).WithPeppers(peppers).WithReversiblePasswords(reversibleKey), nil
+		}
+		// Options["cdb"] = "true" selects the compiled read-only mode (see
+		// CompilePasswd).
+		if config.Options["cdb"] == "true" {
+			a, err := NewCDBAgent(config.CredentialBackend, keyDir, opts...)
+			if err != nil {
+				return nil, err
+			}
+			return a.WithPasswordMaxAge(maxAge).WithPeppers(peppers).WithReversiblePasswords(reversibleKey), nil
+		}
+		// Options["escrow_pubkey"] is a base64 recovery public key new
+		// private keys are escrowed to (see WithEscrowKey).
+		var escrowKey []byte
+		if v := config.Options["escrow_pubkey"]; v != "" {
+			if escrowKey, err = ParseEscrowKey(v); err != nil {
+				return nil, fmt.Errorf("%w: escrow_pubkey: %v", errors.ErrAuthAgentConfigInvalid, err)
+			}
+		}
+		a, err := NewAgent(config.CredentialBackend, keyDir, opts...)
+		if err != nil {
+			return nil, err
+		}
+		// Options["upgrade_hashes"] = "true" replaces bcrypt, scrypt and
+		// SHA-512 crypt hashes with argon2id ones as users log in.
+		return a.WithArgon2Params(params).WithHashUpgrade(config.Options["upgrade_hashes"] == "true").WithPasswordMaxAge(maxAge).WithPeppers(peppers).WithSCRAM(scramIterations).WithReversiblePasswords(reversibleKey).WithEscrowKey(escrowKey), nil
 	})
 }
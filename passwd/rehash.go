@@ -0,0 +1,238 @@
+package passwd
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/infodancer/auth/atrest"
+	"github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/vfs"
+)
+
+// Argon2Params are the argon2id cost parameters of password hashes.
+type Argon2Params struct {
+	// Time is the number of passes over memory.
+	Time uint32
+
+	// Memory is the memory cost in KiB.
+	Memory uint32
+
+	// Threads is the degree of parallelism.
+	Threads uint8
+}
+
+// DefaultArgon2Params are the parameters HashPassword uses: 3 passes over
+// 64 MiB with 4 threads.
+var DefaultArgon2Params = Argon2Params{Time: argon2Time, Memory: argon2Memory, Threads: argon2Threads}
+
+// validate rejects parameters argon2 cannot use.
+func (p Argon2Params) validate() error {
+	switch {
+	case p.Time < 1:
+		return fmt.Errorf("argon2 time must be at least 1")
+	case p.Threads < 1:
+		return fmt.Errorf("argon2 threads must be at least 1")
+	case p.Memory < 8*uint32(p.Threads):
+		return fmt.Errorf("argon2 memory must be at least 8 KiB per thread")
+	}
+	return nil
+}
+
+// Argon2ParamsFromOptions reads argon2id parameters from auth agent
+// options: "argon2_time", "argon2_memory" (KiB) and "argon2_threads".
+// Unset options keep their DefaultArgon2Params value. Invalid values fail
+// with errors.ErrAuthAgentConfigInvalid.
+func Argon2ParamsFromOptions(options map[string]string) (Argon2Params, error) {
+	p := DefaultArgon2Params
+	fields := []struct {
+		name string
+		bits int
+		set  func(uint64)
+	}{
+		{"argon2_time", 32, func(v uint64) { p.Time = uint32(v) }},
+		{"argon2_memory", 32, func(v uint64) { p.Memory = uint32(v) }},
+		{"argon2_threads", 8, func(v uint64) { p.Threads = uint8(v) }},
+	}
+	for _, f := range fields {
+		s := options[f.name]
+		if s == "" {
+			continue
+		}
+		v, err := strconv.ParseUint(s, 10, f.bits)
+		if err != nil {
+			return Argon2Params{}, fmt.Errorf("%w: %s: %v", errors.ErrAuthAgentConfigInvalid, f.name, err)
+		}
+		f.set(v)
+	}
+	if err := p.validate(); err != nil {
+		return Argon2Params{}, fmt.Errorf("%w: %v", errors.ErrAuthAgentConfigInvalid, err)
+	}
+	return p, nil
+}
+
+// WithArgon2Params sets the parameters the agent expects of password
+// hashes. After a successful Authenticate, a main password hash made with
+// other parameters is replaced with one made with p, so raising the cost
+// upgrades users as they log in. Likewise a hash made with a pepper other
+// than the agent's current one (see WithPeppers) is rehashed with it. Memory-mapped and
+// compiled agents and read-only mode (see WithReadOnly) never rewrite
+// hashes. Invalid parameters are ignored.
+func (a *Agent) WithArgon2Params(p Argon2Params) *Agent {
+	if err := p.validate(); err != nil {
+		slog.Warn("ignoring invalid argon2 parameters", "error", err)
+		return a
+	}
+	a.params = p
+	return a
+}
+
+// WithHashUpgrade sets whether a successful Authenticate replaces a main
+// password hash of another scheme, such as bcrypt or SHA-512 crypt (see
+// RegisterHashScheme), with an argon2id one. Like parameter upgrades, it
+// never happens in memory-mapped, compiled or read-only mode.
+func (a *Agent) WithHashUpgrade(upgrade bool) *Agent {
+	a.upgrade = upgrade
+	return a
+}
+
+// needsRehash reports whether hash was made with parameters or a pepper
+// other than the agent's, or with another scheme the agent upgrades.
+func (a *Agent) needsRehash(hash string) bool {
+	h, ok := parseArgon2Hash(hash)
+	if !ok {
+		return a.upgrade
+	}
+	p := a.argon2Params()
+	current, _ := a.peppers.current()
+	return h.time != p.Time || h.memory != p.Memory || h.threads != p.Threads ||
+		len(h.key) != argon2KeyLen || h.keyid != current
+}
+
+// argon2Params returns the agent's parameters, the defaults if none were
+// set.
+func (a *Agent) argon2Params() Argon2Params {
+	if a.params == (Argon2Params{}) {
+		return DefaultArgon2Params
+	}
+	return a.params
+}
+
+// rehash replaces entry's hash with one of password made with the agent's
+// parameters. It is best-effort: the login has already succeeded, so
+// failures are logged rather than returned.
+func (a *Agent) rehash(entry *userEntry, password string) {
+	if a.readOnlyView() || !a.needsRehash(entry.hash) || a.writable() != nil {
+		return
+	}
+	hash, err := hashPassword(password, a.argon2Params(), a.peppers)
+	if err != nil {
+		slog.Warn("password rehash failed", "user", entry.username, "error", err)
+		return
+	}
+	if err := replaceHash(a.writeFiles(), a.passwdPath, entry.username, entry.hash, hash); err != nil {
+		slog.Warn("password rehash failed", "user", entry.username, "error", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if cur := a.users[entry.username]; cur != nil && cur.hash == entry.hash {
+		upgraded := *cur
+		upgraded.hash = hash
+		a.users[entry.username] = &upgraded
+	}
+	slog.Debug("upgraded password hash", "user", entry.username)
+}
+
+// replaceHash rewrites username's entry in place with newHash, provided it
+// still holds oldHash; an entry changed meanwhile is left alone. The change
+// is recorded in the mutation journal.
+func replaceHash(fsys vfs.WriteFS, passwdPath, username, oldHash, newHash string) error {
+	_, err := updateEntry(fsys, passwdPath, username, OpRehash, func(parts []string) ([]string, bool) {
+		if parts[1] != oldHash {
+			return nil, false
+		}
+		parts[1] = newHash
+		return parts, true
+	})
+	return err
+}
+
+// updateEntry rewrites username's entry in place under the lock. edit gets
+// the entry's fields (at least username and hash) and returns the new
+// fields, or false to leave the entry alone. A change is journaled as op.
+// Returns false if the user has no entry or edit made no change.
+func updateEntry(fsys vfs.WriteFS, passwdPath, username, op string, edit func(parts []string) ([]string, bool)) (bool, error) {
+	l, err := lockPasswd(fsys, passwdPath)
+	if err != nil {
+		return false, err
+	}
+	defer l.release()
+	path := userFile(fsys, passwdPath, username)
+
+	f, err := atrest.OpenFS(fsys, path)
+	if err != nil {
+		return false, fmt.Errorf("open passwd file: %w", err)
+	}
+	var lines []string
+	var before, after string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		parts := strings.Split(strings.TrimSpace(line), ":")
+		if len(parts) >= 2 && parts[0] == username && before == "" {
+			if parts, ok := edit(parts); ok {
+				before = strings.TrimSpace(line)
+				after = strings.Join(parts, ":")
+				line = after
+			}
+		}
+		lines = append(lines, line)
+	}
+	err = scanner.Err()
+	_ = f.Close()
+	if err != nil {
+		return false, fmt.Errorf("read passwd file: %w", err)
+	}
+	if before == "" {
+		return false, nil
+	}
+
+	if err := l.check(); err != nil {
+		return false, err
+	}
+	if err := journal(fsys, passwdPath, JournalEntry{
+		Op:       op,
+		Username: username,
+		Before:   before,
+		After:    after,
+		Token:    l.token(),
+	}); err != nil {
+		return false, err
+	}
+	return true, writePasswd(fsys, path, lines)
+}
+
+// padFields extends an entry's fields to n, defaulting the mailbox to
+// username, so that a later field can be set.
+func padFields(parts []string, username string, n int) []string {
+	for len(parts) < n {
+		parts = append(parts, "")
+	}
+	if parts[2] == "" {
+		parts[2] = username
+	}
+	return parts
+}
+
+// trimFields drops empty trailing fields after the mailbox, so entries
+// stay in the shortest form that says the same.
+func trimFields(parts []string) []string {
+	for len(parts) > 3 && parts[len(parts)-1] == "" {
+		parts = parts[:len(parts)-1]
+	}
+	return parts
+}
@@ -0,0 +1,187 @@
+package passwd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/vfs"
+)
+
+// cheapParams keep rehash tests fast.
+var cheapParams = Argon2Params{Time: 1, Memory: 64, Threads: 1}
+
+func TestArgon2ParamsFromOptions(t *testing.T) {
+	p, err := Argon2ParamsFromOptions(nil)
+	if err != nil || p != DefaultArgon2Params {
+		t.Errorf("no options = %+v, %v", p, err)
+	}
+	p, err = Argon2ParamsFromOptions(map[string]string{"argon2_time": "2", "argon2_memory": "131072"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Argon2Params{Time: 2, Memory: 131072, Threads: argon2Threads}); p != want {
+		t.Errorf("params = %+v, want %+v", p, want)
+	}
+	for _, opts := range []map[string]string{
+		{"argon2_time": "fast"},
+		{"argon2_time": "0"},
+		{"argon2_threads": "256"},
+		{"argon2_threads": "4", "argon2_memory": "16"},
+	} {
+		if _, err := Argon2ParamsFromOptions(opts); !errors.Is(err, autherrors.ErrAuthAgentConfigInvalid) {
+			t.Errorf("%v: err = %v, want ErrAuthAgentConfigInvalid", opts, err)
+		}
+	}
+}
+
+func TestHashPasswordWithParams(t *testing.T) {
+	hash, err := HashPasswordWithParams("pw", cheapParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(hash, "$m=64,t=1,p=1$") || !VerifyPassword("pw", hash) {
+		t.Errorf("hash = %q", hash)
+	}
+	if _, err := HashPasswordWithParams("pw", Argon2Params{}); err == nil {
+		t.Error("zero params accepted")
+	}
+}
+
+func TestAuthenticate_Rehash(t *testing.T) {
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	if err := AddUser(passwdPath, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	agent, err := NewAgent(passwdPath, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	agent.WithArgon2Params(cheapParams)
+
+	storedHash := func() string {
+		users, err := ListUsers(passwdPath)
+		if err != nil || len(users) != 1 {
+			t.Fatalf("ListUsers = %v, %v", users, err)
+		}
+		return users[0].Hash
+	}
+	original := storedHash()
+
+	if _, err := agent.Authenticate(context.Background(), "alice", "wrong"); err == nil {
+		t.Fatal("wrong password accepted")
+	}
+	if storedHash() != original {
+		t.Fatal("failed login rewrote the hash")
+	}
+
+	if _, err := agent.Authenticate(context.Background(), "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	upgraded := storedHash()
+	if !strings.Contains(upgraded, "$m=64,t=1,p=1$") {
+		t.Fatalf("hash not upgraded: %q", upgraded)
+	}
+
+	// The cached entry and a fresh agent both use the new hash.
+	if _, err := agent.Authenticate(context.Background(), "alice", "pw"); err != nil {
+		t.Errorf("second login: %v", err)
+	}
+	if storedHash() != upgraded {
+		t.Error("login with current parameters rewrote the hash")
+	}
+	fresh, err := NewAgent(passwdPath, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = fresh.Close() }()
+	if _, err := fresh.Authenticate(context.Background(), "alice", "pw"); err != nil {
+		t.Errorf("fresh agent: %v", err)
+	}
+
+	entries, err := ReadJournal(passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := entries[len(entries)-1]; last.Op != OpRehash || last.Username != "alice" {
+		t.Errorf("last journal entry = %+v", last)
+	}
+
+	// Undo passes over the upgrade and rolls back the add.
+	undone, err := Undo(passwdPath, 1)
+	if err != nil || len(undone) != 1 || undone[0].Op != OpAdd {
+		t.Errorf("Undo = %+v, %v", undone, err)
+	}
+}
+
+// Login-time upgrades rewrite the passwd file; they must not drop entries
+// added meanwhile.
+func TestReplaceHash_ConcurrentWithAddUser(t *testing.T) {
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	hash, err := HashPasswordWithParams("pw", cheapParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AddUserWithHash(passwdPath, "alice", hash); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 100
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := AddUserWithHash(passwdPath, fmt.Sprintf("user%d", i), hash); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			// Swap alice's hash back and forth; only one of each pair of
+			// concurrent swaps matches.
+			_ = replaceHash(vfs.OS{}, passwdPath, "alice", hash, hash+"x")
+			_ = replaceHash(vfs.OS{}, passwdPath, "alice", hash+"x", hash)
+		}()
+	}
+	wg.Wait()
+
+	users, err := ListUsers(passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != n+1 {
+		t.Errorf("%d users after concurrent adds and rehashes, want %d", len(users), n+1)
+	}
+}
+
+func TestAuthenticate_RehashReadOnly(t *testing.T) {
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	if err := AddUser(passwdPath, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	agent, err := NewAgent(passwdPath, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	agent.WithArgon2Params(cheapParams)
+
+	markReadOnly(t, passwdPath)
+	if _, err := agent.Authenticate(context.Background(), "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	users, err := ListUsers(passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(users[0].Hash, "$m=64,") {
+		t.Error("read-only agent rewrote the hash")
+	}
+}
@@ -0,0 +1,178 @@
+package passwd
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/atrest"
+	"github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/sasl/crammd5"
+	"github.com/infodancer/auth/sasl/digestmd5"
+	"github.com/infodancer/auth/vfs"
+)
+
+// reversibleStore holds passwords sealed with a reversible-password key
+// (see WithReversiblePasswords), base64-encoded. It is kept apart from the
+// passwd file: the hashes there never depend on it, and removing it only
+// turns CRAM-MD5 and DIGEST-MD5 off.
+var reversibleStore = taggedFile{name: "reversible_passwords", what: "reversible passwords"}
+
+// SetReversiblePassword stores username's password sealed with key, so that
+// agents holding key can verify CRAM-MD5 and DIGEST-MD5 logins for them.
+// password must be the user's current password. The copy lasts until the
+// password changes. Anyone holding key and the file can read the password:
+// keep key apart from the domain directory, and prefer SCRAM (see
+// SetSCRAMCredentials) for clients that support it.
+//
+// A wrong password fails with errors.ErrAuthFailed, a missing user with
+// errors.ErrUserNotFound, and read-only mode with errors.ErrReadOnly.
+func SetReversiblePassword(passwdPath, username, password string, key *atrest.Key) error {
+	if err := checkWritable(vfs.OS{}, passwdPath); err != nil {
+		return err
+	}
+	if key == nil {
+		return fmt.Errorf("no reversible password key")
+	}
+	hash, err := verifiedHash(vfs.OS{}, passwdPath, username, password)
+	if err != nil {
+		return err
+	}
+	return storeReversible(vfs.OS{}, passwdPath, username, password, hash, key)
+}
+
+// ClearReversiblePassword removes username's reversible password, so
+// CRAM-MD5 and DIGEST-MD5 logins fail for them. Removing one that does not
+// exist is not an error. Returns errors.ErrReadOnly in read-only mode.
+func ClearReversiblePassword(passwdPath, username string) error {
+	if err := checkWritable(vfs.OS{}, passwdPath); err != nil {
+		return err
+	}
+	l, err := lockPasswd(vfs.OS{}, passwdPath)
+	if err != nil {
+		return err
+	}
+	defer l.release()
+	if err := l.check(); err != nil {
+		return err
+	}
+	return reversibleStore.remove(vfs.OS{}, passwdPath, username)
+}
+
+// storeReversible seals password with key and stores it for username,
+// tagged with hash, in place of any older copy.
+func storeReversible(fsys vfs.WriteFS, passwdPath, username, password, hash string, key *atrest.Key) error {
+	sealed, err := atrest.Seal(key, []byte(password))
+	if err != nil {
+		return err
+	}
+	return reversibleStore.set(fsys, passwdPath, username, hash, base64.RawStdEncoding.EncodeToString(sealed))
+}
+
+// WithReversiblePasswords turns on CRAM-MD5 and DIGEST-MD5 logins with
+// passwords sealed under key, which should be its own key rather than the
+// at-rest host key. A successful Authenticate with the main password
+// stores the user's password sealed under key when they have no current
+// copy; like hash upgrades, that never happens in memory-mapped, compiled
+// or read-only mode. nil turns it off, the default: the agent then neither
+// stores nor reads reversible passwords.
+func (a *Agent) WithReversiblePasswords(key *atrest.Key) *Agent {
+	a.reversibleKey = key
+	return a
+}
+
+// VerifyChallengeResponse verifies a CRAM-MD5 or DIGEST-MD5 login against
+// the user's reversible password and opens a session like Authenticate.
+// Users without a current reversible password, agents without
+// WithReversiblePasswords and other mechanisms fail with
+// errors.ErrMechanismUnsupported. Implements
+// auth.ChallengeResponseVerifier.
+func (a *Agent) VerifyChallengeResponse(ctx context.Context, creds auth.Credentials) (*auth.AuthSession, error) {
+	mechanism := strings.ToUpper(creds.Mechanism)
+	if a.reversibleKey == nil || (mechanism != crammd5.Mechanism && mechanism != digestmd5.Mechanism) {
+		return nil, fmt.Errorf("%w: %s", errors.ErrMechanismUnsupported, creds.Mechanism)
+	}
+	entry, ok := a.lookup(creds.Username)
+	if !ok {
+		return nil, errors.ErrUserNotFound
+	}
+	if err := checkStatus(entry); err != nil {
+		return nil, err
+	}
+	value, ok, err := reversibleStore.current(a.files(), a.passwdPath, entry)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: no reversible password for %s", errors.ErrMechanismUnsupported, creds.Username)
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("reversible password for %s: %w", creds.Username, err)
+	}
+	plain, err := atrest.Unseal(a.reversibleKey, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("reversible password for %s: %w", creds.Username, err)
+	}
+	password := string(plain)
+	clear(plain)
+
+	var serverResponse []byte
+	switch mechanism {
+	case crammd5.Mechanism:
+		ok = crammd5.Verify(password, creds.Challenge, creds.Response)
+	case digestmd5.Mechanism:
+		serverResponse, ok = digestmd5.Verify(password, creds.Challenge, creds.Response)
+	}
+	if !ok {
+		return nil, errors.ErrAuthFailed
+	}
+	session, err := a.authenticate(ctx, entry.username, password)
+	if err != nil {
+		return nil, err
+	}
+	session.ServerResponse = serverResponse
+	return session, nil
+}
+
+// dropReversible removes username's reversible password after their
+// password changed, so the old one does not linger on disk. The change
+// has already happened, so failures are logged rather than returned.
+func dropReversible(fsys vfs.WriteFS, passwdPath, username string) {
+	l, err := lockPasswd(fsys, passwdPath)
+	if err == nil {
+		defer l.release()
+		if err = l.check(); err == nil {
+			err = reversibleStore.remove(fsys, passwdPath, username)
+		}
+	}
+	if err != nil {
+		slog.Warn("removing reversible password failed", "user", username, "error", err)
+	}
+}
+
+// storeReversibleAtLogin stores the user's password if
+// WithReversiblePasswords is on and they have no current copy. Like
+// rehash it runs after a successful login, so failures are logged rather
+// than returned.
+func (a *Agent) storeReversibleAtLogin(username, password string) {
+	if a.reversibleKey == nil || a.readOnlyView() {
+		return
+	}
+	// rehash may have replaced the hash; tag the copy with the new one.
+	entry, ok := a.lookup(username)
+	if !ok {
+		return
+	}
+	if _, ok, err := reversibleStore.current(a.files(), a.passwdPath, entry); ok || err != nil || a.writable() != nil {
+		return
+	}
+	if err := storeReversible(a.writeFiles(), a.passwdPath, entry.username, password, entry.hash, a.reversibleKey); err != nil {
+		slog.Warn("storing reversible password failed", "user", entry.username, "error", err)
+		return
+	}
+	slog.Debug("stored reversible password", "user", entry.username)
+}
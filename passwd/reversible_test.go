@@ -0,0 +1,211 @@
+package passwd
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/atrest"
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/sasl/crammd5"
+	"github.com/infodancer/auth/sasl/digestmd5"
+	"github.com/infodancer/auth/vfs"
+)
+
+// newReversibleAgent returns a passwd file with alice and bob (password
+// "pw"), a reversible password key and an agent using it.
+func newReversibleAgent(t *testing.T) (string, *atrest.Key, *Agent) {
+	t.Helper()
+	passwdPath := newSCRAMUsers(t)
+	key, err := atrest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent, err := NewAgent(passwdPath, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = agent.Close() })
+	return passwdPath, key, agent.WithReversiblePasswords(key)
+}
+
+// cramCreds returns CRAM-MD5 credentials of username answering a fixed
+// challenge with password.
+func cramCreds(t *testing.T, username, password string) auth.Credentials {
+	t.Helper()
+	challenge := "<12345.1700000000@mail.example.com>"
+	m := hmac.New(md5.New, []byte(password))
+	m.Write([]byte(challenge))
+	creds, err := crammd5.Credentials([]byte(challenge), []byte(username+" "+hex.EncodeToString(m.Sum(nil))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return creds
+}
+
+func TestVerifyChallengeResponse_CRAMMD5(t *testing.T) {
+	ctx := context.Background()
+	passwdPath, key, agent := newReversibleAgent(t)
+
+	if _, err := agent.VerifyChallengeResponse(ctx, cramCreds(t, "alice", "pw")); !errors.Is(err, autherrors.ErrMechanismUnsupported) {
+		t.Errorf("before SetReversiblePassword: err = %v, want ErrMechanismUnsupported", err)
+	}
+	if err := SetReversiblePassword(passwdPath, "alice", "pw", key); err != nil {
+		t.Fatalf("SetReversiblePassword: %v", err)
+	}
+	session, err := agent.VerifyChallengeResponse(ctx, cramCreds(t, "alice", "pw"))
+	if err != nil {
+		t.Fatalf("VerifyChallengeResponse: %v", err)
+	}
+	if session.User.Username != "alice" || session.Credential.Kind != auth.CredentialPassword {
+		t.Errorf("session = %+v", session)
+	}
+	if _, err := agent.VerifyChallengeResponse(ctx, cramCreds(t, "alice", "wrong")); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("wrong password: err = %v, want ErrAuthFailed", err)
+	}
+	if _, err := agent.VerifyChallengeResponse(ctx, cramCreds(t, "carol", "pw")); !errors.Is(err, autherrors.ErrUserNotFound) {
+		t.Errorf("unknown user: err = %v, want ErrUserNotFound", err)
+	}
+
+	// The file holds no plaintext and is readable only by its owner.
+	data, err := os.ReadFile(reversibleStore.path(passwdPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), ":pw\n") {
+		t.Error("reversible password stored in the clear")
+	}
+	fi, _ := os.Stat(reversibleStore.path(passwdPath))
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("mode = %v, want 0600", fi.Mode().Perm())
+	}
+
+	// Through auth.VerifyCredentials, as the router calls it.
+	if _, err := auth.VerifyCredentials(ctx, agent, cramCreds(t, "alice", "pw")); err != nil {
+		t.Errorf("VerifyCredentials: %v", err)
+	}
+
+	if err := ClearReversiblePassword(passwdPath, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := agent.VerifyChallengeResponse(ctx, cramCreds(t, "alice", "pw")); !errors.Is(err, autherrors.ErrMechanismUnsupported) {
+		t.Errorf("after ClearReversiblePassword: err = %v", err)
+	}
+}
+
+func TestVerifyChallengeResponse_DigestMD5(t *testing.T) {
+	ctx := context.Background()
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	if err := AddUser(passwdPath, "chris", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	key, _ := atrest.GenerateKey()
+	if err := SetReversiblePassword(passwdPath, "chris", "secret", key); err != nil {
+		t.Fatal(err)
+	}
+	agent, err := NewAgent(passwdPath, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	agent.WithReversiblePasswords(key)
+
+	// RFC 2831, section 4.
+	challenge := `realm="elwood.innosoft.com",nonce="OA6MG9tEQGm2hh",qop="auth",algorithm=md5-sess,charset=utf-8`
+	response := `charset=utf-8,username="chris",realm="elwood.innosoft.com",nonce="OA6MG9tEQGm2hh",nc=00000001,cnonce="OA6MHXh6VqTrRk",digest-uri="imap/elwood.innosoft.com",response=d388dad90d4bbd760a152321f2143af7,qop=auth`
+	creds, err := digestmd5.Credentials([]byte(challenge), []byte(response))
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := agent.VerifyChallengeResponse(ctx, creds)
+	if err != nil {
+		t.Fatalf("VerifyChallengeResponse: %v", err)
+	}
+	if string(session.ServerResponse) != "rspauth=ea40f60335c427b5527b84dbabcdfffd" {
+		t.Errorf("ServerResponse = %q", session.ServerResponse)
+	}
+}
+
+func TestVerifyChallengeResponse_Off(t *testing.T) {
+	ctx := context.Background()
+	passwdPath, key, _ := newReversibleAgent(t)
+	if err := SetReversiblePassword(passwdPath, "alice", "pw", key); err != nil {
+		t.Fatal(err)
+	}
+
+	// An agent without the key verifies nothing, even with copies on disk.
+	plain, err := NewAgent(passwdPath, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = plain.Close() }()
+	if _, err := plain.VerifyChallengeResponse(ctx, cramCreds(t, "alice", "pw")); !errors.Is(err, autherrors.ErrMechanismUnsupported) {
+		t.Errorf("agent without key: err = %v, want ErrMechanismUnsupported", err)
+	}
+
+	// Another key cannot open the copies.
+	other, _ := atrest.GenerateKey()
+	plain.WithReversiblePasswords(other)
+	if _, err := plain.VerifyChallengeResponse(ctx, cramCreds(t, "alice", "pw")); !errors.Is(err, atrest.ErrUnseal) {
+		t.Errorf("wrong key: err = %v, want ErrUnseal", err)
+	}
+
+	creds := cramCreds(t, "alice", "pw")
+	creds.Mechanism = "NTLM"
+	if _, err := plain.VerifyChallengeResponse(ctx, creds); !errors.Is(err, autherrors.ErrMechanismUnsupported) {
+		t.Errorf("unknown mechanism: err = %v, want ErrMechanismUnsupported", err)
+	}
+}
+
+func TestReversiblePassword_Lifecycle(t *testing.T) {
+	ctx := context.Background()
+	passwdPath, key, agent := newReversibleAgent(t)
+
+	// A password login stores the copy.
+	if _, err := agent.Authenticate(ctx, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := agent.VerifyChallengeResponse(ctx, cramCreds(t, "alice", "pw")); err != nil {
+		t.Fatalf("after login: %v", err)
+	}
+
+	// A password change removes it.
+	if err := ChangePassword(passwdPath, t.TempDir(), "alice", "pw", "new"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := reversibleStore.read(vfs.OS{}, passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("entries after ChangePassword = %+v", entries)
+	}
+
+	if err := SetReversiblePassword(passwdPath, "bob", "wrong", key); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("wrong password: err = %v, want ErrAuthFailed", err)
+	}
+	if err := SetReversiblePassword(passwdPath, "bob", "pw", nil); err == nil {
+		t.Error("SetReversiblePassword without key succeeded")
+	}
+	if err := SetReversiblePassword(passwdPath, "bob", "pw", key); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteUser(passwdPath, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := reversibleStore.read(vfs.OS{}, passwdPath); len(entries) != 0 {
+		t.Errorf("entries after purging bob = %+v", entries)
+	}
+
+	markReadOnly(t, passwdPath)
+	if err := SetReversiblePassword(passwdPath, "alice", "new", key); !errors.Is(err, autherrors.ErrReadOnly) {
+		t.Errorf("read-only: err = %v, want ErrReadOnly", err)
+	}
+}
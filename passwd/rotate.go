@@ -0,0 +1,234 @@
+package passwd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/vfs"
+)
+
+const (
+	// retiredExt is the extension of a user's retired keys in the key
+	// directory: JSON lines, one per rotation, appended. Each holds the
+	// replaced key pair with its private key sealed under a subkey of the
+	// private key that replaced it, so the chain unlocks from the current
+	// key and password changes need not touch it.
+	retiredExt = ".retired"
+
+	// retiredKeyInfo separates the retired key sealing key from other
+	// uses of the private key.
+	retiredKeyInfo = "infodancer/auth passwd retired key v1"
+)
+
+// retiredKey is one line of a retired key file.
+type retiredKey struct {
+	// Retired is when the key was replaced.
+	Retired time.Time `json:"retired"`
+
+	// PublicKey is the replaced public key.
+	PublicKey []byte `json:"pub"`
+
+	// Under is the fingerprint (see keyFingerprint) of the public key
+	// whose private key seals Sealed.
+	Under string `json:"under"`
+
+	// Sealed is the replaced private key, sealed with sealWith.
+	Sealed []byte `json:"key"`
+}
+
+// keyFingerprint identifies a public key in a retired key file.
+func keyFingerprint(publicKey []byte) string {
+	sum := sha256.Sum256(publicKey)
+	return hex.EncodeToString(sum[:])
+}
+
+// RotateUserKeys replaces username's key pair with a new one, keeping the
+// old one as a retired key that logins still unlock (see
+// auth.AuthSession.RetiredKeys), and returns the new public key. secret
+// is whatever unlocks the key now: the login password or the key
+// passphrase, which then seals the new key as well. A TOTP secret is
+// resealed under the new key, and the new key escrowed as by
+// GenerateUserKeys.
+//
+// App passwords that unlock the key keep the old one only: their sessions
+// have the key locked until the app password is created anew.
+//
+// A user without a key pair fails with errors.ErrEncryptionNotEnabled, a
+// wrong secret with errors.ErrKeyDecryptFailed, and read-only mode with
+// errors.ErrReadOnly.
+func (a *Agent) RotateUserKeys(_ context.Context, username, secret string) ([]byte, error) {
+	if err := a.writable(); err != nil {
+		return nil, err
+	}
+	pubPath := filepath.Join(a.keyDir, username+publicKeyExt)
+	privPath := filepath.Join(a.keyDir, username+privateKeyExt)
+	oldPub, err := a.files().ReadFile(pubPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s has no key pair", errors.ErrEncryptionNotEnabled, username)
+		}
+		return nil, fmt.Errorf("read public key: %w", err)
+	}
+	encryptedKey, err := a.files().ReadFile(privPath)
+	if err != nil {
+		return nil, fmt.Errorf("read private key: %w", err)
+	}
+	oldPriv, err := decryptPrivateKey(encryptedKey, secret)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(oldPriv)
+
+	gen := a.keyGen
+	if gen == nil {
+		gen = GenerateX25519
+	}
+	newPub, newPriv, err := gen()
+	if err != nil {
+		return nil, err
+	}
+	defer clear(newPriv)
+	sealedNew, err := encryptPrivateKey(newPriv, secret)
+	if err != nil {
+		return nil, err
+	}
+	sealedOld, err := sealWith(oldPriv, newPriv, retiredKeyInfo)
+	if err != nil {
+		return nil, err
+	}
+	line, err := json.Marshal(retiredKey{
+		Retired:   time.Now().UTC(),
+		PublicKey: oldPub,
+		Under:     keyFingerprint(newPub),
+		Sealed:    sealedOld,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("encode retired key: %w", err)
+	}
+
+	// The retired key goes first, so that the old key is never lost; a
+	// record for a key that was not installed after all is never reached.
+	if err := a.files().AppendFile(filepath.Join(a.keyDir, username+retiredExt), append(line, '\n'), 0o600); err != nil {
+		return nil, fmt.Errorf("write retired key: %w", err)
+	}
+	if err := vfs.WriteFileAtomic(a.files(), privPath, sealedNew, 0o600); err != nil {
+		return nil, fmt.Errorf("write private key: %w", err)
+	}
+	if err := vfs.WriteFileAtomic(a.files(), pubPath, newPub, 0o644); err != nil {
+		return nil, fmt.Errorf("write public key: %w", err)
+	}
+	if err := a.writeEscrow(username, newPub, newPriv); err != nil {
+		return nil, err
+	}
+	if err := resealTOTP(a.files(), a.keyDir, username, oldPriv, newPriv); err != nil {
+		return nil, err
+	}
+	return newPub, nil
+}
+
+// resealTOTP moves username's TOTP secret, if any, from under oldPriv to
+// under newPriv.
+func resealTOTP(fsys vfs.WriteFS, keyDir, username string, oldPriv, newPriv []byte) error {
+	path := filepath.Join(keyDir, username+totpExt)
+	sealed, err := fsys.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("read totp secret: %w", err)
+	}
+	secret, err := openWith(sealed, oldPriv, totpKeyInfo)
+	if err != nil {
+		return err
+	}
+	defer clear(secret)
+	if sealed, err = sealWith(secret, newPriv, totpKeyInfo); err != nil {
+		return err
+	}
+	if err := vfs.WriteFileAtomic(fsys, path, sealed, 0o600); err != nil {
+		return fmt.Errorf("write totp secret: %w", err)
+	}
+	return nil
+}
+
+// readRetired returns username's retired key records, oldest first.
+func (a *Agent) readRetired(username string) ([]retiredKey, error) {
+	data, err := a.files().ReadFile(filepath.Join(a.keyDir, username+retiredExt))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read retired keys: %w", err)
+	}
+	var records []retiredKey
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var r retiredKey
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			continue // skip a torn final line
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
+
+// unlockRetired returns the key pairs retired before the key pair
+// (publicKey, privateKey), newest first, following the chain of records
+// each sealed under its successor.
+func (a *Agent) unlockRetired(username string, publicKey, privateKey []byte) ([]auth.KeyPair, error) {
+	records, err := a.readRetired(username)
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	byUnder := make(map[string]retiredKey, len(records))
+	for _, r := range records {
+		byUnder[r.Under] = r
+	}
+	var pairs []auth.KeyPair
+	pub, priv := publicKey, privateKey
+	for len(pairs) < len(records) {
+		r, ok := byUnder[keyFingerprint(pub)]
+		if !ok {
+			break
+		}
+		opened, err := openWith(r.Sealed, priv, retiredKeyInfo)
+		if err != nil {
+			for _, p := range pairs {
+				clear(p.PrivateKey)
+			}
+			return nil, fmt.Errorf("unlock retired key: %w", err)
+		}
+		pairs = append(pairs, auth.KeyPair{PublicKey: r.PublicKey, PrivateKey: opened})
+		pub, priv = r.PublicKey, opened
+	}
+	return pairs, nil
+}
+
+// isCurrentKey reports whether privateKey, unsealed by an app password,
+// is still the private key of publicKey: whether no rotation has happened
+// since, or the record the last rotation wrote opens with it.
+func (a *Agent) isCurrentKey(username string, publicKey, privateKey []byte) (bool, error) {
+	records, err := a.readRetired(username)
+	if err != nil {
+		return false, err
+	}
+	under := keyFingerprint(publicKey)
+	for _, r := range records {
+		if r.Under == under {
+			opened, err := openWith(r.Sealed, privateKey, retiredKeyInfo)
+			clear(opened)
+			return err == nil, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,136 @@
+package passwd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/totp"
+)
+
+func TestRotateUserKeys(t *testing.T) {
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	keyDir := filepath.Join(dir, "keys")
+	if err := AddUser(passwdPath, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	agent, err := NewAgent(passwdPath, keyDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	ctx := context.Background()
+
+	if _, err := agent.RotateUserKeys(ctx, "alice", "pw"); !errors.Is(err, autherrors.ErrEncryptionNotEnabled) {
+		t.Errorf("rotate without keys: err = %v, want ErrEncryptionNotEnabled", err)
+	}
+	first, err := agent.GenerateUserKeys(ctx, "alice", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := EnableTOTP(keyDir, "alice", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, appToken, err := AddAppPassword(passwdPath, keyDir, "alice", "Phone", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := agent.RotateUserKeys(ctx, "alice", "wrong"); !errors.Is(err, autherrors.ErrKeyDecryptFailed) {
+		t.Errorf("wrong secret: err = %v, want ErrKeyDecryptFailed", err)
+	}
+	second, err := agent.RotateUserKeys(ctx, "alice", "pw")
+	if err != nil {
+		t.Fatalf("RotateUserKeys: %v", err)
+	}
+	third, err := agent.RotateUserKeys(ctx, "alice", "pw")
+	if err != nil {
+		t.Fatalf("RotateUserKeys: %v", err)
+	}
+	if bytes.Equal(first, second) || bytes.Equal(second, third) {
+		t.Fatal("rotation kept the public key")
+	}
+	if pub, err := agent.GetPublicKey(ctx, "alice"); err != nil || !bytes.Equal(pub, third) {
+		t.Errorf("GetPublicKey = %x, %v; want the current key", pub, err)
+	}
+
+	session, err := agent.Authenticate(ctx, "alice", "pw")
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	defer session.Clear()
+	if !bytes.Equal(session.PublicKey, third) || len(session.RetiredKeys) != 2 {
+		t.Fatalf("session keys: public %x, %d retired", session.PublicKey, len(session.RetiredKeys))
+	}
+	if !bytes.Equal(session.RetiredKeys[0].PublicKey, second) || !bytes.Equal(session.RetiredKeys[1].PublicKey, first) {
+		t.Error("retired keys not newest first")
+	}
+	if len(session.PrivateKeys()) != 3 {
+		t.Errorf("PrivateKeys = %d keys, want 3", len(session.PrivateKeys()))
+	}
+
+	// TOTP moved to the new key.
+	code := totp.Code(secret, time.Now())
+	if ok, err := agent.VerifyTOTP(ctx, "alice", code); err != nil || !ok {
+		t.Errorf("VerifyTOTP after rotation = %v, %v", ok, err)
+	}
+
+	// The app password predates the rotation: its key stays locked.
+	appSession, err := agent.Authenticate(ctx, "alice", appToken)
+	if err != nil {
+		t.Fatalf("Authenticate with app password: %v", err)
+	}
+	if appSession.KeysUnlocked() || appSession.RetiredKeys != nil {
+		t.Error("stale app password unlocked keys")
+	}
+}
+
+func TestRotateUserKeys_InterruptedRotation(t *testing.T) {
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	keyDir := filepath.Join(dir, "keys")
+	if err := AddUser(passwdPath, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	agent, err := NewAgent(passwdPath, keyDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	ctx := context.Background()
+	if _, err := agent.GenerateUserKeys(ctx, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := agent.RotateUserKeys(ctx, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A rotation that wrote its record but not the new key leaves the
+	// current key and its retired chain usable.
+	key, _ := os.ReadFile(filepath.Join(keyDir, "alice"+privateKeyExt))
+	pub, _ := os.ReadFile(filepath.Join(keyDir, "alice"+publicKeyExt))
+	if _, err := agent.RotateUserKeys(ctx, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(keyDir, "alice"+privateKeyExt), key, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(keyDir, "alice"+publicKeyExt), pub, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	session, err := agent.Authenticate(ctx, "alice", "pw")
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	defer session.Clear()
+	if !session.KeysUnlocked() || len(session.RetiredKeys) != 1 {
+		t.Errorf("session: unlocked %v, %d retired keys; want 1", session.KeysUnlocked(), len(session.RetiredKeys))
+	}
+}
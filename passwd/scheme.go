@@ -0,0 +1,169 @@
+package passwd
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// HashVerifier reports whether password matches hash, a hash in the format
+// the verifier was registered for. It must compare in constant time.
+type HashVerifier func(password, hash string) bool
+
+var (
+	schemesMu sync.RWMutex
+	schemes   = make(map[string]HashVerifier) // by hash prefix
+)
+
+// Built-in schemes. Only argon2id hashes are ever written; the others are
+// verified so that passwd files converted from htpasswd, Dovecot or
+// /etc/shadow keep working without a password reset.
+func init() {
+	RegisterHashScheme(argon2Prefix, verifyArgon2)
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		RegisterHashScheme(prefix, verifyBcrypt)
+	}
+	RegisterHashScheme("$scrypt$", verifyScrypt)
+	RegisterHashScheme("$6$", verifySHA512Crypt)
+}
+
+// RegisterHashScheme makes VerifyPassword accept hashes starting with
+// prefix, such as "$2b$", verifying them with verify. Where prefixes
+// overlap the longest one wins. It panics if called with an empty prefix
+// or nil verifier, or if the prefix is already registered.
+func RegisterHashScheme(prefix string, verify HashVerifier) {
+	if prefix == "" {
+		panic("passwd: RegisterHashScheme called with empty prefix")
+	}
+	if verify == nil {
+		panic("passwd: RegisterHashScheme called with nil verifier")
+	}
+
+	schemesMu.Lock()
+	defer schemesMu.Unlock()
+
+	if _, exists := schemes[prefix]; exists {
+		panic("passwd: RegisterHashScheme called twice for " + prefix)
+	}
+	schemes[prefix] = verify
+}
+
+// HashSchemes returns the sorted prefixes of the registered hash schemes.
+func HashSchemes() []string {
+	schemesMu.RLock()
+	defer schemesMu.RUnlock()
+
+	prefixes := make([]string, 0, len(schemes))
+	for prefix := range schemes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// hashScheme returns the prefix and verifier of the scheme hash belongs
+// to. Returns false if no registered scheme matches.
+func hashScheme(hash string) (string, HashVerifier, bool) {
+	schemesMu.RLock()
+	defer schemesMu.RUnlock()
+
+	var best string
+	for prefix := range schemes {
+		if len(prefix) > len(best) && strings.HasPrefix(hash, prefix) {
+			best = prefix
+		}
+	}
+	if best == "" {
+		return "", nil, false
+	}
+	return best, schemes[best], true
+}
+
+// argon2Prefix is the prefix of argon2id PHC strings.
+const argon2Prefix = "$argon2id$"
+
+// verifyArgon2 verifies an argon2id PHC string as produced by HashPassword.
+// A peppered hash matches no password unless its pepper is installed.
+func verifyArgon2(password, hash string) bool {
+	return verifyArgon2With(password, hash, installedPeppers())
+}
+
+// verifyArgon2With is verifyArgon2 with the peppers pp.
+func verifyArgon2With(password, hash string, pp *Peppers) bool {
+	h, ok := parseArgon2Hash(hash)
+	if !ok {
+		return false
+	}
+
+	input := []byte(password)
+	if h.keyid != "" {
+		secret, ok := pp.secret(h.keyid)
+		if !ok {
+			return false
+		}
+		input = pepperPassword(password, secret)
+	}
+
+	// Derive key from password using same parameters
+	derivedKey := argon2.IDKey(input, h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+
+	// Constant-time comparison
+	return subtle.ConstantTimeCompare(derivedKey, h.key) == 1
+}
+
+// verifyBcrypt verifies a bcrypt hash ($2a$, $2b$ or $2y$), as written by
+// htpasswd -B and Dovecot's BLF-CRYPT.
+func verifyBcrypt(password, hash string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// maxScryptMemory bounds the memory of scrypt hashes (128 * N * r bytes)
+// so that a bad passwd entry cannot exhaust memory.
+const maxScryptMemory = 1 << 30
+
+// verifyScrypt verifies an scrypt hash in the PHC-style format
+// $scrypt$ln=<log2 N>,r=<r>,p=<p>$<salt>$<key>, with salt and key in
+// unpadded base64 (passlib's "." for "+" is accepted).
+func verifyScrypt(password, hash string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 {
+		return false
+	}
+	var logN, r, p int
+	if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &logN, &r, &p); err != nil {
+		return false
+	}
+	if logN < 1 || logN > 30 || r < 1 || r > maxScryptMemory/128>>logN || p < 1 || p > 16 {
+		return false
+	}
+	decode := func(s string) ([]byte, error) {
+		return base64.RawStdEncoding.DecodeString(strings.ReplaceAll(s, ".", "+"))
+	}
+	salt, err := decode(parts[3])
+	if err != nil {
+		return false
+	}
+	key, err := decode(parts[4])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+	derived, err := scrypt.Key([]byte(password), salt, 1<<logN, r, p, len(key))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(derived, key) == 1
+}
+
+// verifySHA512Crypt verifies a SHA-512 crypt hash ($6$), the default of
+// /etc/shadow on most Linux systems and Dovecot's SHA512-CRYPT.
+func verifySHA512Crypt(password, hash string) bool {
+	computed, ok := sha512Crypt(password, hash)
+	return ok && subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+}
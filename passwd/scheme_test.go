@@ -0,0 +1,144 @@
+package passwd
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+func TestSHA512Crypt_Vectors(t *testing.T) {
+	// From the SHA-crypt specification (Drepper).
+	for _, tc := range []struct{ password, hash string }{
+		{"Hello world!", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"Hello world!", "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+		{"This is just a test", "$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0"},
+	} {
+		if !VerifyPassword(tc.password, tc.hash) {
+			got, _ := sha512Crypt(tc.password, tc.hash)
+			t.Errorf("%q did not verify against %s (computed %s)", tc.password, tc.hash, got)
+		}
+		if VerifyPassword(tc.password+"x", tc.hash) {
+			t.Errorf("wrong password verified against %s", tc.hash)
+		}
+	}
+}
+
+func TestVerifyPassword_Schemes(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("0123456789abcdef")
+	key, err := scrypt.Key([]byte("pw"), salt, 1<<4, 8, 1, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawStdEncoding.EncodeToString
+	scryptHash := fmt.Sprintf("$scrypt$ln=4,r=8,p=1$%s$%s", b64(salt), b64(key))
+	argonHash, err := HashPasswordWithParams("pw", cheapParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, hash := range []string{argonHash, string(bcryptHash), strings.Replace(string(bcryptHash), "$2a$", "$2y$", 1), scryptHash} {
+		if !VerifyPassword("pw", hash) {
+			t.Errorf("password did not verify against %s", hash)
+		}
+		if VerifyPassword("wrong", hash) {
+			t.Errorf("wrong password verified against %s", hash)
+		}
+	}
+	for _, hash := range []string{"", "pw", "{SHA}abc", "$1$salt$hash", "$scrypt$ln=40,r=8,p=1$c2FsdA$a2V5"} {
+		if VerifyPassword("pw", hash) {
+			t.Errorf("password verified against %q", hash)
+		}
+	}
+}
+
+func TestRegisterHashScheme(t *testing.T) {
+	RegisterHashScheme("$test-plain$", func(password, hash string) bool {
+		return hash == "$test-plain$"+password
+	})
+	defer func() {
+		schemesMu.Lock()
+		delete(schemes, "$test-plain$")
+		schemesMu.Unlock()
+	}()
+	if !VerifyPassword("pw", "$test-plain$pw") || VerifyPassword("x", "$test-plain$pw") {
+		t.Error("registered scheme not used")
+	}
+	if !slices.Contains(HashSchemes(), "$test-plain$") || !slices.Contains(HashSchemes(), "$6$") {
+		t.Errorf("HashSchemes() = %v", HashSchemes())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("duplicate registration did not panic")
+		}
+	}()
+	RegisterHashScheme("$6$", verifySHA512Crypt)
+}
+
+func TestAuthenticate_HashUpgrade(t *testing.T) {
+	const shadow = "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	if err := os.WriteFile(passwdPath, []byte("alice:"+shadow+":alice\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	storedHash := func() string {
+		users, err := ListUsers(passwdPath)
+		if err != nil || len(users) != 1 {
+			t.Fatalf("ListUsers = %v, %v", users, err)
+		}
+		return users[0].Hash
+	}
+	ctx := context.Background()
+
+	agent, err := NewAgent(passwdPath, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	agent.WithArgon2Params(cheapParams)
+	if _, err := agent.Authenticate(ctx, "alice", "Hello world!"); err != nil {
+		t.Fatal(err)
+	}
+	if storedHash() != shadow {
+		t.Fatal("hash upgraded without WithHashUpgrade")
+	}
+
+	agent.WithHashUpgrade(true)
+	if _, err := agent.Authenticate(ctx, "alice", "Hello world!"); err != nil {
+		t.Fatal(err)
+	}
+	upgraded := storedHash()
+	if !strings.HasPrefix(upgraded, "$argon2id$") || !VerifyPassword("Hello world!", upgraded) {
+		t.Fatalf("hash not upgraded: %q", upgraded)
+	}
+	if _, err := agent.Authenticate(ctx, "alice", "Hello world!"); err != nil {
+		t.Errorf("login after upgrade: %v", err)
+	}
+}
+
+func TestLint_LegacyHash(t *testing.T) {
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	content := "alice:$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1:alice\n"
+	if err := os.WriteFile(passwdPath, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := Lint(passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lintCodes(problems); !slices.Equal(got, []string{"1:passwd.legacy-hash"}) {
+		t.Errorf("problems = %v", got)
+	}
+}
@@ -0,0 +1,171 @@
+package passwd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/sasl/scram"
+	"github.com/infodancer/auth/vfs"
+)
+
+// scramStore holds SCRAM verifiers, in the form of scram.Format.
+var scramStore = taggedFile{name: "scram", what: "scram credentials"}
+
+// SetSCRAMCredentials derives a SCRAM-SHA-256 verifier for username from
+// password and stores it, so that the agent can offer SCRAM logins.
+// password must be the user's current password. iterations of 0 means
+// scram.DefaultIterations. The verifier lasts until the password changes
+// (see Agent.WithSCRAM to derive a new one at login).
+//
+// A wrong password fails with errors.ErrAuthFailed, a missing user with
+// errors.ErrUserNotFound, and read-only mode with errors.ErrReadOnly.
+func SetSCRAMCredentials(passwdPath, username, password string, iterations int) error {
+	if err := checkWritable(vfs.OS{}, passwdPath); err != nil {
+		return err
+	}
+	hash, err := verifiedHash(vfs.OS{}, passwdPath, username, password)
+	if err != nil {
+		return err
+	}
+	return storeSCRAM(vfs.OS{}, passwdPath, username, password, hash, iterations)
+}
+
+// ClearSCRAMCredentials removes username's SCRAM verifier, so SCRAM logins
+// fail for them. Removing a verifier that does not exist is not an error.
+// Returns errors.ErrReadOnly in read-only mode.
+func ClearSCRAMCredentials(passwdPath, username string) error {
+	if err := checkWritable(vfs.OS{}, passwdPath); err != nil {
+		return err
+	}
+	l, err := lockPasswd(vfs.OS{}, passwdPath)
+	if err != nil {
+		return err
+	}
+	defer l.release()
+	if err := l.check(); err != nil {
+		return err
+	}
+	return scramStore.remove(vfs.OS{}, passwdPath, username)
+}
+
+// storeSCRAM derives username's verifier from password and stores it,
+// tagged with hash, in place of any older one.
+func storeSCRAM(fsys vfs.WriteFS, passwdPath, username, password, hash string, iterations int) error {
+	creds, err := scram.New(password, iterations)
+	if err != nil {
+		return err
+	}
+	return scramStore.set(fsys, passwdPath, username, hash, scram.Format(creds))
+}
+
+// WithSCRAM makes a successful Authenticate with the main password derive
+// a SCRAM-SHA-256 verifier with the given iteration count when the user
+// has none or theirs is stale, so users become able to log in with SCRAM
+// as they log in with a password. 0 turns it off, the default. Like hash
+// upgrades, it never happens in memory-mapped, compiled or read-only mode;
+// the agent serves verifiers stored by SetSCRAMCredentials either way.
+func (a *Agent) WithSCRAM(iterations int) *Agent {
+	if iterations != 0 && (iterations < scram.MinIterations || iterations > scram.MaxIterations) {
+		slog.Warn("ignoring invalid scram iteration count", "iterations", iterations)
+		return a
+	}
+	a.scramIterations = iterations
+	return a
+}
+
+// SCRAMIterationsFromOptions reads the SCRAM settings from auth agent
+// options: "scram" = "true" turns derivation at login on, with
+// "scram_iterations" iterations (scram.DefaultIterations if unset).
+// Returns 0 when it is off. Invalid values fail with
+// errors.ErrAuthAgentConfigInvalid.
+func SCRAMIterationsFromOptions(options map[string]string) (int, error) {
+	if options["scram"] != "true" {
+		return 0, nil
+	}
+	s := options["scram_iterations"]
+	if s == "" {
+		return scram.DefaultIterations, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < scram.MinIterations || n > scram.MaxIterations {
+		return 0, fmt.Errorf("%w: scram_iterations: must be %d..%d", errors.ErrAuthAgentConfigInvalid, scram.MinIterations, scram.MaxIterations)
+	}
+	return n, nil
+}
+
+// GetSCRAMCredentials returns username's SCRAM-SHA-256 verifier. Users
+// without one, or whose password changed since it was derived, fail with
+// errors.ErrMechanismUnsupported; disabled and locked accounts fail like
+// Authenticate does. Implements auth.SCRAMCredentialProvider.
+func (a *Agent) GetSCRAMCredentials(ctx context.Context, username string) (*auth.SCRAMCredentials, error) {
+	entry, ok := a.lookup(username)
+	if !ok {
+		return nil, errors.ErrUserNotFound
+	}
+	if err := checkStatus(entry); err != nil {
+		return nil, err
+	}
+	verifier, ok, err := scramStore.current(a.files(), a.passwdPath, entry)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: no scram credentials for %s", errors.ErrMechanismUnsupported, username)
+	}
+	creds, err := scram.Parse(verifier)
+	if err != nil {
+		return nil, fmt.Errorf("scram credentials for %s: %w", username, err)
+	}
+	return &creds, nil
+}
+
+// deriveSCRAM stores a verifier of password for the user if WithSCRAM is
+// on and they have no current one. Like rehash it runs after a successful
+// login, so failures are logged rather than returned.
+func (a *Agent) deriveSCRAM(username, password string) {
+	if a.scramIterations == 0 || a.readOnlyView() {
+		return
+	}
+	// rehash may have replaced the hash; tag the verifier with the new one.
+	entry, ok := a.lookup(username)
+	if !ok {
+		return
+	}
+	if _, ok, err := scramStore.current(a.files(), a.passwdPath, entry); ok || err != nil || a.writable() != nil {
+		return
+	}
+	if err := storeSCRAM(a.writeFiles(), a.passwdPath, entry.username, password, entry.hash, a.scramIterations); err != nil {
+		slog.Warn("scram derivation failed", "user", entry.username, "error", err)
+		return
+	}
+	slog.Debug("derived scram credentials", "user", entry.username)
+}
+
+// refreshSCRAM replaces username's verifier, if they have one, with one
+// of their new password and hash, keeping its iteration count. The
+// password has already changed, so failures are logged rather than
+// returned.
+func refreshSCRAM(fsys vfs.WriteFS, passwdPath, username, password, hash string) {
+	entries, err := scramStore.read(fsys, passwdPath)
+	if err != nil {
+		slog.Warn("scram refresh failed", "user", username, "error", err)
+		return
+	}
+	for _, e := range entries {
+		if e.username != username {
+			continue
+		}
+		iterations := scram.DefaultIterations
+		if old, err := scram.Parse(e.value); err == nil {
+			iterations = old.Iterations
+		}
+		if err := storeSCRAM(fsys, passwdPath, username, password, hash, iterations); err != nil {
+			slog.Warn("scram refresh failed", "user", username, "error", err)
+		}
+		return
+	}
+}
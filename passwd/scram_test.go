@@ -0,0 +1,234 @@
+package passwd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/sasl/scram"
+	"github.com/infodancer/auth/vfs"
+)
+
+// newSCRAMUsers returns a passwd file with alice and bob, password "pw".
+func newSCRAMUsers(t *testing.T) string {
+	t.Helper()
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	for _, u := range []string{"alice", "bob"} {
+		if err := AddUser(passwdPath, u, "pw"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return passwdPath
+}
+
+// getSCRAM opens a fresh agent on passwdPath and returns username's
+// verifier.
+func getSCRAM(t *testing.T, passwdPath, username string) (string, error) {
+	t.Helper()
+	agent, err := NewAgent(passwdPath, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	c, err := agent.GetSCRAMCredentials(context.Background(), username)
+	if err != nil {
+		return "", err
+	}
+	return scram.Format(*c), nil
+}
+
+func TestSetSCRAMCredentials(t *testing.T) {
+	passwdPath := newSCRAMUsers(t)
+
+	if _, err := getSCRAM(t, passwdPath, "alice"); !errors.Is(err, autherrors.ErrMechanismUnsupported) {
+		t.Errorf("before SetSCRAMCredentials: err = %v, want ErrMechanismUnsupported", err)
+	}
+	if err := SetSCRAMCredentials(passwdPath, "alice", "pw", 5000); err != nil {
+		t.Fatalf("SetSCRAMCredentials: %v", err)
+	}
+	v, err := getSCRAM(t, passwdPath, "alice")
+	if err != nil {
+		t.Fatalf("GetSCRAMCredentials: %v", err)
+	}
+	c, _ := scram.Parse(v)
+	if c.Iterations != 5000 || !scram.Verify(c, "pw") {
+		t.Errorf("stored verifier %q does not match", v)
+	}
+	if _, err := getSCRAM(t, passwdPath, "bob"); !errors.Is(err, autherrors.ErrMechanismUnsupported) {
+		t.Errorf("bob: err = %v, want ErrMechanismUnsupported", err)
+	}
+	if _, err := getSCRAM(t, passwdPath, "carol"); !errors.Is(err, autherrors.ErrUserNotFound) {
+		t.Errorf("carol: err = %v, want ErrUserNotFound", err)
+	}
+
+	fi, err := os.Stat(scramStore.path(passwdPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("mode = %v, want 0600", fi.Mode().Perm())
+	}
+
+	if err := SetSCRAMCredentials(passwdPath, "alice", "wrong", 0); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("wrong password: err = %v, want ErrAuthFailed", err)
+	}
+	if err := SetSCRAMCredentials(passwdPath, "carol", "pw", 0); !errors.Is(err, autherrors.ErrUserNotFound) {
+		t.Errorf("unknown user: err = %v, want ErrUserNotFound", err)
+	}
+	if err := SetSCRAMCredentials(passwdPath, "bob", "pw", 10); err == nil {
+		t.Error("too few iterations accepted")
+	}
+
+	if err := ClearSCRAMCredentials(passwdPath, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getSCRAM(t, passwdPath, "alice"); !errors.Is(err, autherrors.ErrMechanismUnsupported) {
+		t.Errorf("after ClearSCRAMCredentials: err = %v", err)
+	}
+}
+
+func TestSCRAM_ReadOnly(t *testing.T) {
+	passwdPath := newSCRAMUsers(t)
+	markReadOnly(t, passwdPath)
+	if err := SetSCRAMCredentials(passwdPath, "alice", "pw", 0); !errors.Is(err, autherrors.ErrReadOnly) {
+		t.Errorf("SetSCRAMCredentials: err = %v, want ErrReadOnly", err)
+	}
+	if err := ClearSCRAMCredentials(passwdPath, "alice"); !errors.Is(err, autherrors.ErrReadOnly) {
+		t.Errorf("ClearSCRAMCredentials: err = %v, want ErrReadOnly", err)
+	}
+}
+
+func TestSCRAM_PasswordChange(t *testing.T) {
+	passwdPath := newSCRAMUsers(t)
+	if err := SetSCRAMCredentials(passwdPath, "alice", "pw", 5000); err != nil {
+		t.Fatal(err)
+	}
+
+	// ChangePassword derives a new verifier with the same cost.
+	if err := ChangePassword(passwdPath, t.TempDir(), "alice", "pw", "new"); err != nil {
+		t.Fatal(err)
+	}
+	v, err := getSCRAM(t, passwdPath, "alice")
+	if err != nil {
+		t.Fatalf("after ChangePassword: %v", err)
+	}
+	if c, _ := scram.Parse(v); c.Iterations != 5000 || !scram.Verify(c, "new") {
+		t.Errorf("verifier after ChangePassword = %q", v)
+	}
+
+	// A hash replaced some other way retires the verifier.
+	hash, err := HashPassword("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, _ := ListUsers(passwdPath)
+	for _, u := range users {
+		if u.Username == "alice" {
+			if err := replaceHash(vfs.OS{}, passwdPath, "alice", u.Hash, hash); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := getSCRAM(t, passwdPath, "alice"); !errors.Is(err, autherrors.ErrMechanismUnsupported) {
+		t.Errorf("stale verifier: err = %v, want ErrMechanismUnsupported", err)
+	}
+
+	// A login that raced the change cannot store a verifier for the old
+	// hash over the new one.
+	if err := storeSCRAM(vfs.OS{}, passwdPath, "alice", "new", "stale-hash", 5000); err == nil {
+		t.Error("verifier for a superseded hash stored")
+	}
+}
+
+func TestAuthenticate_DerivesSCRAM(t *testing.T) {
+	passwdPath := newSCRAMUsers(t)
+	agent, err := NewAgent(passwdPath, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	agent.WithSCRAM(6000)
+
+	ctx := context.Background()
+	if _, err := agent.Authenticate(ctx, "alice", "wrong"); err == nil {
+		t.Fatal("wrong password accepted")
+	}
+	if _, err := agent.GetSCRAMCredentials(ctx, "alice"); !errors.Is(err, autherrors.ErrMechanismUnsupported) {
+		t.Errorf("failed login derived a verifier: err = %v", err)
+	}
+	if _, err := agent.Authenticate(ctx, "alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	c, err := agent.GetSCRAMCredentials(ctx, "alice")
+	if err != nil {
+		t.Fatalf("GetSCRAMCredentials: %v", err)
+	}
+	if c.Iterations != 6000 || !scram.Verify(*c, "pw") {
+		t.Errorf("derived verifier = %+v", c)
+	}
+
+	// Without WithSCRAM, logins leave bob alone.
+	plain, err := NewAgent(passwdPath, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = plain.Close() }()
+	if _, err := plain.Authenticate(ctx, "bob", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plain.GetSCRAMCredentials(ctx, "bob"); !errors.Is(err, autherrors.ErrMechanismUnsupported) {
+		t.Errorf("bob: err = %v, want ErrMechanismUnsupported", err)
+	}
+}
+
+func TestSCRAM_DisabledAndDeleted(t *testing.T) {
+	passwdPath := newSCRAMUsers(t)
+	for _, u := range []string{"alice", "bob"} {
+		if err := SetSCRAMCredentials(passwdPath, u, "pw", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := SetFlags(passwdPath, "bob", FlagDisabled); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getSCRAM(t, passwdPath, "bob"); err == nil {
+		t.Error("disabled account got its verifier")
+	}
+
+	if err := DeleteUser(passwdPath, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := scramStore.read(vfs.OS{}, passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].username != "bob" {
+		t.Errorf("entries after purging alice = %+v", entries)
+	}
+}
+
+func TestSCRAMIterationsFromOptions(t *testing.T) {
+	for _, tc := range []struct {
+		options map[string]string
+		want    int
+		wantErr bool
+	}{
+		{nil, 0, false},
+		{map[string]string{"scram_iterations": "8192"}, 0, false},
+		{map[string]string{"scram": "true"}, scram.DefaultIterations, false},
+		{map[string]string{"scram": "true", "scram_iterations": "8192"}, 8192, false},
+		{map[string]string{"scram": "true", "scram_iterations": "100"}, 0, true},
+		{map[string]string{"scram": "true", "scram_iterations": "x"}, 0, true},
+	} {
+		got, err := SCRAMIterationsFromOptions(tc.options)
+		if got != tc.want || (err != nil) != tc.wantErr {
+			t.Errorf("SCRAMIterationsFromOptions(%v) = %d, %v", tc.options, got, err)
+		}
+		if err != nil && !errors.Is(err, autherrors.ErrAuthAgentConfigInvalid) {
+			t.Errorf("error %v does not wrap ErrAuthAgentConfigInvalid", err)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package passwd
+
+import (
+	"fmt"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/vfs"
+)
+
+// AttrServices is the profile attribute holding the services a user may log
+// in to, comma-separated (see auth.ParseServiceSet):
+//
+//	alice:$argon2id$...:alice:1001:::100:0::services=imap,pop3
+//
+// Without it the user may log in to every service. Unknown names restrict
+// rather than allow; Lint reports them.
+const AttrServices = "services"
+
+// services returns the services p allows.
+func (p Profile) services() auth.ServiceSet {
+	set, _ := auth.ParseServiceSet(p.Attributes[AttrServices])
+	return set
+}
+
+// SetServices restricts username to logging in to services; the zero set
+// lifts the restriction. The set is stored in the AttrServices attribute,
+// making the entry a v2 entry. The change is recorded in the mutation
+// journal and can be undone (see Undo). Returns an error if the user does
+// not exist, and errors.ErrReadOnly in read-only mode.
+func SetServices(passwdPath, username string, services auth.ServiceSet) error {
+	if err := checkWritable(vfs.OS{}, passwdPath); err != nil {
+		return err
+	}
+	attr := services.String()
+
+	var found bool
+	_, err := updateEntry(vfs.OS{}, passwdPath, username, OpProfile, func(parts []string) ([]string, bool) {
+		found = true
+		p := parseProfile(parts[min(len(parts), v1Fields):])
+		if p.Attributes[AttrServices] == attr && len(parts) > v1Fields {
+			return nil, false
+		}
+		if attr == "" {
+			delete(p.Attributes, AttrServices)
+		} else {
+			if p.Attributes == nil {
+				p.Attributes = make(map[string]string)
+			}
+			p.Attributes[AttrServices] = attr
+		}
+		return append(padFields(parts, username, v1Fields)[:v1Fields], p.fields()...), true
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("user %q not found", username)
+	}
+	return nil
+}
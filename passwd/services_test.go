@@ -0,0 +1,75 @@
+package passwd
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/infodancer/auth"
+)
+
+func TestSetServices(t *testing.T) {
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	if err := AddUser(passwdPath, "alice", "alice-pw"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetProfile(passwdPath, "alice", Profile{Gid: 100, Attributes: map[string]string{"dept": "ops"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetServices(passwdPath, "alice", auth.ServiceSMTP|auth.ServiceWebmail); err != nil {
+		t.Fatalf("SetServices: %v", err)
+	}
+	users, err := ListUsers(passwdPath)
+	if err != nil || len(users) != 1 {
+		t.Fatalf("ListUsers = %+v, %v", users, err)
+	}
+	if p := users[0].Profile; p.Gid != 100 || p.Attributes["dept"] != "ops" || p.Attributes[AttrServices] != "smtp,webmail" {
+		t.Errorf("profile = %+v", p)
+	}
+
+	agent, err := NewAgent(passwdPath, filepath.Join(dir, "keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	session, err := agent.Authenticate(t.Context(), "alice", "alice-pw")
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	defer session.Clear()
+	if got := session.User.Services; got != auth.ServiceSMTP|auth.ServiceWebmail {
+		t.Errorf("session services = %v", got)
+	}
+	if status, err := agent.AccountStatus(t.Context(), "alice"); err != nil || status.Services != auth.ServiceSMTP|auth.ServiceWebmail {
+		t.Errorf("AccountStatus = %+v, %v", status, err)
+	}
+
+	if err := SetServices(passwdPath, "alice", 0); err != nil {
+		t.Fatalf("SetServices(0): %v", err)
+	}
+	users, _ = ListUsers(passwdPath)
+	if _, ok := users[0].Profile.Attributes[AttrServices]; ok || users[0].Profile.Attributes["dept"] != "ops" {
+		t.Errorf("after lifting: %+v", users[0].Profile)
+	}
+	if err := SetServices(passwdPath, "bob", auth.ServiceIMAP); err == nil {
+		t.Error("expected SetServices of a missing user to fail")
+	}
+}
+
+func TestLint_Services(t *testing.T) {
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	content := "alice:{SHA}abc:alice:1001:::100:0::services=imap\nbob:{SHA}abc:bob:1002:::100:0::services=imap,sieve\n"
+	if err := os.WriteFile(passwdPath, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := Lint(passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes := lintCodes(problems)
+	if slices.Contains(codes, "1:passwd.bad-services") || !slices.Contains(codes, "2:passwd.bad-services") {
+		t.Errorf("codes = %v", codes)
+	}
+}
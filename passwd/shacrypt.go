@@ -0,0 +1,141 @@
+package passwd
+
+import (
+	"crypto/sha512"
+	"strconv"
+	"strings"
+)
+
+// SHA-512 crypt parameters, as in glibc.
+const (
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+	shaCryptMaxSalt       = 16
+)
+
+// cryptAlphabet is the base64 alphabet of crypt(3) hashes.
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// sha512CryptOrder is the byte permutation SHA-512 crypt encodes the final
+// digest in, three bytes at a time; byte 63 is encoded on its own.
+var sha512CryptOrder = [21][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+	{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+	{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+	{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+	{62, 20, 41},
+}
+
+// sha512Crypt computes the SHA-512 crypt hash of password with the salt
+// and rounds of setting, a "$6$[rounds=N$]salt[$...]" string such as a
+// stored hash. Returns false if setting is not one.
+func sha512Crypt(password, setting string) (string, bool) {
+	rest, ok := strings.CutPrefix(setting, "$6$")
+	if !ok {
+		return "", false
+	}
+	rounds, explicit := shaCryptDefaultRounds, false
+	if r, ok := strings.CutPrefix(rest, "rounds="); ok {
+		n, after, found := strings.Cut(r, "$")
+		v, err := strconv.ParseUint(n, 10, 64)
+		if !found || err != nil {
+			return "", false
+		}
+		rounds = int(min(max(v, shaCryptMinRounds), shaCryptMaxRounds))
+		explicit, rest = true, after
+	}
+	salt, _, _ := strings.Cut(rest, "$")
+	if len(salt) > shaCryptMaxSalt {
+		salt = salt[:shaCryptMaxSalt]
+	}
+	key := []byte(password)
+
+	b := sha512.New()
+	b.Write(key)
+	b.Write([]byte(salt))
+	b.Write(key)
+	sumB := b.Sum(nil)
+
+	a := sha512.New()
+	a.Write(key)
+	a.Write([]byte(salt))
+	n := len(key)
+	for ; n > sha512.Size; n -= sha512.Size {
+		a.Write(sumB)
+	}
+	a.Write(sumB[:n])
+	for n := len(key); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			a.Write(sumB)
+		} else {
+			a.Write(key)
+		}
+	}
+	sumA := a.Sum(nil)
+
+	dp := sha512.New()
+	for range len(key) {
+		dp.Write(key)
+	}
+	p := repeatDigest(dp.Sum(nil), len(key))
+
+	ds := sha512.New()
+	for range 16 + int(sumA[0]) {
+		ds.Write([]byte(salt))
+	}
+	s := repeatDigest(ds.Sum(nil), len(salt))
+
+	c := sumA
+	for i := range rounds {
+		h := sha512.New()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(c[:0])
+	}
+
+	var out strings.Builder
+	out.WriteString("$6$")
+	if explicit {
+		out.WriteString("rounds=" + strconv.Itoa(rounds) + "$")
+	}
+	out.WriteString(salt)
+	out.WriteByte('$')
+	for _, t := range sha512CryptOrder {
+		encodeCrypt64(&out, uint(c[t[0]])<<16|uint(c[t[1]])<<8|uint(c[t[2]]), 4)
+	}
+	encodeCrypt64(&out, uint(c[63]), 2)
+	return out.String(), true
+}
+
+// repeatDigest returns n bytes of digest repeated.
+func repeatDigest(digest []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, digest[:min(len(digest), n-len(out))]...)
+	}
+	return out
+}
+
+// encodeCrypt64 writes the low 6*n bits of w in crypt base64, least
+// significant first.
+func encodeCrypt64(out *strings.Builder, w uint, n int) {
+	for range n {
+		out.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
@@ -0,0 +1,167 @@
+package passwd
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/infodancer/auth/atrest"
+	"github.com/infodancer/auth/vfs"
+)
+
+// Sharded passwd layout
+//
+// A domain with many users may split its passwd file across up to 256 shard
+// files in a directory (conventionally "passwd.d"). Each shard uses the normal
+// passwd line format. A user always lives in the shard named by ShardName, so
+// lookups and mutations touch a single small file instead of rewriting one
+// giant passwd file per change.
+//
+//	passwd.d/
+//	├── 00
+//	├── 01
+//	…
+//	└── ff
+//
+// Every function in this package that takes a passwdPath accepts either a
+// regular passwd file or a shard directory; a directory selects sharded mode.
+
+// ShardName returns the shard file name ("00".."ff") for username: the first
+// byte of the SHA-256 of the username, hex-encoded.
+func ShardName(username string) string {
+	sum := sha256.Sum256([]byte(username))
+	return hex.EncodeToString(sum[:1])
+}
+
+// isSharded reports whether passwdPath is a shard directory.
+func isSharded(fsys vfs.FS, passwdPath string) bool {
+	fi, err := fsys.Stat(passwdPath)
+	return err == nil && fi.IsDir()
+}
+
+// userFile returns the file holding username's entry: the shard file in
+// sharded mode, or passwdPath itself.
+func userFile(fsys vfs.FS, passwdPath, username string) string {
+	if isSharded(fsys, passwdPath) {
+		return filepath.Join(passwdPath, ShardName(username))
+	}
+	return passwdPath
+}
+
+// passwdFiles returns the files making up passwdPath: every shard file
+// present in sharded mode (sorted by name), or passwdPath itself.
+func passwdFiles(fsys vfs.FS, passwdPath string) ([]string, error) {
+	if !isSharded(fsys, passwdPath) {
+		return []string{passwdPath}, nil
+	}
+	entries, err := fsys.ReadDir(passwdPath)
+	if err != nil {
+		return nil, fmt.Errorf("read shard directory: %w", err)
+	}
+	var files []string
+	for _, e := range entries {
+		if e.IsDir() || !isShardName(e.Name()) {
+			continue
+		}
+		files = append(files, filepath.Join(passwdPath, e.Name()))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// sourceStamp describes the files making up passwdPath by name, size and
+// modification time.
+func sourceStamp(fsys vfs.FS, passwdPath string) (string, error) {
+	files, err := passwdFiles(fsys, passwdPath)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, path := range files {
+		fi, err := fsys.Stat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				fmt.Fprintf(&b, "%s -\n", path)
+				continue
+			}
+			return "", fmt.Errorf("stat passwd file: %w", err)
+		}
+		fmt.Fprintf(&b, "%s %d %d\n", path, fi.Size(), fi.ModTime().UnixNano())
+	}
+	return b.String(), nil
+}
+
+// isShardName reports whether name is a two-digit lowercase hex shard name.
+func isShardName(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil && strings.ToLower(name) == name
+}
+
+// SplitPasswd converts a single passwd file into a shard directory at
+// shardDir, preserving each entry line verbatim. Comment and blank lines are
+// dropped. shardDir is created if needed and must not already contain shards.
+// Shards of a sealed passwd file are sealed.
+func SplitPasswd(passwdPath, shardDir string) error {
+	if err := checkWritable(vfs.OS{}, passwdPath); err != nil {
+		return err
+	}
+	l, err := lockPasswd(vfs.OS{}, passwdPath)
+	if err != nil {
+		return err
+	}
+	defer l.release()
+	fsys := vfs.OS{}
+	if err := fsys.MkdirAll(shardDir, 0o750); err != nil {
+		return fmt.Errorf("create shard directory: %w", err)
+	}
+	existing, err := passwdFiles(fsys, shardDir)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return fmt.Errorf("shard directory %s is not empty", shardDir)
+	}
+
+	sealed, err := atrest.IsSealedFileFS(fsys, passwdPath)
+	if err != nil {
+		return fmt.Errorf("open passwd file: %w", err)
+	}
+	f, err := atrest.OpenFS(fsys, passwdPath)
+	if err != nil {
+		return fmt.Errorf("open passwd file: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	shards := make(map[string][]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, _, _ := strings.Cut(line, ":")
+		name := ShardName(username)
+		shards[name] = append(shards[name], line)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read passwd file: %w", err)
+	}
+
+	if err := l.check(); err != nil {
+		return err
+	}
+	for name, lines := range shards {
+		if err := writePasswdFile(fsys, filepath.Join(shardDir, name), lines, sealed); err != nil {
+			return fmt.Errorf("write shard %s: %w", name, err)
+		}
+	}
+	return nil
+}
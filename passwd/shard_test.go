@@ -0,0 +1,94 @@
+package passwd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShardName(t *testing.T) {
+	name := ShardName("alice")
+	if !isShardName(name) {
+		t.Fatalf("ShardName returned invalid shard name %q", name)
+	}
+	if ShardName("alice") != name {
+		t.Error("ShardName is not deterministic")
+	}
+}
+
+func TestShardedAddAuthenticateDelete(t *testing.T) {
+	dir := t.TempDir()
+	shardDir := filepath.Join(dir, "passwd.d")
+	keyDir := filepath.Join(dir, "keys")
+	if err := os.MkdirAll(shardDir, 0o750); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, u := range []string{"alice", "bob", "carol"} {
+		if err := AddUser(shardDir, u, u+"-pw"); err != nil {
+			t.Fatalf("AddUser %s: %v", u, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(shardDir, ShardName("alice"))); err != nil {
+		t.Errorf("expected alice's shard file to exist: %v", err)
+	}
+	if err := AddUser(shardDir, "alice", "again"); err == nil {
+		t.Error("expected duplicate AddUser to fail in sharded mode")
+	}
+
+	users, err := ListUsers(shardDir)
+	if err != nil {
+		t.Fatalf("ListUsers: %v", err)
+	}
+	if len(users) != 3 {
+		t.Errorf("expected 3 users across shards, got %d", len(users))
+	}
+
+	agent, err := NewAgent(shardDir, keyDir)
+	if err != nil {
+		t.Fatalf("NewAgent: %v", err)
+	}
+	session, err := agent.Authenticate(t.Context(), "bob", "bob-pw")
+	if err != nil {
+		t.Fatalf("Authenticate bob: %v", err)
+	}
+	session.Clear()
+
+	if err := DeleteUser(shardDir, "bob"); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if _, err := LookupUID(shardDir, "bob"); err == nil {
+		t.Error("expected bob to be gone after delete")
+	}
+	if _, err := LookupUID(shardDir, "alice"); err != nil {
+		t.Errorf("expected alice to remain: %v", err)
+	}
+}
+
+func TestSplitPasswd(t *testing.T) {
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	shardDir := filepath.Join(dir, "passwd.d")
+
+	content := "# header\nalice:HASH:alice:1001\nbob:HASH:bob:1002\n\ncarol:HASH:carol\n"
+	if err := os.WriteFile(passwdPath, []byte(content), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SplitPasswd(passwdPath, shardDir); err != nil {
+		t.Fatalf("SplitPasswd: %v", err)
+	}
+
+	uid, err := LookupUID(shardDir, "bob")
+	if err != nil || uid != 1002 {
+		t.Errorf("LookupUID bob after split = %d, %v", uid, err)
+	}
+	users, err := ListUsers(shardDir)
+	if err != nil || len(users) != 3 {
+		t.Errorf("expected 3 users after split, got %d (%v)", len(users), err)
+	}
+
+	if err := SplitPasswd(passwdPath, shardDir); err == nil {
+		t.Error("expected SplitPasswd into a populated directory to fail")
+	}
+}
@@ -0,0 +1,167 @@
+package passwd
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/infodancer/auth/vfs"
+)
+
+// FlagDeleted marks a user deleted with a grace period. It is kept with
+// the account flags as "deleted=" and the Unix times of the deletion and
+// of the end of the grace period, and is set by SoftDeleteUser rather than
+// SetFlags. A deleted user cannot log in (Authenticate fails with
+// errors.ErrAccountDisabled), but still exists, so daemons keep accepting
+// their mail into quarantine (see auth.AccountStatus.Quarantined) until
+// Reap removes the entry once the grace period has ended. RestoreUser or
+// Undo brings the user back until then:
+//
+//	alice:$argon2id$...:alice:1001:deleted=1760000000/1762592000
+const FlagDeleted = "deleted"
+
+// deletionMarker returns the deletion marker among flags, if any.
+func deletionMarker(flags []string) (string, bool) {
+	for _, f := range flags {
+		if strings.HasPrefix(f, FlagDeleted+"=") {
+			return f, true
+		}
+	}
+	return "", false
+}
+
+// deletion returns when flags mark the user deleted and when their grace
+// period ends. A malformed marker counts as a deletion at an unknown time,
+// the Unix epoch, with the grace period over, so the user stays locked out
+// and is purged by the next Reap.
+func deletion(flags []string) (deleted, purge time.Time, ok bool) {
+	marker, ok := deletionMarker(flags)
+	if !ok {
+		return time.Time{}, time.Time{}, false
+	}
+	deleted, purge, valid := parseDeletion(marker)
+	if !valid {
+		return time.Unix(0, 0), time.Unix(0, 0), true
+	}
+	return deleted, purge, true
+}
+
+// parseDeletion parses a deletion marker, reporting false if it is
+// malformed.
+func parseDeletion(marker string) (deleted, purge time.Time, ok bool) {
+	d, p, found := strings.Cut(strings.TrimPrefix(marker, FlagDeleted+"="), "/")
+	if !found {
+		return time.Time{}, time.Time{}, false
+	}
+	deleted, okDeleted := parseChanged(d)
+	purge, okPurge := parseChanged(p)
+	if !okDeleted || !okPurge || deleted.IsZero() || purge.Before(deleted) {
+		return time.Time{}, time.Time{}, false
+	}
+	return deleted, purge, true
+}
+
+// SoftDeleteUser marks username deleted with a grace period instead of
+// removing it (see FlagDeleted): logins are refused at once, mail is
+// quarantined, and Reap removes the entry once grace has passed. The end
+// of the grace period is recorded in the entry, so it does not depend on
+// the grace Reap is later run with. Domains configure the period with
+// delete_grace_days. The change is recorded in the mutation journal.
+//
+// Returns an error if the user does not exist or is already deleted, or
+// if grace is not positive, and errors.ErrReadOnly in read-only mode.
+func SoftDeleteUser(passwdPath, username string, grace time.Duration) error {
+	if grace <= 0 {
+		return fmt.Errorf("delete grace period must be positive, got %s", grace)
+	}
+	if err := checkWritable(vfs.OS{}, passwdPath); err != nil {
+		return err
+	}
+	now := time.Now()
+	var found, already bool
+	_, err := updateEntry(vfs.OS{}, passwdPath, username, OpSoftDelete, func(parts []string) ([]string, bool) {
+		found = true
+		parts = padFields(parts, username, 5)
+		flags := parseFlags(parts[4])
+		if _, ok := deletionMarker(flags); ok {
+			already = true
+			return nil, false
+		}
+		flags = append(flags, FlagDeleted+"="+formatChanged(now)+"/"+formatChanged(now.Add(grace)))
+		parts[4] = strings.Join(flags, ",")
+		return trimFields(parts), true
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("user %q not found", username)
+	}
+	if already {
+		return fmt.Errorf("user %q is already deleted", username)
+	}
+	return nil
+}
+
+// RestoreUser clears the deletion mark SoftDeleteUser set on username, so
+// they can log in again. Returns an error if the user
+// does not exist or is not marked deleted, and errors.ErrReadOnly in
+// read-only mode.
+func RestoreUser(passwdPath, username string) error {
+	if err := checkWritable(vfs.OS{}, passwdPath); err != nil {
+		return err
+	}
+	var found bool
+	changed, err := updateEntry(vfs.OS{}, passwdPath, username, OpRestore, func(parts []string) ([]string, bool) {
+		found = true
+		parts = padFields(parts, username, 5)
+		flags := parseFlags(parts[4])
+		marker, ok := deletionMarker(flags)
+		if !ok {
+			return nil, false
+		}
+		flags = slices.DeleteFunc(flags, func(f string) bool { return f == marker })
+		parts[4] = strings.Join(flags, ",")
+		return trimFields(parts), true
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("user %q not found", username)
+	}
+	if !changed {
+		return fmt.Errorf("user %q is not deleted", username)
+	}
+	return nil
+}
+
+// Reap removes the users whose grace period (see SoftDeleteUser) has
+// ended, with their app passwords, and returns their names. Each removal
+// is journaled like DeleteUser's. Users restored or changed while Reap
+// runs are left alone. Returns errors.ErrReadOnly in read-only mode.
+func Reap(passwdPath string) ([]string, error) {
+	if err := checkWritable(vfs.OS{}, passwdPath); err != nil {
+		return nil, err
+	}
+	users, err := ListUsers(passwdPath)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var purged []string
+	for _, u := range users {
+		if u.Deleted.IsZero() || u.PurgeAfter.After(now) {
+			continue
+		}
+		removed, err := removeUser(vfs.OS{}, passwdPath, u.Username, now)
+		if err != nil {
+			return purged, fmt.Errorf("purge %q: %w", u.Username, err)
+		}
+		if removed {
+			purged = append(purged, u.Username)
+		}
+	}
+	return purged, nil
+}
@@ -0,0 +1,133 @@
+package passwd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+func TestSoftDeleteUser(t *testing.T) {
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	hash, err := HashPasswordWithParams("pw", cheapParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AddUserWithHash(passwdPath, "alice", hash); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetFlags(passwdPath, "alice", FlagLocked); err != nil {
+		t.Fatal(err)
+	}
+
+	grace := 30 * 24 * time.Hour
+	if err := SoftDeleteUser(passwdPath, "alice", 0); err == nil {
+		t.Error("soft delete without a grace period succeeded")
+	}
+	if err := SoftDeleteUser(passwdPath, "alice", grace); err != nil {
+		t.Fatalf("SoftDeleteUser: %v", err)
+	}
+	if err := SoftDeleteUser(passwdPath, "alice", grace); err == nil {
+		t.Error("deleting a deleted user succeeded")
+	}
+	users, err := ListUsers(passwdPath)
+	if err != nil || len(users) != 1 {
+		t.Fatalf("ListUsers = %+v, %v", users, err)
+	}
+	if u := users[0]; time.Since(u.Deleted) > time.Minute || u.PurgeAfter.Sub(u.Deleted) != grace || !slices.Equal(u.Flags, []string{FlagLocked}) {
+		t.Errorf("deleted entry = %+v", u)
+	}
+
+	// Changing the flags keeps the deletion mark.
+	if err := SetFlags(passwdPath, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	agent, err := NewAgent(passwdPath, filepath.Join(dir, "keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := agent.Authenticate(ctx, "alice", "pw"); !errors.Is(err, autherrors.ErrAccountDisabled) {
+		t.Errorf("Authenticate: err = %v, want ErrAccountDisabled", err)
+	}
+	status, err := agent.AccountStatus(ctx, "alice")
+	if err != nil || !status.Quarantined() || status.CanLogin() || !status.AcceptsMail() {
+		t.Errorf("AccountStatus = %+v, %v", status, err)
+	}
+	if exists, _ := agent.UserExists(ctx, "alice"); !exists {
+		t.Error("deleted user no longer exists during the grace period")
+	}
+	_ = agent.Close()
+
+	// Within the grace period Reap leaves the user alone.
+	if purged, err := Reap(passwdPath); err != nil || len(purged) != 0 {
+		t.Errorf("early Reap = %v, %v", purged, err)
+	}
+	if err := RestoreUser(passwdPath, "alice"); err != nil {
+		t.Fatalf("RestoreUser: %v", err)
+	}
+	if err := RestoreUser(passwdPath, "alice"); err == nil {
+		t.Error("restoring a user that is not deleted succeeded")
+	}
+	if users, _ := ListUsers(passwdPath); len(users) != 1 || !users[0].Deleted.IsZero() {
+		t.Errorf("restored entry = %+v", users)
+	}
+
+	entries, err := ReadJournal(passwdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []string
+	for _, e := range entries {
+		ops = append(ops, e.Op)
+	}
+	if want := []string{OpAdd, OpFlags, OpSoftDelete, OpFlags, OpRestore}; !slices.Equal(ops, want) {
+		t.Errorf("journal ops = %v, want %v", ops, want)
+	}
+}
+
+func TestReap(t *testing.T) {
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	unix := func(d time.Duration) string {
+		return strconv.FormatInt(time.Now().Add(d).Unix(), 10)
+	}
+	day := 24 * time.Hour
+	// recent was deleted long ago with a longer grace period than old's,
+	// which has ended: each entry's own period counts.
+	content := "old:x:old::deleted=" + unix(-10*day) + "/" + unix(-time.Hour) + "\n" +
+		"recent:x:recent::locked,deleted=" + unix(-40*day) + "/" + unix(50*day) + "\n" +
+		"bad:x:bad::deleted=" + unix(-time.Hour) + "\n" +
+		"live:x:live\n"
+	if err := os.WriteFile(passwdPath, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	purged, err := Reap(passwdPath)
+	if err != nil || !slices.Equal(purged, []string{"old", "bad"}) {
+		t.Fatalf("Reap = %v, %v", purged, err)
+	}
+	users, err := ListUsers(passwdPath)
+	if err != nil || len(users) != 2 || users[0].Username != "recent" || users[1].Username != "live" {
+		t.Errorf("remaining users = %+v, %v", users, err)
+	}
+
+	// DeleteUser removes at once, deleted or not.
+	if err := DeleteUser(passwdPath, "recent"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteUser(passwdPath, "recent"); err == nil {
+		t.Error("deleting a missing user succeeded")
+	}
+
+	markReadOnly(t, passwdPath)
+	if _, err := Reap(passwdPath); !errors.Is(err, autherrors.ErrReadOnly) {
+		t.Errorf("read-only Reap: err = %v, want ErrReadOnly", err)
+	}
+}
@@ -0,0 +1,189 @@
+package passwd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/infodancer/auth/atrest"
+	"github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/vfs"
+)
+
+// taggedFile is a file of per-user credentials derived from the password,
+// kept next to the passwd file (or shard directory) in the domain
+// directory. Line format: username:hashtag:value
+//
+// hashtag identifies the password hash the value was made alongside (see
+// hashTag): a value whose tag does not match the user's current hash is
+// stale, so changing the password anywhere retires it without touching
+// the file.
+type taggedFile struct {
+	name string // file name
+	what string // description for errors
+}
+
+// taggedEntry is a parsed line of a taggedFile.
+type taggedEntry struct {
+	username string
+	hashTag  string
+	value    string
+}
+
+// hashTag returns the tag tying a value to the password hash it was made
+// alongside: the first 8 bytes of the hash's SHA-256, in hex.
+func hashTag(hash string) string {
+	sum := sha256.Sum256([]byte(hash))
+	return hex.EncodeToString(sum[:8])
+}
+
+// verifiedHash returns username's password hash after checking password
+// against it, for storing values derived from the password. A wrong
+// password fails with errors.ErrAuthFailed, a missing user with
+// errors.ErrUserNotFound.
+func verifiedHash(fsys vfs.FS, passwdPath, username, password string) (string, error) {
+	hash, err := currentHash(fsys, passwdPath, username)
+	if err != nil {
+		return "", err
+	}
+	if !VerifyPassword(password, hash) {
+		return "", errors.ErrAuthFailed
+	}
+	return hash, nil
+}
+
+// currentHash returns username's password hash as on disk, failing with
+// errors.ErrUserNotFound for a missing user.
+func currentHash(fsys vfs.FS, passwdPath, username string) (string, error) {
+	users, err := parsePasswd(fsys, userFile(fsys, passwdPath, username))
+	if err != nil {
+		return "", err
+	}
+	for _, u := range users {
+		if u.Username == username {
+			return u.Hash, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", errors.ErrUserNotFound, username)
+}
+
+// path returns the file for passwdPath.
+func (f taggedFile) path(passwdPath string) string {
+	return filepath.Join(filepath.Dir(filepath.Clean(passwdPath)), f.name)
+}
+
+// current returns the value stored for entry's user if it was made
+// alongside the entry's current hash.
+func (f taggedFile) current(fsys vfs.FS, passwdPath string, entry *userEntry) (string, bool, error) {
+	entries, err := f.read(fsys, passwdPath)
+	if err != nil {
+		return "", false, err
+	}
+	tag := hashTag(entry.hash)
+	for _, e := range entries {
+		if e.username == entry.username && e.hashTag == tag {
+			return e.value, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// set stores value for username, tagged with hash, in place of any older
+// one. It takes the lock on passwdPath, and fails if hash is no longer the
+// user's, so a value made from a password changed meanwhile does not
+// replace the new password's.
+func (f taggedFile) set(fsys vfs.WriteFS, passwdPath, username, hash, value string) error {
+	l, err := lockPasswd(fsys, passwdPath)
+	if err != nil {
+		return err
+	}
+	defer l.release()
+	cur, err := currentHash(fsys, passwdPath, username)
+	if err != nil {
+		return err
+	}
+	if cur != hash {
+		return fmt.Errorf("%s for %q: password changed meanwhile", f.what, username)
+	}
+	if err := l.check(); err != nil {
+		return err
+	}
+	e := taggedEntry{username: username, hashTag: hashTag(hash), value: value}
+	return f.update(fsys, passwdPath, func(entries []taggedEntry) ([]taggedEntry, bool) {
+		kept := entries[:0]
+		for _, old := range entries {
+			if old.username != username {
+				kept = append(kept, old)
+			}
+		}
+		return append(kept, e), true
+	})
+}
+
+// remove drops username's value. Callers hold the lock on passwdPath.
+func (f taggedFile) remove(fsys vfs.WriteFS, passwdPath, username string) error {
+	return f.update(fsys, passwdPath, func(entries []taggedEntry) ([]taggedEntry, bool) {
+		kept := entries[:0]
+		for _, e := range entries {
+			if e.username != username {
+				kept = append(kept, e)
+			}
+		}
+		return kept, len(kept) != len(entries)
+	})
+}
+
+// update rewrites the file with the entries returned by fn, if fn reports
+// a change.
+func (f taggedFile) update(fsys vfs.WriteFS, passwdPath string, fn func([]taggedEntry) ([]taggedEntry, bool)) error {
+	entries, err := f.read(fsys, passwdPath)
+	if err != nil {
+		return err
+	}
+	entries, changed := fn(entries)
+	if !changed {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, e := range entries {
+		fmt.Fprintf(&buf, "%s:%s:%s\n", e.username, e.hashTag, e.value)
+	}
+	if err := atrest.WriteFileFS(fsys, f.path(passwdPath), buf.Bytes(), 0o600, false); err != nil {
+		return fmt.Errorf("write %s: %w", f.what, err)
+	}
+	return nil
+}
+
+// read parses the file. A missing file has no entries; malformed lines are
+// skipped.
+func (f taggedFile) read(fsys vfs.FS, passwdPath string) ([]taggedEntry, error) {
+	data, err := fsys.ReadFile(f.path(passwdPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read %s: %w", f.what, err)
+	}
+	var entries []taggedEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 || parts[0] == "" {
+			continue
+		}
+		entries = append(entries, taggedEntry{username: parts[0], hashTag: parts[1], value: parts[2]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", f.what, err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,253 @@
+package passwd
+
+import (
+	"context"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/totp"
+	"github.com/infodancer/auth/vfs"
+)
+
+const (
+	// totpExt is the extension of a user's sealed TOTP secret in the key
+	// directory. File format: nonce (24B) || secretbox ciphertext, under a
+	// key derived from the user's private key.
+	totpExt = ".totp"
+
+	// totpKeyInfo separates the TOTP sealing key from other uses of the
+	// private key.
+	totpKeyInfo = "infodancer/auth passwd totp v1"
+
+	// totpPendingTTL is how long after a successful Authenticate a TOTP code
+	// is accepted.
+	totpPendingTTL = 5 * time.Minute
+
+	// maxTOTPFailures is the number of wrong codes after which the pending
+	// login is dropped and the user must authenticate again.
+	maxTOTPFailures = 5
+)
+
+// Compile-time check: Agent must satisfy MFAAgent.
+var _ auth.MFAAgent = (*Agent)(nil)
+
+// totpState holds the TOTP secrets unsealed by recent logins and the last
+// time step each user verified, which is refused from then on.
+type totpState struct {
+	mu       sync.Mutex
+	pending  map[string]*pendingTOTP
+	lastStep map[string]int64
+}
+
+// pendingTOTP is a login waiting for its second factor.
+type pendingTOTP struct {
+	secret   []byte
+	expires  time.Time
+	failures int
+}
+
+// EnableTOTP enrolls username in TOTP: it generates a secret, seals it
+// with a key derived from the user's private key (unlocked with password,
+// or the key passphrase if the user has one) and stores it in keyDir. It
+// returns the secret for provisioning the user's authenticator app (see
+// totp.URI). An existing secret is replaced.
+//
+// The secret can only be unsealed during a login, so users need a key pair,
+// and users with a key passphrase must supply it at every login:
+// without one EnableTOTP fails with errors.ErrEncryptionNotEnabled. A wrong
+// password fails with errors.ErrKeyDecryptFailed, and read-only mode with
+// errors.ErrReadOnly.
+func EnableTOTP(keyDir, username, password string) ([]byte, error) {
+	if err := checkWritable(vfs.OS{}, keyDir); err != nil {
+		return nil, err
+	}
+	fsys := vfs.OS{}
+	encryptedKey, err := fsys.ReadFile(filepath.Join(keyDir, username+privateKeyExt))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s has no key pair", errors.ErrEncryptionNotEnabled, username)
+		}
+		return nil, fmt.Errorf("read private key: %w", err)
+	}
+	privateKey, err := decryptPrivateKey(encryptedKey, password)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(privateKey)
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := sealWith(secret, privateKey, totpKeyInfo)
+	if err != nil {
+		return nil, err
+	}
+	if err := fsys.WriteFile(filepath.Join(keyDir, username+totpExt), sealed, 0o600); err != nil {
+		return nil, fmt.Errorf("write totp secret: %w", err)
+	}
+	return secret, nil
+}
+
+// DisableTOTP removes username's TOTP secret from keyDir. Removing a
+// secret that does not exist is not an error. Returns errors.ErrReadOnly
+// in read-only mode.
+func DisableTOTP(keyDir, username string) error {
+	if err := checkWritable(vfs.OS{}, keyDir); err != nil {
+		return err
+	}
+	fsys := vfs.OS{}
+	if err := fsys.Remove(filepath.Join(keyDir, username+totpExt)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove totp secret: %w", err)
+	}
+	return nil
+}
+
+// TOTPEnabled reports whether username has a TOTP secret.
+// Implements auth.MFAAgent.
+func (a *Agent) TOTPEnabled(ctx context.Context, username string) (bool, error) {
+	if _, exists := a.lookup(username); !exists {
+		return false, nil
+	}
+	_, err := a.files().Stat(filepath.Join(a.keyDir, username+totpExt))
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, fmt.Errorf("stat totp secret: %w", err)
+}
+
+// VerifyTOTP checks code against the secret unsealed by username's last
+// Authenticate, which must have succeeded within the past five minutes. A
+// code's time step is accepted once, and five wrong codes drop the pending
+// login. Implements auth.MFAAgent.
+func (a *Agent) VerifyTOTP(ctx context.Context, username, code string) (bool, error) {
+	now := time.Now()
+	s := &a.totp
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.pending[username]
+	if p == nil {
+		return false, nil
+	}
+	if now.After(p.expires) {
+		s.drop(username)
+		return false, nil
+	}
+	step, ok := totp.Verify(p.secret, code, now, totp.DefaultSkew)
+	if last, used := s.lastStep[username]; ok && used && step <= last {
+		ok = false
+	}
+	if !ok {
+		if p.failures++; p.failures >= maxTOTPFailures {
+			s.drop(username)
+		}
+		return false, nil
+	}
+	if s.lastStep == nil {
+		s.lastStep = make(map[string]int64)
+	}
+	s.lastStep[username] = step
+	s.drop(username)
+	return true, nil
+}
+
+// stageTOTP unseals username's TOTP secret, if any, with the private key
+// decrypted by a successful Authenticate and holds it for VerifyTOTP.
+func (a *Agent) stageTOTP(username string, privateKey []byte) error {
+	sealed, err := a.files().ReadFile(filepath.Join(a.keyDir, username+totpExt))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("read totp secret: %w", err)
+	}
+	secret, err := openWith(sealed, privateKey, totpKeyInfo)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	s := &a.totp
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending == nil {
+		s.pending = make(map[string]*pendingTOTP)
+	}
+	for name, p := range s.pending {
+		if now.After(p.expires) {
+			s.drop(name)
+		}
+	}
+	s.drop(username)
+	s.pending[username] = &pendingTOTP{secret: secret, expires: now.Add(totpPendingTTL)}
+	return nil
+}
+
+// drop zeroes and forgets username's pending secret. Callers hold s.mu.
+func (s *totpState) drop(username string) {
+	if p := s.pending[username]; p != nil {
+		clear(p.secret)
+		delete(s.pending, username)
+	}
+}
+
+// subkey derives a secretbox key for one purpose (info) from secret, a
+// private key or other high-entropy value.
+func subkey(secret []byte, info string) (*[32]byte, error) {
+	k, err := hkdf.Key(sha256.New, secret, nil, info, 32)
+	if err != nil {
+		return nil, fmt.Errorf("derive key: %w", err)
+	}
+	var key [32]byte
+	copy(key[:], k)
+	clear(k)
+	return &key, nil
+}
+
+// sealWith encrypts plaintext under the subkey of secret for info.
+// Format: nonce (24B) || secretbox ciphertext.
+func sealWith(plaintext, secret []byte, info string) ([]byte, error) {
+	key, err := subkey(secret, info)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key[:])
+	var nonce [nonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+	return secretbox.Seal(nonce[:], plaintext, &nonce, key), nil
+}
+
+// openWith decrypts data sealed by sealWith.
+func openWith(sealed, secret []byte, info string) ([]byte, error) {
+	if len(sealed) < nonceSize+secretbox.Overhead {
+		return nil, errors.ErrInvalidKeyFormat
+	}
+	key, err := subkey(secret, info)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key[:])
+	var nonce [nonceSize]byte
+	copy(nonce[:], sealed[:nonceSize])
+	plaintext, ok := secretbox.Open(nil, sealed[nonceSize:], &nonce, key)
+	if !ok {
+		return nil, errors.ErrKeyDecryptFailed
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,184 @@
+package passwd
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/nacl/secretbox"
+
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/totp"
+)
+
+// writeKeyPair stores a key pair for username in keyDir, with the private
+// key encrypted under password as the agent expects.
+func writeKeyPair(t *testing.T, keyDir, username, password string) {
+	t.Helper()
+	if err := os.MkdirAll(keyDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	priv := make([]byte, 32)
+	salt := make([]byte, saltSize)
+	var nonce [nonceSize]byte
+	for _, b := range [][]byte{priv, salt, nonce[:]} {
+		if _, err := rand.Read(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var key [32]byte
+	copy(key[:], argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen))
+	sealed := secretbox.Seal(append(append([]byte(nil), salt...), nonce[:]...), priv, &nonce, &key)
+	if err := os.WriteFile(filepath.Join(keyDir, username+privateKeyExt), sealed, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(keyDir, username+publicKeyExt), []byte("pub"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// otherCode returns a well-formed code different from code.
+func otherCode(code string) string {
+	if code == "000000" {
+		return "111111"
+	}
+	return "000000"
+}
+
+// newTOTPAgent returns an agent with alice (enrolled, with keys) and bob
+// (no keys), and alice's TOTP secret.
+func newTOTPAgent(t *testing.T) (*Agent, []byte) {
+	t.Helper()
+	dir := t.TempDir()
+	passwdPath := filepath.Join(dir, "passwd")
+	keyDir := filepath.Join(dir, "keys")
+	for _, u := range []string{"alice", "bob"} {
+		if err := AddUser(passwdPath, u, "pw"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeKeyPair(t, keyDir, "alice", "pw")
+
+	secret, err := EnableTOTP(keyDir, "alice", "pw")
+	if err != nil {
+		t.Fatalf("EnableTOTP: %v", err)
+	}
+	agent, err := NewAgent(passwdPath, keyDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = agent.Close() })
+	return agent, secret
+}
+
+func TestEnableTOTP_Errors(t *testing.T) {
+	agent, _ := newTOTPAgent(t)
+	if _, err := EnableTOTP(agent.keyDir, "bob", "pw"); !errors.Is(err, autherrors.ErrEncryptionNotEnabled) {
+		t.Errorf("bob without keys: err = %v, want ErrEncryptionNotEnabled", err)
+	}
+	if _, err := EnableTOTP(agent.keyDir, "alice", "wrong"); !errors.Is(err, autherrors.ErrKeyDecryptFailed) {
+		t.Errorf("wrong password: err = %v, want ErrKeyDecryptFailed", err)
+	}
+
+	markReadOnly(t, agent.keyDir)
+	if _, err := EnableTOTP(agent.keyDir, "alice", "pw"); !errors.Is(err, autherrors.ErrReadOnly) {
+		t.Errorf("read-only EnableTOTP: err = %v", err)
+	}
+	if err := DisableTOTP(agent.keyDir, "alice"); !errors.Is(err, autherrors.ErrReadOnly) {
+		t.Errorf("read-only DisableTOTP: err = %v", err)
+	}
+}
+
+func TestTOTP_SecretIsSealed(t *testing.T) {
+	agent, secret := newTOTPAgent(t)
+	data, err := os.ReadFile(filepath.Join(agent.keyDir, "alice"+totpExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != nonceSize+secretbox.Overhead+len(secret) {
+		t.Errorf("sealed secret is %d bytes", len(data))
+	}
+	fi, _ := os.Stat(filepath.Join(agent.keyDir, "alice"+totpExt))
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("mode = %v, want 0600", fi.Mode().Perm())
+	}
+}
+
+func TestAgent_VerifyTOTP(t *testing.T) {
+	ctx := context.Background()
+	agent, secret := newTOTPAgent(t)
+
+	for user, want := range map[string]bool{"alice": true, "bob": false, "nobody": false} {
+		if got, err := agent.TOTPEnabled(ctx, user); err != nil || got != want {
+			t.Errorf("TOTPEnabled(%s) = %v, %v; want %v", user, got, err, want)
+		}
+	}
+
+	code := totp.Code(secret, time.Now())
+	if ok, _ := agent.VerifyTOTP(ctx, "alice", code); ok {
+		t.Fatal("code accepted before Authenticate")
+	}
+
+	session, err := agent.Authenticate(ctx, "alice", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Clear()
+	if ok, _ := agent.VerifyTOTP(ctx, "alice", otherCode(code)); ok {
+		t.Error("wrong code accepted")
+	}
+	if ok, err := agent.VerifyTOTP(ctx, "alice", code); err != nil || !ok {
+		t.Fatalf("VerifyTOTP = %v, %v", ok, err)
+	}
+
+	// The login is complete, and the code cannot be replayed after
+	// another password check.
+	if ok, _ := agent.VerifyTOTP(ctx, "alice", code); ok {
+		t.Error("code accepted twice in one login")
+	}
+	session, err = agent.Authenticate(ctx, "alice", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Clear()
+	if ok, _ := agent.VerifyTOTP(ctx, "alice", code); ok {
+		t.Error("replayed code accepted")
+	}
+}
+
+func TestAgent_VerifyTOTP_TooManyFailures(t *testing.T) {
+	ctx := context.Background()
+	agent, secret := newTOTPAgent(t)
+	session, err := agent.Authenticate(ctx, "alice", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Clear()
+
+	code := totp.Code(secret, time.Now())
+	for range maxTOTPFailures {
+		_, _ = agent.VerifyTOTP(ctx, "alice", otherCode(code))
+	}
+	if ok, _ := agent.VerifyTOTP(ctx, "alice", code); ok {
+		t.Error("code accepted after too many failures")
+	}
+}
+
+func TestDisableTOTP(t *testing.T) {
+	ctx := context.Background()
+	agent, _ := newTOTPAgent(t)
+	if err := DisableTOTP(agent.keyDir, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DisableTOTP(agent.keyDir, "alice"); err != nil {
+		t.Errorf("second DisableTOTP: %v", err)
+	}
+	if got, _ := agent.TOTPEnabled(ctx, "alice"); got {
+		t.Error("TOTPEnabled after DisableTOTP")
+	}
+}
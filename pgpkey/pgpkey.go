@@ -0,0 +1,130 @@
+// Package pgpkey reads and writes OpenPGP public keys in ASCII armor
+// (RFC 4880, section 6), as users export them, so that key backends can
+// store them next to native keys. It does not interpret the key packets
+// beyond checking that a key starts with a public key packet.
+package pgpkey
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Armor lines of a public key block.
+const (
+	header = "-----BEGIN PGP PUBLIC KEY BLOCK-----"
+	footer = "-----END PGP PUBLIC KEY BLOCK-----"
+)
+
+// publicKeyTag is the OpenPGP packet tag of a public key packet.
+const publicKeyTag = 6
+
+// ErrInvalid is returned for data that is not an armored or binary OpenPGP
+// public key.
+var ErrInvalid = errors.New("pgpkey: not an OpenPGP public key")
+
+// IsArmored reports whether data begins, after leading white space, with
+// an armored public key block.
+func IsArmored(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte(header))
+}
+
+// Decode returns the binary key in an armored public key block. Armor
+// headers are skipped; a checksum line, if present, must match.
+func Decode(data []byte) ([]byte, error) {
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	start := strings.Index(text, header+"\n")
+	if start < 0 {
+		return nil, fmt.Errorf("%w: missing armor header", ErrInvalid)
+	}
+	body, _, ok := strings.Cut(text[start+len(header)+1:], footer)
+	if !ok {
+		return nil, fmt.Errorf("%w: missing armor footer", ErrInvalid)
+	}
+	// Armor headers ("Version: ...") cannot be mistaken for base64, which
+	// has no colons.
+	var b64, sum strings.Builder
+	for line := range strings.Lines(body) {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "", strings.Contains(line, ":"):
+		case strings.HasPrefix(line, "="):
+			sum.WriteString(line[1:])
+		default:
+			b64.WriteString(line)
+		}
+	}
+	key, err := base64.StdEncoding.DecodeString(b64.String())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if sum.Len() > 0 {
+		want, err := base64.StdEncoding.DecodeString(sum.String())
+		if err != nil || len(want) != 3 {
+			return nil, fmt.Errorf("%w: bad armor checksum", ErrInvalid)
+		}
+		if got := crc24(key); got != uint32(want[0])<<16|uint32(want[1])<<8|uint32(want[2]) {
+			return nil, fmt.Errorf("%w: armor checksum mismatch", ErrInvalid)
+		}
+	}
+	if err := Check(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Encode returns key, a binary OpenPGP public key, as an armored public
+// key block with a checksum.
+func Encode(key []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(header + "\n\n")
+	enc := base64.StdEncoding.EncodeToString(key)
+	for len(enc) > 64 {
+		buf.WriteString(enc[:64] + "\n")
+		enc = enc[64:]
+	}
+	if enc != "" {
+		buf.WriteString(enc + "\n")
+	}
+	c := crc24(key)
+	buf.WriteString("=" + base64.StdEncoding.EncodeToString([]byte{byte(c >> 16), byte(c >> 8), byte(c)}) + "\n")
+	buf.WriteString(footer + "\n")
+	return buf.Bytes()
+}
+
+// Check reports whether key, binary OpenPGP data, starts with a public key
+// packet, in either the old or the new packet format.
+func Check(key []byte) error {
+	if len(key) == 0 || key[0]&0x80 == 0 {
+		return ErrInvalid
+	}
+	tag := int(key[0]&0x3c) >> 2 // old format
+	if key[0]&0x40 != 0 {
+		tag = int(key[0] & 0x3f) // new format
+	}
+	if tag != publicKeyTag {
+		return fmt.Errorf("%w: first packet has tag %d", ErrInvalid, tag)
+	}
+	return nil
+}
+
+// crc24 is the armor checksum of RFC 4880, section 6.1.
+func crc24(data []byte) uint32 {
+	const (
+		crcInit = 0xb704ce
+		crcPoly = 0x1864cfb
+	)
+	crc := uint32(crcInit)
+	for _, b := range data {
+		crc ^= uint32(b) << 16
+		for range 8 {
+			crc <<= 1
+			if crc&0x1000000 != 0 {
+				crc ^= crcPoly
+			}
+		}
+	}
+	return crc & 0xffffff
+}
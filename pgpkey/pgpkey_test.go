@@ -0,0 +1,79 @@
+package pgpkey
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func readTestdata(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDecode(t *testing.T) {
+	// alice.asc and alice.gpg are the same key exported by GnuPG with and
+	// without --armor.
+	armored, binary := readTestdata(t, "alice.asc"), readTestdata(t, "alice.gpg")
+	if !IsArmored(armored) || IsArmored(binary) {
+		t.Fatal("IsArmored misreports the test keys")
+	}
+	got, err := Decode(armored)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if !bytes.Equal(got, binary) {
+		t.Error("Decode does not match the binary export")
+	}
+
+	// Armor headers, CRLF line ends and surrounding text are tolerated.
+	withHeaders := strings.Replace(string(armored), "BLOCK-----\n\n", "BLOCK-----\nVersion: test\nComment: x\n\n", 1)
+	withHeaders = "Some text\r\n" + strings.ReplaceAll(withHeaders, "\n", "\r\n")
+	if got, err := Decode([]byte(withHeaders)); err != nil || !bytes.Equal(got, binary) {
+		t.Errorf("Decode(with headers) = %v", err)
+	}
+
+	if got, err := Decode(Encode(binary)); err != nil || !bytes.Equal(got, binary) {
+		t.Errorf("Decode(Encode) = %v", err)
+	}
+	if !bytes.Equal(Encode(binary), armored) {
+		t.Errorf("Encode differs from GnuPG:\n%s", Encode(binary))
+	}
+}
+
+func TestDecode_Invalid(t *testing.T) {
+	armored := string(readTestdata(t, "alice.asc"))
+	for name, data := range map[string]string{
+		"no header":    "mDMEatE3AhYJKwYBBAHaRw8BAQdA\n",
+		"no footer":    strings.Split(armored, "-----END")[0],
+		"bad checksum": strings.Replace(armored, "=2tQy", "=AAAA", 1),
+		"bad base64":   strings.Replace(armored, "mDME", "m!ME", 1),
+		"secret key":   string(Encode([]byte{0xc5, 0x01, 0x04})),
+	} {
+		if _, err := Decode([]byte(data)); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: err = %v, want ErrInvalid", name, err)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	for _, key := range [][]byte{
+		{0x99, 0x00, 0x0d}, // old format, tag 6
+		{0xc6, 0x0d},       // new format, tag 6
+	} {
+		if err := Check(key); err != nil {
+			t.Errorf("Check(%x) = %v", key, err)
+		}
+	}
+	for _, key := range [][]byte{nil, {0x06}, {0x95, 0x00}, {0xc5, 0x0d}, bytes.Repeat([]byte{1}, 32)} {
+		if err := Check(key); err == nil {
+			t.Errorf("Check(%x) accepted", key)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package radiusauth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Packet codes (RFC 2865 section 3).
+const (
+	codeAccessRequest   = 1
+	codeAccessAccept    = 2
+	codeAccessReject    = 3
+	codeAccessChallenge = 11
+)
+
+// Attribute types (RFC 2865 section 5, RFC 3579 section 3.2).
+const (
+	attrUserName             = 1
+	attrUserPassword         = 2
+	attrCHAPPassword         = 3
+	attrNASIdentifier        = 32
+	attrCHAPChallenge        = 60
+	attrMessageAuthenticator = 80
+)
+
+const (
+	headerSize    = 20
+	authSize      = 16
+	maxPacketSize = 4096
+	maxPassword   = 128
+)
+
+// errBadPacket indicates a datagram that is not a valid answer to the
+// request; it is dropped, as RFC 2865 requires.
+var errBadPacket = errors.New("radius: invalid response")
+
+// attribute is one type-length-value attribute.
+type attribute struct {
+	typ   byte
+	value []byte
+}
+
+// request is an Access-Request ready to send and retransmit.
+type request struct {
+	id            byte
+	authenticator [authSize]byte
+	raw           []byte
+}
+
+// newRequest encodes an Access-Request with attrs, followed by a
+// Message-Authenticator signed with secret.
+func newRequest(id byte, authenticator [authSize]byte, secret []byte, attrs []attribute) (*request, error) {
+	raw := make([]byte, headerSize, 256)
+	raw[0] = codeAccessRequest
+	raw[1] = id
+	copy(raw[4:], authenticator[:])
+	for _, a := range attrs {
+		if len(a.value) > 253 {
+			return nil, fmt.Errorf("radius: attribute %d too long", a.typ)
+		}
+		raw = append(raw, a.typ, byte(2+len(a.value)))
+		raw = append(raw, a.value...)
+	}
+	raw = append(raw, attrMessageAuthenticator, 2+md5.Size)
+	mac := len(raw)
+	raw = append(raw, make([]byte, md5.Size)...)
+	if len(raw) > maxPacketSize {
+		return nil, errors.New("radius: request too long")
+	}
+	binary.BigEndian.PutUint16(raw[2:], uint16(len(raw)))
+	copy(raw[mac:], messageAuthenticator(secret, raw))
+	return &request{id: id, authenticator: authenticator, raw: raw}, nil
+}
+
+// messageAuthenticator returns HMAC-MD5 over packet, whose
+// Message-Authenticator value must be zero.
+func messageAuthenticator(secret, packet []byte) []byte {
+	h := hmac.New(md5.New, secret)
+	h.Write(packet)
+	return h.Sum(nil)
+}
+
+// encryptPassword hides a PAP password (RFC 2865 section 5.2): the
+// password, zero-padded to a multiple of 16 octets, is XORed with a chain
+// of MD5 digests of the secret and the previous block.
+func encryptPassword(password, secret []byte, authenticator [authSize]byte) ([]byte, error) {
+	if len(password) > maxPassword {
+		return nil, errors.New("radius: password longer than 128 octets")
+	}
+	n := (len(password) + authSize - 1) / authSize * authSize
+	if n == 0 {
+		n = authSize
+	}
+	out := make([]byte, n)
+	copy(out, password)
+	prev := authenticator[:]
+	for off := 0; off < n; off += authSize {
+		b := md5.Sum(append(append([]byte{}, secret...), prev...))
+		for i := range authSize {
+			out[off+i] ^= b[i]
+		}
+		prev = out[off : off+authSize]
+	}
+	return out, nil
+}
+
+// chapPassword returns the CHAP-Password value (RFC 2865 section 5.3):
+// the CHAP identifier and MD5(identifier, password, challenge).
+func chapPassword(ident byte, password, challenge []byte) []byte {
+	h := md5.New()
+	h.Write([]byte{ident})
+	h.Write(password)
+	h.Write(challenge)
+	return h.Sum([]byte{ident})
+}
+
+// response is a verified reply to a request.
+type response struct {
+	code  byte
+	attrs []attribute
+}
+
+// parseResponse checks that raw answers req, signed with secret, and
+// decodes it. A reply without a Message-Authenticator is refused unless
+// allowUnsigned is set.
+func parseResponse(raw []byte, req *request, secret []byte, allowUnsigned bool) (*response, error) {
+	if len(raw) < headerSize {
+		return nil, fmt.Errorf("%w: short packet", errBadPacket)
+	}
+	length := int(binary.BigEndian.Uint16(raw[2:]))
+	if length < headerSize || length > len(raw) {
+		return nil, fmt.Errorf("%w: bad length", errBadPacket)
+	}
+	raw = raw[:length]
+	if raw[1] != req.id {
+		return nil, fmt.Errorf("%w: identifier mismatch", errBadPacket)
+	}
+
+	// Response Authenticator: MD5(code, id, length, request authenticator,
+	// attributes, secret).
+	h := md5.New()
+	h.Write(raw[:4])
+	h.Write(req.authenticator[:])
+	h.Write(raw[headerSize:])
+	h.Write(secret)
+	if !hmac.Equal(h.Sum(nil), raw[4:headerSize]) {
+		return nil, fmt.Errorf("%w: bad response authenticator", errBadPacket)
+	}
+
+	resp := &response{code: raw[0]}
+	signed := false
+	for off := headerSize; off < len(raw); {
+		if off+2 > len(raw) || raw[off+1] < 2 || off+int(raw[off+1]) > len(raw) {
+			return nil, fmt.Errorf("%w: truncated attribute", errBadPacket)
+		}
+		typ, value := raw[off], raw[off+2:off+int(raw[off+1])]
+		if typ == attrMessageAuthenticator {
+			if len(value) != md5.Size {
+				return nil, fmt.Errorf("%w: bad Message-Authenticator", errBadPacket)
+			}
+			// Signed over the reply with the request authenticator in
+			// place of the response authenticator and the value zeroed.
+			check := bytes.Clone(raw)
+			copy(check[4:], req.authenticator[:])
+			clear(check[off+2 : off+2+md5.Size])
+			if !hmac.Equal(value, messageAuthenticator(secret, check)) {
+				return nil, fmt.Errorf("%w: bad Message-Authenticator", errBadPacket)
+			}
+			signed = true
+		}
+		resp.attrs = append(resp.attrs, attribute{typ: typ, value: value})
+		off += int(raw[off+1])
+	}
+	if !signed && !allowUnsigned {
+		return nil, fmt.Errorf("%w: missing Message-Authenticator", errBadPacket)
+	}
+	return resp, nil
+}
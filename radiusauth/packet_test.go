@@ -0,0 +1,111 @@
+package radiusauth
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// RFC 2865 section 7.1: nemo's password "arctangent" with secret
+// "xyzzy5461".
+func TestEncryptPassword(t *testing.T) {
+	var authenticator [authSize]byte
+	hex.Decode(authenticator[:], []byte("0f403f9473978057bd83d5cb98f4227a"))
+	got, err := encryptPassword([]byte("arctangent"), []byte("xyzzy5461"), authenticator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "0dbe708d93d413ce3196e43f782a0aee"; hex.EncodeToString(got) != want {
+		t.Errorf("User-Password = %x, want %s", got, want)
+	}
+
+	long := bytes.Repeat([]byte("p"), 40)
+	got, _ = encryptPassword(long, []byte("s"), authenticator)
+	if len(got) != 48 || !bytes.Equal(decryptPassword(got, []byte("s"), authenticator), long) {
+		t.Errorf("40-octet password: %x", got)
+	}
+	if _, err := encryptPassword(bytes.Repeat([]byte("p"), 129), []byte("s"), authenticator); err == nil {
+		t.Error("129-octet password accepted")
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	secret := []byte("s3cret")
+	var authenticator [authSize]byte
+	req, err := newRequest(7, authenticator, secret, []attribute{{attrUserName, []byte("alice")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := req.raw[len(req.raw)-md5.Size:]; !bytes.Equal(got, requestMAC(req.raw, secret)) {
+		t.Error("request Message-Authenticator does not verify")
+	}
+
+	signed := reply(req, secret, codeAccessAccept, true)
+	if resp, err := parseResponse(signed, req, secret, false); err != nil || resp.code != codeAccessAccept {
+		t.Errorf("signed reply: %+v, %v", resp, err)
+	}
+	unsigned := reply(req, secret, codeAccessAccept, false)
+	if _, err := parseResponse(unsigned, req, secret, false); !errors.Is(err, errBadPacket) {
+		t.Errorf("unsigned reply: err = %v, want errBadPacket", err)
+	}
+	if _, err := parseResponse(unsigned, req, secret, true); err != nil {
+		t.Errorf("unsigned reply allowed: %v", err)
+	}
+
+	for name, raw := range map[string][]byte{
+		"wrong secret": reply(req, []byte("other"), codeAccessAccept, true),
+		"wrong id":     func() []byte { b := bytes.Clone(signed); b[1]++; return b }(),
+		"short":        signed[:10],
+		"truncated":    func() []byte { b := bytes.Clone(signed); b[len(b)-17] = 40; return b }(),
+	} {
+		if _, err := parseResponse(raw, req, secret, true); !errors.Is(err, errBadPacket) {
+			t.Errorf("%s: err = %v, want errBadPacket", name, err)
+		}
+	}
+}
+
+// requestMAC recomputes the Message-Authenticator at the end of raw.
+func requestMAC(raw, secret []byte) []byte {
+	check := bytes.Clone(raw)
+	clear(check[len(check)-md5.Size:])
+	return messageAuthenticator(secret, check)
+}
+
+// reply encodes a server's answer to req, with a Message-Authenticator
+// if signed.
+func reply(req *request, secret []byte, code byte, signed bool) []byte {
+	raw := make([]byte, headerSize)
+	raw[0], raw[1] = code, req.id
+	copy(raw[4:], req.authenticator[:])
+	raw = append(raw, 18, 7, 'h', 'e', 'l', 'l', 'o') // Reply-Message
+	mac := 0
+	if signed {
+		raw = append(raw, attrMessageAuthenticator, 2+md5.Size)
+		mac = len(raw)
+		raw = append(raw, make([]byte, md5.Size)...)
+	}
+	binary.BigEndian.PutUint16(raw[2:], uint16(len(raw)))
+	if signed {
+		copy(raw[mac:], messageAuthenticator(secret, raw))
+	}
+	sum := md5.Sum(append(bytes.Clone(raw), secret...))
+	copy(raw[4:], sum[:])
+	return raw
+}
+
+// decryptPassword reverses encryptPassword, as a server does.
+func decryptPassword(hidden, secret []byte, authenticator [authSize]byte) []byte {
+	out := make([]byte, len(hidden))
+	prev := authenticator[:]
+	for off := 0; off < len(hidden); off += authSize {
+		b := md5.Sum(append(bytes.Clone(secret), prev...))
+		for i := range authSize {
+			out[off+i] = hidden[off+i] ^ b[i]
+		}
+		prev = hidden[off : off+authSize]
+	}
+	return bytes.TrimRight(out, "\x00")
+}
@@ -0,0 +1,289 @@
+// Package radiusauth provides an authentication agent that checks
+// passwords against RADIUS servers (RFC 2865) with PAP or CHAP, for
+// deployments that already keep subscriber credentials in RADIUS.
+//
+// Servers are tried in order. A server that does not answer within the
+// timeout, after any retries, is skipped for the dead time while the
+// others are tried; when every server is dead all are tried again.
+// Every request carries a Message-Authenticator (RFC 3579), and replies
+// must carry one too, which protects against forged replies
+// (CVE-2024-3596); AllowUnsignedResponses relaxes that for old servers.
+//
+// An Access-Reject does not tell a wrong password from an unknown user,
+// so it fails with errors.ErrAuthFailed and a chain does not move past
+// the agent. RADIUS cannot look users up without a password either:
+// UserExists consults Options.Users, and without it reports no user.
+package radiusauth
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// Authentication methods.
+const (
+	MethodPAP  = "pap"
+	MethodCHAP = "chap"
+)
+
+// Defaults for Options.
+const (
+	DefaultPort     = "1812"
+	DefaultTimeout  = 3 * time.Second
+	DefaultDeadTime = 30 * time.Second
+)
+
+// Options configures an Agent.
+type Options struct {
+	// Servers are the RADIUS servers as "host" or "host:port" (port
+	// DefaultPort), in order of preference. At least one is required.
+	Servers []string
+
+	// Secret is the shared secret, the same for every server. Required.
+	Secret []byte
+
+	// Method is MethodPAP (the default) or MethodCHAP. CHAP needs the
+	// server to hold cleartext passwords; PAP works with hashed ones.
+	Method string
+
+	// Realm, when set, is appended to usernames as "@realm" in the
+	// User-Name sent, for servers that key subscribers by address.
+	Realm string
+
+	// NASIdentifier names the mail host to the servers (default the
+	// hostname).
+	NASIdentifier string
+
+	// Timeout bounds each attempt (default DefaultTimeout).
+	Timeout time.Duration
+
+	// Retries is the number of retransmissions to a server before moving
+	// on to the next one.
+	Retries int
+
+	// DeadTime is how long a server that did not answer is skipped
+	// (default DefaultDeadTime).
+	DeadTime time.Duration
+
+	// Users, when set, lists the localparts that exist: UserExists answers
+	// from it, and other users fail with errors.ErrUserNotFound without a
+	// request.
+	Users map[string]bool
+
+	// AllowUnsignedResponses accepts replies without a
+	// Message-Authenticator, for servers that predate RFC 3579.
+	AllowUnsignedResponses bool
+}
+
+// server is one RADIUS server and its health.
+type server struct {
+	addr      string
+	deadUntil time.Time
+}
+
+// Agent authenticates users against RADIUS servers.
+// It is safe for concurrent use.
+type Agent struct {
+	opts Options
+	now  func() time.Time
+
+	mu      sync.Mutex
+	servers []*server
+}
+
+// Compile-time check: Agent must satisfy AuthenticationAgent.
+var _ auth.AuthenticationAgent = (*Agent)(nil)
+
+// New returns an agent for opts.
+func New(opts Options) (*Agent, error) {
+	if len(opts.Servers) == 0 {
+		return nil, fmt.Errorf("%w: radiusauth: no servers", autherrors.ErrAuthAgentConfigInvalid)
+	}
+	if len(opts.Secret) == 0 {
+		return nil, fmt.Errorf("%w: radiusauth: shared secret required", autherrors.ErrAuthAgentConfigInvalid)
+	}
+	switch opts.Method {
+	case "":
+		opts.Method = MethodPAP
+	case MethodPAP, MethodCHAP:
+	default:
+		return nil, fmt.Errorf("%w: radiusauth: unknown method %q", autherrors.ErrAuthAgentConfigInvalid, opts.Method)
+	}
+	if opts.Retries < 0 {
+		return nil, fmt.Errorf("%w: radiusauth: negative retry count", autherrors.ErrAuthAgentConfigInvalid)
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.DeadTime <= 0 {
+		opts.DeadTime = DefaultDeadTime
+	}
+	if opts.NASIdentifier == "" {
+		opts.NASIdentifier, _ = os.Hostname()
+	}
+	a := &Agent{opts: opts, now: time.Now}
+	for _, s := range opts.Servers {
+		addr := s
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			addr = net.JoinHostPort(s, DefaultPort)
+		}
+		a.servers = append(a.servers, &server{addr: addr})
+	}
+	return a, nil
+}
+
+// Authenticate sends an Access-Request for username and password.
+// Returns errors.ErrAuthFailed for an Access-Reject or Access-Challenge
+// (multi-round logins are not supported), and errors.ErrBackendUnavailable
+// when no server answers.
+func (a *Agent) Authenticate(ctx context.Context, username, password string) (*auth.AuthSession, error) {
+	if a.opts.Users != nil && !a.opts.Users[username] {
+		return nil, autherrors.ErrUserNotFound
+	}
+	req, err := a.accessRequest(username, password)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.exchange(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.code {
+	case codeAccessAccept:
+		return &auth.AuthSession{User: &auth.User{Username: username, Mailbox: username}}, nil
+	case codeAccessChallenge:
+		return nil, fmt.Errorf("%w: radius server sent an Access-Challenge", autherrors.ErrAuthFailed)
+	default:
+		return nil, autherrors.ErrAuthFailed
+	}
+}
+
+// UserExists reports whether Options.Users lists username; without a
+// list it reports false.
+func (a *Agent) UserExists(_ context.Context, username string) (bool, error) {
+	return a.opts.Users[username], nil
+}
+
+// Close releases nothing; each request uses its own socket.
+func (a *Agent) Close() error { return nil }
+
+// accessRequest encodes the Access-Request for username and password.
+func (a *Agent) accessRequest(username, password string) (*request, error) {
+	var random [2 + authSize + authSize]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return nil, err
+	}
+	id, chapID := random[0], random[1]
+	var authenticator [authSize]byte
+	copy(authenticator[:], random[2:])
+	challenge := random[2+authSize:]
+
+	name := username
+	if a.opts.Realm != "" {
+		name += "@" + a.opts.Realm
+	}
+	attrs := []attribute{{attrUserName, []byte(name)}}
+	if a.opts.Method == MethodCHAP {
+		attrs = append(attrs,
+			attribute{attrCHAPPassword, chapPassword(chapID, []byte(password), challenge)},
+			attribute{attrCHAPChallenge, challenge})
+	} else {
+		hidden, err := encryptPassword([]byte(password), a.opts.Secret, authenticator)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", autherrors.ErrAuthFailed, err)
+		}
+		attrs = append(attrs, attribute{attrUserPassword, hidden})
+	}
+	if a.opts.NASIdentifier != "" {
+		attrs = append(attrs, attribute{attrNASIdentifier, []byte(a.opts.NASIdentifier)})
+	}
+	return newRequest(id, authenticator, a.opts.Secret, attrs)
+}
+
+// exchange sends req to each server in turn, live ones first, until one
+// answers.
+func (a *Agent) exchange(ctx context.Context, req *request) (*response, error) {
+	var errs []error
+	for _, s := range a.order() {
+		for range a.opts.Retries + 1 {
+			resp, err := a.attempt(ctx, s.addr, req)
+			if err == nil {
+				a.setDeadUntil(s, time.Time{})
+				return resp, nil
+			}
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			errs = append(errs, err)
+		}
+		a.setDeadUntil(s, a.now().Add(a.opts.DeadTime))
+	}
+	return nil, fmt.Errorf("%w: radius: %w", autherrors.ErrBackendUnavailable, errors.Join(errs...))
+}
+
+// order returns the servers to try: those not marked dead, in
+// configured order, then the dead ones.
+func (a *Agent) order() []*server {
+	now := a.now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	live := make([]*server, 0, len(a.servers))
+	var dead []*server
+	for _, s := range a.servers {
+		if now.Before(s.deadUntil) {
+			dead = append(dead, s)
+		} else {
+			live = append(live, s)
+		}
+	}
+	return append(live, dead...)
+}
+
+func (a *Agent) setDeadUntil(s *server, t time.Time) {
+	a.mu.Lock()
+	s.deadUntil = t
+	a.mu.Unlock()
+}
+
+// attempt sends req to addr once and waits for a valid reply, dropping
+// datagrams that are not one.
+func (a *Agent) attempt(ctx context.Context, addr string, req *request) (*response, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.opts.Timeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", addr, err)
+	}
+	defer func() { _ = conn.Close() }()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(req.raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", addr, err)
+	}
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", addr, err)
+		}
+		resp, err := parseResponse(buf[:n], req, a.opts.Secret, a.opts.AllowUnsignedResponses)
+		if err != nil {
+			continue
+		}
+		switch resp.code {
+		case codeAccessAccept, codeAccessReject, codeAccessChallenge:
+			return resp, nil
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package radiusauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+var testSecret = []byte("s3cret")
+
+// testServer is a RADIUS server knowing alice@example.net/wonderland.
+// A silent server reads requests without answering.
+type testServer struct {
+	conn     net.PacketConn
+	requests atomic.Int32
+	silent   atomic.Bool
+	unsigned atomic.Bool
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{conn: conn}
+	t.Cleanup(func() { _ = conn.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *testServer) addr() string { return s.conn.LocalAddr().String() }
+
+func (s *testServer) serve() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		s.requests.Add(1)
+		if s.silent.Load() {
+			continue
+		}
+		raw := bytes.Clone(buf[:n])
+		req := &request{id: raw[1], raw: raw}
+		copy(req.authenticator[:], raw[4:headerSize])
+		code := byte(codeAccessReject)
+		if s.valid(req) {
+			code = codeAccessAccept
+		}
+		_, _ = s.conn.WriteTo(reply(req, testSecret, code, !s.unsigned.Load()), from)
+	}
+}
+
+// valid checks the request's Message-Authenticator and credentials.
+func (s *testServer) valid(req *request) bool {
+	attrs := make(map[byte][]byte)
+	for off := headerSize; off+2 <= len(req.raw); off += int(req.raw[off+1]) {
+		attrs[req.raw[off]] = req.raw[off+2 : off+int(req.raw[off+1])]
+	}
+	if !bytes.Equal(attrs[attrMessageAuthenticator], requestMAC(req.raw, testSecret)) ||
+		string(attrs[attrUserName]) != "alice@example.net" || len(attrs[attrNASIdentifier]) == 0 {
+		return false
+	}
+	if chap := attrs[attrCHAPPassword]; chap != nil {
+		return len(chap) == 1+md5.Size && bytes.Equal(chap, chapPassword(chap[0], []byte("wonderland"), attrs[attrCHAPChallenge]))
+	}
+	return string(decryptPassword(attrs[attrUserPassword], testSecret, req.authenticator)) == "wonderland"
+}
+
+func newAgent(t *testing.T, opts Options) *Agent {
+	t.Helper()
+	opts.Secret = testSecret
+	opts.Realm = "example.net"
+	if opts.Timeout == 0 {
+		opts.Timeout = 200 * time.Millisecond
+	}
+	a, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = a.Close() })
+	return a
+}
+
+func TestAgent_Authenticate(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestServer(t)
+	for _, method := range []string{MethodPAP, MethodCHAP} {
+		a := newAgent(t, Options{Servers: []string{srv.addr()}, Method: method})
+		s, err := a.Authenticate(ctx, "alice", "wonderland")
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		if s.User.Username != "alice" || s.User.Mailbox != "alice" {
+			t.Errorf("%s: session = %+v", method, s.User)
+		}
+		if _, err := a.Authenticate(ctx, "alice", "looking-glass"); !errors.Is(err, autherrors.ErrAuthFailed) {
+			t.Errorf("%s: wrong password: err = %v, want ErrAuthFailed", method, err)
+		}
+	}
+
+	a := newAgent(t, Options{Servers: []string{srv.addr()}, Users: map[string]bool{"alice": true}})
+	if _, err := a.Authenticate(ctx, "bob", "wonderland"); !errors.Is(err, autherrors.ErrUserNotFound) {
+		t.Errorf("unlisted user: err = %v, want ErrUserNotFound", err)
+	}
+	if ok, _ := a.UserExists(ctx, "alice"); !ok {
+		t.Error("UserExists(alice) = false with a users list")
+	}
+}
+
+func TestAgent_Failover(t *testing.T) {
+	ctx := context.Background()
+	down, up := newTestServer(t), newTestServer(t)
+	down.silent.Store(true)
+	a := newAgent(t, Options{Servers: []string{down.addr(), up.addr()}, Retries: 1, Timeout: 50 * time.Millisecond})
+
+	if _, err := a.Authenticate(ctx, "alice", "wonderland"); err != nil {
+		t.Fatal(err)
+	}
+	if n := down.requests.Load(); n != 2 {
+		t.Errorf("silent server got %d requests, want 2 (one retry)", n)
+	}
+	// The silent server is now skipped.
+	if _, err := a.Authenticate(ctx, "alice", "wonderland"); err != nil {
+		t.Fatal(err)
+	}
+	if n := down.requests.Load(); n != 2 {
+		t.Errorf("dead server was retried within the dead time (%d requests)", n)
+	}
+	// Once the dead time passes it is first again.
+	a.now = func() time.Time { return time.Now().Add(DefaultDeadTime) }
+	if _, err := a.Authenticate(ctx, "alice", "wonderland"); err != nil {
+		t.Fatal(err)
+	}
+	if n := down.requests.Load(); n != 4 {
+		t.Errorf("silent server got %d requests after the dead time, want 4", n)
+	}
+
+	// No server answers: the backend is unavailable, not the password wrong.
+	up.silent.Store(true)
+	_, err := a.Authenticate(ctx, "alice", "wonderland")
+	if !errors.Is(err, autherrors.ErrBackendUnavailable) || errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("all down: err = %v, want ErrBackendUnavailable", err)
+	}
+}
+
+func TestAgent_UnsignedResponses(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestServer(t)
+	srv.unsigned.Store(true)
+
+	a := newAgent(t, Options{Servers: []string{srv.addr()}, Timeout: 50 * time.Millisecond})
+	if _, err := a.Authenticate(ctx, "alice", "wonderland"); !errors.Is(err, autherrors.ErrBackendUnavailable) {
+		t.Errorf("unsigned reply: err = %v, want ErrBackendUnavailable", err)
+	}
+	a = newAgent(t, Options{Servers: []string{srv.addr()}, AllowUnsignedResponses: true})
+	if _, err := a.Authenticate(ctx, "alice", "wonderland"); err != nil {
+		t.Errorf("unsigned reply allowed: %v", err)
+	}
+}
+
+func TestNew_Config(t *testing.T) {
+	for name, opts := range map[string]Options{
+		"no servers": {Secret: testSecret},
+		"no secret":  {Servers: []string{"radius.example.net"}},
+		"method":     {Servers: []string{"radius.example.net"}, Secret: testSecret, Method: "mschap"},
+		"retries":    {Servers: []string{"radius.example.net"}, Secret: testSecret, Retries: -1},
+	} {
+		if _, err := New(opts); !errors.Is(err, autherrors.ErrAuthAgentConfigInvalid) {
+			t.Errorf("%s: err = %v, want ErrAuthAgentConfigInvalid", name, err)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "secret")
+	users := filepath.Join(dir, "users")
+	if err := os.WriteFile(secret, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(users, []byte("# subscribers\nalice\nBob\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	agent, err := auth.OpenAuthAgent(auth.AuthAgentConfig{
+		Type:              "radius",
+		CredentialBackend: "radius1.example.net, radius2.example.net:1645",
+		Options: map[string]string{
+			"secret_file": secret,
+			"users_file":  users,
+			"method":      "chap",
+			"retries":     "2",
+			"dead_time":   "1m",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	a := agent.(*Agent)
+	if a.servers[0].addr != "radius1.example.net:1812" || a.servers[1].addr != "radius2.example.net:1645" {
+		t.Errorf("servers = %s, %s", a.servers[0].addr, a.servers[1].addr)
+	}
+	if string(a.opts.Secret) != "s3cret" || a.opts.Method != MethodCHAP || a.opts.Retries != 2 ||
+		a.opts.DeadTime != time.Minute || !a.opts.Users["bob"] {
+		t.Errorf("opts = %+v", a.opts)
+	}
+
+	if _, err := auth.OpenAuthAgent(auth.AuthAgentConfig{Type: "radius", CredentialBackend: "radius.example.net"}); !errors.Is(err, autherrors.ErrAuthAgentConfigInvalid) {
+		t.Errorf("no secret: err = %v, want ErrAuthAgentConfigInvalid", err)
+	}
+}
@@ -0,0 +1,85 @@
+package radiusauth
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/errors"
+)
+
+func init() {
+	// CredentialBackend is a comma-separated list of servers. Options:
+	// "secret_file", a file holding the shared secret so it stays out of
+	// the config (required); "method" ("pap" or "chap"); "realm";
+	// "nas_identifier"; "timeout" and "dead_time" (Go durations);
+	// "retries"; "users_file", a file of localparts, one per line; and
+	// "allow_unsigned_responses" ("true" for servers without RFC 3579).
+	auth.RegisterAuthAgent("radius", func(config auth.AuthAgentConfig) (auth.AuthenticationAgent, error) {
+		opts := Options{
+			Method:        config.Options["method"],
+			Realm:         config.Options["realm"],
+			NASIdentifier: config.Options["nas_identifier"],
+		}
+		for _, s := range strings.Split(config.CredentialBackend, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				opts.Servers = append(opts.Servers, s)
+			}
+		}
+		var err error
+		if v := config.Options["timeout"]; v != "" {
+			if opts.Timeout, err = time.ParseDuration(v); err != nil {
+				return nil, fmt.Errorf("%w: timeout: %v", errors.ErrAuthAgentConfigInvalid, err)
+			}
+		}
+		if v := config.Options["dead_time"]; v != "" {
+			if opts.DeadTime, err = time.ParseDuration(v); err != nil {
+				return nil, fmt.Errorf("%w: dead_time: %v", errors.ErrAuthAgentConfigInvalid, err)
+			}
+		}
+		if v := config.Options["retries"]; v != "" {
+			if opts.Retries, err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("%w: retries: %v", errors.ErrAuthAgentConfigInvalid, err)
+			}
+		}
+		if v := config.Options["allow_unsigned_responses"]; v != "" {
+			if opts.AllowUnsignedResponses, err = strconv.ParseBool(v); err != nil {
+				return nil, fmt.Errorf("%w: allow_unsigned_responses: %v", errors.ErrAuthAgentConfigInvalid, err)
+			}
+		}
+		if path := config.Options["secret_file"]; path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("read secret file: %w", err)
+			}
+			opts.Secret = []byte(strings.TrimSpace(string(data)))
+		}
+		if path := config.Options["users_file"]; path != "" {
+			users, err := readUsers(path)
+			if err != nil {
+				return nil, err
+			}
+			opts.Users = users
+		}
+		return New(opts)
+	})
+}
+
+// readUsers parses a users file: one localpart per line, with blank lines
+// and "#" comments ignored.
+func readUsers(path string) (map[string]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read users file: %w", err)
+	}
+	users := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			users[strings.ToLower(line)] = true
+		}
+	}
+	return users, nil
+}
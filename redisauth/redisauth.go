@@ -0,0 +1,700 @@
+// Package redisauth provides an authentication agent that keeps user
+// records in Redis hashes, for POP3/IMAP clusters whose nodes share one
+// credential store.
+//
+// Each user is a hash at KeyPrefix+username with the fields:
+//
+//	password_hash  argon2id PHC string, as produced by passwd.HashPassword
+//	mailbox        optional; defaults to the username
+//	uid, gid       optional; the user's numeric OS user and group ids
+//	public_key     optional, base64
+//	private_key    optional, base64, sealed under the login password
+//	               (passwd.EncryptPrivateKey)
+//
+// Records are cached in memory. Every write made through the agent
+// (PutUser, ChangePassword, DeleteUser) publishes the username on a
+// channel, and every agent subscribed to it drops its cached copy, so a
+// password changed on one node applies on all at once. Tools writing the
+// hashes directly call Invalidate, or PUBLISH the username themselves; "*"
+// drops every cached record. The cache is used only while the
+// subscription is up: after a disconnect it is cleared and bypassed until
+// the agent has subscribed again, since invalidations may have been lost.
+package redisauth
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/passwd"
+)
+
+// Defaults for Options.
+const (
+	DefaultKeyPrefix = "mail:user:"
+	DefaultChannel   = "mail:auth:invalidate"
+	DefaultCacheTTL  = 5 * time.Minute
+	DefaultTimeout   = 2 * time.Second
+	DefaultPoolSize  = 8
+)
+
+// invalidateAll is the message that drops every cached record.
+const invalidateAll = "*"
+
+// maxCacheEntries bounds the record cache; past it expired entries are
+// dropped, and the whole cache if none are.
+const maxCacheEntries = 10000
+
+// Reconnect delays for the subscription.
+var (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// Options configures an Agent.
+type Options struct {
+	// Addr is the server's "host:port". Required.
+	Addr string
+
+	// Username and Password authenticate to the server (AUTH); Username
+	// only with Redis 6 ACLs.
+	Username string
+	Password string
+
+	// DB selects the logical database.
+	DB int
+
+	// TLS, when set, connects with TLS.
+	TLS *tls.Config
+
+	// KeyPrefix is prepended to usernames to name their hashes (default
+	// DefaultKeyPrefix).
+	KeyPrefix string
+
+	// Channel carries invalidations (default DefaultChannel).
+	Channel string
+
+	// CacheTTL bounds how long a record is cached even without an
+	// invalidation (default DefaultCacheTTL). Negative disables the cache
+	// and the subscription.
+	CacheTTL time.Duration
+
+	// Timeout bounds each command, including connecting (default
+	// DefaultTimeout).
+	Timeout time.Duration
+
+	// PoolSize is the number of idle connections kept (default
+	// DefaultPoolSize).
+	PoolSize int
+}
+
+// Record is a user's credential record.
+type Record struct {
+	PasswordHash string
+	Mailbox      string
+	Uid, Gid     uint32 // 0 when not set
+	PublicKey    []byte
+	PrivateKey   []byte // sealed, see passwd.EncryptPrivateKey
+}
+
+// fields returns the hash fields for r, empty ones omitted.
+func (r Record) fields() []string {
+	f := []string{"password_hash", r.PasswordHash}
+	if r.Mailbox != "" {
+		f = append(f, "mailbox", r.Mailbox)
+	}
+	if r.Uid != 0 {
+		f = append(f, "uid", strconv.FormatUint(uint64(r.Uid), 10))
+	}
+	if r.Gid != 0 {
+		f = append(f, "gid", strconv.FormatUint(uint64(r.Gid), 10))
+	}
+	if r.PublicKey != nil {
+		f = append(f, "public_key", base64.StdEncoding.EncodeToString(r.PublicKey))
+	}
+	if r.PrivateKey != nil {
+		f = append(f, "private_key", base64.StdEncoding.EncodeToString(r.PrivateKey))
+	}
+	return f
+}
+
+// parseRecord decodes a HGETALL reply; an empty one is no record.
+func parseRecord(kv []string) (*Record, error) {
+	if len(kv) == 0 {
+		return nil, nil
+	}
+	fields := make(map[string]string, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		fields[kv[i]] = kv[i+1]
+	}
+	rec := &Record{PasswordHash: fields["password_hash"], Mailbox: fields["mailbox"]}
+	if rec.PasswordHash == "" {
+		return nil, errors.New("record has no password_hash")
+	}
+	var err error
+	if rec.Uid, err = parseID(fields["uid"]); err != nil {
+		return nil, fmt.Errorf("uid: %w", err)
+	}
+	if rec.Gid, err = parseID(fields["gid"]); err != nil {
+		return nil, fmt.Errorf("gid: %w", err)
+	}
+	if v := fields["public_key"]; v != "" {
+		if rec.PublicKey, err = base64.StdEncoding.DecodeString(v); err != nil {
+			return nil, fmt.Errorf("public_key: %w", err)
+		}
+	}
+	if v := fields["private_key"]; v != "" {
+		if rec.PrivateKey, err = base64.StdEncoding.DecodeString(v); err != nil {
+			return nil, fmt.Errorf("private_key: %w", err)
+		}
+	}
+	return rec, nil
+}
+
+// parseID parses a uid or gid field; an empty one is 0.
+func parseID(v string) (uint32, error) {
+	if v == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(v, 10, 32)
+	return uint32(id), err
+}
+
+// cacheEntry is a cached lookup; rec is nil for a user that does not
+// exist.
+type cacheEntry struct {
+	rec     *Record
+	expires time.Time
+}
+
+// Agent authenticates users against records in Redis.
+// It is safe for concurrent use.
+type Agent struct {
+	opts Options
+	now  func() time.Time
+	idle chan *conn
+
+	mu         sync.Mutex
+	cache      map[string]cacheEntry
+	subscribed bool   // the cache is in use, see package doc
+	gen        uint64 // bumped by every invalidation, see record
+
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+// Compile-time check: Agent must satisfy AuthenticationAgent, KeyProvider
+// and UserLister.
+var (
+	_ auth.AuthenticationAgent = (*Agent)(nil)
+	_ auth.KeyProvider         = (*Agent)(nil)
+	_ auth.UserLister          = (*Agent)(nil)
+)
+
+// New returns an agent for the server at opts.Addr and, unless caching is
+// disabled, subscribes to the invalidation channel in the background.
+// Connections are made on first use.
+func New(opts Options) (*Agent, error) {
+	if opts.Addr == "" {
+		return nil, fmt.Errorf("%w: redisauth: no address", autherrors.ErrAuthAgentConfigInvalid)
+	}
+	if _, _, err := net.SplitHostPort(opts.Addr); err != nil {
+		return nil, fmt.Errorf("%w: redisauth: address %q: %v", autherrors.ErrAuthAgentConfigInvalid, opts.Addr, err)
+	}
+	if opts.DB < 0 {
+		return nil, fmt.Errorf("%w: redisauth: negative database", autherrors.ErrAuthAgentConfigInvalid)
+	}
+	if opts.KeyPrefix == "" {
+		opts.KeyPrefix = DefaultKeyPrefix
+	}
+	if opts.Channel == "" {
+		opts.Channel = DefaultChannel
+	}
+	if opts.CacheTTL == 0 {
+		opts.CacheTTL = DefaultCacheTTL
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = DefaultPoolSize
+	}
+	a := &Agent{
+		opts:  opts,
+		now:   time.Now,
+		idle:  make(chan *conn, opts.PoolSize),
+		cache: make(map[string]cacheEntry),
+		done:  make(chan struct{}),
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	a.stop = stop
+	if opts.CacheTTL > 0 {
+		go a.subscribe(ctx)
+	} else {
+		close(a.done)
+	}
+	return a, nil
+}
+
+// Authenticate verifies password against the user's record and unseals
+// their private key, if the record holds one.
+func (a *Agent) Authenticate(ctx context.Context, username, password string) (*auth.AuthSession, error) {
+	rec, err := a.record(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if !passwd.VerifyPassword(password, rec.PasswordHash) {
+		return nil, autherrors.ErrAuthFailed
+	}
+	session := &auth.AuthSession{User: &auth.User{Username: username, Mailbox: rec.Mailbox, Uid: rec.Uid, Gid: rec.Gid}}
+	if session.User.Mailbox == "" {
+		session.User.Mailbox = username
+	}
+	if rec.PublicKey != nil {
+		session.PublicKey = rec.PublicKey
+		session.EncryptionEnabled = true
+	}
+	if rec.PrivateKey != nil {
+		if session.PrivateKey, err = passwd.DecryptPrivateKey(rec.PrivateKey, password); err != nil {
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+// UserExists reports whether username has a record.
+func (a *Agent) UserExists(ctx context.Context, username string) (bool, error) {
+	_, err := a.record(ctx, username)
+	if errors.Is(err, autherrors.ErrUserNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetPublicKey returns the public key from the user's record.
+func (a *Agent) GetPublicKey(ctx context.Context, username string) ([]byte, error) {
+	rec, err := a.record(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if rec.PublicKey == nil {
+		return nil, autherrors.ErrKeyNotFound
+	}
+	return rec.PublicKey, nil
+}
+
+// GetPublicKeys returns the public keys from the users' records. Users
+// without a record or key are left out.
+func (a *Agent) GetPublicKeys(ctx context.Context, usernames []string) (map[string][]byte, error) {
+	return auth.GetPublicKeysOneByOne(ctx, a.GetPublicKey, usernames)
+}
+
+// HasEncryption reports whether the user's record holds a public key.
+func (a *Agent) HasEncryption(ctx context.Context, username string) (bool, error) {
+	rec, err := a.record(ctx, username)
+	if errors.Is(err, autherrors.ErrUserNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return rec.PublicKey != nil, nil
+}
+
+// ListUsers returns the users with a record, sorted, by scanning the keys
+// under KeyPrefix.
+func (a *Agent) ListUsers(ctx context.Context) ([]string, error) {
+	var users []string
+	cursor := "0"
+	for {
+		reply, err := a.command(ctx, "SCAN", cursor, "MATCH", globEscape(a.opts.KeyPrefix)+"*", "COUNT", "1000")
+		if err != nil {
+			return nil, err
+		}
+		items, ok := reply.([]any)
+		if !ok || len(items) != 2 {
+			return nil, fmt.Errorf("%w: %w: SCAN reply", autherrors.ErrBackendUnavailable, errProtocol)
+		}
+		cursor, _ = items[0].(string)
+		keys, err := replyStrings(items[1])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", autherrors.ErrBackendUnavailable, err)
+		}
+		for _, k := range keys {
+			users = append(users, strings.TrimPrefix(k, a.opts.KeyPrefix))
+		}
+		if cursor == "0" || cursor == "" {
+			break
+		}
+	}
+	// SCAN may return a key more than once.
+	slices.Sort(users)
+	return slices.Compact(users), nil
+}
+
+// PutUser stores rec as username's record, replacing any other, and
+// invalidates cached copies on every node.
+func (a *Agent) PutUser(ctx context.Context, username string, rec Record) error {
+	if !validUsername(username) || rec.PasswordHash == "" {
+		return fmt.Errorf("redisauth: invalid record for %q", username)
+	}
+	key := a.opts.KeyPrefix + username
+	args := append([]string{"HSET", key}, rec.fields()...)
+	if err := a.transaction(ctx, []string{"DEL", key}, args); err != nil {
+		return err
+	}
+	return a.Invalidate(ctx, username)
+}
+
+// ChangePassword verifies current, stores the hash of password and reseals
+// the private key under it, then invalidates cached copies on every node.
+func (a *Agent) ChangePassword(ctx context.Context, username, current, password string) error {
+	if _, err := a.Authenticate(ctx, username, current); err != nil {
+		return err
+	}
+	// Read past the cache: the record is about to be rewritten.
+	rec, err := a.fetch(ctx, username)
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		return autherrors.ErrUserNotFound
+	}
+	if rec.PasswordHash, err = passwd.HashPassword(password); err != nil {
+		return err
+	}
+	if rec.PrivateKey != nil {
+		priv, err := passwd.DecryptPrivateKey(rec.PrivateKey, current)
+		if err != nil {
+			return err
+		}
+		rec.PrivateKey, err = passwd.EncryptPrivateKey(priv, password)
+		clear(priv)
+		if err != nil {
+			return err
+		}
+	}
+	return a.PutUser(ctx, username, *rec)
+}
+
+// DeleteUser removes username's record and invalidates cached copies on
+// every node.
+func (a *Agent) DeleteUser(ctx context.Context, username string) error {
+	if !validUsername(username) {
+		return autherrors.ErrUserNotFound
+	}
+	n, err := a.command(ctx, "DEL", a.opts.KeyPrefix+username)
+	if err != nil {
+		return err
+	}
+	if err := a.Invalidate(ctx, username); err != nil {
+		return err
+	}
+	if n == int64(0) {
+		return autherrors.ErrUserNotFound
+	}
+	return nil
+}
+
+// Invalidate drops username's cached record here and, through the
+// channel, on every other node; "*" drops every record.
+func (a *Agent) Invalidate(ctx context.Context, username string) error {
+	a.invalidate(username)
+	_, err := a.command(ctx, "PUBLISH", a.opts.Channel, username)
+	return err
+}
+
+// Close stops the subscription and closes idle connections.
+func (a *Agent) Close() error {
+	a.stop()
+	<-a.done
+	for {
+		select {
+		case c := <-a.idle:
+			_ = c.close()
+		default:
+			return nil
+		}
+	}
+}
+
+// record returns username's record from the cache or the server.
+// Returns errors.ErrUserNotFound for users without a record and
+// errors.ErrBackendUnavailable when the server fails.
+func (a *Agent) record(ctx context.Context, username string) (*Record, error) {
+	if !validUsername(username) {
+		return nil, autherrors.ErrUserNotFound
+	}
+	now := a.now()
+	a.mu.Lock()
+	e, ok := a.cache[username]
+	gen, caching := a.gen, a.subscribed
+	a.mu.Unlock()
+	if caching && ok && now.Before(e.expires) {
+		if e.rec == nil {
+			return nil, autherrors.ErrUserNotFound
+		}
+		return e.rec, nil
+	}
+
+	rec, err := a.fetch(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	a.remember(username, rec, now, gen)
+	if rec == nil {
+		return nil, autherrors.ErrUserNotFound
+	}
+	return rec, nil
+}
+
+// fetch reads username's record from the server; nil if there is none.
+func (a *Agent) fetch(ctx context.Context, username string) (*Record, error) {
+	reply, err := a.command(ctx, "HGETALL", a.opts.KeyPrefix+username)
+	if err != nil {
+		return nil, err
+	}
+	kv, err := replyStrings(reply)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", autherrors.ErrBackendUnavailable, err)
+	}
+	rec, err := parseRecord(kv)
+	if err != nil {
+		return nil, fmt.Errorf("%w: record for %s: %w", autherrors.ErrBackendUnavailable, username, err)
+	}
+	return rec, nil
+}
+
+// remember caches rec, nil for a missing user, as read at now, unless an
+// invalidation arrived since gen was taken: the read may predate it.
+func (a *Agent) remember(username string, rec *Record, now time.Time, gen uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.subscribed || a.gen != gen {
+		return
+	}
+	if len(a.cache) >= maxCacheEntries {
+		for name, e := range a.cache {
+			if !now.Before(e.expires) {
+				delete(a.cache, name)
+			}
+		}
+		if len(a.cache) >= maxCacheEntries {
+			clear(a.cache)
+		}
+	}
+	a.cache[username] = cacheEntry{rec: rec, expires: now.Add(a.opts.CacheTTL)}
+}
+
+// invalidate drops username's cached record, or all for invalidateAll.
+func (a *Agent) invalidate(username string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.gen++
+	if username == invalidateAll {
+		clear(a.cache)
+	} else {
+		delete(a.cache, username)
+	}
+}
+
+// setSubscribed turns the cache on or off, clearing it either way.
+func (a *Agent) setSubscribed(on bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.gen++
+	a.subscribed = on
+	clear(a.cache)
+}
+
+// subscribe listens on the invalidation channel until ctx is done,
+// reconnecting with backoff.
+func (a *Agent) subscribe(ctx context.Context) {
+	defer close(a.done)
+	backoff := minBackoff
+	for {
+		c, err := a.dial(ctx)
+		if err == nil {
+			if a.listen(ctx, c) {
+				backoff = minBackoff
+			}
+			_ = c.close()
+		}
+		a.setSubscribed(false)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// listen subscribes c to the channel and applies invalidations until the
+// connection fails or ctx is done. Reports whether the subscription was
+// established.
+func (a *Agent) listen(ctx context.Context, c *conn) bool {
+	stop := context.AfterFunc(ctx, func() { _ = c.close() })
+	defer stop()
+	if _, err := c.do(time.Now().Add(a.opts.Timeout), "SUBSCRIBE", a.opts.Channel); err != nil {
+		return false
+	}
+	if err := c.nc.SetDeadline(time.Time{}); err != nil {
+		return false
+	}
+	a.setSubscribed(true)
+	for {
+		reply, err := c.read()
+		if err != nil {
+			return true
+		}
+		msg, err := replyStrings(reply)
+		if err == nil && len(msg) == 3 && msg[0] == "message" {
+			a.invalidate(msg[2])
+		}
+	}
+}
+
+// command runs one command on a pooled connection. Failures other than
+// error replies are errors.ErrBackendUnavailable.
+func (a *Agent) command(ctx context.Context, args ...string) (any, error) {
+	var c *conn
+	select {
+	case c = <-a.idle:
+	default:
+		var err error
+		if c, err = a.dial(ctx); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := c.do(a.deadline(ctx), args...)
+	if err == nil {
+		a.release(c)
+		return reply, nil
+	}
+	// After an error reply the connection is still in step; after
+	// anything else it may not be.
+	if rerr := redisError(""); errors.As(err, &rerr) {
+		a.release(c)
+	} else {
+		_ = c.close()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+	}
+	return nil, fmt.Errorf("%w: redis %s: %w", autherrors.ErrBackendUnavailable, args[0], err)
+}
+
+// transaction runs cmds atomically with MULTI/EXEC.
+func (a *Agent) transaction(ctx context.Context, cmds ...[]string) error {
+	c, err := a.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = c.close() }()
+	deadline := a.deadline(ctx)
+	if _, err := c.do(deadline, "MULTI"); err != nil {
+		return fmt.Errorf("%w: redis MULTI: %w", autherrors.ErrBackendUnavailable, err)
+	}
+	for _, cmd := range cmds {
+		if _, err := c.do(deadline, cmd...); err != nil {
+			return fmt.Errorf("%w: redis %s: %w", autherrors.ErrBackendUnavailable, cmd[0], err)
+		}
+	}
+	reply, err := c.do(deadline, "EXEC")
+	if err != nil {
+		return fmt.Errorf("%w: redis EXEC: %w", autherrors.ErrBackendUnavailable, err)
+	}
+	results, _ := reply.([]any)
+	for _, r := range results {
+		if rerr, ok := r.(redisError); ok {
+			return fmt.Errorf("%w: redis EXEC: %w", autherrors.ErrBackendUnavailable, rerr)
+		}
+	}
+	return nil
+}
+
+// release returns c to the pool, or closes it if the pool is full.
+func (a *Agent) release(c *conn) {
+	select {
+	case a.idle <- c:
+	default:
+		_ = c.close()
+	}
+}
+
+// deadline returns the deadline for one command under ctx.
+func (a *Agent) deadline(ctx context.Context) time.Time {
+	d := time.Now().Add(a.opts.Timeout)
+	if cd, ok := ctx.Deadline(); ok && cd.Before(d) {
+		return cd
+	}
+	return d
+}
+
+// dial connects, authenticates and selects the database.
+func (a *Agent) dial(ctx context.Context) (*conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.opts.Timeout)
+	defer cancel()
+	var nc net.Conn
+	var err error
+	if a.opts.TLS != nil {
+		d := tls.Dialer{Config: a.opts.TLS}
+		nc, err = d.DialContext(ctx, "tcp", a.opts.Addr)
+	} else {
+		var d net.Dialer
+		nc, err = d.DialContext(ctx, "tcp", a.opts.Addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: redis: %w", autherrors.ErrBackendUnavailable, err)
+	}
+	c := newConn(nc)
+	deadline, _ := ctx.Deadline()
+	var setup [][]string
+	if a.opts.Password != "" {
+		if a.opts.Username != "" {
+			setup = append(setup, []string{"AUTH", a.opts.Username, a.opts.Password})
+		} else {
+			setup = append(setup, []string{"AUTH", a.opts.Password})
+		}
+	}
+	if a.opts.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(a.opts.DB)})
+	}
+	for _, cmd := range setup {
+		if _, err := c.do(deadline, cmd...); err != nil {
+			_ = c.close()
+			return nil, fmt.Errorf("%w: redis %s: %w", autherrors.ErrBackendUnavailable, cmd[0], err)
+		}
+	}
+	return c, nil
+}
+
+// validUsername reports whether username may name a record. Glob
+// characters are refused so a name cannot match others in ListUsers
+// patterns, and "*" is reserved for invalidating everything.
+func validUsername(username string) bool {
+	return username != "" && !strings.ContainsAny(username, "*?[]\\ \t\r\n")
+}
+
+// globEscape escapes the glob characters in s for a SCAN pattern.
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,375 @@
+package redisauth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/passwd"
+)
+
+// fakeRedis is a Redis server with the commands the agent uses.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu      sync.Mutex
+	hashes  map[string]map[string]string
+	subs    map[*conn]bool
+	hgetall int
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{ln: ln, password: password, hashes: make(map[string]map[string]string), subs: make(map[*conn]bool)}
+	t.Cleanup(func() {
+		_ = ln.Close()
+		s.dropSubscribers()
+	})
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(newConn(nc))
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) addr() string { return s.ln.Addr().String() }
+
+// dropSubscribers closes every subscribed connection.
+func (s *fakeRedis) dropSubscribers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.subs {
+		_ = c.close()
+		delete(s.subs, c)
+	}
+}
+
+// put stores a record for username, as a tool writing to Redis directly
+// would.
+func (s *fakeRedis) put(username, hash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hashes[DefaultKeyPrefix+username] = map[string]string{"password_hash": hash}
+}
+
+func (s *fakeRedis) reads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hgetall
+}
+
+func (s *fakeRedis) serve(c *conn) {
+	defer func() { _ = c.close() }()
+	authed := s.password == ""
+	var queue [][]string // commands inside MULTI; nil outside
+	for {
+		req, err := c.read()
+		if err != nil {
+			return
+		}
+		args, err := replyStrings(req)
+		if err != nil || len(args) == 0 {
+			return
+		}
+		cmd := strings.ToUpper(args[0])
+		switch {
+		case cmd == "AUTH":
+			authed = args[len(args)-1] == s.password
+			if !authed {
+				s.write(c, "-WRONGPASS invalid password\r\n")
+				continue
+			}
+			s.write(c, "+OK\r\n")
+		case !authed:
+			s.write(c, "-NOAUTH Authentication required.\r\n")
+		case cmd == "MULTI":
+			queue = [][]string{}
+			s.write(c, "+OK\r\n")
+		case cmd == "EXEC":
+			var b strings.Builder
+			fmt.Fprintf(&b, "*%d\r\n", len(queue))
+			for _, q := range queue {
+				b.WriteString(s.exec(c, q))
+			}
+			queue = nil
+			s.write(c, b.String())
+		case queue != nil:
+			queue = append(queue, args)
+			s.write(c, "+QUEUED\r\n")
+		default:
+			s.write(c, s.exec(c, args))
+		}
+	}
+}
+
+// exec runs one command and returns its encoded reply.
+func (s *fakeRedis) exec(c *conn, args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "SELECT", "PING":
+		return "+OK\r\n"
+	case "HGETALL":
+		s.hgetall++
+		var kv []string
+		for k, v := range s.hashes[args[1]] {
+			kv = append(kv, k, v)
+		}
+		return bulkArray(kv)
+	case "HSET":
+		h := s.hashes[args[1]]
+		if h == nil {
+			h = make(map[string]string)
+			s.hashes[args[1]] = h
+		}
+		for i := 2; i+1 < len(args); i += 2 {
+			h[args[i]] = args[i+1]
+		}
+		return fmt.Sprintf(":%d\r\n", (len(args)-2)/2)
+	case "DEL":
+		_, ok := s.hashes[args[1]]
+		delete(s.hashes, args[1])
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "SCAN":
+		var keys []string
+		for k := range s.hashes {
+			if ok, _ := filepath.Match(args[3], k); ok {
+				keys = append(keys, k)
+			}
+		}
+		return "*2\r\n$1\r\n0\r\n" + bulkArray(keys)
+	case "SUBSCRIBE":
+		s.subs[c] = true
+		return "*3\r\n$9\r\nsubscribe\r\n" + bulk(args[1]) + ":1\r\n"
+	case "PUBLISH":
+		msg := "*3\r\n$7\r\nmessage\r\n" + bulk(args[1]) + bulk(args[2])
+		for sub := range s.subs {
+			_, _ = sub.nc.Write([]byte(msg))
+		}
+		return fmt.Sprintf(":%d\r\n", len(s.subs))
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+func (s *fakeRedis) write(c *conn, reply string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, _ = c.nc.Write([]byte(reply))
+}
+
+func bulk(s string) string { return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s) }
+
+func bulkArray(items []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(items))
+	for _, it := range items {
+		b.WriteString(bulk(it))
+	}
+	return b.String()
+}
+
+var testParams = passwd.Argon2Params{Time: 1, Memory: 8 * 1024, Threads: 1}
+
+func hash(t *testing.T, password string) string {
+	t.Helper()
+	h, err := passwd.HashPasswordWithParams(password, testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// newAgent returns an agent for s, waiting for its subscription.
+func newAgent(t *testing.T, s *fakeRedis) *Agent {
+	t.Helper()
+	a, err := New(Options{Addr: s.addr(), Password: s.password})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = a.Close() })
+	waitFor(t, "subscription", func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return a.subscribed
+	})
+	return a
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestAgent_Authenticate(t *testing.T) {
+	ctx := context.Background()
+	s := newFakeRedis(t, "hunter2")
+	a := newAgent(t, s)
+
+	priv := []byte("0123456789abcdef0123456789abcdef")
+	sealed, err := passwd.EncryptPrivateKey(priv, "wonderland")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.PutUser(ctx, "alice", Record{
+		PasswordHash: hash(t, "wonderland"),
+		PublicKey:    []byte("alice-pub"),
+		PrivateKey:   sealed,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.PutUser(ctx, "bob", Record{PasswordHash: hash(t, "builder"), Mailbox: "robert", Uid: 1002, Gid: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := a.Authenticate(ctx, "alice", "wonderland")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.User.Mailbox != "alice" || string(session.PublicKey) != "alice-pub" || !bytes.Equal(session.PrivateKey, priv) {
+		t.Errorf("alice: session = %+v", session)
+	}
+	if session, err := a.Authenticate(ctx, "bob", "builder"); err != nil || session.User.Mailbox != "robert" || session.User.Uid != 1002 || session.User.Gid != 100 {
+		t.Errorf("bob: session = %+v, %v", session, err)
+	}
+	if _, err := a.Authenticate(ctx, "alice", "looking-glass"); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("wrong password: err = %v, want ErrAuthFailed", err)
+	}
+	for _, name := range []string{"carol", "", "*", "al?ce"} {
+		if _, err := a.Authenticate(ctx, name, "wonderland"); !errors.Is(err, autherrors.ErrUserNotFound) {
+			t.Errorf("%q: err = %v, want ErrUserNotFound", name, err)
+		}
+	}
+
+	if users, err := a.ListUsers(ctx); err != nil || !slices.Equal(users, []string{"alice", "bob"}) {
+		t.Errorf("ListUsers = %v, %v", users, err)
+	}
+	if err := a.DeleteUser(ctx, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := a.UserExists(ctx, "bob"); ok || err != nil {
+		t.Errorf("deleted user: UserExists = %v, %v", ok, err)
+	}
+}
+
+func TestAgent_Invalidation(t *testing.T) {
+	ctx := context.Background()
+	minBackoff = 10 * time.Millisecond
+	t.Cleanup(func() { minBackoff = time.Second })
+	s := newFakeRedis(t, "")
+	s.put("alice", hash(t, "wonderland"))
+	node1, node2 := newAgent(t, s), newAgent(t, s)
+
+	if _, err := node2.Authenticate(ctx, "alice", "wonderland"); err != nil {
+		t.Fatal(err)
+	}
+	before := s.reads()
+	if _, err := node2.Authenticate(ctx, "alice", "wonderland"); err != nil {
+		t.Fatal(err)
+	}
+	if s.reads() != before {
+		t.Error("cached record read again")
+	}
+
+	// A change on node1 reaches node2's cache.
+	if err := node1.ChangePassword(ctx, "alice", "wonderland", "looking-glass"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "invalidation", func() bool {
+		_, err := node2.Authenticate(ctx, "alice", "looking-glass")
+		return err == nil
+	})
+	if _, err := node2.Authenticate(ctx, "alice", "wonderland"); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("old password: err = %v, want ErrAuthFailed", err)
+	}
+
+	// Losing the subscription empties the cache until it is back.
+	s.dropSubscribers()
+	waitFor(t, "resubscription", func() bool {
+		node2.mu.Lock()
+		defer node2.mu.Unlock()
+		return node2.subscribed && len(node2.cache) == 0
+	})
+}
+
+func TestAgent_Unavailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	a, err := New(Options{Addr: addr, Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = a.Close() }()
+	if _, err := a.Authenticate(context.Background(), "alice", "wonderland"); !errors.Is(err, autherrors.ErrBackendUnavailable) {
+		t.Errorf("err = %v, want ErrBackendUnavailable", err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	s := newFakeRedis(t, "hunter2")
+	s.put("alice", hash(t, "wonderland"))
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("hunter2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	agent, err := auth.OpenAuthAgent(auth.AuthAgentConfig{
+		Type:              "redis",
+		CredentialBackend: s.addr(),
+		Options:           map[string]string{"password_file": passwordFile, "db": "2", "cache_ttl": "-1s"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	if _, err := agent.Authenticate(context.Background(), "alice", "wonderland"); err != nil {
+		t.Error(err)
+	}
+
+	for name, opts := range map[string]map[string]string{
+		"db":      {"db": "two"},
+		"timeout": {"timeout": "soon"},
+		"tls":     {"tls": "maybe"},
+	} {
+		if _, err := auth.OpenAuthAgent(auth.AuthAgentConfig{Type: "redis", CredentialBackend: s.addr(), Options: opts}); !errors.Is(err, autherrors.ErrAuthAgentConfigInvalid) {
+			t.Errorf("%s: err = %v, want ErrAuthAgentConfigInvalid", name, err)
+		}
+	}
+	if _, err := auth.OpenAuthAgent(auth.AuthAgentConfig{Type: "redis", CredentialBackend: "redis.example.com"}); !errors.Is(err, autherrors.ErrAuthAgentConfigInvalid) {
+		t.Errorf("no port: err = %v, want ErrAuthAgentConfigInvalid", err)
+	}
+}
@@ -0,0 +1,74 @@
+package redisauth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/errors"
+)
+
+func init() {
+	// CredentialBackend is the server's "host:port". Options: "username";
+	// "password_file", a file holding the password so it stays out of the
+	// config; "db", "key_prefix", "channel", "pool_size"; "cache_ttl" and
+	// "timeout" (Go durations); "tls" ("true") and "ca_file", a PEM bundle
+	// of CAs to trust for the server.
+	auth.RegisterAuthAgent("redis", func(config auth.AuthAgentConfig) (auth.AuthenticationAgent, error) {
+		opts := Options{
+			Addr:      config.CredentialBackend,
+			Username:  config.Options["username"],
+			KeyPrefix: config.Options["key_prefix"],
+			Channel:   config.Options["channel"],
+		}
+		var err error
+		for name, dst := range map[string]*int{"db": &opts.DB, "pool_size": &opts.PoolSize} {
+			if v := config.Options[name]; v != "" {
+				if *dst, err = strconv.Atoi(v); err != nil {
+					return nil, fmt.Errorf("%w: %s: %v", errors.ErrAuthAgentConfigInvalid, name, err)
+				}
+			}
+		}
+		for name, dst := range map[string]*time.Duration{"cache_ttl": &opts.CacheTTL, "timeout": &opts.Timeout} {
+			if v := config.Options[name]; v != "" {
+				if *dst, err = time.ParseDuration(v); err != nil {
+					return nil, fmt.Errorf("%w: %s: %v", errors.ErrAuthAgentConfigInvalid, name, err)
+				}
+			}
+		}
+		if path := config.Options["password_file"]; path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("read password file: %w", err)
+			}
+			opts.Password = strings.TrimSpace(string(data))
+		}
+		useTLS := false
+		if v := config.Options["tls"]; v != "" {
+			if useTLS, err = strconv.ParseBool(v); err != nil {
+				return nil, fmt.Errorf("%w: tls: %v", errors.ErrAuthAgentConfigInvalid, err)
+			}
+		}
+		if path := config.Options["ca_file"]; path != "" || useTLS {
+			host, _, _ := net.SplitHostPort(opts.Addr)
+			opts.TLS = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+			if path != "" {
+				pem, err := os.ReadFile(path)
+				if err != nil {
+					return nil, fmt.Errorf("read CA file: %w", err)
+				}
+				opts.TLS.RootCAs = x509.NewCertPool()
+				if !opts.TLS.RootCAs.AppendCertsFromPEM(pem) {
+					return nil, fmt.Errorf("%w: ca_file: no certificates", errors.ErrAuthAgentConfigInvalid)
+				}
+			}
+		}
+		return New(opts)
+	})
+}
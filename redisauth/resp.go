@@ -0,0 +1,153 @@
+package redisauth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// maxBulkSize bounds a bulk string in a reply; user records are small.
+const maxBulkSize = 1 << 20
+
+// redisError is an error reply ("-ERR ..."): the server answered, so the
+// connection is still usable.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// errProtocol indicates a reply that does not parse as RESP.
+var errProtocol = errors.New("redis: protocol error")
+
+// conn is one connection speaking RESP2.
+type conn struct {
+	nc net.Conn
+	r  *bufio.Reader
+	w  *bufio.Writer
+}
+
+func newConn(nc net.Conn) *conn {
+	return &conn{nc: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+}
+
+// do sends a command and reads its reply, which must arrive by deadline.
+// Error replies are returned as redisError.
+func (c *conn) do(deadline time.Time, args ...string) (any, error) {
+	if err := c.nc.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// send writes a command as an array of bulk strings.
+func (c *conn) send(args ...string) error {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(a), a)
+	}
+	return c.w.Flush()
+}
+
+// read reads one reply: a string for simple and bulk strings, int64 for
+// integers, []any for arrays and nil for null replies.
+func (c *conn) read() (any, error) {
+	line, err := c.line()
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, errProtocol
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, errProtocol
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 || n > maxBulkSize {
+			return nil, errProtocol
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		if buf[n] != '\r' || buf[n+1] != '\n' {
+			return nil, errProtocol
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 || n > maxBulkSize {
+			return nil, errProtocol
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			// An error inside an array (from EXEC) is kept as a value.
+			item, err := c.read()
+			var rerr redisError
+			if errors.As(err, &rerr) {
+				item, err = rerr, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	default:
+		return nil, errProtocol
+	}
+}
+
+// line reads a CRLF-terminated line without the terminator.
+func (c *conn) line() (string, error) {
+	b, err := c.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", errProtocol
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(b) < 2 || b[len(b)-2] != '\r' {
+		return "", errProtocol
+	}
+	return string(b[:len(b)-2]), nil
+}
+
+func (c *conn) close() error { return c.nc.Close() }
+
+// replyStrings converts an array reply of strings, as from HGETALL or SCAN.
+func replyStrings(reply any) ([]string, error) {
+	items, ok := reply.([]any)
+	if !ok && reply != nil {
+		return nil, fmt.Errorf("%w: unexpected reply %T", errProtocol, reply)
+	}
+	out := make([]string, 0, len(items))
+	for _, item := range items {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: unexpected element %T", errProtocol, item)
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
@@ -0,0 +1,54 @@
+package redisauth
+
+import (
+	"bufio"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func readerConn(s string) *conn {
+	return &conn{r: bufio.NewReader(strings.NewReader(s))}
+}
+
+func TestConn_Read(t *testing.T) {
+	for in, want := range map[string]any{
+		"+OK\r\n":                      "OK",
+		":-7\r\n":                      int64(-7),
+		"$5\r\nhe\r\no\r\n":            "he\r\no",
+		"$0\r\n\r\n":                   "",
+		"$-1\r\n":                      nil,
+		"*0\r\n":                       []any{},
+		"*2\r\n$1\r\na\r\n$-1\r\n":     []any{"a", nil},
+		"*1\r\n*1\r\n:5\r\n":           []any{[]any{int64(5)}},
+		"*2\r\n+QUEUED\r\n-ERR no\r\n": []any{"QUEUED", redisError("ERR no")},
+	} {
+		got, err := readerConn(in).read()
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%q = %#v, %v; want %#v", in, got, err, want)
+		}
+	}
+
+	var rerr redisError
+	if _, err := readerConn("-WRONGTYPE wrong kind\r\n").read(); !errors.As(err, &rerr) {
+		t.Errorf("error reply: err = %v, want a redisError", err)
+	}
+}
+
+func TestConn_ReadMalformed(t *testing.T) {
+	for _, in := range []string{
+		"OK\r\n",
+		"+OK\n",
+		":x\r\n",
+		"$5\r\nhi\r\n",
+		"$2\r\nhiXX",
+		"$-2\r\n",
+		"$99999999\r\n",
+		"\r\n",
+	} {
+		if _, err := readerConn(in).read(); err == nil {
+			t.Errorf("%q: accepted", in)
+		}
+	}
+}
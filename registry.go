@@ -5,6 +5,8 @@ import (
 	"sync"
 
 	"github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/lease"
+	"github.com/infodancer/auth/vfs"
 )
 
 // AuthAgentFactory creates an AuthenticationAgent from configuration.
@@ -30,6 +32,21 @@ type AuthAgentConfig struct {
 
 	// Options contains implementation-specific settings.
 	Options map[string]string
+
+	// FS is the filesystem file-backed agents read their credential and
+	// key backends through. nil means the local disk. Agents serve an FS
+	// that is not a vfs.WriteFS read-only.
+	FS vfs.FS
+
+	// ReadOnly opens the agent in read-only mode, as on a secondary whose
+	// credential files are replicated from a primary: it authenticates,
+	// but never writes its backends, not even to upgrade hashes at login.
+	ReadOnly bool
+
+	// Leases, when set, is the lease manager file-backed agents hold a
+	// lease from while they write their credential backend, for hosts
+	// sharing one tree. nil means the local lock only.
+	Leases *lease.Manager
 }
 
 var (
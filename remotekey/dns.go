@@ -0,0 +1,227 @@
+package remotekey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// DNS constants used by OPENPGPKEY lookups.
+const (
+	typeOPENPGPKEY = 61
+	typeOPT        = 41
+	classIN        = 1
+
+	flagRD = 0x0100 // recursion desired
+	flagTC = 0x0200 // truncated
+	flagAD = 0x0020 // authentic data (DNSSEC validated by the resolver)
+
+	rcodeNXDomain = 3
+
+	// ednsSize is the UDP payload size advertised so that keys, which are
+	// larger than 512 bytes, usually arrive without falling back to TCP.
+	ednsSize = 4096
+)
+
+// errNoRecord reports that the name has no OPENPGPKEY record.
+var errNoRecord = errors.New("no OPENPGPKEY record")
+
+// openpgpkeyName returns the RFC 7929 owner name of address's OPENPGPKEY
+// record: the hex SHA-256 of the localpart, truncated to 28 octets, under
+// _openpgpkey of the domain.
+func openpgpkeyName(local, domain string) string {
+	sum := sha256.Sum256([]byte(local))
+	return hex.EncodeToString(sum[:28]) + "._openpgpkey." + strings.TrimSuffix(domain, ".") + "."
+}
+
+// systemNameserver returns the first nameserver in /etc/resolv.conf, or
+// the local resolver if there is none.
+func systemNameserver() string {
+	data, err := os.ReadFile("/etc/resolv.conf")
+	if err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+// lookupOPENPGPKEY queries server for the OPENPGPKEY records of name and
+// returns their key data. With requireAD, answers the resolver did not
+// validate with DNSSEC are discarded. A truncated UDP answer is retried
+// over TCP.
+func lookupOPENPGPKEY(ctx context.Context, server, name string, requireAD bool) ([][]byte, error) {
+	query, id, err := buildQuery(name, requireAD)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := exchange(ctx, "udp", server, query)
+	if err != nil {
+		return nil, err
+	}
+	keys, truncated, err := parseResponse(resp, id, requireAD)
+	if truncated {
+		if resp, err = exchange(ctx, "tcp", server, query); err != nil {
+			return nil, err
+		}
+		keys, _, err = parseResponse(resp, id, requireAD)
+	}
+	return keys, err
+}
+
+// buildQuery returns an OPENPGPKEY query for name with a random ID and an
+// EDNS0 OPT record.
+func buildQuery(name string, requireAD bool) ([]byte, uint16, error) {
+	var idb [2]byte
+	if _, err := rand.Read(idb[:]); err != nil {
+		return nil, 0, fmt.Errorf("dns query id: %w", err)
+	}
+	id := binary.BigEndian.Uint16(idb[:])
+	flags := uint16(flagRD)
+	if requireAD {
+		flags |= flagAD
+	}
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = binary.BigEndian.AppendUint16(msg, flags)
+	msg = append(msg, 0, 1, 0, 0, 0, 0, 0, 1) // 1 question, 1 additional
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return nil, 0, fmt.Errorf("dns name %q is invalid", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, typeOPENPGPKEY)
+	msg = binary.BigEndian.AppendUint16(msg, classIN)
+
+	// OPT: root name, type, UDP size as class, zero TTL and no options.
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, typeOPT)
+	msg = binary.BigEndian.AppendUint16(msg, ednsSize)
+	msg = append(msg, 0, 0, 0, 0, 0, 0)
+	return msg, id, nil
+}
+
+// exchange sends query to server over network ("udp" or "tcp") and
+// returns the response.
+func exchange(ctx context.Context, network, server string, query []byte) ([]byte, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, server)
+	if err != nil {
+		return nil, fmt.Errorf("dns: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if network == "tcp" {
+		framed := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+		if _, err := conn.Write(append(framed, query...)); err != nil {
+			return nil, fmt.Errorf("dns: %w", err)
+		}
+		var n [2]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return nil, fmt.Errorf("dns: %w", err)
+		}
+		resp := make([]byte, binary.BigEndian.Uint16(n[:]))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return nil, fmt.Errorf("dns: %w", err)
+		}
+		return resp, nil
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, fmt.Errorf("dns: %w", err)
+	}
+	buf := make([]byte, ednsSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, fmt.Errorf("dns: %w", err)
+	}
+	return buf[:n], nil
+}
+
+// parseResponse returns the OPENPGPKEY data in resp, the answer to query
+// id. truncated reports that the answer must be fetched over TCP.
+func parseResponse(resp []byte, id uint16, requireAD bool) (keys [][]byte, truncated bool, err error) {
+	malformed := errors.New("dns: malformed response")
+	if len(resp) < 12 || binary.BigEndian.Uint16(resp) != id {
+		return nil, false, malformed
+	}
+	flags := binary.BigEndian.Uint16(resp[2:])
+	if flags&flagTC != 0 {
+		return nil, true, nil
+	}
+	switch rcode := flags & 0xf; rcode {
+	case 0:
+	case rcodeNXDomain:
+		return nil, false, errNoRecord
+	default:
+		return nil, false, fmt.Errorf("dns: server answered rcode %d", rcode)
+	}
+	if requireAD && flags&flagAD == 0 {
+		return nil, false, errNoRecord
+	}
+
+	qd := int(binary.BigEndian.Uint16(resp[4:]))
+	an := int(binary.BigEndian.Uint16(resp[6:]))
+	off := 12
+	for range qd {
+		if off, err = skipName(resp, off); err != nil || off+4 > len(resp) {
+			return nil, false, malformed
+		}
+		off += 4
+	}
+	for range an {
+		if off, err = skipName(resp, off); err != nil || off+10 > len(resp) {
+			return nil, false, malformed
+		}
+		typ := binary.BigEndian.Uint16(resp[off:])
+		rdlen := int(binary.BigEndian.Uint16(resp[off+8:]))
+		off += 10
+		if off+rdlen > len(resp) {
+			return nil, false, malformed
+		}
+		if typ == typeOPENPGPKEY && rdlen > 0 {
+			keys = append(keys, append([]byte(nil), resp[off:off+rdlen]...))
+		}
+		off += rdlen
+	}
+	if len(keys) == 0 {
+		return nil, false, errNoRecord
+	}
+	return keys, false, nil
+}
+
+// skipName returns the offset just past the (possibly compressed) domain
+// name at off.
+func skipName(msg []byte, off int) (int, error) {
+	for off < len(msg) {
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			return off + 1, nil
+		case n&0xc0 == 0xc0:
+			if off+2 > len(msg) {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return off + 2, nil
+		default:
+			off += 1 + n
+		}
+	}
+	return 0, io.ErrUnexpectedEOF
+}
@@ -0,0 +1,215 @@
+// Package remotekey discovers the public keys of recipients on other mail
+// systems, so that mail forwarded off the host can be encrypted as well as
+// mail delivered locally. RemoteKeyResolver looks an address up through
+// the OpenPGP Web Key Directory (package wkd) and then DNS OPENPGPKEY
+// records (RFC 7929), caches what it finds, and answers through the
+// auth.KeyProvider interface with full addresses as usernames:
+//
+//	r := remotekey.New(remotekey.Options{
+//		Skip: func(domain string) bool { return provider.GetDomain(domain) != nil },
+//	})
+//	key, err := r.GetPublicKey(ctx, "bob@example.org")
+//
+// Discovery is opportunistic: a recipient without a published key is
+// errors.ErrKeyNotFound, and callers deliver in the clear. Keys are
+// returned as published, in binary OpenPGP format.
+package remotekey
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/wkd"
+)
+
+// Defaults for zero Options fields.
+const (
+	DefaultCacheTTL    = time.Hour
+	DefaultNegativeTTL = 10 * time.Minute
+	DefaultTimeout     = 10 * time.Second
+)
+
+// Compile-time check: RemoteKeyResolver must satisfy FormattedKeyProvider.
+var _ auth.FormattedKeyProvider = (*RemoteKeyResolver)(nil)
+
+// Options configures a RemoteKeyResolver. The zero value is usable.
+type Options struct {
+	// HTTPClient fetches WKD keys. nil means a client with Timeout.
+	HTTPClient *http.Client
+
+	// Nameserver is the host:port of the recursive resolver asked for
+	// OPENPGPKEY records. Empty means the first nameserver in
+	// /etc/resolv.conf.
+	Nameserver string
+
+	// RequireDNSSEC ignores OPENPGPKEY answers the resolver did not
+	// validate (no AD flag), as RFC 7929 recommends. Only meaningful with
+	// a trusted, validating resolver.
+	RequireDNSSEC bool
+
+	// DisableWKD and DisableDNS turn off one of the methods.
+	DisableWKD, DisableDNS bool
+
+	// Skip reports domains that must not be looked up remotely, usually
+	// the ones served locally. Their addresses are errors.ErrUserNotFound.
+	Skip func(domain string) bool
+
+	// Timeout bounds one lookup (both methods). 0 means DefaultTimeout.
+	Timeout time.Duration
+
+	// CacheTTL is how long a found key is reused, NegativeTTL how long an
+	// address without one is not asked about again. 0 means the defaults.
+	CacheTTL, NegativeTTL time.Duration
+}
+
+// RemoteKeyResolver looks up recipients' public keys on their own domains.
+// It is safe for concurrent use.
+type RemoteKeyResolver struct {
+	opts Options
+	now  func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+}
+
+// cacheEntry is a cached lookup result; key nil means none was found.
+type cacheEntry struct {
+	key     []byte
+	expires time.Time
+}
+
+// New returns a RemoteKeyResolver with opts.
+func New(opts Options) *RemoteKeyResolver {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.CacheTTL <= 0 {
+		opts.CacheTTL = DefaultCacheTTL
+	}
+	if opts.NegativeTTL <= 0 {
+		opts.NegativeTTL = DefaultNegativeTTL
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = &http.Client{Timeout: opts.Timeout}
+	}
+	if opts.Nameserver == "" {
+		opts.Nameserver = systemNameserver()
+	}
+	return &RemoteKeyResolver{opts: opts, now: time.Now, cache: make(map[string]cacheEntry)}
+}
+
+// GetPublicKey returns the key published for address. Addresses without a
+// domain and addresses in skipped domains are errors.ErrUserNotFound; an
+// address with no published key (including one whose domain's WKD server
+// cannot be reached) is errors.ErrKeyNotFound. Other errors are DNS
+// failures, which are not cached. Implements auth.KeyProvider.
+func (r *RemoteKeyResolver) GetPublicKey(ctx context.Context, address string) ([]byte, error) {
+	local, domain, ok := strings.Cut(address, "@")
+	if !ok || local == "" || domain == "" {
+		return nil, fmt.Errorf("%w: %s is not a remote address", autherrors.ErrUserNotFound, address)
+	}
+	domain = strings.ToLower(domain)
+	if r.opts.Skip != nil && r.opts.Skip(domain) {
+		return nil, fmt.Errorf("%w: %s is served locally", autherrors.ErrUserNotFound, domain)
+	}
+	address = local + "@" + domain
+
+	r.mu.Lock()
+	e, cached := r.cache[address]
+	if cached && r.now().After(e.expires) {
+		delete(r.cache, address)
+		cached = false
+	}
+	r.mu.Unlock()
+	if cached {
+		if e.key == nil {
+			return nil, autherrors.ErrKeyNotFound
+		}
+		return append([]byte(nil), e.key...), nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.opts.Timeout)
+	defer cancel()
+	key, err := r.lookup(ctx, local, domain, address)
+	if err != nil && !errors.Is(err, autherrors.ErrKeyNotFound) {
+		return nil, err
+	}
+
+	ttl := r.opts.CacheTTL
+	if key == nil {
+		ttl = r.opts.NegativeTTL
+	}
+	r.mu.Lock()
+	r.cache[address] = cacheEntry{key: key, expires: r.now().Add(ttl)}
+	r.mu.Unlock()
+	if key == nil {
+		return nil, autherrors.ErrKeyNotFound
+	}
+	return append([]byte(nil), key...), nil
+}
+
+// GetPublicKeyWithFormat returns what GetPublicKey does, tagged
+// auth.KeyFormatOpenPGP. Implements auth.FormattedKeyProvider.
+func (r *RemoteKeyResolver) GetPublicKeyWithFormat(ctx context.Context, address string) ([]byte, auth.KeyFormat, error) {
+	key, err := r.GetPublicKey(ctx, address)
+	if err != nil {
+		return nil, "", err
+	}
+	return key, auth.KeyFormatOpenPGP, nil
+}
+
+// GetPublicKeys returns the keys published for addresses, looked up in
+// turn as GetPublicKey does. Addresses without a published key are left
+// out. Implements auth.KeyProvider.
+func (r *RemoteKeyResolver) GetPublicKeys(ctx context.Context, addresses []string) (map[string][]byte, error) {
+	return auth.GetPublicKeysOneByOne(ctx, r.GetPublicKey, addresses)
+}
+
+// HasEncryption reports whether a key is published for address. Lookup
+// failures are returned as errors. Implements auth.KeyProvider.
+func (r *RemoteKeyResolver) HasEncryption(ctx context.Context, address string) (bool, error) {
+	_, err := r.GetPublicKey(ctx, address)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, autherrors.ErrKeyNotFound), errors.Is(err, autherrors.ErrUserNotFound):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// lookup tries WKD and then DNS. Most domains run no WKD server, so a WKD
+// failure counts as no key there; only DNS failures are reported.
+func (r *RemoteKeyResolver) lookup(ctx context.Context, local, domain, address string) ([]byte, error) {
+	if !r.opts.DisableWKD {
+		key, err := wkd.Lookup(ctx, r.opts.HTTPClient, address)
+		if err == nil {
+			return key, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		if !errors.Is(err, wkd.ErrNotFound) {
+			slog.Debug("wkd lookup failed", "address", address, "error", err)
+		}
+	}
+	if !r.opts.DisableDNS {
+		keys, err := lookupOPENPGPKEY(ctx, r.opts.Nameserver, openpgpkeyName(local, domain), r.opts.RequireDNSSEC)
+		if err == nil {
+			return keys[0], nil
+		}
+		if !errors.Is(err, errNoRecord) {
+			return nil, err
+		}
+	}
+	return nil, autherrors.ErrKeyNotFound
+}
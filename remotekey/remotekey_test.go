@@ -0,0 +1,215 @@
+package remotekey
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// fakeDNS answers OPENPGPKEY queries over UDP and TCP on one port from
+// records, keyed by owner name. With truncate, UDP answers are truncated.
+type fakeDNS struct {
+	addr     string
+	records  map[string][]byte
+	truncate atomic.Bool
+	ad       atomic.Bool
+	queries  atomic.Int32
+}
+
+func newFakeDNS(t *testing.T, records map[string][]byte) *fakeDNS {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		_ = pc.Close()
+		t.Skipf("tcp port not free: %v", err)
+	}
+	d := &fakeDNS{addr: pc.LocalAddr().String(), records: records}
+	t.Cleanup(func() { _ = pc.Close(); _ = ln.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(d.answer(buf[:n], d.truncate.Load()), from)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			var n [2]byte
+			if _, err := conn.Read(n[:]); err == nil {
+				q := make([]byte, binary.BigEndian.Uint16(n[:]))
+				if _, err := conn.Read(q); err == nil {
+					resp := d.answer(q, false)
+					_, _ = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+				}
+			}
+			_ = conn.Close()
+		}
+	}()
+	return d
+}
+
+// answer builds the response to query.
+func (d *fakeDNS) answer(query []byte, truncate bool) []byte {
+	d.queries.Add(1)
+	end, _ := skipName(query, 12)
+	var labels []string
+	for off := 12; query[off] != 0; off += 1 + int(query[off]) {
+		labels = append(labels, string(query[off+1:off+1+int(query[off])]))
+	}
+	name := strings.Join(labels, ".") + "."
+
+	flags := uint16(0x8180)
+	if d.ad.Load() {
+		flags |= flagAD
+	}
+	key, ok := d.records[name]
+	if !ok {
+		flags |= rcodeNXDomain
+	}
+	if truncate && ok {
+		flags |= flagTC
+		ok = false
+	}
+	resp := append([]byte(nil), query[:2]...)
+	resp = binary.BigEndian.AppendUint16(resp, flags)
+	an := uint16(0)
+	if ok {
+		an = 1
+	}
+	resp = append(resp, 0, 1, 0, byte(an), 0, 0, 0, 0)
+	resp = append(resp, query[12:end+4]...)
+	if ok {
+		resp = append(resp, 0xc0, 12)
+		resp = binary.BigEndian.AppendUint16(resp, typeOPENPGPKEY)
+		resp = binary.BigEndian.AppendUint16(resp, classIN)
+		resp = append(resp, 0, 0, 0x0e, 0x10)
+		resp = binary.BigEndian.AppendUint16(resp, uint16(len(key)))
+		resp = append(resp, key...)
+	}
+	return resp
+}
+
+func TestOpenpgpkeyName(t *testing.T) {
+	// Example from RFC 7929 section 3.
+	want := "c93f1e400f26708f98cb19d936620da35eec8f72e57f9eec01c1afd6._openpgpkey.example.com."
+	if got := openpgpkeyName("hugh", "example.com"); got != want {
+		t.Errorf("openpgpkeyName = %q", got)
+	}
+}
+
+func TestGetPublicKey_DNS(t *testing.T) {
+	dns := newFakeDNS(t, map[string][]byte{
+		openpgpkeyName("bob", "example.org"): []byte("bob's key"),
+	})
+	r := New(Options{Nameserver: dns.addr, DisableWKD: true})
+	ctx := context.Background()
+
+	key, err := r.GetPublicKey(ctx, "bob@Example.ORG")
+	if err != nil || string(key) != "bob's key" {
+		t.Fatalf("GetPublicKey(bob) = %q, %v", key, err)
+	}
+	if _, format, err := r.GetPublicKeyWithFormat(ctx, "bob@example.org"); err != nil || format != auth.KeyFormatOpenPGP {
+		t.Errorf("GetPublicKeyWithFormat(bob) = %q, %v", format, err)
+	}
+	if _, err := r.GetPublicKey(ctx, "carol@example.org"); !errors.Is(err, autherrors.ErrKeyNotFound) {
+		t.Errorf("GetPublicKey(carol) err = %v, want ErrKeyNotFound", err)
+	}
+	if ok, err := r.HasEncryption(ctx, "bob@example.org"); !ok || err != nil {
+		t.Errorf("HasEncryption(bob) = %v, %v", ok, err)
+	}
+
+	// Both answers are cached.
+	before := dns.queries.Load()
+	_, _ = r.GetPublicKey(ctx, "bob@example.org")
+	_, _ = r.GetPublicKey(ctx, "carol@example.org")
+	if dns.queries.Load() != before {
+		t.Error("cached lookups queried DNS again")
+	}
+
+	// Expired entries are looked up again.
+	r.now = func() time.Time { return time.Now().Add(DefaultCacheTTL + time.Minute) }
+	_, _ = r.GetPublicKey(ctx, "bob@example.org")
+	if dns.queries.Load() == before {
+		t.Error("expired entry was not looked up again")
+	}
+}
+
+func TestGetPublicKey_TruncatedFallsBackToTCP(t *testing.T) {
+	dns := newFakeDNS(t, map[string][]byte{
+		openpgpkeyName("bob", "example.org"): []byte(strings.Repeat("k", 1000)),
+	})
+	dns.truncate.Store(true)
+	r := New(Options{Nameserver: dns.addr, DisableWKD: true})
+	key, err := r.GetPublicKey(context.Background(), "bob@example.org")
+	if err != nil || len(key) != 1000 {
+		t.Errorf("GetPublicKey = %d bytes, %v", len(key), err)
+	}
+}
+
+func TestGetPublicKey_RequireDNSSEC(t *testing.T) {
+	dns := newFakeDNS(t, map[string][]byte{
+		openpgpkeyName("bob", "example.org"): []byte("bob's key"),
+	})
+	r := New(Options{Nameserver: dns.addr, DisableWKD: true, RequireDNSSEC: true})
+	if _, err := r.GetPublicKey(context.Background(), "bob@example.org"); !errors.Is(err, autherrors.ErrKeyNotFound) {
+		t.Errorf("unvalidated answer: err = %v, want ErrKeyNotFound", err)
+	}
+	dns.ad.Store(true)
+	r = New(Options{Nameserver: dns.addr, DisableWKD: true, RequireDNSSEC: true})
+	if _, err := r.GetPublicKey(context.Background(), "bob@example.org"); err != nil {
+		t.Errorf("validated answer: err = %v", err)
+	}
+}
+
+func TestGetPublicKey_NotRemote(t *testing.T) {
+	r := New(Options{
+		DisableWKD: true,
+		DisableDNS: true,
+		Skip:       func(domain string) bool { return domain == "example.com" },
+	})
+	for _, addr := range []string{"alice", "alice@example.com", "alice@EXAMPLE.com"} {
+		if _, err := r.GetPublicKey(context.Background(), addr); !errors.Is(err, autherrors.ErrUserNotFound) {
+			t.Errorf("GetPublicKey(%q) err = %v, want ErrUserNotFound", addr, err)
+		}
+	}
+	if ok, err := r.HasEncryption(context.Background(), "alice@example.com"); ok || err != nil {
+		t.Errorf("HasEncryption(local) = %v, %v", ok, err)
+	}
+}
+
+func TestGetPublicKey_DNSFailureNotCached(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = pc.Close() }()
+	// A server that never answers.
+	r := New(Options{Nameserver: pc.LocalAddr().String(), DisableWKD: true, Timeout: 100 * time.Millisecond})
+	_, err = r.GetPublicKey(context.Background(), "bob@example.org")
+	if err == nil || errors.Is(err, autherrors.ErrKeyNotFound) {
+		t.Fatalf("err = %v, want a lookup failure", err)
+	}
+	if len(r.cache) != 0 {
+		t.Error("failure was cached")
+	}
+}
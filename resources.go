@@ -0,0 +1,34 @@
+package auth
+
+// ResourceUsage describes the resources held by an agent or domain, for
+// operator reporting. All values are best-effort estimates.
+type ResourceUsage struct {
+	// OpenFiles is the number of file descriptors held open.
+	OpenFiles int
+
+	// Goroutines is the number of background goroutines owned.
+	Goroutines int
+
+	// CacheBytes estimates heap memory held in caches and indexes.
+	CacheBytes int64
+
+	// MappedBytes is the size of memory-mapped files.
+	MappedBytes int64
+}
+
+// Add returns the field-wise sum of u and o.
+func (u ResourceUsage) Add(o ResourceUsage) ResourceUsage {
+	return ResourceUsage{
+		OpenFiles:   u.OpenFiles + o.OpenFiles,
+		Goroutines:  u.Goroutines + o.Goroutines,
+		CacheBytes:  u.CacheBytes + o.CacheBytes,
+		MappedBytes: u.MappedBytes + o.MappedBytes,
+	}
+}
+
+// ResourceReporter is implemented by agents and stores that can report the
+// resources they hold. It is optional; callers should type-assert.
+type ResourceReporter interface {
+	// Resources returns the current resource usage.
+	Resources() ResourceUsage
+}
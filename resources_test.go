@@ -0,0 +1,13 @@
+package auth
+
+import "testing"
+
+func TestResourceUsage_Add(t *testing.T) {
+	a := ResourceUsage{OpenFiles: 1, Goroutines: 2, CacheBytes: 100, MappedBytes: 1000}
+	b := ResourceUsage{OpenFiles: 3, CacheBytes: 50}
+	got := a.Add(b)
+	want := ResourceUsage{OpenFiles: 4, Goroutines: 2, CacheBytes: 150, MappedBytes: 1000}
+	if got != want {
+		t.Errorf("Add = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,121 @@
+package rotation
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FileSecrets rotates random symmetric secrets (HMAC keys, SRS secrets,
+// peppers) stored as versioned files in a per-domain directory:
+//
+//	secrets/srs/
+//	├── 20260101T000000Z.key
+//	└── 20260401T000000Z.key   (newest = active)
+//
+// Each file holds the hex-encoded secret. Consumers read them with
+// LoadSecrets: sign or encode with the newest, and accept any listed
+// version while older ones are still within their overlap window.
+type FileSecrets struct {
+	// Dir returns the secret directory for a domain.
+	Dir func(domain string) string
+
+	// Size is the secret length in bytes. Default 32.
+	Size int
+
+	now func() time.Time // for testing
+}
+
+// Secret is one version of a file secret.
+type Secret struct {
+	Version string
+	Key     []byte
+}
+
+const secretSuffix = ".key"
+
+// Rotate writes a new random secret version. Implements Rotator.
+func (f *FileSecrets) Rotate(_ context.Context, domain string) (string, error) {
+	size := f.Size
+	if size <= 0 {
+		size = 32
+	}
+	now := time.Now
+	if f.now != nil {
+		now = f.now
+	}
+
+	dir := f.Dir(domain)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("create secret directory: %w", err)
+	}
+	key := make([]byte, size)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("generate secret: %w", err)
+	}
+
+	version := now().UTC().Format("20060102T150405Z")
+	path := filepath.Join(dir, version+secretSuffix)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", fmt.Errorf("create secret %s: %w", version, err)
+	}
+	if _, err := file.WriteString(hex.EncodeToString(key) + "\n"); err != nil {
+		_ = file.Close()
+		_ = os.Remove(path)
+		return "", fmt.Errorf("write secret %s: %w", version, err)
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	return version, nil
+}
+
+// Retire deletes a secret version. Implements Rotator.
+func (f *FileSecrets) Retire(_ context.Context, domain, version string) error {
+	if strings.ContainsAny(version, `/\`) {
+		return fmt.Errorf("invalid secret version %q", version)
+	}
+	err := os.Remove(filepath.Join(f.Dir(domain), version+secretSuffix))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// LoadSecrets reads every secret version in dir, newest first. The first
+// entry is the active secret. A missing directory yields no secrets.
+func LoadSecrets(dir string) ([]Secret, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read secret directory: %w", err)
+	}
+	var secrets []Secret
+	for _, e := range entries {
+		version, ok := strings.CutSuffix(e.Name(), secretSuffix)
+		if !ok || e.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("read secret %s: %w", version, err)
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("decode secret %s: %w", version, err)
+		}
+		secrets = append(secrets, Secret{Version: version, Key: key})
+	}
+	// Versions are UTC timestamps, so lexical order is chronological.
+	sort.Slice(secrets, func(i, j int) bool { return secrets[i].Version > secrets[j].Version })
+	return secrets, nil
+}
@@ -0,0 +1,353 @@
+// Package rotation coordinates scheduled rotation of per-domain secrets
+// (token signing keys, SRS secrets, peppers and similar) with an overlap
+// window during which the previous version stays available, and emits an
+// event for every action so rotations can be audited.
+//
+// Each kind of secret is handled by a Rotator registered under a name. The
+// Coordinator tracks, per domain and secret, when it was last rotated and
+// which old versions are due for retirement, persisting that state in a
+// JSON file so schedules survive restarts.
+package rotation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/lease"
+)
+
+// Rotator rotates one kind of secret.
+type Rotator interface {
+	// Rotate creates a new version of the secret for domain and makes it
+	// active, keeping earlier versions usable. Returns the new version ID.
+	Rotate(ctx context.Context, domain string) (version string, err error)
+
+	// Retire removes version once its overlap window has passed.
+	// Retiring a version that no longer exists is not an error.
+	Retire(ctx context.Context, domain, version string) error
+}
+
+// Policy is the schedule for one secret.
+type Policy struct {
+	// Interval is the time between rotations. Zero means manual only
+	// (see RotateNow).
+	Interval time.Duration
+
+	// Overlap is how long the previous version is kept after a rotation
+	// before it is retired.
+	Overlap time.Duration
+}
+
+// Action identifies what an Event records.
+type Action string
+
+// Event actions.
+const (
+	ActionRotated Action = "rotated"
+	ActionRetired Action = "retired"
+	ActionFailed  Action = "failed"
+)
+
+// Event describes one rotation action, for audit logging.
+type Event struct {
+	Time    time.Time
+	Domain  string
+	Secret  string
+	Action  Action
+	Version string
+	Err     error // set for ActionFailed
+}
+
+// secretState is the persisted state of one (domain, secret) pair.
+type secretState struct {
+	LastRotated time.Time    `json:"last_rotated"`
+	Active      string       `json:"active"`
+	Retiring    []retirement `json:"retiring,omitempty"`
+}
+
+type retirement struct {
+	Version string    `json:"version"`
+	At      time.Time `json:"at"`
+}
+
+type registration struct {
+	rotator Rotator
+	policy  Policy
+}
+
+// Coordinator runs registered Rotators across domains on schedule.
+type Coordinator struct {
+	mu        sync.Mutex
+	statePath string
+	domains   func() []string
+	secrets   map[string]registration
+	state     map[string]map[string]*secretState // domain -> secret -> state
+	loaded    bool
+	now       func() time.Time // for testing
+	onEvent   func(Event)
+	leases    *lease.Manager
+}
+
+// NewCoordinator creates a coordinator persisting its schedule at statePath
+// and rotating secrets for every domain returned by domains (e.g.,
+// FilesystemDomainProvider.Domains).
+func NewCoordinator(statePath string, domains func() []string) *Coordinator {
+	return &Coordinator{
+		statePath: statePath,
+		domains:   domains,
+		secrets:   make(map[string]registration),
+		now:       time.Now,
+	}
+}
+
+// WithEventHandler installs fn to receive every rotation event.
+func (c *Coordinator) WithEventHandler(fn func(Event)) *Coordinator {
+	c.onEvent = fn
+	return c
+}
+
+// WithLeaseManager makes the coordinator hold m's lease on the state file
+// while it works, so several hosts sharing the state file can all run it:
+// RunOnce on a host that finds the lease held does nothing, and RotateNow
+// fails with errors.ErrLeaseHeld. The state is re-read after every
+// acquisition and not saved if the lease was lost meanwhile.
+func (c *Coordinator) WithLeaseManager(m *lease.Manager) *Coordinator {
+	c.leases = m
+	return c
+}
+
+// Register adds a secret under name with its schedule. It panics if name is
+// empty or already registered.
+func (c *Coordinator) Register(name string, r Rotator, p Policy) {
+	if name == "" || r == nil {
+		panic("rotation: Register called with empty name or nil rotator")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.secrets[name]; exists {
+		panic("rotation: Register called twice for " + name)
+	}
+	c.secrets[name] = registration{rotator: r, policy: p}
+}
+
+// RunOnce performs every rotation and retirement that is due now. Failures
+// are reported as ActionFailed events and joined into the returned error;
+// one failing domain or secret does not stop the others.
+func (c *Coordinator) RunOnce(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	l, err := c.acquire()
+	if errors.Is(err, autherrors.ErrLeaseHeld) {
+		return nil // another host is running the schedule
+	}
+	if err != nil {
+		return err
+	}
+	defer releaseLease(l)
+
+	if err := c.load(); err != nil {
+		return err
+	}
+	now := c.now()
+	var errs []error
+	for _, domain := range c.domains() {
+		for _, name := range c.secretNames() {
+			reg := c.secrets[name]
+			st := c.stateFor(domain, name)
+			if err := c.retireDue(ctx, domain, name, reg, st, now); err != nil {
+				errs = append(errs, err)
+			}
+			if reg.policy.Interval > 0 && !now.Before(st.LastRotated.Add(reg.policy.Interval)) {
+				if err := c.rotate(ctx, domain, name, reg, st, now); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	if err := c.save(l); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// RotateNow rotates secret for domain immediately, regardless of schedule.
+func (c *Coordinator) RotateNow(ctx context.Context, domain, secret string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	reg, ok := c.secrets[secret]
+	if !ok {
+		return fmt.Errorf("rotation: unknown secret %q", secret)
+	}
+	l, err := c.acquire()
+	if err != nil {
+		return err
+	}
+	defer releaseLease(l)
+	if err := c.load(); err != nil {
+		return err
+	}
+	if err := c.rotate(ctx, domain, secret, reg, c.stateFor(domain, secret), c.now()); err != nil {
+		return err
+	}
+	return c.save(l)
+}
+
+// acquire takes the lease on the state file, if leasing is enabled, and
+// forces the state to be re-read since another host may have changed it.
+// Caller must hold c.mu.
+func (c *Coordinator) acquire() (*lease.Lease, error) {
+	if c.leases == nil {
+		return nil, nil
+	}
+	l, err := c.leases.Acquire(c.statePath)
+	if err != nil {
+		return nil, err
+	}
+	c.loaded = false
+	return l, nil
+}
+
+func releaseLease(l *lease.Lease) {
+	if l != nil {
+		_ = l.Release()
+	}
+}
+
+// Run calls RunOnce every interval until ctx is cancelled. Errors are
+// delivered as events only.
+func (c *Coordinator) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		_ = c.RunOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// rotate creates a new version and schedules the previous one for
+// retirement. Caller must hold c.mu.
+func (c *Coordinator) rotate(ctx context.Context, domain, name string, reg registration, st *secretState, now time.Time) error {
+	version, err := reg.rotator.Rotate(ctx, domain)
+	if err != nil {
+		err = fmt.Errorf("rotate %s for %s: %w", name, domain, err)
+		c.emit(Event{Time: now, Domain: domain, Secret: name, Action: ActionFailed, Err: err})
+		return err
+	}
+	if st.Active != "" {
+		st.Retiring = append(st.Retiring, retirement{Version: st.Active, At: now.Add(reg.policy.Overlap)})
+	}
+	st.Active = version
+	st.LastRotated = now
+	c.emit(Event{Time: now, Domain: domain, Secret: name, Action: ActionRotated, Version: version})
+	return nil
+}
+
+// retireDue retires versions whose overlap window has passed.
+// Caller must hold c.mu.
+func (c *Coordinator) retireDue(ctx context.Context, domain, name string, reg registration, st *secretState, now time.Time) error {
+	var errs []error
+	pending := st.Retiring[:0]
+	for _, r := range st.Retiring {
+		if now.Before(r.At) {
+			pending = append(pending, r)
+			continue
+		}
+		if err := reg.rotator.Retire(ctx, domain, r.Version); err != nil {
+			err = fmt.Errorf("retire %s %s for %s: %w", name, r.Version, domain, err)
+			c.emit(Event{Time: now, Domain: domain, Secret: name, Action: ActionFailed, Version: r.Version, Err: err})
+			errs = append(errs, err)
+			pending = append(pending, r) // try again next run
+			continue
+		}
+		c.emit(Event{Time: now, Domain: domain, Secret: name, Action: ActionRetired, Version: r.Version})
+	}
+	st.Retiring = pending
+	return errors.Join(errs...)
+}
+
+func (c *Coordinator) emit(e Event) {
+	if c.onEvent != nil {
+		c.onEvent(e)
+	}
+}
+
+// secretNames returns registered names in a stable order.
+func (c *Coordinator) secretNames() []string {
+	names := make([]string, 0, len(c.secrets))
+	for name := range c.secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *Coordinator) stateFor(domain, name string) *secretState {
+	byName := c.state[domain]
+	if byName == nil {
+		byName = make(map[string]*secretState)
+		c.state[domain] = byName
+	}
+	st := byName[name]
+	if st == nil {
+		st = &secretState{}
+		byName[name] = st
+	}
+	return st
+}
+
+// load reads the state file on first use. Caller must hold c.mu.
+func (c *Coordinator) load() error {
+	if c.loaded {
+		return nil
+	}
+	c.state = make(map[string]map[string]*secretState)
+	data, err := os.ReadFile(c.statePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			c.loaded = true
+			return nil
+		}
+		return fmt.Errorf("read rotation state: %w", err)
+	}
+	if err := json.Unmarshal(data, &c.state); err != nil {
+		return fmt.Errorf("parse rotation state: %w", err)
+	}
+	c.loaded = true
+	return nil
+}
+
+// save atomically writes the state file, provided lease l (if any) is
+// still held. Caller must hold c.mu.
+func (c *Coordinator) save(l *lease.Lease) error {
+	if l != nil {
+		if err := l.Check(); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(c.state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode rotation state: %w", err)
+	}
+	tmpPath := c.statePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return fmt.Errorf("write rotation state: %w", err)
+	}
+	if err := os.Rename(tmpPath, c.statePath); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("write rotation state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package rotation
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/lease"
+	"github.com/infodancer/auth/vfs"
+)
+
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time { return c.t }
+
+func TestCoordinator_RotateAndRetire(t *testing.T) {
+	dir := t.TempDir()
+	clk := &clock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	secrets := &FileSecrets{
+		Dir: func(d string) string { return filepath.Join(dir, d, "secrets", "srs") },
+		now: clk.now,
+	}
+
+	var events []Event
+	newCoordinator := func() *Coordinator {
+		c := NewCoordinator(filepath.Join(dir, "rotation.json"), func() []string { return []string{"a.com"} }).
+			WithEventHandler(func(e Event) { events = append(events, e) })
+		c.now = clk.now
+		c.Register("srs", secrets, Policy{Interval: 30 * 24 * time.Hour, Overlap: 7 * 24 * time.Hour})
+		return c
+	}
+	c := newCoordinator()
+	ctx := context.Background()
+
+	// First run creates the initial version.
+	if err := c.RunOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadSecrets(secrets.Dir("a.com"))
+	if err != nil || len(loaded) != 1 || len(loaded[0].Key) != 32 {
+		t.Fatalf("after first run: %+v, %v", loaded, err)
+	}
+	first := loaded[0].Version
+
+	// Not yet due: nothing happens.
+	clk.t = clk.t.Add(24 * time.Hour)
+	if err := c.RunOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %+v", events)
+	}
+
+	// Due: a new version becomes active and both are kept during overlap.
+	// A fresh coordinator proves the schedule was persisted.
+	clk.t = clk.t.Add(30 * 24 * time.Hour)
+	c = newCoordinator()
+	if err := c.RunOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	loaded, _ = LoadSecrets(secrets.Dir("a.com"))
+	if len(loaded) != 2 || loaded[1].Version != first {
+		t.Fatalf("during overlap: %+v", loaded)
+	}
+
+	// After the overlap the old version is retired.
+	clk.t = clk.t.Add(8 * 24 * time.Hour)
+	if err := c.RunOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	loaded, _ = LoadSecrets(secrets.Dir("a.com"))
+	if len(loaded) != 1 || loaded[0].Version == first {
+		t.Fatalf("after overlap: %+v", loaded)
+	}
+
+	want := []Action{ActionRotated, ActionRotated, ActionRetired}
+	if len(events) != len(want) {
+		t.Fatalf("events = %+v", events)
+	}
+	for i, a := range want {
+		if events[i].Action != a || events[i].Domain != "a.com" || events[i].Secret != "srs" {
+			t.Errorf("event %d = %+v, want %s", i, events[i], a)
+		}
+	}
+	if events[2].Version != first {
+		t.Errorf("retired %q, want %q", events[2].Version, first)
+	}
+}
+
+func TestCoordinator_RotateNow(t *testing.T) {
+	dir := t.TempDir()
+	c := NewCoordinator(filepath.Join(dir, "rotation.json"), func() []string { return nil })
+	secrets := &FileSecrets{Dir: func(d string) string { return filepath.Join(dir, d) }, Size: 16}
+	c.Register("hmac", secrets, Policy{})
+
+	if err := c.RotateNow(context.Background(), "b.com", "hmac"); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadSecrets(filepath.Join(dir, "b.com"))
+	if err != nil || len(loaded) != 1 || len(loaded[0].Key) != 16 {
+		t.Errorf("RotateNow: %+v, %v", loaded, err)
+	}
+	if err := c.RotateNow(context.Background(), "b.com", "nope"); err == nil {
+		t.Error("expected error for unknown secret")
+	}
+}
+
+func TestCoordinator_LeaseSkipsWhenHeld(t *testing.T) {
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, "rotation.json")
+	secrets := &FileSecrets{Dir: func(d string) string { return filepath.Join(dir, d, "secrets", "srs") }}
+	newCoordinator := func(host string) *Coordinator {
+		c := NewCoordinator(statePath, func() []string { return []string{"a.com"} }).
+			WithLeaseManager(lease.NewManager(vfs.OS{}, host, time.Minute).WithSettle(0))
+		c.Register("srs", secrets, Policy{Interval: time.Hour})
+		return c
+	}
+	ctx := context.Background()
+
+	held, err := lease.NewManager(vfs.OS{}, "host-b", time.Minute).WithSettle(0).Acquire(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newCoordinator("host-a")
+	if err := c.RunOnce(ctx); err != nil {
+		t.Fatalf("RunOnce while held: %v", err)
+	}
+	if loaded, _ := LoadSecrets(secrets.Dir("a.com")); len(loaded) != 0 {
+		t.Fatalf("rotated while another host held the lease: %+v", loaded)
+	}
+	if err := c.RotateNow(ctx, "a.com", "srs"); !errors.Is(err, autherrors.ErrLeaseHeld) {
+		t.Errorf("RotateNow: got %v, want ErrLeaseHeld", err)
+	}
+	_ = held.Release()
+
+	if err := c.RunOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// A second host sees the first host's state and finds nothing due.
+	if err := newCoordinator("host-b").RunOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, _ := LoadSecrets(secrets.Dir("a.com")); len(loaded) != 1 {
+		t.Errorf("secrets after two hosts ran = %d, want 1", len(loaded))
+	}
+}
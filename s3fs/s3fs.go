@@ -0,0 +1,439 @@
+// Package s3fs provides a read-only vfs.FS backed by an S3-compatible object
+// store (AWS S3, MinIO, or Google Cloud Storage through its XML API with
+// HMAC keys), so stateless mail frontends can load domain configuration,
+// passwd files and forwards from a bucket instead of a shared volume:
+//
+//	bucket, err := s3fs.New(s3fs.Options{
+//		Endpoint:  "https://storage.googleapis.com",
+//		Bucket:    "mail-config",
+//		Region:    "auto",
+//		Root:      "/etc/mail/domains",
+//		Prefix:    "domains/",
+//		AccessKey: id,
+//		SecretKey: secret,
+//	})
+//	provider := domain.NewFilesystemDomainProvider("/etc/mail/domains", logger).WithFS(bucket)
+//
+// The provider opens its domains' passwd agents on the bucket too, read-only.
+// Host paths under Root map to object keys under Prefix, and directories are
+// the "/"-delimited key prefixes. Object bodies are cached by ETag and
+// revalidated with a conditional GET on every read, so an unchanged file
+// costs a 304 rather than a download. Requests are signed with AWS
+// Signature Version 4 when credentials are set.
+package s3fs
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/infodancer/auth/vfs"
+)
+
+// maxObjectSize bounds the size of an object read into memory.
+const maxObjectSize = 16 << 20
+
+// Options configures an FS.
+type Options struct {
+	// Endpoint is the service URL, e.g. "https://s3.eu-west-1.amazonaws.com".
+	// Objects are addressed path-style: {Endpoint}/{Bucket}/{key}.
+	Endpoint string
+	Bucket   string
+
+	// Region is used for request signing (default "us-east-1"; GCS uses
+	// "auto").
+	Region string
+
+	// Root is the host path mapped onto Prefix (default "/"). Names outside
+	// Root do not exist.
+	Root string
+
+	// Prefix is prepended to object keys, e.g. "domains/".
+	Prefix string
+
+	// AccessKey and SecretKey sign requests. Leave both empty for a public
+	// bucket.
+	AccessKey string
+	SecretKey string
+
+	// Timeout bounds each request (default 10 seconds).
+	Timeout time.Duration
+
+	// Client is the HTTP client to use; nil uses a default client.
+	Client *http.Client
+}
+
+// FS is a read-only vfs.FS over a bucket. It is safe for concurrent use.
+type FS struct {
+	endpoint *url.URL
+	opts     Options
+	client   *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cachedObject // by object key
+}
+
+type cachedObject struct {
+	etag    string
+	data    []byte
+	modTime time.Time
+}
+
+// Compile-time check: FS must satisfy vfs.FS.
+var _ vfs.FS = (*FS)(nil)
+
+// New returns an FS for the bucket described by opts.
+func New(opts Options) (*FS, error) {
+	u, err := url.Parse(opts.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("s3fs: invalid endpoint %q", opts.Endpoint)
+	}
+	if opts.Bucket == "" || strings.Contains(opts.Bucket, "/") {
+		return nil, fmt.Errorf("s3fs: invalid bucket %q", opts.Bucket)
+	}
+	if (opts.AccessKey == "") != (opts.SecretKey == "") {
+		return nil, errors.New("s3fs: access key and secret key must be set together")
+	}
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+	if opts.Root == "" {
+		opts.Root = "/"
+	}
+	opts.Root = filepath.Clean(opts.Root)
+	if opts.Prefix != "" && !strings.HasSuffix(opts.Prefix, "/") {
+		opts.Prefix += "/"
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	client := opts.Client
+	if client == nil {
+		client = &http.Client{}
+	}
+	return &FS{endpoint: u, opts: opts, client: client, cache: make(map[string]cachedObject)}, nil
+}
+
+// key maps a host path to an object key. ok is false for names outside
+// Root. The key of Root itself is the bare prefix.
+func (f *FS) key(name string) (key string, ok bool) {
+	rel, err := filepath.Rel(f.opts.Root, filepath.Clean(name))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	if rel == "." {
+		return f.opts.Prefix, true
+	}
+	return f.opts.Prefix + filepath.ToSlash(rel), true
+}
+
+// ReadFile implements vfs.FS, revalidating any cached copy by ETag.
+func (f *FS) ReadFile(name string) ([]byte, error) {
+	obj, err := f.get("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Clone(obj.data), nil
+}
+
+// get fetches the object for name, using the cache when it is current.
+func (f *FS) get(op, name string) (cachedObject, error) {
+	key, ok := f.key(name)
+	if !ok || key == f.opts.Prefix || strings.HasSuffix(key, "/") {
+		return cachedObject{}, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	f.mu.Lock()
+	cached, haveCached := f.cache[key]
+	f.mu.Unlock()
+
+	header := http.Header{}
+	if haveCached {
+		header.Set("If-None-Match", cached.etag)
+	}
+	resp, cancel, err := f.do(http.MethodGet, key, nil, header)
+	if err != nil {
+		return cachedObject{}, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	defer cancel()
+	defer func() { _ = resp.Body.Close() }()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		if haveCached {
+			return cached, nil
+		}
+	case http.StatusOK:
+		data, err := io.ReadAll(io.LimitReader(resp.Body, maxObjectSize+1))
+		if err != nil {
+			return cachedObject{}, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		if len(data) > maxObjectSize {
+			return cachedObject{}, &fs.PathError{Op: op, Path: name, Err: errors.New("object too large")}
+		}
+		obj := cachedObject{etag: resp.Header.Get("ETag"), data: data, modTime: lastModified(resp.Header)}
+		if obj.etag != "" {
+			f.mu.Lock()
+			f.cache[key] = obj
+			f.mu.Unlock()
+		}
+		return obj, nil
+	case http.StatusNotFound:
+		f.mu.Lock()
+		delete(f.cache, key)
+		f.mu.Unlock()
+	}
+	return cachedObject{}, &fs.PathError{Op: op, Path: name, Err: statusError(resp)}
+}
+
+// Stat implements vfs.FS. A name is a directory when objects exist below
+// it; Root always exists.
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	key, ok := f.key(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	base := filepath.Base(name)
+	if key == f.opts.Prefix {
+		return fileInfo{name: base, dir: true}, nil
+	}
+
+	resp, cancel, err := f.do(http.MethodHead, key, nil, nil)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	_ = resp.Body.Close()
+	cancel()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		size, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+		return fileInfo{name: base, size: size, modTime: lastModified(resp.Header)}, nil
+	case http.StatusNotFound:
+	default:
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: statusError(resp)}
+	}
+
+	page, err := f.list(key+"/", "", 1)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	if len(page.Contents) == 0 && len(page.CommonPrefixes) == 0 {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return fileInfo{name: base, dir: true}, nil
+}
+
+// ReadDir implements vfs.FS, listing the objects and prefixes directly
+// below name, sorted by name.
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	key, ok := f.key(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	prefix := key
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	var entries []fs.DirEntry
+	token := ""
+	for {
+		page, err := f.list(prefix, token, 1000)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+		}
+		for _, p := range page.CommonPrefixes {
+			if n := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/"); n != "" {
+				entries = append(entries, fs.FileInfoToDirEntry(fileInfo{name: n, dir: true}))
+			}
+		}
+		for _, c := range page.Contents {
+			n := strings.TrimPrefix(c.Key, prefix)
+			if n == "" {
+				continue // directory marker object
+			}
+			entries = append(entries, fs.FileInfoToDirEntry(fileInfo{name: n, size: c.Size, modTime: c.LastModified}))
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+	if len(entries) == 0 && key != f.opts.Prefix {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// Open implements vfs.FS. Files are read whole; directories support
+// ReadDir.
+func (f *FS) Open(name string) (fs.File, error) {
+	obj, err := f.get("open", name)
+	if err == nil {
+		info := fileInfo{name: filepath.Base(name), size: int64(len(obj.data)), modTime: obj.modTime}
+		return &file{Reader: bytes.NewReader(obj.data), info: info}, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	entries, derr := f.ReadDir(name)
+	if derr != nil {
+		return nil, err
+	}
+	return &dir{info: fileInfo{name: filepath.Base(name), dir: true}, entries: entries}, nil
+}
+
+// listResult is the subset of a ListObjectsV2 response this package uses.
+type listResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+}
+
+// list returns one page of ListObjectsV2 results below prefix.
+func (f *FS) list(prefix, token string, maxKeys int) (*listResult, error) {
+	q := url.Values{}
+	q.Set("list-type", "2")
+	q.Set("delimiter", "/")
+	q.Set("prefix", prefix)
+	q.Set("max-keys", strconv.Itoa(maxKeys))
+	if token != "" {
+		q.Set("continuation-token", token)
+	}
+	resp, cancel, err := f.do(http.MethodGet, "", q, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp)
+	}
+	var page listResult
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, maxObjectSize)).Decode(&page); err != nil {
+		return nil, fmt.Errorf("decode bucket listing: %w", err)
+	}
+	return &page, nil
+}
+
+// do sends a signed request for key (the bucket itself when empty). The
+// caller closes the body and then calls cancel.
+func (f *FS) do(method, key string, query url.Values, header http.Header) (*http.Response, context.CancelFunc, error) {
+	u := *f.endpoint
+	u.Path = path.Join("/", u.Path, f.opts.Bucket, key)
+	if key == "" {
+		u.Path += "/"
+	}
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	ctx, cancel := context.WithTimeout(context.Background(), f.opts.Timeout)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if f.opts.AccessKey != "" {
+		signV4(req, f.opts.AccessKey, f.opts.SecretKey, f.opts.Region, time.Now())
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return resp, cancel, nil
+}
+
+// statusError maps an unexpected response status to an error.
+func statusError(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return fs.ErrNotExist
+	case http.StatusForbidden:
+		return fs.ErrPermission
+	}
+	return fmt.Errorf("object store returned %s", resp.Status)
+}
+
+func lastModified(h http.Header) time.Time {
+	t, _ := http.ParseTime(h.Get("Last-Modified"))
+	return t
+}
+
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i fileInfo) Name() string       { return i.name }
+func (i fileInfo) Size() int64        { return i.size }
+func (i fileInfo) ModTime() time.Time { return i.modTime }
+func (i fileInfo) IsDir() bool        { return i.dir }
+func (i fileInfo) Sys() any           { return nil }
+
+func (i fileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
+
+type file struct {
+	*bytes.Reader
+	info fileInfo
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *file) Close() error               { return nil }
+
+type dir struct {
+	info    fileInfo
+	entries []fs.DirEntry
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *dir) Close() error               { return nil }
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
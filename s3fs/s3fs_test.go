@@ -0,0 +1,244 @@
+package s3fs
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/infodancer/auth/authtest"
+	"github.com/infodancer/auth/domain"
+)
+
+// fakeS3 is a minimal path-style S3 server for one bucket supporting GET
+// and HEAD of objects (with If-None-Match) and ListObjectsV2.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	version int
+
+	gets, notModified atomic.Int32
+	unsigned          atomic.Int32
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	t.Helper()
+	s := &fakeS3{objects: map[string][]byte{}}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+func (s *fakeS3) put(key, data string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version++
+	s.objects[key] = []byte(data)
+}
+
+func (s *fakeS3) etag(key string) string {
+	return fmt.Sprintf("%q", fmt.Sprintf("%x-%d", len(s.objects[key]), s.version))
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		s.unsigned.Add(1)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := strings.CutPrefix(r.URL.Path, "/bucket/")
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if key == "" && r.URL.Query().Get("list-type") == "2" {
+		s.serveList(w, r)
+		return
+	}
+	data, ok := s.objects[key]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	etag := s.etag(key)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	s.gets.Add(1)
+	if r.Header.Get("If-None-Match") == etag {
+		s.notModified.Add(1)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	_, _ = w.Write(data)
+}
+
+func (s *fakeS3) serveList(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	var page listResult
+	seen := map[string]bool{}
+	var keys []string
+	for k := range s.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		rest, ok := strings.CutPrefix(k, prefix)
+		if !ok {
+			continue
+		}
+		if i := strings.Index(rest, "/"); i >= 0 {
+			p := prefix + rest[:i+1]
+			if !seen[p] {
+				seen[p] = true
+				page.CommonPrefixes = append(page.CommonPrefixes, struct{ Prefix string }{p})
+			}
+			continue
+		}
+		page.Contents = append(page.Contents, struct {
+			Key          string
+			Size         int64
+			LastModified time.Time
+		}{Key: k, Size: int64(len(s.objects[k]))})
+	}
+	_ = xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"ListBucketResult"`
+		listResult
+	}{listResult: page})
+}
+
+func newTestFS(t *testing.T, srv *httptest.Server, root string) *FS {
+	t.Helper()
+	f, err := New(Options{
+		Endpoint:  srv.URL,
+		Bucket:    "bucket",
+		Root:      root,
+		Prefix:    "domains",
+		AccessKey: "AKIDEXAMPLE",
+		SecretKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestFS_ReadStatReadDir(t *testing.T) {
+	s, srv := newFakeS3(t)
+	s.put("domains/config.toml", "base")
+	s.put("domains/example.com/config.toml", "domain")
+	s.put("domains/example.com/passwd", "alice:x:alice\n")
+	f := newTestFS(t, srv, "/srv/domains")
+
+	data, err := f.ReadFile("/srv/domains/example.com/passwd")
+	if err != nil || string(data) != "alice:x:alice\n" {
+		t.Fatalf("ReadFile = %q, %v", data, err)
+	}
+	if _, err := f.ReadFile("/srv/domains/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("missing file: got %v, want ErrNotExist", err)
+	}
+	if _, err := f.ReadFile("/etc/passwd"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("outside root: got %v, want ErrNotExist", err)
+	}
+
+	if fi, err := f.Stat("/srv/domains/example.com"); err != nil || !fi.IsDir() {
+		t.Errorf("Stat(dir) = %v, %v", fi, err)
+	}
+	if fi, err := f.Stat("/srv/domains/config.toml"); err != nil || fi.IsDir() || fi.Size() != 4 {
+		t.Errorf("Stat(file) = %v, %v", fi, err)
+	}
+	if _, err := f.Stat("/srv/domains/other.com"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat(missing) = %v, want ErrNotExist", err)
+	}
+
+	entries, err := f.ReadDir("/srv/domains")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, fmt.Sprintf("%s:%v", e.Name(), e.IsDir()))
+	}
+	if got := strings.Join(names, " "); got != "config.toml:false example.com:true" {
+		t.Errorf("ReadDir = %s", got)
+	}
+	if s.unsigned.Load() != 0 {
+		t.Errorf("%d requests were not signed", s.unsigned.Load())
+	}
+}
+
+func TestFS_ETagCaching(t *testing.T) {
+	s, srv := newFakeS3(t)
+	s.put("domains/config.toml", "v1")
+	f := newTestFS(t, srv, "/srv/domains")
+
+	for i := 0; i < 3; i++ {
+		if data, err := f.ReadFile("/srv/domains/config.toml"); err != nil || string(data) != "v1" {
+			t.Fatalf("ReadFile = %q, %v", data, err)
+		}
+	}
+	if n := s.notModified.Load(); n != 2 {
+		t.Errorf("304 responses = %d, want 2", n)
+	}
+
+	s.put("domains/config.toml", "v2")
+	if data, err := f.ReadFile("/srv/domains/config.toml"); err != nil || string(data) != "v2" {
+		t.Errorf("after update: ReadFile = %q, %v", data, err)
+	}
+}
+
+// TestProviderOverBucket serves an authtest tree from the bucket, with the
+// local passwd files removed, and authenticates through the router.
+func TestProviderOverBucket(t *testing.T) {
+	tree := authtest.Build(t, authtest.Options{Domains: 2, Users: 2, Aliases: 1})
+	s, srv := newFakeS3(t)
+	err := filepath.WalkDir(tree.Base, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(tree.Base, p)
+		s.put("domains/"+filepath.ToSlash(rel), string(data))
+		if d.Name() == "passwd" {
+			return os.Remove(p)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := newTestFS(t, srv, tree.Base)
+
+	p := domain.NewFilesystemDomainProvider(tree.Base, nil).WithFS(bucket)
+	t.Cleanup(func() { _ = p.Close() })
+	if got := p.Domains(); len(got) != 2 {
+		t.Errorf("Domains() = %v, want 2 domains", got)
+	}
+	r := domain.NewAuthRouter(p, nil)
+	defer func() { _ = r.Close() }()
+	session, err := r.Authenticate(context.Background(), tree.Address(1, 1), tree.Password)
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	session.Clear()
+	if err := p.CreateDomain("new.test", ""); err == nil {
+		t.Error("CreateDomain succeeded on a read-only bucket")
+	}
+}
@@ -0,0 +1,81 @@
+// Package crammd5 implements the server side of CRAM-MD5 (RFC 2195), a
+// legacy challenge-response mechanism some mail clients still offer when
+// they will not send a password in PLAIN. Checking a response takes the
+// plaintext password, so only backends keeping a reversible copy (see
+// auth.ChallengeResponseVerifier) can verify it; prefer SCRAM (package
+// sasl/scram) for clients that support it.
+//
+// A daemon issues a challenge, parses the client's reply and passes the
+// resulting credentials to the router:
+//
+//	challenge, err := crammd5.NewChallenge(hostname)
+//	// send challenge, read response
+//	creds, err := crammd5.Credentials(challenge, response)
+//	result, err := router.AuthenticateCredentials(ctx, creds)
+package crammd5
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/infodancer/auth"
+)
+
+// Mechanism is the SASL mechanism name.
+const Mechanism = "CRAM-MD5"
+
+// ErrMalformed indicates a client response that does not follow the
+// CRAM-MD5 syntax.
+var ErrMalformed = errors.New("crammd5: malformed response")
+
+// NewChallenge returns a fresh challenge in the form RFC 2195 suggests,
+// "<random.timestamp@hostname>". Each exchange needs its own.
+func NewChallenge(hostname string) ([]byte, error) {
+	var n [8]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return nil, fmt.Errorf("generate cram-md5 challenge: %w", err)
+	}
+	return fmt.Appendf(nil, "<%d.%d@%s>", binary.BigEndian.Uint64(n[:]), time.Now().Unix(), hostname), nil
+}
+
+// Credentials parses the client's response to challenge, "username digest",
+// into credentials for AuthenticateCredentials: Username is the username
+// from the response, and Response the hex digest.
+func Credentials(challenge, response []byte) (auth.Credentials, error) {
+	i := strings.LastIndexByte(string(response), ' ')
+	if i <= 0 {
+		return auth.Credentials{}, ErrMalformed
+	}
+	username, digest := string(response[:i]), response[i+1:]
+	if len(digest) != 2*md5.Size {
+		return auth.Credentials{}, ErrMalformed
+	}
+	if _, err := hex.DecodeString(string(digest)); err != nil {
+		return auth.Credentials{}, ErrMalformed
+	}
+	return auth.Credentials{
+		Username:  username,
+		Mechanism: Mechanism,
+		Challenge: append([]byte(nil), challenge...),
+		Response:  []byte(strings.ToLower(string(digest))),
+	}, nil
+}
+
+// Verify reports whether digest, the hex digest of a client response, is
+// HMAC-MD5 of challenge keyed with password.
+func Verify(password string, challenge, digest []byte) bool {
+	want, err := hex.DecodeString(string(digest))
+	if err != nil {
+		return false
+	}
+	m := hmac.New(md5.New, []byte(password))
+	m.Write(challenge)
+	return hmac.Equal(m.Sum(nil), want)
+}
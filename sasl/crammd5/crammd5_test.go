@@ -0,0 +1,66 @@
+package crammd5
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+)
+
+// RFC 2195, section 2.
+const (
+	rfcChallenge = "<1896.697170952@postoffice.reston.mci.net>"
+	rfcResponse  = "tim b913a602c7eda7a495b4e6e7334d3890"
+)
+
+func TestCredentials_RFC2195(t *testing.T) {
+	creds, err := Credentials([]byte(rfcChallenge), []byte(rfcResponse))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.Username != "tim" || creds.Mechanism != Mechanism || string(creds.Challenge) != rfcChallenge {
+		t.Errorf("Credentials = %+v", creds)
+	}
+	if !Verify("tanstaaftanstaaf", creds.Challenge, creds.Response) {
+		t.Error("Verify(right password) = false")
+	}
+	if Verify("tanstaaf", creds.Challenge, creds.Response) {
+		t.Error("Verify(wrong password) = true")
+	}
+	if Verify("tanstaaftanstaaf", []byte("<1@other>"), creds.Response) {
+		t.Error("Verify(other challenge) = true")
+	}
+}
+
+func TestCredentials_Malformed(t *testing.T) {
+	for _, resp := range []string{
+		"",
+		"tim",
+		" b913a602c7eda7a495b4e6e7334d3890",
+		"tim b913a602",
+		"tim z913a602c7eda7a495b4e6e7334d3890",
+	} {
+		if _, err := Credentials([]byte(rfcChallenge), []byte(resp)); !errors.Is(err, ErrMalformed) {
+			t.Errorf("Credentials(%q) err = %v, want ErrMalformed", resp, err)
+		}
+	}
+
+	// Usernames may contain spaces; the digest is the last word.
+	creds, err := Credentials([]byte(rfcChallenge), []byte("tim smith B913A602C7EDA7A495B4E6E7334D3890"))
+	if err != nil || creds.Username != "tim smith" || string(creds.Response) != "b913a602c7eda7a495b4e6e7334d3890" {
+		t.Errorf("Credentials = %+v, %v", creds, err)
+	}
+}
+
+func TestNewChallenge(t *testing.T) {
+	a, err := NewChallenge("mail.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := NewChallenge("mail.example.com")
+	if !regexp.MustCompile(`^<\d+\.\d+@mail\.example\.com>$`).Match(a) {
+		t.Errorf("challenge %q does not have the RFC 2195 form", a)
+	}
+	if string(a) == string(b) {
+		t.Errorf("two challenges are equal: %q", a)
+	}
+}
@@ -0,0 +1,207 @@
+// Package digestmd5 implements the server side of DIGEST-MD5 (RFC 2831)
+// with the "auth" quality of protection, for legacy mail clients. RFC 6331
+// retired the mechanism; it is here only for clients that offer nothing
+// better than it and PLAIN. Checking a response takes the plaintext
+// password, so only backends keeping a reversible copy (see
+// auth.ChallengeResponseVerifier) can verify it.
+//
+// A daemon issues a challenge, parses the client's reply, and on success
+// sends the rspauth value from the session's ServerResponse:
+//
+//	challenge, err := digestmd5.NewChallenge(realm)
+//	// send challenge, read response
+//	creds, err := digestmd5.Credentials(challenge, response)
+//	result, err := router.AuthenticateCredentials(ctx, creds)
+//	// send result.Session.ServerResponse, then expect an empty reply
+//
+// Integrity and confidentiality layers (auth-int, auth-conf) are not
+// supported; use TLS.
+package digestmd5
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/infodancer/auth"
+)
+
+// Mechanism is the SASL mechanism name.
+const Mechanism = "DIGEST-MD5"
+
+// ErrMalformed indicates a challenge or response that does not follow the
+// DIGEST-MD5 syntax, or a response to another challenge.
+var ErrMalformed = errors.New("digestmd5: malformed message")
+
+// nonceSize is the number of random bytes in a server nonce.
+const nonceSize = 24
+
+// NewChallenge returns a fresh digest-challenge offering realm. Each
+// exchange needs its own.
+func NewChallenge(realm string) ([]byte, error) {
+	raw := make([]byte, nonceSize)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("generate digest-md5 nonce: %w", err)
+	}
+	nonce := base64.RawStdEncoding.EncodeToString(raw)
+	var b strings.Builder
+	if realm != "" {
+		fmt.Fprintf(&b, "realm=%s,", quote(realm))
+	}
+	fmt.Fprintf(&b, `nonce="%s",qop="auth",charset=utf-8,algorithm=md5-sess`, nonce)
+	return []byte(b.String()), nil
+}
+
+// Credentials checks that response answers challenge and turns it into
+// credentials for AuthenticateCredentials: Username and AuthzID come from
+// the response, Challenge and Response are the messages themselves.
+func Credentials(challenge, response []byte) (auth.Credentials, error) {
+	r, err := parseExchange(challenge, response)
+	if err != nil {
+		return auth.Credentials{}, err
+	}
+	return auth.Credentials{
+		Username:  r["username"],
+		AuthzID:   r["authzid"],
+		Mechanism: Mechanism,
+		Challenge: append([]byte(nil), challenge...),
+		Response:  append([]byte(nil), response...),
+	}, nil
+}
+
+// Verify checks response to challenge against password. On success it
+// returns the server's final message, "rspauth=" and the digest that
+// proves the server knows the password too.
+func Verify(password string, challenge, response []byte) ([]byte, bool) {
+	r, err := parseExchange(challenge, response)
+	if err != nil {
+		return nil, false
+	}
+	want := digest(r, password, "AUTHENTICATE:")
+	if subtle.ConstantTimeCompare([]byte(strings.ToLower(r["response"])), want) != 1 {
+		return nil, false
+	}
+	return append([]byte("rspauth="), digest(r, password, ":")...), true
+}
+
+// parseExchange parses response and checks it against challenge.
+func parseExchange(challenge, response []byte) (map[string]string, error) {
+	c, err := parseDirectives(string(challenge))
+	if err != nil {
+		return nil, err
+	}
+	r, err := parseDirectives(string(response))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case r["username"] == "", r["cnonce"] == "", r["digest-uri"] == "":
+		return nil, fmt.Errorf("%w: missing directive", ErrMalformed)
+	case c["nonce"] == "" || r["nonce"] != c["nonce"]:
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrMalformed)
+	case r["nc"] != "00000001":
+		return nil, fmt.Errorf("%w: nonce count %q", ErrMalformed, r["nc"])
+	case r["qop"] != "" && r["qop"] != "auth":
+		return nil, fmt.Errorf("%w: quality of protection %q", ErrMalformed, r["qop"])
+	case len(r["response"]) != 2*md5.Size:
+		return nil, fmt.Errorf("%w: response", ErrMalformed)
+	case r["charset"] != "" && (r["charset"] != "utf-8" || c["charset"] != "utf-8"):
+		return nil, fmt.Errorf("%w: charset %q", ErrMalformed, r["charset"])
+	}
+	if _, err := hex.DecodeString(r["response"]); err != nil {
+		return nil, fmt.Errorf("%w: response", ErrMalformed)
+	}
+	return r, nil
+}
+
+// digest computes a response-value (RFC 2831, section 2.1.2.1) for the
+// directives r, with a2prefix "AUTHENTICATE:" for the client's response
+// and ":" for the server's rspauth.
+func digest(r map[string]string, password, a2prefix string) []byte {
+	utf8 := r["charset"] == "utf-8"
+	h := md5.Sum([]byte(latin1(r["username"], utf8) + ":" + latin1(r["realm"], utf8) + ":" + latin1(password, utf8)))
+	a1 := string(h[:]) + ":" + r["nonce"] + ":" + r["cnonce"]
+	if authzid := r["authzid"]; authzid != "" {
+		a1 += ":" + authzid
+	}
+	ha1 := md5.Sum([]byte(a1))
+	ha2 := md5.Sum([]byte(a2prefix + r["digest-uri"]))
+	kd := md5.Sum([]byte(hex.EncodeToString(ha1[:]) + ":" + r["nonce"] + ":" + r["nc"] + ":" +
+		r["cnonce"] + ":auth:" + hex.EncodeToString(ha2[:])))
+	return []byte(hex.EncodeToString(kd[:]))
+}
+
+// latin1 converts s to ISO 8859-1 if the exchange uses UTF-8 and every
+// character of s has an ISO 8859-1 equivalent, as RFC 2831 requires
+// before hashing. Other strings are hashed as they are.
+func latin1(s string, utf8 bool) string {
+	if !utf8 {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 0xff {
+			return s
+		}
+		b = append(b, byte(r))
+	}
+	return string(b)
+}
+
+// parseDirectives parses a comma-separated list of name=value directives,
+// where values may be quoted strings with backslash escapes. Names are
+// case-insensitive; a repeated directive is malformed.
+func parseDirectives(s string) (map[string]string, error) {
+	d := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return d, nil
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("%w: directive without value", ErrMalformed)
+		}
+		name := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " \t")
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, fmt.Errorf("%w: unterminated quoted string", ErrMalformed)
+			}
+			value, s = b.String(), s[i+1:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = strings.TrimSpace(s[:end]), s[end:]
+		}
+		if _, dup := d[name]; dup && name != "realm" {
+			return nil, fmt.Errorf("%w: repeated directive %q", ErrMalformed, name)
+		}
+		d[name] = value
+		s = strings.TrimLeft(s, " \t")
+		if s != "" && s[0] != ',' {
+			return nil, fmt.Errorf("%w: expected ','", ErrMalformed)
+		}
+	}
+}
+
+// quote returns s as a quoted string.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,99 @@
+package digestmd5
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// RFC 2831, section 4: the IMAP example.
+const (
+	rfcChallenge = `realm="elwood.innosoft.com",nonce="OA6MG9tEQGm2hh",qop="auth",algorithm=md5-sess,charset=utf-8`
+	rfcResponse  = `charset=utf-8,username="chris",realm="elwood.innosoft.com",nonce="OA6MG9tEQGm2hh",nc=00000001,cnonce="OA6MHXh6VqTrRk",digest-uri="imap/elwood.innosoft.com",response=d388dad90d4bbd760a152321f2143af7,qop=auth`
+	rfcRspauth   = "rspauth=ea40f60335c427b5527b84dbabcdfffd"
+)
+
+func TestVerify_RFC2831(t *testing.T) {
+	creds, err := Credentials([]byte(rfcChallenge), []byte(rfcResponse))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.Username != "chris" || creds.Mechanism != Mechanism || creds.AuthzID != "" {
+		t.Errorf("Credentials = %+v", creds)
+	}
+	rspauth, ok := Verify("secret", creds.Challenge, creds.Response)
+	if !ok {
+		t.Fatal("Verify(right password) = false")
+	}
+	if string(rspauth) != rfcRspauth {
+		t.Errorf("rspauth = %q, want %q", rspauth, rfcRspauth)
+	}
+	if _, ok := Verify("wrong", creds.Challenge, creds.Response); ok {
+		t.Error("Verify(wrong password) = true")
+	}
+}
+
+func TestCredentials_Malformed(t *testing.T) {
+	for name, resp := range map[string]string{
+		"other nonce":    strings.Replace(rfcResponse, `nonce="OA6MG9tEQGm2hh"`, `nonce="other"`, 1),
+		"replayed nc":    strings.Replace(rfcResponse, "nc=00000001", "nc=00000002", 1),
+		"auth-int":       strings.Replace(rfcResponse, "qop=auth", "qop=auth-int", 1),
+		"no username":    strings.Replace(rfcResponse, `username="chris",`, "", 1),
+		"no cnonce":      strings.Replace(rfcResponse, `cnonce="OA6MHXh6VqTrRk",`, "", 1),
+		"short response": strings.Replace(rfcResponse, "response=d388dad90d4bbd760a152321f2143af7", "response=d388", 1),
+		"repeated":       rfcResponse + `,username="eve"`,
+		"unterminated":   `username="chris`,
+		"no value":       "username",
+		"other charset":  strings.Replace(rfcResponse, "charset=utf-8", "charset=latin1", 1),
+		"garbage after":  `username="chris" x,nonce="OA6MG9tEQGm2hh"`,
+		"non-hex":        strings.Replace(rfcResponse, "d388dad90d4bbd760a152321f2143af7", "z388dad90d4bbd760a152321f2143af7", 1),
+		"no digest-uri":  strings.Replace(rfcResponse, `digest-uri="imap/elwood.innosoft.com",`, "", 1),
+	} {
+		if _, err := Credentials([]byte(rfcChallenge), []byte(resp)); !errors.Is(err, ErrMalformed) {
+			t.Errorf("%s: err = %v, want ErrMalformed", name, err)
+		}
+	}
+	if _, err := Credentials(nil, []byte(rfcResponse)); !errors.Is(err, ErrMalformed) {
+		t.Errorf("no challenge: err = %v, want ErrMalformed", err)
+	}
+}
+
+func TestParseDirectives(t *testing.T) {
+	d, err := parseDirectives(` Realm = "a \"b\", c" , nonce=xyz,qop="auth"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d["realm"] != `a "b", c` || d["nonce"] != "xyz" || d["qop"] != "auth" {
+		t.Errorf("parseDirectives = %q", d)
+	}
+}
+
+func TestNewChallenge(t *testing.T) {
+	c, err := NewChallenge(`example.com`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := parseDirectives(string(c))
+	if err != nil {
+		t.Fatalf("parse %q: %v", c, err)
+	}
+	if d["realm"] != "example.com" || d["qop"] != "auth" || d["charset"] != "utf-8" || len(d["nonce"]) < 16 {
+		t.Errorf("challenge %q", c)
+	}
+	other, _ := NewChallenge("example.com")
+	if string(other) == string(c) {
+		t.Error("two challenges are equal")
+	}
+}
+
+func TestLatin1(t *testing.T) {
+	if got := latin1("café", true); got != "caf\xe9" {
+		t.Errorf("latin1(café) = %q", got)
+	}
+	if got := latin1("café", false); got != "café" {
+		t.Errorf("latin1 without utf-8 = %q", got)
+	}
+	if got := latin1("日本", true); got != "日本" {
+		t.Errorf("latin1(日本) = %q", got)
+	}
+}
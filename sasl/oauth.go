@@ -0,0 +1,248 @@
+package sasl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/oauth"
+)
+
+// OAuthRequest is a parsed XOAUTH2 or OAUTHBEARER initial client response.
+type OAuthRequest struct {
+	// Mechanism is MechXOAUTH2 or MechOAUTHBEARER.
+	Mechanism string
+
+	// User is the identity the client asks to log in as: the XOAUTH2 "user"
+	// field or the OAUTHBEARER authzid. May be empty for OAUTHBEARER.
+	User string
+
+	// Host and Port are the optional OAUTHBEARER host and port fields.
+	Host string
+	Port int
+
+	// Token is the bearer token.
+	Token string
+}
+
+// Credentials returns the request as auth.Credentials for
+// domain.AuthRouter.AuthenticateCredentials, to be verified by an agent
+// such as oidcauth: the bearer token is the Response.
+func (r *OAuthRequest) Credentials() auth.Credentials {
+	return auth.Credentials{Username: r.User, Mechanism: r.Mechanism, Response: []byte(r.Token)}
+}
+
+// ParseXOAUTH2 parses a decoded XOAUTH2 client response:
+//
+//	"user=" user "\x01auth=Bearer " token "\x01\x01"
+func ParseXOAUTH2(resp []byte) (*OAuthRequest, error) {
+	req := &OAuthRequest{Mechanism: MechXOAUTH2}
+	fields, err := splitKV(resp)
+	if err != nil {
+		return nil, err
+	}
+	req.User = fields["user"]
+	req.Token, err = bearerToken(fields["auth"])
+	if err != nil {
+		return nil, err
+	}
+	if req.User == "" {
+		return nil, fmt.Errorf("%w: missing user", ErrMalformedResponse)
+	}
+	return req, nil
+}
+
+// ParseOAUTHBEARER parses a decoded OAUTHBEARER client response (RFC 7628):
+//
+//	gs2-header "\x01" *(key "=" value "\x01") "\x01"
+//
+// where gs2-header is "n,a=authzid," or "n,,". Channel binding is not
+// supported; a "p=" or "y" gs2 flag is rejected.
+func ParseOAUTHBEARER(resp []byte) (*OAuthRequest, error) {
+	header, rest, ok := bytes.Cut(resp, []byte{0x01})
+	if !ok {
+		return nil, fmt.Errorf("%w: missing gs2 header", ErrMalformedResponse)
+	}
+	parts := strings.Split(string(header), ",")
+	if len(parts) != 3 || parts[0] != "n" || parts[2] != "" {
+		return nil, fmt.Errorf("%w: unsupported gs2 header", ErrMalformedResponse)
+	}
+
+	req := &OAuthRequest{Mechanism: MechOAUTHBEARER}
+	if parts[1] != "" {
+		authzid, ok := strings.CutPrefix(parts[1], "a=")
+		if !ok {
+			return nil, fmt.Errorf("%w: bad authzid", ErrMalformedResponse)
+		}
+		req.User = unescapeSASLName(authzid)
+	}
+
+	fields, err := splitKV(append([]byte{0x01}, rest...))
+	if err != nil {
+		return nil, err
+	}
+	req.Host = fields["host"]
+	if p := fields["port"]; p != "" {
+		req.Port, err = strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad port", ErrMalformedResponse)
+		}
+	}
+	req.Token, err = bearerToken(fields["auth"])
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// splitKV parses "\x01"-separated key=value pairs terminated by "\x01\x01".
+// A leading separator is allowed.
+func splitKV(data []byte) (map[string]string, error) {
+	if !bytes.HasSuffix(data, []byte{0x01, 0x01}) {
+		return nil, fmt.Errorf("%w: missing terminator", ErrMalformedResponse)
+	}
+	data = bytes.TrimSuffix(data, []byte{0x01, 0x01})
+	data = bytes.TrimPrefix(data, []byte{0x01})
+
+	fields := make(map[string]string)
+	for _, kv := range bytes.Split(data, []byte{0x01}) {
+		if len(kv) == 0 {
+			continue
+		}
+		k, v, ok := bytes.Cut(kv, []byte("="))
+		if !ok {
+			return nil, fmt.Errorf("%w: field without value", ErrMalformedResponse)
+		}
+		fields[strings.ToLower(string(k))] = string(v)
+	}
+	return fields, nil
+}
+
+// bearerToken extracts the token from an "auth" field value.
+func bearerToken(auth string) (string, error) {
+	scheme, token, ok := strings.Cut(auth, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", fmt.Errorf("%w: missing bearer token", ErrMalformedResponse)
+	}
+	return strings.TrimSpace(token), nil
+}
+
+// unescapeSASLName decodes the "=2C" and "=3D" escapes of RFC 5801.
+func unescapeSASLName(s string) string {
+	return strings.NewReplacer("=2C", ",", "=3D", "=").Replace(s)
+}
+
+// IssuerResolver returns the token validator trusted for a domain.
+// domain.FilesystemDomainProvider implements it from per-domain [oauth]
+// configuration.
+type IssuerResolver interface {
+	// IssuerFor returns the validator for domain. Implementations return an
+	// error wrapping ErrNoIssuer when the domain has none; an empty domain
+	// asks for a default issuer, if any.
+	IssuerFor(ctx context.Context, domain string) (oauth.Agent, error)
+}
+
+// Issuers is a static IssuerResolver keyed by lowercase domain. The key "*"
+// is used for domains without their own entry and for OAUTHBEARER requests
+// that carry no authzid.
+type Issuers map[string]oauth.Agent
+
+// IssuerFor implements IssuerResolver.
+func (m Issuers) IssuerFor(_ context.Context, domain string) (oauth.Agent, error) {
+	if a, ok := m[strings.ToLower(domain)]; ok {
+		return a, nil
+	}
+	if a, ok := m["*"]; ok {
+		return a, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrNoIssuer, domain)
+}
+
+// OAuthServer validates XOAUTH2 and OAUTHBEARER logins.
+type OAuthServer struct {
+	// Issuers selects the token validator by the domain of the requested
+	// user.
+	Issuers IssuerResolver
+
+	// Scope is advertised in error responses, e.g. "https://mail.example.com/".
+	// Optional.
+	Scope string
+
+	// DiscoveryURL returns the OpenID configuration URL advertised in
+	// OAUTHBEARER error responses for a domain. Optional.
+	DiscoveryURL func(domain string) string
+}
+
+// Authenticate validates a decoded initial client response for mechanism.
+//
+// On success it returns the authenticated username (as asserted by the
+// token) and a nil challenge. On failure it returns an error and, for
+// token failures, the mechanism's JSON error challenge: the server sends it
+// to the client, reads the client's dummy response, and then fails the
+// exchange. Malformed responses return a nil challenge and should be failed
+// immediately.
+func (s *OAuthServer) Authenticate(ctx context.Context, mechanism string, resp []byte) (username string, challenge []byte, err error) {
+	var req *OAuthRequest
+	switch strings.ToUpper(mechanism) {
+	case MechXOAUTH2:
+		req, err = ParseXOAUTH2(resp)
+	case MechOAUTHBEARER:
+		req, err = ParseOAUTHBEARER(resp)
+	default:
+		return "", nil, fmt.Errorf("%w: %s", ErrUnknownMechanism, mechanism)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	domain := domainOf(req.User)
+	agent, err := s.Issuers.IssuerFor(ctx, domain)
+	if err != nil {
+		return "", s.errorChallenge(req.Mechanism, domain), err
+	}
+	username, err = agent.ValidateToken(ctx, req.Token)
+	if err != nil {
+		return "", s.errorChallenge(req.Mechanism, domain), err
+	}
+	if req.User != "" && !strings.EqualFold(req.User, username) {
+		return "", s.errorChallenge(req.Mechanism, domain), ErrIdentityMismatch
+	}
+	return username, nil, nil
+}
+
+// errorChallenge builds the JSON error response for mechanism.
+// XOAUTH2 follows Google's format; OAUTHBEARER follows RFC 7628 section 3.2.2.
+func (s *OAuthServer) errorChallenge(mechanism, domain string) []byte {
+	var v any
+	if mechanism == MechXOAUTH2 {
+		v = struct {
+			Status  string `json:"status"`
+			Schemes string `json:"schemes"`
+			Scope   string `json:"scope,omitempty"`
+		}{"401", "bearer", s.Scope}
+	} else {
+		var discovery string
+		if s.DiscoveryURL != nil {
+			discovery = s.DiscoveryURL(domain)
+		}
+		v = struct {
+			Status    string `json:"status"`
+			Scope     string `json:"scope,omitempty"`
+			Discovery string `json:"openid-configuration,omitempty"`
+		}{"invalid_token", s.Scope, discovery}
+	}
+	data, _ := json.Marshal(v)
+	return data
+}
+
+// domainOf returns the lowercase domain part of address, or "".
+func domainOf(address string) string {
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		return strings.ToLower(address[i+1:])
+	}
+	return ""
+}
@@ -0,0 +1,118 @@
+package sasl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/infodancer/auth/oauth"
+)
+
+type fakeAgent struct {
+	tokens map[string]string // token -> username
+}
+
+func (f *fakeAgent) ValidateToken(_ context.Context, token string) (string, error) {
+	if u, ok := f.tokens[token]; ok {
+		return u, nil
+	}
+	return "", oauth.ErrTokenInvalid
+}
+
+func (f *fakeAgent) Close() error { return nil }
+
+func TestParseXOAUTH2(t *testing.T) {
+	req, err := ParseXOAUTH2([]byte("user=alice@example.com\x01auth=Bearer tok123\x01\x01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.User != "alice@example.com" || req.Token != "tok123" || req.Mechanism != MechXOAUTH2 {
+		t.Errorf("unexpected request: %+v", req)
+	}
+	if c := req.Credentials(); c.Username != "alice@example.com" || c.Mechanism != MechXOAUTH2 || string(c.Response) != "tok123" || c.IsPlaintext() {
+		t.Errorf("Credentials = %+v", c)
+	}
+
+	for _, bad := range []string{
+		"user=alice@example.com\x01auth=Bearer tok123",     // no terminator
+		"user=alice@example.com\x01auth=Basic abc\x01\x01", // wrong scheme
+		"auth=Bearer tok\x01\x01",                          // no user
+		"garbage\x01\x01",
+	} {
+		if _, err := ParseXOAUTH2([]byte(bad)); !errors.Is(err, ErrMalformedResponse) {
+			t.Errorf("ParseXOAUTH2(%q) err = %v", bad, err)
+		}
+	}
+}
+
+func TestParseOAUTHBEARER(t *testing.T) {
+	req, err := ParseOAUTHBEARER([]byte("n,a=user=2Cx@example.com,\x01host=mail.example.com\x01port=993\x01auth=Bearer vF9dft4qmT\x01\x01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.User != "user,x@example.com" || req.Host != "mail.example.com" || req.Port != 993 || req.Token != "vF9dft4qmT" {
+		t.Errorf("unexpected request: %+v", req)
+	}
+
+	req, err = ParseOAUTHBEARER([]byte("n,,\x01auth=Bearer abc\x01\x01"))
+	if err != nil || req.User != "" || req.Token != "abc" {
+		t.Errorf("no authzid: %+v, %v", req, err)
+	}
+
+	for _, bad := range []string{
+		"p=tls-unique,,\x01auth=Bearer abc\x01\x01", // channel binding
+		"n,a=alice\x01auth=Bearer abc\x01\x01",      // short header
+		"n,,\x01auth=Bearer abc\x01",                // no terminator
+		"n,,\x01port=x\x01auth=Bearer abc\x01\x01",  // bad port
+	} {
+		if _, err := ParseOAUTHBEARER([]byte(bad)); !errors.Is(err, ErrMalformedResponse) {
+			t.Errorf("ParseOAUTHBEARER(%q) err = %v", bad, err)
+		}
+	}
+}
+
+func TestOAuthServer_Authenticate(t *testing.T) {
+	s := &OAuthServer{
+		Issuers: Issuers{
+			"example.com": &fakeAgent{tokens: map[string]string{"good": "alice@example.com"}},
+		},
+		Scope:        "https://mail.example.com/",
+		DiscoveryURL: func(d string) string { return "https://id." + d + "/.well-known/openid-configuration" },
+	}
+	ctx := context.Background()
+
+	user, challenge, err := s.Authenticate(ctx, "xoauth2", []byte("user=alice@example.com\x01auth=Bearer good\x01\x01"))
+	if err != nil || user != "alice@example.com" || challenge != nil {
+		t.Fatalf("XOAUTH2 success: %q, %q, %v", user, challenge, err)
+	}
+
+	_, challenge, err = s.Authenticate(ctx, MechXOAUTH2, []byte("user=alice@example.com\x01auth=Bearer bad\x01\x01"))
+	if !errors.Is(err, oauth.ErrTokenInvalid) {
+		t.Errorf("XOAUTH2 bad token err = %v", err)
+	}
+	var xerr map[string]string
+	if err := json.Unmarshal(challenge, &xerr); err != nil || xerr["status"] != "401" || xerr["schemes"] != "bearer" || xerr["scope"] != s.Scope {
+		t.Errorf("XOAUTH2 challenge = %s", challenge)
+	}
+
+	_, challenge, err = s.Authenticate(ctx, MechOAUTHBEARER, []byte("n,a=bob@example.com,\x01auth=Bearer good\x01\x01"))
+	if !errors.Is(err, ErrIdentityMismatch) {
+		t.Errorf("OAUTHBEARER mismatch err = %v", err)
+	}
+	var berr map[string]string
+	if err := json.Unmarshal(challenge, &berr); err != nil || berr["status"] != "invalid_token" ||
+		berr["openid-configuration"] != "https://id.example.com/.well-known/openid-configuration" {
+		t.Errorf("OAUTHBEARER challenge = %s", challenge)
+	}
+
+	if _, _, err := s.Authenticate(ctx, MechOAUTHBEARER, []byte("n,a=carol@other.org,\x01auth=Bearer good\x01\x01")); !errors.Is(err, ErrNoIssuer) {
+		t.Errorf("unknown domain err = %v", err)
+	}
+	if _, _, err := s.Authenticate(ctx, "PLAIN", nil); !errors.Is(err, ErrUnknownMechanism) {
+		t.Errorf("PLAIN err = %v", err)
+	}
+	if _, challenge, err := s.Authenticate(ctx, MechXOAUTH2, []byte("junk")); !errors.Is(err, ErrMalformedResponse) || challenge != nil {
+		t.Errorf("malformed: %q, %v", challenge, err)
+	}
+}
@@ -0,0 +1,32 @@
+// Package sasl implements server-side parsing and responses for SASL
+// mechanisms that need more than a username and password, so protocol
+// daemons (smtpd, imapd, pop3d) share one implementation.
+//
+// Functions in this package take and return decoded bytes; base64 framing
+// of SASL exchanges is left to the protocol layer.
+package sasl
+
+import "errors"
+
+// Mechanism names.
+const (
+	MechXOAUTH2     = "XOAUTH2"
+	MechOAUTHBEARER = "OAUTHBEARER"
+)
+
+// Errors returned by this package.
+var (
+	// ErrMalformedResponse indicates a client response that does not follow
+	// the mechanism's syntax.
+	ErrMalformedResponse = errors.New("sasl: malformed client response")
+
+	// ErrUnknownMechanism indicates a mechanism this package does not handle.
+	ErrUnknownMechanism = errors.New("sasl: unknown mechanism")
+
+	// ErrIdentityMismatch indicates the token authenticates a different user
+	// than the one the client asked to log in as.
+	ErrIdentityMismatch = errors.New("sasl: token identity does not match requested user")
+
+	// ErrNoIssuer indicates no token issuer is configured for the domain.
+	ErrNoIssuer = errors.New("sasl: no token issuer for domain")
+)
@@ -0,0 +1,159 @@
+// Package scram implements the server side of SCRAM-SHA-256 (RFC 5802,
+// RFC 7677): deriving the verifiers a backend stores in place of the
+// password, their RFC 5803 text form, and the server's half of the SASL
+// exchange. A server that stores verifiers can offer SCRAM, so the
+// password never crosses the connection, not even inside TLS.
+//
+// Backends store verifiers next to their password hashes and return them
+// through auth.SCRAMCredentialProvider; domain.AuthRouter routes
+// GetSCRAMCredentials like a login. A daemon runs the exchange with a
+// Server:
+//
+//	srv := scram.NewServer(router.GetSCRAMCredentials, binding)
+//	serverFirst, err := srv.Start(ctx, clientFirst)
+//	...
+//	serverFinal, err := srv.Finish(clientFinal)
+//	// on success, srv.Username() is authenticated
+//
+// Passwords are used as UTF-8 bytes without SASLprep normalization, which
+// only matters for passwords with non-ASCII characters that normalize
+// differently.
+package scram
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/infodancer/auth"
+)
+
+// Mechanism names.
+const (
+	Mechanism     = "SCRAM-SHA-256"
+	MechanismPlus = "SCRAM-SHA-256-PLUS"
+)
+
+// Iteration counts. RFC 7677 asks for at least 4096.
+const (
+	DefaultIterations = 4096
+	MinIterations     = 4096
+	MaxIterations     = 1 << 20
+)
+
+// saltSize is the size of a generated salt in bytes.
+const saltSize = 16
+
+// ErrMalformed indicates a message or stored verifier that does not follow
+// the SCRAM syntax.
+var ErrMalformed = errors.New("scram: malformed message")
+
+// New derives SCRAM-SHA-256 credentials for password with a fresh random
+// salt. iterations of 0 means DefaultIterations.
+func New(password string, iterations int) (auth.SCRAMCredentials, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return auth.SCRAMCredentials{}, fmt.Errorf("generate scram salt: %w", err)
+	}
+	if iterations == 0 {
+		iterations = DefaultIterations
+	}
+	return Derive(password, salt, iterations)
+}
+
+// Derive derives SCRAM-SHA-256 credentials for password with salt and
+// iterations (RFC 5802, section 3):
+//
+//	SaltedPassword = PBKDF2-HMAC-SHA-256(password, salt, iterations)
+//	StoredKey      = SHA-256(HMAC(SaltedPassword, "Client Key"))
+//	ServerKey      = HMAC(SaltedPassword, "Server Key")
+func Derive(password string, salt []byte, iterations int) (auth.SCRAMCredentials, error) {
+	if iterations < MinIterations || iterations > MaxIterations {
+		return auth.SCRAMCredentials{}, fmt.Errorf("scram iterations %d outside %d..%d", iterations, MinIterations, MaxIterations)
+	}
+	if len(salt) == 0 {
+		return auth.SCRAMCredentials{}, errors.New("scram salt is empty")
+	}
+	salted, err := pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size)
+	if err != nil {
+		return auth.SCRAMCredentials{}, fmt.Errorf("derive scram key: %w", err)
+	}
+	defer clear(salted)
+	clientKey := hmacSHA256(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	clear(clientKey)
+	return auth.SCRAMCredentials{
+		Mechanism:  Mechanism,
+		Salt:       append([]byte(nil), salt...),
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  hmacSHA256(salted, []byte("Server Key")),
+	}, nil
+}
+
+// Format returns c in the text form of RFC 5803, suitable for storage:
+//
+//	SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>
+//
+// with salt and keys in standard base64.
+func Format(c auth.SCRAMCredentials) string {
+	b64 := base64.StdEncoding.EncodeToString
+	return fmt.Sprintf("%s$%d:%s$%s:%s", c.Mechanism, c.Iterations, b64(c.Salt), b64(c.StoredKey), b64(c.ServerKey))
+}
+
+// Parse parses credentials in the form written by Format.
+func Parse(s string) (auth.SCRAMCredentials, error) {
+	mech, rest, ok1 := strings.Cut(s, "$")
+	params, keys, ok2 := strings.Cut(rest, "$")
+	iter, salt, ok3 := strings.Cut(params, ":")
+	stored, server, ok4 := strings.Cut(keys, ":")
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return auth.SCRAMCredentials{}, fmt.Errorf("%w: stored credentials", ErrMalformed)
+	}
+	if mech != Mechanism {
+		return auth.SCRAMCredentials{}, fmt.Errorf("%w: unsupported mechanism %q", ErrMalformed, mech)
+	}
+	c := auth.SCRAMCredentials{Mechanism: mech}
+	var err error
+	if c.Iterations, err = strconv.Atoi(iter); err != nil || c.Iterations < MinIterations || c.Iterations > MaxIterations {
+		return auth.SCRAMCredentials{}, fmt.Errorf("%w: iteration count %q", ErrMalformed, iter)
+	}
+	for _, f := range []struct {
+		dst  *[]byte
+		text string
+		size int // 0: any non-empty
+	}{
+		{&c.Salt, salt, 0},
+		{&c.StoredKey, stored, sha256.Size},
+		{&c.ServerKey, server, sha256.Size},
+	} {
+		b, err := base64.StdEncoding.DecodeString(f.text)
+		if err != nil || len(b) == 0 || (f.size != 0 && len(b) != f.size) {
+			return auth.SCRAMCredentials{}, fmt.Errorf("%w: stored credentials", ErrMalformed)
+		}
+		*f.dst = b
+	}
+	return c, nil
+}
+
+// Verify reports whether password matches c, for backends checking a
+// plaintext login against stored credentials.
+func Verify(c auth.SCRAMCredentials, password string) bool {
+	d, err := Derive(password, c.Salt, c.Iterations)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(d.StoredKey, c.StoredKey) && hmac.Equal(d.ServerKey, c.ServerKey)
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write(data)
+	return m.Sum(nil)
+}
@@ -0,0 +1,95 @@
+package scram
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// RFC 7677, section 3: user "user", password "pencil".
+const (
+	rfcSalt        = "W22ZaJ0SNY7soEsUEjb6gQ=="
+	rfcClientNonce = "rOprNGfwEbeRWgbNEkqO"
+	rfcNonce       = rfcClientNonce + "%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+	rfcProof       = "dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	rfcSignature   = "6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+	rfcVerifier    = "SCRAM-SHA-256$4096:W22ZaJ0SNY7soEsUEjb6gQ==$WG5d8oPm3OtcPnkdi4Uo7BkeZkBFzpcXkuLmtbsT4qY=:wfPLwcE6nTWhTAmQ7tl2KeoiWGPlZqQxSrmfPwDl2dU="
+)
+
+func TestDerive_RFC7677(t *testing.T) {
+	salt, _ := base64.StdEncoding.DecodeString(rfcSalt)
+	c, err := Derive("pencil", salt, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := Format(c); got != rfcVerifier {
+		t.Errorf("Format = %q, want %q", got, rfcVerifier)
+	}
+
+	authMessage := "n=user,r=" + rfcClientNonce + ",r=" + rfcNonce + ",s=" + rfcSalt + ",i=4096,c=biws,r=" + rfcNonce
+	sig := base64.StdEncoding.EncodeToString(hmacSHA256(c.ServerKey, []byte(authMessage)))
+	if sig != rfcSignature {
+		t.Errorf("server signature = %s, want %s", sig, rfcSignature)
+	}
+	proof := base64.StdEncoding.EncodeToString(clientProof("pencil", salt, 4096, authMessage))
+	if proof != rfcProof {
+		t.Errorf("client proof = %s, want %s", proof, rfcProof)
+	}
+}
+
+func TestFormatParse(t *testing.T) {
+	c, err := New("secret", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Iterations != DefaultIterations || len(c.Salt) != saltSize {
+		t.Errorf("New = %+v", c)
+	}
+	got, err := Parse(Format(c))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if Format(got) != Format(c) {
+		t.Errorf("round trip = %q, want %q", Format(got), Format(c))
+	}
+	if !Verify(got, "secret") {
+		t.Error("Verify(right password) = false")
+	}
+	if Verify(got, "wrong") {
+		t.Error("Verify(wrong password) = true")
+	}
+
+	other, _ := New("secret", 0)
+	if Format(other) == Format(c) {
+		t.Error("two New calls gave the same salt")
+	}
+}
+
+func TestDerive_Errors(t *testing.T) {
+	for _, iter := range []int{1, MinIterations - 1, MaxIterations + 1} {
+		if _, err := Derive("pw", []byte("salt"), iter); err == nil {
+			t.Errorf("Derive(iterations %d) succeeded", iter)
+		}
+	}
+	if _, err := Derive("pw", nil, DefaultIterations); err == nil {
+		t.Error("Derive(empty salt) succeeded")
+	}
+}
+
+func TestParse_Malformed(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"SCRAM-SHA-256",
+		"SCRAM-SHA-1$4096:W22ZaJ0SNY7soEsUEjb6gQ==$AAAA:AAAA",
+		strings.Replace(rfcVerifier, "$4096:", "$100:", 1),
+		strings.Replace(rfcVerifier, "$4096:", "$x:", 1),
+		strings.Replace(rfcVerifier, "W22ZaJ0SNY7soEsUEjb6gQ==", "!!", 1),
+		strings.Replace(rfcVerifier, "W22ZaJ0SNY7soEsUEjb6gQ==", "", 1),
+		strings.TrimSuffix(rfcVerifier, "wfPLwcE6nTWhTAmQ7tl2KeoiWGPlZqQxSrmfPwDl2dU=") + "AAAA",
+	} {
+		if _, err := Parse(s); !errors.Is(err, ErrMalformed) {
+			t.Errorf("Parse(%q) error = %v, want ErrMalformed", s, err)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package scram
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// Lookup returns username's stored credentials. It fails with
+// errors.ErrUserNotFound for unknown users and
+// errors.ErrMechanismUnsupported for users without SCRAM credentials.
+// domain.AuthRouter.GetSCRAMCredentials is a Lookup.
+type Lookup func(ctx context.Context, username string) (*auth.SCRAMCredentials, error)
+
+// nonceSize is the number of random bytes in the server's nonce.
+const nonceSize = 18
+
+// Server is the server side of one SCRAM-SHA-256 exchange: Start with the
+// client-first-message, then Finish with the client-final-message. A
+// Server is not safe for concurrent use and serves a single exchange.
+type Server struct {
+	lookup  Lookup
+	binding *auth.ChannelBinding
+
+	username, authzid string
+	gs2Header         string
+	clientFirstBare   string
+	serverFirst       string
+	nonce             string
+	creds             *auth.SCRAMCredentials // nil: unknown user, fail at Finish
+	done              bool
+}
+
+// NewServer returns a Server checking proofs against the credentials
+// lookup returns. binding is the channel binding of the client's TLS
+// connection; when it is set the daemon may offer MechanismPlus, and a
+// client that claims the server does not support binding is refused as a
+// downgrade. nil means the connection offers no binding, so only
+// Mechanism is possible.
+func NewServer(lookup Lookup, binding *auth.ChannelBinding) *Server {
+	return &Server{lookup: lookup, binding: binding}
+}
+
+// Username returns the authentication identity from the
+// client-first-message, once Start has parsed it.
+func (s *Server) Username() string { return s.username }
+
+// AuthzID returns the authorization identity the client asked for, empty
+// if none.
+func (s *Server) AuthzID() string { return s.authzid }
+
+// Start processes the client-first-message and returns the
+// server-first-message. For a user without credentials it answers with a
+// salt derived from the username, so the reply does not reveal whether
+// the user exists, and Finish fails. Only lookup errors other than
+// errors.ErrUserNotFound and errors.ErrMechanismUnsupported are returned.
+func (s *Server) Start(ctx context.Context, clientFirst []byte) ([]byte, error) {
+	if s.serverFirst != "" {
+		return nil, errors.New("scram: exchange already started")
+	}
+	msg := string(clientFirst)
+
+	// gs2-header: cbind-flag "," [ "a=" authzid ] ","
+	flag, rest, ok := strings.Cut(msg, ",")
+	if !ok {
+		return nil, fmt.Errorf("%w: missing gs2 header", ErrMalformed)
+	}
+	switch {
+	case flag == "n":
+	case flag == "y":
+		if s.binding != nil {
+			return nil, fmt.Errorf("%w: channel binding downgrade", autherrors.ErrAuthFailed)
+		}
+	case strings.HasPrefix(flag, "p="):
+		if s.binding == nil || flag[2:] != s.binding.Type {
+			return nil, fmt.Errorf("%w: channel binding %q", autherrors.ErrMechanismUnsupported, flag[2:])
+		}
+	default:
+		return nil, fmt.Errorf("%w: channel binding flag %q", ErrMalformed, flag)
+	}
+	authz, bare, ok := strings.Cut(rest, ",")
+	if !ok {
+		return nil, fmt.Errorf("%w: missing gs2 header", ErrMalformed)
+	}
+	if authz != "" {
+		if !strings.HasPrefix(authz, "a=") {
+			return nil, fmt.Errorf("%w: authzid", ErrMalformed)
+		}
+		var err error
+		if s.authzid, err = decodeName(authz[2:]); err != nil {
+			return nil, err
+		}
+	}
+	s.gs2Header = msg[:len(msg)-len(bare)]
+
+	// client-first-message-bare: "n=" saslname ",r=" c-nonce ["," extensions]
+	attrs := strings.Split(bare, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "n=") || !strings.HasPrefix(attrs[1], "r=") {
+		return nil, fmt.Errorf("%w: client-first-message", ErrMalformed)
+	}
+	for _, a := range attrs[2:] {
+		if strings.HasPrefix(a, "m=") {
+			return nil, fmt.Errorf("%w: mandatory extension", autherrors.ErrMechanismUnsupported)
+		}
+	}
+	var err error
+	if s.username, err = decodeName(attrs[0][2:]); err != nil {
+		return nil, err
+	}
+	clientNonce := attrs[1][2:]
+	if s.username == "" || !validNonce(clientNonce) {
+		return nil, fmt.Errorf("%w: client-first-message", ErrMalformed)
+	}
+	s.clientFirstBare = bare
+
+	creds, err := s.lookup(ctx, s.username)
+	switch {
+	case err == nil && creds != nil && creds.Mechanism == Mechanism:
+		s.creds = creds
+	case err == nil, errors.Is(err, autherrors.ErrUserNotFound), errors.Is(err, autherrors.ErrMechanismUnsupported):
+		creds = &auth.SCRAMCredentials{Salt: fakeSalt(s.username), Iterations: DefaultIterations}
+	default:
+		return nil, err
+	}
+
+	raw := make([]byte, nonceSize)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("generate scram nonce: %w", err)
+	}
+	s.nonce = clientNonce + base64.RawStdEncoding.EncodeToString(raw)
+	s.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", s.nonce, base64.StdEncoding.EncodeToString(creds.Salt), creds.Iterations)
+	return []byte(s.serverFirst), nil
+}
+
+// Finish processes the client-final-message and returns the
+// server-final-message, which the daemon sends with its success reply so
+// the client can verify the server in turn. A wrong proof, an unknown
+// user or a mismatched channel binding fail with errors.ErrAuthFailed.
+func (s *Server) Finish(clientFinal []byte) ([]byte, error) {
+	if s.serverFirst == "" || s.done {
+		return nil, errors.New("scram: exchange not started")
+	}
+	s.done = true
+	msg := string(clientFinal)
+
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return nil, fmt.Errorf("%w: missing proof", ErrMalformed)
+	}
+	withoutProof := msg[:i]
+	proof, err := base64.StdEncoding.DecodeString(msg[i+len(",p="):])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, fmt.Errorf("%w: proof", ErrMalformed)
+	}
+	attrs := strings.Split(withoutProof, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "c=") || !strings.HasPrefix(attrs[1], "r=") {
+		return nil, fmt.Errorf("%w: client-final-message", ErrMalformed)
+	}
+	cbind, err := base64.StdEncoding.DecodeString(attrs[0][2:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: channel binding", ErrMalformed)
+	}
+	want := []byte(s.gs2Header)
+	if strings.HasPrefix(s.gs2Header, "p=") {
+		want = append(want, s.binding.Data...)
+	}
+	if !hmac.Equal(cbind, want) {
+		return nil, fmt.Errorf("%w: channel binding mismatch", autherrors.ErrAuthFailed)
+	}
+	if attrs[1][2:] != s.nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", autherrors.ErrAuthFailed)
+	}
+	if s.creds == nil {
+		return nil, autherrors.ErrAuthFailed
+	}
+
+	authMessage := []byte(s.clientFirstBare + "," + s.serverFirst + "," + withoutProof)
+	clientSignature := hmacSHA256(s.creds.StoredKey, authMessage)
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	clear(clientKey)
+	if !hmac.Equal(storedKey[:], s.creds.StoredKey) {
+		return nil, autherrors.ErrAuthFailed
+	}
+	serverSignature := hmacSHA256(s.creds.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+// decodeName decodes a saslname: "=2C" is ',' and "=3D" is '='.
+func decodeName(s string) (string, error) {
+	if !strings.Contains(s, "=") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '=' {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(s[i:], "=2C"):
+			b.WriteByte(',')
+		case strings.HasPrefix(s[i:], "=3D"):
+			b.WriteByte('=')
+		default:
+			return "", fmt.Errorf("%w: saslname escape", ErrMalformed)
+		}
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// validNonce reports whether n is a usable nonce: printable ASCII other
+// than ','.
+func validNonce(n string) bool {
+	if n == "" {
+		return false
+	}
+	for i := 0; i < len(n); i++ {
+		if n[i] <= ' ' || n[i] > '~' || n[i] == ',' {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	fakeSaltKeyOnce sync.Once
+	fakeSaltKey     []byte
+)
+
+// fakeSalt returns the salt offered for a user without credentials: the
+// same for every exchange with this process, as a real salt would be.
+func fakeSalt(username string) []byte {
+	fakeSaltKeyOnce.Do(func() {
+		fakeSaltKey = make([]byte, 32)
+		_, _ = rand.Read(fakeSaltKey)
+	})
+	return hmacSHA256(fakeSaltKey, []byte(username))[:saltSize]
+}
@@ -0,0 +1,222 @@
+package scram
+
+import (
+	"context"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// clientProof computes a client's proof for authMessage (RFC 5802,
+// section 3).
+func clientProof(password string, salt []byte, iterations int, authMessage string) []byte {
+	salted, _ := pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size)
+	clientKey := hmacSHA256(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	sig := hmacSHA256(storedKey[:], []byte(authMessage))
+	for i := range clientKey {
+		clientKey[i] ^= sig[i]
+	}
+	return clientKey
+}
+
+// testClient runs the client side of an exchange with s.
+type testClient struct {
+	gs2Header string
+	cbind     []byte // binding data sent in c=, after the header
+	username  string
+	password  string
+}
+
+// run performs the exchange and returns the server-final-message.
+func (c testClient) run(t *testing.T, s *Server) ([]byte, error) {
+	t.Helper()
+	gs2 := c.gs2Header
+	if gs2 == "" {
+		gs2 = "n,,"
+	}
+	bare := "n=" + c.username + ",r=fyko+d2lbbFgONRv9qkxdawL"
+	serverFirst, err := s.Start(context.Background(), []byte(gs2+bare))
+	if err != nil {
+		return nil, err
+	}
+	var nonce, salt string
+	var iter int
+	for _, attr := range strings.Split(string(serverFirst), ",") {
+		switch attr[:2] {
+		case "r=":
+			nonce = attr[2:]
+		case "s=":
+			salt = attr[2:]
+		case "i=":
+			iter, _ = strconv.Atoi(attr[2:])
+		}
+	}
+	rawSalt, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil {
+		t.Fatalf("server-first-message %q: %v", serverFirst, err)
+	}
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString(append([]byte(gs2), c.cbind...)) + ",r=" + nonce
+	authMessage := bare + "," + string(serverFirst) + "," + withoutProof
+	proof := clientProof(c.password, rawSalt, iter, authMessage)
+	return s.Finish([]byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)))
+}
+
+// testLookup returns a Lookup knowing alice with password "pencil".
+func testLookup(t *testing.T) Lookup {
+	t.Helper()
+	alice, err := New("pencil", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func(_ context.Context, username string) (*auth.SCRAMCredentials, error) {
+		switch username {
+		case "alice":
+			return &alice, nil
+		case "nokeys":
+			return nil, autherrors.ErrMechanismUnsupported
+		case "broken":
+			return nil, errors.New("backend down")
+		}
+		return nil, autherrors.ErrUserNotFound
+	}
+}
+
+func TestServer_Exchange(t *testing.T) {
+	lookup := testLookup(t)
+
+	s := NewServer(lookup, nil)
+	final, err := testClient{username: "alice", password: "pencil"}.run(t, s)
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	if !strings.HasPrefix(string(final), "v=") || s.Username() != "alice" || s.AuthzID() != "" {
+		t.Errorf("final = %q, username %q, authzid %q", final, s.Username(), s.AuthzID())
+	}
+	if _, err := s.Finish(nil); err == nil {
+		t.Error("second Finish succeeded")
+	}
+
+	s = NewServer(lookup, nil)
+	if _, err := (testClient{gs2Header: "n,a=bob=2Cx,", username: "alice", password: "pencil"}).run(t, s); err != nil {
+		t.Fatalf("exchange with authzid: %v", err)
+	}
+	if s.AuthzID() != "bob,x" {
+		t.Errorf("AuthzID = %q", s.AuthzID())
+	}
+}
+
+func TestServer_Failures(t *testing.T) {
+	lookup := testLookup(t)
+	for _, tc := range []struct {
+		name   string
+		client testClient
+	}{
+		{"wrong password", testClient{username: "alice", password: "wrong"}},
+		{"unknown user", testClient{username: "carol", password: "pencil"}},
+		{"no credentials", testClient{username: "nokeys", password: "pencil"}},
+		{"binding data without binding", testClient{username: "alice", password: "pencil", cbind: []byte("x")}},
+	} {
+		if _, err := tc.client.run(t, NewServer(lookup, nil)); !errors.Is(err, autherrors.ErrAuthFailed) {
+			t.Errorf("%s: err = %v, want ErrAuthFailed", tc.name, err)
+		}
+	}
+
+	if _, err := NewServer(lookup, nil).Start(context.Background(), []byte("n,,n=broken,r=abc")); err == nil {
+		t.Error("backend error not returned")
+	}
+}
+
+func TestServer_UnknownUserSalt(t *testing.T) {
+	// The reply for an unknown user is stable, like a real user's.
+	start := func(user string) string {
+		out, err := NewServer(testLookup(t), nil).Start(context.Background(), []byte("n,,n="+user+",r=abc"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, params, _ := strings.Cut(string(out), ",s=")
+		return params
+	}
+	if a, b := start("carol"), start("carol"); a != b {
+		t.Errorf("salt for carol changed: %q, %q", a, b)
+	}
+	if a, b := start("carol"), start("dave"); a == b {
+		t.Errorf("carol and dave got the same salt %q", a)
+	}
+	if got := start("carol"); !strings.HasSuffix(got, fmt.Sprintf(",i=%d", DefaultIterations)) {
+		t.Errorf("unknown user parameters = %q", got)
+	}
+}
+
+func TestServer_ChannelBinding(t *testing.T) {
+	lookup := testLookup(t)
+	binding := &auth.ChannelBinding{Type: "tls-exporter", Data: []byte("exporter-data")}
+
+	ok := testClient{gs2Header: "p=tls-exporter,,", cbind: binding.Data, username: "alice", password: "pencil"}
+	if _, err := ok.run(t, NewServer(lookup, binding)); err != nil {
+		t.Errorf("bound exchange: %v", err)
+	}
+	if _, err := (testClient{username: "alice", password: "pencil"}).run(t, NewServer(lookup, binding)); err != nil {
+		t.Errorf("unbound exchange on a binding server: %v", err)
+	}
+
+	wrong := ok
+	wrong.cbind = []byte("other-connection")
+	if _, err := wrong.run(t, NewServer(lookup, binding)); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("mismatched binding: err = %v, want ErrAuthFailed", err)
+	}
+	downgrade := testClient{gs2Header: "y,,", username: "alice", password: "pencil"}
+	if _, err := downgrade.run(t, NewServer(lookup, binding)); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("downgrade: err = %v, want ErrAuthFailed", err)
+	}
+	if _, err := downgrade.run(t, NewServer(lookup, nil)); err != nil {
+		t.Errorf("y flag without binding: %v", err)
+	}
+	otherType := testClient{gs2Header: "p=tls-unique,,", username: "alice", password: "pencil"}
+	if _, err := otherType.run(t, NewServer(lookup, binding)); !errors.Is(err, autherrors.ErrMechanismUnsupported) {
+		t.Errorf("other binding type: err = %v, want ErrMechanismUnsupported", err)
+	}
+	if _, err := ok.run(t, NewServer(lookup, nil)); !errors.Is(err, autherrors.ErrMechanismUnsupported) {
+		t.Errorf("p flag without binding: err = %v, want ErrMechanismUnsupported", err)
+	}
+}
+
+func TestServer_Malformed(t *testing.T) {
+	for _, msg := range []string{
+		"",
+		"n",
+		"x,,n=alice,r=abc",
+		"n,b=bob,n=alice,r=abc",
+		"n,,r=abc,n=alice",
+		"n,,n=alice",
+		"n,,n=,r=abc",
+		"n,,n=al=ice,r=abc",
+		"n,,n=alice,r=a c",
+	} {
+		if _, err := NewServer(testLookup(t), nil).Start(context.Background(), []byte(msg)); !errors.Is(err, ErrMalformed) {
+			t.Errorf("Start(%q) error = %v, want ErrMalformed", msg, err)
+		}
+	}
+	if _, err := NewServer(testLookup(t), nil).Start(context.Background(), []byte("n,,n=alice,r=abc,m=ext")); !errors.Is(err, autherrors.ErrMechanismUnsupported) {
+		t.Errorf("mandatory extension: err = %v", err)
+	}
+
+	s := NewServer(testLookup(t), nil)
+	if _, err := s.Finish([]byte("c=biws,r=abc,p=AAAA")); err == nil {
+		t.Error("Finish before Start succeeded")
+	}
+	if _, err := s.Start(context.Background(), []byte("n,,n=alice,r=abc")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Finish([]byte("c=biws,r=abc")); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Finish without proof: err = %v, want ErrMalformed", err)
+	}
+}
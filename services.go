@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ServiceSet is a set of services an account may log in to, such as
+// ServiceSMTP alone for a send-only account. The zero set places no
+// restriction.
+type ServiceSet uint8
+
+// Services, named by the protocol a daemon passes for a login (see
+// domain.WithProtocol).
+const (
+	ServiceIMAP    ServiceSet = 1 << iota // "imap"
+	ServicePOP3                           // "pop3"
+	ServiceSMTP                           // "smtp" or "submission"
+	ServiceWebmail                        // "webmail"
+
+	// ServiceNone marks a restriction that allows none of the services
+	// above, such as one naming only services unknown here. Unlike the
+	// zero set it refuses every login.
+	ServiceNone ServiceSet = 1 << 7
+)
+
+// serviceNames are the names of the services, in String's order.
+var serviceNames = []struct {
+	name    string
+	service ServiceSet
+}{
+	{"imap", ServiceIMAP},
+	{"pop3", ServicePOP3},
+	{"smtp", ServiceSMTP},
+	{"webmail", ServiceWebmail},
+}
+
+// ServiceByName returns the service protocol names, ignoring case, and
+// false if it names none.
+func ServiceByName(protocol string) (ServiceSet, bool) {
+	protocol = strings.ToLower(strings.TrimSpace(protocol))
+	if protocol == "submission" {
+		return ServiceSMTP, true
+	}
+	for _, n := range serviceNames {
+		if n.name == protocol {
+			return n.service, true
+		}
+	}
+	return 0, false
+}
+
+// ParseServiceSet parses a comma-separated list of service names, such as
+// "imap,smtp", or "none" for ServiceNone. An empty list is the zero set.
+// Unknown names are an error; the set returned with it holds the known
+// names and ServiceNone, so a caller that goes on with it restricts rather
+// than allows.
+func ParseServiceSet(list string) (ServiceSet, error) {
+	var set ServiceSet
+	var unknown []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if strings.EqualFold(name, "none") {
+			set |= ServiceNone
+		} else if s, ok := ServiceByName(name); ok {
+			set |= s
+		} else {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		return set | ServiceNone, fmt.Errorf("unknown service %q", strings.Join(unknown, ","))
+	}
+	return set, nil
+}
+
+// Allows reports whether the set allows logins on protocol. The zero set
+// allows every protocol, and an empty protocol, from a daemon that does
+// not name its own, is always allowed; otherwise the protocol must name a
+// service in the set.
+func (s ServiceSet) Allows(protocol string) bool {
+	if s == 0 || protocol == "" {
+		return true
+	}
+	service, ok := ServiceByName(protocol)
+	return ok && s&service != 0
+}
+
+// String returns the set as ParseServiceSet reads it, "none" for a set
+// allowing no service.
+func (s ServiceSet) String() string {
+	var names []string
+	for _, n := range serviceNames {
+		if s&n.service != 0 {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 && s != 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,57 @@
+package auth
+
+import "testing"
+
+func TestParseServiceSet(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    ServiceSet
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"imap", ServiceIMAP, false},
+		{" IMAP , smtp,", ServiceIMAP | ServiceSMTP, false},
+		{"submission,pop3,webmail", ServiceSMTP | ServicePOP3 | ServiceWebmail, false},
+		{"none", ServiceNone, false},
+		{"imap,sieve", ServiceIMAP | ServiceNone, true},
+		{"sieve", ServiceNone, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseServiceSet(tt.list)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ParseServiceSet(%q) = %v, %v; want %v, error %v", tt.list, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestServiceSet_Allows(t *testing.T) {
+	tests := []struct {
+		set      ServiceSet
+		protocol string
+		want     bool
+	}{
+		{0, "imap", true},
+		{0, "sieve", true},
+		{ServiceSMTP, "", true},
+		{ServiceSMTP, "submission", true},
+		{ServiceSMTP, "SMTP", true},
+		{ServiceSMTP, "imap", false},
+		{ServiceSMTP, "sieve", false},
+		{ServiceIMAP | ServicePOP3, "pop3", true},
+		{ServiceNone, "imap", false},
+	}
+	for _, tt := range tests {
+		if got := tt.set.Allows(tt.protocol); got != tt.want {
+			t.Errorf("%v.Allows(%q) = %v, want %v", tt.set, tt.protocol, got, tt.want)
+		}
+	}
+}
+
+func TestServiceSet_String(t *testing.T) {
+	for _, set := range []ServiceSet{0, ServiceIMAP, ServiceIMAP | ServiceSMTP | ServiceWebmail, ServiceNone} {
+		got, err := ParseServiceSet(set.String())
+		if err != nil || got != set {
+			t.Errorf("ParseServiceSet(%q) = %v, %v; want %v", set.String(), got, err, set)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"context"
+	"time"
+)
+
+// SessionInfo describes a session issued to a user, such as one behind a
+// session token (see AuthTokenAgent), as kept by a SessionStore.
+type SessionInfo struct {
+	// ID identifies the session; for a token, its ID (Credential.ID of
+	// sessions reopened from it).
+	ID string `json:"id"`
+
+	// Username is the account the session belongs to.
+	Username string `json:"user"`
+
+	// Issued and Expires bound the session's lifetime.
+	Issued  time.Time `json:"issued"`
+	Expires time.Time `json:"expires"`
+
+	// Operator is the support operator of an impersonation session, empty
+	// for the user's own.
+	Operator string `json:"operator,omitempty"`
+}
+
+// SessionStore keeps a registry of the sessions issued to users, so they
+// can be listed and revoked before they expire. A session unknown to the
+// store counts as revoked.
+type SessionStore interface {
+	// AddSession registers a newly issued session.
+	AddSession(ctx context.Context, info SessionInfo) error
+
+	// CheckSession returns nil if id is an active session of username,
+	// and errors.ErrSessionRevoked if it was revoked or is unknown.
+	CheckSession(ctx context.Context, username, id string) error
+
+	// ListSessions returns username's active sessions, oldest first.
+	ListSessions(ctx context.Context, username string) ([]SessionInfo, error)
+
+	// RevokeSession ends one of username's sessions. Returns
+	// errors.ErrSessionNotFound if it has no active session id.
+	RevokeSession(ctx context.Context, username, id string) error
+
+	// RevokeSessions ends all of username's sessions and returns how many
+	// were active.
+	RevokeSessions(ctx context.Context, username string) (int, error)
+}
@@ -0,0 +1,268 @@
+// Package sessions keeps a registry of the sessions issued to users, such
+// as those behind session tokens, so they can be listed and revoked before
+// they expire (see auth.SessionStore).
+//
+// A Store keeps one domain's sessions in a file of JSON lines, one per
+// event (a session added, one revoked, or all of a user's revoked),
+// appended so that several daemons serving the domain can share it. Reads
+// replay the file. Once it grows past a threshold it is compacted into one
+// line per active session. Appends and compaction hold the filesystem's
+// lock on the file (see vfs.Lock), so a compaction never drops a line
+// another process appended meanwhile.
+package sessions
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/vfs"
+)
+
+// FileName is the name of a domain's session file in its data directory.
+const FileName = ".sessions"
+
+// compactBytes is the file size that triggers compaction.
+const compactBytes = 1 << 20
+
+// Events recorded in the file.
+const (
+	opAdd       = "add"
+	opRevoke    = "revoke"
+	opRevokeAll = "revoke_all"
+)
+
+// line is one line of the file.
+type line struct {
+	Op       string            `json:"op"`
+	Username string            `json:"user"`
+	ID       string            `json:"id,omitempty"`
+	Session  *auth.SessionInfo `json:"session,omitempty"`
+}
+
+// Store is one domain's session registry. It is safe for concurrent use,
+// and by several processes appending to the same file.
+type Store struct {
+	mu   sync.Mutex
+	fsys vfs.WriteFS
+	path string
+	now  func() time.Time
+}
+
+var _ auth.SessionStore = (*Store)(nil)
+
+// New returns a Store kept in the file at path, which need not exist yet.
+func New(path string) *Store {
+	return &Store{fsys: vfs.OS{}, path: path, now: time.Now}
+}
+
+// Open returns the Store of the domain whose data directory is dir.
+func Open(dir string) *Store {
+	return New(filepath.Join(dir, FileName))
+}
+
+// WithFS makes the store keep its file on fsys instead of the local disk.
+// Returns the Store to allow chaining.
+func (s *Store) WithFS(fsys vfs.WriteFS) *Store {
+	s.fsys = fsys
+	return s
+}
+
+// AddSession registers info.
+func (s *Store) AddSession(_ context.Context, info auth.SessionInfo) error {
+	if info.ID == "" || info.Username == "" {
+		return fmt.Errorf("session needs an ID and a username")
+	}
+	info.Username = strings.ToLower(info.Username)
+	info.Issued, info.Expires = info.Issued.UTC(), info.Expires.UTC()
+	return s.append(line{Op: opAdd, Username: info.Username, ID: info.ID, Session: &info})
+}
+
+// CheckSession returns nil if id is an active session of username, and
+// errors.ErrSessionRevoked if not.
+func (s *Store) CheckSession(_ context.Context, username, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions, err := s.load()
+	if err != nil {
+		return err
+	}
+	info, ok := sessions[strings.ToLower(username)][id]
+	if !ok || !s.active(info) {
+		return autherrors.ErrSessionRevoked
+	}
+	return nil
+}
+
+// ListSessions returns username's active sessions, oldest first.
+func (s *Store) ListSessions(_ context.Context, username string) ([]auth.SessionInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return s.sorted(sessions[strings.ToLower(username)]), nil
+}
+
+// Users returns the users with active sessions, sorted.
+func (s *Store) Users() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	var users []string
+	for user, byID := range sessions {
+		if len(s.sorted(byID)) > 0 {
+			users = append(users, user)
+		}
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+// RevokeSession ends username's session id. Returns
+// errors.ErrSessionNotFound if it is not active.
+func (s *Store) RevokeSession(ctx context.Context, username, id string) error {
+	if err := s.CheckSession(ctx, username, id); err != nil {
+		return fmt.Errorf("%w: %s", autherrors.ErrSessionNotFound, id)
+	}
+	return s.append(line{Op: opRevoke, Username: strings.ToLower(username), ID: id})
+}
+
+// RevokeSessions ends all of username's sessions and returns how many were
+// active.
+func (s *Store) RevokeSessions(ctx context.Context, username string) (int, error) {
+	active, err := s.ListSessions(ctx, username)
+	if err != nil {
+		return 0, err
+	}
+	if len(active) == 0 {
+		return 0, nil
+	}
+	return len(active), s.append(line{Op: opRevokeAll, Username: strings.ToLower(username)})
+}
+
+// active reports whether info has not expired.
+func (s *Store) active(info auth.SessionInfo) bool {
+	return s.now().Before(info.Expires)
+}
+
+// sorted returns the active sessions of byID, oldest first.
+func (s *Store) sorted(byID map[string]auth.SessionInfo) []auth.SessionInfo {
+	var list []auth.SessionInfo
+	for _, info := range byID {
+		if s.active(info) {
+			list = append(list, info)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Issued.Equal(list[j].Issued) {
+			return list[i].Issued.Before(list[j].Issued)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// append writes l to the file, compacting it once it is large.
+func (s *Store) append(l line) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("encode session: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unlock, err := vfs.Lock(s.fsys, s.path)
+	if err != nil {
+		return fmt.Errorf("lock sessions: %w", err)
+	}
+	defer unlock()
+
+	if err := s.fsys.AppendFile(s.path, append(data, '\n'), 0o600); err != nil {
+		return fmt.Errorf("write sessions: %w", err)
+	}
+	if fi, err := s.fsys.Stat(s.path); err == nil && fi.Size() > compactBytes {
+		return s.compact()
+	}
+	return nil
+}
+
+// load replays the file into sessions by user and ID, including expired
+// ones. Caller must hold s.mu.
+func (s *Store) load() (map[string]map[string]auth.SessionInfo, error) {
+	sessions := make(map[string]map[string]auth.SessionInfo)
+	f, err := s.fsys.Open(s.path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return sessions, nil
+		}
+		return nil, fmt.Errorf("open sessions: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var l line
+		if err := json.Unmarshal(scanner.Bytes(), &l); err != nil || l.Username == "" {
+			continue // skip a torn final line
+		}
+		switch l.Op {
+		case opAdd:
+			if l.Session == nil {
+				continue
+			}
+			if sessions[l.Username] == nil {
+				sessions[l.Username] = make(map[string]auth.SessionInfo)
+			}
+			sessions[l.Username][l.ID] = *l.Session
+		case opRevoke:
+			delete(sessions[l.Username], l.ID)
+		case opRevokeAll:
+			delete(sessions, l.Username)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read sessions: %w", err)
+	}
+	return sessions, nil
+}
+
+// compact rewrites the file as one line per active session, dropping
+// revoked and expired ones. Caller must hold s.mu and the file's lock.
+func (s *Store) compact() error {
+	sessions, err := s.load()
+	if err != nil {
+		return err
+	}
+	users := make([]string, 0, len(sessions))
+	for user := range sessions {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, user := range users {
+		for _, info := range s.sorted(sessions[user]) {
+			if err := enc.Encode(line{Op: opAdd, Username: user, ID: info.ID, Session: &info}); err != nil {
+				return err
+			}
+		}
+	}
+	return vfs.WriteFileAtomic(s.fsys, s.path, buf.Bytes(), 0o600)
+}
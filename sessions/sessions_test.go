@@ -0,0 +1,175 @@
+package sessions
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/vfs"
+)
+
+func TestStore_Revocation(t *testing.T) {
+	ctx := context.Background()
+	s := Open(t.TempDir())
+	t0 := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	s.now = func() time.Time { return t0.Add(time.Hour) }
+
+	for i, id := range []string{"s1", "s2", "s3"} {
+		issued := t0.Add(time.Duration(i) * time.Minute)
+		if err := s.AddSession(ctx, auth.SessionInfo{ID: id, Username: "Alice", Issued: issued, Expires: issued.Add(12 * time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Expired sessions are neither active nor listed.
+	if err := s.AddSession(ctx, auth.SessionInfo{ID: "old", Username: "alice", Issued: t0, Expires: t0.Add(time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CheckSession(ctx, "alice", "old"); !errors.Is(err, autherrors.ErrSessionRevoked) {
+		t.Errorf("CheckSession(expired) = %v, want ErrSessionRevoked", err)
+	}
+
+	list, err := s.ListSessions(ctx, "ALICE")
+	if err != nil || len(list) != 3 || list[0].ID != "s1" || list[2].ID != "s3" {
+		t.Fatalf("ListSessions = %+v, %v", list, err)
+	}
+	if err := s.RevokeSession(ctx, "alice", "s2"); err != nil {
+		t.Fatalf("RevokeSession: %v", err)
+	}
+	if err := s.CheckSession(ctx, "alice", "s2"); !errors.Is(err, autherrors.ErrSessionRevoked) || !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("CheckSession(revoked) = %v", err)
+	}
+	if err := s.CheckSession(ctx, "alice", "s1"); err != nil {
+		t.Errorf("CheckSession(active) = %v", err)
+	}
+	if err := s.RevokeSession(ctx, "alice", "s2"); !errors.Is(err, autherrors.ErrSessionNotFound) {
+		t.Errorf("RevokeSession twice = %v, want ErrSessionNotFound", err)
+	}
+	if err := s.CheckSession(ctx, "bob", "s1"); !errors.Is(err, autherrors.ErrSessionRevoked) {
+		t.Errorf("CheckSession(other user) = %v", err)
+	}
+
+	if users, err := s.Users(); err != nil || len(users) != 1 || users[0] != "alice" {
+		t.Errorf("Users = %v, %v", users, err)
+	}
+	if n, err := s.RevokeSessions(ctx, "alice"); err != nil || n != 2 {
+		t.Errorf("RevokeSessions = %d, %v; want 2", n, err)
+	}
+	if list, _ := s.ListSessions(ctx, "alice"); len(list) != 0 {
+		t.Errorf("sessions left after RevokeSessions: %+v", list)
+	}
+	if n, err := s.RevokeSessions(ctx, "alice"); err != nil || n != 0 {
+		t.Errorf("RevokeSessions again = %d, %v", n, err)
+	}
+
+	// A torn final line is skipped.
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString(`{"op":"add","user":"alice","id":"s1","se`)
+	_ = f.Close()
+
+	if err := s.CheckSession(ctx, "alice", "s1"); !errors.Is(err, autherrors.ErrSessionRevoked) {
+		t.Errorf("CheckSession after torn line = %v", err)
+	}
+}
+
+func TestStore_Compact(t *testing.T) {
+	ctx := context.Background()
+	s := Open(t.TempDir())
+	t0 := time.Now()
+	for i := range 200 {
+		id := fmt.Sprintf("s%03d", i)
+		if err := s.AddSession(ctx, auth.SessionInfo{ID: id, Username: fmt.Sprintf("user%d", i%4), Issued: t0, Expires: t0.Add(time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 1 {
+			if err := s.RevokeSession(ctx, fmt.Sprintf("user%d", i%4), id); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	s.mu.Lock()
+	err := s.compact()
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list, err := s.ListSessions(ctx, "user0"); err != nil || len(list) != 50 {
+		t.Errorf("user0 sessions after compaction = %d, %v; want 50", len(list), err)
+	}
+	if list, _ := s.ListSessions(ctx, "user1"); len(list) != 0 {
+		t.Errorf("user1 kept revoked sessions: %d", len(list))
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != 100 {
+		t.Errorf("compacted file has %d lines, want 100", lines)
+	}
+}
+
+// Two Stores on one file stand for two processes: compaction by one must
+// not drop what the other appends meanwhile.
+func TestStore_CompactConcurrentAppend(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	writer, compactor := Open(dir), Open(dir)
+	t0 := time.Now()
+
+	const n = 200
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range n / 4 {
+			compactor.mu.Lock()
+			unlock, err := vfs.Lock(compactor.fsys, compactor.path)
+			if err == nil {
+				err = compactor.compact()
+				unlock()
+			}
+			compactor.mu.Unlock()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := range n {
+		if err := writer.AddSession(ctx, auth.SessionInfo{ID: fmt.Sprintf("s%03d", i), Username: "alice", Issued: t0, Expires: t0.Add(time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+
+	if list, err := compactor.ListSessions(ctx, "alice"); err != nil || len(list) != n {
+		t.Errorf("%d sessions after concurrent compaction, %v; want %d", len(list), err, n)
+	}
+}
+
+func TestStore_WithFS(t *testing.T) {
+	ctx := context.Background()
+	mem := vfs.NewMemFS()
+	if err := mem.MkdirAll("/data", 0o750); err != nil {
+		t.Fatal(err)
+	}
+	s := Open("/data").WithFS(mem)
+	t0 := time.Now()
+	if err := s.AddSession(ctx, auth.SessionInfo{ID: "s1", Username: "alice", Issued: t0, Expires: t0.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Stat("/data/" + FileName); err != nil {
+		t.Errorf("session file not on the given FS: %v", err)
+	}
+	if err := s.CheckSession(ctx, "alice", "s1"); err != nil {
+		t.Errorf("CheckSession: %v", err)
+	}
+}
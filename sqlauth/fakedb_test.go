@@ -0,0 +1,251 @@
+package sqlauth
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeDriver is a minimal in-memory database/sql driver understanding only
+// the statements this package issues, so tests run without a real database.
+type fakeDriver struct{}
+
+// fakeDB is one named in-memory database: tables of rows keyed by column.
+type fakeDB struct {
+	mu       sync.Mutex
+	tables   map[string][]map[string]string
+	columns  map[string][]string
+	prepares atomic.Int64
+}
+
+var (
+	fakeDBsMu sync.Mutex
+	fakeDBs   = map[string]*fakeDB{}
+)
+
+func init() {
+	sql.Register("sqlauth-fake", fakeDriver{})
+}
+
+// openFakeDB returns a fresh database and its backing store.
+func openFakeDB(t *testing.T) (*sql.DB, *fakeDB) {
+	t.Helper()
+	fdb := &fakeDB{tables: map[string][]map[string]string{}, columns: map[string][]string{}}
+	fakeDBsMu.Lock()
+	fakeDBs[t.Name()] = fdb
+	fakeDBsMu.Unlock()
+	db, err := sql.Open("sqlauth-fake", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db, fdb
+}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeDBsMu.Lock()
+	defer fakeDBsMu.Unlock()
+	fdb, ok := fakeDBs[name]
+	if !ok {
+		return nil, fmt.Errorf("fake database %q not found", name)
+	}
+	return &fakeConn{db: fdb}, nil
+}
+
+type fakeConn struct{ db *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	c.db.prepares.Add(1)
+	return &fakeStmt{db: c.db, query: query}, nil
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+var (
+	createRe = regexp.MustCompile(`^CREATE TABLE IF NOT EXISTS (\w+) \((.*)\)$`)
+	insertRe = regexp.MustCompile(`^INSERT (?:OR IGNORE |IGNORE )?INTO (\w+) \(([^)]*)\) VALUES`)
+	lookupRe = regexp.MustCompile(`^SELECT (.+) FROM (\w+) WHERE (\w+) = (?:\?|\$1)$`)
+	listRe   = regexp.MustCompile(`^SELECT (\w+) FROM (\w+) ORDER BY \w+$`)
+	whereRe  = regexp.MustCompile(`^SELECT (.+) FROM (\w+) WHERE (.+?)(?: ORDER BY (\w+))?$`)
+	deleteRe = regexp.MustCompile(`^DELETE FROM (\w+) WHERE (.+)$`)
+	condRe   = regexp.MustCompile(`^(\w+) (=|>|<=) (?:\?|\$\d+)$`)
+)
+
+// matches reports whether row satisfies where, a conjunction of
+// "column op placeholder" conditions bound in order to args. > and <=
+// compare as integers.
+func matches(row map[string]string, where string, args []driver.Value) (bool, error) {
+	for i, cond := range strings.Split(where, " AND ") {
+		m := condRe.FindStringSubmatch(cond)
+		if m == nil || i >= len(args) {
+			return false, fmt.Errorf("fake driver: unsupported condition %q", cond)
+		}
+		val, arg := row[m[1]], fmt.Sprint(args[i])
+		if m[2] == "=" {
+			if val != arg {
+				return false, nil
+			}
+			continue
+		}
+		v, _ := strconv.ParseInt(val, 10, 64)
+		a, _ := strconv.ParseInt(arg, 10, 64)
+		if (m[2] == ">") != (v > a) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if m := createRe.FindStringSubmatch(s.query); m != nil {
+		if _, ok := s.db.columns[m[1]]; !ok {
+			var cols []string
+			for _, def := range strings.Split(m[2], ",") {
+				cols = append(cols, strings.Fields(def)[0])
+			}
+			s.db.columns[m[1]] = cols
+		}
+		return driver.RowsAffected(0), nil
+	}
+	if m := insertRe.FindStringSubmatch(s.query); m != nil {
+		cols := strings.Split(m[2], ", ")
+		for _, row := range s.db.tables[m[1]] {
+			if row[cols[0]] == fmt.Sprint(args[0]) {
+				return driver.RowsAffected(0), nil // duplicate key ignored
+			}
+		}
+		row := map[string]string{}
+		for i, col := range cols {
+			row[col] = fmt.Sprint(args[i])
+		}
+		s.db.tables[m[1]] = append(s.db.tables[m[1]], row)
+		return driver.RowsAffected(1), nil
+	}
+	if m := deleteRe.FindStringSubmatch(s.query); m != nil {
+		var kept []map[string]string
+		for _, row := range s.db.tables[m[1]] {
+			ok, err := matches(row, m[2], args)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				kept = append(kept, row)
+			}
+		}
+		deleted := len(s.db.tables[m[1]]) - len(kept)
+		s.db.tables[m[1]] = kept
+		return driver.RowsAffected(deleted), nil
+	}
+	return nil, fmt.Errorf("fake driver: unsupported exec %q", s.query)
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if m := lookupRe.FindStringSubmatch(s.query); m != nil {
+		var matched []map[string]string
+		for _, row := range s.db.tables[m[2]] {
+			if row[m[3]] == fmt.Sprint(args[0]) {
+				matched = append(matched, row)
+			}
+		}
+		if m[1] == "COUNT(*)" {
+			return &fakeRows{cols: []string{"n"}, values: [][]driver.Value{{int64(len(matched))}}}, nil
+		}
+		cols := strings.Split(m[1], ", ")
+		rows := &fakeRows{cols: cols}
+		for _, row := range matched {
+			var vals []driver.Value
+			for _, col := range cols {
+				vals = append(vals, row[col])
+			}
+			rows.values = append(rows.values, vals)
+		}
+		return rows, nil
+	}
+	if m := listRe.FindStringSubmatch(s.query); m != nil {
+		var names []string
+		for _, row := range s.db.tables[m[2]] {
+			names = append(names, row[m[1]])
+		}
+		sort.Strings(names)
+		rows := &fakeRows{cols: []string{m[1]}}
+		for _, name := range names {
+			rows.values = append(rows.values, []driver.Value{name})
+		}
+		return rows, nil
+	}
+	if m := whereRe.FindStringSubmatch(s.query); m != nil {
+		var matched []map[string]string
+		for _, row := range s.db.tables[m[2]] {
+			ok, err := matches(row, m[3], args)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				matched = append(matched, row)
+			}
+		}
+		if m[1] == "COUNT(*)" {
+			return &fakeRows{cols: []string{"n"}, values: [][]driver.Value{{int64(len(matched))}}}, nil
+		}
+		if order := m[4]; order != "" {
+			sort.SliceStable(matched, func(i, j int) bool {
+				a, _ := strconv.ParseInt(matched[i][order], 10, 64)
+				b, _ := strconv.ParseInt(matched[j][order], 10, 64)
+				return a < b
+			})
+		}
+		cols := strings.Split(m[1], ", ")
+		rows := &fakeRows{cols: cols}
+		for _, row := range matched {
+			var vals []driver.Value
+			for _, col := range cols {
+				vals = append(vals, row[col])
+			}
+			rows.values = append(rows.values, vals)
+		}
+		return rows, nil
+	}
+	return nil, fmt.Errorf("fake driver: unsupported query %q", s.query)
+}
+
+type fakeRows struct {
+	cols   []string
+	values [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
@@ -0,0 +1,109 @@
+package sqlauth
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/infodancer/auth/passwd"
+)
+
+// Migrate creates the user table described by opts if it does not exist.
+// It is idempotent and safe to run at every start. Tables mapped onto an
+// existing schema need no migration.
+func Migrate(ctx context.Context, db *sql.DB, opts Options) error {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return err
+	}
+	columns := fmt.Sprintf("%s VARCHAR(255) NOT NULL PRIMARY KEY, %s VARCHAR(255) NOT NULL",
+		opts.UsernameColumn, opts.HashColumn)
+	if opts.MailboxColumn != "-" {
+		columns += fmt.Sprintf(", %s VARCHAR(255)", opts.MailboxColumn)
+	}
+	for _, c := range opts.idColumns() {
+		columns += fmt.Sprintf(", %s INTEGER", c)
+	}
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", opts.Table, columns)
+	if _, err := db.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("create table %s: %w", opts.Table, err)
+	}
+	return nil
+}
+
+// ImportPasswd copies the entries of a passwd file (or shard directory)
+// into the table, keeping their argon2id hashes and, where the table has
+// the columns, their uids and gids, and returns the number of
+// rows inserted. Users already in the table are left unchanged, so an
+// import can be re-run after adding users to the passwd file.
+func ImportPasswd(ctx context.Context, db *sql.DB, opts Options, passwdPath string) (int, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return 0, err
+	}
+	users, err := passwd.ListUsers(passwdPath)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("begin import: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	stmt, err := tx.PrepareContext(ctx, opts.insertIgnore())
+	if err != nil {
+		return 0, fmt.Errorf("prepare import: %w", err)
+	}
+	defer func() { _ = stmt.Close() }()
+
+	imported := 0
+	for _, u := range users {
+		args := []any{u.Username, u.Hash}
+		if opts.MailboxColumn != "-" {
+			args = append(args, u.Mailbox)
+		}
+		if opts.UidColumn != "" {
+			args = append(args, int64(u.Uid))
+		}
+		if opts.GidColumn != "" {
+			args = append(args, int64(u.Gid))
+		}
+		res, err := stmt.ExecContext(ctx, args...)
+		if err != nil {
+			return 0, fmt.Errorf("import %s: %w", u.Username, err)
+		}
+		if n, err := res.RowsAffected(); err == nil {
+			imported += int(n)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit import: %w", err)
+	}
+	return imported, nil
+}
+
+// insertIgnore returns an INSERT that skips rows whose username exists.
+func (o Options) insertIgnore() string {
+	cols := []string{o.UsernameColumn, o.HashColumn}
+	if o.MailboxColumn != "-" {
+		cols = append(cols, o.MailboxColumn)
+	}
+	cols = append(cols, o.idColumns()...)
+	values := make([]string, len(cols))
+	for i := range cols {
+		values[i] = o.placeholder(i + 1)
+	}
+	columns := strings.Join(cols, ", ")
+	switch o.Dialect {
+	case DialectPostgres:
+		return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) DO NOTHING",
+			o.Table, columns, strings.Join(values, ", "), o.UsernameColumn)
+	case DialectMySQL:
+		return fmt.Sprintf("INSERT IGNORE INTO %s (%s) VALUES (%s)", o.Table, columns, strings.Join(values, ", "))
+	default:
+		return fmt.Sprintf("INSERT OR IGNORE INTO %s (%s) VALUES (%s)", o.Table, columns, strings.Join(values, ", "))
+	}
+}
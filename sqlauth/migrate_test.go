@@ -0,0 +1,84 @@
+package sqlauth
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/infodancer/auth/passwd"
+)
+
+func TestImportPasswd(t *testing.T) {
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	for _, name := range []string{"alice", "bob"} {
+		if err := passwd.AddUser(passwdPath, name, name+"-pw"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, _ := openFakeDB(t)
+	ctx := context.Background()
+	opts := Options{Table: "mail_users"}
+	if err := Migrate(ctx, db, opts); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if err := Migrate(ctx, db, opts); err != nil {
+		t.Fatalf("Migrate is not idempotent: %v", err)
+	}
+
+	n, err := ImportPasswd(ctx, db, opts, passwdPath)
+	if err != nil || n != 2 {
+		t.Fatalf("ImportPasswd = %d, %v; want 2", n, err)
+	}
+	// Re-running skips existing users.
+	if n, err := ImportPasswd(ctx, db, opts, passwdPath); err != nil || n != 0 {
+		t.Errorf("second ImportPasswd = %d, %v; want 0", n, err)
+	}
+
+	a, err := New(db, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = a.Close() }()
+	if _, err := a.Authenticate(ctx, "bob", "bob-pw"); err != nil {
+		t.Errorf("imported hash does not verify: %v", err)
+	}
+}
+
+func TestImportPasswd_UidGid(t *testing.T) {
+	passwdPath := filepath.Join(t.TempDir(), "passwd")
+	if err := passwd.AddUser(passwdPath, "alice", "alice-pw"); err != nil {
+		t.Fatal(err)
+	}
+	if err := passwd.SetProfile(passwdPath, "alice", passwd.Profile{Gid: 100}); err != nil {
+		t.Fatal(err)
+	}
+	users, err := passwd.ListUsers(passwdPath)
+	if err != nil || len(users) != 1 {
+		t.Fatalf("ListUsers = %v, %v", users, err)
+	}
+
+	db, _ := openFakeDB(t)
+	ctx := context.Background()
+	opts := Options{UidColumn: "uid", GidColumn: "gid"}
+	if err := Migrate(ctx, db, opts); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if n, err := ImportPasswd(ctx, db, opts, passwdPath); err != nil || n != 1 {
+		t.Fatalf("ImportPasswd = %d, %v; want 1", n, err)
+	}
+
+	a, err := New(db, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = a.Close() }()
+	session, err := a.Authenticate(ctx, "alice", "alice-pw")
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	defer session.Clear()
+	if session.User.Uid != users[0].Uid || session.User.Gid != 100 {
+		t.Errorf("uid, gid = %d, %d; want %d, 100", session.User.Uid, session.User.Gid, users[0].Uid)
+	}
+}
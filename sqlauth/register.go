@@ -0,0 +1,28 @@
+package sqlauth
+
+import (
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/errors"
+)
+
+func init() {
+	// CredentialBackend is the data source name; Options select the driver
+	// ("driver", required) and map the table ("dialect", "table",
+	// "username_column", "hash_column", "mailbox_column", "uid_column",
+	// "gid_column").
+	auth.RegisterAuthAgent("sql", func(config auth.AuthAgentConfig) (auth.AuthenticationAgent, error) {
+		driver := config.Options["driver"]
+		if driver == "" || config.CredentialBackend == "" {
+			return nil, errors.ErrAuthAgentConfigInvalid
+		}
+		return Open(driver, config.CredentialBackend, Options{
+			Dialect:        config.Options["dialect"],
+			Table:          config.Options["table"],
+			UsernameColumn: config.Options["username_column"],
+			HashColumn:     config.Options["hash_column"],
+			MailboxColumn:  config.Options["mailbox_column"],
+			UidColumn:      config.Options["uid_column"],
+			GidColumn:      config.Options["gid_column"],
+		})
+	})
+}
@@ -0,0 +1,229 @@
+package sqlauth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// SessionOptions maps a SessionStore onto a table. Zero values select the
+// defaults, which match the schema created by MigrateSessions.
+type SessionOptions struct {
+	// Dialect is DialectSQLite (default), DialectPostgres or DialectMySQL.
+	Dialect string
+
+	// Table holds one row per active session (default "sessions"), with
+	// columns id, username, issued, expires (Unix seconds) and operator.
+	Table string
+}
+
+// withDefaults fills in zero fields and validates the result.
+func (o SessionOptions) withDefaults() (SessionOptions, error) {
+	if o.Table == "" {
+		o.Table = "sessions"
+	}
+	opts, err := Options{Dialect: o.Dialect, Table: o.Table}.withDefaults()
+	if err != nil {
+		return o, err
+	}
+	o.Dialect = opts.Dialect
+	return o, nil
+}
+
+// MigrateSessions creates the session table described by opts if it does
+// not exist. It is idempotent and safe to run at every start.
+func MigrateSessions(ctx context.Context, db *sql.DB, opts SessionOptions) error {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id VARCHAR(64) NOT NULL PRIMARY KEY, "+
+		"username VARCHAR(255) NOT NULL, issued BIGINT NOT NULL, expires BIGINT NOT NULL, operator VARCHAR(255))", opts.Table)
+	if _, err := db.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("create table %s: %w", opts.Table, err)
+	}
+	return nil
+}
+
+// SessionStore keeps the sessions issued to users in a SQL table, so every
+// host sharing the database sees revocations at once. Revoked sessions are
+// deleted; expired ones stay until Prune. It implements auth.SessionStore
+// and is safe for concurrent use.
+type SessionStore struct {
+	db  *sql.DB
+	now func() time.Time
+
+	queries struct {
+		add, check, list, revoke, revokeAll, prune string
+	}
+
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt // prepared statements by query text
+}
+
+var _ auth.SessionStore = (*SessionStore)(nil)
+
+// NewSessionStore returns a store using db, which the caller keeps
+// ownership of.
+func NewSessionStore(db *sql.DB, opts SessionOptions) (*SessionStore, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	s := &SessionStore{db: db, now: time.Now, stmts: make(map[string]*sql.Stmt)}
+	p := Options{Dialect: opts.Dialect}.placeholder
+	s.queries.add = fmt.Sprintf("INSERT INTO %s (id, username, issued, expires, operator) VALUES (%s, %s, %s, %s, %s)",
+		opts.Table, p(1), p(2), p(3), p(4), p(5))
+	s.queries.check = fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id = %s AND username = %s AND expires > %s",
+		opts.Table, p(1), p(2), p(3))
+	s.queries.list = fmt.Sprintf("SELECT id, username, issued, expires, operator FROM %s WHERE username = %s AND expires > %s ORDER BY issued",
+		opts.Table, p(1), p(2))
+	s.queries.revoke = fmt.Sprintf("DELETE FROM %s WHERE id = %s AND username = %s AND expires > %s",
+		opts.Table, p(1), p(2), p(3))
+	s.queries.revokeAll = fmt.Sprintf("DELETE FROM %s WHERE username = %s AND expires > %s",
+		opts.Table, p(1), p(2))
+	s.queries.prune = fmt.Sprintf("DELETE FROM %s WHERE expires <= %s", opts.Table, p(1))
+	return s, nil
+}
+
+// AddSession registers info.
+func (s *SessionStore) AddSession(ctx context.Context, info auth.SessionInfo) error {
+	if info.ID == "" || info.Username == "" {
+		return fmt.Errorf("session needs an ID and a username")
+	}
+	if _, err := s.exec(ctx, s.queries.add, info.ID, info.Username, info.Issued.Unix(), info.Expires.Unix(), info.Operator); err != nil {
+		return fmt.Errorf("add session: %w", err)
+	}
+	return nil
+}
+
+// CheckSession returns nil if id is an active session of username, and
+// errors.ErrSessionRevoked if not.
+func (s *SessionStore) CheckSession(ctx context.Context, username, id string) error {
+	stmt, err := s.stmt(ctx, s.queries.check)
+	if err != nil {
+		return err
+	}
+	var n int
+	if err := stmt.QueryRowContext(ctx, id, username, s.now().Unix()).Scan(&n); err != nil {
+		return fmt.Errorf("check session: %w", err)
+	}
+	if n == 0 {
+		return autherrors.ErrSessionRevoked
+	}
+	return nil
+}
+
+// ListSessions returns username's active sessions, oldest first.
+func (s *SessionStore) ListSessions(ctx context.Context, username string) ([]auth.SessionInfo, error) {
+	stmt, err := s.stmt(ctx, s.queries.list)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.QueryContext(ctx, username, s.now().Unix())
+	if err != nil {
+		return nil, fmt.Errorf("list sessions: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+	var list []auth.SessionInfo
+	for rows.Next() {
+		var info auth.SessionInfo
+		var issued, expires int64
+		var operator sql.NullString
+		if err := rows.Scan(&info.ID, &info.Username, &issued, &expires, &operator); err != nil {
+			return nil, fmt.Errorf("list sessions: %w", err)
+		}
+		info.Issued, info.Expires = time.Unix(issued, 0).UTC(), time.Unix(expires, 0).UTC()
+		info.Operator = operator.String
+		list = append(list, info)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list sessions: %w", err)
+	}
+	return list, nil
+}
+
+// RevokeSession deletes username's session id. Returns
+// errors.ErrSessionNotFound if it is not active.
+func (s *SessionStore) RevokeSession(ctx context.Context, username, id string) error {
+	n, err := s.exec(ctx, s.queries.revoke, id, username, s.now().Unix())
+	if err != nil {
+		return fmt.Errorf("revoke session: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: %s", autherrors.ErrSessionNotFound, id)
+	}
+	return nil
+}
+
+// RevokeSessions deletes all of username's active sessions and returns how
+// many there were.
+func (s *SessionStore) RevokeSessions(ctx context.Context, username string) (int, error) {
+	n, err := s.exec(ctx, s.queries.revokeAll, username, s.now().Unix())
+	if err != nil {
+		return 0, fmt.Errorf("revoke sessions: %w", err)
+	}
+	return n, nil
+}
+
+// Prune deletes expired sessions and returns how many there were. Run it
+// periodically to keep the table small.
+func (s *SessionStore) Prune(ctx context.Context) (int, error) {
+	n, err := s.exec(ctx, s.queries.prune, s.now().Unix())
+	if err != nil {
+		return 0, fmt.Errorf("prune sessions: %w", err)
+	}
+	return n, nil
+}
+
+// exec runs query and returns the number of rows affected.
+func (s *SessionStore) exec(ctx context.Context, query string, args ...any) (int, error) {
+	stmt, err := s.stmt(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	res, err := stmt.ExecContext(ctx, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// stmt returns the prepared statement for query, preparing it on first use.
+func (s *SessionStore) stmt(ctx context.Context, query string) (*sql.Stmt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st, ok := s.stmts[query]; ok {
+		return st, nil
+	}
+	st, err := s.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("prepare query: %w", err)
+	}
+	s.stmts[query] = st
+	return st, nil
+}
+
+// Close releases the prepared statements. The database stays open.
+func (s *SessionStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for query, st := range s.stmts {
+		if err := st.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		delete(s.stmts, query)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,65 @@
+package sqlauth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+func TestSessionStore(t *testing.T) {
+	db, _ := openFakeDB(t)
+	ctx := context.Background()
+	if err := MigrateSessions(ctx, db, SessionOptions{}); err != nil {
+		t.Fatalf("MigrateSessions: %v", err)
+	}
+	s, err := NewSessionStore(db, SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.Close() }()
+	t0 := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	s.now = func() time.Time { return t0.Add(time.Hour) }
+
+	for i, id := range []string{"s2", "s1", "s3"} {
+		issued := t0.Add(time.Duration(2-i) * time.Minute)
+		if err := s.AddSession(ctx, auth.SessionInfo{ID: id, Username: "alice", Issued: issued, Expires: issued.Add(12 * time.Hour), Operator: "ops"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.AddSession(ctx, auth.SessionInfo{ID: "old", Username: "alice", Issued: t0, Expires: t0.Add(time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := s.ListSessions(ctx, "alice")
+	if err != nil || len(list) != 3 || list[0].ID != "s3" || list[2].ID != "s2" {
+		t.Fatalf("ListSessions = %+v, %v", list, err)
+	}
+	if !list[0].Issued.Equal(t0) || list[0].Operator != "ops" {
+		t.Errorf("ListSessions[0] = %+v", list[0])
+	}
+	if err := s.CheckSession(ctx, "alice", "s1"); err != nil {
+		t.Errorf("CheckSession(active) = %v", err)
+	}
+	if err := s.CheckSession(ctx, "alice", "old"); !errors.Is(err, autherrors.ErrSessionRevoked) {
+		t.Errorf("CheckSession(expired) = %v, want ErrSessionRevoked", err)
+	}
+	if err := s.RevokeSession(ctx, "alice", "s1"); err != nil {
+		t.Fatalf("RevokeSession: %v", err)
+	}
+	if err := s.CheckSession(ctx, "alice", "s1"); !errors.Is(err, autherrors.ErrSessionRevoked) {
+		t.Errorf("CheckSession(revoked) = %v, want ErrSessionRevoked", err)
+	}
+	if err := s.RevokeSession(ctx, "bob", "s2"); !errors.Is(err, autherrors.ErrSessionNotFound) {
+		t.Errorf("RevokeSession(other user) = %v, want ErrSessionNotFound", err)
+	}
+	if n, err := s.RevokeSessions(ctx, "alice"); err != nil || n != 2 {
+		t.Errorf("RevokeSessions = %d, %v; want 2", n, err)
+	}
+	if n, err := s.Prune(ctx); err != nil || n != 1 {
+		t.Errorf("Prune = %d, %v; want 1", n, err)
+	}
+}
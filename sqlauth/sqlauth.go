@@ -0,0 +1,294 @@
+// Package sqlauth provides an authentication agent backed by a SQL database
+// (SQLite, PostgreSQL or MySQL) through database/sql.
+//
+// Users live in one table with a username, a password hash and an optional
+// mailbox column; names are configurable with Options so an existing schema
+// can be used as is. Hashes are argon2id PHC strings as produced by
+// passwd.HashPassword, so credentials move between backends unchanged (see
+// ImportPasswd).
+//
+// This package does not import a SQL driver. The program registers one
+// (e.g. by blank-importing modernc.org/sqlite or github.com/lib/pq) and
+// either passes an open *sql.DB to New, or uses the "sql" agent type:
+//
+//	[auth]
+//	type = "sql"
+//	credential_backend = "file:/var/lib/mail/users.db"
+//
+//	[auth.options]
+//	driver = "sqlite"
+//	dialect = "sqlite"
+//	table = "mail_users"
+package sqlauth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/passwd"
+)
+
+// SQL dialects, selecting placeholder syntax and migration DDL.
+const (
+	DialectSQLite   = "sqlite"
+	DialectPostgres = "postgres"
+	DialectMySQL    = "mysql"
+)
+
+// Options maps the agent onto a table. Zero values select the defaults
+// shown, which match the schema created by Migrate.
+type Options struct {
+	// Dialect is DialectSQLite (default), DialectPostgres or DialectMySQL.
+	Dialect string
+
+	// Table holds one row per user (default "users").
+	Table string
+
+	// UsernameColumn, HashColumn and MailboxColumn name the columns
+	// (defaults "username", "password_hash", "mailbox"). Set MailboxColumn
+	// to "-" when the table has no mailbox column; the username is used.
+	UsernameColumn string
+	HashColumn     string
+	MailboxColumn  string
+
+	// UidColumn and GidColumn name optional integer columns holding the
+	// user's OS user and group ids. Empty, the default, means the table
+	// has none and sessions carry 0.
+	UidColumn string
+	GidColumn string
+}
+
+// identifier matches table and column names accepted in Options. Names are
+// interpolated into SQL, so nothing else is allowed.
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// withDefaults fills in zero fields and validates the result.
+func (o Options) withDefaults() (Options, error) {
+	if o.Dialect == "" {
+		o.Dialect = DialectSQLite
+	}
+	if o.Table == "" {
+		o.Table = "users"
+	}
+	if o.UsernameColumn == "" {
+		o.UsernameColumn = "username"
+	}
+	if o.HashColumn == "" {
+		o.HashColumn = "password_hash"
+	}
+	if o.MailboxColumn == "" {
+		o.MailboxColumn = "mailbox"
+	}
+
+	switch o.Dialect {
+	case DialectSQLite, DialectPostgres, DialectMySQL:
+	default:
+		return o, fmt.Errorf("%w: unknown SQL dialect %q", autherrors.ErrAuthAgentConfigInvalid, o.Dialect)
+	}
+	names := []string{o.Table, o.UsernameColumn, o.HashColumn}
+	if o.MailboxColumn != "-" {
+		names = append(names, o.MailboxColumn)
+	}
+	names = append(names, o.idColumns()...)
+	for _, name := range names {
+		if !identifier.MatchString(name) {
+			return o, fmt.Errorf("%w: invalid SQL identifier %q", autherrors.ErrAuthAgentConfigInvalid, name)
+		}
+	}
+	return o, nil
+}
+
+// idColumns returns the uid and gid columns that are set, in that order.
+func (o Options) idColumns() []string {
+	var cols []string
+	for _, c := range []string{o.UidColumn, o.GidColumn} {
+		if c != "" {
+			cols = append(cols, c)
+		}
+	}
+	return cols
+}
+
+// placeholder returns the n'th (1-based) bind parameter for the dialect.
+func (o Options) placeholder(n int) string {
+	if o.Dialect == DialectPostgres {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+// Agent authenticates users against a SQL table.
+// It is safe for concurrent use.
+type Agent struct {
+	db     *sql.DB
+	ownsDB bool
+	opts   Options
+
+	queries struct {
+		lookup, exists, list string
+	}
+
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt // prepared statements by query text
+}
+
+// Compile-time check: Agent must satisfy AuthenticationAgent and UserLister.
+var (
+	_ auth.AuthenticationAgent = (*Agent)(nil)
+	_ auth.UserLister          = (*Agent)(nil)
+)
+
+// New returns an agent using db, which the caller keeps ownership of.
+func New(db *sql.DB, opts Options) (*Agent, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	a := &Agent{db: db, opts: opts, stmts: make(map[string]*sql.Stmt)}
+
+	mailbox := opts.MailboxColumn
+	if mailbox == "-" {
+		mailbox = opts.UsernameColumn
+	}
+	a.queries.lookup = fmt.Sprintf("SELECT %s FROM %s WHERE %s = %s",
+		strings.Join(append([]string{opts.HashColumn, mailbox}, opts.idColumns()...), ", "),
+		opts.Table, opts.UsernameColumn, opts.placeholder(1))
+	a.queries.exists = fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s = %s",
+		opts.Table, opts.UsernameColumn, opts.placeholder(1))
+	a.queries.list = fmt.Sprintf("SELECT %s FROM %s ORDER BY %s",
+		opts.UsernameColumn, opts.Table, opts.UsernameColumn)
+	return a, nil
+}
+
+// Open opens a database with the named (already registered) driver and
+// returns an agent that closes it on Close.
+func Open(driverName, dsn string, opts Options) (*Agent, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open database: %w", err)
+	}
+	a, err := New(db, opts)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	a.ownsDB = true
+	return a, nil
+}
+
+// stmt returns the prepared statement for query, preparing it on first use.
+func (a *Agent) stmt(ctx context.Context, query string) (*sql.Stmt, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if s, ok := a.stmts[query]; ok {
+		return s, nil
+	}
+	s, err := a.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("prepare query: %w", err)
+	}
+	a.stmts[query] = s
+	return s, nil
+}
+
+// Authenticate validates credentials against the stored hash. Sessions
+// carry no keys: encryption keys are not stored in the database.
+func (a *Agent) Authenticate(ctx context.Context, username, password string) (*auth.AuthSession, error) {
+	s, err := a.stmt(ctx, a.queries.lookup)
+	if err != nil {
+		return nil, err
+	}
+	var hash, mailbox sql.NullString
+	var uid, gid sql.NullInt64
+	dest := []any{&hash, &mailbox}
+	if a.opts.UidColumn != "" {
+		dest = append(dest, &uid)
+	}
+	if a.opts.GidColumn != "" {
+		dest = append(dest, &gid)
+	}
+	if err := s.QueryRowContext(ctx, username).Scan(dest...); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, autherrors.ErrUserNotFound
+		}
+		return nil, fmt.Errorf("look up user: %w", err)
+	}
+	if !passwd.VerifyPassword(password, hash.String) {
+		return nil, autherrors.ErrAuthFailed
+	}
+	user := &auth.User{Username: username, Mailbox: mailbox.String, Uid: uint32(uid.Int64), Gid: uint32(gid.Int64)}
+	if user.Mailbox == "" {
+		user.Mailbox = username
+	}
+	return &auth.AuthSession{User: user}, nil
+}
+
+// UserExists reports whether the table has a row for username.
+func (a *Agent) UserExists(ctx context.Context, username string) (bool, error) {
+	s, err := a.stmt(ctx, a.queries.exists)
+	if err != nil {
+		return false, err
+	}
+	var n int
+	if err := s.QueryRowContext(ctx, username).Scan(&n); err != nil {
+		return false, fmt.Errorf("look up user: %w", err)
+	}
+	return n > 0, nil
+}
+
+// ListUsers returns every username in the table, sorted.
+// Implements auth.UserLister.
+func (a *Agent) ListUsers(ctx context.Context) ([]string, error) {
+	s, err := a.stmt(ctx, a.queries.list)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.QueryContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list users: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("list users: %w", err)
+		}
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list users: %w", err)
+	}
+	return names, nil
+}
+
+// Capabilities reports the optional interfaces the agent supports.
+// Implements auth.CapabilityReporter.
+func (a *Agent) Capabilities() auth.AgentCapabilities {
+	return auth.AgentCapabilities{UserLister: true}
+}
+
+// Close releases the prepared statements and, if the agent opened the
+// database itself, closes it.
+func (a *Agent) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var errs []error
+	for query, s := range a.stmts {
+		if err := s.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		delete(a.stmts, query)
+	}
+	if a.ownsDB {
+		errs = append(errs, a.db.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,122 @@
+package sqlauth
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/passwd"
+)
+
+func TestAgent_Authenticate(t *testing.T) {
+	db, _ := openFakeDB(t)
+	ctx := context.Background()
+	if err := Migrate(ctx, db, Options{}); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	hash, err := passwd.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "INSERT INTO users (username, password_hash, mailbox) VALUES (?, ?, ?)",
+		"alice", hash, "alice-box"); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New(db, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = a.Close() }()
+
+	session, err := a.Authenticate(ctx, "alice", "secret")
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if session.User.Mailbox != "alice-box" {
+		t.Errorf("Mailbox = %q, want alice-box", session.User.Mailbox)
+	}
+	if _, err := a.Authenticate(ctx, "alice", "wrong"); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("wrong password: got %v, want ErrAuthFailed", err)
+	}
+	if _, err := a.Authenticate(ctx, "nobody", "secret"); !errors.Is(err, autherrors.ErrUserNotFound) {
+		t.Errorf("unknown user: got %v, want ErrUserNotFound", err)
+	}
+
+	if ok, err := a.UserExists(ctx, "alice"); err != nil || !ok {
+		t.Errorf("UserExists(alice) = %v, %v", ok, err)
+	}
+	if ok, err := a.UserExists(ctx, "nobody"); err != nil || ok {
+		t.Errorf("UserExists(nobody) = %v, %v", ok, err)
+	}
+	if ul, ok := auth.AsUserLister(a); !ok {
+		t.Error("agent does not report UserLister")
+	} else if names, err := ul.ListUsers(ctx); err != nil || len(names) != 1 || names[0] != "alice" {
+		t.Errorf("ListUsers = %v, %v", names, err)
+	}
+}
+
+func TestAgent_CachesPreparedStatements(t *testing.T) {
+	db, fdb := openFakeDB(t)
+	ctx := context.Background()
+	if err := Migrate(ctx, db, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(db, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = a.Close() }()
+
+	before := fdb.prepares.Load()
+	for i := 0; i < 5; i++ {
+		if _, err := a.UserExists(ctx, "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := fdb.prepares.Load() - before; n != 1 {
+		t.Errorf("prepared %d times for 5 lookups, want 1", n)
+	}
+}
+
+func TestOptions_RejectsUnsafeIdentifiers(t *testing.T) {
+	for _, opts := range []Options{
+		{Table: "users; DROP TABLE users"},
+		{HashColumn: "hash--"},
+		{Dialect: "oracle"},
+	} {
+		if _, err := New(nil, opts); !errors.Is(err, autherrors.ErrAuthAgentConfigInvalid) {
+			t.Errorf("New(%+v): got %v, want ErrAuthAgentConfigInvalid", opts, err)
+		}
+	}
+}
+
+func TestOptions_PostgresPlaceholders(t *testing.T) {
+	a, err := New(nil, Options{Dialect: DialectPostgres, Table: "accounts", MailboxColumn: "-"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "SELECT password_hash, username FROM accounts WHERE username = $1"
+	if a.queries.lookup != want {
+		t.Errorf("lookup query = %q, want %q", a.queries.lookup, want)
+	}
+}
+
+func TestRegisteredAgentType(t *testing.T) {
+	openFakeDB(t)
+	agent, err := auth.OpenAuthAgent(auth.AuthAgentConfig{
+		Type:              "sql",
+		CredentialBackend: t.Name(),
+		Options:           map[string]string{"driver": "sqlauth-fake"},
+	})
+	if err != nil {
+		t.Fatalf("OpenAuthAgent: %v", err)
+	}
+	_ = agent.Close()
+
+	if _, err := auth.OpenAuthAgent(auth.AuthAgentConfig{Type: "sql", CredentialBackend: "x"}); !errors.Is(err, autherrors.ErrAuthAgentConfigInvalid) {
+		t.Errorf("missing driver: got %v, want ErrAuthAgentConfigInvalid", err)
+	}
+}
@@ -0,0 +1,324 @@
+// Package token mints and verifies session tokens: signed, expiring
+// statements that a user logged in, so webmail and the session manager can
+// reopen a user's session between connections without keeping the
+// password.
+//
+// A token is "st1." followed by the base64url claims (the user's profile,
+// an ID and the issue and expiry times) and a base64url signature over
+// everything before it. Tokens are signed with an HMAC-SHA256 key shared
+// by the issuer and the verifiers, or with an Ed25519 key whose public half
+// lets other hosts verify without being able to mint. A verifier accepts
+// only tokens signed with its own algorithm. Tokens carry no key material,
+// so sessions reopened from them have their private key locked.
+//
+// With a session store (see WithSessionStore) each token is also
+// registered as a session when minted and checked against the store when
+// verified, so it can be revoked before it expires. With an account checker
+// (see WithAccountChecker) a token also stops working once its account is
+// disabled or deleted or its domain frozen.
+package token
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// Prefix starts every session token, so daemons can tell one from a
+// password.
+const Prefix = "st1."
+
+// DefaultTTL is the lifetime of tokens minted by an Agent without WithTTL.
+const DefaultTTL = 12 * time.Hour
+
+// MinHMACKeySize is the shortest HMAC key NewHMAC accepts.
+const MinHMACKeySize = 32
+
+// maxTokenSize bounds the tokens Verify will decode.
+const maxTokenSize = 8 << 10
+
+// Signing algorithms, as recorded in the claims.
+const (
+	algHMAC    = "hs256"
+	algEd25519 = "ed25519"
+)
+
+// claims is the signed content of a token.
+type claims struct {
+	Alg         string            `json:"alg"`
+	ID          string            `json:"jti"`
+	Username    string            `json:"sub"`
+	Mailbox     string            `json:"mbx,omitempty"`
+	Uid         uint32            `json:"uid,omitempty"`
+	Gid         uint32            `json:"gid,omitempty"`
+	Quota       uint64            `json:"quota,omitempty"`
+	DisplayName string            `json:"name,omitempty"`
+	Attributes  map[string]string `json:"attrs,omitempty"`
+	Services    auth.ServiceSet   `json:"svc,omitempty"`
+	Operator    string            `json:"op,omitempty"`
+	Issued      int64             `json:"iat"`
+	Expires     int64             `json:"exp"`
+}
+
+// user returns the User c was issued for.
+func (c *claims) user() *auth.User {
+	return &auth.User{
+		Username:    c.Username,
+		Mailbox:     c.Mailbox,
+		Uid:         c.Uid,
+		Gid:         c.Gid,
+		Quota:       c.Quota,
+		DisplayName: c.DisplayName,
+		Attributes:  c.Attributes,
+		Services:    c.Services,
+	}
+}
+
+// account returns the name c's session is registered under in a session
+// store: the mailbox address if the user has one, since routers return
+// bare localparts as usernames, else the username.
+func (c *claims) account() string {
+	if strings.Contains(c.Mailbox, "@") {
+		return c.Mailbox
+	}
+	return c.Username
+}
+
+// Agent mints and verifies session tokens with one key. It implements
+// auth.AuthTokenAgent and is safe for concurrent use.
+type Agent struct {
+	alg      string
+	sign     func(msg []byte) []byte // nil: verify only
+	verify   func(msg, sig []byte) bool
+	ttl      time.Duration
+	now      func() time.Time
+	store    auth.SessionStore // nil: tokens cannot be revoked
+	accounts AccountChecker    // nil: account status is not checked
+}
+
+// AccountChecker reports whether an account may still use its sessions.
+// domain.AuthRouter implements it.
+type AccountChecker interface {
+	// CheckAccount returns nil if username may still log in, and else the
+	// error a login would fail with, such as errors.ErrAccountDisabled or
+	// errors.ErrUserNotFound.
+	CheckAccount(ctx context.Context, username string) error
+}
+
+var _ auth.AuthTokenAgent = (*Agent)(nil)
+
+// NewHMAC returns an Agent signing with HMAC-SHA256 under key, which must
+// be at least MinHMACKeySize random bytes and known only to the hosts that
+// mint or verify tokens.
+func NewHMAC(key []byte) (*Agent, error) {
+	if len(key) < MinHMACKeySize {
+		return nil, fmt.Errorf("%w: token key must be at least %d bytes", autherrors.ErrAuthAgentConfigInvalid, MinHMACKeySize)
+	}
+	key = append([]byte(nil), key...)
+	mac := func(msg []byte) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write(msg)
+		return h.Sum(nil)
+	}
+	return newAgent(algHMAC, mac, func(msg, sig []byte) bool {
+		return hmac.Equal(mac(msg), sig)
+	}), nil
+}
+
+// NewEd25519 returns an Agent signing with key. Hosts that only verify
+// should use NewEd25519Verifier with its public half.
+func NewEd25519(key ed25519.PrivateKey) (*Agent, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("%w: bad Ed25519 private key size %d", autherrors.ErrAuthAgentConfigInvalid, len(key))
+	}
+	pub := key.Public().(ed25519.PublicKey)
+	return newAgent(algEd25519, func(msg []byte) []byte {
+		return ed25519.Sign(key, msg)
+	}, func(msg, sig []byte) bool {
+		return ed25519.Verify(pub, msg, sig)
+	}), nil
+}
+
+// NewEd25519Verifier returns an Agent that verifies tokens signed with the
+// private half of pub. Its IssueToken fails.
+func NewEd25519Verifier(pub ed25519.PublicKey) (*Agent, error) {
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%w: bad Ed25519 public key size %d", autherrors.ErrAuthAgentConfigInvalid, len(pub))
+	}
+	return newAgent(algEd25519, nil, func(msg, sig []byte) bool {
+		return ed25519.Verify(pub, msg, sig)
+	}), nil
+}
+
+func newAgent(alg string, sign func([]byte) []byte, verify func(msg, sig []byte) bool) *Agent {
+	return &Agent{alg: alg, sign: sign, verify: verify, ttl: DefaultTTL, now: time.Now}
+}
+
+// WithTTL sets the lifetime of the tokens the agent mints (DefaultTTL if
+// zero). Returns the Agent to allow chaining.
+func (a *Agent) WithTTL(ttl time.Duration) *Agent {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	a.ttl = ttl
+	return a
+}
+
+// WithSessionStore registers every token the agent mints in store, under
+// the user's mailbox address or else their username, and makes
+// verification fail with errors.ErrSessionRevoked for tokens whose session
+// the store no longer holds. Hosts that only verify need the same store as
+// the issuer. Returns the Agent to allow chaining.
+func (a *Agent) WithSessionStore(store auth.SessionStore) *Agent {
+	a.store = store
+	return a
+}
+
+// WithAccountChecker makes verification ask accounts whether the user,
+// under their mailbox address or else their username, may still log in,
+// so tokens of accounts disabled, deleted or in a frozen domain since they
+// were minted fail with the error a login would. Returns the Agent to
+// allow chaining.
+func (a *Agent) WithAccountChecker(accounts AccountChecker) *Agent {
+	a.accounts = accounts
+	return a
+}
+
+// IssueToken returns a token for session's user, valid for the agent's
+// TTL. The operator of an impersonation session is kept in the token, so
+// sessions reopened from it stay marked as impersonated.
+func (a *Agent) IssueToken(ctx context.Context, session *auth.AuthSession) (string, error) {
+	if a.sign == nil {
+		return "", fmt.Errorf("%w: token agent has no signing key", autherrors.ErrAuthAgentConfigInvalid)
+	}
+	if session == nil || session.User == nil || session.User.Username == "" {
+		return "", fmt.Errorf("%w: session has no user", autherrors.ErrAuthFailed)
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("generate token id: %w", err)
+	}
+	u := session.User
+	now := a.now()
+	c := claims{
+		Alg:         a.alg,
+		ID:          hex.EncodeToString(id),
+		Username:    u.Username,
+		Mailbox:     u.Mailbox,
+		Uid:         u.Uid,
+		Gid:         u.Gid,
+		Quota:       u.Quota,
+		DisplayName: u.DisplayName,
+		Attributes:  maps.Clone(u.Attributes),
+		Services:    u.Services,
+		Operator:    session.Credential.Operator,
+		Issued:      now.Unix(),
+		Expires:     now.Add(a.ttl).Unix(),
+	}
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", fmt.Errorf("encode token: %w", err)
+	}
+	if a.store != nil {
+		err := a.store.AddSession(ctx, auth.SessionInfo{
+			ID:       c.ID,
+			Username: c.account(),
+			Issued:   time.Unix(c.Issued, 0),
+			Expires:  time.Unix(c.Expires, 0),
+			Operator: c.Operator,
+		})
+		if err != nil {
+			return "", fmt.Errorf("register session: %w", err)
+		}
+	}
+	signed := Prefix + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(a.sign([]byte(signed))), nil
+}
+
+// VerifyToken returns the user tok was issued for. Returns
+// errors.ErrTokenExpired once it has expired, errors.ErrSessionRevoked if
+// its session was revoked, the account checker's error if the account may
+// no longer log in, and errors.ErrAuthFailed if it is malformed,
+// signed with another key or algorithm, or not a session token at all.
+func (a *Agent) VerifyToken(ctx context.Context, tok string) (*auth.User, error) {
+	c, err := a.parse(ctx, tok)
+	if err != nil {
+		return nil, err
+	}
+	return c.user(), nil
+}
+
+// Session returns a session for the user tok was issued for, as
+// VerifyToken checks it. Its Credential is auth.CredentialSessionToken
+// with the token's ID, and its private key is locked.
+func (a *Agent) Session(ctx context.Context, tok string) (*auth.AuthSession, error) {
+	c, err := a.parse(ctx, tok)
+	if err != nil {
+		return nil, err
+	}
+	return &auth.AuthSession{
+		User: c.user(),
+		Credential: auth.Credential{
+			Kind:     auth.CredentialSessionToken,
+			ID:       c.ID,
+			Operator: c.Operator,
+		},
+	}, nil
+}
+
+// parse checks tok's signature, expiry and, with a store, revocation and,
+// with an account checker, the account's status, and returns its claims.
+func (a *Agent) parse(ctx context.Context, tok string) (*claims, error) {
+	invalid := func(why string) error {
+		return fmt.Errorf("%w: %s session token", autherrors.ErrAuthFailed, why)
+	}
+	if len(tok) > maxTokenSize || !strings.HasPrefix(tok, Prefix) {
+		return nil, invalid("not a")
+	}
+	dot := strings.LastIndexByte(tok, '.')
+	if dot < len(Prefix) {
+		return nil, invalid("malformed")
+	}
+	signed, sigPart := tok[:dot], tok[dot+1:]
+	sig, err := base64.RawURLEncoding.DecodeString(sigPart)
+	if err != nil || !a.verify([]byte(signed), sig) {
+		return nil, invalid("badly signed")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(signed[len(Prefix):])
+	if err != nil {
+		return nil, invalid("malformed")
+	}
+	var c claims
+	if err := json.Unmarshal(payload, &c); err != nil || c.Username == "" {
+		return nil, invalid("malformed")
+	}
+	if c.Alg != a.alg {
+		return nil, invalid("wrongly signed")
+	}
+	if !a.now().Before(time.Unix(c.Expires, 0)) {
+		return nil, fmt.Errorf("%w at %s", autherrors.ErrTokenExpired, time.Unix(c.Expires, 0).UTC().Format(time.RFC3339))
+	}
+	if a.store != nil {
+		if err := a.store.CheckSession(ctx, c.account(), c.ID); err != nil {
+			return nil, err
+		}
+	}
+	if a.accounts != nil {
+		if err := a.accounts.CheckAccount(ctx, c.account()); err != nil {
+			return nil, err
+		}
+	}
+	return &c, nil
+}
@@ -0,0 +1,229 @@
+package token
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/sessions"
+)
+
+func testSession() *auth.AuthSession {
+	return &auth.AuthSession{
+		User: &auth.User{
+			Username:    "alice@example.com",
+			Mailbox:     "alice",
+			Uid:         1001,
+			Gid:         100,
+			Quota:       1 << 30,
+			DisplayName: "Alice Smith",
+			Attributes:  map[string]string{"dept": "ops"},
+			Services:    auth.ServiceIMAP | auth.ServiceWebmail,
+		},
+		PrivateKey: []byte("secret key material"),
+	}
+}
+
+func TestAgent_RoundTrip(t *testing.T) {
+	hmacAgent, err := NewHMAC([]byte(strings.Repeat("k", MinHMACKeySize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edAgent, err := NewEd25519(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := NewEd25519Verifier(priv.Public().(ed25519.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name           string
+		minter, reader *Agent
+	}{
+		{"hmac", hmacAgent, hmacAgent},
+		{"ed25519", edAgent, edAgent},
+		{"ed25519 verifier", edAgent, verifier},
+	} {
+		tok, err := tc.minter.IssueToken(t.Context(), testSession())
+		if err != nil {
+			t.Fatalf("%s: IssueToken: %v", tc.name, err)
+		}
+		if !strings.HasPrefix(tok, Prefix) || strings.Contains(tok, "secret") {
+			t.Errorf("%s: token = %q", tc.name, tok)
+		}
+		u, err := tc.reader.VerifyToken(t.Context(), tok)
+		if err != nil {
+			t.Fatalf("%s: VerifyToken: %v", tc.name, err)
+		}
+		want := testSession().User
+		if u.Username != want.Username || u.Mailbox != want.Mailbox || u.Uid != want.Uid || u.Gid != want.Gid ||
+			u.Quota != want.Quota || u.DisplayName != want.DisplayName || u.Attributes["dept"] != "ops" || u.Services != want.Services {
+			t.Errorf("%s: user = %+v", tc.name, u)
+		}
+	}
+
+	if _, err := verifier.IssueToken(t.Context(), testSession()); !errors.Is(err, autherrors.ErrAuthAgentConfigInvalid) {
+		t.Errorf("verifier IssueToken err = %v", err)
+	}
+}
+
+func TestAgent_Session(t *testing.T) {
+	a, err := NewHMAC([]byte(strings.Repeat("k", MinHMACKeySize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := testSession()
+	session.Credential = auth.Credential{Kind: auth.CredentialImpersonation, ID: "imp", Operator: "bob"}
+	tok, err := a.IssueToken(t.Context(), session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := a.Session(t.Context(), tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Credential.Kind != auth.CredentialSessionToken || s.Credential.ID == "" || s.Credential.Operator != "bob" {
+		t.Errorf("credential = %+v", s.Credential)
+	}
+	if s.KeysUnlocked() || s.User.Username != "alice@example.com" {
+		t.Errorf("session = %+v", s)
+	}
+}
+
+func TestAgent_Reject(t *testing.T) {
+	key := []byte(strings.Repeat("k", MinHMACKeySize))
+	a, err := NewHMAC(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	a.now = func() time.Time { return now }
+	a.WithTTL(time.Hour)
+	tok, err := a.IssueToken(t.Context(), testSession())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, _ := NewHMAC([]byte(strings.Repeat("x", MinHMACKeySize)))
+	_, priv, _ := ed25519.GenerateKey(nil)
+	ed, _ := NewEd25519(priv)
+	edTok, _ := ed.IssueToken(t.Context(), testSession())
+	dot := strings.LastIndexByte(tok, '.')
+
+	for _, tc := range []struct {
+		name   string
+		reader *Agent
+		tok    string
+	}{
+		{"other key", other, tok},
+		{"other algorithm", a, edTok},
+		{"password", a, "hunter2"},
+		{"truncated", a, tok[:dot]},
+		{"tampered", a, tok[:dot-2] + "AA" + tok[dot:]},
+		{"bad signature", a, tok[:dot+1] + "AAAA"},
+		{"oversized", a, Prefix + strings.Repeat("A", maxTokenSize)},
+	} {
+		_, err := tc.reader.VerifyToken(t.Context(), tc.tok)
+		if !errors.Is(err, autherrors.ErrAuthFailed) || errors.Is(err, autherrors.ErrTokenExpired) {
+			t.Errorf("%s: err = %v, want ErrAuthFailed", tc.name, err)
+		}
+	}
+
+	now = now.Add(time.Hour)
+	if _, err := a.VerifyToken(t.Context(), tok); !errors.Is(err, autherrors.ErrTokenExpired) || !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("expired: err = %v, want ErrTokenExpired", err)
+	}
+
+	if _, err := NewHMAC(key[:MinHMACKeySize-1]); !errors.Is(err, autherrors.ErrAuthAgentConfigInvalid) {
+		t.Errorf("short key: err = %v", err)
+	}
+	if _, err := a.IssueToken(t.Context(), &auth.AuthSession{}); err == nil {
+		t.Error("IssueToken without a user succeeded")
+	}
+}
+
+func TestAgent_SessionStore(t *testing.T) {
+	store := sessions.Open(t.TempDir())
+	a, err := NewHMAC([]byte(strings.Repeat("k", MinHMACKeySize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.WithSessionStore(store)
+	first, err := a.IssueToken(t.Context(), testSession())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := a.IssueToken(t.Context(), testSession())
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := store.ListSessions(t.Context(), "alice@example.com")
+	if err != nil || len(list) != 2 {
+		t.Fatalf("ListSessions = %+v, %v", list, err)
+	}
+
+	s, err := a.Session(t.Context(), first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RevokeSession(t.Context(), "alice@example.com", s.Credential.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.VerifyToken(t.Context(), first); !errors.Is(err, autherrors.ErrSessionRevoked) || !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("revoked: err = %v, want ErrSessionRevoked", err)
+	}
+	if _, err := a.VerifyToken(t.Context(), second); err != nil {
+		t.Errorf("other session: %v", err)
+	}
+}
+
+// checkerFunc adapts a function to AccountChecker.
+type checkerFunc func(ctx context.Context, username string) error
+
+func (f checkerFunc) CheckAccount(ctx context.Context, username string) error {
+	return f(ctx, username)
+}
+
+func TestAgent_AccountChecker(t *testing.T) {
+	a, err := NewHMAC([]byte(strings.Repeat("k", MinHMACKeySize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := a.IssueToken(t.Context(), testSession())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var status error
+	var checked string
+	a.WithAccountChecker(checkerFunc(func(_ context.Context, username string) error {
+		checked = username
+		return status
+	}))
+	if _, err := a.VerifyToken(t.Context(), tok); err != nil || checked != "alice@example.com" {
+		t.Fatalf("good standing: err = %v, checked %q", err, checked)
+	}
+	for _, status = range []error{
+		autherrors.ErrAccountDisabled,
+		autherrors.ErrDomainFrozen,
+		autherrors.ErrUserNotFound,
+	} {
+		if _, err := a.VerifyToken(t.Context(), tok); !errors.Is(err, status) {
+			t.Errorf("VerifyToken err = %v, want %v", err, status)
+		}
+		if _, err := a.Session(t.Context(), tok); !errors.Is(err, status) {
+			t.Errorf("Session err = %v, want %v", err, status)
+		}
+	}
+}
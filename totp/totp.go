@@ -0,0 +1,138 @@
+// Package totp implements time-based one-time passwords (RFC 6238) with the
+// parameters every authenticator app supports: HMAC-SHA1, six digits and a
+// 30-second period.
+//
+// Enrollment generates a secret and shows it to the user as a QR code of
+// URI; login then checks the app's current code with Verify:
+//
+//	secret, _ := totp.GenerateSecret()
+//	uri := totp.URI("Example Mail", "alice@example.com", secret)
+//	...
+//	step, ok := totp.Verify(secret, code, time.Now(), totp.DefaultSkew)
+//
+// Verify returns the time step the code belongs to, so callers can refuse
+// to accept the same code twice.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Period is the lifetime of a code.
+	Period = 30 * time.Second
+
+	// Digits is the length of a code.
+	Digits = 6
+
+	// SecretSize is the size of secrets from GenerateSecret (160 bits, as
+	// RFC 4226 recommends for HMAC-SHA1).
+	SecretSize = 20
+
+	// DefaultSkew is the number of periods before and after the current one
+	// whose codes Verify accepts, allowing for clock drift and typing time.
+	DefaultSkew = 1
+)
+
+// encoding is the base32 alphabet authenticator apps expect, unpadded.
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random secret.
+func GenerateSecret() ([]byte, error) {
+	secret := make([]byte, SecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("generate totp secret: %w", err)
+	}
+	return secret, nil
+}
+
+// EncodeSecret returns secret in the base32 form users type into an
+// authenticator app.
+func EncodeSecret(secret []byte) string {
+	return encoding.EncodeToString(secret)
+}
+
+// DecodeSecret parses a base32 secret as written by EncodeSecret, ignoring
+// case, spaces and padding.
+func DecodeSecret(s string) ([]byte, error) {
+	s = strings.ToUpper(strings.Join(strings.Fields(s), ""))
+	secret, err := encoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, fmt.Errorf("decode totp secret: %w", err)
+	}
+	return secret, nil
+}
+
+// URI returns the otpauth:// URI that provisions secret in an
+// authenticator app, usually shown as a QR code. issuer names the service
+// and account the user.
+func URI(issuer, account string, secret []byte) string {
+	q := url.Values{}
+	q.Set("secret", EncodeSecret(secret))
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(Digits))
+	q.Set("period", fmt.Sprint(int(Period/time.Second)))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
+
+// Step returns the time step t falls in.
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Code returns the code for secret at time t.
+func Code(secret []byte, t time.Time) string {
+	return codeAt(secret, Step(t), Digits)
+}
+
+// Verify reports whether code is valid for secret at time t, accepting the
+// codes of skew periods either side of t's. On success it returns the time
+// step that matched; callers that record it can reject replays by refusing
+// steps not after the last one used. Every candidate is compared in
+// constant time.
+func Verify(secret []byte, code string, t time.Time, skew int) (step int64, ok bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != Digits {
+		return 0, false
+	}
+	now := Step(t)
+	for s := now - int64(skew); s <= now+int64(skew); s++ {
+		if subtle.ConstantTimeCompare([]byte(codeAt(secret, s, Digits)), []byte(code)) == 1 && !ok {
+			step, ok = s, true
+		}
+	}
+	return step, ok
+}
+
+// codeAt computes the HOTP value (RFC 4226) of secret for counter.
+func codeAt(secret []byte, counter int64, digits int) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	mod := uint32(1)
+	for range digits {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
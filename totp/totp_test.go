@@ -0,0 +1,104 @@
+package totp
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 seed of the RFC 6238 appendix B test vectors.
+var rfcSecret = []byte("12345678901234567890")
+
+func TestCodeAt_RFC6238(t *testing.T) {
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		got := codeAt(rfcSecret, Step(time.Unix(tt.unix, 0)), 8)
+		if got != tt.want {
+			t.Errorf("codeAt(%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+		// Six-digit codes are the low digits of the eight-digit value.
+		if got := Code(rfcSecret, time.Unix(tt.unix, 0)); got != tt.want[2:] {
+			t.Errorf("Code(%d) = %s, want %s", tt.unix, got, tt.want[2:])
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	code := Code(rfcSecret, now)
+
+	step, ok := Verify(rfcSecret, code, now, DefaultSkew)
+	if !ok || step != Step(now) {
+		t.Errorf("Verify(current) = %d, %v", step, ok)
+	}
+	if _, ok := Verify(rfcSecret, " "+code+" ", now, DefaultSkew); !ok {
+		t.Error("surrounding space should be ignored")
+	}
+
+	prev := Code(rfcSecret, now.Add(-Period))
+	if step, ok := Verify(rfcSecret, prev, now, DefaultSkew); !ok || step != Step(now)-1 {
+		t.Errorf("Verify(previous) = %d, %v", step, ok)
+	}
+	if _, ok := Verify(rfcSecret, prev, now, 0); ok {
+		t.Error("previous code accepted without skew")
+	}
+	old := Code(rfcSecret, now.Add(-3*Period))
+	if _, ok := Verify(rfcSecret, old, now, DefaultSkew); ok {
+		t.Error("code three periods old accepted")
+	}
+
+	for _, bad := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, ok := Verify(rfcSecret, bad, now, DefaultSkew); ok {
+			t.Errorf("Verify(%q) accepted", bad)
+		}
+	}
+}
+
+func TestSecretEncoding(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret) != SecretSize {
+		t.Fatalf("secret is %d bytes", len(secret))
+	}
+	enc := EncodeSecret(secret)
+	if strings.Contains(enc, "=") {
+		t.Errorf("encoded secret is padded: %s", enc)
+	}
+	spaced := strings.ToLower(enc[:4] + " " + enc[4:])
+	got, err := DecodeSecret(spaced)
+	if err != nil || !bytes.Equal(got, secret) {
+		t.Errorf("DecodeSecret = %x, %v", got, err)
+	}
+	if _, err := DecodeSecret("not base32!"); err == nil {
+		t.Error("expected error for invalid secret")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Example Mail", "alice@example.com", rfcSecret)
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Example Mail:alice@example.com" {
+		t.Errorf("uri = %s", uri)
+	}
+	q := u.Query()
+	if q.Get("secret") != EncodeSecret(rfcSecret) || q.Get("issuer") != "Example Mail" || q.Get("digits") != "6" || q.Get("period") != "30" {
+		t.Errorf("query = %v", q)
+	}
+}
@@ -0,0 +1,109 @@
+// Package tracing instruments auth calls with spans, so operators can follow
+// a slow login from a daemon through the AuthRouter into the backend. It has
+// no dependencies: Tracer and Span follow the shape of the OpenTelemetry
+// trace API, and a program using OpenTelemetry installs a small adapter
+// with SetTracer (see the README for one). Until then every span is a no-op.
+//
+// Spans:
+//
+//	auth.Authenticate    AuthRouter logins (AuthenticateWithDomain and the methods built on it)
+//	auth.UserExists      AuthRouter lookups
+//	auth.LoadDomain      reading a domain's configuration
+//	auth.OpenAgent       opening a domain's auth backend on first use
+//	passwd.Authenticate  the passwd agent's credential check
+//
+// Attributes use the keys below; spans of failed calls record the error.
+package tracing
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Attribute keys set on auth spans.
+const (
+	AttrDomain    = "auth.domain"    // serving domain
+	AttrBackend   = "auth.backend"   // auth backend type, such as "passwd" or "chain"
+	AttrResult    = "auth.result"    // ResultSuccess or ResultFailure
+	AttrProtocol  = "auth.protocol"  // client protocol, such as "imap"
+	AttrMechanism = "auth.mechanism" // SASL mechanism, empty for a plaintext password
+	AttrExists    = "auth.exists"    // whether UserExists found the user
+)
+
+// Values of AttrResult.
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+// Attr is a span attribute, like OpenTelemetry's attribute.KeyValue. Value
+// is a string, bool or int.
+type Attr struct {
+	Key   string
+	Value any
+}
+
+// String returns a string attribute.
+func String(key, value string) Attr { return Attr{Key: key, Value: value} }
+
+// Bool returns a boolean attribute.
+func Bool(key string, value bool) Attr { return Attr{Key: key, Value: value} }
+
+// Int returns an integer attribute.
+func Int(key string, value int) Attr { return Attr{Key: key, Value: value} }
+
+// Span is a traced operation.
+type Span interface {
+	// SetAttributes adds attributes to the span.
+	SetAttributes(attrs ...Attr)
+
+	// RecordError records err as the reason the operation failed.
+	RecordError(err error)
+
+	// End completes the span.
+	End()
+}
+
+// Tracer starts spans.
+type Tracer interface {
+	// Start starts a span named name as a child of any span in ctx, and
+	// returns a context carrying the new span.
+	Start(ctx context.Context, name string, attrs ...Attr) (context.Context, Span)
+}
+
+// tracerHolder lets atomic.Value hold Tracers of different types.
+type tracerHolder struct{ t Tracer }
+
+var tracer atomic.Value // tracerHolder
+
+// SetTracer installs t for all auth spans of this process. nil turns
+// tracing off again.
+func SetTracer(t Tracer) {
+	tracer.Store(tracerHolder{t})
+}
+
+// Start starts a span with the installed Tracer, or returns ctx and a
+// no-op span when there is none.
+func Start(ctx context.Context, name string, attrs ...Attr) (context.Context, Span) {
+	if h, _ := tracer.Load().(tracerHolder); h.t != nil {
+		return h.t.Start(ctx, name, attrs...)
+	}
+	return ctx, noopSpan{}
+}
+
+// End sets span's AttrResult from err, records err if any, and ends span.
+func End(span Span, err error) {
+	if err != nil {
+		span.SetAttributes(String(AttrResult, ResultFailure))
+		span.RecordError(err)
+	} else {
+		span.SetAttributes(String(AttrResult, ResultSuccess))
+	}
+	span.End()
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(...Attr) {}
+func (noopSpan) RecordError(error)     {}
+func (noopSpan) End()                  {}
@@ -0,0 +1,66 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type testSpan struct {
+	name  string
+	attrs map[string]any
+	err   error
+	ended bool
+}
+
+func (s *testSpan) SetAttributes(attrs ...Attr) {
+	for _, a := range attrs {
+		s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *testSpan) RecordError(err error) { s.err = err }
+func (s *testSpan) End()                  { s.ended = true }
+
+type testTracer struct{ spans []*testSpan }
+
+func (t *testTracer) Start(ctx context.Context, name string, attrs ...Attr) (context.Context, Span) {
+	s := &testSpan{name: name, attrs: map[string]any{}}
+	s.SetAttributes(attrs...)
+	t.spans = append(t.spans, s)
+	return ctx, s
+}
+
+func TestStart(t *testing.T) {
+	// Without a tracer spans are no-ops.
+	ctx := context.Background()
+	if got, span := Start(ctx, "x"); got != ctx || span == nil {
+		t.Fatalf("Start without tracer = %v, %v", got, span)
+	}
+
+	tr := &testTracer{}
+	SetTracer(tr)
+	defer SetTracer(nil)
+	_, span := Start(ctx, "auth.Authenticate", String(AttrDomain, "example.com"))
+	End(span, nil)
+	_, span = Start(ctx, "passwd.Authenticate")
+	failure := errors.New("authentication failed")
+	End(span, failure)
+
+	if len(tr.spans) != 2 {
+		t.Fatalf("spans = %+v", tr.spans)
+	}
+	ok, failed := tr.spans[0], tr.spans[1]
+	if !ok.ended || ok.attrs[AttrDomain] != "example.com" || ok.attrs[AttrResult] != ResultSuccess || ok.err != nil {
+		t.Errorf("successful span = %+v", ok)
+	}
+	if !failed.ended || failed.attrs[AttrResult] != ResultFailure || failed.err != failure {
+		t.Errorf("failed span = %+v", failed)
+	}
+
+	SetTracer(nil)
+	Start(ctx, "after")
+	if len(tr.spans) != 2 {
+		t.Error("span started after SetTracer(nil)")
+	}
+}
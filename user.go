@@ -7,6 +7,30 @@ type User struct {
 
 	// Mailbox is the path or identifier for the user's mailbox.
 	Mailbox string
+
+	// Uid is the user's numeric id, 0 when the backend assigns none. A
+	// session manager setuids to it after login instead of re-reading the
+	// backend.
+	Uid uint32
+
+	// Gid is the user's numeric group id, 0 when the backend assigns none.
+	// The domain router fills in the domain's gid when it is 0.
+	Gid uint32
+
+	// Quota is the user's mailbox quota in bytes, 0 for no limit.
+	Quota uint64
+
+	// DisplayName is the user's full name, empty if the backend has none.
+	DisplayName string
+
+	// Attributes holds site-specific key=value attributes the backend
+	// stores for the user; nil if there are none.
+	Attributes map[string]string
+
+	// Services is the set of services the user may log in to; the zero
+	// set places no restriction. The domain router refuses logins on other
+	// protocols.
+	Services ServiceSet
 }
 
 // AuthSession represents an authenticated user with access to keys.
@@ -16,7 +40,10 @@ type AuthSession struct {
 	User *User
 
 	// PrivateKey is the decrypted private key for this session.
-	// nil if encryption is not enabled for this user.
+	// nil if encryption is not enabled for this user, if the session was
+	// opened with an app password that does not unlock the key, or if the
+	// key has a separate passphrase the login did not supply (see
+	// WithKeyPassphrase).
 	// This key is held in memory only during the session and should be
 	// zeroed when the session ends.
 	PrivateKey []byte
@@ -25,8 +52,120 @@ type AuthSession struct {
 	// nil if encryption is not enabled for this user.
 	PublicKey []byte
 
+	// RetiredKeys are the key pairs the user's key replaced in earlier
+	// rotations, newest first, so mail encrypted to them stays readable.
+	// They are unlocked with PrivateKey, and nil while it is locked or the
+	// key was never rotated. Zeroed by Clear like PrivateKey.
+	RetiredKeys []KeyPair
+
 	// EncryptionEnabled indicates whether encryption is enabled for this user.
 	EncryptionEnabled bool
+
+	// Credential records which credential opened the session, so callers
+	// can scope what an app password may do. The zero value is the
+	// account password.
+	Credential Credential
+
+	// PasswordExpired is set when the login used the account password and
+	// it is older than the agent's maximum password age. The login still
+	// succeeds; interactive callers (webmail, IMAP with a change command)
+	// should make the user change it before going on.
+	PasswordExpired bool
+
+	// ServerResponse is the final server message of the login's SASL
+	// mechanism, which the daemon sends before reporting success, such as
+	// DIGEST-MD5's rspauth. nil for mechanisms without one.
+	ServerResponse []byte
+}
+
+// CredentialKind identifies the kind of credential that opened a session.
+type CredentialKind int
+
+const (
+	// CredentialPassword is the account's main password.
+	CredentialPassword CredentialKind = iota
+
+	// CredentialAppPassword is an application-specific password.
+	CredentialAppPassword
+
+	// CredentialCertificate is a TLS client certificate (SASL EXTERNAL).
+	CredentialCertificate
+
+	// CredentialImpersonation is an operator's impersonation token (see
+	// domain.AuthRouter.AuthenticateToken).
+	CredentialImpersonation
+
+	// CredentialBearerToken is an OAuth 2.0 access token (SASL XOAUTH2 and
+	// OAUTHBEARER).
+	CredentialBearerToken
+
+	// CredentialKerberos is a Kerberos ticket (SASL GSSAPI, see the
+	// krb5auth package).
+	CredentialKerberos
+
+	// CredentialSessionToken is a session token minted after an earlier
+	// login (see AuthTokenAgent).
+	CredentialSessionToken
+)
+
+// String returns "password", "app_password", "certificate",
+// "impersonation", "bearer_token", "kerberos" or "session_token".
+func (k CredentialKind) String() string {
+	switch k {
+	case CredentialAppPassword:
+		return "app_password"
+	case CredentialCertificate:
+		return "certificate"
+	case CredentialImpersonation:
+		return "impersonation"
+	case CredentialBearerToken:
+		return "bearer_token"
+	case CredentialKerberos:
+		return "kerberos"
+	case CredentialSessionToken:
+		return "session_token"
+	}
+	return "password"
+}
+
+// Credential describes the credential that opened a session.
+type Credential struct {
+	// Kind is the kind of credential.
+	Kind CredentialKind
+
+	// ID identifies an app password (for revocation), a certificate by
+	// its SHA-256 fingerprint, an impersonation or session token, a bearer
+	// token's subject, or a Kerberos principal; empty for the main
+	// password.
+	ID string
+
+	// Label is the app password's user-chosen label, such as "Phone".
+	Label string
+
+	// Operator is the operator acting as the user with an impersonation
+	// token, empty for the user's own credentials.
+	Operator string
+}
+
+// KeysUnlocked reports whether the session holds the decrypted private
+// key. It is false for sessions with EncryptionEnabled whose key stayed
+// locked (see PrivateKey), and after Clear.
+func (s *AuthSession) KeysUnlocked() bool {
+	return s.PrivateKey != nil
+}
+
+// PrivateKeys returns every private key the session holds, the current
+// one first and then the retired ones, for decrypting mail that may
+// predate a key rotation. It is empty while the key is locked.
+func (s *AuthSession) PrivateKeys() [][]byte {
+	if s.PrivateKey == nil {
+		return nil
+	}
+	keys := [][]byte{s.PrivateKey}
+	for _, k := range s.RetiredKeys {
+		keys = append(keys, k.PrivateKey)
+	}
+	return keys
 }
 
 // Clear zeros out sensitive key material in the session.
@@ -38,4 +177,8 @@ func (s *AuthSession) Clear() {
 		}
 		s.PrivateKey = nil
 	}
+	for _, k := range s.RetiredKeys {
+		clear(k.PrivateKey)
+	}
+	s.RetiredKeys = nil
 }
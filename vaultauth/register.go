@@ -0,0 +1,69 @@
+package vaultauth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/infodancer/auth"
+	"github.com/infodancer/auth/errors"
+)
+
+func init() {
+	// CredentialBackend is the Vault address. Options: "mount", "prefix",
+	// "kv_version", "namespace", "timeout" and "cache_ttl" (Go durations),
+	// "ca_file", a PEM bundle of CAs to trust for the server, and
+	// "token_file", a file holding the token; without it the token comes
+	// from the VAULT_TOKEN environment variable.
+	auth.RegisterAuthAgent("vault", func(config auth.AuthAgentConfig) (auth.AuthenticationAgent, error) {
+		vopts := VaultOptions{
+			Address:   config.CredentialBackend,
+			Mount:     config.Options["mount"],
+			Prefix:    config.Options["prefix"],
+			Namespace: config.Options["namespace"],
+			TokenFile: config.Options["token_file"],
+		}
+		if vopts.TokenFile == "" {
+			vopts.Token = os.Getenv("VAULT_TOKEN")
+		}
+		var opts Options
+		var err error
+		if v := config.Options["kv_version"]; v != "" {
+			if vopts.KVVersion, err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("%w: kv_version: %v", errors.ErrAuthAgentConfigInvalid, err)
+			}
+		}
+		if v := config.Options["timeout"]; v != "" {
+			if vopts.Timeout, err = time.ParseDuration(v); err != nil {
+				return nil, fmt.Errorf("%w: timeout: %v", errors.ErrAuthAgentConfigInvalid, err)
+			}
+		}
+		if v := config.Options["cache_ttl"]; v != "" {
+			if opts.CacheTTL, err = time.ParseDuration(v); err != nil {
+				return nil, fmt.Errorf("%w: cache_ttl: %v", errors.ErrAuthAgentConfigInvalid, err)
+			}
+		}
+		if path := config.Options["ca_file"]; path != "" {
+			pem, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("read CA file: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("%w: ca_file: no certificates", errors.ErrAuthAgentConfigInvalid)
+			}
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+			vopts.Client = &http.Client{Transport: transport}
+		}
+		store, err := NewVault(vopts)
+		if err != nil {
+			return nil, err
+		}
+		return New(store, opts), nil
+	})
+}
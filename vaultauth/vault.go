@@ -0,0 +1,296 @@
+package vaultauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// Defaults for VaultOptions.
+const (
+	DefaultMount   = "secret"
+	DefaultTimeout = 5 * time.Second
+)
+
+// renewRetry is how long a failed renewal waits before the next attempt,
+// and how often a token file is re-read for a token that cannot be renewed.
+var renewRetry = 30 * time.Second
+
+// maxVaultResponse bounds how much of a response body is read.
+const maxVaultResponse = 1 << 20
+
+// VaultOptions configures a Vault store.
+type VaultOptions struct {
+	// Address is the Vault server URL, e.g. "https://vault.example.com:8200".
+	Address string
+
+	// Mount is the path of the KV secrets engine (default DefaultMount).
+	Mount string
+
+	// Prefix is the path below the mount holding the user secrets, e.g.
+	// "mail/example.com"; empty for the mount's root.
+	Prefix string
+
+	// KVVersion is 1 or 2 (default 2), the version of the KV engine.
+	KVVersion int
+
+	// Token authenticates to Vault. When TokenFile is set it is read from
+	// there instead, and read again when renewal fails, so a token kept
+	// fresh by Vault Agent is picked up.
+	Token     string
+	TokenFile string
+
+	// Namespace is the Vault Enterprise namespace, if any.
+	Namespace string
+
+	// Timeout bounds each request (default DefaultTimeout).
+	Timeout time.Duration
+
+	// Client is the HTTP client to use, e.g. one trusting a private CA.
+	Client *http.Client
+}
+
+// Vault is a SecretStore reading Vault's KV secrets engine. A renewable
+// token is renewed in the background at half its TTL until Close.
+type Vault struct {
+	base   *url.URL
+	opts   VaultOptions
+	client *http.Client
+
+	mu    sync.Mutex
+	token string
+
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+// Compile-time check: Vault must satisfy SecretStore.
+var _ SecretStore = (*Vault)(nil)
+
+// NewVault returns a store for the Vault server at opts.Address and starts
+// renewing its token.
+func NewVault(opts VaultOptions) (*Vault, error) {
+	base, err := url.Parse(opts.Address)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("%w: vaultauth: invalid address %q", autherrors.ErrAuthAgentConfigInvalid, opts.Address)
+	}
+	if opts.Mount == "" {
+		opts.Mount = DefaultMount
+	}
+	opts.Mount = strings.Trim(opts.Mount, "/")
+	opts.Prefix = strings.Trim(opts.Prefix, "/")
+	switch opts.KVVersion {
+	case 0:
+		opts.KVVersion = 2
+	case 1, 2:
+	default:
+		return nil, fmt.Errorf("%w: vaultauth: unknown KV version %d", autherrors.ErrAuthAgentConfigInvalid, opts.KVVersion)
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	client := opts.Client
+	if client == nil {
+		client = &http.Client{}
+	}
+	v := &Vault{base: base, opts: opts, client: client, token: opts.Token, done: make(chan struct{})}
+	if opts.TokenFile != "" {
+		if err := v.loadToken(); err != nil {
+			return nil, err
+		}
+	}
+	if v.currentToken() == "" {
+		return nil, fmt.Errorf("%w: vaultauth: no token", autherrors.ErrAuthAgentConfigInvalid)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	v.stop = stop
+	go v.renewLoop(ctx)
+	return v, nil
+}
+
+// Read returns the string fields of the user secret name.
+func (v *Vault) Read(ctx context.Context, name string) (map[string]string, error) {
+	p := []string{"v1", v.opts.Mount}
+	if v.opts.KVVersion == 2 {
+		p = append(p, "data")
+	}
+	if v.opts.Prefix != "" {
+		p = append(p, v.opts.Prefix)
+	}
+	var resp struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := v.do(ctx, http.MethodGet, strings.Join(p, "/")+"/"+url.PathEscape(name), &resp); err != nil {
+		return nil, err
+	}
+	data := resp.Data
+	if v.opts.KVVersion == 2 {
+		var inner struct {
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(data, &inner); err != nil {
+			return nil, fmt.Errorf("decode vault secret: %w", err)
+		}
+		data = inner.Data
+	}
+	// A KV v2 secret whose latest version is deleted has null data.
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("decode vault secret: %w", err)
+	}
+	if raw == nil {
+		return nil, ErrSecretNotFound
+	}
+	fields := make(map[string]string, len(raw))
+	for k, val := range raw {
+		if s, ok := val.(string); ok {
+			fields[k] = s
+		}
+	}
+	return fields, nil
+}
+
+// Close stops token renewal and releases idle connections.
+func (v *Vault) Close() error {
+	v.stop()
+	<-v.done
+	v.client.CloseIdleConnections()
+	return nil
+}
+
+// tokenInfo is the part of a token lookup or renewal that renewal needs.
+type tokenInfo struct {
+	ttl       time.Duration
+	renewable bool
+}
+
+// renewLoop renews the token at half its TTL until ctx is done.
+func (v *Vault) renewLoop(ctx context.Context) {
+	defer close(v.done)
+	info, err := v.lookupSelf(ctx)
+	for {
+		var wait time.Duration
+		switch {
+		case err != nil:
+			wait = renewRetry
+		case info.renewable && info.ttl > 0:
+			wait = max(info.ttl/2, time.Second)
+		case v.opts.TokenFile != "":
+			wait = renewRetry
+		default:
+			return // never expires, or nothing can be done when it does
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		info, err = v.refresh(ctx, err == nil && info.renewable)
+	}
+}
+
+// refresh renews the token if renewable, and otherwise, or if that
+// fails, reads the token file again and looks the token up.
+func (v *Vault) refresh(ctx context.Context, renewable bool) (tokenInfo, error) {
+	if renewable {
+		info, err := v.renewSelf(ctx)
+		if err == nil || v.opts.TokenFile == "" {
+			return info, err
+		}
+	}
+	if v.opts.TokenFile != "" {
+		if err := v.loadToken(); err != nil {
+			return tokenInfo{}, err
+		}
+	}
+	return v.lookupSelf(ctx)
+}
+
+func (v *Vault) lookupSelf(ctx context.Context) (tokenInfo, error) {
+	var resp struct {
+		Data struct {
+			TTL       int64 `json:"ttl"`
+			Renewable bool  `json:"renewable"`
+		} `json:"data"`
+	}
+	if err := v.do(ctx, http.MethodGet, "v1/auth/token/lookup-self", &resp); err != nil {
+		return tokenInfo{}, err
+	}
+	return tokenInfo{ttl: time.Duration(resp.Data.TTL) * time.Second, renewable: resp.Data.Renewable}, nil
+}
+
+func (v *Vault) renewSelf(ctx context.Context) (tokenInfo, error) {
+	var resp struct {
+		Auth struct {
+			LeaseDuration int64 `json:"lease_duration"`
+			Renewable     bool  `json:"renewable"`
+		} `json:"auth"`
+	}
+	if err := v.do(ctx, http.MethodPost, "v1/auth/token/renew-self", &resp); err != nil {
+		return tokenInfo{}, err
+	}
+	return tokenInfo{ttl: time.Duration(resp.Auth.LeaseDuration) * time.Second, renewable: resp.Auth.Renewable}, nil
+}
+
+// loadToken reads the token from the token file.
+func (v *Vault) loadToken() error {
+	data, err := os.ReadFile(v.opts.TokenFile)
+	if err != nil {
+		return fmt.Errorf("read vault token file: %w", err)
+	}
+	v.mu.Lock()
+	v.token = strings.TrimSpace(string(data))
+	v.mu.Unlock()
+	return nil
+}
+
+func (v *Vault) currentToken() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.token
+}
+
+// do makes a request to path, below the server URL, and decodes a 200
+// response into out. A 404 is ErrSecretNotFound.
+func (v *Vault) do(ctx context.Context, method, path string, out any) error {
+	ctx, cancel := context.WithTimeout(ctx, v.opts.Timeout)
+	defer cancel()
+	u := v.base.JoinPath(path)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("build vault request: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", v.currentToken())
+	if v.opts.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.opts.Namespace)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault request: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body := io.LimitReader(resp.Body, maxVaultResponse)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := json.NewDecoder(body).Decode(out); err != nil {
+			return fmt.Errorf("decode vault response: %w", err)
+		}
+		return nil
+	case http.StatusNotFound:
+		_, _ = io.Copy(io.Discard, body)
+		return ErrSecretNotFound
+	default:
+		_, _ = io.Copy(io.Discard, body)
+		return fmt.Errorf("vault %s %s: status %d", method, u.Path, resp.StatusCode)
+	}
+}
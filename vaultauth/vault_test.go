@@ -0,0 +1,157 @@
+package vaultauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	autherrors "github.com/infodancer/auth/errors"
+)
+
+// fakeVault serves KV secrets under "secret" (v2) and "kv" (v1) for one
+// token, and the token lookup and renewal endpoints.
+type fakeVault struct {
+	mu       sync.Mutex
+	token    string
+	ttl      int64
+	renewals int
+	secrets  map[string]map[string]any // by path below the mount
+}
+
+func newFakeVault(t *testing.T) (*fakeVault, *httptest.Server) {
+	t.Helper()
+	fv := &fakeVault{token: "s.good", ttl: 3600, secrets: map[string]map[string]any{
+		"mail/alice": {"password_hash": "hash", "mailbox": "alice.box", "version": 3},
+	}}
+	srv := httptest.NewServer(fv)
+	t.Cleanup(srv.Close)
+	return fv, srv
+}
+
+func (fv *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fv.mu.Lock()
+	defer fv.mu.Unlock()
+	if r.Header.Get("X-Vault-Token") != fv.token {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var body any
+	switch p := r.URL.Path; {
+	case p == "/v1/auth/token/lookup-self":
+		body = map[string]any{"data": map[string]any{"ttl": fv.ttl, "renewable": true}}
+	case p == "/v1/auth/token/renew-self" && r.Method == http.MethodPost:
+		fv.renewals++
+		body = map[string]any{"auth": map[string]any{"lease_duration": fv.ttl, "renewable": true}}
+	case strings.HasPrefix(p, "/v1/secret/data/"):
+		data, ok := fv.secrets[strings.TrimPrefix(p, "/v1/secret/data/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body = map[string]any{"data": map[string]any{"data": data, "metadata": map[string]any{"version": 1}}}
+	case strings.HasPrefix(p, "/v1/kv/"):
+		data, ok := fv.secrets[strings.TrimPrefix(p, "/v1/kv/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body = map[string]any{"data": data}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func newVault(t *testing.T, opts VaultOptions) *Vault {
+	t.Helper()
+	v, err := NewVault(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = v.Close() })
+	return v
+}
+
+func TestVault_Read(t *testing.T) {
+	ctx := context.Background()
+	_, srv := newFakeVault(t)
+	for _, opts := range []VaultOptions{
+		{Address: srv.URL, Token: "s.good", Prefix: "/mail/"},
+		{Address: srv.URL, Token: "s.good", Prefix: "mail", Mount: "kv", KVVersion: 1},
+	} {
+		v := newVault(t, opts)
+		fields, err := v.Read(ctx, "alice")
+		if err != nil {
+			t.Fatalf("KV v%d: %v", v.opts.KVVersion, err)
+		}
+		if fields["password_hash"] != "hash" || fields["mailbox"] != "alice.box" {
+			t.Errorf("KV v%d: fields = %v", v.opts.KVVersion, fields)
+		}
+		if _, ok := fields["version"]; ok {
+			t.Errorf("KV v%d: non-string field kept", v.opts.KVVersion)
+		}
+		if _, err := v.Read(ctx, "bob"); !errors.Is(err, ErrSecretNotFound) {
+			t.Errorf("KV v%d: missing secret: err = %v, want ErrSecretNotFound", v.opts.KVVersion, err)
+		}
+	}
+
+	v := newVault(t, VaultOptions{Address: srv.URL, Token: "s.bad", Prefix: "mail"})
+	if _, err := v.Read(ctx, "alice"); err == nil || errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("bad token: err = %v, want a store error", err)
+	}
+}
+
+func TestVault_Refresh(t *testing.T) {
+	ctx := context.Background()
+	fv, srv := newFakeVault(t)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("s.good\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	v := newVault(t, VaultOptions{Address: srv.URL, TokenFile: tokenFile, Prefix: "mail"})
+
+	info, err := v.refresh(ctx, true)
+	if err != nil || !info.renewable || info.ttl.Hours() != 1 {
+		t.Fatalf("renew: %+v, %v", info, err)
+	}
+
+	// The old token expired and Vault Agent wrote a new one: renewal
+	// fails, and the token file is read again.
+	fv.mu.Lock()
+	renewals := fv.renewals
+	fv.token = "s.fresh"
+	fv.mu.Unlock()
+	if renewals != 1 {
+		t.Errorf("renewals = %d, want 1", renewals)
+	}
+	if err := os.WriteFile(tokenFile, []byte("s.fresh\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.refresh(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Read(ctx, "alice"); err != nil {
+		t.Errorf("read with the new token: %v", err)
+	}
+}
+
+func TestNewVault_Config(t *testing.T) {
+	for name, opts := range map[string]VaultOptions{
+		"no address": {Token: "s.good"},
+		"scheme":     {Address: "vault.example.com:8200", Token: "s.good"},
+		"no token":   {Address: "https://vault.example.com"},
+		"kv version": {Address: "https://vault.example.com", Token: "s.good", KVVersion: 3},
+	} {
+		if _, err := NewVault(opts); !errors.Is(err, autherrors.ErrAuthAgentConfigInvalid) {
+			t.Errorf("%s: err = %v, want ErrAuthAgentConfigInvalid", name, err)
+		}
+	}
+}
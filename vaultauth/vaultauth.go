@@ -0,0 +1,280 @@
+// Package vaultauth provides an authentication agent that reads per-user
+// credential records from a secret store, so password hashes and private
+// keys never live on the mail host's disk. Vault's KV secrets engine is the
+// store provided (see Vault); others plug in through SecretStore.
+//
+// Each user is one secret named by their localpart, with string fields:
+//
+//	password_hash  argon2id PHC string, as produced by passwd.HashPassword
+//	mailbox        optional; defaults to the username
+//	uid, gid       optional; the user's numeric OS user and group ids
+//	public_key     optional, base64
+//	private_key    optional, base64, sealed under the login password
+//	               (passwd.EncryptPrivateKey)
+//
+// Records are cached for a short time so a burst of logins does not hit the
+// store for each one. A wrong password against a cached record re-reads it
+// before failing, so a password changed in the store takes effect at once.
+// Store failures are errors.ErrBackendUnavailable, never a wrong password.
+package vaultauth
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/passwd"
+)
+
+// DefaultCacheTTL is how long records are cached when Options.CacheTTL is
+// zero.
+const DefaultCacheTTL = 30 * time.Second
+
+// maxCacheEntries bounds the record cache; past it expired entries are
+// dropped, and the whole cache if none are.
+const maxCacheEntries = 10000
+
+// ErrSecretNotFound is returned by a SecretStore for a secret that does
+// not exist.
+var ErrSecretNotFound = errors.New("secret not found")
+
+// SecretStore reads secrets by name.
+type SecretStore interface {
+	// Read returns the string fields of the named secret.
+	// Returns ErrSecretNotFound if it does not exist.
+	Read(ctx context.Context, name string) (map[string]string, error)
+
+	// Close releases the store's resources.
+	Close() error
+}
+
+// Record is a user's credential record.
+type Record struct {
+	PasswordHash string
+	Mailbox      string
+	Uid, Gid     uint32 // 0 when not set
+	PublicKey    []byte
+	PrivateKey   []byte // sealed, see passwd.EncryptPrivateKey
+}
+
+// parseRecord decodes the fields of a user's secret.
+func parseRecord(fields map[string]string) (*Record, error) {
+	rec := &Record{PasswordHash: fields["password_hash"], Mailbox: fields["mailbox"]}
+	if rec.PasswordHash == "" {
+		return nil, errors.New("record has no password_hash")
+	}
+	var err error
+	if rec.Uid, err = parseID(fields["uid"]); err != nil {
+		return nil, fmt.Errorf("uid: %w", err)
+	}
+	if rec.Gid, err = parseID(fields["gid"]); err != nil {
+		return nil, fmt.Errorf("gid: %w", err)
+	}
+	if v := fields["public_key"]; v != "" {
+		if rec.PublicKey, err = base64.StdEncoding.DecodeString(v); err != nil {
+			return nil, fmt.Errorf("public_key: %w", err)
+		}
+	}
+	if v := fields["private_key"]; v != "" {
+		if rec.PrivateKey, err = base64.StdEncoding.DecodeString(v); err != nil {
+			return nil, fmt.Errorf("private_key: %w", err)
+		}
+	}
+	return rec, nil
+}
+
+// parseID parses a uid or gid field; an empty one is 0.
+func parseID(v string) (uint32, error) {
+	if v == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(v, 10, 32)
+	return uint32(id), err
+}
+
+// Options configures an Agent.
+type Options struct {
+	// CacheTTL is how long a record, or its absence, is cached (default
+	// DefaultCacheTTL). Negative disables caching.
+	CacheTTL time.Duration
+}
+
+// cacheEntry is a cached lookup; rec is nil for a user that does not
+// exist.
+type cacheEntry struct {
+	rec     *Record
+	expires time.Time
+}
+
+// Agent authenticates users against records in a SecretStore.
+// It is safe for concurrent use.
+type Agent struct {
+	store SecretStore
+	ttl   time.Duration
+	now   func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+}
+
+// Compile-time check: Agent must satisfy AuthenticationAgent and KeyProvider.
+var (
+	_ auth.AuthenticationAgent = (*Agent)(nil)
+	_ auth.KeyProvider         = (*Agent)(nil)
+)
+
+// New returns an agent reading records from store. Close closes store.
+func New(store SecretStore, opts Options) *Agent {
+	if opts.CacheTTL == 0 {
+		opts.CacheTTL = DefaultCacheTTL
+	}
+	return &Agent{store: store, ttl: opts.CacheTTL, now: time.Now, cache: make(map[string]cacheEntry)}
+}
+
+// Authenticate verifies password against the user's record and unseals
+// their private key, if the record holds one.
+func (a *Agent) Authenticate(ctx context.Context, username, password string) (*auth.AuthSession, error) {
+	rec, cached, err := a.record(ctx, username, false)
+	if err != nil {
+		return nil, err
+	}
+	if !passwd.VerifyPassword(password, rec.PasswordHash) {
+		if !cached {
+			return nil, autherrors.ErrAuthFailed
+		}
+		if rec, _, err = a.record(ctx, username, true); err != nil {
+			return nil, err
+		}
+		if !passwd.VerifyPassword(password, rec.PasswordHash) {
+			return nil, autherrors.ErrAuthFailed
+		}
+	}
+
+	session := &auth.AuthSession{User: &auth.User{Username: username, Mailbox: rec.Mailbox, Uid: rec.Uid, Gid: rec.Gid}}
+	if session.User.Mailbox == "" {
+		session.User.Mailbox = username
+	}
+	if rec.PublicKey != nil {
+		session.PublicKey = rec.PublicKey
+		session.EncryptionEnabled = true
+	}
+	if rec.PrivateKey != nil {
+		if session.PrivateKey, err = passwd.DecryptPrivateKey(rec.PrivateKey, password); err != nil {
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+// UserExists reports whether the store holds a record for username.
+func (a *Agent) UserExists(ctx context.Context, username string) (bool, error) {
+	_, _, err := a.record(ctx, username, false)
+	if errors.Is(err, autherrors.ErrUserNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetPublicKey returns the public key from the user's record.
+func (a *Agent) GetPublicKey(ctx context.Context, username string) ([]byte, error) {
+	rec, _, err := a.record(ctx, username, false)
+	if err != nil {
+		return nil, err
+	}
+	if rec.PublicKey == nil {
+		return nil, autherrors.ErrKeyNotFound
+	}
+	return rec.PublicKey, nil
+}
+
+// GetPublicKeys returns the public keys from the users' records. Users
+// without a record or key are left out.
+func (a *Agent) GetPublicKeys(ctx context.Context, usernames []string) (map[string][]byte, error) {
+	return auth.GetPublicKeysOneByOne(ctx, a.GetPublicKey, usernames)
+}
+
+// HasEncryption reports whether the user's record holds a public key.
+func (a *Agent) HasEncryption(ctx context.Context, username string) (bool, error) {
+	rec, _, err := a.record(ctx, username, false)
+	if errors.Is(err, autherrors.ErrUserNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return rec.PublicKey != nil, nil
+}
+
+// Close closes the store.
+func (a *Agent) Close() error {
+	return a.store.Close()
+}
+
+// record returns username's record from the cache or, when absent,
+// expired or refresh is set, from the store. cached reports whether it
+// came from the cache. Returns errors.ErrUserNotFound for users without a
+// record and errors.ErrBackendUnavailable when the store fails.
+func (a *Agent) record(ctx context.Context, username string, refresh bool) (rec *Record, cached bool, err error) {
+	// Names are paths in most stores; a separator would reach other secrets.
+	if username == "" || strings.ContainsAny(username, "/\\") || username == "." || username == ".." {
+		return nil, false, autherrors.ErrUserNotFound
+	}
+	now := a.now()
+	if !refresh {
+		a.mu.Lock()
+		e, ok := a.cache[username]
+		a.mu.Unlock()
+		if ok && now.Before(e.expires) {
+			if e.rec == nil {
+				return nil, true, autherrors.ErrUserNotFound
+			}
+			return e.rec, true, nil
+		}
+	}
+
+	fields, err := a.store.Read(ctx, username)
+	switch {
+	case errors.Is(err, ErrSecretNotFound):
+	case err != nil:
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, false, ctxErr
+		}
+		return nil, false, fmt.Errorf("%w: secret store: %w", autherrors.ErrBackendUnavailable, err)
+	default:
+		if rec, err = parseRecord(fields); err != nil {
+			return nil, false, fmt.Errorf("%w: record for %s: %w", autherrors.ErrBackendUnavailable, username, err)
+		}
+	}
+	a.remember(username, rec, now)
+	if rec == nil {
+		return nil, false, autherrors.ErrUserNotFound
+	}
+	return rec, false, nil
+}
+
+// remember caches rec, nil for a missing user, as read at now.
+func (a *Agent) remember(username string, rec *Record, now time.Time) {
+	if a.ttl < 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.cache) >= maxCacheEntries {
+		for name, e := range a.cache {
+			if !now.Before(e.expires) {
+				delete(a.cache, name)
+			}
+		}
+		if len(a.cache) >= maxCacheEntries {
+			clear(a.cache)
+		}
+	}
+	a.cache[username] = cacheEntry{rec: rec, expires: now.Add(a.ttl)}
+}
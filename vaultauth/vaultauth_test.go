@@ -0,0 +1,179 @@
+package vaultauth
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/infodancer/auth"
+	autherrors "github.com/infodancer/auth/errors"
+	"github.com/infodancer/auth/passwd"
+)
+
+// mapStore is a SecretStore over a map; err, when set, fails every read.
+type mapStore struct {
+	mu      sync.Mutex
+	secrets map[string]map[string]string
+	reads   int
+	err     error
+}
+
+func (s *mapStore) Read(_ context.Context, name string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reads++
+	if s.err != nil {
+		return nil, s.err
+	}
+	fields, ok := s.secrets[name]
+	if !ok {
+		return nil, ErrSecretNotFound
+	}
+	return fields, nil
+}
+
+func (s *mapStore) Close() error { return nil }
+
+func (s *mapStore) set(name string, fields map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.secrets[name] = fields
+}
+
+var testParams = passwd.Argon2Params{Time: 1, Memory: 8 * 1024, Threads: 1}
+
+func hash(t *testing.T, password string) string {
+	t.Helper()
+	h, err := passwd.HashPasswordWithParams(password, testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestAgent_Authenticate(t *testing.T) {
+	ctx := context.Background()
+	priv := []byte("0123456789abcdef0123456789abcdef")
+	sealed, err := passwd.EncryptPrivateKey(priv, "wonderland")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &mapStore{secrets: map[string]map[string]string{
+		"alice": {
+			"password_hash": hash(t, "wonderland"),
+			"public_key":    base64.StdEncoding.EncodeToString([]byte("alice-pub")),
+			"private_key":   base64.StdEncoding.EncodeToString(sealed),
+		},
+		"bob":     {"password_hash": hash(t, "builder"), "mailbox": "robert", "uid": "1002", "gid": "100"},
+		"mallory": {"mailbox": "mallory"},
+	}}
+	a := New(store, Options{})
+
+	s, err := a.Authenticate(ctx, "alice", "wonderland")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.User.Mailbox != "alice" || !s.EncryptionEnabled || string(s.PublicKey) != "alice-pub" || !bytes.Equal(s.PrivateKey, priv) {
+		t.Errorf("alice: session = %+v", s)
+	}
+	if s, err := a.Authenticate(ctx, "bob", "builder"); err != nil || s.User.Mailbox != "robert" || s.User.Uid != 1002 || s.User.Gid != 100 || s.PrivateKey != nil {
+		t.Errorf("bob: session = %+v, %v", s, err)
+	}
+	if _, err := a.Authenticate(ctx, "alice", "looking-glass"); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("wrong password: err = %v, want ErrAuthFailed", err)
+	}
+	for _, name := range []string{"carol", "", "..", "mail/alice"} {
+		if _, err := a.Authenticate(ctx, name, "wonderland"); !errors.Is(err, autherrors.ErrUserNotFound) {
+			t.Errorf("%q: err = %v, want ErrUserNotFound", name, err)
+		}
+	}
+	if _, err := a.Authenticate(ctx, "mallory", "x"); !errors.Is(err, autherrors.ErrBackendUnavailable) {
+		t.Errorf("record without hash: err = %v, want ErrBackendUnavailable", err)
+	}
+
+	if key, err := a.GetPublicKey(ctx, "alice"); err != nil || string(key) != "alice-pub" {
+		t.Errorf("GetPublicKey(alice) = %q, %v", key, err)
+	}
+	if _, err := a.GetPublicKey(ctx, "bob"); !errors.Is(err, autherrors.ErrKeyNotFound) {
+		t.Errorf("GetPublicKey(bob): err = %v, want ErrKeyNotFound", err)
+	}
+	if ok, err := a.UserExists(ctx, "carol"); ok || err != nil {
+		t.Errorf("UserExists(carol) = %v, %v", ok, err)
+	}
+}
+
+func TestAgent_Cache(t *testing.T) {
+	ctx := context.Background()
+	store := &mapStore{secrets: map[string]map[string]string{"alice": {"password_hash": hash(t, "wonderland")}}}
+	a := New(store, Options{CacheTTL: time.Minute})
+	now := time.Now()
+	a.now = func() time.Time { return now }
+
+	for range 3 {
+		if _, err := a.Authenticate(ctx, "alice", "wonderland"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ok, _ := a.UserExists(ctx, "carol"); ok {
+		t.Fatal("UserExists(carol) = true")
+	}
+	_, _ = a.UserExists(ctx, "carol")
+	if store.reads != 2 {
+		t.Errorf("store reads = %d, want 2 (one per user)", store.reads)
+	}
+
+	// A password changed in the store works before the entry expires.
+	store.set("alice", map[string]string{"password_hash": hash(t, "looking-glass")})
+	if _, err := a.Authenticate(ctx, "alice", "looking-glass"); err != nil {
+		t.Errorf("changed password: %v", err)
+	}
+	if _, err := a.Authenticate(ctx, "alice", "wonderland"); !errors.Is(err, autherrors.ErrAuthFailed) {
+		t.Errorf("old password: err = %v, want ErrAuthFailed", err)
+	}
+
+	// After expiry a failing store is an outage, not a wrong password.
+	now = now.Add(2 * time.Minute)
+	store.err = errors.New("connection refused")
+	if _, err := a.Authenticate(ctx, "alice", "looking-glass"); !errors.Is(err, autherrors.ErrBackendUnavailable) {
+		t.Errorf("store down: err = %v, want ErrBackendUnavailable", err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	_, srv := newFakeVault(t)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("s.good\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	agent, err := auth.OpenAuthAgent(auth.AuthAgentConfig{
+		Type:              "vault",
+		CredentialBackend: srv.URL,
+		Options: map[string]string{
+			"prefix":     "mail",
+			"token_file": tokenFile,
+			"cache_ttl":  "10s",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = agent.Close() }()
+	if ok, err := agent.UserExists(context.Background(), "alice"); !ok || err != nil {
+		t.Errorf("UserExists(alice) = %v, %v", ok, err)
+	}
+	if a := agent.(*Agent); a.ttl != 10*time.Second {
+		t.Errorf("cache TTL = %v", a.ttl)
+	}
+
+	if _, err := auth.OpenAuthAgent(auth.AuthAgentConfig{
+		Type: "vault", CredentialBackend: srv.URL, Options: map[string]string{"kv_version": "two"},
+	}); !errors.Is(err, autherrors.ErrAuthAgentConfigInvalid) {
+		t.Errorf("bad kv_version: err = %v, want ErrAuthAgentConfigInvalid", err)
+	}
+}
@@ -0,0 +1,65 @@
+package vfs
+
+import "sync"
+
+// LockSuffix is appended to a path to name the file Locker implementations
+// keep its lock in. The lock lives beside the file rather than on it, so it
+// still holds when the file is replaced by a rename.
+const LockSuffix = ".lock"
+
+// Locker is implemented by filesystems that can serialize writers of a
+// file across processes.
+type Locker interface {
+	// Lock blocks until the caller holds the exclusive lock on name and
+	// returns the function that releases it.
+	Lock(name string) (unlock func(), err error)
+}
+
+// Lock takes fsys's exclusive lock on name, for a read-modify-write or an
+// append that must not interleave with a rewrite. Filesystems that are not
+// Lockers, such as object stores, get no lock: writers sharing them must
+// be coordinated otherwise, e.g. with package lease.
+func Lock(fsys FS, name string) (unlock func(), err error) {
+	if l, ok := fsys.(Locker); ok {
+		return l.Lock(name)
+	}
+	return func() {}, nil
+}
+
+// keyedMutex is a set of in-process mutexes, one per name.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+// keyedLock is one name's mutex and how many callers want it.
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock blocks until the caller holds name's mutex and returns the function
+// that releases it.
+func (k *keyedMutex) lock(name string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyedLock)
+	}
+	l := k.locks[name]
+	if l == nil {
+		l = &keyedLock{}
+		k.locks[name] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		k.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(k.locks, name)
+		}
+		k.mu.Unlock()
+	}
+}
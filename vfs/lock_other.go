@@ -0,0 +1,17 @@
+//go:build !unix
+
+package vfs
+
+import "path/filepath"
+
+// osLocks serializes OS.Lock callers on platforms without flock.
+var osLocks keyedMutex
+
+// Compile-time check: OS must satisfy Locker.
+var _ Locker = OS{}
+
+// Lock implements Locker on platforms without flock(2). It only excludes
+// other callers in this process.
+func (OS) Lock(name string) (func(), error) {
+	return osLocks.lock(filepath.Clean(name)), nil
+}
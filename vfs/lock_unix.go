@@ -0,0 +1,35 @@
+//go:build unix
+
+package vfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// Compile-time check: OS must satisfy Locker.
+var _ Locker = OS{}
+
+// Lock implements Locker with flock(2) on name+LockSuffix, which it
+// creates if needed. The lock excludes other processes and other callers
+// in this one.
+func (OS) Lock(name string) (func(), error) {
+	f, err := os.OpenFile(name+LockSuffix, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, &os.PathError{Op: "flock", Path: f.Name(), Err: err}
+	}
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		_ = f.Close()
+	}, nil
+}
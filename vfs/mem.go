@@ -0,0 +1,326 @@
+package vfs
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemFS is an in-memory WriteFS for tests. It follows os semantics closely
+// enough for the packages in this module: parent directories must exist,
+// Remove refuses non-empty directories, and Rename replaces files. The root
+// directory and "." always exist. A MemFS is safe for concurrent use.
+type MemFS struct {
+	mu      sync.RWMutex
+	entries map[string]*memEntry
+	locks   keyedMutex // see Lock
+}
+
+// memEntry is a file or, when mode has fs.ModeDir, a directory.
+type memEntry struct {
+	data    []byte
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+// Compile-time check: MemFS must satisfy WriteFS and Locker.
+var (
+	_ WriteFS = (*MemFS)(nil)
+	_ Locker  = (*MemFS)(nil)
+)
+
+// NewMemFS returns an empty MemFS.
+func NewMemFS() *MemFS {
+	return &MemFS{entries: make(map[string]*memEntry)}
+}
+
+// isRoot reports whether the cleaned name always exists as a directory.
+func isRoot(name string) bool {
+	return name == "." || name == string(filepath.Separator)
+}
+
+// lookup returns the entry for the cleaned name. Caller holds m.mu.
+func (m *MemFS) lookup(name string) (*memEntry, bool) {
+	if isRoot(name) {
+		return &memEntry{mode: fs.ModeDir | 0o755}, true
+	}
+	e, ok := m.entries[name]
+	return e, ok
+}
+
+// checkParent returns an error unless name's parent directory exists.
+// Caller holds m.mu.
+func (m *MemFS) checkParent(op, name string) error {
+	parent, ok := m.lookup(filepath.Dir(name))
+	if !ok {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	if !parent.mode.IsDir() {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return nil
+}
+
+// Stat implements FS.
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	name = filepath.Clean(name)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	e, ok := m.lookup(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return memInfo{name: filepath.Base(name), size: int64(len(e.data)), e: *e}, nil
+}
+
+// ReadFile implements FS.
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	name = filepath.Clean(name)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	e, ok := m.lookup(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if e.mode.IsDir() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrInvalid}
+	}
+	return bytes.Clone(e.data), nil
+}
+
+// ReadDir implements FS. Entries are sorted by name.
+func (m *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	name = filepath.Clean(name)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	e, ok := m.lookup(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if !e.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	var out []fs.DirEntry
+	for path, child := range m.entries {
+		if filepath.Dir(path) == name && !isRoot(path) {
+			out = append(out, fs.FileInfoToDirEntry(memInfo{
+				name: filepath.Base(path), size: int64(len(child.data)), e: *child,
+			}))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name() < out[j].Name() })
+	return out, nil
+}
+
+// Open implements FS.
+func (m *MemFS) Open(name string) (fs.File, error) {
+	fi, err := m.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		entries, err := m.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		return &memDir{info: fi, entries: entries}, nil
+	}
+	data, err := m.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return &memFile{info: fi, Reader: bytes.NewReader(data)}, nil
+}
+
+// WriteFile implements WriteFS.
+func (m *MemFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkParent("open", name); err != nil {
+		return err
+	}
+	if e, ok := m.lookup(name); ok {
+		if e.mode.IsDir() {
+			return &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+		}
+		perm = e.mode.Perm() // like os.WriteFile, keep an existing file's mode
+	}
+	m.entries[name] = &memEntry{data: bytes.Clone(data), mode: perm.Perm(), modTime: time.Now()}
+	return nil
+}
+
+// AppendFile implements WriteFS.
+func (m *MemFS) AppendFile(name string, data []byte, perm fs.FileMode) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.lookup(name)
+	if !ok {
+		if err := m.checkParent("open", name); err != nil {
+			return err
+		}
+		e = &memEntry{mode: perm.Perm()}
+		m.entries[name] = e
+	} else if e.mode.IsDir() {
+		return &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	e.data = append(e.data, data...)
+	e.modTime = time.Now()
+	return nil
+}
+
+// MkdirAll implements WriteFS.
+func (m *MemFS) MkdirAll(name string, perm fs.FileMode) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for dir := name; !isRoot(dir); dir = filepath.Dir(dir) {
+		if e, ok := m.entries[dir]; ok {
+			if !e.mode.IsDir() {
+				return &fs.PathError{Op: "mkdir", Path: dir, Err: fs.ErrExist}
+			}
+			break
+		}
+		m.entries[dir] = &memEntry{mode: fs.ModeDir | perm.Perm(), modTime: time.Now()}
+	}
+	return nil
+}
+
+// Rename implements WriteFS. Renaming a directory moves its contents; the
+// target must not be an existing directory.
+func (m *MemFS) Rename(oldname, newname string) error {
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[oldname]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrNotExist}
+	}
+	if err := m.checkParent("rename", newname); err != nil {
+		return err
+	}
+	if target, ok := m.lookup(newname); ok && target.mode.IsDir() {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrExist}
+	}
+	delete(m.entries, oldname)
+	m.entries[newname] = e
+	if e.mode.IsDir() {
+		prefix := oldname + string(filepath.Separator)
+		moved := make(map[string]*memEntry)
+		for path, child := range m.entries {
+			if rest, ok := strings.CutPrefix(path, prefix); ok {
+				delete(m.entries, path)
+				moved[filepath.Join(newname, rest)] = child
+			}
+		}
+		for path, child := range moved {
+			m.entries[path] = child
+		}
+	}
+	return nil
+}
+
+// Remove implements WriteFS.
+func (m *MemFS) Remove(name string) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[name]
+	if !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if e.mode.IsDir() && m.hasChildren(name) {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrExist}
+	}
+	delete(m.entries, name)
+	return nil
+}
+
+// RemoveAll implements WriteFS. A missing name is not an error.
+func (m *MemFS) RemoveAll(name string) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prefix := name + string(filepath.Separator)
+	for path := range m.entries {
+		if path == name || strings.HasPrefix(path, prefix) {
+			delete(m.entries, path)
+		}
+	}
+	return nil
+}
+
+// hasChildren reports whether any entry lives under dir. Caller holds m.mu.
+func (m *MemFS) hasChildren(dir string) bool {
+	prefix := dir + string(filepath.Separator)
+	for path := range m.entries {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// memInfo implements fs.FileInfo for a MemFS entry.
+type memInfo struct {
+	name string
+	size int64
+	e    memEntry
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) Mode() fs.FileMode  { return i.e.mode }
+func (i memInfo) ModTime() time.Time { return i.e.modTime }
+func (i memInfo) IsDir() bool        { return i.e.mode.IsDir() }
+func (i memInfo) Sys() any           { return nil }
+
+// memFile is an open MemFS file: a snapshot of its contents at Open.
+type memFile struct {
+	*bytes.Reader
+	info fs.FileInfo
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memFile) Close() error               { return nil }
+
+// memDir is an open MemFS directory.
+type memDir struct {
+	info    fs.FileInfo
+	entries []fs.DirEntry
+}
+
+func (d *memDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *memDir) Close() error               { return nil }
+
+func (d *memDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: fs.ErrInvalid}
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *memDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		out := d.entries
+		d.entries = nil
+		return out, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	out := d.entries[:n]
+	d.entries = d.entries[n:]
+	return out, nil
+}
+
+// Lock implements Locker with an in-memory mutex per name.
+func (m *MemFS) Lock(name string) (func(), error) {
+	return m.locks.lock(filepath.Clean(name)), nil
+}
@@ -0,0 +1,137 @@
+// Package vfs defines the filesystem interfaces through which the domain
+// provider and the passwd package reach their files, so they can run against
+// the local disk, an in-memory tree in tests, a read-only bundle, or an
+// object store (see package s3fs).
+//
+// Unlike io/fs, names are host paths (absolute or relative, separated by
+// filepath.Separator) exactly as package os takes them, so existing
+// configuration paths work unchanged. Implementations report a missing file
+// with an error satisfying errors.Is(err, fs.ErrNotExist), and a refused
+// mutation with fs.ErrPermission.
+package vfs
+
+import (
+	"io/fs"
+	"os"
+)
+
+// FS is a read-only filesystem.
+type FS interface {
+	Open(name string) (fs.File, error)
+	Stat(name string) (fs.FileInfo, error)
+	ReadFile(name string) ([]byte, error)
+	ReadDir(name string) ([]fs.DirEntry, error)
+}
+
+// WriteFS is an FS that can also be modified.
+type WriteFS interface {
+	FS
+
+	// WriteFile creates or truncates name and writes data to it. The parent
+	// directory must exist.
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+
+	// AppendFile appends data to name, creating it with perm if needed,
+	// and syncs it to stable storage before returning.
+	AppendFile(name string, data []byte, perm fs.FileMode) error
+
+	MkdirAll(name string, perm fs.FileMode) error
+	Rename(oldname, newname string) error
+	Remove(name string) error
+	RemoveAll(name string) error
+}
+
+// OS is the WriteFS backed by the local disk via package os.
+type OS struct{}
+
+// Compile-time check: OS must satisfy WriteFS.
+var _ WriteFS = OS{}
+
+// Open implements FS.
+func (OS) Open(name string) (fs.File, error) { return os.Open(name) }
+
+// Stat implements FS.
+func (OS) Stat(name string) (fs.FileInfo, error) { return os.Stat(name) }
+
+// ReadFile implements FS.
+func (OS) ReadFile(name string) ([]byte, error) { return os.ReadFile(name) }
+
+// ReadDir implements FS.
+func (OS) ReadDir(name string) ([]fs.DirEntry, error) { return os.ReadDir(name) }
+
+// WriteFile implements WriteFS.
+func (OS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+
+// AppendFile implements WriteFS.
+func (OS) AppendFile(name string, data []byte, perm fs.FileMode) error {
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY|os.O_CREATE, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// MkdirAll implements WriteFS.
+func (OS) MkdirAll(name string, perm fs.FileMode) error { return os.MkdirAll(name, perm) }
+
+// Rename implements WriteFS.
+func (OS) Rename(oldname, newname string) error { return os.Rename(oldname, newname) }
+
+// Remove implements WriteFS.
+func (OS) Remove(name string) error { return os.Remove(name) }
+
+// RemoveAll implements WriteFS.
+func (OS) RemoveAll(name string) error { return os.RemoveAll(name) }
+
+// ReadOnly returns a WriteFS that reads through fsys and refuses every
+// mutation with fs.ErrPermission, for serving a read-only bundle.
+func ReadOnly(fsys FS) WriteFS {
+	return readOnlyFS{fsys}
+}
+
+type readOnlyFS struct{ FS }
+
+// Compile-time check: readOnlyFS must satisfy WriteFS.
+var _ WriteFS = readOnlyFS{}
+
+func (readOnlyFS) WriteFile(name string, _ []byte, _ fs.FileMode) error {
+	return refuse("write", name)
+}
+
+func (readOnlyFS) AppendFile(name string, _ []byte, _ fs.FileMode) error {
+	return refuse("append", name)
+}
+
+func (readOnlyFS) MkdirAll(name string, _ fs.FileMode) error { return refuse("mkdir", name) }
+func (readOnlyFS) Rename(oldname, _ string) error            { return refuse("rename", oldname) }
+func (readOnlyFS) Remove(name string) error                  { return refuse("remove", name) }
+func (readOnlyFS) RemoveAll(name string) error               { return refuse("remove", name) }
+
+func refuse(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+}
+
+// WriteFileAtomic replaces name with data by writing name+".tmp" and
+// renaming it into place, so readers never see a partial file.
+func WriteFileAtomic(fsys WriteFS, name string, data []byte, perm fs.FileMode) error {
+	tmp := name + ".tmp"
+	if err := fsys.WriteFile(tmp, data, perm); err != nil {
+		_ = fsys.Remove(tmp)
+		return err
+	}
+	if err := fsys.Rename(tmp, name); err != nil {
+		_ = fsys.Remove(tmp)
+		return err
+	}
+	return nil
+}
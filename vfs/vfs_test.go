@@ -0,0 +1,153 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// exercise runs the same sequence of operations against any WriteFS rooted
+// at dir, so MemFS is checked against the behavior of OS.
+func exercise(t *testing.T, fsys WriteFS, dir string) {
+	t.Helper()
+	sub := filepath.Join(dir, "a", "b")
+	if err := fsys.WriteFile(filepath.Join(sub, "f"), []byte("x"), 0o640); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("WriteFile without parent: got %v, want ErrNotExist", err)
+	}
+	if err := fsys.MkdirAll(sub, 0o750); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	file := filepath.Join(sub, "f")
+	if err := fsys.WriteFile(file, []byte("hello\n"), 0o640); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := fsys.AppendFile(file, []byte("world\n"), 0o640); err != nil {
+		t.Fatalf("AppendFile: %v", err)
+	}
+	if data, err := fsys.ReadFile(file); err != nil || string(data) != "hello\nworld\n" {
+		t.Errorf("ReadFile = %q, %v", data, err)
+	}
+
+	f, err := fsys.Open(file)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	data, err := io.ReadAll(f)
+	_ = f.Close()
+	if err != nil || string(data) != "hello\nworld\n" {
+		t.Errorf("Open+ReadAll = %q, %v", data, err)
+	}
+
+	if err := WriteFileAtomic(fsys, file, []byte("replaced"), 0o640); err != nil {
+		t.Fatalf("WriteFileAtomic: %v", err)
+	}
+	entries, err := fsys.ReadDir(sub)
+	if err != nil || len(entries) != 1 || entries[0].Name() != "f" {
+		t.Errorf("ReadDir after atomic write = %v, %v; want only f", entries, err)
+	}
+
+	if err := fsys.Remove(filepath.Join(dir, "a")); err == nil {
+		t.Error("Remove of a non-empty directory succeeded")
+	}
+	moved := filepath.Join(dir, "c")
+	if err := fsys.Rename(filepath.Join(dir, "a"), moved); err != nil {
+		t.Fatalf("Rename directory: %v", err)
+	}
+	if data, err := fsys.ReadFile(filepath.Join(moved, "b", "f")); err != nil || string(data) != "replaced" {
+		t.Errorf("ReadFile after rename = %q, %v", data, err)
+	}
+	if _, err := fsys.Stat(file); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of old path: got %v, want ErrNotExist", err)
+	}
+	if err := fsys.RemoveAll(moved); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	if _, err := fsys.Stat(filepath.Join(moved, "b")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat after RemoveAll: got %v, want ErrNotExist", err)
+	}
+}
+
+func TestOS(t *testing.T) {
+	exercise(t, OS{}, t.TempDir())
+}
+
+func TestMemFS(t *testing.T) {
+	exercise(t, NewMemFS(), "/srv")
+}
+
+func TestMemFS_StatRoot(t *testing.T) {
+	fi, err := NewMemFS().Stat("/")
+	if err != nil || !fi.IsDir() {
+		t.Errorf("Stat(/) = %v, %v; want a directory", fi, err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "f")
+	if err := os.WriteFile(path, []byte("data"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	ro := ReadOnly(OS{})
+	if data, err := ro.ReadFile(path); err != nil || string(data) != "data" {
+		t.Errorf("ReadFile = %q, %v", data, err)
+	}
+	for name, err := range map[string]error{
+		"WriteFile":  ro.WriteFile(path, nil, 0o640),
+		"AppendFile": ro.AppendFile(path, nil, 0o640),
+		"MkdirAll":   ro.MkdirAll(filepath.Join(dir, "d"), 0o750),
+		"Rename":     ro.Rename(path, path+".new"),
+		"Remove":     ro.Remove(path),
+		"RemoveAll":  ro.RemoveAll(dir),
+	} {
+		if !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("%s: got %v, want ErrPermission", name, err)
+		}
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("file was modified through ReadOnly: %v", err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	dir := t.TempDir()
+	for name, fsys := range map[string]FS{"os": OS{}, "mem": NewMemFS(), "readonly": ReadOnly(OS{})} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			unlock, err := Lock(fsys, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := fsys.(Locker); !ok {
+				// Not a Locker: nothing to wait for.
+				unlock()
+				return
+			}
+			got := make(chan struct{})
+			go func() {
+				unlock, err := Lock(fsys, path)
+				if err != nil {
+					t.Error(err)
+				} else {
+					unlock()
+				}
+				close(got)
+			}()
+			select {
+			case <-got:
+				t.Fatal("second Lock did not wait for the first")
+			case <-time.After(50 * time.Millisecond):
+			}
+			unlock()
+			select {
+			case <-got:
+			case <-time.After(5 * time.Second):
+				t.Fatal("second Lock not granted after unlock")
+			}
+		})
+	}
+}
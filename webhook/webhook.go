@@ -0,0 +1,264 @@
+// Package webhook delivers provisioning webhooks: an HTTP POST to each
+// configured endpoint whenever a domain or user is created, deleted,
+// renamed, disabled or enabled (for a domain, frozen or thawed), so
+// external systems such as DNS automation and billing stay in sync with
+// the domains tree.
+//
+// Changes are taken from a domain.EventSource, normally the
+// FilesystemDomainProvider, which notices them by polling the domains tree.
+// Every code path that changes the tree is therefore covered, whether
+// userctl, a directory sync (see package dirsync) or an edit by hand:
+//
+//	cfg, err := webhook.LoadConfig("/etc/infodancer/webhooks.toml")
+//	d, err := webhook.New(cfg, nil, logger)
+//	go d.Run(ctx, provider)
+//
+// A configuration file lists the endpoints:
+//
+//	[[hook]]
+//	url    = "https://dns.example.net/hooks/mail"
+//	secret = "..."
+//	events = ["domain.created", "domain.deleted", "domain.renamed"]
+//
+// Each request carries a JSON Payload. When a secret is set, the
+// X-Infodancer-Signature header is "sha256=" followed by the hex
+// HMAC-SHA256 of the body under the secret.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+
+	"github.com/infodancer/auth/domain"
+)
+
+// SignatureHeader is the request header carrying the body's HMAC.
+const SignatureHeader = "X-Infodancer-Signature"
+
+// Defaults for Config fields left zero.
+const (
+	DefaultTimeout  = 10 * time.Second
+	DefaultAttempts = 3
+)
+
+// Hook is one webhook endpoint.
+type Hook struct {
+	// URL is the http or https endpoint requests are posted to.
+	URL string `toml:"url"`
+
+	// Secret, when set, signs each request (see SignatureHeader).
+	Secret string `toml:"secret,omitempty"`
+
+	// Events limits the hook to the listed Payload.Event names, such as
+	// "user.disabled". Empty means every event.
+	Events []string `toml:"events,omitempty"`
+}
+
+// Config is a set of webhook endpoints.
+type Config struct {
+	Hooks []Hook `toml:"hook"`
+
+	// TimeoutSec bounds each request, in seconds. Zero means
+	// DefaultTimeout.
+	TimeoutSec int64 `toml:"timeout_sec,omitempty"`
+
+	// Attempts is how often a failed delivery is tried, with doubling
+	// delays from one second. Zero means DefaultAttempts.
+	Attempts int `toml:"attempts,omitempty"`
+}
+
+// LoadConfig reads a webhook configuration file. A missing file is an
+// empty Config.
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return cfg, fmt.Errorf("read webhook config: %w", err)
+	}
+	if err := toml.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("parse webhook config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Payload is the JSON body of a webhook request.
+type Payload struct {
+	// Event is "domain." or "user." followed by the domain.Change, for
+	// example "domain.created" or "user.renamed".
+	Event string `json:"event"`
+
+	// Domain is the domain, after the change for a renamed domain.
+	Domain string `json:"domain"`
+
+	// User is the localpart of a user event, after the change for a
+	// renamed user. It is empty when the domain's credential backend is
+	// not a passwd file and only the backend as a whole is known to have
+	// changed.
+	User string `json:"user,omitempty"`
+
+	// Previous is the old name of a renamed domain or user.
+	Previous string `json:"previous,omitempty"`
+
+	// Time is when the change was noticed.
+	Time time.Time `json:"time"`
+}
+
+// PayloadFor returns the payload reporting ev. Events without a change,
+// from sources that do not classify changes, are reported as modified.
+func PayloadFor(ev domain.Event) Payload {
+	change := ev.Change
+	if change == "" {
+		change = domain.ChangeModified
+	}
+	kind := "domain"
+	if ev.Type == domain.EventUserChanged {
+		kind = "user"
+	}
+	return Payload{
+		Event:    kind + "." + string(change),
+		Domain:   ev.Domain,
+		User:     ev.User,
+		Previous: ev.Previous,
+		Time:     ev.Time.UTC(),
+	}
+}
+
+// Dispatcher posts payloads to the configured hooks.
+type Dispatcher struct {
+	hooks    []Hook
+	client   *http.Client
+	attempts int
+	backoff  time.Duration
+	logger   *slog.Logger
+}
+
+// New returns a Dispatcher for cfg. client nil means a client with
+// cfg.TimeoutSec; logger nil means slog.Default(). It fails if a hook URL is
+// not an absolute http or https URL.
+func New(cfg Config, client *http.Client, logger *slog.Logger) (*Dispatcher, error) {
+	for _, h := range cfg.Hooks {
+		u, err := url.Parse(h.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("webhook url %q: must be an absolute http or https URL", h.URL)
+		}
+	}
+	if client == nil {
+		timeout := time.Duration(cfg.TimeoutSec) * time.Second
+		if timeout <= 0 {
+			timeout = DefaultTimeout
+		}
+		client = &http.Client{Timeout: timeout}
+	}
+	attempts := cfg.Attempts
+	if attempts <= 0 {
+		attempts = DefaultAttempts
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &Dispatcher{hooks: cfg.Hooks, client: client, attempts: attempts, backoff: time.Second, logger: logger}, nil
+}
+
+// Send posts p to every hook that wants it, retrying failed deliveries,
+// and returns the errors of the hooks it could not reach. A hook answering
+// with a 4xx status other than 429 is not retried.
+func (d *Dispatcher) Send(ctx context.Context, p Payload) error {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, h := range d.hooks {
+		if len(h.Events) > 0 && !slices.Contains(h.Events, p.Event) {
+			continue
+		}
+		if err := d.deliver(ctx, h, body); err != nil {
+			errs = append(errs, fmt.Errorf("webhook %s: %w", h.URL, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deliver posts body to h, up to d.attempts times.
+func (d *Dispatcher) deliver(ctx context.Context, h Hook, body []byte) error {
+	delay := d.backoff
+	var err error
+	for attempt := range d.attempts {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+		var retry bool
+		if retry, err = d.post(ctx, h, body); err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+// post makes one delivery attempt, reporting whether a failure is worth
+// retrying.
+func (d *Dispatcher) post(ctx context.Context, h Hook, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(h.Secret))
+		mac.Write(body)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("status %d", resp.StatusCode)
+}
+
+// Run subscribes to src and sends a payload for each event until ctx is
+// done or the subscription ends. Delivery failures are logged.
+func (d *Dispatcher) Run(ctx context.Context, src domain.EventSource) {
+	for ev := range src.Subscribe(ctx) {
+		p := PayloadFor(ev)
+		if err := d.Send(ctx, p); err != nil && ctx.Err() == nil {
+			d.logger.Warn("webhook delivery failed",
+				slog.String("event", p.Event),
+				slog.String("domain", p.Domain),
+				slog.String("error", err.Error()))
+		} else if err == nil {
+			d.logger.Debug("webhook delivered",
+				slog.String("event", p.Event),
+				slog.String("domain", p.Domain),
+				slog.String("user", p.User))
+		}
+	}
+}
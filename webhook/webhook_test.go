@@ -0,0 +1,121 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/infodancer/auth/domain"
+)
+
+func TestPayloadFor(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		ev   domain.Event
+		want string
+	}{
+		{domain.Event{Type: domain.EventDomainAdded, Change: domain.ChangeCreated}, "domain.created"},
+		{domain.Event{Type: domain.EventDomainAdded, Change: domain.ChangeRenamed, Previous: "old.com"}, "domain.renamed"},
+		{domain.Event{Type: domain.EventDomainReloaded}, "domain.modified"},
+		{domain.Event{Type: domain.EventUserChanged, Change: domain.ChangeDisabled}, "user.disabled"},
+	} {
+		tc.ev.Domain, tc.ev.Time = "example.com", now
+		p := PayloadFor(tc.ev)
+		if p.Event != tc.want || p.Domain != "example.com" || p.Previous != tc.ev.Previous || !p.Time.Equal(now) {
+			t.Errorf("PayloadFor(%+v) = %+v, want event %s", tc.ev, p, tc.want)
+		}
+	}
+}
+
+func TestDispatcher_Send(t *testing.T) {
+	var mu sync.Mutex
+	var got []Payload
+	failures := 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write(body)
+		if r.Header.Get(SignatureHeader) != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var p Payload
+		if err := json.Unmarshal(body, &p); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		got = append(got, p)
+	}))
+	defer srv.Close()
+
+	d, err := New(Config{Hooks: []Hook{
+		{URL: srv.URL, Secret: "s3cret", Events: []string{"user.disabled"}},
+		{URL: srv.URL + "/unsigned", Events: []string{"domain.deleted"}},
+	}}, srv.Client(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.backoff = time.Millisecond
+	ctx := context.Background()
+
+	// The first attempt gets a 503 and is retried.
+	if err := d.Send(ctx, Payload{Event: "user.disabled", Domain: "example.com", User: "alice"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if err := d.Send(ctx, Payload{Event: "user.created", Domain: "example.com", User: "bob"}); err != nil {
+		t.Fatalf("Send unwanted event: %v", err)
+	}
+	mu.Lock()
+	if len(got) != 1 || got[0].User != "alice" {
+		t.Errorf("delivered = %+v, want alice's user.disabled only", got)
+	}
+	mu.Unlock()
+
+	// A 401 for the unsigned hook is not retried.
+	if err := d.Send(ctx, Payload{Event: "domain.deleted", Domain: "example.com"}); err == nil {
+		t.Error("rejected delivery reported no error")
+	}
+}
+
+func TestNew_InvalidURL(t *testing.T) {
+	for _, u := range []string{"", "ftp://example.com/", "/relative", "https://"} {
+		if _, err := New(Config{Hooks: []Hook{{URL: u}}}, nil, nil); err == nil {
+			t.Errorf("URL %q accepted", u)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks.toml")
+	if cfg, err := LoadConfig(path); err != nil || len(cfg.Hooks) != 0 {
+		t.Errorf("missing file = %+v, %v", cfg, err)
+	}
+	content := "timeout_sec = 5\n\n[[hook]]\nurl = \"https://billing.example.net/hook\"\nevents = [\"user.created\", \"user.deleted\"]\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TimeoutSec != 5 || len(cfg.Hooks) != 1 || len(cfg.Hooks[0].Events) != 2 {
+		t.Errorf("config = %+v", cfg)
+	}
+}
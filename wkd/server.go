@@ -0,0 +1,129 @@
+package wkd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/infodancer/auth/vfs"
+)
+
+// wellKnown is the path prefix of every WKD request.
+const wellKnown = "/.well-known/openpgpkey/"
+
+// KeyFunc returns the binary OpenPGP key domain publishes for the WKD hash
+// of a localpart (see Hash), or ErrNotFound if it publishes none.
+type KeyFunc func(ctx context.Context, domain, hash string) ([]byte, error)
+
+// Handler serves a Web Key Directory for the domains keys knows about, by
+// both methods:
+//
+//	/.well-known/openpgpkey/<domain>/hu/<hash>  advanced, on openpgpkey.<domain>
+//	/.well-known/openpgpkey/hu/<hash>           direct, on <domain> itself
+//
+// along with the policy file each method requires. The domain of a direct
+// request is the request's host. Mount it at /.well-known/openpgpkey/.
+type Handler struct {
+	keys KeyFunc
+}
+
+// NewHandler returns a Handler looking keys up with keys.
+func NewHandler(keys KeyFunc) *Handler {
+	return &Handler{keys: keys}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rest, ok := strings.CutPrefix(r.URL.Path, wellKnown)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	parts := strings.Split(rest, "/")
+	if parts[0] == "hu" || parts[0] == "policy" {
+		// Direct method: the domain is the host's.
+		host := r.Host
+		if name, _, err := net.SplitHostPort(host); err == nil {
+			host = name
+		}
+		parts = append([]string{host}, parts...)
+	}
+	domain := strings.ToLower(parts[0])
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	switch {
+	case len(parts) == 2 && parts[1] == "policy":
+		// An empty policy announces the directory; it is required
+		// before clients trust the advanced method.
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+	case len(parts) == 3 && parts[1] == "hu" && len(parts[2]) == 32:
+		key, err := h.keys(r.Context(), domain, parts[2])
+		switch {
+		case errors.Is(err, ErrNotFound):
+			http.NotFound(w, r)
+		case err != nil:
+			http.Error(w, "key lookup failed", http.StatusServiceUnavailable)
+		default:
+			w.Header().Set("Content-Type", "application/octet-stream")
+			_, _ = w.Write(key)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Export writes keys, binary OpenPGP keys by WKD hash, into dir in the
+// advanced method's layout, ready to be served as /.well-known/ on
+// openpgpkey.<domain>:
+//
+//	dir/openpgpkey/<domain>/policy
+//	dir/openpgpkey/<domain>/hu/<hash>
+//
+// Keys under hu that are not in keys are removed, so that keys users no
+// longer publish are withdrawn.
+func Export(dir, domain string, keys map[string][]byte) error {
+	domain = strings.ToLower(domain)
+	if domain == "" || strings.ContainsAny(domain, `/\`) || domain == "." || domain == ".." {
+		return fmt.Errorf("wkd: invalid domain %q", domain)
+	}
+	base := filepath.Join(dir, "openpgpkey", domain)
+	hu := filepath.Join(base, "hu")
+	if err := os.MkdirAll(hu, 0o755); err != nil {
+		return fmt.Errorf("wkd: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(base, "policy"), nil, 0o644); err != nil {
+		return fmt.Errorf("wkd: %w", err)
+	}
+	for hash, key := range keys {
+		if len(hash) != 32 || strings.ContainsAny(hash, `/\.`) {
+			return fmt.Errorf("wkd: invalid hash %q", hash)
+		}
+		// Written atomically, so that a web server never serves a
+		// partial key.
+		if err := vfs.WriteFileAtomic(vfs.OS{}, filepath.Join(hu, hash), key, 0o644); err != nil {
+			return fmt.Errorf("wkd: %w", err)
+		}
+	}
+	entries, err := os.ReadDir(hu)
+	if err != nil {
+		return fmt.Errorf("wkd: %w", err)
+	}
+	for _, e := range entries {
+		if _, ok := keys[e.Name()]; !ok && !e.IsDir() {
+			if err := os.Remove(filepath.Join(hu, e.Name())); err != nil {
+				return fmt.Errorf("wkd: %w", err)
+			}
+		}
+	}
+	return nil
+}
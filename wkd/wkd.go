@@ -0,0 +1,105 @@
+// Package wkd implements the client side of the OpenPGP Web Key Directory
+// (draft-koch-openpgp-webkey-service): finding a mail address's public key
+// over HTTPS at a well-known location on the address's domain.
+//
+// A key is looked up first by the advanced method, on the openpgpkey
+// subdomain, and then by the direct method, on the domain itself:
+//
+//	https://openpgpkey.example.com/.well-known/openpgpkey/example.com/hu/<hash>?l=alice
+//	https://example.com/.well-known/openpgpkey/hu/<hash>?l=alice
+//
+// where <hash> is Hash of the localpart.
+package wkd
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// MaxKeySize bounds the key a lookup will read; real keys are a few KiB.
+const MaxKeySize = 64 << 10
+
+// ErrNotFound is returned by Lookup when neither method finds a key.
+var ErrNotFound = errors.New("wkd: no key published")
+
+// zbase32 is the z-base-32 encoding WKD uses for hashed localparts.
+var zbase32 = base32.NewEncoding("ybndrfg8ejkmcpqxot1uwisza345h769").WithPadding(base32.NoPadding)
+
+// Hash returns the WKD hash of localpart: the z-base-32 encoded SHA-1 of
+// the lower-cased localpart, always 32 characters.
+func Hash(localpart string) string {
+	sum := sha1.Sum([]byte(strings.ToLower(localpart)))
+	return zbase32.EncodeToString(sum[:])
+}
+
+// URLs returns the advanced and direct method URLs for address, in the
+// order they are tried. It fails if address is not localpart@domain.
+func URLs(address string) (advanced, direct string, err error) {
+	local, domain, ok := strings.Cut(address, "@")
+	if !ok || local == "" || domain == "" || strings.ContainsAny(domain, "/?#@") {
+		return "", "", fmt.Errorf("wkd: %q is not a mail address", address)
+	}
+	domain = strings.ToLower(domain)
+	hash := Hash(local)
+	query := "?l=" + url.QueryEscape(local)
+	advanced = "https://openpgpkey." + domain + "/.well-known/openpgpkey/" + domain + "/hu/" + hash + query
+	direct = "https://" + domain + "/.well-known/openpgpkey/hu/" + hash + query
+	return advanced, direct, nil
+}
+
+// Lookup fetches the binary OpenPGP key published for address, trying the
+// advanced method and then, if that fails for any reason, the direct one.
+// client nil means http.DefaultClient. The result is the direct method's:
+// ErrNotFound when it answers without a key, another error when it fails.
+func Lookup(ctx context.Context, client *http.Client, address string) ([]byte, error) {
+	advanced, direct, err := URLs(address)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if key, err := fetch(ctx, client, advanced); err == nil {
+		return key, nil
+	} else if ctx.Err() != nil {
+		return nil, err
+	}
+	return fetch(ctx, client, direct)
+}
+
+// fetch GETs one WKD URL. A 404 is ErrNotFound.
+func fetch(ctx context.Context, client *http.Client, u string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("wkd: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, ErrNotFound
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("wkd: %s: %s", u, resp.Status)
+	}
+	key, err := io.ReadAll(io.LimitReader(resp.Body, MaxKeySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("wkd: read key: %w", err)
+	}
+	switch {
+	case len(key) == 0:
+		return nil, ErrNotFound
+	case len(key) > MaxKeySize:
+		return nil, fmt.Errorf("wkd: %s: key exceeds %d bytes", u, MaxKeySize)
+	}
+	return key, nil
+}
@@ -0,0 +1,126 @@
+package wkd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHash(t *testing.T) {
+	// Example from draft-koch-openpgp-webkey-service.
+	if got := Hash("Joe.Doe"); got != "iy9q119eutrkn8s1mk4r39qejnbu3n5q" {
+		t.Errorf("Hash = %q", got)
+	}
+}
+
+func TestURLs(t *testing.T) {
+	advanced, direct, err := URLs("Joe.Doe@Example.ORG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://openpgpkey.example.org/.well-known/openpgpkey/example.org/hu/iy9q119eutrkn8s1mk4r39qejnbu3n5q?l=Joe.Doe"; advanced != want {
+		t.Errorf("advanced = %q", advanced)
+	}
+	if want := "https://example.org/.well-known/openpgpkey/hu/iy9q119eutrkn8s1mk4r39qejnbu3n5q?l=Joe.Doe"; direct != want {
+		t.Errorf("direct = %q", direct)
+	}
+	for _, bad := range []string{"alice", "@example.org", "alice@", "alice@evil.com/x"} {
+		if _, _, err := URLs(bad); err == nil {
+			t.Errorf("URLs(%q) accepted", bad)
+		}
+	}
+}
+
+// testClient returns a client that sends every request to srv, whatever
+// the host. srv's certificate is only valid for example.com, so the
+// advanced method's openpgpkey subdomain fails verification.
+func testClient(srv *httptest.Server) *http.Client {
+	client := srv.Client()
+	transport := client.Transport.(*http.Transport)
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+	}
+	return client
+}
+
+func TestLookup(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/openpgpkey/hu/"+Hash("alice") {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("key bytes"))
+	}))
+	defer srv.Close()
+	client := testClient(srv)
+
+	key, err := Lookup(context.Background(), client, "alice@example.com")
+	if err != nil || string(key) != "key bytes" {
+		t.Errorf("Lookup(alice) = %q, %v", key, err)
+	}
+	if _, err := Lookup(context.Background(), client, "bob@example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Lookup(bob) err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestLookup_Oversized(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(strings.Repeat("k", MaxKeySize+1)))
+	}))
+	defer srv.Close()
+	if _, err := Lookup(context.Background(), testClient(srv), "alice@example.com"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("oversized key: err = %v", err)
+	}
+}
+
+func TestExport(t *testing.T) {
+	dir := t.TempDir()
+	alice, bob := Hash("alice"), Hash("bob")
+	if err := Export(dir, "Example.ORG", map[string][]byte{alice: []byte("alice key"), bob: []byte("bob key")}); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	hu := filepath.Join(dir, "openpgpkey", "example.org", "hu")
+	if data, err := os.ReadFile(filepath.Join(hu, alice)); err != nil || string(data) != "alice key" {
+		t.Errorf("alice's key = %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "openpgpkey", "example.org", "policy")); err != nil {
+		t.Errorf("policy: %v", err)
+	}
+
+	// A key no longer published is withdrawn.
+	if err := Export(dir, "example.org", map[string][]byte{alice: []byte("alice key")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(hu, bob)); !os.IsNotExist(err) {
+		t.Errorf("bob's key kept: %v", err)
+	}
+
+	if err := Export(dir, "../x", nil); err == nil {
+		t.Error("Export accepted a domain with a slash")
+	}
+	if err := Export(dir, "example.org", map[string][]byte{"../../escape": nil}); err == nil {
+		t.Error("Export accepted an invalid hash")
+	}
+}
+
+func TestHandler_LookupError(t *testing.T) {
+	h := NewHandler(func(context.Context, string, string) ([]byte, error) { return nil, errors.New("down") })
+	req := httptest.NewRequest(http.MethodGet, "https://example.org/.well-known/openpgpkey/hu/"+Hash("alice"), nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", rec.Code)
+	}
+	req = httptest.NewRequest(http.MethodPost, "https://example.org/.well-known/openpgpkey/policy", nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want 405", rec.Code)
+	}
+}